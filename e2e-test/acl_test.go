@@ -0,0 +1,189 @@
+package tests
+
+import (
+	"context"
+
+	"github.com/marsevilspirit/nimbis/e2e-test/util"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/redis/go-redis/v9"
+)
+
+var _ = Describe("ACL Commands", func() {
+	var rdb *redis.Client
+	var ctx context.Context
+
+	BeforeEach(func() {
+		rdb = util.NewClient()
+		ctx = context.Background()
+		Expect(rdb.Ping(ctx).Err()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(rdb.Do(ctx, "ACL", "DELUSER", "alice", "bob").Err()).To(Succeed())
+		Expect(rdb.Do(ctx, "ACL", "SETUSER", "default",
+			"reset", "on", "nopass", "~*", "&*", "+@all").Err()).To(Succeed())
+		Expect(rdb.Close()).To(Succeed())
+	})
+
+	// login returns a single connection logged in as user.
+	login := func(user, password string) *redis.Conn {
+		conn := util.NewClient().Conn()
+		Expect(conn.Do(ctx, "AUTH", user, password).Err()).To(Succeed())
+		return conn
+	}
+
+	It("should start every connection as the default user", func() {
+		Expect(rdb.Do(ctx, "ACL", "WHOAMI").Text()).To(Equal("default"))
+		Expect(rdb.Do(ctx, "ACL", "USERS").StringSlice()).To(ContainElement("default"))
+		Expect(rdb.Do(ctx, "ACL", "LIST").StringSlice()).To(ContainElement(
+			"user default on nopass ~* resetchannels &* +@all"))
+	})
+
+	It("should authenticate users by password", func() {
+		Expect(rdb.Do(ctx, "ACL", "SETUSER", "alice", "on", ">secret", "+@all", "~*").Err()).To(Succeed())
+
+		conn := util.NewClient().Conn()
+		defer conn.Close()
+		err := conn.Do(ctx, "AUTH", "alice", "wrong").Err()
+		Expect(err).To(MatchError(ContainSubstring("WRONGPASS")))
+		Expect(conn.Do(ctx, "AUTH", "alice", "secret").Err()).To(Succeed())
+		Expect(conn.Do(ctx, "ACL", "WHOAMI").Text()).To(Equal("alice"))
+
+		Expect(rdb.Do(ctx, "ACL", "SETUSER", "alice", "off").Err()).To(Succeed())
+		err = conn.Do(ctx, "AUTH", "alice", "secret").Err()
+		Expect(err).To(MatchError(ContainSubstring("WRONGPASS")))
+	})
+
+	It("should enforce command, key and channel rules", func() {
+		Expect(rdb.Do(ctx, "ACL", "SETUSER", "alice", "on", ">secret", "~app:*", "&news.*",
+			"+@read", "+@write", "+@pubsub", "-@dangerous", "+ping").Err()).To(Succeed())
+		conn := login("alice", "secret")
+		defer conn.Close()
+
+		Expect(conn.Set(ctx, "app:1", "v", 0).Err()).To(Succeed())
+		Expect(conn.Get(ctx, "app:1").Val()).To(Equal("v"))
+		Expect(conn.Get(ctx, "other").Err()).To(MatchError("NOPERM No permissions to access a key"))
+		Expect(conn.Del(ctx, "app:1", "other").Err()).To(MatchError(ContainSubstring("NOPERM")))
+		Expect(conn.Do(ctx, "FLUSHDB").Err()).To(MatchError(
+			"NOPERM User alice has no permissions to run the 'flushdb' command"))
+		Expect(conn.Do(ctx, "CONFIG", "GET", "port").Err()).To(MatchError(ContainSubstring("NOPERM")))
+
+		Expect(conn.Publish(ctx, "news.today", "hi").Err()).To(Succeed())
+		Expect(conn.Publish(ctx, "other", "hi").Err()).To(MatchError(
+			"NOPERM No permissions to access a channel"))
+
+		Expect(rdb.Del(ctx, "app:1").Err()).To(Succeed())
+	})
+
+	It("should abort a transaction queueing a denied command", func() {
+		Expect(rdb.Do(ctx, "ACL", "SETUSER", "alice", "on", ">secret", "~*", "+@all", "-flushdb").Err()).To(Succeed())
+		conn := login("alice", "secret")
+		defer conn.Close()
+
+		Expect(conn.Do(ctx, "MULTI").Err()).To(Succeed())
+		Expect(conn.Do(ctx, "FLUSHDB").Err()).To(MatchError(ContainSubstring("NOPERM")))
+		Expect(conn.Do(ctx, "EXEC").Err()).To(MatchError(ContainSubstring("EXECABORT")))
+	})
+
+	It("should describe users with GETUSER", func() {
+		Expect(rdb.Do(ctx, "ACL", "SETUSER", "alice", "on", "nopass", "~app:*", "+@all", "-@dangerous").Err()).To(Succeed())
+
+		result, err := rdb.Do(ctx, "ACL", "GETUSER", "alice").Result()
+		Expect(err).NotTo(HaveOccurred())
+		user := normalizeHelloMap(result)
+		Expect(user["flags"]).To(ConsistOf("on", "nopass"))
+		Expect(user["commands"]).To(Equal("+@all -@dangerous"))
+		Expect(user["keys"]).To(Equal("~app:*"))
+		Expect(user["channels"]).To(Equal(""))
+
+		Expect(rdb.Do(ctx, "ACL", "GETUSER", "nobody").Err()).To(Equal(redis.Nil))
+	})
+
+	It("should reject invalid rules without changing the user", func() {
+		err := rdb.Do(ctx, "ACL", "SETUSER", "alice", "on", "+nosuchcmd").Err()
+		Expect(err).To(MatchError(
+			"ERR Error in ACL SETUSER modifier '+nosuchcmd': Unknown command or category name in ACL"))
+		Expect(rdb.Do(ctx, "ACL", "USERS").StringSlice()).NotTo(ContainElement("alice"))
+	})
+
+	It("should log out connections of deleted users", func() {
+		Expect(rdb.Do(ctx, "ACL", "SETUSER", "bob", "on", ">pw", "~*", "+@all").Err()).To(Succeed())
+		conn := login("bob", "pw")
+		defer conn.Close()
+
+		Expect(rdb.Do(ctx, "ACL", "DELUSER", "bob").Int()).To(Equal(1))
+		Expect(conn.Ping(ctx).Err()).To(MatchError("NOAUTH Authentication required."))
+
+		err := rdb.Do(ctx, "ACL", "DELUSER", "default").Err()
+		Expect(err).To(MatchError(ContainSubstring("cannot be removed")))
+	})
+
+	It("should require AUTH once the default user has a password", func() {
+		admin := rdb.Conn()
+		defer admin.Close()
+		Expect(admin.Do(ctx, "ACL", "SETUSER", "default", ">pw").Err()).To(Succeed())
+		defer func() {
+			Expect(admin.Do(ctx, "ACL", "SETUSER", "default", "nopass").Err()).To(Succeed())
+		}()
+
+		conn := util.NewClient().Conn()
+		defer conn.Close()
+		Expect(conn.Ping(ctx).Err()).To(MatchError("NOAUTH Authentication required."))
+		Expect(conn.Do(ctx, "HELLO", "3").Err()).To(MatchError(ContainSubstring("NOAUTH")))
+		Expect(conn.Do(ctx, "HELLO", "3", "AUTH", "default", "pw").Err()).To(Succeed())
+		Expect(conn.Ping(ctx).Err()).To(Succeed())
+
+		Expect(conn.Do(ctx, "RESET").Err()).To(Succeed())
+		Expect(conn.Ping(ctx).Err()).To(MatchError("NOAUTH Authentication required."))
+		Expect(conn.Do(ctx, "AUTH", "pw").Err()).To(Succeed())
+		Expect(conn.Ping(ctx).Err()).To(Succeed())
+	})
+
+	It("should record denials in the ACL log", func() {
+		Expect(rdb.Do(ctx, "ACL", "LOG", "RESET").Err()).To(Succeed())
+		Expect(rdb.Do(ctx, "ACL", "SETUSER", "alice", "on", ">secret", "~app:*", "+@all", "-flushdb").Err()).To(Succeed())
+
+		conn := util.NewClient().Conn()
+		defer conn.Close()
+		Expect(conn.Do(ctx, "AUTH", "alice", "wrong").Err()).To(HaveOccurred())
+		Expect(conn.Do(ctx, "AUTH", "alice", "secret").Err()).To(Succeed())
+		Expect(conn.Do(ctx, "FLUSHDB").Err()).To(HaveOccurred())
+		Expect(conn.Do(ctx, "FLUSHDB").Err()).To(HaveOccurred())
+		Expect(conn.Get(ctx, "other").Err()).To(HaveOccurred())
+
+		result, err := rdb.Do(ctx, "ACL", "LOG").Slice()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(HaveLen(3))
+		entries := make([]map[string]interface{}, len(result))
+		for i, entry := range result {
+			entries[i] = normalizeHelloMap(entry)
+		}
+
+		Expect(entries[0]["reason"]).To(Equal("key"))
+		Expect(entries[0]["object"]).To(Equal("other"))
+		Expect(entries[1]["reason"]).To(Equal("command"))
+		Expect(entries[1]["object"]).To(Equal("flushdb"))
+		Expect(entries[1]["context"]).To(Equal("toplevel"))
+		Expect(entries[1]["count"]).To(BeEquivalentTo(2))
+		Expect(entries[1]["username"]).To(Equal("alice"))
+		Expect(entries[1]["client-info"]).To(ContainSubstring("user=alice"))
+		Expect(entries[2]["reason"]).To(Equal("auth"))
+		Expect(entries[2]["object"]).To(Equal("AUTH"))
+
+		Expect(rdb.Do(ctx, "ACL", "LOG", "1").Slice()).To(HaveLen(1))
+		Expect(rdb.Do(ctx, "ACL", "LOG", "RESET").Err()).To(Succeed())
+		Expect(rdb.Do(ctx, "ACL", "LOG").Slice()).To(BeEmpty())
+	})
+
+	It("should list categories and their commands", func() {
+		Expect(rdb.Do(ctx, "ACL", "CAT").StringSlice()).To(ContainElements("read", "write", "string", "dangerous"))
+		Expect(rdb.Do(ctx, "ACL", "CAT", "string").StringSlice()).To(ContainElements("get", "set"))
+		Expect(rdb.Do(ctx, "ACL", "CAT", "nosuch").Err()).To(MatchError("ERR Unknown category 'nosuch'"))
+	})
+
+	It("should refuse LOAD and SAVE without an aclfile", func() {
+		Expect(rdb.Do(ctx, "ACL", "LOAD").Err()).To(MatchError(ContainSubstring("not configured to use an ACL file")))
+		Expect(rdb.Do(ctx, "ACL", "SAVE").Err()).To(MatchError(ContainSubstring("not configured to use an ACL file")))
+	})
+})
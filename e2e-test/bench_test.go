@@ -0,0 +1,286 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/marsevilspirit/nimbis/e2e-test/util"
+	"github.com/redis/go-redis/v9"
+)
+
+// BenchmarkIncr compares concurrent INCR on one key, which serializes on
+// that key's lock, with INCR on a key per client, which should scale with
+// the server's cores. It starts a server of its own, so run it without the
+// specs:
+//
+//	go test -run '^$' -bench Incr
+func BenchmarkIncr(b *testing.B) {
+	if err := util.StartServer(); err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(util.StopServer)
+
+	ctx := context.Background()
+	rdb := redis.NewClient(&redis.Options{Addr: util.Addr(), PoolSize: 256})
+	b.Cleanup(func() { _ = rdb.Close() })
+
+	incr := func(b *testing.B, key func() string) {
+		b.SetParallelism(16)
+		b.RunParallel(func(pb *testing.PB) {
+			key := key()
+			for pb.Next() {
+				if err := rdb.Incr(ctx, key).Err(); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	}
+
+	b.Run("same_key", func(b *testing.B) {
+		incr(b, func() string { return "bench:incr" })
+	})
+	b.Run("distinct_keys", func(b *testing.B) {
+		var next atomic.Int64
+		incr(b, func() string { return fmt.Sprintf("bench:incr:%d", next.Add(1)) })
+	})
+}
+
+// workload is a GET/SET load on a key space of string values, set with
+// environment variables so runs can be compared release to release:
+//
+//	BENCH_CLIENTS     connections sending commands at once (default 50)
+//	BENCH_PIPELINE    commands each connection sends per round trip (default 1)
+//	BENCH_VALUE_SIZE  bytes in each value written (default 128)
+//	BENCH_KEYS        keys the commands pick from at random (default 10000)
+//	BENCH_READ_RATIO  share of GETs in the mixed workload (default 0.9)
+type workload struct {
+	clients   int
+	pipeline  int
+	valueSize int
+	keys      int
+	readRatio float64
+}
+
+func workloadFromEnv(b *testing.B) workload {
+	w := workload{clients: 50, pipeline: 1, valueSize: 128, keys: 10000, readRatio: 0.9}
+	for name, value := range map[string]*int{
+		"BENCH_CLIENTS":    &w.clients,
+		"BENCH_PIPELINE":   &w.pipeline,
+		"BENCH_VALUE_SIZE": &w.valueSize,
+		"BENCH_KEYS":       &w.keys,
+	} {
+		raw := os.Getenv(name)
+		if raw == "" {
+			continue
+		}
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			b.Fatalf("%s must be a positive integer, got %q", name, raw)
+		}
+		*value = n
+	}
+	if raw := os.Getenv("BENCH_READ_RATIO"); raw != "" {
+		ratio, err := strconv.ParseFloat(raw, 64)
+		if err != nil || ratio < 0 || ratio > 1 {
+			b.Fatalf("BENCH_READ_RATIO must be between 0 and 1, got %q", raw)
+		}
+		w.readRatio = ratio
+	}
+	return w
+}
+
+func benchKey(n int) string {
+	return fmt.Sprintf("bench:key:%d", n)
+}
+
+// benchOp queues one command of a workload on pipe, picking its key and
+// kind with rng.
+type benchOp func(ctx context.Context, pipe redis.Pipeliner, rng *rand.Rand)
+
+// benchPipelineDepth is how many commands each connection sends per round
+// trip in the pipelined workload.
+const benchPipelineDepth = 16
+
+// benchResult is one line of the BENCH_RESULTS file: the final run of a
+// sub-benchmark with the workload it ran.
+type benchResult struct {
+	Name      string  `json:"name"`
+	Clients   int     `json:"clients"`
+	Pipeline  int     `json:"pipeline"`
+	ValueSize int     `json:"value_size"`
+	Keys      int     `json:"keys"`
+	Ops       int     `json:"ops"`
+	OpsPerSec float64 `json:"ops_per_sec"`
+	P50Us     float64 `json:"p50_us"`
+	P99Us     float64 `json:"p99_us"`
+	P999Us    float64 `json:"p999_us"`
+}
+
+// getOrSet returns the op of a GET with probability readRatio and a SET of
+// a value of the workload's size otherwise.
+func (w workload) getOrSet(readRatio float64) benchOp {
+	value := strings.Repeat("x", w.valueSize)
+	return func(ctx context.Context, pipe redis.Pipeliner, rng *rand.Rand) {
+		key := benchKey(rng.IntN(w.keys))
+		if rng.Float64() < readRatio {
+			pipe.Get(ctx, key)
+		} else {
+			pipe.Set(ctx, key, value, 0)
+		}
+	}
+}
+
+// run sends b.N commands of op over the workload's connections, reports
+// throughput and the latency of a round trip, and returns them.
+func (w workload) run(b *testing.B, rdb *redis.Client, op benchOp) benchResult {
+	ctx := context.Background()
+	var sent atomic.Int64
+	latencies := make([][]time.Duration, w.clients)
+	var wg sync.WaitGroup
+
+	b.ResetTimer()
+	for client := range w.clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rng := rand.New(rand.NewPCG(uint64(client), 0))
+			for {
+				first := sent.Add(int64(w.pipeline)) - int64(w.pipeline)
+				if first >= int64(b.N) {
+					return
+				}
+				batch := min(int64(w.pipeline), int64(b.N)-first)
+				pipe := rdb.Pipeline()
+				for range batch {
+					op(ctx, pipe, rng)
+				}
+				start := time.Now()
+				if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+					b.Error(err)
+					return
+				}
+				latencies[client] = append(latencies[client], time.Since(start))
+			}
+		}()
+	}
+	wg.Wait()
+	b.StopTimer()
+
+	all := slices.Concat(latencies...)
+	slices.Sort(all)
+	percentile := func(p float64) float64 {
+		if len(all) == 0 {
+			return 0
+		}
+		return float64(all[int(p*float64(len(all)-1))].Microseconds())
+	}
+	result := benchResult{
+		Name:      b.Name(),
+		Clients:   w.clients,
+		Pipeline:  w.pipeline,
+		ValueSize: w.valueSize,
+		Keys:      w.keys,
+		Ops:       b.N,
+		OpsPerSec: float64(b.N) / b.Elapsed().Seconds(),
+		P50Us:     percentile(0.50),
+		P99Us:     percentile(0.99),
+		P999Us:    percentile(0.999),
+	}
+	b.ReportMetric(result.OpsPerSec, "ops/s")
+	b.ReportMetric(result.P50Us, "p50-us")
+	b.ReportMetric(result.P99Us, "p99-us")
+	b.ReportMetric(result.P999Us, "p999-us")
+	return result
+}
+
+// writeBenchResults appends results to the file BENCH_RESULTS names, one
+// JSON object per line, so CI can keep a history of every run. It does
+// nothing if BENCH_RESULTS is unset.
+func writeBenchResults(b *testing.B, results []benchResult) {
+	path := os.Getenv("BENCH_RESULTS")
+	if path == "" {
+		return
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer file.Close()
+	encoder := json.NewEncoder(file)
+	for _, result := range results {
+		if err := encoder.Encode(result); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkWorkload runs GET, SET, mixed, INCR, LPUSH and pipelined mixed
+// workloads, reporting ops/s and round trip latency percentiles next to
+// ns/op. Save the output of each release and compare runs with benchstat:
+//
+//	BENCH_PIPELINE=16 go test -run '^$' -bench Workload -count 5 > new.txt
+//	benchstat old.txt new.txt
+//
+// With BENCH_RESULTS set to a path, the final run of each sub-benchmark is
+// also appended to that file as a line of JSON.
+func BenchmarkWorkload(b *testing.B) {
+	w := workloadFromEnv(b)
+	if err := util.StartServer(); err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(util.StopServer)
+
+	ctx := context.Background()
+	rdb := redis.NewClient(&redis.Options{Addr: util.Addr(), PoolSize: w.clients})
+	b.Cleanup(func() { _ = rdb.Close() })
+
+	// Fill the key space so GETs find their keys.
+	value := strings.Repeat("x", w.valueSize)
+	pipe := rdb.Pipeline()
+	for n := range w.keys {
+		pipe.Set(ctx, benchKey(n), value, 0)
+		if pipe.Len() == 1000 || n == w.keys-1 {
+			if _, err := pipe.Exec(ctx); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	pipelined := w
+	pipelined.pipeline = max(w.pipeline, benchPipelineDepth)
+	var results []benchResult
+	for _, sub := range []struct {
+		name string
+		w    workload
+		op   benchOp
+	}{
+		{"get", w, w.getOrSet(1)},
+		{"set", w, w.getOrSet(0)},
+		{"mixed", w, w.getOrSet(w.readRatio)},
+		{"incr", w, func(ctx context.Context, pipe redis.Pipeliner, rng *rand.Rand) {
+			pipe.Incr(ctx, fmt.Sprintf("bench:counter:%d", rng.IntN(w.keys)))
+		}},
+		{"lpush", w, func(ctx context.Context, pipe redis.Pipeliner, rng *rand.Rand) {
+			pipe.LPush(ctx, fmt.Sprintf("bench:list:%d", rng.IntN(w.keys)), value)
+		}},
+		{"pipelined", pipelined, pipelined.getOrSet(w.readRatio)},
+	} {
+		// Sub-benchmarks left out by -bench leave result empty.
+		var result benchResult
+		if b.Run(sub.name, func(b *testing.B) { result = sub.w.run(b, rdb, sub.op) }) && result.Name != "" {
+			results = append(results, result)
+		}
+	}
+	writeBenchResults(b, results)
+}
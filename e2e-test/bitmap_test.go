@@ -0,0 +1,208 @@
+package tests
+
+import (
+	"context"
+
+	"github.com/marsevilspirit/nimbis/e2e-test/util"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/redis/go-redis/v9"
+)
+
+var _ = Describe("Bitmap Commands", func() {
+	var rdb *redis.Client
+	var ctx context.Context
+
+	BeforeEach(func() {
+		rdb = util.NewClient()
+		ctx = context.Background()
+		Expect(rdb.Ping(ctx).Err()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(rdb.Close()).To(Succeed())
+	})
+
+	It("should SETBIT and GETBIT", func() {
+		key := "bitmap_setbit_key"
+		rdb.Del(ctx, key)
+
+		Expect(rdb.SetBit(ctx, key, 7, 1).Val()).To(Equal(int64(0)))
+		Expect(rdb.SetBit(ctx, key, 7, 0).Val()).To(Equal(int64(1)))
+		Expect(rdb.SetBit(ctx, key, 7, 1).Val()).To(Equal(int64(0)))
+		Expect(rdb.GetBit(ctx, key, 7).Val()).To(Equal(int64(1)))
+		Expect(rdb.GetBit(ctx, key, 6).Val()).To(Equal(int64(0)))
+		Expect(rdb.GetBit(ctx, key, 100).Val()).To(Equal(int64(0)))
+		Expect(rdb.Get(ctx, key).Val()).To(Equal("\x01"))
+
+		// Setting a bit pads the string with zero bytes.
+		Expect(rdb.SetBit(ctx, key, 23, 1).Err()).NotTo(HaveOccurred())
+		Expect(rdb.Get(ctx, key).Val()).To(Equal("\x01\x00\x01"))
+	})
+
+	It("should keep bitmaps with high offsets usable", func() {
+		key := "bitmap_sparse_key"
+		rdb.Del(ctx, key)
+
+		offset := int64(1<<32 - 1)
+		Expect(rdb.SetBit(ctx, key, offset, 1).Err()).NotTo(HaveOccurred())
+		Expect(rdb.GetBit(ctx, key, offset).Val()).To(Equal(int64(1)))
+		Expect(rdb.BitCount(ctx, key, nil).Val()).To(Equal(int64(1)))
+		Expect(rdb.BitPos(ctx, key, 1).Val()).To(Equal(offset))
+	})
+
+	It("should reject invalid SETBIT arguments", func() {
+		key := "bitmap_invalid_key"
+		rdb.Del(ctx, key)
+
+		err := rdb.SetBit(ctx, key, 1<<32, 1).Err()
+		Expect(err).To(MatchError(ContainSubstring("bit offset is not an integer or out of range")))
+		err = rdb.SetBit(ctx, key, 0, 2).Err()
+		Expect(err).To(MatchError(ContainSubstring("bit is not an integer or out of range")))
+
+		rdb.HSet(ctx, key, "field", "value")
+		err = rdb.SetBit(ctx, key, 0, 1).Err()
+		Expect(err).To(MatchError(ContainSubstring("WRONGTYPE")))
+	})
+
+	It("should BITCOUNT with BYTE and BIT ranges", func() {
+		key := "bitmap_bitcount_key"
+		rdb.Set(ctx, key, "foobar", 0)
+
+		Expect(rdb.BitCount(ctx, key, nil).Val()).To(Equal(int64(26)))
+		Expect(rdb.BitCount(ctx, key, &redis.BitCount{Start: 0, End: 0}).Val()).To(Equal(int64(4)))
+		Expect(rdb.BitCount(ctx, key, &redis.BitCount{Start: 1, End: 1}).Val()).To(Equal(int64(6)))
+		Expect(rdb.BitCount(ctx, key, &redis.BitCount{Start: -2, End: -1}).Val()).To(Equal(int64(7)))
+		Expect(rdb.BitCount(ctx, key, &redis.BitCount{Start: 5, End: 30, Unit: redis.BitCountIndexBit}).Val()).
+			To(Equal(int64(17)))
+		Expect(rdb.BitCount(ctx, "bitmap_missing_key", nil).Val()).To(Equal(int64(0)))
+
+		err := rdb.Do(ctx, "BITCOUNT", key, "0").Err()
+		Expect(err).To(MatchError(ContainSubstring("syntax error")))
+	})
+
+	It("should BITPOS with BYTE and BIT ranges", func() {
+		key := "bitmap_bitpos_key"
+		rdb.Set(ctx, key, "\xff\xf0\x00", 0)
+
+		Expect(rdb.BitPos(ctx, key, 0).Val()).To(Equal(int64(12)))
+		Expect(rdb.BitPos(ctx, key, 1, 2).Val()).To(Equal(int64(-1)))
+		Expect(rdb.BitPos(ctx, key, 0, 2, -1).Val()).To(Equal(int64(16)))
+		Expect(rdb.BitPosSpan(ctx, key, 1, 7, 15, "bit").Val()).To(Equal(int64(7)))
+		Expect(rdb.BitPosSpan(ctx, key, 0, 0, 11, "bit").Val()).To(Equal(int64(-1)))
+
+		rdb.Set(ctx, key, "\xff\xff", 0)
+		Expect(rdb.BitPos(ctx, key, 0).Val()).To(Equal(int64(16)))
+		Expect(rdb.BitPos(ctx, key, 0, 0, -1).Val()).To(Equal(int64(-1)))
+
+		rdb.Del(ctx, key)
+		Expect(rdb.BitPos(ctx, key, 1).Val()).To(Equal(int64(-1)))
+		Expect(rdb.BitPos(ctx, key, 0).Val()).To(Equal(int64(0)))
+
+		err := rdb.Do(ctx, "BITPOS", key, "2").Err()
+		Expect(err).To(MatchError(ContainSubstring("bit argument must be 1 or 0")))
+	})
+
+	It("should BITOP AND, OR, XOR and NOT", func() {
+		a, b, dest := "bitmap_bitop_a", "bitmap_bitop_b", "bitmap_bitop_dest"
+		rdb.Set(ctx, a, "abc", 0)
+		rdb.Set(ctx, b, "\xff\x00", 0)
+
+		Expect(rdb.BitOpAnd(ctx, dest, a, b).Val()).To(Equal(int64(3)))
+		Expect(rdb.Get(ctx, dest).Val()).To(Equal("a\x00\x00"))
+		Expect(rdb.BitOpOr(ctx, dest, a, b).Val()).To(Equal(int64(3)))
+		Expect(rdb.Get(ctx, dest).Val()).To(Equal("\xffbc"))
+		Expect(rdb.BitOpXor(ctx, dest, a, b).Val()).To(Equal(int64(3)))
+		Expect(rdb.Get(ctx, dest).Val()).To(Equal("\x9ebc"))
+		Expect(rdb.BitOpNot(ctx, dest, b).Val()).To(Equal(int64(2)))
+		Expect(rdb.Get(ctx, dest).Val()).To(Equal("\x00\xff"))
+
+		// Sparse bitmaps only combine the chunks they have.
+		rdb.Del(ctx, a, b)
+		rdb.SetBit(ctx, a, 1<<32-1, 1)
+		rdb.SetBit(ctx, b, 0, 1)
+		Expect(rdb.BitOpOr(ctx, dest, a, b).Val()).To(Equal(int64(1 << 29)))
+		Expect(rdb.BitCount(ctx, dest, nil).Val()).To(Equal(int64(2)))
+
+		rdb.Del(ctx, a, b)
+		Expect(rdb.BitOpAnd(ctx, dest, a, b).Val()).To(Equal(int64(0)))
+		Expect(rdb.Exists(ctx, dest).Val()).To(Equal(int64(0)))
+
+		err := rdb.Do(ctx, "BITOP", "NOT", dest, a, b).Err()
+		Expect(err).To(MatchError(ContainSubstring("BITOP NOT must be called with a single source key")))
+		rdb.HSet(ctx, a, "field", "value")
+		err = rdb.BitOpOr(ctx, dest, a).Err()
+		Expect(err).To(MatchError(ContainSubstring("WRONGTYPE")))
+	})
+
+	It("should convert a string when a bit is set", func() {
+		key := "bitmap_convert_key"
+		rdb.Set(ctx, key, "foobar", 0)
+
+		Expect(rdb.SetBit(ctx, key, 7, 1).Val()).To(Equal(int64(0)))
+		Expect(rdb.Get(ctx, key).Val()).To(Equal("goobar"))
+		Expect(rdb.Append(ctx, key, "!").Val()).To(Equal(int64(7)))
+		Expect(rdb.Get(ctx, key).Val()).To(Equal("goobar!"))
+	})
+
+	It("should BITFIELD GET, SET and INCRBY", func() {
+		key := "bitmap_bitfield_key"
+		rdb.Del(ctx, key)
+
+		Expect(rdb.BitField(ctx, key, "SET", "u8", 0, 200, "INCRBY", "u8", 0, 100, "GET", "i8", 0).Val()).
+			To(Equal([]int64{0, 44, 44}))
+		Expect(rdb.BitField(ctx, key, "SET", "i4", "#2", -1).Val()).To(Equal([]int64{0}))
+		Expect(rdb.Get(ctx, key).Val()).To(Equal(",\xf0"))
+		Expect(rdb.BitField(ctx, key, "GET", "i4", "#2", "GET", "u4", "#2").Val()).To(Equal([]int64{-1, 15}))
+
+		// A high offset pads the string with zeros.
+		Expect(rdb.BitField(ctx, key, "SET", "u16", 64, 0xabcd).Val()).To(Equal([]int64{0}))
+		Expect(rdb.Get(ctx, key).Val()).To(HaveLen(10))
+
+		Expect(rdb.BitField(ctx, "bitmap_bitfield_missing", "GET", "u8", 0).Val()).To(Equal([]int64{0}))
+		Expect(rdb.Exists(ctx, "bitmap_bitfield_missing").Val()).To(Equal(int64(0)))
+	})
+
+	It("should BITFIELD with OVERFLOW control", func() {
+		key := "bitmap_bitfield_overflow_key"
+		rdb.Del(ctx, key)
+
+		res, err := rdb.Do(ctx, "BITFIELD", key,
+			"INCRBY", "u2", 0, 5,
+			"OVERFLOW", "SAT", "INCRBY", "u2", 0, 5,
+			"OVERFLOW", "FAIL", "INCRBY", "u2", 0, 1,
+			"INCRBY", "i8", 8, -100,
+			"OVERFLOW", "WRAP", "INCRBY", "i8", 8, -100,
+		).Slice()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res).To(Equal([]interface{}{int64(1), int64(3), nil, int64(-100), int64(56)}))
+	})
+
+	It("should reject invalid BITFIELD arguments", func() {
+		key := "bitmap_bitfield_invalid_key"
+		rdb.Del(ctx, key)
+
+		err := rdb.Do(ctx, "BITFIELD", key, "GET", "u64", 0).Err()
+		Expect(err).To(MatchError(ContainSubstring("Invalid bitfield type")))
+		err = rdb.Do(ctx, "BITFIELD", key, "GET", "u8", -1).Err()
+		Expect(err).To(MatchError(ContainSubstring("bit offset is not an integer or out of range")))
+		err = rdb.Do(ctx, "BITFIELD", key, "OVERFLOW", "BOUNCE").Err()
+		Expect(err).To(MatchError(ContainSubstring("Invalid OVERFLOW type specified")))
+		err = rdb.Do(ctx, "BITFIELD", key, "SET", "u8", 0).Err()
+		Expect(err).To(MatchError(ContainSubstring("syntax error")))
+		Expect(rdb.Exists(ctx, key).Val()).To(Equal(int64(0)))
+
+		rdb.HSet(ctx, key, "field", "value")
+		err = rdb.Do(ctx, "BITFIELD", key, "GET", "u8", 0).Err()
+		Expect(err).To(MatchError(ContainSubstring("WRONGTYPE")))
+	})
+
+	It("should BITFIELD_RO only with GET", func() {
+		key := "bitmap_bitfield_ro_key"
+		rdb.Set(ctx, key, "\x80\x01", 0)
+
+		Expect(rdb.BitFieldRO(ctx, key, "i8", 0, "u16", 0).Val()).To(Equal([]int64{-128, 0x8001}))
+		err := rdb.Do(ctx, "BITFIELD_RO", key, "SET", "u8", 0, 1).Err()
+		Expect(err).To(MatchError(ContainSubstring("BITFIELD_RO only supports the GET subcommand")))
+	})
+})
@@ -0,0 +1,105 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/marsevilspirit/nimbis/e2e-test/util"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/redis/go-redis/v9"
+)
+
+var _ = Describe("Bloom Filter Commands", func() {
+	var rdb *redis.Client
+	var ctx context.Context
+
+	BeforeEach(func() {
+		rdb = util.NewClient()
+		ctx = context.Background()
+		Expect(rdb.Ping(ctx).Err()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(rdb.Close()).To(Succeed())
+	})
+
+	It("should BF.ADD and BF.EXISTS", func() {
+		key := "bf_add_key"
+		rdb.Del(ctx, key)
+
+		Expect(rdb.Do(ctx, "BF.EXISTS", key, "a").Int64()).To(Equal(int64(0)))
+		Expect(rdb.Do(ctx, "BF.ADD", key, "a").Int64()).To(Equal(int64(1)))
+		Expect(rdb.Do(ctx, "BF.ADD", key, "a").Int64()).To(Equal(int64(0)))
+		Expect(rdb.Do(ctx, "BF.EXISTS", key, "a").Int64()).To(Equal(int64(1)))
+		Expect(rdb.Do(ctx, "BF.EXISTS", key, "b").Int64()).To(Equal(int64(0)))
+		Expect(rdb.Exists(ctx, key).Val()).To(Equal(int64(1)))
+	})
+
+	It("should BF.MADD", func() {
+		key := "bf_madd_key"
+		rdb.Del(ctx, key)
+
+		res, err := rdb.Do(ctx, "BF.MADD", key, "a", "b", "a").Slice()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res).To(Equal([]interface{}{int64(1), int64(1), int64(0)}))
+		Expect(rdb.Do(ctx, "BF.EXISTS", key, "b").Int64()).To(Equal(int64(1)))
+	})
+
+	It("should BF.RESERVE", func() {
+		key := "bf_reserve_key"
+		rdb.Del(ctx, key)
+
+		Expect(rdb.Do(ctx, "BF.RESERVE", key, "0.01", "1000").Err()).To(Succeed())
+		err := rdb.Do(ctx, "BF.RESERVE", key, "0.01", "1000").Err()
+		Expect(err).To(MatchError(ContainSubstring("item exists")))
+
+		err = rdb.Do(ctx, "BF.RESERVE", "bf_reserve_bad", "1.5", "1000").Err()
+		Expect(err).To(MatchError(ContainSubstring("(0 < error rate range < 1)")))
+		err = rdb.Do(ctx, "BF.RESERVE", "bf_reserve_bad", "0.01", "0").Err()
+		Expect(err).To(MatchError(ContainSubstring("capacity should be larger than 0")))
+		err = rdb.Do(ctx, "BF.RESERVE", "bf_reserve_bad", "0.01", "10", "NONSCALING", "EXPANSION", "2").Err()
+		Expect(err).To(MatchError(ContainSubstring("cannot expand")))
+	})
+
+	It("should keep scaling filters low on false positives", func() {
+		key := "bf_scaling_key"
+		rdb.Del(ctx, key)
+		Expect(rdb.Do(ctx, "BF.RESERVE", key, "0.01", "50", "EXPANSION", "2").Err()).To(Succeed())
+
+		for i := 0; i < 500; i++ {
+			Expect(rdb.Do(ctx, "BF.ADD", key, fmt.Sprintf("item:%d", i)).Err()).To(Succeed())
+		}
+		for i := 0; i < 500; i++ {
+			Expect(rdb.Do(ctx, "BF.EXISTS", key, fmt.Sprintf("item:%d", i)).Int64()).To(Equal(int64(1)))
+		}
+		falsePositives := 0
+		for i := 500; i < 1500; i++ {
+			falsePositives += int(rdb.Do(ctx, "BF.EXISTS", key, fmt.Sprintf("item:%d", i)).Val().(int64))
+		}
+		Expect(falsePositives).To(BeNumerically("<", 50))
+	})
+
+	It("should fill non scaling filters", func() {
+		key := "bf_nonscaling_key"
+		rdb.Del(ctx, key)
+		Expect(rdb.Do(ctx, "BF.RESERVE", key, "0.01", "2", "NONSCALING").Err()).To(Succeed())
+
+		res, err := rdb.Do(ctx, "BF.MADD", key, "a", "b", "c").Slice()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res[:2]).To(Equal([]interface{}{int64(1), int64(1)}))
+		Expect(res[2]).To(MatchError(ContainSubstring("non scaling filter is full")))
+
+		err = rdb.Do(ctx, "BF.ADD", key, "d").Err()
+		Expect(err).To(MatchError(ContainSubstring("non scaling filter is full")))
+	})
+
+	It("should reject bloom commands on other types", func() {
+		key := "bf_wrongtype_key"
+		rdb.Del(ctx, key)
+		rdb.Set(ctx, key, "v", 0)
+
+		Expect(rdb.Do(ctx, "BF.ADD", key, "a").Err()).To(MatchError(ContainSubstring("WRONGTYPE")))
+		Expect(rdb.Do(ctx, "BF.EXISTS", key, "a").Err()).To(MatchError(ContainSubstring("WRONGTYPE")))
+	})
+})
@@ -2,8 +2,10 @@ package tests
 
 import (
 	"context"
+	"net"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/marsevilspirit/nimbis/e2e-test/util"
 	. "github.com/onsi/ginkgo/v2"
@@ -12,8 +14,17 @@ import (
 )
 
 type clientListEntry struct {
-	id   int64
-	name string
+	id      int64
+	addr    string
+	laddr   string
+	fd      string
+	name    string
+	age     string
+	idle    string
+	db      string
+	cmd     string
+	libName string
+	libVer  string
 }
 
 func parseClientList(result interface{}) []clientListEntry {
@@ -33,18 +44,30 @@ func parseClientList(result interface{}) []clientListEntry {
 			continue
 		}
 
-		parts := strings.SplitN(line, " ", 2)
-		Expect(parts).To(HaveLen(2), "unexpected CLIENT LIST line format: %s", line)
-		Expect(strings.HasPrefix(parts[0], "id=")).To(BeTrue(), "unexpected CLIENT LIST id part: %s", line)
-		Expect(strings.HasPrefix(parts[1], "name=")).To(BeTrue(), "unexpected CLIENT LIST name part: %s", line)
+		fields := make(map[string]string)
+		for _, field := range strings.Fields(line) {
+			key, value, found := strings.Cut(field, "=")
+			Expect(found).To(BeTrue(), "unexpected CLIENT LIST field %q in line: %s", field, line)
+			fields[key] = value
+		}
+		Expect(fields).To(HaveKey("id"), "unexpected CLIENT LIST line format: %s", line)
+		Expect(fields).To(HaveKey("name"), "unexpected CLIENT LIST line format: %s", line)
 
-		idStr := strings.TrimPrefix(parts[0], "id=")
-		id, err := strconv.ParseInt(idStr, 10, 64)
+		id, err := strconv.ParseInt(fields["id"], 10, 64)
 		Expect(err).NotTo(HaveOccurred(), "invalid client id in line: %s", line)
 
 		entries = append(entries, clientListEntry{
-			id:   id,
-			name: strings.TrimPrefix(parts[1], "name="),
+			id:      id,
+			addr:    fields["addr"],
+			laddr:   fields["laddr"],
+			fd:      fields["fd"],
+			name:    fields["name"],
+			age:     fields["age"],
+			idle:    fields["idle"],
+			db:      fields["db"],
+			cmd:     fields["cmd"],
+			libName: fields["lib-name"],
+			libVer:  fields["lib-ver"],
 		})
 	}
 
@@ -155,10 +178,106 @@ var _ = Describe("CLIENT Group Commands", func() {
 		}
 	})
 
+	It("should report the connection, age, idle time and last command of a client", func() {
+		// Dial directly, to know both ends of the connection.
+		var local, remote string
+		client := redis.NewClient(&redis.Options{
+			Addr: util.Addr(),
+			Dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+				if err == nil {
+					local, remote = conn.LocalAddr().String(), conn.RemoteAddr().String()
+				}
+				return conn, err
+			},
+		})
+		defer func() { Expect(client.Close()).To(Succeed()) }()
+		id := mustClientID(ctx, client)
+
+		info, err := client.Do(ctx, "CLIENT", "INFO").Result()
+		Expect(err).NotTo(HaveOccurred())
+		entry := parseClientList(info)[0]
+		Expect(entry.id).To(Equal(id))
+		Expect(entry.addr).To(Equal(local))
+		Expect(entry.laddr).To(Equal(remote))
+		fd, err := strconv.Atoi(entry.fd)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fd).To(BeNumerically(">", 0))
+		Expect(entry.db).To(Equal("0"))
+		Expect(entry.cmd).To(Equal("client"))
+		Expect(entry.idle).To(Equal("0"))
+
+		time.Sleep(1100 * time.Millisecond)
+		result, err := rdb.Do(ctx, "CLIENT", "LIST").Result()
+		Expect(err).NotTo(HaveOccurred())
+		entry, ok := findClient(parseClientList(result), id)
+		Expect(ok).To(BeTrue())
+		Expect(strconv.Atoi(entry.age)).To(BeNumerically(">=", 1))
+		Expect(strconv.Atoi(entry.idle)).To(BeNumerically(">=", 1))
+		Expect(entry.cmd).To(Equal("client"))
+	})
+
+	It("should record the library go-redis reports on connect", func() {
+		id := mustClientID(ctx, rdb)
+
+		result, err := rdb.Do(ctx, "CLIENT", "LIST").Result()
+		Expect(err).NotTo(HaveOccurred())
+		entry, ok := findClient(parseClientList(result), id)
+		Expect(ok).To(BeTrue())
+		Expect(entry.libName).To(HavePrefix("go-redis"))
+		Expect(entry.libVer).NotTo(BeEmpty())
+	})
+
+	It("should set and clear library info with CLIENT SETINFO", func() {
+		id := mustClientID(ctx, rdb)
+
+		Expect(rdb.Do(ctx, "CLIENT", "SETINFO", "LIB-NAME", "mylib").Err()).To(Succeed())
+		Expect(rdb.Do(ctx, "CLIENT", "setinfo", "lib-ver", "1.2.3").Err()).To(Succeed())
+
+		info, err := rdb.Do(ctx, "CLIENT", "INFO").Result()
+		Expect(err).NotTo(HaveOccurred())
+		entries := parseClientList(info)
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].id).To(Equal(id))
+		Expect(entries[0].libName).To(Equal("mylib"))
+		Expect(entries[0].libVer).To(Equal("1.2.3"))
+
+		Expect(rdb.Do(ctx, "CLIENT", "SETINFO", "LIB-VER", "").Err()).To(Succeed())
+		info, err = rdb.Do(ctx, "CLIENT", "INFO").Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(parseClientList(info)[0].libVer).To(BeEmpty())
+	})
+
+	It("should reject invalid CLIENT SETINFO arguments", func() {
+		err := rdb.Do(ctx, "CLIENT", "SETINFO", "LIB-OS", "linux").Err()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("ERR Unrecognized option 'LIB-OS'"))
+
+		err = rdb.Do(ctx, "CLIENT", "SETINFO", "LIB-NAME", "my lib").Err()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("lib-name cannot contain spaces"))
+
+		err = rdb.Do(ctx, "CLIENT", "SETINFO", "LIB-NAME").Err()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("ERR wrong number of arguments for 'client|setinfo' command"))
+	})
+
 	It("should reject unknown subcommand", func() {
 		_, err := rdb.Do(ctx, "CLIENT", "BOGUS").Result()
 		Expect(err).To(HaveOccurred())
-		Expect(err.Error()).To(ContainSubstring("ERR unknown CLIENT subcommand 'BOGUS'"))
+		Expect(err).To(MatchError("ERR unknown CLIENT subcommand 'BOGUS'. Try CLIENT HELP."))
+	})
+
+	It("should list subcommands in help", func() {
+		help, err := rdb.Do(ctx, "CLIENT", "HELP").StringSlice()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(help[0]).To(HavePrefix("CLIENT <subcommand>"))
+		Expect(help).To(ContainElement("SETNAME <name>"))
+		Expect(help).To(ContainElement("TRACKINGINFO"))
+		Expect(help[len(help)-2:]).To(Equal([]string{"HELP", "    Print this help."}))
+
+		err = rdb.Do(ctx, "CLIENT", "HELP", "extra").Err()
+		Expect(err).To(MatchError("ERR wrong number of arguments for 'client|help' command"))
 	})
 
 	It("should reject wrong number of arguments", func() {
@@ -168,18 +287,18 @@ var _ = Describe("CLIENT Group Commands", func() {
 
 		_, err = rdb.Do(ctx, "CLIENT", "SETNAME").Result()
 		Expect(err).To(HaveOccurred())
-		Expect(err.Error()).To(ContainSubstring("ERR wrong number of arguments for 'setname' command"))
+		Expect(err.Error()).To(ContainSubstring("ERR wrong number of arguments for 'client|setname' command"))
 
 		_, err = rdb.Do(ctx, "CLIENT", "GETNAME", "extra").Result()
 		Expect(err).To(HaveOccurred())
-		Expect(err.Error()).To(ContainSubstring("ERR wrong number of arguments for 'getname' command"))
+		Expect(err.Error()).To(ContainSubstring("ERR wrong number of arguments for 'client|getname' command"))
 
 		_, err = rdb.Do(ctx, "CLIENT", "ID", "extra").Result()
 		Expect(err).To(HaveOccurred())
-		Expect(err.Error()).To(ContainSubstring("ERR wrong number of arguments for 'id' command"))
+		Expect(err.Error()).To(ContainSubstring("ERR wrong number of arguments for 'client|id' command"))
 
 		_, err = rdb.Do(ctx, "CLIENT", "LIST", "extra").Result()
 		Expect(err).To(HaveOccurred())
-		Expect(err.Error()).To(ContainSubstring("ERR wrong number of arguments for 'list' command"))
+		Expect(err.Error()).To(ContainSubstring("ERR wrong number of arguments for 'client|list' command"))
 	})
 })
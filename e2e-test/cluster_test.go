@@ -0,0 +1,464 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/marsevilspirit/nimbis/e2e-test/util"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/redis/go-redis/v9"
+)
+
+// startClusterNode starts a server in cluster mode with its bus on a free
+// port, and returns it with the bus port.
+func startClusterNode() (*util.Server, int) {
+	cport, err := util.FreePort()
+	Expect(err).NotTo(HaveOccurred())
+	server, err := util.StartServerWithOptions(0, map[string]string{
+		"cluster_enabled":      "true",
+		"cluster_port":         strconv.Itoa(cport),
+		"cluster_node_timeout": "2000",
+	}, "")
+	Expect(err).NotTo(HaveOccurred())
+	return server, cport
+}
+
+// clusterInfoField returns field of the CLUSTER INFO reply of rdb.
+func clusterInfoField(ctx context.Context, rdb *redis.Client, field string) string {
+	for _, line := range strings.Split(rdb.ClusterInfo(ctx).Val(), "\r\n") {
+		if value, found := strings.CutPrefix(line, field+":"); found {
+			return value
+		}
+	}
+	return ""
+}
+
+// clusterNodeFields returns the fields of the CLUSTER NODES line of the
+// node id, as rdb sees it.
+func clusterNodeFields(ctx context.Context, rdb *redis.Client, id string) []string {
+	for _, line := range strings.Split(rdb.ClusterNodes(ctx).Val(), "\n") {
+		if fields := strings.Fields(line); len(fields) > 3 && fields[0] == id {
+			return fields
+		}
+	}
+	return nil
+}
+
+// clusterRole returns the flags and the primary of the node id, as rdb sees
+// it, without the myself flag.
+func clusterRole(ctx context.Context, rdb *redis.Client, id string) string {
+	fields := clusterNodeFields(ctx, rdb, id)
+	if fields == nil {
+		return ""
+	}
+	return strings.TrimPrefix(fields[2], "myself,") + " " + fields[3]
+}
+
+var _ = Describe("Cluster", Ordered, func() {
+	var first, second *util.Server
+	var firstBus, secondBus int
+	var a, b *redis.Client
+	var ctx context.Context
+
+	BeforeAll(func() {
+		skipIfExternal()
+		first, firstBus = startClusterNode()
+		second, secondBus = startClusterNode()
+	})
+
+	AfterAll(func() {
+		if first != nil {
+			first.Stop()
+		}
+		if second != nil {
+			second.Stop()
+		}
+	})
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		a = first.NewClient()
+		b = second.NewClient()
+	})
+
+	AfterEach(func() {
+		Expect(a.Close()).To(Succeed())
+		Expect(b.Close()).To(Succeed())
+	})
+
+	It("should report cluster mode", func() {
+		Expect(a.Info(ctx, "cluster").Val()).To(ContainSubstring("cluster_enabled:1"))
+		hello, err := a.Do(ctx, "HELLO").Result()
+		Expect(err).NotTo(HaveOccurred())
+		expectHelloFieldString(normalizeHelloMap(hello), "mode", "cluster")
+
+		id := a.ClusterMyID(ctx).Val()
+		Expect(id).To(HaveLen(40))
+		Expect(a.ClusterNodes(ctx).Val()).To(HavePrefix(id + " "))
+		Expect(a.ClusterNodes(ctx).Val()).To(ContainSubstring("myself,master"))
+		Expect(clusterInfoField(ctx, a, "cluster_state")).To(Equal("fail"))
+		Expect(clusterInfoField(ctx, a, "cluster_known_nodes")).To(Equal("1"))
+	})
+
+	It("should hash keys to slots", func() {
+		Expect(a.ClusterKeySlot(ctx, "foo").Val()).To(Equal(int64(12182)))
+		Expect(a.ClusterKeySlot(ctx, "bar").Val()).To(Equal(int64(5061)))
+		Expect(a.ClusterKeySlot(ctx, "{user1000}.following").Val()).To(
+			Equal(a.ClusterKeySlot(ctx, "{user1000}.followers").Val()))
+		Expect(a.ClusterKeySlot(ctx, "foo{}bar").Val()).NotTo(
+			Equal(a.ClusterKeySlot(ctx, "bar").Val()))
+	})
+
+	It("should refuse keys in slots nobody serves", func() {
+		Expect(a.Set(ctx, "foo", "v", 0).Err()).To(MatchError("CLUSTERDOWN Hash slot not served"))
+		Expect(a.Ping(ctx).Err()).To(Succeed())
+	})
+
+	It("should assign and delete slots", func() {
+		Expect(a.ClusterAddSlotsRange(ctx, 0, 99).Err()).To(Succeed())
+		Expect(a.ClusterAddSlots(ctx, 50).Err()).To(MatchError("ERR Slot 50 is already busy"))
+		Expect(a.ClusterAddSlots(ctx, 100, 100).Err()).To(
+			MatchError("ERR Slot 100 specified multiple times"))
+		Expect(a.ClusterAddSlots(ctx, 16384).Err()).To(MatchError("ERR Invalid or out of range slot"))
+		Expect(a.Do(ctx, "CLUSTER", "ADDSLOTSRANGE", "10", "5").Err()).To(
+			MatchError("ERR start slot number 10 is greater than end slot number 5"))
+		Expect(clusterInfoField(ctx, a, "cluster_slots_assigned")).To(Equal("100"))
+
+		Expect(a.ClusterDelSlotsRange(ctx, 50, 99).Err()).To(Succeed())
+		Expect(a.ClusterDelSlots(ctx, 50).Err()).To(MatchError("ERR Slot 50 is already unassigned"))
+		Expect(clusterInfoField(ctx, a, "cluster_slots_assigned")).To(Equal("50"))
+		Expect(a.Do(ctx, "CLUSTER", "FLUSHSLOTS").Err()).To(Succeed())
+		Expect(clusterInfoField(ctx, a, "cluster_slots_assigned")).To(Equal("0"))
+	})
+
+	It("should form a cluster with MEET and redirect with MOVED", func() {
+		Expect(a.ClusterAddSlotsRange(ctx, 0, 8191).Err()).To(Succeed())
+		Expect(b.ClusterAddSlotsRange(ctx, 8192, 16383).Err()).To(Succeed())
+		Expect(a.Do(ctx, "CLUSTER", "MEET", "nowhere", second.Port()).Err()).To(
+			MatchError(fmt.Sprintf("ERR Invalid node address specified: nowhere:%d", second.Port())))
+		Expect(a.Do(ctx, "CLUSTER", "MEET", "127.0.0.1", second.Port(), secondBus).Err()).To(Succeed())
+
+		for _, rdb := range []*redis.Client{a, b} {
+			Eventually(func() string {
+				return clusterInfoField(ctx, rdb, "cluster_state")
+			}, 10*time.Second, 100*time.Millisecond).Should(Equal("ok"))
+			Expect(clusterInfoField(ctx, rdb, "cluster_known_nodes")).To(Equal("2"))
+			Expect(clusterInfoField(ctx, rdb, "cluster_size")).To(Equal("2"))
+		}
+		Expect(a.ClusterNodes(ctx).Val()).To(ContainSubstring(
+			fmt.Sprintf("%s 127.0.0.1:%d@%d master", b.ClusterMyID(ctx).Val(), second.Port(), secondBus)))
+		Expect(b.ClusterNodes(ctx).Val()).To(ContainSubstring(
+			fmt.Sprintf("%s 127.0.0.1:%d@%d master", a.ClusterMyID(ctx).Val(), first.Port(), firstBus)))
+
+		slots, err := a.ClusterSlots(ctx).Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(slots).To(HaveLen(2))
+		Expect(slots[0].Start).To(Equal(0))
+		Expect(slots[0].End).To(Equal(8191))
+		Expect(slots[0].Nodes[0].Addr).To(Equal(fmt.Sprintf("127.0.0.1:%d", first.Port())))
+		Expect(slots[1].Start).To(Equal(8192))
+		Expect(slots[1].Nodes[0].ID).To(Equal(b.ClusterMyID(ctx).Val()))
+
+		shards, err := b.ClusterShards(ctx).Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(shards).To(HaveLen(2))
+		for _, shard := range shards {
+			Expect(shard.Nodes).To(HaveLen(1))
+			Expect(shard.Nodes[0].Role).To(Equal("master"))
+			Expect(shard.Nodes[0].Health).To(Equal("online"))
+		}
+
+		Expect(a.Set(ctx, "bar", "1", 0).Err()).To(Succeed())
+		Expect(a.Set(ctx, "foo", "1", 0).Err()).To(
+			MatchError(fmt.Sprintf("MOVED 12182 127.0.0.1:%d", second.Port())))
+		Expect(b.Set(ctx, "foo", "2", 0).Err()).To(Succeed())
+		Expect(b.Get(ctx, "bar").Err()).To(
+			MatchError(fmt.Sprintf("MOVED 5061 127.0.0.1:%d", first.Port())))
+	})
+
+	It("should follow MOVED with a cluster client", func() {
+		cluster := redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs: []string{first.Addr()},
+		})
+		defer cluster.Close()
+		for i := range 20 {
+			key := fmt.Sprintf("cluster:key:%d", i)
+			Expect(cluster.Set(ctx, key, i, 0).Err()).To(Succeed())
+			Expect(cluster.Get(ctx, key).Val()).To(Equal(strconv.Itoa(i)))
+		}
+	})
+
+	It("should refuse keys in different slots", func() {
+		Expect(a.Del(ctx, "{bar}a", "bar").Err()).To(Succeed())
+		Expect(a.Del(ctx, "bar", "baz").Err()).To(
+			MatchError("CROSSSLOT Keys in request don't hash to the same slot"))
+
+		conn := a.Conn()
+		defer conn.Close()
+		Expect(conn.Do(ctx, "MULTI").Err()).To(Succeed())
+		Expect(conn.Do(ctx, "SET", "bar", "1").Val()).To(Equal("QUEUED"))
+		Expect(conn.Do(ctx, "SET", "{bar}x", "1").Val()).To(Equal("QUEUED"))
+		Expect(conn.Do(ctx, "SET", "zap", "1").Val()).To(Equal("QUEUED"))
+		Expect(conn.Do(ctx, "EXEC").Err()).To(
+			MatchError("CROSSSLOT Keys in request don't hash to the same slot"))
+		Expect(conn.Do(ctx, "EXEC").Err()).To(MatchError("ERR EXEC without MULTI"))
+
+		Expect(conn.Do(ctx, "MULTI").Err()).To(Succeed())
+		Expect(conn.Do(ctx, "SET", "foo", "1").Err()).To(MatchError(HavePrefix("MOVED 12182")))
+		Expect(conn.Do(ctx, "EXEC").Err()).To(MatchError(HavePrefix("EXECABORT")))
+	})
+
+	It("should keep the configuration across restarts", func() {
+		id := a.ClusterMyID(ctx).Val()
+		Expect(a.Do(ctx, "CLUSTER", "SAVECONFIG").Err()).To(Succeed())
+		Expect(first.Restart()).To(Succeed())
+		restarted := first.NewClient()
+		defer restarted.Close()
+		Expect(restarted.ClusterMyID(ctx).Val()).To(Equal(id))
+		Expect(clusterInfoField(ctx, restarted, "cluster_slots_assigned")).To(Equal("16384"))
+		Eventually(func() string {
+			return clusterInfoField(ctx, restarted, "cluster_state")
+		}, 10*time.Second, 100*time.Millisecond).Should(Equal("ok"))
+		Expect(restarted.Get(ctx, "bar").Val()).To(Equal("1"))
+	})
+
+	It("should bump the config epoch", func() {
+		// Epoch collision resolution may already have given this node the
+		// greatest epoch, which it keeps.
+		bumped, err := a.Do(ctx, "CLUSTER", "BUMPEPOCH").Text()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bumped).To(MatchRegexp(`^(BUMPED|STILL) \d+$`))
+		epoch := strings.Fields(bumped)[1]
+		Expect(a.Do(ctx, "CLUSTER", "BUMPEPOCH").Val()).To(Equal("STILL " + epoch))
+		Expect(clusterInfoField(ctx, a, "cluster_my_epoch")).To(Equal(epoch))
+		Eventually(func() string {
+			return clusterInfoField(ctx, b, "cluster_current_epoch")
+		}, 10*time.Second, 100*time.Millisecond).Should(Equal(epoch))
+		Expect(a.Do(ctx, "CLUSTER", "SET-CONFIG-EPOCH", "5").Err()).To(
+			MatchError(ContainSubstring("does not know any other node")))
+	})
+
+	It("should move a slot with SETSLOT and MIGRATE", func() {
+		aID, bID := a.ClusterMyID(ctx).Val(), b.ClusterMyID(ctx).Val()
+		const slot = 5061 // bar
+		Expect(a.Set(ctx, "{bar}moved", "x", 0).Err()).To(Succeed())
+		Expect(a.ClusterCountKeysInSlot(ctx, slot).Val()).To(Equal(int64(2)))
+		Expect(a.ClusterGetKeysInSlot(ctx, slot, 10).Val()).To(ConsistOf("bar", "{bar}moved"))
+		Expect(a.ClusterGetKeysInSlot(ctx, slot, 1).Val()).To(HaveLen(1))
+		Expect(a.ClusterCountKeysInSlot(ctx, 16384).Err()).To(MatchError("ERR Invalid slot"))
+		Expect(a.ClusterGetKeysInSlot(ctx, slot, -1).Err()).To(
+			MatchError("ERR Invalid slot or number of keys"))
+
+		Expect(b.Do(ctx, "CLUSTER", "SETSLOT", slot, "MIGRATING", aID).Err()).To(
+			MatchError("ERR I'm not the owner of hash slot 5061"))
+		Expect(a.Do(ctx, "CLUSTER", "SETSLOT", slot, "IMPORTING", bID).Err()).To(
+			MatchError("ERR I'm already the owner of hash slot 5061"))
+		Expect(a.Do(ctx, "CLUSTER", "SETSLOT", slot, "MIGRATING", "nosuchnode").Err()).To(
+			MatchError("ERR I don't know about node nosuchnode"))
+		Expect(a.Do(ctx, "CLUSTER", "SETSLOT", slot, "STABLE", bID).Err()).To(
+			MatchError("ERR Invalid CLUSTER SETSLOT action or number of arguments. Try CLUSTER HELP"))
+		Expect(b.Do(ctx, "CLUSTER", "SETSLOT", slot, "IMPORTING", aID).Err()).To(Succeed())
+		Expect(a.Do(ctx, "CLUSTER", "SETSLOT", slot, "MIGRATING", bID).Err()).To(Succeed())
+		Expect(a.ClusterNodes(ctx).Val()).To(ContainSubstring(fmt.Sprintf("[%d->-%s]", slot, bID)))
+		Expect(b.ClusterNodes(ctx).Val()).To(ContainSubstring(fmt.Sprintf("[%d-<-%s]", slot, aID)))
+
+		// The keys still here are served here, the others are asked for on
+		// the importing node.
+		ask := fmt.Sprintf("ASK %d 127.0.0.1:%d", slot, second.Port())
+		Expect(a.Get(ctx, "bar").Val()).To(Equal("1"))
+		Expect(a.Get(ctx, "{bar}new").Err()).To(MatchError(ask))
+		Expect(a.Migrate(ctx, "127.0.0.1", strconv.Itoa(second.Port()), "{bar}moved", 0, 5*time.Second).Err()).To(Succeed())
+		Expect(a.Get(ctx, "{bar}moved").Err()).To(MatchError(ask))
+		Expect(a.Exists(ctx, "bar", "{bar}moved").Err()).To(
+			MatchError("TRYAGAIN Multiple keys request during rehashing of slot"))
+
+		// The importing node serves the slot only after ASKING, for one
+		// command.
+		conn := b.Conn()
+		defer conn.Close()
+		Expect(conn.Get(ctx, "{bar}moved").Err()).To(MatchError(HavePrefix("MOVED 5061")))
+		Expect(conn.Do(ctx, "ASKING").Err()).To(Succeed())
+		Expect(conn.Get(ctx, "{bar}moved").Val()).To(Equal("x"))
+		Expect(conn.Get(ctx, "{bar}moved").Err()).To(MatchError(HavePrefix("MOVED 5061")))
+		Expect(conn.Do(ctx, "ASKING").Err()).To(Succeed())
+		Expect(conn.Exists(ctx, "bar", "{bar}moved").Err()).To(
+			MatchError("TRYAGAIN Multiple keys request during rehashing of slot"))
+
+		cluster := redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs: []string{first.Addr()},
+		})
+		defer cluster.Close()
+		Expect(cluster.Get(ctx, "{bar}moved").Val()).To(Equal("x"))
+
+		// The slot is handed over once it is empty.
+		Expect(a.Do(ctx, "CLUSTER", "SETSLOT", slot, "NODE", bID).Err()).To(MatchError(
+			"ERR Can't assign hashslot 5061 to a different node while I still hold keys for this hash slot."))
+		Expect(a.Migrate(ctx, "127.0.0.1", strconv.Itoa(second.Port()), "bar", 0, 5*time.Second).Err()).To(Succeed())
+		Expect(a.ClusterCountKeysInSlot(ctx, slot).Val()).To(Equal(int64(0)))
+		Expect(b.ClusterCountKeysInSlot(ctx, slot).Val()).To(Equal(int64(2)))
+		Expect(b.Do(ctx, "CLUSTER", "SETSLOT", slot, "NODE", bID).Err()).To(Succeed())
+		Expect(a.Do(ctx, "CLUSTER", "SETSLOT", slot, "NODE", bID).Err()).To(Succeed())
+		Expect(a.ClusterNodes(ctx).Val()).NotTo(ContainSubstring("->-"))
+		Expect(b.ClusterNodes(ctx).Val()).NotTo(ContainSubstring("-<-"))
+
+		Expect(a.Get(ctx, "bar").Err()).To(
+			MatchError(fmt.Sprintf("MOVED 5061 127.0.0.1:%d", second.Port())))
+		Expect(b.Get(ctx, "bar").Val()).To(Equal("1"))
+		// The new epoch of the importing node makes its claim stick.
+		Eventually(func() string {
+			return clusterInfoField(ctx, a, "cluster_current_epoch")
+		}, 10*time.Second, 100*time.Millisecond).Should(Equal(clusterInfoField(ctx, b, "cluster_my_epoch")))
+		Consistently(func() error {
+			return a.Get(ctx, "bar").Err()
+		}, 2*time.Second, 200*time.Millisecond).Should(MatchError(HavePrefix("MOVED 5061")))
+	})
+})
+
+var _ = Describe("Cluster failover", Ordered, func() {
+	var servers [4]*util.Server
+	var buses [4]int
+	var clients [4]*redis.Client
+	var ids [4]string
+	var ctx context.Context
+
+	BeforeAll(func() {
+		skipIfExternal()
+		for i := range servers {
+			servers[i], buses[i] = startClusterNode()
+		}
+	})
+
+	AfterAll(func() {
+		for _, server := range servers {
+			if server != nil {
+				server.Stop()
+			}
+		}
+	})
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		for i, server := range servers {
+			clients[i] = server.NewClient()
+			ids[i] = clients[i].ClusterMyID(ctx).Val()
+		}
+	})
+
+	AfterEach(func() {
+		for _, rdb := range clients {
+			Expect(rdb.Close()).To(Succeed())
+		}
+	})
+
+	It("should discover nodes through gossip", func() {
+		Expect(clients[0].ClusterAddSlotsRange(ctx, 0, 5460).Err()).To(Succeed())
+		Expect(clients[1].ClusterAddSlotsRange(ctx, 5461, 10922).Err()).To(Succeed())
+		Expect(clients[2].ClusterAddSlotsRange(ctx, 10923, 16383).Err()).To(Succeed())
+		// Only the first node is told about the others.
+		for i := 1; i < len(servers); i++ {
+			Expect(clients[0].Do(ctx, "CLUSTER", "MEET", "127.0.0.1", servers[i].Port(), buses[i]).Err()).To(Succeed())
+		}
+		for _, rdb := range clients {
+			Eventually(func() string {
+				return clusterInfoField(ctx, rdb, "cluster_known_nodes")
+			}, 15*time.Second, 100*time.Millisecond).Should(Equal("4"))
+			Eventually(func() string {
+				return clusterInfoField(ctx, rdb, "cluster_state")
+			}, 15*time.Second, 100*time.Millisecond).Should(Equal("ok"))
+		}
+		Expect(clients[0].Set(ctx, "bar", "1", 0).Err()).To(Succeed())
+	})
+
+	It("should make a node the replica of a primary", func() {
+		Expect(clients[0].Do(ctx, "CLUSTER", "REPLICATE", ids[1]).Err()).To(
+			MatchError("ERR To set a master the node must be empty and without assigned slots."))
+		Expect(clients[3].Do(ctx, "CLUSTER", "REPLICATE", ids[3]).Err()).To(
+			MatchError("ERR Can't replicate myself"))
+		Expect(clients[3].Do(ctx, "CLUSTER", "REPLICATE", ids[0]).Err()).To(Succeed())
+		for _, rdb := range clients {
+			Eventually(func() string {
+				return clusterRole(ctx, rdb, ids[3])
+			}, 15*time.Second, 100*time.Millisecond).Should(Equal("slave " + ids[0]))
+		}
+		Expect(clusterNodeFields(ctx, clients[1], ids[3])[1]).To(
+			Equal(fmt.Sprintf("127.0.0.1:%d@%d", servers[3].Port(), buses[3])))
+		Expect(clients[1].Do(ctx, "CLUSTER", "REPLICAS", ids[0]).Val()).To(HaveLen(1))
+		Expect(clients[1].Do(ctx, "CLUSTER", "SLAVES", ids[3]).Err()).To(
+			MatchError("ERR The specified node is not a master"))
+		Expect(clients[3].Do(ctx, "REPLICAOF", "NO", "ONE").Err()).To(
+			MatchError("ERR REPLICAOF not allowed in cluster mode."))
+
+		slots, err := clients[2].ClusterSlots(ctx).Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(slots[0].Nodes).To(HaveLen(2))
+		Expect(slots[0].Nodes[1].ID).To(Equal(ids[3]))
+	})
+
+	It("should serve reads on a replica after READONLY", func() {
+		Expect(clients[3].Get(ctx, "bar").Err()).To(
+			MatchError(fmt.Sprintf("MOVED 5061 127.0.0.1:%d", servers[0].Port())))
+		conn := clients[3].Conn()
+		defer conn.Close()
+		Expect(conn.ReadOnly(ctx).Err()).To(Succeed())
+		Eventually(func() string {
+			return conn.Get(ctx, "bar").Val()
+		}, 15*time.Second, 100*time.Millisecond).Should(Equal("1"))
+		Expect(conn.Set(ctx, "bar", "2", 0).Err()).To(
+			MatchError(fmt.Sprintf("MOVED 5061 127.0.0.1:%d", servers[0].Port())))
+		Expect(conn.ReadWrite(ctx).Err()).To(Succeed())
+		Expect(conn.Get(ctx, "bar").Err()).To(MatchError(HavePrefix("MOVED 5061")))
+	})
+
+	It("should swap roles with CLUSTER FAILOVER", func() {
+		Expect(clients[0].Do(ctx, "CLUSTER", "FAILOVER").Err()).To(
+			MatchError("ERR You should send CLUSTER FAILOVER to a replica"))
+		Expect(clients[3].Do(ctx, "CLUSTER", "FAILOVER").Err()).To(Succeed())
+		for _, rdb := range clients {
+			Eventually(func() string {
+				return clusterRole(ctx, rdb, ids[0])
+			}, 15*time.Second, 100*time.Millisecond).Should(Equal("slave " + ids[3]))
+			Expect(clusterRole(ctx, rdb, ids[3])).To(Equal("master -"))
+		}
+		Expect(clients[3].Get(ctx, "bar").Val()).To(Equal("1"))
+		Expect(clients[3].Set(ctx, "bar", "2", 0).Err()).To(Succeed())
+		Expect(clients[0].Get(ctx, "bar").Err()).To(
+			MatchError(fmt.Sprintf("MOVED 5061 127.0.0.1:%d", servers[3].Port())))
+		Eventually(func() string {
+			return clients[0].Info(ctx, "replication").Val()
+		}, 15*time.Second, 100*time.Millisecond).Should(ContainSubstring("master_link_status:up"))
+	})
+
+	It("should promote the replica of a failed primary", func() {
+		Expect(servers[3].Halt()).To(Succeed())
+		for _, rdb := range clients[:3] {
+			Eventually(func() string {
+				return clusterRole(ctx, rdb, ids[0])
+			}, 20*time.Second, 100*time.Millisecond).Should(Equal("master -"))
+			Eventually(func() string {
+				return clusterRole(ctx, rdb, ids[3])
+			}, 20*time.Second, 100*time.Millisecond).Should(Equal("master,fail -"))
+			Eventually(func() string {
+				return clusterInfoField(ctx, rdb, "cluster_state")
+			}, 20*time.Second, 100*time.Millisecond).Should(Equal("ok"))
+		}
+		Expect(clients[0].Get(ctx, "bar").Val()).To(Equal("2"))
+		Expect(clients[0].Set(ctx, "bar", "3", 0).Err()).To(Succeed())
+		Expect(clients[1].Get(ctx, "bar").Err()).To(
+			MatchError(fmt.Sprintf("MOVED 5061 127.0.0.1:%d", servers[0].Port())))
+	})
+
+	It("should stop taking writes on a primary cut off from the others", func() {
+		Expect(servers[1].Halt()).To(Succeed())
+		Expect(servers[2].Halt()).To(Succeed())
+		Eventually(func() string {
+			return clusterInfoField(ctx, clients[0], "cluster_state")
+		}, 20*time.Second, 100*time.Millisecond).Should(Equal("fail"))
+		Expect(clients[0].Set(ctx, "bar", "4", 0).Err()).To(
+			MatchError("CLUSTERDOWN The cluster is down"))
+		Expect(clients[0].Ping(ctx).Err()).To(Succeed())
+	})
+})
@@ -2,6 +2,8 @@ package tests
 
 import (
 	"context"
+	"os"
+	"path/filepath"
 	"strconv"
 
 	"github.com/marsevilspirit/nimbis/e2e-test/util"
@@ -34,7 +36,7 @@ var _ = Describe("CONFIG Commands", func() {
 			result, err = rdb.ConfigGet(ctx, "port").Result()
 			Expect(err).NotTo(HaveOccurred())
 			Expect(result).To(HaveLen(1))
-			Expect(result).To(HaveKeyWithValue("port", "6379"))
+			Expect(result).To(HaveKeyWithValue("port", strconv.Itoa(util.Port())))
 		})
 
 		It("should get the object store URL", func() {
@@ -66,27 +68,71 @@ var _ = Describe("CONFIG Commands", func() {
 			Expect(result).To(HaveKeyWithValue("trace_enabled", "false"))
 		})
 
-		It("should return error for non-existent field", func() {
-			_, err := rdb.ConfigGet(ctx, "non_existent_field").Result()
-			Expect(err).To(HaveOccurred())
-			Expect(err.Error()).To(ContainSubstring("Field 'non_existent_field' not found"))
+		It("should return an empty map for a non-existent field", func() {
+			result, err := rdb.ConfigGet(ctx, "non_existent_field").Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(BeEmpty())
+		})
+
+		It("should get several parameters in one call", func() {
+			cmd := redis.NewMapStringStringCmd(ctx, "CONFIG", "GET", "port", "slowlog*", "PROTECTED_MODE", "port", "nothing")
+			Expect(rdb.Process(ctx, cmd)).To(Succeed())
+			Expect(cmd.Val()).To(Equal(map[string]string{
+				"port":                    strconv.Itoa(util.Port()),
+				"slowlog_log_slower_than": "10000",
+				"slowlog_max_len":         "128",
+				"protected_mode":          "true",
+			}))
+		})
+
+		It("should match full glob patterns", func() {
+			result, err := rdb.ConfigGet(ctx, "tls_[ck]*_file").Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(HaveLen(3))
+			Expect(result).To(HaveKey("tls_cert_file"))
+			Expect(result).To(HaveKey("tls_key_file"))
+			Expect(result).To(HaveKey("tls_ca_cert_file"))
+
+			result, err = rdb.ConfigGet(ctx, "tim?out").Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(HaveKeyWithValue("timeout", "0"))
 		})
 
 		It("should get all fields with * wildcard", func() {
 			result, err := rdb.ConfigGet(ctx, "*").Result()
 			Expect(err).NotTo(HaveOccurred())
-			// host, port, object_store_url, object_store_options, save, appendonly,
-			// log_level, log_output, log_rotation, trace_enabled, trace_endpoint,
+			// host, port, protected_mode, maxclients, timeout, tcp_keepalive, tcp_nodelay,
+			// tcp_backlog, proto_max_inline_len, proto_max_multibulk_len, proto_max_bulk_len, object_store_url, object_store_options, save, appendonly, appendfsync, log_level, log_output, log_rotation, trace_enabled, trace_endpoint,
 			// trace_sampling_ratio, trace_protocol, trace_export_timeout_seconds,
-			// trace_report_interval_ms, runtime_threads
-			Expect(result).To(HaveLen(16))
+			// trace_report_interval_ms, runtime_threads, io_threads, command_parallelism, slowlog_log_slower_than,
+			// slowlog_max_len, latency_monitor_threshold, latency_tracking, lua_time_limit,
+			// lfu_log_factor, lfu_decay_time, gc_interval_seconds, compaction_threads,
+			// compaction_interval_seconds, compaction_rate_limit, lazyfree_lazy_server_del, value_compression,
+			// value_compression_threshold, hot_cache_max_keys, hot_cache_max_value_size,
+			// disk_soft_limit_percent, disk_hard_limit_percent,
+			// repl_backlog_size, replica_read_only, masteruser, masterauth, cluster_enabled, cluster_port,
+			// cluster_node_timeout, cluster_require_full_coverage, client_output_buffer_limit, maxmemory,
+			// maxmemory_clients, aclfile, acllog_max_len, client_commands_per_second,
+			// user_commands_per_second, tls_port,
+			// tls_cert_file, tls_key_file, tls_ca_cert_file, tls_auth_clients, rename_command
+			Expect(result).To(HaveLen(67))
 			Expect(result).To(HaveKeyWithValue("host", "127.0.0.1"))
-			Expect(result).To(HaveKeyWithValue("port", "6379"))
+			Expect(result).To(HaveKeyWithValue("port", strconv.Itoa(util.Port())))
+			Expect(result).To(HaveKeyWithValue("protected_mode", "true"))
+			Expect(result).To(HaveKeyWithValue("maxclients", "10000"))
+			Expect(result).To(HaveKeyWithValue("timeout", "0"))
+			Expect(result).To(HaveKeyWithValue("tcp_keepalive", "300"))
+			Expect(result).To(HaveKeyWithValue("tcp_nodelay", "true"))
+			Expect(result).To(HaveKeyWithValue("tcp_backlog", "511"))
+			Expect(result).To(HaveKeyWithValue("proto_max_inline_len", "65536"))
+			Expect(result).To(HaveKeyWithValue("proto_max_multibulk_len", "1048576"))
+			Expect(result).To(HaveKeyWithValue("proto_max_bulk_len", "536870912"))
 			Expect(result).To(HaveKey("object_store_url"))
 			Expect(result["object_store_url"]).NotTo(BeEmpty())
 			Expect(result).To(HaveKey("object_store_options"))
 			Expect(result).To(HaveKeyWithValue("save", ""))
 			Expect(result).To(HaveKeyWithValue("appendonly", "no"))
+			Expect(result).To(HaveKeyWithValue("appendfsync", "everysec"))
 			Expect(result).To(HaveKeyWithValue("log_level", "info"))
 			Expect(result).To(HaveKeyWithValue("log_output", "terminal"))
 			Expect(result).To(HaveKeyWithValue("log_rotation", "daily"))
@@ -101,6 +147,48 @@ var _ = Describe("CONFIG Commands", func() {
 			workerThreadsInt, convErr := strconv.Atoi(workerThreads)
 			Expect(convErr).NotTo(HaveOccurred())
 			Expect(workerThreadsInt).To(BeNumerically(">", 0))
+			Expect(result).To(HaveKeyWithValue("io_threads", "0"))
+			Expect(result).To(HaveKeyWithValue("command_parallelism", "0"))
+			Expect(result).To(HaveKeyWithValue("slowlog_log_slower_than", "10000"))
+			Expect(result).To(HaveKeyWithValue("slowlog_max_len", "128"))
+			Expect(result).To(HaveKeyWithValue("latency_monitor_threshold", "0"))
+			Expect(result).To(HaveKeyWithValue("latency_tracking", "true"))
+			Expect(result).To(HaveKeyWithValue("lua_time_limit", "5000"))
+			Expect(result).To(HaveKeyWithValue("lfu_log_factor", "10"))
+			Expect(result).To(HaveKeyWithValue("lfu_decay_time", "1"))
+			Expect(result).To(HaveKeyWithValue("gc_interval_seconds", "600"))
+			Expect(result).To(HaveKeyWithValue("compaction_threads", "0"))
+			Expect(result).To(HaveKeyWithValue("compaction_interval_seconds", "0"))
+			Expect(result).To(HaveKeyWithValue("compaction_rate_limit", "0"))
+			Expect(result).To(HaveKeyWithValue("lazyfree_lazy_server_del", "true"))
+			Expect(result).To(HaveKeyWithValue("value_compression", "none"))
+			Expect(result).To(HaveKeyWithValue("value_compression_threshold", "1024"))
+			Expect(result).To(HaveKeyWithValue("hot_cache_max_keys", "0"))
+			Expect(result).To(HaveKeyWithValue("hot_cache_max_value_size", "1024"))
+			Expect(result).To(HaveKeyWithValue("disk_soft_limit_percent", "90"))
+			Expect(result).To(HaveKeyWithValue("disk_hard_limit_percent", "95"))
+			Expect(result).To(HaveKeyWithValue("repl_backlog_size", "1048576"))
+			Expect(result).To(HaveKeyWithValue("replica_read_only", "true"))
+			Expect(result).To(HaveKeyWithValue("masteruser", ""))
+			Expect(result).To(HaveKeyWithValue("masterauth", ""))
+			Expect(result).To(HaveKeyWithValue("cluster_enabled", "false"))
+			Expect(result).To(HaveKeyWithValue("cluster_port", "0"))
+			Expect(result).To(HaveKeyWithValue("cluster_node_timeout", "15000"))
+			Expect(result).To(HaveKeyWithValue("cluster_require_full_coverage", "true"))
+			Expect(result).To(HaveKeyWithValue("client_output_buffer_limit",
+				"normal 0 0 0 replica 268435456 67108864 60 pubsub 33554432 8388608 60"))
+			Expect(result).To(HaveKeyWithValue("maxmemory", "0"))
+			Expect(result).To(HaveKeyWithValue("maxmemory_clients", "0"))
+			Expect(result).To(HaveKeyWithValue("aclfile", ""))
+			Expect(result).To(HaveKeyWithValue("acllog_max_len", "128"))
+			Expect(result).To(HaveKeyWithValue("client_commands_per_second", "0"))
+			Expect(result).To(HaveKeyWithValue("user_commands_per_second", "0"))
+			Expect(result).To(HaveKeyWithValue("tls_port", "0"))
+			Expect(result).To(HaveKeyWithValue("tls_cert_file", ""))
+			Expect(result).To(HaveKeyWithValue("tls_key_file", ""))
+			Expect(result).To(HaveKeyWithValue("tls_ca_cert_file", ""))
+			Expect(result).To(HaveKeyWithValue("tls_auth_clients", "yes"))
+			Expect(result).To(HaveKeyWithValue("rename_command", "{}"))
 		})
 
 		It("should match fields with prefix wildcard", func() {
@@ -139,6 +227,20 @@ var _ = Describe("CONFIG Commands", func() {
 		})
 	})
 
+	Describe("CONFIG HELP", func() {
+		It("should list the subcommands", func() {
+			help, err := rdb.Do(ctx, "CONFIG", "HELP").StringSlice()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(help[0]).To(HavePrefix("CONFIG <subcommand>"))
+			Expect(help).To(ContainElements("RESETSTAT", "REWRITE", "HELP"))
+		})
+
+		It("should point unknown subcommands to HELP", func() {
+			err := rdb.Do(ctx, "CONFIG", "NOPE").Err()
+			Expect(err).To(MatchError("ERR unknown CONFIG subcommand 'NOPE'. Try CONFIG HELP."))
+		})
+	})
+
 	Describe("CONFIG SET", func() {
 		It("should fail to set immutable field 'host'", func() {
 			err := rdb.ConfigSet(ctx, "host", "localhost").Err()
@@ -228,10 +330,196 @@ var _ = Describe("CONFIG Commands", func() {
 			Expect(rdb.ConfigSet(ctx, "log_level", "info").Err()).To(Succeed())
 		})
 
+		It("should toggle protected_mode", func() {
+			Expect(rdb.ConfigSet(ctx, "protected_mode", "false").Err()).To(Succeed())
+			Expect(rdb.ConfigGet(ctx, "protected_mode").Val()).To(HaveKeyWithValue("protected_mode", "false"))
+
+			Expect(rdb.ConfigSet(ctx, "protected_mode", "true").Err()).To(Succeed())
+			Expect(rdb.ConfigGet(ctx, "protected_mode").Val()).To(HaveKeyWithValue("protected_mode", "true"))
+		})
+
 		It("should reject an invalid EnvFilter expression for log_level", func() {
 			err := rdb.ConfigSet(ctx, "log_level", "nimbis=verbose").Err()
 			Expect(err).To(HaveOccurred())
 			Expect(err.Error()).To(ContainSubstring("Invalid log level"))
 		})
+
+		It("should apply runtime settings and reject bad values", func() {
+			for _, setting := range []struct{ name, value, bad string }{
+				{"save", "900 1 300 10", "900"},
+				{"appendonly", "yes", "maybe"},
+				{"slowlog_log_slower_than", "5000", "slow"},
+				{"slowlog_max_len", "64", "-1"},
+				{"timeout", "300", "-1"},
+				{"maxmemory", "1073741824", "1gb"},
+			} {
+				before := rdb.ConfigGet(ctx, setting.name).Val()[setting.name]
+				Expect(rdb.ConfigSet(ctx, setting.name, setting.value).Err()).To(Succeed(), setting.name)
+				Expect(rdb.ConfigGet(ctx, setting.name).Val()).To(HaveKeyWithValue(setting.name, setting.value))
+
+				Expect(rdb.ConfigSet(ctx, setting.name, setting.bad).Err()).To(HaveOccurred(), setting.name)
+				Expect(rdb.ConfigGet(ctx, setting.name).Val()).To(HaveKeyWithValue(setting.name, setting.value))
+				Expect(rdb.ConfigSet(ctx, setting.name, before).Err()).To(Succeed(), setting.name)
+			}
+		})
+
+		It("should refuse writes but not reads or deletes over maxmemory", func() {
+			Expect(rdb.Set(ctx, "config:maxmemory", "v", 0).Err()).To(Succeed())
+			Expect(rdb.ConfigSet(ctx, "maxmemory", "1").Err()).To(Succeed())
+			DeferCleanup(func() {
+				Expect(rdb.ConfigSet(ctx, "maxmemory", "0").Err()).To(Succeed())
+			})
+
+			Eventually(func() error {
+				return rdb.Set(ctx, "config:maxmemory", "w", 0).Err()
+			}, "2s", "50ms").Should(MatchError(ContainSubstring("OOM command not allowed")))
+			Expect(rdb.Get(ctx, "config:maxmemory").Val()).To(Equal("v"))
+			Expect(rdb.Del(ctx, "config:maxmemory").Val()).To(Equal(int64(1)))
+
+			Expect(rdb.ConfigSet(ctx, "maxmemory", "0").Err()).To(Succeed())
+			Expect(rdb.Set(ctx, "config:maxmemory", "w", 0).Err()).To(Succeed())
+		})
+	})
+})
+
+var _ = Describe("CONFIG REWRITE", Ordered, func() {
+	var config string
+	var ctx context.Context
+
+	BeforeAll(func() {
+		skipIfExternal()
+		dir, err := os.MkdirTemp("", "nimbis-config-rewrite")
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(os.RemoveAll, dir)
+
+		config = filepath.Join(dir, "config.toml")
+		Expect(os.WriteFile(config, []byte(`# Rewritten by the e2e tests
+slowlog_max_len = 128 # entries
+`), 0o600)).To(Succeed())
+		ctx = context.Background()
+	})
+
+	AfterEach(util.StopServerWithConfig)
+
+	It("should persist runtime changes and keep comments", func() {
+		Expect(util.StartServerWithConfig(config)).To(Succeed())
+		rdb := util.NewConfigServerClient()
+		defer rdb.Close()
+
+		Expect(rdb.ConfigSet(ctx, "slowlog_max_len", "64").Err()).To(Succeed())
+		Expect(rdb.ConfigSet(ctx, "timeout", "300").Err()).To(Succeed())
+		Expect(rdb.ConfigRewrite(ctx).Err()).To(Succeed())
+
+		content, err := os.ReadFile(config)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(content)).To(ContainSubstring("# Rewritten by the e2e tests\n"))
+		Expect(string(content)).To(ContainSubstring("slowlog_max_len = 64 # entries\n"))
+		Expect(string(content)).To(ContainSubstring("timeout = 300\n"))
+		// The port comes from the command line and is never written.
+		Expect(string(content)).NotTo(ContainSubstring("port"))
+	})
+
+	It("should start with the rewritten settings", func() {
+		Expect(util.StartServerWithConfig(config)).To(Succeed())
+		rdb := util.NewConfigServerClient()
+		defer rdb.Close()
+
+		Expect(rdb.ConfigGet(ctx, "slowlog_max_len").Val()).To(HaveKeyWithValue("slowlog_max_len", "64"))
+		Expect(rdb.ConfigGet(ctx, "timeout").Val()).To(HaveKeyWithValue("timeout", "300"))
+	})
+})
+
+var _ = Describe("Config Sources", Ordered, func() {
+	var rdb *redis.Client
+	var ctx context.Context
+	var config string
+
+	BeforeAll(func() {
+		skipIfExternal()
+		dir, err := os.MkdirTemp("", "nimbis-config-sources")
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(os.RemoveAll, dir)
+
+		config = filepath.Join(dir, "nimbis.conf")
+		Expect(os.WriteFile(config, []byte(`# redis.conf style
+port 7000
+object-store-url file:from_the_file
+slowlog-max-len 64
+protected-mode no
+save "900 1"
+`), 0o600)).To(Succeed())
+
+		Expect(util.StartServerWithConfig(config)).To(Succeed())
+		DeferCleanup(util.StopServerWithConfig)
+		rdb = util.NewConfigServerClient()
+		DeferCleanup(rdb.Close)
+		ctx = context.Background()
+	})
+
+	It("should load a redis.conf style file", func() {
+		values := rdb.ConfigGet(ctx, "*").Val()
+		Expect(values).To(HaveKeyWithValue("slowlog_max_len", "64"))
+		Expect(values).To(HaveKeyWithValue("protected_mode", "false"))
+		Expect(values).To(HaveKeyWithValue("save", "900 1"))
+	})
+
+	It("should let the environment and flags override the file", func() {
+		values := rdb.ConfigGet(ctx, "*").Val()
+		// The harness sets NIMBIS_OBJECT_STORE_URL and passes --port.
+		Expect(values).To(HaveKeyWithValue("object_store_url", "file:"+util.ConfigServerDataDir()))
+		Expect(values).To(HaveKeyWithValue("port", strconv.Itoa(util.ConfigServerPort())))
+	})
+
+	It("should report the config file", func() {
+		info, err := rdb.Info(ctx, "server").Result()
+		Expect(err).NotTo(HaveOccurred())
+		// The path is canonical, and temporary directories may be symlinks.
+		path, err := filepath.EvalSymlinks(config)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(infoField(info, "config_file")).To(Equal(path))
+	})
+})
+
+var _ = Describe("Server Options", func() {
+	var ctx context.Context
+
+	BeforeEach(func() {
+		skipIfExternal()
+		ctx = context.Background()
+	})
+
+	It("should start with config overrides on the given data directory", func() {
+		dir, err := os.MkdirTemp("", "nimbis-server-options")
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(os.RemoveAll, dir)
+
+		server, err := util.StartServerWithOptions(0, map[string]string{
+			"maxmemory":       "1048576",
+			"slowlog_max_len": "7",
+		}, dir)
+		Expect(err).NotTo(HaveOccurred())
+		defer server.Stop()
+		rdb := server.NewClient()
+		defer rdb.Close()
+		values := rdb.ConfigGet(ctx, "*").Val()
+		Expect(values).To(HaveKeyWithValue("port", strconv.Itoa(server.Port())))
+		Expect(values).To(HaveKeyWithValue("maxmemory", "1048576"))
+		Expect(values).To(HaveKeyWithValue("slowlog_max_len", "7"))
+		Expect(values).To(HaveKeyWithValue("object_store_url", "file:"+server.DataDir()))
+
+		Expect(rdb.Set(ctx, "options_key", "value", 0).Err()).To(Succeed())
+		Expect(rdb.Save(ctx).Err()).To(Succeed())
+		entries, err := os.ReadDir(dir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).NotTo(BeEmpty())
+	})
+
+	It("should remove a temporary data directory when stopped", func() {
+		server, err := util.StartServerWithOptions(0, nil, "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(server.DataDir()).To(BeADirectory())
+
+		server.Stop()
+		Expect(server.DataDir()).NotTo(BeAnExistingFile())
 	})
 })
@@ -0,0 +1,132 @@
+package tests
+
+import (
+	"context"
+
+	"github.com/marsevilspirit/nimbis/e2e-test/util"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/redis/go-redis/v9"
+)
+
+const functionLibrary = `#!lua name=e2elib
+redis.register_function('e2e_set', function(keys, args)
+	redis.call('SET', keys[1], args[1])
+	return redis.call('GET', keys[1])
+end)
+redis.register_function{
+	function_name = 'e2e_echo',
+	callback = function(keys, args) return args[1] end,
+	flags = {'no-writes'},
+	description = 'echo the first argument',
+}
+`
+
+var _ = Describe("Function Commands", func() {
+	var rdb *redis.Client
+	var ctx context.Context
+
+	BeforeEach(func() {
+		rdb = util.NewClient()
+		ctx = context.Background()
+		Expect(rdb.FlushDB(ctx).Err()).To(Succeed())
+		Expect(rdb.FunctionFlush(ctx).Err()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(rdb.FunctionFlush(ctx).Err()).To(Succeed())
+		Expect(rdb.Close()).To(Succeed())
+	})
+
+	It("should load a library and call its functions", func() {
+		Expect(rdb.FunctionLoad(ctx, functionLibrary).Val()).To(Equal("e2elib"))
+
+		result, err := rdb.FCall(ctx, "e2e_set", []string{"fn:key"}, "value").Text()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal("value"))
+		Expect(rdb.Get(ctx, "fn:key").Val()).To(Equal("value"))
+
+		Expect(rdb.FCall(ctx, "e2e_echo", nil, "hello").Val()).To(Equal("hello"))
+		Expect(rdb.FCall(ctx, "missing", nil).Err()).To(MatchError("ERR Function not found"))
+	})
+
+	It("should only run no-writes functions with FCALL_RO", func() {
+		Expect(rdb.FunctionLoad(ctx, functionLibrary).Err()).To(Succeed())
+		Expect(rdb.FCallRO(ctx, "e2e_echo", nil, "ro").Val()).To(Equal("ro"))
+
+		err := rdb.FCallRO(ctx, "e2e_set", []string{"fn:key"}, "value").Err()
+		Expect(err).To(MatchError("ERR Can not execute a script with write flag using *_ro command."))
+		Expect(rdb.Exists(ctx, "fn:key").Val()).To(Equal(int64(0)))
+	})
+
+	It("should reject writes from no-writes functions", func() {
+		library := `#!lua name=e2erolib
+redis.register_function{
+	function_name = 'e2e_sneaky_set',
+	callback = function(keys, args) return redis.call('SET', keys[1], 'v') end,
+	flags = {'no-writes'},
+}
+`
+		Expect(rdb.FunctionLoad(ctx, library).Err()).To(Succeed())
+		err := rdb.FCall(ctx, "e2e_sneaky_set", []string{"fn:key"}).Err()
+		Expect(err).To(MatchError(ContainSubstring("Write commands are not allowed from read-only scripts")))
+		Expect(rdb.Exists(ctx, "fn:key").Val()).To(Equal(int64(0)))
+	})
+
+	It("should reject duplicate libraries unless REPLACE is given", func() {
+		Expect(rdb.FunctionLoad(ctx, functionLibrary).Err()).To(Succeed())
+		Expect(rdb.FunctionLoad(ctx, functionLibrary).Err()).To(MatchError("ERR Library 'e2elib' already exists"))
+		Expect(rdb.FunctionLoadReplace(ctx, functionLibrary).Val()).To(Equal("e2elib"))
+	})
+
+	It("should reject invalid libraries", func() {
+		Expect(rdb.FunctionLoad(ctx, "return 1").Err()).To(MatchError("ERR Missing library metadata"))
+		Expect(rdb.FunctionLoad(ctx, "#!lua name=empty\nlocal x = 1").Err()).To(MatchError("ERR No functions registered"))
+	})
+
+	It("should list libraries", func() {
+		Expect(rdb.FunctionLoad(ctx, functionLibrary).Err()).To(Succeed())
+
+		libraries, err := rdb.FunctionList(ctx, redis.FunctionListQuery{WithCode: true}).Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(libraries).To(HaveLen(1))
+		Expect(libraries[0].Name).To(Equal("e2elib"))
+		Expect(libraries[0].Engine).To(Equal("LUA"))
+		Expect(libraries[0].Code).To(Equal(functionLibrary))
+		Expect(libraries[0].Functions).To(Equal([]redis.Function{
+			{Name: "e2e_echo", Description: "echo the first argument", Flags: []string{"no-writes"}},
+			{Name: "e2e_set", Flags: []string{}},
+		}))
+
+		libraries, err = rdb.FunctionList(ctx, redis.FunctionListQuery{LibraryNamePattern: "other*"}).Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(libraries).To(BeEmpty())
+	})
+
+	It("should dump and restore libraries", func() {
+		Expect(rdb.FunctionLoad(ctx, functionLibrary).Err()).To(Succeed())
+		payload, err := rdb.FunctionDump(ctx).Result()
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(rdb.FunctionRestore(ctx, payload).Err()).To(MatchError("ERR Library 'e2elib' already exists"))
+		Expect(rdb.FunctionFlush(ctx).Err()).To(Succeed())
+		Expect(rdb.FCall(ctx, "e2e_echo", nil, "x").Err()).To(MatchError("ERR Function not found"))
+
+		Expect(rdb.FunctionRestore(ctx, payload).Err()).To(Succeed())
+		Expect(rdb.FCall(ctx, "e2e_echo", nil, "x").Val()).To(Equal("x"))
+		Expect(rdb.FunctionRestore(ctx, "garbage").Err()).To(MatchError("ERR payload version or checksum are wrong"))
+	})
+
+	It("should delete libraries", func() {
+		Expect(rdb.FunctionLoad(ctx, functionLibrary).Err()).To(Succeed())
+		Expect(rdb.FunctionDelete(ctx, "e2elib").Err()).To(Succeed())
+		Expect(rdb.FunctionDelete(ctx, "e2elib").Err()).To(MatchError("ERR Library not found"))
+		Expect(rdb.FCall(ctx, "e2e_set", []string{"fn:key"}, "v").Err()).To(MatchError("ERR Function not found"))
+	})
+
+	It("should keep libraries across FLUSHDB", func() {
+		Expect(rdb.FunctionLoad(ctx, functionLibrary).Err()).To(Succeed())
+		Expect(rdb.FlushDB(ctx).Err()).To(Succeed())
+		Expect(rdb.FCall(ctx, "e2e_echo", nil, "kept").Val()).To(Equal("kept"))
+	})
+})
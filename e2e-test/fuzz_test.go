@@ -0,0 +1,127 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/marsevilspirit/nimbis/e2e-test/util"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/redis/go-redis/v9"
+)
+
+// fuzzAliveTimeout is how long the server may take to answer PING after a
+// frame before it counts as hung.
+const fuzzAliveTimeout = 2 * time.Second
+
+// fuzzSettings reads the seed and number of frames of a fuzz run from
+// FUZZ_SEED and FUZZ_ITERATIONS, so a failing run can be repeated exactly.
+func fuzzSettings() (uint64, int) {
+	seed := uint64(time.Now().UnixNano())
+	if env := os.Getenv("FUZZ_SEED"); env != "" {
+		parsed, err := strconv.ParseUint(env, 10, 64)
+		Expect(err).NotTo(HaveOccurred(), "FUZZ_SEED")
+		seed = parsed
+	}
+	iterations := 300
+	if env := os.Getenv("FUZZ_ITERATIONS"); env != "" {
+		parsed, err := strconv.Atoi(env)
+		Expect(err).NotTo(HaveOccurred(), "FUZZ_ITERATIONS")
+		iterations = parsed
+	}
+	return seed, iterations
+}
+
+// fuzzAlive checks that rdb is still answered promptly.
+func fuzzAlive(rdb *redis.Client) error {
+	ctx, cancel := context.WithTimeout(context.Background(), fuzzAliveTimeout)
+	defer cancel()
+	return rdb.Ping(ctx).Err()
+}
+
+var _ = Describe("Protocol Fuzzing", func() {
+	var rdb *redis.Client
+	ctx := context.Background()
+
+	BeforeEach(func() {
+		rdb = util.NewClient()
+		Expect(rdb.Ping(ctx).Err()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		rdb.Close()
+	})
+
+	connectedClients := func() int {
+		value, err := util.InfoField(rdb, "clients", "connected_clients")
+		Expect(err).NotTo(HaveOccurred())
+		connected, err := strconv.Atoi(value)
+		Expect(err).NotTo(HaveOccurred())
+		return connected
+	}
+
+	It("should survive random and malformed frames without leaking connections", func() {
+		seed, iterations := fuzzSettings()
+		GinkgoWriter.Printf("Fuzzing with FUZZ_SEED=%d FUZZ_ITERATIONS=%d\n", seed, iterations)
+		rng := rand.New(rand.NewPCG(seed, seed))
+		baseline := connectedClients()
+
+		for i := range iterations {
+			frame := util.RandomFrame(rng)
+			err := util.SendFrame(util.Addr(), frame)
+			if err == nil {
+				err = fuzzAlive(rdb)
+			}
+			if err != nil {
+				path, saveErr := util.SaveFuzzReproducer(frame)
+				Fail(fmt.Sprintf("frame %d of FUZZ_SEED=%d broke the server: %v\nframe: %q\nreproducer: %s (%v)",
+					i, seed, err, frame, path, saveErr))
+			}
+		}
+
+		Eventually(connectedClients, 5*time.Second, 50*time.Millisecond).Should(
+			BeNumerically("<=", baseline),
+			fmt.Sprintf("connections of FUZZ_SEED=%d were not closed", seed))
+	})
+})
+
+// FuzzProtocol sends each input as raw bytes to a server of its own and
+// checks that the server still answers PING afterwards. Plain go test runs
+// the seeds below and the reproducers the Protocol Fuzzing spec saved in
+// testdata/fuzz/FuzzProtocol; to search for new ones, run
+//
+//	go test -run '^$' -fuzz FuzzProtocol -fuzztime 5m
+func FuzzProtocol(f *testing.F) {
+	if util.External() {
+		f.Skip("starts a server of its own")
+	}
+	server, err := util.StartServerWithOptions(0, nil, "")
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Cleanup(server.Stop)
+	rdb := server.NewClient()
+	f.Cleanup(func() { _ = rdb.Close() })
+
+	f.Add([]byte(util.EncodeCommand("SET", "fuzz:string", "value")))
+	f.Add([]byte("PING\r\nPING hello\r\n"))
+	f.Add([]byte("*2\r\n$3\r\nGET\r\n$-1\r\n"))
+	f.Add([]byte("*1\r\n$x\r\n"))
+	f.Add([]byte("*2147483648\r\n"))
+	f.Add([]byte("*3\r\n$3\r\nSET\r\n$1\r\nk"))
+	f.Add([]byte("\"unbalanced quote\r\n"))
+
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		if err := util.SendFrame(server.Addr(), frame); err != nil {
+			t.Fatal(err)
+		}
+		if err := fuzzAlive(rdb); err != nil {
+			t.Fatalf("server stopped answering after %q: %v", frame, err)
+		}
+	})
+}
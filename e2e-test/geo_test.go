@@ -0,0 +1,202 @@
+package tests
+
+import (
+	"context"
+
+	"github.com/marsevilspirit/nimbis/e2e-test/util"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/redis/go-redis/v9"
+)
+
+var _ = Describe("Geo Commands", func() {
+	var rdb *redis.Client
+	var ctx context.Context
+
+	BeforeEach(func() {
+		rdb = util.NewClient()
+		ctx = context.Background()
+		Expect(rdb.Ping(ctx).Err()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(rdb.Close()).To(Succeed())
+	})
+
+	addSicily := func(key string) {
+		rdb.Del(ctx, key)
+		added := rdb.GeoAdd(ctx, key,
+			&redis.GeoLocation{Name: "Palermo", Longitude: 13.361389, Latitude: 38.115556},
+			&redis.GeoLocation{Name: "Catania", Longitude: 15.087269, Latitude: 37.502669},
+		).Val()
+		Expect(added).To(Equal(int64(2)))
+	}
+
+	It("should GEOADD with geohash scores", func() {
+		key := "geo_add_key"
+		addSicily(key)
+
+		Expect(rdb.ZScore(ctx, key, "Palermo").Val()).To(Equal(float64(3479099956230698)))
+		Expect(rdb.ZScore(ctx, key, "Catania").Val()).To(Equal(float64(3479447370796909)))
+		Expect(rdb.ZCard(ctx, key).Val()).To(Equal(int64(2)))
+	})
+
+	It("should GEOADD with NX, XX and CH", func() {
+		key := "geo_options_key"
+		addSicily(key)
+
+		res, err := rdb.Do(ctx, "GEOADD", key, "NX", "13", "38", "Palermo", "14", "37", "Agrigento").Int64()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res).To(Equal(int64(1)))
+
+		res, err = rdb.Do(ctx, "GEOADD", key, "XX", "CH", "13", "38", "Palermo", "12", "37", "Trapani").Int64()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res).To(Equal(int64(1)))
+		Expect(rdb.ZCard(ctx, key).Val()).To(Equal(int64(3)))
+
+		err = rdb.Do(ctx, "GEOADD", key, "NX", "XX", "13", "38", "Palermo").Err()
+		Expect(err).To(MatchError(ContainSubstring("not compatible")))
+	})
+
+	It("should reject invalid GEOADD coordinates", func() {
+		key := "geo_invalid_key"
+		rdb.Del(ctx, key)
+
+		err := rdb.Do(ctx, "GEOADD", key, "181", "10", "m").Err()
+		Expect(err).To(MatchError(ContainSubstring("invalid longitude,latitude pair 181.000000,10.000000")))
+		err = rdb.Do(ctx, "GEOADD", key, "10", "86", "m").Err()
+		Expect(err).To(MatchError(ContainSubstring("invalid longitude,latitude pair")))
+		err = rdb.Do(ctx, "GEOADD", key, "10", "20", "m", "30").Err()
+		Expect(err).To(MatchError(ContainSubstring("syntax error")))
+		Expect(rdb.Exists(ctx, key).Val()).To(Equal(int64(0)))
+	})
+
+	It("should GEOPOS", func() {
+		key := "geo_pos_key"
+		addSicily(key)
+
+		res, err := rdb.Do(ctx, "GEOPOS", key, "Palermo", "missing").Slice()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res).To(Equal([]interface{}{
+			[]interface{}{"13.36138933897018433", "38.11555639549629859"},
+			nil,
+		}))
+		Expect(rdb.GeoPos(ctx, "geo_missing_key", "Palermo").Val()).To(Equal([]*redis.GeoPos{nil}))
+	})
+
+	It("should GEODIST in every unit", func() {
+		key := "geo_dist_key"
+		addSicily(key)
+
+		Expect(rdb.Do(ctx, "GEODIST", key, "Palermo", "Catania").Val()).To(Equal("166274.1516"))
+		Expect(rdb.GeoDist(ctx, key, "Palermo", "Catania", "m").Val()).To(Equal(166274.1516))
+		Expect(rdb.GeoDist(ctx, key, "Palermo", "Catania", "km").Val()).To(Equal(166.2742))
+		Expect(rdb.GeoDist(ctx, key, "Palermo", "Catania", "mi").Val()).To(Equal(103.3182))
+		Expect(rdb.GeoDist(ctx, key, "Palermo", "Catania", "ft").Val()).To(Equal(545518.8700))
+
+		Expect(rdb.GeoDist(ctx, key, "Palermo", "missing", "m").Err()).To(Equal(redis.Nil))
+		err := rdb.GeoDist(ctx, key, "Palermo", "Catania", "yd").Err()
+		Expect(err).To(MatchError(ContainSubstring("unsupported unit provided")))
+	})
+
+	It("should GEOHASH", func() {
+		key := "geo_hash_key"
+		addSicily(key)
+
+		res, err := rdb.Do(ctx, "GEOHASH", key, "Palermo", "Catania", "missing").Slice()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res).To(Equal([]interface{}{"sqc8b49rny0", "sqdtr74hyu0", nil}))
+	})
+
+	It("should GEOSEARCH by radius and box", func() {
+		key := "geo_search_key"
+		addSicily(key)
+		rdb.GeoAdd(ctx, key,
+			&redis.GeoLocation{Name: "edge1", Longitude: 12.758489, Latitude: 38.788135},
+			&redis.GeoLocation{Name: "edge2", Longitude: 17.241510, Latitude: 38.788135},
+		)
+
+		res, err := rdb.Do(ctx, "GEOSEARCH", key, "FROMLONLAT", "15", "37", "BYRADIUS", "200", "km", "ASC").Slice()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res).To(Equal([]interface{}{"Catania", "Palermo"}))
+
+		res, err = rdb.Do(ctx, "GEOSEARCH", key, "FROMLONLAT", "15", "37", "BYBOX", "400", "400", "km", "ASC", "WITHDIST", "WITHHASH").Slice()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res).To(Equal([]interface{}{
+			[]interface{}{"Catania", "56.4413", int64(3479447370796909)},
+			[]interface{}{"Palermo", "190.4424", int64(3479099956230698)},
+			[]interface{}{"edge2", "279.7403", int64(3481342659049484)},
+			[]interface{}{"edge1", "279.7405", int64(3479273021651468)},
+		}))
+
+		res, err = rdb.Do(ctx, "GEOSEARCH", key, "FROMMEMBER", "Palermo", "BYRADIUS", "1", "m", "WITHCOORD").Slice()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res).To(HaveLen(1))
+		item := res[0].([]interface{})
+		Expect(item[0]).To(Equal("Palermo"))
+		Expect(item[1]).To(HaveLen(2))
+	})
+
+	It("should GEOSEARCH with COUNT and ANY", func() {
+		key := "geo_search_count_key"
+		addSicily(key)
+
+		res, err := rdb.Do(ctx, "GEOSEARCH", key, "FROMLONLAT", "15", "37", "BYRADIUS", "500", "km", "COUNT", "1").Slice()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res).To(Equal([]interface{}{"Catania"}))
+
+		res, err = rdb.Do(ctx, "GEOSEARCH", key, "FROMLONLAT", "15", "37", "BYRADIUS", "500", "km", "DESC", "COUNT", "1").Slice()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res).To(Equal([]interface{}{"Palermo"}))
+
+		res, err = rdb.Do(ctx, "GEOSEARCH", key, "FROMLONLAT", "15", "37", "BYRADIUS", "500", "km", "COUNT", "1", "ANY").Slice()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res).To(HaveLen(1))
+
+		res, err = rdb.Do(ctx, "GEOSEARCH", "geo_search_missing", "FROMMEMBER", "a", "BYRADIUS", "1", "km").Slice()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res).To(BeEmpty())
+	})
+
+	It("should reject invalid GEOSEARCH arguments", func() {
+		key := "geo_search_err_key"
+		addSicily(key)
+
+		err := rdb.Do(ctx, "GEOSEARCH", key, "BYRADIUS", "1", "km", "ASC").Err()
+		Expect(err).To(MatchError(ContainSubstring("exactly one of FROMMEMBER or FROMLONLAT")))
+
+		err = rdb.Do(ctx, "GEOSEARCH", key, "FROMMEMBER", "Palermo", "ASC").Err()
+		Expect(err).To(MatchError(ContainSubstring("exactly one of BYRADIUS and BYBOX")))
+
+		err = rdb.Do(ctx, "GEOSEARCH", key, "FROMMEMBER", "Palermo", "BYRADIUS", "1", "km", "ANY").Err()
+		Expect(err).To(MatchError(ContainSubstring("ANY argument requires COUNT")))
+
+		err = rdb.Do(ctx, "GEOSEARCH", key, "FROMMEMBER", "missing", "BYRADIUS", "1", "km").Err()
+		Expect(err).To(MatchError(ContainSubstring("could not decode requested zset member")))
+
+		err = rdb.Do(ctx, "GEOSEARCH", key, "FROMMEMBER", "Palermo", "BYRADIUS", "1", "km", "STOREDIST").Err()
+		Expect(err).To(MatchError(ContainSubstring("syntax error")))
+	})
+
+	It("should GEOSEARCHSTORE", func() {
+		key := "geo_store_src"
+		dest := "geo_store_dest"
+		addSicily(key)
+		rdb.Set(ctx, dest, "overwritten", 0)
+
+		n, err := rdb.Do(ctx, "GEOSEARCHSTORE", dest, key, "FROMLONLAT", "15", "37", "BYRADIUS", "200", "km").Int64()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n).To(Equal(int64(2)))
+		Expect(rdb.ZScore(ctx, dest, "Palermo").Val()).To(Equal(float64(3479099956230698)))
+
+		n, err = rdb.Do(ctx, "GEOSEARCHSTORE", dest, key, "FROMLONLAT", "15", "37", "BYRADIUS", "200", "km", "STOREDIST").Int64()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n).To(Equal(int64(2)))
+		Expect(rdb.ZScore(ctx, dest, "Catania").Val()).To(BeNumerically("~", 56.4413, 0.0001))
+
+		n, err = rdb.Do(ctx, "GEOSEARCHSTORE", dest, "geo_store_missing", "FROMLONLAT", "15", "37", "BYRADIUS", "200", "km").Int64()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n).To(Equal(int64(0)))
+		Expect(rdb.Exists(ctx, dest).Val()).To(Equal(int64(0)))
+	})
+})
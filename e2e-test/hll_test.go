@@ -0,0 +1,104 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/marsevilspirit/nimbis/e2e-test/util"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/redis/go-redis/v9"
+)
+
+var _ = Describe("HyperLogLog Commands", func() {
+	var rdb *redis.Client
+	var ctx context.Context
+
+	BeforeEach(func() {
+		rdb = util.NewClient()
+		ctx = context.Background()
+		Expect(rdb.Ping(ctx).Err()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(rdb.Close()).To(Succeed())
+	})
+
+	It("should PFADD and PFCOUNT", func() {
+		key := "hll_pfadd_key"
+		rdb.Del(ctx, key)
+
+		Expect(rdb.PFAdd(ctx, key, "a", "b", "c").Val()).To(Equal(int64(1)))
+		Expect(rdb.PFAdd(ctx, key, "a", "b").Val()).To(Equal(int64(0)))
+		Expect(rdb.PFCount(ctx, key).Val()).To(Equal(int64(3)))
+		Expect(rdb.Get(ctx, key).Val()).To(HavePrefix("HYLL"))
+
+		empty := "hll_empty_key"
+		rdb.Del(ctx, empty)
+		Expect(rdb.PFAdd(ctx, empty).Val()).To(Equal(int64(1)))
+		Expect(rdb.PFCount(ctx, empty).Val()).To(Equal(int64(0)))
+		Expect(rdb.PFCount(ctx, "hll_missing_key").Val()).To(Equal(int64(0)))
+	})
+
+	It("should estimate large cardinalities", func() {
+		key := "hll_large_key"
+		rdb.Del(ctx, key)
+
+		elements := make([]interface{}, 0, 20000)
+		for i := range 20000 {
+			elements = append(elements, fmt.Sprintf("visitor:%d", i))
+		}
+		Expect(rdb.PFAdd(ctx, key, elements...).Err()).NotTo(HaveOccurred())
+		Expect(rdb.PFCount(ctx, key).Val()).To(BeNumerically("~", 20000, 400))
+		// Past the sparse limit the value is dense: header plus 12288 bytes.
+		Expect(rdb.Get(ctx, key).Val()).To(HaveLen(12304))
+	})
+
+	It("should PFMERGE and count unions", func() {
+		a, b, dest := "hll_merge_a", "hll_merge_b", "hll_merge_dest"
+		rdb.Del(ctx, a, b, dest)
+
+		rdb.PFAdd(ctx, a, "1", "2", "3")
+		rdb.PFAdd(ctx, b, "3", "4")
+		Expect(rdb.PFCount(ctx, a, b).Val()).To(Equal(int64(4)))
+		Expect(rdb.PFMerge(ctx, dest, a, b, "hll_merge_missing").Val()).To(Equal("OK"))
+		Expect(rdb.PFCount(ctx, dest).Val()).To(Equal(int64(4)))
+
+		// The destination is merged too.
+		rdb.PFAdd(ctx, dest, "5")
+		Expect(rdb.PFMerge(ctx, dest, a).Val()).To(Equal("OK"))
+		Expect(rdb.PFCount(ctx, dest).Val()).To(Equal(int64(5)))
+	})
+
+	It("should read HyperLogLogs in the Redis format", func() {
+		key := "hll_redis_format_key"
+		// Sparse, stale cache, register 0 set to 1 and 16383 zero registers.
+		value := "HYLL\x01\x00\x00\x00" + "\x00\x00\x00\x00\x00\x00\x00\x80" + "\x80\x7f\xfe"
+		rdb.Set(ctx, key, value, 0)
+		Expect(rdb.PFCount(ctx, key).Val()).To(Equal(int64(1)))
+
+		// A valid cached cardinality is returned as is.
+		value = "HYLL\x01\x00\x00\x00" + "\x2a\x00\x00\x00\x00\x00\x00\x00" + "\x80\x7f\xfe"
+		rdb.Set(ctx, key, value, 0)
+		Expect(rdb.PFCount(ctx, key).Val()).To(Equal(int64(42)))
+	})
+
+	It("should reject values that are not HyperLogLogs", func() {
+		key := "hll_invalid_key"
+		rdb.Set(ctx, key, "plain string", 0)
+
+		err := rdb.PFAdd(ctx, key, "a").Err()
+		Expect(err).To(MatchError(ContainSubstring("WRONGTYPE Key is not a valid HyperLogLog string value")))
+		err = rdb.PFCount(ctx, key).Err()
+		Expect(err).To(MatchError(ContainSubstring("WRONGTYPE")))
+
+		rdb.Set(ctx, key, "HYLL\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x80\x7f", 0)
+		err = rdb.PFCount(ctx, key).Err()
+		Expect(err).To(MatchError(ContainSubstring("INVALIDOBJ")))
+
+		rdb.Del(ctx, key)
+		rdb.HSet(ctx, key, "field", "value")
+		err = rdb.PFMerge(ctx, key, "hll_merge_a").Err()
+		Expect(err).To(MatchError(ContainSubstring("WRONGTYPE")))
+	})
+})
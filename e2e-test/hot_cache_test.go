@@ -0,0 +1,104 @@
+package tests
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/marsevilspirit/nimbis/e2e-test/util"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/redis/go-redis/v9"
+)
+
+var _ = Describe("Hot Cache", Ordered, func() {
+	var rdb *redis.Client
+	var ctx context.Context
+
+	BeforeAll(func() {
+		skipIfExternal()
+		dir, err := os.MkdirTemp("", "nimbis-hot-cache")
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(os.RemoveAll, dir)
+
+		config := filepath.Join(dir, "config.toml")
+		Expect(os.WriteFile(config, []byte(`
+hot_cache_max_keys = 100
+hot_cache_max_value_size = 64
+`), 0o600)).To(Succeed())
+
+		Expect(util.StartServerWithConfig(config)).To(Succeed())
+		DeferCleanup(util.StopServerWithConfig)
+	})
+
+	BeforeEach(func() {
+		rdb = util.NewConfigServerClient()
+		ctx = context.Background()
+		Expect(rdb.FlushDB(ctx).Err()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(rdb.Close()).To(Succeed())
+	})
+
+	stats := func() string {
+		info, err := rdb.Info(ctx, "stats").Result()
+		Expect(err).NotTo(HaveOccurred())
+		return info
+	}
+
+	It("should answer repeated reads from the cache", func() {
+		Expect(infoField(stats(), "hot_cache_max_keys")).To(Equal("100"))
+		Expect(rdb.Set(ctx, "hot", "v1", 0).Err()).To(Succeed())
+		hits := infoField(stats(), "hot_cache_hits")
+
+		for range 10 {
+			Expect(rdb.Get(ctx, "hot").Val()).To(Equal("v1"))
+		}
+		info := stats()
+		Expect(infoField(info, "hot_cache_hits")).NotTo(Equal(hits))
+		Expect(infoField(info, "hot_cache_keys")).To(Equal("1"))
+		Expect(infoField(info, "hot_cache_hit_rate")).NotTo(Equal("0.00"))
+	})
+
+	It("should never return a value that was overwritten", func() {
+		Expect(rdb.Set(ctx, "hot", "v1", 0).Err()).To(Succeed())
+		Expect(rdb.Get(ctx, "hot").Val()).To(Equal("v1"))
+
+		Expect(rdb.Set(ctx, "hot", "v2", 0).Err()).To(Succeed())
+		Expect(rdb.Get(ctx, "hot").Val()).To(Equal("v2"))
+		Expect(rdb.Append(ctx, "hot", "!").Err()).To(Succeed())
+		Expect(rdb.Get(ctx, "hot").Val()).To(Equal("v2!"))
+
+		Expect(rdb.Del(ctx, "hot").Err()).To(Succeed())
+		Expect(rdb.Exists(ctx, "hot").Val()).To(Equal(int64(0)))
+		Expect(rdb.HSet(ctx, "hot", "field", "value").Err()).To(Succeed())
+		Expect(rdb.HGet(ctx, "hot", "field").Val()).To(Equal("value"))
+		Expect(rdb.Get(ctx, "hot").Err()).To(MatchError(ContainSubstring("WRONGTYPE")))
+
+		Expect(rdb.Set(ctx, "hot", "v3", 0).Err()).To(Succeed())
+		Expect(rdb.Get(ctx, "hot").Val()).To(Equal("v3"))
+		Expect(rdb.FlushDB(ctx).Err()).To(Succeed())
+		Expect(rdb.Get(ctx, "hot").Err()).To(Equal(redis.Nil))
+	})
+
+	It("should expire cached keys on time", func() {
+		Expect(rdb.Set(ctx, "hot", "v1", 0).Err()).To(Succeed())
+		Expect(rdb.Get(ctx, "hot").Val()).To(Equal("v1"))
+		Expect(rdb.PExpireAt(ctx, "hot", time.Now().Add(100*time.Millisecond)).Val()).To(BeTrue())
+		Expect(rdb.Get(ctx, "hot").Val()).To(Equal("v1"))
+		Eventually(func() error {
+			return rdb.Get(ctx, "hot").Err()
+		}, "2s", "20ms").Should(Equal(redis.Nil))
+	})
+
+	It("should read values larger than the limit from storage", func() {
+		value := string(make([]byte, 100))
+		Expect(rdb.Set(ctx, "large", value, 0).Err()).To(Succeed())
+		for range 3 {
+			Expect(rdb.Get(ctx, "large").Val()).To(Equal(value))
+		}
+		Expect(infoField(stats(), "hot_cache_keys")).To(Equal("0"))
+	})
+})
@@ -1,27 +1,18 @@
 package tests
 
 import (
-	"bufio"
-	"net"
-	"time"
-
+	"github.com/marsevilspirit/nimbis/e2e-test/util"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 )
 
 var _ = Describe("Inline Command Parsing", func() {
-	var conn net.Conn
-	var reader *bufio.Reader
+	var conn *util.RespConn
 
 	BeforeEach(func() {
-		// Ensure server is running (suite_test.go usually handles this, but we need raw connection)
-		// We assume util.StartServer() is called in Suite setup.
-
 		var err error
-		conn, err = net.Dial("tcp", "localhost:6379")
+		conn, err = util.DialResp(util.Addr())
 		Expect(err).NotTo(HaveOccurred())
-		conn.SetDeadline(time.Now().Add(5 * time.Second))
-		reader = bufio.NewReader(conn)
 	})
 
 	AfterEach(func() {
@@ -31,52 +22,40 @@ var _ = Describe("Inline Command Parsing", func() {
 	})
 
 	It("should handle valid inline PING", func() {
-		_, err := conn.Write([]byte("PING\r\n"))
-		Expect(err).NotTo(HaveOccurred())
+		Expect(conn.WriteRaw("PING\r\n")).To(Succeed())
 
-		line, err := reader.ReadString('\n')
+		line, err := conn.ReadLine()
 		Expect(err).NotTo(HaveOccurred())
 		// PING returns simple string PONG: "+PONG\r\n"
 		Expect(line).To(Equal("+PONG\r\n"))
 	})
 
 	It("should handle valid inline SET and GET", func() {
-		_, err := conn.Write([]byte("SET inline_key inline_val\r\n"))
-		Expect(err).NotTo(HaveOccurred())
+		Expect(conn.WriteRaw("SET inline_key inline_val\r\n")).To(Succeed())
 
-		line, err := reader.ReadString('\n')
+		line, err := conn.ReadLine()
 		Expect(err).NotTo(HaveOccurred())
 		Expect(line).To(Equal("+OK\r\n"))
 
-		_, err = conn.Write([]byte("GET inline_key\r\n"))
-		Expect(err).NotTo(HaveOccurred())
+		Expect(conn.WriteRaw("GET inline_key\r\n")).To(Succeed())
 
-		// GET returns bulk string: "$10\r\ninline_val\r\n"
-		line, err = reader.ReadString('\n')
-		Expect(err).NotTo(HaveOccurred())
-		Expect(line).To(Equal("$10\r\n"))
-
-		line, err = reader.ReadString('\n')
-		Expect(err).NotTo(HaveOccurred())
-		Expect(line).To(Equal("inline_val\r\n"))
+		Expect(conn.ReadReply()).To(Equal(util.Reply{Kind: util.BulkString, Str: "inline_val"}))
 	})
 
 	It("should skip empty lines", func() {
 		// Send empty lines then PING
-		_, err := conn.Write([]byte("\r\n\r\n \r\nPING\r\n"))
-		Expect(err).NotTo(HaveOccurred())
+		Expect(conn.WriteRaw("\r\n\r\n \r\nPING\r\n")).To(Succeed())
 
-		line, err := reader.ReadString('\n')
+		line, err := conn.ReadLine()
 		Expect(err).NotTo(HaveOccurred())
 		Expect(line).To(Equal("+PONG\r\n"))
 	})
 
 	It("should return error for invalid start character", func() {
 		// Send control character start
-		_, err := conn.Write([]byte("\x01PING\r\n"))
-		Expect(err).NotTo(HaveOccurred())
+		Expect(conn.WriteRaw("\x01PING\r\n")).To(Succeed())
 
-		line, err := reader.ReadString('\n')
+		line, err := conn.ReadLine()
 		Expect(err).NotTo(HaveOccurred())
 		// Check that it's an error response
 		Expect(line).To(HavePrefix("-ERR"))
@@ -84,11 +63,29 @@ var _ = Describe("Inline Command Parsing", func() {
 	})
 
 	It("should handle leading whitespace", func() {
-		_, err := conn.Write([]byte("   PING\r\n"))
-		Expect(err).NotTo(HaveOccurred())
+		Expect(conn.WriteRaw("   PING\r\n")).To(Succeed())
 
-		line, err := reader.ReadString('\n')
+		line, err := conn.ReadLine()
 		Expect(err).NotTo(HaveOccurred())
 		Expect(line).To(Equal("+PONG\r\n"))
 	})
+
+	It("should handle quoted arguments with escapes", func() {
+		Expect(conn.WriteRaw("SET inline_quoted \"hello \\\"world\\\"\\x21\"\r\n")).To(Succeed())
+		line, err := conn.ReadLine()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(line).To(Equal("+OK\r\n"))
+
+		Expect(conn.WriteRaw("GET 'inline_quoted'\r\n")).To(Succeed())
+		Expect(conn.ReadReply()).To(Equal(util.Reply{Kind: util.BulkString, Str: "hello \"world\"!"}))
+	})
+
+	It("should return error for unbalanced quotes", func() {
+		Expect(conn.WriteRaw("SET inline_key \"unterminated\r\n")).To(Succeed())
+
+		line, err := conn.ReadLine()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(line).To(HavePrefix("-ERR"))
+		Expect(line).To(ContainSubstring("unbalanced quotes"))
+	})
 })
@@ -0,0 +1,158 @@
+package tests
+
+import (
+	"context"
+
+	"github.com/marsevilspirit/nimbis/e2e-test/util"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/redis/go-redis/v9"
+)
+
+var _ = Describe("LATENCY Commands", func() {
+	var rdb *redis.Client
+	var ctx context.Context
+
+	BeforeEach(func() {
+		rdb = util.NewClient()
+		ctx = context.Background()
+		Expect(rdb.Ping(ctx).Err()).To(Succeed())
+		Expect(rdb.Do(ctx, "LATENCY", "RESET").Err()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(rdb.ConfigSet(ctx, "latency_monitor_threshold", "0").Err()).To(Succeed())
+		Expect(rdb.Do(ctx, "LATENCY", "RESET").Err()).To(Succeed())
+		Expect(rdb.Close()).To(Succeed())
+	})
+
+	It("should report no events when monitoring is disabled", func() {
+		Expect(rdb.Set(ctx, "latency:key", "value", 0).Err()).To(Succeed())
+
+		latest, err := rdb.Do(ctx, "LATENCY", "LATEST").Slice()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(latest).To(BeEmpty())
+
+		report, err := rdb.Do(ctx, "LATENCY", "DOCTOR").Text()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report).To(ContainSubstring("disabled"))
+	})
+
+	It("should return an empty history for unknown events", func() {
+		history, err := rdb.Do(ctx, "LATENCY", "HISTORY", "no-such-event").Slice()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(history).To(BeEmpty())
+	})
+
+	It("should report zero resets when nothing was recorded", func() {
+		reset, err := rdb.Do(ctx, "LATENCY", "RESET", "command").Int64()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reset).To(BeZero())
+
+		reset, err = rdb.Do(ctx, "LATENCY", "RESET", "no-such-event").Int64()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reset).To(BeZero())
+	})
+
+	It("should mention the absence of spikes once enabled", func() {
+		Expect(rdb.ConfigSet(ctx, "latency_monitor_threshold", "100000").Err()).To(Succeed())
+
+		report, err := rdb.Do(ctx, "LATENCY", "DOCTOR").Text()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report).To(ContainSubstring("No latency spike"))
+	})
+
+	It("should record slow commands once enabled", func() {
+		Expect(rdb.ConfigSet(ctx, "latency_monitor_threshold", "10").Err()).To(Succeed())
+		Expect(rdb.Do(ctx, "DEBUG", "SLEEP", "0.05").Err()).To(Succeed())
+
+		latest, err := rdb.Do(ctx, "LATENCY", "LATEST").Slice()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(latest).To(HaveLen(1))
+		event := latest[0].([]interface{})
+		Expect(event[0]).To(Equal("command"))
+		Expect(event[2]).To(BeNumerically(">=", 50))
+
+		history, err := rdb.Do(ctx, "LATENCY", "HISTORY", "command").Slice()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(history).To(HaveLen(1))
+
+		report, err := rdb.Do(ctx, "LATENCY", "DOCTOR").Text()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report).To(ContainSubstring("command"))
+
+		reset, err := rdb.Do(ctx, "LATENCY", "RESET", "command").Int64()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reset).To(Equal(int64(1)))
+	})
+
+	It("should report command latency percentiles in INFO latencystats", func() {
+		for i := 0; i < 10; i++ {
+			Expect(rdb.Time(ctx).Err()).To(Succeed())
+		}
+
+		info, err := rdb.Info(ctx, "latencystats").Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info).To(HavePrefix("# Latencystats\r\n"))
+		Expect(info).To(MatchRegexp(`latency_percentiles_usec_time:p50=\d+,p99=\d+,p99\.9=\d+\r\n`))
+
+		Expect(rdb.Do(ctx, "NOSUCHCOMMAND").Err()).To(HaveOccurred())
+		Expect(rdb.Info(ctx, "latencystats").Val()).NotTo(ContainSubstring("nosuchcommand"))
+	})
+
+	It("should reply cumulative histograms with LATENCY HISTOGRAM", func() {
+		before := timeCalls(ctx, rdb)
+		for i := 0; i < 5; i++ {
+			Expect(rdb.Time(ctx).Err()).To(Succeed())
+		}
+		Expect(timeCalls(ctx, rdb)).To(Equal(before + 5))
+
+		Expect(rdb.Do(ctx, "DEBUG", "SLEEP", "0.01").Err()).To(Succeed())
+		reply, err := rdb.Do(ctx, "LATENCY", "HISTOGRAM", "DEBUG", "nosuchcommand").Slice()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reply).To(HaveLen(2))
+		Expect(reply[0]).To(Equal("debug"))
+		histogram := reply[1].([]interface{})
+		Expect(histogram[0]).To(Equal("calls"))
+		Expect(histogram[2]).To(Equal("histogram_usec"))
+		buckets := histogram[3].([]interface{})
+		Expect(len(buckets) % 2).To(BeZero())
+		// The last bucket lies above the slowest call, so every call is below it.
+		Expect(buckets[len(buckets)-2]).To(BeNumerically(">", 10000))
+		Expect(buckets[len(buckets)-1]).To(Equal(histogram[1]))
+
+		all, err := rdb.Do(ctx, "LATENCY", "HISTOGRAM").Slice()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(all).To(ContainElements("time", "debug"))
+	})
+
+	It("should stop recording with latency_tracking off", func() {
+		Expect(rdb.ConfigSet(ctx, "latency_tracking", "false").Err()).To(Succeed())
+		defer rdb.ConfigSet(ctx, "latency_tracking", "true")
+
+		before := timeCalls(ctx, rdb)
+		Expect(rdb.Time(ctx).Err()).To(Succeed())
+		Expect(timeCalls(ctx, rdb)).To(Equal(before))
+	})
+
+	It("should print help and reject unknown subcommands", func() {
+		help, err := rdb.Do(ctx, "LATENCY", "HELP").StringSlice()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(help[0]).To(HavePrefix("LATENCY <subcommand>"))
+
+		err = rdb.Do(ctx, "LATENCY", "NOPE").Err()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("unknown LATENCY subcommand"))
+	})
+})
+
+// timeCalls returns the TIME calls LATENCY HISTOGRAM reports.
+func timeCalls(ctx context.Context, rdb *redis.Client) int64 {
+	reply, err := rdb.Do(ctx, "LATENCY", "HISTOGRAM", "time").Slice()
+	Expect(err).NotTo(HaveOccurred())
+	if len(reply) == 0 {
+		return 0
+	}
+	Expect(reply[0]).To(Equal("time"))
+	return reply[1].([]interface{})[1].(int64)
+}
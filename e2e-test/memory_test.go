@@ -0,0 +1,90 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/marsevilspirit/nimbis/e2e-test/util"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/redis/go-redis/v9"
+)
+
+var _ = Describe("MEMORY Commands", func() {
+	var rdb *redis.Client
+	var ctx context.Context
+
+	BeforeEach(func() {
+		rdb = util.NewClient()
+		ctx = context.Background()
+		Expect(rdb.FlushDB(ctx).Err()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(rdb.Close()).To(Succeed())
+	})
+
+	It("should return nil for a missing key", func() {
+		err := rdb.MemoryUsage(ctx, "memory:missing").Err()
+		Expect(err).To(Equal(redis.Nil))
+	})
+
+	It("should grow with the size of a string value", func() {
+		Expect(rdb.Set(ctx, "memory:small", "v", 0).Err()).To(Succeed())
+		Expect(rdb.Set(ctx, "memory:large", strings.Repeat("x", 4096), 0).Err()).To(Succeed())
+
+		small, err := rdb.MemoryUsage(ctx, "memory:small").Result()
+		Expect(err).NotTo(HaveOccurred())
+		large, err := rdb.MemoryUsage(ctx, "memory:large").Result()
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(small).To(BeNumerically(">", 0))
+		Expect(large).To(BeNumerically(">=", small+4095))
+	})
+
+	It("should account for collection elements", func() {
+		for i := 0; i < 50; i++ {
+			Expect(rdb.HSet(ctx, "memory:hash", fmt.Sprintf("field-%02d", i), "value").Err()).To(Succeed())
+		}
+		Expect(rdb.HSet(ctx, "memory:tiny", "field-00", "value").Err()).To(Succeed())
+
+		all, err := rdb.MemoryUsage(ctx, "memory:hash", 0).Result()
+		Expect(err).NotTo(HaveOccurred())
+		sampled, err := rdb.MemoryUsage(ctx, "memory:hash", 5).Result()
+		Expect(err).NotTo(HaveOccurred())
+		tiny, err := rdb.MemoryUsage(ctx, "memory:tiny").Result()
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(all).To(Equal(sampled))
+		Expect(all).To(BeNumerically(">", tiny*10))
+	})
+
+	It("should reject invalid options", func() {
+		Expect(rdb.Set(ctx, "memory:key", "v", 0).Err()).To(Succeed())
+
+		err := rdb.Do(ctx, "MEMORY", "USAGE", "memory:key", "SAMPLES").Err()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("syntax error"))
+
+		err = rdb.Do(ctx, "MEMORY", "USAGE", "memory:key", "SAMPLES", "-1").Err()
+		Expect(err).To(HaveOccurred())
+
+		err = rdb.Do(ctx, "MEMORY", "NOPE").Err()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("unknown MEMORY subcommand"))
+	})
+
+	It("should purge memory and keep every key", func() {
+		Expect(rdb.Set(ctx, "memory:kept", "v", 0).Err()).To(Succeed())
+		Expect(rdb.HSet(ctx, "memory:hash", "field", "value").Err()).To(Succeed())
+		Expect(rdb.Del(ctx, "memory:hash").Err()).To(Succeed())
+
+		Expect(rdb.Do(ctx, "MEMORY", "PURGE").Val()).To(Equal("OK"))
+		Expect(rdb.Get(ctx, "memory:kept").Val()).To(Equal("v"))
+		Expect(rdb.Exists(ctx, "memory:hash").Val()).To(Equal(int64(0)))
+
+		err := rdb.Do(ctx, "MEMORY", "PURGE", "extra").Err()
+		Expect(err).To(HaveOccurred())
+	})
+})
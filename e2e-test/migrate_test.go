@@ -0,0 +1,159 @@
+package tests
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/marsevilspirit/nimbis/e2e-test/util"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/redis/go-redis/v9"
+)
+
+var _ = Describe("Key Migration Commands", func() {
+	var rdb *redis.Client
+	var ctx context.Context
+
+	BeforeEach(func() {
+		rdb = util.NewClient()
+		ctx = context.Background()
+		Expect(rdb.FlushDB(ctx).Err()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(rdb.Close()).To(Succeed())
+	})
+
+	It("should dump and restore every type", func() {
+		Expect(rdb.Set(ctx, "dump:string", "value", 0).Err()).To(Succeed())
+		Expect(rdb.HSet(ctx, "dump:hash", "f1", "v1", "f2", "v2").Err()).To(Succeed())
+		Expect(rdb.RPush(ctx, "dump:list", "a", "b", "c").Err()).To(Succeed())
+		Expect(rdb.SAdd(ctx, "dump:set", "x", "y").Err()).To(Succeed())
+		Expect(rdb.ZAdd(ctx, "dump:zset", redis.Z{Score: 1.5, Member: "m"}).Err()).To(Succeed())
+
+		for _, key := range []string{"dump:string", "dump:hash", "dump:list", "dump:set", "dump:zset"} {
+			payload, err := rdb.Dump(ctx, key).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rdb.Restore(ctx, key+":copy", 0, payload).Val()).To(Equal("OK"))
+		}
+
+		Expect(rdb.Get(ctx, "dump:string:copy").Val()).To(Equal("value"))
+		Expect(rdb.HGetAll(ctx, "dump:hash:copy").Val()).To(Equal(map[string]string{"f1": "v1", "f2": "v2"}))
+		Expect(rdb.LRange(ctx, "dump:list:copy", 0, -1).Val()).To(Equal([]string{"a", "b", "c"}))
+		Expect(rdb.SMembers(ctx, "dump:set:copy").Val()).To(ConsistOf("x", "y"))
+		Expect(rdb.ZRangeWithScores(ctx, "dump:zset:copy", 0, -1).Val()).To(Equal([]redis.Z{{Score: 1.5, Member: "m"}}))
+
+		Expect(rdb.Dump(ctx, "dump:missing").Err()).To(Equal(redis.Nil))
+	})
+
+	It("should restore with a TTL and only replace with REPLACE", func() {
+		Expect(rdb.Set(ctx, "dump:key", "old", 0).Err()).To(Succeed())
+		Expect(rdb.Set(ctx, "dump:source", "new", 0).Err()).To(Succeed())
+		payload := rdb.Dump(ctx, "dump:source").Val()
+
+		err := rdb.Restore(ctx, "dump:key", 0, payload).Err()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("BUSYKEY"))
+		Expect(rdb.Get(ctx, "dump:key").Val()).To(Equal("old"))
+
+		Expect(rdb.RestoreReplace(ctx, "dump:key", time.Hour, payload).Val()).To(Equal("OK"))
+		Expect(rdb.Get(ctx, "dump:key").Val()).To(Equal("new"))
+		Expect(rdb.TTL(ctx, "dump:key").Val()).To(BeNumerically(">", 59*time.Minute))
+	})
+
+	It("should reject corrupt payloads and extension types", func() {
+		Expect(rdb.Set(ctx, "dump:key", "value", 0).Err()).To(Succeed())
+		payload := []byte(rdb.Dump(ctx, "dump:key").Val())
+		payload[1] ^= 0xff
+
+		err := rdb.Restore(ctx, "dump:other", 0, string(payload)).Err()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("checksum are wrong"))
+
+		err = rdb.Restore(ctx, "dump:other", -1, rdb.Dump(ctx, "dump:key").Val()).Err()
+		Expect(err).To(HaveOccurred())
+
+		Expect(rdb.Do(ctx, "BF.ADD", "dump:bloom", "item").Err()).To(Succeed())
+		Expect(rdb.Dump(ctx, "dump:bloom").Err()).To(HaveOccurred())
+	})
+
+	It("should dump and restore streams with their consumer groups", func() {
+		for _, id := range []string{"1-1", "2-1", "3-1"} {
+			Expect(rdb.XAdd(ctx, &redis.XAddArgs{Stream: "dump:stream", ID: id, Values: []string{"f", id}}).Err()).To(Succeed())
+		}
+		Expect(rdb.XDel(ctx, "dump:stream", "2-1").Err()).To(Succeed())
+		Expect(rdb.XGroupCreate(ctx, "dump:stream", "g", "0").Err()).To(Succeed())
+		Expect(rdb.XReadGroup(ctx, &redis.XReadGroupArgs{Group: "g", Consumer: "alice", Streams: []string{"dump:stream", ">"}, Count: 1}).Err()).To(Succeed())
+
+		payload, err := rdb.Dump(ctx, "dump:stream").Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rdb.Restore(ctx, "dump:stream:copy", 0, payload).Val()).To(Equal("OK"))
+
+		Expect(rdb.XRange(ctx, "dump:stream:copy", "-", "+").Val()).To(Equal([]redis.XMessage{
+			{ID: "1-1", Values: map[string]interface{}{"f": "1-1"}},
+			{ID: "3-1", Values: map[string]interface{}{"f": "3-1"}},
+		}))
+		groups := rdb.XInfoGroups(ctx, "dump:stream:copy").Val()
+		Expect(groups).To(Equal(rdb.XInfoGroups(ctx, "dump:stream").Val()))
+		Expect(groups).To(HaveLen(1))
+		Expect(groups[0].Name).To(Equal("g"))
+		Expect(groups[0].Consumers).To(Equal(int64(1)))
+		Expect(groups[0].Pending).To(Equal(int64(1)))
+		Expect(groups[0].LastDeliveredID).To(Equal("1-1"))
+		Expect(groups[0].EntriesRead).To(Equal(int64(1)))
+		info := rdb.XInfoStream(ctx, "dump:stream:copy").Val()
+		Expect(info.EntriesAdded).To(Equal(int64(3)))
+		Expect(info.MaxDeletedEntryID).To(Equal("2-1"))
+		pending := rdb.XPendingExt(ctx, &redis.XPendingExtArgs{Stream: "dump:stream:copy", Group: "g", Start: "-", End: "+", Count: 10}).Val()
+		Expect(pending).To(HaveLen(1))
+		Expect(pending[0].ID).To(Equal("1-1"))
+		Expect(pending[0].Consumer).To(Equal("alice"))
+
+		// New IDs continue after the last one ever added.
+		err = rdb.XAdd(ctx, &redis.XAddArgs{Stream: "dump:stream:copy", ID: "3-1", Values: []string{"f", "v"}}).Err()
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should migrate keys and delete them once the target has them", func() {
+		Expect(rdb.Set(ctx, "migrate:a", "1", 0).Err()).To(Succeed())
+		Expect(rdb.HSet(ctx, "migrate:b", "f", "v").Err()).To(Succeed())
+		Expect(rdb.Expire(ctx, "migrate:b", time.Hour).Err()).To(Succeed())
+
+		// The target is this server, so without REPLACE every key is busy
+		// there and stays here.
+		err := rdb.Do(ctx, "MIGRATE", "localhost", strconv.Itoa(util.Port()), "", "0", "1000", "KEYS", "migrate:a", "migrate:b").Err()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("Target instance replied with error: BUSYKEY"))
+		Expect(rdb.Exists(ctx, "migrate:a", "migrate:b").Val()).To(Equal(int64(2)))
+
+		res := rdb.Do(ctx, "MIGRATE", "localhost", strconv.Itoa(util.Port()), "", "0", "1000", "COPY", "REPLACE", "KEYS", "migrate:a", "migrate:b")
+		Expect(res.Val()).To(Equal("OK"))
+		Expect(rdb.Get(ctx, "migrate:a").Val()).To(Equal("1"))
+		Expect(rdb.HGet(ctx, "migrate:b", "f").Val()).To(Equal("v"))
+		Expect(rdb.TTL(ctx, "migrate:b").Val()).To(BeNumerically(">", 59*time.Minute))
+
+		Expect(rdb.Migrate(ctx, "localhost", strconv.Itoa(util.Port()), "migrate:a", 0, time.Second).Err()).To(HaveOccurred())
+		res = rdb.Do(ctx, "MIGRATE", "localhost", strconv.Itoa(util.Port()), "migrate:a", "0", "1000", "REPLACE")
+		Expect(res.Val()).To(Equal("OK"))
+		Expect(rdb.Exists(ctx, "migrate:a").Val()).To(Equal(int64(0)))
+	})
+
+	It("should reply NOKEY and reject bad arguments", func() {
+		Expect(rdb.Migrate(ctx, "localhost", strconv.Itoa(util.Port()), "migrate:missing", 0, time.Second).Val()).To(Equal("NOKEY"))
+
+		err := rdb.Do(ctx, "MIGRATE", "localhost", strconv.Itoa(util.Port()), "migrate:a", "0", "1000", "KEYS", "migrate:b").Err()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("must be set to the empty string"))
+
+		err = rdb.Do(ctx, "MIGRATE", "localhost", strconv.Itoa(util.Port()), "migrate:a", "0", "1000", "AUTH").Err()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("syntax error"))
+
+		Expect(rdb.Set(ctx, "migrate:a", "1", 0).Err()).To(Succeed())
+		err = rdb.Do(ctx, "MIGRATE", "localhost", "1", "migrate:a", "0", "200").Err()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("IOERR"))
+		Expect(rdb.Get(ctx, "migrate:a").Val()).To(Equal("1"))
+	})
+})
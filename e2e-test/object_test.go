@@ -0,0 +1,90 @@
+package tests
+
+import (
+	"context"
+	"time"
+
+	"github.com/marsevilspirit/nimbis/e2e-test/util"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/redis/go-redis/v9"
+)
+
+var _ = Describe("OBJECT Commands", func() {
+	var rdb *redis.Client
+	var ctx context.Context
+
+	BeforeEach(func() {
+		rdb = util.NewClient()
+		ctx = context.Background()
+		Expect(rdb.FlushDB(ctx).Err()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(rdb.ConfigSet(ctx, "lfu_log_factor", "10").Err()).To(Succeed())
+		Expect(rdb.ConfigSet(ctx, "lfu_decay_time", "1").Err()).To(Succeed())
+		Expect(rdb.Close()).To(Succeed())
+	})
+
+	It("should return nil for a missing key", func() {
+		Expect(rdb.ObjectIdleTime(ctx, "object:missing").Err()).To(Equal(redis.Nil))
+		Expect(rdb.ObjectFreq(ctx, "object:missing").Err()).To(Equal(redis.Nil))
+	})
+
+	It("should report the idle time since the last access", func() {
+		Expect(rdb.Set(ctx, "object:idle", "v", 0).Err()).To(Succeed())
+		time.Sleep(2100 * time.Millisecond)
+
+		idle, err := rdb.ObjectIdleTime(ctx, "object:idle").Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(idle).To(BeNumerically(">=", 2*time.Second))
+
+		// OBJECT itself does not count as an access, GET does.
+		Expect(rdb.ObjectIdleTime(ctx, "object:idle").Val()).To(BeNumerically(">=", 2*time.Second))
+		Expect(rdb.Get(ctx, "object:idle").Err()).To(Succeed())
+		Expect(rdb.ObjectIdleTime(ctx, "object:idle").Val()).To(BeNumerically("<", time.Second))
+	})
+
+	It("should count accesses in the frequency", func() {
+		Expect(rdb.Set(ctx, "object:freq", "v", 0).Err()).To(Succeed())
+		Expect(rdb.ObjectFreq(ctx, "object:freq").Val()).To(Equal(int64(5)))
+
+		// Without a log factor every access counts, and without decay a
+		// minute passing does not take one away.
+		Expect(rdb.ConfigSet(ctx, "lfu_log_factor", "0").Err()).To(Succeed())
+		Expect(rdb.ConfigSet(ctx, "lfu_decay_time", "0").Err()).To(Succeed())
+		for i := 0; i < 10; i++ {
+			Expect(rdb.Get(ctx, "object:freq").Err()).To(Succeed())
+		}
+		Expect(rdb.ObjectFreq(ctx, "object:freq").Val()).To(Equal(int64(15)))
+
+		Expect(rdb.Del(ctx, "object:freq").Err()).To(Succeed())
+		Expect(rdb.Set(ctx, "object:freq", "v", 0).Err()).To(Succeed())
+		Expect(rdb.ObjectFreq(ctx, "object:freq").Val()).To(Equal(int64(5)))
+	})
+
+	It("should set the statistics with RESTORE IDLETIME and FREQ", func() {
+		Expect(rdb.Set(ctx, "object:src", "v", 0).Err()).To(Succeed())
+		payload, err := rdb.Dump(ctx, "object:src").Result()
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(rdb.Do(ctx, "RESTORE", "object:dst", 0, payload, "IDLETIME", 1000).Err()).To(Succeed())
+		Expect(rdb.ObjectIdleTime(ctx, "object:dst").Val()).To(BeNumerically(">=", 1000*time.Second))
+
+		Expect(rdb.Do(ctx, "RESTORE", "object:dst", 0, payload, "REPLACE", "FREQ", 100).Err()).To(Succeed())
+		Expect(rdb.ObjectFreq(ctx, "object:dst").Val()).To(Equal(int64(100)))
+
+		err = rdb.Do(ctx, "RESTORE", "object:dst", 0, payload, "REPLACE", "FREQ", 256).Err()
+		Expect(err).To(MatchError("ERR Invalid FREQ value, must be >= 0 and <= 255"))
+	})
+
+	It("should reject unknown subcommands and list help", func() {
+		err := rdb.Do(ctx, "OBJECT", "BOGUS", "key").Err()
+		Expect(err).To(MatchError("ERR unknown OBJECT subcommand 'BOGUS'. Try OBJECT HELP."))
+
+		help, err := rdb.Do(ctx, "OBJECT", "HELP").StringSlice()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(help).To(ContainElement("FREQ <key>"))
+		Expect(help).To(ContainElement("IDLETIME <key>"))
+	})
+})
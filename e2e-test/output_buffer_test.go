@@ -0,0 +1,147 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/marsevilspirit/nimbis/e2e-test/util"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/redis/go-redis/v9"
+)
+
+var _ = Describe("Client Output Buffer Limits", func() {
+	var rdb *redis.Client
+	var ctx context.Context
+
+	BeforeEach(func() {
+		rdb = util.NewClient()
+		ctx = context.Background()
+	})
+
+	AfterEach(func() {
+		Expect(rdb.ConfigSet(ctx, "client_output_buffer_limit", "normal 0 0 0").Err()).To(Succeed())
+		Expect(rdb.Close()).To(Succeed())
+	})
+
+	// fillList pushes count values of size bytes to key.
+	fillList := func(key string, count, size int) {
+		Expect(rdb.Del(ctx, key).Err()).To(Succeed())
+		value := strings.Repeat("v", size)
+		pipe := rdb.Pipeline()
+		for i := 0; i < count; i++ {
+			pipe.RPush(ctx, key, value)
+		}
+		_, err := pipe.Exec(ctx)
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	It("should disconnect normal clients whose reply passes the hard limit", func() {
+		fillList("obl:hard", 64, 32*1024)
+		Expect(rdb.ConfigSet(ctx, "client_output_buffer_limit", "normal 1mb 0 0").Err()).To(Succeed())
+
+		client := dialRaw()
+		defer client.close()
+		Expect(client.do("LLEN", "obl:hard")).To(Equal(int64(64)))
+		Expect(client.do("LRANGE", "obl:hard", "0", "9")).To(HaveLen(10))
+
+		Expect(client.Send("LRANGE", "obl:hard", "0", "-1")).To(Succeed())
+		_, err := client.ReadReply()
+		Expect(err).To(MatchError(io.EOF))
+
+		Expect(rdb.LLen(ctx, "obl:hard").Val()).To(Equal(int64(64)))
+	})
+
+	It("should disconnect normal clients that stay above the soft limit", func() {
+		// Larger than what the socket buffers can take, so the reply stays
+		// queued while the client does not read.
+		const count, size = 512, 64 * 1024
+		fillList("obl:soft", count, size)
+		Expect(rdb.ConfigSet(ctx, "client_output_buffer_limit", "normal 0 1mb 1").Err()).To(Succeed())
+
+		client := dialRaw()
+		defer client.close()
+		client.SetTimeout(10 * time.Second)
+		Expect(client.Send("LRANGE", "obl:soft", "0", "-1")).To(Succeed())
+
+		time.Sleep(3 * time.Second)
+		n, err := client.Drain()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n).To(BeNumerically("<", int64(count*size)),
+			fmt.Sprintf("expected the reply to be cut short, read %d bytes", n))
+	})
+
+	It("should keep serving clients under the limits", func() {
+		fillList("obl:ok", 64, 32*1024)
+		Expect(rdb.ConfigSet(ctx, "client_output_buffer_limit", "normal 4mb 2mb 10").Err()).To(Succeed())
+
+		values, err := rdb.LRange(ctx, "obl:ok", 0, -1).Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(values).To(HaveLen(64))
+		Expect(rdb.Ping(ctx).Err()).To(Succeed())
+	})
+})
+
+var _ = Describe("Client Eviction", func() {
+	var rdb *redis.Client
+	var ctx context.Context
+
+	BeforeEach(func() {
+		rdb = util.NewClient()
+		ctx = context.Background()
+	})
+
+	AfterEach(func() {
+		Expect(rdb.ConfigSet(ctx, "maxmemory_clients", "0").Err()).To(Succeed())
+		Expect(rdb.Close()).To(Succeed())
+	})
+
+	evictedClients := func() string {
+		info, err := rdb.Info(ctx, "stats").Result()
+		Expect(err).NotTo(HaveOccurred())
+		return infoField(info, "evicted_clients")
+	}
+
+	It("should evict the client holding the most memory", func() {
+		const count, size = 512, 64 * 1024
+		Expect(rdb.Del(ctx, "mmc:big").Err()).To(Succeed())
+		value := strings.Repeat("v", size)
+		pipe := rdb.Pipeline()
+		for i := 0; i < count; i++ {
+			pipe.RPush(ctx, "mmc:big", value)
+		}
+		_, err := pipe.Exec(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		evicted := evictedClients()
+
+		Expect(rdb.ConfigSet(ctx, "maxmemory_clients", "1048576").Err()).To(Succeed())
+		client := dialRaw()
+		defer client.close()
+		client.SetTimeout(10 * time.Second)
+		Expect(client.Send("LRANGE", "mmc:big", "0", "-1")).To(Succeed())
+
+		time.Sleep(time.Second)
+		n, err := client.Drain()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n).To(BeNumerically("<", int64(count*size)),
+			fmt.Sprintf("expected the reply to be cut short, read %d bytes", n))
+		Expect(evictedClients()).NotTo(Equal(evicted))
+		Expect(rdb.Ping(ctx).Err()).To(Succeed())
+	})
+
+	It("should switch eviction off for a client with CLIENT NO-EVICT", func() {
+		client := dialRaw()
+		defer client.close()
+		Expect(client.do("CLIENT", "NO-EVICT", "on")).To(Equal("OK"))
+		Expect(client.do("CLIENT", "NO-EVICT", "off")).To(Equal("OK"))
+		Expect(client.do("CLIENT", "NO-EVICT", "maybe")).To(ContainSubstring("syntax error"))
+
+		info, err := rdb.Info(ctx, "clients").Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(infoField(info, "maxmemory_clients")).To(Equal("0"))
+		Expect(infoField(info, "clients_memory")).NotTo(Equal("0"))
+	})
+})
@@ -0,0 +1,381 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/marsevilspirit/nimbis/e2e-test/util"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/redis/go-redis/v9"
+)
+
+var _ = Describe("Persistence Commands", func() {
+	var rdb *redis.Client
+	var ctx context.Context
+
+	BeforeEach(func() {
+		rdb = util.NewClient()
+		ctx = context.Background()
+		Expect(rdb.FlushDB(ctx).Err()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(rdb.Close()).To(Succeed())
+	})
+
+	waitForBgsave := func() {
+		Eventually(func() string {
+			return rdb.Info(ctx, "persistence").Val()
+		}, 10*time.Second, 50*time.Millisecond).Should(ContainSubstring("rdb_bgsave_in_progress:0"))
+	}
+
+	It("should save and report the last save time", func() {
+		Expect(rdb.Set(ctx, "persist:key", "value", 0).Err()).To(Succeed())
+		Expect(rdb.HSet(ctx, "persist:hash", "field", "value").Err()).To(Succeed())
+		Expect(rdb.Expire(ctx, "persist:hash", time.Hour).Err()).To(Succeed())
+
+		before := time.Now().Unix()
+		Expect(rdb.Save(ctx).Val()).To(Equal("OK"))
+		Expect(rdb.LastSave(ctx).Val()).To(BeNumerically(">=", before))
+
+		// Saving does not change the dataset.
+		Expect(rdb.Get(ctx, "persist:key").Val()).To(Equal("value"))
+		Expect(rdb.TTL(ctx, "persist:hash").Val()).To(BeNumerically(">", 0))
+	})
+
+	It("should save in the background", func() {
+		Expect(rdb.Set(ctx, "persist:key", "value", 0).Err()).To(Succeed())
+		waitForBgsave()
+
+		before := time.Now().Unix()
+		Expect(rdb.BgSave(ctx).Val()).To(Equal("Background saving started"))
+		waitForBgsave()
+
+		info := rdb.Info(ctx, "persistence").Val()
+		Expect(info).To(ContainSubstring("# Persistence"))
+		Expect(info).To(ContainSubstring("rdb_last_bgsave_status:ok"))
+		Expect(rdb.LastSave(ctx).Val()).To(BeNumerically(">=", before))
+	})
+
+	It("should report the server as loaded", func() {
+		info := rdb.Info(ctx, "persistence").Val()
+		Expect(info).To(ContainSubstring("# Persistence\r\nloading:0\r\n"))
+		Expect(info).NotTo(ContainSubstring("loading_start_time"))
+		Expect(info).NotTo(ContainSubstring("loading_eta_seconds"))
+		Expect(rdb.Ping(ctx).Val()).To(Equal("PONG"))
+	})
+
+	It("should save on the save schedule", func() {
+		waitForBgsave()
+		before := rdb.LastSave(ctx).Val()
+		Expect(rdb.ConfigSet(ctx, "save", "1 2").Err()).To(Succeed())
+		DeferCleanup(func() {
+			Expect(rdb.ConfigSet(ctx, "save", "").Err()).To(Succeed())
+		})
+
+		Expect(rdb.Set(ctx, "persist:key", "value", 0).Err()).To(Succeed())
+		Expect(rdb.Set(ctx, "persist:other", "value", 0).Err()).To(Succeed())
+		Eventually(func() int64 {
+			return rdb.LastSave(ctx).Val()
+		}, 10*time.Second, 100*time.Millisecond).Should(BeNumerically(">", before))
+		waitForBgsave()
+		Expect(rdb.Info(ctx, "persistence").Val()).To(ContainSubstring("rdb_last_bgsave_status:ok"))
+	})
+
+	It("should reject an invalid save schedule", func() {
+		Expect(rdb.ConfigSet(ctx, "save", "900").Err()).To(HaveOccurred())
+	})
+
+	It("should sync writes with appendfsync always", func() {
+		Expect(rdb.ConfigSet(ctx, "appendonly", "yes").Err()).To(Succeed())
+		Expect(rdb.ConfigSet(ctx, "appendfsync", "always").Err()).To(Succeed())
+		DeferCleanup(func() {
+			Expect(rdb.ConfigSet(ctx, "appendonly", "no").Err()).To(Succeed())
+			Expect(rdb.ConfigSet(ctx, "appendfsync", "everysec").Err()).To(Succeed())
+		})
+		Expect(rdb.ConfigGet(ctx, "append*").Val()).To(Equal(map[string]string{
+			"appendonly":  "yes",
+			"appendfsync": "always",
+		}))
+
+		Expect(rdb.Set(ctx, "persist:key", "value", 0).Err()).To(Succeed())
+		Expect(rdb.Get(ctx, "persist:key").Val()).To(Equal("value"))
+		info := rdb.Info(ctx, "persistence").Val()
+		Expect(info).To(ContainSubstring("aof_enabled:1"))
+		Expect(info).To(ContainSubstring("aof_last_write_status:ok"))
+	})
+
+	It("should sync a pipeline of writes together with appendfsync always", func() {
+		Expect(rdb.ConfigSet(ctx, "appendonly", "yes").Err()).To(Succeed())
+		Expect(rdb.ConfigSet(ctx, "appendfsync", "always").Err()).To(Succeed())
+		DeferCleanup(func() {
+			Expect(rdb.ConfigSet(ctx, "appendonly", "no").Err()).To(Succeed())
+			Expect(rdb.ConfigSet(ctx, "appendfsync", "everysec").Err()).To(Succeed())
+		})
+
+		pipe := rdb.Pipeline()
+		sets := make([]*redis.StatusCmd, 100)
+		for i := range sets {
+			sets[i] = pipe.Set(ctx, fmt.Sprintf("persist:pipeline:%d", i), i, 0)
+		}
+		get := pipe.Get(ctx, "persist:pipeline:99")
+		wrongType := pipe.LPush(ctx, "persist:pipeline:0", "item")
+		_, err := pipe.Exec(ctx)
+		Expect(err).To(HaveOccurred())
+
+		for _, set := range sets {
+			Expect(set.Val()).To(Equal("OK"))
+		}
+		Expect(get.Val()).To(Equal("99"))
+		Expect(wrongType.Err()).To(MatchError(ContainSubstring("WRONGTYPE")))
+		Expect(rdb.Info(ctx, "persistence").Val()).To(ContainSubstring("aof_last_write_status:ok"))
+	})
+
+	It("should make earlier writes durable with WAITAOF", func() {
+		Expect(rdb.Set(ctx, "persist:key", "value", 0).Err()).To(Succeed())
+
+		result, err := rdb.Do(ctx, "WAITAOF", 1, 0, 0).Slice()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal([]interface{}{int64(1), int64(0)}))
+		Expect(rdb.Do(ctx, "WAITAOF", 0, 0, 100).Val()).To(Equal([]interface{}{int64(0), int64(0)}))
+
+		err = rdb.Do(ctx, "WAITAOF", -1, 0, 0).Err()
+		Expect(err).To(MatchError(ContainSubstring("out of range")))
+		err = rdb.Do(ctx, "WAITAOF", 1, 0, -1).Err()
+		Expect(err).To(MatchError(ContainSubstring("timeout is negative")))
+		err = rdb.Do(ctx, "WAITAOF", 1, 0).Err()
+		Expect(err).To(MatchError(ContainSubstring("wrong number of arguments")))
+	})
+
+	It("should rewrite the log in the background", func() {
+		waitForRewrite := func() {
+			Eventually(func() string {
+				return rdb.Info(ctx, "persistence").Val()
+			}, 10*time.Second, 50*time.Millisecond).Should(ContainSubstring("aof_rewrite_in_progress:0"))
+		}
+		Expect(rdb.Set(ctx, "persist:key", "value", 0).Err()).To(Succeed())
+		waitForRewrite()
+
+		Expect(rdb.BgRewriteAOF(ctx).Val()).To(Equal("Background append only file rewriting started"))
+		waitForRewrite()
+		info := rdb.Info(ctx, "persistence").Val()
+		Expect(info).To(ContainSubstring("aof_last_bgrewrite_status:ok"))
+		Expect(info).To(ContainSubstring("aof_current_rewrite_time_sec:-1"))
+		Expect(rdb.Get(ctx, "persist:key").Val()).To(Equal("value"))
+	})
+
+	It("should export the dataset as an RDB file", func() {
+		Expect(rdb.Set(ctx, "persist:key", "value", 0).Err()).To(Succeed())
+		Expect(rdb.RPush(ctx, "persist:list", "a", "b").Err()).To(Succeed())
+		Expect(rdb.XAdd(ctx, &redis.XAddArgs{Stream: "persist:stream", Values: []string{"f", "v"}}).Err()).To(Succeed())
+		Expect(rdb.Do(ctx, "BF.ADD", "persist:bloom", "item").Err()).To(Succeed())
+
+		result, err := rdb.Do(ctx, "NIMBIS", "EXPORT").Slice()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(HaveLen(6))
+		Expect(result[0]).To(Equal("path"))
+		Expect(result[1]).To(HaveSuffix("snapshot/dump.rdb"))
+		Expect(result[2:]).To(Equal([]interface{}{"keys", int64(3), "skipped", int64(1)}))
+	})
+
+	It("should import the exported RDB file", func() {
+		Expect(rdb.Set(ctx, "persist:key", "value", time.Minute).Err()).To(Succeed())
+		Expect(rdb.ZAdd(ctx, "persist:zset", redis.Z{Score: 1.5, Member: "m"}).Err()).To(Succeed())
+		Expect(rdb.Do(ctx, "NIMBIS", "EXPORT").Err()).To(Succeed())
+
+		Expect(rdb.Set(ctx, "persist:key", "changed", 0).Err()).To(Succeed())
+		Expect(rdb.Del(ctx, "persist:zset").Err()).To(Succeed())
+		Expect(rdb.Set(ctx, "persist:other", "kept", 0).Err()).To(Succeed())
+
+		result, err := rdb.Do(ctx, "NIMBIS", "IMPORT").Slice()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal([]interface{}{"keys", int64(2), "skipped", int64(0)}))
+		Expect(rdb.Get(ctx, "persist:key").Val()).To(Equal("value"))
+		Expect(rdb.TTL(ctx, "persist:key").Val()).To(BeNumerically(">", 0))
+		Expect(rdb.ZScore(ctx, "persist:zset", "m").Val()).To(Equal(1.5))
+		Expect(rdb.Get(ctx, "persist:other").Val()).To(Equal("kept"))
+	})
+
+	It("should back up the dataset to a directory", func() {
+		Expect(rdb.Set(ctx, "persist:key", "value", 0).Err()).To(Succeed())
+		dir := filepath.Join(GinkgoT().TempDir(), "backup")
+
+		result, err := rdb.Do(ctx, "BACKUP", dir).Slice()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal([]interface{}{"path", filepath.Join(dir, "snapshot", "dump.nsnap"), "keys", int64(1)}))
+		Expect(filepath.Join(dir, "snapshot", "dump.nsnap")).To(BeARegularFile())
+
+		err = rdb.Do(ctx, "BACKUP", dir).Err()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("is not empty"))
+
+		err = rdb.Do(ctx, "BACKUP").Err()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("wrong number of arguments"))
+	})
+
+	It("should restore a backup into the running server", func() {
+		Expect(rdb.Set(ctx, "persist:key", "value", 0).Err()).To(Succeed())
+		dir := filepath.Join(GinkgoT().TempDir(), "backup")
+		Expect(rdb.Do(ctx, "BACKUP", dir).Err()).To(Succeed())
+
+		Expect(rdb.Set(ctx, "persist:key", "changed", 0).Err()).To(Succeed())
+		Expect(rdb.Set(ctx, "persist:later", "value", 0).Err()).To(Succeed())
+
+		err := rdb.Do(ctx, "NIMBIS", "RESTORE", dir).Err()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("CONFIRM"))
+		Expect(rdb.Get(ctx, "persist:key").Val()).To(Equal("changed"))
+
+		result, err := rdb.Do(ctx, "NIMBIS", "RESTORE", dir, "CONFIRM").Slice()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result[2:4]).To(Equal([]interface{}{"keys", int64(1)}))
+		Expect(rdb.Get(ctx, "persist:key").Val()).To(Equal("value"))
+		Expect(rdb.Exists(ctx, "persist:later").Val()).To(Equal(int64(0)))
+
+		err = rdb.Do(ctx, "NIMBIS", "RESTORE", filepath.Join(dir, "missing"), "CONFIRM").Err()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("no backup"))
+	})
+
+	It("should refuse writes above the disk hard limit", func() {
+		Expect(rdb.Set(ctx, "persist:key", "value", 0).Err()).To(Succeed())
+		Eventually(func() string {
+			return rdb.Info(ctx, "persistence").Val()
+		}, 5*time.Second, 50*time.Millisecond).Should(MatchRegexp(`disk_total_bytes:[1-9]`))
+
+		// Any volume in use is at least 1% full. The soft limit may not be
+		// above the hard one, so it goes down first.
+		Expect(rdb.ConfigSet(ctx, "disk_hard_limit_percent", "1").Err()).To(HaveOccurred())
+		Expect(rdb.ConfigSet(ctx, "disk_soft_limit_percent", "1").Err()).To(Succeed())
+		Expect(rdb.ConfigSet(ctx, "disk_hard_limit_percent", "1").Err()).To(Succeed())
+		DeferCleanup(func() {
+			Expect(rdb.ConfigSet(ctx, "disk_hard_limit_percent", "95").Err()).To(Succeed())
+			Expect(rdb.ConfigSet(ctx, "disk_soft_limit_percent", "90").Err()).To(Succeed())
+		})
+		Expect(rdb.Info(ctx, "persistence").Val()).To(ContainSubstring("disk_status:hard_limit"))
+
+		err := rdb.Set(ctx, "persist:other", "value", 0).Err()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(HavePrefix("MISCONF"))
+		err = rdb.Eval(ctx, "return redis.call('SET', KEYS[1], 'value')", []string{"persist:other"}).Err()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("MISCONF"))
+		Expect(rdb.Get(ctx, "persist:key").Val()).To(Equal("value"))
+		Expect(rdb.Del(ctx, "persist:key").Val()).To(Equal(int64(1)))
+
+		Expect(rdb.ConfigSet(ctx, "disk_hard_limit_percent", "0").Err()).To(Succeed())
+		Expect(rdb.Set(ctx, "persist:other", "value", 0).Err()).To(Succeed())
+		Expect(rdb.ConfigSet(ctx, "disk_hard_limit_percent", "101").Err()).To(HaveOccurred())
+	})
+
+	It("should reject invalid append-only settings", func() {
+		Expect(rdb.ConfigSet(ctx, "appendonly", "maybe").Err()).To(HaveOccurred())
+		Expect(rdb.ConfigSet(ctx, "appendfsync", "sometimes").Err()).To(HaveOccurred())
+	})
+
+	It("should include the persistence section in INFO", func() {
+		info := rdb.Info(ctx).Val()
+		Expect(info).To(ContainSubstring("# Persistence"))
+		Expect(info).To(ContainSubstring("rdb_last_save_time:"))
+		Expect(info).To(ContainSubstring("rdb_current_bgsave_time_sec:"))
+	})
+
+	It("should reject arguments", func() {
+		for _, cmd := range []string{"SAVE", "BGSAVE", "LASTSAVE", "BGREWRITEAOF"} {
+			err := rdb.Do(ctx, cmd, "now").Err()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("wrong number of arguments"))
+		}
+	})
+})
+
+var _ = Describe("Recovery", func() {
+	var server *util.Server
+	var rdb *redis.Client
+	var ctx context.Context
+
+	BeforeEach(func() {
+		skipIfExternal()
+		var err error
+		server, err = util.StartServerWithOptions(0, map[string]string{
+			"appendonly":  "yes",
+			"appendfsync": "always",
+		}, "")
+		Expect(err).NotTo(HaveOccurred())
+		rdb = server.NewClient()
+		ctx = context.Background()
+	})
+
+	AfterEach(func() {
+		Expect(rdb.Close()).To(Succeed())
+		server.Stop()
+	})
+
+	It("should keep acknowledged writes across a crash", func() {
+		Expect(rdb.Set(ctx, "recovery:string", "v", 0).Err()).To(Succeed())
+		Expect(rdb.RPush(ctx, "recovery:list", "a", "b").Err()).To(Succeed())
+
+		Expect(server.Crash()).To(Succeed())
+		Expect(rdb.Close()).To(Succeed())
+		rdb = server.NewClient()
+
+		Expect(rdb.Get(ctx, "recovery:string").Val()).To(Equal("v"))
+		Expect(rdb.LRange(ctx, "recovery:list", 0, -1).Val()).To(Equal([]string{"a", "b"}))
+	})
+
+	It("should keep a dataset of every type across a crash", func() {
+		dataset, err := util.Seed(ctx, rdb, util.SeedOptions{
+			Prefix:   "recovery:seed",
+			Keys:     50,
+			TTLRatio: 0.3,
+			Seed:     1195,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dataset.Expiring()).NotTo(BeEmpty())
+
+		Expect(server.Crash()).To(Succeed())
+		Expect(rdb.Close()).To(Succeed())
+		rdb = server.NewClient()
+
+		Expect(dataset.Verify(ctx, rdb)).To(Succeed())
+	})
+
+	It("should keep keys and their TTLs across a graceful restart", func() {
+		Expect(rdb.Set(ctx, "recovery:ttl", "v", 100*time.Second).Err()).To(Succeed())
+		ttlBefore := rdb.TTL(ctx, "recovery:ttl").Val()
+
+		Expect(server.Restart()).To(Succeed())
+		Expect(rdb.Close()).To(Succeed())
+		rdb = server.NewClient()
+
+		Expect(rdb.Get(ctx, "recovery:ttl").Val()).To(Equal("v"))
+		ttlAfter := rdb.TTL(ctx, "recovery:ttl").Val()
+		Expect(ttlAfter).To(BeNumerically(">", 0))
+		Expect(ttlAfter).To(BeNumerically("<=", ttlBefore))
+	})
+
+	It("should load a snapshot into a new object store", func() {
+		Expect(rdb.Set(ctx, "recovery:snapshot", "v", 0).Err()).To(Succeed())
+		Expect(rdb.Save(ctx).Err()).To(Succeed())
+		snapshot, err := os.ReadFile(filepath.Join(server.DataDir(), "snapshot", "dump.nsnap"))
+		Expect(err).NotTo(HaveOccurred())
+
+		dir, err := os.MkdirTemp("", "nimbis-recovery")
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(os.RemoveAll, dir)
+		Expect(os.Mkdir(filepath.Join(dir, "snapshot"), 0o755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, "snapshot", "dump.nsnap"), snapshot, 0o600)).To(Succeed())
+
+		restored, err := util.StartServerWithOptions(0, nil, dir)
+		Expect(err).NotTo(HaveOccurred())
+		defer restored.Stop()
+		client := restored.NewClient()
+		defer client.Close()
+		Expect(client.Get(ctx, "recovery:snapshot").Val()).To(Equal("v"))
+	})
+})
@@ -0,0 +1,63 @@
+package tests
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/marsevilspirit/nimbis/e2e-test/util"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/redis/go-redis/v9"
+)
+
+var _ = Describe("Pipelining", func() {
+	var rdb *redis.Client
+	var ctx context.Context
+
+	BeforeEach(func() {
+		rdb = util.NewClient()
+		ctx = context.Background()
+		Expect(rdb.Del(ctx, "pipeline_counter", "pipeline_value", "pipeline_list").Err()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(rdb.Close()).To(Succeed())
+	})
+
+	It("should answer a long pipeline in order", func() {
+		pipe := rdb.Pipeline()
+		incrs := make([]*redis.IntCmd, 5000)
+		for i := range incrs {
+			incrs[i] = pipe.Incr(ctx, "pipeline_counter")
+		}
+		value := strings.Repeat("x", 100*1024)
+		set := pipe.Set(ctx, "pipeline_value", value, 0)
+		get := pipe.Get(ctx, "pipeline_value")
+		_, err := pipe.Exec(ctx)
+		Expect(err).NotTo(HaveOccurred())
+
+		for i, incr := range incrs {
+			Expect(incr.Val()).To(Equal(int64(i + 1)))
+		}
+		Expect(set.Val()).To(Equal("OK"))
+		Expect(get.Val()).To(Equal(value))
+	})
+
+	It("should answer the commands before a blocking command without waiting for it", func() {
+		conn, err := util.DialResp(util.Addr())
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+
+		Expect(conn.WriteRaw("PING\r\nBLPOP pipeline_list 3\r\n")).To(Succeed())
+
+		conn.SetTimeout(time.Second)
+		Expect(conn.ReadLine()).To(Equal("+PONG\r\n"))
+
+		Expect(rdb.RPush(ctx, "pipeline_list", "item").Err()).To(Succeed())
+		conn.SetTimeout(5 * time.Second)
+		reply, err := conn.ReadReply()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reply.Value()).To(Equal([]interface{}{"pipeline_list", "item"}))
+	})
+})
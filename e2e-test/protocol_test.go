@@ -0,0 +1,132 @@
+package tests
+
+import (
+	"context"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/marsevilspirit/nimbis/e2e-test/util"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/redis/go-redis/v9"
+)
+
+var _ = Describe("Protocol Limits", func() {
+	var rdb *redis.Client
+	var ctx context.Context
+	var conn *util.RespConn
+
+	BeforeEach(func() {
+		rdb = util.NewClient()
+		ctx = context.Background()
+
+		var err error
+		conn, err = util.DialResp(util.Addr())
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		conn.Close()
+		for field, value := range map[string]string{
+			"proto_max_inline_len":    "65536",
+			"proto_max_multibulk_len": "1048576",
+			"proto_max_bulk_len":      "536870912",
+		} {
+			Expect(rdb.ConfigSet(ctx, field, value).Err()).To(Succeed())
+		}
+		Expect(rdb.Close()).To(Succeed())
+	})
+
+	expectProtocolError := func(request, message string) {
+		Expect(conn.WriteRaw(request)).To(Succeed())
+
+		reply, err := conn.ReadReply()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reply.Kind).To(Equal(util.Error))
+		Expect(reply.Str).To(HavePrefix("ERR Protocol error"))
+		Expect(reply.Str).To(ContainSubstring(message))
+
+		_, err = conn.ReadReply()
+		Expect(err).To(MatchError(io.EOF))
+	}
+
+	It("should reject bulk strings above proto_max_bulk_len", func() {
+		Expect(rdb.ConfigSet(ctx, "proto_max_bulk_len", "16").Err()).To(Succeed())
+		Expect(rdb.Set(ctx, "proto_key", strings.Repeat("v", 16), 0).Err()).To(Succeed())
+
+		expectProtocolError("*3\r\n$3\r\nSET\r\n$9\r\nproto_key\r\n$1000000\r\n", "Bulk length 1000000 exceeds")
+	})
+
+	It("should reject multibulk requests above proto_max_multibulk_len", func() {
+		Expect(rdb.ConfigSet(ctx, "proto_max_multibulk_len", "3").Err()).To(Succeed())
+
+		expectProtocolError("*1000000\r\n", "Multibulk length 1000000 exceeds")
+	})
+
+	It("should reject inline commands above proto_max_inline_len", func() {
+		Expect(rdb.ConfigSet(ctx, "proto_max_inline_len", "32").Err()).To(Succeed())
+
+		expectProtocolError("SET proto_key "+strings.Repeat("v", 64), "Inline command exceeds")
+	})
+
+	It("should refuse a limit of 0", func() {
+		Expect(rdb.ConfigSet(ctx, "proto_max_bulk_len", "0").Err()).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("Protocol Framing", func() {
+	var conn *util.RespConn
+
+	BeforeEach(func() {
+		var err error
+		conn, err = util.DialResp(util.Addr())
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(conn.Close()).To(Succeed())
+	})
+
+	It("should wait for the rest of a partial request", func() {
+		request := util.EncodeCommand("SET", "framing:key", "value")
+		for _, cut := range []int{1, 4, 10, len(request) - 1} {
+			Expect(conn.WriteRaw(request[:cut])).To(Succeed())
+			Expect(conn.Silent(100 * time.Millisecond)).To(Succeed())
+			Expect(conn.WriteRaw(request[cut:])).To(Succeed())
+			Expect(conn.ReadReply()).To(Equal(util.Reply{Kind: util.SimpleString, Str: "OK"}))
+		}
+	})
+
+	It("should answer pipelined requests in order", func() {
+		Expect(conn.WriteRaw(util.EncodeCommand("SET", "framing:n", "1") +
+			util.EncodeCommand("INCR", "framing:n") +
+			"GET framing:n\r\n")).To(Succeed())
+
+		Expect(conn.ReadReply()).To(Equal(util.Reply{Kind: util.SimpleString, Str: "OK"}))
+		Expect(conn.ReadReply()).To(Equal(util.Reply{Kind: util.Integer, Int: 2}))
+		Expect(conn.ReadReply()).To(Equal(util.Reply{Kind: util.BulkString, Str: "2"}))
+	})
+
+	It("should reply with RESP2 nulls by default and RESP3 types after HELLO 3", func() {
+		Expect(conn.Do("GET", "framing:missing")).To(Equal(util.Reply{Kind: util.BulkString, Null: true}))
+
+		hello, err := conn.Do("HELLO", "3")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(hello.Kind).To(Equal(util.Map))
+		Expect(hello.Value()).To(ContainElements("proto", int64(3)))
+
+		Expect(conn.Do("GET", "framing:missing")).To(Equal(util.Reply{Kind: util.Null, Null: true}))
+	})
+
+	It("should close the connection after a malformed request", func() {
+		Expect(conn.WriteRaw("*1\r\n$x\r\n")).To(Succeed())
+
+		reply, err := conn.ReadReply()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reply.Kind).To(Equal(util.Error))
+		Expect(reply.Str).To(HavePrefix("ERR Protocol error"))
+		_, err = conn.ReadReply()
+		Expect(err).To(MatchError(io.EOF))
+	})
+})
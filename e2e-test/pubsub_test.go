@@ -0,0 +1,167 @@
+package tests
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/marsevilspirit/nimbis/e2e-test/util"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/redis/go-redis/v9"
+)
+
+var _ = Describe("Pub/Sub Commands", func() {
+	var rdb *redis.Client
+	var ctx context.Context
+
+	BeforeEach(func() {
+		rdb = util.NewClient()
+		ctx = context.Background()
+	})
+
+	AfterEach(func() {
+		Expect(rdb.Close()).To(Succeed())
+	})
+
+	receive := func(pubsub *redis.PubSub) *redis.Message {
+		ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		defer cancel()
+		msg, err := pubsub.ReceiveMessage(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		return msg
+	}
+
+	It("should deliver published messages to subscribers", func() {
+		Expect(rdb.Publish(ctx, "ps:news", "nobody").Val()).To(Equal(int64(0)))
+
+		first := rdb.Subscribe(ctx, "ps:news")
+		defer first.Close()
+		second := rdb.Subscribe(ctx, "ps:news", "ps:other")
+		defer second.Close()
+		_, err := first.Receive(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = second.Receive(ctx)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(rdb.Publish(ctx, "ps:news", "hello").Val()).To(Equal(int64(2)))
+		for _, pubsub := range []*redis.PubSub{first, second} {
+			msg := receive(pubsub)
+			Expect(msg.Channel).To(Equal("ps:news"))
+			Expect(msg.Payload).To(Equal("hello"))
+		}
+
+		Expect(rdb.Publish(ctx, "ps:other", "only second").Val()).To(Equal(int64(1)))
+		Expect(receive(second).Payload).To(Equal("only second"))
+	})
+
+	It("should stop delivering after UNSUBSCRIBE", func() {
+		pubsub := rdb.Subscribe(ctx, "ps:a", "ps:b")
+		defer pubsub.Close()
+		_, err := pubsub.Receive(ctx)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(pubsub.Unsubscribe(ctx, "ps:a")).To(Succeed())
+		Eventually(func() int64 {
+			return rdb.Publish(ctx, "ps:a", "x").Val()
+		}).Should(Equal(int64(0)))
+		Expect(rdb.Publish(ctx, "ps:b", "still here").Val()).To(Equal(int64(1)))
+		Expect(receive(pubsub).Payload).To(Equal("still here"))
+	})
+
+	It("should drop subscriptions when the client disconnects", func() {
+		pubsub := rdb.Subscribe(ctx, "ps:gone")
+		_, err := pubsub.Receive(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pubsub.Close()).To(Succeed())
+
+		Eventually(func() int64 {
+			return rdb.Publish(ctx, "ps:gone", "x").Val()
+		}).Should(Equal(int64(0)))
+	})
+
+	It("should deliver messages to pattern subscribers", func() {
+		pubsub := rdb.PSubscribe(ctx, "ps:news.*")
+		defer pubsub.Close()
+		_, err := pubsub.Receive(ctx)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(rdb.Publish(ctx, "ps:sports", "x").Val()).To(Equal(int64(0)))
+		Expect(rdb.Publish(ctx, "ps:news.tech", "hello").Val()).To(Equal(int64(1)))
+		msg := receive(pubsub)
+		Expect(msg.Pattern).To(Equal("ps:news.*"))
+		Expect(msg.Channel).To(Equal("ps:news.tech"))
+		Expect(msg.Payload).To(Equal("hello"))
+
+		Expect(pubsub.Subscribe(ctx, "ps:news.tech")).To(Succeed())
+		Eventually(func() int64 {
+			return rdb.Publish(ctx, "ps:news.tech", "twice").Val()
+		}).Should(Equal(int64(2)))
+
+		Expect(pubsub.PUnsubscribe(ctx)).To(Succeed())
+		Eventually(func() int64 {
+			return rdb.PubSubNumPat(ctx).Val()
+		}).Should(Equal(int64(0)))
+	})
+
+	It("should report active channels and subscriber counts", func() {
+		first := rdb.Subscribe(ctx, "ps:intro:a", "ps:intro:b")
+		defer first.Close()
+		second := rdb.Subscribe(ctx, "ps:intro:a")
+		defer second.Close()
+		patterns := rdb.PSubscribe(ctx, "ps:intro:*")
+		defer patterns.Close()
+		for _, pubsub := range []*redis.PubSub{first, second, patterns} {
+			_, err := pubsub.Receive(ctx)
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		Eventually(func() []string {
+			return rdb.PubSubChannels(ctx, "ps:intro:*").Val()
+		}).Should(ConsistOf("ps:intro:a", "ps:intro:b"))
+		Eventually(func() map[string]int64 {
+			return rdb.PubSubNumSub(ctx, "ps:intro:a", "ps:intro:b", "ps:intro:c").Val()
+		}).Should(Equal(map[string]int64{"ps:intro:a": 2, "ps:intro:b": 1, "ps:intro:c": 0}))
+		Expect(rdb.PubSubNumPat(ctx).Val()).To(Equal(int64(1)))
+
+		Expect(rdb.Do(ctx, "PUBSUB", "NOPE").Err()).To(MatchError("ERR unknown PUBSUB subcommand 'NOPE'. Try PUBSUB HELP."))
+	})
+
+	It("should disconnect subscribers over the output buffer limit", func() {
+		Expect(rdb.ConfigSet(ctx, "client_output_buffer_limit", "pubsub 64kb 0 0").Err()).To(Succeed())
+		defer func() {
+			Expect(rdb.ConfigSet(ctx, "client_output_buffer_limit", "pubsub 32mb 8mb 60").Err()).To(Succeed())
+		}()
+
+		slow := dialRaw()
+		defer slow.close()
+		Expect(slow.do("SUBSCRIBE", "ps:slow")).To(Equal([]interface{}{"subscribe", "ps:slow", int64(1)}))
+
+		Expect(rdb.Publish(ctx, "ps:slow", "small").Val()).To(Equal(int64(1)))
+		Expect(slow.read()).To(Equal([]interface{}{"message", "ps:slow", "small"}))
+		Expect(rdb.Publish(ctx, "ps:slow", strings.Repeat("x", 100*1024)).Val()).To(Equal(int64(0)))
+		_, err := slow.ReadReply()
+		Expect(err).To(HaveOccurred())
+		Eventually(func() int64 {
+			return rdb.Publish(ctx, "ps:slow", "x").Val()
+		}).Should(Equal(int64(0)))
+	})
+
+	It("should restrict RESP2 connections in subscribe mode", func() {
+		resp2 := redis.NewClient(&redis.Options{Addr: util.Addr(), Protocol: 2})
+		defer resp2.Close()
+		conn := resp2.Conn()
+		defer conn.Close()
+
+		reply, err := conn.Do(ctx, "SUBSCRIBE", "ps:resp2").Slice()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reply).To(Equal([]interface{}{"subscribe", "ps:resp2", int64(1)}))
+
+		Expect(conn.Do(ctx, "GET", "ps:key").Err()).To(MatchError(ContainSubstring("Can't execute 'get'")))
+		Expect(conn.Do(ctx, "PING").Slice()).To(Equal([]interface{}{"pong", ""}))
+
+		Expect(conn.Do(ctx, "RESET").Text()).To(Equal("RESET"))
+		Expect(rdb.Publish(ctx, "ps:resp2", "x").Val()).To(Equal(int64(0)))
+		Expect(conn.Do(ctx, "PING").Text()).To(Equal("PONG"))
+	})
+})
@@ -0,0 +1,86 @@
+package tests
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/marsevilspirit/nimbis/e2e-test/util"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/redis/go-redis/v9"
+)
+
+var _ = Describe("Rate Limits", func() {
+	var rdb *redis.Client
+	var ctx context.Context
+
+	BeforeEach(func() {
+		rdb = util.NewClient()
+		ctx = context.Background()
+	})
+
+	AfterEach(func() {
+		Expect(rdb.ConfigSet(ctx, "client_commands_per_second", "0").Err()).To(Succeed())
+		Expect(rdb.ConfigSet(ctx, "user_commands_per_second", "0").Err()).To(Succeed())
+		Expect(rdb.Close()).To(Succeed())
+	})
+
+	limitedPings := func(client *redis.Client, n int) int {
+		pipe := client.Pipeline()
+		pings := make([]*redis.StatusCmd, n)
+		for i := range pings {
+			pings[i] = pipe.Ping(ctx)
+		}
+		_, _ = pipe.Exec(ctx)
+		limited := 0
+		for _, ping := range pings {
+			if err := ping.Err(); err != nil {
+				Expect(err.Error()).To(HavePrefix("RATELIMIT"))
+				limited++
+			}
+		}
+		return limited
+	}
+
+	It("should limit the commands of each connection", func() {
+		Expect(rdb.ConfigSet(ctx, "client_commands_per_second", "5").Err()).To(Succeed())
+
+		client := util.NewClient()
+		defer client.Close()
+		Expect(limitedPings(client, 20)).To(BeNumerically(">=", 10))
+
+		other := util.NewClient()
+		defer other.Close()
+		Expect(other.Ping(ctx).Err()).To(Succeed())
+
+		stat, err := util.InfoField(rdb, "stats", "rate_limited_commands")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(strconv.Atoi(stat)).To(BeNumerically(">=", 10))
+	})
+
+	It("should share the limit of a user across its connections", func() {
+		Expect(rdb.Do(ctx, "ACL", "SETUSER", "ratelimited", "on", "nopass", "+@all", "~*").Err()).To(Succeed())
+		DeferCleanup(func() {
+			Expect(rdb.Do(ctx, "ACL", "DELUSER", "ratelimited").Err()).To(Succeed())
+		})
+		Expect(rdb.ConfigSet(ctx, "user_commands_per_second", "10").Err()).To(Succeed())
+
+		first := util.NewClient().Conn()
+		defer first.Close()
+		second := util.NewClient().Conn()
+		defer second.Close()
+		Expect(first.Do(ctx, "AUTH", "ratelimited", "any").Err()).To(Succeed())
+		Expect(second.Do(ctx, "AUTH", "ratelimited", "any").Err()).To(Succeed())
+
+		limited := 0
+		for i := 0; i < 15; i++ {
+			for _, conn := range []*redis.Conn{first, second} {
+				if err := conn.Ping(ctx).Err(); err != nil {
+					Expect(err.Error()).To(HavePrefix("RATELIMIT"))
+					limited++
+				}
+			}
+		}
+		Expect(limited).To(BeNumerically(">=", 10))
+	})
+})
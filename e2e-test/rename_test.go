@@ -0,0 +1,77 @@
+package tests
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/marsevilspirit/nimbis/e2e-test/util"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/redis/go-redis/v9"
+)
+
+var _ = Describe("Renamed Commands", Ordered, func() {
+	var rdb *redis.Client
+	var ctx context.Context
+
+	BeforeAll(func() {
+		skipIfExternal()
+		dir, err := os.MkdirTemp("", "nimbis-rename")
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(os.RemoveAll, dir)
+
+		config := filepath.Join(dir, "config.toml")
+		Expect(os.WriteFile(config, []byte(`
+[rename_command]
+FLUSHALL = ""
+CONFIG = "admin-config"
+`), 0o600)).To(Succeed())
+
+		Expect(util.StartServerWithConfig(config)).To(Succeed())
+		DeferCleanup(util.StopServerWithConfig)
+	})
+
+	BeforeEach(func() {
+		rdb = util.NewConfigServerClient()
+		ctx = context.Background()
+	})
+
+	AfterEach(func() {
+		Expect(rdb.Close()).To(Succeed())
+	})
+
+	It("should refuse disabled commands", func() {
+		err := rdb.FlushAll(ctx).Err()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("unknown command 'flushall'"))
+	})
+
+	It("should only run renamed commands under their new name", func() {
+		err := rdb.ConfigGet(ctx, "port").Err()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("unknown command 'config'"))
+
+		result, err := rdb.Do(ctx, "admin-config", "GET", "port").Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).NotTo(BeEmpty())
+	})
+
+	It("should abort a transaction that queues a disabled command", func() {
+		pipe := rdb.TxPipeline()
+		pipe.Set(ctx, "rename:key", "v", 0)
+		pipe.FlushAll(ctx)
+		_, err := pipe.Exec(ctx)
+		Expect(err).To(HaveOccurred())
+		Expect(rdb.Exists(ctx, "rename:key").Val()).To(Equal(int64(0)))
+	})
+
+	It("should apply the names to scripts", func() {
+		_, err := rdb.Eval(ctx, "return redis.call('flushall')", nil).Result()
+		Expect(err).To(HaveOccurred())
+
+		result, err := rdb.Eval(ctx, "return redis.call('admin-config', 'get', 'port')", nil).StringSlice()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(HaveLen(2))
+	})
+})
@@ -0,0 +1,505 @@
+package tests
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/marsevilspirit/nimbis/e2e-test/util"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/redis/go-redis/v9"
+)
+
+var _ = Describe("Replication", Ordered, func() {
+	var rdb *redis.Client
+	var replica *redis.Client
+	var ctx context.Context
+
+	BeforeAll(func() {
+		skipIfExternal()
+		Expect(util.StartReplicaServer()).To(Succeed())
+	})
+
+	AfterAll(func() {
+		util.StopReplicaServer()
+	})
+
+	BeforeEach(func() {
+		rdb = util.NewClient()
+		replica = util.NewReplicaClient()
+		ctx = context.Background()
+		Expect(rdb.FlushDB(ctx).Err()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(util.StopReplicating(replica)).To(Succeed())
+		Expect(replica.Close()).To(Succeed())
+		Expect(rdb.Close()).To(Succeed())
+	})
+
+	replicationInfo := func() string {
+		return replica.Info(ctx, "replication").Val()
+	}
+
+	It("should copy the dataset and stream new writes", func() {
+		Expect(rdb.Set(ctx, "repl:string", "before", 0).Err()).To(Succeed())
+		Expect(rdb.HSet(ctx, "repl:hash", "f", "v").Err()).To(Succeed())
+		Expect(replica.Set(ctx, "repl:stale", "x", 0).Err()).To(Succeed())
+
+		Expect(util.StartReplicaOf(replica, util.Addr())).To(Succeed())
+		Expect(replica.Get(ctx, "repl:string").Val()).To(Equal("before"))
+		Expect(replica.HGet(ctx, "repl:hash", "f").Val()).To(Equal("v"))
+		Expect(replica.Exists(ctx, "repl:stale").Val()).To(Equal(int64(0)))
+
+		Expect(rdb.Set(ctx, "repl:string", "after", 0).Err()).To(Succeed())
+		Expect(rdb.RPush(ctx, "repl:list", "a", "b").Err()).To(Succeed())
+		Expect(rdb.Del(ctx, "repl:hash").Err()).To(Succeed())
+		Expect(util.ReplicaGet(rdb, replica, "repl:string")).To(Equal("after"))
+		Expect(replica.LRange(ctx, "repl:list", 0, -1).Val()).To(Equal([]string{"a", "b"}))
+		Expect(replica.Exists(ctx, "repl:hash").Val()).To(Equal(int64(0)))
+
+		info := rdb.Info(ctx, "replication").Val()
+		Expect(info).To(ContainSubstring("role:master"))
+		Expect(info).To(ContainSubstring("connected_slaves:1"))
+		Expect(info).To(ContainSubstring(fmt.Sprintf("port=%d", util.ReplicaPort())))
+		Expect(replicationInfo()).To(ContainSubstring("role:slave"))
+		Expect(replicationInfo()).To(ContainSubstring(fmt.Sprintf("master_port:%d", util.Port())))
+	})
+
+	It("should stream transactions and stream IDs as the primary applied them", func() {
+		Expect(util.StartReplicaOf(replica, util.Addr())).To(Succeed())
+		Expect(replica.Do(ctx, "REPLICAOF", "localhost", strconv.Itoa(util.Port())).Val()).To(Equal("OK Already connected to specified master"))
+
+		_, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Incr(ctx, "repl:counter")
+			pipe.Incr(ctx, "repl:counter")
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+		id := rdb.XAdd(ctx, &redis.XAddArgs{Stream: "repl:stream", Values: []string{"f", "v"}}).Val()
+
+		Eventually(func() []redis.XMessage {
+			return replica.XRange(ctx, "repl:stream", "-", "+").Val()
+		}, 5*time.Second, 50*time.Millisecond).Should(HaveLen(1))
+		Expect(replica.XRange(ctx, "repl:stream", "-", "+").Val()[0].ID).To(Equal(id))
+		Expect(replica.Get(ctx, "repl:counter").Val()).To(Equal("2"))
+	})
+
+	It("should stream concurrent writes to many keys in the order each key applied them", func() {
+		Expect(util.StartReplicaOf(replica, util.Addr())).To(Succeed())
+
+		const numKeys = 8
+		const numIncrements = 200
+		var wg sync.WaitGroup
+		for k := 0; k < numKeys; k++ {
+			wg.Add(1)
+			go func(key string) {
+				defer wg.Done()
+				defer GinkgoRecover()
+				for i := 0; i < numIncrements; i++ {
+					Expect(rdb.Incr(ctx, key).Err()).To(Succeed())
+					// The last SET of a key has to win on the replica too.
+					Expect(rdb.Set(ctx, key+":last", i, 0).Err()).To(Succeed())
+				}
+			}(fmt.Sprintf("repl:striped:%d", k))
+		}
+		wg.Wait()
+
+		for k := 0; k < numKeys; k++ {
+			key := fmt.Sprintf("repl:striped:%d", k)
+			Expect(util.ReplicaGet(rdb, replica, key)).To(Equal(strconv.Itoa(numIncrements)))
+			Expect(replica.Get(ctx, key+":last").Val()).To(Equal(strconv.Itoa(numIncrements - 1)))
+		}
+	})
+
+	It("should keep the dataset after REPLICAOF NO ONE", func() {
+		Expect(rdb.Set(ctx, "repl:kept", "1", 0).Err()).To(Succeed())
+		Expect(util.StartReplicaOf(replica, util.Addr())).To(Succeed())
+		replid := infoField(rdb.Info(ctx, "replication").Val(), "master_replid")
+		Expect(infoField(replicationInfo(), "master_replid")).To(Equal(replid))
+
+		// The promoted replica takes over the stream of its old primary.
+		Expect(replica.Do(ctx, "REPLICAOF", "NO", "ONE").Val()).To(Equal("OK"))
+		Expect(replicationInfo()).To(ContainSubstring("role:master"))
+		Expect(infoField(replicationInfo(), "master_replid")).NotTo(Equal(replid))
+		Expect(infoField(replicationInfo(), "master_replid2")).To(Equal(replid))
+		Expect(rdb.Set(ctx, "repl:kept", "2", 0).Err()).To(Succeed())
+		Consistently(func() string {
+			return replica.Get(ctx, "repl:kept").Val()
+		}, 500*time.Millisecond, 50*time.Millisecond).Should(Equal("1"))
+		Eventually(func() string {
+			return rdb.Info(ctx, "replication").Val()
+		}, 5*time.Second, 50*time.Millisecond).Should(ContainSubstring("connected_slaves:0"))
+	})
+
+	It("should refuse writes on a read-only replica unless the client sends READWRITE", func() {
+		Expect(util.StartReplicaOf(replica, util.Addr())).To(Succeed())
+
+		err := replica.Set(ctx, "repl:local", "1", 0).Err()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(HavePrefix("READONLY"))
+		Expect(replica.Get(ctx, "repl:local").Err()).To(Equal(redis.Nil))
+
+		// The override belongs to one connection.
+		conn := replica.Conn()
+		defer conn.Close()
+		Expect(conn.Do(ctx, "READWRITE").Val()).To(Equal("OK"))
+		Expect(conn.Set(ctx, "repl:local", "1", 0).Err()).To(Succeed())
+		Expect(replica.Set(ctx, "repl:other", "1", 0).Err()).To(HaveOccurred())
+		Expect(conn.Do(ctx, "READONLY").Val()).To(Equal("OK"))
+		Expect(conn.Set(ctx, "repl:local", "2", 0).Err()).To(HaveOccurred())
+
+		Expect(replica.ConfigSet(ctx, "replica_read_only", "false").Err()).To(Succeed())
+		Expect(replica.Set(ctx, "repl:other", "1", 0).Err()).To(Succeed())
+		Expect(replica.ConfigSet(ctx, "replica_read_only", "true").Err()).To(Succeed())
+	})
+
+	It("should give replicas the expire time the primary set", func() {
+		Expect(util.StartReplicaOf(replica, util.Addr())).To(Succeed())
+
+		Expect(rdb.Set(ctx, "repl:ttl", "v", 0).Err()).To(Succeed())
+		Expect(rdb.Expire(ctx, "repl:ttl", time.Hour).Val()).To(BeTrue())
+		Expect(rdb.Set(ctx, "repl:short", "v", 0).Err()).To(Succeed())
+		Expect(rdb.Expire(ctx, "repl:short", time.Second).Val()).To(BeTrue())
+
+		Eventually(func() time.Duration {
+			return replica.TTL(ctx, "repl:ttl").Val()
+		}, 5*time.Second, 50*time.Millisecond).Should(BeNumerically(">", 59*time.Minute))
+		Eventually(func() int64 {
+			return replica.Exists(ctx, "repl:short").Val()
+		}, 5*time.Second, 100*time.Millisecond).Should(Equal(int64(0)))
+	})
+
+	It("should resume a reconnecting replica from the backlog", func() {
+		dial := func() (net.Conn, *bufio.Reader) {
+			conn, err := net.Dial("tcp", util.Addr())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(conn.SetDeadline(time.Now().Add(5 * time.Second))).To(Succeed())
+			return conn, bufio.NewReader(conn)
+		}
+		readLine := func(reader *bufio.Reader) string {
+			line, err := reader.ReadString('\n')
+			Expect(err).NotTo(HaveOccurred())
+			return line
+		}
+
+		conn, reader := dial()
+		_, err := conn.Write([]byte("PSYNC ? -1\r\n"))
+		Expect(err).NotTo(HaveOccurred())
+		fields := strings.Fields(readLine(reader))
+		Expect(fields).To(HaveLen(3))
+		Expect(fields[0]).To(Equal("+FULLRESYNC"))
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(readLine(reader), "$")))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = io.ReadFull(reader, make([]byte, size))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conn.Close()).To(Succeed())
+
+		Expect(rdb.Set(ctx, "repl:missed", "v", 0).Err()).To(Succeed())
+
+		offset, err := strconv.ParseInt(fields[2], 10, 64)
+		Expect(err).NotTo(HaveOccurred())
+		conn, reader = dial()
+		defer conn.Close()
+		_, err = fmt.Fprintf(conn, "PSYNC %s %d\r\n", fields[1], offset+1)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(readLine(reader)).To(Equal("+CONTINUE " + fields[1] + "\r\n"))
+		var frame strings.Builder
+		for range 7 {
+			frame.WriteString(readLine(reader))
+		}
+		Expect(frame.String()).To(Equal("*3\r\n$3\r\nSET\r\n$11\r\nrepl:missed\r\n$1\r\nv\r\n"))
+
+		info := rdb.Info(ctx, "replication").Val()
+		Expect(info).To(ContainSubstring("repl_backlog_active:1"))
+		Expect(info).To(ContainSubstring("repl_backlog_size:1048576"))
+
+		// A stream the primary does not know gets a full resync.
+		other, otherReader := dial()
+		defer other.Close()
+		_, err = other.Write([]byte("PSYNC 0000000000000000000000000000000000000000 1\r\n"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(readLine(otherReader)).To(HavePrefix("+FULLRESYNC "))
+	})
+
+	It("should hand the primary role to a replica with FAILOVER", func() {
+		Expect(rdb.Set(ctx, "repl:before", "1", 0).Err()).To(Succeed())
+		Expect(util.StartReplicaOf(replica, util.Addr())).To(Succeed())
+		Eventually(func() string {
+			return rdb.Info(ctx, "replication").Val()
+		}, 5*time.Second, 50*time.Millisecond).Should(ContainSubstring(fmt.Sprintf("port=%d", util.ReplicaPort())))
+		Expect(rdb.Info(ctx, "replication").Val()).To(ContainSubstring("master_failover_state:no-failover"))
+		defer func() {
+			Expect(rdb.Do(ctx, "REPLICAOF", "NO", "ONE").Err()).To(Succeed())
+		}()
+
+		Expect(rdb.Do(ctx, "FAILOVER", "TIMEOUT", "5000").Val()).To(Equal("OK"))
+		Eventually(replicationInfo, 10*time.Second, 50*time.Millisecond).Should(ContainSubstring("role:master"))
+		Eventually(func() string {
+			return rdb.Info(ctx, "replication").Val()
+		}, 10*time.Second, 100*time.Millisecond).Should(ContainSubstring("master_link_status:up"))
+		info := rdb.Info(ctx, "replication").Val()
+		Expect(info).To(ContainSubstring("role:slave"))
+		Expect(info).To(ContainSubstring(fmt.Sprintf("master_port:%d", util.ReplicaPort())))
+		Expect(info).To(ContainSubstring("master_failover_state:no-failover"))
+
+		// The old primary is now a read-only replica of the new one.
+		Expect(rdb.Set(ctx, "repl:after", "1", 0).Err()).To(HaveOccurred())
+		Expect(replica.Get(ctx, "repl:before").Val()).To(Equal("1"))
+		Expect(replica.Set(ctx, "repl:after", "2", 0).Err()).To(Succeed())
+		Eventually(func() string {
+			return rdb.Get(ctx, "repl:after").Val()
+		}, 5*time.Second, 50*time.Millisecond).Should(Equal("2"))
+	})
+
+	It("should reject FAILOVER without a suitable replica", func() {
+		err := rdb.Do(ctx, "FAILOVER").Err()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("requires connected replicas"))
+
+		err = rdb.Do(ctx, "FAILOVER", "ABORT").Err()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("No failover in progress"))
+
+		err = rdb.Do(ctx, "FAILOVER", "TO", "localhost", strconv.Itoa(util.ReplicaPort()), "FORCE").Err()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("requires both a timeout"))
+
+		Expect(util.StartReplicaOf(replica, util.Addr())).To(Succeed())
+		err = rdb.Do(ctx, "FAILOVER", "TO", "10.255.255.1", "6380").Err()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("is not a replica"))
+
+		err = replica.Do(ctx, "FAILOVER").Err()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("not valid when server is a replica"))
+	})
+
+	It("should count the replicas that acknowledged earlier writes with WAITAOF", func() {
+		Expect(util.StartReplicaOf(replica, util.Addr())).To(Succeed())
+		Expect(rdb.Set(ctx, "repl:waitaof", "v", 0).Err()).To(Succeed())
+		Expect(rdb.Do(ctx, "WAITAOF", 1, 1, 5000).Val()).To(Equal([]interface{}{int64(1), int64(1)}))
+		Expect(replica.Get(ctx, "repl:waitaof").Val()).To(Equal("v"))
+
+		// With one replica, waiting for two runs out the timeout.
+		start := time.Now()
+		Expect(rdb.Do(ctx, "WAITAOF", 0, 2, 200).Val()).To(Equal([]interface{}{int64(0), int64(1)}))
+		Expect(time.Since(start)).To(BeNumerically(">=", 200*time.Millisecond))
+
+		err := replica.Do(ctx, "WAITAOF", 0, 0, 0).Err()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("cannot be used with replica instances"))
+	})
+
+	It("should only count replicas that flushed their log with WAITAOF", func() {
+		Expect(util.StopReplicating(replica)).To(Succeed())
+		Eventually(func() string {
+			return rdb.Info(ctx, "replication").Val()
+		}, 5*time.Second, 50*time.Millisecond).Should(ContainSubstring("connected_slaves:0"))
+
+		conn, err := net.Dial("tcp", util.Addr())
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		Expect(conn.SetDeadline(time.Now().Add(5 * time.Second))).To(Succeed())
+		reader := bufio.NewReader(conn)
+		_, err = conn.Write([]byte("PSYNC ? -1\r\n"))
+		Expect(err).NotTo(HaveOccurred())
+		line, err := reader.ReadString('\n')
+		Expect(err).NotTo(HaveOccurred())
+		Expect(line).To(HavePrefix("+FULLRESYNC "))
+		line, err = reader.ReadString('\n')
+		Expect(err).NotTo(HaveOccurred())
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = io.ReadFull(reader, make([]byte, size))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rdb.Set(ctx, "repl:waitaof:fack", "v", 0).Err()).To(Succeed())
+
+		// Applying the stream is not enough without flushing it.
+		_, err = conn.Write([]byte(util.EncodeCommand("REPLCONF", "ACK", "1000000000")))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rdb.Do(ctx, "WAITAOF", 0, 1, 300).Val()).To(Equal([]interface{}{int64(0), int64(0)}))
+
+		_, err = conn.Write([]byte(util.EncodeCommand("REPLCONF", "ACK", "1000000000", "FACK", "1000000000")))
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(func() interface{} {
+			return rdb.Do(ctx, "WAITAOF", 0, 1, 100).Val()
+		}, 5*time.Second, 50*time.Millisecond).Should(Equal([]interface{}{int64(0), int64(1)}))
+	})
+
+	It("should give replicas the function libraries of the primary", func() {
+		defer func() {
+			Expect(rdb.FunctionFlush(ctx).Err()).To(Succeed())
+			Expect(replica.FunctionFlush(ctx).Err()).To(Succeed())
+		}()
+		Expect(rdb.FunctionLoad(ctx, functionLibrary).Err()).To(Succeed())
+		Expect(replica.FunctionLoad(ctx, "#!lua name=stale\nredis.register_function('stale', function() return 1 end)").Err()).To(Succeed())
+
+		// A full resync replaces the libraries of the replica.
+		Expect(util.StartReplicaOf(replica, util.Addr())).To(Succeed())
+		Expect(replica.Do(ctx, "FCALL_RO", "e2e_echo", 0, "hi").Val()).To(Equal("hi"))
+		err := replica.Do(ctx, "FCALL_RO", "stale", 0).Err()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("Function not found"))
+
+		// Changes are streamed, and so are the writes the functions make.
+		Expect(rdb.Do(ctx, "FCALL", "e2e_set", 1, "repl:fcall", "v").Val()).To(Equal("v"))
+		Expect(rdb.FunctionDelete(ctx, "e2elib").Err()).To(Succeed())
+		Expect(util.WaitForSyncOffset(rdb, replica)).To(Succeed())
+		Expect(replica.Get(ctx, "repl:fcall").Val()).To(Equal("v"))
+		err = replica.Do(ctx, "FCALL_RO", "e2e_echo", 0, "hi").Err()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("Function not found"))
+
+		Expect(rdb.FunctionLoad(ctx, functionLibrary).Err()).To(Succeed())
+		Expect(util.WaitForSyncOffset(rdb, replica)).To(Succeed())
+		Expect(replica.Do(ctx, "FCALL_RO", "e2e_echo", 0, "hi").Val()).To(Equal("hi"))
+	})
+
+	It("should authenticate to a password-protected primary with masterauth", func() {
+		primary, err := util.StartServerWithOptions(0, nil, "")
+		Expect(err).NotTo(HaveOccurred())
+		defer primary.Stop()
+		admin := primary.NewClient()
+		Expect(admin.Do(ctx, "ACL", "SETUSER", "repl", "on", ">replpass", "+@all", "~*").Err()).To(Succeed())
+		Expect(admin.Do(ctx, "ACL", "SETUSER", "default", "resetpass", ">primarypass").Err()).To(Succeed())
+		Expect(admin.Close()).To(Succeed())
+		client := redis.NewClient(&redis.Options{Addr: primary.Addr(), Password: "primarypass"})
+		defer client.Close()
+		Expect(client.Set(ctx, "repl:auth", "v", 0).Err()).To(Succeed())
+		defer func() {
+			Expect(replica.ConfigSet(ctx, "masteruser", "").Err()).To(Succeed())
+			Expect(replica.ConfigSet(ctx, "masterauth", "").Err()).To(Succeed())
+		}()
+
+		// Without the password the primary refuses the replica.
+		host, port, err := net.SplitHostPort(primary.Addr())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(replica.Do(ctx, "REPLICAOF", host, port).Err()).To(Succeed())
+		Consistently(replicationInfo, time.Second, 100*time.Millisecond).ShouldNot(ContainSubstring("master_link_status:up"))
+		Expect(util.StopReplicating(replica)).To(Succeed())
+
+		Expect(replica.ConfigSet(ctx, "masterauth", "primarypass").Err()).To(Succeed())
+		Expect(util.StartReplicaOf(replica, primary.Addr())).To(Succeed())
+		Expect(replica.Get(ctx, "repl:auth").Val()).To(Equal("v"))
+		Expect(util.StopReplicating(replica)).To(Succeed())
+
+		Expect(replica.ConfigSet(ctx, "masteruser", "repl").Err()).To(Succeed())
+		Expect(replica.ConfigSet(ctx, "masterauth", "replpass").Err()).To(Succeed())
+		Expect(util.StartReplicaOf(replica, primary.Addr())).To(Succeed())
+		Expect(client.Set(ctx, "repl:auth", "w", 0).Err()).To(Succeed())
+		Expect(util.WaitForSyncOffset(client, replica)).To(Succeed())
+		Expect(replica.Get(ctx, "repl:auth").Val()).To(Equal("w"))
+	})
+
+	It("should report the topology with ROLE", func() {
+		replicas := func() []interface{} {
+			return rdb.Do(ctx, "ROLE").Val().([]interface{})[2].([]interface{})
+		}
+		Eventually(replicas, 5*time.Second, 50*time.Millisecond).Should(BeEmpty())
+
+		Expect(util.StartReplicaOf(replica, util.Addr())).To(Succeed())
+		Eventually(replicas, 5*time.Second, 50*time.Millisecond).Should(HaveLen(1))
+
+		role := rdb.Do(ctx, "ROLE").Val().([]interface{})
+		Expect(role[0]).To(Equal("master"))
+		Expect(role[2].([]interface{})[0].([]interface{})[1]).To(Equal(strconv.Itoa(util.ReplicaPort())))
+
+		role = replica.Do(ctx, "ROLE").Val().([]interface{})
+		Expect(role[:4]).To(Equal([]interface{}{"slave", "localhost", int64(util.Port()), "connected"}))
+	})
+
+	It("should reject a bad port and accept REPLCONF", func() {
+		err := replica.Do(ctx, "REPLICAOF", "localhost", "port").Err()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("Invalid master port"))
+
+		Expect(rdb.Do(ctx, "REPLCONF", "listening-port", "6390").Val()).To(Equal("OK"))
+	})
+})
+
+var _ = Describe("Replica chaining", Ordered, func() {
+	var rdb *redis.Client
+	var replica *redis.Client
+	var sub *redis.Client
+	var ctx context.Context
+
+	BeforeAll(func() {
+		skipIfExternal()
+		Expect(util.StartReplicaServer()).To(Succeed())
+		Expect(util.StartSubReplicaServer()).To(Succeed())
+	})
+
+	AfterAll(func() {
+		util.StopSubReplicaServer()
+		util.StopReplicaServer()
+	})
+
+	BeforeEach(func() {
+		rdb = util.NewClient()
+		replica = util.NewReplicaClient()
+		sub = util.NewSubReplicaClient()
+		ctx = context.Background()
+		Expect(rdb.FlushDB(ctx).Err()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(util.StopReplicating(sub)).To(Succeed())
+		Expect(replica.Do(ctx, "REPLICAOF", "NO", "ONE").Err()).To(Succeed())
+		Expect(sub.Close()).To(Succeed())
+		Expect(replica.Close()).To(Succeed())
+		Expect(rdb.Close()).To(Succeed())
+	})
+
+	linkUp := func(client *redis.Client) func() string {
+		return func() string {
+			return infoField(client.Info(ctx, "replication").Val(), "master_link_status")
+		}
+	}
+
+	It("should pass the stream of the primary on to a replica of a replica", func() {
+		Expect(rdb.Set(ctx, "chain:before", "1", 0).Err()).To(Succeed())
+		Expect(util.StartReplicaOf(replica, util.Addr())).To(Succeed())
+		Expect(util.StartReplicaOf(sub, util.ReplicaAddr())).To(Succeed())
+		Expect(sub.Get(ctx, "chain:before").Val()).To(Equal("1"))
+
+		_, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, "chain:after", "2", 0)
+			pipe.RPush(ctx, "chain:list", "a")
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(util.ReplicaGet(rdb, sub, "chain:after")).To(Equal("2"))
+		Expect(sub.LRange(ctx, "chain:list", 0, -1).Val()).To(Equal([]string{"a"}))
+
+		primaryInfo := rdb.Info(ctx, "replication").Val()
+		Expect(primaryInfo).To(ContainSubstring("connected_slaves:1"))
+		Expect(replica.Info(ctx, "replication").Val()).To(ContainSubstring("connected_slaves:1"))
+		subInfo := sub.Info(ctx, "replication").Val()
+		Expect(infoField(subInfo, "master_replid")).To(Equal(infoField(primaryInfo, "master_replid")))
+	})
+
+	It("should not serve replicas while its own link is down", func() {
+		Expect(replica.Do(ctx, "REPLICAOF", "localhost", "6399").Val()).To(Equal("OK"))
+		Expect(sub.Do(ctx, "REPLICAOF", "localhost", strconv.Itoa(util.ReplicaPort())).Val()).To(Equal("OK"))
+		Consistently(linkUp(sub), 2*time.Second, 200*time.Millisecond).Should(Equal("down"))
+		Expect(replica.Info(ctx, "replication").Val()).To(ContainSubstring("connected_slaves:0"))
+	})
+})
+
+// infoField returns the value of field in an INFO reply.
+func infoField(info, field string) string {
+	for _, line := range strings.Split(info, "\r\n") {
+		if value, ok := strings.CutPrefix(line, field+":"); ok {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,186 @@
+package tests
+
+import (
+	"context"
+	"time"
+
+	"github.com/marsevilspirit/nimbis/e2e-test/util"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/redis/go-redis/v9"
+)
+
+var _ = Describe("Scripting Commands", func() {
+	var rdb *redis.Client
+	var ctx context.Context
+
+	BeforeEach(func() {
+		rdb = util.NewClient()
+		ctx = context.Background()
+		Expect(rdb.FlushDB(ctx).Err()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(rdb.Close()).To(Succeed())
+	})
+
+	It("should bind KEYS and ARGV", func() {
+		result, err := rdb.Eval(ctx, "return {KEYS[1], KEYS[2], ARGV[1]}", []string{"k1", "k2"}, "a1").Slice()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal([]interface{}{"k1", "k2", "a1"}))
+	})
+
+	It("should convert Lua values to replies", func() {
+		Expect(rdb.Eval(ctx, "return 42", nil).Val()).To(Equal(int64(42)))
+		Expect(rdb.Eval(ctx, "return 3.7", nil).Val()).To(Equal(int64(3)))
+		Expect(rdb.Eval(ctx, "return true", nil).Val()).To(Equal(int64(1)))
+		Expect(rdb.Eval(ctx, "return redis.status_reply('FINE')", nil).Val()).To(Equal("FINE"))
+
+		err := rdb.Eval(ctx, "return false", nil).Err()
+		Expect(err).To(Equal(redis.Nil))
+
+		err = rdb.Eval(ctx, "return redis.error_reply('MYERR custom')", nil).Err()
+		Expect(err).To(MatchError("MYERR custom"))
+	})
+
+	It("should run commands with redis.call", func() {
+		script := `
+			redis.call("SET", KEYS[1], ARGV[1])
+			redis.call("HSET", KEYS[2], "field", ARGV[1])
+			return redis.call("INCR", KEYS[1])
+		`
+		result, err := rdb.Eval(ctx, script, []string{"script:counter", "script:hash"}, "10").Int64()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(int64(11)))
+		Expect(rdb.Get(ctx, "script:counter").Val()).To(Equal("11"))
+		Expect(rdb.HGet(ctx, "script:hash", "field").Val()).To(Equal("10"))
+	})
+
+	It("should raise errors from redis.call and return them from redis.pcall", func() {
+		Expect(rdb.LPush(ctx, "script:list", "a").Err()).To(Succeed())
+
+		err := rdb.Eval(ctx, "return redis.call('GET', KEYS[1])", []string{"script:list"}).Err()
+		Expect(err).To(MatchError(ContainSubstring("WRONGTYPE")))
+
+		script := `
+			local reply = redis.pcall("GET", KEYS[1])
+			return reply.err ~= nil
+		`
+		Expect(rdb.Eval(ctx, script, []string{"script:list"}).Val()).To(Equal(int64(1)))
+	})
+
+	It("should map missing keys to false", func() {
+		script := `return redis.call("GET", KEYS[1]) == false`
+		Expect(rdb.Eval(ctx, script, []string{"script:missing"}).Val()).To(Equal(int64(1)))
+	})
+
+	It("should reject forbidden commands and bad scripts", func() {
+		err := rdb.Eval(ctx, "return redis.call('MULTI')", nil).Err()
+		Expect(err).To(MatchError(ContainSubstring("not allowed from script")))
+
+		err = rdb.Eval(ctx, "return redis.call('NO_SUCH_CMD')", nil).Err()
+		Expect(err).To(MatchError(ContainSubstring("Unknown Redis command")))
+
+		err = rdb.Eval(ctx, "return +", nil).Err()
+		Expect(err).To(MatchError(ContainSubstring("Error compiling script")))
+
+		err = rdb.Eval(ctx, "return 1", []string{"a", "b"}).Err()
+		Expect(err).NotTo(HaveOccurred())
+
+		err = rdb.Do(ctx, "EVAL", "return 1", "2", "only-one").Err()
+		Expect(err).To(MatchError(ContainSubstring("greater than number of args")))
+	})
+
+	It("should run cached scripts with EVALSHA", func() {
+		script := redis.NewScript("return ARGV[1]")
+
+		err := rdb.EvalSha(ctx, script.Hash(), nil, "x").Err()
+		Expect(err).To(MatchError(ContainSubstring("NOSCRIPT")))
+
+		Expect(script.Eval(ctx, rdb, nil, "first").Val()).To(Equal("first"))
+		Expect(rdb.EvalSha(ctx, script.Hash(), nil, "second").Val()).To(Equal("second"))
+
+		// SHA1 digests are matched case-insensitively.
+		Expect(rdb.Eval(ctx, "return 1", nil).Err()).To(Succeed())
+		Expect(rdb.EvalSha(ctx, "E0E1F9FABFC9D4800C877A703B823AC0578FF8DB", nil).Val()).To(Equal(int64(1)))
+	})
+
+	It("should reject writes from EVAL_RO and EVALSHA_RO", func() {
+		Expect(rdb.Set(ctx, "script:ro", "v", 0).Err()).To(Succeed())
+		Expect(rdb.EvalRO(ctx, "return redis.call('GET', KEYS[1])", []string{"script:ro"}).Val()).To(Equal("v"))
+
+		write := "return redis.call('SET', KEYS[1], 'changed')"
+		err := rdb.EvalRO(ctx, write, []string{"script:ro"}).Err()
+		Expect(err).To(MatchError(ContainSubstring("Write commands are not allowed from read-only scripts")))
+
+		sha := rdb.ScriptLoad(ctx, write).Val()
+		err = rdb.EvalShaRO(ctx, sha, []string{"script:ro"}).Err()
+		Expect(err).To(MatchError(ContainSubstring("Write commands are not allowed from read-only scripts")))
+		Expect(rdb.Get(ctx, "script:ro").Val()).To(Equal("v"))
+	})
+
+	It("should be deterministic across runs", func() {
+		script := "return math.random(1000000)"
+		first := rdb.Eval(ctx, script, nil).Val()
+		Expect(rdb.Eval(ctx, script, nil).Val()).To(Equal(first))
+	})
+
+	It("should run inside MULTI", func() {
+		conn := rdb.Conn()
+		defer conn.Close()
+
+		Expect(conn.Do(ctx, "MULTI").Err()).To(Succeed())
+		Expect(conn.Do(ctx, "EVAL", "return redis.call('SET', KEYS[1], 'v')", "1", "script:tx").Text()).To(Equal("QUEUED"))
+		result, err := conn.Do(ctx, "EXEC").Slice()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal([]interface{}{"OK"}))
+		Expect(rdb.Get(ctx, "script:tx").Val()).To(Equal("v"))
+	})
+
+	It("should manage the script cache with SCRIPT LOAD, EXISTS and FLUSH", func() {
+		sha, err := rdb.ScriptLoad(ctx, "return 'loaded'").Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sha).To(Equal(redis.NewScript("return 'loaded'").Hash()))
+
+		Expect(rdb.ScriptExists(ctx, sha, "0000000000000000000000000000000000000000").Val()).To(Equal([]bool{true, false}))
+		Expect(rdb.EvalSha(ctx, sha, nil).Val()).To(Equal("loaded"))
+
+		Expect(rdb.ScriptFlush(ctx).Err()).To(Succeed())
+		Expect(rdb.ScriptExists(ctx, sha).Val()).To(Equal([]bool{false}))
+		Expect(rdb.Do(ctx, "SCRIPT", "FLUSH", "ASYNC").Err()).To(Succeed())
+
+		err = rdb.ScriptLoad(ctx, "return +").Err()
+		Expect(err).To(MatchError(ContainSubstring("Error compiling script")))
+	})
+
+	It("should reply NOTBUSY to SCRIPT KILL when no script runs", func() {
+		err := rdb.ScriptKill(ctx).Err()
+		Expect(err).To(MatchError(ContainSubstring("NOTBUSY")))
+	})
+
+	It("should reply BUSY after lua_time_limit and stop the script with SCRIPT KILL", func() {
+		Expect(rdb.ConfigSet(ctx, "lua_time_limit", "100").Err()).To(Succeed())
+		defer func() {
+			Expect(rdb.ConfigSet(ctx, "lua_time_limit", "5000").Err()).To(Succeed())
+		}()
+
+		scriptClient := util.NewClient()
+		defer scriptClient.Close()
+
+		done := make(chan error, 1)
+		go func() {
+			done <- scriptClient.Eval(ctx, "while true do end", nil).Err()
+		}()
+
+		Eventually(func() error {
+			return rdb.Ping(ctx).Err()
+		}, 5*time.Second, 50*time.Millisecond).Should(MatchError(ContainSubstring("BUSY")))
+
+		Expect(rdb.ScriptKill(ctx).Err()).To(Succeed())
+
+		var scriptErr error
+		Eventually(done, 5*time.Second).Should(Receive(&scriptErr))
+		Expect(scriptErr).To(MatchError(ContainSubstring("Script killed by user")))
+		Expect(rdb.Ping(ctx).Err()).To(Succeed())
+	})
+})
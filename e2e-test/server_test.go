@@ -0,0 +1,441 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/marsevilspirit/nimbis/e2e-test/util"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/redis/go-redis/v9"
+)
+
+var _ = Describe("Server Commands", func() {
+	var rdb *redis.Client
+	var ctx context.Context
+
+	BeforeEach(func() {
+		rdb = util.NewClient()
+		ctx = context.Background()
+		Expect(rdb.Ping(ctx).Err()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(rdb.Close()).To(Succeed())
+	})
+
+	It("should return the server time with microseconds", func() {
+		before := time.Now()
+		serverTime, err := rdb.Time(ctx).Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(serverTime).To(BeTemporally("~", before, 5*time.Second))
+
+		result, err := rdb.Do(ctx, "TIME").StringSlice()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(HaveLen(2))
+	})
+
+	It("should reject TIME with arguments", func() {
+		err := rdb.Do(ctx, "TIME", "now").Err()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("wrong number of arguments"))
+	})
+
+	It("should draw LOLWUT with the server version", func() {
+		art, err := rdb.Do(ctx, "LOLWUT").Text()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(art).To(ContainSubstring("Nimbis ver."))
+
+		art, err = rdb.Do(ctx, "LOLWUT", "VERSION", "5", "2", "8").Text()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(art).To(ContainSubstring("Nimbis ver."))
+
+		err = rdb.Do(ctx, "LOLWUT", "rows").Err()
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should reset the connection state", func() {
+		Expect(rdb.Do(ctx, "CLIENT", "SETNAME", "before-reset").Err()).To(Succeed())
+
+		result, err := rdb.Do(ctx, "RESET").Text()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal("RESET"))
+
+		name, err := rdb.Do(ctx, "CLIENT", "GETNAME").Result()
+		Expect(err).To(Equal(redis.Nil))
+		Expect(name).To(BeNil())
+	})
+
+	It("should sleep with DEBUG SLEEP", func() {
+		start := time.Now()
+		Expect(rdb.Do(ctx, "DEBUG", "SLEEP", "0.1").Err()).To(Succeed())
+		Expect(time.Since(start)).To(BeNumerically(">=", 100*time.Millisecond))
+
+		err := rdb.Do(ctx, "DEBUG", "SLEEP", "soon").Err()
+		Expect(err).To(HaveOccurred())
+
+		err = rdb.Do(ctx, "DEBUG", "NOPE").Err()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("unknown DEBUG subcommand"))
+	})
+
+	It("should report INFO sections", func() {
+		info, err := rdb.Info(ctx).Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info).To(ContainSubstring("# Server\r\n"))
+		Expect(info).To(ContainSubstring("nimbis_version:"))
+		Expect(info).To(ContainSubstring("# Modules\r\n"))
+
+		server, err := rdb.Info(ctx, "SERVER").Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(server).To(ContainSubstring(fmt.Sprintf("tcp_port:%d", util.Port())))
+		Expect(server).NotTo(ContainSubstring("# Modules"))
+
+		Expect(rdb.Info(ctx, "nosuchsection").Val()).To(BeEmpty())
+	})
+
+	It("should count keys and expires in INFO keyspace", func() {
+		keyspace := func() string {
+			return infoField(rdb.Info(ctx, "keyspace").Val(), "db0")
+		}
+		Expect(rdb.FlushDB(ctx).Err()).To(Succeed())
+		Expect(rdb.Info(ctx, "keyspace").Val()).To(ContainSubstring("# Keyspace\r\n"))
+		Expect(keyspace()).To(BeEmpty())
+
+		Expect(rdb.Set(ctx, "keyspace:a", "v", 0).Err()).To(Succeed())
+		Expect(rdb.Set(ctx, "keyspace:b", "v", 100*time.Second).Err()).To(Succeed())
+		Expect(rdb.HSet(ctx, "keyspace:h", "field", "value").Err()).To(Succeed())
+		Expect(rdb.RPush(ctx, "keyspace:l", "x").Err()).To(Succeed())
+
+		Expect(keyspace()).To(MatchRegexp(`^keys=4,expires=1,avg_ttl=\d+$`))
+		avgTTL, err := strconv.Atoi(strings.TrimPrefix(regexp.MustCompile(`avg_ttl=\d+`).FindString(keyspace()), "avg_ttl="))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(avgTTL).To(BeNumerically(">", 90_000))
+		Expect(avgTTL).To(BeNumerically("<=", 100_000))
+
+		// Deleted keys and keys whose time passed drop out of the counts.
+		Expect(rdb.Del(ctx, "keyspace:a").Err()).To(Succeed())
+		Expect(rdb.PExpire(ctx, "keyspace:l", 500*time.Millisecond).Err()).To(Succeed())
+		Expect(keyspace()).To(MatchRegexp(`^keys=3,expires=2,avg_ttl=\d+$`))
+		Eventually(keyspace, "5s", "100ms").Should(MatchRegexp(`^keys=2,expires=1,avg_ttl=\d+$`))
+
+		Expect(rdb.FlushDB(ctx).Err()).To(Succeed())
+		Expect(keyspace()).To(BeEmpty())
+	})
+
+	It("should count calls, failures and rejections in INFO commandstats", func() {
+		cmdstat := func(name string) string {
+			return infoField(rdb.Info(ctx, "commandstats").Val(), "cmdstat_"+name)
+		}
+		Expect(rdb.Do(ctx, "CONFIG", "RESETSTAT").Val()).To(Equal("OK"))
+		Expect(cmdstat("get")).To(BeEmpty())
+
+		Expect(rdb.Set(ctx, "commandstats:key", "value", 0).Err()).To(Succeed())
+		Expect(rdb.Get(ctx, "commandstats:key").Val()).To(Equal("value"))
+		Expect(rdb.Get(ctx, "commandstats:missing").Err()).To(Equal(redis.Nil))
+		Expect(rdb.Incr(ctx, "commandstats:key").Err()).To(HaveOccurred())
+		Expect(rdb.Do(ctx, "GET").Err()).To(HaveOccurred())
+		Expect(rdb.Do(ctx, "NOSUCHCOMMAND").Err()).To(HaveOccurred())
+
+		Expect(cmdstat("get")).To(MatchRegexp(
+			`^calls=2,usec=\d+,usec_per_call=\d+\.\d{2},rejected_calls=1,failed_calls=0$`))
+		Expect(cmdstat("incr")).To(MatchRegexp(
+			`^calls=1,usec=\d+,usec_per_call=\d+\.\d{2},rejected_calls=0,failed_calls=1$`))
+		Expect(cmdstat("nosuchcommand")).To(BeEmpty())
+		Expect(rdb.Info(ctx).Val()).To(ContainSubstring("# Commandstats\r\n"))
+
+		Expect(rdb.Do(ctx, "CONFIG", "RESETSTAT").Val()).To(Equal("OK"))
+		Expect(cmdstat("get")).To(BeEmpty())
+		Expect(cmdstat("incr")).To(BeEmpty())
+	})
+
+	It("should refuse clients above maxclients", func() {
+		connected, err := util.InfoField(rdb, "clients", "connected_clients")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(util.InfoField(rdb, "clients", "maxclients")).To(Equal("10000"))
+		rejected, err := util.InfoField(rdb, "stats", "rejected_connections")
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(rdb.ConfigSet(ctx, "maxclients", connected).Err()).To(Succeed())
+		DeferCleanup(func() {
+			Expect(rdb.ConfigSet(ctx, "maxclients", "10000").Err()).To(Succeed())
+		})
+		Expect(rdb.ConfigSet(ctx, "maxclients", "0").Err()).To(HaveOccurred())
+
+		extra := util.NewClient()
+		defer extra.Close()
+		err = extra.Ping(ctx).Err()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("max number of clients reached"))
+
+		before, err := strconv.Atoi(rejected)
+		Expect(err).NotTo(HaveOccurred())
+		after, err := util.InfoField(rdb, "stats", "rejected_connections")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(strconv.Atoi(after)).To(BeNumerically(">", before))
+	})
+
+	It("should close clients idle for longer than timeout", func() {
+		Expect(rdb.ConfigSet(ctx, "timeout", "1").Err()).To(Succeed())
+		DeferCleanup(func() {
+			admin := util.NewClient()
+			defer admin.Close()
+			Expect(admin.ConfigSet(ctx, "timeout", "0").Err()).To(Succeed())
+		})
+
+		idle, err := util.DialResp(util.Addr())
+		Expect(err).NotTo(HaveOccurred())
+		defer idle.Close()
+		Expect(idle.Do("PING")).To(Equal(util.Reply{Kind: util.SimpleString, Str: "PONG"}))
+
+		subscriber := util.NewClient()
+		defer subscriber.Close()
+		pubsub := subscriber.Subscribe(ctx, "idle-channel")
+		defer pubsub.Close()
+		_, err = pubsub.Receive(ctx)
+		Expect(err).NotTo(HaveOccurred())
+
+		blocked := util.NewClient()
+		defer blocked.Close()
+		Expect(blocked.BLPop(ctx, 3*time.Second, "idle-list").Err()).To(MatchError(redis.Nil))
+		Expect(blocked.Ping(ctx).Err()).To(Succeed())
+
+		_, err = idle.ReadReply()
+		Expect(err).To(MatchError(io.EOF))
+
+		publisher := util.NewClient()
+		defer publisher.Close()
+		Expect(publisher.Publish(ctx, "idle-channel", "still here").Err()).To(Succeed())
+		msg, err := pubsub.ReceiveMessage(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(msg.Payload).To(Equal("still here"))
+	})
+
+	It("should report that cluster support is disabled", func() {
+		Expect(rdb.Info(ctx, "cluster").Val()).To(ContainSubstring("cluster_enabled:0"))
+		for _, sub := range []string{"NODES", "SLOTS", "SHARDS", "INFO", "MYID", "COUNTKEYSINSLOT"} {
+			err := rdb.Do(ctx, "CLUSTER", sub).Err()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("cluster support disabled"))
+		}
+		Expect(rdb.Do(ctx, "CLUSTER", "HELP").Val()).NotTo(BeEmpty())
+	})
+
+	It("should report value compression in INFO memory", func() {
+		memory, err := rdb.Info(ctx, "memory").Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(memory).To(ContainSubstring("# Memory\r\n"))
+		Expect(infoField(memory, "value_compression")).To(Equal("none"))
+		Expect(infoField(memory, "value_compression_threshold")).To(Equal("1024"))
+		Expect(infoField(memory, "compressed_values")).To(Equal("0"))
+		Expect(infoField(memory, "compression_ratio")).To(Equal("1.00"))
+
+		// Without a codec large values are stored as they are.
+		value := strings.Repeat(`{"name":"nimbis"},`, 1024)
+		Expect(rdb.Set(ctx, "compression:json", value, 0).Err()).To(Succeed())
+		Expect(rdb.Get(ctx, "compression:json").Val()).To(Equal(value))
+		Expect(infoField(rdb.Info(ctx, "memory").Val(), "compressed_values")).To(Equal("0"))
+		Expect(rdb.Del(ctx, "compression:json").Err()).To(Succeed())
+	})
+
+	It("should report storage engine stats only when asked", func() {
+		Expect(rdb.Info(ctx).Val()).NotTo(ContainSubstring("# Storage"))
+
+		storage, err := rdb.Info(ctx, "storage").Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(storage).To(ContainSubstring("# Storage\r\n"))
+		Expect(storage).To(ContainSubstring("sst_files:"))
+		Expect(storage).To(ContainSubstring("wal_bytes:"))
+		Expect(storage).To(MatchRegexp(`db_string:sst_files=\d+,sst_bytes=\d+,wal_files=\d+,wal_bytes=\d+,total_bytes=\d+`))
+	})
+
+	It("should purge the elements of deleted collections with NIMBIS GC", func() {
+		gcField := func(name string) int64 {
+			info := rdb.Info(ctx, "storage").Val()
+			match := regexp.MustCompile(name + `:(\d+)`).FindStringSubmatch(info)
+			Expect(match).NotTo(BeNil())
+			value, err := strconv.ParseInt(match[1], 10, 64)
+			Expect(err).NotTo(HaveOccurred())
+			return value
+		}
+		waitForGc := func() {
+			Eventually(func() int64 {
+				return gcField("gc_in_progress")
+			}, 10*time.Second, 50*time.Millisecond).Should(Equal(int64(0)))
+		}
+		// Lazy freeing would purge the elements before the pass does.
+		Expect(rdb.ConfigSet(ctx, "lazyfree_lazy_server_del", "false").Err()).To(Succeed())
+		defer rdb.ConfigSet(ctx, "lazyfree_lazy_server_del", "true")
+
+		waitForGc()
+		passes := gcField("gc_passes")
+		purged := gcField("gc_purged_records")
+
+		key := "gc:hash"
+		Expect(rdb.HSet(ctx, key, "f1", "v", "f2", "v", "f3", "v").Err()).To(Succeed())
+		Expect(rdb.Del(ctx, key).Err()).To(Succeed())
+		Expect(rdb.HSet(ctx, key, "f4", "v").Err()).To(Succeed())
+
+		Expect(rdb.Do(ctx, "NIMBIS", "GC").Val()).To(Equal("Background GC started"))
+		Eventually(func() int64 {
+			return gcField("gc_passes")
+		}, 10*time.Second, 50*time.Millisecond).Should(BeNumerically(">", passes))
+		waitForGc()
+
+		Expect(gcField("gc_purged_records")).To(BeNumerically(">=", purged+3))
+		Expect(gcField("gc_reclaimed_bytes")).To(BeNumerically(">", 0))
+		Expect(rdb.HGetAll(ctx, key).Val()).To(Equal(map[string]string{"f4": "v"}))
+		Expect(rdb.Del(ctx, key).Err()).To(Succeed())
+	})
+
+	It("should compact a range of keys in the background with COMPACT", func() {
+		storageField := func(name string) int64 {
+			info := rdb.Info(ctx, "storage").Val()
+			match := regexp.MustCompile(name + `:(\d+)`).FindStringSubmatch(info)
+			Expect(match).NotTo(BeNil())
+			value, err := strconv.ParseInt(match[1], 10, 64)
+			Expect(err).NotTo(HaveOccurred())
+			return value
+		}
+		waitForCompaction := func() {
+			Eventually(func() int64 {
+				return storageField("compaction_in_progress")
+			}, 10*time.Second, 50*time.Millisecond).Should(Equal(int64(0)))
+		}
+		// Lazy freeing would purge the elements before the run does.
+		Expect(rdb.ConfigSet(ctx, "lazyfree_lazy_server_del", "false").Err()).To(Succeed())
+		defer rdb.ConfigSet(ctx, "lazyfree_lazy_server_del", "true")
+		Expect(rdb.ConfigSet(ctx, "compaction_rate_limit", "100").Err()).To(Succeed())
+		defer rdb.ConfigSet(ctx, "compaction_rate_limit", "0")
+
+		waitForCompaction()
+		runs := storageField("compaction_runs")
+		purged := storageField("compaction_purged_records")
+
+		for _, key := range []string{"compact:a", "compact:b", "compact:z"} {
+			Expect(rdb.HSet(ctx, key, "f1", "v", "f2", "v").Err()).To(Succeed())
+			Expect(rdb.Del(ctx, key).Err()).To(Succeed())
+		}
+		Expect(rdb.HSet(ctx, "compact:b", "f3", "v").Err()).To(Succeed())
+
+		Expect(rdb.Do(ctx, "COMPACT", "compact:a", "compact:b").Val()).To(Equal("Background compaction started"))
+		err := rdb.Do(ctx, "COMPACT").Err()
+		Expect(err).To(MatchError(ContainSubstring("already in progress")))
+		Eventually(func() int64 {
+			return storageField("compaction_runs")
+		}, 10*time.Second, 50*time.Millisecond).Should(Equal(runs + 1))
+		waitForCompaction()
+
+		// Only the keys in the range were compacted.
+		Expect(storageField("compaction_purged_records")).To(Equal(purged + 4))
+		Expect(rdb.HGetAll(ctx, "compact:b").Val()).To(Equal(map[string]string{"f3": "v"}))
+		Expect(rdb.Info(ctx, "storage").Val()).To(ContainSubstring("compaction_last_run_status:ok"))
+		Expect(rdb.Del(ctx, "compact:b").Err()).To(Succeed())
+
+		err = rdb.Do(ctx, "COMPACT", "b", "a").Err()
+		Expect(err).To(MatchError(ContainSubstring("first key of the range is after the last")))
+		err = rdb.Do(ctx, "COMPACT", "a").Err()
+		Expect(err).To(MatchError(ContainSubstring("syntax error")))
+	})
+
+	It("should report the largest keys of each type with NIMBIS BIGKEYS", func() {
+		Expect(rdb.FlushDB(ctx).Err()).To(Succeed())
+		members := make([]interface{}, 0, 200)
+		for i := 0; i < 200; i++ {
+			members = append(members, fmt.Sprintf("m%d", i))
+		}
+		Expect(rdb.SAdd(ctx, "bigkeys:set:big", members...).Err()).To(Succeed())
+		Expect(rdb.SAdd(ctx, "bigkeys:set:small", "a", "b").Err()).To(Succeed())
+		Expect(rdb.Set(ctx, "bigkeys:string", strings.Repeat("x", 1000), 0).Err()).To(Succeed())
+		Expect(rdb.RPush(ctx, "bigkeys:list", "a", "b", "c").Err()).To(Succeed())
+
+		Expect(rdb.Do(ctx, "NIMBIS", "BIGKEYS", "START").Val()).To(Equal("Background big keys scan started"))
+		var report []interface{}
+		Eventually(func() interface{} {
+			var err error
+			report, err = rdb.Do(ctx, "NIMBIS", "BIGKEYS").Slice()
+			Expect(err).NotTo(HaveOccurred())
+			return report[1]
+		}, 10*time.Second, 50*time.Millisecond).Should(Equal("done"))
+		Expect(report[2:4]).To(Equal([]interface{}{"scanned_keys", int64(4)}))
+
+		types := map[string][]interface{}{}
+		for _, t := range report[7].([]interface{}) {
+			fields := t.([]interface{})
+			types[fields[1].(string)] = fields
+		}
+		Expect(types).To(HaveLen(3))
+		set := types["set"]
+		Expect(set[2:6]).To(Equal([]interface{}{"keys", int64(2), "elements", int64(202)}))
+		Expect(set[9]).To(Equal([]interface{}{
+			[]interface{}{"bigkeys:set:big", int64(200)},
+			[]interface{}{"bigkeys:set:small", int64(2)},
+		}))
+		largestByBytes := set[11].([]interface{})
+		Expect(largestByBytes[0].([]interface{})[0]).To(Equal("bigkeys:set:big"))
+		Expect(types["string"][9]).To(Equal([]interface{}{
+			[]interface{}{"bigkeys:string", int64(1000)},
+		}))
+		Expect(types["list"][5]).To(Equal(int64(3)))
+
+		err := rdb.Do(ctx, "NIMBIS", "BIGKEYS", "BOGUS").Err()
+		Expect(err).To(MatchError("ERR syntax error"))
+	})
+
+	It("should lazily free the elements of deleted and overwritten collections", func() {
+		statsField := func(name string) int64 {
+			value, err := strconv.ParseInt(infoField(rdb.Info(ctx, "stats").Val(), name), 10, 64)
+			Expect(err).NotTo(HaveOccurred())
+			return value
+		}
+		waitForLazyFree := func() {
+			Eventually(func() int64 {
+				return statsField("lazyfree_pending_objects")
+			}, 10*time.Second, 50*time.Millisecond).Should(Equal(int64(0)))
+		}
+		waitForLazyFree()
+		freed := statsField("lazyfreed_objects")
+		purged := statsField("lazyfree_purged_records")
+
+		// More elements than one batch reads.
+		fields := make([]interface{}, 0, 2*2500)
+		for i := 0; i < 2500; i++ {
+			fields = append(fields, fmt.Sprintf("f%d", i), "v")
+		}
+		Expect(rdb.HSet(ctx, "lazyfree:big", fields...).Err()).To(Succeed())
+		Expect(rdb.Del(ctx, "lazyfree:big").Err()).To(Succeed())
+		waitForLazyFree()
+		Expect(statsField("lazyfreed_objects")).To(Equal(freed + 1))
+		Expect(statsField("lazyfree_purged_records")).To(Equal(purged + 2500))
+
+		// Overwriting a collection with a string frees its elements too.
+		Expect(rdb.SAdd(ctx, "lazyfree:set", "a", "b", "c").Err()).To(Succeed())
+		Expect(rdb.Set(ctx, "lazyfree:set", "v", 0).Err()).To(Succeed())
+		waitForLazyFree()
+		Expect(statsField("lazyfreed_objects")).To(Equal(freed + 2))
+		Expect(statsField("lazyfree_purged_records")).To(Equal(purged + 2503))
+		Expect(rdb.Get(ctx, "lazyfree:set").Val()).To(Equal("v"))
+
+		// Keys of plain strings have nothing to free.
+		Expect(rdb.Set(ctx, "lazyfree:set", "w", 0).Err()).To(Succeed())
+		waitForLazyFree()
+		Expect(statsField("lazyfreed_objects")).To(Equal(freed + 2))
+		Expect(rdb.Del(ctx, "lazyfree:set").Err()).To(Succeed())
+	})
+
+	It("should list compiled-in extensions with MODULE LIST", func() {
+		modules, err := rdb.Do(ctx, "MODULE", "LIST").Slice()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(modules).To(ContainElement([]interface{}{
+			"name", "bf", "ver", int64(1), "path", "builtin", "args", []interface{}{},
+		}))
+
+		err = rdb.Do(ctx, "MODULE", "LOAD", "/tmp/module.so").Err()
+		Expect(err).To(MatchError(ContainSubstring("unknown MODULE subcommand")))
+	})
+})
@@ -0,0 +1,107 @@
+package tests
+
+import (
+	"context"
+	"strings"
+
+	"github.com/marsevilspirit/nimbis/e2e-test/util"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/redis/go-redis/v9"
+)
+
+var _ = Describe("SLOWLOG Commands", func() {
+	var rdb *redis.Client
+	var ctx context.Context
+
+	BeforeEach(func() {
+		rdb = util.NewClient()
+		ctx = context.Background()
+		Expect(rdb.Ping(ctx).Err()).To(Succeed())
+		Expect(rdb.ConfigSet(ctx, "slowlog_log_slower_than", "0").Err()).To(Succeed())
+		Expect(rdb.Do(ctx, "SLOWLOG", "RESET").Err()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(rdb.ConfigSet(ctx, "slowlog_log_slower_than", "10000").Err()).To(Succeed())
+		Expect(rdb.ConfigSet(ctx, "slowlog_max_len", "128").Err()).To(Succeed())
+		Expect(rdb.Do(ctx, "SLOWLOG", "RESET").Err()).To(Succeed())
+		Expect(rdb.Close()).To(Succeed())
+	})
+
+	It("should record executed commands with their arguments", func() {
+		Expect(rdb.Set(ctx, "slowlog:key", "value", 0).Err()).To(Succeed())
+
+		entries, err := rdb.SlowLogGet(ctx, -1).Result()
+		Expect(err).NotTo(HaveOccurred())
+
+		var found bool
+		for _, entry := range entries {
+			if len(entry.Args) == 3 && strings.EqualFold(entry.Args[0], "set") {
+				Expect(entry.Args[1:]).To(Equal([]string{"slowlog:key", "value"}))
+				Expect(entry.ClientAddr).NotTo(BeEmpty())
+				found = true
+			}
+		}
+		Expect(found).To(BeTrue(), "SET should be recorded in the slowlog")
+	})
+
+	It("should return entries newest first and honour the count", func() {
+		Expect(rdb.Set(ctx, "slowlog:a", "1", 0).Err()).To(Succeed())
+		Expect(rdb.Get(ctx, "slowlog:a").Err()).To(Succeed())
+
+		entries, err := rdb.SlowLogGet(ctx, 1).Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(HaveLen(1))
+		Expect(strings.ToUpper(entries[0].Args[0])).To(Equal("GET"))
+	})
+
+	It("should truncate long arguments", func() {
+		Expect(rdb.Set(ctx, "slowlog:long", strings.Repeat("a", 200), 0).Err()).To(Succeed())
+
+		entries, err := rdb.SlowLogGet(ctx, 1).Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].Args[2]).To(HaveSuffix("... (72 more bytes)"))
+	})
+
+	It("should report the length and reset the log", func() {
+		Expect(rdb.Ping(ctx).Err()).To(Succeed())
+
+		length, err := rdb.Do(ctx, "SLOWLOG", "LEN").Int64()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(length).To(BeNumerically(">", 0))
+
+		Expect(rdb.ConfigSet(ctx, "slowlog_log_slower_than", "-1").Err()).To(Succeed())
+		Expect(rdb.Do(ctx, "SLOWLOG", "RESET").Val()).To(Equal("OK"))
+
+		length, err = rdb.Do(ctx, "SLOWLOG", "LEN").Int64()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(length).To(BeZero())
+	})
+
+	It("should bound the log by slowlog_max_len", func() {
+		Expect(rdb.ConfigSet(ctx, "slowlog_max_len", "2").Err()).To(Succeed())
+		for i := 0; i < 5; i++ {
+			Expect(rdb.Ping(ctx).Err()).To(Succeed())
+		}
+
+		length, err := rdb.Do(ctx, "SLOWLOG", "LEN").Int64()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(length).To(BeNumerically("==", 2))
+	})
+
+	It("should print help and reject unknown subcommands", func() {
+		help, err := rdb.Do(ctx, "SLOWLOG", "HELP").StringSlice()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(help).NotTo(BeEmpty())
+		Expect(help[0]).To(HavePrefix("SLOWLOG <subcommand>"))
+
+		err = rdb.Do(ctx, "SLOWLOG", "NOPE").Err()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("unknown SLOWLOG subcommand"))
+
+		err = rdb.Do(ctx, "SLOWLOG", "GET", "-2").Err()
+		Expect(err).To(HaveOccurred())
+	})
+})
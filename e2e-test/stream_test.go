@@ -0,0 +1,676 @@
+package tests
+
+import (
+	"context"
+	"time"
+
+	"github.com/marsevilspirit/nimbis/e2e-test/util"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/redis/go-redis/v9"
+)
+
+var _ = Describe("Stream Commands", func() {
+	var rdb *redis.Client
+	var ctx context.Context
+
+	BeforeEach(func() {
+		rdb = util.NewClient()
+		ctx = context.Background()
+		Expect(rdb.Ping(ctx).Err()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(rdb.Close()).To(Succeed())
+	})
+
+	ids := func(msgs []redis.XMessage) []string {
+		out := make([]string, 0, len(msgs))
+		for _, msg := range msgs {
+			out = append(out, msg.ID)
+		}
+		return out
+	}
+
+	It("should XADD with generated IDs and XLEN", func() {
+		key := "stream_auto_key"
+		rdb.Del(ctx, key)
+
+		first, err := rdb.XAdd(ctx, &redis.XAddArgs{Stream: key, Values: []string{"a", "1"}}).Result()
+		Expect(err).NotTo(HaveOccurred())
+		second, err := rdb.XAdd(ctx, &redis.XAddArgs{Stream: key, Values: []string{"b", "2"}}).Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(second).NotTo(Equal(first))
+
+		msgs, err := rdb.XRange(ctx, key, "-", "+").Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ids(msgs)).To(Equal([]string{first, second}))
+		Expect(msgs[0].Values).To(Equal(map[string]interface{}{"a": "1"}))
+
+		Expect(rdb.XLen(ctx, key).Val()).To(Equal(int64(2)))
+		Expect(rdb.XLen(ctx, "stream_missing_key").Val()).To(Equal(int64(0)))
+	})
+
+	It("should XADD with explicit and partial IDs", func() {
+		key := "stream_explicit_key"
+		rdb.Del(ctx, key)
+
+		id, err := rdb.XAdd(ctx, &redis.XAddArgs{Stream: key, ID: "5-1", Values: []string{"f", "v"}}).Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(id).To(Equal("5-1"))
+
+		id, err = rdb.XAdd(ctx, &redis.XAddArgs{Stream: key, ID: "5-*", Values: []string{"f", "v"}}).Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(id).To(Equal("5-2"))
+
+		err = rdb.XAdd(ctx, &redis.XAddArgs{Stream: key, ID: "5-2", Values: []string{"f", "v"}}).Err()
+		Expect(err).To(MatchError(ContainSubstring("equal or smaller than the target stream top item")))
+
+		err = rdb.XAdd(ctx, &redis.XAddArgs{Stream: "stream_zero_key", ID: "0-0", Values: []string{"f", "v"}}).Err()
+		Expect(err).To(MatchError(ContainSubstring("must be greater than 0-0")))
+
+		err = rdb.XAdd(ctx, &redis.XAddArgs{Stream: key, ID: "abc", Values: []string{"f", "v"}}).Err()
+		Expect(err).To(MatchError(ContainSubstring("Invalid stream ID")))
+
+		Expect(rdb.XLen(ctx, key).Val()).To(Equal(int64(2)))
+	})
+
+	It("should honor NOMKSTREAM", func() {
+		key := "stream_nomkstream_key"
+		rdb.Del(ctx, key)
+
+		err := rdb.XAdd(ctx, &redis.XAddArgs{Stream: key, NoMkStream: true, Values: []string{"f", "v"}}).Err()
+		Expect(err).To(Equal(redis.Nil))
+		Expect(rdb.Exists(ctx, key).Val()).To(Equal(int64(0)))
+
+		rdb.XAdd(ctx, &redis.XAddArgs{Stream: key, Values: []string{"f", "v"}})
+		err = rdb.XAdd(ctx, &redis.XAddArgs{Stream: key, NoMkStream: true, Values: []string{"f", "v"}}).Err()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rdb.XLen(ctx, key).Val()).To(Equal(int64(2)))
+	})
+
+	It("should XRANGE and XREVRANGE with bounds and COUNT", func() {
+		key := "stream_range_key"
+		rdb.Del(ctx, key)
+		for _, id := range []string{"1-1", "1-2", "2-1", "3-1"} {
+			Expect(rdb.XAdd(ctx, &redis.XAddArgs{Stream: key, ID: id, Values: []string{"f", id}}).Err()).To(Succeed())
+		}
+
+		msgs, err := rdb.XRange(ctx, key, "1", "2").Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ids(msgs)).To(Equal([]string{"1-1", "1-2", "2-1"}))
+
+		msgs, err = rdb.XRange(ctx, key, "(1-1", "(3-1").Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ids(msgs)).To(Equal([]string{"1-2", "2-1"}))
+
+		msgs, err = rdb.XRangeN(ctx, key, "-", "+", 2).Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ids(msgs)).To(Equal([]string{"1-1", "1-2"}))
+
+		msgs, err = rdb.XRevRangeN(ctx, key, "+", "-", 3).Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ids(msgs)).To(Equal([]string{"3-1", "2-1", "1-2"}))
+		Expect(msgs[0].Values).To(Equal(map[string]interface{}{"f": "3-1"}))
+
+		msgs, err = rdb.XRange(ctx, key, "3", "1").Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(msgs).To(BeEmpty())
+
+		err = rdb.XRange(ctx, key, "-", "(0-0").Err()
+		Expect(err).To(MatchError(ContainSubstring("invalid end ID for the interval")))
+	})
+
+	addIDs := func(key string, ids ...string) {
+		for _, id := range ids {
+			Expect(rdb.XAdd(ctx, &redis.XAddArgs{Stream: key, ID: id, Values: []string{"f", "v"}}).Err()).To(Succeed())
+		}
+	}
+
+	It("should XDEL entries", func() {
+		key := "stream_xdel_key"
+		rdb.Del(ctx, key)
+		addIDs(key, "1-1", "1-2", "1-3")
+
+		Expect(rdb.XDel(ctx, key, "1-2", "1-2", "9-9").Val()).To(Equal(int64(1)))
+		msgs, err := rdb.XRange(ctx, key, "-", "+").Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ids(msgs)).To(Equal([]string{"1-1", "1-3"}))
+		Expect(rdb.XLen(ctx, key).Val()).To(Equal(int64(2)))
+
+		Expect(rdb.XDel(ctx, "stream_missing_key", "1-1").Val()).To(Equal(int64(0)))
+		err = rdb.XDel(ctx, key, "abc").Err()
+		Expect(err).To(MatchError(ContainSubstring("Invalid stream ID")))
+	})
+
+	It("should XTRIM with MAXLEN and MINID", func() {
+		key := "stream_xtrim_key"
+		rdb.Del(ctx, key)
+		addIDs(key, "1-1", "1-2", "1-3", "1-4", "1-5")
+
+		Expect(rdb.XTrimMinID(ctx, key, "1-3").Val()).To(Equal(int64(2)))
+		Expect(rdb.XTrimMaxLen(ctx, key, 2).Val()).To(Equal(int64(1)))
+		Expect(rdb.XTrimMaxLen(ctx, key, 5).Val()).To(Equal(int64(0)))
+		msgs, err := rdb.XRange(ctx, key, "-", "+").Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ids(msgs)).To(Equal([]string{"1-4", "1-5"}))
+		Expect(rdb.XLen(ctx, key).Val()).To(Equal(int64(2)))
+
+		// New IDs must still follow the newest ever added.
+		err = rdb.XAdd(ctx, &redis.XAddArgs{Stream: key, ID: "1-2", Values: []string{"f", "v"}}).Err()
+		Expect(err).To(MatchError(ContainSubstring("equal or smaller than the target stream top item")))
+
+		Expect(rdb.XTrimMaxLen(ctx, "stream_missing_key", 0).Val()).To(Equal(int64(0)))
+	})
+
+	It("should bound approximate trims with LIMIT", func() {
+		key := "stream_xtrim_limit_key"
+		rdb.Del(ctx, key)
+		addIDs(key, "1-1", "1-2", "1-3", "1-4", "1-5")
+
+		Expect(rdb.XTrimMaxLenApprox(ctx, key, 0, 2).Val()).To(Equal(int64(2)))
+		Expect(rdb.XLen(ctx, key).Val()).To(Equal(int64(3)))
+		Expect(rdb.XTrimMaxLenApprox(ctx, key, 0, 0).Val()).To(Equal(int64(3)))
+		Expect(rdb.XLen(ctx, key).Val()).To(Equal(int64(0)))
+
+		err := rdb.Do(ctx, "XTRIM", key, "MAXLEN", "1", "LIMIT", "1").Err()
+		Expect(err).To(MatchError(ContainSubstring("LIMIT cannot be used without the special ~ option")))
+		err = rdb.Do(ctx, "XTRIM", key, "MAXLEN", "-1").Err()
+		Expect(err).To(MatchError(ContainSubstring("The MAXLEN argument must be >= 0")))
+		err = rdb.Do(ctx, "XTRIM", key, "MAXLEN", "1", "extra").Err()
+		Expect(err).To(MatchError(ContainSubstring("syntax error")))
+	})
+
+	It("should trim inline with XADD", func() {
+		key := "stream_xadd_trim_key"
+		rdb.Del(ctx, key)
+		addIDs(key, "1-1", "1-2", "1-3")
+
+		id, err := rdb.XAdd(ctx, &redis.XAddArgs{Stream: key, MaxLen: 2, ID: "1-4", Values: []string{"f", "v"}}).Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(id).To(Equal("1-4"))
+		msgs, err := rdb.XRange(ctx, key, "-", "+").Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ids(msgs)).To(Equal([]string{"1-3", "1-4"}))
+
+		err = rdb.XAdd(ctx, &redis.XAddArgs{Stream: key, MinID: "1-5", ID: "1-5", Values: []string{"f", "v"}}).Err()
+		Expect(err).NotTo(HaveOccurred())
+		msgs, err = rdb.XRange(ctx, key, "-", "+").Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ids(msgs)).To(Equal([]string{"1-5"}))
+		Expect(rdb.XLen(ctx, key).Val()).To(Equal(int64(1)))
+
+		err = rdb.XAdd(ctx, &redis.XAddArgs{Stream: "stream_missing_key", NoMkStream: true, MaxLen: 1, Values: []string{"f", "v"}}).Err()
+		Expect(err).To(Equal(redis.Nil))
+	})
+
+	It("should reset the last generated ID with XSETID", func() {
+		key := "stream_xsetid_key"
+		rdb.Del(ctx, key)
+		addIDs(key, "1-1", "1-2")
+
+		err := rdb.Do(ctx, "XSETID", key, "1-1").Err()
+		Expect(err).To(MatchError(ContainSubstring("smaller than the target stream top item")))
+		err = rdb.Do(ctx, "XSETID", key, "5-0", "ENTRIESADDED", "1").Err()
+		Expect(err).To(MatchError(ContainSubstring("smaller than the target stream length")))
+		err = rdb.Do(ctx, "XSETID", "stream_missing_key", "5-0").Err()
+		Expect(err).To(MatchError(ContainSubstring("no such key")))
+
+		Expect(rdb.Do(ctx, "XSETID", key, "5-0", "ENTRIESADDED", "9", "MAXDELETEDID", "1-0").Val()).To(Equal("OK"))
+		info, err := rdb.XInfoStream(ctx, key).Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.LastGeneratedID).To(Equal("5-0"))
+		Expect(info.EntriesAdded).To(Equal(int64(9)))
+		Expect(info.MaxDeletedEntryID).To(Equal("1-0"))
+
+		err = rdb.XAdd(ctx, &redis.XAddArgs{Stream: key, ID: "4-0", Values: []string{"f", "v"}}).Err()
+		Expect(err).To(MatchError(ContainSubstring("equal or smaller than the target stream top item")))
+		id, err := rdb.XAdd(ctx, &redis.XAddArgs{Stream: key, ID: "5-*", Values: []string{"f", "v"}}).Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(id).To(Equal("5-1"))
+	})
+
+	It("should reject stream commands on other types", func() {
+		key := "stream_wrongtype_key"
+		rdb.Del(ctx, key)
+		rdb.Set(ctx, key, "value", 0)
+
+		err := rdb.XAdd(ctx, &redis.XAddArgs{Stream: key, Values: []string{"f", "v"}}).Err()
+		Expect(err).To(MatchError(ContainSubstring("WRONGTYPE")))
+		err = rdb.XLen(ctx, key).Err()
+		Expect(err).To(MatchError(ContainSubstring("WRONGTYPE")))
+	})
+
+	It("should XREAD from several streams", func() {
+		first, second := "stream_xread_a", "stream_xread_b"
+		rdb.Del(ctx, first, second)
+		for _, id := range []string{"1-1", "1-2", "1-3"} {
+			rdb.XAdd(ctx, &redis.XAddArgs{Stream: first, ID: id, Values: []string{"f", id}})
+		}
+		rdb.XAdd(ctx, &redis.XAddArgs{Stream: second, ID: "5-1", Values: []string{"f", "v"}})
+
+		streams, err := rdb.XRead(ctx, &redis.XReadArgs{
+			Streams: []string{first, second, "1-1", "0"},
+			Count:   1,
+			Block:   -1,
+		}).Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(streams).To(HaveLen(2))
+		Expect(streams[0].Stream).To(Equal(first))
+		Expect(ids(streams[0].Messages)).To(Equal([]string{"1-2"}))
+		Expect(streams[1].Stream).To(Equal(second))
+		Expect(ids(streams[1].Messages)).To(Equal([]string{"5-1"}))
+
+		// Streams without newer entries are left out; nothing at all is a nil.
+		streams, err = rdb.XRead(ctx, &redis.XReadArgs{
+			Streams: []string{first, second, "0", "5-1"},
+			Block:   -1,
+		}).Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(streams).To(HaveLen(1))
+		Expect(ids(streams[0].Messages)).To(Equal([]string{"1-1", "1-2", "1-3"}))
+
+		err = rdb.XRead(ctx, &redis.XReadArgs{Streams: []string{first, "$"}, Block: -1}).Err()
+		Expect(err).To(Equal(redis.Nil))
+
+		err = rdb.Do(ctx, "XREAD", "STREAMS", first, second, "0").Err()
+		Expect(err).To(MatchError(ContainSubstring("Unbalanced 'xread' list of streams")))
+	})
+
+	It("should time out a blocking XREAD", func() {
+		key := "stream_xread_timeout"
+		rdb.Del(ctx, key)
+
+		start := time.Now()
+		err := rdb.XRead(ctx, &redis.XReadArgs{
+			Streams: []string{key, "$"},
+			Block:   200 * time.Millisecond,
+		}).Err()
+		Expect(err).To(Equal(redis.Nil))
+		Expect(time.Since(start)).To(BeNumerically(">=", 200*time.Millisecond))
+	})
+
+	It("should wake a blocking XREAD on XADD", func() {
+		key := "stream_xread_block"
+		rdb.Del(ctx, key)
+		rdb.XAdd(ctx, &redis.XAddArgs{Stream: key, ID: "1-1", Values: []string{"old", "1"}})
+
+		writer := util.NewClient()
+		defer writer.Close()
+
+		type result struct {
+			streams []redis.XStream
+			err     error
+		}
+		done := make(chan result, 1)
+		go func() {
+			defer GinkgoRecover()
+			streams, err := rdb.XRead(ctx, &redis.XReadArgs{
+				Streams: []string{key, "$"},
+				Block:   5 * time.Second,
+			}).Result()
+			done <- result{streams, err}
+		}()
+
+		time.Sleep(200 * time.Millisecond)
+		Consistently(done, 100*time.Millisecond).ShouldNot(Receive())
+		Expect(writer.XAdd(ctx, &redis.XAddArgs{Stream: key, ID: "2-1", Values: []string{"new", "1"}}).Err()).To(Succeed())
+
+		var got result
+		Eventually(done, 2*time.Second).Should(Receive(&got))
+		Expect(got.err).NotTo(HaveOccurred())
+		Expect(got.streams).To(HaveLen(1))
+		Expect(ids(got.streams[0].Messages)).To(Equal([]string{"2-1"}))
+	})
+
+	It("should not block XREAD inside MULTI", func() {
+		key := "stream_xread_multi"
+		rdb.Del(ctx, key)
+
+		start := time.Now()
+		cmds, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.XRead(ctx, &redis.XReadArgs{Streams: []string{key, "$"}, Block: 0})
+			return nil
+		})
+		Expect(err).To(Equal(redis.Nil))
+		Expect(cmds[0].Err()).To(Equal(redis.Nil))
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+	})
+
+	It("should deliver new entries to a consumer group once", func() {
+		key := "stream_group_deliver"
+		rdb.Del(ctx, key)
+		for _, id := range []string{"1-1", "1-2", "1-3"} {
+			rdb.XAdd(ctx, &redis.XAddArgs{Stream: key, ID: id, Values: []string{"f", id}})
+		}
+		Expect(rdb.XGroupCreate(ctx, key, "g1", "0").Err()).To(Succeed())
+
+		err := rdb.XGroupCreate(ctx, key, "g1", "0").Err()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(HavePrefix("BUSYGROUP"))
+
+		streams, err := rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group: "g1", Consumer: "alice", Streams: []string{key, ">"}, Count: 2, Block: -1,
+		}).Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ids(streams[0].Messages)).To(Equal([]string{"1-1", "1-2"}))
+		Expect(streams[0].Messages[0].Values).To(Equal(map[string]interface{}{"f": "1-1"}))
+
+		streams, err = rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group: "g1", Consumer: "bob", Streams: []string{key, ">"}, Block: -1,
+		}).Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ids(streams[0].Messages)).To(Equal([]string{"1-3"}))
+
+		err = rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group: "g1", Consumer: "bob", Streams: []string{key, ">"}, Block: -1,
+		}).Err()
+		Expect(err).To(Equal(redis.Nil))
+	})
+
+	It("should replay and acknowledge a consumer's pending entries", func() {
+		key := "stream_group_pending"
+		rdb.Del(ctx, key)
+		for _, id := range []string{"1-1", "1-2"} {
+			rdb.XAdd(ctx, &redis.XAddArgs{Stream: key, ID: id, Values: []string{"f", id}})
+		}
+		Expect(rdb.XGroupCreate(ctx, key, "g1", "0").Err()).To(Succeed())
+		Expect(rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group: "g1", Consumer: "alice", Streams: []string{key, ">"}, Block: -1,
+		}).Err()).To(Succeed())
+
+		history := func() []string {
+			streams, err := rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+				Group: "g1", Consumer: "alice", Streams: []string{key, "0"}, Block: -1,
+			}).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(streams).To(HaveLen(1))
+			return ids(streams[0].Messages)
+		}
+		Expect(history()).To(Equal([]string{"1-1", "1-2"}))
+
+		Expect(rdb.XAck(ctx, key, "g1", "1-1", "9-9").Val()).To(Equal(int64(1)))
+		Expect(history()).To(Equal([]string{"1-2"}))
+		Expect(rdb.XAck(ctx, key, "g1", "1-2").Val()).To(Equal(int64(1)))
+		Expect(history()).To(BeEmpty())
+	})
+
+	It("should not track entries read with NOACK", func() {
+		key := "stream_group_noack"
+		rdb.Del(ctx, key)
+		rdb.XAdd(ctx, &redis.XAddArgs{Stream: key, ID: "1-1", Values: []string{"f", "v"}})
+		Expect(rdb.XGroupCreate(ctx, key, "g1", "0").Err()).To(Succeed())
+
+		streams, err := rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group: "g1", Consumer: "alice", Streams: []string{key, ">"}, NoAck: true, Block: -1,
+		}).Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ids(streams[0].Messages)).To(Equal([]string{"1-1"}))
+		Expect(rdb.XAck(ctx, key, "g1", "1-1").Val()).To(Equal(int64(0)))
+	})
+
+	It("should manage groups and consumers with XGROUP", func() {
+		key := "stream_group_manage"
+		rdb.Del(ctx, key)
+
+		err := rdb.XGroupCreate(ctx, key, "g1", "$").Err()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("MKSTREAM"))
+		Expect(rdb.XGroupCreateMkStream(ctx, key, "g1", "$").Err()).To(Succeed())
+		Expect(rdb.Exists(ctx, key).Val()).To(Equal(int64(1)))
+		Expect(rdb.XLen(ctx, key).Val()).To(Equal(int64(0)))
+
+		Expect(rdb.XGroupCreateConsumer(ctx, key, "g1", "alice").Val()).To(Equal(int64(1)))
+		Expect(rdb.XGroupCreateConsumer(ctx, key, "g1", "alice").Val()).To(Equal(int64(0)))
+
+		rdb.XAdd(ctx, &redis.XAddArgs{Stream: key, ID: "1-1", Values: []string{"f", "v"}})
+		Expect(rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group: "g1", Consumer: "alice", Streams: []string{key, ">"}, Block: -1,
+		}).Err()).To(Succeed())
+		Expect(rdb.XGroupDelConsumer(ctx, key, "g1", "alice").Val()).To(Equal(int64(1)))
+
+		// Rewinding the group delivers the entry again.
+		Expect(rdb.XGroupSetID(ctx, key, "g1", "0").Err()).To(Succeed())
+		streams, err := rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group: "g1", Consumer: "bob", Streams: []string{key, ">"}, Block: -1,
+		}).Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ids(streams[0].Messages)).To(Equal([]string{"1-1"}))
+
+		Expect(rdb.XGroupDestroy(ctx, key, "g1").Val()).To(Equal(int64(1)))
+		Expect(rdb.XGroupDestroy(ctx, key, "g1").Val()).To(Equal(int64(0)))
+		err = rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group: "g1", Consumer: "bob", Streams: []string{key, ">"}, Block: -1,
+		}).Err()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(HavePrefix("NOGROUP"))
+	})
+
+	It("should drop groups when the stream is deleted", func() {
+		key := "stream_group_del"
+		rdb.Del(ctx, key)
+		Expect(rdb.XGroupCreateMkStream(ctx, key, "g1", "$").Err()).To(Succeed())
+		rdb.Del(ctx, key)
+		Expect(rdb.XGroupCreateMkStream(ctx, key, "g1", "$").Err()).To(Succeed())
+	})
+
+	It("should wake a blocking XREADGROUP on XADD", func() {
+		key := "stream_group_block"
+		rdb.Del(ctx, key)
+		Expect(rdb.XGroupCreateMkStream(ctx, key, "g1", "$").Err()).To(Succeed())
+
+		writer := util.NewClient()
+		defer writer.Close()
+
+		type result struct {
+			streams []redis.XStream
+			err     error
+		}
+		done := make(chan result, 1)
+		go func() {
+			defer GinkgoRecover()
+			streams, err := rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+				Group: "g1", Consumer: "alice", Streams: []string{key, ">"}, Block: 5 * time.Second,
+			}).Result()
+			done <- result{streams, err}
+		}()
+
+		time.Sleep(200 * time.Millisecond)
+		Consistently(done, 100*time.Millisecond).ShouldNot(Receive())
+		Expect(writer.XAdd(ctx, &redis.XAddArgs{Stream: key, ID: "1-1", Values: []string{"f", "v"}}).Err()).To(Succeed())
+
+		var got result
+		Eventually(done, 2*time.Second).Should(Receive(&got))
+		Expect(got.err).NotTo(HaveOccurred())
+		Expect(ids(got.streams[0].Messages)).To(Equal([]string{"1-1"}))
+	})
+
+	It("should summarize and list pending entries with XPENDING", func() {
+		key := "stream_group_xpending"
+		rdb.Del(ctx, key)
+		for _, id := range []string{"1-1", "1-2", "1-3"} {
+			rdb.XAdd(ctx, &redis.XAddArgs{Stream: key, ID: id, Values: []string{"f", id}})
+		}
+		Expect(rdb.XGroupCreate(ctx, key, "g1", "0").Err()).To(Succeed())
+		Expect(rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group: "g1", Consumer: "alice", Streams: []string{key, ">"}, Count: 2, Block: -1,
+		}).Err()).To(Succeed())
+		Expect(rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group: "g1", Consumer: "bob", Streams: []string{key, ">"}, Block: -1,
+		}).Err()).To(Succeed())
+
+		summary, err := rdb.XPending(ctx, key, "g1").Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(summary.Count).To(Equal(int64(3)))
+		Expect(summary.Lower).To(Equal("1-1"))
+		Expect(summary.Higher).To(Equal("1-3"))
+		Expect(summary.Consumers).To(Equal(map[string]int64{"alice": 2, "bob": 1}))
+
+		entries, err := rdb.XPendingExt(ctx, &redis.XPendingExtArgs{
+			Stream: key, Group: "g1", Start: "-", End: "+", Count: 10, Consumer: "alice",
+		}).Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(HaveLen(2))
+		Expect(entries[0].ID).To(Equal("1-1"))
+		Expect(entries[0].Consumer).To(Equal("alice"))
+		Expect(entries[0].RetryCount).To(Equal(int64(1)))
+
+		entries, err = rdb.XPendingExt(ctx, &redis.XPendingExtArgs{
+			Stream: key, Group: "g1", Idle: time.Hour, Start: "-", End: "+", Count: 10,
+		}).Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(BeEmpty())
+
+		Expect(rdb.XAck(ctx, key, "g1", "1-1", "1-2", "1-3").Val()).To(Equal(int64(3)))
+		summary, err = rdb.XPending(ctx, key, "g1").Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(summary.Count).To(Equal(int64(0)))
+	})
+
+	It("should transfer idle pending entries with XCLAIM", func() {
+		key := "stream_group_xclaim"
+		rdb.Del(ctx, key)
+		for _, id := range []string{"1-1", "1-2"} {
+			rdb.XAdd(ctx, &redis.XAddArgs{Stream: key, ID: id, Values: []string{"f", id}})
+		}
+		Expect(rdb.XGroupCreate(ctx, key, "g1", "0").Err()).To(Succeed())
+		Expect(rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group: "g1", Consumer: "alice", Streams: []string{key, ">"}, Block: -1,
+		}).Err()).To(Succeed())
+
+		msgs, err := rdb.XClaim(ctx, &redis.XClaimArgs{
+			Stream: key, Group: "g1", Consumer: "bob", MinIdle: time.Hour, Messages: []string{"1-1"},
+		}).Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(msgs).To(BeEmpty())
+
+		time.Sleep(20 * time.Millisecond)
+		msgs, err = rdb.XClaim(ctx, &redis.XClaimArgs{
+			Stream: key, Group: "g1", Consumer: "bob", MinIdle: 10 * time.Millisecond, Messages: []string{"1-1"},
+		}).Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ids(msgs)).To(Equal([]string{"1-1"}))
+		Expect(msgs[0].Values).To(Equal(map[string]interface{}{"f": "1-1"}))
+
+		claimed, err := rdb.XClaimJustID(ctx, &redis.XClaimArgs{
+			Stream: key, Group: "g1", Consumer: "bob", Messages: []string{"1-2"},
+		}).Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(claimed).To(Equal([]string{"1-2"}))
+
+		entries, err := rdb.XPendingExt(ctx, &redis.XPendingExtArgs{
+			Stream: key, Group: "g1", Start: "-", End: "+", Count: 10,
+		}).Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(HaveLen(2))
+		Expect(entries[0].Consumer).To(Equal("bob"))
+		Expect(entries[0].RetryCount).To(Equal(int64(2)))
+		Expect(entries[1].Consumer).To(Equal("bob"))
+		Expect(entries[1].RetryCount).To(Equal(int64(1)))
+	})
+
+	It("should scan and claim pending entries with XAUTOCLAIM", func() {
+		key := "stream_group_xautoclaim"
+		rdb.Del(ctx, key)
+		for _, id := range []string{"1-1", "1-2", "1-3"} {
+			rdb.XAdd(ctx, &redis.XAddArgs{Stream: key, ID: id, Values: []string{"f", id}})
+		}
+		Expect(rdb.XGroupCreate(ctx, key, "g1", "0").Err()).To(Succeed())
+		Expect(rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group: "g1", Consumer: "alice", Streams: []string{key, ">"}, Block: -1,
+		}).Err()).To(Succeed())
+
+		msgs, next, err := rdb.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+			Stream: key, Group: "g1", Consumer: "bob", Start: "0", Count: 2,
+		}).Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ids(msgs)).To(Equal([]string{"1-1", "1-2"}))
+		Expect(next).To(Equal("1-3"))
+
+		claimed, next, err := rdb.XAutoClaimJustID(ctx, &redis.XAutoClaimArgs{
+			Stream: key, Group: "g1", Consumer: "bob", Start: next, Count: 2,
+		}).Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(claimed).To(Equal([]string{"1-3"}))
+		Expect(next).To(Equal("0-0"))
+
+		err = rdb.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+			Stream: key, Group: "missing", Consumer: "bob", Start: "0",
+		}).Err()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(HavePrefix("NOGROUP"))
+	})
+
+	It("should describe a stream with XINFO STREAM", func() {
+		key := "stream_xinfo_stream"
+		rdb.Del(ctx, key)
+		addIDs(key, "1-1", "1-2", "1-3")
+		Expect(rdb.XGroupCreate(ctx, key, "g1", "$").Err()).To(Succeed())
+		Expect(rdb.XDel(ctx, key, "1-3").Err()).To(Succeed())
+
+		info, err := rdb.XInfoStream(ctx, key).Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Length).To(Equal(int64(2)))
+		Expect(info.LastGeneratedID).To(Equal("1-3"))
+		Expect(info.MaxDeletedEntryID).To(Equal("1-3"))
+		Expect(info.EntriesAdded).To(Equal(int64(3)))
+		Expect(info.RecordedFirstEntryID).To(Equal("1-1"))
+		Expect(info.Groups).To(Equal(int64(1)))
+		Expect(info.FirstEntry.ID).To(Equal("1-1"))
+		Expect(info.LastEntry.ID).To(Equal("1-2"))
+		Expect(info.LastEntry.Values).To(Equal(map[string]interface{}{"f": "v"}))
+
+		err = rdb.XInfoStream(ctx, "stream_missing_key").Err()
+		Expect(err).To(MatchError(ContainSubstring("no such key")))
+	})
+
+	It("should report group lag with XINFO GROUPS", func() {
+		key := "stream_xinfo_groups"
+		rdb.Del(ctx, key)
+		addIDs(key, "1-1", "1-2", "1-3", "1-4")
+		Expect(rdb.XGroupCreate(ctx, key, "g1", "0").Err()).To(Succeed())
+		Expect(rdb.XGroupCreate(ctx, key, "g2", "$").Err()).To(Succeed())
+		Expect(rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group: "g1", Consumer: "alice", Streams: []string{key, ">"}, Count: 1, Block: -1,
+		}).Err()).To(Succeed())
+
+		groups, err := rdb.XInfoGroups(ctx, key).Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(groups).To(Equal([]redis.XInfoGroup{
+			{Name: "g1", Consumers: 1, Pending: 1, LastDeliveredID: "1-1", EntriesRead: 1, Lag: 3},
+			{Name: "g2", Consumers: 0, Pending: 0, LastDeliveredID: "1-4", EntriesRead: 0, Lag: 0},
+		}))
+
+		// A deletion past g1's position makes its lag unknown.
+		Expect(rdb.XDel(ctx, key, "1-3").Err()).To(Succeed())
+		groups, err = rdb.XInfoGroups(ctx, key).Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(groups[0].Lag).To(Equal(int64(-1)))
+		Expect(groups[1].Lag).To(Equal(int64(0)))
+	})
+
+	It("should list consumers with XINFO CONSUMERS", func() {
+		key := "stream_xinfo_consumers"
+		rdb.Del(ctx, key)
+		addIDs(key, "1-1", "1-2")
+		Expect(rdb.XGroupCreate(ctx, key, "g1", "0").Err()).To(Succeed())
+		Expect(rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group: "g1", Consumer: "alice", Streams: []string{key, ">"}, Block: -1,
+		}).Err()).To(Succeed())
+		Expect(rdb.XGroupCreateConsumer(ctx, key, "g1", "bob").Err()).To(Succeed())
+
+		consumers, err := rdb.XInfoConsumers(ctx, key, "g1").Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(consumers).To(HaveLen(2))
+		Expect(consumers[0].Name).To(Equal("alice"))
+		Expect(consumers[0].Pending).To(Equal(int64(2)))
+		Expect(consumers[0].Inactive).To(BeNumerically(">=", 0))
+		Expect(consumers[1].Name).To(Equal("bob"))
+		Expect(consumers[1].Pending).To(Equal(int64(0)))
+		Expect(consumers[1].Inactive).To(Equal(-time.Millisecond))
+
+		err = rdb.XInfoConsumers(ctx, key, "missing").Err()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(HavePrefix("NOGROUP"))
+	})
+})
@@ -0,0 +1,498 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/marsevilspirit/nimbis/e2e-test/util"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/redis/go-redis/v9"
+)
+
+// errWrongType and errNotInteger are the errors the model predicts, matched
+// by prefix against those of the server.
+var (
+	errWrongType  = errors.New("WRONGTYPE")
+	errNotInteger = errors.New("ERR")
+)
+
+// stressModel is the oracle of a stress worker: the value each of its keys
+// should hold, as a string, a hash (map[string]string), a set
+// (map[string]bool) or a list ([]string).
+type stressModel map[string]interface{}
+
+// apply applies a command to the model and returns the reply the server
+// should give it, as go-redis Do returns it.
+func (m stressModel) apply(args []string) (interface{}, error) {
+	key := args[1]
+	value, exists := m[key]
+	wrongType := func(ok bool) bool { return exists && !ok }
+
+	switch args[0] {
+	case "SET":
+		m[key] = args[2]
+		return "OK", nil
+	case "GET":
+		str, ok := value.(string)
+		if wrongType(ok) {
+			return nil, errWrongType
+		}
+		if !exists {
+			return nil, redis.Nil
+		}
+		return str, nil
+	case "APPEND":
+		str, ok := value.(string)
+		if wrongType(ok) {
+			return nil, errWrongType
+		}
+		m[key] = str + args[2]
+		return int64(len(str) + len(args[2])), nil
+	case "INCR", "DECR":
+		str, ok := value.(string)
+		if wrongType(ok) {
+			return nil, errWrongType
+		}
+		if !exists {
+			str = "0"
+		}
+		n, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			return nil, errNotInteger
+		}
+		if args[0] == "INCR" {
+			n++
+		} else {
+			n--
+		}
+		m[key] = strconv.FormatInt(n, 10)
+		return n, nil
+	case "DEL":
+		delete(m, key)
+		return boolInt(exists), nil
+	case "EXISTS":
+		return boolInt(exists), nil
+	case "HSET", "HDEL", "HGET", "HLEN":
+		hash, ok := value.(map[string]string)
+		if wrongType(ok) {
+			return nil, errWrongType
+		}
+		if hash == nil {
+			hash = map[string]string{}
+		}
+		switch args[0] {
+		case "HSET":
+			_, had := hash[args[2]]
+			hash[args[2]] = args[3]
+			m[key] = hash
+			return boolInt(!had), nil
+		case "HDEL":
+			_, had := hash[args[2]]
+			delete(hash, args[2])
+			m.keep(key, len(hash))
+			return boolInt(had), nil
+		case "HGET":
+			field, had := hash[args[2]]
+			if !had {
+				return nil, redis.Nil
+			}
+			return field, nil
+		default:
+			return int64(len(hash)), nil
+		}
+	case "SADD", "SREM", "SCARD":
+		set, ok := value.(map[string]bool)
+		if wrongType(ok) {
+			return nil, errWrongType
+		}
+		if set == nil {
+			set = map[string]bool{}
+		}
+		switch args[0] {
+		case "SADD":
+			had := set[args[2]]
+			set[args[2]] = true
+			m[key] = set
+			return boolInt(!had), nil
+		case "SREM":
+			had := set[args[2]]
+			delete(set, args[2])
+			m.keep(key, len(set))
+			return boolInt(had), nil
+		default:
+			return int64(len(set)), nil
+		}
+	case "RPUSH", "LPOP", "LLEN":
+		list, ok := value.([]string)
+		if wrongType(ok) {
+			return nil, errWrongType
+		}
+		switch args[0] {
+		case "RPUSH":
+			m[key] = append(list, args[2])
+			return int64(len(list) + 1), nil
+		case "LPOP":
+			if len(list) == 0 {
+				return nil, redis.Nil
+			}
+			m[key] = list[1:]
+			m.keep(key, len(list)-1)
+			return list[0], nil
+		default:
+			return int64(len(list)), nil
+		}
+	}
+	panic("stress model has no " + args[0])
+}
+
+// keep deletes key once its collection is empty, as the server does.
+func (m stressModel) keep(key string, size int) {
+	if size == 0 {
+		delete(m, key)
+	}
+}
+
+func boolInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// randomStressOp picks a command on one of keys. The keys are few and
+// shared by every type, so type conflicts are exercised as well.
+func randomStressOp(rng *rand.Rand, keys []string) []string {
+	key := keys[rng.IntN(len(keys))]
+	field := fmt.Sprintf("f%d", rng.IntN(4))
+	value := []string{"1", "42", "-7", "abc", "v" + strconv.Itoa(rng.IntN(100))}[rng.IntN(5)]
+	switch rng.IntN(17) {
+	case 0:
+		return []string{"SET", key, value}
+	case 1:
+		return []string{"GET", key}
+	case 2:
+		return []string{"APPEND", key, value}
+	case 3:
+		return []string{[]string{"INCR", "DECR"}[rng.IntN(2)], key}
+	case 4:
+		return []string{"DEL", key}
+	case 5:
+		return []string{"EXISTS", key}
+	case 6:
+		return []string{"HSET", key, field, value}
+	case 7:
+		return []string{"HDEL", key, field}
+	case 8:
+		return []string{"HGET", key, field}
+	case 9:
+		return []string{"HLEN", key}
+	case 10:
+		return []string{"SADD", key, field}
+	case 11:
+		return []string{"SREM", key, field}
+	case 12:
+		return []string{"SCARD", key}
+	case 13:
+		return []string{"RPUSH", key, value}
+	case 14:
+		return []string{"LPOP", key}
+	case 15:
+		return []string{"LLEN", key}
+	default:
+		return []string{"GET", key}
+	}
+}
+
+// stressSettings reads the seed, workers and operations per worker of a
+// stress run from STRESS_SEED, STRESS_WORKERS and STRESS_OPS, so a failing
+// run can be repeated.
+func stressSettings() (seed uint64, workers, ops int) {
+	seed = uint64(time.Now().UnixNano())
+	workers, ops = 16, 400
+	if env := os.Getenv("STRESS_SEED"); env != "" {
+		parsed, err := strconv.ParseUint(env, 10, 64)
+		Expect(err).NotTo(HaveOccurred(), "STRESS_SEED")
+		seed = parsed
+	}
+	for _, setting := range []struct {
+		env   string
+		value *int
+	}{{"STRESS_WORKERS", &workers}, {"STRESS_OPS", &ops}} {
+		if env := os.Getenv(setting.env); env != "" {
+			parsed, err := strconv.Atoi(env)
+			Expect(err).NotTo(HaveOccurred(), setting.env)
+			*setting.value = parsed
+		}
+	}
+	return seed, workers, ops
+}
+
+// serverValue reads key back in the shape the model keeps want in, or
+// reports whether it exists at all if want is nil. A key of another type
+// than want fails with WRONGTYPE.
+func serverValue(ctx context.Context, client *redis.Client, key string, want interface{}) (interface{}, error) {
+	switch want.(type) {
+	case nil:
+		return client.Exists(ctx, key).Result()
+	case string:
+		return client.Get(ctx, key).Result()
+	case map[string]string:
+		return client.HGetAll(ctx, key).Result()
+	case map[string]bool:
+		members, err := client.SMembers(ctx, key).Result()
+		set := map[string]bool{}
+		for _, member := range members {
+			set[member] = true
+		}
+		return set, err
+	default:
+		return client.LRange(ctx, key, 0, -1).Result()
+	}
+}
+
+const (
+	stressAccounts       = 4
+	stressAccountBalance = 1000
+	stressCounters       = 4
+)
+
+func stressAccount(n int) string {
+	return fmt.Sprintf("stress:account:%d", n)
+}
+
+func stressCounter(n int) string {
+	return fmt.Sprintf("stress:counter:%d", n)
+}
+
+// stressWorker is what one goroutine of a stress run expects of the keys
+// it shares with the others.
+type stressWorker struct {
+	// deltas are what the worker added to each shared counter.
+	deltas [stressCounters]int64
+	// members are the members the worker left in the shared set.
+	members map[string]bool
+	// versions are the versions the worker's script calls bumped the
+	// shared version key to.
+	versions []int64
+	// tickets are the tickets the worker's transactions drew.
+	tickets []int64
+}
+
+// stressBump is a script that reads the shared version key and writes it
+// back one higher, which only its atomicity keeps from losing an update.
+const stressBump = `
+local version = tonumber(redis.call("GET", KEYS[1]) or "0") + 1
+redis.call("SET", KEYS[1], version)
+return version`
+
+var _ = Describe("Stress Tests", func() {
+	var ctx context.Context
+	var client *redis.Client
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		client = util.NewClient()
+		Expect(client.FlushDB(ctx).Err()).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(client.Close()).NotTo(HaveOccurred())
+	})
+
+	It("should match a model under random concurrent operations", func() {
+		seed, workers, ops := stressSettings()
+		GinkgoWriter.Printf("Stressing with STRESS_SEED=%d STRESS_WORKERS=%d STRESS_OPS=%d\n", seed, workers, ops)
+		stress := redis.NewClient(&redis.Options{Addr: util.Addr(), PoolSize: workers})
+		defer stress.Close()
+
+		for n := range stressAccounts {
+			Expect(client.Set(ctx, stressAccount(n), stressAccountBalance, 0).Err()).To(Succeed())
+		}
+		accounts := make([]string, stressAccounts)
+		for n := range accounts {
+			accounts[n] = stressAccount(n)
+		}
+
+		models := make([]stressModel, workers)
+		expected := make([]stressWorker, workers)
+		var wg sync.WaitGroup
+		for w := range workers {
+			models[w] = stressModel{}
+			expected[w].members = map[string]bool{}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer GinkgoRecover()
+				rng := rand.New(rand.NewPCG(seed, uint64(w)))
+				model, shared := models[w], &expected[w]
+				keys := []string{
+					fmt.Sprintf("stress:w%d:a", w),
+					fmt.Sprintf("stress:w%d:b", w),
+					fmt.Sprintf("stress:w%d:c", w),
+				}
+				at := func(i int, op interface{}) string {
+					return fmt.Sprintf("STRESS_SEED=%d worker %d op %d %v", seed, w, i, op)
+				}
+
+				for i := range ops {
+					switch rng.IntN(10) {
+					case 0:
+						// Commutative updates of keys every worker shares.
+						n := rng.IntN(stressCounters)
+						if rng.IntN(2) == 0 {
+							Expect(stress.Incr(ctx, stressCounter(n)).Err()).To(Succeed(), at(i, "INCR"))
+							shared.deltas[n]++
+						} else {
+							Expect(stress.Decr(ctx, stressCounter(n)).Err()).To(Succeed(), at(i, "DECR"))
+							shared.deltas[n]--
+						}
+						member := fmt.Sprintf("w%d:%d", w, rng.IntN(8))
+						if rng.IntN(2) == 0 {
+							Expect(stress.SAdd(ctx, "stress:members", member).Err()).To(Succeed(), at(i, "SADD"))
+							shared.members[member] = true
+						} else {
+							Expect(stress.SRem(ctx, "stress:members", member).Err()).To(Succeed(), at(i, "SREM"))
+							delete(shared.members, member)
+						}
+					case 1:
+						// Move a unit between accounts in a transaction, which
+						// must never show a partial transfer.
+						from, to := rng.IntN(stressAccounts), rng.IntN(stressAccounts)
+						_, err := stress.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+							pipe.Decr(ctx, stressAccount(from))
+							pipe.Incr(ctx, stressAccount(to))
+							return nil
+						})
+						Expect(err).NotTo(HaveOccurred(), at(i, "transfer"))
+					case 2:
+						// Audit every account in one transaction.
+						balances := make([]*redis.StringCmd, stressAccounts)
+						_, err := stress.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+							for n, account := range accounts {
+								balances[n] = pipe.Get(ctx, account)
+							}
+							return nil
+						})
+						Expect(err).NotTo(HaveOccurred(), at(i, "audit"))
+						total, seen := 0, make([]string, stressAccounts)
+						for n, balance := range balances {
+							seen[n] = balance.Val()
+							value, err := balance.Int()
+							Expect(err).NotTo(HaveOccurred(), at(i, "audit"))
+							total += value
+						}
+						Expect(total).To(Equal(stressAccounts*stressAccountBalance),
+							at(i, fmt.Sprintf("audit saw %v", seen)))
+					case 3:
+						// Bump a version in a script, which no two calls may
+						// bump to the same version.
+						version, err := stress.Eval(ctx, stressBump, []string{"stress:version"}).Int64()
+						Expect(err).NotTo(HaveOccurred(), at(i, "EVAL"))
+						shared.versions = append(shared.versions, version)
+					case 4:
+						// Draw a ticket and its shadow in a transaction; a
+						// transaction run between the two would leave them
+						// apart, and a lost update would hand out a ticket
+						// twice.
+						var ticket, shadow *redis.IntCmd
+						_, err := stress.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+							ticket = pipe.Incr(ctx, "stress:ticket")
+							shadow = pipe.Incr(ctx, "stress:ticket:shadow")
+							return nil
+						})
+						Expect(err).NotTo(HaveOccurred(), at(i, "ticket"))
+						Expect(shadow.Val()).To(Equal(ticket.Val()), at(i, "ticket"))
+						shared.tickets = append(shared.tickets, ticket.Val())
+					default:
+						// Keys of the worker's own, whose every reply the
+						// model predicts.
+						op := randomStressOp(rng, keys)
+						want, wantErr := model.apply(op)
+						args := make([]interface{}, len(op))
+						for n, arg := range op {
+							args[n] = arg
+						}
+						got, err := stress.Do(ctx, args...).Result()
+						switch {
+						case wantErr == nil:
+							Expect(err).NotTo(HaveOccurred(), at(i, op))
+							Expect(got).To(Equal(want), at(i, op))
+						case wantErr == redis.Nil:
+							Expect(err).To(Equal(redis.Nil), at(i, op))
+						default:
+							Expect(err).To(HaveOccurred(), at(i, op))
+							Expect(err.Error()).To(HavePrefix(wantErr.Error()), at(i, op))
+						}
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		for w, model := range models {
+			for _, suffix := range []string{"a", "b", "c"} {
+				key := fmt.Sprintf("stress:w%d:%s", w, suffix)
+				want := model[key]
+				got, err := serverValue(ctx, client, key, want)
+				Expect(err).NotTo(HaveOccurred(), fmt.Sprintf("STRESS_SEED=%d final %s", seed, key))
+				if want == nil {
+					want = int64(0)
+				}
+				Expect(got).To(Equal(want), fmt.Sprintf("STRESS_SEED=%d final %s", seed, key))
+			}
+		}
+
+		var deltas [stressCounters]int64
+		members := []string{}
+		var versions, tickets []int64
+		for _, worker := range expected {
+			for n, delta := range worker.deltas {
+				deltas[n] += delta
+			}
+			for member := range worker.members {
+				members = append(members, member)
+			}
+			versions = append(versions, worker.versions...)
+			tickets = append(tickets, worker.tickets...)
+		}
+		for n, delta := range deltas {
+			value, err := client.Get(ctx, stressCounter(n)).Int64()
+			if err == redis.Nil {
+				value, err = 0, nil
+			}
+			Expect(err).NotTo(HaveOccurred())
+			Expect(value).To(Equal(delta), fmt.Sprintf("STRESS_SEED=%d %s", seed, stressCounter(n)))
+		}
+		Expect(client.SMembers(ctx, "stress:members").Val()).To(ConsistOf(members))
+		version, err := client.Get(ctx, "stress:version").Int64()
+		if err == redis.Nil {
+			version, err = 0, nil
+		}
+		Expect(err).NotTo(HaveOccurred())
+		slices.Sort(versions)
+		for n, bumped := range versions {
+			Expect(bumped).To(Equal(int64(n+1)), fmt.Sprintf("STRESS_SEED=%d versions bumped", seed))
+		}
+		Expect(version).To(Equal(int64(len(versions))), fmt.Sprintf("STRESS_SEED=%d final version", seed))
+		slices.Sort(tickets)
+		for n, ticket := range tickets {
+			Expect(ticket).To(Equal(int64(n+1)), fmt.Sprintf("STRESS_SEED=%d tickets drawn", seed))
+		}
+
+		total := 0
+		for _, account := range accounts {
+			balance, err := client.Get(ctx, account).Int()
+			Expect(err).NotTo(HaveOccurred())
+			total += balance
+		}
+		Expect(total).To(Equal(stressAccounts * stressAccountBalance))
+	})
+})
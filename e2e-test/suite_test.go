@@ -15,13 +15,25 @@ func TestNimbis(t *testing.T) {
 }
 
 var _ = BeforeSuite(func() {
-	// Start server on port 6379
 	err := util.StartServer()
 	Expect(err).NotTo(HaveOccurred())
-	fmt.Println("Server started on port 6379")
+	if util.External() {
+		fmt.Printf("Using the server at %s\n", util.Addr())
+	} else {
+		fmt.Printf("Server started on port %d\n", util.Port())
+	}
 })
 
 var _ = AfterSuite(func() {
 	util.StopServer()
 	fmt.Println("Server stopped")
 })
+
+// skipIfExternal skips specs that start servers of their own or restart the
+// main one, which they cannot do when the suite runs against an external
+// server.
+func skipIfExternal() {
+	if util.External() {
+		Skip("needs servers the suite starts itself")
+	}
+}
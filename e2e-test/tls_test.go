@@ -0,0 +1,78 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/marsevilspirit/nimbis/e2e-test/util"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("TLS", Ordered, func() {
+	var certs *util.Certificates
+	var tlsPort int
+	var ctx context.Context
+
+	BeforeAll(func() {
+		skipIfExternal()
+		dir, err := os.MkdirTemp("", "nimbis-tls")
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(os.RemoveAll, dir)
+
+		certs, err = util.WriteCertificates(dir)
+		Expect(err).NotTo(HaveOccurred())
+		tlsPort, err = util.FreePort()
+		Expect(err).NotTo(HaveOccurred())
+		config := filepath.Join(dir, "config.toml")
+		Expect(os.WriteFile(config, []byte(fmt.Sprintf(`
+tls_port = %d
+tls_cert_file = %q
+tls_key_file = %q
+tls_ca_cert_file = %q
+tls_auth_clients = "yes"
+`, tlsPort, certs.ServerCert, certs.ServerKey, certs.CACert)), 0o600)).To(Succeed())
+
+		Expect(util.StartServerWithConfig(config)).To(Succeed())
+		DeferCleanup(util.StopServerWithConfig)
+	})
+
+	BeforeEach(func() {
+		ctx = context.Background()
+	})
+
+	It("should serve clients presenting a trusted certificate", func() {
+		config, err := certs.ClientConfig(true)
+		Expect(err).NotTo(HaveOccurred())
+		client := util.NewTLSClient(tlsPort, config)
+		defer client.Close()
+
+		Expect(client.Ping(ctx).Val()).To(Equal("PONG"))
+		Expect(client.Set(ctx, "tls:key", "secret", 0).Err()).To(Succeed())
+		Expect(client.Get(ctx, "tls:key").Val()).To(Equal("secret"))
+		Expect(client.ConfigGet(ctx, "tls_auth_clients").Val()).To(HaveKeyWithValue("tls_auth_clients", "yes"))
+	})
+
+	It("should refuse clients without a certificate", func() {
+		config, err := certs.ClientConfig(false)
+		Expect(err).NotTo(HaveOccurred())
+		client := util.NewTLSClient(tlsPort, config)
+		defer client.Close()
+
+		Expect(client.Ping(ctx).Err()).To(HaveOccurred())
+	})
+
+	It("should keep serving plain TCP on port", func() {
+		config, err := certs.ClientConfig(true)
+		Expect(err).NotTo(HaveOccurred())
+		client := util.NewTLSClient(tlsPort, config)
+		defer client.Close()
+		Expect(client.Set(ctx, "tls:shared", "v", 0).Err()).To(Succeed())
+
+		plain := util.NewConfigServerClient()
+		defer plain.Close()
+		Expect(plain.Get(ctx, "tls:shared").Val()).To(Equal("v"))
+	})
+})
@@ -0,0 +1,155 @@
+package tests
+
+import (
+	"context"
+
+	"github.com/marsevilspirit/nimbis/e2e-test/util"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/redis/go-redis/v9"
+)
+
+// rawConn is a bare connection used where go-redis hides push messages,
+// with replies compared as plain values.
+type rawConn struct {
+	*util.RespConn
+}
+
+func dialRaw() *rawConn {
+	conn, err := util.DialResp(util.Addr())
+	Expect(err).NotTo(HaveOccurred())
+	return &rawConn{conn}
+}
+
+func (c *rawConn) do(args ...string) interface{} {
+	reply, err := c.Do(args...)
+	Expect(err).NotTo(HaveOccurred())
+	return reply.Value()
+}
+
+// read parses one reply. Arrays, maps and pushes become []interface{}.
+func (c *rawConn) read() interface{} {
+	reply, err := c.ReadReply()
+	Expect(err).NotTo(HaveOccurred())
+	return reply.Value()
+}
+
+func (c *rawConn) close() {
+	Expect(c.Close()).To(Succeed())
+}
+
+var _ = Describe("Client Tracking", func() {
+	var rdb *redis.Client
+	var ctx context.Context
+
+	BeforeEach(func() {
+		rdb = util.NewClient()
+		ctx = context.Background()
+		Expect(rdb.FlushDB(ctx).Err()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(rdb.Close()).To(Succeed())
+	})
+
+	It("should push invalidations for keys read in default mode", func() {
+		conn := dialRaw()
+		defer conn.close()
+		conn.do("HELLO", "3")
+		Expect(conn.do("CLIENT", "TRACKING", "ON")).To(Equal("OK"))
+
+		Expect(rdb.Set(ctx, "track:key", "v1", 0).Err()).To(Succeed())
+		Expect(conn.do("GET", "track:key")).To(Equal("v1"))
+		Expect(rdb.Set(ctx, "track:key", "v2", 0).Err()).To(Succeed())
+		Expect(conn.read()).To(Equal([]interface{}{"invalidate", []interface{}{"track:key"}}))
+
+		// The key is only tracked again after the next read.
+		Expect(rdb.Set(ctx, "track:key", "v3", 0).Err()).To(Succeed())
+		Expect(conn.do("GET", "track:key")).To(Equal("v3"))
+		Expect(rdb.Del(ctx, "track:key").Err()).To(Succeed())
+		Expect(conn.read()).To(Equal([]interface{}{"invalidate", []interface{}{"track:key"}}))
+
+		Expect(conn.do("GET", "track:key")).To(BeNil())
+		Expect(rdb.FlushDB(ctx).Err()).To(Succeed())
+		Expect(conn.read()).To(Equal([]interface{}{"invalidate", nil}))
+	})
+
+	It("should broadcast writes to matching prefixes", func() {
+		conn := dialRaw()
+		defer conn.close()
+		conn.do("HELLO", "3")
+		Expect(conn.do("CLIENT", "TRACKING", "ON", "BCAST", "PREFIX", "user:")).To(Equal("OK"))
+
+		Expect(rdb.Set(ctx, "order:1", "x", 0).Err()).To(Succeed())
+		Expect(rdb.Set(ctx, "user:1", "x", 0).Err()).To(Succeed())
+		Expect(conn.read()).To(Equal([]interface{}{"invalidate", []interface{}{"user:1"}}))
+	})
+
+	It("should only track reads after CLIENT CACHING YES in OPTIN mode", func() {
+		conn := dialRaw()
+		defer conn.close()
+		conn.do("HELLO", "3")
+		Expect(conn.do("CLIENT", "TRACKING", "ON", "OPTIN")).To(Equal("OK"))
+
+		conn.do("GET", "track:skipped")
+		Expect(conn.do("CLIENT", "CACHING", "YES")).To(Equal("OK"))
+		conn.do("GET", "track:cached")
+		Expect(rdb.Set(ctx, "track:skipped", "x", 0).Err()).To(Succeed())
+		Expect(rdb.Set(ctx, "track:cached", "x", 0).Err()).To(Succeed())
+		Expect(conn.read()).To(Equal([]interface{}{"invalidate", []interface{}{"track:cached"}}))
+
+		Expect(conn.do("CLIENT", "CACHING", "NO")).To(Equal(
+			"ERR CLIENT CACHING NO is only valid when tracking is enabled in OPTOUT mode."))
+	})
+
+	It("should redirect invalidations to a RESP2 subscriber", func() {
+		target := dialRaw()
+		defer target.close()
+		targetID := target.do("CLIENT", "ID").(int64)
+		Expect(target.do("SUBSCRIBE", "__redis__:invalidate")).To(Equal(
+			[]interface{}{"subscribe", "__redis__:invalidate", int64(1)}))
+
+		conn := rdb.Conn()
+		defer conn.Close()
+		Expect(conn.Do(ctx, "CLIENT", "TRACKING", "ON", "REDIRECT", targetID, "NOLOOP").Err()).To(Succeed())
+		Expect(conn.Do(ctx, "CLIENT", "GETREDIRECT").Val()).To(Equal(targetID))
+
+		Expect(conn.Get(ctx, "track:redirect").Err()).To(Equal(redis.Nil))
+		Expect(conn.Set(ctx, "track:redirect", "own write", 0).Err()).To(Succeed())
+		Expect(conn.Get(ctx, "track:redirect").Val()).To(Equal("own write"))
+		Expect(rdb.Set(ctx, "track:redirect", "other write", 0).Err()).To(Succeed())
+		Expect(target.read()).To(Equal([]interface{}{
+			"message", "__redis__:invalidate", []interface{}{"track:redirect"},
+		}))
+	})
+
+	It("should validate tracking options", func() {
+		conn := rdb.Conn()
+		defer conn.Close()
+
+		Expect(conn.Do(ctx, "CLIENT", "GETREDIRECT").Val()).To(Equal(int64(-1)))
+		Expect(conn.Do(ctx, "CLIENT", "TRACKING", "ON", "PREFIX", "a").Err()).To(
+			MatchError("ERR PREFIX option requires BCAST mode to be enabled"))
+		Expect(conn.Do(ctx, "CLIENT", "TRACKING", "ON", "OPTIN", "OPTOUT").Err()).To(
+			MatchError("ERR You can't use both OPTIN and OPTOUT options"))
+		Expect(conn.Do(ctx, "CLIENT", "TRACKING", "ON", "REDIRECT", "999999").Err()).To(
+			MatchError("ERR The client ID you want redirect to does not exist"))
+		Expect(conn.Do(ctx, "CLIENT", "CACHING", "YES").Err()).To(
+			MatchError(ContainSubstring("CLIENT CACHING can be called only when the client is in tracking mode")))
+
+		Expect(conn.Do(ctx, "CLIENT", "TRACKING", "ON", "BCAST", "PREFIX", "a:").Err()).To(Succeed())
+		Expect(conn.Do(ctx, "CLIENT", "TRACKING", "ON").Err()).To(
+			MatchError(ContainSubstring("You can't switch BCAST mode on/off")))
+		Expect(conn.Do(ctx, "CLIENT", "GETREDIRECT").Val()).To(Equal(int64(0)))
+		info, err := conn.Do(ctx, "CLIENT", "TRACKINGINFO").Slice()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info).To(Equal([]interface{}{
+			"flags", []interface{}{"on", "bcast"},
+			"redirect", int64(0),
+			"prefixes", []interface{}{"a:"},
+		}))
+
+		Expect(conn.Do(ctx, "RESET").Err()).To(Succeed())
+		Expect(conn.Do(ctx, "CLIENT", "GETREDIRECT").Val()).To(Equal(int64(-1)))
+	})
+})
@@ -0,0 +1,116 @@
+package tests
+
+import (
+	"context"
+
+	"github.com/marsevilspirit/nimbis/e2e-test/util"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/redis/go-redis/v9"
+)
+
+var _ = Describe("Transaction Commands", func() {
+	var rdb *redis.Client
+	var conn *redis.Conn
+	var ctx context.Context
+
+	BeforeEach(func() {
+		rdb = util.NewClient()
+		ctx = context.Background()
+		Expect(rdb.FlushDB(ctx).Err()).To(Succeed())
+		conn = rdb.Conn()
+	})
+
+	AfterEach(func() {
+		Expect(conn.Close()).To(Succeed())
+		Expect(rdb.Close()).To(Succeed())
+	})
+
+	It("should queue commands and execute them on EXEC", func() {
+		Expect(conn.Do(ctx, "MULTI").Text()).To(Equal("OK"))
+		Expect(conn.Do(ctx, "SET", "tx:key", "1").Text()).To(Equal("QUEUED"))
+		Expect(conn.Do(ctx, "INCR", "tx:key").Text()).To(Equal("QUEUED"))
+		Expect(conn.Do(ctx, "GET", "tx:key").Text()).To(Equal("QUEUED"))
+
+		// Queued commands are not visible before EXEC.
+		Expect(rdb.Exists(ctx, "tx:key").Val()).To(Equal(int64(0)))
+
+		result, err := conn.Do(ctx, "EXEC").Slice()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal([]interface{}{"OK", int64(2), "2"}))
+		Expect(rdb.Get(ctx, "tx:key").Val()).To(Equal("2"))
+	})
+
+	It("should work with go-redis TxPipelined", func() {
+		cmds, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, "tx:hash", "field", "value")
+			pipe.HGet(ctx, "tx:hash", "field")
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cmds).To(HaveLen(2))
+		Expect(cmds[1].(*redis.StringCmd).Val()).To(Equal("value"))
+	})
+
+	It("should discard queued commands", func() {
+		Expect(conn.Do(ctx, "MULTI").Err()).To(Succeed())
+		Expect(conn.Do(ctx, "SET", "tx:discard", "value").Text()).To(Equal("QUEUED"))
+		Expect(conn.Do(ctx, "DISCARD").Text()).To(Equal("OK"))
+		Expect(rdb.Exists(ctx, "tx:discard").Val()).To(Equal(int64(0)))
+
+		err := conn.Do(ctx, "DISCARD").Err()
+		Expect(err).To(MatchError(ContainSubstring("DISCARD without MULTI")))
+	})
+
+	It("should abort EXEC after a queue-time error", func() {
+		Expect(conn.Do(ctx, "MULTI").Err()).To(Succeed())
+		Expect(conn.Do(ctx, "SET", "tx:abort", "value").Text()).To(Equal("QUEUED"))
+
+		err := conn.Do(ctx, "NO_SUCH_CMD").Err()
+		Expect(err).To(MatchError(ContainSubstring("unknown command")))
+		err = conn.Do(ctx, "GET").Err()
+		Expect(err).To(MatchError(ContainSubstring("wrong number of arguments")))
+
+		err = conn.Do(ctx, "EXEC").Err()
+		Expect(err).To(MatchError(ContainSubstring("EXECABORT")))
+		Expect(rdb.Exists(ctx, "tx:abort").Val()).To(Equal(int64(0)))
+	})
+
+	It("should report runtime errors inside the EXEC reply", func() {
+		Expect(rdb.LPush(ctx, "tx:list", "a").Err()).To(Succeed())
+
+		Expect(conn.Do(ctx, "MULTI").Err()).To(Succeed())
+		Expect(conn.Do(ctx, "GET", "tx:list").Text()).To(Equal("QUEUED"))
+		Expect(conn.Do(ctx, "SET", "tx:after", "value").Text()).To(Equal("QUEUED"))
+
+		result, err := conn.Do(ctx, "EXEC").Slice()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(HaveLen(2))
+		Expect(result[0]).To(MatchError(ContainSubstring("WRONGTYPE")))
+		Expect(result[1]).To(Equal("OK"))
+	})
+
+	It("should reject EXEC without MULTI and nested MULTI", func() {
+		err := conn.Do(ctx, "EXEC").Err()
+		Expect(err).To(MatchError(ContainSubstring("EXEC without MULTI")))
+
+		Expect(conn.Do(ctx, "MULTI").Err()).To(Succeed())
+		err = conn.Do(ctx, "MULTI").Err()
+		Expect(err).To(MatchError(ContainSubstring("MULTI calls can not be nested")))
+
+		// A nested MULTI does not abort the transaction.
+		result, err := conn.Do(ctx, "EXEC").Slice()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(BeEmpty())
+	})
+
+	It("should drop the transaction on RESET", func() {
+		Expect(conn.Do(ctx, "MULTI").Err()).To(Succeed())
+		Expect(conn.Do(ctx, "SET", "tx:reset", "value").Text()).To(Equal("QUEUED"))
+		Expect(conn.Do(ctx, "RESET").Text()).To(Equal("RESET"))
+
+		err := conn.Do(ctx, "EXEC").Err()
+		Expect(err).To(MatchError(ContainSubstring("EXEC without MULTI")))
+		Expect(rdb.Exists(ctx, "tx:reset").Val()).To(Equal(int64(0)))
+	})
+})
@@ -2,6 +2,7 @@ package tests
 
 import (
 	"context"
+	"strconv"
 	"time"
 
 	"github.com/marsevilspirit/nimbis/e2e-test/util"
@@ -23,7 +24,14 @@ var _ = Describe("Expire/TTL Commands", func() {
 		"list_ttl_lpush_key",
 		"zset_ttl_zadd_key",
 		"expire_update_key",
+		"pexpireat_key",
 		"non_existent_key_expire",
+		"restart_long_key",
+		"restart_short_key",
+		"restart_hash_key",
+		"active_string_key",
+		"active_hash_key",
+		"active_kept_key",
 	}
 
 	BeforeEach(func() {
@@ -112,6 +120,19 @@ var _ = Describe("Expire/TTL Commands", func() {
 		Expect(ttl).To(BeNumerically("<=", 1*time.Second))
 	})
 
+	It("should handle PEXPIREAT", func() {
+		key := "pexpireat_key"
+		Expect(rdb.PExpireAt(ctx, key, time.Now().Add(time.Hour)).Val()).To(BeFalse())
+
+		Expect(rdb.Set(ctx, key, "val", 0).Err()).To(Succeed())
+		Expect(rdb.PExpireAt(ctx, key, time.Now().Add(time.Hour)).Val()).To(BeTrue())
+		Expect(rdb.TTL(ctx, key).Val()).To(BeNumerically(">", 59*time.Minute))
+
+		// A time in the past deletes the key.
+		Expect(rdb.PExpireAt(ctx, key, time.Now().Add(-time.Second)).Val()).To(BeTrue())
+		Expect(rdb.Exists(ctx, key).Val()).To(Equal(int64(0)))
+	})
+
 	It("should handle basic EXPIRE and TTL for Hash", func() {
 		key := "hash_expire_key"
 
@@ -227,4 +248,56 @@ var _ = Describe("Expire/TTL Commands", func() {
 		Expect(ttlAfter).To(BeNumerically(">", 0))
 		Expect(ttlAfter).To(BeNumerically("<=", ttlBefore))
 	})
+
+	It("should keep expire times across a restart", func() {
+		skipIfExternal()
+		Expect(rdb.Set(ctx, "restart_long_key", "v", 100*time.Second).Err()).To(Succeed())
+		Expect(rdb.Set(ctx, "restart_short_key", "v", 0).Err()).To(Succeed())
+		Expect(rdb.PExpireAt(ctx, "restart_short_key", time.Now().Add(300*time.Millisecond)).Err()).To(Succeed())
+		Expect(rdb.HSet(ctx, "restart_hash_key", "old", "v").Err()).To(Succeed())
+		Expect(rdb.PExpireAt(ctx, "restart_hash_key", time.Now().Add(300*time.Millisecond)).Err()).To(Succeed())
+
+		ttlBefore, err := rdb.TTL(ctx, "restart_long_key").Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ttlBefore).To(BeNumerically(">", 0))
+
+		Expect(rdb.Close()).To(Succeed())
+
+		// The short TTLs run out while the server is down.
+		Expect(util.HaltServer()).To(Succeed())
+		time.Sleep(500 * time.Millisecond)
+		Expect(util.RelaunchServer()).To(Succeed())
+		rdb = util.NewClient()
+
+		ttlAfter, err := rdb.TTL(ctx, "restart_long_key").Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ttlAfter).To(BeNumerically(">", 0))
+		Expect(ttlAfter).To(BeNumerically("<=", ttlBefore))
+
+		Expect(rdb.Exists(ctx, "restart_short_key", "restart_hash_key").Val()).To(Equal(int64(0)))
+		Expect(rdb.TTL(ctx, "restart_short_key").Val()).To(Equal(time.Duration(-2)))
+		Expect(rdb.Get(ctx, "restart_short_key").Err()).To(Equal(redis.Nil))
+
+		// Writing to the expired hash starts a new one without the old fields.
+		Expect(rdb.HSet(ctx, "restart_hash_key", "new", "v").Err()).To(Succeed())
+		Expect(rdb.HGetAll(ctx, "restart_hash_key").Val()).To(Equal(map[string]string{"new": "v"}))
+	})
+
+	It("should delete keys past their expire time without a read", func() {
+		expiredKeys := func() int64 {
+			value, err := strconv.ParseInt(infoField(rdb.Info(ctx, "stats").Val(), "expired_keys"), 10, 64)
+			Expect(err).NotTo(HaveOccurred())
+			return value
+		}
+		before := expiredKeys()
+		Expect(rdb.Set(ctx, "active_string_key", "v", 100*time.Millisecond).Err()).To(Succeed())
+		Expect(rdb.HSet(ctx, "active_hash_key", "field", "v").Err()).To(Succeed())
+		Expect(rdb.PExpire(ctx, "active_hash_key", 100*time.Millisecond).Err()).To(Succeed())
+		Expect(rdb.Set(ctx, "active_kept_key", "v", 100*time.Second).Err()).To(Succeed())
+
+		// Nothing reads the keys; the active expire cycle finds them.
+		Eventually(expiredKeys, 5*time.Second, 50*time.Millisecond).Should(BeNumerically(">=", before+2))
+		Expect(rdb.Exists(ctx, "active_string_key", "active_hash_key").Val()).To(Equal(int64(0)))
+		Expect(rdb.Exists(ctx, "active_kept_key").Val()).To(Equal(int64(1)))
+	})
 })
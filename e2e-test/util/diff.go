@@ -0,0 +1,390 @@
+package util
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DiffRedisEnv names the environment variable that turns on differential
+// runs. Set to the host:port of a Redis server, every client NewClient
+// creates talks to the main server through a proxy that sends each request
+// to that Redis as well and compares the two replies: their types, values
+// and error strings. The specs still only see, and assert on, the replies of
+// nimbis. Raw connections to Addr are not compared.
+const DiffRedisEnv = "NIMBIS_DIFF_REDIS"
+
+// DiffReportEnv names the environment variable holding the path of the
+// compatibility report a differential run writes when the main server
+// stops, compat-report.txt by default.
+const DiffReportEnv = "NIMBIS_DIFF_REPORT"
+
+// diffReplyTimeout bounds how long the proxy waits for the reply of Redis
+// once nimbis has replied. A connection Redis does not answer in time is no
+// longer compared, since its replies no longer pair up.
+const diffReplyTimeout = 2 * time.Second
+
+// maxDiffExamples is how many differing replies the report shows for each
+// command.
+const maxDiffExamples = 3
+
+// skippedDiffCommands reply with values that differ between any two
+// servers, such as times, IDs, random picks, cursors and server details.
+var skippedDiffCommands = map[string]bool{
+	"ACL": true, "BGREWRITEAOF": true, "BGSAVE": true, "CLIENT": true,
+	"COMMAND": true, "CONFIG": true, "DEBUG": true, "HELLO": true,
+	"HRANDFIELD": true, "HSCAN": true, "INFO": true, "LASTSAVE": true,
+	"LATENCY": true, "MEMORY": true, "MODULE": true, "NIMBIS": true,
+	"OBJECT": true, "RANDOMKEY": true, "ROLE": true, "SAVE": true,
+	"SCAN": true, "SLOWLOG": true, "SPOP": true, "SRANDMEMBER": true,
+	"SSCAN": true, "TIME": true, "ZRANDMEMBER": true, "ZSCAN": true,
+}
+
+// unorderedDiffCommands reply with arrays in an order each server picks, so
+// their elements are compared as multisets.
+var unorderedDiffCommands = map[string]bool{
+	"HGETALL": true, "HKEYS": true, "HVALS": true, "KEYS": true,
+	"SDIFF": true, "SINTER": true, "SMEMBERS": true, "SUNION": true,
+}
+
+// differ is the proxy of a differential run.
+type differ struct {
+	listener  net.Listener
+	redisAddr string
+
+	mu sync.Mutex
+	// serverAddr is where the server listens, which moves when it is
+	// relaunched on another port.
+	serverAddr string
+	commands   map[string]*commandDiff
+	desynced   int
+}
+
+// commandDiff counts the replies of one command.
+type commandDiff struct {
+	compared int
+	differed int
+	examples []string
+}
+
+// startDiffer starts a differential proxy in front of the server at
+// serverAddr, comparing its replies with those of Redis at redisAddr, which
+// it flushes first so both start out empty. Redis is given a few seconds to
+// come up, as a container just started may need.
+func startDiffer(serverAddr, redisAddr string) (*differ, error) {
+	var redis *RespConn
+	var err error
+	for i := 0; i < 50; i++ {
+		if redis, err = DialResp(redisAddr); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		return nil, err
+	}
+	reply, err := redis.Do("FLUSHALL")
+	_ = redis.Close()
+	if err != nil {
+		return nil, err
+	}
+	if reply.Kind == Error {
+		return nil, RespError(reply.Str)
+	}
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return nil, err
+	}
+	d := &differ{
+		listener:   listener,
+		serverAddr: serverAddr,
+		redisAddr:  redisAddr,
+		commands:   map[string]*commandDiff{},
+	}
+	go d.accept()
+	return d, nil
+}
+
+// Addr returns the host:port clients connect to.
+func (d *differ) Addr() string {
+	return d.listener.Addr().String()
+}
+
+// close stops accepting clients and writes the report.
+func (d *differ) close() error {
+	_ = d.listener.Close()
+	path := os.Getenv(DiffReportEnv)
+	if path == "" {
+		path = "compat-report.txt"
+	}
+	return os.WriteFile(path, []byte(d.report()), 0o644)
+}
+
+func (d *differ) accept() {
+	for {
+		client, err := d.listener.Accept()
+		if err != nil {
+			return
+		}
+		go d.serve(client)
+	}
+}
+
+// setServerAddr points connections made from now on at the server at addr.
+func (d *differ) setServerAddr(addr string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.serverAddr = addr
+}
+
+// serve proxies one client connection.
+func (d *differ) serve(client net.Conn) {
+	defer client.Close()
+	d.mu.Lock()
+	serverAddr := d.serverAddr
+	d.mu.Unlock()
+	server, err := net.Dial("tcp", serverAddr)
+	if err != nil {
+		return
+	}
+	defer server.Close()
+	redis, err := net.Dial("tcp", d.redisAddr)
+	if err != nil {
+		_, _ = io.Copy(server, client)
+		return
+	}
+	defer redis.Close()
+
+	names := make(chan string, 1024)
+	go forwardRequests(client, server, redis, names)
+	d.compareReplies(client, server, redis, names)
+}
+
+// forwardRequests sends each request of client to server and redis, after
+// queueing its command name in names so the reply can be labelled with it.
+// What cannot be parsed as requests is forwarded as it is.
+func forwardRequests(client net.Conn, server, redis net.Conn, names chan<- string) {
+	reader := bufio.NewReader(client)
+	parser := &RespConn{reader: reader}
+	forward := func(data string) error {
+		_, _ = io.WriteString(redis, data)
+		_, err := io.WriteString(server, data)
+		return err
+	}
+	for {
+		first, err := reader.Peek(1)
+		if err != nil {
+			break
+		}
+		var name, data string
+		if Kind(first[0]) == Array {
+			request, err := parser.readReply()
+			if err != nil {
+				break
+			}
+			args := make([]string, len(request.Elems))
+			for i, arg := range request.Elems {
+				args[i] = arg.Str
+			}
+			if len(args) > 0 {
+				name = strings.ToUpper(args[0])
+			}
+			data = EncodeCommand(args...)
+		} else {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				_ = forward(line)
+				break
+			}
+			// Empty inline lines get no reply.
+			if fields := strings.Fields(line); len(fields) > 0 {
+				name = strings.ToUpper(fields[0])
+			}
+			data = line
+		}
+		if name != "" {
+			names <- name
+		}
+		if forward(data) != nil {
+			return
+		}
+	}
+	// Pass on whatever is left untouched, such as a malformed request.
+	_, _ = io.Copy(io.MultiWriter(server, redis), reader)
+	if tcp, ok := server.(*net.TCPConn); ok {
+		_ = tcp.CloseWrite()
+	}
+}
+
+// compareReplies forwards each reply of server to client and compares it
+// with the next reply of redis.
+func (d *differ) compareReplies(client, server, redis net.Conn, names <-chan string) {
+	serverReplies := &RespConn{reader: bufio.NewReader(io.TeeReader(server, client))}
+	redisReplies := make(chan Reply, 1024)
+	go func() {
+		defer close(redisReplies)
+		parser := &RespConn{reader: bufio.NewReader(redis)}
+		for {
+			reply, err := parser.readReply()
+			if err != nil {
+				return
+			}
+			redisReplies <- reply
+		}
+	}()
+
+	synced := true
+	for {
+		reply, err := serverReplies.readReply()
+		if err != nil {
+			return
+		}
+		// Pushes and the messages of RESP2 subscribers answer no request.
+		name := "(push)"
+		if reply.Kind != Push {
+			select {
+			case name = <-names:
+			default:
+			}
+		}
+		if !synced {
+			continue
+		}
+		select {
+		case expected, ok := <-redisReplies:
+			if !ok {
+				synced = false
+				d.desync()
+				continue
+			}
+			d.record(name, reply, expected)
+		case <-time.After(diffReplyTimeout):
+			synced = false
+			d.desync()
+			go func() {
+				for range redisReplies {
+				}
+			}()
+		}
+	}
+}
+
+func (d *differ) desync() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.desynced++
+}
+
+// record compares the reply of nimbis to command name with the one of
+// Redis.
+func (d *differ) record(name string, got, expected Reply) {
+	if skippedDiffCommands[name] {
+		return
+	}
+	if unorderedDiffCommands[name] {
+		got, expected = sortedReply(got), sortedReply(expected)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	stat, ok := d.commands[name]
+	if !ok {
+		stat = &commandDiff{}
+		d.commands[name] = stat
+	}
+	stat.compared++
+	if reflect.DeepEqual(got, expected) {
+		return
+	}
+	stat.differed++
+	if len(stat.examples) < maxDiffExamples {
+		stat.examples = append(stat.examples,
+			fmt.Sprintf("nimbis %s, redis %s", formatReply(got), formatReply(expected)))
+	}
+}
+
+// report renders the counts and examples of every command compared.
+func (d *differ) report() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	names := make([]string, 0, len(d.commands))
+	compared, differed, differing := 0, 0, 0
+	for name, stat := range d.commands {
+		names = append(names, name)
+		compared += stat.compared
+		differed += stat.differed
+		if stat.differed > 0 {
+			differing++
+		}
+	}
+	sort.Strings(names)
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "Compatibility report: nimbis against Redis at %s\n", d.redisAddr)
+	fmt.Fprintf(&out, "%d replies of %d commands compared, %d differ, from %d commands.\n",
+		compared, len(names), differed, differing)
+	if d.desynced > 0 {
+		fmt.Fprintf(&out, "%d connections stopped being compared when Redis did not answer in step.\n", d.desynced)
+	}
+	fmt.Fprintf(&out, "\n%-24s %8s %8s\n", "COMMAND", "COMPARED", "DIFFER")
+	for _, name := range names {
+		stat := d.commands[name]
+		fmt.Fprintf(&out, "%-24s %8d %8d\n", name, stat.compared, stat.differed)
+	}
+	for _, name := range names {
+		stat := d.commands[name]
+		if stat.differed == 0 {
+			continue
+		}
+		fmt.Fprintf(&out, "\n%s\n", name)
+		for _, example := range stat.examples {
+			fmt.Fprintf(&out, "  %s\n", example)
+		}
+	}
+	return out.String()
+}
+
+// sortedReply returns reply with the elements of an aggregate sorted.
+func sortedReply(reply Reply) Reply {
+	if len(reply.Elems) == 0 {
+		return reply
+	}
+	elems := append([]Reply(nil), reply.Elems...)
+	sort.Slice(elems, func(i, j int) bool {
+		return formatReply(elems[i]) < formatReply(elems[j])
+	})
+	reply.Elems = elems
+	return reply
+}
+
+// formatReply renders reply on one line, marked with its type.
+func formatReply(reply Reply) string {
+	if reply.Null {
+		return "(nil)"
+	}
+	switch reply.Kind {
+	case SimpleString, Error, BulkError, BigNumber:
+		return string(reply.Kind) + reply.Str
+	case Integer:
+		return ":" + strconv.FormatInt(reply.Int, 10)
+	case Double:
+		return "," + strconv.FormatFloat(reply.Float, 'g', -1, 64)
+	case Boolean:
+		return "#" + strconv.FormatBool(reply.Bool)
+	case Array, Set, Push, Map, Attribute:
+		elems := make([]string, len(reply.Elems))
+		for i, elem := range reply.Elems {
+			elems[i] = formatReply(elem)
+		}
+		return string(reply.Kind) + "[" + strings.Join(elems, " ") + "]"
+	default:
+		return strconv.Quote(reply.Str)
+	}
+}
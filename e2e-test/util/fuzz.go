@@ -0,0 +1,180 @@
+package util
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FuzzCorpusDir is where reproducers of frames that broke the server are
+// saved, in the corpus format of go test fuzzing, so that
+//
+//	go test -run FuzzProtocol/<name>
+//
+// replays one against a fresh server.
+const FuzzCorpusDir = "testdata/fuzz/FuzzProtocol"
+
+// FuzzReadTimeout is how long SendFrame reads what the server answers to a
+// frame before giving up on the rest, since a truncated frame is rightly
+// never answered.
+const FuzzReadTimeout = 20 * time.Millisecond
+
+// fuzzCommands are the requests frames are made from. They stick to keys of
+// their own and leave out commands that stop, flush or reconfigure the
+// server, so fuzzing can run next to the other specs.
+var fuzzCommands = [][]string{
+	{"PING"},
+	{"PING", "hello"},
+	{"SET", "fuzz:string", "value"},
+	{"GET", "fuzz:string"},
+	{"APPEND", "fuzz:string", "tail"},
+	{"INCR", "fuzz:counter"},
+	{"HSET", "fuzz:hash", "a", "1", "b", "2"},
+	{"HMGET", "fuzz:hash", "a", "b", "missing"},
+	{"HSET", "fuzz:hash", "field", "value"},
+	{"HGETALL", "fuzz:hash"},
+	{"LPUSH", "fuzz:list", "a", "b", "c"},
+	{"LRANGE", "fuzz:list", "0", "-1"},
+	{"SADD", "fuzz:set", "a", "b"},
+	{"ZADD", "fuzz:zset", "1.5", "a"},
+	{"ZRANGE", "fuzz:zset", "0", "-1", "WITHSCORES"},
+	{"EXPIRE", "fuzz:string", "100"},
+	{"TTL", "fuzz:string"},
+	{"DEL", "fuzz:string", "fuzz:counter"},
+	{"EXISTS", "fuzz:hash"},
+	{"LLEN", "fuzz:list"},
+	{"MULTI"},
+	{"EXEC"},
+	{"DISCARD"},
+	{"HELLO", "3"},
+	{"HELLO", "2"},
+	{"SUBSCRIBE", "fuzz:channel"},
+	{"UNSUBSCRIBE"},
+}
+
+// fuzzNumbers replace lengths and counts in frames, to reach the edges of
+// the parser.
+var fuzzNumbers = []string{
+	"-1", "-2", "0", "1", "2147483647", "2147483648", "9223372036854775807",
+	"99999999999999999999", "-9223372036854775808", "1e3", "abc", "", " 1", "+1",
+}
+
+// RandomFrame returns the bytes of one or more requests from rng, most of
+// them broken: truncated multibulks, lying lengths, flipped bytes and inline
+// garbage, next to some well formed ones.
+func RandomFrame(rng *rand.Rand) []byte {
+	switch rng.IntN(6) {
+	case 0:
+		return []byte(randomRequests(rng))
+	case 1:
+		frame := randomRequests(rng)
+		return []byte(frame[:rng.IntN(len(frame))])
+	case 2:
+		return []byte(lieAboutLengths(rng, randomRequests(rng)))
+	case 3:
+		return randomGarbage(rng)
+	default:
+		return mutate(rng, []byte(randomRequests(rng)))
+	}
+}
+
+// randomRequests encodes a few requests of fuzzCommands, each either as a
+// multibulk or inline.
+func randomRequests(rng *rand.Rand) string {
+	var frame strings.Builder
+	for range 1 + rng.IntN(3) {
+		args := fuzzCommands[rng.IntN(len(fuzzCommands))]
+		if rng.IntN(4) == 0 {
+			frame.WriteString(strings.Join(args, " ") + "\r\n")
+		} else {
+			frame.WriteString(EncodeCommand(args...))
+		}
+	}
+	return frame.String()
+}
+
+// lieAboutLengths replaces the number after some '*' and '$' markers.
+func lieAboutLengths(rng *rand.Rand, frame string) string {
+	lines := strings.Split(frame, "\r\n")
+	for i, line := range lines {
+		if line == "" || (line[0] != '*' && line[0] != '$') || rng.IntN(3) != 0 {
+			continue
+		}
+		lines[i] = line[:1] + fuzzNumbers[rng.IntN(len(fuzzNumbers))]
+	}
+	return strings.Join(lines, "\r\n")
+}
+
+// randomGarbage returns random bytes, often starting with a RESP marker and
+// ending in a line break so the server parses them as a request.
+func randomGarbage(rng *rand.Rand) []byte {
+	garbage := make([]byte, rng.IntN(64))
+	for i := range garbage {
+		garbage[i] = byte(rng.IntN(256))
+	}
+	if rng.IntN(2) == 0 {
+		markers := "*$+-:_#,(!=%|~>"
+		garbage = append([]byte{markers[rng.IntN(len(markers))]}, garbage...)
+	}
+	if rng.IntN(2) == 0 {
+		garbage = append(garbage, '\r', '\n')
+	}
+	return garbage
+}
+
+// mutate flips, inserts, deletes or duplicates a few bytes of frame.
+func mutate(rng *rand.Rand, frame []byte) []byte {
+	for range 1 + rng.IntN(4) {
+		if len(frame) == 0 {
+			break
+		}
+		i := rng.IntN(len(frame))
+		switch rng.IntN(4) {
+		case 0:
+			frame[i] ^= byte(1 << rng.IntN(8))
+		case 1:
+			frame = append(frame[:i], append([]byte{byte(rng.IntN(256))}, frame[i:]...)...)
+		case 2:
+			frame = append(frame[:i], frame[i+1:]...)
+		default:
+			end := i + rng.IntN(len(frame)-i) + 1
+			frame = append(frame[:end:end], append(append([]byte(nil), frame[i:end]...), frame[end:]...)...)
+		}
+	}
+	return frame
+}
+
+// SendFrame sends frame to the server at addr on a connection of its own,
+// reads what the server answers for up to FuzzReadTimeout, and closes the
+// connection. It fails only if the server cannot be connected to, since any
+// reply, an error, or the server closing the connection even before the
+// whole frame is written, are all fair answers to a broken frame.
+func SendFrame(addr string, frame []byte) error {
+	conn, err := DialResp(addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_ = conn.WriteRaw(string(frame))
+	conn.SetTimeout(FuzzReadTimeout)
+	_, _ = conn.Drain()
+	return nil
+}
+
+// SaveFuzzReproducer writes frame to FuzzCorpusDir, named after its hash,
+// and returns the path.
+func SaveFuzzReproducer(frame []byte) (string, error) {
+	if err := os.MkdirAll(FuzzCorpusDir, 0o755); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(frame)
+	path := filepath.Join(FuzzCorpusDir, hex.EncodeToString(sum[:8]))
+	data := fmt.Sprintf("go test fuzz v1\n[]byte(%s)\n", strconv.Quote(string(frame)))
+	return path, os.WriteFile(path, []byte(data), 0o644)
+}
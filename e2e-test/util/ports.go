@@ -0,0 +1,35 @@
+package util
+
+import (
+	"net"
+	"sync"
+)
+
+var (
+	portsMu sync.Mutex
+	// handedOut holds the ports FreePort returned, which it never returns
+	// again, since a server may not listen on them yet.
+	handedOut = map[int]bool{}
+)
+
+// FreePort returns a TCP port nothing listens on, for a server to be started
+// on. The kernel picks it, so test processes running in parallel get
+// different ones.
+func FreePort() (int, error) {
+	portsMu.Lock()
+	defer portsMu.Unlock()
+	for {
+		listener, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			return 0, err
+		}
+		port := listener.Addr().(*net.TCPAddr).Port
+		if err := listener.Close(); err != nil {
+			return 0, err
+		}
+		if !handedOut[port] {
+			handedOut[port] = true
+			return port, nil
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// SyncTimeout bounds how long the replication helpers wait for a replica.
+const SyncTimeout = 10 * time.Second
+
+const pollInterval = 50 * time.Millisecond
+
+// StartReplicaOf makes the server replica is connected to replicate from
+// primaryAddr, given as host:port, and waits until its link is up.
+func StartReplicaOf(replica *redis.Client, primaryAddr string) error {
+	host, port, err := net.SplitHostPort(primaryAddr)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	if err := replica.Do(ctx, "REPLICAOF", host, port).Err(); err != nil {
+		return err
+	}
+	return poll(func() (bool, error) {
+		status, err := InfoField(replica, "replication", "master_link_status")
+		return status == "up", err
+	}, "replica link to %s did not come up", primaryAddr)
+}
+
+// StopReplicating makes the server replica is connected to a primary again,
+// keeping its dataset.
+func StopReplicating(replica *redis.Client) error {
+	return replica.Do(context.Background(), "REPLICAOF", "NO", "ONE").Err()
+}
+
+// WaitForSyncOffset waits until replica has applied every write primary
+// streamed before the call, so reads on the replica see them.
+func WaitForSyncOffset(primary, replica *redis.Client) error {
+	target, err := infoOffset(primary, "master_repl_offset")
+	if err != nil {
+		return err
+	}
+	return poll(func() (bool, error) {
+		offset, err := infoOffset(replica, "slave_repl_offset")
+		return offset >= target, err
+	}, "replica did not reach offset %d", target)
+}
+
+// ReplicaGet waits until replica has caught up with primary, then reads key
+// from the replica.
+func ReplicaGet(primary, replica *redis.Client, key string) (string, error) {
+	if err := WaitForSyncOffset(primary, replica); err != nil {
+		return "", err
+	}
+	return replica.Get(context.Background(), key).Result()
+}
+
+// InfoField returns the value of field in the INFO section of client, or ""
+// if the section does not have it.
+func InfoField(client *redis.Client, section, field string) (string, error) {
+	info, err := client.Info(context.Background(), section).Result()
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(info, "\r\n") {
+		if value, ok := strings.CutPrefix(line, field+":"); ok {
+			return value, nil
+		}
+	}
+	return "", nil
+}
+
+func infoOffset(client *redis.Client, field string) (int64, error) {
+	value, err := InfoField(client, "replication", field)
+	if err != nil {
+		return 0, err
+	}
+	if value == "" {
+		return 0, fmt.Errorf("INFO replication has no %s", field)
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+// poll calls done until it reports true or fails, for up to SyncTimeout.
+func poll(done func() (bool, error), format string, args ...any) error {
+	deadline := time.Now().Add(SyncTimeout)
+	for {
+		ok, err := done()
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf(format, args...)
+		}
+		time.Sleep(pollInterval)
+	}
+}
@@ -0,0 +1,272 @@
+package util
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RespTimeout is how long each read or write on a RespConn may take, unless
+// changed with SetTimeout.
+const RespTimeout = 5 * time.Second
+
+// Kind is the type marker a RESP2 or RESP3 reply starts with.
+type Kind byte
+
+const (
+	SimpleString   Kind = '+'
+	Error          Kind = '-'
+	Integer        Kind = ':'
+	BulkString     Kind = '$'
+	Array          Kind = '*'
+	Null           Kind = '_'
+	Boolean        Kind = '#'
+	Double         Kind = ','
+	BigNumber      Kind = '('
+	BulkError      Kind = '!'
+	VerbatimString Kind = '='
+	Map            Kind = '%'
+	Attribute      Kind = '|'
+	Set            Kind = '~'
+	Push           Kind = '>'
+)
+
+// Reply is one parsed reply.
+type Reply struct {
+	Kind Kind
+	// Str holds simple strings, errors, bulk strings, big numbers, and
+	// verbatim strings with their format prefix, such as "txt:".
+	Str   string
+	Int   int64
+	Float float64
+	Bool  bool
+	// Elems holds the elements of arrays, sets and pushes, and the keys and
+	// values of maps and attributes in turn.
+	Elems []Reply
+	// Null is set for the RESP3 null and for the RESP2 null bulk string and
+	// null array.
+	Null bool
+}
+
+// RespError is the message of an error reply, as Reply.Value returns it.
+type RespError string
+
+func (e RespError) Error() string {
+	return string(e)
+}
+
+// Value returns the reply as a plain Go value, for comparing with Equal:
+// strings, RespError, int64, float64, bool, nil, and []interface{} for
+// aggregates, with maps flattened to their keys and values in turn.
+func (r Reply) Value() interface{} {
+	if r.Null {
+		return nil
+	}
+	switch r.Kind {
+	case Error, BulkError:
+		return RespError(r.Str)
+	case Integer:
+		return r.Int
+	case Double:
+		return r.Float
+	case Boolean:
+		return r.Bool
+	case Array, Set, Push, Map, Attribute:
+		values := make([]interface{}, len(r.Elems))
+		for i, elem := range r.Elems {
+			values[i] = elem.Value()
+		}
+		return values
+	default:
+		return r.Str
+	}
+}
+
+// RespConn is a bare connection to a server, for specs of the protocol
+// itself and of replies go-redis hides, such as pushes: it writes requests
+// byte for byte and parses replies without interpreting them.
+type RespConn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+}
+
+// DialResp connects to the server at addr, given as host:port.
+func DialResp(addr string) (*RespConn, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &RespConn{conn: conn, reader: bufio.NewReader(conn), timeout: RespTimeout}, nil
+}
+
+// Close closes the connection.
+func (c *RespConn) Close() error {
+	return c.conn.Close()
+}
+
+// SetTimeout sets how long each read or write may take from now on.
+func (c *RespConn) SetTimeout(timeout time.Duration) {
+	c.timeout = timeout
+}
+
+// WriteRaw writes data as it is, which may be inline commands, several
+// requests, or part of one.
+func (c *RespConn) WriteRaw(data string) error {
+	if err := c.deadline(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(c.conn, data)
+	return err
+}
+
+// Send writes a request of args as a RESP array of bulk strings.
+func (c *RespConn) Send(args ...string) error {
+	return c.WriteRaw(EncodeCommand(args...))
+}
+
+// Do sends a request of args and reads its reply.
+func (c *RespConn) Do(args ...string) (Reply, error) {
+	if err := c.Send(args...); err != nil {
+		return Reply{}, err
+	}
+	return c.ReadReply()
+}
+
+// ReadReply reads one reply. It returns io.EOF once the server has closed
+// the connection.
+func (c *RespConn) ReadReply() (Reply, error) {
+	if err := c.deadline(); err != nil {
+		return Reply{}, err
+	}
+	return c.readReply()
+}
+
+// ReadLine reads up to and including the next "\r\n", for specs that check
+// the exact bytes of a reply.
+func (c *RespConn) ReadLine() (string, error) {
+	if err := c.deadline(); err != nil {
+		return "", err
+	}
+	return c.reader.ReadString('\n')
+}
+
+// Drain reads and discards everything until the server closes the
+// connection, returning how many bytes it read, for specs that the server
+// cuts a reply short.
+func (c *RespConn) Drain() (int64, error) {
+	if err := c.deadline(); err != nil {
+		return 0, err
+	}
+	return io.Copy(io.Discard, c.reader)
+}
+
+// Silent waits for d and returns an error if the server sent anything
+// meanwhile, for specs that a partial request must not be answered.
+func (c *RespConn) Silent(d time.Duration) error {
+	if err := c.conn.SetReadDeadline(time.Now().Add(d)); err != nil {
+		return err
+	}
+	_, err := c.reader.Peek(1)
+	switch {
+	case err == nil:
+		return fmt.Errorf("server replied within %s", d)
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return nil
+	default:
+		return err
+	}
+}
+
+// deadline gives the next read or write the timeout of the connection.
+func (c *RespConn) deadline() error {
+	return c.conn.SetDeadline(time.Now().Add(c.timeout))
+}
+
+func (c *RespConn) readReply() (Reply, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return Reply{}, err
+	}
+	line, ok := strings.CutSuffix(line, "\r\n")
+	if !ok || line == "" {
+		return Reply{}, fmt.Errorf("malformed reply line %q", line)
+	}
+	reply := Reply{Kind: Kind(line[0])}
+	rest := line[1:]
+	switch reply.Kind {
+	case SimpleString, Error, BigNumber:
+		reply.Str = rest
+	case Integer:
+		reply.Int, err = strconv.ParseInt(rest, 10, 64)
+	case Null:
+		reply.Null = true
+	case Boolean:
+		if rest != "t" && rest != "f" {
+			return Reply{}, fmt.Errorf("malformed boolean %q", line)
+		}
+		reply.Bool = rest == "t"
+	case Double:
+		reply.Float, err = strconv.ParseFloat(rest, 64)
+	case BulkString, BulkError, VerbatimString:
+		var n int
+		if n, err = strconv.Atoi(rest); err != nil {
+			break
+		}
+		if n < 0 {
+			reply.Null = true
+			break
+		}
+		buf := make([]byte, n+2)
+		if _, err = io.ReadFull(c.reader, buf); err != nil {
+			break
+		}
+		if string(buf[n:]) != "\r\n" {
+			return Reply{}, fmt.Errorf("bulk reply of %d bytes not ended by CRLF", n)
+		}
+		reply.Str = string(buf[:n])
+	case Array, Set, Push, Map, Attribute:
+		var n int
+		if n, err = strconv.Atoi(rest); err != nil {
+			break
+		}
+		if n < 0 {
+			reply.Null = true
+			break
+		}
+		if reply.Kind == Map || reply.Kind == Attribute {
+			n *= 2
+		}
+		reply.Elems = make([]Reply, 0, n)
+		for i := 0; i < n; i++ {
+			elem, err := c.readReply()
+			if err != nil {
+				return Reply{}, err
+			}
+			reply.Elems = append(reply.Elems, elem)
+		}
+	default:
+		return Reply{}, fmt.Errorf("unexpected reply %q", line)
+	}
+	if err != nil {
+		return Reply{}, fmt.Errorf("malformed reply %q: %w", line, err)
+	}
+	return reply, nil
+}
+
+// EncodeCommand encodes args as a RESP array of bulk strings, the way
+// clients send requests.
+func EncodeCommand(args ...string) string {
+	var cmd strings.Builder
+	fmt.Fprintf(&cmd, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&cmd, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return cmd.String()
+}
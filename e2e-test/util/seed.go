@@ -0,0 +1,262 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// The types Seed can write keys of.
+const (
+	SeedString = "string"
+	SeedHash   = "hash"
+	SeedList   = "list"
+	SeedSet    = "set"
+	SeedZSet   = "zset"
+)
+
+// seedBatch is how many commands Seed pipelines per round trip.
+const seedBatch = 1000
+
+// SeedOptions describes the dataset Seed writes. Zero fields take the
+// defaults given.
+type SeedOptions struct {
+	// Prefix starts every key, "seed" by default. Keys are named
+	// <prefix>:<type>:<n>.
+	Prefix string
+	// Keys is how many keys of each type to write, 100 by default.
+	Keys int
+	// Types are the types to write keys of, every one by default.
+	Types []string
+	// ValueSize is the bytes of each string, field value, element and
+	// member, 16 by default.
+	ValueSize int
+	// Elements is how many fields or elements each collection holds, 8 by
+	// default.
+	Elements int
+	// TTLRatio is the share of keys given a TTL, none by default.
+	TTLRatio float64
+	// MinTTL and MaxTTL bound the TTLs, which are spread evenly between
+	// them, one and two hours by default so no key expires during a spec.
+	MinTTL, MaxTTL time.Duration
+	// Seed seeds the generator, so the same options write the same dataset.
+	Seed uint64
+}
+
+func (o SeedOptions) withDefaults() SeedOptions {
+	if o.Prefix == "" {
+		o.Prefix = "seed"
+	}
+	if o.Keys == 0 {
+		o.Keys = 100
+	}
+	if len(o.Types) == 0 {
+		o.Types = []string{SeedString, SeedHash, SeedList, SeedSet, SeedZSet}
+	}
+	if o.ValueSize == 0 {
+		o.ValueSize = 16
+	}
+	if o.Elements == 0 {
+		o.Elements = 8
+	}
+	if o.MinTTL == 0 && o.MaxTTL == 0 {
+		o.MinTTL, o.MaxTTL = time.Hour, 2*time.Hour
+	}
+	return o
+}
+
+// SeededKey is one key Seed wrote.
+type SeededKey struct {
+	Type string
+	// Values holds the value of a string, the fields and values of a hash
+	// in turn, the elements of a list in order, the members of a set, or
+	// the members of a sorted set by score, member n scored n.
+	Values []string
+	// TTL is the TTL the key was given, 0 if none.
+	TTL time.Duration
+}
+
+// Dataset is what Seed wrote, for specs to check against.
+type Dataset struct {
+	Keys map[string]SeededKey
+}
+
+// Names returns the names of the keys, sorted.
+func (d *Dataset) Names() []string {
+	return slices.Sorted(maps.Keys(d.Keys))
+}
+
+// OfType returns the names of the keys of type kind, sorted.
+func (d *Dataset) OfType(kind string) []string {
+	var names []string
+	for _, name := range d.Names() {
+		if d.Keys[name].Type == kind {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Expiring returns the names of the keys given a TTL, sorted.
+func (d *Dataset) Expiring() []string {
+	var names []string
+	for _, name := range d.Names() {
+		if d.Keys[name].TTL > 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Seed writes a dataset of opts.Keys keys of each of opts.Types through
+// client, in pipelined batches, and returns what it wrote. Keys it writes
+// replace any of the same names.
+func Seed(ctx context.Context, client *redis.Client, opts SeedOptions) (*Dataset, error) {
+	opts = opts.withDefaults()
+	rng := rand.New(rand.NewPCG(opts.Seed, 0))
+	random := func() string {
+		value := make([]byte, opts.ValueSize)
+		for i := range value {
+			value[i] = byte('a' + rng.IntN(26))
+		}
+		return string(value)
+	}
+
+	dataset := &Dataset{Keys: map[string]SeededKey{}}
+	pipe := client.Pipeline()
+	flush := func() error {
+		if pipe.Len() == 0 {
+			return nil
+		}
+		_, err := pipe.Exec(ctx)
+		return err
+	}
+	for _, kind := range opts.Types {
+		for n := range opts.Keys {
+			name := fmt.Sprintf("%s:%s:%d", opts.Prefix, kind, n)
+			key := SeededKey{Type: kind}
+			pipe.Del(ctx, name)
+			switch kind {
+			case SeedString:
+				key.Values = []string{random()}
+				pipe.Set(ctx, name, key.Values[0], 0)
+			case SeedHash:
+				for i := range opts.Elements {
+					key.Values = append(key.Values, fmt.Sprintf("field:%d", i), random())
+				}
+				pipe.HSet(ctx, name, toArgs(key.Values)...)
+			case SeedList:
+				for range opts.Elements {
+					key.Values = append(key.Values, random())
+				}
+				pipe.RPush(ctx, name, toArgs(key.Values)...)
+			case SeedSet:
+				// The index keeps members distinct.
+				for i := range opts.Elements {
+					key.Values = append(key.Values, strconv.Itoa(i)+":"+random())
+				}
+				pipe.SAdd(ctx, name, toArgs(key.Values)...)
+			case SeedZSet:
+				members := make([]redis.Z, opts.Elements)
+				for i := range members {
+					key.Values = append(key.Values, strconv.Itoa(i)+":"+random())
+					members[i] = redis.Z{Score: float64(i), Member: key.Values[i]}
+				}
+				pipe.ZAdd(ctx, name, members...)
+			default:
+				return nil, fmt.Errorf("cannot seed keys of type %q", kind)
+			}
+			if rng.Float64() < opts.TTLRatio {
+				spread := opts.MaxTTL - opts.MinTTL
+				key.TTL = opts.MinTTL
+				if spread > 0 {
+					key.TTL += time.Duration(rng.Int64N(int64(spread)))
+				}
+				pipe.PExpireAt(ctx, name, time.Now().Add(key.TTL))
+			}
+			dataset.Keys[name] = key
+			if pipe.Len() >= seedBatch {
+				if err := flush(); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return dataset, nil
+}
+
+// Verify checks through client that every key of the dataset still holds
+// what Seed wrote, and has a TTL no longer than it was given if it was
+// given one and none otherwise. It returns the first difference found; a
+// key of another type fails with WRONGTYPE.
+func (d *Dataset) Verify(ctx context.Context, client *redis.Client) error {
+	for _, name := range d.Names() {
+		key := d.Keys[name]
+		var got []string
+		var err error
+		want := key.Values
+		switch key.Type {
+		case SeedString:
+			var value string
+			value, err = client.Get(ctx, name).Result()
+			got = []string{value}
+		case SeedHash:
+			var fields map[string]string
+			fields, err = client.HGetAll(ctx, name).Result()
+			for field, value := range fields {
+				got = append(got, field+"="+value)
+			}
+			want = nil
+			for i := 0; i < len(key.Values); i += 2 {
+				want = append(want, key.Values[i]+"="+key.Values[i+1])
+			}
+			sort.Strings(got)
+			sort.Strings(want)
+		case SeedList:
+			got, err = client.LRange(ctx, name, 0, -1).Result()
+		case SeedSet:
+			got, err = client.SMembers(ctx, name).Result()
+			sort.Strings(got)
+			want = slices.Sorted(slices.Values(want))
+		case SeedZSet:
+			got, err = client.ZRange(ctx, name, 0, -1).Result()
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if !slices.Equal(got, want) {
+			return fmt.Errorf("%s holds %q, not %q", name, got, want)
+		}
+
+		// TTL rounds to seconds.
+		ttl, err := client.TTL(ctx, name).Result()
+		if err != nil {
+			return err
+		}
+		switch {
+		case key.TTL == 0 && ttl >= 0:
+			return fmt.Errorf("%s has a TTL of %s, but was given none", name, ttl)
+		case key.TTL > 0 && (ttl <= 0 || ttl > key.TTL+time.Second):
+			return fmt.Errorf("%s has a TTL of %s, but was given %s", name, ttl, key.TTL)
+		}
+	}
+	return nil
+}
+
+func toArgs(values []string) []interface{} {
+	args := make([]interface{}, len(values))
+	for i, value := range values {
+		args[i] = value
+	}
+	return args
+}
@@ -2,17 +2,55 @@ package util
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
-var serverCmd *exec.Cmd
+// AddrEnv names the environment variable that points the suite at a
+// server it does not manage, given as host:port, such as a container or a
+// staging deployment. The suite then starts no main server of its own.
+const AddrEnv = "NIMBIS_ADDR"
+
+// SkipStartEnv names the environment variable that, set to true, keeps the
+// suite from starting the main server and has it use the one at AddrEnv, or
+// at localhost:6379 if that is unset.
+const SkipStartEnv = "NIMBIS_SKIP_START"
+
+// BinaryEnv names the environment variable that points the suite at a
+// nimbis binary other than target/release/nimbis, such as a build of an
+// earlier commit to compare benchmarks with.
+const BinaryEnv = "NIMBIS_BINARY"
+
+// ShutdownTimeout bounds how long a graceful restart waits for the server
+// to exit.
+const ShutdownTimeout = 10 * time.Second
+
+// The servers the suite shares: the main one every spec talks to by
+// default, and the ones StartReplicaServer, StartSubReplicaServer and
+// StartServerWithConfig start. Each listens on a port of its own from
+// FreePort and keeps its object store in a temporary directory, so parallel
+// test processes never share a server.
+var (
+	mainServer    *Server
+	replicaServer *Server
+	subReplica    *Server
+	configServer  *Server
+)
+
+// mainDiffer is the proxy the clients of the main server go through in a
+// differential run, when DiffRedisEnv is set.
+var mainDiffer *differ
 
 // findProjectRoot searches upward from the current directory
 // to find the project root (identified by Cargo.toml)
@@ -38,8 +76,16 @@ func findProjectRoot() (string, error) {
 	}
 }
 
-// findBinary locates the nimbis binary in target/release/nimbis
+// findBinary locates the nimbis binary BinaryEnv names, or else the one in
+// target/release/nimbis
 func findBinary() (string, error) {
+	if binPath := os.Getenv(BinaryEnv); binPath != "" {
+		if _, err := os.Stat(binPath); err != nil {
+			return "", fmt.Errorf("%s names no binary: %w", BinaryEnv, err)
+		}
+		return binPath, nil
+	}
+
 	// Find project root and construct binary path
 	projectRoot, err := findProjectRoot()
 	if err != nil {
@@ -59,69 +105,444 @@ func findBinary() (string, error) {
 	return binPath, nil
 }
 
-// StartServer starts the nimbis server on the specified port.
-// It assumes the binary is located at ../../target/release/nimbis
+// External reports whether the main server is one the suite does not
+// manage, as AddrEnv or SkipStartEnv ask. Specs that start servers of their
+// own, or restart the main one, cannot run against it.
+func External() bool {
+	skip, _ := strconv.ParseBool(os.Getenv(SkipStartEnv))
+	return skip || os.Getenv(AddrEnv) != ""
+}
+
+// StartServer starts the main server on a free port, with an empty object
+// store, or in External mode waits until the server it was pointed at
+// answers PING. If DiffRedisEnv is set, it also flushes that Redis and
+// starts the proxy that compares their replies.
 func StartServer() error {
-	// Find the binary using environment variable or project root detection
-	binPath, err := findBinary()
+	var server *Server
+	var err error
+	if External() {
+		server, err = connectServer()
+	} else {
+		server, err = StartServerWithOptions(0, nil, "")
+	}
 	if err != nil {
 		return err
 	}
+	mainServer = server
+	if redisAddr := os.Getenv(DiffRedisEnv); redisAddr != "" {
+		if mainDiffer, err = startDiffer(server.Addr(), redisAddr); err != nil {
+			stopServer(&mainServer)
+			return fmt.Errorf("failed to start the differential proxy: %w", err)
+		}
+	}
+	return nil
+}
 
-	// Get project root for setting working directory
-	projectRoot, err := findProjectRoot()
+// connectServer returns a handle on the server External mode points at.
+func connectServer() (*Server, error) {
+	addr := os.Getenv(AddrEnv)
+	if addr == "" {
+		addr = "localhost:6379"
+	}
+	host, port, err := net.SplitHostPort(addr)
 	if err != nil {
-		return fmt.Errorf("failed to find project root: %w", err)
+		return nil, fmt.Errorf("%s must be host:port: %w", AddrEnv, err)
+	}
+	server := &Server{host: host, external: true}
+	if server.port, err = strconv.Atoi(port); err != nil {
+		return nil, fmt.Errorf("%s must be host:port: %w", AddrEnv, err)
 	}
+	if err := server.waitReady(); err != nil {
+		return nil, fmt.Errorf("no server answers at %s: %w", addr, err)
+	}
+	return server, nil
+}
 
-	// Clean up the default file-backed object store path.
-	dataPath := filepath.Join(projectRoot, "nimbis_store")
-	_ = os.RemoveAll(dataPath)
+// RestartServer shuts the main server down gracefully and starts it again
+// on the same port and object store, so tests can check what survives a
+// restart.
+func RestartServer() error {
+	return mainServer.Restart()
+}
 
-	serverCmd = exec.Command(binPath)
-	serverCmd.Dir = projectRoot // Resolve relative object_store_url values from the project root.
-	// Redirect stdout/stderr for debugging
-	serverCmd.Stdout = os.Stdout
-	serverCmd.Stderr = os.Stderr
+// CrashServer kills the main server with SIGKILL and starts it again on the
+// same port and object store, so tests can check what survives a crash.
+func CrashServer() error {
+	return mainServer.Crash()
+}
 
-	if err := serverCmd.Start(); err != nil {
-		return fmt.Errorf("failed to start server: %w", err)
-	}
+// HaltServer shuts the main server down gracefully but keeps its object
+// store, so tests can check what happens while no server runs, such as
+// keys expiring. RelaunchServer starts it again.
+func HaltServer() error {
+	return mainServer.Halt()
+}
 
-	// Wait for server to be ready
-	addr := "localhost:6379"
-	client := redis.NewClient(&redis.Options{
-		Addr: addr,
-	})
-	defer client.Close()
+// RelaunchServer starts the main server HaltServer stopped again, on a new
+// port from FreePort since the old one may have been taken in the meantime,
+// and points clients NewClient creates from now on at it.
+func RelaunchServer() error {
+	if err := mainServer.Relaunch(); err != nil {
+		return err
+	}
+	if mainDiffer != nil {
+		mainDiffer.setServerAddr(mainServer.Addr())
+	}
+	return nil
+}
 
-	ctx := context.Background()
-	for i := 0; i < 20; i++ {
-		err := client.Ping(ctx).Err()
-		if err == nil {
-			return nil // Server is ready
+// StopServer kills the main server and removes its object store. In a
+// differential run it first writes the compatibility report.
+func StopServer() {
+	if mainDiffer != nil {
+		if err := mainDiffer.close(); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to write the compatibility report: %v\n", err)
 		}
-		fmt.Printf("Tick %d: Ping failed: %v\n", i, err)
-		time.Sleep(100 * time.Millisecond)
+		mainDiffer = nil
 	}
+	stopServer(&mainServer)
+}
 
-	_ = serverCmd.Process.Kill()
-	serverCmd = nil
-	return fmt.Errorf("server failed to start on %s", addr)
+// Port returns the port of the main server.
+func Port() int {
+	return mainServer.port
 }
 
-// StopServer kills the server process.
-func StopServer() {
-	if serverCmd != nil && serverCmd.Process != nil {
-		_ = serverCmd.Process.Kill()
-		_ = serverCmd.Wait()
-		serverCmd = nil
-	}
+// Addr returns the host:port of the main server.
+func Addr() string {
+	return mainServer.Addr()
 }
 
-// NewClient creates a new Redis client connected to the local server.
+// NewClient creates a new Redis client connected to the main server, or to
+// the proxy in front of it in a differential run.
 func NewClient() *redis.Client {
+	if mainDiffer != nil {
+		return redis.NewClient(&redis.Options{Addr: mainDiffer.Addr()})
+	}
+	return mainServer.NewClient()
+}
+
+// StartReplicaServer starts a second server, with an object store of its
+// own, for tests that need two servers such as replication.
+func StartReplicaServer() error {
+	return startServer(&replicaServer)
+}
+
+// StopReplicaServer kills the server StartReplicaServer started.
+func StopReplicaServer() {
+	stopServer(&replicaServer)
+}
+
+// ReplicaPort returns the port of the server StartReplicaServer started.
+func ReplicaPort() int {
+	return replicaServer.port
+}
+
+// ReplicaAddr returns the host:port of the server StartReplicaServer
+// started.
+func ReplicaAddr() string {
+	return replicaServer.Addr()
+}
+
+// NewReplicaClient creates a Redis client connected to the replica server.
+func NewReplicaClient() *redis.Client {
+	return replicaServer.NewClient()
+}
+
+// StartSubReplicaServer starts a third server, with an object store of its
+// own, for tests that chain replicas.
+func StartSubReplicaServer() error {
+	return startServer(&subReplica)
+}
+
+// StopSubReplicaServer kills the server StartSubReplicaServer started.
+func StopSubReplicaServer() {
+	stopServer(&subReplica)
+}
+
+// NewSubReplicaClient creates a Redis client connected to the sub-replica
+// server.
+func NewSubReplicaClient() *redis.Client {
+	return subReplica.NewClient()
+}
+
+// StartServerWithConfig starts a server from the configuration file at
+// config, for tests of settings that can only be made at startup. The port
+// and object store of the harness override those of the file.
+func StartServerWithConfig(config string) error {
+	return startServer(&configServer, "--config", config)
+}
+
+// StopServerWithConfig kills the server StartServerWithConfig started.
+func StopServerWithConfig() {
+	stopServer(&configServer)
+}
+
+// ConfigServerPort returns the port of the server StartServerWithConfig
+// started.
+func ConfigServerPort() int {
+	return configServer.port
+}
+
+// ConfigServerDataDir returns the directory holding the object store of the
+// server StartServerWithConfig started.
+func ConfigServerDataDir() string {
+	return configServer.dataDir
+}
+
+// NewConfigServerClient creates a Redis client connected to the server
+// StartServerWithConfig started.
+func NewConfigServerClient() *redis.Client {
+	return configServer.NewClient()
+}
+
+// startServer starts a server on a free port and an empty object store
+// into *server, passing args on to it.
+func startServer(server **Server, args ...string) error {
+	started, err := startServerWithArgs(0, "", args)
+	if err != nil {
+		return err
+	}
+	*server = started
+	return nil
+}
+
+// stopServer stops *server, if it runs, and forgets it.
+func stopServer(server **Server) {
+	if *server != nil {
+		(*server).Stop()
+		*server = nil
+	}
+}
+
+// Server is a server started by StartServerWithOptions, or the main server
+// in External mode.
+type Server struct {
+	cmd *exec.Cmd
+	// host is where the server listens, localhost unless External.
+	host    string
+	port    int
+	dataDir string
+	args    []string
+	// ownsDataDir is set when the data directory is a temporary one the
+	// server removes when stopped.
+	ownsDataDir bool
+	// external is set for a server the suite did not start, which it
+	// neither stops nor restarts.
+	external bool
+}
+
+// StartServerWithOptions starts a server on port, or on a port from
+// FreePort if it is 0, with the config fields in configOverrides set as
+// with --set, such as "maxmemory" or "appendonly", and its object store in
+// dataDir, and waits until it answers PING. An existing dataDir is kept as
+// it is, so a server can be started on the data of an earlier one; an empty
+// dataDir starts the server on a temporary directory that Stop removes.
+func StartServerWithOptions(port int, configOverrides map[string]string, dataDir string) (*Server, error) {
+	fields := make([]string, 0, len(configOverrides))
+	for field := range configOverrides {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	var args []string
+	for _, field := range fields {
+		args = append(args, "--set", field+"="+configOverrides[field])
+	}
+	return startServerWithArgs(port, dataDir, args)
+}
+
+func startServerWithArgs(port int, dataDir string, args []string) (*Server, error) {
+	server := &Server{host: "localhost", port: port, dataDir: dataDir, args: args}
+	if dataDir == "" {
+		dir, err := os.MkdirTemp("", "nimbis-server")
+		if err != nil {
+			return nil, err
+		}
+		server.dataDir = dir
+		server.ownsDataDir = true
+	}
+	dataDir, err := filepath.Abs(server.dataDir)
+	if err != nil {
+		server.Stop()
+		return nil, err
+	}
+	server.dataDir = dataDir
+	if server.port == 0 {
+		if server.port, err = FreePort(); err != nil {
+			server.Stop()
+			return nil, err
+		}
+	}
+
+	if err := server.launch(); err != nil {
+		server.Stop()
+		return nil, err
+	}
+	return server, nil
+}
+
+// Port returns the port the server listens on.
+func (s *Server) Port() int {
+	return s.port
+}
+
+// Addr returns the host:port the server listens on.
+func (s *Server) Addr() string {
+	return net.JoinHostPort(s.host, strconv.Itoa(s.port))
+}
+
+// DataDir returns the directory holding the object store of the server.
+func (s *Server) DataDir() string {
+	return s.dataDir
+}
+
+// NewClient creates a Redis client connected to the server.
+func (s *Server) NewClient() *redis.Client {
 	return redis.NewClient(&redis.Options{
-		Addr: "localhost:6379",
+		Addr: s.Addr(),
 	})
 }
+
+// Stop kills the server, and removes its data directory if it was a
+// temporary one. It leaves an external server running.
+func (s *Server) Stop() {
+	s.kill()
+	if s.ownsDataDir {
+		_ = os.RemoveAll(s.dataDir)
+	}
+}
+
+// Restart interrupts the server as Ctrl-C does, waits up to ShutdownTimeout
+// for it to exit, and starts it again on the same port and data directory.
+// A server that does not exit in time is killed and not restarted.
+func (s *Server) Restart() error {
+	if s.external {
+		return errExternal
+	}
+	if err := s.shutdown(); err != nil {
+		return err
+	}
+	return s.launch()
+}
+
+// Halt interrupts the server as Restart does, but leaves it stopped, with
+// its data directory kept for Relaunch.
+func (s *Server) Halt() error {
+	if s.external {
+		return errExternal
+	}
+	return s.shutdown()
+}
+
+// Relaunch starts a server Halt stopped on its data directory again, on a
+// new port from FreePort.
+func (s *Server) Relaunch() error {
+	if s.external {
+		return errExternal
+	}
+	if s.cmd != nil {
+		return fmt.Errorf("server on port %d is still running", s.port)
+	}
+	port, err := FreePort()
+	if err != nil {
+		return err
+	}
+	s.port = port
+	return s.launch()
+}
+
+// Crash kills the server with SIGKILL, leaving it no chance to flush
+// anything, and starts it again on the same port and data directory.
+func (s *Server) Crash() error {
+	if s.external {
+		return errExternal
+	}
+	s.kill()
+	return s.launch()
+}
+
+// shutdown interrupts the server and waits for it to exit.
+func (s *Server) shutdown() error {
+	if s.cmd == nil || s.cmd.Process == nil {
+		return nil
+	}
+	if err := s.cmd.Process.Signal(os.Interrupt); err != nil {
+		return err
+	}
+	exited := make(chan struct{})
+	go func() {
+		_ = s.cmd.Wait()
+		close(exited)
+	}()
+	select {
+	case <-exited:
+		s.cmd = nil
+		return nil
+	case <-time.After(ShutdownTimeout):
+		_ = s.cmd.Process.Kill()
+		<-exited
+		s.cmd = nil
+		return fmt.Errorf("server on port %d did not shut down within %s", s.port, ShutdownTimeout)
+	}
+}
+
+// errExternal is the error of restarting a server the suite did not start.
+var errExternal = errors.New("cannot restart a server the suite did not start")
+
+// kill kills the server process, if it runs, and waits for it to exit.
+func (s *Server) kill() {
+	if s.cmd != nil && s.cmd.Process != nil {
+		_ = s.cmd.Process.Kill()
+		_ = s.cmd.Wait()
+		s.cmd = nil
+	}
+}
+
+// launch starts the binary from the project root, so relative paths in the
+// configuration resolve predictably, and waits until it answers PING.
+func (s *Server) launch() error {
+	binPath, err := findBinary()
+	if err != nil {
+		return err
+	}
+
+	projectRoot, err := findProjectRoot()
+	if err != nil {
+		return fmt.Errorf("failed to find project root: %w", err)
+	}
+
+	cmd := exec.Command(binPath, append([]string{"--port", fmt.Sprint(s.port)}, s.args...)...)
+	cmd.Dir = projectRoot
+	cmd.Env = append(os.Environ(), "NIMBIS_OBJECT_STORE_URL=file:"+s.dataDir)
+	// Redirect stdout/stderr for debugging
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start server on port %d: %w", s.port, err)
+	}
+	s.cmd = cmd
+
+	if err := s.waitReady(); err != nil {
+		s.kill()
+		return fmt.Errorf("server failed to start on port %d: %w", s.port, err)
+	}
+	return nil
+}
+
+// waitReady waits up to two seconds for the server to answer PING.
+func (s *Server) waitReady() error {
+	client := s.NewClient()
+	defer client.Close()
+
+	ctx := context.Background()
+	var err error
+	for i := 0; i < 20; i++ {
+		// A server that requires a password is up once it refuses PING.
+		if err = client.Ping(ctx).Err(); err == nil || strings.HasPrefix(err.Error(), "NOAUTH") {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return err
+}
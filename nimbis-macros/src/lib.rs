@@ -134,6 +134,7 @@ pub fn online_config_derive(input: TokenStream) -> TokenStream {
 	};
 
 	let mut parse_errors: Vec<syn::Error> = Vec::new();
+	let mut mutable_field_names = Vec::new();
 
 	let set_match_arms: Vec<_> = fields
 		.iter()
@@ -173,6 +174,7 @@ pub fn online_config_derive(input: TokenStream) -> TokenStream {
 					}
 				}
 			} else {
+				mutable_field_names.push(field_name_str.clone());
 				let callback_invocation = if let Some(cb) = callback {
 					let cb_ident = format_ident!("{}", cb);
 					quote! {
@@ -254,6 +256,11 @@ pub fn online_config_derive(input: TokenStream) -> TokenStream {
 				vec![#(#field_names),*]
 			}
 
+			/// List the field names that can be set at runtime
+			pub fn mutable_fields() -> Vec<&'static str> {
+				vec![#(#mutable_field_names),*]
+			}
+
 			/// Get all fields as key-value pairs
 			pub fn get_all_fields(&self) -> Vec<(String, String)> {
 				vec![#(#all_fields_pairs),*]
@@ -81,6 +81,11 @@ fn test_list_fields() {
 	assert!(fields.contains(&"id"));
 }
 
+#[test]
+fn test_mutable_fields() {
+	assert_eq!(TestConfig::mutable_fields(), vec!["addr", "port"]);
+}
+
 #[test]
 fn test_get_all_fields() {
 	let conf = TestConfig::default();
@@ -35,6 +35,7 @@ pub use encode::EncodeError;
 pub use encode::RespEncoder;
 pub use error::ParseError;
 pub use error::RespError;
+pub use parser::ParserLimits;
 pub use parser::RespParseResult;
 pub use parser::RespParser;
 pub use parser::parse;
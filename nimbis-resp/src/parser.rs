@@ -23,9 +23,36 @@ pub enum RespParseResult {
 	Error(RespError),
 }
 
+/// Hard limits on the frames a parser accepts, so a peer cannot make it
+/// buffer or allocate without bound. Exceeding one is a parse error.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct ParserLimits {
+	/// Longest inline command line, in bytes.
+	pub max_inline_len: usize,
+	/// Most elements of an array, set, map or push.
+	pub max_multibulk_len: usize,
+	/// Longest bulk string, bulk error or verbatim string, in bytes.
+	pub max_bulk_len: usize,
+}
+
+impl Default for ParserLimits {
+	fn default() -> Self {
+		Self {
+			max_inline_len: 64 * 1024,
+			max_multibulk_len: 1024 * 1024,
+			max_bulk_len: 512 * 1024 * 1024,
+		}
+	}
+}
+
+/// Aggregates never reserve room for more elements than this up front, since
+/// their length is only a claim of the peer until the elements arrive.
+const MAX_PREALLOCATED_ELEMENTS: usize = 1024;
+
 /// A stateful RESP parser that supports streaming.
 pub struct RespParser {
 	frames: Vec<Frame>,
+	limits: ParserLimits,
 }
 
 #[derive(Debug)]
@@ -64,7 +91,19 @@ enum ParsedItem {
 
 impl RespParser {
 	pub fn new() -> Self {
-		Self { frames: Vec::new() }
+		Self::with_limits(ParserLimits::default())
+	}
+
+	pub fn with_limits(limits: ParserLimits) -> Self {
+		Self {
+			frames: Vec::new(),
+			limits,
+		}
+	}
+
+	/// Change the limits for the frames parsed from now on.
+	pub fn set_limits(&mut self, limits: ParserLimits) {
+		self.limits = limits;
 	}
 
 	/// Parse a RESP value from a mutable BytesMut buffer.
@@ -230,12 +269,8 @@ impl RespParser {
 		loop {
 			if let Some((line, total_len)) = peek_line(buf) {
 				// Add a length check to prevent DoS from very long inline commands.
-				const MAX_INLINE_COMMAND_LEN: usize = 65536; // 64KB
-				if line.len() > MAX_INLINE_COMMAND_LEN {
-					return Err(ParseError::InvalidFormat(format!(
-						"Inline command exceeds maximum length of {} bytes",
-						MAX_INLINE_COMMAND_LEN
-					)));
+				if line.len() > self.limits.max_inline_len {
+					return Err(self.inline_too_long());
 				}
 
 				// Check if the first byte is a printable ASCII character.
@@ -254,47 +289,65 @@ impl RespParser {
 					}
 				}
 
-				// We need valid UTF-8 to split by whitespace easily.
-				// Best effort conversion.
-				let s = std::str::from_utf8(line).map_err(|e| {
+				// Inline commands are typed by hand, so they must be valid UTF-8;
+				// binary values can still be written with `\xHH` escapes.
+				std::str::from_utf8(line).map_err(|e| {
 					ParseError::InvalidFormat(format!("Invalid inline command: {}", e))
 				})?;
 
-				let parts: Vec<&str> = s.split_whitespace().collect();
-				if parts.is_empty() {
+				// Format: "CMD arg1 \"arg with spaces\" 'arg2'\r\n", split into an
+				// Array of BulkStrings with redis-cli's quoting rules.
+				let args = split_inline_args(line)?;
+				if args.is_empty() {
 					// Empty line or whitespace only? Just consume and continue looking.
 					// Redis ignores empty newlines.
 					buf.advance(total_len);
 					continue;
 				}
-
-				// This is an inline command.
-				// Format: "CMD arg1 arg2 ...\r\n"
-				// Split by whitespace and return as Array of BulkStrings.
-				//
-				// NOTE: This simple parsing does NOT support quoted strings with spaces.
-				// E.g. `SET key "value with spaces"` will be parsed as ["SET", "key",
-				// "\"value", "with", "spaces\""]. This is consistent with Redis inline
-				// protocol which is meant for simple telnet usage.
-
-				// NOTE: We use Bytes::copy_from_slice which allocates new memory for each
-				// argument. Since split_whitespace() returns slices that may not be
-				// contiguous in the original buffer (due to skipped whitespace), zero-copy
-				// slicing is complex here. Given inline commands are typically short
-				// control commands, this copy is acceptable.
-				let args: Vec<RespValue> = parts
-					.into_iter()
-					.map(|p| RespValue::BulkString(Bytes::copy_from_slice(p.as_bytes())))
-					.collect();
+				let args: Vec<RespValue> = args.into_iter().map(RespValue::BulkString).collect();
 
 				buf.advance(total_len);
 				return Ok(Some(ParsedItem::Value(RespValue::Array(args))));
+			} else if buf.len() > self.limits.max_inline_len {
+				// A peer that never ends the line would grow the buffer forever.
+				return Err(self.inline_too_long());
 			} else {
 				return Ok(None);
 			}
 		}
 	}
 
+	fn inline_too_long(&self) -> ParseError {
+		ParseError::InvalidFormat(format!(
+			"Inline command exceeds maximum length of {} bytes",
+			self.limits.max_inline_len
+		))
+	}
+
+	/// Check the length a bulk string, bulk error or verbatim string header
+	/// announces against `max_bulk_len`.
+	fn check_bulk_len(&self, length: usize) -> Result<(), ParseError> {
+		if length > self.limits.max_bulk_len {
+			return Err(ParseError::InvalidFormat(format!(
+				"Bulk length {} exceeds maximum of {} bytes",
+				length, self.limits.max_bulk_len
+			)));
+		}
+		Ok(())
+	}
+
+	/// Check the element count an aggregate header announces against
+	/// `max_multibulk_len`.
+	fn check_multibulk_len(&self, length: usize) -> Result<(), ParseError> {
+		if length > self.limits.max_multibulk_len {
+			return Err(ParseError::InvalidFormat(format!(
+				"Multibulk length {} exceeds maximum of {} elements",
+				length, self.limits.max_multibulk_len
+			)));
+		}
+		Ok(())
+	}
+
 	fn parse_simple_string(
 		&mut self,
 		buf: &mut BytesMut,
@@ -391,6 +444,7 @@ impl RespParser {
 			}
 
 			let length = length as usize;
+			self.check_bulk_len(length)?;
 			let total_needed = 1 + len_consumed + length + 2; // +2 for CRLF
 
 			if buf.len() < total_needed {
@@ -423,6 +477,7 @@ impl RespParser {
 			}
 
 			let length = length as usize;
+			self.check_bulk_len(length)?;
 			let total_needed = 1 + len_consumed + length + 2;
 
 			if buf.len() < total_needed {
@@ -455,6 +510,7 @@ impl RespParser {
 				return Err(ParseError::InvalidBulkStringLength(length));
 			}
 			let length = length as usize;
+			self.check_bulk_len(length)?;
 			let total_needed = 1 + len_consumed + length + 2;
 
 			if buf.len() < total_needed {
@@ -503,13 +559,14 @@ impl RespParser {
 			}
 
 			let length = length as usize;
+			self.check_multibulk_len(length)?;
 			if length == 0 {
 				return Ok(Some(ParsedItem::Value(RespValue::Array(Vec::new()))));
 			}
 
 			self.frames.push(Frame::Array {
 				expected: length,
-				elements: Vec::with_capacity(length),
+				elements: Vec::with_capacity(length.min(MAX_PREALLOCATED_ELEMENTS)),
 			});
 			Ok(Some(ParsedItem::FramePushed))
 		} else {
@@ -530,13 +587,14 @@ impl RespParser {
 			}
 
 			let length = length as usize;
+			self.check_multibulk_len(length)?;
 			if length == 0 {
 				return Ok(Some(ParsedItem::Value(RespValue::Set(HashSet::new()))));
 			}
 
 			self.frames.push(Frame::Set {
 				expected: length,
-				elements: HashSet::with_capacity(length),
+				elements: HashSet::with_capacity(length.min(MAX_PREALLOCATED_ELEMENTS)),
 			});
 			Ok(Some(ParsedItem::FramePushed))
 		} else {
@@ -557,13 +615,14 @@ impl RespParser {
 			}
 
 			let length = length as usize;
+			self.check_multibulk_len(length)?;
 			if length == 0 {
 				return Ok(Some(ParsedItem::Value(RespValue::Map(HashMap::new()))));
 			}
 
 			self.frames.push(Frame::Map {
 				expected: length,
-				elements: HashMap::with_capacity(length),
+				elements: HashMap::with_capacity(length.min(MAX_PREALLOCATED_ELEMENTS)),
 				key: None,
 			});
 			Ok(Some(ParsedItem::FramePushed))
@@ -585,13 +644,14 @@ impl RespParser {
 			}
 
 			let length = length as usize;
+			self.check_multibulk_len(length)?;
 			if length == 0 {
 				return Ok(Some(ParsedItem::Value(RespValue::Push(Vec::new()))));
 			}
 
 			self.frames.push(Frame::Push {
 				expected: length,
-				elements: Vec::with_capacity(length),
+				elements: Vec::with_capacity(length.min(MAX_PREALLOCATED_ELEMENTS)),
 			});
 			Ok(Some(ParsedItem::FramePushed))
 		} else {
@@ -706,7 +766,9 @@ mod tests {
 	#[case(b" \r\nPING\r\n", vec!["PING"])] // Whitespace only line skipped
 	#[case(b" PING\r\n", vec!["PING"])] // Starts with space
 	#[case(b"GET\tkey\r\n", vec!["GET", "key"])] // Tab separator
-	#[case(b"SET key \"val with spaces\"\r\n", vec!["SET", "key", "\"val", "with", "spaces\""])] // Quotes not handled
+	#[case(b"SET key \"val with spaces\"\r\n", vec!["SET", "key", "val with spaces"])]
+	#[case(b"SET key 'it\\'s'\r\n", vec!["SET", "key", "it's"])]
+	#[case(b"SET key \"a\\tb\"\r\n", vec!["SET", "key", "a\tb"])]
 	fn test_parse_inline_command_valid(#[case] input: &[u8], #[case] expected: Vec<&str>) {
 		let mut buf = BytesMut::from(input);
 		let value = parse(&mut buf).unwrap();
@@ -734,6 +796,7 @@ mod tests {
 
 	#[rstest]
 	#[case(b"PING \x80\r\n", "Invalid inline command")] // Invalid UTF-8
+	#[case(b"SET key \"value\r\n", "unbalanced quotes")]
 	#[case(b"\x01PING\r\n", "Invalid type marker")] // Control char start -> InvalidTypeMarker
 	#[case(b"\x7FPING\r\n", "Invalid type marker")] // Non-printable start -> InvalidTypeMarker
 	fn test_parse_inline_command_invalid(#[case] input: &[u8], #[case] error_msg_part: &str) {
@@ -766,4 +829,53 @@ mod tests {
 			matches!(result, Err(ParseError::InvalidFormat(msg)) if msg.contains("exceeds maximum length"))
 		);
 	}
+
+	fn parse_with_limits(input: &[u8], limits: ParserLimits) -> RespParseResult {
+		let mut buf = BytesMut::from(input);
+		RespParser::with_limits(limits).parse(&mut buf)
+	}
+
+	#[rstest]
+	#[case(b"*3\r\n$3\r\nGET\r\n", "Multibulk length 3 exceeds")]
+	#[case(b"~3\r\n", "Multibulk length 3 exceeds")]
+	#[case(b"%3\r\n", "Multibulk length 3 exceeds")]
+	#[case(b">3\r\n", "Multibulk length 3 exceeds")]
+	#[case(b"*1\r\n$9\r\n", "Bulk length 9 exceeds")]
+	#[case(b"!9\r\n", "Bulk length 9 exceeds")]
+	#[case(b"=9\r\n", "Bulk length 9 exceeds")]
+	#[case(b"GET a-long-key\r\n", "Inline command exceeds")]
+	#[case(b"GET a-long-key-without-crlf", "Inline command exceeds")]
+	fn test_parse_exceeding_limits(#[case] input: &[u8], #[case] error_msg_part: &str) {
+		let limits = ParserLimits {
+			max_inline_len: 8,
+			max_multibulk_len: 2,
+			max_bulk_len: 8,
+		};
+		match parse_with_limits(input, limits) {
+			RespParseResult::Error(e) => assert!(
+				e.to_string().contains(error_msg_part),
+				"Expected error containing '{}', got {}",
+				error_msg_part,
+				e
+			),
+			other => panic!("Expected error, got {:?}", other),
+		}
+	}
+
+	#[test]
+	fn test_parse_within_limits() {
+		let limits = ParserLimits {
+			max_inline_len: 8,
+			max_multibulk_len: 2,
+			max_bulk_len: 8,
+		};
+		let result = parse_with_limits(b"*2\r\n$3\r\nGET\r\n$8\r\n12345678\r\n", limits);
+		assert!(
+			matches!(result, RespParseResult::Complete(RespValue::Array(arr)) if arr.len() == 2)
+		);
+		assert!(matches!(
+			parse_with_limits(b"GET key", limits),
+			RespParseResult::Incomplete
+		));
+	}
 }
@@ -1,5 +1,7 @@
 //! Utility functions and constants for RESP protocol.
 
+use bytes::Bytes;
+
 use crate::error::ParseError;
 
 /// CRLF line ending
@@ -126,6 +128,96 @@ pub fn parse_double(buf: &[u8]) -> Result<f64, ParseError> {
 	}
 }
 
+/// Split an inline command line into its arguments the way redis-cli does:
+/// arguments are separated by whitespace and may be quoted. Double quotes
+/// support the escapes `\n`, `\r`, `\t`, `\b`, `\a` and `\xHH`, single quotes
+/// only `\'`, and a closing quote must end the argument.
+pub fn split_inline_args(line: &[u8]) -> Result<Vec<Bytes>, ParseError> {
+	let unbalanced = || ParseError::InvalidFormat("unbalanced quotes in inline command".into());
+	let is_space = |c: u8| matches!(c, b' ' | b'\n' | b'\r' | b'\t' | b'\0');
+	let mut args = Vec::new();
+	let mut pos = 0;
+	loop {
+		while pos < line.len() && is_space(line[pos]) {
+			pos += 1;
+		}
+		if pos == line.len() {
+			return Ok(args);
+		}
+
+		let mut arg = Vec::new();
+		let mut in_double = false;
+		let mut in_single = false;
+		loop {
+			let Some(&c) = line.get(pos) else {
+				if in_double || in_single {
+					return Err(unbalanced());
+				}
+				break;
+			};
+			if in_double {
+				if c == b'\\'
+					&& pos + 3 < line.len()
+					&& line[pos + 1] == b'x'
+					&& let Some(byte) = hex_byte(line[pos + 2], line[pos + 3])
+				{
+					arg.push(byte);
+					pos += 4;
+					continue;
+				}
+				if c == b'\\' && pos + 1 < line.len() {
+					arg.push(match line[pos + 1] {
+						b'n' => b'\n',
+						b'r' => b'\r',
+						b't' => b'\t',
+						b'b' => 0x08,
+						b'a' => 0x07,
+						other => other,
+					});
+					pos += 2;
+					continue;
+				}
+				if c == b'"' {
+					if line.get(pos + 1).is_some_and(|&next| !is_space(next)) {
+						return Err(unbalanced());
+					}
+					pos += 1;
+					break;
+				}
+				arg.push(c);
+			} else if in_single {
+				if c == b'\\' && line.get(pos + 1) == Some(&b'\'') {
+					arg.push(b'\'');
+					pos += 2;
+					continue;
+				}
+				if c == b'\'' {
+					if line.get(pos + 1).is_some_and(|&next| !is_space(next)) {
+						return Err(unbalanced());
+					}
+					pos += 1;
+					break;
+				}
+				arg.push(c);
+			} else {
+				match c {
+					c if is_space(c) => break,
+					b'"' => in_double = true,
+					b'\'' => in_single = true,
+					c => arg.push(c),
+				}
+			}
+			pos += 1;
+		}
+		args.push(Bytes::from(arg));
+	}
+}
+
+fn hex_byte(high: u8, low: u8) -> Option<u8> {
+	let digit = |c: u8| (c as char).to_digit(16);
+	Some((digit(high)? * 16 + digit(low)?) as u8)
+}
+
 #[cfg(test)]
 mod tests {
 	use rstest::rstest;
@@ -177,4 +269,30 @@ mod tests {
 			assert_eq!(result, expected);
 		}
 	}
+
+	#[rstest]
+	#[case(b"SET key \"val with spaces\"", vec![&b"SET"[..], b"key", b"val with spaces"])]
+	#[case(b"SET key 'it\\'s'", vec![&b"SET"[..], b"key", b"it's"])]
+	#[case(b"SET key \"a\\n\\t\\\"b\\x41\\xzz\"", vec![&b"SET"[..], b"key", b"a\n\t\"bAxzz"])]
+	#[case(b"SET key \"\\xff\"", vec![&b"SET"[..], b"key", b"\xff"])]
+	#[case(b"SET key \"\"", vec![&b"SET"[..], b"key", b""])]
+	#[case(b"GET a\"b c\"", vec![&b"GET"[..], b"ab c"])]
+	#[case(b"  GET\tkey  ", vec![&b"GET"[..], b"key"])]
+	fn test_split_inline_args(#[case] input: &[u8], #[case] expected: Vec<&[u8]>) {
+		let args = split_inline_args(input).unwrap();
+		assert_eq!(args, expected);
+	}
+
+	#[rstest]
+	#[case(b"SET key \"unterminated")]
+	#[case(b"SET key 'unterminated")]
+	#[case(b"SET key \"closed\"trailing")]
+	#[case(b"SET key 'closed'trailing")]
+	#[case(b"GET a\"b c\"d")]
+	fn test_split_inline_args_unbalanced_quotes(#[case] input: &[u8]) {
+		assert!(matches!(
+			split_inline_args(input),
+			Err(ParseError::InvalidFormat(msg)) if msg.contains("unbalanced quotes")
+		));
+	}
 }
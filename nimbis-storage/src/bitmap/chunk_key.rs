@@ -0,0 +1,61 @@
+use bytes::BufMut;
+use bytes::Bytes;
+use bytes::BytesMut;
+
+#[derive(Debug, PartialEq)]
+pub struct BitmapChunkKey {
+	user_key: Bytes,
+	index: u64,
+}
+
+impl BitmapChunkKey {
+	pub fn new(user_key: impl Into<Bytes>, index: u64) -> Self {
+		Self {
+			user_key: user_key.into(),
+			index,
+		}
+	}
+
+	pub fn encode(&self) -> Bytes {
+		// Key format: len(user_key) (u16 BE) + user_key + index (u64 BE). A
+		// big-endian index keeps chunks in offset order.
+		let mut bytes = BytesMut::with_capacity(2 + self.user_key.len() + 8);
+		bytes.put_u16(self.user_key.len() as u16);
+		bytes.extend_from_slice(&self.user_key);
+		bytes.put_u64(self.index);
+		bytes.freeze()
+	}
+
+	/// Decode the chunk index from an encoded key, which ends with it.
+	pub fn decode_index(encoded: &[u8]) -> Option<u64> {
+		let start = encoded.len().checked_sub(8)?;
+		Some(u64::from_be_bytes(encoded[start..].try_into().ok()?))
+	}
+
+	/// Returns the user_key from this chunk key.
+	pub fn user_key(&self) -> &Bytes {
+		&self.user_key
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+
+	#[test]
+	fn test_bitmap_chunk_key_encode() {
+		let encoded = BitmapChunkKey::new(Bytes::from("bits"), 7).encode();
+		// Verify format: key_len(u16) + key + index(u64)
+		assert_eq!(&encoded[..2], &4u16.to_be_bytes());
+		assert_eq!(&encoded[2..6], b"bits");
+		assert_eq!(BitmapChunkKey::decode_index(&encoded), Some(7));
+	}
+
+	#[test]
+	fn test_bitmap_chunk_keys_sort_by_index() {
+		let key = Bytes::from("bits");
+		let first = BitmapChunkKey::new(key.clone(), 255).encode();
+		let second = BitmapChunkKey::new(key, 256).encode();
+		assert!(first < second);
+	}
+}
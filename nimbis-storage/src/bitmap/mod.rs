@@ -0,0 +1,6 @@
+pub mod chunk_key;
+pub mod sparse;
+
+/// Bitmaps are stored in chunks of this many bytes, so a bit at a high
+/// offset costs one chunk rather than every byte before it.
+pub const CHUNK_SIZE: u64 = 4096;
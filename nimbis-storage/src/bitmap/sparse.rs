@@ -0,0 +1,254 @@
+use bytes::Bytes;
+
+/// A string read for bit operations, where only some ranges are loaded.
+///
+/// `segments` are non-overlapping `(offset, bytes)` pairs in offset order;
+/// every other byte below `len` is zero. Bits are numbered from the most
+/// significant bit of the first byte, as in Redis.
+#[derive(Debug, Clone, PartialEq)]
+pub struct SparseBytes {
+	len: u64,
+	segments: Vec<(u64, Bytes)>,
+}
+
+impl SparseBytes {
+	pub fn new(len: u64, mut segments: Vec<(u64, Bytes)>) -> Self {
+		segments.retain(|(_, bytes)| !bytes.is_empty());
+		Self { len, segments }
+	}
+
+	/// A fully loaded string.
+	pub fn dense(value: Bytes) -> Self {
+		let len = value.len() as u64;
+		Self::new(len, vec![(0, value)])
+	}
+
+	/// Length of the string in bytes.
+	pub fn len(&self) -> u64 {
+		self.len
+	}
+
+	pub fn is_empty(&self) -> bool {
+		self.len == 0
+	}
+
+	/// The byte at `offset`, zero past the end of the string.
+	pub fn byte(&self, offset: u64) -> u8 {
+		let idx = self
+			.segments
+			.partition_point(|(start, bytes)| start + bytes.len() as u64 <= offset);
+		match self.segments.get(idx) {
+			Some((start, bytes)) if *start <= offset => bytes[(offset - start) as usize],
+			_ => 0,
+		}
+	}
+
+	/// The bit at `offset`, unset past the end of the string.
+	pub fn bit(&self, offset: u64) -> bool {
+		self.byte(offset / 8) & (0x80 >> (offset % 8)) != 0
+	}
+
+	/// Count the set bits between `start` and `end`, both inclusive.
+	pub fn count_ones(&self, start: u64, end: u64) -> u64 {
+		self.segments
+			.iter()
+			.map(|(offset, bytes)| count_ones_in(bytes, offset * 8, start, end))
+			.sum()
+	}
+
+	/// Find the first bit equal to `bit` between `start` and `end`, both
+	/// inclusive. `end` must lie within the string.
+	pub fn position(&self, bit: bool, start: u64, end: u64) -> Option<u64> {
+		if start > end {
+			return None;
+		}
+		if bit {
+			return self
+				.segments
+				.iter()
+				.find_map(|(offset, bytes)| find_bit_in(bytes, offset * 8, true, start, end));
+		}
+
+		// A zero is found either in a gap between segments or inside one.
+		let mut cursor = start;
+		for (offset, bytes) in &self.segments {
+			let first = offset * 8;
+			let last = first + bytes.len() as u64 * 8 - 1;
+			if last < cursor {
+				continue;
+			}
+			if first > cursor || cursor > end {
+				break;
+			}
+			if let Some(pos) = find_bit_in(bytes, first, false, cursor, end) {
+				return Some(pos);
+			}
+			cursor = last + 1;
+		}
+		(cursor <= end).then_some(cursor)
+	}
+
+	/// Read the bytes `start..end`, zero-padded past the end of the string.
+	/// Returns `None` if no loaded segment overlaps them, so they are all
+	/// zero.
+	pub fn read(&self, start: u64, end: u64) -> Option<Vec<u8>> {
+		let mut value = None;
+		for (offset, bytes) in &self.segments {
+			let seg_end = offset + bytes.len() as u64;
+			if seg_end <= start || *offset >= end {
+				continue;
+			}
+			let out = value.get_or_insert_with(|| vec![0u8; (end - start) as usize]);
+			let from = start.max(*offset);
+			let to = end.min(seg_end);
+			out[(from - start) as usize..(to - start) as usize]
+				.copy_from_slice(&bytes[(from - offset) as usize..(to - offset) as usize]);
+		}
+		value
+	}
+
+	/// Indexes of the `chunk_size` chunks that loaded segments overlap, in
+	/// order and possibly repeated.
+	pub fn chunk_indices(&self, chunk_size: u64) -> impl Iterator<Item = u64> + '_ {
+		self.segments.iter().flat_map(move |(offset, bytes)| {
+			offset / chunk_size..=(offset + bytes.len() as u64 - 1) / chunk_size
+		})
+	}
+
+	/// Materialize the whole string.
+	pub fn to_vec(&self) -> Vec<u8> {
+		let mut value = vec![0u8; self.len as usize];
+		for (offset, bytes) in &self.segments {
+			let start = *offset as usize;
+			let end = (start + bytes.len()).min(value.len());
+			if start < end {
+				value[start..end].copy_from_slice(&bytes[..end - start]);
+			}
+		}
+		value
+	}
+}
+
+/// Mask of the bits `from..=to` of a byte, numbered from the most
+/// significant bit.
+fn bit_mask(from: u64, to: u64) -> u8 {
+	(0xFF >> from) & (0xFF << (7 - to))
+}
+
+/// Clip the bit range `start..=end` to `bytes`, whose first bit is `base`,
+/// returning the range relative to `bytes`.
+fn clip(bytes: &[u8], base: u64, start: u64, end: u64) -> Option<(u64, u64)> {
+	let first = start.max(base);
+	let last = end.min(base + bytes.len() as u64 * 8 - 1);
+	(first <= last).then(|| (first - base, last - base))
+}
+
+fn count_ones_in(bytes: &[u8], base: u64, start: u64, end: u64) -> u64 {
+	let Some((first, last)) = clip(bytes, base, start, end) else {
+		return 0;
+	};
+	let (first_byte, last_byte) = ((first / 8) as usize, (last / 8) as usize);
+	if first_byte == last_byte {
+		return (bytes[first_byte] & bit_mask(first % 8, last % 8)).count_ones() as u64;
+	}
+
+	let head = (bytes[first_byte] & bit_mask(first % 8, 7)).count_ones();
+	let tail = (bytes[last_byte] & bit_mask(0, last % 8)).count_ones();
+	let middle: u32 = bytes[first_byte + 1..last_byte]
+		.iter()
+		.map(|b| b.count_ones())
+		.sum();
+	(head + middle + tail) as u64
+}
+
+fn find_bit_in(bytes: &[u8], base: u64, bit: bool, start: u64, end: u64) -> Option<u64> {
+	let (first, last) = clip(bytes, base, start, end)?;
+	for idx in first / 8..=last / 8 {
+		let from = if idx == first / 8 { first % 8 } else { 0 };
+		let to = if idx == last / 8 { last % 8 } else { 7 };
+		let byte = bytes[idx as usize];
+		let candidates = (if bit { byte } else { !byte }) & bit_mask(from, to);
+		if candidates != 0 {
+			return Some(base + idx * 8 + candidates.leading_zeros() as u64);
+		}
+	}
+	None
+}
+
+#[cfg(test)]
+mod tests {
+	use rstest::rstest;
+
+	use super::*;
+
+	fn sparse() -> SparseBytes {
+		// Bytes 0..=9 with 0xF0 at offset 2 and 0xFF 0x0F at offsets 6 and 7.
+		SparseBytes::new(
+			10,
+			vec![
+				(2, Bytes::from_static(&[0xF0])),
+				(6, Bytes::from_static(&[0xFF, 0x0F])),
+			],
+		)
+	}
+
+	#[test]
+	fn test_byte_and_bit() {
+		let bytes = sparse();
+		assert_eq!(bytes.byte(0), 0);
+		assert_eq!(bytes.byte(2), 0xF0);
+		assert_eq!(bytes.byte(7), 0x0F);
+		assert_eq!(bytes.byte(100), 0);
+		assert!(bytes.bit(16));
+		assert!(!bytes.bit(20));
+		assert!(bytes.bit(63));
+	}
+
+	#[rstest]
+	#[case(0, 79, 16)]
+	#[case(16, 19, 4)]
+	#[case(18, 50, 2 + 3)]
+	#[case(60, 61, 2)]
+	#[case(24, 47, 0)]
+	fn test_count_ones(#[case] start: u64, #[case] end: u64, #[case] expected: u64) {
+		assert_eq!(sparse().count_ones(start, end), expected);
+	}
+
+	#[rstest]
+	#[case(true, 0, 79, Some(16))]
+	#[case(true, 20, 79, Some(48))]
+	#[case(true, 57, 59, None)]
+	#[case(false, 0, 79, Some(0))]
+	#[case(false, 16, 79, Some(20))]
+	#[case(false, 48, 79, Some(56))]
+	#[case(false, 48, 55, None)]
+	#[case(true, 64, 79, None)]
+	fn test_position(
+		#[case] bit: bool,
+		#[case] start: u64,
+		#[case] end: u64,
+		#[case] expected: Option<u64>,
+	) {
+		assert_eq!(sparse().position(bit, start, end), expected);
+	}
+
+	#[test]
+	fn test_read_and_chunk_indices() {
+		let bytes = sparse();
+		assert_eq!(bytes.read(0, 2), None);
+		assert_eq!(bytes.read(1, 4), Some(vec![0, 0xF0, 0]));
+		assert_eq!(bytes.read(7, 12), Some(vec![0x0F, 0, 0, 0, 0]));
+		assert_eq!(bytes.chunk_indices(4).collect::<Vec<_>>(), vec![0, 1]);
+	}
+
+	#[test]
+	fn test_dense_to_vec() {
+		let bytes = SparseBytes::dense(Bytes::from("foobar"));
+		assert_eq!(bytes.count_ones(0, 47), 26);
+		assert_eq!(bytes.to_vec(), b"foobar");
+		assert_eq!(
+			sparse().to_vec(),
+			vec![0, 0, 0xF0, 0, 0, 0, 0xFF, 0x0F, 0, 0]
+		);
+	}
+}
@@ -15,10 +15,12 @@ use slatedb::RowEntry;
 use slatedb::ValueDeletable;
 
 use crate::data_type::DataType;
+use crate::stream::entry_key::StreamEntryKey;
 use crate::string::meta::AnyValue;
 use crate::string::meta::MetaKey;
 
-// CollectionCompactionFilter used by hash_db, list_db, set_db, zset_db
+// CollectionCompactionFilter used by hash_db, list_db, set_db, zset_db,
+// stream_db, bitmap_db
 pub struct CollectionCompactionFilter {
 	pub(crate) string_db: Arc<Db>,
 	pub(crate) data_type: DataType,
@@ -27,7 +29,7 @@ pub struct CollectionCompactionFilter {
 impl CollectionCompactionFilter {
 	/// Decode a sub-key to extract the user_key portion.
 	/// Sub-key format: key_len(u16 BE) + user_key + ...
-	fn decode_sub_key(key: &[u8]) -> Option<Bytes> {
+	pub(crate) fn decode_sub_key(key: &[u8]) -> Option<Bytes> {
 		if key.len() < 2 {
 			return None;
 		}
@@ -118,6 +120,20 @@ impl CompactionFilter for CollectionCompactionFilter {
 			return Ok(CompactionFilterDecision::Modify(ValueDeletable::Tombstone));
 		}
 
+		// Check trim — stream entries up to the trimmed ID are already hidden
+		if let AnyValue::Stream(meta) = &any_val
+			&& entry.key.len() == 2 + user_key.len() + 1 + 16
+			&& entry.key[2 + user_key.len()] == b'E'
+			&& let Some(id) = StreamEntryKey::decode_id(&entry.key)
+			&& id <= meta.trimmed_id
+		{
+			info!(
+				"[{:?}Filter] Drop[trimmed: trimmed_id {}, id {}] key: {:?}",
+				self.data_type, meta.trimmed_id, id, user_key
+			);
+			return Ok(CompactionFilterDecision::Modify(ValueDeletable::Tombstone));
+		}
+
 		Ok(CompactionFilterDecision::Keep)
 	}
 
@@ -226,6 +242,73 @@ mod tests {
 		);
 	}
 
+	#[tokio::test]
+	async fn test_collection_filter_drops_trimmed_stream_entries() {
+		use std::sync::Arc;
+
+		use slatedb::Db;
+		use slatedb::object_store::local::LocalFileSystem;
+		use slatedb::object_store::path::Path;
+
+		use crate::stream::id::StreamId;
+		use crate::stream::pending::StreamPendingKey;
+		use crate::string::meta::StreamMetaValue;
+
+		let temp_dir = std::env::temp_dir().join(format!("nimbis-test-{}", ulid::Ulid::new()));
+		tokio::fs::create_dir_all(&temp_dir).await.unwrap();
+		let object_store = Arc::new(LocalFileSystem::new_with_prefix(&temp_dir).unwrap());
+		let string_db = Arc::new(
+			Db::builder(Path::from("/string"), object_store)
+				.build()
+				.await
+				.unwrap(),
+		);
+
+		// Put Metadata trimmed up to 1-2
+		let user_key = Bytes::from("mystream");
+		let mut meta_val = StreamMetaValue::new(1);
+		meta_val.trimmed_id = StreamId::new(1, 2);
+		string_db
+			.put(MetaKey::new(user_key.clone()).encode(), meta_val.encode())
+			.await
+			.unwrap();
+
+		let mut filter = CollectionCompactionFilter {
+			string_db: string_db.clone(),
+			data_type: DataType::Stream,
+		};
+		let row = |key: Bytes| RowEntry {
+			key,
+			value: ValueDeletable::Value(Bytes::from("val")),
+			seq: 1,
+			create_ts: None,
+			expire_ts: None,
+		};
+
+		let trimmed = row(StreamEntryKey::new(user_key.clone(), StreamId::new(1, 2)).encode());
+		assert_eq!(
+			filter.filter(&trimmed).await.unwrap(),
+			CompactionFilterDecision::Modify(ValueDeletable::Tombstone)
+		);
+
+		let live = row(StreamEntryKey::new(user_key.clone(), StreamId::new(1, 3)).encode());
+		assert_eq!(
+			filter.filter(&live).await.unwrap(),
+			CompactionFilterDecision::Keep
+		);
+
+		// Pending entries of trimmed IDs stay until acknowledged.
+		let pending =
+			row(
+				StreamPendingKey::new(user_key.clone(), Bytes::from("g"), StreamId::new(1, 1))
+					.encode(),
+			);
+		assert_eq!(
+			filter.filter(&pending).await.unwrap(),
+			CompactionFilterDecision::Keep
+		);
+	}
+
 	#[tokio::test]
 	async fn test_collection_filter_reclaims_orphaned_data() {
 		use std::sync::Arc;
@@ -0,0 +1,252 @@
+//! Transparent compression of large string values.
+//!
+//! With a codec set, string values of at least the threshold size are written
+//! compressed when that makes them smaller. A compressed value has its own
+//! type code, followed by the codec and the uncompressed length:
+//!
+//! `[b'c'] [codec: u8] [len: u32 BE] [payload]`
+//!
+//! Reads decompress whatever they find, so values written before or after the
+//! codec changes read back the same way. Keys, TTLs and the elements of
+//! collections are never compressed.
+
+use std::fmt;
+use std::str::FromStr;
+use std::sync::Mutex;
+use std::sync::atomic::AtomicU64;
+use std::sync::atomic::Ordering;
+
+use bytes::Buf;
+use bytes::BufMut;
+use bytes::Bytes;
+use bytes::BytesMut;
+
+use crate::error::DecoderError;
+use crate::string::value::StringValue;
+
+/// The type code of a compressed string value.
+pub const COMPRESSED_STRING: u8 = b'c';
+/// Type code, codec and uncompressed length.
+const HEADER_LEN: usize = 1 + 1 + 4;
+const ZSTD_LEVEL: i32 = 3;
+
+/// How string values are compressed.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub enum Codec {
+	/// Values are written as they are.
+	#[default]
+	None,
+	Zstd,
+}
+
+impl Codec {
+	fn id(self) -> u8 {
+		match self {
+			Codec::None => 0,
+			Codec::Zstd => 1,
+		}
+	}
+}
+
+impl FromStr for Codec {
+	type Err = String;
+
+	fn from_str(s: &str) -> Result<Self, Self::Err> {
+		match s.to_ascii_lowercase().as_str() {
+			"none" => Ok(Codec::None),
+			"zstd" => Ok(Codec::Zstd),
+			_ => Err(format!("Invalid value compression: {}", s)),
+		}
+	}
+}
+
+impl fmt::Display for Codec {
+	fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+		f.write_str(match self {
+			Codec::None => "none",
+			Codec::Zstd => "zstd",
+		})
+	}
+}
+
+/// Compression settings and what was compressed since the store opened.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct CompressionStats {
+	pub codec: Codec,
+	/// The size from which values are compressed.
+	pub threshold: usize,
+	/// Values written compressed.
+	pub values: u64,
+	/// Bytes of those values before compression.
+	pub input_bytes: u64,
+	/// Bytes of those values after compression.
+	pub output_bytes: u64,
+}
+
+#[derive(Debug, Default)]
+pub(crate) struct Compression {
+	settings: Mutex<(Codec, usize)>,
+	values: AtomicU64,
+	input_bytes: AtomicU64,
+	output_bytes: AtomicU64,
+}
+
+impl Compression {
+	pub(crate) fn configure(&self, codec: Codec, threshold: usize) {
+		*self.settings.lock().unwrap() = (codec, threshold);
+	}
+
+	/// Encode `value`, compressed if it is large enough and compresses.
+	pub(crate) fn encode(&self, value: &StringValue) -> Bytes {
+		let (codec, threshold) = *self.settings.lock().unwrap();
+		if codec == Codec::None || value.value.len() < threshold.max(1) {
+			return value.encode();
+		}
+		let Some(payload) = compress(codec, &value.value) else {
+			return value.encode();
+		};
+		if HEADER_LEN + payload.len() >= 1 + value.value.len() {
+			return value.encode();
+		}
+
+		self.values.fetch_add(1, Ordering::Relaxed);
+		self.input_bytes
+			.fetch_add(value.value.len() as u64, Ordering::Relaxed);
+		self.output_bytes
+			.fetch_add(payload.len() as u64, Ordering::Relaxed);
+
+		let mut bytes = BytesMut::with_capacity(HEADER_LEN + payload.len());
+		bytes.put_u8(COMPRESSED_STRING);
+		bytes.put_u8(codec.id());
+		bytes.put_u32(value.value.len() as u32);
+		bytes.extend_from_slice(&payload);
+		bytes.freeze()
+	}
+
+	pub(crate) fn stats(&self) -> CompressionStats {
+		let (codec, threshold) = *self.settings.lock().unwrap();
+		CompressionStats {
+			codec,
+			threshold,
+			values: self.values.load(Ordering::Relaxed),
+			input_bytes: self.input_bytes.load(Ordering::Relaxed),
+			output_bytes: self.output_bytes.load(Ordering::Relaxed),
+		}
+	}
+}
+
+fn compress(codec: Codec, value: &[u8]) -> Option<Vec<u8>> {
+	match codec {
+		Codec::None => None,
+		// Values too large for the length field are left as they are.
+		Codec::Zstd if value.len() > u32::MAX as usize => None,
+		Codec::Zstd => zstd::bulk::compress(value, ZSTD_LEVEL).ok(),
+	}
+}
+
+/// Decode a compressed string value, without its type code.
+pub(crate) fn decompress(mut buf: &[u8]) -> Result<Bytes, DecoderError> {
+	if buf.len() < HEADER_LEN - 1 {
+		return Err(DecoderError::InvalidLength);
+	}
+	let codec = buf.get_u8();
+	let len = buf.get_u32() as usize;
+	if codec != Codec::Zstd.id() {
+		return Err(DecoderError::InvalidCompression);
+	}
+	match zstd::bulk::decompress(buf, len) {
+		Ok(value) if value.len() == len => Ok(Bytes::from(value)),
+		_ => Err(DecoderError::InvalidCompression),
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+
+	fn json(len: usize) -> Bytes {
+		let mut value = String::from("[");
+		while value.len() < len {
+			value.push_str(r#"{"name":"nimbis","tags":["kv","redis"]},"#);
+		}
+		Bytes::from(value)
+	}
+
+	#[test]
+	fn test_codec_names() {
+		assert_eq!("zstd".parse::<Codec>().unwrap(), Codec::Zstd);
+		assert_eq!("NONE".parse::<Codec>().unwrap(), Codec::None);
+		assert!("lz4".parse::<Codec>().is_err());
+		assert_eq!(Codec::Zstd.to_string(), "zstd");
+	}
+
+	#[test]
+	fn test_roundtrip() {
+		let compression = Compression::default();
+		compression.configure(Codec::Zstd, 64);
+
+		let value = StringValue::new(json(4096));
+		let encoded = compression.encode(&value);
+		assert_eq!(encoded[0], COMPRESSED_STRING);
+		assert!(encoded.len() < value.value.len() / 4);
+		assert_eq!(StringValue::decode(&encoded).unwrap(), value);
+
+		let stats = compression.stats();
+		assert_eq!(stats.values, 1);
+		assert_eq!(stats.input_bytes, value.value.len() as u64);
+		assert_eq!(stats.output_bytes, (encoded.len() - HEADER_LEN) as u64);
+	}
+
+	#[test]
+	fn test_values_left_as_they_are() {
+		let compression = Compression::default();
+		let value = StringValue::new(json(4096));
+		// No codec.
+		assert_eq!(compression.encode(&value), value.encode());
+
+		compression.configure(Codec::Zstd, 8192);
+		// Below the threshold.
+		assert_eq!(compression.encode(&value), value.encode());
+
+		compression.configure(Codec::Zstd, 64);
+		// Not smaller once compressed.
+		let mut state = 0x9e37_79b9_7f4a_7c15u64;
+		let random: Vec<u8> = (0..1024)
+			.map(|_| {
+				state ^= state << 13;
+				state ^= state >> 7;
+				state ^= state << 17;
+				state as u8
+			})
+			.collect();
+		let value = StringValue::new(Bytes::from(random));
+		assert_eq!(compression.encode(&value), value.encode());
+		assert_eq!(compression.stats().values, 0);
+	}
+
+	#[test]
+	fn test_decompress_corrupted() {
+		let compression = Compression::default();
+		compression.configure(Codec::Zstd, 64);
+		let encoded = compression.encode(&StringValue::new(json(1024)));
+
+		let mut wrong_len = encoded.to_vec();
+		wrong_len[5] ^= 1;
+		assert!(matches!(
+			StringValue::decode(&wrong_len),
+			Err(DecoderError::InvalidCompression)
+		));
+
+		let mut unknown_codec = encoded.to_vec();
+		unknown_codec[1] = 9;
+		assert!(matches!(
+			StringValue::decode(&unknown_codec),
+			Err(DecoderError::InvalidCompression)
+		));
+
+		assert!(matches!(
+			StringValue::decode(&encoded[..3]),
+			Err(DecoderError::InvalidLength)
+		));
+	}
+}
@@ -6,6 +6,9 @@ pub enum DataType {
 	Set = b'S',
 	List = b'l',
 	ZSet = b'z',
+	Stream = b't',
+	Bitmap = b'b',
+	Extension = b'x',
 }
 
 impl DataType {
@@ -16,6 +19,9 @@ impl DataType {
 			b'S' => Some(Self::Set),
 			b'l' => Some(Self::List),
 			b'z' => Some(Self::ZSet),
+			b't' => Some(Self::Stream),
+			b'b' => Some(Self::Bitmap),
+			b'x' => Some(Self::Extension),
 			_ => None,
 		}
 	}
@@ -10,6 +10,8 @@ pub enum DecoderError {
 	InvalidType,
 	#[error("Invalid data length")]
 	InvalidLength,
+	#[error("Invalid compressed value")]
+	InvalidCompression,
 }
 
 impl DecoderError {
@@ -19,6 +21,7 @@ impl DecoderError {
 			Self::Empty => "E0001",
 			Self::InvalidType => "E0002",
 			Self::InvalidLength => "E0003",
+			Self::InvalidCompression => "E0004",
 		}
 	}
 }
@@ -62,6 +65,15 @@ pub enum StorageError {
 	/// Object store configuration failed
 	#[error("Object store configuration failed: {message}")]
 	ObjectStoreConfig { message: String },
+
+	/// Command argument rejected by the storage layer, message is sent to the
+	/// client as is
+	#[error("{message}")]
+	InvalidArgument { message: String },
+
+	/// RDB file could not be decoded
+	#[error("Invalid RDB file: {message}")]
+	InvalidRdb { message: String },
 }
 
 impl StorageError {
@@ -74,6 +86,8 @@ impl StorageError {
 			Self::IoError { .. } => "E1003",
 			Self::DataInconsistency { .. } => "E1004",
 			Self::ObjectStoreConfig { .. } => "E1005",
+			Self::InvalidArgument { .. } => "E1006",
+			Self::InvalidRdb { .. } => "E1007",
 		}
 	}
 
@@ -188,6 +202,7 @@ mod tests {
 		assert_eq!(DecoderError::Empty.code(), "E0001");
 		assert_eq!(DecoderError::InvalidType.code(), "E0002");
 		assert_eq!(DecoderError::InvalidLength.code(), "E0003");
+		assert_eq!(DecoderError::InvalidCompression.code(), "E0004");
 	}
 
 	#[test]
@@ -196,6 +211,7 @@ mod tests {
 			DecoderError::Empty.code(),
 			DecoderError::InvalidType.code(),
 			DecoderError::InvalidLength.code(),
+			DecoderError::InvalidCompression.code(),
 		];
 		let unique_codes: std::collections::HashSet<_> = codes.iter().collect();
 		assert_eq!(
@@ -244,6 +260,17 @@ mod tests {
 			message: "test".into(),
 		};
 		assert_eq!(object_store_err.code(), "E1005");
+
+		let invalid_argument_err = StorageError::InvalidArgument {
+			message: "ERR test".into(),
+		};
+		assert_eq!(invalid_argument_err.code(), "E1006");
+		assert_eq!(invalid_argument_err.to_string(), "ERR test");
+
+		let invalid_rdb_err = StorageError::InvalidRdb {
+			message: "test".into(),
+		};
+		assert_eq!(invalid_rdb_err.code(), "E1007");
 	}
 
 	#[test]
@@ -264,7 +291,9 @@ mod tests {
 
 	#[test]
 	fn test_storage_error_codes_unique() {
-		let codes = ["E1000", "E1001", "E1002", "E1003", "E1004", "E1005"];
+		let codes = [
+			"E1000", "E1001", "E1002", "E1003", "E1004", "E1005", "E1006",
+		];
 		let unique_codes: std::collections::HashSet<_> = codes.iter().collect();
 		assert_eq!(
 			codes.len(),
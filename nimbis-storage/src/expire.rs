@@ -0,0 +1,112 @@
+//! Active expiry of keys whose expire time has passed.
+//!
+//! SlateDB stops returning a record once its expire time passes, but the
+//! record stays in its tables until compaction drops it, and nothing tells
+//! the server the key is gone until a command reads it. The key counts index
+//! the keys with an expire time by that time, so the keys past it are found
+//! without sampling or a walk. Each step deletes a batch of them under their
+//! key locks and tells the expire listener, like a read that finds one.
+
+use bytes::Bytes;
+use chrono::Utc;
+
+use crate::error::StorageError;
+use crate::storage::Storage;
+use crate::string::meta::MetaKey;
+use crate::utils::is_expired;
+
+/// The outcome of one active expire step.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct ExpireStep {
+	/// Keys the index had past their expire time.
+	pub due: u64,
+	/// Those that were deleted, leaving out keys written again since.
+	pub expired: u64,
+}
+
+impl Storage {
+	/// Delete up to `limit` keys whose expire time has passed, the longest
+	/// past it first. Each key is read again under its key lock, so a key
+	/// written again since it was found is left alone.
+	///
+	/// Like GC batches, the caller must not run a step while an atomic group
+	/// is open.
+	#[fastrace::trace]
+	pub async fn expire_step(&self, limit: usize) -> Result<ExpireStep, StorageError> {
+		let due = self.keyspace.due(Utc::now().timestamp_millis(), limit);
+		let mut step = ExpireStep {
+			due: due.len() as u64,
+			expired: 0,
+		};
+		for key in due {
+			let _guard = self.write_lock([key.clone()]).await;
+			if self.expire_key(&key).await? {
+				step.expired += 1;
+			}
+		}
+		Ok(step)
+	}
+
+	/// Delete `key` if its record is past its expire time. The caller holds
+	/// its key lock.
+	async fn expire_key(&self, key: &Bytes) -> Result<bool, StorageError> {
+		let encoded_key = MetaKey::new(key.clone()).encode();
+		match self.string_db.get_key_value(encoded_key).await? {
+			Some(kv) if !is_expired(kv.expire_ts) => Ok(false),
+			Some(_) => {
+				self.delete_expired(key).await?;
+				Ok(true)
+			}
+			// SlateDB hides the record already; only the index has the key.
+			None => Ok(self.forget_expired(key)),
+		}
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+
+	#[tokio::test]
+	async fn test_expire_step_deletes_keys_past_their_time() {
+		let timestamp = ulid::Ulid::new().to_string();
+		let path = std::env::temp_dir().join(format!("nimbis_test_expire_step_{}", timestamp));
+		std::fs::create_dir_all(&path).unwrap();
+		let storage = Storage::open(&path, None).await.unwrap();
+		let expired = std::sync::Arc::new(std::sync::Mutex::new(Vec::new()));
+		let listened = expired.clone();
+		storage.set_expire_listener(Box::new(move |key: &Bytes| {
+			listened.lock().unwrap().push(key.clone());
+		}));
+
+		let now = Utc::now().timestamp_millis() as u64;
+		for key in ["a", "b", "kept"] {
+			storage
+				.set(Bytes::from(key), Bytes::from("value"))
+				.await
+				.unwrap();
+		}
+		storage.expire(Bytes::from("a"), now + 50).await.unwrap();
+		storage.expire(Bytes::from("b"), now + 50).await.unwrap();
+		storage
+			.expire(Bytes::from("kept"), now + 60_000)
+			.await
+			.unwrap();
+		assert_eq!(storage.expire_step(10).await.unwrap().due, 0);
+
+		tokio::time::sleep(std::time::Duration::from_millis(100)).await;
+		let step = storage.expire_step(1).await.unwrap();
+		assert_eq!(step, ExpireStep { due: 1, expired: 1 });
+		let step = storage.expire_step(10).await.unwrap();
+		assert_eq!(step, ExpireStep { due: 1, expired: 1 });
+		assert_eq!(storage.expire_step(10).await.unwrap().due, 0);
+
+		let mut expired = expired.lock().unwrap().clone();
+		expired.sort();
+		assert_eq!(expired, vec![Bytes::from("a"), Bytes::from("b")]);
+		assert_eq!(storage.keyspace_counts().keys, 1);
+
+		storage.close().await.unwrap();
+		std::fs::remove_dir_all(path).unwrap();
+	}
+}
@@ -0,0 +1,349 @@
+//! Garbage collection of element data left behind by deleted or replaced
+//! collections.
+//!
+//! DEL, expiry and re-creation only replace a collection's metadata; its
+//! elements stay in their DB until compaction rewrites the tables holding
+//! them and the collection compaction filter drops them. Compaction only
+//! runs once enough data is written, so a quiet store can keep stale
+//! elements for a long time. GC walks the element DBs in batches, finds the
+//! records the compaction filter would drop, and deletes them right away, so
+//! the next compaction reclaims their space whatever the write load.
+
+use std::collections::BTreeMap;
+
+use bytes::BufMut;
+use bytes::Bytes;
+use bytes::BytesMut;
+use slatedb::WriteBatch;
+use slatedb::config::WriteOptions;
+
+use crate::compaction_filter::CollectionCompactionFilter;
+use crate::data_type::DataType;
+use crate::error::StorageError;
+use crate::storage::Storage;
+use crate::utils::user_key_prefix;
+
+/// Every DB holding collection elements, in the order GC walks them.
+pub const GC_DBS: [DataType; 6] = [
+	DataType::Hash,
+	DataType::List,
+	DataType::Set,
+	DataType::ZSet,
+	DataType::Stream,
+	DataType::Bitmap,
+];
+
+/// The outcome of one GC batch.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct GcStep {
+	/// Element records read.
+	pub scanned: u64,
+	/// Records of superseded generations that were deleted.
+	pub purged: u64,
+	/// Key and value bytes of the deleted records.
+	pub reclaimed_bytes: u64,
+	/// Where the next batch of the same DB starts, or `None` once the DB
+	/// has been walked to its end.
+	pub next: Option<Bytes>,
+}
+
+/// The user keys from `first` to `last`, both included, in byte order.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct KeyRange {
+	pub first: Bytes,
+	pub last: Bytes,
+}
+
+impl KeyRange {
+	pub fn contains(&self, key: &Bytes) -> bool {
+		self.first <= *key && *key <= self.last
+	}
+
+	/// Where the records of the keys of `len` bytes in the range start.
+	/// Records are ordered by key length first, so the keys of each length
+	/// in the range are next to each other, but those of different lengths
+	/// are not.
+	fn seek(&self, len: usize) -> Option<Bytes> {
+		let len = u16::try_from(len).ok()?;
+		let first = &self.first[..self.first.len().min(len as usize)];
+		let mut seek = BytesMut::with_capacity(2 + first.len());
+		seek.put_u16(len);
+		seek.extend_from_slice(first);
+		Some(seek.freeze())
+	}
+}
+
+impl Storage {
+	/// Read up to `limit` element records of the DB of `data_type`, starting
+	/// at `start` or at the first key, and delete those that no longer belong
+	/// to the current generation of their collection. Each collection is
+	/// checked again under its key lock before its records are deleted, so a
+	/// write racing with GC never loses data.
+	///
+	/// The caller must not run a batch while an atomic group is open: rolling
+	/// the group back could bring back metadata whose elements GC deleted.
+	#[fastrace::trace]
+	pub async fn gc_step(
+		&self,
+		data_type: DataType,
+		start: Option<Bytes>,
+		limit: usize,
+	) -> Result<GcStep, StorageError> {
+		self.gc_range(data_type, start.unwrap_or_default(), &[], None, limit)
+			.await
+	}
+
+	/// Like [`Storage::gc_step`], but only read the element records of the
+	/// keys in `range`, skipping over the records of other keys.
+	#[fastrace::trace]
+	pub async fn gc_range_step(
+		&self,
+		data_type: DataType,
+		range: &KeyRange,
+		start: Option<Bytes>,
+		limit: usize,
+	) -> Result<GcStep, StorageError> {
+		let Some(start) = start.or_else(|| range.seek(0)) else {
+			return Ok(GcStep::default());
+		};
+		self.gc_range(data_type, start, &[], Some(range), limit)
+			.await
+	}
+
+	/// Like [`Storage::gc_step`], but only read the element records of
+	/// `key`, starting at `start` or at its first record. `next` is `None`
+	/// once every record of the key has been read.
+	#[fastrace::trace]
+	pub async fn gc_key_step(
+		&self,
+		data_type: DataType,
+		key: &Bytes,
+		start: Option<Bytes>,
+		limit: usize,
+	) -> Result<GcStep, StorageError> {
+		let prefix = user_key_prefix(key);
+		let start = start.unwrap_or_else(|| prefix.clone());
+		self.gc_range(data_type, start, &prefix, None, limit).await
+	}
+
+	/// Run a GC batch over the records from `start` on that begin with
+	/// `prefix` and, with a `range`, belong to a key in it.
+	async fn gc_range(
+		&self,
+		data_type: DataType,
+		start: Bytes,
+		prefix: &[u8],
+		range: Option<&KeyRange>,
+		limit: usize,
+	) -> Result<GcStep, StorageError> {
+		let db = self.db(data_type);
+		let mut step = GcStep::default();
+		// Stale records by user key, with the seq they were read at.
+		let mut stale: BTreeMap<Bytes, Vec<(Bytes, u64)>> = BTreeMap::new();
+
+		let mut stream = db.scan(start..).await?;
+		while let Some(kv) = stream.next().await? {
+			if !kv.key.starts_with(prefix) {
+				break;
+			}
+			if step.scanned as usize == limit {
+				// The next batch starts at the record not read yet.
+				step.next = Some(kv.key);
+				break;
+			}
+			step.scanned += 1;
+			// Records with keys GC cannot read are left to the compaction
+			// filter, which keeps them too.
+			let Some(user_key) = CollectionCompactionFilter::decode_sub_key(&kv.key) else {
+				continue;
+			};
+			if let Some(range) = range
+				&& !range.contains(&user_key)
+			{
+				// Skip to the next key of the range: the first one of this
+				// length, or of the next length once past the last one.
+				let len = user_key.len() + (user_key > range.last) as usize;
+				match range.seek(len) {
+					Some(seek) if seek > kv.key => stream = db.scan(seek..).await?,
+					Some(_) => {}
+					None => break,
+				}
+				continue;
+			}
+			if !self.is_live_element(data_type, &kv.key, kv.seq).await? {
+				stale.entry(user_key).or_default().push((kv.key, kv.seq));
+			}
+		}
+		drop(stream);
+
+		if stale.is_empty() {
+			return Ok(step);
+		}
+
+		let _guard = self.write_lock(stale.keys().cloned()).await;
+		let mut batch = WriteBatch::new();
+		for (key, seq) in stale.into_values().flatten() {
+			// A record written since the scan belongs to a new generation.
+			let Some(kv) = db.get_key_value(key.clone()).await? else {
+				continue;
+			};
+			if kv.seq != seq || self.is_live_element(data_type, &key, seq).await? {
+				continue;
+			}
+			step.purged += 1;
+			step.reclaimed_bytes += (kv.key.len() + kv.value.len()) as u64;
+			batch.delete(key);
+		}
+		if step.purged > 0 {
+			let write_opts = WriteOptions {
+				await_durable: false,
+			};
+			db.write_with_options(batch, &write_opts).await?;
+		}
+		Ok(step)
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+
+	async fn get_storage() -> (Storage, std::path::PathBuf) {
+		let timestamp = ulid::Ulid::new().to_string();
+		let path = std::env::temp_dir().join(format!("nimbis_test_{}", timestamp));
+		std::fs::create_dir_all(&path).unwrap();
+		let storage = Storage::open(&path, None).await.unwrap();
+		(storage, path)
+	}
+
+	#[tokio::test]
+	async fn test_gc_step_purges_old_generations() {
+		let (storage, path) = get_storage().await;
+		let key = Bytes::from("hash");
+
+		for field in ["a", "b", "c"] {
+			storage
+				.hset(key.clone(), Bytes::from(field), Bytes::from("v"))
+				.await
+				.unwrap();
+		}
+		storage.del([key.clone()]).await.unwrap();
+		storage
+			.hset(key.clone(), Bytes::from("d"), Bytes::from("v"))
+			.await
+			.unwrap();
+
+		// A small limit walks the DB over several batches.
+		let mut total = GcStep::default();
+		let mut start = None;
+		loop {
+			let step = storage.gc_step(DataType::Hash, start, 2).await.unwrap();
+			total.scanned += step.scanned;
+			total.purged += step.purged;
+			total.reclaimed_bytes += step.reclaimed_bytes;
+			start = step.next;
+			if start.is_none() {
+				break;
+			}
+		}
+		assert_eq!(total.scanned, 4);
+		assert_eq!(total.purged, 3);
+		assert!(total.reclaimed_bytes > 0);
+
+		assert_eq!(
+			storage.hgetall(key.clone()).await.unwrap(),
+			vec![(Bytes::from("d"), Bytes::from("v"))]
+		);
+		let step = storage.gc_step(DataType::Hash, None, 100).await.unwrap();
+		assert_eq!((step.scanned, step.purged, step.next), (1, 0, None));
+
+		storage.close().await.unwrap();
+		let _ = std::fs::remove_dir_all(path);
+	}
+
+	#[tokio::test]
+	async fn test_gc_key_step_only_reads_its_key() {
+		let (storage, path) = get_storage().await;
+		for key in ["a", "b"] {
+			for field in ["x", "y", "z"] {
+				storage
+					.hset(Bytes::from(key), Bytes::from(field), Bytes::from("v"))
+					.await
+					.unwrap();
+			}
+		}
+		storage
+			.del([Bytes::from("a"), Bytes::from("b")])
+			.await
+			.unwrap();
+
+		let key = Bytes::from("a");
+		let mut total = GcStep::default();
+		let mut start = None;
+		loop {
+			let step = storage
+				.gc_key_step(DataType::Hash, &key, start, 2)
+				.await
+				.unwrap();
+			total.scanned += step.scanned;
+			total.purged += step.purged;
+			start = step.next;
+			if start.is_none() {
+				break;
+			}
+		}
+		assert_eq!(total.purged, 3);
+
+		// The records of "b" are left to GC passes.
+		let step = storage.gc_step(DataType::Hash, None, 100).await.unwrap();
+		assert_eq!((step.scanned, step.purged), (3, 3));
+
+		storage.close().await.unwrap();
+		let _ = std::fs::remove_dir_all(path);
+	}
+
+	#[tokio::test]
+	async fn test_gc_range_step_only_reads_keys_in_range() {
+		let (storage, path) = get_storage().await;
+		let keys = ["a", "b", "ba", "bzz", "c", "zz"];
+		for key in keys {
+			for field in ["x", "y"] {
+				storage
+					.hset(Bytes::from(key), Bytes::from(field), Bytes::from("v"))
+					.await
+					.unwrap();
+			}
+		}
+		storage.del(keys.map(Bytes::from)).await.unwrap();
+
+		let range = KeyRange {
+			first: Bytes::from("b"),
+			last: Bytes::from("bz"),
+		};
+		assert!(range.contains(&Bytes::from("ba")));
+		assert!(!range.contains(&Bytes::from("bzz")));
+
+		// A small limit resumes where the last batch stopped.
+		let mut purged = 0;
+		let mut start = None;
+		loop {
+			let step = storage
+				.gc_range_step(DataType::Hash, &range, start, 1)
+				.await
+				.unwrap();
+			purged += step.purged;
+			start = step.next;
+			if start.is_none() {
+				break;
+			}
+		}
+		assert_eq!(purged, 4);
+
+		// The records of the other keys are left to GC passes.
+		let step = storage.gc_step(DataType::Hash, None, 100).await.unwrap();
+		assert_eq!((step.scanned, step.purged), (8, 8));
+
+		storage.close().await.unwrap();
+		let _ = std::fs::remove_dir_all(path);
+	}
+}
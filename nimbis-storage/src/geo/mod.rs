@@ -0,0 +1,256 @@
+//! Geohash encoding of coordinates into sorted set scores, compatible with
+//! Redis: 26 bits per axis interleaved into a 52-bit integer, which a double
+//! score holds exactly.
+
+pub mod search;
+
+/// Bits per axis of a score.
+pub const GEO_STEP_MAX: u32 = 26;
+pub const GEO_LONG_MIN: f64 = -180.0;
+pub const GEO_LONG_MAX: f64 = 180.0;
+/// Latitudes are limited to the range of Web Mercator, like in Redis.
+pub const GEO_LAT_MIN: f64 = -85.05112878;
+pub const GEO_LAT_MAX: f64 = 85.05112878;
+/// Earth radius used by Redis for distances.
+pub const EARTH_RADIUS_IN_METERS: f64 = 6372797.560856;
+
+const GEOHASH_ALPHABET: &[u8] = b"0123456789bcdefghjkmnpqrstuvwxyz";
+
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub struct GeoPoint {
+	pub longitude: f64,
+	pub latitude: f64,
+}
+
+impl GeoPoint {
+	/// A point, or `None` if the coordinates cannot be indexed.
+	pub fn new(longitude: f64, latitude: f64) -> Option<Self> {
+		((GEO_LONG_MIN..=GEO_LONG_MAX).contains(&longitude)
+			&& (GEO_LAT_MIN..=GEO_LAT_MAX).contains(&latitude))
+		.then_some(Self {
+			longitude,
+			latitude,
+		})
+	}
+
+	/// The sorted set score of the point.
+	pub fn score(&self) -> f64 {
+		encode(
+			self.longitude,
+			self.latitude,
+			(GEO_LONG_MIN, GEO_LONG_MAX),
+			(GEO_LAT_MIN, GEO_LAT_MAX),
+			GEO_STEP_MAX,
+		) as f64
+	}
+
+	/// The center of the cell a score stands for, which is what reads of
+	/// stored points return.
+	pub fn from_score(score: f64) -> Self {
+		let (ilat, ilong) = deinterleave(score as u64);
+		let cells = (1u64 << GEO_STEP_MAX) as f64;
+		let lat_scale = GEO_LAT_MAX - GEO_LAT_MIN;
+		let long_scale = GEO_LONG_MAX - GEO_LONG_MIN;
+
+		let lat_min = GEO_LAT_MIN + (ilat as f64 / cells) * lat_scale;
+		let lat_max = GEO_LAT_MIN + ((ilat as f64 + 1.0) / cells) * lat_scale;
+		let long_min = GEO_LONG_MIN + (ilong as f64 / cells) * long_scale;
+		let long_max = GEO_LONG_MIN + ((ilong as f64 + 1.0) / cells) * long_scale;
+		Self {
+			longitude: ((long_min + long_max) / 2.0).clamp(GEO_LONG_MIN, GEO_LONG_MAX),
+			latitude: ((lat_min + lat_max) / 2.0).clamp(GEO_LAT_MIN, GEO_LAT_MAX),
+		}
+	}
+
+	/// Great-circle distance to `other` in meters, by the haversine formula.
+	pub fn distance(&self, other: &GeoPoint) -> f64 {
+		let lon1r = self.longitude.to_radians();
+		let lon2r = other.longitude.to_radians();
+		let v = ((lon2r - lon1r) / 2.0).sin();
+		// Points on the same meridian only differ in latitude.
+		if v == 0.0 {
+			return EARTH_RADIUS_IN_METERS
+				* (other.latitude.to_radians() - self.latitude.to_radians()).abs();
+		}
+		let lat1r = self.latitude.to_radians();
+		let lat2r = other.latitude.to_radians();
+		let u = ((lat2r - lat1r) / 2.0).sin();
+		let a = u * u + lat1r.cos() * lat2r.cos() * v * v;
+		2.0 * EARTH_RADIUS_IN_METERS * a.sqrt().asin()
+	}
+
+	/// The standard 11 character geohash of the point, which uses the full
+	/// latitude range unlike scores.
+	pub fn geohash(&self) -> String {
+		let bits = encode(
+			self.longitude,
+			self.latitude,
+			(-180.0, 180.0),
+			(-90.0, 90.0),
+			GEO_STEP_MAX,
+		);
+		(0..11)
+			.map(|i| {
+				// 52 bits fill 10 characters and a bit; the last one is '0'.
+				let index = if i == 10 {
+					0
+				} else {
+					(bits >> (52 - (i + 1) * 5)) & 0x1F
+				};
+				GEOHASH_ALPHABET[index as usize] as char
+			})
+			.collect()
+	}
+}
+
+/// Units GEO commands take distances in.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum GeoUnit {
+	Meters,
+	Kilometers,
+	Miles,
+	Feet,
+}
+
+impl GeoUnit {
+	pub fn parse(unit: &[u8]) -> Option<Self> {
+		match unit.to_ascii_lowercase().as_slice() {
+			b"m" => Some(Self::Meters),
+			b"km" => Some(Self::Kilometers),
+			b"mi" => Some(Self::Miles),
+			b"ft" => Some(Self::Feet),
+			_ => None,
+		}
+	}
+
+	/// Meters in one unit.
+	pub fn meters(&self) -> f64 {
+		match self {
+			Self::Meters => 1.0,
+			Self::Kilometers => 1000.0,
+			Self::Miles => 1609.34,
+			Self::Feet => 0.3048,
+		}
+	}
+}
+
+/// Interleave the cell indexes of `longitude` and `latitude` within the
+/// ranges, with latitude in the even bits.
+fn encode(
+	longitude: f64,
+	latitude: f64,
+	long_range: (f64, f64),
+	lat_range: (f64, f64),
+	step: u32,
+) -> u64 {
+	let cells = (1u64 << step) as f64;
+	let lat_offset = (latitude - lat_range.0) / (lat_range.1 - lat_range.0) * cells;
+	let long_offset = (longitude - long_range.0) / (long_range.1 - long_range.0) * cells;
+	// The maximum of a range falls in the last cell.
+	let max = (1u64 << step) - 1;
+	interleave((lat_offset as u64).min(max), (long_offset as u64).min(max))
+}
+
+/// Spread the low 32 bits of `x` over the even bits and those of `y` over
+/// the odd bits.
+fn interleave(x: u64, y: u64) -> u64 {
+	spread(x) | (spread(y) << 1)
+}
+
+/// Undo [`interleave`], returning the even and odd bits.
+fn deinterleave(bits: u64) -> (u64, u64) {
+	(squash(bits), squash(bits >> 1))
+}
+
+fn spread(mut x: u64) -> u64 {
+	x &= 0xFFFF_FFFF;
+	x = (x | (x << 16)) & 0x0000_FFFF_0000_FFFF;
+	x = (x | (x << 8)) & 0x00FF_00FF_00FF_00FF;
+	x = (x | (x << 4)) & 0x0F0F_0F0F_0F0F_0F0F;
+	x = (x | (x << 2)) & 0x3333_3333_3333_3333;
+	(x | (x << 1)) & 0x5555_5555_5555_5555
+}
+
+fn squash(mut x: u64) -> u64 {
+	x &= 0x5555_5555_5555_5555;
+	x = (x | (x >> 1)) & 0x3333_3333_3333_3333;
+	x = (x | (x >> 2)) & 0x0F0F_0F0F_0F0F_0F0F;
+	x = (x | (x >> 4)) & 0x00FF_00FF_00FF_00FF;
+	x = (x | (x >> 8)) & 0x0000_FFFF_0000_FFFF;
+	(x | (x >> 16)) & 0x0000_0000_FFFF_FFFF
+}
+
+#[cfg(test)]
+mod tests {
+	use rstest::rstest;
+
+	use super::*;
+
+	fn palermo() -> GeoPoint {
+		GeoPoint::new(13.361389, 38.115556).unwrap()
+	}
+
+	fn catania() -> GeoPoint {
+		GeoPoint::new(15.087269, 37.502669).unwrap()
+	}
+
+	#[test]
+	fn test_interleave() {
+		assert_eq!(interleave(0b11, 0b00), 0b0101);
+		assert_eq!(interleave(0b00, 0b11), 0b1010);
+		for (x, y) in [(0, 0), (1, 2), (0x3FF_FFFF, 0x155_5555)] {
+			assert_eq!(deinterleave(interleave(x, y)), (x, y));
+		}
+	}
+
+	#[test]
+	fn test_score_roundtrip() {
+		// Scores from the Redis GEOADD documentation example.
+		assert_eq!(palermo().score(), 3479099956230698.0);
+		assert_eq!(catania().score(), 3479447370796909.0);
+
+		let point = GeoPoint::from_score(palermo().score());
+		assert!((point.longitude - 13.361389).abs() < 1e-5);
+		assert!((point.latitude - 38.115556).abs() < 1e-5);
+	}
+
+	#[test]
+	fn test_distance() {
+		let (a, b) = (
+			GeoPoint::from_score(palermo().score()),
+			GeoPoint::from_score(catania().score()),
+		);
+		// Redis replies 166274.1516 for GEODIST Sicily Palermo Catania.
+		assert_eq!(format!("{:.4}", a.distance(&b)), "166274.1516");
+		assert_eq!(a.distance(&a), 0.0);
+	}
+
+	#[test]
+	fn test_geohash() {
+		// Redis replies sqc8b49rny0 and sqdtr74hyu0 for GEOHASH.
+		assert_eq!(
+			GeoPoint::from_score(palermo().score()).geohash(),
+			"sqc8b49rny0"
+		);
+		assert_eq!(
+			GeoPoint::from_score(catania().score()).geohash(),
+			"sqdtr74hyu0"
+		);
+	}
+
+	#[rstest]
+	#[case(180.1, 0.0)]
+	#[case(-180.1, 0.0)]
+	#[case(0.0, 85.06)]
+	#[case(0.0, -90.0)]
+	fn test_invalid_point(#[case] longitude: f64, #[case] latitude: f64) {
+		assert_eq!(GeoPoint::new(longitude, latitude), None);
+	}
+
+	#[test]
+	fn test_unit() {
+		assert_eq!(GeoUnit::parse(b"KM"), Some(GeoUnit::Kilometers));
+		assert_eq!(GeoUnit::parse(b"yd"), None);
+		assert_eq!(GeoUnit::Feet.meters(), 0.3048);
+	}
+}
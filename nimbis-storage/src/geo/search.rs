@@ -0,0 +1,300 @@
+//! Areas of GEOSEARCH queries. Like Redis, a query scans the geohash cell of
+//! its center, at a step about the size of the shape, and the neighbours of
+//! that cell the shape may reach, instead of the whole sorted set.
+
+use super::EARTH_RADIUS_IN_METERS;
+use super::GEO_LAT_MAX;
+use super::GEO_LAT_MIN;
+use super::GEO_LONG_MAX;
+use super::GEO_LONG_MIN;
+use super::GEO_STEP_MAX;
+use super::GeoPoint;
+use super::deinterleave;
+use super::encode;
+use super::interleave;
+
+/// Half the circumference of the Web Mercator world in meters.
+const MERCATOR_MAX: f64 = 20037726.37;
+
+/// Shape of a search around its center, in meters.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum GeoShape {
+	Radius(f64),
+	Box { width: f64, height: f64 },
+}
+
+impl GeoShape {
+	/// Distance from `center` to `point` in meters, or `None` if the point is
+	/// outside the shape.
+	pub fn distance_if_within(&self, center: &GeoPoint, point: &GeoPoint) -> Option<f64> {
+		match *self {
+			Self::Radius(radius) => {
+				let distance = center.distance(point);
+				(distance <= radius).then_some(distance)
+			}
+			Self::Box { width, height } => {
+				// The latitude distance is the cheaper one, so it goes first.
+				let lat_distance =
+					EARTH_RADIUS_IN_METERS * (point.latitude - center.latitude).to_radians().abs();
+				if lat_distance > height / 2.0 {
+					return None;
+				}
+				let aligned = GeoPoint {
+					longitude: center.longitude,
+					latitude: point.latitude,
+				};
+				if point.distance(&aligned) > width / 2.0 {
+					return None;
+				}
+				Some(center.distance(point))
+			}
+		}
+	}
+
+	/// Distance from the center to the farthest point of the shape.
+	fn radius(&self) -> f64 {
+		match *self {
+			Self::Radius(radius) => radius,
+			Self::Box { width, height } => (width / 2.0).hypot(height / 2.0),
+		}
+	}
+
+	/// The `(min_long, min_lat, max_long, max_lat)` box around the shape.
+	fn bounding_box(&self, center: &GeoPoint) -> (f64, f64, f64, f64) {
+		let (half_width, half_height) = match *self {
+			Self::Radius(radius) => (radius, radius),
+			Self::Box { width, height } => (width / 2.0, height / 2.0),
+		};
+		let lat_delta = (half_height / EARTH_RADIUS_IN_METERS).to_degrees();
+		let long_delta = |latitude: f64| {
+			(half_width / EARTH_RADIUS_IN_METERS / latitude.to_radians().cos()).to_degrees()
+		};
+		// The side nearer to the pole is the wider one.
+		let long_delta = if center.latitude < 0.0 {
+			long_delta(center.latitude - lat_delta)
+		} else {
+			long_delta(center.latitude + lat_delta)
+		};
+		(
+			center.longitude - long_delta,
+			center.latitude - lat_delta,
+			center.longitude + long_delta,
+			center.latitude + lat_delta,
+		)
+	}
+}
+
+/// Score ranges, as `(min, max)` with `max` excluded, holding every point of
+/// `shape` around `center`.
+pub fn search_ranges(center: &GeoPoint, shape: &GeoShape) -> Vec<(f64, f64)> {
+	let (min_long, min_lat, max_long, max_lat) = shape.bounding_box(center);
+	let mut cell = Cell::new(center, estimate_step(shape.radius(), center.latitude));
+
+	// Near the border of the center cell, the neighbours may not reach the
+	// edge of the shape; use larger cells then.
+	let too_small = cell.moved(1, 0).area().lat_max < max_lat
+		|| cell.moved(-1, 0).area().lat_min > min_lat
+		|| cell.moved(0, 1).area().long_max < max_long
+		|| cell.moved(0, -1).area().long_min > min_long;
+	if cell.step > 1 && too_small {
+		cell = Cell::new(center, cell.step - 1);
+	}
+
+	// Skip the neighbours on the sides the shape does not cross.
+	let area = cell.area();
+	let prune = cell.step >= 2;
+	let skip_south = prune && area.lat_min < min_lat;
+	let skip_north = prune && area.lat_max > max_lat;
+	let skip_west = prune && area.long_min < min_long;
+	let skip_east = prune && area.long_max > max_long;
+
+	let mut ranges = Vec::with_capacity(9);
+	for (lat, long) in [
+		(0, 0),
+		(1, 0),
+		(-1, 0),
+		(0, 1),
+		(0, -1),
+		(1, 1),
+		(1, -1),
+		(-1, 1),
+		(-1, -1),
+	] {
+		if (lat == -1 && skip_south)
+			|| (lat == 1 && skip_north)
+			|| (long == -1 && skip_west)
+			|| (long == 1 && skip_east)
+		{
+			continue;
+		}
+		// Huge shapes wrap around, making neighbours the same cell.
+		let range = cell.moved(lat, long).score_range();
+		if !ranges.contains(&range) {
+			ranges.push(range);
+		}
+	}
+	ranges
+}
+
+/// The step whose cells are about the size of `radius` meters around
+/// `latitude`.
+fn estimate_step(mut radius: f64, latitude: f64) -> u32 {
+	if radius == 0.0 {
+		return GEO_STEP_MAX;
+	}
+	let mut step: i32 = 1;
+	while radius < MERCATOR_MAX {
+		radius *= 2.0;
+		step += 1;
+	}
+	// Make sure the radius fits in most cases.
+	step -= 2;
+	// Cells get narrower towards the poles.
+	if latitude.abs() > 66.0 {
+		step -= 1;
+		if latitude.abs() > 80.0 {
+			step -= 1;
+		}
+	}
+	step.clamp(1, GEO_STEP_MAX as i32) as u32
+}
+
+/// A geohash cell at some step, by the indexes of its latitude and
+/// longitude intervals.
+#[derive(Debug, Clone, Copy)]
+struct Cell {
+	lat: u64,
+	long: u64,
+	step: u32,
+}
+
+struct Area {
+	long_min: f64,
+	long_max: f64,
+	lat_min: f64,
+	lat_max: f64,
+}
+
+impl Cell {
+	fn new(point: &GeoPoint, step: u32) -> Self {
+		let bits = encode(
+			point.longitude,
+			point.latitude,
+			(GEO_LONG_MIN, GEO_LONG_MAX),
+			(GEO_LAT_MIN, GEO_LAT_MAX),
+			step,
+		);
+		let (lat, long) = deinterleave(bits);
+		Self { lat, long, step }
+	}
+
+	/// The cell `lat` rows north and `long` columns east, wrapping around.
+	fn moved(&self, lat: i64, long: i64) -> Self {
+		let cells = 1i64 << self.step;
+		Self {
+			lat: (self.lat as i64 + lat).rem_euclid(cells) as u64,
+			long: (self.long as i64 + long).rem_euclid(cells) as u64,
+			step: self.step,
+		}
+	}
+
+	fn area(&self) -> Area {
+		let cells = (1u64 << self.step) as f64;
+		let lat_scale = GEO_LAT_MAX - GEO_LAT_MIN;
+		let long_scale = GEO_LONG_MAX - GEO_LONG_MIN;
+		Area {
+			long_min: GEO_LONG_MIN + (self.long as f64 / cells) * long_scale,
+			long_max: GEO_LONG_MIN + ((self.long as f64 + 1.0) / cells) * long_scale,
+			lat_min: GEO_LAT_MIN + (self.lat as f64 / cells) * lat_scale,
+			lat_max: GEO_LAT_MIN + ((self.lat as f64 + 1.0) / cells) * lat_scale,
+		}
+	}
+
+	/// Scores of the full precision points inside the cell.
+	fn score_range(&self) -> (f64, f64) {
+		let shift = 2 * (GEO_STEP_MAX - self.step);
+		let bits = interleave(self.lat, self.long);
+		((bits << shift) as f64, ((bits + 1) << shift) as f64)
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+
+	fn contains(ranges: &[(f64, f64)], point: &GeoPoint) -> bool {
+		let score = point.score();
+		ranges.iter().any(|&(min, max)| min <= score && score < max)
+	}
+
+	#[test]
+	fn test_estimate_step() {
+		assert_eq!(estimate_step(0.0, 0.0), GEO_STEP_MAX);
+		assert_eq!(estimate_step(1000.0, 0.0), 14);
+		assert_eq!(estimate_step(1000.0, 70.0), 13);
+		assert_eq!(estimate_step(1000.0, -85.0), 12);
+		assert_eq!(estimate_step(1e9, 0.0), 1);
+	}
+
+	#[test]
+	fn test_search_ranges_cover_shape() {
+		let center = GeoPoint::new(15.0, 37.0).unwrap();
+		let shapes = [
+			GeoShape::Radius(200_000.0),
+			GeoShape::Box {
+				width: 400_000.0,
+				height: 100_000.0,
+			},
+		];
+		for shape in shapes {
+			let ranges = search_ranges(&center, &shape);
+			assert!(ranges.len() <= 9);
+			for i in 0..100 {
+				let angle = i as f64 / 100.0 * std::f64::consts::TAU;
+				let point = GeoPoint::new(
+					center.longitude + 1.5 * angle.cos(),
+					center.latitude + 0.4 * angle.sin(),
+				)
+				.unwrap();
+				if shape.distance_if_within(&center, &point).is_some() {
+					assert!(contains(&ranges, &point), "{shape:?} misses {point:?}");
+				}
+			}
+		}
+	}
+
+	#[test]
+	fn test_search_ranges_huge_radius() {
+		let center = GeoPoint::new(0.0, 0.0).unwrap();
+		// The four cells of step 1, each once.
+		let ranges = search_ranges(&center, &GeoShape::Radius(2e7));
+		assert_eq!(ranges.len(), 4);
+		assert!(contains(&ranges, &GeoPoint::new(179.0, 80.0).unwrap()));
+	}
+
+	#[test]
+	fn test_distance_if_within() {
+		let center = GeoPoint::new(15.0, 37.0).unwrap();
+		let point = GeoPoint::new(15.0, 37.5).unwrap();
+		let distance = center.distance(&point);
+		assert_eq!(
+			GeoShape::Radius(distance + 1.0).distance_if_within(&center, &point),
+			Some(distance)
+		);
+		assert_eq!(
+			GeoShape::Radius(distance - 1.0).distance_if_within(&center, &point),
+			None
+		);
+
+		let wide = GeoShape::Box {
+			width: 1000.0,
+			height: 2.0 * distance + 2.0,
+		};
+		assert_eq!(wide.distance_if_within(&center, &point), Some(distance));
+		let flat = GeoShape::Box {
+			width: 2.0 * distance + 2.0,
+			height: 1000.0,
+		};
+		assert_eq!(flat.distance_if_within(&center, &point), None);
+	}
+}
@@ -0,0 +1,73 @@
+use super::HLL_P;
+use super::HLL_Q;
+use super::HLL_REGISTERS;
+
+/// Seed Redis hashes HyperLogLog elements with.
+const SEED: u64 = 0xadc83b19;
+
+/// MurmurHash64A, the hash Redis uses for HyperLogLog elements, reading
+/// blocks as little-endian.
+pub fn murmur_hash64a(data: &[u8], seed: u64) -> u64 {
+	const M: u64 = 0xc6a4a7935bd1e995;
+	const R: u32 = 47;
+
+	let mut h = seed ^ (data.len() as u64).wrapping_mul(M);
+	let mut blocks = data.chunks_exact(8);
+	for block in &mut blocks {
+		let mut k = u64::from_le_bytes(block.try_into().unwrap());
+		k = k.wrapping_mul(M);
+		k ^= k >> R;
+		k = k.wrapping_mul(M);
+		h ^= k;
+		h = h.wrapping_mul(M);
+	}
+
+	let tail = blocks.remainder();
+	if !tail.is_empty() {
+		for (i, byte) in tail.iter().enumerate() {
+			h ^= (*byte as u64) << (8 * i);
+		}
+		h = h.wrapping_mul(M);
+	}
+
+	h ^= h >> R;
+	h = h.wrapping_mul(M);
+	h ^= h >> R;
+	h
+}
+
+/// The register `element` maps to, and the length of the run of zeros in
+/// the rest of its hash plus one: the value the register must reach.
+pub fn pattern(element: &[u8]) -> (usize, u8) {
+	let hash = murmur_hash64a(element, SEED);
+	let index = (hash as usize) & (HLL_REGISTERS - 1);
+	// Cap the run so the count fits in a register.
+	let rest = (hash >> HLL_P) | (1 << HLL_Q);
+	(index, rest.trailing_zeros() as u8 + 1)
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+
+	#[test]
+	fn test_murmur_hash64a() {
+		assert_eq!(murmur_hash64a(b"", 0), 0);
+		// Every tail length hashes differently from its neighbours.
+		let hashes: Vec<u64> = (0..=16)
+			.map(|len| murmur_hash64a(&b"abcdefghijklmnop"[..len], SEED))
+			.collect();
+		for pair in hashes.windows(2) {
+			assert_ne!(pair[0], pair[1]);
+		}
+	}
+
+	#[test]
+	fn test_pattern() {
+		for element in [&b"a"[..], b"hello", b"nimbis"] {
+			let (index, count) = pattern(element);
+			assert!(index < HLL_REGISTERS);
+			assert!((1..=(HLL_Q + 1) as u8).contains(&count));
+		}
+	}
+}
@@ -0,0 +1,21 @@
+pub mod hash;
+pub mod sketch;
+
+/// Number of bits of the hash that select a register.
+pub const HLL_P: u32 = 14;
+/// Number of registers.
+pub const HLL_REGISTERS: usize = 1 << HLL_P;
+/// Number of hash bits left to count leading zeros in.
+pub const HLL_Q: u32 = 64 - HLL_P;
+/// Sparse encodings above this many bytes are converted to dense, like the
+/// `hll-sparse-max-bytes` default of Redis.
+pub const HLL_SPARSE_MAX_BYTES: usize = 3000;
+
+/// Why a string could not be read as a HyperLogLog.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum HllError {
+	/// The string does not have a valid header.
+	NotHll,
+	/// The header is valid but the registers are not.
+	Corrupted,
+}
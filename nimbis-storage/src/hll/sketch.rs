@@ -0,0 +1,386 @@
+use bytes::BufMut;
+use bytes::Bytes;
+use bytes::BytesMut;
+
+use super::HLL_Q;
+use super::HLL_REGISTERS;
+use super::HLL_SPARSE_MAX_BYTES;
+use super::HllError;
+use super::hash;
+
+const MAGIC: &[u8] = b"HYLL";
+/// Magic, encoding, three unused bytes and the cached cardinality.
+const HDR_SIZE: usize = 16;
+const ENCODING_DENSE: u8 = 0;
+const ENCODING_SPARSE: u8 = 1;
+/// Dense registers are packed 6 bits each.
+const REGISTER_BITS: usize = 6;
+const REGISTER_MAX: u8 = (1 << REGISTER_BITS) - 1;
+const DENSE_SIZE: usize = HDR_SIZE + (HLL_REGISTERS * REGISTER_BITS).div_ceil(8);
+/// Set in the last cardinality byte when the cached value is stale.
+const CACHE_INVALID: u8 = 0x80;
+
+// Sparse opcodes: ZERO `00xxxxxx` covers up to 64 zero registers, XZERO
+// `01xxxxxx yyyyyyyy` up to 16384, and VAL `1vvvvvxx` up to 4 registers
+// holding a value of at most 32.
+const ZERO_MAX_LEN: usize = 64;
+const XZERO_MAX_LEN: usize = 16384;
+const VAL_MAX_LEN: usize = 4;
+const VAL_MAX_VALUE: u8 = 32;
+
+const ALPHA_INF: f64 = 0.721_347_520_444_481_7;
+
+/// A HyperLogLog with 16384 registers, read from and written to the string
+/// format of Redis so values can move between the two.
+///
+/// Registers are kept unpacked in memory. `dense` tracks the encoding the
+/// value was read in: like Redis, a dense value never goes back to sparse.
+#[derive(Debug, Clone, PartialEq)]
+pub struct HyperLogLog {
+	registers: Vec<u8>,
+	dense: bool,
+}
+
+impl Default for HyperLogLog {
+	fn default() -> Self {
+		Self::new()
+	}
+}
+
+impl HyperLogLog {
+	/// An empty HyperLogLog, which encodes as sparse.
+	pub fn new() -> Self {
+		Self {
+			registers: vec![0; HLL_REGISTERS],
+			dense: false,
+		}
+	}
+
+	pub fn decode(bytes: &[u8]) -> Result<Self, HllError> {
+		if bytes.len() < HDR_SIZE || &bytes[..MAGIC.len()] != MAGIC {
+			return Err(HllError::NotHll);
+		}
+		let data = &bytes[HDR_SIZE..];
+		match bytes[MAGIC.len()] {
+			ENCODING_DENSE if bytes.len() == DENSE_SIZE => Ok(Self {
+				registers: (0..HLL_REGISTERS)
+					.map(|index| dense_get(data, index))
+					.collect(),
+				dense: true,
+			}),
+			ENCODING_SPARSE => Ok(Self {
+				registers: sparse_decode(data)?,
+				dense: false,
+			}),
+			_ => Err(HllError::NotHll),
+		}
+	}
+
+	/// The cardinality cached in the header of an encoded HyperLogLog, if it
+	/// is present and up to date.
+	pub fn cached_count(bytes: &[u8]) -> Option<u64> {
+		let card: [u8; 8] = bytes.get(8..HDR_SIZE)?.try_into().ok()?;
+		(card[7] & CACHE_INVALID == 0).then(|| u64::from_le_bytes(card))
+	}
+
+	/// Encode as sparse if the value is still sparse and fits, else as
+	/// dense. The header caches the current cardinality.
+	pub fn encode(&self) -> Bytes {
+		if !self.dense
+			&& let Some(bytes) = self.encode_sparse()
+		{
+			return bytes;
+		}
+
+		let mut bytes = BytesMut::zeroed(DENSE_SIZE);
+		self.put_header(&mut bytes, ENCODING_DENSE);
+		let data = &mut bytes[HDR_SIZE..];
+		for (index, value) in self.registers.iter().enumerate() {
+			dense_set(data, index, *value);
+		}
+		bytes.freeze()
+	}
+
+	/// Add `element`, returning whether a register changed.
+	pub fn add(&mut self, element: &[u8]) -> bool {
+		let (index, count) = hash::pattern(element);
+		if count > self.registers[index] {
+			self.registers[index] = count;
+			true
+		} else {
+			false
+		}
+	}
+
+	/// Merge `other` in, so this counts the union of both. The result is
+	/// dense if either side is.
+	pub fn merge(&mut self, other: &HyperLogLog) {
+		for (register, value) in self.registers.iter_mut().zip(&other.registers) {
+			*register = (*register).max(*value);
+		}
+		self.dense |= other.dense;
+	}
+
+	/// Estimate the cardinality with the estimator Redis uses, from Otmar
+	/// Ertl's "New cardinality estimation algorithms for HyperLogLog
+	/// sketches".
+	pub fn count(&self) -> u64 {
+		let mut histogram = [0u32; 64];
+		for register in &self.registers {
+			histogram[*register as usize] += 1;
+		}
+
+		let m = HLL_REGISTERS as f64;
+		let q = HLL_Q as usize;
+		let mut z = m * tau((m - histogram[q + 1] as f64) / m);
+		for count in histogram[1..=q].iter().rev() {
+			z += *count as f64;
+			z *= 0.5;
+		}
+		z += m * sigma(histogram[0] as f64 / m);
+		(ALPHA_INF * m * m / z).round() as u64
+	}
+
+	fn put_header(&self, bytes: &mut [u8], encoding: u8) {
+		bytes[..MAGIC.len()].copy_from_slice(MAGIC);
+		bytes[MAGIC.len()] = encoding;
+		bytes[8..HDR_SIZE].copy_from_slice(&self.count().to_le_bytes());
+	}
+
+	fn encode_sparse(&self) -> Option<Bytes> {
+		let mut bytes = BytesMut::zeroed(HDR_SIZE);
+		self.put_header(&mut bytes, ENCODING_SPARSE);
+
+		let mut index = 0;
+		while index < HLL_REGISTERS {
+			let value = self.registers[index];
+			let run = self.registers[index..]
+				.iter()
+				.take_while(|register| **register == value)
+				.count();
+			index += run;
+
+			let mut left = run;
+			while left > 0 {
+				if value == 0 && left > ZERO_MAX_LEN {
+					let len = left.min(XZERO_MAX_LEN) - 1;
+					bytes.put_u8(0x40 | (len >> 8) as u8);
+					bytes.put_u8(len as u8);
+					left -= len + 1;
+				} else if value == 0 {
+					bytes.put_u8((left - 1) as u8);
+					left = 0;
+				} else if value <= VAL_MAX_VALUE {
+					let len = left.min(VAL_MAX_LEN);
+					bytes.put_u8(0x80 | ((value - 1) << 2) | (len - 1) as u8);
+					left -= len;
+				} else {
+					return None;
+				}
+			}
+			if bytes.len() > HLL_SPARSE_MAX_BYTES {
+				return None;
+			}
+		}
+		Some(bytes.freeze())
+	}
+}
+
+fn dense_get(data: &[u8], index: usize) -> u8 {
+	let bit = index * REGISTER_BITS;
+	let (byte, shift) = (bit / 8, bit % 8);
+	let mut value = data[byte] as u16 >> shift;
+	// The last register does not reach past the end.
+	if let Some(next) = data.get(byte + 1) {
+		value |= (*next as u16) << (8 - shift);
+	}
+	value as u8 & REGISTER_MAX
+}
+
+fn dense_set(data: &mut [u8], index: usize, value: u8) {
+	let bit = index * REGISTER_BITS;
+	let (byte, shift) = (bit / 8, bit % 8);
+	data[byte] &= !(REGISTER_MAX << shift);
+	data[byte] |= value << shift;
+	if shift > 8 - REGISTER_BITS {
+		data[byte + 1] &= !(REGISTER_MAX >> (8 - shift));
+		data[byte + 1] |= value >> (8 - shift);
+	}
+}
+
+fn sparse_decode(data: &[u8]) -> Result<Vec<u8>, HllError> {
+	let mut registers = Vec::with_capacity(HLL_REGISTERS);
+	let mut pos = 0;
+	while pos < data.len() {
+		let op = data[pos];
+		let (value, len) = match op & 0xC0 {
+			0x00 => (0, (op & 0x3F) as usize + 1),
+			0x40 => {
+				let next = *data.get(pos + 1).ok_or(HllError::Corrupted)?;
+				pos += 1;
+				(0, (((op & 0x3F) as usize) << 8 | next as usize) + 1)
+			}
+			_ => (((op >> 2) & 0x1F) + 1, (op & 0x03) as usize + 1),
+		};
+		pos += 1;
+		if registers.len() + len > HLL_REGISTERS {
+			return Err(HllError::Corrupted);
+		}
+		registers.resize(registers.len() + len, value);
+	}
+	if registers.len() != HLL_REGISTERS {
+		return Err(HllError::Corrupted);
+	}
+	Ok(registers)
+}
+
+fn sigma(mut x: f64) -> f64 {
+	if x == 1.0 {
+		return f64::INFINITY;
+	}
+	let mut y = 1.0;
+	let mut z = x;
+	loop {
+		x *= x;
+		let prev = z;
+		z += x * y;
+		y += y;
+		if prev == z {
+			return z;
+		}
+	}
+}
+
+fn tau(mut x: f64) -> f64 {
+	if x == 0.0 || x == 1.0 {
+		return 0.0;
+	}
+	let mut y = 1.0;
+	let mut z = 1.0 - x;
+	loop {
+		x = x.sqrt();
+		let prev = z;
+		y *= 0.5;
+		z -= (1.0 - x).powi(2) * y;
+		if prev == z {
+			return z / 3.0;
+		}
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use rstest::rstest;
+
+	use super::*;
+
+	fn filled(count: usize) -> HyperLogLog {
+		let mut hll = HyperLogLog::new();
+		for i in 0..count {
+			hll.add(format!("element:{i}").as_bytes());
+		}
+		hll
+	}
+
+	#[test]
+	fn test_empty_sparse_encoding() {
+		let hll = HyperLogLog::new();
+		let bytes = hll.encode();
+		// Header plus a single XZERO covering every register, as in Redis.
+		assert_eq!(bytes.len(), HDR_SIZE + 2);
+		assert_eq!(&bytes[..5], b"HYLL\x01");
+		assert_eq!(&bytes[HDR_SIZE..], &[0x7F, 0xFF]);
+		assert_eq!(HyperLogLog::cached_count(&bytes), Some(0));
+		assert_eq!(HyperLogLog::decode(&bytes).unwrap(), hll);
+	}
+
+	#[test]
+	fn test_add() {
+		let mut hll = HyperLogLog::new();
+		assert!(hll.add(b"a"));
+		assert!(!hll.add(b"a"));
+		assert!(hll.add(b"b"));
+		assert_eq!(hll.count(), 2);
+	}
+
+	#[rstest]
+	#[case(10)]
+	#[case(1000)]
+	#[case(100_000)]
+	fn test_count_accuracy(#[case] count: usize) {
+		let hll = filled(count);
+		let estimate = hll.count() as f64;
+		// The standard error with 16384 registers is 0.81%.
+		let error = (estimate - count as f64).abs() / count as f64;
+		assert!(error < 0.03, "estimated {estimate} for {count}");
+	}
+
+	#[rstest]
+	#[case(100, ENCODING_SPARSE)]
+	#[case(100_000, ENCODING_DENSE)]
+	fn test_encode_decode(#[case] count: usize, #[case] encoding: u8) {
+		let hll = filled(count);
+		let bytes = hll.encode();
+		assert_eq!(bytes[4], encoding);
+		assert_eq!(HyperLogLog::cached_count(&bytes), Some(hll.count()));
+
+		let decoded = HyperLogLog::decode(&bytes).unwrap();
+		assert_eq!(decoded.registers, hll.registers);
+		assert_eq!(decoded.count(), hll.count());
+	}
+
+	#[test]
+	fn test_dense_registers() {
+		let mut data = vec![0u8; DENSE_SIZE - HDR_SIZE];
+		for index in [0, 1, 2, 3, 4, 5, HLL_REGISTERS - 1] {
+			dense_set(&mut data, index, (index % 64) as u8 | 0x21);
+		}
+		for index in [0, 1, 2, 3, 4, 5, HLL_REGISTERS - 1] {
+			assert_eq!(dense_get(&data, index), (index % 64) as u8 | 0x21);
+		}
+		assert_eq!(dense_get(&data, 6), 0);
+	}
+
+	#[test]
+	fn test_merge() {
+		let mut a = filled(1000);
+		let mut b = HyperLogLog::new();
+		for i in 500..1500 {
+			b.add(format!("element:{i}").as_bytes());
+		}
+		a.merge(&b);
+		let estimate = a.count() as f64;
+		assert!((estimate - 1500.0).abs() / 1500.0 < 0.03);
+
+		// Merging a dense value makes the result dense.
+		let mut sparse = HyperLogLog::new();
+		sparse.merge(&HyperLogLog::decode(&filled(100_000).encode()).unwrap());
+		assert_eq!(sparse.encode()[4], ENCODING_DENSE);
+	}
+
+	#[rstest]
+	#[case(b"", HllError::NotHll)]
+	#[case(
+		b"HYLL\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00",
+		HllError::NotHll
+	)]
+	#[case(
+		b"HYLL\x02\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00",
+		HllError::NotHll
+	)]
+	#[case(
+		b"HYLL\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x7F",
+		HllError::Corrupted
+	)]
+	#[case(
+		b"HYLL\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00",
+		HllError::Corrupted
+	)]
+	#[case(
+		b"HYLL\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x7F\xFF\x00",
+		HllError::Corrupted
+	)]
+	fn test_decode_invalid(#[case] bytes: &[u8], #[case] expected: HllError) {
+		assert_eq!(HyperLogLog::decode(bytes).unwrap_err(), expected);
+	}
+}
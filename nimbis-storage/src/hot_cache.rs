@@ -0,0 +1,333 @@
+//! An in-memory cache of hot records of the string DB.
+//!
+//! The string DB holds the value of every string and the metadata of every
+//! collection, so nearly every command reads it before anything else. With a
+//! capacity set, records of at most the size limit are kept in memory once
+//! read, up to that many keys, and evicted with the CLOCK algorithm, which
+//! approximates LRU: a key read since the hand last passed it is kept for
+//! another round.
+//!
+//! A write lock drops the keys it covers from the cache when it is released,
+//! and the global lock clears the whole cache, so a cached record is never
+//! older than the last write to its key. A record read while a write lock was
+//! released is not cached, since it may predate that write.
+
+use std::collections::HashMap;
+use std::sync::Mutex;
+use std::sync::atomic::AtomicBool;
+use std::sync::atomic::AtomicU64;
+use std::sync::atomic::Ordering;
+
+use bytes::Bytes;
+
+use crate::utils::is_expired;
+
+/// A record of the string DB: the encoded value and its expire time.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub(crate) struct CachedRecord {
+	pub(crate) value: Bytes,
+	pub(crate) expire_ts: Option<i64>,
+}
+
+/// Cache settings and how reads went since the store opened.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct HotCacheStats {
+	/// The keys the cache holds at most, `0` when it is off.
+	pub max_keys: usize,
+	/// The largest record cached, in bytes.
+	pub max_value_size: usize,
+	/// The keys cached now.
+	pub keys: usize,
+	pub hits: u64,
+	pub misses: u64,
+}
+
+#[derive(Debug)]
+struct Slot {
+	key: Bytes,
+	record: CachedRecord,
+	/// Whether the key was read since the hand last passed it.
+	referenced: bool,
+}
+
+#[derive(Debug, Default)]
+struct HotCacheState {
+	max_keys: usize,
+	max_value_size: usize,
+	slots: Vec<Option<Slot>>,
+	/// The slot of each cached key.
+	index: HashMap<Bytes, usize>,
+	/// Slots emptied by invalidation.
+	free: Vec<usize>,
+	/// The next slot eviction looks at.
+	hand: usize,
+}
+
+impl HotCacheState {
+	fn remove(&mut self, key: &Bytes) {
+		if let Some(at) = self.index.remove(key) {
+			self.slots[at] = None;
+			self.free.push(at);
+		}
+	}
+
+	/// A slot for a new key, evicting one if the cache is full.
+	fn claim(&mut self) -> usize {
+		if let Some(at) = self.free.pop() {
+			return at;
+		}
+		if self.slots.len() < self.max_keys {
+			self.slots.push(None);
+			return self.slots.len() - 1;
+		}
+		loop {
+			let at = self.hand;
+			self.hand = (self.hand + 1) % self.slots.len();
+			// Every slot is taken when there is no free one.
+			let Some(slot) = self.slots[at].as_mut() else {
+				return at;
+			};
+			if slot.referenced {
+				slot.referenced = false;
+				continue;
+			}
+			let key = slot.key.clone();
+			self.index.remove(&key);
+			self.slots[at] = None;
+			return at;
+		}
+	}
+}
+
+#[derive(Debug, Default)]
+pub(crate) struct HotCache {
+	enabled: AtomicBool,
+	state: Mutex<HotCacheState>,
+	/// Bumped by every invalidation, so reads that raced one are not cached.
+	epoch: AtomicU64,
+	hits: AtomicU64,
+	misses: AtomicU64,
+}
+
+impl HotCache {
+	/// Cache up to `max_keys` records of at most `max_value_size` bytes,
+	/// dropping what was cached. `0` keys turns the cache off.
+	pub(crate) fn configure(&self, max_keys: usize, max_value_size: usize) {
+		let mut state = self.state.lock().unwrap();
+		*state = HotCacheState {
+			max_keys,
+			max_value_size,
+			..HotCacheState::default()
+		};
+		self.epoch.fetch_add(1, Ordering::Relaxed);
+		self.enabled.store(max_keys > 0, Ordering::Relaxed);
+	}
+
+	pub(crate) fn enabled(&self) -> bool {
+		self.enabled.load(Ordering::Relaxed)
+	}
+
+	/// The cached record of `key`, unless it expired.
+	pub(crate) fn get(&self, key: &Bytes) -> Option<CachedRecord> {
+		if !self.enabled() {
+			return None;
+		}
+		let mut state = self.state.lock().unwrap();
+		let record = state.index.get(key).copied().and_then(|at| {
+			let slot = state.slots[at].as_mut()?;
+			slot.referenced = true;
+			Some(slot.record.clone())
+		});
+		match record {
+			Some(record) if !is_expired(record.expire_ts) => {
+				self.hits.fetch_add(1, Ordering::Relaxed);
+				Some(record)
+			}
+			record => {
+				if record.is_some() {
+					state.remove(key);
+				}
+				self.misses.fetch_add(1, Ordering::Relaxed);
+				None
+			}
+		}
+	}
+
+	/// The epoch to pass to `insert` for a record about to be read.
+	pub(crate) fn epoch(&self) -> u64 {
+		self.epoch.load(Ordering::Relaxed)
+	}
+
+	/// Cache `record`, read from the DB after `epoch` was taken, unless it
+	/// is too large or a key was invalidated since.
+	pub(crate) fn insert(&self, key: &Bytes, record: &CachedRecord, epoch: u64) {
+		if !self.enabled() || is_expired(record.expire_ts) {
+			return;
+		}
+		let mut state = self.state.lock().unwrap();
+		if record.value.len() > state.max_value_size || self.epoch() != epoch {
+			return;
+		}
+		if let Some(slot) = state
+			.index
+			.get(key)
+			.and_then(|at| state.slots[*at].as_ref())
+			&& slot.record == *record
+		{
+			return;
+		}
+		state.remove(key);
+		if state.max_keys == 0 {
+			return;
+		}
+		let at = state.claim();
+		state.slots[at] = Some(Slot {
+			key: key.clone(),
+			record: record.clone(),
+			referenced: false,
+		});
+		state.index.insert(key.clone(), at);
+	}
+
+	/// Drop `keys`, which were written.
+	pub(crate) fn invalidate(&self, keys: &[Bytes]) {
+		if !self.enabled() {
+			return;
+		}
+		let mut state = self.state.lock().unwrap();
+		self.epoch.fetch_add(1, Ordering::Relaxed);
+		for key in keys {
+			state.remove(key);
+		}
+	}
+
+	/// Drop every key, after a write to the whole dataset.
+	pub(crate) fn clear(&self) {
+		if !self.enabled() {
+			return;
+		}
+		let mut state = self.state.lock().unwrap();
+		self.epoch.fetch_add(1, Ordering::Relaxed);
+		state.slots.clear();
+		state.index.clear();
+		state.free.clear();
+		state.hand = 0;
+	}
+
+	pub(crate) fn stats(&self) -> HotCacheStats {
+		let state = self.state.lock().unwrap();
+		HotCacheStats {
+			max_keys: state.max_keys,
+			max_value_size: state.max_value_size,
+			keys: state.index.len(),
+			hits: self.hits.load(Ordering::Relaxed),
+			misses: self.misses.load(Ordering::Relaxed),
+		}
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+
+	fn record(value: &'static str) -> CachedRecord {
+		CachedRecord {
+			value: Bytes::from(value),
+			expire_ts: None,
+		}
+	}
+
+	fn key(name: &str) -> Bytes {
+		Bytes::from(name.to_string())
+	}
+
+	#[test]
+	fn test_off_by_default() {
+		let cache = HotCache::default();
+		cache.insert(&key("a"), &record("1"), cache.epoch());
+		assert_eq!(cache.get(&key("a")), None);
+		assert_eq!(cache.stats(), HotCacheStats::default());
+	}
+
+	#[test]
+	fn test_hits_and_misses() {
+		let cache = HotCache::default();
+		cache.configure(10, 16);
+		assert_eq!(cache.get(&key("a")), None);
+		cache.insert(&key("a"), &record("1"), cache.epoch());
+		assert_eq!(cache.get(&key("a")), Some(record("1")));
+
+		// Too large to cache.
+		cache.insert(&key("b"), &record("0123456789abcdefg"), cache.epoch());
+		assert_eq!(cache.get(&key("b")), None);
+
+		let stats = cache.stats();
+		assert_eq!((stats.keys, stats.hits, stats.misses), (1, 1, 2));
+	}
+
+	#[test]
+	fn test_invalidation() {
+		let cache = HotCache::default();
+		cache.configure(10, 16);
+		cache.insert(&key("a"), &record("1"), cache.epoch());
+		cache.insert(&key("b"), &record("2"), cache.epoch());
+
+		// A record read before a write was released is not cached.
+		let epoch = cache.epoch();
+		cache.invalidate(&[key("a")]);
+		cache.insert(&key("c"), &record("3"), epoch);
+		assert_eq!(cache.get(&key("a")), None);
+		assert_eq!(cache.get(&key("c")), None);
+		assert_eq!(cache.get(&key("b")), Some(record("2")));
+
+		cache.clear();
+		assert_eq!(cache.get(&key("b")), None);
+		assert_eq!(cache.stats().keys, 0);
+	}
+
+	#[test]
+	fn test_expired_records() {
+		let cache = HotCache::default();
+		cache.configure(10, 16);
+		let expired = CachedRecord {
+			value: Bytes::from("1"),
+			expire_ts: Some(1),
+		};
+		cache.insert(&key("a"), &expired, cache.epoch());
+		assert_eq!(cache.stats().keys, 0);
+
+		let soon = CachedRecord {
+			value: Bytes::from("1"),
+			expire_ts: Some(chrono::Utc::now().timestamp_millis() + 50),
+		};
+		cache.insert(&key("a"), &soon, cache.epoch());
+		assert_eq!(cache.get(&key("a")), Some(soon));
+		std::thread::sleep(std::time::Duration::from_millis(60));
+		assert_eq!(cache.get(&key("a")), None);
+		assert_eq!(cache.stats().keys, 0);
+	}
+
+	#[test]
+	fn test_clock_eviction() {
+		let cache = HotCache::default();
+		cache.configure(3, 16);
+		for name in ["a", "b", "c"] {
+			cache.insert(&key(name), &record("1"), cache.epoch());
+		}
+		// `a` was read, so `b` is evicted first.
+		cache.get(&key("a"));
+		cache.insert(&key("d"), &record("1"), cache.epoch());
+		assert!(cache.get(&key("b")).is_none());
+		assert!(cache.get(&key("a")).is_some());
+		assert!(cache.get(&key("c")).is_some());
+		assert!(cache.get(&key("d")).is_some());
+		assert_eq!(cache.stats().keys, 3);
+
+		// A slot freed by invalidation is reused before anything is evicted.
+		cache.invalidate(&[key("c")]);
+		cache.insert(&key("e"), &record("1"), cache.epoch());
+		for name in ["a", "d", "e"] {
+			assert!(cache.get(&key(name)).is_some());
+		}
+	}
+}
@@ -0,0 +1,356 @@
+//! Undo journal for writes that must be atomic across storage DBs.
+//!
+//! Each data type lives in its own SlateDB instance, so a single write batch
+//! cannot cover a group of commands that touches several of them. While an
+//! atomic group is open, the first write to every raw key first persists the
+//! key's previous state as a journal segment in the object store. Committing
+//! flushes all DBs and removes the segments. If the process dies before the
+//! commit, the segments are still there on the next open and the recorded
+//! states are restored, so a partially applied group is never visible. A
+//! commit that fails to flush rolls the group back right away; if that fails
+//! too, the segments are kept for the next open and no new group begins.
+
+use std::collections::HashSet;
+use std::sync::Arc;
+use std::sync::atomic::AtomicBool;
+use std::sync::atomic::Ordering;
+
+use bytes::Buf;
+use bytes::BufMut;
+use bytes::Bytes;
+use bytes::BytesMut;
+use futures::TryStreamExt;
+use slatedb::Db;
+use slatedb::object_store::ObjectStore;
+use slatedb::object_store::path::Path as ObjectStorePath;
+use tokio::sync::Mutex;
+
+use crate::data_type::DataType;
+use crate::error::DecoderError;
+use crate::error::StorageError;
+
+const JOURNAL_DIR: &str = "journal";
+
+/// Previous state of a raw key in one of the storage DBs.
+#[derive(Debug, Clone, PartialEq)]
+pub struct UndoValue {
+	pub value: Bytes,
+	pub seq: u64,
+	pub expire_ts: Option<i64>,
+}
+
+/// One journaled key. `data_type` selects the DB the key lives in;
+/// `DataType::String` is the DB that also holds collection metadata.
+#[derive(Debug, Clone, PartialEq)]
+pub struct UndoRecord {
+	pub data_type: DataType,
+	pub key: Bytes,
+	pub before: Option<UndoValue>,
+}
+
+impl UndoRecord {
+	fn encode_into(&self, buf: &mut BytesMut) {
+		buf.put_u8(self.data_type as u8);
+		buf.put_u32(self.key.len() as u32);
+		buf.extend_from_slice(&self.key);
+		match &self.before {
+			Some(before) => {
+				buf.put_u8(1);
+				buf.put_u64(before.seq);
+				match before.expire_ts {
+					Some(ts) => {
+						buf.put_u8(1);
+						buf.put_i64(ts);
+					}
+					None => buf.put_u8(0),
+				}
+				buf.put_u32(before.value.len() as u32);
+				buf.extend_from_slice(&before.value);
+			}
+			None => buf.put_u8(0),
+		}
+	}
+
+	fn decode_from(buf: &mut &[u8]) -> Result<Self, DecoderError> {
+		let data_type = DataType::from_u8(read_u8(buf)?).ok_or(DecoderError::InvalidType)?;
+		let key = read_bytes(buf)?;
+		let before = match read_u8(buf)? {
+			0 => None,
+			_ => {
+				if buf.remaining() < 8 {
+					return Err(DecoderError::InvalidLength);
+				}
+				let seq = buf.get_u64();
+				let expire_ts = match read_u8(buf)? {
+					0 => None,
+					_ => {
+						if buf.remaining() < 8 {
+							return Err(DecoderError::InvalidLength);
+						}
+						Some(buf.get_i64())
+					}
+				};
+				let value = read_bytes(buf)?;
+				Some(UndoValue {
+					value,
+					seq,
+					expire_ts,
+				})
+			}
+		};
+
+		Ok(Self {
+			data_type,
+			key,
+			before,
+		})
+	}
+}
+
+pub(crate) fn read_u8(buf: &mut &[u8]) -> Result<u8, DecoderError> {
+	if buf.is_empty() {
+		return Err(DecoderError::InvalidLength);
+	}
+	Ok(buf.get_u8())
+}
+
+pub(crate) fn read_bytes(buf: &mut &[u8]) -> Result<Bytes, DecoderError> {
+	if buf.remaining() < 4 {
+		return Err(DecoderError::InvalidLength);
+	}
+	let len = buf.get_u32() as usize;
+	if buf.remaining() < len {
+		return Err(DecoderError::InvalidLength);
+	}
+	let bytes = Bytes::copy_from_slice(&buf[..len]);
+	buf.advance(len);
+	Ok(bytes)
+}
+
+pub fn encode_segment(records: &[UndoRecord]) -> Bytes {
+	let mut buf = BytesMut::new();
+	for record in records {
+		record.encode_into(&mut buf);
+	}
+	buf.freeze()
+}
+
+pub fn decode_segment(mut buf: &[u8]) -> Result<Vec<UndoRecord>, DecoderError> {
+	let mut records = Vec::new();
+	while !buf.is_empty() {
+		records.push(UndoRecord::decode_from(&mut buf)?);
+	}
+	Ok(records)
+}
+
+#[derive(Default)]
+struct JournalState {
+	open: bool,
+	/// Number of segments written since the last successful clear.
+	next_segment: u64,
+	captured: HashSet<(u8, Bytes)>,
+	/// Whether the segments belong to a group whose commit failed and that
+	/// is not rolled back yet.
+	aborted: bool,
+}
+
+pub struct UndoJournal {
+	object_store: Arc<dyn ObjectStore>,
+	dir: ObjectStorePath,
+	state: Mutex<JournalState>,
+	/// Whether a group is open, read without the state lock so that writes
+	/// outside groups, which are all but a few, do not queue on it. Writers
+	/// are kept out while a group opens or closes.
+	open: AtomicBool,
+}
+
+impl UndoJournal {
+	pub fn new(object_store: Arc<dyn ObjectStore>, root_path: &ObjectStorePath) -> Self {
+		Self {
+			object_store,
+			dir: root_path.child(JOURNAL_DIR),
+			state: Mutex::new(JournalState::default()),
+			open: AtomicBool::new(false),
+		}
+	}
+
+	/// Start capturing undo records. Segments left behind by a commit that
+	/// failed to clear them belong to a group that already completed, so they
+	/// are dropped first. Segments of a group that is still to be rolled back
+	/// must stay, so no group begins until it is.
+	pub async fn begin(&self) -> Result<(), StorageError> {
+		let mut state = self.state.lock().await;
+		if state.aborted {
+			return Err(StorageError::DataInconsistency {
+				message: "an atomic group that failed to commit is not rolled back yet".to_string(),
+			});
+		}
+		if state.next_segment > 0 {
+			self.clear().await?;
+		}
+		*state = JournalState {
+			open: true,
+			..JournalState::default()
+		};
+		self.open.store(true, Ordering::Release);
+		Ok(())
+	}
+
+	/// Persist the current state of `keys` in `db` unless the group already
+	/// captured them. Does nothing when no group is open.
+	pub async fn capture<I>(
+		&self,
+		db: &Db,
+		data_type: DataType,
+		keys: I,
+	) -> Result<(), StorageError>
+	where
+		I: IntoIterator<Item = Bytes>,
+	{
+		if !self.open.load(Ordering::Acquire) {
+			return Ok(());
+		}
+		let mut state = self.state.lock().await;
+		if !state.open {
+			return Ok(());
+		}
+
+		let mut records = Vec::new();
+		for key in keys {
+			if !state.captured.insert((data_type as u8, key.clone())) {
+				continue;
+			}
+			let before = db.get_key_value(key.clone()).await?.map(|kv| UndoValue {
+				value: kv.value,
+				seq: kv.seq,
+				expire_ts: kv.expire_ts,
+			});
+			records.push(UndoRecord {
+				data_type,
+				key,
+				before,
+			});
+		}
+
+		if records.is_empty() {
+			return Ok(());
+		}
+
+		let path = self.dir.child(format!("{:020}", state.next_segment));
+		state.next_segment += 1;
+		self.object_store
+			.put(&path, encode_segment(&records).into())
+			.await?;
+		Ok(())
+	}
+
+	/// Whether the open group has journaled any write.
+	pub async fn has_records(&self) -> bool {
+		self.state.lock().await.next_segment > 0
+	}
+
+	/// Close the group. Callers must flush every DB before committing.
+	pub async fn commit(&self) -> Result<(), StorageError> {
+		let mut state = self.state.lock().await;
+		state.open = false;
+		self.open.store(false, Ordering::Release);
+		state.captured.clear();
+		if state.next_segment > 0 {
+			self.clear().await?;
+			state.next_segment = 0;
+		}
+		Ok(())
+	}
+
+	/// Close a group whose commit failed, keeping its segments to roll it
+	/// back with.
+	pub async fn abort(&self) {
+		let mut state = self.state.lock().await;
+		state.open = false;
+		self.open.store(false, Ordering::Release);
+		state.captured.clear();
+		state.aborted = true;
+	}
+
+	/// Forget an aborted group once it is rolled back and its segments are
+	/// cleared.
+	pub async fn rolled_back(&self) {
+		let mut state = self.state.lock().await;
+		state.aborted = false;
+		state.next_segment = 0;
+	}
+
+	/// Read every record left by an unfinished group, oldest first.
+	pub async fn pending(&self) -> Result<Vec<UndoRecord>, StorageError> {
+		let mut paths = self.segment_paths().await?;
+		paths.sort();
+
+		let mut records = Vec::new();
+		for path in paths {
+			let segment = self.object_store.get(&path).await?.bytes().await?;
+			records.extend(decode_segment(&segment)?);
+		}
+		Ok(records)
+	}
+
+	pub async fn clear(&self) -> Result<(), StorageError> {
+		for path in self.segment_paths().await? {
+			self.object_store.delete(&path).await?;
+		}
+		Ok(())
+	}
+
+	async fn segment_paths(&self) -> Result<Vec<ObjectStorePath>, StorageError> {
+		let metas: Vec<_> = self
+			.object_store
+			.list(Some(&self.dir))
+			.try_collect()
+			.await?;
+		Ok(metas.into_iter().map(|meta| meta.location).collect())
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use rstest::rstest;
+
+	use super::*;
+
+	#[rstest]
+	#[case(None)]
+	#[case(Some(UndoValue { value: Bytes::from("value"), seq: 42, expire_ts: None }))]
+	#[case(Some(UndoValue { value: Bytes::new(), seq: 7, expire_ts: Some(1_700_000_000_000) }))]
+	fn test_segment_roundtrip(#[case] before: Option<UndoValue>) {
+		let records = vec![
+			UndoRecord {
+				data_type: DataType::Hash,
+				key: Bytes::from("field-key"),
+				before,
+			},
+			UndoRecord {
+				data_type: DataType::String,
+				key: Bytes::from("meta-key"),
+				before: None,
+			},
+		];
+
+		let encoded = encode_segment(&records);
+		assert_eq!(decode_segment(&encoded).unwrap(), records);
+	}
+
+	#[test]
+	fn test_decode_truncated_segment() {
+		let records = vec![UndoRecord {
+			data_type: DataType::List,
+			key: Bytes::from("key"),
+			before: Some(UndoValue {
+				value: Bytes::from("value"),
+				seq: 1,
+				expire_ts: None,
+			}),
+		}];
+
+		let encoded = encode_segment(&records);
+		assert!(decode_segment(&encoded[..encoded.len() - 1]).is_err());
+	}
+}
@@ -0,0 +1,224 @@
+//! Key counts kept in step with the string DB.
+//!
+//! Every key has one record in the string DB, the value of a string or the
+//! metadata of a collection, and every write of one goes through
+//! `Storage::put_string_record` or `Storage::delete_string_record`. Those
+//! count the keys that come and go and index the keys with an expire time by
+//! that time, so the counts are read without walking the keys. SlateDB stops
+//! returning a record once its expire time passes, without a write anyone
+//! sees, so the counts leave out indexed keys whose time has passed until
+//! storage deletes them, which `Storage::expire_step` does for the keys the
+//! index has past their time. Opening the store walks the keys once to start
+//! the counts.
+
+use std::collections::BTreeSet;
+use std::collections::HashMap;
+use std::sync::Mutex;
+
+use bytes::Bytes;
+
+/// The keys of the store at one moment.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct KeyspaceCounts {
+	pub keys: u64,
+	/// Keys with an expire time.
+	pub expires: u64,
+	/// The average time the keys with an expire time have left to live, in
+	/// milliseconds.
+	pub avg_ttl_ms: u64,
+}
+
+#[derive(Debug, Default)]
+struct KeyspaceState {
+	/// Keys with a record, including indexed keys whose time has passed.
+	keys: u64,
+	/// The expire time of each key that has one.
+	expire_at: HashMap<Bytes, i64>,
+	/// The same keys, ordered by expire time.
+	by_expire: BTreeSet<(i64, Bytes)>,
+	/// The times of `expire_at`, summed.
+	expire_sum: i128,
+}
+
+impl KeyspaceState {
+	fn index(&mut self, key: &Bytes, at: i64) {
+		self.expire_at.insert(key.clone(), at);
+		self.by_expire.insert((at, key.clone()));
+		self.expire_sum += at as i128;
+	}
+
+	/// Drop `key` from the index, returning whether it was there.
+	fn unindex(&mut self, key: &Bytes) -> bool {
+		let Some(at) = self.expire_at.remove(key) else {
+			return false;
+		};
+		self.by_expire.remove(&(at, key.clone()));
+		self.expire_sum -= at as i128;
+		true
+	}
+}
+
+#[derive(Debug, Default)]
+pub(crate) struct Keyspace {
+	state: Mutex<KeyspaceState>,
+}
+
+impl Keyspace {
+	/// Count a write of the record of user `key`: `before` is the expire time
+	/// of the live record it replaced, `None` without one, and `after` that
+	/// of the record written, `None` when it was deleted. Returns whether the
+	/// key had expired unseen, indexed but with its record already gone.
+	pub(crate) fn record(
+		&self,
+		key: &Bytes,
+		before: Option<Option<i64>>,
+		after: Option<Option<i64>>,
+	) -> bool {
+		let mut state = self.state.lock().unwrap();
+		let expired = state.unindex(key) && before.is_none();
+		if before.is_some() || expired {
+			state.keys = state.keys.saturating_sub(1);
+		}
+		if let Some(after) = after {
+			state.keys += 1;
+			if let Some(at) = after {
+				state.index(key, at);
+			}
+		}
+		expired
+	}
+
+	/// Start over from `keys` keys, of which `expires` have an expire time.
+	pub(crate) fn reset(&self, keys: u64, expires: impl IntoIterator<Item = (Bytes, i64)>) {
+		let mut state = KeyspaceState {
+			keys,
+			..Default::default()
+		};
+		for (key, at) in expires {
+			state.index(&key, at);
+		}
+		*self.state.lock().unwrap() = state;
+	}
+
+	/// Up to `limit` keys whose expire time is at or before `now`, the
+	/// longest past their time first.
+	pub(crate) fn due(&self, now: i64, limit: usize) -> Vec<Bytes> {
+		let state = self.state.lock().unwrap();
+		state
+			.by_expire
+			.range(..(now.saturating_add(1), Bytes::new()))
+			.take(limit)
+			.map(|(_, key)| key.clone())
+			.collect()
+	}
+
+	/// The counts at `now`, in milliseconds since the epoch.
+	pub(crate) fn counts(&self, now: i64) -> KeyspaceCounts {
+		let state = self.state.lock().unwrap();
+		let mut passed = 0;
+		let mut passed_sum = 0;
+		for (at, _) in state
+			.by_expire
+			.range(..(now.saturating_add(1), Bytes::new()))
+		{
+			passed += 1;
+			passed_sum += *at as i128;
+		}
+		let expires = state.expire_at.len() as u64 - passed;
+		let ttl_sum = state.expire_sum - passed_sum - expires as i128 * now as i128;
+		KeyspaceCounts {
+			keys: state.keys.saturating_sub(passed),
+			expires,
+			avg_ttl_ms: ttl_sum.checked_div(expires as i128).unwrap_or(0).max(0) as u64,
+		}
+	}
+}
+
+/// The user key of the meta key `encoded`, a length prefix and the key.
+pub(crate) fn meta_user_key(encoded: &Bytes) -> Bytes {
+	encoded.slice(encoded.len().min(2)..)
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+
+	fn key(name: &str) -> Bytes {
+		Bytes::from(name.to_string())
+	}
+
+	#[test]
+	fn test_counts_follow_writes() {
+		let keyspace = Keyspace::default();
+		assert!(!keyspace.record(&key("a"), None, Some(None)));
+		assert!(!keyspace.record(&key("b"), None, Some(Some(3_000))));
+		assert!(!keyspace.record(&key("c"), None, Some(Some(5_000))));
+		assert_eq!(
+			keyspace.counts(1_000),
+			KeyspaceCounts {
+				keys: 3,
+				expires: 2,
+				avg_ttl_ms: 3_000,
+			}
+		);
+
+		// Overwriting a key without an expire time drops it from the index.
+		assert!(!keyspace.record(&key("b"), Some(Some(3_000)), Some(None)));
+		assert!(!keyspace.record(&key("a"), Some(None), None));
+		assert_eq!(
+			keyspace.counts(1_000),
+			KeyspaceCounts {
+				keys: 2,
+				expires: 1,
+				avg_ttl_ms: 4_000,
+			}
+		);
+	}
+
+	#[test]
+	fn test_keys_past_their_time_are_left_out() {
+		let keyspace = Keyspace::default();
+		keyspace.record(&key("a"), None, Some(Some(1_000)));
+		keyspace.record(&key("b"), None, Some(None));
+		assert_eq!(
+			keyspace.counts(1_000),
+			KeyspaceCounts {
+				keys: 1,
+				expires: 0,
+				avg_ttl_ms: 0,
+			}
+		);
+
+		// Writing it again finds its record gone.
+		assert!(keyspace.record(&key("a"), None, Some(None)));
+		assert_eq!(keyspace.counts(1_000).keys, 2);
+
+		keyspace.reset(1, [(key("c"), 2_000)]);
+		assert_eq!(
+			keyspace.counts(1_000),
+			KeyspaceCounts {
+				keys: 1,
+				expires: 1,
+				avg_ttl_ms: 1_000,
+			}
+		);
+	}
+
+	#[test]
+	fn test_due_keys_come_oldest_first() {
+		let keyspace = Keyspace::default();
+		keyspace.record(&key("late"), None, Some(Some(2_000)));
+		keyspace.record(&key("early"), None, Some(Some(500)));
+		keyspace.record(&key("never"), None, Some(None));
+		keyspace.record(&key("later"), None, Some(Some(9_000)));
+
+		assert_eq!(keyspace.due(2_000, 10), vec![key("early"), key("late")]);
+		assert_eq!(keyspace.due(2_000, 1), vec![key("early")]);
+		assert!(keyspace.due(100, 10).is_empty());
+
+		// A key deleted or given a later time is no longer due.
+		keyspace.record(&key("early"), Some(Some(500)), None);
+		keyspace.record(&key("late"), Some(Some(2_000)), Some(Some(5_000)));
+		assert!(keyspace.due(2_000, 10).is_empty());
+	}
+}
@@ -1,20 +1,47 @@
+pub mod bitmap;
 pub mod compaction_filter;
+pub mod compression;
 pub mod data_type;
 pub mod error;
+pub mod expire;
+pub mod gc;
+pub mod geo;
 pub mod hash;
+pub mod hll;
+pub mod hot_cache;
+pub mod journal;
+pub mod keyspace;
 pub mod list;
 pub mod lock;
+pub mod metadata;
+pub mod rdb;
 pub mod set;
+pub mod snapshot;
+pub mod stats;
 pub mod storage;
+pub mod storage_bitfield;
+pub mod storage_bitmap;
+pub mod storage_extension;
+pub mod storage_geo;
 pub mod storage_hash;
+pub mod storage_hll;
 pub mod storage_list;
+pub mod storage_memory;
+pub mod storage_rdb;
 pub mod storage_set;
+pub mod storage_snapshot;
+pub mod storage_stream;
+pub mod storage_stream_group;
 pub mod storage_string;
 pub mod storage_zset;
+pub mod stream;
 pub mod string;
 pub mod utils;
 pub mod version;
 pub mod zset;
 
+pub use crate::storage::CompactorSettings;
+pub use crate::storage::ExpireListener;
 pub use crate::storage::Storage;
+pub use crate::storage::local_store_path;
 pub use crate::storage::validate_object_store_url;
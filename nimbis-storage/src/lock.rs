@@ -96,6 +96,7 @@ impl StorageLocks {
 				_db_read_guard: None,
 				_db_write_guard: Some(self.db_lock.clone().write_owned().await),
 				_key_guards: Vec::new(),
+				on_release: None,
 			},
 			StorageLockMode::Keys => self.acquire_key_locks(lock).await,
 		}
@@ -122,6 +123,7 @@ impl StorageLocks {
 			_db_read_guard: Some(db_read_guard),
 			_db_write_guard: None,
 			_key_guards: key_guards,
+			on_release: None,
 		}
 	}
 }
@@ -156,6 +158,24 @@ pub struct StorageLockGuard {
 	_db_read_guard: Option<OwnedRwLockReadGuard<()>>,
 	_db_write_guard: Option<OwnedRwLockWriteGuard<()>>,
 	_key_guards: Vec<KeyLockGuard>,
+	/// Run just before the locks are released.
+	on_release: Option<Box<dyn FnOnce() + Send + Sync>>,
+}
+
+impl StorageLockGuard {
+	/// Call `f` when the guard is dropped, while the locks are still held.
+	pub fn on_release(mut self, f: impl FnOnce() + Send + Sync + 'static) -> Self {
+		self.on_release = Some(Box::new(f));
+		self
+	}
+}
+
+impl Drop for StorageLockGuard {
+	fn drop(&mut self) {
+		if let Some(f) = self.on_release.take() {
+			f();
+		}
+	}
 }
 
 enum KeyLockGuard {
@@ -183,4 +203,23 @@ mod tests {
 
 		assert_eq!(locks.key_locks.len(), lock_slots);
 	}
+
+	#[tokio::test]
+	async fn release_hook_runs_while_locks_are_held() {
+		let locks = StorageLocks::new();
+		let db_lock = locks.db_lock.clone();
+		let ran = Arc::new(std::sync::atomic::AtomicBool::new(false));
+		let flag = ran.clone();
+		let guard = locks
+			.acquire(&StorageLock::write_keys([Bytes::from("key")]))
+			.await
+			.on_release(move || {
+				assert!(db_lock.try_write().is_err());
+				flag.store(true, std::sync::atomic::Ordering::Relaxed);
+			});
+		drop(guard);
+
+		assert!(ran.load(std::sync::atomic::Ordering::Relaxed));
+		assert!(locks.db_lock.try_write().is_ok());
+	}
 }
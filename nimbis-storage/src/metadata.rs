@@ -0,0 +1,44 @@
+//! Server metadata kept next to the storage DBs.
+//!
+//! Some server state is not part of the keyspace but must survive restarts,
+//! such as loaded function libraries. Each entry is a single object under
+//! `metadata/` in the object store, written whole on every change.
+
+use std::sync::Arc;
+
+use bytes::Bytes;
+use slatedb::object_store::ObjectStore;
+use slatedb::object_store::path::Path as ObjectStorePath;
+
+use crate::error::StorageError;
+
+const METADATA_DIR: &str = "metadata";
+
+pub struct MetadataStore {
+	object_store: Arc<dyn ObjectStore>,
+	dir: ObjectStorePath,
+}
+
+impl MetadataStore {
+	pub fn new(object_store: Arc<dyn ObjectStore>, root_path: &ObjectStorePath) -> Self {
+		Self {
+			object_store,
+			dir: root_path.child(METADATA_DIR),
+		}
+	}
+
+	pub async fn get(&self, name: &str) -> Result<Option<Bytes>, StorageError> {
+		match self.object_store.get(&self.dir.child(name)).await {
+			Ok(result) => Ok(Some(result.bytes().await?)),
+			Err(slatedb::object_store::Error::NotFound { .. }) => Ok(None),
+			Err(err) => Err(err.into()),
+		}
+	}
+
+	pub async fn put(&self, name: &str, value: Bytes) -> Result<(), StorageError> {
+		self.object_store
+			.put(&self.dir.child(name), value.into())
+			.await?;
+		Ok(())
+	}
+}
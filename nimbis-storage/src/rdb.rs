@@ -0,0 +1,1572 @@
+//! The Redis RDB file format.
+//!
+//! Files are written as RDB version 11, which every Redis since 7.2 loads.
+//! Values use the plain encodings of each type rather than the compact
+//! ziplist and listpack ones; Redis converts them on load. Streams have no
+//! plain encoding and are written as listpacks of at most 100 entries, in
+//! the third stream encoding, which carries entries, consumer groups and
+//! their pending entries along with the counters Redis 7 added: the entries
+//! ever added, the greatest deleted ID, the entries each group has read and
+//! the time each consumer was last active. The file ends with the CRC64
+//! checksum Redis verifies.
+//!
+//! Files written by Redis up to RDB version 12 can be read back, in any of
+//! the encodings Redis uses for them, including LZF-compressed strings.
+//!
+//! DUMP, RESTORE and MIGRATE move single values in the DUMP payload format:
+//! one value encoded as in a file, followed by the RDB version and a CRC64
+//! checksum.
+
+use std::collections::HashMap;
+
+use bytes::BufMut;
+use bytes::Bytes;
+use bytes::BytesMut;
+
+use crate::error::StorageError;
+use crate::stream::id::StreamId;
+
+const MAGIC: &[u8] = b"REDIS";
+/// The first version with the third stream encoding.
+const RDB_VERSION: u32 = 11;
+/// The newest version the decoder understands.
+const MAX_RDB_VERSION: u32 = 12;
+
+const OPCODE_SLOT_INFO: u8 = 0xf4;
+const OPCODE_FUNCTION_2: u8 = 0xf5;
+const OPCODE_FUNCTION_PRE_GA: u8 = 0xf6;
+const OPCODE_MODULE_AUX: u8 = 0xf7;
+const OPCODE_IDLE: u8 = 0xf8;
+const OPCODE_FREQ: u8 = 0xf9;
+const OPCODE_AUX: u8 = 0xfa;
+const OPCODE_RESIZEDB: u8 = 0xfb;
+const OPCODE_EXPIRETIME_MS: u8 = 0xfc;
+const OPCODE_EXPIRETIME: u8 = 0xfd;
+const OPCODE_SELECTDB: u8 = 0xfe;
+const OPCODE_EOF: u8 = 0xff;
+
+const TYPE_STRING: u8 = 0;
+const TYPE_LIST: u8 = 1;
+const TYPE_SET: u8 = 2;
+const TYPE_ZSET: u8 = 3;
+const TYPE_HASH: u8 = 4;
+const TYPE_ZSET_2: u8 = 5;
+const TYPE_HASH_ZIPMAP: u8 = 9;
+const TYPE_LIST_ZIPLIST: u8 = 10;
+const TYPE_SET_INTSET: u8 = 11;
+const TYPE_ZSET_ZIPLIST: u8 = 12;
+const TYPE_HASH_ZIPLIST: u8 = 13;
+const TYPE_LIST_QUICKLIST: u8 = 14;
+const TYPE_STREAM_LISTPACKS: u8 = 15;
+const TYPE_HASH_LISTPACK: u8 = 16;
+const TYPE_ZSET_LISTPACK: u8 = 17;
+const TYPE_LIST_QUICKLIST_2: u8 = 18;
+const TYPE_STREAM_LISTPACKS_2: u8 = 19;
+const TYPE_SET_LISTPACK: u8 = 20;
+const TYPE_STREAM_LISTPACKS_3: u8 = 21;
+
+/// Special string encodings, flagged by the top two bits of a length.
+const ENC_INT8: u64 = 0;
+const ENC_INT16: u64 = 1;
+const ENC_INT32: u64 = 2;
+const ENC_LZF: u64 = 3;
+
+/// Quicklist 2 node containers.
+const QUICKLIST_NODE_PLAIN: u64 = 1;
+const QUICKLIST_NODE_PACKED: u64 = 2;
+
+/// Flags of an entry in a stream listpack node.
+const STREAM_ITEM_FLAG_DELETED: i64 = 1;
+const STREAM_ITEM_FLAG_SAMEFIELDS: i64 = 2;
+/// Entries per stream listpack node, as Redis caps them by default.
+const STREAM_NODE_MAX_ENTRIES: usize = 100;
+
+/// A key's value as Redis sees it.
+#[derive(Debug, Clone, PartialEq)]
+pub enum RdbValue {
+	String(Bytes),
+	List(Vec<Bytes>),
+	Set(Vec<Bytes>),
+	/// Members with their scores.
+	ZSet(Vec<(Bytes, f64)>),
+	/// Fields with their values.
+	Hash(Vec<(Bytes, Bytes)>),
+	Stream(RdbStream),
+}
+
+/// A stream with its consumer groups.
+#[derive(Debug, Clone, PartialEq, Default)]
+pub struct RdbStream {
+	/// Entries in ID order, each with its fields and values.
+	pub entries: Vec<(StreamId, Vec<(Bytes, Bytes)>)>,
+	pub last_id: StreamId,
+	/// Entries ever added, deleted and trimmed ones included.
+	pub entries_added: u64,
+	/// The greatest ID of an entry deleted with XDEL.
+	pub max_deleted_id: StreamId,
+	/// Groups in name order.
+	pub groups: Vec<RdbStreamGroup>,
+}
+
+#[derive(Debug, Clone, PartialEq)]
+pub struct RdbStreamGroup {
+	pub name: Bytes,
+	pub last_delivered_id: StreamId,
+	/// Entries the group has read, `None` when unknown.
+	pub entries_read: Option<u64>,
+	/// The pending entries list, in ID order.
+	pub pending: Vec<RdbPendingEntry>,
+	/// Consumers in name order, every owner of a pending entry among them.
+	pub consumers: Vec<RdbStreamConsumer>,
+}
+
+#[derive(Debug, Clone, PartialEq)]
+pub struct RdbPendingEntry {
+	pub id: StreamId,
+	pub consumer: Bytes,
+	/// Last delivery, in milliseconds since the epoch.
+	pub delivery_time: u64,
+	pub delivery_count: u64,
+}
+
+#[derive(Debug, Clone, PartialEq)]
+pub struct RdbStreamConsumer {
+	pub name: Bytes,
+	/// Times in milliseconds since the epoch.
+	pub seen_time: u64,
+	pub active_time: u64,
+}
+
+#[derive(Debug, Clone, PartialEq)]
+pub struct RdbEntry {
+	pub key: Bytes,
+	pub value: RdbValue,
+	/// Expiry in milliseconds since the epoch.
+	pub expire_ts: Option<i64>,
+}
+
+/// Encode `entries` as an RDB file with a single database, stamped as
+/// created at `ctime` (seconds since the epoch).
+pub fn encode(entries: &[RdbEntry], ctime: i64) -> Bytes {
+	let mut buf = BytesMut::new();
+	buf.extend_from_slice(MAGIC);
+	buf.extend_from_slice(format!("{:04}", RDB_VERSION).as_bytes());
+
+	put_aux(&mut buf, "nimbis-ver", env!("CARGO_PKG_VERSION"));
+	put_aux(&mut buf, "redis-bits", "64");
+	put_aux(&mut buf, "ctime", &ctime.to_string());
+
+	buf.put_u8(OPCODE_SELECTDB);
+	put_length(&mut buf, 0);
+	buf.put_u8(OPCODE_RESIZEDB);
+	put_length(&mut buf, entries.len() as u64);
+	put_length(
+		&mut buf,
+		entries.iter().filter(|e| e.expire_ts.is_some()).count() as u64,
+	);
+
+	for entry in entries {
+		if let Some(ts) = entry.expire_ts {
+			buf.put_u8(OPCODE_EXPIRETIME_MS);
+			buf.put_i64_le(ts);
+		}
+		buf.put_u8(type_code(&entry.value));
+		put_string(&mut buf, &entry.key);
+		put_value(&mut buf, &entry.value);
+	}
+
+	buf.put_u8(OPCODE_EOF);
+	let checksum = crc64(&buf);
+	buf.put_u64_le(checksum);
+	buf.freeze()
+}
+
+/// Encode `value` as a DUMP payload: the value as it appears in an RDB
+/// file, followed by the RDB version and a checksum of both.
+pub fn dump(value: &RdbValue) -> Bytes {
+	let mut buf = BytesMut::new();
+	buf.put_u8(type_code(value));
+	put_value(&mut buf, value);
+	buf.put_u16_le(RDB_VERSION as u16);
+	let checksum = crc64(&buf);
+	buf.put_u64_le(checksum);
+	buf.freeze()
+}
+
+/// Decode a DUMP payload written by `dump` or by Redis. A payload with a
+/// newer RDB version or a wrong checksum is rejected with
+/// `StorageError::InvalidArgument`, one that cannot be decoded with
+/// `StorageError::InvalidRdb`.
+pub fn undump(payload: &[u8]) -> Result<RdbValue, StorageError> {
+	let wrong = || StorageError::InvalidArgument {
+		message: "ERR DUMP payload version or checksum are wrong".to_string(),
+	};
+	let Some(body_len) = payload.len().checked_sub(10) else {
+		return Err(wrong());
+	};
+	let version = u16::from_le_bytes(payload[body_len..body_len + 2].try_into().unwrap());
+	let checksum = u64::from_le_bytes(payload[body_len + 2..].try_into().unwrap());
+	if version as u32 > MAX_RDB_VERSION || checksum != crc64(&payload[..body_len + 2]) {
+		return Err(wrong());
+	}
+
+	let mut reader = Reader::new(&payload[..body_len]);
+	let type_code = reader.u8()?;
+	let value = reader.value(type_code)?;
+	if !reader.is_empty() {
+		return Err(invalid("trailing bytes after the value"));
+	}
+	Ok(value)
+}
+
+/// The RDB type `put_value` writes `value` as.
+fn type_code(value: &RdbValue) -> u8 {
+	match value {
+		RdbValue::String(_) => TYPE_STRING,
+		RdbValue::List(_) => TYPE_LIST,
+		RdbValue::Set(_) => TYPE_SET,
+		RdbValue::ZSet(_) => TYPE_ZSET_2,
+		RdbValue::Hash(_) => TYPE_HASH,
+		RdbValue::Stream(_) => TYPE_STREAM_LISTPACKS_3,
+	}
+}
+
+fn put_value(buf: &mut BytesMut, value: &RdbValue) {
+	match value {
+		RdbValue::String(value) => put_string(buf, value),
+		RdbValue::List(elements) | RdbValue::Set(elements) => {
+			put_length(buf, elements.len() as u64);
+			for element in elements {
+				put_string(buf, element);
+			}
+		}
+		RdbValue::ZSet(members) => {
+			put_length(buf, members.len() as u64);
+			for (member, score) in members {
+				put_string(buf, member);
+				buf.put_f64_le(*score);
+			}
+		}
+		RdbValue::Hash(fields) => {
+			put_length(buf, fields.len() as u64);
+			for (field, value) in fields {
+				put_string(buf, field);
+				put_string(buf, value);
+			}
+		}
+		RdbValue::Stream(stream) => put_stream(buf, stream),
+	}
+}
+
+/// A stream in the third encoding: its entries in listpack nodes keyed by
+/// their first ID, the length, last ID, first ID, greatest deleted ID and
+/// entries ever added, then each group with the entries it has read, its
+/// pending entries and its consumers, who list the IDs of the pending
+/// entries they own.
+fn put_stream(buf: &mut BytesMut, stream: &RdbStream) {
+	let nodes = stream.entries.chunks(STREAM_NODE_MAX_ENTRIES);
+	put_length(buf, nodes.len() as u64);
+	for node in nodes {
+		put_string(buf, &node[0].0.to_bytes());
+		put_string(buf, &stream_node(node));
+	}
+	put_length(buf, stream.entries.len() as u64);
+	let first_id = stream.entries.first().map_or(StreamId::MIN, |(id, _)| *id);
+	for id in [stream.last_id, first_id, stream.max_deleted_id] {
+		put_length(buf, id.ms);
+		put_length(buf, id.seq);
+	}
+	put_length(buf, stream.entries_added);
+
+	put_length(buf, stream.groups.len() as u64);
+	for group in &stream.groups {
+		put_string(buf, &group.name);
+		put_length(buf, group.last_delivered_id.ms);
+		put_length(buf, group.last_delivered_id.seq);
+		// Redis marks an unknown count as -1.
+		put_length(buf, group.entries_read.unwrap_or(u64::MAX));
+		put_length(buf, group.pending.len() as u64);
+		for pending in &group.pending {
+			buf.extend_from_slice(&pending.id.to_bytes());
+			buf.put_u64_le(pending.delivery_time);
+			put_length(buf, pending.delivery_count);
+		}
+		put_length(buf, group.consumers.len() as u64);
+		for consumer in &group.consumers {
+			put_string(buf, &consumer.name);
+			buf.put_u64_le(consumer.seen_time);
+			buf.put_u64_le(consumer.active_time);
+			let owned: Vec<_> = group
+				.pending
+				.iter()
+				.filter(|pending| pending.consumer == consumer.name)
+				.collect();
+			put_length(buf, owned.len() as u64);
+			for pending in owned {
+				buf.extend_from_slice(&pending.id.to_bytes());
+			}
+		}
+	}
+}
+
+/// The listpack of a stream node. It opens with a master entry holding the
+/// entry count, the deleted count and the fields of the first entry; entries
+/// with the same fields store only their values. Every entry stores its ID
+/// relative to the first one and ends with the number of its elements, so
+/// the node can be walked backwards.
+fn stream_node(entries: &[(StreamId, Vec<(Bytes, Bytes)>)]) -> Bytes {
+	let (master_id, master_fields) = &entries[0];
+	let mut lp = Listpack::default();
+	lp.int(entries.len() as i64);
+	lp.int(0);
+	lp.int(master_fields.len() as i64);
+	for (field, _) in master_fields {
+		lp.string(field);
+	}
+	lp.int(0);
+	for (id, fields) in entries {
+		let same_fields = fields.len() == master_fields.len()
+			&& fields
+				.iter()
+				.zip(master_fields)
+				.all(|((field, _), (master, _))| field == master);
+		lp.int(if same_fields {
+			STREAM_ITEM_FLAG_SAMEFIELDS
+		} else {
+			0
+		});
+		lp.int(id.ms.wrapping_sub(master_id.ms) as i64);
+		lp.int(id.seq.wrapping_sub(master_id.seq) as i64);
+		if same_fields {
+			for (_, value) in fields {
+				lp.string(value);
+			}
+			lp.int(fields.len() as i64 + 3);
+		} else {
+			lp.int(fields.len() as i64);
+			for (field, value) in fields {
+				lp.string(field);
+				lp.string(value);
+			}
+			lp.int(fields.len() as i64 * 2 + 4);
+		}
+	}
+	lp.finish()
+}
+
+/// A listpack under construction.
+#[derive(Default)]
+struct Listpack {
+	elements: BytesMut,
+	count: usize,
+}
+
+impl Listpack {
+	/// Append `value` in the smallest integer encoding that holds it.
+	fn int(&mut self, value: i64) {
+		let mut element = BytesMut::new();
+		match value {
+			0..=127 => element.put_u8(value as u8),
+			-4096..=4095 => element.put_u16(0xc000 | (value as u16 & 0x1fff)),
+			-32768..=32767 => {
+				element.put_u8(0xf1);
+				element.put_i16_le(value as i16);
+			}
+			-8388608..=8388607 => {
+				element.put_u8(0xf2);
+				element.extend_from_slice(&(value as i32).to_le_bytes()[..3]);
+			}
+			-2147483648..=2147483647 => {
+				element.put_u8(0xf3);
+				element.put_i32_le(value as i32);
+			}
+			_ => {
+				element.put_u8(0xf4);
+				element.put_i64_le(value);
+			}
+		}
+		self.push(&element);
+	}
+
+	fn string(&mut self, value: &[u8]) {
+		let mut element = BytesMut::new();
+		if value.len() < 1 << 6 {
+			element.put_u8(0x80 | value.len() as u8);
+		} else if value.len() < 1 << 12 {
+			element.put_u16(0xe000 | value.len() as u16);
+		} else {
+			element.put_u8(0xf0);
+			element.put_u32_le(value.len() as u32);
+		}
+		element.extend_from_slice(value);
+		self.push(&element);
+	}
+
+	/// Append an encoded element and its back length, seven bits per byte
+	/// with the high bit set on all but the first.
+	fn push(&mut self, element: &[u8]) {
+		self.elements.extend_from_slice(element);
+		let len = element.len();
+		let size = listpack_backlen_size(len);
+		for i in 0..size {
+			let byte = (len >> (7 * (size - 1 - i))) as u8 & 0x7f;
+			self.elements
+				.put_u8(if i == 0 { byte } else { byte | 0x80 });
+		}
+		self.count += 1;
+	}
+
+	/// The listpack: its total size and element count, the elements and the
+	/// end marker. Counts that do not fit the header are left to be walked.
+	fn finish(self) -> Bytes {
+		let mut buf = BytesMut::with_capacity(self.elements.len() + 7);
+		buf.put_u32_le(self.elements.len() as u32 + 7);
+		buf.put_u16_le(self.count.min(u16::MAX as usize) as u16);
+		buf.extend_from_slice(&self.elements);
+		buf.put_u8(0xff);
+		buf.freeze()
+	}
+}
+
+fn put_aux(buf: &mut BytesMut, name: &str, value: &str) {
+	buf.put_u8(OPCODE_AUX);
+	put_string(buf, name.as_bytes());
+	put_string(buf, value.as_bytes());
+}
+
+fn put_string(buf: &mut BytesMut, value: &[u8]) {
+	put_length(buf, value.len() as u64);
+	buf.extend_from_slice(value);
+}
+
+fn put_length(buf: &mut BytesMut, len: u64) {
+	if len < 1 << 6 {
+		buf.put_u8(len as u8);
+	} else if len < 1 << 14 {
+		buf.put_u16(0x4000 | len as u16);
+	} else if len <= u32::MAX as u64 {
+		buf.put_u8(0x80);
+		buf.put_u32(len as u32);
+	} else {
+		buf.put_u8(0x81);
+		buf.put_u64(len);
+	}
+}
+
+/// CRC-64/Jones, reflected, as used by Redis for RDB checksums.
+pub fn crc64(data: &[u8]) -> u64 {
+	const POLY: u64 = 0x95ac_9329_ac4b_c9b5;
+	let mut crc = 0u64;
+	for &byte in data {
+		crc ^= byte as u64;
+		for _ in 0..8 {
+			crc = if crc & 1 == 1 {
+				(crc >> 1) ^ POLY
+			} else {
+				crc >> 1
+			};
+		}
+	}
+	crc
+}
+
+fn invalid(message: impl Into<String>) -> StorageError {
+	StorageError::InvalidRdb {
+		message: message.into(),
+	}
+}
+
+/// Decode the keys of database 0 of an RDB file, returning them with the
+/// number of keys of other databases, which are left out. Expired keys are
+/// returned as is.
+pub fn decode(data: &[u8]) -> Result<(Vec<RdbEntry>, usize), StorageError> {
+	let mut reader = Reader::new(data);
+	if reader.take(MAGIC.len())? != MAGIC {
+		return Err(invalid("wrong signature"));
+	}
+	let version = std::str::from_utf8(reader.take(4)?)
+		.ok()
+		.and_then(|version| version.parse::<u32>().ok())
+		.ok_or_else(|| invalid("wrong version"))?;
+	if version == 0 || version > MAX_RDB_VERSION {
+		return Err(invalid(format!("unsupported version {}", version)));
+	}
+
+	let mut entries = Vec::new();
+	let mut skipped = 0;
+	let mut db = 0;
+	let mut expire_ts = None;
+	loop {
+		let type_code = reader.u8()?;
+		match type_code {
+			OPCODE_EOF => break,
+			OPCODE_SELECTDB => db = reader.length()?,
+			OPCODE_RESIZEDB => {
+				reader.length()?;
+				reader.length()?;
+			}
+			OPCODE_EXPIRETIME_MS => {
+				expire_ts = Some(i64::from_le_bytes(reader.take(8)?.try_into().unwrap()));
+			}
+			OPCODE_EXPIRETIME => {
+				let secs = i32::from_le_bytes(reader.take(4)?.try_into().unwrap());
+				expire_ts = Some(secs as i64 * 1000);
+			}
+			OPCODE_AUX => {
+				reader.string()?;
+				reader.string()?;
+			}
+			OPCODE_IDLE => {
+				reader.length()?;
+			}
+			OPCODE_FREQ => {
+				reader.u8()?;
+			}
+			OPCODE_SLOT_INFO => {
+				for _ in 0..3 {
+					reader.length()?;
+				}
+			}
+			// Function libraries are not keys; they are loaded with FUNCTION
+			// RESTORE, not from here.
+			OPCODE_FUNCTION_2 => {
+				reader.string()?;
+			}
+			OPCODE_FUNCTION_PRE_GA | OPCODE_MODULE_AUX => {
+				return Err(invalid(format!("unsupported opcode {:#x}", type_code)));
+			}
+			_ => {
+				let key = reader.string()?;
+				let value = reader.value(type_code)?;
+				if db == 0 {
+					entries.push(RdbEntry {
+						key,
+						value,
+						expire_ts,
+					});
+				} else {
+					skipped += 1;
+				}
+				expire_ts = None;
+			}
+		}
+	}
+
+	// Files before version 5 have no checksum, and a zero checksum means
+	// Redis was configured not to compute one.
+	if version >= 5 {
+		let end = reader.pos;
+		let checksum = u64::from_le_bytes(reader.take(8)?.try_into().unwrap());
+		if checksum != 0 && checksum != crc64(&data[..end]) {
+			return Err(invalid("checksum mismatch"));
+		}
+	}
+	Ok((entries, skipped))
+}
+
+struct Reader<'a> {
+	data: &'a [u8],
+	pos: usize,
+}
+
+impl<'a> Reader<'a> {
+	fn new(data: &'a [u8]) -> Self {
+		Self { data, pos: 0 }
+	}
+
+	fn is_empty(&self) -> bool {
+		self.pos >= self.data.len()
+	}
+
+	fn take(&mut self, len: usize) -> Result<&'a [u8], StorageError> {
+		let bytes = self
+			.pos
+			.checked_add(len)
+			.and_then(|end| self.data.get(self.pos..end))
+			.ok_or_else(|| invalid("unexpected end of data"))?;
+		self.pos += len;
+		Ok(bytes)
+	}
+
+	fn u8(&mut self) -> Result<u8, StorageError> {
+		Ok(self.take(1)?[0])
+	}
+
+	/// A length, or with the flag set, the kind of a specially encoded
+	/// string.
+	fn length_or_encoding(&mut self) -> Result<(u64, bool), StorageError> {
+		let first = self.u8()?;
+		Ok(match first >> 6 {
+			0 => ((first & 0x3f) as u64, false),
+			1 => ((((first & 0x3f) as u64) << 8) | self.u8()? as u64, false),
+			3 => ((first & 0x3f) as u64, true),
+			_ => match first {
+				0x80 => (
+					u32::from_be_bytes(self.take(4)?.try_into().unwrap()) as u64,
+					false,
+				),
+				0x81 => (u64::from_be_bytes(self.take(8)?.try_into().unwrap()), false),
+				_ => return Err(invalid(format!("unknown length encoding {:#x}", first))),
+			},
+		})
+	}
+
+	fn length(&mut self) -> Result<u64, StorageError> {
+		match self.length_or_encoding()? {
+			(len, false) => Ok(len),
+			(_, true) => Err(invalid("unexpected string encoding")),
+		}
+	}
+
+	/// A length used to size a collection, bounded by the remaining data so
+	/// that a corrupt file cannot make us allocate without limit.
+	fn count(&mut self) -> Result<usize, StorageError> {
+		let count = self.length()?;
+		if count > (self.data.len() - self.pos) as u64 {
+			return Err(invalid("collection larger than the file"));
+		}
+		Ok(count as usize)
+	}
+
+	fn string(&mut self) -> Result<Bytes, StorageError> {
+		let (len, encoded) = self.length_or_encoding()?;
+		if !encoded {
+			return Ok(Bytes::copy_from_slice(self.take(len as usize)?));
+		}
+		let int = match len {
+			ENC_INT8 => self.u8()? as i8 as i64,
+			ENC_INT16 => i16::from_le_bytes(self.take(2)?.try_into().unwrap()) as i64,
+			ENC_INT32 => i32::from_le_bytes(self.take(4)?.try_into().unwrap()) as i64,
+			ENC_LZF => {
+				let compressed_len = self.length()? as usize;
+				let len = self.length()? as usize;
+				return lzf_decompress(self.take(compressed_len)?, len).map(Bytes::from);
+			}
+			_ => return Err(invalid(format!("unknown string encoding {}", len))),
+		};
+		Ok(Bytes::from(int.to_string()))
+	}
+
+	/// A score of the original sorted set encoding: a length-prefixed decimal
+	/// string, with three lengths reserved for NaN and the infinities.
+	fn string_score(&mut self) -> Result<f64, StorageError> {
+		match self.u8()? {
+			253 => Ok(f64::NAN),
+			254 => Ok(f64::INFINITY),
+			255 => Ok(f64::NEG_INFINITY),
+			len => parse_score(self.take(len as usize)?),
+		}
+	}
+
+	/// The value of a key of type `type_code`.
+	fn value(&mut self, type_code: u8) -> Result<RdbValue, StorageError> {
+		let value = match type_code {
+			TYPE_STRING => RdbValue::String(self.string()?),
+			TYPE_LIST | TYPE_SET => {
+				let count = self.count()?;
+				let mut elements = Vec::with_capacity(count);
+				for _ in 0..count {
+					elements.push(self.string()?);
+				}
+				if type_code == TYPE_LIST {
+					RdbValue::List(elements)
+				} else {
+					RdbValue::Set(elements)
+				}
+			}
+			TYPE_ZSET | TYPE_ZSET_2 => {
+				let count = self.count()?;
+				let mut members = Vec::with_capacity(count);
+				for _ in 0..count {
+					let member = self.string()?;
+					let score = if type_code == TYPE_ZSET {
+						self.string_score()?
+					} else {
+						f64::from_le_bytes(self.take(8)?.try_into().unwrap())
+					};
+					members.push((member, score));
+				}
+				RdbValue::ZSet(members)
+			}
+			TYPE_HASH => {
+				let count = self.count()?;
+				let mut fields = Vec::with_capacity(count);
+				for _ in 0..count {
+					fields.push((self.string()?, self.string()?));
+				}
+				RdbValue::Hash(fields)
+			}
+			TYPE_HASH_ZIPMAP => RdbValue::Hash(zipmap_entries(&self.string()?)?),
+			TYPE_LIST_ZIPLIST => RdbValue::List(ziplist_entries(&self.string()?)?),
+			TYPE_SET_INTSET => RdbValue::Set(intset_entries(&self.string()?)?),
+			TYPE_SET_LISTPACK => RdbValue::Set(listpack_entries(&self.string()?)?),
+			TYPE_ZSET_ZIPLIST | TYPE_ZSET_LISTPACK => {
+				let data = self.string()?;
+				let flat = if type_code == TYPE_ZSET_ZIPLIST {
+					ziplist_entries(&data)?
+				} else {
+					listpack_entries(&data)?
+				};
+				RdbValue::ZSet(
+					pairs(flat)?
+						.into_iter()
+						.map(|(member, score)| Ok((member, parse_score(&score)?)))
+						.collect::<Result<_, StorageError>>()?,
+				)
+			}
+			TYPE_HASH_ZIPLIST | TYPE_HASH_LISTPACK => {
+				let data = self.string()?;
+				RdbValue::Hash(pairs(if type_code == TYPE_HASH_ZIPLIST {
+					ziplist_entries(&data)?
+				} else {
+					listpack_entries(&data)?
+				})?)
+			}
+			TYPE_LIST_QUICKLIST => {
+				let mut elements = Vec::new();
+				for _ in 0..self.count()? {
+					elements.extend(ziplist_entries(&self.string()?)?);
+				}
+				RdbValue::List(elements)
+			}
+			TYPE_LIST_QUICKLIST_2 => {
+				let mut elements = Vec::new();
+				for _ in 0..self.count()? {
+					let container = self.length()?;
+					let node = self.string()?;
+					match container {
+						QUICKLIST_NODE_PLAIN => elements.push(node),
+						QUICKLIST_NODE_PACKED => elements.extend(listpack_entries(&node)?),
+						_ => {
+							return Err(invalid(format!(
+								"unknown quicklist container {}",
+								container
+							)));
+						}
+					}
+				}
+				RdbValue::List(elements)
+			}
+			TYPE_STREAM_LISTPACKS | TYPE_STREAM_LISTPACKS_2 | TYPE_STREAM_LISTPACKS_3 => {
+				RdbValue::Stream(self.stream(type_code)?)
+			}
+			_ => return Err(invalid(format!("unsupported value type {}", type_code))),
+		};
+		Ok(value)
+	}
+
+	/// A stream as `put_stream` writes it. The second encoding adds the first
+	/// ID, the greatest deleted ID and the entries ever added after the last
+	/// ID, and the entries read to each group; the third adds the time a
+	/// consumer was last active after the time it was last seen.
+	fn stream(&mut self, type_code: u8) -> Result<RdbStream, StorageError> {
+		let mut stream = RdbStream::default();
+		for _ in 0..self.count()? {
+			let master_id = self.string()?;
+			let master_id = Some(&master_id)
+				.filter(|id| id.len() == 16)
+				.and_then(|id| StreamId::from_bytes(id))
+				.ok_or_else(|| invalid("invalid stream node key"))?;
+			let node = listpack_entries(&self.string()?)?;
+			stream_node_entries(master_id, &node, &mut stream.entries)?;
+		}
+		self.length()?;
+		stream.last_id = self.stream_id()?;
+		if type_code == TYPE_STREAM_LISTPACKS {
+			stream.entries_added = stream.entries.len() as u64;
+		} else {
+			self.stream_id()?;
+			stream.max_deleted_id = self.stream_id()?;
+			stream.entries_added = self.length()?;
+		}
+
+		for _ in 0..self.count()? {
+			let name = self.string()?;
+			let last_delivered_id = self.stream_id()?;
+			let entries_read = if type_code == TYPE_STREAM_LISTPACKS {
+				None
+			} else {
+				Some(self.length()?).filter(|&read| read != u64::MAX)
+			};
+			let mut pending = Vec::new();
+			let mut owners = Vec::new();
+			for _ in 0..self.count()? {
+				let id = self.raw_stream_id()?;
+				let delivery_time = self.millis()?;
+				let delivery_count = self.length()?;
+				pending.push(RdbPendingEntry {
+					id,
+					consumer: Bytes::new(),
+					delivery_time,
+					delivery_count,
+				});
+				owners.push(false);
+			}
+			let index: HashMap<StreamId, usize> = pending
+				.iter()
+				.enumerate()
+				.map(|(i, pending)| (pending.id, i))
+				.collect();
+			let mut consumers = Vec::new();
+			for _ in 0..self.count()? {
+				let name = self.string()?;
+				let seen_time = self.millis()?;
+				let active_time = if type_code == TYPE_STREAM_LISTPACKS_3 {
+					self.millis()?
+				} else {
+					seen_time
+				};
+				for _ in 0..self.count()? {
+					let id = self.raw_stream_id()?;
+					let &i = index
+						.get(&id)
+						.ok_or_else(|| invalid("consumer owns an entry its group does not"))?;
+					pending[i].consumer = name.clone();
+					owners[i] = true;
+				}
+				consumers.push(RdbStreamConsumer {
+					name,
+					seen_time,
+					active_time,
+				});
+			}
+			if owners.contains(&false) {
+				return Err(invalid("pending entry without a consumer"));
+			}
+			pending.sort_by_key(|pending| pending.id);
+			consumers.sort_by(|a, b| a.name.cmp(&b.name));
+			stream.groups.push(RdbStreamGroup {
+				name,
+				last_delivered_id,
+				entries_read,
+				pending,
+				consumers,
+			});
+		}
+		stream.entries.sort_by_key(|(id, _)| *id);
+		stream.groups.sort_by(|a, b| a.name.cmp(&b.name));
+		Ok(stream)
+	}
+
+	/// A stream ID as two lengths.
+	fn stream_id(&mut self) -> Result<StreamId, StorageError> {
+		Ok(StreamId::new(self.length()?, self.length()?))
+	}
+
+	/// A stream ID as its 16 big-endian bytes.
+	fn raw_stream_id(&mut self) -> Result<StreamId, StorageError> {
+		Ok(StreamId::from_bytes(self.take(16)?).unwrap())
+	}
+
+	/// A time in milliseconds, stored little-endian. Redis marks a time that
+	/// never happened as -1, which reads as 0.
+	fn millis(&mut self) -> Result<u64, StorageError> {
+		let millis = i64::from_le_bytes(self.take(8)?.try_into().unwrap());
+		Ok(millis.max(0) as u64)
+	}
+}
+
+/// Add the live entries of a stream listpack node, as `stream_node` writes
+/// it, to `entries`. Entries flagged as deleted are skipped.
+fn stream_node_entries(
+	master_id: StreamId,
+	node: &[Bytes],
+	entries: &mut Vec<(StreamId, Vec<(Bytes, Bytes)>)>,
+) -> Result<(), StorageError> {
+	let mut node = NodeElements(node.iter());
+	let count = node.count()?;
+	let deleted = node.count()?;
+	let master_fields = (0..node.count()?)
+		.map(|_| node.next().cloned())
+		.collect::<Result<Vec<_>, _>>()?;
+	node.next()?;
+	for _ in 0..count.saturating_add(deleted) {
+		let flags = node.int()?;
+		let id = StreamId::new(
+			master_id.ms.wrapping_add(node.int()? as u64),
+			master_id.seq.wrapping_add(node.int()? as u64),
+		);
+		let fields = if flags & STREAM_ITEM_FLAG_SAMEFIELDS != 0 {
+			master_fields
+				.iter()
+				.map(|field| Ok((field.clone(), node.next()?.clone())))
+				.collect::<Result<Vec<_>, StorageError>>()?
+		} else {
+			(0..node.count()?)
+				.map(|_| Ok((node.next()?.clone(), node.next()?.clone())))
+				.collect::<Result<Vec<_>, StorageError>>()?
+		};
+		node.next()?;
+		if flags & STREAM_ITEM_FLAG_DELETED == 0 {
+			entries.push((id, fields));
+		}
+	}
+	Ok(())
+}
+
+/// The elements of a stream listpack node, read in order.
+struct NodeElements<'a>(std::slice::Iter<'a, Bytes>);
+
+impl<'a> NodeElements<'a> {
+	fn next(&mut self) -> Result<&'a Bytes, StorageError> {
+		self.0
+			.next()
+			.ok_or_else(|| invalid("truncated stream node"))
+	}
+
+	fn int(&mut self) -> Result<i64, StorageError> {
+		std::str::from_utf8(self.next()?)
+			.ok()
+			.and_then(|int| int.parse().ok())
+			.ok_or_else(|| invalid("invalid integer in stream node"))
+	}
+
+	/// A count, bounded by the elements left.
+	fn count(&mut self) -> Result<usize, StorageError> {
+		let count = self.int()?;
+		if count < 0 || count as usize > self.0.len() {
+			return Err(invalid("invalid count in stream node"));
+		}
+		Ok(count as usize)
+	}
+}
+
+fn parse_score(score: &[u8]) -> Result<f64, StorageError> {
+	std::str::from_utf8(score)
+		.ok()
+		.and_then(|score| match score {
+			"inf" | "+inf" => Some(f64::INFINITY),
+			"-inf" => Some(f64::NEG_INFINITY),
+			_ => score.parse().ok(),
+		})
+		.ok_or_else(|| invalid("invalid sorted set score"))
+}
+
+/// Group the flat field, value sequence of a compact hash or sorted set.
+fn pairs(flat: Vec<Bytes>) -> Result<Vec<(Bytes, Bytes)>, StorageError> {
+	if !flat.len().is_multiple_of(2) {
+		return Err(invalid("odd number of entries in a pair encoding"));
+	}
+	let mut flat = flat.into_iter();
+	let mut pairs = Vec::new();
+	while let (Some(first), Some(second)) = (flat.next(), flat.next()) {
+		pairs.push((first, second));
+	}
+	Ok(pairs)
+}
+
+fn lzf_decompress(input: &[u8], len: usize) -> Result<Vec<u8>, StorageError> {
+	let corrupt = || invalid("corrupt LZF string");
+	let mut out = Vec::with_capacity(len);
+	let mut reader = Reader::new(input);
+	while !reader.is_empty() {
+		let ctrl = reader.u8()? as usize;
+		if ctrl < 1 << 5 {
+			out.extend_from_slice(reader.take(ctrl + 1).map_err(|_| corrupt())?);
+			continue;
+		}
+		// A back reference: the top three bits are the length, with 7
+		// meaning an extra length byte follows.
+		let mut run = ctrl >> 5;
+		if run == 7 {
+			run += reader.u8().map_err(|_| corrupt())? as usize;
+		}
+		let offset = ((ctrl & 0x1f) << 8) + reader.u8().map_err(|_| corrupt())? as usize + 1;
+		let start = out.len().checked_sub(offset).ok_or_else(corrupt)?;
+		for i in start..start + run + 2 {
+			out.push(out[i]);
+		}
+		if out.len() > len {
+			return Err(corrupt());
+		}
+	}
+	if out.len() != len {
+		return Err(corrupt());
+	}
+	Ok(out)
+}
+
+/// Entries of a ziplist: a header of total bytes, tail offset and count,
+/// then entries each prefixed by the length of the previous one.
+fn ziplist_entries(data: &[u8]) -> Result<Vec<Bytes>, StorageError> {
+	let mut reader = Reader::new(data);
+	reader.take(10)?;
+	let mut entries = Vec::new();
+	loop {
+		// The previous entry length, in one byte or, flagged by 0xfe, four.
+		match reader.u8()? {
+			0xff => break,
+			0xfe => {
+				reader.take(4)?;
+			}
+			_ => {}
+		}
+		let encoding = reader.u8()?;
+		let entry = match encoding >> 6 {
+			0 => reader.take((encoding & 0x3f) as usize)?,
+			1 => {
+				let len = (((encoding & 0x3f) as usize) << 8) | reader.u8()? as usize;
+				reader.take(len)?
+			}
+			2 => {
+				let len = u32::from_be_bytes(reader.take(4)?.try_into().unwrap());
+				reader.take(len as usize)?
+			}
+			_ => {
+				let int = match encoding {
+					0xc0 => i16::from_le_bytes(reader.take(2)?.try_into().unwrap()) as i64,
+					0xd0 => i32::from_le_bytes(reader.take(4)?.try_into().unwrap()) as i64,
+					0xe0 => i64::from_le_bytes(reader.take(8)?.try_into().unwrap()),
+					0xf0 => {
+						let bytes = reader.take(3)?;
+						i32::from_le_bytes([0, bytes[0], bytes[1], bytes[2]]) as i64 >> 8
+					}
+					0xfe => reader.u8()? as i8 as i64,
+					0xf1..=0xfd => (encoding & 0x0f) as i64 - 1,
+					_ => return Err(invalid("unknown ziplist encoding")),
+				};
+				entries.push(Bytes::from(int.to_string()));
+				continue;
+			}
+		};
+		entries.push(Bytes::copy_from_slice(entry));
+	}
+	Ok(entries)
+}
+
+/// Entries of a listpack: a header of total bytes and count, then entries
+/// each followed by its own length so it can be walked backwards.
+fn listpack_entries(data: &[u8]) -> Result<Vec<Bytes>, StorageError> {
+	let mut reader = Reader::new(data);
+	reader.take(6)?;
+	let mut entries = Vec::new();
+	loop {
+		let start = reader.pos;
+		let encoding = reader.u8()?;
+		if encoding == 0xff {
+			break;
+		}
+		let int = match encoding {
+			0x00..=0x7f => Some(encoding as i64),
+			0x80..=0xbf => {
+				let len = (encoding & 0x3f) as usize;
+				entries.push(Bytes::copy_from_slice(reader.take(len)?));
+				None
+			}
+			0xc0..=0xdf => {
+				let uint = (((encoding & 0x1f) as i64) << 8) | reader.u8()? as i64;
+				// Sign-extend from 13 bits.
+				Some((uint << 51) >> 51)
+			}
+			0xe0..=0xef => {
+				let len = (((encoding & 0x0f) as usize) << 8) | reader.u8()? as usize;
+				entries.push(Bytes::copy_from_slice(reader.take(len)?));
+				None
+			}
+			0xf0 => {
+				let len = u32::from_le_bytes(reader.take(4)?.try_into().unwrap());
+				entries.push(Bytes::copy_from_slice(reader.take(len as usize)?));
+				None
+			}
+			0xf1 => Some(i16::from_le_bytes(reader.take(2)?.try_into().unwrap()) as i64),
+			0xf2 => {
+				let bytes = reader.take(3)?;
+				Some(i32::from_le_bytes([0, bytes[0], bytes[1], bytes[2]]) as i64 >> 8)
+			}
+			0xf3 => Some(i32::from_le_bytes(reader.take(4)?.try_into().unwrap()) as i64),
+			0xf4 => Some(i64::from_le_bytes(reader.take(8)?.try_into().unwrap())),
+			_ => return Err(invalid("unknown listpack encoding")),
+		};
+		if let Some(int) = int {
+			entries.push(Bytes::from(int.to_string()));
+		}
+		reader.take(listpack_backlen_size(reader.pos - start))?;
+	}
+	Ok(entries)
+}
+
+/// Bytes taken by the back length of a listpack entry of `len` bytes: seven
+/// bits of the length per byte.
+fn listpack_backlen_size(len: usize) -> usize {
+	match len {
+		0..=127 => 1,
+		128..=16382 => 2,
+		16383..=2097150 => 3,
+		2097151..=268435454 => 4,
+		_ => 5,
+	}
+}
+
+/// Members of an intset: the byte width of every member, the count, then
+/// the sorted members.
+fn intset_entries(data: &[u8]) -> Result<Vec<Bytes>, StorageError> {
+	let mut reader = Reader::new(data);
+	let width = u32::from_le_bytes(reader.take(4)?.try_into().unwrap()) as usize;
+	let count = u32::from_le_bytes(reader.take(4)?.try_into().unwrap()) as usize;
+	let mut members = Vec::new();
+	for _ in 0..count {
+		let bytes = reader.take(width)?;
+		let member = match width {
+			2 => i16::from_le_bytes(bytes.try_into().unwrap()) as i64,
+			4 => i32::from_le_bytes(bytes.try_into().unwrap()) as i64,
+			8 => i64::from_le_bytes(bytes.try_into().unwrap()),
+			_ => return Err(invalid("unknown intset encoding")),
+		};
+		members.push(Bytes::from(member.to_string()));
+	}
+	Ok(members)
+}
+
+/// Fields of a zipmap, the hash encoding of Redis before 2.6: a count byte,
+/// then fields and values with a free-space byte after each value length.
+fn zipmap_entries(data: &[u8]) -> Result<Vec<(Bytes, Bytes)>, StorageError> {
+	let mut reader = Reader::new(data);
+	reader.u8()?;
+	let mut fields = Vec::new();
+	while let Some(len) = zipmap_length(&mut reader)? {
+		let field = Bytes::copy_from_slice(reader.take(len)?);
+		let len = zipmap_length(&mut reader)?.ok_or_else(|| invalid("truncated zipmap"))?;
+		let free = reader.u8()? as usize;
+		let value = Bytes::copy_from_slice(reader.take(len)?);
+		reader.take(free)?;
+		fields.push((field, value));
+	}
+	Ok(fields)
+}
+
+/// A zipmap length: one byte, or flagged by 0xfe, four. 0xff ends the map.
+fn zipmap_length(reader: &mut Reader) -> Result<Option<usize>, StorageError> {
+	Ok(match reader.u8()? {
+		0xff => None,
+		0xfe => Some(u32::from_le_bytes(reader.take(4)?.try_into().unwrap()) as usize),
+		len => Some(len as usize),
+	})
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+
+	#[test]
+	fn test_crc64() {
+		// The check value Redis tests its implementation with.
+		assert_eq!(crc64(b"123456789"), 0xe9c6_d914_c4b8_d9ca);
+	}
+
+	#[test]
+	fn test_put_length() {
+		let encode = |len| {
+			let mut buf = BytesMut::new();
+			put_length(&mut buf, len);
+			buf.to_vec()
+		};
+		assert_eq!(encode(10), vec![10]);
+		assert_eq!(encode(700), vec![0x42, 0xbc]);
+		assert_eq!(encode(17000), vec![0x80, 0, 0, 0x42, 0x68]);
+		assert_eq!(encode(1 << 33), vec![0x81, 0, 0, 0, 2, 0, 0, 0, 0]);
+	}
+
+	#[test]
+	fn test_encode_string() {
+		let encoded = encode(
+			&[RdbEntry {
+				key: Bytes::from("key"),
+				value: RdbValue::String(Bytes::from("value")),
+				expire_ts: Some(1_700_000_000_000),
+			}],
+			1_700_000_000,
+		);
+		assert!(encoded.starts_with(b"REDIS0011"));
+
+		let body = &encoded[..encoded.len() - 8];
+		let mut expected_tail = vec![OPCODE_SELECTDB, 0, OPCODE_RESIZEDB, 1, 1];
+		expected_tail.push(OPCODE_EXPIRETIME_MS);
+		expected_tail.extend_from_slice(&1_700_000_000_000i64.to_le_bytes());
+		expected_tail.extend_from_slice(b"\x00\x03key\x05value\xff");
+		assert!(body.ends_with(&expected_tail));
+		assert_eq!(&encoded[encoded.len() - 8..], &crc64(body).to_le_bytes());
+	}
+
+	#[test]
+	fn test_decode_roundtrip() {
+		let entries = vec![
+			RdbEntry {
+				key: Bytes::from("string"),
+				value: RdbValue::String(Bytes::from("value")),
+				expire_ts: Some(1_700_000_000_000),
+			},
+			RdbEntry {
+				key: Bytes::from("list"),
+				value: RdbValue::List(vec![Bytes::from("a"), Bytes::from("b")]),
+				expire_ts: None,
+			},
+			RdbEntry {
+				key: Bytes::from("set"),
+				value: RdbValue::Set(vec![Bytes::from("member")]),
+				expire_ts: None,
+			},
+			RdbEntry {
+				key: Bytes::from("zset"),
+				value: RdbValue::ZSet(vec![(Bytes::from("member"), -1.5)]),
+				expire_ts: None,
+			},
+			RdbEntry {
+				key: Bytes::from("hash"),
+				value: RdbValue::Hash(vec![(Bytes::from("field"), Bytes::from("x".repeat(100)))]),
+				expire_ts: None,
+			},
+		];
+		let encoded = encode(&entries, 1_700_000_000);
+		assert_eq!(decode(&encoded).unwrap(), (entries, 0));
+
+		let mut corrupt = encoded.to_vec();
+		corrupt[20] ^= 1;
+		assert!(matches!(
+			decode(&corrupt),
+			Err(StorageError::InvalidRdb { .. })
+		));
+		assert!(decode(b"REDIS0099").is_err());
+		assert!(decode(b"NOTRDB").is_err());
+	}
+
+	#[test]
+	fn test_decode_compact_encodings() {
+		let mut buf = BytesMut::new();
+		buf.extend_from_slice(b"REDIS0011");
+		buf.put_u8(OPCODE_SELECTDB);
+		put_length(&mut buf, 0);
+
+		buf.put_u8(OPCODE_EXPIRETIME);
+		buf.put_u32_le(1_700_000_000);
+		buf.put_u8(TYPE_SET_INTSET);
+		put_string(&mut buf, b"intset");
+		let mut intset = BytesMut::new();
+		intset.put_u32_le(2);
+		intset.put_u32_le(2);
+		intset.put_i16_le(-1);
+		intset.put_i16_le(7);
+		put_string(&mut buf, &intset);
+
+		// A listpack of "a", 5 (7-bit uint), "b" and -1 (13-bit int).
+		buf.put_u8(TYPE_ZSET_LISTPACK);
+		put_string(&mut buf, b"zset");
+		let listpack = [
+			0, 0, 0, 0, 4, 0, 0x81, b'a', 2, 0x05, 1, 0x81, b'b', 2, 0xdf, 0xff, 2, 0xff,
+		];
+		put_string(&mut buf, &listpack);
+
+		// A ziplist of "abc" and the 16-bit, 24-bit and 4-bit ints -2, -1 and 1.
+		buf.put_u8(TYPE_LIST_ZIPLIST);
+		put_string(&mut buf, b"list");
+		let ziplist = [
+			0, 0, 0, 0, 0, 0, 0, 0, 4, 0, 0, 0x03, b'a', b'b', b'c', 5, 0xc0, 0xfe, 0xff, 4, 0xf0,
+			0xff, 0xff, 0xff, 5, 0xf2, 0xff,
+		];
+		put_string(&mut buf, &ziplist);
+
+		// An LZF-compressed string of ten "a": a literal, then a back
+		// reference of nine.
+		buf.put_u8(TYPE_STRING);
+		put_string(&mut buf, b"lzf");
+		buf.put_u8(0xc0 | ENC_LZF as u8);
+		put_length(&mut buf, 5);
+		put_length(&mut buf, 10);
+		buf.extend_from_slice(&[0x00, b'a', 0xe0, 0x00, 0x00]);
+
+		// An integer-encoded string in another database.
+		buf.put_u8(OPCODE_SELECTDB);
+		put_length(&mut buf, 1);
+		buf.put_u8(TYPE_STRING);
+		put_string(&mut buf, b"other");
+		buf.put_u8(0xc0 | ENC_INT16 as u8);
+		buf.put_i16_le(1000);
+
+		buf.put_u8(OPCODE_EOF);
+		buf.put_u64_le(0);
+
+		let (entries, skipped) = decode(&buf).unwrap();
+		assert_eq!(skipped, 1);
+		assert_eq!(
+			entries,
+			vec![
+				RdbEntry {
+					key: Bytes::from("intset"),
+					value: RdbValue::Set(vec![Bytes::from("-1"), Bytes::from("7")]),
+					expire_ts: Some(1_700_000_000_000),
+				},
+				RdbEntry {
+					key: Bytes::from("zset"),
+					value: RdbValue::ZSet(vec![(Bytes::from("a"), 5.0), (Bytes::from("b"), -1.0)]),
+					expire_ts: None,
+				},
+				RdbEntry {
+					key: Bytes::from("list"),
+					value: RdbValue::List(vec![
+						Bytes::from("abc"),
+						Bytes::from("-2"),
+						Bytes::from("-1"),
+						Bytes::from("1")
+					]),
+					expire_ts: None,
+				},
+				RdbEntry {
+					key: Bytes::from("lzf"),
+					value: RdbValue::String(Bytes::from("a".repeat(10))),
+					expire_ts: None,
+				},
+			]
+		);
+	}
+
+	#[test]
+	fn test_dump_roundtrip() {
+		let values = [
+			RdbValue::String(Bytes::from("bar")),
+			RdbValue::List(vec![Bytes::from("a"), Bytes::from("b")]),
+			RdbValue::Set(vec![Bytes::from("m")]),
+			RdbValue::ZSet(vec![(Bytes::from("m"), 1.5)]),
+			RdbValue::Hash(vec![(Bytes::from("f"), Bytes::from("v"))]),
+		];
+		for value in values {
+			assert_eq!(undump(&dump(&value)).unwrap(), value);
+		}
+
+		let mut payload = dump(&RdbValue::String(Bytes::from("bar"))).to_vec();
+		let last = payload.len() - 1;
+		payload[last] ^= 1;
+		assert!(matches!(
+			undump(&payload),
+			Err(StorageError::InvalidArgument { .. })
+		));
+		assert!(matches!(
+			undump(b"short"),
+			Err(StorageError::InvalidArgument { .. })
+		));
+	}
+
+	#[test]
+	fn test_listpack_encoding() {
+		let ints = [
+			0,
+			127,
+			128,
+			-1,
+			4095,
+			-4096,
+			4096,
+			-32768,
+			32768,
+			-8388608,
+			8388608,
+			i32::MIN as i64,
+			i64::MAX,
+			i64::MIN,
+		];
+		let strings = [
+			Bytes::new(),
+			Bytes::from("x".repeat(63)),
+			Bytes::from("x".repeat(200)),
+			Bytes::from("x".repeat(5000)),
+		];
+		let mut lp = Listpack::default();
+		for int in ints {
+			lp.int(int);
+		}
+		for string in &strings {
+			lp.string(string);
+		}
+		let encoded = lp.finish();
+		assert_eq!(&encoded[..4], &(encoded.len() as u32).to_le_bytes());
+		let expected: Vec<_> = ints
+			.iter()
+			.map(|int| Bytes::from(int.to_string()))
+			.chain(strings)
+			.collect();
+		assert_eq!(listpack_entries(&encoded).unwrap(), expected);
+	}
+
+	fn stream_entry(
+		ms: u64,
+		fields: &[(&'static str, &'static str)],
+	) -> (StreamId, Vec<(Bytes, Bytes)>) {
+		let fields = fields
+			.iter()
+			.map(|(field, value)| (Bytes::from(*field), Bytes::from(*value)))
+			.collect();
+		(StreamId::new(ms, 0), fields)
+	}
+
+	#[test]
+	fn test_stream_dump_roundtrip() {
+		let mut entries: Vec<_> = (1..=150)
+			.map(|ms| stream_entry(ms, &[("name", "a"), ("n", "1")]))
+			.collect();
+		entries[7] = stream_entry(8, &[("other", "b")]);
+		entries[8] = stream_entry(9, &[]);
+		entries.push((
+			StreamId::new(150, 3),
+			vec![(Bytes::from("name"), Bytes::from("c"))],
+		));
+		let stream = RdbStream {
+			entries,
+			last_id: StreamId::new(200, 0),
+			entries_added: 153,
+			max_deleted_id: StreamId::new(160, 2),
+			groups: vec![
+				RdbStreamGroup {
+					name: Bytes::from("g1"),
+					last_delivered_id: StreamId::new(3, 0),
+					entries_read: Some(3),
+					pending: vec![
+						RdbPendingEntry {
+							id: StreamId::new(1, 0),
+							consumer: Bytes::from("bob"),
+							delivery_time: 1_700_000_000_000,
+							delivery_count: 2,
+						},
+						RdbPendingEntry {
+							id: StreamId::new(3, 0),
+							consumer: Bytes::from("alice"),
+							delivery_time: 1_700_000_000_001,
+							delivery_count: 1,
+						},
+					],
+					consumers: vec![
+						RdbStreamConsumer {
+							name: Bytes::from("alice"),
+							seen_time: 1_700_000_000_002,
+							active_time: 1_700_000_000_001,
+						},
+						RdbStreamConsumer {
+							name: Bytes::from("bob"),
+							seen_time: 1_700_000_000_003,
+							active_time: 1_700_000_000_003,
+						},
+						RdbStreamConsumer {
+							name: Bytes::from("idle"),
+							seen_time: 5,
+							active_time: 0,
+						},
+					],
+				},
+				RdbStreamGroup {
+					name: Bytes::from("g2"),
+					last_delivered_id: StreamId::MIN,
+					entries_read: None,
+					pending: Vec::new(),
+					consumers: Vec::new(),
+				},
+			],
+		};
+		let value = RdbValue::Stream(stream);
+		assert_eq!(undump(&dump(&value)).unwrap(), value);
+
+		let empty = RdbValue::Stream(RdbStream {
+			last_id: StreamId::new(5, 1),
+			entries_added: 0,
+			..RdbStream::default()
+		});
+		assert_eq!(undump(&dump(&empty)).unwrap(), empty);
+	}
+
+	#[test]
+	fn test_undump_stream_listpacks_3() {
+		// A node of 1-0 {f: v}, 1-1 deleted and 2-5 {g: w}: the master
+		// entry, then each entry's flags, ID deltas, fields and count.
+		let mut lp = Listpack::default();
+		for int in [2, 1, 1] {
+			lp.int(int);
+		}
+		lp.string(b"f");
+		lp.int(0);
+		for int in [STREAM_ITEM_FLAG_SAMEFIELDS, 0, 0] {
+			lp.int(int);
+		}
+		lp.string(b"v");
+		lp.int(4);
+		for int in [STREAM_ITEM_FLAG_SAMEFIELDS | STREAM_ITEM_FLAG_DELETED, 0, 1] {
+			lp.int(int);
+		}
+		lp.string(b"x");
+		lp.int(4);
+		for int in [0, 1, 5, 1] {
+			lp.int(int);
+		}
+		lp.string(b"g");
+		lp.string(b"w");
+		lp.int(6);
+
+		let mut buf = BytesMut::new();
+		buf.put_u8(TYPE_STREAM_LISTPACKS_3);
+		put_length(&mut buf, 1);
+		put_string(&mut buf, &StreamId::new(1, 0).to_bytes());
+		put_string(&mut buf, &lp.finish());
+		// Length, last ID, first ID, greatest deleted ID, entries added.
+		for length in [2, 2, 5, 1, 0, 1, 1, 3] {
+			put_length(&mut buf, length);
+		}
+		put_length(&mut buf, 1);
+		put_string(&mut buf, b"g1");
+		for length in [2, 5, 2] {
+			put_length(&mut buf, length);
+		}
+		put_length(&mut buf, 1);
+		buf.extend_from_slice(&StreamId::new(2, 5).to_bytes());
+		buf.put_u64_le(1000);
+		put_length(&mut buf, 3);
+		put_length(&mut buf, 1);
+		put_string(&mut buf, b"alice");
+		buf.put_u64_le(2000);
+		buf.put_i64_le(-1);
+		put_length(&mut buf, 1);
+		buf.extend_from_slice(&StreamId::new(2, 5).to_bytes());
+		buf.put_u16_le(11);
+		let checksum = crc64(&buf);
+		buf.put_u64_le(checksum);
+
+		assert_eq!(
+			undump(&buf).unwrap(),
+			RdbValue::Stream(RdbStream {
+				entries: vec![
+					(
+						StreamId::new(1, 0),
+						vec![(Bytes::from("f"), Bytes::from("v"))]
+					),
+					(
+						StreamId::new(2, 5),
+						vec![(Bytes::from("g"), Bytes::from("w"))]
+					),
+				],
+				last_id: StreamId::new(2, 5),
+				entries_added: 3,
+				max_deleted_id: StreamId::new(1, 1),
+				groups: vec![RdbStreamGroup {
+					name: Bytes::from("g1"),
+					last_delivered_id: StreamId::new(2, 5),
+					entries_read: Some(2),
+					pending: vec![RdbPendingEntry {
+						id: StreamId::new(2, 5),
+						consumer: Bytes::from("alice"),
+						delivery_time: 1000,
+						delivery_count: 3,
+					}],
+					consumers: vec![RdbStreamConsumer {
+						name: Bytes::from("alice"),
+						seen_time: 2000,
+						active_time: 0,
+					}],
+				}],
+			})
+		);
+	}
+
+	#[test]
+	fn test_undump_redis_payload() {
+		// DUMP of the integer-encoded string "10", from the Redis docs.
+		let payload = b"\x00\xc0\n\t\x00\xbem\x06\x89Z(\x00\n";
+		assert_eq!(
+			undump(payload).unwrap(),
+			RdbValue::String(Bytes::from("10"))
+		);
+	}
+}
@@ -0,0 +1,276 @@
+//! Point-in-time snapshots of the whole keyspace.
+//!
+//! A snapshot holds the raw entries of every storage DB that make up the
+//! live dataset at one moment: string values and collection metadata, with
+//! their expiry times, and the elements of the current generation of each
+//! collection. It is written as a single object under `snapshot/` in the
+//! object store, so a save either replaces the previous snapshot whole or
+//! leaves it untouched.
+
+use std::path::Path;
+use std::path::PathBuf;
+use std::sync::Arc;
+
+use bytes::Buf;
+use bytes::BufMut;
+use bytes::Bytes;
+use bytes::BytesMut;
+use slatedb::object_store::ObjectStore;
+use slatedb::object_store::path::Path as ObjectStorePath;
+use tokio::io::AsyncWriteExt;
+
+use crate::data_type::DataType;
+use crate::error::DecoderError;
+use crate::error::StorageError;
+use crate::journal::read_bytes;
+use crate::journal::read_u8;
+
+const SNAPSHOT_DIR: &str = "snapshot";
+const SNAPSHOT_FILE: &str = "dump.nsnap";
+const RDB_FILE: &str = "dump.rdb";
+const MAGIC: &[u8] = b"NIMBISSNAP";
+const FORMAT_VERSION: u8 = 1;
+
+/// One raw key of a storage DB. `data_type` selects the DB as in the undo
+/// journal: `DataType::String` is the DB that also holds collection
+/// metadata.
+#[derive(Debug, Clone, PartialEq)]
+pub struct SnapshotEntry {
+	pub data_type: DataType,
+	pub key: Bytes,
+	pub value: Bytes,
+	pub expire_ts: Option<i64>,
+}
+
+#[derive(Debug, Clone, PartialEq)]
+pub struct Snapshot {
+	/// When the snapshot was taken, in milliseconds since the epoch.
+	pub saved_at: i64,
+	pub entries: Vec<SnapshotEntry>,
+}
+
+impl Snapshot {
+	/// Number of user keys in the snapshot.
+	pub fn key_count(&self) -> usize {
+		self.entries
+			.iter()
+			.filter(|entry| entry.data_type == DataType::String)
+			.count()
+	}
+
+	pub fn encode(&self) -> Bytes {
+		let mut buf = BytesMut::new();
+		encode_header(&mut buf, self.saved_at, self.entries.len() as u64);
+		for entry in &self.entries {
+			encode_entry(&mut buf, entry);
+		}
+		buf.freeze()
+	}
+
+	pub fn decode(mut buf: &[u8]) -> Result<Self, DecoderError> {
+		if buf.remaining() < HEADER_LEN as usize || &buf[..MAGIC.len()] != MAGIC {
+			return Err(DecoderError::InvalidType);
+		}
+		buf.advance(MAGIC.len());
+		if buf.get_u8() != FORMAT_VERSION {
+			return Err(DecoderError::InvalidType);
+		}
+		let saved_at = buf.get_i64();
+		let count = buf.get_u64();
+
+		let mut entries = Vec::with_capacity(count.min(1 << 16) as usize);
+		for _ in 0..count {
+			let data_type =
+				DataType::from_u8(read_u8(&mut buf)?).ok_or(DecoderError::InvalidType)?;
+			let key = read_bytes(&mut buf)?;
+			let expire_ts = match read_u8(&mut buf)? {
+				0 => None,
+				_ => {
+					if buf.remaining() < 8 {
+						return Err(DecoderError::InvalidLength);
+					}
+					Some(buf.get_i64())
+				}
+			};
+			let value = read_bytes(&mut buf)?;
+			entries.push(SnapshotEntry {
+				data_type,
+				key,
+				value,
+				expire_ts,
+			});
+		}
+		if buf.has_remaining() {
+			return Err(DecoderError::InvalidLength);
+		}
+
+		Ok(Self { saved_at, entries })
+	}
+}
+
+/// Bytes `encode_header` writes.
+pub(crate) const HEADER_LEN: u64 = MAGIC.len() as u64 + 17;
+
+// [Magic] [Version: u8] [SavedAt: i64] [EntryCount: u64], then per entry
+// [DataType: u8] [KeyLen: u32] [Key] [HasExpiry: u8] [ExpireTs: i64, if any]
+// [ValueLen: u32] [Value]
+
+pub(crate) fn encode_header(buf: &mut BytesMut, saved_at: i64, count: u64) {
+	buf.extend_from_slice(MAGIC);
+	buf.put_u8(FORMAT_VERSION);
+	buf.put_i64(saved_at);
+	buf.put_u64(count);
+}
+
+pub(crate) fn encode_entry(buf: &mut BytesMut, entry: &SnapshotEntry) {
+	buf.put_u8(entry.data_type as u8);
+	buf.put_u32(entry.key.len() as u32);
+	buf.extend_from_slice(&entry.key);
+	match entry.expire_ts {
+		Some(ts) => {
+			buf.put_u8(1);
+			buf.put_i64(ts);
+		}
+		None => buf.put_u8(0),
+	}
+	buf.put_u32(entry.value.len() as u32);
+	buf.extend_from_slice(&entry.value);
+}
+
+/// Bytes `encode_entry` writes for `entry`.
+pub(crate) fn encoded_entry_len(entry: &SnapshotEntry) -> u64 {
+	let expiry = if entry.expire_ts.is_some() { 9 } else { 1 };
+	(1 + 4 + entry.key.len() + expiry + 4 + entry.value.len()) as u64
+}
+
+/// Write `snapshot` where a store rooted at the local directory `dir` keeps
+/// its snapshot, returning the file written. The file is synced and then
+/// renamed into place, so it is never seen half written.
+pub(crate) async fn write_to_dir(dir: &Path, snapshot: &Snapshot) -> Result<PathBuf, StorageError> {
+	let snapshot_dir = dir.join(SNAPSHOT_DIR);
+	tokio::fs::create_dir_all(&snapshot_dir).await?;
+	let path = snapshot_dir.join(SNAPSHOT_FILE);
+	let partial = snapshot_dir.join(format!("{}.tmp", SNAPSHOT_FILE));
+	let mut file = tokio::fs::File::create(&partial).await?;
+	file.write_all(&snapshot.encode()).await?;
+	file.sync_all().await?;
+	tokio::fs::rename(&partial, &path).await?;
+	Ok(path)
+}
+
+/// Read the snapshot that `write_to_dir` wrote under `dir`, with the file it
+/// was read from.
+pub(crate) async fn read_from_dir(dir: &Path) -> Result<(PathBuf, Snapshot), StorageError> {
+	let path = dir.join(SNAPSHOT_DIR).join(SNAPSHOT_FILE);
+	let data = match tokio::fs::read(&path).await {
+		Ok(data) => data,
+		Err(err) if err.kind() == std::io::ErrorKind::NotFound => {
+			return Err(StorageError::InvalidArgument {
+				message: format!("ERR no backup at {}", path.display()),
+			});
+		}
+		Err(err) => return Err(err.into()),
+	};
+	let snapshot = Snapshot::decode(&data)?;
+	Ok((path, snapshot))
+}
+
+pub struct SnapshotStore {
+	object_store: Arc<dyn ObjectStore>,
+	path: ObjectStorePath,
+	rdb_path: ObjectStorePath,
+}
+
+impl SnapshotStore {
+	pub fn new(object_store: Arc<dyn ObjectStore>, root_path: &ObjectStorePath) -> Self {
+		Self {
+			object_store,
+			path: root_path.child(SNAPSHOT_DIR).child(SNAPSHOT_FILE),
+			rdb_path: root_path.child(SNAPSHOT_DIR).child(RDB_FILE),
+		}
+	}
+
+	/// The last snapshot saved, if any.
+	pub async fn get(&self) -> Result<Option<Snapshot>, StorageError> {
+		match self.object_store.get(&self.path).await {
+			Ok(result) => Ok(Some(Snapshot::decode(&result.bytes().await?)?)),
+			Err(slatedb::object_store::Error::NotFound { .. }) => Ok(None),
+			Err(err) => Err(err.into()),
+		}
+	}
+
+	pub async fn put(&self, snapshot: &Snapshot) -> Result<(), StorageError> {
+		self.object_store
+			.put(&self.path, snapshot.encode().into())
+			.await?;
+		Ok(())
+	}
+
+	/// Replace the exported RDB file with `data`, returning its path in the
+	/// object store.
+	pub async fn put_rdb(&self, data: Bytes) -> Result<String, StorageError> {
+		self.object_store.put(&self.rdb_path, data.into()).await?;
+		Ok(self.rdb_path.to_string())
+	}
+
+	/// The RDB file at the export path, if any, with that path.
+	pub async fn get_rdb(&self) -> Result<(String, Option<Bytes>), StorageError> {
+		let path = self.rdb_path.to_string();
+		match self.object_store.get(&self.rdb_path).await {
+			Ok(result) => Ok((path, Some(result.bytes().await?))),
+			Err(slatedb::object_store::Error::NotFound { .. }) => Ok((path, None)),
+			Err(err) => Err(err.into()),
+		}
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+
+	fn snapshot() -> Snapshot {
+		Snapshot {
+			saved_at: 1_700_000_000_000,
+			entries: vec![
+				SnapshotEntry {
+					data_type: DataType::String,
+					key: Bytes::from("meta-key"),
+					value: Bytes::from("value"),
+					expire_ts: Some(1_700_000_100_000),
+				},
+				SnapshotEntry {
+					data_type: DataType::Hash,
+					key: Bytes::from("field-key"),
+					value: Bytes::new(),
+					expire_ts: None,
+				},
+			],
+		}
+	}
+
+	#[test]
+	fn test_snapshot_roundtrip() {
+		let snapshot = snapshot();
+		assert_eq!(snapshot.key_count(), 1);
+		assert_eq!(Snapshot::decode(&snapshot.encode()).unwrap(), snapshot);
+	}
+
+	#[test]
+	fn test_encoded_len() {
+		let snapshot = snapshot();
+		let len = HEADER_LEN + snapshot.entries.iter().map(encoded_entry_len).sum::<u64>();
+		assert_eq!(len, snapshot.encode().len() as u64);
+	}
+
+	#[test]
+	fn test_decode_damaged_snapshot() {
+		let encoded = snapshot().encode();
+		assert!(Snapshot::decode(&encoded[..encoded.len() - 1]).is_err());
+		assert!(Snapshot::decode(&encoded[1..]).is_err());
+		assert!(Snapshot::decode(b"").is_err());
+
+		let mut extra = encoded.to_vec();
+		extra.push(0);
+		assert!(Snapshot::decode(&extra).is_err());
+	}
+}
@@ -0,0 +1,217 @@
+//! Storage engine statistics for monitoring.
+//!
+//! File counts and sizes come from listing the objects of each DB, grouped
+//! by the directories SlateDB keeps them in: sorted tables under
+//! `compacted/`, write-ahead log tables under `wal/` and manifests under
+//! `manifest/`. Engine counters and gauges, such as request, cache and
+//! compaction stats, come from the stat registry of each DB. Key names come
+//! from walking the meta records in batches.
+
+use std::sync::Arc;
+
+use bytes::Bytes;
+use futures::TryStreamExt;
+use slatedb::object_store::ObjectStore;
+use slatedb::object_store::path::Path as ObjectStorePath;
+
+use crate::compaction_filter::CollectionCompactionFilter;
+use crate::data_type::DataType;
+use crate::error::StorageError;
+use crate::storage::Storage;
+use crate::utils::is_expired;
+
+const SST_DIR: &str = "compacted";
+const WAL_DIR: &str = "wal";
+const MANIFEST_DIR: &str = "manifest";
+
+/// Every DB by the name of its directory, in the order they are opened.
+const DBS: [(&str, DataType); 7] = [
+	("string", DataType::String),
+	("hash", DataType::Hash),
+	("list", DataType::List),
+	("set", DataType::Set),
+	("zset", DataType::ZSet),
+	("stream", DataType::Stream),
+	("bitmap", DataType::Bitmap),
+];
+
+/// Objects of one DB in the object store.
+#[derive(Debug, Clone, Default, PartialEq)]
+pub struct DbFiles {
+	pub sst_files: u64,
+	pub sst_bytes: u64,
+	pub wal_files: u64,
+	pub wal_bytes: u64,
+	pub manifest_files: u64,
+	/// Bytes of every object of the DB, including manifests and compaction
+	/// state.
+	pub total_bytes: u64,
+}
+
+#[derive(Debug, Clone)]
+pub struct DbStats {
+	pub name: &'static str,
+	pub files: DbFiles,
+	/// Engine stats by their SlateDB name, such as `db/get_requests`.
+	pub metrics: Vec<(&'static str, i64)>,
+}
+
+/// The key names one `Storage::key_names` batch read.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct KeyNames {
+	pub keys: Vec<Bytes>,
+	/// Where the next batch starts, or `None` once every key was read.
+	pub next: Option<Bytes>,
+}
+
+pub struct StorageFiles {
+	object_store: Arc<dyn ObjectStore>,
+	root_path: ObjectStorePath,
+}
+
+impl StorageFiles {
+	pub fn new(object_store: Arc<dyn ObjectStore>, root_path: &ObjectStorePath) -> Self {
+		Self {
+			object_store,
+			root_path: root_path.clone(),
+		}
+	}
+
+	/// Count the objects of the DB stored under `name`.
+	pub async fn db_files(&self, name: &str) -> Result<DbFiles, StorageError> {
+		let dir = self.root_path.child(name);
+		let metas: Vec<_> = self.object_store.list(Some(&dir)).try_collect().await?;
+		let mut files = DbFiles::default();
+		for meta in metas {
+			let size = meta.size as u64;
+			files.total_bytes += size;
+			let kind = meta
+				.location
+				.prefix_match(&dir)
+				.and_then(|mut parts| parts.next());
+			match kind.as_ref().map(|part| part.as_ref()) {
+				Some(SST_DIR) => {
+					files.sst_files += 1;
+					files.sst_bytes += size;
+				}
+				Some(WAL_DIR) => {
+					files.wal_files += 1;
+					files.wal_bytes += size;
+				}
+				Some(MANIFEST_DIR) => files.manifest_files += 1,
+				_ => {}
+			}
+		}
+		Ok(files)
+	}
+}
+
+impl Storage {
+	/// Files and engine stats of every DB.
+	#[fastrace::trace]
+	pub async fn db_stats(&self) -> Result<Vec<DbStats>, StorageError> {
+		let mut stats = Vec::with_capacity(DBS.len());
+		for (name, data_type) in DBS {
+			let files = self.files.db_files(name).await?;
+			let registry = self.db(data_type).metrics();
+			let metrics = registry
+				.names()
+				.into_iter()
+				.filter_map(|metric| registry.lookup(metric).map(|stat| (metric, stat.get())))
+				.collect();
+			stats.push(DbStats {
+				name,
+				files,
+				metrics,
+			});
+		}
+		Ok(stats)
+	}
+
+	/// Read the names of up to `limit` live keys from `start`, or from the
+	/// first key.
+	#[fastrace::trace]
+	pub async fn key_names(
+		&self,
+		start: Option<Bytes>,
+		limit: usize,
+	) -> Result<KeyNames, StorageError> {
+		let mut names = KeyNames::default();
+		let mut stream = self.string_db.scan(start.unwrap_or_default()..).await?;
+		while let Some(kv) = stream.next().await? {
+			if names.keys.len() == limit {
+				names.next = Some(kv.key);
+				break;
+			}
+			if is_expired(kv.expire_ts) {
+				continue;
+			}
+			if let Some(key) = CollectionCompactionFilter::decode_sub_key(&kv.key) {
+				names.keys.push(key);
+			}
+		}
+		Ok(names)
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use bytes::Bytes;
+
+	use super::*;
+
+	#[tokio::test]
+	async fn test_db_stats() {
+		let timestamp = ulid::Ulid::new().to_string();
+		let path = std::env::temp_dir().join(format!("nimbis_test_stats_{}", timestamp));
+		std::fs::create_dir_all(&path).unwrap();
+		let storage = Storage::open(&path, None).await.unwrap();
+		storage
+			.set(Bytes::from("key"), Bytes::from("value"))
+			.await
+			.unwrap();
+		storage.rewrite_log().await.unwrap();
+
+		let stats = storage.db_stats().await.unwrap();
+		let names: Vec<_> = stats.iter().map(|db| db.name).collect();
+		assert_eq!(
+			names,
+			vec!["string", "hash", "list", "set", "zset", "stream", "bitmap"]
+		);
+		let string = &stats[0];
+		assert!(string.files.sst_files > 0);
+		assert!(string.files.manifest_files > 0);
+		assert!(string.files.total_bytes >= string.files.sst_bytes + string.files.wal_bytes);
+		assert!(!string.metrics.is_empty());
+
+		storage.close().await.unwrap();
+		std::fs::remove_dir_all(path).unwrap();
+	}
+
+	#[tokio::test]
+	async fn test_key_names() {
+		let timestamp = ulid::Ulid::new().to_string();
+		let path = std::env::temp_dir().join(format!("nimbis_test_key_names_{}", timestamp));
+		std::fs::create_dir_all(&path).unwrap();
+		let storage = Storage::open(&path, None).await.unwrap();
+		for key in ["a", "b", "c"] {
+			storage
+				.set(Bytes::from(key), Bytes::from("value"))
+				.await
+				.unwrap();
+		}
+		storage
+			.hset(Bytes::from("h"), Bytes::from("field"), Bytes::from("value"))
+			.await
+			.unwrap();
+
+		let first = storage.key_names(None, 2).await.unwrap();
+		assert_eq!(first.keys, vec![Bytes::from("a"), Bytes::from("b")]);
+		let rest = storage.key_names(first.next, 10).await.unwrap();
+		assert_eq!(rest.keys, vec![Bytes::from("c"), Bytes::from("h")]);
+		assert_eq!(rest.next, None);
+
+		storage.close().await.unwrap();
+		std::fs::remove_dir_all(path).unwrap();
+	}
+}
@@ -1,9 +1,17 @@
 use std::sync::Arc;
+use std::sync::OnceLock;
 
 use bytes::Bytes;
+use log::info;
+use log::warn;
 use nimbis_macros::storage_lock;
+use slatedb::CompactorBuilder;
 use slatedb::Db;
+use slatedb::config::CompactorOptions;
+use slatedb::config::FlushOptions;
+use slatedb::config::FlushType;
 use slatedb::config::PutOptions;
+use slatedb::config::Ttl;
 use slatedb::config::WriteOptions;
 use slatedb::db_cache::foyer::FoyerCache;
 use slatedb::object_store::ObjectStore;
@@ -12,14 +20,31 @@ use slatedb::object_store::local::LocalFileSystem;
 use slatedb::object_store::parse_url_opts;
 use slatedb::object_store::path::Path as ObjectStorePath;
 
+use crate::compaction_filter::CollectionCompactionFilter;
 use crate::compaction_filter::CollectionCompactionFilterSupplier;
+use crate::compression::Codec;
+use crate::compression::Compression;
+use crate::compression::CompressionStats;
 use crate::data_type::DataType;
 use crate::error::StorageError;
+use crate::hot_cache::CachedRecord;
+use crate::hot_cache::HotCache;
+use crate::hot_cache::HotCacheStats;
+use crate::journal::UndoJournal;
+use crate::journal::UndoRecord;
+use crate::keyspace::Keyspace;
+use crate::keyspace::KeyspaceCounts;
+use crate::keyspace::meta_user_key;
 use crate::lock::StorageLock;
 use crate::lock::StorageLockGuard;
 use crate::lock::StorageLocks;
+use crate::metadata::MetadataStore;
+use crate::snapshot::SnapshotStore;
+use crate::stats::StorageFiles;
+use crate::string::meta::AnyValue;
 use crate::string::meta::MetaKey;
 use crate::string::meta::MetaValue;
+use crate::string::value::StringValue;
 use crate::utils::is_expired;
 
 #[derive(Clone)]
@@ -29,7 +54,49 @@ pub struct Storage {
 	pub(crate) list_db: Arc<Db>,
 	pub(crate) set_db: Arc<Db>,
 	pub(crate) zset_db: Arc<Db>,
+	pub(crate) stream_db: Arc<Db>,
+	pub(crate) bitmap_db: Arc<Db>,
 	locks: Arc<StorageLocks>,
+	journal: Arc<UndoJournal>,
+	metadata: Arc<MetadataStore>,
+	pub(crate) snapshots: Arc<SnapshotStore>,
+	pub(crate) files: Arc<StorageFiles>,
+	expire_listener: Arc<OnceLock<ExpireListener>>,
+	compression: Arc<Compression>,
+	hot_cache: Arc<HotCache>,
+	pub(crate) keyspace: Arc<Keyspace>,
+	/// Flushes of every DB left to fail after flushing the first one.
+	#[cfg(test)]
+	failing_flushes: Arc<std::sync::atomic::AtomicUsize>,
+}
+
+/// Settings of the compactor of every DB.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct CompactorSettings {
+	/// Compactions each DB runs at once, or the engine default with `None`.
+	pub max_concurrent_compactions: Option<usize>,
+}
+
+impl CompactorSettings {
+	fn options(&self) -> CompactorOptions {
+		let mut options = CompactorOptions::default();
+		if let Some(compactions) = self.max_concurrent_compactions {
+			options.max_concurrent_compactions = compactions;
+		}
+		options
+	}
+}
+
+/// Called with the user key of each key storage deletes because it expired,
+/// while the key is still locked.
+pub type ExpireListener = Box<dyn Fn(&Bytes) + Send + Sync>;
+
+/// The TTL of a key written now that must expire at `expire_ts`.
+pub(crate) fn ttl_until(expire_ts: Option<i64>) -> Ttl {
+	match expire_ts {
+		Some(ts) => Ttl::ExpireAfter((ts - chrono::Utc::now().timestamp_millis()).max(0) as u64),
+		None => Ttl::NoExpiry,
+	}
 }
 
 fn shard_path(base_path: ObjectStorePath, shard_id: Option<usize>) -> ObjectStorePath {
@@ -64,6 +131,16 @@ pub fn validate_object_store_url(url: &str) -> Result<(), StorageError> {
 	Ok(())
 }
 
+/// The local directory the object store at `url` keeps its files in, or
+/// `None` when it is not on the local filesystem.
+pub fn local_store_path(url: &str) -> Option<std::path::PathBuf> {
+	let parsed = url::Url::parse(url).ok()?;
+	match ObjectStoreScheme::parse(&parsed) {
+		Ok((ObjectStoreScheme::Local, _)) => local_file_root(url, &parsed).ok(),
+		_ => None,
+	}
+}
+
 fn local_file_root(raw_url: &str, url: &url::Url) -> Result<std::path::PathBuf, StorageError> {
 	let Some(path) = raw_url.strip_prefix("file:") else {
 		return Ok(std::path::PathBuf::from(url.path()));
@@ -114,6 +191,12 @@ impl Storage {
 		list_db: Arc<Db>,
 		set_db: Arc<Db>,
 		zset_db: Arc<Db>,
+		stream_db: Arc<Db>,
+		bitmap_db: Arc<Db>,
+		journal: UndoJournal,
+		metadata: MetadataStore,
+		snapshots: SnapshotStore,
+		files: StorageFiles,
 	) -> Self {
 		Self {
 			string_db,
@@ -121,10 +204,439 @@ impl Storage {
 			list_db,
 			set_db,
 			zset_db,
+			stream_db,
+			bitmap_db,
 			locks: Arc::new(StorageLocks::new()),
+			journal: Arc::new(journal),
+			metadata: Arc::new(metadata),
+			snapshots: Arc::new(snapshots),
+			files: Arc::new(files),
+			expire_listener: Arc::new(OnceLock::new()),
+			compression: Arc::new(Compression::default()),
+			hot_cache: Arc::new(HotCache::default()),
+			keyspace: Arc::new(Keyspace::default()),
+			#[cfg(test)]
+			failing_flushes: Arc::new(std::sync::atomic::AtomicUsize::new(0)),
+		}
+	}
+
+	/// Set the listener told about expired keys storage deletes. Only the
+	/// first listener set is kept.
+	pub fn set_expire_listener(&self, listener: ExpireListener) {
+		let _ = self.expire_listener.set(listener);
+	}
+
+	pub(crate) fn notify_expired(&self, key: &Bytes) {
+		if let Some(listener) = self.expire_listener.get() {
+			listener(key);
+		}
+	}
+
+	/// Compress string values of at least `threshold` bytes written from now
+	/// on with `codec`. Values already written are read back either way.
+	pub fn set_compression(&self, codec: Codec, threshold: usize) {
+		self.compression.configure(codec, threshold);
+	}
+
+	pub fn compression_stats(&self) -> CompressionStats {
+		self.compression.stats()
+	}
+
+	/// Keep up to `max_keys` records of the string DB of at most
+	/// `max_value_size` bytes in memory once read. `0` keys turns the cache
+	/// off. Whatever was cached is dropped.
+	pub fn set_hot_cache(&self, max_keys: usize, max_value_size: usize) {
+		self.hot_cache.configure(max_keys, max_value_size);
+	}
+
+	pub fn hot_cache_stats(&self) -> HotCacheStats {
+		self.hot_cache.stats()
+	}
+
+	/// Read the string DB record of user `key`, through the hot cache.
+	pub(crate) async fn string_record(
+		&self,
+		key: &Bytes,
+	) -> Result<Option<CachedRecord>, StorageError> {
+		if let Some(record) = self.hot_cache.get(key) {
+			return Ok(Some(record));
+		}
+		let epoch = self.hot_cache.epoch();
+		let Some(kv) = self
+			.string_db
+			.get_key_value(MetaKey::new(key.clone()).encode())
+			.await?
+		else {
+			return Ok(None);
+		};
+		let record = CachedRecord {
+			value: kv.value,
+			expire_ts: kv.expire_ts,
+		};
+		self.hot_cache.insert(key, &record, epoch);
+		Ok(Some(record))
+	}
+
+	/// The expire time of the live string DB record under the meta key
+	/// `encoded_key`, or `None` without one.
+	async fn live_record(&self, encoded_key: &Bytes) -> Result<Option<Option<i64>>, StorageError> {
+		Ok(self
+			.string_db
+			.get_key_value(encoded_key.clone())
+			.await?
+			.filter(|kv| !is_expired(kv.expire_ts))
+			.map(|kv| kv.expire_ts))
+	}
+
+	/// Count a write of the record of `key` in the key counts, telling the
+	/// expire listener if the key had expired unseen before it.
+	fn count_write(&self, key: &Bytes, before: Option<Option<i64>>, after: Option<Option<i64>>) {
+		if self.keyspace.record(key, before, after) {
+			self.notify_expired(key);
 		}
 	}
 
+	/// Write the string DB record under the meta key `encoded_key`, keeping
+	/// the key counts in step. Every write of a key's record goes through
+	/// here or `delete_string_record`.
+	pub(crate) async fn put_string_record(
+		&self,
+		encoded_key: Bytes,
+		value: Bytes,
+		put_opts: &PutOptions,
+		write_opts: &WriteOptions,
+	) -> Result<(), StorageError> {
+		let before = self.live_record(&encoded_key).await?;
+		let after = match put_opts.ttl {
+			Ttl::ExpireAfter(ttl) => Some(
+				chrono::Utc::now()
+					.timestamp_millis()
+					.saturating_add(ttl as i64),
+			),
+			_ => None,
+		};
+		let key = meta_user_key(&encoded_key);
+		self.string_db
+			.put_with_options(encoded_key, value, put_opts, write_opts)
+			.await?;
+		self.count_write(&key, before, Some(after));
+		Ok(())
+	}
+
+	/// Delete the string DB record under the meta key `encoded_key`, keeping
+	/// the key counts in step.
+	pub(crate) async fn delete_string_record(
+		&self,
+		encoded_key: Bytes,
+		write_opts: &WriteOptions,
+	) -> Result<(), StorageError> {
+		let before = self.live_record(&encoded_key).await?;
+		let key = meta_user_key(&encoded_key);
+		self.string_db
+			.delete_with_options(encoded_key, write_opts)
+			.await?;
+		self.count_write(&key, before, None);
+		Ok(())
+	}
+
+	/// Count a record loaded into the string DB after `clear_dbs`, where no
+	/// live record can be in its place.
+	pub(crate) fn count_loaded(&self, encoded_key: &Bytes, expire_ts: Option<i64>) {
+		self.keyspace
+			.record(&meta_user_key(encoded_key), None, Some(expire_ts));
+	}
+
+	/// Delete the record of `key`, found past its expire time, and tell the
+	/// expire listener.
+	pub(crate) async fn delete_expired(&self, key: &Bytes) -> Result<(), StorageError> {
+		let encoded_key = MetaKey::new(key.clone()).encode();
+		self.record_undo(DataType::String, [encoded_key.clone()])
+			.await?;
+		let write_opts = WriteOptions {
+			await_durable: false,
+		};
+		self.string_db
+			.delete_with_options(encoded_key, &write_opts)
+			.await?;
+		self.keyspace.record(key, None, None);
+		self.notify_expired(key);
+		Ok(())
+	}
+
+	/// Drop `key`, whose record SlateDB no longer returns, from the key
+	/// counts, telling the expire listener if they still had it.
+	pub(crate) fn forget_expired(&self, key: &Bytes) -> bool {
+		let expired = self.keyspace.record(key, None, None);
+		if expired {
+			self.notify_expired(key);
+		}
+		expired
+	}
+
+	/// The keys of the store, counted as they are written, deleted and
+	/// expired.
+	pub fn keyspace_counts(&self) -> KeyspaceCounts {
+		self.keyspace.counts(chrono::Utc::now().timestamp_millis())
+	}
+
+	/// Start the key counts over from a walk of every key.
+	async fn count_keys(&self) -> Result<(), StorageError> {
+		let mut keys = 0;
+		let mut expires = Vec::new();
+		let mut stream = self.string_db.scan::<Bytes, _>(..).await?;
+		while let Some(kv) = stream.next().await? {
+			// Records already past their time are counted and indexed too,
+			// for the active expire cycle to delete.
+			keys += 1;
+			if let Some(at) = kv.expire_ts {
+				expires.push((meta_user_key(&kv.key), at));
+			}
+		}
+		self.keyspace.reset(keys, expires);
+		Ok(())
+	}
+
+	/// Encode a string value, compressed per the compression settings.
+	pub(crate) fn encode_string(&self, value: &StringValue) -> Bytes {
+		self.compression.encode(value)
+	}
+
+	pub(crate) fn db(&self, data_type: DataType) -> &Arc<Db> {
+		match data_type {
+			DataType::String | DataType::Extension => &self.string_db,
+			DataType::Hash => &self.hash_db,
+			DataType::List => &self.list_db,
+			DataType::Set => &self.set_db,
+			DataType::ZSet => &self.zset_db,
+			DataType::Stream => &self.stream_db,
+			DataType::Bitmap => &self.bitmap_db,
+		}
+	}
+
+	/// Journal the current state of raw `keys` in the DB of `data_type`
+	/// before they are written. This is a no-op outside an atomic group.
+	pub(crate) async fn record_undo<I>(
+		&self,
+		data_type: DataType,
+		keys: I,
+	) -> Result<(), StorageError>
+	where
+		I: IntoIterator<Item = Bytes>,
+	{
+		self.journal
+			.capture(self.db(data_type), data_type, keys)
+			.await
+	}
+
+	/// Open an atomic group. Until `commit_atomic` returns, a crash rolls
+	/// back every write made through this storage on the next open.
+	///
+	/// The caller must keep other writers out for the duration of the group;
+	/// the server does so with its exclusive exec lock.
+	#[fastrace::trace]
+	pub async fn begin_atomic(&self) -> Result<(), StorageError> {
+		self.journal.begin().await
+	}
+
+	/// Make every write of the open group durable and discard its journal.
+	/// When the writes cannot be made durable, some DBs may hold them and
+	/// others not, so the group is rolled back before the error is returned.
+	#[fastrace::trace]
+	pub async fn commit_atomic(&self) -> Result<(), StorageError> {
+		if self.journal.has_records().await
+			&& let Err(e) = self.flush_dbs().await
+		{
+			if let Err(rollback) = self.rollback_atomic().await {
+				warn!(
+					"Failed to roll back an atomic group that failed to commit, it is rolled back on the next open: {}",
+					rollback
+				);
+			}
+			return Err(e);
+		}
+		self.journal.commit().await
+	}
+
+	/// Restore what the journal of the open group recorded. Until this
+	/// succeeds the journal is kept, and no new group begins.
+	async fn rollback_atomic(&self) -> Result<(), StorageError> {
+		self.journal.abort().await;
+		let rolled_back = self.recover_journal().await;
+		// Restored records bypass the key locks that keep the cache in step.
+		self.hot_cache.clear();
+		rolled_back?;
+		self.journal.rolled_back().await;
+		Ok(())
+	}
+
+	/// Wait until every write made so far is durable in the object store,
+	/// flushing the write-ahead log of each DB.
+	#[fastrace::trace]
+	pub async fn sync(&self) -> Result<(), StorageError> {
+		self.flush_dbs().await
+	}
+
+	/// Flush the memtable of every DB into sorted tables. The write-ahead log
+	/// behind them is then obsolete and left to garbage collection, and
+	/// compaction merges the new tables with the older ones, dropping
+	/// overwritten, deleted and expired entries.
+	#[fastrace::trace]
+	pub async fn rewrite_log(&self) -> Result<(), StorageError> {
+		let flush = |db: &Arc<Db>| {
+			let db = db.clone();
+			async move {
+				db.flush_with_options(FlushOptions {
+					flush_type: FlushType::MemTable,
+				})
+				.await
+			}
+		};
+		tokio::try_join!(
+			flush(&self.string_db),
+			flush(&self.hash_db),
+			flush(&self.list_db),
+			flush(&self.set_db),
+			flush(&self.zset_db),
+			flush(&self.stream_db),
+			flush(&self.bitmap_db),
+		)?;
+		Ok(())
+	}
+
+	/// Release memory the store holds on to: drop the hot cache and flush the
+	/// memtable of every DB, whose data is then read from the sorted tables.
+	pub async fn purge_memory(&self) -> Result<(), StorageError> {
+		self.hot_cache.clear();
+		self.rewrite_log().await
+	}
+
+	/// Read a server metadata entry saved with `put_metadata`.
+	pub async fn get_metadata(&self, name: &str) -> Result<Option<Bytes>, StorageError> {
+		self.metadata.get(name).await
+	}
+
+	/// Durably replace a server metadata entry. Metadata lives outside the
+	/// keyspace, so FLUSHDB and atomic groups do not touch it.
+	pub async fn put_metadata(&self, name: &str, value: Bytes) -> Result<(), StorageError> {
+		self.metadata.put(name, value).await
+	}
+
+	pub(crate) async fn flush_dbs(&self) -> Result<(), StorageError> {
+		#[cfg(test)]
+		if self
+			.failing_flushes
+			.fetch_update(
+				std::sync::atomic::Ordering::AcqRel,
+				std::sync::atomic::Ordering::Acquire,
+				|n| n.checked_sub(1),
+			)
+			.is_ok()
+		{
+			// Like an object store that goes away after the first DB flushed.
+			self.string_db.flush().await?;
+			return Err(StorageError::IoError {
+				source: std::io::Error::other("injected flush failure"),
+			});
+		}
+		tokio::try_join!(
+			self.string_db.flush(),
+			self.hash_db.flush(),
+			self.list_db.flush(),
+			self.set_db.flush(),
+			self.zset_db.flush(),
+			self.stream_db.flush(),
+			self.bitmap_db.flush(),
+		)?;
+		Ok(())
+	}
+
+	/// Roll back an atomic group that was interrupted by a crash or failed to
+	/// commit.
+	async fn recover_journal(&self) -> Result<(), StorageError> {
+		let records = self.journal.pending().await?;
+		if records.is_empty() {
+			return Ok(());
+		}
+		warn!(
+			"Rolling back {} keys written by an unfinished atomic group",
+			records.len()
+		);
+
+		// Restore metadata first so collection elements can be checked
+		// against the generation they belong to.
+		let (meta_records, element_records): (Vec<_>, Vec<_>) = records
+			.into_iter()
+			.partition(|record| record.data_type == DataType::String);
+		for record in meta_records {
+			self.restore_record(record).await?;
+		}
+		for mut record in element_records {
+			if let Some(before) = &record.before
+				&& !self
+					.is_live_element(record.data_type, &record.key, before.seq)
+					.await?
+			{
+				record.before = None;
+			}
+			self.restore_record(record).await?;
+		}
+
+		self.flush_dbs().await?;
+		self.journal.clear().await
+	}
+
+	/// Whether an element record with `seq` belongs to the current
+	/// generation of its collection, using the same rules as the compaction
+	/// filter.
+	pub(crate) async fn is_live_element(
+		&self,
+		data_type: DataType,
+		key: &[u8],
+		seq: u64,
+	) -> Result<bool, StorageError> {
+		let Some(user_key) = CollectionCompactionFilter::decode_sub_key(key) else {
+			return Ok(false);
+		};
+		let Some(kv) = self
+			.string_db
+			.get_key_value(MetaKey::new(user_key).encode())
+			.await?
+		else {
+			return Ok(false);
+		};
+		let meta = AnyValue::decode(&kv.value)?;
+		Ok(meta.data_type() == data_type && meta.version().is_none_or(|version| seq >= version))
+	}
+
+	async fn restore_record(&self, record: UndoRecord) -> Result<(), StorageError> {
+		let db = self.db(record.data_type);
+		let write_opts = WriteOptions {
+			await_durable: false,
+		};
+		let is_meta = record.data_type == DataType::String;
+		match record.before {
+			Some(before) if !is_expired(before.expire_ts) => {
+				let put_opts = PutOptions {
+					ttl: ttl_until(before.expire_ts),
+				};
+				if is_meta {
+					self.put_string_record(record.key, before.value, &put_opts, &write_opts)
+						.await?;
+				} else {
+					db.put_with_options(record.key, before.value, &put_opts, &write_opts)
+						.await?;
+				}
+			}
+			_ if is_meta => {
+				self.delete_string_record(record.key, &write_opts).await?;
+			}
+			_ => {
+				db.delete_with_options(record.key, &write_opts).await?;
+			}
+		}
+		Ok(())
+	}
+
 	pub(crate) async fn read_lock(
 		&self,
 		keys: impl IntoIterator<Item = Bytes>,
@@ -138,12 +650,23 @@ impl Storage {
 		keys: impl IntoIterator<Item = Bytes>,
 	) -> StorageLockGuard {
 		let lock = StorageLock::write_keys(keys);
-		self.locks.acquire(&lock).await
+		let guard = self.locks.acquire(&lock).await;
+		if !self.hot_cache.enabled() {
+			return guard;
+		}
+		// Dropped once the write is done, before readers can get in.
+		let hot_cache = self.hot_cache.clone();
+		guard.on_release(move || hot_cache.invalidate(&lock.write_keys))
 	}
 
 	pub(crate) async fn global_write_lock(&self) -> StorageLockGuard {
 		let lock = StorageLock::global_write();
-		self.locks.acquire(&lock).await
+		let guard = self.locks.acquire(&lock).await;
+		if !self.hot_cache.enabled() {
+			return guard;
+		}
+		let hot_cache = self.hot_cache.clone();
+		guard.on_release(move || hot_cache.clear())
 	}
 
 	#[fastrace::trace]
@@ -161,6 +684,24 @@ impl Storage {
 		options: I,
 		shard_id: Option<usize>,
 	) -> Result<Self, StorageError>
+	where
+		I: IntoIterator<Item = (K, V)>,
+		K: AsRef<str>,
+		V: Into<String>,
+	{
+		Self::open_object_store_with_compactor(url, options, shard_id, CompactorSettings::default())
+			.await
+	}
+
+	/// Like [`Storage::open_object_store`], with the compactor of every DB
+	/// set up per `compactor`.
+	#[fastrace::trace]
+	pub async fn open_object_store_with_compactor<I, K, V>(
+		url: &str,
+		options: I,
+		shard_id: Option<usize>,
+		compactor: CompactorSettings,
+	) -> Result<Self, StorageError>
 	where
 		I: IntoIterator<Item = (K, V)>,
 		K: AsRef<str>,
@@ -171,16 +712,23 @@ impl Storage {
 		let (object_store, base_path) = build_object_store(raw_url, &url, options).await?;
 		let root_path = shard_path(base_path, shard_id);
 
-		Self::open_with_object_store(object_store, root_path).await
+		Self::open_with_object_store(object_store, root_path, compactor).await
 	}
 
 	async fn open_with_object_store(
 		object_store: Arc<dyn ObjectStore>,
 		root_path: ObjectStorePath,
+		compactor: CompactorSettings,
 	) -> Result<Self, StorageError> {
 		let child_path = |name: &'static str| root_path.child(name);
 
+		// The marker is written on every open, so a store without one has
+		// never been opened before.
 		let marker = child_path(".nimbis");
+		let is_new = matches!(
+			object_store.head(&marker).await,
+			Err(slatedb::object_store::Error::NotFound { .. })
+		);
 		object_store
 			.put(&marker, bytes::Bytes::new().into())
 			.await
@@ -193,8 +741,11 @@ impl Storage {
 		// SlateDB's built-in TTL mechanism handles expiration during compaction.
 		let string_db = {
 			let db_path = child_path("string");
+			let compactor_builder = CompactorBuilder::new(db_path.clone(), object_store.clone())
+				.with_options(compactor.options());
 			let db = Db::builder(db_path, object_store.clone())
 				.with_db_cache(cache.clone())
+				.with_compactor_builder(compactor_builder)
 				.build()
 				.await
 				.map_err(StorageError::from)?;
@@ -208,14 +759,14 @@ impl Storage {
 			let string_db = string_db.clone();
 			let db_path = child_path(name);
 			async move {
-				let compactor_builder =
-					slatedb::CompactorBuilder::new(db_path.clone(), store.clone())
-						.with_compaction_filter_supplier(Arc::new(
-							CollectionCompactionFilterSupplier {
-								string_db,
-								data_type,
-							},
-						));
+				let compactor_builder = CompactorBuilder::new(db_path.clone(), store.clone())
+					.with_options(compactor.options())
+					.with_compaction_filter_supplier(Arc::new(
+						CollectionCompactionFilterSupplier {
+							string_db,
+							data_type,
+						},
+					));
 				let db: Result<Db, slatedb::Error> = Db::builder(db_path, store)
 					.with_db_cache(cache)
 					.with_compactor_builder(compactor_builder)
@@ -225,20 +776,37 @@ impl Storage {
 			}
 		};
 
-		let (hash_db, list_db, set_db, zset_db) = tokio::try_join!(
+		let (hash_db, list_db, set_db, zset_db, stream_db, bitmap_db) = tokio::try_join!(
 			open_db_with_collection_filter("hash", DataType::Hash),
 			open_db_with_collection_filter("list", DataType::List),
 			open_db_with_collection_filter("set", DataType::Set),
-			open_db_with_collection_filter("zset", DataType::ZSet)
+			open_db_with_collection_filter("zset", DataType::ZSet),
+			open_db_with_collection_filter("stream", DataType::Stream),
+			open_db_with_collection_filter("bitmap", DataType::Bitmap)
 		)?;
 
-		Ok(Self::new(
+		let storage = Self::new(
 			string_db,
 			Arc::new(hash_db),
 			Arc::new(list_db),
 			Arc::new(set_db),
 			Arc::new(zset_db),
-		))
+			Arc::new(stream_db),
+			Arc::new(bitmap_db),
+			UndoJournal::new(object_store.clone(), &root_path),
+			MetadataStore::new(object_store.clone(), &root_path),
+			SnapshotStore::new(object_store.clone(), &root_path),
+			StorageFiles::new(object_store, &root_path),
+		);
+		storage.recover_journal().await?;
+		// A new store only has a snapshot when one was copied into it to be
+		// restored. Existing stores keep their data, which is never older than
+		// their last snapshot.
+		if is_new && let Some(saved_at) = storage.load_snapshot().await? {
+			info!("Loaded the snapshot saved at {} (ms since epoch)", saved_at);
+		}
+		storage.count_keys().await?;
+		Ok(storage)
 	}
 
 	pub async fn close(&self) -> Result<(), StorageError> {
@@ -247,6 +815,8 @@ impl Storage {
 			self.list_db.close(),
 			self.set_db.close(),
 			self.zset_db.close(),
+			self.stream_db.close(),
+			self.bitmap_db.close(),
 		)?;
 		self.string_db.close().await?;
 		Ok(())
@@ -255,31 +825,46 @@ impl Storage {
 	#[storage_lock(global_write)]
 	#[fastrace::trace]
 	pub async fn flush_all(&self) -> Result<(), StorageError> {
+		self.clear_dbs().await
+	}
+
+	/// Delete every key of every DB. The caller must hold the global lock.
+	pub(crate) async fn clear_dbs(&self) -> Result<(), StorageError> {
 		// Iterate over all DBs and delete all keys
 		// Since we don't have atomic flush_all, we do best effort sequential
 		// Scanning and deleting everything is slow but correct for tests.
 		// For production this is blocking and bad, but it's FLUSHDB.
 
 		// Helper to clear a DB
-		async fn clear_db(
-			db: &slatedb::Db,
-		) -> Result<(), Box<dyn std::error::Error + Send + Sync>> {
+		async fn clear_db(storage: &Storage, data_type: DataType) -> Result<(), StorageError> {
+			let db = storage.db(data_type);
 			let scan_range = ..;
 			let mut stream = db.scan::<bytes::Bytes, _>(scan_range).await?;
+			let mut keys = Vec::new();
+			while let Some(kv) = stream.next().await? {
+				keys.push(kv.key);
+			}
+
+			storage.record_undo(data_type, keys.iter().cloned()).await?;
 			let write_opts = slatedb::config::WriteOptions {
 				await_durable: false,
 			};
-			while let Some(kv) = stream.next().await? {
-				db.delete_with_options(kv.key, &write_opts).await?;
+			for key in keys {
+				db.delete_with_options(key, &write_opts).await?;
+			}
+			if data_type == DataType::String {
+				storage.keyspace.reset(0, []);
 			}
 			Ok(())
 		}
 
-		clear_db(&self.string_db).await?;
-		clear_db(&self.hash_db).await?;
-		clear_db(&self.list_db).await?;
-		clear_db(&self.set_db).await?;
-		clear_db(&self.zset_db).await?;
+		clear_db(self, DataType::String).await?;
+		clear_db(self, DataType::Hash).await?;
+		clear_db(self, DataType::List).await?;
+		clear_db(self, DataType::Set).await?;
+		clear_db(self, DataType::ZSet).await?;
+		clear_db(self, DataType::Stream).await?;
+		clear_db(self, DataType::Bitmap).await?;
 
 		Ok(())
 	}
@@ -294,24 +879,13 @@ impl Storage {
 		&self,
 		key: &Bytes,
 	) -> Result<Option<T>, StorageError> {
-		let meta_key = MetaKey::new(key.clone());
-		let meta_encoded_key = meta_key.encode();
-		let kv = match self
-			.string_db
-			.get_key_value(meta_encoded_key.clone())
-			.await?
-		{
+		let kv = match self.string_record(key).await? {
 			Some(kv) => kv,
 			None => return Ok(None),
 		};
 
 		if is_expired(kv.expire_ts) {
-			let write_opts = WriteOptions {
-				await_durable: false,
-			};
-			self.string_db
-				.delete_with_options(meta_encoded_key, &write_opts)
-				.await?;
+			self.delete_expired(key).await?;
 			return Ok(None);
 		}
 
@@ -394,6 +968,20 @@ mod tests {
 		let _ = std::fs::remove_dir_all(path);
 	}
 
+	#[test]
+	fn test_local_store_path() {
+		assert_eq!(
+			local_store_path("file:nimbis_store"),
+			Some(std::path::PathBuf::from("nimbis_store"))
+		);
+		assert_eq!(
+			local_store_path("file:///var/lib/nimbis"),
+			Some(std::path::PathBuf::from("/var/lib/nimbis"))
+		);
+		assert_eq!(local_store_path("s3://bucket/prefix"), None);
+		assert_eq!(local_store_path("not a url"), None);
+	}
+
 	#[rstest]
 	#[tokio::test]
 	async fn test_lazy_delete_zombie_isolation(#[future] ctx: TestContext) {
@@ -523,6 +1111,329 @@ mod tests {
 		);
 	}
 
+	#[rstest]
+	#[tokio::test]
+	async fn test_unfinished_atomic_group_is_rolled_back_on_open(#[future] ctx: TestContext) {
+		let ctx = ctx.await;
+		ctx.storage
+			.set(Bytes::from("atomic_string"), Bytes::from("before"))
+			.await
+			.unwrap();
+		ctx.storage
+			.hset(
+				Bytes::from("atomic_hash"),
+				Bytes::from("kept"),
+				Bytes::from("v1"),
+			)
+			.await
+			.unwrap();
+
+		ctx.storage.begin_atomic().await.unwrap();
+		ctx.storage
+			.set(Bytes::from("atomic_string"), Bytes::from("after"))
+			.await
+			.unwrap();
+		ctx.storage
+			.hset(
+				Bytes::from("atomic_hash"),
+				Bytes::from("kept"),
+				Bytes::from("v2"),
+			)
+			.await
+			.unwrap();
+		ctx.storage
+			.hset(
+				Bytes::from("atomic_hash"),
+				Bytes::from("added"),
+				Bytes::from("v2"),
+			)
+			.await
+			.unwrap();
+		ctx.storage
+			.sadd(Bytes::from("atomic_set"), vec![Bytes::from("member")])
+			.await
+			.unwrap();
+		// Simulate a crash: the writes reach the object store but the group
+		// is never committed.
+		ctx.storage.close().await.unwrap();
+
+		let storage = Storage::open(&ctx.path, None).await.unwrap();
+		assert_eq!(
+			storage.get(Bytes::from("atomic_string")).await.unwrap(),
+			Some(Bytes::from("before"))
+		);
+		assert_eq!(
+			storage
+				.hget(Bytes::from("atomic_hash"), Bytes::from("kept"))
+				.await
+				.unwrap(),
+			Some(Bytes::from("v1"))
+		);
+		assert_eq!(
+			storage
+				.hget(Bytes::from("atomic_hash"), Bytes::from("added"))
+				.await
+				.unwrap(),
+			None
+		);
+		assert_eq!(storage.hlen(Bytes::from("atomic_hash")).await.unwrap(), 1);
+		assert!(!storage.exists(Bytes::from("atomic_set")).await.unwrap());
+		storage.close().await.unwrap();
+	}
+
+	#[rstest]
+	#[tokio::test]
+	async fn test_committed_atomic_group_survives_reopen(#[future] ctx: TestContext) {
+		let ctx = ctx.await;
+		ctx.storage.begin_atomic().await.unwrap();
+		ctx.storage
+			.set(Bytes::from("atomic_string"), Bytes::from("value"))
+			.await
+			.unwrap();
+		ctx.storage
+			.rpush(Bytes::from("atomic_list"), vec![Bytes::from("a")])
+			.await
+			.unwrap();
+		ctx.storage.commit_atomic().await.unwrap();
+		ctx.storage.close().await.unwrap();
+
+		let storage = Storage::open(&ctx.path, None).await.unwrap();
+		assert_eq!(
+			storage.get(Bytes::from("atomic_string")).await.unwrap(),
+			Some(Bytes::from("value"))
+		);
+		assert_eq!(storage.llen(Bytes::from("atomic_list")).await.unwrap(), 1);
+		storage.close().await.unwrap();
+	}
+
+	/// Write over `atomic_string` and `atomic_hash` in a group, and add
+	/// `atomic_set`, the writes landing in three DBs.
+	async fn write_atomic_group(storage: &Storage) {
+		storage
+			.set(Bytes::from("atomic_string"), Bytes::from("before"))
+			.await
+			.unwrap();
+		storage
+			.hset(
+				Bytes::from("atomic_hash"),
+				Bytes::from("kept"),
+				Bytes::from("v1"),
+			)
+			.await
+			.unwrap();
+
+		storage.begin_atomic().await.unwrap();
+		storage
+			.set(Bytes::from("atomic_string"), Bytes::from("after"))
+			.await
+			.unwrap();
+		storage
+			.hset(
+				Bytes::from("atomic_hash"),
+				Bytes::from("kept"),
+				Bytes::from("v2"),
+			)
+			.await
+			.unwrap();
+		storage
+			.sadd(Bytes::from("atomic_set"), vec![Bytes::from("member")])
+			.await
+			.unwrap();
+	}
+
+	async fn assert_atomic_group_rolled_back(storage: &Storage) {
+		assert_eq!(
+			storage.get(Bytes::from("atomic_string")).await.unwrap(),
+			Some(Bytes::from("before"))
+		);
+		assert_eq!(
+			storage
+				.hget(Bytes::from("atomic_hash"), Bytes::from("kept"))
+				.await
+				.unwrap(),
+			Some(Bytes::from("v1"))
+		);
+		assert!(!storage.exists(Bytes::from("atomic_set")).await.unwrap());
+	}
+
+	#[rstest]
+	#[tokio::test]
+	async fn test_failed_commit_rolls_the_atomic_group_back(#[future] ctx: TestContext) {
+		let ctx = ctx.await;
+		write_atomic_group(&ctx.storage).await;
+		// The string DB flushes, the others do not.
+		ctx.storage
+			.failing_flushes
+			.store(1, std::sync::atomic::Ordering::Release);
+		assert!(ctx.storage.commit_atomic().await.is_err());
+
+		assert_atomic_group_rolled_back(&ctx.storage).await;
+		assert!(ctx.storage.journal.pending().await.unwrap().is_empty());
+		// The next group begins and commits as usual.
+		ctx.storage.begin_atomic().await.unwrap();
+		ctx.storage
+			.set(Bytes::from("atomic_string"), Bytes::from("next"))
+			.await
+			.unwrap();
+		ctx.storage.commit_atomic().await.unwrap();
+		ctx.storage.close().await.unwrap();
+
+		let storage = Storage::open(&ctx.path, None).await.unwrap();
+		assert_eq!(
+			storage.get(Bytes::from("atomic_string")).await.unwrap(),
+			Some(Bytes::from("next"))
+		);
+		assert!(!storage.exists(Bytes::from("atomic_set")).await.unwrap());
+		storage.close().await.unwrap();
+	}
+
+	#[rstest]
+	#[tokio::test]
+	async fn test_failed_rollback_keeps_the_journal_for_the_next_open(#[future] ctx: TestContext) {
+		let ctx = ctx.await;
+		write_atomic_group(&ctx.storage).await;
+		// The rollback fails to flush as well.
+		ctx.storage
+			.failing_flushes
+			.store(2, std::sync::atomic::Ordering::Release);
+		assert!(ctx.storage.commit_atomic().await.is_err());
+
+		assert!(!ctx.storage.journal.pending().await.unwrap().is_empty());
+		assert!(ctx.storage.begin_atomic().await.is_err());
+		ctx.storage.close().await.unwrap();
+
+		let storage = Storage::open(&ctx.path, None).await.unwrap();
+		assert_atomic_group_rolled_back(&storage).await;
+		storage.begin_atomic().await.unwrap();
+		storage.commit_atomic().await.unwrap();
+		storage.close().await.unwrap();
+	}
+
+	#[rstest]
+	#[tokio::test]
+	async fn test_metadata_survives_reopen_and_flush(#[future] ctx: TestContext) {
+		let ctx = ctx.await;
+		assert_eq!(ctx.storage.get_metadata("functions").await.unwrap(), None);
+
+		ctx.storage
+			.put_metadata("functions", Bytes::from("payload"))
+			.await
+			.unwrap();
+		ctx.storage.flush_all().await.unwrap();
+		ctx.storage.close().await.unwrap();
+
+		let storage = Storage::open(&ctx.path, None).await.unwrap();
+		assert_eq!(
+			storage.get_metadata("functions").await.unwrap(),
+			Some(Bytes::from("payload"))
+		);
+		storage.close().await.unwrap();
+	}
+
+	#[rstest]
+	#[tokio::test]
+	async fn test_hot_cache_sees_writes(#[future] ctx: TestContext) {
+		let ctx = ctx.await;
+		ctx.storage.set_hot_cache(100, 1024);
+		let key = Bytes::from("hot");
+
+		ctx.storage
+			.set(key.clone(), Bytes::from("v1"))
+			.await
+			.unwrap();
+		assert_eq!(
+			ctx.storage.get(key.clone()).await.unwrap(),
+			Some(Bytes::from("v1"))
+		);
+		assert_eq!(
+			ctx.storage.get(key.clone()).await.unwrap(),
+			Some(Bytes::from("v1"))
+		);
+		let stats = ctx.storage.hot_cache_stats();
+		assert_eq!((stats.keys, stats.hits, stats.misses), (1, 1, 1));
+
+		// Every write drops the key.
+		ctx.storage
+			.set(key.clone(), Bytes::from("v2"))
+			.await
+			.unwrap();
+		assert_eq!(
+			ctx.storage.get(key.clone()).await.unwrap(),
+			Some(Bytes::from("v2"))
+		);
+		ctx.storage.del([key.clone()]).await.unwrap();
+		assert_eq!(ctx.storage.get(key.clone()).await.unwrap(), None);
+
+		ctx.storage
+			.set(key.clone(), Bytes::from("v3"))
+			.await
+			.unwrap();
+		ctx.storage.get(key.clone()).await.unwrap();
+		ctx.storage.flush_all().await.unwrap();
+		assert_eq!(ctx.storage.get(key).await.unwrap(), None);
+		assert_eq!(ctx.storage.hot_cache_stats().keys, 0);
+	}
+
+	#[rstest]
+	#[tokio::test]
+	async fn test_purge_memory_keeps_data(#[future] ctx: TestContext) {
+		let ctx = ctx.await;
+		ctx.storage.set_hot_cache(100, 1024);
+		let key = Bytes::from("purged");
+		ctx.storage
+			.set(key.clone(), Bytes::from("value"))
+			.await
+			.unwrap();
+		ctx.storage.get(key.clone()).await.unwrap();
+		assert_eq!(ctx.storage.hot_cache_stats().keys, 1);
+
+		ctx.storage.purge_memory().await.unwrap();
+		assert_eq!(ctx.storage.hot_cache_stats().keys, 0);
+		assert_eq!(
+			ctx.storage.get(key).await.unwrap(),
+			Some(Bytes::from("value"))
+		);
+	}
+
+	#[rstest]
+	#[tokio::test]
+	async fn test_keyspace_counts_follow_writes(#[future] ctx: TestContext) {
+		let ctx = ctx.await;
+		let counts = |storage: &Storage| {
+			let counts = storage.keyspace_counts();
+			(counts.keys, counts.expires)
+		};
+		ctx.storage
+			.set(Bytes::from("a"), Bytes::from("1"))
+			.await
+			.unwrap();
+		ctx.storage
+			.set(Bytes::from("b"), Bytes::from("2"))
+			.await
+			.unwrap();
+		ctx.storage
+			.hset(Bytes::from("h"), Bytes::from("f"), Bytes::from("v"))
+			.await
+			.unwrap();
+		let later = chrono::Utc::now().timestamp_millis() as u64 + 60_000;
+		ctx.storage.expire(Bytes::from("h"), later).await.unwrap();
+		assert_eq!(counts(&ctx.storage), (3, 1));
+		assert!(ctx.storage.keyspace_counts().avg_ttl_ms > 0);
+
+		ctx.storage.del([Bytes::from("a")]).await.unwrap();
+		ctx.storage.expire(Bytes::from("b"), 1).await.unwrap();
+		assert_eq!(counts(&ctx.storage), (1, 1));
+
+		// Reopening counts the keys again.
+		ctx.storage.close().await.unwrap();
+		let storage = Storage::open(&ctx.path, None).await.unwrap();
+		assert_eq!(counts(&storage), (1, 1));
+
+		storage.flush_all().await.unwrap();
+		assert_eq!(counts(&storage), (0, 0));
+		storage.close().await.unwrap();
+	}
+
 	#[test]
 	fn test_meta_put_opts() {
 		use slatedb::config::Ttl;
@@ -0,0 +1,425 @@
+use bytes::Bytes;
+use nimbis_macros::storage_lock;
+
+use crate::bitmap::CHUNK_SIZE;
+use crate::bitmap::sparse::SparseBytes;
+use crate::error::StorageError;
+use crate::storage::Storage;
+use crate::storage_bitmap::BitmapWrite;
+
+/// The integer type of a BITFIELD field: signed or unsigned, and its width
+/// in bits. Signed fields hold up to 64 bits, unsigned ones up to 63.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct BitFieldType {
+	pub signed: bool,
+	pub bits: u8,
+}
+
+impl BitFieldType {
+	/// The smallest and largest values of the type.
+	fn range(&self) -> (i128, i128) {
+		if self.signed {
+			(-(1i128 << (self.bits - 1)), (1i128 << (self.bits - 1)) - 1)
+		} else {
+			(0, (1i128 << self.bits) - 1)
+		}
+	}
+
+	/// Interpret the low `bits` bits of `raw` as a value of the type.
+	fn decode(&self, raw: u64) -> i64 {
+		let shift = 64 - self.bits as u32;
+		if self.signed {
+			((raw << shift) as i64) >> shift
+		} else {
+			raw as i64
+		}
+	}
+
+	/// Encode `value` as the low `bits` bits of the result.
+	fn encode(&self, value: i64) -> u64 {
+		(value as u64) & (u64::MAX >> (64 - self.bits as u32))
+	}
+
+	/// Fit `value` into the type, or `None` if it overflows with `Fail`.
+	fn fit(&self, value: i128, overflow: BitFieldOverflow) -> Option<i64> {
+		let (min, max) = self.range();
+		if (min..=max).contains(&value) {
+			return Some(value as i64);
+		}
+		match overflow {
+			BitFieldOverflow::Wrap => {
+				let modulus = 1i128 << self.bits;
+				let wrapped = value.rem_euclid(modulus);
+				Some(if wrapped > max {
+					wrapped - modulus
+				} else {
+					wrapped
+				} as i64)
+			}
+			BitFieldOverflow::Sat => Some(if value > max { max } else { min } as i64),
+			BitFieldOverflow::Fail => None,
+		}
+	}
+}
+
+/// How BITFIELD SET and INCRBY handle values that do not fit the field.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub enum BitFieldOverflow {
+	/// Wrap around, like two's complement arithmetic.
+	#[default]
+	Wrap,
+	/// Saturate at the smallest or largest value.
+	Sat,
+	/// Leave the field unchanged and reply nil.
+	Fail,
+}
+
+/// One BITFIELD subcommand. Offsets are in bits.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum BitFieldOp {
+	Get {
+		ty: BitFieldType,
+		offset: u64,
+	},
+	Set {
+		ty: BitFieldType,
+		offset: u64,
+		value: i64,
+		overflow: BitFieldOverflow,
+	},
+	IncrBy {
+		ty: BitFieldType,
+		offset: u64,
+		increment: i64,
+		overflow: BitFieldOverflow,
+	},
+}
+
+impl BitFieldOp {
+	fn is_write(&self) -> bool {
+		self.write_len().is_some()
+	}
+
+	/// The length in bytes a string needs to hold the field this subcommand
+	/// writes, if it writes one.
+	fn write_len(&self) -> Option<u64> {
+		match self {
+			Self::Get { .. } => None,
+			Self::Set { ty, offset, .. } | Self::IncrBy { ty, offset, .. } => {
+				Some((offset + ty.bits as u64).div_ceil(8))
+			}
+		}
+	}
+}
+
+impl Storage {
+	/// Run the BITFIELD subcommands `ops` in order on the string at `key`,
+	/// replying per subcommand: the value for GET, the old value for SET,
+	/// the new value for INCRBY, and `None` when an overflow failed.
+	///
+	/// With any SET or INCRBY, the string is created or zero-padded to cover
+	/// every field written, as in Redis.
+	#[storage_lock(write, key)]
+	#[fastrace::trace]
+	pub async fn bitfield(
+		&self,
+		key: Bytes,
+		ops: Vec<BitFieldOp>,
+	) -> Result<Vec<Option<i64>>, StorageError> {
+		if !ops.iter().any(BitFieldOp::is_write) {
+			return self.bitfield_gets(&key, &ops).await;
+		}
+
+		let mut bitmap = self.bitmap_for_write(&key).await?;
+		let mut replies = Vec::with_capacity(ops.len());
+		for op in ops {
+			let reply = match op {
+				BitFieldOp::Get { ty, offset } => {
+					let raw = self.read_field(&key, &mut bitmap, offset, ty.bits).await?;
+					Some(ty.decode(raw))
+				}
+				BitFieldOp::Set {
+					ty,
+					offset,
+					value,
+					overflow,
+				} => {
+					let old = ty.decode(self.read_field(&key, &mut bitmap, offset, ty.bits).await?);
+					// Unsigned fields take the value's bits as unsigned, as in Redis.
+					let value = if ty.signed {
+						value as i128
+					} else {
+						value as u64 as i128
+					};
+					let new = ty.fit(value, overflow);
+					if let Some(new) = new {
+						self.write_field(&key, &mut bitmap, offset, ty.bits, ty.encode(new))
+							.await?;
+					}
+					new.map(|_| old)
+				}
+				BitFieldOp::IncrBy {
+					ty,
+					offset,
+					increment,
+					overflow,
+				} => {
+					let old = ty.decode(self.read_field(&key, &mut bitmap, offset, ty.bits).await?);
+					let new = ty.fit(old as i128 + increment as i128, overflow);
+					if let Some(new) = new {
+						self.write_field(&key, &mut bitmap, offset, ty.bits, ty.encode(new))
+							.await?;
+					}
+					new
+				}
+			};
+			if let Some(len) = op.write_len() {
+				bitmap.meta.len = bitmap.meta.len.max(len);
+			}
+			replies.push(reply);
+		}
+
+		self.commit_bitmap(&key, bitmap).await?;
+		Ok(replies)
+	}
+
+	/// Run the BITFIELD GET subcommands `ops` on the string at `key` without
+	/// writing. Any other subcommand is rejected.
+	#[storage_lock(read, key)]
+	#[fastrace::trace]
+	pub async fn bitfield_ro(
+		&self,
+		key: Bytes,
+		ops: Vec<BitFieldOp>,
+	) -> Result<Vec<Option<i64>>, StorageError> {
+		if ops.iter().any(BitFieldOp::is_write) {
+			return Err(StorageError::InvalidArgument {
+				message: "ERR BITFIELD_RO only supports the GET subcommand".to_string(),
+			});
+		}
+		self.bitfield_gets(&key, &ops).await
+	}
+
+	/// Read the GET subcommands `ops`. The caller must hold the key lock.
+	async fn bitfield_gets(
+		&self,
+		key: &Bytes,
+		ops: &[BitFieldOp],
+	) -> Result<Vec<Option<i64>>, StorageError> {
+		let Some(string) = self.bit_string(key).await? else {
+			return Ok(vec![Some(0); ops.len()]);
+		};
+		// Only load the bytes the fields cover.
+		let (first, last) = ops
+			.iter()
+			.fold((u64::MAX, 0), |(first, last), op| match op {
+				BitFieldOp::Get { ty, offset } => (
+					first.min(offset / 8),
+					last.max((offset + ty.bits as u64 - 1) / 8),
+				),
+				_ => (first, last),
+			});
+		let len = string.len();
+		let bits = if first < len {
+			self.read_bits(key, string, first, last.min(len - 1))
+				.await?
+		} else {
+			SparseBytes::new(len, Vec::new())
+		};
+
+		Ok(ops
+			.iter()
+			.map(|op| match op {
+				BitFieldOp::Get { ty, offset } => {
+					let raw = (*offset..*offset + ty.bits as u64)
+						.fold(0u64, |raw, bit| (raw << 1) | bits.bit(bit) as u64);
+					Some(ty.decode(raw))
+				}
+				_ => None,
+			})
+			.collect())
+	}
+
+	/// Read `bits` bits at `offset` of `bitmap` as an unsigned integer. The
+	/// caller must hold the key lock.
+	async fn read_field(
+		&self,
+		key: &Bytes,
+		bitmap: &mut BitmapWrite,
+		offset: u64,
+		bits: u8,
+	) -> Result<u64, StorageError> {
+		let mut raw = 0u64;
+		for bit in offset..offset + bits as u64 {
+			let byte = bit / 8;
+			let chunk = self
+				.bitmap_chunk_mut(key, bitmap, byte / CHUNK_SIZE)
+				.await?;
+			let set = chunk
+				.get((byte % CHUNK_SIZE) as usize)
+				.is_some_and(|b| b & (0x80 >> (bit % 8)) != 0);
+			raw = (raw << 1) | set as u64;
+		}
+		Ok(raw)
+	}
+
+	/// Write the low `bits` bits of `raw` at `offset` of `bitmap`. The caller
+	/// must hold the key lock.
+	async fn write_field(
+		&self,
+		key: &Bytes,
+		bitmap: &mut BitmapWrite,
+		offset: u64,
+		bits: u8,
+		raw: u64,
+	) -> Result<(), StorageError> {
+		for i in 0..bits as u64 {
+			let bit = offset + i;
+			let byte = bit / 8;
+			let chunk = self
+				.bitmap_chunk_mut(key, bitmap, byte / CHUNK_SIZE)
+				.await?;
+			let pos = (byte % CHUNK_SIZE) as usize;
+			if chunk.len() <= pos {
+				chunk.resize(pos + 1, 0);
+			}
+			let mask = 0x80u8 >> (bit % 8);
+			if (raw >> (bits as u64 - 1 - i)) & 1 == 1 {
+				chunk[pos] |= mask;
+			} else {
+				chunk[pos] &= !mask;
+			}
+		}
+		Ok(())
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use rstest::rstest;
+
+	use super::*;
+
+	async fn get_storage() -> (Storage, std::path::PathBuf) {
+		let timestamp = ulid::Ulid::new().to_string();
+		let path = std::env::temp_dir().join(format!("nimbis_test_bitfield_{}", timestamp));
+		std::fs::create_dir_all(&path).unwrap();
+		let storage = Storage::open(&path, None).await.unwrap();
+		(storage, path)
+	}
+
+	fn ty(signed: bool, bits: u8) -> BitFieldType {
+		BitFieldType { signed, bits }
+	}
+
+	#[rstest]
+	#[case(ty(false, 8), 300, BitFieldOverflow::Wrap, Some(44))]
+	#[case(ty(false, 8), 300, BitFieldOverflow::Sat, Some(255))]
+	#[case(ty(false, 8), -1, BitFieldOverflow::Sat, Some(0))]
+	#[case(ty(false, 8), 300, BitFieldOverflow::Fail, None)]
+	#[case(ty(true, 8), 128, BitFieldOverflow::Wrap, Some(-128))]
+	#[case(ty(true, 8), -129, BitFieldOverflow::Wrap, Some(127))]
+	#[case(ty(true, 8), -200, BitFieldOverflow::Sat, Some(-128))]
+	#[case(ty(true, 64), i64::MAX as i128 + 1, BitFieldOverflow::Wrap, Some(i64::MIN))]
+	#[case(ty(false, 63), 1 << 63, BitFieldOverflow::Sat, Some(i64::MAX))]
+	fn test_fit(
+		#[case] ty: BitFieldType,
+		#[case] value: i128,
+		#[case] overflow: BitFieldOverflow,
+		#[case] expected: Option<i64>,
+	) {
+		assert_eq!(ty.fit(value, overflow), expected);
+	}
+
+	#[test]
+	fn test_decode_encode() {
+		assert_eq!(ty(true, 4).decode(0b1111), -1);
+		assert_eq!(ty(false, 4).decode(0b1111), 15);
+		assert_eq!(ty(true, 4).encode(-1), 0b1111);
+		assert_eq!(ty(true, 64).decode(u64::MAX), -1);
+		assert_eq!(ty(true, 64).encode(-1), u64::MAX);
+	}
+
+	#[tokio::test]
+	async fn test_bitfield_set_get_incrby() {
+		let (storage, path) = get_storage().await;
+		let key = Bytes::from("bf");
+
+		let replies = storage
+			.bitfield(
+				key.clone(),
+				vec![
+					BitFieldOp::Set {
+						ty: ty(false, 8),
+						offset: 0,
+						value: 200,
+						overflow: BitFieldOverflow::Wrap,
+					},
+					BitFieldOp::IncrBy {
+						ty: ty(false, 8),
+						offset: 0,
+						increment: 100,
+						overflow: BitFieldOverflow::Sat,
+					},
+					BitFieldOp::IncrBy {
+						ty: ty(true, 5),
+						offset: 8,
+						increment: 20,
+						overflow: BitFieldOverflow::Fail,
+					},
+					BitFieldOp::Get {
+						ty: ty(true, 8),
+						offset: 0,
+					},
+				],
+			)
+			.await
+			.unwrap();
+		assert_eq!(replies, vec![Some(0), Some(255), None, Some(-1)]);
+		// The failed INCRBY still padded the string to cover its field.
+		assert_eq!(
+			storage.get(key.clone()).await.unwrap(),
+			Some(Bytes::from_static(b"\xff\x00"))
+		);
+
+		let replies = storage
+			.bitfield_ro(
+				key.clone(),
+				vec![BitFieldOp::Get {
+					ty: ty(false, 4),
+					offset: 4,
+				}],
+			)
+			.await
+			.unwrap();
+		assert_eq!(replies, vec![Some(15)]);
+
+		std::fs::remove_dir_all(path).unwrap();
+	}
+
+	#[tokio::test]
+	async fn test_bitfield_get_does_not_create_key() {
+		let (storage, path) = get_storage().await;
+		let key = Bytes::from("bf");
+
+		let get = BitFieldOp::Get {
+			ty: ty(true, 16),
+			offset: 100,
+		};
+		assert_eq!(
+			storage.bitfield(key.clone(), vec![get]).await.unwrap(),
+			vec![Some(0)]
+		);
+		assert!(!storage.exists(key.clone()).await.unwrap());
+
+		let set = BitFieldOp::Set {
+			ty: ty(true, 16),
+			offset: 100,
+			value: 1,
+			overflow: BitFieldOverflow::Wrap,
+		};
+		assert!(storage.bitfield_ro(key, vec![set]).await.is_err());
+
+		std::fs::remove_dir_all(path).unwrap();
+	}
+}
@@ -0,0 +1,765 @@
+use std::collections::BTreeMap;
+use std::collections::BTreeSet;
+
+use bytes::Bytes;
+use nimbis_macros::storage_lock;
+use slatedb::WriteBatch;
+use slatedb::config::PutOptions;
+use slatedb::config::WriteOptions;
+
+use crate::bitmap::CHUNK_SIZE;
+use crate::bitmap::chunk_key::BitmapChunkKey;
+use crate::bitmap::sparse::SparseBytes;
+use crate::data_type::DataType;
+use crate::error::StorageError;
+use crate::storage::Storage;
+use crate::string::meta::AnyValue;
+use crate::string::meta::BitmapMetaValue;
+use crate::string::meta::MetaKey;
+
+/// Whether the indexes of a `BitRange` count bytes or bits.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub enum BitUnit {
+	#[default]
+	Byte,
+	Bit,
+}
+
+/// The range of a BITCOUNT or BITPOS. Negative indexes count back from the
+/// end of the string.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct BitRange {
+	pub start: i64,
+	/// The last index, inclusive; `None` runs to the end of the string.
+	pub end: Option<i64>,
+	pub unit: BitUnit,
+}
+
+impl BitRange {
+	/// Resolve the range against a string of `len` bytes into an inclusive
+	/// range of bits, clamping it as Redis does. Returns `None` if it is
+	/// empty.
+	pub fn resolve(&self, len: u64) -> Option<(u64, u64)> {
+		let total = match self.unit {
+			BitUnit::Byte => len as i64,
+			BitUnit::Bit => (len * 8) as i64,
+		};
+		let mut start = self.start;
+		let mut end = self.end.unwrap_or(total - 1);
+		if start < 0 {
+			start = (total + start).max(0);
+		}
+		if end < 0 {
+			end = (total + end).max(0);
+		}
+		end = end.min(total - 1);
+		if start > end {
+			return None;
+		}
+
+		let (start, end) = (start as u64, end as u64);
+		match self.unit {
+			BitUnit::Byte => Some((start * 8, end * 8 + 7)),
+			BitUnit::Bit => Some((start, end)),
+		}
+	}
+}
+
+/// The bitwise operation of BITOP.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum BitOp {
+	And,
+	Or,
+	Xor,
+	Not,
+}
+
+/// A string value as read by the bit commands: either a plain string or a
+/// chunked bitmap.
+pub(crate) enum BitString {
+	Plain(Bytes),
+	Chunked(BitmapMetaValue),
+}
+
+impl BitString {
+	pub(crate) fn len(&self) -> u64 {
+		match self {
+			Self::Plain(value) => value.len() as u64,
+			Self::Chunked(meta) => meta.len,
+		}
+	}
+}
+
+/// A bitmap being modified. Touched chunks are buffered and written together
+/// with the meta by `commit_bitmap`.
+pub(crate) struct BitmapWrite {
+	pub(crate) meta: BitmapMetaValue,
+	/// Whether the write starts a new generation, because the key is missing
+	/// or holds a plain string.
+	fresh: bool,
+	chunks: BTreeMap<u64, Vec<u8>>,
+}
+
+impl Storage {
+	/// Set the bit at `offset` of the string at `key` and return its old
+	/// value. The string is zero-padded to reach `offset`.
+	#[storage_lock(write, key)]
+	#[fastrace::trace]
+	pub async fn setbit(&self, key: Bytes, offset: u64, value: bool) -> Result<bool, StorageError> {
+		let byte = offset / 8;
+		let mask = 0x80u8 >> (offset % 8);
+		let mut bitmap = self.bitmap_for_write(&key).await?;
+
+		let chunk = self
+			.bitmap_chunk_mut(&key, &mut bitmap, byte / CHUNK_SIZE)
+			.await?;
+		let pos = (byte % CHUNK_SIZE) as usize;
+		if chunk.len() <= pos {
+			chunk.resize(pos + 1, 0);
+		}
+		let old = chunk[pos] & mask != 0;
+		if value {
+			chunk[pos] |= mask;
+		} else {
+			chunk[pos] &= !mask;
+		}
+
+		if old == value && !bitmap.fresh && byte < bitmap.meta.len {
+			return Ok(old);
+		}
+		bitmap.meta.len = bitmap.meta.len.max(byte + 1);
+		self.commit_bitmap(&key, bitmap).await?;
+		Ok(old)
+	}
+
+	/// Return the bit at `offset` of the string at `key`; bits past its end
+	/// are unset.
+	#[storage_lock(read, key)]
+	#[fastrace::trace]
+	pub async fn getbit(&self, key: Bytes, offset: u64) -> Result<bool, StorageError> {
+		let Some(string) = self.bit_string(&key).await? else {
+			return Ok(false);
+		};
+		let byte = offset / 8;
+		if byte >= string.len() {
+			return Ok(false);
+		}
+		let bits = self.read_bits(&key, string, byte, byte).await?;
+		Ok(bits.bit(offset))
+	}
+
+	/// Count the set bits of the string at `key` within `range`, or in the
+	/// whole string.
+	#[storage_lock(read, key)]
+	#[fastrace::trace]
+	pub async fn bitcount(&self, key: Bytes, range: Option<BitRange>) -> Result<u64, StorageError> {
+		let Some(string) = self.bit_string(&key).await? else {
+			return Ok(0);
+		};
+		let Some((start, end)) = range.unwrap_or_default().resolve(string.len()) else {
+			return Ok(0);
+		};
+		let bits = self.read_bits(&key, string, start / 8, end / 8).await?;
+		Ok(bits.count_ones(start, end))
+	}
+
+	/// Find the first bit equal to `bit` in the string at `key` within
+	/// `range`, returning -1 if there is none.
+	///
+	/// As in Redis, a missing key is all clear bits, and a search for a clear
+	/// bit without an end index finds the first bit past the string.
+	#[storage_lock(read, key)]
+	#[fastrace::trace]
+	pub async fn bitpos(
+		&self,
+		key: Bytes,
+		bit: bool,
+		range: BitRange,
+	) -> Result<i64, StorageError> {
+		let Some(string) = self.bit_string(&key).await? else {
+			return Ok(if bit { -1 } else { 0 });
+		};
+		let Some((start, end)) = range.resolve(string.len()) else {
+			return Ok(-1);
+		};
+		let bits = self.read_bits(&key, string, start / 8, end / 8).await?;
+		Ok(match bits.position(bit, start, end) {
+			Some(pos) => pos as i64,
+			None if !bit && range.end.is_none() => (end + 1) as i64,
+			None => -1,
+		})
+	}
+
+	/// Combine the strings at `keys` with `op` into a bitmap at `dest` and
+	/// return its length, the length of the longest input. Missing keys read
+	/// as empty strings and shorter inputs are zero-padded. An empty result
+	/// deletes `dest`.
+	#[fastrace::trace]
+	pub async fn bitop(
+		&self,
+		op: BitOp,
+		dest: Bytes,
+		keys: Vec<Bytes>,
+	) -> Result<u64, StorageError> {
+		let _guard = self
+			.write_lock(std::iter::once(dest.clone()).chain(keys.iter().cloned()))
+			.await;
+
+		let mut sources = Vec::with_capacity(keys.len());
+		for key in &keys {
+			let bits = match self.bit_string(key).await? {
+				Some(string) if string.len() > 0 => {
+					let last = string.len() - 1;
+					self.read_bits(key, string, 0, last).await?
+				}
+				_ => SparseBytes::new(0, Vec::new()),
+			};
+			sources.push(bits);
+		}
+
+		let (len, chunks) = combine(op, &sources);
+		if len == 0 {
+			let meta_encoded_key = MetaKey::new(dest).encode();
+			self.record_undo(DataType::String, [meta_encoded_key.clone()])
+				.await?;
+			let write_opts = WriteOptions {
+				await_durable: false,
+			};
+			self.delete_string_record(meta_encoded_key, &write_opts)
+				.await?;
+			return Ok(0);
+		}
+
+		let bitmap = BitmapWrite {
+			meta: BitmapMetaValue::new(0, len),
+			fresh: true,
+			chunks,
+		};
+		self.commit_bitmap(&dest, bitmap).await?;
+		Ok(len)
+	}
+
+	/// Look up the string at `key` for a bit read. The caller must hold the
+	/// key lock.
+	pub(crate) async fn bit_string(&self, key: &Bytes) -> Result<Option<BitString>, StorageError> {
+		match self.get_meta::<AnyValue>(key).await? {
+			Some(AnyValue::String(val)) => Ok(Some(BitString::Plain(val.value))),
+			Some(AnyValue::Bitmap(meta)) => Ok(Some(BitString::Chunked(meta))),
+			Some(val) => Err(StorageError::wrong_type(DataType::String, val.data_type())),
+			None => Ok(None),
+		}
+	}
+
+	/// Load the bytes `first..=last` of `string`; bytes outside them may be
+	/// missing from the result. The caller must hold the key lock.
+	pub(crate) async fn read_bits(
+		&self,
+		key: &Bytes,
+		string: BitString,
+		first: u64,
+		last: u64,
+	) -> Result<SparseBytes, StorageError> {
+		let meta = match string {
+			BitString::Plain(value) => return Ok(SparseBytes::dense(value)),
+			BitString::Chunked(meta) => meta,
+		};
+
+		let start_key = BitmapChunkKey::new(key.clone(), first / CHUNK_SIZE).encode();
+		let end_key = BitmapChunkKey::new(key.clone(), last / CHUNK_SIZE).encode();
+		let mut stream = self.bitmap_db.scan(start_key..=end_key).await?;
+
+		let mut segments = Vec::new();
+		while let Some(kv) = stream.next().await? {
+			if kv.seq < meta.version {
+				continue;
+			}
+			let index = BitmapChunkKey::decode_index(&kv.key).ok_or_else(|| {
+				StorageError::DataInconsistency {
+					message: "invalid bitmap chunk key".to_string(),
+				}
+			})?;
+			segments.push((index * CHUNK_SIZE, kv.value));
+		}
+		Ok(SparseBytes::new(meta.len, segments))
+	}
+
+	/// Materialize the whole bitmap at `key`. The caller must hold the key
+	/// lock.
+	pub(crate) async fn read_bitmap(
+		&self,
+		key: &Bytes,
+		meta: BitmapMetaValue,
+	) -> Result<Bytes, StorageError> {
+		if meta.len == 0 {
+			return Ok(Bytes::new());
+		}
+		let last = meta.len - 1;
+		let bits = self
+			.read_bits(key, BitString::Chunked(meta), 0, last)
+			.await?;
+		Ok(Bytes::from(bits.to_vec()))
+	}
+
+	/// Prepare the string at `key` for a bit write, converting a plain string
+	/// into chunks. The caller must hold the key lock.
+	pub(crate) async fn bitmap_for_write(&self, key: &Bytes) -> Result<BitmapWrite, StorageError> {
+		match self.get_meta::<AnyValue>(key).await? {
+			Some(AnyValue::Bitmap(meta)) => Ok(BitmapWrite {
+				meta,
+				fresh: false,
+				chunks: BTreeMap::new(),
+			}),
+			Some(AnyValue::String(val)) => {
+				let chunks = val
+					.value
+					.chunks(CHUNK_SIZE as usize)
+					.enumerate()
+					.filter(|(_, chunk)| chunk.iter().any(|b| *b != 0))
+					.map(|(index, chunk)| (index as u64, chunk.to_vec()))
+					.collect();
+				Ok(BitmapWrite {
+					meta: BitmapMetaValue::new(0, val.value.len() as u64),
+					fresh: true,
+					chunks,
+				})
+			}
+			Some(val) => Err(StorageError::wrong_type(DataType::String, val.data_type())),
+			None => Ok(BitmapWrite {
+				meta: BitmapMetaValue::new(0, 0),
+				fresh: true,
+				chunks: BTreeMap::new(),
+			}),
+		}
+	}
+
+	/// Return the chunk `index` of `bitmap` for modification, loading it if it
+	/// is not buffered yet. The caller must hold the key lock.
+	pub(crate) async fn bitmap_chunk_mut<'a>(
+		&self,
+		key: &Bytes,
+		bitmap: &'a mut BitmapWrite,
+		index: u64,
+	) -> Result<&'a mut Vec<u8>, StorageError> {
+		if !bitmap.fresh && !bitmap.chunks.contains_key(&index) {
+			let chunk_key = BitmapChunkKey::new(key.clone(), index).encode();
+			let chunk = match self.bitmap_db.get_key_value(chunk_key).await? {
+				Some(kv) if kv.seq >= bitmap.meta.version => kv.value.to_vec(),
+				_ => Vec::new(),
+			};
+			bitmap.chunks.insert(index, chunk);
+		}
+		Ok(bitmap.chunks.entry(index).or_default())
+	}
+
+	/// Write the buffered chunks and the meta of `bitmap`. The caller must
+	/// hold the key lock.
+	pub(crate) async fn commit_bitmap(
+		&self,
+		key: &Bytes,
+		bitmap: BitmapWrite,
+	) -> Result<(), StorageError> {
+		let BitmapWrite {
+			mut meta,
+			fresh,
+			mut chunks,
+		} = bitmap;
+		let write_opts = WriteOptions {
+			await_durable: false,
+		};
+
+		// A new generation takes its version from the chunk write, so it
+		// needs at least one chunk even if every bit is clear.
+		if fresh && chunks.is_empty() {
+			chunks.insert(0, Vec::new());
+		}
+		if !chunks.is_empty() {
+			let put_opts = PutOptions::default();
+			let mut batch = WriteBatch::new();
+			let mut chunk_keys = Vec::with_capacity(chunks.len());
+			for (index, chunk) in chunks {
+				let chunk_key = BitmapChunkKey::new(key.clone(), index).encode();
+				batch.put_with_options(chunk_key.clone(), Bytes::from(chunk), &put_opts);
+				chunk_keys.push(chunk_key);
+			}
+			self.record_undo(DataType::Bitmap, chunk_keys).await?;
+			let wh = self
+				.bitmap_db
+				.write_with_options(batch, &write_opts)
+				.await?;
+			if fresh {
+				meta.version = wh.seqnum();
+			}
+		}
+
+		let meta_encoded_key = MetaKey::new(key.clone()).encode();
+		self.record_undo(DataType::String, [meta_encoded_key.clone()])
+			.await?;
+		let put_opts = Storage::meta_put_opts(&meta);
+		self.put_string_record(meta_encoded_key, meta.encode(), &put_opts, &write_opts)
+			.await?;
+		Ok(())
+	}
+}
+
+/// Apply `op` to `sources` one chunk at a time, returning the length of the
+/// result and its non-zero chunks. Only chunks some source has are computed,
+/// except for NOT, which turns missing chunks into set bits.
+fn combine(op: BitOp, sources: &[SparseBytes]) -> (u64, BTreeMap<u64, Vec<u8>>) {
+	let len = sources.iter().map(SparseBytes::len).max().unwrap_or(0);
+	let indices: BTreeSet<u64> = match op {
+		BitOp::Not => (0..len.div_ceil(CHUNK_SIZE)).collect(),
+		_ => sources
+			.iter()
+			.flat_map(|source| source.chunk_indices(CHUNK_SIZE))
+			.collect(),
+	};
+
+	let mut chunks = BTreeMap::new();
+	for index in indices {
+		let start = index * CHUNK_SIZE;
+		let end = (start + CHUNK_SIZE).min(len);
+		let size = (end - start) as usize;
+		let mut parts = sources.iter().map(|source| source.read(start, end));
+
+		let chunk = match op {
+			BitOp::Not => {
+				let mut chunk = parts.next().flatten().unwrap_or_else(|| vec![0; size]);
+				chunk.iter_mut().for_each(|b| *b = !*b);
+				chunk
+			}
+			BitOp::And => {
+				let mut chunk = vec![0xFF; size];
+				for part in parts {
+					let Some(part) = part else {
+						chunk.fill(0);
+						break;
+					};
+					chunk.iter_mut().zip(part).for_each(|(b, p)| *b &= p);
+				}
+				chunk
+			}
+			BitOp::Or | BitOp::Xor => {
+				let mut chunk = vec![0; size];
+				for part in parts.flatten() {
+					for (b, p) in chunk.iter_mut().zip(part) {
+						if op == BitOp::Or {
+							*b |= p;
+						} else {
+							*b ^= p;
+						}
+					}
+				}
+				chunk
+			}
+		};
+		if chunk.iter().any(|b| *b != 0) {
+			chunks.insert(index, chunk);
+		}
+	}
+	(len, chunks)
+}
+
+#[cfg(test)]
+mod tests {
+	use rstest::rstest;
+
+	use super::*;
+
+	async fn get_storage() -> (Storage, std::path::PathBuf) {
+		let timestamp = ulid::Ulid::new().to_string();
+		let path = std::env::temp_dir().join(format!("nimbis_test_bitmap_{}", timestamp));
+		std::fs::create_dir_all(&path).unwrap();
+		let storage = Storage::open(&path, None).await.unwrap();
+		(storage, path)
+	}
+
+	#[rstest]
+	#[case(BitRange::default(), 6, Some((0, 47)))]
+	#[case(BitRange { start: 1, end: Some(1), unit: BitUnit::Byte }, 6, Some((8, 15)))]
+	#[case(BitRange { start: -2, end: Some(-1), unit: BitUnit::Byte }, 6, Some((32, 47)))]
+	#[case(BitRange { start: 5, end: Some(30), unit: BitUnit::Bit }, 6, Some((5, 30)))]
+	#[case(BitRange { start: 0, end: Some(100), unit: BitUnit::Bit }, 2, Some((0, 15)))]
+	#[case(BitRange { start: 3, end: Some(1), unit: BitUnit::Byte }, 6, None)]
+	#[case(BitRange::default(), 0, None)]
+	fn test_bit_range_resolve(
+		#[case] range: BitRange,
+		#[case] len: u64,
+		#[case] expected: Option<(u64, u64)>,
+	) {
+		assert_eq!(range.resolve(len), expected);
+	}
+
+	#[rstest]
+	#[case(BitOp::And, b"\x00\x00\xff\x00")]
+	#[case(BitOp::Or, b"\xff\x0f\xff\x0f")]
+	#[case(BitOp::Xor, b"\xff\x0f\x00\x0f")]
+	fn test_combine(#[case] op: BitOp, #[case] expected: &[u8]) {
+		let sources = [
+			SparseBytes::dense(Bytes::from_static(b"\xff\x00\xff")),
+			SparseBytes::dense(Bytes::from_static(b"\x00\x0f\xff\x0f")),
+		];
+		let (len, chunks) = combine(op, &sources);
+		let segments = chunks
+			.into_iter()
+			.map(|(index, chunk)| (index * CHUNK_SIZE, Bytes::from(chunk)))
+			.collect();
+		assert_eq!(SparseBytes::new(len, segments).to_vec(), expected);
+	}
+
+	#[test]
+	fn test_combine_sparse() {
+		// Two bits a million chunks apart only produce their own chunks.
+		let far = 1_000_000 * CHUNK_SIZE;
+		let sources = [
+			SparseBytes::new(1, vec![(0, Bytes::from_static(b"\x80"))]),
+			SparseBytes::new(far + 1, vec![(far, Bytes::from_static(b"\x01"))]),
+		];
+		let (len, chunks) = combine(BitOp::Or, &sources);
+		assert_eq!(len, far + 1);
+		assert_eq!(
+			chunks.keys().copied().collect::<Vec<_>>(),
+			vec![0, 1_000_000]
+		);
+		let (_, chunks) = combine(BitOp::And, &sources);
+		assert!(chunks.is_empty());
+
+		let (len, chunks) = combine(BitOp::Not, &sources[..1]);
+		assert_eq!(len, 1);
+		assert_eq!(chunks[&0], vec![0x7F]);
+	}
+
+	#[tokio::test]
+	async fn test_bitop() {
+		let (storage, path) = get_storage().await;
+		let (a, b, dest) = (Bytes::from("a"), Bytes::from("b"), Bytes::from("dest"));
+		storage.set(a.clone(), Bytes::from("abc")).await.unwrap();
+		storage.setbit(b.clone(), 0, true).await.unwrap();
+		storage
+			.hset(dest.clone(), Bytes::from("f"), Bytes::from("v"))
+			.await
+			.unwrap();
+
+		// The destination is replaced whatever it held.
+		let len = storage
+			.bitop(BitOp::Or, dest.clone(), vec![a.clone(), b.clone()])
+			.await
+			.unwrap();
+		assert_eq!(len, 3);
+		assert_eq!(
+			storage.get(dest.clone()).await.unwrap(),
+			Some(Bytes::from_static(b"\xe1bc"))
+		);
+
+		let len = storage
+			.bitop(
+				BitOp::And,
+				dest.clone(),
+				vec![a.clone(), Bytes::from("missing")],
+			)
+			.await
+			.unwrap();
+		assert_eq!(len, 3);
+		assert_eq!(
+			storage.get(dest.clone()).await.unwrap(),
+			Some(Bytes::from_static(b"\0\0\0"))
+		);
+
+		// A source may also be the destination.
+		let len = storage
+			.bitop(BitOp::Not, a.clone(), vec![a.clone()])
+			.await
+			.unwrap();
+		assert_eq!(len, 3);
+		assert_eq!(
+			storage.get(a).await.unwrap(),
+			Some(Bytes::from_static(b"\x9e\x9d\x9c"))
+		);
+
+		// An empty result deletes the destination.
+		let len = storage
+			.bitop(BitOp::Xor, dest.clone(), vec![Bytes::from("missing")])
+			.await
+			.unwrap();
+		assert_eq!(len, 0);
+		assert!(!storage.exists(dest).await.unwrap());
+
+		std::fs::remove_dir_all(path).unwrap();
+	}
+
+	#[tokio::test]
+	async fn test_setbit_getbit() {
+		let (storage, path) = get_storage().await;
+		let key = Bytes::from("bits");
+
+		assert!(!storage.setbit(key.clone(), 7, true).await.unwrap());
+		assert!(storage.setbit(key.clone(), 7, true).await.unwrap());
+		assert!(storage.getbit(key.clone(), 7).await.unwrap());
+		assert!(!storage.getbit(key.clone(), 6).await.unwrap());
+		assert!(!storage.getbit(key.clone(), 1000).await.unwrap());
+		assert_eq!(
+			storage.get(key.clone()).await.unwrap(),
+			Some(Bytes::from("\x01"))
+		);
+
+		assert!(storage.setbit(key.clone(), 7, false).await.unwrap());
+		assert_eq!(storage.get(key).await.unwrap(), Some(Bytes::from("\x00")));
+
+		std::fs::remove_dir_all(path).unwrap();
+	}
+
+	#[tokio::test]
+	async fn test_setbit_sparse_high_offset() {
+		let (storage, path) = get_storage().await;
+		let key = Bytes::from("sparse");
+		let offset = (u32::MAX as u64) - 1;
+
+		storage.setbit(key.clone(), 3, true).await.unwrap();
+		storage.setbit(key.clone(), offset, true).await.unwrap();
+		assert!(storage.getbit(key.clone(), offset).await.unwrap());
+		assert_eq!(storage.bitcount(key.clone(), None).await.unwrap(), 2);
+		assert_eq!(
+			storage
+				.bitpos(
+					key.clone(),
+					true,
+					BitRange {
+						start: 1,
+						..Default::default()
+					}
+				)
+				.await
+				.unwrap(),
+			offset as i64
+		);
+
+		// Only the two touched chunks are stored.
+		let prefix = crate::utils::user_key_prefix(&key);
+		let mut stream = storage.bitmap_db.scan(prefix.clone()..).await.unwrap();
+		let mut chunks = 0;
+		while let Some(kv) = stream.next().await.unwrap() {
+			if !kv.key.starts_with(&prefix) {
+				break;
+			}
+			chunks += 1;
+		}
+		assert_eq!(chunks, 2);
+
+		std::fs::remove_dir_all(path).unwrap();
+	}
+
+	#[tokio::test]
+	async fn test_bit_ops_on_plain_string() {
+		let (storage, path) = get_storage().await;
+		let key = Bytes::from("str");
+		storage
+			.set(key.clone(), Bytes::from("foobar"))
+			.await
+			.unwrap();
+
+		assert_eq!(storage.bitcount(key.clone(), None).await.unwrap(), 26);
+		let range = BitRange {
+			start: 5,
+			end: Some(30),
+			unit: BitUnit::Bit,
+		};
+		assert_eq!(
+			storage.bitcount(key.clone(), Some(range)).await.unwrap(),
+			17
+		);
+
+		// Converting to chunks keeps the value and the string commands work.
+		storage.setbit(key.clone(), 7, true).await.unwrap();
+		assert_eq!(
+			storage.get(key.clone()).await.unwrap(),
+			Some(Bytes::from("goobar"))
+		);
+		assert_eq!(
+			storage.append(key.clone(), Bytes::from("!")).await.unwrap(),
+			7
+		);
+		assert_eq!(
+			storage.get(key).await.unwrap(),
+			Some(Bytes::from("goobar!"))
+		);
+
+		std::fs::remove_dir_all(path).unwrap();
+	}
+
+	#[rstest]
+	#[case(b"\xff\xf0\x00", true, BitRange::default(), 0)]
+	#[case(b"\xff\xf0\x00", false, BitRange::default(), 12)]
+	#[case(b"\x00\xff\xf0", true, BitRange { start: 2, end: None, unit: BitUnit::Byte }, 16)]
+	#[case(b"\x00\x00\x00", true, BitRange::default(), -1)]
+	#[case(b"\xff\xff\xff", false, BitRange::default(), 24)]
+	#[case(b"\xff\xff\xff", false, BitRange { start: 0, end: Some(-1), unit: BitUnit::Byte }, -1)]
+	#[case(b"\x00\xff\xf0", false, BitRange { start: 7, end: Some(15), unit: BitUnit::Bit }, 7)]
+	#[case(b"\x00\xff\xf0", true, BitRange { start: 7, end: Some(15), unit: BitUnit::Bit }, 8)]
+	#[tokio::test]
+	async fn test_bitpos(
+		#[case] value: &'static [u8],
+		#[case] bit: bool,
+		#[case] range: BitRange,
+		#[case] expected: i64,
+	) {
+		let (storage, path) = get_storage().await;
+		let key = Bytes::from("pos");
+		storage
+			.set(key.clone(), Bytes::from_static(value))
+			.await
+			.unwrap();
+
+		assert_eq!(storage.bitpos(key, bit, range).await.unwrap(), expected);
+
+		std::fs::remove_dir_all(path).unwrap();
+	}
+
+	#[tokio::test]
+	async fn test_bit_ops_missing_and_wrong_type() {
+		let (storage, path) = get_storage().await;
+
+		let missing = Bytes::from("missing");
+		assert!(!storage.getbit(missing.clone(), 0).await.unwrap());
+		assert_eq!(storage.bitcount(missing.clone(), None).await.unwrap(), 0);
+		let range = BitRange::default();
+		assert_eq!(
+			storage.bitpos(missing.clone(), true, range).await.unwrap(),
+			-1
+		);
+		assert_eq!(storage.bitpos(missing, false, range).await.unwrap(), 0);
+
+		let hash = Bytes::from("hash");
+		storage
+			.hset(hash.clone(), Bytes::from("f"), Bytes::from("v"))
+			.await
+			.unwrap();
+		let err = storage.setbit(hash, 0, true).await.unwrap_err();
+		assert!(err.to_string().contains("WRONGTYPE"));
+
+		std::fs::remove_dir_all(path).unwrap();
+	}
+
+	#[tokio::test]
+	async fn test_set_replaces_bitmap() {
+		let (storage, path) = get_storage().await;
+		let key = Bytes::from("bits");
+		let chunk_bits = CHUNK_SIZE * 8;
+
+		storage
+			.setbit(key.clone(), 2 * chunk_bits, true)
+			.await
+			.unwrap();
+		storage.set(key.clone(), Bytes::from("x")).await.unwrap();
+		assert_eq!(storage.bitcount(key.clone(), None).await.unwrap(), 4);
+
+		// A new bitmap generation does not see the chunks of the old one.
+		storage.del([key.clone()]).await.unwrap();
+		storage
+			.setbit(key.clone(), 3 * chunk_bits, true)
+			.await
+			.unwrap();
+		assert!(!storage.getbit(key.clone(), 2 * chunk_bits).await.unwrap());
+		assert_eq!(storage.bitcount(key, None).await.unwrap(), 1);
+
+		std::fs::remove_dir_all(path).unwrap();
+	}
+}
@@ -0,0 +1,234 @@
+use bytes::Bytes;
+use nimbis_macros::storage_lock;
+use slatedb::config::WriteOptions;
+
+use crate::data_type::DataType;
+use crate::error::StorageError;
+use crate::storage::Storage;
+use crate::string::extension::ExtensionValue;
+use crate::string::meta::MetaKey;
+
+impl Storage {
+	/// Read the payload stored at `key` by the extension type `type_name`.
+	/// Keys holding a core type or another extension's type are WRONGTYPE.
+	#[storage_lock(read, key)]
+	#[fastrace::trace]
+	pub async fn get_extension(
+		&self,
+		key: Bytes,
+		type_name: &str,
+	) -> Result<Option<Bytes>, StorageError> {
+		Ok(self
+			.get_typed_extension(&key, type_name)
+			.await?
+			.map(|value| value.payload))
+	}
+
+	/// Store `payload` at `key` as a value of the extension type `type_name`.
+	/// Replacing a value of the same type keeps its TTL; keys holding any
+	/// other type are WRONGTYPE.
+	#[storage_lock(write, key)]
+	#[fastrace::trace]
+	pub async fn set_extension(
+		&self,
+		key: Bytes,
+		type_name: &str,
+		payload: Bytes,
+	) -> Result<(), StorageError> {
+		let mut value = self
+			.get_typed_extension(&key, type_name)
+			.await?
+			.unwrap_or_else(|| {
+				ExtensionValue::new(Bytes::copy_from_slice(type_name.as_bytes()), "")
+			});
+		value.payload = payload;
+		self.put_extension(key, &value).await
+	}
+
+	/// Replace the payload at `key` of the extension type `type_name` with
+	/// the one `update` computes from the current payload, holding the key
+	/// lock throughout so concurrent updates are not lost. `update` returning
+	/// `None` leaves the key unchanged.
+	#[storage_lock(write, key)]
+	#[fastrace::trace]
+	pub async fn update_extension<F>(
+		&self,
+		key: Bytes,
+		type_name: &str,
+		update: F,
+	) -> Result<(), StorageError>
+	where
+		F: FnOnce(Option<&Bytes>) -> Option<Bytes> + Send,
+	{
+		let current = self.get_typed_extension(&key, type_name).await?;
+		let Some(payload) = update(current.as_ref().map(|value| &value.payload)) else {
+			return Ok(());
+		};
+		let mut value = current.unwrap_or_else(|| {
+			ExtensionValue::new(Bytes::copy_from_slice(type_name.as_bytes()), "")
+		});
+		value.payload = payload;
+		self.put_extension(key, &value).await
+	}
+
+	/// Write `value` at `key`. The caller must hold the key lock.
+	async fn put_extension(&self, key: Bytes, value: &ExtensionValue) -> Result<(), StorageError> {
+		let meta_encoded_key = MetaKey::new(key).encode();
+		let write_opts = WriteOptions {
+			await_durable: false,
+		};
+		self.record_undo(DataType::String, [meta_encoded_key.clone()])
+			.await?;
+		self.put_string_record(
+			meta_encoded_key,
+			value.encode(),
+			&Self::meta_put_opts(value),
+			&write_opts,
+		)
+		.await?;
+		Ok(())
+	}
+
+	async fn get_typed_extension(
+		&self,
+		key: &Bytes,
+		type_name: &str,
+	) -> Result<Option<ExtensionValue>, StorageError> {
+		match self.get_meta::<ExtensionValue>(key).await? {
+			Some(value) if value.type_name == type_name.as_bytes() => Ok(Some(value)),
+			Some(_) => Err(StorageError::wrong_type(
+				DataType::Extension,
+				DataType::Extension,
+			)),
+			None => Ok(None),
+		}
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+
+	async fn get_storage() -> (Storage, std::path::PathBuf) {
+		let timestamp = ulid::Ulid::new().to_string();
+		let path = std::env::temp_dir().join(format!("nimbis_test_{}", timestamp));
+		std::fs::create_dir_all(&path).unwrap();
+		let storage = Storage::open(&path, None).await.unwrap();
+		(storage, path)
+	}
+
+	#[tokio::test]
+	async fn test_storage_extension_roundtrip() {
+		let (storage, path) = get_storage().await;
+		let key = Bytes::from("ext");
+
+		assert_eq!(
+			storage.get_extension(key.clone(), "counter").await.unwrap(),
+			None
+		);
+		storage
+			.set_extension(key.clone(), "counter", Bytes::from("1"))
+			.await
+			.unwrap();
+		storage
+			.set_extension(key.clone(), "counter", Bytes::from("2"))
+			.await
+			.unwrap();
+		assert_eq!(
+			storage.get_extension(key.clone(), "counter").await.unwrap(),
+			Some(Bytes::from("2"))
+		);
+
+		assert!(storage.exists(key.clone()).await.unwrap());
+		assert_eq!(storage.del([key.clone()]).await.unwrap(), 1);
+		assert_eq!(storage.get_extension(key, "counter").await.unwrap(), None);
+
+		let _ = std::fs::remove_dir_all(path);
+	}
+
+	#[tokio::test]
+	async fn test_storage_extension_update() {
+		let (storage, path) = get_storage().await;
+		let key = Bytes::from("ext_update");
+
+		storage
+			.update_extension(key.clone(), "counter", |current| {
+				assert_eq!(current, None);
+				Some(Bytes::from("1"))
+			})
+			.await
+			.unwrap();
+		storage
+			.update_extension(key.clone(), "counter", |current| {
+				assert_eq!(current, Some(&Bytes::from("1")));
+				None
+			})
+			.await
+			.unwrap();
+		assert_eq!(
+			storage.get_extension(key.clone(), "counter").await.unwrap(),
+			Some(Bytes::from("1"))
+		);
+
+		let err = storage
+			.update_extension(key, "other", |_| Some(Bytes::new()))
+			.await
+			.unwrap_err();
+		assert!(err.to_string().contains("WRONGTYPE"));
+
+		let _ = std::fs::remove_dir_all(path);
+	}
+
+	#[tokio::test]
+	async fn test_storage_extension_keeps_ttl() {
+		let (storage, path) = get_storage().await;
+		let key = Bytes::from("ext_ttl");
+
+		storage
+			.set_extension(key.clone(), "counter", Bytes::from("1"))
+			.await
+			.unwrap();
+		let expire_at = chrono::Utc::now().timestamp_millis() as u64 + 60_000;
+		assert!(storage.expire(key.clone(), expire_at).await.unwrap());
+		storage
+			.set_extension(key.clone(), "counter", Bytes::from("2"))
+			.await
+			.unwrap();
+
+		let ttl = storage.ttl(key).await.unwrap().unwrap();
+		assert!(ttl > 0 && ttl <= 60_000, "unexpected ttl {}", ttl);
+
+		let _ = std::fs::remove_dir_all(path);
+	}
+
+	#[tokio::test]
+	async fn test_storage_extension_wrong_type() {
+		let (storage, path) = get_storage().await;
+		let string_key = Bytes::from("plain");
+		let ext_key = Bytes::from("ext");
+
+		storage
+			.set(string_key.clone(), Bytes::from("v"))
+			.await
+			.unwrap();
+		let err = storage
+			.set_extension(string_key, "counter", Bytes::from("1"))
+			.await
+			.unwrap_err();
+		assert!(err.to_string().contains("WRONGTYPE"));
+
+		storage
+			.set_extension(ext_key.clone(), "counter", Bytes::from("1"))
+			.await
+			.unwrap();
+		let err = storage
+			.get_extension(ext_key.clone(), "other")
+			.await
+			.unwrap_err();
+		assert!(err.to_string().contains("WRONGTYPE"));
+		let err = storage.get(ext_key).await.unwrap_err();
+		assert!(err.to_string().contains("WRONGTYPE"));
+
+		let _ = std::fs::remove_dir_all(path);
+	}
+}
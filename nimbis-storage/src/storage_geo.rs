@@ -0,0 +1,500 @@
+use bytes::Bytes;
+use nimbis_macros::storage_lock;
+use slatedb::config::WriteOptions;
+
+use crate::data_type::DataType;
+use crate::error::StorageError;
+use crate::geo::GeoPoint;
+use crate::geo::GeoUnit;
+use crate::geo::search::GeoShape;
+use crate::geo::search::search_ranges;
+use crate::storage::Storage;
+use crate::storage_zset::ZAddOptions;
+use crate::string::meta::MetaKey;
+use crate::string::meta::ZSetMetaValue;
+
+/// Center of a GEOSEARCH query.
+#[derive(Debug, Clone, PartialEq)]
+pub enum GeoOrigin {
+	/// The position of a member of the searched set.
+	Member(Bytes),
+	Point(GeoPoint),
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum GeoOrder {
+	Asc,
+	Desc,
+}
+
+/// A GEOSEARCH query.
+#[derive(Debug, Clone, PartialEq)]
+pub struct GeoSearch {
+	pub origin: GeoOrigin,
+	pub shape: GeoShape,
+	/// Order by distance from the center; a `count` without `any` implies
+	/// ascending order.
+	pub order: Option<GeoOrder>,
+	pub count: Option<usize>,
+	/// Stop at the first `count` matches instead of the nearest ones.
+	pub any: bool,
+}
+
+/// A member found by a GEOSEARCH query.
+#[derive(Debug, Clone, PartialEq)]
+pub struct GeoMatch {
+	pub member: Bytes,
+	pub score: f64,
+	/// Distance from the center in meters.
+	pub distance: f64,
+}
+
+impl Storage {
+	/// Add `points` to the sorted set at `key`, scored by geohash, and return
+	/// how many were added, or also updated with `ch`.
+	#[storage_lock(write, key)]
+	#[fastrace::trace]
+	pub async fn geoadd(
+		&self,
+		key: Bytes,
+		points: Vec<(GeoPoint, Bytes)>,
+		options: ZAddOptions,
+	) -> Result<u64, StorageError> {
+		let elements = points
+			.into_iter()
+			.map(|(point, member)| (point.score(), member))
+			.collect();
+		self.zadd_elements(key, elements, options).await
+	}
+
+	/// Read the positions of `members` of the sorted set at `key`, `None` for
+	/// missing ones.
+	#[storage_lock(read, key)]
+	#[fastrace::trace]
+	pub async fn geopos(
+		&self,
+		key: Bytes,
+		members: Vec<Bytes>,
+	) -> Result<Vec<Option<GeoPoint>>, StorageError> {
+		let scores = self.zset_scores(&key, &members).await?;
+		Ok(scores
+			.into_iter()
+			.map(|score| score.map(GeoPoint::from_score))
+			.collect())
+	}
+
+	/// Distance in meters between two members of the sorted set at `key`, or
+	/// `None` if either is missing.
+	#[storage_lock(read, key)]
+	#[fastrace::trace]
+	pub async fn geodist(
+		&self,
+		key: Bytes,
+		member1: Bytes,
+		member2: Bytes,
+	) -> Result<Option<f64>, StorageError> {
+		let scores = self.zset_scores(&key, &[member1, member2]).await?;
+		match scores[..] {
+			[Some(score1), Some(score2)] => Ok(Some(
+				GeoPoint::from_score(score1).distance(&GeoPoint::from_score(score2)),
+			)),
+			_ => Ok(None),
+		}
+	}
+
+	/// Read the standard geohash strings of `members` of the sorted set at
+	/// `key`, `None` for missing ones.
+	#[storage_lock(read, key)]
+	#[fastrace::trace]
+	pub async fn geohash(
+		&self,
+		key: Bytes,
+		members: Vec<Bytes>,
+	) -> Result<Vec<Option<String>>, StorageError> {
+		let points = self.zset_scores(&key, &members).await?;
+		Ok(points
+			.into_iter()
+			.map(|score| score.map(|score| GeoPoint::from_score(score).geohash()))
+			.collect())
+	}
+
+	/// Find the members of the sorted set at `key` within the shape of
+	/// `query`.
+	#[storage_lock(read, key)]
+	#[fastrace::trace]
+	pub async fn geosearch(
+		&self,
+		key: Bytes,
+		query: GeoSearch,
+	) -> Result<Vec<GeoMatch>, StorageError> {
+		self.geo_matches(&key, &query).await
+	}
+
+	/// Store the members of the sorted set at `src` found by `query` as a
+	/// sorted set at `dest`, scored by geohash, or by distance in `store_dist`
+	/// units if given. Returns how many were stored; an empty result deletes
+	/// `dest`.
+	#[fastrace::trace]
+	pub async fn geosearchstore(
+		&self,
+		dest: Bytes,
+		src: Bytes,
+		query: GeoSearch,
+		store_dist: Option<GeoUnit>,
+	) -> Result<u64, StorageError> {
+		let _guard = self.write_lock([dest.clone(), src.clone()]).await;
+
+		let matches = self.geo_matches(&src, &query).await?;
+
+		// The result replaces whatever `dest` held.
+		let meta_encoded_key = MetaKey::new(dest.clone()).encode();
+		self.record_undo(DataType::String, [meta_encoded_key.clone()])
+			.await?;
+		let write_opts = WriteOptions {
+			await_durable: false,
+		};
+		self.delete_string_record(meta_encoded_key, &write_opts)
+			.await?;
+		if matches.is_empty() {
+			return Ok(0);
+		}
+
+		let elements = matches
+			.into_iter()
+			.map(|found| {
+				let score = match store_dist {
+					Some(unit) => found.distance / unit.meters(),
+					None => found.score,
+				};
+				(score, found.member)
+			})
+			.collect();
+		self.zadd_elements(dest, elements, ZAddOptions::default())
+			.await
+	}
+
+	/// Run `query` over the sorted set at `key`, scanning only the score
+	/// ranges that may hold matches. The caller must hold the key lock.
+	async fn geo_matches(
+		&self,
+		key: &Bytes,
+		query: &GeoSearch,
+	) -> Result<Vec<GeoMatch>, StorageError> {
+		if self.get_meta::<ZSetMetaValue>(key).await?.is_none() {
+			return Ok(Vec::new());
+		}
+		let center = match &query.origin {
+			GeoOrigin::Point(point) => *point,
+			GeoOrigin::Member(member) => {
+				match self.zset_scores(key, std::slice::from_ref(member)).await?[0] {
+					Some(score) => GeoPoint::from_score(score),
+					None => {
+						return Err(StorageError::InvalidArgument {
+							message: "ERR could not decode requested zset member".to_string(),
+						});
+					}
+				}
+			}
+		};
+
+		// With ANY, the first matches found are good enough.
+		let limit = query.count.filter(|_| query.any);
+		let mut matches = Vec::new();
+		'ranges: for (min, max) in search_ranges(&center, &query.shape) {
+			for (member, score) in self.zset_range_by_score(key, min, max).await? {
+				if limit.is_some_and(|limit| matches.len() >= limit) {
+					break 'ranges;
+				}
+				let point = GeoPoint::from_score(score);
+				if let Some(distance) = query.shape.distance_if_within(&center, &point) {
+					matches.push(GeoMatch {
+						member,
+						score,
+						distance,
+					});
+				}
+			}
+		}
+
+		let order = match query.order {
+			None if query.count.is_some() && !query.any => Some(GeoOrder::Asc),
+			order => order,
+		};
+		match order {
+			Some(GeoOrder::Asc) => matches.sort_by(|a, b| a.distance.total_cmp(&b.distance)),
+			Some(GeoOrder::Desc) => matches.sort_by(|a, b| b.distance.total_cmp(&a.distance)),
+			None => {}
+		}
+		if let Some(count) = query.count {
+			matches.truncate(count);
+		}
+		Ok(matches)
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+
+	async fn get_storage() -> (Storage, std::path::PathBuf) {
+		let timestamp = ulid::Ulid::new().to_string();
+		let path = std::env::temp_dir().join(format!("nimbis_test_geo_{}", timestamp));
+		std::fs::create_dir_all(&path).unwrap();
+		let storage = Storage::open(&path, None).await.unwrap();
+		(storage, path)
+	}
+
+	fn sicily() -> Vec<(GeoPoint, Bytes)> {
+		vec![
+			(
+				GeoPoint::new(13.361389, 38.115556).unwrap(),
+				Bytes::from("Palermo"),
+			),
+			(
+				GeoPoint::new(15.087269, 37.502669).unwrap(),
+				Bytes::from("Catania"),
+			),
+		]
+	}
+
+	#[tokio::test]
+	async fn test_geoadd_and_reads() {
+		let (storage, path) = get_storage().await;
+		let key = Bytes::from("Sicily");
+
+		let added = storage
+			.geoadd(key.clone(), sicily(), ZAddOptions::default())
+			.await
+			.unwrap();
+		assert_eq!(added, 2);
+		assert_eq!(
+			storage
+				.zscore(key.clone(), Bytes::from("Palermo"))
+				.await
+				.unwrap(),
+			Some(3479099956230698.0)
+		);
+
+		let positions = storage
+			.geopos(
+				key.clone(),
+				vec![Bytes::from("Palermo"), Bytes::from("missing")],
+			)
+			.await
+			.unwrap();
+		let palermo = positions[0].unwrap();
+		assert!((palermo.longitude - 13.361389).abs() < 1e-5);
+		assert_eq!(positions[1], None);
+
+		let dist = storage
+			.geodist(key.clone(), Bytes::from("Palermo"), Bytes::from("Catania"))
+			.await
+			.unwrap()
+			.unwrap();
+		assert_eq!(format!("{dist:.4}"), "166274.1516");
+		assert_eq!(
+			storage
+				.geodist(key.clone(), Bytes::from("Palermo"), Bytes::from("missing"))
+				.await
+				.unwrap(),
+			None
+		);
+
+		let hashes = storage
+			.geohash(key.clone(), vec![Bytes::from("Catania")])
+			.await
+			.unwrap();
+		assert_eq!(hashes, vec![Some("sqdtr74hyu0".to_string())]);
+
+		std::fs::remove_dir_all(path).unwrap();
+	}
+
+	#[tokio::test]
+	async fn test_geoadd_options() {
+		let (storage, path) = get_storage().await;
+		let key = Bytes::from("Sicily");
+		storage
+			.geoadd(key.clone(), sicily(), ZAddOptions::default())
+			.await
+			.unwrap();
+
+		let moved = vec![(GeoPoint::new(13.0, 38.0).unwrap(), Bytes::from("Palermo"))];
+		let nx = ZAddOptions {
+			nx: true,
+			..Default::default()
+		};
+		assert_eq!(
+			storage
+				.geoadd(key.clone(), moved.clone(), nx)
+				.await
+				.unwrap(),
+			0
+		);
+
+		let xx_ch = ZAddOptions {
+			xx: true,
+			ch: true,
+			..Default::default()
+		};
+		let mut points = moved;
+		points.push((GeoPoint::new(14.0, 37.0).unwrap(), Bytes::from("Agrigento")));
+		assert_eq!(storage.geoadd(key.clone(), points, xx_ch).await.unwrap(), 1);
+		assert_eq!(storage.zcard(key.clone()).await.unwrap(), 2);
+
+		let position = storage
+			.geopos(key, vec![Bytes::from("Palermo")])
+			.await
+			.unwrap();
+		assert!((position[0].unwrap().longitude - 13.0).abs() < 1e-5);
+
+		std::fs::remove_dir_all(path).unwrap();
+	}
+
+	fn search(origin: GeoOrigin, shape: GeoShape) -> GeoSearch {
+		GeoSearch {
+			origin,
+			shape,
+			order: None,
+			count: None,
+			any: false,
+		}
+	}
+
+	fn members(matches: &[GeoMatch]) -> Vec<&[u8]> {
+		matches.iter().map(|found| &found.member[..]).collect()
+	}
+
+	#[tokio::test]
+	async fn test_geosearch() {
+		let (storage, path) = get_storage().await;
+		let key = Bytes::from("Sicily");
+		let mut points = sicily();
+		points.push((
+			GeoPoint::new(12.758489, 38.788135).unwrap(),
+			Bytes::from("edge1"),
+		));
+		points.push((
+			GeoPoint::new(17.241510, 38.788135).unwrap(),
+			Bytes::from("edge2"),
+		));
+		storage
+			.geoadd(key.clone(), points, ZAddOptions::default())
+			.await
+			.unwrap();
+
+		// The GEOSEARCH examples of the Redis documentation.
+		let center = GeoOrigin::Point(GeoPoint::new(15.0, 37.0).unwrap());
+		let mut query = search(center.clone(), GeoShape::Radius(200_000.0));
+		query.order = Some(GeoOrder::Asc);
+		let found = storage.geosearch(key.clone(), query).await.unwrap();
+		assert_eq!(members(&found), vec![&b"Catania"[..], b"Palermo"]);
+		assert_eq!(format!("{:.4}", found[0].distance / 1000.0), "56.4413");
+
+		let mut query = search(
+			center.clone(),
+			GeoShape::Box {
+				width: 400_000.0,
+				height: 400_000.0,
+			},
+		);
+		query.order = Some(GeoOrder::Desc);
+		let found = storage.geosearch(key.clone(), query).await.unwrap();
+		assert_eq!(
+			members(&found),
+			vec![&b"edge1"[..], b"edge2", b"Palermo", b"Catania"]
+		);
+
+		// COUNT keeps the nearest, ANY the first found.
+		let mut query = search(center.clone(), GeoShape::Radius(1e6));
+		query.count = Some(1);
+		let found = storage.geosearch(key.clone(), query.clone()).await.unwrap();
+		assert_eq!(members(&found), vec![&b"Catania"[..]]);
+		query.any = true;
+		assert_eq!(
+			storage.geosearch(key.clone(), query).await.unwrap().len(),
+			1
+		);
+
+		let from_member = search(
+			GeoOrigin::Member(Bytes::from("Palermo")),
+			GeoShape::Radius(1.0),
+		);
+		let found = storage.geosearch(key.clone(), from_member).await.unwrap();
+		assert_eq!(members(&found), vec![&b"Palermo"[..]]);
+		assert_eq!(found[0].distance, 0.0);
+
+		let missing = search(
+			GeoOrigin::Member(Bytes::from("missing")),
+			GeoShape::Radius(1.0),
+		);
+		let err = storage.geosearch(key, missing.clone()).await.unwrap_err();
+		assert!(err.to_string().contains("could not decode"));
+		assert!(
+			storage
+				.geosearch(Bytes::from("nokey"), missing)
+				.await
+				.unwrap()
+				.is_empty()
+		);
+
+		std::fs::remove_dir_all(path).unwrap();
+	}
+
+	#[tokio::test]
+	async fn test_geosearchstore() {
+		let (storage, path) = get_storage().await;
+		let (key, dest) = (Bytes::from("Sicily"), Bytes::from("dest"));
+		storage
+			.geoadd(key.clone(), sicily(), ZAddOptions::default())
+			.await
+			.unwrap();
+		storage
+			.set(dest.clone(), Bytes::from("overwritten"))
+			.await
+			.unwrap();
+
+		let query = search(
+			GeoOrigin::Point(GeoPoint::new(15.0, 37.0).unwrap()),
+			GeoShape::Radius(200_000.0),
+		);
+		let stored = storage
+			.geosearchstore(dest.clone(), key.clone(), query.clone(), None)
+			.await
+			.unwrap();
+		assert_eq!(stored, 2);
+		assert_eq!(
+			storage
+				.zscore(dest.clone(), Bytes::from("Palermo"))
+				.await
+				.unwrap(),
+			Some(3479099956230698.0)
+		);
+
+		let stored = storage
+			.geosearchstore(
+				dest.clone(),
+				key.clone(),
+				query.clone(),
+				Some(GeoUnit::Kilometers),
+			)
+			.await
+			.unwrap();
+		assert_eq!(stored, 2);
+		let score = storage
+			.zscore(dest.clone(), Bytes::from("Catania"))
+			.await
+			.unwrap()
+			.unwrap();
+		assert_eq!(format!("{score:.4}"), "56.4413");
+
+		// An empty result deletes the destination.
+		let stored = storage
+			.geosearchstore(dest.clone(), Bytes::from("missing"), query, None)
+			.await
+			.unwrap();
+		assert_eq!(stored, 0);
+		assert!(!storage.exists(dest).await.unwrap());
+
+		std::fs::remove_dir_all(path).unwrap();
+	}
+}
@@ -5,6 +5,7 @@ use nimbis_macros::storage_lock;
 use slatedb::config::PutOptions;
 use slatedb::config::WriteOptions;
 
+use crate::data_type::DataType;
 use crate::error::StorageError;
 use crate::hash::field_key::HashFieldKey;
 use crate::storage::Storage;
@@ -28,14 +29,17 @@ impl Storage {
 		let encoded_field_key = field_key.encode();
 
 		let Some(mut meta_val) = self.get_meta::<HashMetaValue>(&key).await? else {
+			self.record_undo(DataType::Hash, [encoded_field_key.clone()])
+				.await?;
+			self.record_undo(DataType::String, [meta_encoded_key.clone()])
+				.await?;
 			let wh = self
 				.hash_db
 				.put_with_options(encoded_field_key, value, &put_opts, &write_opts)
 				.await?;
 
 			let new_meta = HashMetaValue::new(wh.seqnum(), 1);
-			self.string_db
-				.put_with_options(meta_encoded_key, new_meta.encode(), &put_opts, &write_opts)
+			self.put_string_record(meta_encoded_key, new_meta.encode(), &put_opts, &write_opts)
 				.await?;
 			return Ok(1);
 		};
@@ -52,6 +56,8 @@ impl Storage {
 		let is_new_field = !field_exists;
 
 		// Set the field in hash_db
+		self.record_undo(DataType::Hash, [encoded_field_key.clone()])
+			.await?;
 		self.hash_db
 			.put_with_options(encoded_field_key, value, &put_opts, &write_opts)
 			.await?;
@@ -62,8 +68,9 @@ impl Storage {
 
 			let put_opts = Storage::meta_put_opts(&meta_val);
 
-			self.string_db
-				.put_with_options(meta_encoded_key, meta_val.encode(), &put_opts, &write_opts)
+			self.record_undo(DataType::String, [meta_encoded_key.clone()])
+				.await?;
+			self.put_string_record(meta_encoded_key, meta_val.encode(), &put_opts, &write_opts)
 				.await?;
 			Ok(1)
 		} else {
@@ -225,6 +232,8 @@ impl Storage {
 				.await?
 				.is_some_and(|kv| kv.seq >= meta_val.version);
 			if exists {
+				self.record_undo(DataType::Hash, [encoded_field_key.clone()])
+					.await?;
 				self.hash_db
 					.delete_with_options(encoded_field_key, &write_opts)
 					.await?;
@@ -233,10 +242,11 @@ impl Storage {
 		}
 
 		if deleted_count > 0 {
+			self.record_undo(DataType::String, [meta_encoded_key.clone()])
+				.await?;
 			if meta_val.len <= deleted_count as u64 {
 				// Hash is empty, delete meta
-				self.string_db
-					.delete_with_options(meta_encoded_key, &write_opts)
+				self.delete_string_record(meta_encoded_key, &write_opts)
 					.await?;
 			} else {
 				// Update meta
@@ -244,8 +254,7 @@ impl Storage {
 
 				let put_opts = Storage::meta_put_opts(&meta_val);
 
-				self.string_db
-					.put_with_options(meta_encoded_key, meta_val.encode(), &put_opts, &write_opts)
+				self.put_string_record(meta_encoded_key, meta_val.encode(), &put_opts, &write_opts)
 					.await?;
 			}
 		}
@@ -0,0 +1,217 @@
+use bytes::Bytes;
+use nimbis_macros::storage_lock;
+use slatedb::config::PutOptions;
+use slatedb::config::WriteOptions;
+
+use crate::data_type::DataType;
+use crate::error::StorageError;
+use crate::hll::HllError;
+use crate::hll::sketch::HyperLogLog;
+use crate::storage::Storage;
+use crate::string::key::StringKey;
+use crate::string::value::StringValue;
+
+impl Storage {
+	/// Add `elements` to the HyperLogLog at `key`, creating it if missing.
+	/// Returns whether the estimate may have changed: a register was updated
+	/// or the key was created.
+	#[storage_lock(write, key)]
+	#[fastrace::trace]
+	pub async fn pfadd(&self, key: Bytes, elements: Vec<Bytes>) -> Result<bool, StorageError> {
+		let (mut hll, mut changed) = match self.read_hll(&key).await? {
+			Some(hll) => (hll, false),
+			None => (HyperLogLog::new(), true),
+		};
+		for element in &elements {
+			changed |= hll.add(element);
+		}
+
+		if changed {
+			self.write_hll(&key, &hll).await?;
+		}
+		Ok(changed)
+	}
+
+	/// Estimate the number of distinct elements added to the HyperLogLogs
+	/// at `keys`, counting their union. Missing keys count as empty.
+	#[storage_lock(read_many, keys)]
+	#[fastrace::trace]
+	pub async fn pfcount<I>(&self, keys: I) -> Result<u64, StorageError>
+	where
+		I: IntoIterator<Item = Bytes>,
+	{
+		// A single value may carry its cardinality, e.g. written by Redis.
+		if let [key] = keys.as_slice() {
+			let Some(value) = self.string_value(key).await? else {
+				return Ok(0);
+			};
+			let hll = HyperLogLog::decode(&value).map_err(hll_error)?;
+			return Ok(HyperLogLog::cached_count(&value).unwrap_or_else(|| hll.count()));
+		}
+
+		let mut union = HyperLogLog::new();
+		for key in &keys {
+			if let Some(hll) = self.read_hll(key).await? {
+				union.merge(&hll);
+			}
+		}
+		Ok(union.count())
+	}
+
+	/// Merge the HyperLogLogs at `sources` into the one at `dest`, creating
+	/// it if missing. Missing sources count as empty.
+	#[fastrace::trace]
+	pub async fn pfmerge(&self, dest: Bytes, sources: Vec<Bytes>) -> Result<(), StorageError> {
+		let _guard = self
+			.write_lock(std::iter::once(dest.clone()).chain(sources.iter().cloned()))
+			.await;
+
+		let mut merged = self.read_hll(&dest).await?.unwrap_or_default();
+		for source in &sources {
+			if let Some(hll) = self.read_hll(source).await? {
+				merged.merge(&hll);
+			}
+		}
+		self.write_hll(&dest, &merged).await
+	}
+
+	/// Read the HyperLogLog at `key`. The caller must hold the key lock.
+	async fn read_hll(&self, key: &Bytes) -> Result<Option<HyperLogLog>, StorageError> {
+		match self.string_value(key).await? {
+			Some(value) => Ok(Some(HyperLogLog::decode(&value).map_err(hll_error)?)),
+			None => Ok(None),
+		}
+	}
+
+	/// Store `hll` as the string at `key`. The caller must hold the key lock.
+	async fn write_hll(&self, key: &Bytes, hll: &HyperLogLog) -> Result<(), StorageError> {
+		let key = StringKey::new(key.clone());
+		let value = StringValue::new(hll.encode());
+
+		let write_opts = WriteOptions {
+			await_durable: false,
+		};
+		let put_opts = PutOptions::default();
+		self.record_undo(DataType::String, [key.encode()]).await?;
+		self.put_string_record(key.encode(), value.encode(), &put_opts, &write_opts)
+			.await?;
+		Ok(())
+	}
+}
+
+fn hll_error(err: HllError) -> StorageError {
+	let message = match err {
+		HllError::NotHll => "WRONGTYPE Key is not a valid HyperLogLog string value.",
+		HllError::Corrupted => "INVALIDOBJ Corrupted HLL object detected",
+	};
+	StorageError::InvalidArgument {
+		message: message.to_string(),
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+
+	async fn get_storage() -> (Storage, std::path::PathBuf) {
+		let timestamp = ulid::Ulid::new().to_string();
+		let path = std::env::temp_dir().join(format!("nimbis_test_hll_{}", timestamp));
+		std::fs::create_dir_all(&path).unwrap();
+		let storage = Storage::open(&path, None).await.unwrap();
+		(storage, path)
+	}
+
+	fn elements(range: std::ops::Range<usize>) -> Vec<Bytes> {
+		range.map(|i| Bytes::from(format!("user:{i}"))).collect()
+	}
+
+	#[tokio::test]
+	async fn test_pfadd_pfcount() {
+		let (storage, path) = get_storage().await;
+		let key = Bytes::from("hll");
+
+		assert!(storage.pfadd(key.clone(), elements(0..3)).await.unwrap());
+		assert!(!storage.pfadd(key.clone(), elements(0..3)).await.unwrap());
+		assert_eq!(storage.pfcount([key.clone()]).await.unwrap(), 3);
+
+		// Creating an empty HyperLogLog counts as a change.
+		let empty = Bytes::from("empty");
+		assert!(storage.pfadd(empty.clone(), Vec::new()).await.unwrap());
+		assert!(!storage.pfadd(empty.clone(), Vec::new()).await.unwrap());
+		assert_eq!(storage.pfcount([empty]).await.unwrap(), 0);
+
+		assert_eq!(storage.pfcount([Bytes::from("missing")]).await.unwrap(), 0);
+		let value = storage.get(key).await.unwrap().unwrap();
+		assert_eq!(&value[..4], b"HYLL");
+
+		std::fs::remove_dir_all(path).unwrap();
+	}
+
+	#[tokio::test]
+	async fn test_pfmerge_and_union_count() {
+		let (storage, path) = get_storage().await;
+		let (a, b, dest) = (Bytes::from("a"), Bytes::from("b"), Bytes::from("dest"));
+
+		storage.pfadd(a.clone(), elements(0..5000)).await.unwrap();
+		storage
+			.pfadd(b.clone(), elements(2500..7500))
+			.await
+			.unwrap();
+
+		let union = storage.pfcount([a.clone(), b.clone()]).await.unwrap();
+		assert!(union.abs_diff(7500) < 7500 / 50, "union estimated {union}");
+
+		storage
+			.pfmerge(dest.clone(), vec![a, b, Bytes::from("missing")])
+			.await
+			.unwrap();
+		assert_eq!(storage.pfcount([dest.clone()]).await.unwrap(), union);
+
+		// The destination is part of the merge.
+		storage
+			.pfadd(dest.clone(), elements(7500..7501))
+			.await
+			.unwrap();
+		storage.pfmerge(dest.clone(), Vec::new()).await.unwrap();
+		assert!(storage.pfcount([dest]).await.unwrap() >= union);
+
+		std::fs::remove_dir_all(path).unwrap();
+	}
+
+	#[tokio::test]
+	async fn test_hll_invalid_values() {
+		let (storage, path) = get_storage().await;
+		let (string, hash) = (Bytes::from("string"), Bytes::from("hash"));
+
+		storage
+			.set(string.clone(), Bytes::from("not an hll"))
+			.await
+			.unwrap();
+		let err = storage.pfadd(string.clone(), elements(0..1)).await;
+		assert!(
+			err.unwrap_err()
+				.to_string()
+				.contains("not a valid HyperLogLog")
+		);
+
+		// A sparse header followed by a truncated XZERO opcode.
+		let mut corrupted = b"HYLL\x01".to_vec();
+		corrupted.extend_from_slice(&[0; 11]);
+		corrupted.push(0x7F);
+		storage
+			.set(string.clone(), Bytes::from(corrupted))
+			.await
+			.unwrap();
+		let err = storage.pfcount([string]).await.unwrap_err();
+		assert!(err.to_string().contains("INVALIDOBJ"));
+
+		storage
+			.hset(hash.clone(), Bytes::from("f"), Bytes::from("v"))
+			.await
+			.unwrap();
+		let err = storage.pfmerge(hash, Vec::new()).await.unwrap_err();
+		assert!(err.to_string().contains("WRONGTYPE"));
+
+		std::fs::remove_dir_all(path).unwrap();
+	}
+}
@@ -5,6 +5,7 @@ use nimbis_macros::storage_lock;
 use slatedb::config::PutOptions;
 use slatedb::config::WriteOptions;
 
+use crate::data_type::DataType;
 use crate::error::StorageError;
 use crate::list::element_key::ListElementKey;
 use crate::storage::Storage;
@@ -62,6 +63,8 @@ impl Storage {
 			};
 
 			let element_key = ListElementKey::new(key.clone(), seq);
+			self.record_undo(DataType::List, [element_key.encode()])
+				.await?;
 			let wh = self
 				.list_db
 				.put_with_options(element_key.encode(), element, &put_opts, &write_opts)
@@ -81,14 +84,15 @@ impl Storage {
 		// Update metadata
 		let meta_put_opts = Storage::meta_put_opts(&meta_val);
 
-		self.string_db
-			.put_with_options(
-				meta_encoded_key,
-				meta_val.encode(),
-				&meta_put_opts,
-				&write_opts,
-			)
+		self.record_undo(DataType::String, [meta_encoded_key.clone()])
 			.await?;
+		self.put_string_record(
+			meta_encoded_key,
+			meta_val.encode(),
+			&meta_put_opts,
+			&write_opts,
+		)
+		.await?;
 
 		Ok(meta_val.len)
 	}
@@ -153,6 +157,8 @@ impl Storage {
 				}
 				meta_val.len -= 1;
 
+				self.record_undo(DataType::List, [element_key.encode()])
+					.await?;
 				self.list_db
 					.delete_with_options(element_key.encode(), &write_opts)
 					.await?;
@@ -161,23 +167,23 @@ impl Storage {
 
 		// Update metadata
 		let meta_key = MetaKey::new(key.clone());
+		self.record_undo(DataType::String, [meta_key.encode()])
+			.await?;
 
 		if meta_val.len == 0 {
 			// List empty, delete metadata
-			self.string_db
-				.delete_with_options(meta_key.encode(), &write_opts)
+			self.delete_string_record(meta_key.encode(), &write_opts)
 				.await?;
 		} else {
 			let meta_put_opts = Storage::meta_put_opts(&meta_val);
 
-			self.string_db
-				.put_with_options(
-					meta_key.encode(),
-					meta_val.encode(),
-					&meta_put_opts,
-					&write_opts,
-				)
-				.await?;
+			self.put_string_record(
+				meta_key.encode(),
+				meta_val.encode(),
+				&meta_put_opts,
+				&write_opts,
+			)
+			.await?;
 		}
 
 		Ok(results)
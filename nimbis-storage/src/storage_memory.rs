@@ -0,0 +1,309 @@
+use bytes::Bytes;
+use nimbis_macros::storage_lock;
+use slatedb::Db;
+
+use crate::bitmap::CHUNK_SIZE;
+use crate::compaction_filter::CollectionCompactionFilter;
+use crate::error::StorageError;
+use crate::storage::Storage;
+use crate::string::meta::AnyValue;
+use crate::string::meta::MetaKey;
+use crate::utils::is_expired;
+use crate::utils::stream_entry_user_key_prefix;
+use crate::utils::user_key_prefix;
+use crate::utils::zset_score_user_key_prefix;
+
+/// The size of one key, from `Storage::key_sizes`.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct KeySize {
+	pub key: Bytes,
+	/// The Redis type name of the key, or the type name of an extension.
+	pub type_name: String,
+	/// Elements of a collection, or bytes of a string or bitmap. Extension
+	/// values count as one element.
+	pub elements: u64,
+	/// Estimated storage footprint, as `Storage::memory_usage` reports it.
+	pub bytes: u64,
+}
+
+/// The outcome of one `Storage::key_sizes` batch.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct KeySizes {
+	pub sizes: Vec<KeySize>,
+	/// Where the next batch starts, or `None` once every key was read.
+	pub next: Option<Bytes>,
+}
+
+impl Storage {
+	/// Estimate the storage footprint of `key` in bytes: its encoded meta
+	/// record plus the encoded keys and values of its collection elements.
+	///
+	/// At most `samples` elements are read and the average element size is
+	/// extrapolated to the full collection; `samples == 0` reads every
+	/// element. Returns `None` if the key does not exist.
+	#[storage_lock(read, key)]
+	#[fastrace::trace]
+	pub async fn memory_usage(
+		&self,
+		key: Bytes,
+		samples: usize,
+	) -> Result<Option<u64>, StorageError> {
+		let Some(meta) = self.get_meta::<AnyValue>(&key).await? else {
+			return Ok(None);
+		};
+
+		let meta_bytes = (MetaKey::new(key.clone()).encode().len() + meta.encode().len()) as u64;
+		let elements_bytes = self.elements_bytes(&key, &meta, samples).await?;
+		Ok(Some(meta_bytes + elements_bytes))
+	}
+
+	/// Read the size of up to `limit` keys, starting at the meta record
+	/// `start` or at the first key, estimating collections from `samples`
+	/// elements like `Storage::memory_usage`. Keys are read without their
+	/// lock, so a key written meanwhile may be reported as it was before or
+	/// after the write.
+	#[fastrace::trace]
+	pub async fn key_sizes(
+		&self,
+		start: Option<Bytes>,
+		limit: usize,
+		samples: usize,
+	) -> Result<KeySizes, StorageError> {
+		let mut result = KeySizes::default();
+		let mut stream = self.string_db.scan(start.unwrap_or_default()..).await?;
+		while let Some(kv) = stream.next().await? {
+			if result.sizes.len() == limit {
+				result.next = Some(kv.key);
+				break;
+			}
+			if is_expired(kv.expire_ts) {
+				continue;
+			}
+			let Some(key) = CollectionCompactionFilter::decode_sub_key(&kv.key) else {
+				continue;
+			};
+			let meta = AnyValue::decode(&kv.value)?;
+			let (type_name, elements) = match &meta {
+				AnyValue::String(value) => ("string".to_string(), value.value.len() as u64),
+				// Bitmaps are strings to Redis.
+				AnyValue::Bitmap(meta) => ("string".to_string(), meta.len),
+				AnyValue::Hash(meta) => ("hash".to_string(), meta.len),
+				AnyValue::List(meta) => ("list".to_string(), meta.len),
+				AnyValue::Set(meta) => ("set".to_string(), meta.len),
+				AnyValue::ZSet(meta) => ("zset".to_string(), meta.len),
+				AnyValue::Stream(meta) => ("stream".to_string(), meta.len),
+				AnyValue::Extension(value) => {
+					(String::from_utf8_lossy(&value.type_name).into_owned(), 1)
+				}
+			};
+			let bytes = (kv.key.len() + kv.value.len()) as u64
+				+ self.elements_bytes(&key, &meta, samples).await?;
+			result.sizes.push(KeySize {
+				key,
+				type_name,
+				elements,
+				bytes,
+			});
+		}
+		Ok(result)
+	}
+
+	/// Estimate the encoded size of the collection elements of `key`.
+	async fn elements_bytes(
+		&self,
+		key: &Bytes,
+		meta: &AnyValue,
+		samples: usize,
+	) -> Result<u64, StorageError> {
+		let bytes = match meta {
+			AnyValue::String(_) | AnyValue::Extension(_) => 0,
+			AnyValue::Hash(meta) => {
+				let prefix = user_key_prefix(key);
+				sample_elements(&self.hash_db, &prefix, meta.version, meta.len, samples).await?
+			}
+			AnyValue::List(meta) => {
+				let prefix = user_key_prefix(key);
+				sample_elements(&self.list_db, &prefix, meta.version, meta.len, samples).await?
+			}
+			AnyValue::Set(meta) => {
+				let prefix = user_key_prefix(key);
+				sample_elements(&self.set_db, &prefix, meta.version, meta.len, samples).await?
+			}
+			AnyValue::ZSet(meta) => {
+				// Every member is stored twice, once keyed by member and once
+				// keyed by score, with records of about the same size.
+				let prefix = zset_score_user_key_prefix(key);
+				2 * sample_elements(&self.zset_db, &prefix, meta.version, meta.len, samples).await?
+			}
+			AnyValue::Stream(meta) => {
+				let prefix = stream_entry_user_key_prefix(key);
+				sample_elements(&self.stream_db, &prefix, meta.version, meta.len, samples).await?
+			}
+			AnyValue::Bitmap(meta) => {
+				// Chunks are only stored where bits were written, so the chunk
+				// count of a dense bitmap is an upper bound.
+				let prefix = user_key_prefix(key);
+				let chunks = meta.len.div_ceil(CHUNK_SIZE);
+				sample_elements(&self.bitmap_db, &prefix, meta.version, chunks, samples).await?
+			}
+		};
+		Ok(bytes)
+	}
+}
+
+/// Sum the encoded size of up to `samples` visible elements under `prefix`
+/// and extrapolate it to `len` elements. If fewer elements exist, their
+/// exact size is returned.
+async fn sample_elements(
+	db: &Db,
+	prefix: &Bytes,
+	version: u64,
+	len: u64,
+	samples: usize,
+) -> Result<u64, StorageError> {
+	let mut stream = db.scan(prefix.clone()..).await?;
+	let mut sampled = 0u64;
+	let mut sampled_bytes = 0u64;
+	let mut truncated = false;
+
+	while let Some(kv) = stream.next().await? {
+		if !kv.key.starts_with(prefix) {
+			break;
+		}
+		if kv.seq < version {
+			continue;
+		}
+
+		sampled += 1;
+		sampled_bytes += (kv.key.len() + kv.value.len()) as u64;
+		if samples > 0 && sampled >= samples as u64 {
+			truncated = true;
+			break;
+		}
+	}
+
+	if !truncated || sampled >= len {
+		return Ok(sampled_bytes);
+	}
+
+	Ok(sampled_bytes * len / sampled)
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+
+	async fn get_storage() -> (Storage, std::path::PathBuf) {
+		let timestamp = ulid::Ulid::new().to_string();
+		let path = std::env::temp_dir().join(format!("nimbis_test_memory_{}", timestamp));
+		std::fs::create_dir_all(&path).unwrap();
+		let storage = Storage::open(&path, None).await.unwrap();
+		(storage, path)
+	}
+
+	#[tokio::test]
+	async fn test_memory_usage_missing_key() {
+		let (storage, path) = get_storage().await;
+
+		let usage = storage
+			.memory_usage(Bytes::from("missing"), 5)
+			.await
+			.unwrap();
+		assert_eq!(usage, None);
+
+		std::fs::remove_dir_all(path).unwrap();
+	}
+
+	#[tokio::test]
+	async fn test_memory_usage_grows_with_value_size() {
+		let (storage, path) = get_storage().await;
+		let small = Bytes::from("small");
+		let large = Bytes::from("large");
+
+		storage.set(small.clone(), Bytes::from("v")).await.unwrap();
+		storage
+			.set(large.clone(), Bytes::from(vec![b'x'; 1024]))
+			.await
+			.unwrap();
+
+		let small_usage = storage.memory_usage(small, 5).await.unwrap().unwrap();
+		let large_usage = storage.memory_usage(large, 5).await.unwrap().unwrap();
+		assert!(small_usage > 0);
+		assert!(large_usage >= small_usage + 1023);
+
+		std::fs::remove_dir_all(path).unwrap();
+	}
+
+	#[tokio::test]
+	async fn test_memory_usage_samples_collections() {
+		let (storage, path) = get_storage().await;
+		let key = Bytes::from("myset");
+		let members = (0..100)
+			.map(|i| Bytes::from(format!("member-{:03}", i)))
+			.collect::<Vec<_>>();
+		storage.sadd(key.clone(), members).await.unwrap();
+
+		let exact = storage.memory_usage(key.clone(), 0).await.unwrap().unwrap();
+		let sampled = storage.memory_usage(key, 5).await.unwrap().unwrap();
+		// Members have the same size, so sampling extrapolates exactly.
+		assert_eq!(exact, sampled);
+		assert!(exact > 100 * "member-000".len() as u64);
+
+		std::fs::remove_dir_all(path).unwrap();
+	}
+
+	#[tokio::test]
+	async fn test_key_sizes_walks_every_key() {
+		let (storage, path) = get_storage().await;
+		storage
+			.set(Bytes::from("str"), Bytes::from(vec![b'x'; 100]))
+			.await
+			.unwrap();
+		let members = (0..50)
+			.map(|i| Bytes::from(format!("member-{:03}", i)))
+			.collect::<Vec<_>>();
+		storage.sadd(Bytes::from("set"), members).await.unwrap();
+		storage
+			.rpush(
+				Bytes::from("list"),
+				vec![Bytes::from("a"), Bytes::from("b")],
+			)
+			.await
+			.unwrap();
+
+		// A small limit walks the keys over several batches.
+		let mut sizes = Vec::new();
+		let mut start = None;
+		loop {
+			let batch = storage.key_sizes(start, 2, 5).await.unwrap();
+			assert!(batch.sizes.len() <= 2);
+			sizes.extend(batch.sizes);
+			start = batch.next;
+			if start.is_none() {
+				break;
+			}
+		}
+		sizes.sort_by(|a, b| a.key.cmp(&b.key));
+		let summary: Vec<_> = sizes
+			.iter()
+			.map(|size| (size.key.clone(), size.type_name.as_str(), size.elements))
+			.collect();
+		assert_eq!(
+			summary,
+			vec![
+				(Bytes::from("list"), "list", 2),
+				(Bytes::from("set"), "set", 50),
+				(Bytes::from("str"), "string", 100),
+			]
+		);
+
+		let set_usage = storage
+			.memory_usage(Bytes::from("set"), 5)
+			.await
+			.unwrap()
+			.unwrap();
+		assert_eq!(sizes[1].bytes, set_usage);
+
+		std::fs::remove_dir_all(path).unwrap();
+	}
+}
@@ -0,0 +1,931 @@
+use std::collections::HashMap;
+
+use bytes::Bytes;
+use bytes::BytesMut;
+use nimbis_macros::storage_lock;
+
+use crate::bitmap::CHUNK_SIZE;
+use crate::bitmap::chunk_key::BitmapChunkKey;
+use crate::compaction_filter::CollectionCompactionFilter;
+use crate::data_type::DataType;
+use crate::error::DecoderError;
+use crate::error::StorageError;
+use crate::rdb;
+use crate::rdb::RdbEntry;
+use crate::rdb::RdbPendingEntry;
+use crate::rdb::RdbStream;
+use crate::rdb::RdbStreamConsumer;
+use crate::rdb::RdbStreamGroup;
+use crate::rdb::RdbValue;
+use crate::snapshot::Snapshot;
+use crate::snapshot::SnapshotEntry;
+use crate::storage::Storage;
+use crate::storage_snapshot::LoadProgress;
+use crate::stream::consumer::StreamConsumerValue;
+use crate::stream::entry_value::StreamEntryValue;
+use crate::stream::group::StreamGroupValue;
+use crate::stream::id::StreamId;
+use crate::stream::pending::StreamPendingKey;
+use crate::stream::pending::StreamPendingValue;
+use crate::string::meta::AnyValue;
+use crate::string::meta::MetaKey;
+use crate::utils::is_expired;
+use crate::utils::user_key_prefix;
+use crate::zset::score_key::ScoreKey;
+
+/// The outcome of `Storage::export_rdb`.
+#[derive(Debug, Clone, PartialEq)]
+pub struct RdbExport {
+	/// Where the file was written in the object store.
+	pub path: String,
+	/// Keys written to the file.
+	pub keys: usize,
+	/// Keys of extension types, which Redis cannot load from an RDB file
+	/// without a module, and which were left out.
+	pub skipped: usize,
+}
+
+/// The outcome of `Storage::import_rdb`.
+#[derive(Debug, Clone, PartialEq)]
+pub struct RdbImport {
+	/// Keys loaded from the file.
+	pub keys: usize,
+	/// Keys the file holds that were not loaded: keys of databases other
+	/// than 0. Keys already expired are dropped without
+	/// being counted.
+	pub skipped: usize,
+}
+
+impl Storage {
+	/// Write the live dataset to the object store as a Redis RDB file. The
+	/// dataset is copied as for a snapshot, so the file is consistent across
+	/// keys.
+	#[fastrace::trace]
+	pub async fn export_rdb(&self) -> Result<RdbExport, StorageError> {
+		let snapshot = self.snapshot().await?;
+		let ctime = snapshot.saved_at / 1000;
+		let (entries, skipped) = rdb_entries(snapshot)?;
+		let path = self.snapshots.put_rdb(rdb::encode(&entries, ctime)).await?;
+		Ok(RdbExport {
+			path,
+			keys: entries.len(),
+			skipped,
+		})
+	}
+
+	/// Load the keys of an RDB file written by Redis or by `export_rdb`. Each
+	/// key replaces any value already stored under it; other keys are kept.
+	/// The whole file is decoded and checked before anything is written, but
+	/// the keys are then written one at a time, not as one atomic group.
+	/// `progress` is called after each key.
+	#[fastrace::trace]
+	pub async fn import_rdb(
+		&self,
+		data: &[u8],
+		progress: &(dyn Fn(LoadProgress) + Sync),
+	) -> Result<RdbImport, StorageError> {
+		let (entries, skipped) = rdb::decode(data)?;
+		let now = chrono::Utc::now().timestamp_millis();
+		let total = entries.len();
+		let mut keys = 0;
+		for (i, entry) in entries.into_iter().enumerate() {
+			if entry.expire_ts.is_none_or(|ts| ts > now) {
+				self.restore_entry(entry).await?;
+				keys += 1;
+			}
+			progress(LoadProgress {
+				loaded: i + 1,
+				total,
+			});
+		}
+		Ok(RdbImport { keys, skipped })
+	}
+
+	/// Read `key` as a Redis value with its expire time, for DUMP and
+	/// MIGRATE. Returns `None` if the key does not exist. Extension types have
+	/// no RDB encoding, so they are rejected with
+	/// `StorageError::InvalidArgument`.
+	#[storage_lock(read, key)]
+	#[fastrace::trace]
+	pub async fn dump_entry(&self, key: Bytes) -> Result<Option<RdbEntry>, StorageError> {
+		self.read_entry(key).await
+	}
+
+	/// Read `keys` as `dump_entry` does and hand the entries of those that
+	/// exist to `transfer`, which returns its outcome and the keys it moved.
+	/// With `delete`, those keys are then deleted. The keys stay locked from
+	/// the read to the delete, so MIGRATE never deletes a key written after it
+	/// was copied: the write waits for the transfer instead. Returns the
+	/// outcome and the keys deleted.
+	pub async fn transfer_entries<T, F, Fut>(
+		&self,
+		keys: Vec<Bytes>,
+		delete: bool,
+		transfer: F,
+	) -> Result<(T, Vec<Bytes>), StorageError>
+	where
+		F: FnOnce(Vec<RdbEntry>) -> Fut,
+		Fut: Future<Output = (T, Vec<Bytes>)>,
+	{
+		let _guard = if delete {
+			self.write_lock(keys.iter().cloned()).await
+		} else {
+			self.read_lock(keys.iter().cloned()).await
+		};
+		let mut entries = Vec::with_capacity(keys.len());
+		for key in keys {
+			if let Some(entry) = self.read_entry(key).await? {
+				entries.push(entry);
+			}
+		}
+		let (outcome, moved) = transfer(entries).await;
+		let mut deleted = Vec::new();
+		if delete {
+			for key in moved {
+				if self.delete_keys(vec![key.clone()]).await? > 0 {
+					deleted.push(key);
+				}
+			}
+		}
+		Ok((outcome, deleted))
+	}
+
+	/// `dump_entry` without taking the lock of `key`, which the caller holds.
+	async fn read_entry(&self, key: Bytes) -> Result<Option<RdbEntry>, StorageError> {
+		let meta_key = MetaKey::new(key.clone()).encode();
+		let Some(kv) = self.string_db.get_key_value(meta_key.clone()).await? else {
+			return Ok(None);
+		};
+		if is_expired(kv.expire_ts) {
+			return Ok(None);
+		}
+
+		// Read the key and its current elements the way a snapshot lists
+		// them, so they are converted like an RDB export.
+		let meta = AnyValue::decode(&kv.value)?;
+		let mut entries = vec![SnapshotEntry {
+			data_type: DataType::String,
+			key: meta_key,
+			value: kv.value,
+			expire_ts: kv.expire_ts,
+		}];
+		if let Some(version) = meta.version() {
+			let data_type = meta.data_type();
+			let prefix = user_key_prefix(&key);
+			let mut stream = self.db(data_type).scan(prefix.clone()..).await?;
+			while let Some(kv) = stream.next().await? {
+				if !kv.key.starts_with(&prefix) {
+					break;
+				}
+				if kv.seq >= version {
+					entries.push(SnapshotEntry {
+						data_type,
+						key: kv.key,
+						value: kv.value,
+						expire_ts: kv.expire_ts,
+					});
+				}
+			}
+		}
+
+		let (mut entries, skipped) = rdb_entries(Snapshot {
+			saved_at: 0,
+			entries,
+		})?;
+		if skipped > 0 {
+			return Err(StorageError::InvalidArgument {
+				message: "ERR extension keys cannot be serialized".to_string(),
+			});
+		}
+		Ok(entries.pop())
+	}
+
+	/// Replace whatever is stored under the key of `entry` with its value
+	/// and expire time. An entry that has already expired only deletes the
+	/// key. Like `import_rdb`, the value is written in several steps, not as
+	/// one atomic group.
+	#[fastrace::trace]
+	pub async fn restore_entry(&self, entry: RdbEntry) -> Result<(), StorageError> {
+		let key = entry.key;
+		self.del([key.clone()]).await?;
+		if entry
+			.expire_ts
+			.is_some_and(|ts| ts <= chrono::Utc::now().timestamp_millis())
+		{
+			return Ok(());
+		}
+		match entry.value {
+			RdbValue::String(value) => self.set(key.clone(), value).await?,
+			RdbValue::List(elements) => {
+				self.rpush(key.clone(), elements).await?;
+			}
+			RdbValue::Set(members) => {
+				self.sadd(key.clone(), members).await?;
+			}
+			RdbValue::ZSet(members) => {
+				let members = members
+					.into_iter()
+					.map(|(member, score)| (score, member))
+					.collect();
+				self.zadd(key.clone(), members).await?;
+			}
+			RdbValue::Hash(fields) => {
+				for (field, value) in fields {
+					self.hset(key.clone(), field, value).await?;
+				}
+			}
+			RdbValue::Stream(stream) => self.restore_stream(key.clone(), stream).await?,
+		}
+		if let Some(ts) = entry.expire_ts {
+			self.expire(key, ts as u64).await?;
+		}
+		Ok(())
+	}
+
+	/// Load the RDB file at the export path in the object store, where
+	/// `export_rdb` writes and where a Redis dump can be uploaded.
+	#[fastrace::trace]
+	pub async fn import_stored_rdb(&self) -> Result<RdbImport, StorageError> {
+		match self.snapshots.get_rdb().await? {
+			(_, Some(data)) => self.import_rdb(&data, &|_| {}).await,
+			(path, None) => Err(StorageError::InvalidArgument {
+				message: format!("ERR no RDB file at {}", path),
+			}),
+		}
+	}
+}
+
+/// The value at the end of an element key: `len (u32 BE) + bytes`.
+fn length_prefixed(rest: &[u8]) -> Result<Bytes, DecoderError> {
+	let len = rest
+		.get(..4)
+		.map(|len| u32::from_be_bytes(len.try_into().unwrap()) as usize)
+		.ok_or(DecoderError::InvalidLength)?;
+	rest.get(4..4 + len)
+		.map(Bytes::copy_from_slice)
+		.ok_or(DecoderError::InvalidLength)
+}
+
+/// Add a record of a stream, after its user key, to `stream`: an entry
+/// unless it was trimmed, a group, a consumer or a pending entry. The
+/// records of a stream sort consumers before entries, entries before groups
+/// and groups before pending entries, so a group is found by name when its
+/// consumers come first.
+fn stream_record(
+	stream: &mut RdbStream,
+	trimmed_id: StreamId,
+	rest: &[u8],
+	value: Bytes,
+) -> Result<(), StorageError> {
+	let invalid = || DecoderError::InvalidLength;
+	match rest.first() {
+		Some(b'E') => {
+			let id = StreamId::from_bytes(&rest[1..]).ok_or_else(invalid)?;
+			if id > trimmed_id {
+				stream
+					.entries
+					.push((id, StreamEntryValue::decode(&value)?.fields));
+			}
+		}
+		Some(b'G') => {
+			let group = stream_group(stream, Bytes::copy_from_slice(&rest[1..]));
+			let value = StreamGroupValue::decode(&value)?;
+			group.last_delivered_id = value.last_delivered_id;
+			group.entries_read = value.entries_read;
+		}
+		Some(b'C') => {
+			let name = length_prefixed(&rest[1..])?;
+			let consumer = Bytes::copy_from_slice(&rest[5 + name.len()..]);
+			let value = StreamConsumerValue::decode(&value)?;
+			stream_group(stream, name)
+				.consumers
+				.push(RdbStreamConsumer {
+					name: consumer,
+					seen_time: value.seen_time,
+					active_time: value.active_time,
+				});
+		}
+		Some(b'P') => {
+			let name = length_prefixed(&rest[1..])?;
+			let id = StreamPendingKey::decode_id(rest).ok_or_else(invalid)?;
+			let value = StreamPendingValue::decode(&value)?;
+			stream_group(stream, name).pending.push(RdbPendingEntry {
+				id,
+				consumer: value.consumer,
+				delivery_time: value.delivery_time,
+				delivery_count: value.delivery_count,
+			});
+		}
+		_ => {}
+	}
+	Ok(())
+}
+
+/// The group `name` of `stream`, added if its records were not seen yet.
+/// Groups are kept in name order, the order their records sort in.
+fn stream_group(stream: &mut RdbStream, name: Bytes) -> &mut RdbStreamGroup {
+	let index = match stream
+		.groups
+		.binary_search_by(|group| group.name.cmp(&name))
+	{
+		Ok(index) => index,
+		Err(index) => {
+			stream.groups.insert(
+				index,
+				RdbStreamGroup {
+					name,
+					last_delivered_id: StreamId::MIN,
+					entries_read: None,
+					pending: Vec::new(),
+					consumers: Vec::new(),
+				},
+			);
+			index
+		}
+	};
+	&mut stream.groups[index]
+}
+
+/// Turn the raw entries of `snapshot` into Redis values, returning them with
+/// the number of keys left out.
+fn rdb_entries(snapshot: Snapshot) -> Result<(Vec<RdbEntry>, usize), StorageError> {
+	let mut entries = Vec::new();
+	let mut skipped = 0;
+	// Index in `entries` of each collection, by user key.
+	let mut collections = HashMap::new();
+	// Element range of each list, the bytes of each bitmap, and the entries
+	// each stream trimmed.
+	let mut list_ranges = HashMap::new();
+	let mut bitmaps = HashMap::new();
+	let mut trimmed_ids = HashMap::new();
+
+	// Collection metadata lives in the string DB, which the snapshot lists
+	// before the element DBs.
+	for entry in snapshot.entries {
+		let Some(user_key) = CollectionCompactionFilter::decode_sub_key(&entry.key) else {
+			continue;
+		};
+		let rest = &entry.key[2 + user_key.len()..];
+
+		if entry.data_type == DataType::String {
+			let value = match AnyValue::decode(&entry.value)? {
+				AnyValue::String(value) => RdbValue::String(value.value),
+				AnyValue::Hash(_) => RdbValue::Hash(Vec::new()),
+				AnyValue::Set(_) => RdbValue::Set(Vec::new()),
+				AnyValue::ZSet(_) => RdbValue::ZSet(Vec::new()),
+				AnyValue::List(meta) => {
+					list_ranges.insert(user_key.clone(), meta.head..meta.tail);
+					RdbValue::List(Vec::new())
+				}
+				// Bitmaps are strings to Redis.
+				AnyValue::Bitmap(meta) => {
+					bitmaps.insert(user_key.clone(), BytesMut::zeroed(meta.len as usize));
+					RdbValue::String(Bytes::new())
+				}
+				AnyValue::Stream(meta) => {
+					trimmed_ids.insert(user_key.clone(), meta.trimmed_id);
+					RdbValue::Stream(RdbStream {
+						last_id: meta.last_id,
+						entries_added: meta.entries_added,
+						max_deleted_id: meta.max_deleted_id,
+						..RdbStream::default()
+					})
+				}
+				AnyValue::Extension(_) => {
+					skipped += 1;
+					continue;
+				}
+			};
+			collections.insert(user_key.clone(), entries.len());
+			entries.push(RdbEntry {
+				key: user_key,
+				value,
+				expire_ts: entry.expire_ts,
+			});
+			continue;
+		}
+
+		if entry.data_type == DataType::Bitmap {
+			if let Some(bitmap) = bitmaps.get_mut(&user_key)
+				&& let Some(index) = BitmapChunkKey::decode_index(&entry.key)
+			{
+				let start = (index * CHUNK_SIZE) as usize;
+				if start < bitmap.len() {
+					let len = entry.value.len().min(bitmap.len() - start);
+					bitmap[start..start + len].copy_from_slice(&entry.value[..len]);
+				}
+			}
+			continue;
+		}
+
+		let Some(&index) = collections.get(&user_key) else {
+			continue;
+		};
+		match (&mut entries[index].value, entry.data_type) {
+			(RdbValue::Hash(fields), DataType::Hash) => {
+				fields.push((length_prefixed(rest)?, entry.value));
+			}
+			(RdbValue::Set(members), DataType::Set) => {
+				members.push(length_prefixed(rest)?);
+			}
+			// Each member has a member key holding its score and a score key
+			// for ordering; the member keys are enough.
+			(RdbValue::ZSet(members), DataType::ZSet) if rest.first() == Some(&b'M') => {
+				let score = entry
+					.value
+					.get(..8)
+					.map(|score| u64::from_be_bytes(score.try_into().unwrap()))
+					.ok_or(DecoderError::InvalidLength)?;
+				members.push((length_prefixed(&rest[1..])?, ScoreKey::decode_score(score)));
+			}
+			// Element keys sort by sequence number, which is list order.
+			(RdbValue::List(elements), DataType::List) => {
+				let seq = rest
+					.get(..8)
+					.map(|seq| u64::from_be_bytes(seq.try_into().unwrap()))
+					.ok_or(DecoderError::InvalidLength)?;
+				if list_ranges
+					.get(&user_key)
+					.is_some_and(|range| range.contains(&seq))
+				{
+					elements.push(entry.value);
+				}
+			}
+			(RdbValue::Stream(stream), DataType::Stream) => {
+				stream_record(stream, trimmed_ids[&user_key], rest, entry.value)?;
+			}
+			_ => {}
+		}
+	}
+
+	for entry in &mut entries {
+		if let Some(bitmap) = bitmaps.remove(&entry.key) {
+			entry.value = RdbValue::String(bitmap.freeze());
+		}
+		if let RdbValue::Stream(stream) = &mut entry.value {
+			// Redis rejects a pending entry whose owner is not a consumer of
+			// its group, so give any owner without a record one.
+			for group in &mut stream.groups {
+				for pending in &group.pending {
+					if !group.consumers.iter().any(|c| c.name == pending.consumer) {
+						group.consumers.push(RdbStreamConsumer {
+							name: pending.consumer.clone(),
+							seen_time: pending.delivery_time,
+							active_time: pending.delivery_time,
+						});
+					}
+				}
+				group.consumers.sort_by(|a, b| a.name.cmp(&b.name));
+			}
+		}
+	}
+	Ok((entries, skipped))
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+
+	async fn get_storage() -> (Storage, std::path::PathBuf) {
+		let timestamp = ulid::Ulid::new().to_string();
+		let path = std::env::temp_dir().join(format!("nimbis_test_rdb_{}", timestamp));
+		std::fs::create_dir_all(&path).unwrap();
+		let storage = Storage::open(&path, None).await.unwrap();
+		(storage, path)
+	}
+
+	fn value<'a>(entries: &'a [RdbEntry], key: &str) -> &'a RdbValue {
+		&entries.iter().find(|entry| entry.key == key).unwrap().value
+	}
+
+	#[tokio::test]
+	async fn test_rdb_entries() {
+		let (storage, path) = get_storage().await;
+		storage
+			.set(Bytes::from("string"), Bytes::from("value"))
+			.await
+			.unwrap();
+		storage
+			.hset(Bytes::from("hash"), Bytes::from("field"), Bytes::from("v"))
+			.await
+			.unwrap();
+		storage
+			.rpush(
+				Bytes::from("list"),
+				vec![Bytes::from("a"), Bytes::from("b")],
+			)
+			.await
+			.unwrap();
+		storage
+			.lpush(Bytes::from("list"), vec![Bytes::from("first")])
+			.await
+			.unwrap();
+		storage
+			.sadd(Bytes::from("set"), vec![Bytes::from("member")])
+			.await
+			.unwrap();
+		storage
+			.zadd(Bytes::from("zset"), vec![(-1.5, Bytes::from("member"))])
+			.await
+			.unwrap();
+		storage
+			.setbit(Bytes::from("bits"), 4097 * 8 + 7, true)
+			.await
+			.unwrap();
+		let expire_at = chrono::Utc::now().timestamp_millis() as u64 + 100_000;
+		storage
+			.expire(Bytes::from("hash"), expire_at)
+			.await
+			.unwrap();
+
+		let (entries, skipped) = rdb_entries(storage.snapshot().await.unwrap()).unwrap();
+		assert_eq!(entries.len(), 6);
+		assert_eq!(skipped, 0);
+		assert_eq!(
+			value(&entries, "string"),
+			&RdbValue::String(Bytes::from("value"))
+		);
+		assert_eq!(
+			value(&entries, "hash"),
+			&RdbValue::Hash(vec![(Bytes::from("field"), Bytes::from("v"))])
+		);
+		assert_eq!(
+			value(&entries, "list"),
+			&RdbValue::List(vec![
+				Bytes::from("first"),
+				Bytes::from("a"),
+				Bytes::from("b")
+			])
+		);
+		assert_eq!(
+			value(&entries, "set"),
+			&RdbValue::Set(vec![Bytes::from("member")])
+		);
+		assert_eq!(
+			value(&entries, "zset"),
+			&RdbValue::ZSet(vec![(Bytes::from("member"), -1.5)])
+		);
+		let RdbValue::String(bits) = value(&entries, "bits") else {
+			panic!("bitmap exported as {:?}", value(&entries, "bits"));
+		};
+		assert_eq!(bits.len(), 4098);
+		assert_eq!(bits[4097], 1);
+		assert!(bits[..4097].iter().all(|&byte| byte == 0));
+		let hash = entries.iter().find(|entry| entry.key == "hash").unwrap();
+		assert!(hash.expire_ts.is_some());
+
+		let export = storage.export_rdb().await.unwrap();
+		assert_eq!(export.keys, 6);
+		assert!(export.path.ends_with("snapshot/dump.rdb"));
+		let file = std::fs::read(path.join("snapshot/dump.rdb")).unwrap();
+		assert!(file.starts_with(b"REDIS0011"));
+
+		storage.close().await.unwrap();
+		std::fs::remove_dir_all(path).unwrap();
+	}
+
+	#[tokio::test]
+	async fn test_import_rdb() {
+		let (storage, path) = get_storage().await;
+		storage
+			.rpush(Bytes::from("replaced"), vec![Bytes::from("old")])
+			.await
+			.unwrap();
+		storage
+			.set(Bytes::from("kept"), Bytes::from("value"))
+			.await
+			.unwrap();
+		let now = chrono::Utc::now().timestamp_millis();
+		let entry = |key: &str, value, expire_ts| RdbEntry {
+			key: Bytes::from(key.to_string()),
+			value,
+			expire_ts,
+		};
+		let data = rdb::encode(
+			&[
+				entry(
+					"replaced",
+					RdbValue::String(Bytes::from("new")),
+					Some(now + 100_000),
+				),
+				entry(
+					"list",
+					RdbValue::List(vec![Bytes::from("a"), Bytes::from("b")]),
+					None,
+				),
+				entry("set", RdbValue::Set(vec![Bytes::from("member")]), None),
+				entry(
+					"zset",
+					RdbValue::ZSet(vec![(Bytes::from("member"), 2.5)]),
+					None,
+				),
+				entry(
+					"hash",
+					RdbValue::Hash(vec![(Bytes::from("field"), Bytes::from("v"))]),
+					None,
+				),
+				entry(
+					"expired",
+					RdbValue::String(Bytes::from("gone")),
+					Some(now - 1000),
+				),
+			],
+			now / 1000,
+		);
+
+		let reported = std::sync::Mutex::new(Vec::new());
+		let import = storage
+			.import_rdb(&data, &|progress| reported.lock().unwrap().push(progress))
+			.await
+			.unwrap();
+		assert_eq!(
+			import,
+			RdbImport {
+				keys: 5,
+				skipped: 0
+			}
+		);
+		let reported = reported.into_inner().unwrap();
+		assert_eq!(reported.len(), 6);
+		assert_eq!(
+			reported.last(),
+			Some(&LoadProgress {
+				loaded: 6,
+				total: 6
+			})
+		);
+		assert_eq!(
+			storage.get(Bytes::from("replaced")).await.unwrap(),
+			Some(Bytes::from("new"))
+		);
+		assert!(storage.ttl(Bytes::from("replaced")).await.unwrap().unwrap() > 0);
+		assert_eq!(
+			storage.get(Bytes::from("kept")).await.unwrap(),
+			Some(Bytes::from("value"))
+		);
+		assert_eq!(
+			storage.lrange(Bytes::from("list"), 0, -1).await.unwrap(),
+			vec![Bytes::from("a"), Bytes::from("b")]
+		);
+		assert_eq!(
+			storage.smembers(Bytes::from("set")).await.unwrap(),
+			vec![Bytes::from("member")]
+		);
+		assert_eq!(
+			storage
+				.zscore(Bytes::from("zset"), Bytes::from("member"))
+				.await
+				.unwrap(),
+			Some(2.5)
+		);
+		assert_eq!(
+			storage
+				.hget(Bytes::from("hash"), Bytes::from("field"))
+				.await
+				.unwrap(),
+			Some(Bytes::from("v"))
+		);
+		assert!(!storage.exists(Bytes::from("expired")).await.unwrap());
+
+		assert!(matches!(
+			storage.import_rdb(b"REDIS0009\xff", &|_| {}).await,
+			Err(StorageError::InvalidRdb { .. })
+		));
+		assert!(matches!(
+			storage.import_stored_rdb().await,
+			Err(StorageError::InvalidArgument { .. })
+		));
+		storage.export_rdb().await.unwrap();
+		assert_eq!(storage.import_stored_rdb().await.unwrap().keys, 6);
+
+		storage.close().await.unwrap();
+		std::fs::remove_dir_all(path).unwrap();
+	}
+
+	#[tokio::test]
+	async fn test_dump_and_restore_entry() {
+		let (storage, path) = get_storage().await;
+		let key = Bytes::from("hash");
+		storage
+			.hset(key.clone(), Bytes::from("old"), Bytes::from("v"))
+			.await
+			.unwrap();
+		storage.del([key.clone()]).await.unwrap();
+		storage
+			.hset(key.clone(), Bytes::from("field"), Bytes::from("v"))
+			.await
+			.unwrap();
+		let expire_at = chrono::Utc::now().timestamp_millis() + 100_000;
+		storage.expire(key.clone(), expire_at as u64).await.unwrap();
+
+		// Only the current generation of the hash is dumped.
+		let entry = storage.dump_entry(key.clone()).await.unwrap().unwrap();
+		assert_eq!(
+			entry.value,
+			RdbValue::Hash(vec![(Bytes::from("field"), Bytes::from("v"))])
+		);
+		assert!(entry.expire_ts.is_some());
+		assert_eq!(
+			storage.dump_entry(Bytes::from("missing")).await.unwrap(),
+			None
+		);
+
+		let copy = RdbEntry {
+			key: Bytes::from("copy"),
+			..entry
+		};
+		storage.restore_entry(copy).await.unwrap();
+		assert_eq!(
+			storage.hgetall(Bytes::from("copy")).await.unwrap(),
+			vec![(Bytes::from("field"), Bytes::from("v"))]
+		);
+		assert!(storage.ttl(Bytes::from("copy")).await.unwrap().unwrap() > 0);
+
+		storage.close().await.unwrap();
+		std::fs::remove_dir_all(path).unwrap();
+	}
+
+	#[tokio::test]
+	async fn test_dump_and_restore_stream() {
+		use crate::storage_stream::StreamTrim;
+		use crate::storage_stream::TrimStrategy;
+		use crate::stream::id::StreamIdSpec;
+
+		let (storage, path) = get_storage().await;
+		let key = Bytes::from("stream");
+		for ms in 1..=3 {
+			storage
+				.xadd(
+					key.clone(),
+					StreamIdSpec::Explicit(StreamId::new(ms, 0)),
+					vec![(Bytes::from("f"), Bytes::from(ms.to_string()))],
+					false,
+					None,
+				)
+				.await
+				.unwrap();
+		}
+		storage
+			.xtrim(
+				key.clone(),
+				StreamTrim {
+					strategy: TrimStrategy::MinId(StreamId::new(2, 0)),
+					limit: None,
+				},
+			)
+			.await
+			.unwrap();
+		for group in ["g1", "g2"] {
+			storage
+				.xgroup_create(key.clone(), Bytes::from(group), Some(StreamId::MIN), false)
+				.await
+				.unwrap();
+		}
+		storage
+			.xreadgroup(
+				key.clone(),
+				Bytes::from("g1"),
+				Bytes::from("alice"),
+				None,
+				Some(1),
+				false,
+			)
+			.await
+			.unwrap();
+
+		// Trimmed entries are left out; groups keep their pending entries
+		// and consumers.
+		let entry = storage.dump_entry(key.clone()).await.unwrap().unwrap();
+		let RdbValue::Stream(stream) = &entry.value else {
+			panic!("not a stream: {:?}", entry.value);
+		};
+		assert_eq!(
+			stream.entries.iter().map(|(id, _)| *id).collect::<Vec<_>>(),
+			vec![StreamId::new(2, 0), StreamId::new(3, 0)]
+		);
+		assert_eq!(stream.last_id, StreamId::new(3, 0));
+		assert_eq!(stream.entries_added, 3);
+		let [g1, g2] = &stream.groups[..] else {
+			panic!("groups: {:?}", stream.groups);
+		};
+		assert_eq!(
+			(g1.name.clone(), g1.last_delivered_id),
+			(Bytes::from("g1"), StreamId::new(2, 0))
+		);
+		assert_eq!(g1.pending.len(), 1);
+		assert_eq!(
+			(g1.pending[0].id, g1.pending[0].consumer.clone()),
+			(StreamId::new(2, 0), Bytes::from("alice"))
+		);
+		assert_eq!(g1.consumers.len(), 1);
+		assert_eq!(g1.consumers[0].name, Bytes::from("alice"));
+		assert!(g2.pending.is_empty() && g2.consumers.is_empty());
+
+		// Restoring over an existing stream replaces all of it.
+		let copy = Bytes::from("copy");
+		storage
+			.xadd(
+				copy.clone(),
+				StreamIdSpec::Auto,
+				vec![(Bytes::from("old"), Bytes::from("v"))],
+				false,
+				None,
+			)
+			.await
+			.unwrap();
+		storage
+			.xgroup_create(copy.clone(), Bytes::from("old"), None, false)
+			.await
+			.unwrap();
+		storage
+			.restore_entry(RdbEntry {
+				key: copy.clone(),
+				..entry.clone()
+			})
+			.await
+			.unwrap();
+		let restored = storage.dump_entry(copy.clone()).await.unwrap().unwrap();
+		assert_eq!(restored.value, entry.value);
+		assert_eq!(
+			storage.xlast_id(copy.clone()).await.unwrap(),
+			Some(StreamId::new(3, 0))
+		);
+
+		// An empty stream with no entries survives too.
+		storage
+			.xgroup_create(Bytes::from("empty"), Bytes::from("g"), None, true)
+			.await
+			.unwrap();
+		let empty = storage
+			.dump_entry(Bytes::from("empty"))
+			.await
+			.unwrap()
+			.unwrap();
+		storage.del([Bytes::from("empty")]).await.unwrap();
+		storage.restore_entry(empty.clone()).await.unwrap();
+		assert_eq!(
+			storage.dump_entry(Bytes::from("empty")).await.unwrap(),
+			Some(empty)
+		);
+
+		storage.close().await.unwrap();
+		std::fs::remove_dir_all(path).unwrap();
+	}
+
+	#[tokio::test]
+	async fn test_transfer_entries() {
+		let (storage, path) = get_storage().await;
+		let kept = Bytes::from("kept");
+		let moved = Bytes::from("moved");
+		for key in [&kept, &moved] {
+			storage
+				.rpush(key.clone(), vec![Bytes::from("a")])
+				.await
+				.unwrap();
+		}
+
+		let keys = vec![kept.clone(), moved.clone(), Bytes::from("missing")];
+		let (write, deleted) = storage
+			.transfer_entries(keys, true, |entries| {
+				let storage = storage.clone();
+				let moved = moved.clone();
+				async move {
+					assert_eq!(entries.len(), 2);
+					// A write to a key on its way waits for the transfer.
+					let write = tokio::spawn({
+						let moved = moved.clone();
+						async move { storage.rpush(moved, vec![Bytes::from("b")]).await }
+					});
+					tokio::time::sleep(std::time::Duration::from_millis(50)).await;
+					assert!(!write.is_finished());
+					(write, vec![moved])
+				}
+			})
+			.await
+			.unwrap();
+		assert_eq!(deleted, vec![moved.clone()]);
+		write.await.unwrap().unwrap();
+		assert_eq!(
+			storage.lrange(moved, 0, -1).await.unwrap(),
+			vec![Bytes::from("b")]
+		);
+		assert!(storage.exists(kept.clone()).await.unwrap());
+
+		// Without delete, the keys are only read.
+		let (_, deleted) = storage
+			.transfer_entries(vec![kept.clone()], false, |entries| {
+				let kept = kept.clone();
+				async move {
+					assert_eq!(entries.len(), 1);
+					((), vec![kept])
+				}
+			})
+			.await
+			.unwrap();
+		assert!(deleted.is_empty());
+		assert!(storage.exists(kept).await.unwrap());
+
+		storage.close().await.unwrap();
+		std::fs::remove_dir_all(path).unwrap();
+	}
+}
@@ -4,6 +4,7 @@ use nimbis_macros::storage_lock;
 use slatedb::config::PutOptions;
 use slatedb::config::WriteOptions;
 
+use crate::data_type::DataType;
 use crate::error::StorageError;
 use crate::set::member_key::SetMemberKey;
 use crate::storage::Storage;
@@ -50,6 +51,8 @@ impl Storage {
 			};
 
 			if !exists {
+				self.record_undo(DataType::Set, [encoded_member_key.clone()])
+					.await?;
 				let wh = self
 					.set_db
 					.put_with_options(
@@ -77,8 +80,9 @@ impl Storage {
 
 			let put_opts = Storage::meta_put_opts(&meta_val);
 
-			self.string_db
-				.put_with_options(meta_encoded_key, meta_val.encode(), &put_opts, &write_opts)
+			self.record_undo(DataType::String, [meta_encoded_key.clone()])
+				.await?;
+			self.put_string_record(meta_encoded_key, meta_val.encode(), &put_opts, &write_opts)
 				.await?;
 		}
 
@@ -170,6 +174,8 @@ impl Storage {
 				.is_some_and(|kv| kv.seq >= meta_val.version);
 
 			if exists {
+				self.record_undo(DataType::Set, [encoded_key.clone()])
+					.await?;
 				self.set_db
 					.delete_with_options(encoded_key, &write_opts)
 					.await?;
@@ -178,15 +184,15 @@ impl Storage {
 		}
 
 		if removed_count > 0 {
+			self.record_undo(DataType::String, [meta_encoded_key.clone()])
+				.await?;
 			meta_val.len -= removed_count;
 			if meta_val.len == 0 {
-				self.string_db
-					.delete_with_options(meta_encoded_key, &write_opts)
+				self.delete_string_record(meta_encoded_key, &write_opts)
 					.await?;
 			} else {
 				let put_opts = Storage::meta_put_opts(&meta_val);
-				self.string_db
-					.put_with_options(meta_encoded_key, meta_val.encode(), &put_opts, &write_opts)
+				self.put_string_record(meta_encoded_key, meta_val.encode(), &put_opts, &write_opts)
 					.await?;
 			}
 		}
@@ -0,0 +1,591 @@
+use std::collections::HashMap;
+use std::path::Path;
+use std::path::PathBuf;
+use std::sync::Arc;
+
+use bytes::Bytes;
+use bytes::BytesMut;
+use nimbis_macros::storage_lock;
+use slatedb::DbSnapshot;
+use slatedb::config::PutOptions;
+use slatedb::config::WriteOptions;
+use tokio::io::AsyncWrite;
+use tokio::io::AsyncWriteExt;
+use tokio::sync::mpsc;
+
+use crate::compaction_filter::CollectionCompactionFilter;
+use crate::data_type::DataType;
+use crate::error::StorageError;
+use crate::snapshot;
+use crate::snapshot::Snapshot;
+use crate::snapshot::SnapshotEntry;
+use crate::storage::Storage;
+use crate::storage::ttl_until;
+use crate::string::meta::AnyValue;
+use crate::utils::is_expired;
+
+/// How far a dataset load has come, reported as it writes. The entries of
+/// an RDB file are its keys; those of a snapshot are its keys and their
+/// elements. Expired entries count as loaded when they are dropped, so
+/// `loaded` ends at `total`.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct LoadProgress {
+	/// Entries loaded so far.
+	pub loaded: usize,
+	/// Entries to load.
+	pub total: usize,
+}
+
+/// The outcome of `Storage::backup`.
+#[derive(Debug, Clone, PartialEq)]
+pub struct Backup {
+	/// The snapshot file written.
+	pub path: PathBuf,
+	/// When the copy was taken, in milliseconds since the epoch.
+	pub saved_at: i64,
+	pub keys: usize,
+}
+
+/// The DBs holding collection elements, each named by its data type.
+const ELEMENT_DBS: [DataType; 6] = [
+	DataType::Hash,
+	DataType::List,
+	DataType::Set,
+	DataType::ZSet,
+	DataType::Stream,
+	DataType::Bitmap,
+];
+
+/// A point-in-time view of every DB, from `Storage::snapshot_view`.
+pub struct SnapshotView {
+	saved_at: i64,
+	string_view: Arc<DbSnapshot>,
+	element_views: Vec<(DataType, Arc<DbSnapshot>)>,
+}
+
+impl Storage {
+	/// Copy the live dataset in memory. The global lock keeps every writer
+	/// out only while a point-in-time view of each DB is taken; the copy is
+	/// then read from those views while writes go on, so it is consistent
+	/// across keys, types and TTLs.
+	#[fastrace::trace]
+	pub async fn snapshot(&self) -> Result<Snapshot, StorageError> {
+		self.snapshot_view().await?.read().await
+	}
+
+	/// Take the point-in-time view `snapshot` copies the dataset from, for
+	/// callers that must know exactly which writes it holds.
+	#[fastrace::trace]
+	pub async fn snapshot_view(&self) -> Result<SnapshotView, StorageError> {
+		let _guard = self.global_write_lock().await;
+		let string_view = self.string_db.snapshot().await?;
+		let mut element_views = Vec::with_capacity(ELEMENT_DBS.len());
+		for data_type in ELEMENT_DBS {
+			element_views.push((data_type, self.db(data_type).snapshot().await?));
+		}
+		Ok(SnapshotView {
+			saved_at: chrono::Utc::now().timestamp_millis(),
+			string_view,
+			element_views,
+		})
+	}
+}
+
+/// The size of the encoding of a `SnapshotView`, from `SnapshotView::size`.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct SnapshotSize {
+	pub keys: usize,
+	entries: u64,
+	/// Bytes `SnapshotView::write_to` writes.
+	pub len: u64,
+}
+
+/// Entries a walk of a view runs ahead of its consumer.
+const WALK_BUFFER: usize = 1024;
+/// Bytes `SnapshotView::write_to` gathers before writing them out.
+const WRITE_CHUNK: usize = 64 * 1024;
+
+impl SnapshotView {
+	/// Copy the live dataset of the view in memory.
+	#[fastrace::trace]
+	pub async fn read(self) -> Result<Snapshot, StorageError> {
+		let (sender, mut receiver) = mpsc::channel(WALK_BUFFER);
+		let collect = async {
+			let mut entries = Vec::new();
+			while let Some(entry) = receiver.recv().await {
+				entries.push(entry);
+			}
+			entries
+		};
+		let (walked, entries) = futures::join!(self.walk(sender), collect);
+		walked?;
+		Ok(Snapshot {
+			saved_at: self.saved_at,
+			entries,
+		})
+	}
+
+	/// Measure the encoding `write_to` writes, by walking the view without
+	/// keeping what it holds.
+	#[fastrace::trace]
+	pub async fn size(&self) -> Result<SnapshotSize, StorageError> {
+		let (sender, mut receiver) = mpsc::channel(WALK_BUFFER);
+		let measure = async {
+			let mut size = SnapshotSize {
+				keys: 0,
+				entries: 0,
+				len: snapshot::HEADER_LEN,
+			};
+			while let Some(entry) = receiver.recv().await {
+				if entry.data_type == DataType::String {
+					size.keys += 1;
+				}
+				size.entries += 1;
+				size.len += snapshot::encoded_entry_len(&entry);
+			}
+			size
+		};
+		let (walked, size) = futures::join!(self.walk(sender), measure);
+		walked?;
+		Ok(size)
+	}
+
+	/// Write the live dataset of the view to `out` in the encoding of
+	/// `Snapshot::encode`, as it is read, so the dataset is never held whole.
+	/// `size` is what `size` measured: the encoding starts with the entry
+	/// count.
+	#[fastrace::trace]
+	pub async fn write_to<W>(&self, size: &SnapshotSize, out: &mut W) -> Result<(), StorageError>
+	where
+		W: AsyncWrite + Unpin + Send,
+	{
+		let (sender, mut receiver) = mpsc::channel(WALK_BUFFER);
+		let write = async {
+			let mut buf = BytesMut::with_capacity(WRITE_CHUNK);
+			snapshot::encode_header(&mut buf, self.saved_at, size.entries);
+			while let Some(entry) = receiver.recv().await {
+				snapshot::encode_entry(&mut buf, &entry);
+				if buf.len() >= WRITE_CHUNK {
+					out.write_all(&buf).await?;
+					buf.clear();
+				}
+			}
+			out.write_all(&buf).await?;
+			Ok::<(), StorageError>(())
+		};
+		let (walked, written) = futures::join!(self.walk(sender), write);
+		walked?;
+		written
+	}
+
+	/// Send every live entry of the view to `sender`, string DB first. Keys
+	/// count as expired as of when the view was taken, so every walk of a
+	/// view yields the same entries. Stops early if the receiver is dropped.
+	async fn walk(&self, sender: mpsc::Sender<SnapshotEntry>) -> Result<(), StorageError> {
+		let expired = |expire_ts: Option<i64>| expire_ts.is_some_and(|ts| ts <= self.saved_at);
+
+		// Versions of the live collections by user key, to leave out elements
+		// of deleted generations that compaction has not dropped yet.
+		let mut versions = HashMap::new();
+		let mut stream = self.string_view.scan::<Bytes, _>(..).await?;
+		while let Some(kv) = stream.next().await? {
+			if expired(kv.expire_ts) {
+				continue;
+			}
+			let value = AnyValue::decode(&kv.value)?;
+			if let Some(version) = value.version()
+				&& let Some(user_key) = CollectionCompactionFilter::decode_sub_key(&kv.key)
+			{
+				versions.insert(user_key, (value.data_type(), version));
+			}
+			let entry = SnapshotEntry {
+				data_type: DataType::String,
+				key: kv.key,
+				value: kv.value,
+				expire_ts: kv.expire_ts,
+			};
+			if sender.send(entry).await.is_err() {
+				return Ok(());
+			}
+		}
+
+		for (data_type, view) in &self.element_views {
+			let data_type = *data_type;
+			let mut stream = view.scan::<Bytes, _>(..).await?;
+			while let Some(kv) = stream.next().await? {
+				let live = CollectionCompactionFilter::decode_sub_key(&kv.key)
+					.and_then(|user_key| versions.get(&user_key))
+					.is_some_and(|&(owner, version)| owner == data_type && kv.seq >= version);
+				if !live {
+					continue;
+				}
+				let entry = SnapshotEntry {
+					data_type,
+					key: kv.key,
+					value: kv.value,
+					expire_ts: kv.expire_ts,
+				};
+				if sender.send(entry).await.is_err() {
+					return Ok(());
+				}
+			}
+		}
+		Ok(())
+	}
+}
+
+impl Storage {
+	/// Write a consistent copy of the dataset to the local directory `dir`,
+	/// laid out as a store holding nothing but its snapshot, so a new server
+	/// started on `dir`, or on a copy of it, loads the backup. `dir` must be
+	/// missing or empty, so a backup never lands on a live store.
+	#[fastrace::trace]
+	pub async fn backup(&self, dir: &Path) -> Result<Backup, StorageError> {
+		if let Ok(mut existing) = tokio::fs::read_dir(dir).await
+			&& existing.next_entry().await?.is_some()
+		{
+			return Err(StorageError::InvalidArgument {
+				message: format!("ERR backup directory {} is not empty", dir.display()),
+			});
+		}
+		let snapshot = self.snapshot().await?;
+		let path = snapshot::write_to_dir(dir, &snapshot).await?;
+		Ok(Backup {
+			path,
+			saved_at: snapshot.saved_at,
+			keys: snapshot.key_count(),
+		})
+	}
+
+	/// Durably replace the saved snapshot with `snapshot`.
+	#[fastrace::trace]
+	pub async fn save_snapshot(&self, snapshot: &Snapshot) -> Result<(), StorageError> {
+		self.snapshots.put(snapshot).await
+	}
+
+	/// Replace the whole dataset with the saved snapshot, returning when it
+	/// was taken, or `None` without touching the dataset if there is none.
+	/// Keys that expired since the snapshot was taken are not restored.
+	#[fastrace::trace]
+	pub async fn load_snapshot(&self) -> Result<Option<i64>, StorageError> {
+		let Some(snapshot) = self.snapshots.get().await? else {
+			return Ok(None);
+		};
+		let saved_at = snapshot.saved_at;
+		self.replace_dataset(snapshot, &|_| {}).await?;
+		Ok(Some(saved_at))
+	}
+
+	/// Replace the whole dataset with the backup that `backup` wrote to the
+	/// local directory `dir`, returning it. The backup is read and checked
+	/// before the dataset is touched. Keys that expired since the backup was
+	/// taken are not restored.
+	#[fastrace::trace]
+	pub async fn restore_backup(&self, dir: &Path) -> Result<Backup, StorageError> {
+		let (path, snapshot) = snapshot::read_from_dir(dir).await?;
+		let backup = Backup {
+			path,
+			saved_at: snapshot.saved_at,
+			keys: snapshot.key_count(),
+		};
+		self.replace_dataset(snapshot, &|_| {}).await?;
+		Ok(backup)
+	}
+
+	/// Clear every DB and write the live entries of `snapshot` back, calling
+	/// `progress` after each entry.
+	#[storage_lock(global_write)]
+	pub async fn replace_dataset(
+		&self,
+		snapshot: Snapshot,
+		progress: &(dyn Fn(LoadProgress) + Sync),
+	) -> Result<(), StorageError> {
+		self.clear_dbs().await?;
+
+		let write_opts = WriteOptions {
+			await_durable: false,
+		};
+		let total = snapshot.entries.len();
+		for (i, entry) in snapshot.entries.into_iter().enumerate() {
+			let loaded = LoadProgress {
+				loaded: i + 1,
+				total,
+			};
+			if is_expired(entry.expire_ts) {
+				progress(loaded);
+				continue;
+			}
+			let mut value = entry.value;
+			if entry.data_type == DataType::String {
+				// Restored elements get new sequence numbers, so the version
+				// must let every one of them count as current.
+				let mut meta = AnyValue::decode(&value)?;
+				if meta.version().is_some() {
+					meta.set_version(0);
+					value = meta.encode();
+				}
+			}
+			let ttl = ttl_until(entry.expire_ts);
+			self.db(entry.data_type)
+				.put_with_options(entry.key.clone(), value, &PutOptions { ttl }, &write_opts)
+				.await?;
+			if entry.data_type == DataType::String {
+				self.count_loaded(&entry.key, entry.expire_ts);
+			}
+			progress(loaded);
+		}
+		self.flush_dbs().await
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+
+	async fn get_storage() -> (Storage, std::path::PathBuf) {
+		let timestamp = ulid::Ulid::new().to_string();
+		let path = std::env::temp_dir().join(format!("nimbis_test_snapshot_{}", timestamp));
+		std::fs::create_dir_all(&path).unwrap();
+		let storage = Storage::open(&path, None).await.unwrap();
+		(storage, path)
+	}
+
+	#[tokio::test]
+	async fn test_snapshot_roundtrip() {
+		let (storage, path) = get_storage().await;
+		storage
+			.set(Bytes::from("string"), Bytes::from("value"))
+			.await
+			.unwrap();
+		storage
+			.hset(Bytes::from("hash"), Bytes::from("field"), Bytes::from("v"))
+			.await
+			.unwrap();
+		storage
+			.zadd(Bytes::from("zset"), vec![(1.0, Bytes::from("member"))])
+			.await
+			.unwrap();
+		let expire_at = chrono::Utc::now().timestamp_millis() as u64 + 100_000;
+		storage
+			.expire(Bytes::from("hash"), expire_at)
+			.await
+			.unwrap();
+		// An older generation of the set must not come back with the snapshot.
+		storage
+			.sadd(Bytes::from("set"), vec![Bytes::from("old")])
+			.await
+			.unwrap();
+		storage.del([Bytes::from("set")]).await.unwrap();
+		storage
+			.sadd(Bytes::from("set"), vec![Bytes::from("new")])
+			.await
+			.unwrap();
+
+		let snapshot = storage.snapshot().await.unwrap();
+		assert_eq!(snapshot.key_count(), 4);
+		storage.save_snapshot(&snapshot).await.unwrap();
+
+		storage
+			.set(Bytes::from("string"), Bytes::from("changed"))
+			.await
+			.unwrap();
+		storage
+			.set(Bytes::from("later"), Bytes::from("value"))
+			.await
+			.unwrap();
+
+		assert_eq!(
+			storage.load_snapshot().await.unwrap(),
+			Some(snapshot.saved_at)
+		);
+		assert_eq!(
+			storage.get(Bytes::from("string")).await.unwrap(),
+			Some(Bytes::from("value"))
+		);
+		assert_eq!(storage.get(Bytes::from("later")).await.unwrap(), None);
+		assert_eq!(
+			storage
+				.hget(Bytes::from("hash"), Bytes::from("field"))
+				.await
+				.unwrap(),
+			Some(Bytes::from("v"))
+		);
+		assert!(storage.ttl(Bytes::from("hash")).await.unwrap().unwrap() > 0);
+		assert_eq!(
+			storage
+				.zscore(Bytes::from("zset"), Bytes::from("member"))
+				.await
+				.unwrap(),
+			Some(1.0)
+		);
+		assert_eq!(
+			storage.smembers(Bytes::from("set")).await.unwrap(),
+			vec![Bytes::from("new")]
+		);
+
+		storage.close().await.unwrap();
+		std::fs::remove_dir_all(path).unwrap();
+	}
+
+	#[tokio::test]
+	async fn test_snapshot_view_write_to() {
+		let (storage, path) = get_storage().await;
+		storage
+			.set(Bytes::from("string"), Bytes::from("value"))
+			.await
+			.unwrap();
+		storage
+			.rpush(
+				Bytes::from("list"),
+				vec![Bytes::from("a"), Bytes::from("b")],
+			)
+			.await
+			.unwrap();
+
+		let view = storage.snapshot_view().await.unwrap();
+		let size = view.size().await.unwrap();
+		assert_eq!(size.keys, 2);
+		let mut written = Vec::new();
+		view.write_to(&size, &mut written).await.unwrap();
+		assert_eq!(written.len() as u64, size.len);
+		assert_eq!(
+			Snapshot::decode(&written).unwrap(),
+			view.read().await.unwrap()
+		);
+
+		storage.close().await.unwrap();
+		std::fs::remove_dir_all(path).unwrap();
+	}
+
+	#[tokio::test]
+	async fn test_snapshot_loaded_into_new_store() {
+		let (storage, path) = get_storage().await;
+		storage
+			.set(Bytes::from("key"), Bytes::from("value"))
+			.await
+			.unwrap();
+		let snapshot = storage.snapshot().await.unwrap();
+		storage.save_snapshot(&snapshot).await.unwrap();
+		storage.close().await.unwrap();
+
+		// Reopening keeps the store's own data rather than the snapshot.
+		let storage = Storage::open(&path, None).await.unwrap();
+		storage.del([Bytes::from("key")]).await.unwrap();
+		storage.close().await.unwrap();
+		let storage = Storage::open(&path, None).await.unwrap();
+		assert_eq!(storage.get(Bytes::from("key")).await.unwrap(), None);
+		storage.close().await.unwrap();
+
+		// A new store with the snapshot copied in starts from it.
+		let restored_path = path.with_extension("restored");
+		std::fs::create_dir_all(restored_path.join("snapshot")).unwrap();
+		std::fs::copy(
+			path.join("snapshot/dump.nsnap"),
+			restored_path.join("snapshot/dump.nsnap"),
+		)
+		.unwrap();
+		let restored = Storage::open(&restored_path, None).await.unwrap();
+		assert_eq!(
+			restored.get(Bytes::from("key")).await.unwrap(),
+			Some(Bytes::from("value"))
+		);
+		restored.close().await.unwrap();
+
+		std::fs::remove_dir_all(path).unwrap();
+		std::fs::remove_dir_all(restored_path).unwrap();
+	}
+
+	#[tokio::test]
+	async fn test_backup_restores_into_new_store() {
+		let (storage, path) = get_storage().await;
+		storage
+			.set(Bytes::from("key"), Bytes::from("value"))
+			.await
+			.unwrap();
+		storage
+			.sadd(Bytes::from("set"), vec![Bytes::from("member")])
+			.await
+			.unwrap();
+
+		let backup_path = path.with_extension("backup");
+		let backup = storage.backup(&backup_path).await.unwrap();
+		assert_eq!(backup.keys, 2);
+		assert_eq!(backup.path, backup_path.join("snapshot/dump.nsnap"));
+		assert!(matches!(
+			storage.backup(&backup_path).await,
+			Err(StorageError::InvalidArgument { .. })
+		));
+		storage.del([Bytes::from("key")]).await.unwrap();
+		storage.close().await.unwrap();
+
+		let restored = Storage::open(&backup_path, None).await.unwrap();
+		assert_eq!(
+			restored.get(Bytes::from("key")).await.unwrap(),
+			Some(Bytes::from("value"))
+		);
+		assert_eq!(
+			restored.smembers(Bytes::from("set")).await.unwrap(),
+			vec![Bytes::from("member")]
+		);
+		restored.close().await.unwrap();
+
+		std::fs::remove_dir_all(path).unwrap();
+		std::fs::remove_dir_all(backup_path).unwrap();
+	}
+
+	#[tokio::test]
+	async fn test_restore_backup() {
+		let (storage, path) = get_storage().await;
+		storage
+			.rpush(Bytes::from("list"), vec![Bytes::from("a")])
+			.await
+			.unwrap();
+		let backup_path = path.with_extension("backup");
+		storage.backup(&backup_path).await.unwrap();
+
+		storage
+			.rpush(Bytes::from("list"), vec![Bytes::from("b")])
+			.await
+			.unwrap();
+		storage
+			.set(Bytes::from("later"), Bytes::from("value"))
+			.await
+			.unwrap();
+		let backup = storage.restore_backup(&backup_path).await.unwrap();
+		assert_eq!(backup.keys, 1);
+		assert_eq!(
+			storage.lrange(Bytes::from("list"), 0, -1).await.unwrap(),
+			vec![Bytes::from("a")]
+		);
+		assert_eq!(storage.get(Bytes::from("later")).await.unwrap(), None);
+
+		// A missing backup leaves the dataset alone.
+		assert!(matches!(
+			storage
+				.restore_backup(&path.with_extension("missing"))
+				.await,
+			Err(StorageError::InvalidArgument { .. })
+		));
+		assert!(storage.exists(Bytes::from("list")).await.unwrap());
+
+		storage.close().await.unwrap();
+		std::fs::remove_dir_all(path).unwrap();
+		std::fs::remove_dir_all(backup_path).unwrap();
+	}
+
+	#[tokio::test]
+	async fn test_load_without_snapshot() {
+		let (storage, path) = get_storage().await;
+		storage
+			.set(Bytes::from("key"), Bytes::from("value"))
+			.await
+			.unwrap();
+		assert_eq!(storage.load_snapshot().await.unwrap(), None);
+		assert_eq!(
+			storage.get(Bytes::from("key")).await.unwrap(),
+			Some(Bytes::from("value"))
+		);
+		storage.close().await.unwrap();
+		std::fs::remove_dir_all(path).unwrap();
+	}
+}
@@ -0,0 +1,1059 @@
+use bytes::Bytes;
+use nimbis_macros::storage_lock;
+use slatedb::WriteBatch;
+use slatedb::config::PutOptions;
+use slatedb::config::WriteOptions;
+
+use crate::data_type::DataType;
+use crate::error::StorageError;
+use crate::rdb::RdbStream;
+use crate::storage::Storage;
+use crate::stream::consumer::StreamConsumerKey;
+use crate::stream::consumer::StreamConsumerValue;
+use crate::stream::entry_key::StreamEntryKey;
+use crate::stream::entry_value::StreamEntryValue;
+use crate::stream::group::StreamGroupKey;
+use crate::stream::group::StreamGroupValue;
+use crate::stream::id::StreamId;
+use crate::stream::id::StreamIdSpec;
+use crate::stream::pending::StreamPendingKey;
+use crate::stream::pending::StreamPendingValue;
+use crate::string::meta::MetaKey;
+use crate::string::meta::StreamMetaValue;
+
+/// Which entries a stream trim removes, oldest first.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum TrimStrategy {
+	/// Keep at most this many entries.
+	MaxLen(u64),
+	/// Remove the entries with smaller IDs.
+	MinId(StreamId),
+}
+
+/// A stream trim: its strategy, and for approximate trims the most entries
+/// removed at once.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct StreamTrim {
+	pub strategy: TrimStrategy,
+	/// Remove at most this many entries; `None` trims exactly.
+	pub limit: Option<usize>,
+}
+
+/// What XINFO STREAM reports about a stream.
+#[derive(Debug, Clone, PartialEq)]
+pub struct StreamInfo {
+	pub len: u64,
+	pub last_generated_id: StreamId,
+	pub max_deleted_id: StreamId,
+	pub entries_added: u64,
+	pub groups: u64,
+	pub first_entry: Option<(StreamId, StreamEntryValue)>,
+	pub last_entry: Option<(StreamId, StreamEntryValue)>,
+}
+
+impl Storage {
+	/// Append an entry to the stream at `key` and return its ID, then apply
+	/// `trim` if given.
+	///
+	/// Returns `None` without writing if the stream does not exist and
+	/// `nomkstream` is set.
+	#[storage_lock(write, key)]
+	#[fastrace::trace]
+	pub async fn xadd(
+		&self,
+		key: Bytes,
+		id: StreamIdSpec,
+		fields: Vec<(Bytes, Bytes)>,
+		nomkstream: bool,
+		trim: Option<StreamTrim>,
+	) -> Result<Option<StreamId>, StorageError> {
+		let meta_key = MetaKey::new(key.clone());
+		let meta_encoded_key = meta_key.encode();
+		let write_opts = WriteOptions {
+			await_durable: false,
+		};
+
+		let (mut meta_val, meta_missing) = match self.get_meta::<StreamMetaValue>(&key).await? {
+			Some(val) => (val, false),
+			None if nomkstream => return Ok(None),
+			None => (StreamMetaValue::new(0), true),
+		};
+
+		let now_ms = chrono::Utc::now().timestamp_millis().max(0) as u64;
+		let id = id.resolve(meta_val.last_id, now_ms)?;
+
+		let entry_key = StreamEntryKey::new(key.clone(), id).encode();
+		self.record_undo(DataType::Stream, [entry_key.clone()])
+			.await?;
+		self.record_undo(DataType::String, [meta_encoded_key.clone()])
+			.await?;
+		let wh = self
+			.stream_db
+			.put_with_options(
+				entry_key,
+				StreamEntryValue::new(fields).encode(),
+				&PutOptions::default(),
+				&write_opts,
+			)
+			.await?;
+
+		if meta_missing {
+			meta_val.version = wh.seqnum();
+		}
+		meta_val.len += 1;
+		meta_val.last_id = id;
+		meta_val.entries_added += 1;
+		if let Some(trim) = trim {
+			self.trim_stream(&key, &mut meta_val, trim).await?;
+		}
+
+		let put_opts = Storage::meta_put_opts(&meta_val);
+		self.put_string_record(meta_encoded_key, meta_val.encode(), &put_opts, &write_opts)
+			.await?;
+
+		Ok(Some(id))
+	}
+
+	/// Delete the entries `ids` from the stream at `key` and return how many
+	/// existed.
+	#[storage_lock(write, key)]
+	#[fastrace::trace]
+	pub async fn xdel(&self, key: Bytes, ids: Vec<StreamId>) -> Result<u64, StorageError> {
+		let Some(mut meta_val) = self.get_meta::<StreamMetaValue>(&key).await? else {
+			return Ok(0);
+		};
+
+		let mut ids = ids;
+		ids.sort_unstable();
+		ids.dedup();
+
+		let mut batch = WriteBatch::new();
+		let mut batch_keys = Vec::new();
+		for id in ids {
+			if id <= meta_val.trimmed_id {
+				continue;
+			}
+			let entry_key = StreamEntryKey::new(key.clone(), id).encode();
+			if let Some(kv) = self.stream_db.get_key_value(entry_key.clone()).await?
+				&& kv.seq >= meta_val.version
+			{
+				batch.delete(entry_key.clone());
+				batch_keys.push(entry_key);
+				meta_val.max_deleted_id = meta_val.max_deleted_id.max(id);
+			}
+		}
+
+		let deleted = batch_keys.len() as u64;
+		if deleted == 0 {
+			return Ok(0);
+		}
+		let write_opts = WriteOptions {
+			await_durable: false,
+		};
+		self.record_undo(DataType::Stream, batch_keys).await?;
+		self.stream_db
+			.write_with_options(batch, &write_opts)
+			.await?;
+
+		meta_val.len -= deleted;
+		let meta_encoded_key = MetaKey::new(key).encode();
+		self.record_undo(DataType::String, [meta_encoded_key.clone()])
+			.await?;
+		let put_opts = Storage::meta_put_opts(&meta_val);
+		self.put_string_record(meta_encoded_key, meta_val.encode(), &put_opts, &write_opts)
+			.await?;
+		Ok(deleted)
+	}
+
+	/// Trim the stream at `key` and return how many entries were removed.
+	#[storage_lock(write, key)]
+	#[fastrace::trace]
+	pub async fn xtrim(&self, key: Bytes, trim: StreamTrim) -> Result<u64, StorageError> {
+		let Some(mut meta_val) = self.get_meta::<StreamMetaValue>(&key).await? else {
+			return Ok(0);
+		};
+
+		let trimmed = self.trim_stream(&key, &mut meta_val, trim).await?;
+		if trimmed > 0 {
+			let meta_encoded_key = MetaKey::new(key).encode();
+			self.record_undo(DataType::String, [meta_encoded_key.clone()])
+				.await?;
+			let put_opts = Storage::meta_put_opts(&meta_val);
+			self.put_string_record(
+				meta_encoded_key,
+				meta_val.encode(),
+				&put_opts,
+				&WriteOptions {
+					await_durable: false,
+				},
+			)
+			.await?;
+		}
+		Ok(trimmed)
+	}
+
+	/// Set the last generated ID of the stream at `key`, and optionally its
+	/// entries added counter and greatest deleted ID. Returns false if the
+	/// stream does not exist.
+	#[storage_lock(write, key)]
+	#[fastrace::trace]
+	pub async fn xsetid(
+		&self,
+		key: Bytes,
+		last_id: StreamId,
+		entries_added: Option<u64>,
+		max_deleted_id: Option<StreamId>,
+	) -> Result<bool, StorageError> {
+		let Some(mut meta_val) = self.get_meta::<StreamMetaValue>(&key).await? else {
+			return Ok(false);
+		};
+
+		if let Some((top_id, _)) = self.last_stream_entry(&key, &meta_val).await?
+			&& last_id < top_id
+		{
+			return Err(StorageError::InvalidArgument {
+				message:
+					"ERR The ID specified in XSETID is smaller than the target stream top item"
+						.to_string(),
+			});
+		}
+		if entries_added.is_some_and(|added| added < meta_val.len) {
+			return Err(StorageError::InvalidArgument {
+				message: "ERR The entries_added specified in XSETID is smaller than the target stream length".to_string(),
+			});
+		}
+		if max_deleted_id.is_some_and(|max_deleted_id| last_id < max_deleted_id) {
+			return Err(StorageError::InvalidArgument {
+				message: "ERR The ID specified in XSETID is smaller than the provided max_deleted_entry_id".to_string(),
+			});
+		}
+
+		let write_opts = WriteOptions {
+			await_durable: false,
+		};
+		// New entries may now get IDs up to `trimmed_id`, which would hide
+		// them. Delete the trimmed entries compaction has not dropped yet, so
+		// `trimmed_id` can move back.
+		if last_id < meta_val.trimmed_id {
+			let start = StreamEntryKey::new(key.clone(), last_id).encode();
+			let end = StreamEntryKey::new(key.clone(), meta_val.trimmed_id).encode();
+			let mut stream = self.stream_db.scan(start..=end).await?;
+			let mut batch = WriteBatch::new();
+			let mut batch_keys = Vec::new();
+			while let Some(kv) = stream.next().await? {
+				batch.delete(kv.key.clone());
+				batch_keys.push(kv.key);
+			}
+			if !batch_keys.is_empty() {
+				self.record_undo(DataType::Stream, batch_keys).await?;
+				self.stream_db
+					.write_with_options(batch, &write_opts)
+					.await?;
+			}
+			meta_val.trimmed_id = last_id;
+		}
+
+		meta_val.last_id = last_id;
+		if let Some(entries_added) = entries_added {
+			meta_val.entries_added = entries_added;
+		}
+		if let Some(max_deleted_id) = max_deleted_id {
+			meta_val.max_deleted_id = max_deleted_id;
+		}
+		let meta_encoded_key = MetaKey::new(key).encode();
+		self.record_undo(DataType::String, [meta_encoded_key.clone()])
+			.await?;
+		let put_opts = Storage::meta_put_opts(&meta_val);
+		self.put_string_record(meta_encoded_key, meta_val.encode(), &put_opts, &write_opts)
+			.await?;
+		Ok(true)
+	}
+
+	/// Apply `trim` to `meta_val` and return how many entries it removes. The
+	/// caller writes the meta back.
+	///
+	/// Trimming only moves `trimmed_id` past the removed entries, which hides
+	/// them at once; compaction drops them later. Finding that ID still scans
+	/// the removed entries, which `limit` bounds.
+	async fn trim_stream(
+		&self,
+		key: &Bytes,
+		meta_val: &mut StreamMetaValue,
+		trim: StreamTrim,
+	) -> Result<u64, StorageError> {
+		let (end, count) = match trim.strategy {
+			TrimStrategy::MaxLen(max_len) => {
+				let excess = meta_val.len.saturating_sub(max_len);
+				(StreamId::MAX, usize::try_from(excess).unwrap_or(usize::MAX))
+			}
+			TrimStrategy::MinId(min_id) => match min_id.prev() {
+				Some(end) => (end, usize::MAX),
+				None => return Ok(0),
+			},
+		};
+		let count = trim.limit.map_or(count, |limit| count.min(limit));
+		if count == 0 {
+			return Ok(0);
+		}
+
+		let trimmed = self
+			.scan_stream_entries(key, meta_val, StreamId::MIN, end, Some(count))
+			.await?;
+		let Some((last_id, _)) = trimmed.last() else {
+			return Ok(0);
+		};
+		meta_val.trimmed_id = *last_id;
+		meta_val.len -= trimmed.len() as u64;
+		Ok(trimmed.len() as u64)
+	}
+
+	#[storage_lock(read, key)]
+	#[fastrace::trace]
+	pub async fn xlen(&self, key: Bytes) -> Result<u64, StorageError> {
+		if let Some(meta_val) = self.get_meta::<StreamMetaValue>(&key).await? {
+			Ok(meta_val.len)
+		} else {
+			Ok(0)
+		}
+	}
+
+	/// Return the ID of the newest entry ever added to the stream, or `None`
+	/// if the stream does not exist.
+	#[storage_lock(read, key)]
+	#[fastrace::trace]
+	pub async fn xlast_id(&self, key: Bytes) -> Result<Option<StreamId>, StorageError> {
+		Ok(self
+			.get_meta::<StreamMetaValue>(&key)
+			.await?
+			.map(|meta_val| meta_val.last_id))
+	}
+
+	/// Return the entries with IDs in `start..=end`, in ascending order, or in
+	/// descending order when `rev` is set. At most `count` entries are
+	/// returned.
+	///
+	/// Entry keys sort by ID, so the range is one sequential scan. SlateDB has
+	/// no reverse iterator, so a reverse read scans the whole range and keeps
+	/// its tail.
+	#[storage_lock(read, key)]
+	#[fastrace::trace]
+	pub async fn xrange(
+		&self,
+		key: Bytes,
+		start: StreamId,
+		end: StreamId,
+		count: Option<usize>,
+		rev: bool,
+	) -> Result<Vec<(StreamId, StreamEntryValue)>, StorageError> {
+		let Some(meta_val) = self.get_meta::<StreamMetaValue>(&key).await? else {
+			return Ok(Vec::new());
+		};
+		if start > end || count == Some(0) {
+			return Ok(Vec::new());
+		}
+
+		let scan_count = if rev { None } else { count };
+		let mut entries = self
+			.scan_stream_entries(&key, &meta_val, start, end, scan_count)
+			.await?;
+
+		if rev {
+			entries.reverse();
+			if let Some(count) = count {
+				entries.truncate(count);
+			}
+		}
+		Ok(entries)
+	}
+
+	/// Describe the stream at `key`, `None` if it does not exist.
+	#[storage_lock(read, key)]
+	#[fastrace::trace]
+	pub async fn xinfo_stream(&self, key: Bytes) -> Result<Option<StreamInfo>, StorageError> {
+		let Some(meta_val) = self.get_meta::<StreamMetaValue>(&key).await? else {
+			return Ok(None);
+		};
+
+		let groups = self.scan_groups(&key, &meta_val).await?.len() as u64;
+		let first_entry = self.first_stream_entry(&key, &meta_val).await?;
+		let last_entry = self.last_stream_entry(&key, &meta_val).await?;
+		Ok(Some(StreamInfo {
+			len: meta_val.len,
+			last_generated_id: meta_val.last_id,
+			max_deleted_id: meta_val.max_deleted_id,
+			entries_added: meta_val.entries_added,
+			groups,
+			first_entry,
+			last_entry,
+		}))
+	}
+
+	/// Create the stream at `key`, which must not exist, from a value read
+	/// by RESTORE or from an RDB file. Its entries, groups, consumers and
+	/// pending entries are written in one batch.
+	#[storage_lock(write, key)]
+	#[fastrace::trace]
+	pub async fn restore_stream(&self, key: Bytes, stream: RdbStream) -> Result<(), StorageError> {
+		let put_opts = PutOptions::default();
+		let mut batch = WriteBatch::new();
+		// No entry has ID 0-0. Deleting it gives the batch a sequence number
+		// to version the stream with even when there is nothing to put.
+		let mut batch_keys = vec![StreamEntryKey::new(key.clone(), StreamId::MIN).encode()];
+		batch.delete(batch_keys[0].clone());
+
+		let len = stream.entries.len() as u64;
+		for (id, fields) in stream.entries {
+			let entry_key = StreamEntryKey::new(key.clone(), id).encode();
+			batch.put_with_options(
+				entry_key.clone(),
+				StreamEntryValue::new(fields).encode(),
+				&put_opts,
+			);
+			batch_keys.push(entry_key);
+		}
+		for group in stream.groups {
+			let group_key = StreamGroupKey::new(key.clone(), group.name.clone()).encode();
+			let group_val = StreamGroupValue {
+				last_delivered_id: group.last_delivered_id,
+				entries_read: group.entries_read,
+			};
+			batch.put_with_options(group_key.clone(), group_val.encode(), &put_opts);
+			batch_keys.push(group_key);
+			for consumer in group.consumers {
+				let consumer_key =
+					StreamConsumerKey::new(key.clone(), group.name.clone(), consumer.name).encode();
+				let consumer_val = StreamConsumerValue {
+					seen_time: consumer.seen_time,
+					active_time: consumer.active_time,
+				};
+				batch.put_with_options(consumer_key.clone(), consumer_val.encode(), &put_opts);
+				batch_keys.push(consumer_key);
+			}
+			for pending in group.pending {
+				let pending_key =
+					StreamPendingKey::new(key.clone(), group.name.clone(), pending.id).encode();
+				let pending_val = StreamPendingValue {
+					consumer: pending.consumer,
+					delivery_time: pending.delivery_time,
+					delivery_count: pending.delivery_count,
+				};
+				batch.put_with_options(pending_key.clone(), pending_val.encode(), &put_opts);
+				batch_keys.push(pending_key);
+			}
+		}
+
+		let write_opts = WriteOptions {
+			await_durable: false,
+		};
+		let meta_encoded_key = MetaKey::new(key).encode();
+		self.record_undo(DataType::Stream, batch_keys).await?;
+		self.record_undo(DataType::String, [meta_encoded_key.clone()])
+			.await?;
+		let wh = self
+			.stream_db
+			.write_with_options(batch, &write_opts)
+			.await?;
+
+		let meta_val = StreamMetaValue {
+			len,
+			last_id: stream.last_id,
+			entries_added: stream.entries_added,
+			max_deleted_id: stream.max_deleted_id,
+			..StreamMetaValue::new(wh.seqnum())
+		};
+		let put_opts = Storage::meta_put_opts(&meta_val);
+		self.put_string_record(meta_encoded_key, meta_val.encode(), &put_opts, &write_opts)
+			.await?;
+		Ok(())
+	}
+
+	/// Read the oldest visible entry of the stream at `key`. The caller must
+	/// hold the key lock.
+	pub(crate) async fn first_stream_entry(
+		&self,
+		key: &Bytes,
+		meta_val: &StreamMetaValue,
+	) -> Result<Option<(StreamId, StreamEntryValue)>, StorageError> {
+		let mut entries = self
+			.scan_stream_entries(key, meta_val, StreamId::MIN, StreamId::MAX, Some(1))
+			.await?;
+		Ok(entries.pop())
+	}
+
+	/// Read the newest visible entry of the stream at `key`. It is looked up
+	/// directly unless it was deleted, which scans the whole stream. The
+	/// caller must hold the key lock.
+	async fn last_stream_entry(
+		&self,
+		key: &Bytes,
+		meta_val: &StreamMetaValue,
+	) -> Result<Option<(StreamId, StreamEntryValue)>, StorageError> {
+		if meta_val.len == 0 {
+			return Ok(None);
+		}
+		if let Some(entry) = self
+			.get_stream_entry(key, meta_val, meta_val.last_id)
+			.await?
+		{
+			return Ok(Some((meta_val.last_id, entry)));
+		}
+		let mut entries = self
+			.scan_stream_entries(key, meta_val, StreamId::MIN, StreamId::MAX, None)
+			.await?;
+		Ok(entries.pop())
+	}
+
+	/// Scan the visible entries of the stream at `key` with IDs in
+	/// `start..=end`, in ascending order, stopping after `count` entries.
+	/// Trimmed entries are skipped. The caller must hold the key lock.
+	pub(crate) async fn scan_stream_entries(
+		&self,
+		key: &Bytes,
+		meta_val: &StreamMetaValue,
+		start: StreamId,
+		end: StreamId,
+		count: Option<usize>,
+	) -> Result<Vec<(StreamId, StreamEntryValue)>, StorageError> {
+		let Some(first) = meta_val.trimmed_id.next() else {
+			return Ok(Vec::new());
+		};
+		let start = start.max(first);
+		if start > end || count == Some(0) {
+			return Ok(Vec::new());
+		}
+		let start_key = StreamEntryKey::new(key.clone(), start).encode();
+		let end_key = StreamEntryKey::new(key.clone(), end).encode();
+		let mut stream = self.stream_db.scan(start_key..=end_key).await?;
+
+		let mut entries = Vec::new();
+		while let Some(kv) = stream.next().await? {
+			if kv.seq < meta_val.version {
+				continue;
+			}
+			let id = StreamEntryKey::decode_id(&kv.key).ok_or_else(|| {
+				StorageError::DataInconsistency {
+					message: "invalid stream entry key".to_string(),
+				}
+			})?;
+			entries.push((id, StreamEntryValue::decode(&kv.value)?));
+			if count.is_some_and(|count| entries.len() >= count) {
+				break;
+			}
+		}
+		Ok(entries)
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use rstest::rstest;
+
+	use super::*;
+
+	async fn get_storage() -> (Storage, std::path::PathBuf) {
+		let timestamp = ulid::Ulid::new().to_string();
+		let path = std::env::temp_dir().join(format!("nimbis_test_stream_{}", timestamp));
+		std::fs::create_dir_all(&path).unwrap();
+		let storage = Storage::open(&path, None).await.unwrap();
+		(storage, path)
+	}
+
+	fn fields(field: &'static str, value: &'static str) -> Vec<(Bytes, Bytes)> {
+		vec![(Bytes::from(field), Bytes::from(value))]
+	}
+
+	#[tokio::test]
+	async fn test_xadd_xlen() {
+		let (storage, path) = get_storage().await;
+		let key = Bytes::from("mystream");
+
+		let first = storage
+			.xadd(
+				key.clone(),
+				StreamIdSpec::Auto,
+				fields("a", "1"),
+				false,
+				None,
+			)
+			.await
+			.unwrap()
+			.unwrap();
+		let second = storage
+			.xadd(
+				key.clone(),
+				StreamIdSpec::Auto,
+				fields("b", "2"),
+				false,
+				None,
+			)
+			.await
+			.unwrap()
+			.unwrap();
+		assert!(second > first);
+		assert_eq!(storage.xlen(key.clone()).await.unwrap(), 2);
+		assert_eq!(storage.xlast_id(key.clone()).await.unwrap(), Some(second));
+		assert_eq!(
+			storage.xlast_id(Bytes::from("missing")).await.unwrap(),
+			None
+		);
+
+		let _ = std::fs::remove_dir_all(path);
+	}
+
+	#[tokio::test]
+	async fn test_xadd_explicit_ids() {
+		let (storage, path) = get_storage().await;
+		let key = Bytes::from("mystream");
+
+		let id = storage
+			.xadd(
+				key.clone(),
+				StreamIdSpec::Explicit(StreamId::new(5, 1)),
+				fields("a", "1"),
+				false,
+				None,
+			)
+			.await
+			.unwrap();
+		assert_eq!(id, Some(StreamId::new(5, 1)));
+
+		let id = storage
+			.xadd(
+				key.clone(),
+				StreamIdSpec::AutoSeq(5),
+				fields("b", "2"),
+				false,
+				None,
+			)
+			.await
+			.unwrap();
+		assert_eq!(id, Some(StreamId::new(5, 2)));
+
+		let err = storage
+			.xadd(
+				key.clone(),
+				StreamIdSpec::Explicit(StreamId::new(5, 2)),
+				fields("c", "3"),
+				false,
+				None,
+			)
+			.await
+			.unwrap_err();
+		assert!(matches!(err, StorageError::InvalidArgument { .. }));
+		assert_eq!(storage.xlen(key).await.unwrap(), 2);
+
+		let _ = std::fs::remove_dir_all(path);
+	}
+
+	#[tokio::test]
+	async fn test_xadd_nomkstream() {
+		let (storage, path) = get_storage().await;
+		let key = Bytes::from("mystream");
+
+		let id = storage
+			.xadd(
+				key.clone(),
+				StreamIdSpec::Auto,
+				fields("a", "1"),
+				true,
+				None,
+			)
+			.await
+			.unwrap();
+		assert_eq!(id, None);
+		assert_eq!(storage.xlen(key.clone()).await.unwrap(), 0);
+
+		storage
+			.xadd(
+				key.clone(),
+				StreamIdSpec::Auto,
+				fields("a", "1"),
+				false,
+				None,
+			)
+			.await
+			.unwrap();
+		let id = storage
+			.xadd(
+				key.clone(),
+				StreamIdSpec::Auto,
+				fields("b", "2"),
+				true,
+				None,
+			)
+			.await
+			.unwrap();
+		assert!(id.is_some());
+		assert_eq!(storage.xlen(key).await.unwrap(), 2);
+
+		let _ = std::fs::remove_dir_all(path);
+	}
+
+	#[tokio::test]
+	async fn test_xrange() {
+		let (storage, path) = get_storage().await;
+		let key = Bytes::from("mystream");
+
+		for seq in 1..=4 {
+			storage
+				.xadd(
+					key.clone(),
+					StreamIdSpec::Explicit(StreamId::new(1, seq)),
+					fields("n", "v"),
+					false,
+					None,
+				)
+				.await
+				.unwrap();
+		}
+
+		let ids = |entries: Vec<(StreamId, StreamEntryValue)>| {
+			entries
+				.into_iter()
+				.map(|(id, _)| id.seq)
+				.collect::<Vec<_>>()
+		};
+
+		let all = storage
+			.xrange(key.clone(), StreamId::MIN, StreamId::MAX, None, false)
+			.await
+			.unwrap();
+		assert_eq!(all[0].1, StreamEntryValue::new(fields("n", "v")));
+		assert_eq!(ids(all), vec![1, 2, 3, 4]);
+
+		let bounded = storage
+			.xrange(
+				key.clone(),
+				StreamId::new(1, 2),
+				StreamId::new(1, 3),
+				None,
+				false,
+			)
+			.await
+			.unwrap();
+		assert_eq!(ids(bounded), vec![2, 3]);
+
+		let limited = storage
+			.xrange(key.clone(), StreamId::MIN, StreamId::MAX, Some(2), false)
+			.await
+			.unwrap();
+		assert_eq!(ids(limited), vec![1, 2]);
+
+		let reversed = storage
+			.xrange(key.clone(), StreamId::MIN, StreamId::MAX, Some(3), true)
+			.await
+			.unwrap();
+		assert_eq!(ids(reversed), vec![4, 3, 2]);
+
+		let _ = std::fs::remove_dir_all(path);
+	}
+
+	#[tokio::test]
+	async fn test_stream_recreate_hides_old_entries() {
+		let (storage, path) = get_storage().await;
+		let key = Bytes::from("mystream");
+
+		storage
+			.xadd(
+				key.clone(),
+				StreamIdSpec::Explicit(StreamId::new(1, 1)),
+				fields("old", "1"),
+				false,
+				None,
+			)
+			.await
+			.unwrap();
+		storage.del([key.clone()]).await.unwrap();
+		storage
+			.xadd(
+				key.clone(),
+				StreamIdSpec::Explicit(StreamId::new(2, 1)),
+				fields("new", "1"),
+				false,
+				None,
+			)
+			.await
+			.unwrap();
+
+		let entries = storage
+			.xrange(key.clone(), StreamId::MIN, StreamId::MAX, None, false)
+			.await
+			.unwrap();
+		assert_eq!(entries.len(), 1);
+		assert_eq!(entries[0].0, StreamId::new(2, 1));
+		assert_eq!(storage.xlen(key).await.unwrap(), 1);
+
+		let _ = std::fs::remove_dir_all(path);
+	}
+
+	async fn add_entries(storage: &Storage, key: &Bytes, seqs: std::ops::RangeInclusive<u64>) {
+		for seq in seqs {
+			storage
+				.xadd(
+					key.clone(),
+					StreamIdSpec::Explicit(StreamId::new(1, seq)),
+					fields("n", "v"),
+					false,
+					None,
+				)
+				.await
+				.unwrap();
+		}
+	}
+
+	async fn entry_seqs(storage: &Storage, key: &Bytes) -> Vec<u64> {
+		storage
+			.xrange(key.clone(), StreamId::MIN, StreamId::MAX, None, false)
+			.await
+			.unwrap()
+			.into_iter()
+			.map(|(id, _)| id.seq)
+			.collect()
+	}
+
+	#[tokio::test]
+	async fn test_xdel() {
+		let (storage, path) = get_storage().await;
+		let key = Bytes::from("mystream");
+		add_entries(&storage, &key, 1..=3).await;
+
+		let deleted = storage
+			.xdel(
+				key.clone(),
+				vec![
+					StreamId::new(1, 2),
+					StreamId::new(1, 2),
+					StreamId::new(9, 9),
+				],
+			)
+			.await
+			.unwrap();
+		assert_eq!(deleted, 1);
+		assert_eq!(entry_seqs(&storage, &key).await, vec![1, 3]);
+		assert_eq!(storage.xlen(key.clone()).await.unwrap(), 2);
+
+		let deleted = storage
+			.xdel(Bytes::from("missing"), vec![StreamId::new(1, 1)])
+			.await
+			.unwrap();
+		assert_eq!(deleted, 0);
+
+		let _ = std::fs::remove_dir_all(path);
+	}
+
+	#[rstest]
+	#[case(TrimStrategy::MaxLen(2), None, 3, vec![4, 5])]
+	#[case(TrimStrategy::MaxLen(2), Some(1), 1, vec![2, 3, 4, 5])]
+	#[case(TrimStrategy::MaxLen(9), None, 0, vec![1, 2, 3, 4, 5])]
+	#[case(TrimStrategy::MinId(StreamId::new(1, 3)), None, 2, vec![3, 4, 5])]
+	#[case(TrimStrategy::MinId(StreamId::new(1, 3)), Some(1), 1, vec![2, 3, 4, 5])]
+	#[case(TrimStrategy::MinId(StreamId::MIN), None, 0, vec![1, 2, 3, 4, 5])]
+	#[tokio::test]
+	async fn test_xtrim(
+		#[case] strategy: TrimStrategy,
+		#[case] limit: Option<usize>,
+		#[case] trimmed: u64,
+		#[case] remaining: Vec<u64>,
+	) {
+		let (storage, path) = get_storage().await;
+		let key = Bytes::from("mystream");
+		add_entries(&storage, &key, 1..=5).await;
+
+		let n = storage
+			.xtrim(key.clone(), StreamTrim { strategy, limit })
+			.await
+			.unwrap();
+		assert_eq!(n, trimmed);
+		assert_eq!(entry_seqs(&storage, &key).await, remaining);
+		assert_eq!(
+			storage.xlen(key.clone()).await.unwrap(),
+			remaining.len() as u64
+		);
+
+		let _ = std::fs::remove_dir_all(path);
+	}
+
+	#[tokio::test]
+	async fn test_xadd_trim() {
+		let (storage, path) = get_storage().await;
+		let key = Bytes::from("mystream");
+		add_entries(&storage, &key, 1..=3).await;
+
+		storage
+			.xadd(
+				key.clone(),
+				StreamIdSpec::Explicit(StreamId::new(1, 4)),
+				fields("n", "v"),
+				false,
+				Some(StreamTrim {
+					strategy: TrimStrategy::MaxLen(2),
+					limit: None,
+				}),
+			)
+			.await
+			.unwrap();
+		assert_eq!(entry_seqs(&storage, &key).await, vec![3, 4]);
+		assert_eq!(storage.xlen(key.clone()).await.unwrap(), 2);
+
+		// Trimmed IDs stay hidden from deletes.
+		let deleted = storage
+			.xdel(key.clone(), vec![StreamId::new(1, 1), StreamId::new(1, 3)])
+			.await
+			.unwrap();
+		assert_eq!(deleted, 1);
+		assert_eq!(storage.xlen(key).await.unwrap(), 1);
+
+		let _ = std::fs::remove_dir_all(path);
+	}
+
+	#[tokio::test]
+	async fn test_xinfo_stream() {
+		let (storage, path) = get_storage().await;
+		let key = Bytes::from("mystream");
+		add_entries(&storage, &key, 1..=4).await;
+		storage
+			.xgroup_create(key.clone(), Bytes::from("g1"), None, false)
+			.await
+			.unwrap();
+		storage
+			.xdel(key.clone(), vec![StreamId::new(1, 4)])
+			.await
+			.unwrap();
+		storage
+			.xtrim(
+				key.clone(),
+				StreamTrim {
+					strategy: TrimStrategy::MaxLen(2),
+					limit: None,
+				},
+			)
+			.await
+			.unwrap();
+
+		let info = storage.xinfo_stream(key.clone()).await.unwrap().unwrap();
+		assert_eq!(info.len, 2);
+		assert_eq!(info.last_generated_id, StreamId::new(1, 4));
+		assert_eq!(info.max_deleted_id, StreamId::new(1, 4));
+		assert_eq!(info.entries_added, 4);
+		assert_eq!(info.groups, 1);
+		assert_eq!(
+			info.first_entry.map(|(id, _)| id),
+			Some(StreamId::new(1, 2))
+		);
+		assert_eq!(info.last_entry.map(|(id, _)| id), Some(StreamId::new(1, 3)));
+
+		assert!(
+			storage
+				.xinfo_stream(Bytes::from("missing"))
+				.await
+				.unwrap()
+				.is_none()
+		);
+
+		let _ = std::fs::remove_dir_all(path);
+	}
+
+	#[tokio::test]
+	async fn test_xsetid() {
+		let (storage, path) = get_storage().await;
+		let key = Bytes::from("mystream");
+		add_entries(&storage, &key, 1..=3).await;
+
+		for (last_id, entries_added, max_deleted_id) in [
+			(StreamId::new(1, 2), None, None),
+			(StreamId::new(9, 9), Some(2), None),
+			(StreamId::new(9, 9), None, Some(StreamId::new(10, 0))),
+		] {
+			let err = storage
+				.xsetid(key.clone(), last_id, entries_added, max_deleted_id)
+				.await
+				.unwrap_err();
+			assert!(matches!(err, StorageError::InvalidArgument { .. }));
+		}
+
+		assert!(
+			storage
+				.xsetid(
+					key.clone(),
+					StreamId::new(9, 9),
+					Some(10),
+					Some(StreamId::new(1, 1))
+				)
+				.await
+				.unwrap()
+		);
+		let info = storage.xinfo_stream(key.clone()).await.unwrap().unwrap();
+		assert_eq!(info.last_generated_id, StreamId::new(9, 9));
+		assert_eq!(info.entries_added, 10);
+		assert_eq!(info.max_deleted_id, StreamId::new(1, 1));
+		let err = storage
+			.xadd(
+				key.clone(),
+				StreamIdSpec::Explicit(StreamId::new(9, 9)),
+				fields("n", "v"),
+				false,
+				None,
+			)
+			.await
+			.unwrap_err();
+		assert!(matches!(err, StorageError::InvalidArgument { .. }));
+
+		assert!(
+			!storage
+				.xsetid(Bytes::from("missing"), StreamId::new(1, 1), None, None)
+				.await
+				.unwrap()
+		);
+
+		let _ = std::fs::remove_dir_all(path);
+	}
+
+	#[tokio::test]
+	async fn test_xsetid_below_trimmed_entries() {
+		let (storage, path) = get_storage().await;
+		let key = Bytes::from("mystream");
+		add_entries(&storage, &key, 1..=3).await;
+		storage
+			.xtrim(
+				key.clone(),
+				StreamTrim {
+					strategy: TrimStrategy::MaxLen(0),
+					limit: None,
+				},
+			)
+			.await
+			.unwrap();
+
+		// Entries added below the old trim point must be visible.
+		storage
+			.xsetid(key.clone(), StreamId::new(1, 1), None, None)
+			.await
+			.unwrap();
+		add_entries(&storage, &key, 2..=2).await;
+		assert_eq!(entry_seqs(&storage, &key).await, vec![2]);
+		assert_eq!(storage.xlen(key).await.unwrap(), 1);
+
+		let _ = std::fs::remove_dir_all(path);
+	}
+
+	#[tokio::test]
+	async fn test_stream_wrong_type() {
+		let (storage, path) = get_storage().await;
+		let key = Bytes::from("mystring");
+
+		storage.set(key.clone(), Bytes::from("v")).await.unwrap();
+		let err = storage
+			.xadd(
+				key.clone(),
+				StreamIdSpec::Auto,
+				fields("a", "1"),
+				false,
+				None,
+			)
+			.await
+			.unwrap_err();
+		assert!(matches!(err, StorageError::WrongType { .. }));
+
+		let _ = std::fs::remove_dir_all(path);
+	}
+}
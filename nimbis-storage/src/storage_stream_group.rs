@@ -0,0 +1,1599 @@
+use std::cmp::Ordering;
+use std::collections::HashMap;
+
+use bytes::Bytes;
+use nimbis_macros::storage_lock;
+use slatedb::WriteBatch;
+use slatedb::config::PutOptions;
+use slatedb::config::WriteOptions;
+
+use crate::data_type::DataType;
+use crate::error::StorageError;
+use crate::storage::Storage;
+use crate::stream::consumer::StreamConsumerKey;
+use crate::stream::consumer::StreamConsumerValue;
+use crate::stream::entry_key::StreamEntryKey;
+use crate::stream::entry_value::StreamEntryValue;
+use crate::stream::group::StreamGroupKey;
+use crate::stream::group::StreamGroupValue;
+use crate::stream::id::StreamId;
+use crate::stream::pending::StreamPendingKey;
+use crate::stream::pending::StreamPendingValue;
+use crate::string::meta::MetaKey;
+use crate::string::meta::StreamMetaValue;
+use crate::utils::stream_consumer_group_prefix;
+use crate::utils::stream_group_user_key_prefix;
+use crate::utils::stream_pending_group_prefix;
+
+/// An entry read by XREADGROUP. The entry is `None` when a pending ID was
+/// deleted from the stream after its delivery.
+pub type StreamGroupEntry = (StreamId, Option<StreamEntryValue>);
+
+/// Selects entries of a pending entries list.
+#[derive(Debug, Clone)]
+pub struct PendingFilter {
+	/// Smallest ID returned.
+	pub start: StreamId,
+	/// Greatest ID returned.
+	pub end: StreamId,
+	/// Only return entries delivered at least this many milliseconds ago.
+	pub min_idle: u64,
+	/// Only return entries owned by this consumer.
+	pub consumer: Option<Bytes>,
+	/// Stop after this many entries.
+	pub count: Option<usize>,
+}
+
+impl Default for PendingFilter {
+	fn default() -> Self {
+		Self {
+			start: StreamId::MIN,
+			end: StreamId::MAX,
+			min_idle: 0,
+			consumer: None,
+			count: None,
+		}
+	}
+}
+
+/// Options of XCLAIM.
+#[derive(Debug, Clone, Default)]
+pub struct ClaimOptions {
+	/// New delivery time in milliseconds since the epoch, now by default.
+	pub delivery_time: Option<u64>,
+	/// New delivery count, otherwise it is incremented unless `justid`.
+	pub retry_count: Option<u64>,
+	/// Add IDs missing from the pending entries list, if still in the stream.
+	pub force: bool,
+	/// Return IDs only, and leave delivery counts alone.
+	pub justid: bool,
+	/// Raise the group's last delivered ID to this.
+	pub last_id: Option<StreamId>,
+}
+
+/// The outcome of XAUTOCLAIM.
+#[derive(Debug, Clone, PartialEq)]
+pub struct AutoClaim {
+	/// Where the next call continues the scan, `0-0` once it is complete.
+	pub next: StreamId,
+	/// The claimed entries, without values under JUSTID.
+	pub claimed: Vec<StreamGroupEntry>,
+	/// Pending IDs found deleted from the stream and dropped from the list.
+	pub deleted: Vec<StreamId>,
+}
+
+/// What XINFO GROUPS reports about a consumer group.
+#[derive(Debug, Clone, PartialEq)]
+pub struct StreamGroupInfo {
+	pub name: Bytes,
+	pub consumers: u64,
+	pub pending: u64,
+	pub last_delivered_id: StreamId,
+	/// Entries read by the group, `None` when unknown.
+	pub entries_read: Option<u64>,
+	/// Entries not yet delivered to the group, `None` when deletions make it
+	/// unknown.
+	pub lag: Option<u64>,
+}
+
+/// What XINFO CONSUMERS reports about a consumer. Times are milliseconds
+/// since the epoch.
+#[derive(Debug, Clone, PartialEq)]
+pub struct StreamConsumerInfo {
+	pub name: Bytes,
+	pub pending: u64,
+	pub seen_time: u64,
+	/// Last time the consumer was delivered an entry, 0 if never.
+	pub active_time: u64,
+}
+
+impl Storage {
+	/// Create consumer group `group` on the stream at `key`, delivering the
+	/// entries after `id`, or only entries added from now on when `id` is
+	/// `None`. A missing stream is created empty when `mkstream` is set.
+	#[storage_lock(write, key)]
+	#[fastrace::trace]
+	pub async fn xgroup_create(
+		&self,
+		key: Bytes,
+		group: Bytes,
+		id: Option<StreamId>,
+		mkstream: bool,
+	) -> Result<(), StorageError> {
+		let (mut meta_val, meta_missing) = match self.get_meta::<StreamMetaValue>(&key).await? {
+			Some(val) => (val, false),
+			None if mkstream => (StreamMetaValue::new(0), true),
+			None => return Err(missing_key()),
+		};
+		if !meta_missing && self.get_group(&key, &meta_val, &group).await?.is_some() {
+			return Err(StorageError::InvalidArgument {
+				message: "BUSYGROUP Consumer Group name already exists".to_string(),
+			});
+		}
+
+		let write_opts = WriteOptions {
+			await_durable: false,
+		};
+		let group_key = StreamGroupKey::new(key.clone(), group).encode();
+		let group_val = StreamGroupValue::new(id.unwrap_or(meta_val.last_id));
+		self.record_undo(DataType::Stream, [group_key.clone()])
+			.await?;
+		let wh = self
+			.stream_db
+			.put_with_options(
+				group_key,
+				group_val.encode(),
+				&PutOptions::default(),
+				&write_opts,
+			)
+			.await?;
+
+		if meta_missing {
+			meta_val.version = wh.seqnum();
+			let meta_encoded_key = MetaKey::new(key).encode();
+			self.record_undo(DataType::String, [meta_encoded_key.clone()])
+				.await?;
+			let put_opts = Storage::meta_put_opts(&meta_val);
+			self.put_string_record(meta_encoded_key, meta_val.encode(), &put_opts, &write_opts)
+				.await?;
+		}
+		Ok(())
+	}
+
+	/// Set the last delivered ID of `group`, or to the newest entry when `id`
+	/// is `None`.
+	#[storage_lock(write, key)]
+	#[fastrace::trace]
+	pub async fn xgroup_setid(
+		&self,
+		key: Bytes,
+		group: Bytes,
+		id: Option<StreamId>,
+	) -> Result<(), StorageError> {
+		let meta_val = self.existing_stream(&key).await?;
+		if self.get_group(&key, &meta_val, &group).await?.is_none() {
+			return Err(no_group(&key, &group));
+		}
+
+		let group_key = StreamGroupKey::new(key, group).encode();
+		let group_val = StreamGroupValue::new(id.unwrap_or(meta_val.last_id));
+		self.record_undo(DataType::Stream, [group_key.clone()])
+			.await?;
+		self.stream_db
+			.put_with_options(
+				group_key,
+				group_val.encode(),
+				&PutOptions::default(),
+				&WriteOptions {
+					await_durable: false,
+				},
+			)
+			.await?;
+		Ok(())
+	}
+
+	/// Destroy `group` with its consumers and pending entries. Returns false
+	/// if the group does not exist.
+	#[storage_lock(write, key)]
+	#[fastrace::trace]
+	pub async fn xgroup_destroy(&self, key: Bytes, group: Bytes) -> Result<bool, StorageError> {
+		let meta_val = self.existing_stream(&key).await?;
+		if self.get_group(&key, &meta_val, &group).await?.is_none() {
+			return Ok(false);
+		}
+
+		let mut keys = vec![StreamGroupKey::new(key.clone(), group.clone()).encode()];
+		for prefix in [
+			stream_consumer_group_prefix(&key, &group),
+			stream_pending_group_prefix(&key, &group),
+		] {
+			let mut stream = self.stream_db.scan(prefix.clone()..).await?;
+			while let Some(kv) = stream.next().await? {
+				if !kv.key.starts_with(&prefix) {
+					break;
+				}
+				keys.push(kv.key);
+			}
+		}
+
+		let mut batch = WriteBatch::new();
+		for key in &keys {
+			batch.delete(key.clone());
+		}
+		self.record_undo(DataType::Stream, keys).await?;
+		self.stream_db
+			.write_with_options(
+				batch,
+				&WriteOptions {
+					await_durable: false,
+				},
+			)
+			.await?;
+		Ok(true)
+	}
+
+	/// Create `consumer` in `group`. Returns false if it already exists.
+	#[storage_lock(write, key)]
+	#[fastrace::trace]
+	pub async fn xgroup_createconsumer(
+		&self,
+		key: Bytes,
+		group: Bytes,
+		consumer: Bytes,
+	) -> Result<bool, StorageError> {
+		let meta_val = self.existing_stream(&key).await?;
+		if self.get_group(&key, &meta_val, &group).await?.is_none() {
+			return Err(no_group(&key, &group));
+		}
+		if self
+			.get_consumer(&key, &meta_val, &group, &consumer)
+			.await?
+			.is_some()
+		{
+			return Ok(false);
+		}
+
+		let consumer_key = StreamConsumerKey::new(key, group, consumer).encode();
+		self.record_undo(DataType::Stream, [consumer_key.clone()])
+			.await?;
+		self.stream_db
+			.put_with_options(
+				consumer_key,
+				StreamConsumerValue::new(now_ms()).encode(),
+				&PutOptions::default(),
+				&WriteOptions {
+					await_durable: false,
+				},
+			)
+			.await?;
+		Ok(true)
+	}
+
+	/// Delete `consumer` from `group` together with its pending entries, and
+	/// return how many entries were pending.
+	#[storage_lock(write, key)]
+	#[fastrace::trace]
+	pub async fn xgroup_delconsumer(
+		&self,
+		key: Bytes,
+		group: Bytes,
+		consumer: Bytes,
+	) -> Result<u64, StorageError> {
+		let meta_val = self.existing_stream(&key).await?;
+		if self.get_group(&key, &meta_val, &group).await?.is_none() {
+			return Err(no_group(&key, &group));
+		}
+		if self
+			.get_consumer(&key, &meta_val, &group, &consumer)
+			.await?
+			.is_none()
+		{
+			return Ok(0);
+		}
+
+		let filter = PendingFilter {
+			consumer: Some(consumer.clone()),
+			..PendingFilter::default()
+		};
+		let pending = self.scan_pending(&key, &meta_val, &group, &filter).await?;
+		let mut keys = vec![StreamConsumerKey::new(key.clone(), group.clone(), consumer).encode()];
+		keys.extend(
+			pending
+				.iter()
+				.map(|(id, _)| StreamPendingKey::new(key.clone(), group.clone(), *id).encode()),
+		);
+
+		let mut batch = WriteBatch::new();
+		for key in &keys {
+			batch.delete(key.clone());
+		}
+		self.record_undo(DataType::Stream, keys).await?;
+		self.stream_db
+			.write_with_options(
+				batch,
+				&WriteOptions {
+					await_durable: false,
+				},
+			)
+			.await?;
+		Ok(pending.len() as u64)
+	}
+
+	/// Read entries for `consumer` of `group`, creating the consumer if
+	/// needed. Returns `None` if the stream or the group does not exist.
+	///
+	/// With `after` set to `None` (the `>` ID) this delivers up to `count`
+	/// entries never delivered to the group and, unless `noack` is set, adds
+	/// them to the pending entries list. Otherwise it returns the consumer's
+	/// pending entries with IDs greater than `after`, without redelivering
+	/// them.
+	#[storage_lock(write, key)]
+	#[fastrace::trace]
+	pub async fn xreadgroup(
+		&self,
+		key: Bytes,
+		group: Bytes,
+		consumer: Bytes,
+		after: Option<StreamId>,
+		count: Option<usize>,
+		noack: bool,
+	) -> Result<Option<Vec<StreamGroupEntry>>, StorageError> {
+		let Some(meta_val) = self.get_meta::<StreamMetaValue>(&key).await? else {
+			return Ok(None);
+		};
+		let Some(mut group_val) = self.get_group(&key, &meta_val, &group).await? else {
+			return Ok(None);
+		};
+
+		let now = now_ms();
+		let put_opts = PutOptions::default();
+		let mut batch = WriteBatch::new();
+		let mut batch_keys = Vec::new();
+		let entries: Vec<StreamGroupEntry> = match after {
+			None => {
+				let entries = match group_val.last_delivered_id.next() {
+					Some(start) => {
+						self.scan_stream_entries(&key, &meta_val, start, StreamId::MAX, count)
+							.await?
+					}
+					None => Vec::new(),
+				};
+				if let (Some((first_id, _)), Some((last_id, _))) = (entries.first(), entries.last())
+				{
+					let delivered = entries.len() as u64;
+					group_val.entries_read = match group_val.entries_read {
+						Some(read) if !range_has_tombstones(&meta_val, *first_id) => {
+							Some(read + delivered)
+						}
+						_ => {
+							let stream_first = self.first_stream_entry(&key, &meta_val).await?;
+							estimate_entries_read(
+								&meta_val,
+								stream_first.map(|(id, _)| id),
+								*first_id,
+							)
+							.map(|read| read + delivered - 1)
+						}
+					};
+					group_val.last_delivered_id = *last_id;
+
+					let group_key = StreamGroupKey::new(key.clone(), group.clone()).encode();
+					batch.put_with_options(group_key.clone(), group_val.encode(), &put_opts);
+					batch_keys.push(group_key);
+					if !noack {
+						let pending_val = StreamPendingValue::new(consumer.clone(), now).encode();
+						for (id, _) in &entries {
+							let pending_key =
+								StreamPendingKey::new(key.clone(), group.clone(), *id).encode();
+							batch.put_with_options(
+								pending_key.clone(),
+								pending_val.clone(),
+								&put_opts,
+							);
+							batch_keys.push(pending_key);
+						}
+					}
+				}
+				entries
+					.into_iter()
+					.map(|(id, entry)| (id, Some(entry)))
+					.collect()
+			}
+			Some(after) => {
+				let pending = match after.next() {
+					Some(start) => {
+						let filter = PendingFilter {
+							start,
+							consumer: Some(consumer.clone()),
+							count,
+							..PendingFilter::default()
+						};
+						self.scan_pending(&key, &meta_val, &group, &filter).await?
+					}
+					None => Vec::new(),
+				};
+				let mut entries = Vec::with_capacity(pending.len());
+				for (id, _) in pending {
+					entries.push((id, self.get_stream_entry(&key, &meta_val, id).await?));
+				}
+				entries
+			}
+		};
+
+		// Only `>` reads hand out entries; history reads just see the consumer.
+		let active = after.is_none() && !entries.is_empty();
+		let (consumer_key, consumer_val) = self
+			.touch_consumer(&key, &meta_val, &group, &consumer, now, active)
+			.await?;
+		batch.put_with_options(consumer_key.clone(), consumer_val, &put_opts);
+		batch_keys.push(consumer_key);
+		self.record_undo(DataType::Stream, batch_keys).await?;
+		self.stream_db
+			.write_with_options(
+				batch,
+				&WriteOptions {
+					await_durable: false,
+				},
+			)
+			.await?;
+		Ok(Some(entries))
+	}
+
+	/// Remove `ids` from the pending entries list of `group` and return how
+	/// many were pending.
+	#[storage_lock(write, key)]
+	#[fastrace::trace]
+	pub async fn xack(
+		&self,
+		key: Bytes,
+		group: Bytes,
+		ids: Vec<StreamId>,
+	) -> Result<u64, StorageError> {
+		let Some(meta_val) = self.get_meta::<StreamMetaValue>(&key).await? else {
+			return Ok(0);
+		};
+		if self.get_group(&key, &meta_val, &group).await?.is_none() {
+			return Ok(0);
+		}
+
+		let mut ids = ids;
+		ids.sort_unstable();
+		ids.dedup();
+
+		let mut batch = WriteBatch::new();
+		let mut batch_keys = Vec::new();
+		for id in ids {
+			let pending_key = StreamPendingKey::new(key.clone(), group.clone(), id).encode();
+			if let Some(kv) = self.stream_db.get_key_value(pending_key.clone()).await?
+				&& kv.seq >= meta_val.version
+			{
+				batch.delete(pending_key.clone());
+				batch_keys.push(pending_key);
+			}
+		}
+
+		let acked = batch_keys.len() as u64;
+		if acked > 0 {
+			self.record_undo(DataType::Stream, batch_keys).await?;
+			self.stream_db
+				.write_with_options(
+					batch,
+					&WriteOptions {
+						await_durable: false,
+					},
+				)
+				.await?;
+		}
+		Ok(acked)
+	}
+
+	/// Return the pending entries of `group` that pass `filter`, or `None` if
+	/// the stream or the group does not exist.
+	#[storage_lock(read, key)]
+	#[fastrace::trace]
+	pub async fn xpending(
+		&self,
+		key: Bytes,
+		group: Bytes,
+		filter: PendingFilter,
+	) -> Result<Option<Vec<(StreamId, StreamPendingValue)>>, StorageError> {
+		let Some(meta_val) = self.get_meta::<StreamMetaValue>(&key).await? else {
+			return Ok(None);
+		};
+		if self.get_group(&key, &meta_val, &group).await?.is_none() {
+			return Ok(None);
+		}
+		let pending = self.scan_pending(&key, &meta_val, &group, &filter).await?;
+		Ok(Some(pending))
+	}
+
+	/// Transfer the pending entries `ids` idle for at least `min_idle`
+	/// milliseconds to `consumer`, and return them. Returns `None` if the
+	/// stream or the group does not exist.
+	///
+	/// Pending entries deleted from the stream are dropped from the pending
+	/// entries list instead of being claimed.
+	#[storage_lock(write, key)]
+	#[fastrace::trace]
+	pub async fn xclaim(
+		&self,
+		key: Bytes,
+		group: Bytes,
+		consumer: Bytes,
+		min_idle: u64,
+		ids: Vec<StreamId>,
+		opts: ClaimOptions,
+	) -> Result<Option<Vec<StreamGroupEntry>>, StorageError> {
+		let Some(meta_val) = self.get_meta::<StreamMetaValue>(&key).await? else {
+			return Ok(None);
+		};
+		let Some(mut group_val) = self.get_group(&key, &meta_val, &group).await? else {
+			return Ok(None);
+		};
+
+		let now = now_ms();
+		let delivery_time = opts.delivery_time.unwrap_or(now);
+		let put_opts = PutOptions::default();
+		let mut batch = WriteBatch::new();
+		let mut batch_keys = Vec::new();
+
+		if let Some(last_id) = opts.last_id
+			&& last_id > group_val.last_delivered_id
+		{
+			group_val.last_delivered_id = last_id;
+			let group_key = StreamGroupKey::new(key.clone(), group.clone()).encode();
+			batch.put_with_options(group_key.clone(), group_val.encode(), &put_opts);
+			batch_keys.push(group_key);
+		}
+
+		let mut claimed = Vec::new();
+		for id in ids {
+			let pending_key = StreamPendingKey::new(key.clone(), group.clone(), id).encode();
+			let pending = match self.stream_db.get_key_value(pending_key.clone()).await? {
+				Some(kv) if kv.seq >= meta_val.version => {
+					Some(StreamPendingValue::decode(&kv.value)?)
+				}
+				_ => None,
+			};
+			let Some(entry) = self.get_stream_entry(&key, &meta_val, id).await? else {
+				if pending.is_some() {
+					batch.delete(pending_key.clone());
+					batch_keys.push(pending_key);
+				}
+				continue;
+			};
+
+			let mut pending_val = match pending {
+				Some(pending_val) if pending_val.idle(now) < min_idle => continue,
+				Some(pending_val) => pending_val,
+				None if opts.force => StreamPendingValue::new(consumer.clone(), now),
+				None => continue,
+			};
+			pending_val.consumer = consumer.clone();
+			pending_val.delivery_time = delivery_time;
+			if let Some(retry_count) = opts.retry_count {
+				pending_val.delivery_count = retry_count;
+			} else if !opts.justid {
+				pending_val.delivery_count += 1;
+			}
+			batch.put_with_options(pending_key.clone(), pending_val.encode(), &put_opts);
+			batch_keys.push(pending_key);
+			claimed.push((id, (!opts.justid).then_some(entry)));
+		}
+
+		let (consumer_key, consumer_val) = self
+			.touch_consumer(&key, &meta_val, &group, &consumer, now, !claimed.is_empty())
+			.await?;
+		batch.put_with_options(consumer_key.clone(), consumer_val, &put_opts);
+		batch_keys.push(consumer_key);
+		self.record_undo(DataType::Stream, batch_keys).await?;
+		self.stream_db
+			.write_with_options(
+				batch,
+				&WriteOptions {
+					await_durable: false,
+				},
+			)
+			.await?;
+		Ok(Some(claimed))
+	}
+
+	/// Scan the pending entries list of `group` from `start` and transfer up
+	/// to `count` entries idle for at least `min_idle` milliseconds to
+	/// `consumer`. At most ten times `count` entries are examined per call.
+	/// Returns `None` if the stream or the group does not exist.
+	#[allow(clippy::too_many_arguments)]
+	#[storage_lock(write, key)]
+	#[fastrace::trace]
+	pub async fn xautoclaim(
+		&self,
+		key: Bytes,
+		group: Bytes,
+		consumer: Bytes,
+		min_idle: u64,
+		start: StreamId,
+		count: usize,
+		justid: bool,
+	) -> Result<Option<AutoClaim>, StorageError> {
+		let Some(meta_val) = self.get_meta::<StreamMetaValue>(&key).await? else {
+			return Ok(None);
+		};
+		if self.get_group(&key, &meta_val, &group).await?.is_none() {
+			return Ok(None);
+		}
+
+		// Read one entry past the examined ones to know where to resume.
+		let attempts = count.saturating_mul(10);
+		let filter = PendingFilter {
+			start,
+			count: Some(attempts.saturating_add(1)),
+			..PendingFilter::default()
+		};
+		let pending = self.scan_pending(&key, &meta_val, &group, &filter).await?;
+
+		let now = now_ms();
+		let put_opts = PutOptions::default();
+		let mut batch = WriteBatch::new();
+		let mut batch_keys = Vec::new();
+		let mut claimed = Vec::new();
+		let mut deleted = Vec::new();
+		let mut examined = 0;
+		for (id, mut pending_val) in pending.iter().cloned() {
+			if examined == attempts || claimed.len() == count {
+				break;
+			}
+			examined += 1;
+
+			let pending_key = StreamPendingKey::new(key.clone(), group.clone(), id).encode();
+			let Some(entry) = self.get_stream_entry(&key, &meta_val, id).await? else {
+				batch.delete(pending_key.clone());
+				batch_keys.push(pending_key);
+				deleted.push(id);
+				continue;
+			};
+			if pending_val.idle(now) < min_idle {
+				continue;
+			}
+
+			pending_val.consumer = consumer.clone();
+			pending_val.delivery_time = now;
+			if !justid {
+				pending_val.delivery_count += 1;
+			}
+			batch.put_with_options(pending_key.clone(), pending_val.encode(), &put_opts);
+			batch_keys.push(pending_key);
+			claimed.push((id, (!justid).then_some(entry)));
+		}
+		let next = pending
+			.get(examined)
+			.map(|(id, _)| *id)
+			.unwrap_or(StreamId::MIN);
+
+		let (consumer_key, consumer_val) = self
+			.touch_consumer(&key, &meta_val, &group, &consumer, now, !claimed.is_empty())
+			.await?;
+		batch.put_with_options(consumer_key.clone(), consumer_val, &put_opts);
+		batch_keys.push(consumer_key);
+		self.record_undo(DataType::Stream, batch_keys).await?;
+		self.stream_db
+			.write_with_options(
+				batch,
+				&WriteOptions {
+					await_durable: false,
+				},
+			)
+			.await?;
+		Ok(Some(AutoClaim {
+			next,
+			claimed,
+			deleted,
+		}))
+	}
+
+	/// Describe the consumer groups of the stream at `key`, `None` if it does
+	/// not exist. Counting consumers and pending entries scans them.
+	#[storage_lock(read, key)]
+	#[fastrace::trace]
+	pub async fn xinfo_groups(
+		&self,
+		key: Bytes,
+	) -> Result<Option<Vec<StreamGroupInfo>>, StorageError> {
+		let Some(meta_val) = self.get_meta::<StreamMetaValue>(&key).await? else {
+			return Ok(None);
+		};
+
+		let groups = self.scan_groups(&key, &meta_val).await?;
+		let first_id = if groups.is_empty() {
+			None
+		} else {
+			self.first_stream_entry(&key, &meta_val)
+				.await?
+				.map(|(id, _)| id)
+		};
+		let mut infos = Vec::with_capacity(groups.len());
+		for (name, group_val) in groups {
+			let consumers = self.scan_consumers(&key, &meta_val, &name).await?.len() as u64;
+			let pending = self
+				.scan_pending(&key, &meta_val, &name, &PendingFilter::default())
+				.await?
+				.len() as u64;
+			infos.push(StreamGroupInfo {
+				lag: group_lag(&meta_val, &group_val, first_id),
+				name,
+				consumers,
+				pending,
+				last_delivered_id: group_val.last_delivered_id,
+				entries_read: group_val.entries_read,
+			});
+		}
+		Ok(Some(infos))
+	}
+
+	/// Describe the consumers of `group`, `None` if the stream at `key` does
+	/// not exist. Counting pending entries scans the group's list.
+	#[storage_lock(read, key)]
+	#[fastrace::trace]
+	pub async fn xinfo_consumers(
+		&self,
+		key: Bytes,
+		group: Bytes,
+	) -> Result<Option<Vec<StreamConsumerInfo>>, StorageError> {
+		let Some(meta_val) = self.get_meta::<StreamMetaValue>(&key).await? else {
+			return Ok(None);
+		};
+		if self.get_group(&key, &meta_val, &group).await?.is_none() {
+			return Err(no_group(&key, &group));
+		}
+
+		let mut pending_counts: HashMap<Bytes, u64> = HashMap::new();
+		for (_, pending_val) in self
+			.scan_pending(&key, &meta_val, &group, &PendingFilter::default())
+			.await?
+		{
+			*pending_counts.entry(pending_val.consumer).or_default() += 1;
+		}
+		let consumers = self.scan_consumers(&key, &meta_val, &group).await?;
+		Ok(Some(
+			consumers
+				.into_iter()
+				.map(|(name, consumer_val)| StreamConsumerInfo {
+					pending: pending_counts.get(&name).copied().unwrap_or(0),
+					name,
+					seen_time: consumer_val.seen_time,
+					active_time: consumer_val.active_time,
+				})
+				.collect(),
+		))
+	}
+
+	/// Encode the record of `consumer` after it read or claimed `now`,
+	/// creating it if needed. It is active too if it was handed entries.
+	/// Returns the key and value to write.
+	async fn touch_consumer(
+		&self,
+		key: &Bytes,
+		meta_val: &StreamMetaValue,
+		group: &Bytes,
+		consumer: &Bytes,
+		now: u64,
+		active: bool,
+	) -> Result<(Bytes, Bytes), StorageError> {
+		let mut consumer_val = self
+			.get_consumer(key, meta_val, group, consumer)
+			.await?
+			.unwrap_or_else(|| StreamConsumerValue::new(now));
+		consumer_val.seen_time = now;
+		if active {
+			consumer_val.active_time = now;
+		}
+		let consumer_key =
+			StreamConsumerKey::new(key.clone(), group.clone(), consumer.clone()).encode();
+		Ok((consumer_key, consumer_val.encode()))
+	}
+
+	/// Read the meta of the stream at `key`, which XGROUP requires to exist.
+	async fn existing_stream(&self, key: &Bytes) -> Result<StreamMetaValue, StorageError> {
+		self.get_meta::<StreamMetaValue>(key)
+			.await?
+			.ok_or_else(missing_key)
+	}
+
+	pub(crate) async fn get_group(
+		&self,
+		key: &Bytes,
+		meta_val: &StreamMetaValue,
+		group: &Bytes,
+	) -> Result<Option<StreamGroupValue>, StorageError> {
+		let group_key = StreamGroupKey::new(key.clone(), group.clone()).encode();
+		match self.stream_db.get_key_value(group_key).await? {
+			Some(kv) if kv.seq >= meta_val.version => {
+				Ok(Some(StreamGroupValue::decode(&kv.value)?))
+			}
+			_ => Ok(None),
+		}
+	}
+
+	pub(crate) async fn get_consumer(
+		&self,
+		key: &Bytes,
+		meta_val: &StreamMetaValue,
+		group: &Bytes,
+		consumer: &Bytes,
+	) -> Result<Option<StreamConsumerValue>, StorageError> {
+		let consumer_key =
+			StreamConsumerKey::new(key.clone(), group.clone(), consumer.clone()).encode();
+		match self.stream_db.get_key_value(consumer_key).await? {
+			Some(kv) if kv.seq >= meta_val.version => {
+				Ok(Some(StreamConsumerValue::decode(&kv.value)?))
+			}
+			_ => Ok(None),
+		}
+	}
+
+	/// Scan the consumer groups of the stream at `key`, in name order. The
+	/// caller must hold the key lock.
+	pub(crate) async fn scan_groups(
+		&self,
+		key: &Bytes,
+		meta_val: &StreamMetaValue,
+	) -> Result<Vec<(Bytes, StreamGroupValue)>, StorageError> {
+		let prefix = stream_group_user_key_prefix(key);
+		let mut stream = self.stream_db.scan(prefix.clone()..).await?;
+		let mut groups = Vec::new();
+		while let Some(kv) = stream.next().await? {
+			if !kv.key.starts_with(&prefix) {
+				break;
+			}
+			if kv.seq < meta_val.version {
+				continue;
+			}
+			let name = kv.key.slice(prefix.len()..);
+			groups.push((name, StreamGroupValue::decode(&kv.value)?));
+		}
+		Ok(groups)
+	}
+
+	/// Scan the consumers of `group`, in name order. The caller must hold the
+	/// key lock.
+	async fn scan_consumers(
+		&self,
+		key: &Bytes,
+		meta_val: &StreamMetaValue,
+		group: &Bytes,
+	) -> Result<Vec<(Bytes, StreamConsumerValue)>, StorageError> {
+		let prefix = stream_consumer_group_prefix(key, group);
+		let mut stream = self.stream_db.scan(prefix.clone()..).await?;
+		let mut consumers = Vec::new();
+		while let Some(kv) = stream.next().await? {
+			if !kv.key.starts_with(&prefix) {
+				break;
+			}
+			if kv.seq < meta_val.version {
+				continue;
+			}
+			let name = kv.key.slice(prefix.len()..);
+			consumers.push((name, StreamConsumerValue::decode(&kv.value)?));
+		}
+		Ok(consumers)
+	}
+
+	/// Scan the pending entries of `group` that pass `filter`, in ID order.
+	/// The caller must hold the key lock.
+	pub(crate) async fn scan_pending(
+		&self,
+		key: &Bytes,
+		meta_val: &StreamMetaValue,
+		group: &Bytes,
+		filter: &PendingFilter,
+	) -> Result<Vec<(StreamId, StreamPendingValue)>, StorageError> {
+		if filter.start > filter.end || filter.count == Some(0) {
+			return Ok(Vec::new());
+		}
+		let start_key = StreamPendingKey::new(key.clone(), group.clone(), filter.start).encode();
+		let end_key = StreamPendingKey::new(key.clone(), group.clone(), filter.end).encode();
+		let mut stream = self.stream_db.scan(start_key..=end_key).await?;
+
+		let now = now_ms();
+		let mut pending = Vec::new();
+		while let Some(kv) = stream.next().await? {
+			if kv.seq < meta_val.version {
+				continue;
+			}
+			let id = StreamPendingKey::decode_id(&kv.key).ok_or_else(|| {
+				StorageError::DataInconsistency {
+					message: "invalid stream pending key".to_string(),
+				}
+			})?;
+			let pending_val = StreamPendingValue::decode(&kv.value)?;
+			if filter
+				.consumer
+				.as_ref()
+				.is_some_and(|consumer| &pending_val.consumer != consumer)
+				|| pending_val.idle(now) < filter.min_idle
+			{
+				continue;
+			}
+			pending.push((id, pending_val));
+			if filter.count.is_some_and(|count| pending.len() >= count) {
+				break;
+			}
+		}
+		Ok(pending)
+	}
+
+	/// Look up the entry `id` of the stream at `key`, `None` if it was
+	/// deleted or trimmed. The caller must hold the key lock.
+	pub(crate) async fn get_stream_entry(
+		&self,
+		key: &Bytes,
+		meta_val: &StreamMetaValue,
+		id: StreamId,
+	) -> Result<Option<StreamEntryValue>, StorageError> {
+		if id <= meta_val.trimmed_id {
+			return Ok(None);
+		}
+		let entry_key = StreamEntryKey::new(key.clone(), id).encode();
+		match self.stream_db.get_key_value(entry_key).await? {
+			Some(kv) if kv.seq >= meta_val.version => {
+				Ok(Some(StreamEntryValue::decode(&kv.value)?))
+			}
+			_ => Ok(None),
+		}
+	}
+}
+
+/// Whether an entry with an ID of at least `start` may have been deleted,
+/// which makes counting entries by `entries_added` unreliable.
+fn range_has_tombstones(meta_val: &StreamMetaValue, start: StreamId) -> bool {
+	meta_val.len > 0 && meta_val.max_deleted_id != StreamId::MIN && meta_val.max_deleted_id >= start
+}
+
+/// Estimate how many entries a group that last read `id` has read, counting
+/// from the first entry ever added. `first_id` is the oldest entry of the
+/// stream. Returns `None` when deletions make it unknown.
+fn estimate_entries_read(
+	meta_val: &StreamMetaValue,
+	first_id: Option<StreamId>,
+	id: StreamId,
+) -> Option<u64> {
+	if meta_val.entries_added == 0 {
+		return Some(0);
+	}
+	if meta_val.len == 0 && id <= meta_val.last_id {
+		return Some(meta_val.entries_added);
+	}
+	match id.cmp(&meta_val.last_id) {
+		Ordering::Equal => return Some(meta_val.entries_added),
+		Ordering::Greater => return None,
+		Ordering::Less => {}
+	}
+
+	// Without deletions after the first entry, only the first entry's
+	// position is known.
+	let first_id = first_id?;
+	if meta_val.max_deleted_id != StreamId::MIN && meta_val.max_deleted_id >= first_id {
+		return None;
+	}
+	let removed = meta_val.entries_added - meta_val.len;
+	match id.cmp(&first_id) {
+		Ordering::Less => Some(removed),
+		Ordering::Equal => Some(removed + 1),
+		Ordering::Greater => None,
+	}
+}
+
+/// The number of entries not yet delivered to a group, `None` when unknown.
+fn group_lag(
+	meta_val: &StreamMetaValue,
+	group_val: &StreamGroupValue,
+	first_id: Option<StreamId>,
+) -> Option<u64> {
+	if meta_val.entries_added == 0 {
+		return Some(0);
+	}
+	let entries_read = match group_val.entries_read {
+		Some(read) if !range_has_tombstones(meta_val, group_val.last_delivered_id) => read,
+		_ => estimate_entries_read(meta_val, first_id, group_val.last_delivered_id)?,
+	};
+	Some(meta_val.entries_added.saturating_sub(entries_read))
+}
+
+fn now_ms() -> u64 {
+	chrono::Utc::now().timestamp_millis().max(0) as u64
+}
+
+fn missing_key() -> StorageError {
+	StorageError::InvalidArgument {
+		message: "ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.".to_string(),
+	}
+}
+
+fn no_group(key: &Bytes, group: &Bytes) -> StorageError {
+	StorageError::InvalidArgument {
+		message: format!(
+			"NOGROUP No such consumer group '{}' for key name '{}'",
+			String::from_utf8_lossy(group),
+			String::from_utf8_lossy(key)
+		),
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+	use crate::stream::id::StreamIdSpec;
+
+	async fn get_storage() -> (Storage, std::path::PathBuf) {
+		let timestamp = ulid::Ulid::new().to_string();
+		let path = std::env::temp_dir().join(format!("nimbis_test_stream_group_{}", timestamp));
+		std::fs::create_dir_all(&path).unwrap();
+		let storage = Storage::open(&path, None).await.unwrap();
+		(storage, path)
+	}
+
+	async fn add_entries(storage: &Storage, key: &Bytes, seqs: std::ops::RangeInclusive<u64>) {
+		for seq in seqs {
+			storage
+				.xadd(
+					key.clone(),
+					StreamIdSpec::Explicit(StreamId::new(1, seq)),
+					vec![(Bytes::from("n"), Bytes::from(seq.to_string()))],
+					false,
+					None,
+				)
+				.await
+				.unwrap();
+		}
+	}
+
+	fn ids(entries: &[StreamGroupEntry]) -> Vec<u64> {
+		entries.iter().map(|(id, _)| id.seq).collect()
+	}
+
+	#[tokio::test]
+	async fn test_xgroup_create() {
+		let (storage, path) = get_storage().await;
+		let key = Bytes::from("mystream");
+		let group = Bytes::from("g1");
+
+		let err = storage
+			.xgroup_create(key.clone(), group.clone(), None, false)
+			.await
+			.unwrap_err();
+		assert!(err.to_string().contains("requires the key to exist"));
+
+		storage
+			.xgroup_create(key.clone(), group.clone(), None, true)
+			.await
+			.unwrap();
+		assert_eq!(storage.xlen(key.clone()).await.unwrap(), 0);
+
+		let err = storage
+			.xgroup_create(key.clone(), group.clone(), None, true)
+			.await
+			.unwrap_err();
+		assert!(err.to_string().starts_with("BUSYGROUP"));
+
+		let _ = std::fs::remove_dir_all(path);
+	}
+
+	#[tokio::test]
+	async fn test_xreadgroup_new_entries_and_ack() {
+		let (storage, path) = get_storage().await;
+		let key = Bytes::from("mystream");
+		let group = Bytes::from("g1");
+		let alice = Bytes::from("alice");
+		let bob = Bytes::from("bob");
+
+		add_entries(&storage, &key, 1..=3).await;
+		storage
+			.xgroup_create(key.clone(), group.clone(), Some(StreamId::MIN), false)
+			.await
+			.unwrap();
+
+		let read = |consumer: &Bytes, after, count| {
+			storage.xreadgroup(
+				key.clone(),
+				group.clone(),
+				consumer.clone(),
+				after,
+				count,
+				false,
+			)
+		};
+
+		// Each `>` read continues after the entries delivered to the group.
+		let first = read(&alice, None, Some(2)).await.unwrap().unwrap();
+		assert_eq!(ids(&first), vec![1, 2]);
+		let second = read(&bob, None, None).await.unwrap().unwrap();
+		assert_eq!(ids(&second), vec![3]);
+		assert!(read(&bob, None, None).await.unwrap().unwrap().is_empty());
+
+		// History reads return the consumer's own pending entries.
+		let history = read(&alice, Some(StreamId::MIN), None)
+			.await
+			.unwrap()
+			.unwrap();
+		assert_eq!(ids(&history), vec![1, 2]);
+		assert!(history[0].1.is_some());
+
+		let acked = storage
+			.xack(
+				key.clone(),
+				group.clone(),
+				vec![
+					StreamId::new(1, 1),
+					StreamId::new(1, 1),
+					StreamId::new(1, 3),
+				],
+			)
+			.await
+			.unwrap();
+		assert_eq!(acked, 2);
+		let history = read(&alice, Some(StreamId::MIN), None)
+			.await
+			.unwrap()
+			.unwrap();
+		assert_eq!(ids(&history), vec![2]);
+
+		let _ = std::fs::remove_dir_all(path);
+	}
+
+	#[tokio::test]
+	async fn test_xreadgroup_noack_and_missing_group() {
+		let (storage, path) = get_storage().await;
+		let key = Bytes::from("mystream");
+		let group = Bytes::from("g1");
+		let alice = Bytes::from("alice");
+
+		add_entries(&storage, &key, 1..=2).await;
+		let missing = storage
+			.xreadgroup(key.clone(), group.clone(), alice.clone(), None, None, false)
+			.await
+			.unwrap();
+		assert!(missing.is_none());
+
+		storage
+			.xgroup_create(key.clone(), group.clone(), Some(StreamId::MIN), false)
+			.await
+			.unwrap();
+		let read = storage
+			.xreadgroup(key.clone(), group.clone(), alice.clone(), None, None, true)
+			.await
+			.unwrap()
+			.unwrap();
+		assert_eq!(ids(&read), vec![1, 2]);
+		let history = storage
+			.xreadgroup(
+				key.clone(),
+				group.clone(),
+				alice.clone(),
+				Some(StreamId::MIN),
+				None,
+				false,
+			)
+			.await
+			.unwrap()
+			.unwrap();
+		assert!(history.is_empty());
+
+		let _ = std::fs::remove_dir_all(path);
+	}
+
+	#[tokio::test]
+	async fn test_xgroup_consumers_and_destroy() {
+		let (storage, path) = get_storage().await;
+		let key = Bytes::from("mystream");
+		let group = Bytes::from("g1");
+		let alice = Bytes::from("alice");
+
+		add_entries(&storage, &key, 1..=2).await;
+		storage
+			.xgroup_create(key.clone(), group.clone(), Some(StreamId::MIN), false)
+			.await
+			.unwrap();
+		assert!(
+			storage
+				.xgroup_createconsumer(key.clone(), group.clone(), alice.clone())
+				.await
+				.unwrap()
+		);
+		assert!(
+			!storage
+				.xgroup_createconsumer(key.clone(), group.clone(), alice.clone())
+				.await
+				.unwrap()
+		);
+
+		storage
+			.xreadgroup(key.clone(), group.clone(), alice.clone(), None, None, false)
+			.await
+			.unwrap();
+		let deleted = storage
+			.xgroup_delconsumer(key.clone(), group.clone(), alice.clone())
+			.await
+			.unwrap();
+		assert_eq!(deleted, 2);
+
+		storage
+			.xgroup_setid(key.clone(), group.clone(), Some(StreamId::MIN))
+			.await
+			.unwrap();
+		assert!(
+			storage
+				.xgroup_destroy(key.clone(), group.clone())
+				.await
+				.unwrap()
+		);
+		assert!(
+			!storage
+				.xgroup_destroy(key.clone(), group.clone())
+				.await
+				.unwrap()
+		);
+		let err = storage
+			.xgroup_setid(key.clone(), group.clone(), None)
+			.await
+			.unwrap_err();
+		assert!(err.to_string().starts_with("NOGROUP"));
+
+		let _ = std::fs::remove_dir_all(path);
+	}
+
+	#[tokio::test]
+	async fn test_stream_recreate_drops_groups() {
+		let (storage, path) = get_storage().await;
+		let key = Bytes::from("mystream");
+		let group = Bytes::from("g1");
+
+		add_entries(&storage, &key, 1..=1).await;
+		storage
+			.xgroup_create(key.clone(), group.clone(), None, false)
+			.await
+			.unwrap();
+		storage.del([key.clone()]).await.unwrap();
+		add_entries(&storage, &key, 1..=1).await;
+
+		storage
+			.xgroup_create(key.clone(), group.clone(), None, false)
+			.await
+			.unwrap();
+
+		let _ = std::fs::remove_dir_all(path);
+	}
+
+	async fn deliver_all(storage: &Storage, key: &Bytes, group: &Bytes, consumer: &str) {
+		storage
+			.xgroup_create(key.clone(), group.clone(), Some(StreamId::MIN), false)
+			.await
+			.unwrap();
+		storage
+			.xreadgroup(
+				key.clone(),
+				group.clone(),
+				Bytes::from(consumer.to_string()),
+				None,
+				None,
+				false,
+			)
+			.await
+			.unwrap();
+	}
+
+	#[tokio::test]
+	async fn test_xpending() {
+		let (storage, path) = get_storage().await;
+		let key = Bytes::from("mystream");
+		let group = Bytes::from("g1");
+
+		add_entries(&storage, &key, 1..=3).await;
+		deliver_all(&storage, &key, &group, "alice").await;
+		storage
+			.xclaim(
+				key.clone(),
+				group.clone(),
+				Bytes::from("bob"),
+				0,
+				vec![StreamId::new(1, 3)],
+				ClaimOptions::default(),
+			)
+			.await
+			.unwrap();
+
+		let pending = storage
+			.xpending(key.clone(), group.clone(), PendingFilter::default())
+			.await
+			.unwrap()
+			.unwrap();
+		assert_eq!(pending.len(), 3);
+		assert_eq!(pending[2].1.consumer, Bytes::from("bob"));
+		assert_eq!(pending[2].1.delivery_count, 2);
+
+		let filter = PendingFilter {
+			start: StreamId::new(1, 2),
+			consumer: Some(Bytes::from("alice")),
+			..PendingFilter::default()
+		};
+		let pending = storage
+			.xpending(key.clone(), group.clone(), filter)
+			.await
+			.unwrap()
+			.unwrap();
+		assert_eq!(pending.len(), 1);
+		assert_eq!(pending[0].0, StreamId::new(1, 2));
+
+		let filter = PendingFilter {
+			min_idle: 60_000,
+			..PendingFilter::default()
+		};
+		let pending = storage
+			.xpending(key.clone(), group.clone(), filter)
+			.await
+			.unwrap()
+			.unwrap();
+		assert!(pending.is_empty());
+		assert!(
+			storage
+				.xpending(
+					key.clone(),
+					Bytes::from("missing"),
+					PendingFilter::default()
+				)
+				.await
+				.unwrap()
+				.is_none()
+		);
+
+		let _ = std::fs::remove_dir_all(path);
+	}
+
+	#[tokio::test]
+	async fn test_xclaim() {
+		let (storage, path) = get_storage().await;
+		let key = Bytes::from("mystream");
+		let group = Bytes::from("g1");
+		let bob = Bytes::from("bob");
+
+		add_entries(&storage, &key, 1..=2).await;
+		deliver_all(&storage, &key, &group, "alice").await;
+
+		// Entries delivered just now are not idle enough.
+		let claimed = storage
+			.xclaim(
+				key.clone(),
+				group.clone(),
+				bob.clone(),
+				60_000,
+				vec![StreamId::new(1, 1)],
+				ClaimOptions::default(),
+			)
+			.await
+			.unwrap()
+			.unwrap();
+		assert!(claimed.is_empty());
+
+		let opts = ClaimOptions {
+			justid: true,
+			..ClaimOptions::default()
+		};
+		let claimed = storage
+			.xclaim(
+				key.clone(),
+				group.clone(),
+				bob.clone(),
+				0,
+				vec![StreamId::new(1, 1), StreamId::new(9, 9)],
+				opts,
+			)
+			.await
+			.unwrap()
+			.unwrap();
+		assert_eq!(claimed, vec![(StreamId::new(1, 1), None)]);
+
+		let pending = storage
+			.xpending(key.clone(), group.clone(), PendingFilter::default())
+			.await
+			.unwrap()
+			.unwrap();
+		assert_eq!(pending[0].1.consumer, bob);
+		// JUSTID leaves the delivery count alone.
+		assert_eq!(pending[0].1.delivery_count, 1);
+
+		let opts = ClaimOptions {
+			retry_count: Some(7),
+			..ClaimOptions::default()
+		};
+		let claimed = storage
+			.xclaim(
+				key.clone(),
+				group.clone(),
+				bob.clone(),
+				0,
+				vec![StreamId::new(1, 2)],
+				opts,
+			)
+			.await
+			.unwrap()
+			.unwrap();
+		assert!(claimed[0].1.is_some());
+		let pending = storage
+			.xpending(key.clone(), group.clone(), PendingFilter::default())
+			.await
+			.unwrap()
+			.unwrap();
+		assert_eq!(pending[1].1.delivery_count, 7);
+
+		let _ = std::fs::remove_dir_all(path);
+	}
+
+	#[tokio::test]
+	async fn test_xautoclaim() {
+		let (storage, path) = get_storage().await;
+		let key = Bytes::from("mystream");
+		let group = Bytes::from("g1");
+		let bob = Bytes::from("bob");
+
+		add_entries(&storage, &key, 1..=3).await;
+		deliver_all(&storage, &key, &group, "alice").await;
+
+		let first = storage
+			.xautoclaim(
+				key.clone(),
+				group.clone(),
+				bob.clone(),
+				0,
+				StreamId::MIN,
+				2,
+				false,
+			)
+			.await
+			.unwrap()
+			.unwrap();
+		assert_eq!(ids(&first.claimed), vec![1, 2]);
+		assert_eq!(first.next, StreamId::new(1, 3));
+		assert!(first.deleted.is_empty());
+
+		let second = storage
+			.xautoclaim(
+				key.clone(),
+				group.clone(),
+				bob.clone(),
+				0,
+				first.next,
+				2,
+				true,
+			)
+			.await
+			.unwrap()
+			.unwrap();
+		assert_eq!(second.claimed, vec![(StreamId::new(1, 3), None)]);
+		assert_eq!(second.next, StreamId::MIN);
+
+		let pending = storage
+			.xpending(
+				key.clone(),
+				group.clone(),
+				PendingFilter {
+					consumer: Some(bob),
+					..PendingFilter::default()
+				},
+			)
+			.await
+			.unwrap()
+			.unwrap();
+		assert_eq!(pending.len(), 3);
+
+		let _ = std::fs::remove_dir_all(path);
+	}
+
+	#[tokio::test]
+	async fn test_xinfo_groups_lag() {
+		let (storage, path) = get_storage().await;
+		let key = Bytes::from("mystream");
+		let g1 = Bytes::from("g1");
+		let g2 = Bytes::from("g2");
+
+		add_entries(&storage, &key, 1..=5).await;
+		storage
+			.xgroup_create(key.clone(), g1.clone(), Some(StreamId::MIN), false)
+			.await
+			.unwrap();
+		storage
+			.xgroup_create(key.clone(), g2.clone(), None, false)
+			.await
+			.unwrap();
+		let lags = |infos: Vec<StreamGroupInfo>| {
+			infos
+				.into_iter()
+				.map(|info| (info.entries_read, info.lag))
+				.collect::<Vec<_>>()
+		};
+		let infos = storage.xinfo_groups(key.clone()).await.unwrap().unwrap();
+		assert_eq!(infos[0].name, g1);
+		assert_eq!(lags(infos), vec![(None, Some(5)), (None, Some(0))]);
+
+		storage
+			.xreadgroup(
+				key.clone(),
+				g1.clone(),
+				Bytes::from("alice"),
+				None,
+				Some(2),
+				false,
+			)
+			.await
+			.unwrap();
+		let infos = storage.xinfo_groups(key.clone()).await.unwrap().unwrap();
+		assert_eq!(infos[0].consumers, 1);
+		assert_eq!(infos[0].pending, 2);
+		assert_eq!(lags(infos)[0], (Some(2), Some(3)));
+
+		// A deletion past the group's position hides how far behind it is.
+		storage
+			.xdel(key.clone(), vec![StreamId::new(1, 4)])
+			.await
+			.unwrap();
+		let infos = storage.xinfo_groups(key.clone()).await.unwrap().unwrap();
+		assert_eq!(lags(infos)[0], (Some(2), None));
+
+		// Reading up to the newest entry makes it known again.
+		storage
+			.xreadgroup(
+				key.clone(),
+				g1.clone(),
+				Bytes::from("alice"),
+				None,
+				None,
+				false,
+			)
+			.await
+			.unwrap();
+		let infos = storage.xinfo_groups(key.clone()).await.unwrap().unwrap();
+		assert_eq!(lags(infos)[0], (None, Some(0)));
+
+		assert!(
+			storage
+				.xinfo_groups(Bytes::from("missing"))
+				.await
+				.unwrap()
+				.is_none()
+		);
+
+		let _ = std::fs::remove_dir_all(path);
+	}
+
+	#[tokio::test]
+	async fn test_xinfo_consumers() {
+		let (storage, path) = get_storage().await;
+		let key = Bytes::from("mystream");
+		let group = Bytes::from("g1");
+
+		add_entries(&storage, &key, 1..=2).await;
+		deliver_all(&storage, &key, &group, "alice").await;
+		storage
+			.xgroup_createconsumer(key.clone(), group.clone(), Bytes::from("bob"))
+			.await
+			.unwrap();
+
+		let consumers = storage
+			.xinfo_consumers(key.clone(), group.clone())
+			.await
+			.unwrap()
+			.unwrap();
+		assert_eq!(consumers.len(), 2);
+		assert_eq!(consumers[0].name, Bytes::from("alice"));
+		assert_eq!(consumers[0].pending, 2);
+		assert!(consumers[0].active_time > 0);
+		assert_eq!(consumers[1].name, Bytes::from("bob"));
+		assert_eq!(consumers[1].pending, 0);
+		assert_eq!(consumers[1].active_time, 0);
+
+		let err = storage
+			.xinfo_consumers(key.clone(), Bytes::from("nope"))
+			.await
+			.unwrap_err();
+		assert!(err.to_string().starts_with("NOGROUP"));
+
+		let _ = std::fs::remove_dir_all(path);
+	}
+}
@@ -17,8 +17,15 @@ impl Storage {
 	#[storage_lock(read, key)]
 	#[fastrace::trace]
 	pub async fn get(&self, key: Bytes) -> Result<Option<Bytes>, StorageError> {
-		match self.get_meta::<AnyValue>(&key).await? {
+		self.string_value(&key).await
+	}
+
+	/// Read the string at `key`, materializing it if it is stored as a
+	/// bitmap. The caller must hold the key lock.
+	pub(crate) async fn string_value(&self, key: &Bytes) -> Result<Option<Bytes>, StorageError> {
+		match self.get_meta::<AnyValue>(key).await? {
 			Some(AnyValue::String(val)) => Ok(Some(val.value)),
+			Some(AnyValue::Bitmap(meta)) => Ok(Some(self.read_bitmap(key, meta).await?)),
 			Some(val) => Err(StorageError::wrong_type(DataType::String, val.data_type())),
 			None => Ok(None),
 		}
@@ -34,9 +41,14 @@ impl Storage {
 			await_durable: false,
 		};
 		let put_opts = PutOptions::default();
-		self.string_db
-			.put_with_options(key.encode(), value.encode(), &put_opts, &write_opts)
-			.await?;
+		self.record_undo(DataType::String, [key.encode()]).await?;
+		self.put_string_record(
+			key.encode(),
+			self.encode_string(&value),
+			&put_opts,
+			&write_opts,
+		)
+		.await?;
 		Ok(())
 	}
 
@@ -46,6 +58,11 @@ impl Storage {
 	where
 		I: IntoIterator<Item = Bytes>,
 	{
+		self.delete_keys(keys).await
+	}
+
+	/// `del` without taking the locks of `keys`, which the caller holds.
+	pub(crate) async fn delete_keys(&self, keys: Vec<Bytes>) -> Result<i64, StorageError> {
 		let mut deleted = 0;
 		let write_opts = WriteOptions {
 			await_durable: false,
@@ -60,9 +77,8 @@ impl Storage {
 				continue;
 			}
 
-			self.string_db
-				.delete_with_options(key.encode(), &write_opts)
-				.await?;
+			self.record_undo(DataType::String, [key.encode()]).await?;
+			self.delete_string_record(key.encode(), &write_opts).await?;
 
 			deleted += 1;
 		}
@@ -92,9 +108,9 @@ impl Storage {
 			let write_opts = WriteOptions {
 				await_durable: false,
 			};
-			self.string_db
-				.delete_with_options(encoded_key, &write_opts)
+			self.record_undo(DataType::String, [encoded_key.clone()])
 				.await?;
+			self.delete_string_record(encoded_key, &write_opts).await?;
 			return Ok(true);
 		}
 
@@ -110,8 +126,9 @@ impl Storage {
 
 		let put_opts = PutOptions { ttl };
 
-		self.string_db
-			.put_with_options(encoded_key, encoded_val, &put_opts, &write_opts)
+		self.record_undo(DataType::String, [encoded_key.clone()])
+			.await?;
+		self.put_string_record(encoded_key, encoded_val, &put_opts, &write_opts)
 			.await?;
 		Ok(true)
 	}
@@ -119,19 +136,13 @@ impl Storage {
 	#[storage_lock(read, key)]
 	#[fastrace::trace]
 	pub async fn ttl(&self, key: Bytes) -> Result<Option<i64>, StorageError> {
-		let encoded_key = StringKey::new(key).encode();
-		let kv = match self.string_db.get_key_value(encoded_key.clone()).await? {
+		let kv = match self.string_record(&key).await? {
 			Some(kv) => kv,
 			None => return Ok(None),
 		};
 
 		if is_expired(kv.expire_ts) {
-			let write_opts = WriteOptions {
-				await_durable: false,
-			};
-			self.string_db
-				.delete_with_options(encoded_key, &write_opts)
-				.await?;
+			self.delete_expired(&key).await?;
 			return Ok(None);
 		}
 
@@ -169,11 +180,7 @@ impl Storage {
 	#[storage_lock(write, key)]
 	#[fastrace::trace]
 	pub async fn incr(&self, key: Bytes) -> Result<i64, StorageError> {
-		let current_val = match self.get_meta::<AnyValue>(&key).await? {
-			Some(AnyValue::String(val)) => Some(val.value),
-			Some(val) => return Err(StorageError::wrong_type(DataType::String, val.data_type())),
-			None => None,
-		};
+		let current_val = self.string_value(&key).await?;
 
 		let mut int_val: i64 = match current_val {
 			Some(bytes) => {
@@ -200,8 +207,8 @@ impl Storage {
 			await_durable: false,
 		};
 		let put_opts = PutOptions::default();
-		self.string_db
-			.put_with_options(key.encode(), value.encode(), &put_opts, &write_opts)
+		self.record_undo(DataType::String, [key.encode()]).await?;
+		self.put_string_record(key.encode(), value.encode(), &put_opts, &write_opts)
 			.await?;
 
 		Ok(int_val)
@@ -210,11 +217,7 @@ impl Storage {
 	#[storage_lock(write, key)]
 	#[fastrace::trace]
 	pub async fn decr(&self, key: Bytes) -> Result<i64, StorageError> {
-		let current_val = match self.get_meta::<AnyValue>(&key).await? {
-			Some(AnyValue::String(val)) => Some(val.value),
-			Some(val) => return Err(StorageError::wrong_type(DataType::String, val.data_type())),
-			None => None,
-		};
+		let current_val = self.string_value(&key).await?;
 
 		let mut int_val: i64 = match current_val {
 			Some(bytes) => {
@@ -241,8 +244,8 @@ impl Storage {
 			await_durable: false,
 		};
 		let put_opts = PutOptions::default();
-		self.string_db
-			.put_with_options(key.encode(), value.encode(), &put_opts, &write_opts)
+		self.record_undo(DataType::String, [key.encode()]).await?;
+		self.put_string_record(key.encode(), value.encode(), &put_opts, &write_opts)
 			.await?;
 
 		Ok(int_val)
@@ -251,11 +254,7 @@ impl Storage {
 	#[storage_lock(write, key)]
 	#[fastrace::trace]
 	pub async fn append(&self, key: Bytes, append_val: Bytes) -> Result<usize, StorageError> {
-		let current_val = match self.get_meta::<AnyValue>(&key).await? {
-			Some(AnyValue::String(val)) => Some(val.value),
-			Some(val) => return Err(StorageError::wrong_type(DataType::String, val.data_type())),
-			None => None,
-		};
+		let current_val = self.string_value(&key).await?;
 
 		let new_val = match current_val {
 			Some(bytes) => {
@@ -275,9 +274,14 @@ impl Storage {
 			await_durable: false,
 		};
 		let put_opts = PutOptions::default();
-		self.string_db
-			.put_with_options(key.encode(), value.encode(), &put_opts, &write_opts)
-			.await?;
+		self.record_undo(DataType::String, [key.encode()]).await?;
+		self.put_string_record(
+			key.encode(),
+			self.encode_string(&value),
+			&put_opts,
+			&write_opts,
+		)
+		.await?;
 
 		Ok(len)
 	}
@@ -548,4 +552,94 @@ mod tests {
 
 		let _ = std::fs::remove_dir_all(path);
 	}
+
+	#[tokio::test]
+	async fn test_storage_ttl_survives_reopen() {
+		let (storage, path) = get_storage().await;
+		let now = Utc::now().timestamp_millis() as u64;
+
+		storage
+			.set(Bytes::from("kept"), Bytes::from("v"))
+			.await
+			.unwrap();
+		assert!(
+			storage
+				.expire(Bytes::from("kept"), now + 100_000)
+				.await
+				.unwrap()
+		);
+		storage
+			.set(Bytes::from("short"), Bytes::from("v"))
+			.await
+			.unwrap();
+		assert!(
+			storage
+				.expire(Bytes::from("short"), now + 200)
+				.await
+				.unwrap()
+		);
+		storage
+			.hset(Bytes::from("hash"), Bytes::from("old"), Bytes::from("v"))
+			.await
+			.unwrap();
+		assert!(
+			storage
+				.expire(Bytes::from("hash"), now + 200)
+				.await
+				.unwrap()
+		);
+		storage.close().await.unwrap();
+
+		// Let the short TTLs run out while the store is closed.
+		tokio::time::sleep(std::time::Duration::from_millis(300)).await;
+		let storage = Storage::open(&path, None).await.unwrap();
+
+		// The absolute expire time is kept, so the remaining TTL only shrinks.
+		let ttl = storage.ttl(Bytes::from("kept")).await.unwrap().unwrap();
+		assert!(ttl > 0 && ttl <= 100_000);
+
+		assert_eq!(storage.get(Bytes::from("short")).await.unwrap(), None);
+		assert_eq!(storage.ttl(Bytes::from("short")).await.unwrap(), None);
+		assert!(!storage.exists(Bytes::from("hash")).await.unwrap());
+
+		// A new hash under the expired key must not bring back the old fields.
+		storage
+			.hset(Bytes::from("hash"), Bytes::from("new"), Bytes::from("v"))
+			.await
+			.unwrap();
+		assert_eq!(
+			storage.hgetall(Bytes::from("hash")).await.unwrap(),
+			vec![(Bytes::from("new"), Bytes::from("v"))]
+		);
+
+		storage.close().await.unwrap();
+		let _ = std::fs::remove_dir_all(path);
+	}
+
+	#[tokio::test]
+	async fn test_storage_compressed_values() {
+		let (storage, path) = get_storage().await;
+		storage.set_compression(crate::compression::Codec::Zstd, 64);
+		let key = Bytes::from("json");
+		let value = Bytes::from(r#"{"name":"nimbis"},"#.repeat(64));
+
+		storage.set(key.clone(), value.clone()).await.unwrap();
+		assert_eq!(storage.get(key.clone()).await.unwrap(), Some(value.clone()));
+		let stats = storage.compression_stats();
+		assert_eq!(stats.values, 1);
+		assert!(stats.output_bytes < stats.input_bytes);
+
+		// Compressed values read back after compression is turned off.
+		storage.set_compression(crate::compression::Codec::None, 64);
+		let len = storage.append(key.clone(), Bytes::from("]")).await.unwrap();
+		assert_eq!(len, value.len() + 1);
+		assert_eq!(
+			storage.get(key.clone()).await.unwrap().unwrap().len(),
+			value.len() + 1
+		);
+		assert_eq!(storage.compression_stats().values, 1);
+
+		storage.close().await.unwrap();
+		let _ = std::fs::remove_dir_all(path);
+	}
 }
@@ -5,6 +5,7 @@ use slatedb::WriteBatch;
 use slatedb::config::PutOptions;
 use slatedb::config::WriteOptions;
 
+use crate::data_type::DataType;
 use crate::error::StorageError;
 use crate::storage::Storage;
 use crate::string::meta::MetaKey;
@@ -13,6 +14,17 @@ use crate::utils::zset_score_user_key_prefix;
 use crate::zset::member_key::MemberKey;
 use crate::zset::score_key::ScoreKey;
 
+/// Conditions of a ZADD-like write.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct ZAddOptions {
+	/// Only add new members.
+	pub nx: bool,
+	/// Only update existing members.
+	pub xx: bool,
+	/// Count updated members in the reply, not only added ones.
+	pub ch: bool,
+}
+
 impl Storage {
 	#[storage_lock(write, key)]
 	#[fastrace::trace]
@@ -20,6 +32,19 @@ impl Storage {
 		&self,
 		key: Bytes,
 		elements: Vec<(f64, Bytes)>, // (score, member)
+	) -> Result<u64, StorageError> {
+		self.zadd_elements(key, elements, ZAddOptions::default())
+			.await
+	}
+
+	/// Add or update `elements` of the sorted set at `key` under `options`,
+	/// returning how many were added, or also updated with `ch`. The caller
+	/// must hold the key lock.
+	pub(crate) async fn zadd_elements(
+		&self,
+		key: Bytes,
+		elements: Vec<(f64, Bytes)>,
+		options: ZAddOptions,
 	) -> Result<u64, StorageError> {
 		let meta_key = MetaKey::new(key.clone());
 		let meta_encoded_key = meta_key.encode();
@@ -72,9 +97,11 @@ impl Storage {
 		};
 
 		let mut added_count = 0;
+		let mut updated_count = 0;
 		let mut first_new_member_key: Option<Bytes> = None;
 		// Use WriteBatch to ensure atomicity of all zset operations
 		let mut batch = WriteBatch::new();
+		let mut batch_keys = Vec::new();
 		let mut has_writes = false;
 
 		for (idx, (score, member)) in elements.into_iter().enumerate() {
@@ -82,18 +109,24 @@ impl Storage {
 			let old_score_bytes = &old_values[idx];
 
 			if let Some(old_score_bytes) = old_score_bytes {
+				if options.nx {
+					continue;
+				}
 				// Update existing member
 				let old_score =
 					ScoreKey::decode_score(u64::from_be_bytes(old_score_bytes[..8].try_into()?));
 				if old_score != score {
 					has_writes = true;
+					updated_count += 1;
 					// Delete old ScoreKey
 					let old_score_key = ScoreKey::new(key.clone(), old_score, member.clone());
 					batch.delete(old_score_key.encode());
+					batch_keys.push(old_score_key.encode());
 
 					// Add new ScoreKey
 					let new_score_key = ScoreKey::new(key.clone(), score, member.clone());
 					batch.put_with_options(new_score_key.encode(), Bytes::new(), &put_opts);
+					batch_keys.push(new_score_key.encode());
 
 					// Update MemberKey
 					let encoded_score = ScoreKey::encode_score(score);
@@ -102,8 +135,9 @@ impl Storage {
 						Bytes::copy_from_slice(&encoded_score.to_be_bytes()),
 						&put_opts,
 					);
+					batch_keys.push(encoded_member_key.clone());
 				}
-			} else {
+			} else if !options.xx {
 				has_writes = true;
 				// New member
 				added_count += 1;
@@ -118,14 +152,17 @@ impl Storage {
 					Bytes::copy_from_slice(&encoded_score.to_be_bytes()),
 					&put_opts,
 				);
+				batch_keys.push(encoded_member_key.clone());
 
 				// Add ScoreKey
 				let score_key = ScoreKey::new(key.clone(), score, member);
 				batch.put_with_options(score_key.encode(), Bytes::new(), &put_opts);
+				batch_keys.push(score_key.encode());
 			}
 		}
 
 		if has_writes {
+			self.record_undo(DataType::ZSet, batch_keys).await?;
 			self.zset_db.write_with_options(batch, &write_opts).await?;
 		}
 
@@ -150,12 +187,17 @@ impl Storage {
 
 			let put_opts = Storage::meta_put_opts(&meta_val);
 
-			self.string_db
-				.put_with_options(meta_encoded_key, meta_val.encode(), &put_opts, &write_opts)
+			self.record_undo(DataType::String, [meta_encoded_key.clone()])
+				.await?;
+			self.put_string_record(meta_encoded_key, meta_val.encode(), &put_opts, &write_opts)
 				.await?;
 		}
 
-		Ok(added_count)
+		if options.ch {
+			Ok(added_count + updated_count)
+		} else {
+			Ok(added_count)
+		}
 	}
 
 	#[storage_lock(read, key)]
@@ -247,6 +289,67 @@ impl Storage {
 		}
 	}
 
+	/// Read the scores of `members` of the sorted set at `key`, `None` for
+	/// missing ones. The caller must hold the key lock.
+	pub(crate) async fn zset_scores(
+		&self,
+		key: &Bytes,
+		members: &[Bytes],
+	) -> Result<Vec<Option<f64>>, StorageError> {
+		let Some(meta_val) = self.get_meta::<ZSetMetaValue>(key).await? else {
+			return Ok(vec![None; members.len()]);
+		};
+
+		let fetch_futures = members.iter().map(|member| {
+			let member_key = MemberKey::new(key.clone(), member.clone());
+			self.zset_db.get_key_value(member_key.encode())
+		});
+		let mut scores = Vec::with_capacity(members.len());
+		for entry in future::join_all(fetch_futures).await {
+			let score = match entry? {
+				Some(kv) if kv.seq >= meta_val.version => Some(ScoreKey::decode_score(
+					u64::from_be_bytes(kv.value[..8].try_into()?),
+				)),
+				_ => None,
+			};
+			scores.push(score);
+		}
+		Ok(scores)
+	}
+
+	/// Read the members of the sorted set at `key` with scores in
+	/// `min..max`, in score order. The caller must hold the key lock.
+	pub(crate) async fn zset_range_by_score(
+		&self,
+		key: &Bytes,
+		min: f64,
+		max: f64,
+	) -> Result<Vec<(Bytes, f64)>, StorageError> {
+		let Some(meta_val) = self.get_meta::<ZSetMetaValue>(key).await? else {
+			return Ok(Vec::new());
+		};
+
+		let prefix = zset_score_user_key_prefix(key);
+		let bound = |score: f64| {
+			let mut bound = prefix.to_vec();
+			bound.extend_from_slice(&ScoreKey::encode_score(score).to_be_bytes());
+			Bytes::from(bound)
+		};
+		let mut stream = self.zset_db.scan(bound(min)..bound(max)).await?;
+
+		let header_len = prefix.len() + 8;
+		let mut result = Vec::new();
+		while let Some(kv) = stream.next().await? {
+			if kv.seq < meta_val.version || kv.key.len() <= header_len {
+				continue;
+			}
+			let score_bytes: [u8; 8] = kv.key[prefix.len()..header_len].try_into()?;
+			let score = ScoreKey::decode_score(u64::from_be_bytes(score_bytes));
+			result.push((kv.key.slice(header_len..), score));
+		}
+		Ok(result)
+	}
+
 	#[storage_lock(write, key)]
 	#[fastrace::trace]
 	pub async fn zrem(&self, key: Bytes, members: Vec<Bytes>) -> Result<u64, StorageError> {
@@ -279,18 +382,21 @@ impl Storage {
 
 		// Use WriteBatch to ensure atomicity of all delete operations
 		let mut batch = WriteBatch::new();
+		let mut batch_keys = Vec::new();
 		let mut removed_count = 0;
 
 		for (idx, member) in members.into_iter().enumerate() {
 			if let Some(val) = &old_values[idx] {
 				// Delete MemberKey
 				batch.delete(&member_encoded_keys[idx]);
+				batch_keys.push(member_encoded_keys[idx].clone());
 
 				// Delete ScoreKey
 				let encoded_score = u64::from_be_bytes(val[..8].try_into()?);
 				let score = ScoreKey::decode_score(encoded_score);
 				let score_key = ScoreKey::new(key.clone(), score, member);
 				batch.delete(score_key.encode());
+				batch_keys.push(score_key.encode());
 
 				removed_count += 1;
 			}
@@ -305,17 +411,18 @@ impl Storage {
 		};
 
 		// Execute all delete operations atomically
+		self.record_undo(DataType::ZSet, batch_keys).await?;
+		self.record_undo(DataType::String, [meta_encoded_key.clone()])
+			.await?;
 		self.zset_db.write_with_options(batch, &write_opts).await?;
 
 		meta_val.len -= removed_count;
 		if meta_val.len == 0 {
-			self.string_db
-				.delete_with_options(meta_encoded_key, &write_opts)
+			self.delete_string_record(meta_encoded_key, &write_opts)
 				.await?;
 		} else {
 			let put_opts = Storage::meta_put_opts(&meta_val);
-			self.string_db
-				.put_with_options(meta_encoded_key, meta_val.encode(), &put_opts, &write_opts)
+			self.put_string_record(meta_encoded_key, meta_val.encode(), &put_opts, &write_opts)
 				.await?;
 		}
 
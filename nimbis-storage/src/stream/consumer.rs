@@ -0,0 +1,110 @@
+use bytes::Buf;
+use bytes::BufMut;
+use bytes::Bytes;
+use bytes::BytesMut;
+
+use crate::error::DecoderError;
+use crate::utils::stream_consumer_group_prefix;
+
+#[derive(Debug, PartialEq)]
+pub struct StreamConsumerKey {
+	user_key: Bytes,
+	group: Bytes,
+	consumer: Bytes,
+}
+
+impl StreamConsumerKey {
+	pub fn new(
+		user_key: impl Into<Bytes>,
+		group: impl Into<Bytes>,
+		consumer: impl Into<Bytes>,
+	) -> Self {
+		Self {
+			user_key: user_key.into(),
+			group: group.into(),
+			consumer: consumer.into(),
+		}
+	}
+
+	pub fn encode(&self) -> Bytes {
+		// Key format: len(user_key) (u16 BE) + user_key + b'C' + len(group)
+		// (u32 BE) + group + consumer
+		let prefix = stream_consumer_group_prefix(&self.user_key, &self.group);
+		let mut bytes = BytesMut::with_capacity(prefix.len() + self.consumer.len());
+		bytes.extend_from_slice(&prefix);
+		bytes.extend_from_slice(&self.consumer);
+		bytes.freeze()
+	}
+
+	/// Returns the user_key from this consumer key.
+	pub fn user_key(&self) -> &Bytes {
+		&self.user_key
+	}
+}
+
+/// The state of one consumer in a group. Times are milliseconds since the
+/// epoch.
+#[derive(Debug, Clone, PartialEq)]
+pub struct StreamConsumerValue {
+	/// Last time the consumer read or claimed, successful or not.
+	pub seen_time: u64,
+	/// Last time the consumer was delivered an entry, 0 if never.
+	pub active_time: u64,
+}
+
+impl StreamConsumerValue {
+	pub fn new(seen_time: u64) -> Self {
+		Self {
+			seen_time,
+			active_time: 0,
+		}
+	}
+
+	pub fn encode(&self) -> Bytes {
+		// Value format: seen_time (u64 BE) + active_time (u64 BE)
+		let mut bytes = BytesMut::with_capacity(16);
+		bytes.put_u64(self.seen_time);
+		bytes.put_u64(self.active_time);
+		bytes.freeze()
+	}
+
+	pub fn decode(bytes: &[u8]) -> Result<Self, DecoderError> {
+		if bytes.len() < 16 {
+			return Err(DecoderError::InvalidLength);
+		}
+		let mut buf = bytes;
+		let seen_time = buf.get_u64();
+		let active_time = buf.get_u64();
+		Ok(Self {
+			seen_time,
+			active_time,
+		})
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+
+	#[test]
+	fn test_stream_consumer_key_encode() {
+		let encoded =
+			StreamConsumerKey::new(Bytes::from("s"), Bytes::from("g1"), Bytes::from("alice"))
+				.encode();
+		// Verify format: key_len(u16) + key + b'C' + group_len(u32) + group + consumer
+		assert_eq!(&encoded[..3], &[0, 1, b's']);
+		assert_eq!(encoded[3], b'C');
+		assert_eq!(&encoded[4..8], &2u32.to_be_bytes());
+		assert_eq!(&encoded[8..10], b"g1");
+		assert_eq!(&encoded[10..], b"alice");
+	}
+
+	#[test]
+	fn test_stream_consumer_value_round_trip() {
+		let value = StreamConsumerValue {
+			seen_time: 20,
+			active_time: 10,
+		};
+		assert_eq!(StreamConsumerValue::decode(&value.encode()).unwrap(), value);
+	}
+}
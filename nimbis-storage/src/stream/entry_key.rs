@@ -0,0 +1,67 @@
+use bytes::BufMut;
+use bytes::Bytes;
+use bytes::BytesMut;
+
+use crate::stream::id::StreamId;
+
+#[derive(Debug, PartialEq)]
+pub struct StreamEntryKey {
+	user_key: Bytes,
+	id: StreamId,
+}
+
+impl StreamEntryKey {
+	pub fn new(user_key: impl Into<Bytes>, id: StreamId) -> Self {
+		Self {
+			user_key: user_key.into(),
+			id,
+		}
+	}
+
+	pub fn encode(&self) -> Bytes {
+		// Key format: len(user_key) (u16 BE) + user_key + b'E' + ms (u64 BE) +
+		// seq (u64 BE). Big-endian IDs make key order match ID order, so a range
+		// of IDs is one sequential scan.
+		let mut bytes = BytesMut::with_capacity(2 + self.user_key.len() + 1 + 16);
+		bytes.put_u16(self.user_key.len() as u16);
+		bytes.extend_from_slice(&self.user_key);
+		bytes.put_u8(b'E');
+		bytes.extend_from_slice(&self.id.to_bytes());
+		bytes.freeze()
+	}
+
+	/// Decode the entry ID from an encoded key, which ends with it.
+	pub fn decode_id(encoded: &[u8]) -> Option<StreamId> {
+		let start = encoded.len().checked_sub(16)?;
+		StreamId::from_bytes(&encoded[start..])
+	}
+
+	/// Returns the user_key from this entry key.
+	pub fn user_key(&self) -> &Bytes {
+		&self.user_key
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+
+	#[test]
+	fn test_stream_entry_key_encode() {
+		let id = StreamId::new(1526919030474, 55);
+		let encoded = StreamEntryKey::new(Bytes::from("mystream"), id).encode();
+		// Verify format: key_len(u16) + key + b'E' + ms(u64) + seq(u64)
+		assert_eq!(&encoded[..2], &8u16.to_be_bytes());
+		assert_eq!(&encoded[2..10], b"mystream");
+		assert_eq!(encoded[10], b'E');
+		assert_eq!(StreamEntryKey::decode_id(&encoded), Some(id));
+	}
+
+	#[test]
+	fn test_stream_entry_keys_sort_by_id() {
+		let key = Bytes::from("s");
+		let first = StreamEntryKey::new(key.clone(), StreamId::new(9, u64::MAX)).encode();
+		let second = StreamEntryKey::new(key, StreamId::new(10, 0)).encode();
+		assert!(first < second);
+	}
+}
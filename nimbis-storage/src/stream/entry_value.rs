@@ -0,0 +1,88 @@
+use bytes::Buf;
+use bytes::BufMut;
+use bytes::Bytes;
+use bytes::BytesMut;
+
+use crate::error::DecoderError;
+
+/// The field-value pairs of one stream entry.
+#[derive(Debug, Clone, PartialEq)]
+pub struct StreamEntryValue {
+	pub fields: Vec<(Bytes, Bytes)>,
+}
+
+impl StreamEntryValue {
+	pub fn new(fields: Vec<(Bytes, Bytes)>) -> Self {
+		Self { fields }
+	}
+
+	pub fn encode(&self) -> Bytes {
+		// Value format: count (u32 BE), then per pair len(field) (u32 BE) + field +
+		// len(value) (u32 BE) + value
+		let size = self
+			.fields
+			.iter()
+			.map(|(field, value)| 8 + field.len() + value.len())
+			.sum::<usize>();
+		let mut bytes = BytesMut::with_capacity(4 + size);
+		bytes.put_u32(self.fields.len() as u32);
+		for (field, value) in &self.fields {
+			bytes.put_u32(field.len() as u32);
+			bytes.extend_from_slice(field);
+			bytes.put_u32(value.len() as u32);
+			bytes.extend_from_slice(value);
+		}
+		bytes.freeze()
+	}
+
+	pub fn decode(bytes: &Bytes) -> Result<Self, DecoderError> {
+		let mut buf = &bytes[..];
+		let read_part = |buf: &mut &[u8]| {
+			if buf.remaining() < 4 {
+				return Err(DecoderError::InvalidLength);
+			}
+			let len = buf.get_u32() as usize;
+			if buf.remaining() < len {
+				return Err(DecoderError::InvalidLength);
+			}
+			let start = bytes.len() - buf.remaining();
+			buf.advance(len);
+			Ok(bytes.slice(start..start + len))
+		};
+
+		if buf.remaining() < 4 {
+			return Err(DecoderError::InvalidLength);
+		}
+		let count = buf.get_u32() as usize;
+		let mut fields = Vec::with_capacity(count.min(buf.remaining() / 8));
+		for _ in 0..count {
+			let field = read_part(&mut buf)?;
+			let value = read_part(&mut buf)?;
+			fields.push((field, value));
+		}
+		Ok(Self { fields })
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+
+	#[test]
+	fn test_stream_entry_value_round_trip() {
+		let value = StreamEntryValue::new(vec![
+			(Bytes::from("name"), Bytes::from("nimbis")),
+			(Bytes::from("empty"), Bytes::new()),
+		]);
+		let encoded = value.encode();
+		assert_eq!(&encoded[..4], &2u32.to_be_bytes());
+		assert_eq!(StreamEntryValue::decode(&encoded).unwrap(), value);
+	}
+
+	#[test]
+	fn test_stream_entry_value_rejects_truncated_input() {
+		let encoded = StreamEntryValue::new(vec![(Bytes::from("f"), Bytes::from("v"))]).encode();
+		let truncated = encoded.slice(..encoded.len() - 1);
+		assert!(StreamEntryValue::decode(&truncated).is_err());
+	}
+}
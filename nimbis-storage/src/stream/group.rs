@@ -0,0 +1,103 @@
+use bytes::Buf;
+use bytes::BufMut;
+use bytes::Bytes;
+use bytes::BytesMut;
+
+use crate::error::DecoderError;
+use crate::stream::id::StreamId;
+use crate::utils::stream_group_user_key_prefix;
+
+#[derive(Debug, PartialEq)]
+pub struct StreamGroupKey {
+	user_key: Bytes,
+	group: Bytes,
+}
+
+impl StreamGroupKey {
+	pub fn new(user_key: impl Into<Bytes>, group: impl Into<Bytes>) -> Self {
+		Self {
+			user_key: user_key.into(),
+			group: group.into(),
+		}
+	}
+
+	pub fn encode(&self) -> Bytes {
+		// Key format: len(user_key) (u16 BE) + user_key + b'G' + group
+		let prefix = stream_group_user_key_prefix(&self.user_key);
+		let mut bytes = BytesMut::with_capacity(prefix.len() + self.group.len());
+		bytes.extend_from_slice(&prefix);
+		bytes.extend_from_slice(&self.group);
+		bytes.freeze()
+	}
+
+	/// Returns the user_key from this group key.
+	pub fn user_key(&self) -> &Bytes {
+		&self.user_key
+	}
+}
+
+/// The state of one consumer group.
+#[derive(Debug, Clone, PartialEq)]
+pub struct StreamGroupValue {
+	/// ID of the last entry delivered to the group, `>` reads after it.
+	pub last_delivered_id: StreamId,
+	/// How many entries of the stream the group has read, counting from the
+	/// first entry ever added, `None` when unknown.
+	pub entries_read: Option<u64>,
+}
+
+impl StreamGroupValue {
+	pub fn new(last_delivered_id: StreamId) -> Self {
+		Self {
+			last_delivered_id,
+			entries_read: None,
+		}
+	}
+
+	pub fn encode(&self) -> Bytes {
+		// Value format: last_delivered_id (ms u64 BE + seq u64 BE) + entries_read
+		// (u64 BE, u64::MAX when unknown)
+		let mut bytes = BytesMut::with_capacity(16 + 8);
+		bytes.extend_from_slice(&self.last_delivered_id.to_bytes());
+		bytes.put_u64(self.entries_read.unwrap_or(u64::MAX));
+		bytes.freeze()
+	}
+
+	pub fn decode(bytes: &[u8]) -> Result<Self, DecoderError> {
+		if bytes.len() < 16 + 8 {
+			return Err(DecoderError::InvalidLength);
+		}
+		let last_delivered_id =
+			StreamId::from_bytes(&bytes[..16]).ok_or(DecoderError::InvalidLength)?;
+		let mut buf = &bytes[16..];
+		let entries_read = Some(buf.get_u64()).filter(|&n| n != u64::MAX);
+		Ok(Self {
+			last_delivered_id,
+			entries_read,
+		})
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+
+	#[test]
+	fn test_stream_group_key_encode() {
+		let encoded = StreamGroupKey::new(Bytes::from("mystream"), Bytes::from("g1")).encode();
+		// Verify format: key_len(u16) + key + b'G' + group
+		assert_eq!(&encoded[..2], &8u16.to_be_bytes());
+		assert_eq!(&encoded[2..10], b"mystream");
+		assert_eq!(encoded[10], b'G');
+		assert_eq!(&encoded[11..], b"g1");
+	}
+
+	#[test]
+	fn test_stream_group_value_round_trip() {
+		let mut value = StreamGroupValue::new(StreamId::new(7, 3));
+		assert_eq!(StreamGroupValue::decode(&value.encode()).unwrap(), value);
+		value.entries_read = Some(5);
+		assert_eq!(StreamGroupValue::decode(&value.encode()).unwrap(), value);
+		assert!(StreamGroupValue::decode(&[0u8; 23]).is_err());
+	}
+}
@@ -0,0 +1,200 @@
+use std::fmt;
+
+use crate::error::StorageError;
+
+/// A stream entry ID: a millisecond timestamp and a sequence number within
+/// that millisecond. IDs order by `ms` first, then `seq`.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord, Hash, Default)]
+pub struct StreamId {
+	pub ms: u64,
+	pub seq: u64,
+}
+
+impl StreamId {
+	pub const MIN: StreamId = StreamId { ms: 0, seq: 0 };
+	pub const MAX: StreamId = StreamId {
+		ms: u64::MAX,
+		seq: u64::MAX,
+	};
+
+	pub const fn new(ms: u64, seq: u64) -> Self {
+		Self { ms, seq }
+	}
+
+	/// Parse `<ms>-<seq>`, or a bare `<ms>` with `missing_seq` as sequence.
+	pub fn parse(bytes: &[u8], missing_seq: u64) -> Option<Self> {
+		let s = std::str::from_utf8(bytes).ok()?;
+		let parse_part = |part: &str| {
+			if part.is_empty() || !part.bytes().all(|b| b.is_ascii_digit()) {
+				return None;
+			}
+			part.parse::<u64>().ok()
+		};
+		match s.split_once('-') {
+			Some((ms, seq)) => Some(Self::new(parse_part(ms)?, parse_part(seq)?)),
+			None => Some(Self::new(parse_part(s)?, missing_seq)),
+		}
+	}
+
+	/// The smallest ID greater than this one.
+	pub fn next(self) -> Option<Self> {
+		match self.seq.checked_add(1) {
+			Some(seq) => Some(Self::new(self.ms, seq)),
+			None => self.ms.checked_add(1).map(|ms| Self::new(ms, 0)),
+		}
+	}
+
+	/// The greatest ID smaller than this one.
+	pub fn prev(self) -> Option<Self> {
+		match self.seq.checked_sub(1) {
+			Some(seq) => Some(Self::new(self.ms, seq)),
+			None => self.ms.checked_sub(1).map(|ms| Self::new(ms, u64::MAX)),
+		}
+	}
+
+	pub fn to_bytes(self) -> [u8; 16] {
+		let mut bytes = [0u8; 16];
+		bytes[..8].copy_from_slice(&self.ms.to_be_bytes());
+		bytes[8..].copy_from_slice(&self.seq.to_be_bytes());
+		bytes
+	}
+
+	pub fn from_bytes(bytes: &[u8]) -> Option<Self> {
+		let ms = u64::from_be_bytes(bytes.get(..8)?.try_into().ok()?);
+		let seq = u64::from_be_bytes(bytes.get(8..16)?.try_into().ok()?);
+		Some(Self::new(ms, seq))
+	}
+}
+
+impl fmt::Display for StreamId {
+	fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+		write!(f, "{}-{}", self.ms, self.seq)
+	}
+}
+
+/// The ID requested for a new entry.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum StreamIdSpec {
+	/// `*`: generate the whole ID from the current time.
+	Auto,
+	/// `<ms>-*`: generate the sequence number within `ms`.
+	AutoSeq(u64),
+	/// `<ms>-<seq>`.
+	Explicit(StreamId),
+}
+
+impl StreamIdSpec {
+	/// Resolve the ID of an entry added after `last`, at `now_ms`.
+	pub fn resolve(self, last: StreamId, now_ms: u64) -> Result<StreamId, StorageError> {
+		let id = match self {
+			Self::Auto if now_ms > last.ms => Some(StreamId::new(now_ms, 0)),
+			Self::Auto => Some(last.next().ok_or_else(exhausted)?),
+			Self::AutoSeq(ms) if ms == last.ms => Some(StreamId::new(
+				ms,
+				last.seq.checked_add(1).ok_or_else(too_small)?,
+			)),
+			// 0-0 is never a valid entry ID, so the first ID of 0 is 0-1.
+			Self::AutoSeq(ms) if ms > last.ms => Some(StreamId::new(ms, u64::from(ms == 0))),
+			Self::Explicit(id) if id > last => Some(id),
+			_ => None,
+		};
+		id.ok_or_else(too_small)
+	}
+}
+
+fn exhausted() -> StorageError {
+	StorageError::InvalidArgument {
+		message: "ERR The stream has exhausted the last possible ID, unable to add more items"
+			.to_string(),
+	}
+}
+
+fn too_small() -> StorageError {
+	StorageError::InvalidArgument {
+		message: "ERR The ID specified in XADD is equal or smaller than the target stream top item"
+			.to_string(),
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use rstest::rstest;
+
+	use super::*;
+
+	#[rstest]
+	#[case(b"1-2", 0, Some(StreamId::new(1, 2)))]
+	#[case(b"5", 0, Some(StreamId::new(5, 0)))]
+	#[case(b"5", u64::MAX, Some(StreamId::new(5, u64::MAX)))]
+	#[case(b"18446744073709551615-18446744073709551615", 0, Some(StreamId::MAX))]
+	#[case(b"1-", 0, None)]
+	#[case(b"-1", 0, None)]
+	#[case(b"+1-1", 0, None)]
+	#[case(b"1-2-3", 0, None)]
+	#[case(b"abc", 0, None)]
+	fn test_parse(
+		#[case] input: &[u8],
+		#[case] missing_seq: u64,
+		#[case] expected: Option<StreamId>,
+	) {
+		assert_eq!(StreamId::parse(input, missing_seq), expected);
+	}
+
+	#[test]
+	fn test_next_and_prev() {
+		assert_eq!(StreamId::new(1, 1).next(), Some(StreamId::new(1, 2)));
+		assert_eq!(StreamId::new(1, u64::MAX).next(), Some(StreamId::new(2, 0)));
+		assert_eq!(StreamId::MAX.next(), None);
+		assert_eq!(StreamId::new(2, 0).prev(), Some(StreamId::new(1, u64::MAX)));
+		assert_eq!(StreamId::MIN.prev(), None);
+	}
+
+	#[test]
+	fn test_bytes_sort_like_ids() {
+		let ids = [
+			StreamId::new(0, 1),
+			StreamId::new(1, 0),
+			StreamId::new(1, 256),
+			StreamId::new(256, 0),
+		];
+		for pair in ids.windows(2) {
+			assert!(pair[0].to_bytes() < pair[1].to_bytes());
+			assert_eq!(StreamId::from_bytes(&pair[0].to_bytes()), Some(pair[0]));
+		}
+	}
+
+	#[test]
+	fn test_resolve() {
+		let last = StreamId::new(100, 5);
+		assert_eq!(
+			StreamIdSpec::Auto.resolve(last, 200).unwrap(),
+			StreamId::new(200, 0)
+		);
+		// A clock behind the last entry keeps the IDs increasing.
+		assert_eq!(
+			StreamIdSpec::Auto.resolve(last, 50).unwrap(),
+			StreamId::new(100, 6)
+		);
+		assert_eq!(
+			StreamIdSpec::AutoSeq(100).resolve(last, 0).unwrap(),
+			StreamId::new(100, 6)
+		);
+		assert_eq!(
+			StreamIdSpec::AutoSeq(101).resolve(last, 0).unwrap(),
+			StreamId::new(101, 0)
+		);
+		assert_eq!(
+			StreamIdSpec::AutoSeq(0).resolve(StreamId::MIN, 0).unwrap(),
+			StreamId::new(0, 1)
+		);
+		assert!(StreamIdSpec::AutoSeq(99).resolve(last, 0).is_err());
+		assert!(StreamIdSpec::Explicit(last).resolve(last, 0).is_err());
+		assert_eq!(
+			StreamIdSpec::Explicit(StreamId::new(100, 6))
+				.resolve(last, 0)
+				.unwrap(),
+			StreamId::new(100, 6)
+		);
+		assert!(StreamIdSpec::Auto.resolve(StreamId::MAX, 0).is_err());
+	}
+}
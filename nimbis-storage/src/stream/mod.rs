@@ -0,0 +1,6 @@
+pub mod consumer;
+pub mod entry_key;
+pub mod entry_value;
+pub mod group;
+pub mod id;
+pub mod pending;
@@ -0,0 +1,121 @@
+use bytes::Buf;
+use bytes::BufMut;
+use bytes::Bytes;
+use bytes::BytesMut;
+
+use crate::error::DecoderError;
+use crate::stream::id::StreamId;
+use crate::utils::stream_pending_group_prefix;
+
+/// Key of one entry in a group's pending entries list (PEL): delivered to a
+/// consumer but not acknowledged yet.
+#[derive(Debug, PartialEq)]
+pub struct StreamPendingKey {
+	user_key: Bytes,
+	group: Bytes,
+	id: StreamId,
+}
+
+impl StreamPendingKey {
+	pub fn new(user_key: impl Into<Bytes>, group: impl Into<Bytes>, id: StreamId) -> Self {
+		Self {
+			user_key: user_key.into(),
+			group: group.into(),
+			id,
+		}
+	}
+
+	pub fn encode(&self) -> Bytes {
+		// Key format: len(user_key) (u16 BE) + user_key + b'P' + len(group)
+		// (u32 BE) + group + ms (u64 BE) + seq (u64 BE). The PEL of a group is
+		// one key range sorted by ID.
+		let prefix = stream_pending_group_prefix(&self.user_key, &self.group);
+		let mut bytes = BytesMut::with_capacity(prefix.len() + 16);
+		bytes.extend_from_slice(&prefix);
+		bytes.extend_from_slice(&self.id.to_bytes());
+		bytes.freeze()
+	}
+
+	/// Decode the entry ID from an encoded key, which ends with it.
+	pub fn decode_id(encoded: &[u8]) -> Option<StreamId> {
+		let start = encoded.len().checked_sub(16)?;
+		StreamId::from_bytes(&encoded[start..])
+	}
+
+	/// Returns the user_key from this pending key.
+	pub fn user_key(&self) -> &Bytes {
+		&self.user_key
+	}
+}
+
+/// Delivery state of one pending entry.
+#[derive(Debug, Clone, PartialEq)]
+pub struct StreamPendingValue {
+	/// Consumer that owns the entry.
+	pub consumer: Bytes,
+	/// Last delivery, in milliseconds since the epoch.
+	pub delivery_time: u64,
+	pub delivery_count: u64,
+}
+
+impl StreamPendingValue {
+	pub fn new(consumer: impl Into<Bytes>, delivery_time: u64) -> Self {
+		Self {
+			consumer: consumer.into(),
+			delivery_time,
+			delivery_count: 1,
+		}
+	}
+
+	/// Milliseconds since the last delivery, as of `now`.
+	pub fn idle(&self, now: u64) -> u64 {
+		now.saturating_sub(self.delivery_time)
+	}
+
+	pub fn encode(&self) -> Bytes {
+		// Value format: delivery_time (u64 BE) + delivery_count (u64 BE) + consumer
+		let mut bytes = BytesMut::with_capacity(16 + self.consumer.len());
+		bytes.put_u64(self.delivery_time);
+		bytes.put_u64(self.delivery_count);
+		bytes.extend_from_slice(&self.consumer);
+		bytes.freeze()
+	}
+
+	pub fn decode(bytes: &Bytes) -> Result<Self, DecoderError> {
+		if bytes.len() < 16 {
+			return Err(DecoderError::InvalidLength);
+		}
+		let mut buf = &bytes[..];
+		let delivery_time = buf.get_u64();
+		let delivery_count = buf.get_u64();
+		Ok(Self {
+			consumer: bytes.slice(16..),
+			delivery_time,
+			delivery_count,
+		})
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+
+	#[test]
+	fn test_stream_pending_key_encode() {
+		let id = StreamId::new(5, 1);
+		let encoded = StreamPendingKey::new(Bytes::from("s"), Bytes::from("g1"), id).encode();
+		// Verify format: key_len(u16) + key + b'P' + group_len(u32) + group + id
+		assert_eq!(&encoded[..3], &[0, 1, b's']);
+		assert_eq!(encoded[3], b'P');
+		assert_eq!(&encoded[4..8], &2u32.to_be_bytes());
+		assert_eq!(&encoded[8..10], b"g1");
+		assert_eq!(StreamPendingKey::decode_id(&encoded), Some(id));
+	}
+
+	#[test]
+	fn test_stream_pending_value_round_trip() {
+		let mut value = StreamPendingValue::new(Bytes::from("alice"), 42);
+		value.delivery_count = 3;
+		assert_eq!(StreamPendingValue::decode(&value.encode()).unwrap(), value);
+	}
+}
@@ -0,0 +1,121 @@
+use bytes::Buf;
+use bytes::BufMut;
+use bytes::Bytes;
+use bytes::BytesMut;
+
+use crate::data_type::DataType;
+use crate::error::DecoderError;
+use crate::string::meta::MetaValue;
+
+/// A value owned by a server extension. Storage only knows the extension's
+/// type name; the payload is encoded and decoded by the extension itself.
+#[derive(Debug, PartialEq, Clone)]
+pub struct ExtensionValue {
+	/// At most 255 bytes.
+	pub type_name: Bytes,
+	pub payload: Bytes,
+	pub expire_time: u64,
+}
+
+impl ExtensionValue {
+	pub fn new(type_name: impl Into<Bytes>, payload: impl Into<Bytes>) -> Self {
+		Self {
+			type_name: type_name.into(),
+			payload: payload.into(),
+			expire_time: 0,
+		}
+	}
+
+	pub fn encode(&self) -> Bytes {
+		debug_assert!(self.type_name.len() <= u8::MAX as usize);
+		// [Type: 'x'] [TypeNameLen: u8] [TypeName] [Payload]
+		let mut bytes = BytesMut::with_capacity(2 + self.type_name.len() + self.payload.len());
+		bytes.put_u8(DataType::Extension as u8);
+		bytes.put_u8(self.type_name.len() as u8);
+		bytes.extend_from_slice(&self.type_name);
+		bytes.extend_from_slice(&self.payload);
+		bytes.freeze()
+	}
+
+	pub fn decode(bytes: &[u8]) -> Result<Self, DecoderError> {
+		if bytes.is_empty() {
+			return Err(DecoderError::Empty);
+		}
+		let mut buf = bytes;
+		if buf.get_u8() != DataType::Extension as u8 {
+			return Err(DecoderError::InvalidType);
+		}
+		if !buf.has_remaining() {
+			return Err(DecoderError::InvalidLength);
+		}
+		let name_len = buf.get_u8() as usize;
+		if buf.remaining() < name_len {
+			return Err(DecoderError::InvalidLength);
+		}
+		let type_name = Bytes::copy_from_slice(&buf[..name_len]);
+		buf.advance(name_len);
+		Ok(Self::new(type_name, Bytes::copy_from_slice(buf)))
+	}
+}
+
+impl MetaValue for ExtensionValue {
+	fn decode(bytes: &[u8]) -> Result<Self, DecoderError> {
+		Self::decode(bytes)
+	}
+
+	fn is_type_match(type_code: u8) -> bool {
+		type_code == DataType::Extension as u8
+	}
+
+	fn data_type() -> Option<DataType> {
+		Some(DataType::Extension)
+	}
+
+	fn encode(&self) -> Bytes {
+		self.encode()
+	}
+
+	fn expire_time(&self) -> u64 {
+		self.expire_time
+	}
+
+	fn set_expire_time(&mut self, timestamp: u64) {
+		self.expire_time = timestamp;
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use rstest::rstest;
+
+	use super::*;
+
+	#[rstest]
+	#[case("bloom", "")]
+	#[case("bloom", "\x00\x01payload")]
+	#[case("", "payload")]
+	fn test_roundtrip(#[case] type_name: &str, #[case] payload: &str) {
+		let original = ExtensionValue::new(
+			Bytes::copy_from_slice(type_name.as_bytes()),
+			Bytes::copy_from_slice(payload.as_bytes()),
+		);
+		let encoded = original.encode();
+		assert_eq!(encoded[0], DataType::Extension as u8);
+		assert_eq!(ExtensionValue::decode(&encoded).unwrap(), original);
+	}
+
+	#[test]
+	fn test_decode_errors() {
+		let err = ExtensionValue::decode(b"").unwrap_err();
+		assert!(matches!(err, DecoderError::Empty));
+
+		let err = ExtensionValue::decode(b"svalue").unwrap_err();
+		assert!(matches!(err, DecoderError::InvalidType));
+
+		let err = ExtensionValue::decode(b"x").unwrap_err();
+		assert!(matches!(err, DecoderError::InvalidLength));
+
+		let err = ExtensionValue::decode(b"x\x05blo").unwrap_err();
+		assert!(matches!(err, DecoderError::InvalidLength));
+	}
+}
@@ -5,8 +5,11 @@ use bytes::BufMut;
 use bytes::Bytes;
 use bytes::BytesMut;
 
+use crate::compression::COMPRESSED_STRING;
 use crate::data_type::DataType;
 use crate::error::DecoderError;
+use crate::stream::id::StreamId;
+use crate::string::extension::ExtensionValue;
 use crate::string::value::StringValue;
 
 /// Trait for values stored in the string database that carry TTL and type
@@ -51,7 +54,7 @@ impl MetaValue for StringValue {
 	}
 
 	fn is_type_match(type_code: u8) -> bool {
-		type_code == DataType::String as u8
+		type_code == DataType::String as u8 || type_code == COMPRESSED_STRING
 	}
 
 	fn data_type() -> Option<DataType> {
@@ -402,6 +405,184 @@ impl MetaValue for ZSetMetaValue {
 	}
 }
 
+#[derive(Debug, PartialEq)]
+pub struct StreamMetaValue {
+	pub version: u64,
+	pub len: u64,
+	/// ID of the newest entry ever added, new IDs must be greater than it even
+	/// after that entry is deleted.
+	pub last_id: StreamId,
+	pub entries_added: u64,
+	/// Entries with IDs up to this one were trimmed. They are invisible at
+	/// once and dropped by compaction later.
+	pub trimmed_id: StreamId,
+	/// Greatest ID deleted by XDEL, `0-0` if none. Consumer group lag is
+	/// only known for reads past it.
+	pub max_deleted_id: StreamId,
+	pub expire_time: u64,
+}
+
+impl StreamMetaValue {
+	pub fn new(version: u64) -> Self {
+		Self {
+			version,
+			len: 0,
+			last_id: StreamId::MIN,
+			entries_added: 0,
+			trimmed_id: StreamId::MIN,
+			max_deleted_id: StreamId::MIN,
+			expire_time: 0,
+		}
+	}
+
+	pub fn encode(&self) -> Bytes {
+		let mut bytes = BytesMut::with_capacity(1 + 8 + 8 + 16 + 8 + 16 + 16 + 8);
+		bytes.put_u8(DataType::Stream as u8);
+		bytes.put_u64(self.version);
+		bytes.put_u64(self.len);
+		bytes.extend_from_slice(&self.last_id.to_bytes());
+		bytes.put_u64(self.entries_added);
+		bytes.extend_from_slice(&self.trimmed_id.to_bytes());
+		bytes.extend_from_slice(&self.max_deleted_id.to_bytes());
+		bytes.put_u64(self.expire_time);
+		bytes.freeze()
+	}
+
+	pub fn decode(bytes: &[u8]) -> Result<Self, DecoderError> {
+		if bytes.len() < 81 {
+			return Err(DecoderError::InvalidLength);
+		}
+
+		let mut buf = bytes;
+		let type_code = buf.get_u8();
+		if type_code != DataType::Stream as u8 {
+			return Err(DecoderError::InvalidType);
+		}
+		let version = buf.get_u64();
+		let len = buf.get_u64();
+		let last_ms = buf.get_u64();
+		let last_seq = buf.get_u64();
+		let last_id = StreamId::new(last_ms, last_seq);
+		let entries_added = buf.get_u64();
+		let trimmed_ms = buf.get_u64();
+		let trimmed_seq = buf.get_u64();
+		let trimmed_id = StreamId::new(trimmed_ms, trimmed_seq);
+		let deleted_ms = buf.get_u64();
+		let deleted_seq = buf.get_u64();
+		let max_deleted_id = StreamId::new(deleted_ms, deleted_seq);
+		let expire_time = buf.get_u64();
+		Ok(Self {
+			version,
+			len,
+			last_id,
+			entries_added,
+			trimmed_id,
+			max_deleted_id,
+			expire_time,
+		})
+	}
+}
+
+impl MetaValue for StreamMetaValue {
+	fn decode(bytes: &[u8]) -> Result<Self, DecoderError> {
+		Self::decode(bytes)
+	}
+
+	fn is_type_match(type_code: u8) -> bool {
+		type_code == DataType::Stream as u8
+	}
+
+	fn data_type() -> Option<DataType> {
+		Some(DataType::Stream)
+	}
+
+	fn encode(&self) -> Bytes {
+		self.encode()
+	}
+
+	fn expire_time(&self) -> u64 {
+		self.expire_time
+	}
+
+	fn set_expire_time(&mut self, timestamp: u64) {
+		self.expire_time = timestamp;
+	}
+}
+
+#[derive(Debug, Clone, PartialEq)]
+pub struct BitmapMetaValue {
+	pub version: u64,
+	/// Length of the string in bytes. Chunks past the last one written read
+	/// as zeros.
+	pub len: u64,
+	pub expire_time: u64,
+}
+
+impl BitmapMetaValue {
+	pub fn new(version: u64, len: u64) -> Self {
+		Self {
+			version,
+			len,
+			expire_time: 0,
+		}
+	}
+
+	pub fn encode(&self) -> Bytes {
+		let mut bytes = BytesMut::with_capacity(1 + 8 + 8 + 8);
+		bytes.put_u8(DataType::Bitmap as u8);
+		bytes.put_u64(self.version);
+		bytes.put_u64(self.len);
+		bytes.put_u64(self.expire_time);
+		bytes.freeze()
+	}
+
+	pub fn decode(bytes: &[u8]) -> Result<Self, DecoderError> {
+		if bytes.len() < 25 {
+			return Err(DecoderError::InvalidLength);
+		}
+
+		let mut buf = bytes;
+		let type_code = buf.get_u8();
+		if type_code != DataType::Bitmap as u8 {
+			return Err(DecoderError::InvalidType);
+		}
+		let version = buf.get_u64();
+		let len = buf.get_u64();
+		let expire_time = buf.get_u64();
+		Ok(Self {
+			version,
+			len,
+			expire_time,
+		})
+	}
+}
+
+impl MetaValue for BitmapMetaValue {
+	fn decode(bytes: &[u8]) -> Result<Self, DecoderError> {
+		Self::decode(bytes)
+	}
+
+	fn is_type_match(type_code: u8) -> bool {
+		type_code == DataType::Bitmap as u8
+	}
+
+	fn data_type() -> Option<DataType> {
+		Some(DataType::Bitmap)
+	}
+
+	fn encode(&self) -> Bytes {
+		self.encode()
+	}
+
+	fn expire_time(&self) -> u64 {
+		self.expire_time
+	}
+
+	fn set_expire_time(&mut self, timestamp: u64) {
+		self.expire_time = timestamp;
+	}
+}
+
 /// Enum representing any value or metadata stored in the string database.
 pub enum AnyValue {
 	String(StringValue),
@@ -409,6 +590,9 @@ pub enum AnyValue {
 	List(ListMetaValue),
 	Set(SetMetaValue),
 	ZSet(ZSetMetaValue),
+	Stream(StreamMetaValue),
+	Bitmap(BitmapMetaValue),
+	Extension(ExtensionValue),
 }
 
 impl AnyValue {
@@ -416,12 +600,18 @@ impl AnyValue {
 		if bytes.is_empty() {
 			return Err(DecoderError::Empty);
 		}
+		if bytes[0] == COMPRESSED_STRING {
+			return Ok(Self::String(StringValue::decode(bytes)?));
+		}
 		match DataType::from_u8(bytes[0]) {
 			Some(DataType::String) => Ok(Self::String(StringValue::decode(bytes)?)),
 			Some(DataType::Hash) => Ok(Self::Hash(HashMetaValue::decode(bytes)?)),
 			Some(DataType::List) => Ok(Self::List(ListMetaValue::decode(bytes)?)),
 			Some(DataType::Set) => Ok(Self::Set(SetMetaValue::decode(bytes)?)),
 			Some(DataType::ZSet) => Ok(Self::ZSet(ZSetMetaValue::decode(bytes)?)),
+			Some(DataType::Stream) => Ok(Self::Stream(StreamMetaValue::decode(bytes)?)),
+			Some(DataType::Bitmap) => Ok(Self::Bitmap(BitmapMetaValue::decode(bytes)?)),
+			Some(DataType::Extension) => Ok(Self::Extension(ExtensionValue::decode(bytes)?)),
 			None => Err(DecoderError::InvalidType),
 		}
 	}
@@ -433,6 +623,9 @@ impl AnyValue {
 			Self::List(_) => DataType::List,
 			Self::Set(_) => DataType::Set,
 			Self::ZSet(_) => DataType::ZSet,
+			Self::Stream(_) => DataType::Stream,
+			Self::Bitmap(_) => DataType::Bitmap,
+			Self::Extension(_) => DataType::Extension,
 		}
 	}
 
@@ -443,16 +636,34 @@ impl AnyValue {
 			Self::List(v) => v.encode(),
 			Self::Set(v) => v.encode(),
 			Self::ZSet(v) => v.encode(),
+			Self::Stream(v) => v.encode(),
+			Self::Bitmap(v) => v.encode(),
+			Self::Extension(v) => v.encode(),
 		}
 	}
 
 	pub fn version(&self) -> Option<u64> {
 		match self {
-			Self::String(_) => None,
+			Self::String(_) | Self::Extension(_) => None,
 			Self::Hash(v) => Some(v.version),
 			Self::List(v) => Some(v.version),
 			Self::Set(v) => Some(v.version),
 			Self::ZSet(v) => Some(v.version),
+			Self::Stream(v) => Some(v.version),
+			Self::Bitmap(v) => Some(v.version),
+		}
+	}
+
+	/// Change the version of a collection meta; other values have none.
+	pub fn set_version(&mut self, version: u64) {
+		match self {
+			Self::String(_) | Self::Extension(_) => {}
+			Self::Hash(v) => v.version = version,
+			Self::List(v) => v.version = version,
+			Self::Set(v) => v.version = version,
+			Self::ZSet(v) => v.version = version,
+			Self::Stream(v) => v.version = version,
+			Self::Bitmap(v) => v.version = version,
 		}
 	}
 }
@@ -487,6 +698,24 @@ impl From<ZSetMetaValue> for AnyValue {
 	}
 }
 
+impl From<StreamMetaValue> for AnyValue {
+	fn from(v: StreamMetaValue) -> Self {
+		Self::Stream(v)
+	}
+}
+
+impl From<BitmapMetaValue> for AnyValue {
+	fn from(v: BitmapMetaValue) -> Self {
+		Self::Bitmap(v)
+	}
+}
+
+impl From<ExtensionValue> for AnyValue {
+	fn from(v: ExtensionValue) -> Self {
+		Self::Extension(v)
+	}
+}
+
 impl MetaValue for AnyValue {
 	fn decode(bytes: &[u8]) -> Result<Self, DecoderError> {
 		Self::decode(bytes)
@@ -507,6 +736,9 @@ impl MetaValue for AnyValue {
 			Self::List(v) => v.expire_time(),
 			Self::Set(v) => v.expire_time(),
 			Self::ZSet(v) => v.expire_time(),
+			Self::Stream(v) => v.expire_time(),
+			Self::Bitmap(v) => v.expire_time(),
+			Self::Extension(v) => v.expire_time(),
 		}
 	}
 
@@ -517,6 +749,9 @@ impl MetaValue for AnyValue {
 			Self::List(v) => v.set_expire_time(timestamp),
 			Self::Set(v) => v.set_expire_time(timestamp),
 			Self::ZSet(v) => v.set_expire_time(timestamp),
+			Self::Stream(v) => v.set_expire_time(timestamp),
+			Self::Bitmap(v) => v.set_expire_time(timestamp),
+			Self::Extension(v) => v.set_expire_time(timestamp),
 		}
 	}
 }
@@ -640,6 +875,35 @@ mod tests {
 		assert_eq!(decoded, val);
 	}
 
+	#[test]
+	fn test_stream_meta_value_encode_decode() {
+		let val = StreamMetaValue {
+			version: 1,
+			len: 3,
+			last_id: StreamId::new(1526919030474, 55),
+			entries_added: 4,
+			trimmed_id: StreamId::new(1526919030000, 1),
+			max_deleted_id: StreamId::new(1526919030000, 2),
+			expire_time: 123456789,
+		};
+		let encoded = val.encode();
+		assert_eq!(encoded.len(), 81);
+		assert_eq!(encoded[0], b't');
+		let decoded = StreamMetaValue::decode(&encoded).unwrap();
+		assert_eq!(decoded, val);
+	}
+
+	#[test]
+	fn test_bitmap_meta_value_encode_decode() {
+		let mut val = BitmapMetaValue::new(1, 4096);
+		val.expire_time = 123456789;
+		let encoded = val.encode();
+		assert_eq!(encoded.len(), 25);
+		assert_eq!(encoded[0], b'b');
+		let decoded = BitmapMetaValue::decode(&encoded).unwrap();
+		assert_eq!(decoded, val);
+	}
+
 	#[test]
 	fn test_remaining_ttl() {
 		let mut val = HashMetaValue::new(1, 10);
@@ -1,3 +1,4 @@
+pub mod extension;
 pub mod key;
 pub mod meta;
 pub mod value;
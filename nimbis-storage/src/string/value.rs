@@ -3,6 +3,8 @@ use bytes::BufMut;
 use bytes::Bytes;
 use bytes::BytesMut;
 
+use crate::compression;
+use crate::compression::COMPRESSED_STRING;
 use crate::data_type::DataType;
 use crate::error::DecoderError;
 
@@ -31,10 +33,11 @@ impl StringValue {
 			return Err(DecoderError::Empty);
 		}
 		let mut buf = bytes;
-		if buf.get_u8() != DataType::String as u8 {
-			return Err(DecoderError::InvalidType);
+		match buf.get_u8() {
+			COMPRESSED_STRING => Ok(Self::new(compression::decompress(buf)?)),
+			code if code == DataType::String as u8 => Ok(Self::new(Bytes::copy_from_slice(buf))),
+			_ => Err(DecoderError::InvalidType),
 		}
-		Ok(Self::new(Bytes::copy_from_slice(buf)))
 	}
 }
 
@@ -25,3 +25,45 @@ pub fn zset_score_user_key_prefix(key: &Bytes) -> Bytes {
 	prefix.put_u8(b'S');
 	prefix.freeze()
 }
+
+/// Build stream entry-key prefix:
+/// len(user_key) (u16 BE) + user_key + b'E'.
+pub fn stream_entry_user_key_prefix(key: &Bytes) -> Bytes {
+	let mut prefix = BytesMut::with_capacity(2 + key.len() + 1);
+	prefix.put_u16(key.len() as u16);
+	prefix.extend_from_slice(key);
+	prefix.put_u8(b'E');
+	prefix.freeze()
+}
+
+/// Build stream group-key prefix:
+/// len(user_key) (u16 BE) + user_key + b'G'.
+pub fn stream_group_user_key_prefix(key: &Bytes) -> Bytes {
+	let mut prefix = BytesMut::with_capacity(2 + key.len() + 1);
+	prefix.put_u16(key.len() as u16);
+	prefix.extend_from_slice(key);
+	prefix.put_u8(b'G');
+	prefix.freeze()
+}
+
+/// Build the prefix of the consumer keys of one stream group:
+/// len(user_key) (u16 BE) + user_key + b'C' + len(group) (u32 BE) + group.
+pub fn stream_consumer_group_prefix(key: &Bytes, group: &Bytes) -> Bytes {
+	stream_group_record_prefix(key, b'C', group)
+}
+
+/// Build the prefix of the pending-entry keys of one stream group:
+/// len(user_key) (u16 BE) + user_key + b'P' + len(group) (u32 BE) + group.
+pub fn stream_pending_group_prefix(key: &Bytes, group: &Bytes) -> Bytes {
+	stream_group_record_prefix(key, b'P', group)
+}
+
+fn stream_group_record_prefix(key: &Bytes, tag: u8, group: &Bytes) -> Bytes {
+	let mut prefix = BytesMut::with_capacity(2 + key.len() + 1 + 4 + group.len());
+	prefix.put_u16(key.len() as u16);
+	prefix.extend_from_slice(key);
+	prefix.put_u8(tag);
+	prefix.put_u32(group.len() as u32);
+	prefix.extend_from_slice(group);
+	prefix.freeze()
+}
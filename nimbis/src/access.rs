@@ -0,0 +1,521 @@
+//! Approximate key access statistics, for eviction and OBJECT IDLETIME/FREQ.
+//!
+//! Like Redis, each key accessed by a command gets 24 bits of recency and
+//! frequency kept in memory, so reads never write to storage:
+//!
+//! - The LRU clock is the Unix time in seconds, wrapping every 2^24 seconds
+//!   (about 194 days). The idle time of a key is the distance between its clock
+//!   and the current one.
+//! - The LFU counter is an 8-bit logarithmic counter: an access increments it
+//!   with a probability that falls as it grows, scaled by `lfu_log_factor`, so
+//!   255 stands for about a million accesses. It is decremented by one for
+//!   every `lfu_decay_time` minutes the key went unaccessed, tracked with a
+//!   16-bit clock in minutes.
+//!
+//! New keys start at [`LFU_INIT_VAL`] so they are not the first to go.
+//! Eviction does not rank every key: [`AccessTracker::eviction_candidate`]
+//! samples a few tracked keys at random and picks the idlest or least
+//! frequently used one, as Redis does with `maxmemory-samples`.
+
+use std::collections::HashMap;
+use std::hash::BuildHasher;
+use std::hash::RandomState;
+use std::sync::Mutex;
+use std::time::SystemTime;
+use std::time::UNIX_EPOCH;
+
+use bytes::Bytes;
+
+use crate::GCTX;
+use crate::acl;
+use crate::server_config;
+
+/// The counter a new key starts with.
+pub const LFU_INIT_VAL: u8 = 5;
+const LRU_CLOCK_MAX: u32 = (1 << 24) - 1;
+const SHARDS: usize = 16;
+
+/// Commands that look at keys without counting as an access.
+const NOTOUCH_CMDS: &[&str] = &[
+	"OBJECT",
+	"TTL",
+	"EXISTS",
+	"MEMORY",
+	"RESTORE",
+	"RESTORE-ASKING",
+];
+
+/// Commands that delete every key they are given.
+const DELETE_CMDS: &[&str] = &["DEL", "MIGRATE"];
+
+/// How eviction ranks keys.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum EvictionPolicy {
+	/// Evict the key idle for longest.
+	Lru,
+	/// Evict the key accessed least frequently.
+	Lfu,
+}
+
+/// The statistics of one key.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+struct Access {
+	/// The LRU clock of the last access.
+	lru: u32,
+	/// The minute clock of the last LFU decrement.
+	ldt: u16,
+	counter: u8,
+}
+
+/// The current time on the LRU clock and the LFU minute clock.
+#[derive(Debug, Clone, Copy)]
+struct Clock {
+	seconds: u32,
+	minutes: u16,
+}
+
+impl Clock {
+	fn now() -> Self {
+		let secs = SystemTime::now()
+			.duration_since(UNIX_EPOCH)
+			.map(|d| d.as_secs())
+			.unwrap_or_default();
+		Self::at(secs)
+	}
+
+	fn at(unix_secs: u64) -> Self {
+		Self {
+			seconds: (unix_secs & LRU_CLOCK_MAX as u64) as u32,
+			minutes: ((unix_secs / 60) & u16::MAX as u64) as u16,
+		}
+	}
+
+	/// Seconds since the LRU clock read `lru`, allowing for one wrap.
+	fn idle_since(self, lru: u32) -> u64 {
+		if self.seconds >= lru {
+			(self.seconds - lru) as u64
+		} else {
+			(self.seconds as u64 + LRU_CLOCK_MAX as u64) - lru as u64
+		}
+	}
+
+	/// Minutes since the minute clock read `ldt`, allowing for one wrap.
+	fn minutes_since(self, ldt: u16) -> u64 {
+		if self.minutes >= ldt {
+			(self.minutes - ldt) as u64
+		} else {
+			(self.minutes as u64 + u16::MAX as u64 + 1) - ldt as u64
+		}
+	}
+}
+
+/// The LFU settings in effect.
+#[derive(Debug, Clone, Copy)]
+struct LfuParams {
+	log_factor: u32,
+	decay_time: u64,
+}
+
+impl LfuParams {
+	fn current() -> Self {
+		Self {
+			log_factor: server_config!(lfu_log_factor),
+			decay_time: server_config!(lfu_decay_time),
+		}
+	}
+}
+
+impl Access {
+	fn new(clock: Clock) -> Self {
+		Self {
+			lru: clock.seconds,
+			ldt: clock.minutes,
+			counter: LFU_INIT_VAL,
+		}
+	}
+
+	/// The counter after the decay for the minutes since the last one.
+	fn decayed(&self, clock: Clock, params: LfuParams) -> u8 {
+		if params.decay_time == 0 {
+			return self.counter;
+		}
+		let periods = clock.minutes_since(self.ldt) / params.decay_time;
+		self.counter
+			.saturating_sub(periods.min(u8::MAX as u64) as u8)
+	}
+
+	/// Record an access; `roll` is a uniform random number in [0, 1).
+	fn touch(&mut self, clock: Clock, params: LfuParams, roll: f64) {
+		let mut counter = self.decayed(clock, params);
+		if counter < u8::MAX {
+			let base = counter.saturating_sub(LFU_INIT_VAL) as f64;
+			if roll < 1.0 / (base * params.log_factor as f64 + 1.0) {
+				counter += 1;
+			}
+		}
+		self.counter = counter;
+		self.lru = clock.seconds;
+		self.ldt = clock.minutes;
+	}
+}
+
+/// The tracked keys of one shard, in a vector so a random one can be
+/// picked in constant time.
+#[derive(Debug, Default)]
+struct Shard {
+	index: HashMap<Bytes, usize>,
+	entries: Vec<(Bytes, Access)>,
+}
+
+impl Shard {
+	fn remove(&mut self, key: &[u8]) {
+		let Some(at) = self.index.remove(key) else {
+			return;
+		};
+		self.entries.swap_remove(at);
+		if let Some((moved, _)) = self.entries.get(at) {
+			self.index.insert(moved.clone(), at);
+		}
+	}
+
+	fn get_or_insert(&mut self, key: &Bytes, clock: Clock) -> (&mut Access, bool) {
+		match self.index.get(key) {
+			Some(&at) => (&mut self.entries[at].1, false),
+			None => {
+				self.index.insert(key.clone(), self.entries.len());
+				self.entries.push((key.clone(), Access::new(clock)));
+				(&mut self.entries.last_mut().unwrap().1, true)
+			}
+		}
+	}
+}
+
+/// Access statistics of the keys commands have used since startup. Keys
+/// leave it when they are deleted or expire.
+#[derive(Debug)]
+pub struct AccessTracker {
+	shards: Vec<Mutex<Shard>>,
+	hasher: RandomState,
+	/// When the server started, the access time of keys not accessed since.
+	started: Clock,
+}
+
+impl Default for AccessTracker {
+	fn default() -> Self {
+		Self::new()
+	}
+}
+
+impl AccessTracker {
+	pub fn new() -> Self {
+		Self {
+			shards: (0..SHARDS).map(|_| Mutex::default()).collect(),
+			hasher: RandomState::new(),
+			started: Clock::now(),
+		}
+	}
+
+	fn shard(&self, key: &[u8]) -> &Mutex<Shard> {
+		&self.shards[self.hasher.hash_one(key) as usize % SHARDS]
+	}
+
+	/// Record an access to `key`. A key seen for the first time starts at
+	/// [`LFU_INIT_VAL`].
+	pub fn touch(&self, key: &Bytes) {
+		self.touch_with(key, Clock::now(), LfuParams::current(), rand::random());
+	}
+
+	fn touch_with(&self, key: &Bytes, clock: Clock, params: LfuParams, roll: f64) {
+		let mut shard = self.shard(key).lock().unwrap();
+		let (access, new) = shard.get_or_insert(key, clock);
+		if !new {
+			access.touch(clock, params, roll);
+		}
+	}
+
+	/// Set the statistics of `key` as RESTORE's IDLETIME and FREQ ask,
+	/// starting over from a new key's for what is not given.
+	pub fn restore(&self, key: &Bytes, idle: Option<u64>, freq: Option<u8>) {
+		let clock = Clock::now();
+		let mut shard = self.shard(key).lock().unwrap();
+		let (access, _) = shard.get_or_insert(key, clock);
+		*access = Access::new(clock);
+		if let Some(idle) = idle {
+			let idle = idle.min(LRU_CLOCK_MAX as u64) as u32;
+			access.lru = clock.seconds.wrapping_sub(idle) & LRU_CLOCK_MAX;
+		}
+		if let Some(freq) = freq {
+			access.counter = freq;
+		}
+	}
+
+	pub fn forget(&self, key: &[u8]) {
+		self.shard(key).lock().unwrap().remove(key);
+	}
+
+	pub fn clear(&self) {
+		for shard in &self.shards {
+			*shard.lock().unwrap() = Shard::default();
+		}
+	}
+
+	/// Seconds since `key` was last accessed, or since startup if it was
+	/// not accessed since.
+	pub fn idle_time(&self, key: &[u8]) -> u64 {
+		self.idle_time_at(key, Clock::now())
+	}
+
+	fn idle_time_at(&self, key: &[u8], clock: Clock) -> u64 {
+		let lru = self
+			.get(key)
+			.map(|access| access.lru)
+			.unwrap_or(self.started.seconds);
+		clock.idle_since(lru)
+	}
+
+	/// The decayed LFU counter of `key`.
+	pub fn frequency(&self, key: &[u8]) -> u8 {
+		self.frequency_at(key, Clock::now(), LfuParams::current())
+	}
+
+	fn frequency_at(&self, key: &[u8], clock: Clock, params: LfuParams) -> u8 {
+		match self.get(key) {
+			Some(access) => access.decayed(clock, params),
+			None => Access::new(self.started).decayed(clock, params),
+		}
+	}
+
+	/// The number of keys tracked.
+	pub fn len(&self) -> usize {
+		self.shards
+			.iter()
+			.map(|shard| shard.lock().unwrap().entries.len())
+			.sum()
+	}
+
+	pub fn is_empty(&self) -> bool {
+		self.len() == 0
+	}
+
+	/// Sample `samples` tracked keys at random and return the one `policy`
+	/// would evict first. The key may have been removed without this
+	/// tracker knowing, in which case the caller should forget it and ask
+	/// again.
+	pub fn eviction_candidate(&self, policy: EvictionPolicy, samples: usize) -> Option<Bytes> {
+		self.eviction_candidate_at(policy, samples, Clock::now(), LfuParams::current())
+	}
+
+	fn eviction_candidate_at(
+		&self,
+		policy: EvictionPolicy,
+		samples: usize,
+		clock: Clock,
+		params: LfuParams,
+	) -> Option<Bytes> {
+		let mut best: Option<(u64, Bytes)> = None;
+		let mut sampled = 0;
+		// Empty shards are skipped, but give up rather than spin when there
+		// is little or nothing to sample.
+		for _ in 0..samples.saturating_mul(SHARDS) {
+			if sampled == samples {
+				break;
+			}
+			let shard = self.shards[rand::random_range(0..SHARDS)].lock().unwrap();
+			if shard.entries.is_empty() {
+				continue;
+			}
+			sampled += 1;
+			let (key, access) = &shard.entries[rand::random_range(0..shard.entries.len())];
+			// Higher scores are evicted first.
+			let score = match policy {
+				EvictionPolicy::Lru => clock.idle_since(access.lru),
+				EvictionPolicy::Lfu => (u8::MAX - access.decayed(clock, params)) as u64,
+			};
+			if best.as_ref().is_none_or(|(best, _)| score > *best) {
+				best = Some((score, key.clone()));
+			}
+		}
+		best.map(|(_, key)| key)
+	}
+
+	fn get(&self, key: &[u8]) -> Option<Access> {
+		let shard = self.shard(key).lock().unwrap();
+		shard.index.get(key).map(|&at| shard.entries[at].1)
+	}
+}
+
+/// Update the statistics after a command ran `name` with `args`
+/// successfully: its keys count as accessed, or are forgotten if it
+/// deleted them.
+pub fn after_command(name: &str, args: &[Bytes]) {
+	let tracker = GCTX!(access);
+	if name == "FLUSHDB" {
+		tracker.clear();
+	} else if DELETE_CMDS.contains(&name) {
+		for key in acl::command_keys(name, args) {
+			tracker.forget(key);
+		}
+	} else if !NOTOUCH_CMDS.contains(&name) {
+		for key in acl::command_keys(name, args) {
+			tracker.touch(key);
+		}
+	}
+}
+
+/// Forget `key`, which storage found expired.
+pub fn expired(key: &Bytes) {
+	GCTX!(access).forget(key);
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+
+	const PARAMS: LfuParams = LfuParams {
+		log_factor: 10,
+		decay_time: 1,
+	};
+
+	fn key(key: &'static str) -> Bytes {
+		Bytes::from(key)
+	}
+
+	#[test]
+	fn test_idle_time() {
+		let tracker = AccessTracker::new();
+		let start = 1_700_000_000;
+		tracker.touch_with(&key("a"), Clock::at(start), PARAMS, 0.5);
+		assert_eq!(tracker.idle_time_at(b"a", Clock::at(start + 42)), 42);
+
+		tracker.touch_with(&key("a"), Clock::at(start + 50), PARAMS, 0.5);
+		assert_eq!(tracker.idle_time_at(b"a", Clock::at(start + 60)), 10);
+	}
+
+	#[test]
+	fn test_idle_time_across_clock_wrap() {
+		let clock = Clock::at(LRU_CLOCK_MAX as u64 + 5);
+		assert_eq!(clock.seconds, 4);
+		assert_eq!(clock.idle_since(LRU_CLOCK_MAX - 10), 14);
+	}
+
+	#[test]
+	fn test_frequency_grows_logarithmically() {
+		let tracker = AccessTracker::new();
+		let clock = Clock::at(1_700_000_000);
+		tracker.touch_with(&key("a"), clock, PARAMS, 0.0);
+		assert_eq!(tracker.frequency_at(b"a", clock, PARAMS), LFU_INIT_VAL);
+
+		// At the initial value every access counts.
+		tracker.touch_with(&key("a"), clock, PARAMS, 0.99);
+		assert_eq!(tracker.frequency_at(b"a", clock, PARAMS), LFU_INIT_VAL + 1);
+		// One above it an access counts with probability 1/11.
+		tracker.touch_with(&key("a"), clock, PARAMS, 0.1);
+		assert_eq!(tracker.frequency_at(b"a", clock, PARAMS), LFU_INIT_VAL + 1);
+		tracker.touch_with(&key("a"), clock, PARAMS, 0.05);
+		assert_eq!(tracker.frequency_at(b"a", clock, PARAMS), LFU_INIT_VAL + 2);
+	}
+
+	#[test]
+	fn test_frequency_saturates() {
+		let mut access = Access::new(Clock::at(0));
+		access.counter = u8::MAX;
+		access.touch(Clock::at(0), PARAMS, 0.0);
+		assert_eq!(access.counter, u8::MAX);
+	}
+
+	#[test]
+	fn test_frequency_decays() {
+		let start = Clock::at(1_700_000_000);
+		let mut access = Access::new(start);
+		access.counter = 20;
+		let later = Clock::at(1_700_000_000 + 3 * 60);
+
+		assert_eq!(access.decayed(later, PARAMS), 17);
+		let params = LfuParams {
+			decay_time: 2,
+			..PARAMS
+		};
+		assert_eq!(access.decayed(later, params), 19);
+		let params = LfuParams {
+			decay_time: 0,
+			..PARAMS
+		};
+		assert_eq!(access.decayed(later, params), 20);
+
+		// An access first applies the decay.
+		access.touch(later, PARAMS, 0.99);
+		assert_eq!(access.counter, 17);
+		assert_eq!(access.ldt, later.minutes);
+	}
+
+	#[test]
+	fn test_untracked_keys_count_from_startup() {
+		let start = 1_700_000_000;
+		let tracker = AccessTracker {
+			started: Clock::at(start),
+			..AccessTracker::new()
+		};
+		let clock = Clock::at(start + 7);
+		assert_eq!(tracker.idle_time_at(b"missing", clock), 7);
+		assert_eq!(
+			tracker.frequency_at(b"missing", clock, PARAMS),
+			LFU_INIT_VAL
+		);
+	}
+
+	#[test]
+	fn test_restore_idle_time() {
+		let tracker = AccessTracker::new();
+		tracker.restore(&key("a"), Some(100), None);
+		let idle = tracker.idle_time_at(b"a", Clock::now());
+		assert!((100..=101).contains(&idle), "{}", idle);
+		assert_eq!(
+			tracker.frequency_at(b"a", Clock::now(), PARAMS),
+			LFU_INIT_VAL
+		);
+	}
+
+	#[test]
+	fn test_forget_and_clear() {
+		let tracker = AccessTracker::new();
+		let clock = Clock::at(1_700_000_000);
+		for name in ["a", "b", "c"] {
+			tracker.touch_with(&Bytes::from(name), clock, PARAMS, 0.0);
+		}
+		assert_eq!(tracker.len(), 3);
+		tracker.forget(b"a");
+		tracker.forget(b"missing");
+		assert_eq!(tracker.len(), 2);
+		assert!(tracker.get(b"a").is_none());
+		assert!(tracker.get(b"b").is_some());
+		assert!(tracker.get(b"c").is_some());
+		tracker.clear();
+		assert!(tracker.is_empty());
+	}
+
+	#[test]
+	fn test_eviction_candidate() {
+		let tracker = AccessTracker::new();
+		let start = 1_700_000_000;
+		tracker.touch_with(&key("old"), Clock::at(start), PARAMS, 0.0);
+		tracker.touch_with(&key("hot"), Clock::at(start + 100), PARAMS, 0.0);
+		for _ in 0..10 {
+			tracker.touch_with(&key("hot"), Clock::at(start + 100), PARAMS, 0.0);
+		}
+		let clock = Clock::at(start + 100);
+
+		// With more samples than keys both are seen almost surely.
+		assert_eq!(
+			tracker.eviction_candidate_at(EvictionPolicy::Lru, 64, clock, PARAMS),
+			Some(key("old"))
+		);
+		assert_eq!(
+			tracker.eviction_candidate_at(EvictionPolicy::Lfu, 64, clock, PARAMS),
+			Some(key("old"))
+		);
+		assert_eq!(
+			AccessTracker::new().eviction_candidate_at(EvictionPolicy::Lru, 5, clock, PARAMS),
+			None
+		);
+	}
+}
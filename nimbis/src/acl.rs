@@ -0,0 +1,1118 @@
+//! Access control lists for ACL and AUTH.
+//!
+//! Every connection runs as a user. A user has passwords, stored as SHA256
+//! hashes, and rules for the commands, keys and channels it may use. Command
+//! rules are applied in order, so the last rule matching a command decides
+//! whether it may run; key and channel patterns are globs, any of which
+//! grants access. A fresh server has only the `default` user, which needs no
+//! password and may do anything, so clients start out logged in as it. Once
+//! it is given a password or disabled, clients must AUTH before running
+//! anything but AUTH, HELLO and RESET. Failed AUTH attempts and refused
+//! commands are recorded in the ACL log.
+//!
+//! Users live in memory. With `aclfile` set they are loaded from that file
+//! at startup and by ACL LOAD, and written back by ACL SAVE, one
+//! `user <name> <rules>` line each.
+
+use std::collections::BTreeMap;
+use std::collections::BTreeSet;
+use std::sync::RwLock;
+
+use bytes::Bytes;
+use sha2::Digest;
+use sha2::Sha256;
+
+use crate::GCTX;
+use crate::acllog;
+use crate::acllog::Context;
+use crate::acllog::Reason;
+use crate::cmd::CmdTable;
+use crate::cmd::utils::glob_match;
+use crate::server_config;
+
+pub const DEFAULT_USER: &str = "default";
+
+const NOAUTH: &str = "NOAUTH Authentication required.";
+
+/// Commands an unauthenticated client may still run.
+const AUTH_EXEMPT_CMDS: &[&str] = &["AUTH", "HELLO", "RESET"];
+
+/// Command categories for `+@<category>` rules, besides `all`, `read` and
+/// `write`, which are derived from the command table.
+const CATEGORIES: &[(&str, &[&str])] = &[
+	(
+		"keyspace",
+		&[
+			"DEL",
+			"EXISTS",
+			"EXPIRE",
+			"PEXPIREAT",
+			"TTL",
+			"OBJECT",
+			"DUMP",
+			"RESTORE",
+			"RESTORE-ASKING",
+			"MIGRATE",
+			"FLUSHDB",
+		],
+	),
+	("string", &["SET", "GET", "INCR", "DECR", "APPEND"]),
+	(
+		"bitmap",
+		&[
+			"SETBIT",
+			"GETBIT",
+			"BITCOUNT",
+			"BITPOS",
+			"BITOP",
+			"BITFIELD",
+			"BITFIELD_RO",
+		],
+	),
+	("hyperloglog", &["PFADD", "PFCOUNT", "PFMERGE"]),
+	(
+		"geo",
+		&[
+			"GEOADD",
+			"GEOPOS",
+			"GEODIST",
+			"GEOHASH",
+			"GEOSEARCH",
+			"GEOSEARCHSTORE",
+		],
+	),
+	(
+		"hash",
+		&["HSET", "HDEL", "HGET", "HLEN", "HMGET", "HGETALL"],
+	),
+	(
+		"list",
+		&["LPUSH", "RPUSH", "LPOP", "RPOP", "LLEN", "LRANGE"],
+	),
+	("set", &["SADD", "SMEMBERS", "SISMEMBER", "SREM", "SCARD"]),
+	("sortedset", &["ZADD", "ZRANGE", "ZSCORE", "ZREM", "ZCARD"]),
+	(
+		"stream",
+		&[
+			"XADD",
+			"XLEN",
+			"XRANGE",
+			"XREVRANGE",
+			"XDEL",
+			"XTRIM",
+			"XSETID",
+			"XREAD",
+			"XGROUP",
+			"XREADGROUP",
+			"XACK",
+			"XPENDING",
+			"XCLAIM",
+			"XAUTOCLAIM",
+			"XINFO",
+		],
+	),
+	(
+		"pubsub",
+		&[
+			"SUBSCRIBE",
+			"UNSUBSCRIBE",
+			"PSUBSCRIBE",
+			"PUNSUBSCRIBE",
+			"PUBLISH",
+			"PUBSUB",
+		],
+	),
+	(
+		"connection",
+		&[
+			"PING",
+			"HELLO",
+			"AUTH",
+			"CLIENT",
+			"RESET",
+			"READONLY",
+			"READWRITE",
+			"ASKING",
+		],
+	),
+	("transaction", &["MULTI", "EXEC", "DISCARD"]),
+	(
+		"scripting",
+		&[
+			"EVAL",
+			"EVALSHA",
+			"EVAL_RO",
+			"EVALSHA_RO",
+			"SCRIPT",
+			"FUNCTION",
+			"FCALL",
+			"FCALL_RO",
+		],
+	),
+	(
+		"admin",
+		&[
+			"ACL",
+			"CONFIG",
+			"SLOWLOG",
+			"LATENCY",
+			"DEBUG",
+			"MODULE",
+			"SAVE",
+			"BGSAVE",
+			"LASTSAVE",
+			"BGREWRITEAOF",
+			"COMPACT",
+			"BACKUP",
+			"NIMBIS",
+			"REPLICAOF",
+			"SLAVEOF",
+			"REPLCONF",
+			"PSYNC",
+			"FAILOVER",
+			"ROLE",
+			"CLUSTER",
+		],
+	),
+	(
+		"dangerous",
+		&[
+			"ACL",
+			"CONFIG",
+			"DEBUG",
+			"MODULE",
+			"SAVE",
+			"BGSAVE",
+			"LASTSAVE",
+			"BGREWRITEAOF",
+			"COMPACT",
+			"BACKUP",
+			"NIMBIS",
+			"REPLICAOF",
+			"SLAVEOF",
+			"REPLCONF",
+			"PSYNC",
+			"FAILOVER",
+			"ROLE",
+			"CLUSTER",
+			"FLUSHDB",
+			"RESTORE",
+			"RESTORE-ASKING",
+			"MIGRATE",
+			"INFO",
+			"CLIENT",
+		],
+	),
+];
+
+/// Commands that take no keys. Every other command takes its first argument
+/// as its key unless `command_keys` knows better.
+const KEYLESS_CMDS: &[&str] = &[
+	"PING",
+	"HELLO",
+	"AUTH",
+	"CLIENT",
+	"RESET",
+	"READONLY",
+	"READWRITE",
+	"ASKING",
+	"MULTI",
+	"EXEC",
+	"DISCARD",
+	"SCRIPT",
+	"FUNCTION",
+	"SUBSCRIBE",
+	"UNSUBSCRIBE",
+	"PSUBSCRIBE",
+	"PUNSUBSCRIBE",
+	"PUBLISH",
+	"PUBSUB",
+	"ACL",
+	"CONFIG",
+	"SLOWLOG",
+	"LATENCY",
+	"MEMORY",
+	"DEBUG",
+	"MODULE",
+	"SAVE",
+	"BGSAVE",
+	"LASTSAVE",
+	"BGREWRITEAOF",
+	"COMPACT",
+	"WAITAOF",
+	"BACKUP",
+	"NIMBIS",
+	"REPLICAOF",
+	"SLAVEOF",
+	"REPLCONF",
+	"PSYNC",
+	"FAILOVER",
+	"ROLE",
+	"CLUSTER",
+	"TIME",
+	"LOLWUT",
+	"INFO",
+	"FLUSHDB",
+];
+
+/// Lowercase hex SHA256 of a password, the form users keep it in.
+pub fn hash_password(password: &[u8]) -> String {
+	format!("{:x}", Sha256::digest(password))
+}
+
+/// Log `client_id` in as the default user if that needs no password, the
+/// state of a freshly connected or reset client.
+pub fn auto_authenticate(client_id: i64) {
+	let user = GCTX!(acl)
+		.default_needs_no_auth()
+		.then(|| DEFAULT_USER.to_string());
+	GCTX!(client_sessions).set_user(client_id, user);
+}
+
+/// Log `client_id` in as `user` if `password` is one of its passwords.
+pub fn authenticate(client_id: i64, user: String, password: &[u8]) -> Result<(), String> {
+	if !GCTX!(acl).authenticate(&user, password) {
+		log_denial(
+			client_id,
+			Reason::Auth,
+			Context::TopLevel,
+			Bytes::from_static(b"AUTH"),
+			&user,
+		);
+		return Err("WRONGPASS invalid username-password pair or user is disabled.".to_string());
+	}
+	GCTX!(client_sessions).set_user(client_id, Some(user));
+	Ok(())
+}
+
+/// Check that `client_id` may run `name` with `args`, recording a denial in
+/// the ACL log.
+pub fn check(client_id: i64, name: &str, args: &[Bytes], context: Context) -> Result<(), String> {
+	let Some(user) = GCTX!(client_sessions).get_user(client_id) else {
+		if AUTH_EXEMPT_CMDS.contains(&name) {
+			return Ok(());
+		}
+		return Err(NOAUTH.to_string());
+	};
+	let denial = match GCTX!(acl).check(&user, GCTX!(cmd_table), name, args) {
+		Ok(()) => return Ok(()),
+		Err(denial) => denial,
+	};
+	let (reason, object) = match &denial {
+		Denial::NoAuth => return Err(NOAUTH.to_string()),
+		Denial::Command => (Reason::Command, Bytes::from(name.to_lowercase())),
+		Denial::Key(key) => (Reason::Key, key.clone()),
+		Denial::Channel(channel) => (Reason::Channel, channel.clone()),
+	};
+	log_denial(client_id, reason, context, object, &user);
+	Err(denial.message(&user, name))
+}
+
+fn log_denial(client_id: i64, reason: Reason, context: Context, object: Bytes, user: &str) {
+	GCTX!(acl_log).record(
+		server_config!(acllog_max_len),
+		reason,
+		context,
+		object,
+		user,
+		GCTX!(client_sessions).describe(client_id),
+		acllog::now_ms(),
+	);
+}
+
+/// Why a command was refused.
+#[derive(Debug, Clone, PartialEq)]
+pub enum Denial {
+	/// The user the client logged in as no longer exists.
+	NoAuth,
+	Command,
+	Key(Bytes),
+	Channel(Bytes),
+}
+
+impl Denial {
+	/// The error reply for `user` running `cmd`.
+	pub fn message(&self, user: &str, cmd: &str) -> String {
+		match self {
+			Denial::NoAuth => NOAUTH.to_string(),
+			Denial::Command => format!(
+				"NOPERM User {} has no permissions to run the '{}' command",
+				user,
+				cmd.to_lowercase()
+			),
+			Denial::Key(_) => "NOPERM No permissions to access a key".to_string(),
+			Denial::Channel(_) => "NOPERM No permissions to access a channel".to_string(),
+		}
+	}
+}
+
+#[derive(Debug, Clone, PartialEq)]
+enum Target {
+	All,
+	Category(String),
+	Command(String),
+	Subcommand(String, String),
+}
+
+#[derive(Debug, Clone, PartialEq)]
+struct CommandRule {
+	allow: bool,
+	target: Target,
+}
+
+impl CommandRule {
+	fn matches(&self, table: &CmdTable, name: &str, args: &[Bytes]) -> bool {
+		match &self.target {
+			Target::All => true,
+			Target::Category(category) => in_category(table, category, name),
+			Target::Command(cmd) => cmd == name,
+			Target::Subcommand(cmd, sub) => {
+				cmd == name
+					&& args
+						.first()
+						.is_some_and(|arg| arg.eq_ignore_ascii_case(sub.as_bytes()))
+			}
+		}
+	}
+
+	fn describe(&self) -> String {
+		let sign = if self.allow { '+' } else { '-' };
+		match &self.target {
+			Target::All => format!("{}@all", sign),
+			Target::Category(category) => format!("{}@{}", sign, category),
+			Target::Command(cmd) => format!("{}{}", sign, cmd.to_lowercase()),
+			Target::Subcommand(cmd, sub) => {
+				format!("{}{}|{}", sign, cmd.to_lowercase(), sub.to_lowercase())
+			}
+		}
+	}
+}
+
+fn in_category(table: &CmdTable, category: &str, name: &str) -> bool {
+	match category {
+		"all" => true,
+		"write" => table.is_write(name),
+		"read" => !table.is_write(name) && !KEYLESS_CMDS.contains(&name),
+		_ => CATEGORIES
+			.iter()
+			.any(|(cat, cmds)| *cat == category && cmds.contains(&name)),
+	}
+}
+
+/// The names accepted by `+@<category>` and listed by ACL CAT.
+pub fn categories() -> Vec<&'static str> {
+	let mut names = vec!["all", "read", "write"];
+	names.extend(CATEGORIES.iter().map(|(name, _)| *name));
+	names.sort_unstable();
+	names
+}
+
+/// The commands in `category`, or None if there is no such category.
+pub fn category_commands(table: &CmdTable, category: &str) -> Option<Vec<String>> {
+	if !categories().contains(&category) {
+		return None;
+	}
+	let mut names = table
+		.names()
+		.filter(|name| in_category(table, category, name))
+		.map(|name| name.to_lowercase())
+		.collect::<Vec<_>>();
+	names.sort_unstable();
+	Some(names)
+}
+
+/// The keys `name` accesses when run with `args`.
+pub fn command_keys<'a>(name: &str, args: &'a [Bytes]) -> Vec<&'a Bytes> {
+	match name {
+		"DEL" | "EXISTS" | "PFCOUNT" | "PFMERGE" => args.iter().collect(),
+		"BITOP" => args.iter().skip(1).collect(),
+		"GEOSEARCHSTORE" => args.iter().take(2).collect(),
+		"XREAD" | "XREADGROUP" => {
+			let Some(streams) = args
+				.iter()
+				.position(|arg| arg.eq_ignore_ascii_case(b"STREAMS"))
+			else {
+				return Vec::new();
+			};
+			let rest = &args[streams + 1..];
+			rest[..rest.len() / 2].iter().collect()
+		}
+		"EVAL" | "EVALSHA" | "EVAL_RO" | "EVALSHA_RO" | "FCALL" | "FCALL_RO" => {
+			let numkeys = args
+				.get(1)
+				.and_then(|arg| std::str::from_utf8(arg).ok())
+				.and_then(|arg| arg.parse::<usize>().ok())
+				.unwrap_or(0);
+			args.iter().skip(2).take(numkeys).collect()
+		}
+		"MIGRATE" => match args.get(2) {
+			Some(key) if !key.is_empty() => vec![key],
+			_ => args
+				.iter()
+				.position(|arg| arg.eq_ignore_ascii_case(b"KEYS"))
+				.map(|at| args[at + 1..].iter().collect())
+				.unwrap_or_default(),
+		},
+		"OBJECT" => args.get(1).into_iter().collect(),
+		"MEMORY"
+			if args
+				.first()
+				.is_some_and(|arg| arg.eq_ignore_ascii_case(b"USAGE")) =>
+		{
+			args.get(1).into_iter().collect()
+		}
+		name if KEYLESS_CMDS.contains(&name) => Vec::new(),
+		_ => args.first().into_iter().collect(),
+	}
+}
+
+#[derive(Debug, Clone, PartialEq)]
+pub struct User {
+	pub name: String,
+	enabled: bool,
+	nopass: bool,
+	passwords: BTreeSet<String>,
+	commands: Vec<CommandRule>,
+	keys: Vec<Bytes>,
+	channels: Vec<Bytes>,
+}
+
+impl User {
+	/// A user created by ACL SETUSER: disabled, without passwords and
+	/// allowed nothing.
+	fn new(name: &str) -> Self {
+		Self {
+			name: name.to_string(),
+			enabled: false,
+			nopass: false,
+			passwords: BTreeSet::new(),
+			commands: Vec::new(),
+			keys: Vec::new(),
+			channels: Vec::new(),
+		}
+	}
+
+	fn default_user() -> Self {
+		Self {
+			enabled: true,
+			nopass: true,
+			commands: vec![CommandRule {
+				allow: true,
+				target: Target::All,
+			}],
+			keys: vec![Bytes::from_static(b"*")],
+			channels: vec![Bytes::from_static(b"*")],
+			..Self::new(DEFAULT_USER)
+		}
+	}
+
+	/// Apply one ACL SETUSER rule.
+	fn apply(&mut self, rule: &[u8], table: &CmdTable) -> Result<(), String> {
+		match rule.to_ascii_lowercase().as_slice() {
+			b"on" => self.enabled = true,
+			b"off" => self.enabled = false,
+			b"nopass" => {
+				self.nopass = true;
+				self.passwords.clear();
+			}
+			b"resetpass" => {
+				self.nopass = false;
+				self.passwords.clear();
+			}
+			b"allkeys" => self.keys = vec![Bytes::from_static(b"*")],
+			b"resetkeys" => self.keys.clear(),
+			b"allchannels" => self.channels = vec![Bytes::from_static(b"*")],
+			b"resetchannels" => self.channels.clear(),
+			b"allcommands" => self.apply(b"+@all", table)?,
+			b"nocommands" => self.apply(b"-@all", table)?,
+			b"reset" => *self = Self::new(&self.name),
+			_ => match rule.split_first() {
+				Some((b'>', password)) => {
+					self.passwords.insert(hash_password(password));
+					self.nopass = false;
+				}
+				Some((b'<', password)) => {
+					if !self.passwords.remove(&hash_password(password)) {
+						return Err(
+							"The password you are trying to remove from the user does not exist"
+								.to_string(),
+						);
+					}
+				}
+				Some((b'#', hash)) => {
+					let hash = parse_hash(hash)?;
+					self.passwords.insert(hash);
+					self.nopass = false;
+				}
+				Some((b'!', hash)) => {
+					let hash = parse_hash(hash)?;
+					if !self.passwords.remove(&hash) {
+						return Err(
+							"The password hash you are trying to remove from the user does not exist"
+								.to_string(),
+						);
+					}
+				}
+				Some((b'~', pattern)) => self.keys.push(Bytes::copy_from_slice(pattern)),
+				Some((b'&', pattern)) => self.channels.push(Bytes::copy_from_slice(pattern)),
+				Some((sign @ (b'+' | b'-'), target)) => {
+					let rule = CommandRule {
+						allow: *sign == b'+',
+						target: parse_target(target, table)?,
+					};
+					if rule.target == Target::All {
+						self.commands.clear();
+						if rule.allow {
+							self.commands.push(rule);
+						}
+					} else {
+						self.commands.push(rule);
+					}
+				}
+				_ => return Err("Syntax error".to_string()),
+			},
+		}
+		Ok(())
+	}
+
+	pub fn is_enabled(&self) -> bool {
+		self.enabled
+	}
+
+	/// The flags ACL GETUSER reports.
+	pub fn flags(&self) -> Vec<&'static str> {
+		let mut flags = vec![if self.enabled { "on" } else { "off" }];
+		if self.nopass {
+			flags.push("nopass");
+		}
+		flags
+	}
+
+	pub fn passwords(&self) -> impl Iterator<Item = &String> {
+		self.passwords.iter()
+	}
+
+	/// The command rules, starting from `-@all` unless they allow everything
+	/// first.
+	pub fn command_rules(&self) -> String {
+		let mut rules = Vec::new();
+		if self
+			.commands
+			.first()
+			.is_none_or(|rule| rule.target != Target::All)
+		{
+			rules.push("-@all".to_string());
+		}
+		rules.extend(self.commands.iter().map(CommandRule::describe));
+		rules.join(" ")
+	}
+
+	pub fn key_patterns(&self) -> &[Bytes] {
+		&self.keys
+	}
+
+	pub fn channel_patterns(&self) -> &[Bytes] {
+		&self.channels
+	}
+
+	/// The rules that recreate this user, as ACL LIST and ACL SAVE write them.
+	pub fn describe(&self) -> String {
+		let mut rules = vec![format!("user {}", self.name)];
+		rules.extend(self.flags().into_iter().map(str::to_string));
+		rules.extend(self.passwords.iter().map(|hash| format!("#{}", hash)));
+		rules.extend(
+			self.keys
+				.iter()
+				.map(|pattern| format!("~{}", String::from_utf8_lossy(pattern))),
+		);
+		rules.push("resetchannels".to_string());
+		rules.extend(
+			self.channels
+				.iter()
+				.map(|pattern| format!("&{}", String::from_utf8_lossy(pattern))),
+		);
+		rules.push(self.command_rules());
+		rules.join(" ")
+	}
+
+	fn authenticates(&self, password: &[u8]) -> bool {
+		self.enabled && (self.nopass || self.passwords.contains(&hash_password(password)))
+	}
+
+	fn check(&self, table: &CmdTable, name: &str, args: &[Bytes]) -> Result<(), Denial> {
+		let allowed = self
+			.commands
+			.iter()
+			.rev()
+			.find(|rule| rule.matches(table, name, args))
+			.is_some_and(|rule| rule.allow);
+		if !allowed {
+			return Err(Denial::Command);
+		}
+
+		if let Some(key) = command_keys(name, args)
+			.into_iter()
+			.find(|key| !self.keys.iter().any(|pattern| glob_match(pattern, key)))
+		{
+			return Err(Denial::Key(key.clone()));
+		}
+
+		let denied_channel = match name {
+			"PUBLISH" => args
+				.first()
+				.filter(|channel| !self.may_use_channel(channel)),
+			"SUBSCRIBE" => args.iter().find(|channel| !self.may_use_channel(channel)),
+			// A pattern may match channels the user cannot use, so it must
+			// be one of the user's own patterns.
+			"PSUBSCRIBE" => args.iter().find(|pattern| {
+				!self
+					.channels
+					.iter()
+					.any(|allowed| allowed.as_ref() == b"*" || allowed == *pattern)
+			}),
+			_ => None,
+		};
+		if let Some(channel) = denied_channel {
+			return Err(Denial::Channel(channel.clone()));
+		}
+		Ok(())
+	}
+
+	fn may_use_channel(&self, channel: &[u8]) -> bool {
+		self.channels
+			.iter()
+			.any(|pattern| glob_match(pattern, channel))
+	}
+}
+
+fn parse_hash(hash: &[u8]) -> Result<String, String> {
+	if hash.len() != 64 || !hash.iter().all(|b| matches!(b, b'0'..=b'9' | b'a'..=b'f')) {
+		return Err(
+			"The password hash must be exactly 64 characters and contain only \
+		            lowercase hexadecimal characters"
+				.to_string(),
+		);
+	}
+	Ok(String::from_utf8_lossy(hash).into_owned())
+}
+
+fn parse_target(target: &[u8], table: &CmdTable) -> Result<Target, String> {
+	let unknown = || "Unknown command or category name in ACL".to_string();
+	let target = std::str::from_utf8(target).map_err(|_| unknown())?;
+	if let Some(category) = target.strip_prefix('@') {
+		let category = category.to_lowercase();
+		return match category.as_str() {
+			"all" => Ok(Target::All),
+			_ if categories().contains(&category.as_str()) => Ok(Target::Category(category)),
+			_ => Err(unknown()),
+		};
+	}
+
+	let (cmd, sub) = match target.split_once('|') {
+		Some((cmd, sub)) if !sub.is_empty() => (cmd.to_uppercase(), Some(sub.to_uppercase())),
+		Some(_) => return Err(unknown()),
+		None => (target.to_uppercase(), None),
+	};
+	if table.get_cmd(&cmd).is_none() {
+		return Err(unknown());
+	}
+	Ok(match sub {
+		Some(sub) => Target::Subcommand(cmd, sub),
+		None => Target::Command(cmd),
+	})
+}
+
+/// Parse the rules of every `user <name> <rules>` line of an ACL file.
+fn parse_file(text: &str, table: &CmdTable) -> Result<BTreeMap<String, User>, String> {
+	let mut users = BTreeMap::new();
+	for (number, line) in text.lines().enumerate() {
+		let line = line.trim();
+		if line.is_empty() || line.starts_with('#') {
+			continue;
+		}
+		let mut words = line.split_ascii_whitespace();
+		let (Some("user"), Some(name)) = (words.next(), words.next()) else {
+			return Err(format!(
+				"ERR /{}: line should start with user keyword",
+				number + 1
+			));
+		};
+		if users.contains_key(name) {
+			return Err(format!("ERR /{}: duplicate user '{}'", number + 1, name));
+		}
+		let mut user = User::new(name);
+		for rule in words {
+			user.apply(rule.as_bytes(), table)
+				.map_err(|reason| format!("ERR /{}: {}", number + 1, reason))?;
+		}
+		users.insert(name.to_string(), user);
+	}
+	users
+		.entry(DEFAULT_USER.to_string())
+		.or_insert_with(User::default_user);
+	Ok(users)
+}
+
+#[derive(Debug)]
+pub struct Acl {
+	users: RwLock<BTreeMap<String, User>>,
+}
+
+impl Default for Acl {
+	fn default() -> Self {
+		Self::new()
+	}
+}
+
+impl Acl {
+	pub fn new() -> Self {
+		let mut users = BTreeMap::new();
+		users.insert(DEFAULT_USER.to_string(), User::default_user());
+		Self {
+			users: RwLock::new(users),
+		}
+	}
+
+	/// Create or modify the user `name` with `rules`. Nothing changes if any
+	/// rule is invalid.
+	pub fn set_user(&self, name: &str, rules: &[Bytes], table: &CmdTable) -> Result<(), String> {
+		if name.is_empty() || name.contains(char::is_whitespace) {
+			return Err("ERR Usernames can't contain spaces or be empty".to_string());
+		}
+		let mut users = self.users.write().unwrap();
+		let mut user = users.get(name).cloned().unwrap_or_else(|| User::new(name));
+		for rule in rules {
+			user.apply(rule, table).map_err(|reason| {
+				format!(
+					"ERR Error in ACL SETUSER modifier '{}': {}",
+					String::from_utf8_lossy(rule),
+					reason
+				)
+			})?;
+		}
+		users.insert(name.to_string(), user);
+		Ok(())
+	}
+
+	pub fn get_user(&self, name: &str) -> Option<User> {
+		self.users.read().unwrap().get(name).cloned()
+	}
+
+	/// Remove the users in `names`, returning how many existed.
+	pub fn del_users(&self, names: &[String]) -> Result<i64, String> {
+		if names.iter().any(|name| name == DEFAULT_USER) {
+			return Err("ERR The 'default' user cannot be removed".to_string());
+		}
+		let mut users = self.users.write().unwrap();
+		Ok(names
+			.iter()
+			.filter(|name| users.remove(name.as_str()).is_some())
+			.count() as i64)
+	}
+
+	pub fn usernames(&self) -> Vec<String> {
+		self.users.read().unwrap().keys().cloned().collect()
+	}
+
+	/// Every user, as the rules that recreate it.
+	pub fn list(&self) -> Vec<String> {
+		self.users
+			.read()
+			.unwrap()
+			.values()
+			.map(User::describe)
+			.collect()
+	}
+
+	/// Whether `password` logs in as the enabled user `name`.
+	pub fn authenticate(&self, name: &str, password: &[u8]) -> bool {
+		self.users
+			.read()
+			.unwrap()
+			.get(name)
+			.is_some_and(|user| user.authenticates(password))
+	}
+
+	/// Whether clients are logged in as the default user without AUTH.
+	pub fn default_needs_no_auth(&self) -> bool {
+		self.users
+			.read()
+			.unwrap()
+			.get(DEFAULT_USER)
+			.is_some_and(|user| user.enabled && user.nopass)
+	}
+
+	/// Check that the user `name` may run `cmd` with `args`. Unknown commands
+	/// pass, so they fail as unknown.
+	pub fn check(
+		&self,
+		name: &str,
+		table: &CmdTable,
+		cmd: &str,
+		args: &[Bytes],
+	) -> Result<(), Denial> {
+		let users = self.users.read().unwrap();
+		let Some(user) = users.get(name) else {
+			return Err(Denial::NoAuth);
+		};
+		if table.get_cmd(cmd).is_none() {
+			return Ok(());
+		}
+		user.check(table, cmd, args)
+	}
+
+	/// Replace every user with those of an ACL file. Nothing changes if the
+	/// file is invalid.
+	pub fn load(&self, text: &str, table: &CmdTable) -> Result<(), String> {
+		let users = parse_file(text, table)?;
+		*self.users.write().unwrap() = users;
+		Ok(())
+	}
+
+	/// The ACL file recreating every user.
+	pub fn dump(&self) -> String {
+		self.list()
+			.into_iter()
+			.map(|line| format!("{}\n", line))
+			.collect()
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use rstest::rstest;
+
+	use super::*;
+
+	fn setuser(acl: &Acl, name: &str, rules: &[&str]) -> Result<(), String> {
+		let rules = rules
+			.iter()
+			.map(|rule| Bytes::copy_from_slice(rule.as_bytes()))
+			.collect::<Vec<_>>();
+		acl.set_user(name, &rules, &CmdTable::new())
+	}
+
+	fn args(args: &[&str]) -> Vec<Bytes> {
+		args.iter()
+			.map(|arg| Bytes::copy_from_slice(arg.as_bytes()))
+			.collect()
+	}
+
+	#[test]
+	fn test_default_user_allows_everything() {
+		let acl = Acl::new();
+		assert!(acl.default_needs_no_auth());
+		assert!(acl.authenticate(DEFAULT_USER, b"anything"));
+		assert!(
+			acl.check(DEFAULT_USER, &CmdTable::new(), "FLUSHDB", &[])
+				.is_ok()
+		);
+		assert_eq!(
+			acl.list(),
+			vec!["user default on nopass ~* resetchannels &* +@all"]
+		);
+	}
+
+	#[test]
+	fn test_passwords() {
+		let acl = Acl::new();
+		setuser(&acl, "alice", &["on", ">secret"]).unwrap();
+		assert!(acl.authenticate("alice", b"secret"));
+		assert!(!acl.authenticate("alice", b"wrong"));
+
+		setuser(&acl, "alice", &["off"]).unwrap();
+		assert!(!acl.authenticate("alice", b"secret"));
+
+		setuser(&acl, "alice", &["on", "<secret"]).unwrap();
+		assert!(!acl.authenticate("alice", b"secret"));
+
+		let hash = hash_password(b"hashed");
+		setuser(&acl, "alice", &[&format!("#{}", hash)]).unwrap();
+		assert!(acl.authenticate("alice", b"hashed"));
+	}
+
+	#[rstest]
+	#[case(
+		"<missing",
+		"The password you are trying to remove from the user does not exist"
+	)]
+	#[case("#abc", "The password hash must be exactly 64 characters")]
+	#[case("+nosuchcmd", "Unknown command or category name in ACL")]
+	#[case("+@nosuchcategory", "Unknown command or category name in ACL")]
+	#[case("bogus", "Syntax error")]
+	fn test_invalid_rule_changes_nothing(#[case] rule: &str, #[case] reason: &str) {
+		let acl = Acl::new();
+		let err = setuser(&acl, "bob", &["on", rule]).unwrap_err();
+		assert!(
+			err.starts_with(&format!(
+				"ERR Error in ACL SETUSER modifier '{}': {}",
+				rule, reason
+			)),
+			"{}",
+			err
+		);
+		assert!(acl.get_user("bob").is_none());
+	}
+
+	#[test]
+	fn test_last_matching_command_rule_wins() {
+		let acl = Acl::new();
+		let table = CmdTable::new();
+		setuser(
+			&acl,
+			"app",
+			&[
+				"on",
+				"nopass",
+				"~*",
+				"+@all",
+				"-@dangerous",
+				"+info",
+				"-client",
+				"+client|id",
+			],
+		)
+		.unwrap();
+		assert!(acl.check("app", &table, "GET", &args(&["k"])).is_ok());
+		assert!(acl.check("app", &table, "INFO", &[]).is_ok());
+		assert!(acl.check("app", &table, "CLIENT", &args(&["ID"])).is_ok());
+		assert_eq!(
+			acl.check("app", &table, "CLIENT", &args(&["LIST"])),
+			Err(Denial::Command)
+		);
+		assert!(acl.check("app", &table, "FLUSHDB", &[]).is_err());
+		assert_eq!(
+			acl.get_user("app").unwrap().command_rules(),
+			"+@all -@dangerous +info -client +client|id"
+		);
+
+		setuser(&acl, "app", &["nocommands", "+@read"]).unwrap();
+		assert!(acl.check("app", &table, "GET", &args(&["k"])).is_ok());
+		assert!(acl.check("app", &table, "SET", &args(&["k", "v"])).is_err());
+		assert_eq!(acl.get_user("app").unwrap().command_rules(), "-@all +@read");
+	}
+
+	#[test]
+	fn test_key_patterns() {
+		let acl = Acl::new();
+		let table = CmdTable::new();
+		setuser(&acl, "app", &["on", "nopass", "+@all", "~app:*"]).unwrap();
+		assert!(
+			acl.check("app", &table, "SET", &args(&["app:1", "v"]))
+				.is_ok()
+		);
+		assert_eq!(
+			acl.check("app", &table, "GET", &args(&["other"])),
+			Err(Denial::Key(Bytes::from_static(b"other")))
+		);
+		assert!(
+			acl.check("app", &table, "DEL", &args(&["app:1", "other"]))
+				.is_err()
+		);
+		assert!(
+			acl.check(
+				"app",
+				&table,
+				"XREAD",
+				&args(&["COUNT", "1", "STREAMS", "app:s", "other", "0", "0"])
+			)
+			.is_err()
+		);
+		assert!(
+			acl.check(
+				"app",
+				&table,
+				"EVAL",
+				&args(&["return 1", "1", "app:1", "other"])
+			)
+			.is_ok()
+		);
+		assert!(acl.check("app", &table, "PING", &[]).is_ok());
+	}
+
+	#[test]
+	fn test_channel_patterns() {
+		let acl = Acl::new();
+		let table = CmdTable::new();
+		setuser(&acl, "app", &["on", "nopass", "+@all", "&news.*"]).unwrap();
+		assert!(
+			acl.check("app", &table, "PUBLISH", &args(&["news.1", "m"]))
+				.is_ok()
+		);
+		assert!(
+			acl.check("app", &table, "SUBSCRIBE", &args(&["news.1"]))
+				.is_ok()
+		);
+		assert!(
+			acl.check("app", &table, "PSUBSCRIBE", &args(&["news.*"]))
+				.is_ok()
+		);
+		assert_eq!(
+			acl.check("app", &table, "PSUBSCRIBE", &args(&["news.1*"])),
+			Err(Denial::Channel(Bytes::from_static(b"news.1*")))
+		);
+		assert!(
+			acl.check("app", &table, "SUBSCRIBE", &args(&["other"]))
+				.is_err()
+		);
+	}
+
+	#[test]
+	fn test_denial_message() {
+		assert_eq!(
+			Denial::Command.message("app", "FLUSHDB"),
+			"NOPERM User app has no permissions to run the 'flushdb' command"
+		);
+		assert_eq!(
+			Denial::Key(Bytes::from_static(b"k")).message("app", "GET"),
+			"NOPERM No permissions to access a key"
+		);
+		assert_eq!(
+			Denial::Channel(Bytes::from_static(b"c")).message("app", "PUBLISH"),
+			"NOPERM No permissions to access a channel"
+		);
+	}
+
+	#[test]
+	fn test_del_users() {
+		let acl = Acl::new();
+		setuser(&acl, "alice", &["on"]).unwrap();
+		assert_eq!(
+			acl.del_users(&["alice".to_string(), "nobody".to_string()]),
+			Ok(1)
+		);
+		assert!(acl.del_users(&[DEFAULT_USER.to_string()]).is_err());
+		assert_eq!(acl.usernames(), vec![DEFAULT_USER]);
+	}
+
+	#[test]
+	fn test_dump_and_load_round_trip() {
+		let acl = Acl::new();
+		let table = CmdTable::new();
+		setuser(
+			&acl,
+			"app",
+			&["on", ">secret", "~app:*", "&news", "+@read", "-@dangerous"],
+		)
+		.unwrap();
+		setuser(&acl, DEFAULT_USER, &["off"]).unwrap();
+
+		let loaded = Acl::new();
+		loaded.load(&acl.dump(), &table).unwrap();
+		assert_eq!(loaded.list(), acl.list());
+		assert!(loaded.authenticate("app", b"secret"));
+		assert!(!loaded.default_needs_no_auth());
+	}
+
+	#[test]
+	fn test_load_rejects_invalid_file() {
+		let acl = Acl::new();
+		let table = CmdTable::new();
+		assert!(acl.load("user app on +nosuchcmd\n", &table).is_err());
+		assert!(acl.load("app on\n", &table).is_err());
+		assert_eq!(acl.usernames(), vec![DEFAULT_USER]);
+
+		acl.load("# users\nuser app on nopass\n", &table).unwrap();
+		assert_eq!(acl.usernames(), vec!["app", DEFAULT_USER]);
+	}
+}
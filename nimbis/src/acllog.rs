@@ -0,0 +1,238 @@
+//! ACL LOG: a bounded in-memory record of failed AUTH attempts and of
+//! commands refused by ACL rules.
+//!
+//! Like Redis, a denial with the same reason, context, object and user as an
+//! entry updated less than a minute ago bumps that entry's count instead of
+//! adding a new one, so a misbehaving client cannot flush the log.
+
+use std::collections::VecDeque;
+use std::sync::Mutex;
+use std::time::SystemTime;
+use std::time::UNIX_EPOCH;
+
+use bytes::Bytes;
+use nimbis_resp::RespValue;
+
+/// Milliseconds within which a repeated denial updates the same entry.
+const GROUP_WINDOW_MS: i64 = 60_000;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Reason {
+	Auth,
+	Command,
+	Key,
+	Channel,
+}
+
+impl Reason {
+	pub fn name(self) -> &'static str {
+		match self {
+			Reason::Auth => "auth",
+			Reason::Command => "command",
+			Reason::Key => "key",
+			Reason::Channel => "channel",
+		}
+	}
+}
+
+/// Where the denied command was run from.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Context {
+	TopLevel,
+	Multi,
+	Lua,
+}
+
+impl Context {
+	pub fn name(self) -> &'static str {
+		match self {
+			Context::TopLevel => "toplevel",
+			Context::Multi => "multi",
+			Context::Lua => "lua",
+		}
+	}
+}
+
+#[derive(Debug, Clone)]
+pub struct AclLogEntry {
+	pub id: u64,
+	pub count: u64,
+	pub reason: Reason,
+	pub context: Context,
+	/// The command, key or channel that was denied, or `AUTH`.
+	pub object: Bytes,
+	pub username: String,
+	pub client_info: String,
+	pub created_ms: i64,
+	pub updated_ms: i64,
+}
+
+impl AclLogEntry {
+	pub fn to_resp(&self, now_ms: i64) -> RespValue {
+		let age = (now_ms - self.created_ms).max(0) as f64 / 1000.0;
+		RespValue::array(vec![
+			RespValue::bulk_string("count"),
+			RespValue::integer(self.count as i64),
+			RespValue::bulk_string("reason"),
+			RespValue::bulk_string(self.reason.name()),
+			RespValue::bulk_string("context"),
+			RespValue::bulk_string(self.context.name()),
+			RespValue::bulk_string("object"),
+			RespValue::bulk_string(self.object.clone()),
+			RespValue::bulk_string("username"),
+			RespValue::bulk_string(Bytes::from(self.username.clone())),
+			RespValue::bulk_string("age-seconds"),
+			RespValue::bulk_string(Bytes::from(format!("{:.3}", age))),
+			RespValue::bulk_string("client-info"),
+			RespValue::bulk_string(Bytes::from(self.client_info.clone())),
+			RespValue::bulk_string("entry-id"),
+			RespValue::integer(self.id as i64),
+			RespValue::bulk_string("timestamp-created"),
+			RespValue::integer(self.created_ms),
+			RespValue::bulk_string("timestamp-last-updated"),
+			RespValue::integer(self.updated_ms),
+		])
+	}
+}
+
+#[derive(Debug, Default)]
+struct AclLogInner {
+	next_id: u64,
+	entries: VecDeque<AclLogEntry>,
+}
+
+/// The newest entry is kept at the front.
+#[derive(Debug, Default)]
+pub struct AclLog {
+	inner: Mutex<AclLogInner>,
+}
+
+impl AclLog {
+	pub fn new() -> Self {
+		Self::default()
+	}
+
+	/// Record a denial, dropping the oldest entries beyond `max_len`.
+	#[allow(clippy::too_many_arguments)]
+	pub fn record(
+		&self,
+		max_len: usize,
+		reason: Reason,
+		context: Context,
+		object: Bytes,
+		username: &str,
+		client_info: String,
+		now_ms: i64,
+	) {
+		let mut inner = self.inner.lock().unwrap();
+		let similar = inner.entries.iter().position(|entry| {
+			entry.reason == reason
+				&& entry.context == context
+				&& entry.object == object
+				&& entry.username == username
+				&& now_ms - entry.updated_ms < GROUP_WINDOW_MS
+		});
+		let entry = match similar.and_then(|at| inner.entries.remove(at)) {
+			Some(entry) => AclLogEntry {
+				count: entry.count + 1,
+				client_info,
+				updated_ms: now_ms,
+				..entry
+			},
+			None => {
+				let id = inner.next_id;
+				inner.next_id += 1;
+				AclLogEntry {
+					id,
+					count: 1,
+					reason,
+					context,
+					object,
+					username: username.to_string(),
+					client_info,
+					created_ms: now_ms,
+					updated_ms: now_ms,
+				}
+			}
+		};
+		inner.entries.push_front(entry);
+		inner.entries.truncate(max_len);
+	}
+
+	/// Return up to `count` of the newest entries, or all of them when
+	/// `count` is `None`.
+	pub fn get(&self, count: Option<usize>) -> Vec<AclLogEntry> {
+		let inner = self.inner.lock().unwrap();
+		let count = count.unwrap_or(inner.entries.len());
+		inner.entries.iter().take(count).cloned().collect()
+	}
+
+	pub fn reset(&self) {
+		self.inner.lock().unwrap().entries.clear();
+	}
+}
+
+pub fn now_ms() -> i64 {
+	SystemTime::now()
+		.duration_since(UNIX_EPOCH)
+		.map(|d| d.as_millis() as i64)
+		.unwrap_or_default()
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+
+	fn record(log: &AclLog, max_len: usize, object: &'static str, now_ms: i64) {
+		log.record(
+			max_len,
+			Reason::Command,
+			Context::TopLevel,
+			Bytes::from_static(object.as_bytes()),
+			"alice",
+			"id=1".to_string(),
+			now_ms,
+		);
+	}
+
+	#[test]
+	fn test_record_groups_similar_denials() {
+		let log = AclLog::new();
+		record(&log, 10, "get", 0);
+		record(&log, 10, "set", 1_000);
+		record(&log, 10, "get", 2_000);
+
+		let entries = log.get(None);
+		assert_eq!(entries.len(), 2);
+		assert_eq!(entries[0].object, Bytes::from_static(b"get"));
+		assert_eq!(entries[0].count, 2);
+		assert_eq!(entries[0].id, 0);
+		assert_eq!(entries[0].created_ms, 0);
+		assert_eq!(entries[0].updated_ms, 2_000);
+
+		record(&log, 10, "get", 2_000 + GROUP_WINDOW_MS);
+		let entries = log.get(None);
+		assert_eq!(entries.len(), 3);
+		assert_eq!(entries[0].id, 2);
+		assert_eq!(entries[0].count, 1);
+	}
+
+	#[test]
+	fn test_record_keeps_newest_entries() {
+		let log = AclLog::new();
+		for (i, object) in ["a", "b", "c", "d"].into_iter().enumerate() {
+			record(&log, 3, object, i as i64);
+		}
+
+		let ids = log
+			.get(None)
+			.into_iter()
+			.map(|entry| entry.id)
+			.collect::<Vec<_>>();
+		assert_eq!(ids, vec![3, 2, 1]);
+		assert_eq!(log.get(Some(1)).len(), 1);
+
+		log.reset();
+		assert!(log.get(None).is_empty());
+	}
+}
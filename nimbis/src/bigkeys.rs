@@ -0,0 +1,319 @@
+//! Background scans of the keyspace for the largest keys of each type.
+//!
+//! NIMBIS BIGKEYS START walks every key in small batches, one batch per
+//! tick, like GC passes, so clients are never held up. For each type it
+//! keeps the key count, element and byte totals, and the largest keys by
+//! element count and by estimated bytes, which NIMBIS BIGKEYS reports while
+//! the scan runs and after it ended, like `redis-cli --bigkeys` and
+//! `--memkeys` but without a client walking the keyspace.
+
+use std::collections::BTreeMap;
+use std::sync::Mutex;
+use std::time::Duration;
+use std::time::Instant;
+
+use bytes::Bytes;
+use log::error;
+use log::info;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+use nimbis_storage::storage_memory::KeySize;
+
+use crate::GCTX;
+
+const BIGKEYS_IN_PROGRESS: &str = "ERR Big keys scan already in progress";
+/// How often the next batch of a scan runs, or a scan is checked for.
+const BIGKEYS_TICK: Duration = Duration::from_millis(10);
+/// Keys read by one batch.
+const BIGKEYS_BATCH_SIZE: usize = 100;
+/// Elements sampled to estimate the bytes of a collection, as MEMORY USAGE
+/// does by default.
+const BIGKEYS_SAMPLES: usize = 5;
+/// The largest keys kept for each type and measure.
+pub const BIGKEYS_TOP: usize = 5;
+
+/// Run big keys scans for the lifetime of the server.
+pub fn start_bigkeys(storage: Storage) {
+	tokio::spawn(async move {
+		let mut interval = tokio::time::interval(BIGKEYS_TICK);
+		loop {
+			interval.tick().await;
+			let bigkeys = GCTX!(bigkeys);
+			let Some(start) = bigkeys.next_batch() else {
+				continue;
+			};
+			match storage
+				.key_sizes(start, BIGKEYS_BATCH_SIZE, BIGKEYS_SAMPLES)
+				.await
+			{
+				Ok(batch) => bigkeys.finish_batch(batch.sizes, batch.next),
+				Err(e) => bigkeys.fail_scan(&e.to_string()),
+			}
+		}
+	});
+}
+
+/// What a scan found for one type.
+#[derive(Debug, Default, Clone)]
+struct TypeStats {
+	keys: u64,
+	elements: u64,
+	bytes: u64,
+	/// The largest keys by elements, largest first.
+	by_elements: Vec<(Bytes, u64)>,
+	/// The largest keys by bytes, largest first.
+	by_bytes: Vec<(Bytes, u64)>,
+}
+
+impl TypeStats {
+	fn add(&mut self, size: &KeySize) {
+		self.keys += 1;
+		self.elements += size.elements;
+		self.bytes += size.bytes;
+		keep_top(&mut self.by_elements, &size.key, size.elements);
+		keep_top(&mut self.by_bytes, &size.key, size.bytes);
+	}
+}
+
+/// Add `key` to `top` if it is among the `BIGKEYS_TOP` largest.
+fn keep_top(top: &mut Vec<(Bytes, u64)>, key: &Bytes, value: u64) {
+	if top.len() == BIGKEYS_TOP && top.last().is_some_and(|(_, last)| *last >= value) {
+		return;
+	}
+	let at = top.partition_point(|(_, v)| *v >= value);
+	top.insert(at, (key.clone(), value));
+	top.truncate(BIGKEYS_TOP);
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum ScanStatus {
+	/// No scan ran since the server started.
+	Idle,
+	Running,
+	Done,
+	Failed,
+}
+
+impl ScanStatus {
+	fn name(self) -> &'static str {
+		match self {
+			ScanStatus::Idle => "idle",
+			ScanStatus::Running => "running",
+			ScanStatus::Done => "done",
+			ScanStatus::Failed => "err",
+		}
+	}
+}
+
+#[derive(Debug)]
+struct BigKeysState {
+	status: ScanStatus,
+	/// Whether NIMBIS BIGKEYS START asked for a scan.
+	requested: bool,
+	/// Where the next batch of the running scan starts.
+	start: Option<Bytes>,
+	started: Option<Instant>,
+	duration: Duration,
+	scanned: u64,
+	types: BTreeMap<String, TypeStats>,
+}
+
+#[derive(Debug)]
+pub struct BigKeys {
+	state: Mutex<BigKeysState>,
+}
+
+impl Default for BigKeys {
+	fn default() -> Self {
+		Self::new()
+	}
+}
+
+impl BigKeys {
+	pub fn new() -> Self {
+		Self {
+			state: Mutex::new(BigKeysState {
+				status: ScanStatus::Idle,
+				requested: false,
+				start: None,
+				started: None,
+				duration: Duration::ZERO,
+				scanned: 0,
+				types: BTreeMap::new(),
+			}),
+		}
+	}
+
+	/// Ask for a scan to start on the next tick. The results of the last
+	/// scan are dropped.
+	pub fn request(&self) -> Result<(), String> {
+		let mut state = self.state.lock().unwrap();
+		if state.status == ScanStatus::Running || state.requested {
+			return Err(BIGKEYS_IN_PROGRESS.to_string());
+		}
+		state.requested = true;
+		Ok(())
+	}
+
+	/// Where the next batch starts, starting a scan when one is requested.
+	/// `None` when no scan runs.
+	fn next_batch(&self) -> Option<Option<Bytes>> {
+		let mut state = self.state.lock().unwrap();
+		if state.requested {
+			state.requested = false;
+			state.status = ScanStatus::Running;
+			state.start = None;
+			state.started = Some(Instant::now());
+			state.duration = Duration::ZERO;
+			state.scanned = 0;
+			state.types.clear();
+		}
+		(state.status == ScanStatus::Running).then(|| state.start.clone())
+	}
+
+	fn finish_batch(&self, sizes: Vec<KeySize>, next: Option<Bytes>) {
+		let mut state = self.state.lock().unwrap();
+		if state.status != ScanStatus::Running {
+			return;
+		}
+		for size in &sizes {
+			state.scanned += 1;
+			state
+				.types
+				.entry(size.type_name.clone())
+				.or_default()
+				.add(size);
+		}
+		state.start = next;
+		if state.start.is_some() {
+			return;
+		}
+		state.status = ScanStatus::Done;
+		state.duration = state.started.map_or(Duration::ZERO, |at| at.elapsed());
+		info!(
+			"Big keys scan terminated with success in {:?}: {} keys",
+			state.duration, state.scanned
+		);
+	}
+
+	fn fail_scan(&self, err: &str) {
+		error!("Big keys scan error: {}", err);
+		let mut state = self.state.lock().unwrap();
+		state.status = ScanStatus::Failed;
+		state.start = None;
+		state.duration = state.started.map_or(Duration::ZERO, |at| at.elapsed());
+	}
+
+	/// The reply of NIMBIS BIGKEYS: the state of the last scan and, for
+	/// each type, what it found so far.
+	pub fn report(&self) -> RespValue {
+		let state = self.state.lock().unwrap();
+		let duration = match (state.status, state.started) {
+			(ScanStatus::Running, Some(at)) => at.elapsed(),
+			_ => state.duration,
+		};
+		let top = |keys: &[(Bytes, u64)]| {
+			RespValue::array(keys.iter().map(|(key, value)| {
+				RespValue::array(vec![
+					RespValue::bulk_string(key.clone()),
+					RespValue::integer(*value as i64),
+				])
+			}))
+		};
+		let types = state.types.iter().map(|(name, stats)| {
+			RespValue::array(vec![
+				RespValue::bulk_string("type"),
+				RespValue::bulk_string(name.clone()),
+				RespValue::bulk_string("keys"),
+				RespValue::integer(stats.keys as i64),
+				RespValue::bulk_string("elements"),
+				RespValue::integer(stats.elements as i64),
+				RespValue::bulk_string("bytes"),
+				RespValue::integer(stats.bytes as i64),
+				RespValue::bulk_string("largest_by_elements"),
+				top(&stats.by_elements),
+				RespValue::bulk_string("largest_by_bytes"),
+				top(&stats.by_bytes),
+			])
+		});
+		RespValue::array(vec![
+			RespValue::bulk_string("status"),
+			RespValue::bulk_string(state.status.name()),
+			RespValue::bulk_string("scanned_keys"),
+			RespValue::integer(state.scanned as i64),
+			RespValue::bulk_string("duration_ms"),
+			RespValue::integer(duration.as_millis() as i64),
+			RespValue::bulk_string("types"),
+			RespValue::array(types.collect::<Vec<_>>()),
+		])
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+
+	fn size(key: &'static str, type_name: &str, elements: u64, bytes: u64) -> KeySize {
+		KeySize {
+			key: Bytes::from(key),
+			type_name: type_name.to_string(),
+			elements,
+			bytes,
+		}
+	}
+
+	#[test]
+	fn test_keep_top() {
+		let mut top = Vec::new();
+		for (i, value) in [3, 9, 1, 7, 5, 8, 2].into_iter().enumerate() {
+			keep_top(&mut top, &Bytes::from(i.to_string()), value);
+		}
+		let values: Vec<u64> = top.iter().map(|(_, v)| *v).collect();
+		assert_eq!(values, vec![9, 8, 7, 5, 3]);
+		assert_eq!(top[0].0, Bytes::from("1"));
+	}
+
+	#[test]
+	fn test_scan_lifecycle() {
+		let bigkeys = BigKeys::new();
+		assert_eq!(bigkeys.next_batch(), None);
+
+		bigkeys.request().unwrap();
+		assert_eq!(bigkeys.request(), Err(BIGKEYS_IN_PROGRESS.to_string()));
+		assert_eq!(bigkeys.next_batch(), Some(None));
+
+		// A batch that stops early resumes where it stopped.
+		bigkeys.finish_batch(
+			vec![size("h1", "hash", 10, 400), size("s1", "string", 5, 20)],
+			Some(Bytes::from("s1\0")),
+		);
+		assert_eq!(bigkeys.next_batch(), Some(Some(Bytes::from("s1\0"))));
+		bigkeys.finish_batch(vec![size("h2", "hash", 3, 900)], None);
+		assert_eq!(bigkeys.next_batch(), None);
+
+		let state = bigkeys.state.lock().unwrap();
+		assert_eq!(state.status, ScanStatus::Done);
+		assert_eq!(state.scanned, 3);
+		let hash = &state.types["hash"];
+		assert_eq!((hash.keys, hash.elements, hash.bytes), (2, 13, 1300));
+		assert_eq!(hash.by_elements[0], (Bytes::from("h1"), 10));
+		assert_eq!(hash.by_bytes[0], (Bytes::from("h2"), 900));
+		drop(state);
+
+		// A new scan starts over.
+		bigkeys.request().unwrap();
+		assert_eq!(bigkeys.next_batch(), Some(None));
+		assert!(bigkeys.state.lock().unwrap().types.is_empty());
+	}
+
+	#[test]
+	fn test_failed_scan() {
+		let bigkeys = BigKeys::new();
+		bigkeys.request().unwrap();
+		bigkeys.next_batch().unwrap();
+		bigkeys.fail_scan("boom");
+		assert_eq!(bigkeys.state.lock().unwrap().status, ScanStatus::Failed);
+		assert_eq!(bigkeys.next_batch(), None);
+		bigkeys.request().unwrap();
+	}
+}
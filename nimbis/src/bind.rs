@@ -0,0 +1,118 @@
+//! The addresses the server listens on, and protected mode, which keeps an
+//! accidentally exposed server without a password to loopback clients.
+
+use std::fmt;
+use std::net::IpAddr;
+use std::str::FromStr;
+
+use serde::Deserialize;
+use serde::Serialize;
+
+use crate::GCTX;
+use crate::server_config;
+
+/// The reply sent to a client protected mode refuses, before closing it.
+pub const DENIED: &str = "-DENIED Nimbis is running in protected mode because protected mode is enabled, it listens on all interfaces and no password is set for the default user. In this mode connections are only accepted from the loopback interface. To accept connections from other hosts, set a password for the default user with ACL SETUSER, bind to specific addresses with the host setting, or disable protected mode with 'CONFIG SET protected_mode false' from the loopback interface.\r\n";
+
+/// The `host` setting: one or more addresses, separated by spaces, each
+/// port is bound on.
+#[derive(Debug, Clone, PartialEq, Eq, Deserialize, Serialize)]
+#[serde(try_from = "String", into = "String")]
+pub struct BindAddresses(pub Vec<String>);
+
+impl BindAddresses {
+	/// Whether one of the addresses is the wildcard of IPv4 or IPv6, which
+	/// accepts connections on every interface.
+	pub fn is_all_interfaces(&self) -> bool {
+		self.0
+			.iter()
+			.any(|addr| addr == "*" || addr.parse::<IpAddr>().is_ok_and(|ip| ip.is_unspecified()))
+	}
+
+	/// The socket addresses for `port` on every address.
+	pub fn with_port(&self, port: u16) -> Vec<String> {
+		self.0
+			.iter()
+			.map(|addr| match addr.as_str() {
+				"*" => format!("0.0.0.0:{}", port),
+				addr if addr.contains(':') => format!("[{}]:{}", addr, port),
+				addr => format!("{}:{}", addr, port),
+			})
+			.collect()
+	}
+}
+
+impl Default for BindAddresses {
+	fn default() -> Self {
+		Self(vec!["127.0.0.1".into()])
+	}
+}
+
+impl FromStr for BindAddresses {
+	type Err = String;
+
+	fn from_str(s: &str) -> Result<Self, Self::Err> {
+		let addrs = s.split_whitespace().map(str::to_string).collect::<Vec<_>>();
+		if addrs.is_empty() {
+			return Err("host must have at least one address".to_string());
+		}
+		Ok(Self(addrs))
+	}
+}
+
+impl TryFrom<String> for BindAddresses {
+	type Error = String;
+
+	fn try_from(value: String) -> Result<Self, Self::Error> {
+		value.parse()
+	}
+}
+
+impl From<BindAddresses> for String {
+	fn from(value: BindAddresses) -> Self {
+		value.to_string()
+	}
+}
+
+impl fmt::Display for BindAddresses {
+	fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+		f.write_str(&self.0.join(" "))
+	}
+}
+
+/// Whether protected mode refuses a client connecting from `peer`: it is
+/// on, the server listens on all interfaces, the default user needs no
+/// password and the client is not on the loopback interface.
+pub fn denies(peer: IpAddr) -> bool {
+	server_config!(protected_mode)
+		&& server_config!(host).is_all_interfaces()
+		&& !peer.to_canonical().is_loopback()
+		&& GCTX!(acl).default_needs_no_auth()
+}
+
+#[cfg(test)]
+mod tests {
+	use rstest::rstest;
+
+	use super::BindAddresses;
+
+	#[test]
+	fn test_parse_bind_addresses() {
+		let addrs = "127.0.0.1  ::1".parse::<BindAddresses>().unwrap();
+		assert_eq!(addrs.0, vec!["127.0.0.1", "::1"]);
+		assert_eq!(addrs.to_string(), "127.0.0.1 ::1");
+		assert_eq!(addrs.with_port(6379), vec!["127.0.0.1:6379", "[::1]:6379"]);
+		assert!(" ".parse::<BindAddresses>().is_err());
+	}
+
+	#[rstest]
+	#[case("0.0.0.0", true)]
+	#[case("127.0.0.1 ::", true)]
+	#[case("*", true)]
+	#[case("127.0.0.1 ::1", false)]
+	#[case("10.0.0.5", false)]
+	fn test_is_all_interfaces(#[case] host: &str, #[case] expected: bool) {
+		let addrs = host.parse::<BindAddresses>().unwrap();
+		assert_eq!(addrs.is_all_interfaces(), expected);
+	}
+}
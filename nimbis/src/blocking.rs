@@ -0,0 +1,251 @@
+//! Clients blocked until a key is written.
+//!
+//! A blocking command registers a [`KeyWaiter`] on its keys *before* its
+//! first read, through a [`BlockingRead`], then waits on it whenever the
+//! read comes back empty. Writes
+//! that can serve a blocked client call [`after_command`], which wakes every
+//! waiter on the written key; the woken command reads again. Registering
+//! first means a write landing between the read and the wait is not lost:
+//! the wake-up is kept until the waiter next waits.
+//!
+//! Blocked commands do not hold the exec lock while they wait, so they never
+//! hold off EXEC or scripts. Inside MULTI and scripts commands never block.
+
+use std::collections::HashMap;
+use std::sync::Arc;
+use std::sync::atomic::AtomicU64;
+use std::sync::atomic::Ordering;
+use std::time::Duration;
+use std::time::Instant;
+
+use bytes::Bytes;
+use dashmap::DashMap;
+use dashmap::mapref::entry::Entry;
+use tokio::sync::Notify;
+use tokio::sync::RwLockReadGuard;
+
+use crate::GCTX;
+use crate::cmd::CmdContext;
+use crate::cmd::ParsedCmd;
+
+/// Write commands that can serve a blocked client, keyed by their first
+/// argument.
+const SIGNAL_CMDS: &[&str] = &["XADD"];
+
+/// Commands that block when given a BLOCK option before STREAMS.
+const BLOCKING_CMDS: &[&str] = &["XREAD", "XREADGROUP"];
+
+/// Returns true if `parsed_cmd` may block: XREAD or XREADGROUP with a BLOCK
+/// option.
+pub fn may_block(parsed_cmd: &ParsedCmd) -> bool {
+	BLOCKING_CMDS.contains(&parsed_cmd.name.as_str())
+		&& parsed_cmd
+			.args
+			.iter()
+			.take_while(|arg| !arg.eq_ignore_ascii_case(b"STREAMS"))
+			.any(|arg| arg.eq_ignore_ascii_case(b"BLOCK"))
+}
+
+/// Take the exec lock for one read of a command that may block. Commands
+/// that may not block already run under it, so this returns `None` for them.
+pub async fn exec_guard(ctx: &CmdContext) -> Option<RwLockReadGuard<'static, ()>> {
+	if ctx.may_block {
+		Some(GCTX!(exec_lock).read().await)
+	} else {
+		None
+	}
+}
+
+/// Wake the clients blocked on the key written by a successful command.
+pub fn after_command(name: &str, args: &[Bytes]) {
+	if SIGNAL_CMDS.contains(&name)
+		&& let Some(key) = args.first()
+	{
+		GCTX!(blocking).signal(key);
+	}
+}
+
+/// Server-wide registry of the waiters blocked on each key.
+#[derive(Debug, Default)]
+pub struct Blocking {
+	waiters: DashMap<Bytes, HashMap<u64, Arc<Notify>>>,
+	next_id: AtomicU64,
+}
+
+impl Blocking {
+	pub fn new() -> Self {
+		Self::default()
+	}
+
+	/// Register a waiter on `keys`. It is unregistered when dropped.
+	pub fn watch(self: &Arc<Self>, keys: &[Bytes]) -> KeyWaiter {
+		let id = self.next_id.fetch_add(1, Ordering::Relaxed);
+		let notify = Arc::new(Notify::new());
+		for key in keys {
+			self.waiters
+				.entry(key.clone())
+				.or_default()
+				.insert(id, notify.clone());
+		}
+		KeyWaiter {
+			id,
+			keys: keys.to_vec(),
+			notify,
+			blocking: self.clone(),
+		}
+	}
+
+	/// Wake every waiter on `key`.
+	pub fn signal(&self, key: &Bytes) {
+		if let Some(waiters) = self.waiters.get(key) {
+			for notify in waiters.values() {
+				notify.notify_one();
+			}
+		}
+	}
+
+	/// Number of keys with at least one waiter.
+	pub fn blocked_keys(&self) -> usize {
+		self.waiters.len()
+	}
+
+	fn unwatch(&self, id: u64, keys: &[Bytes]) {
+		for key in keys {
+			if let Entry::Occupied(mut entry) = self.waiters.entry(key.clone()) {
+				entry.get_mut().remove(&id);
+				if entry.get().is_empty() {
+					entry.remove();
+				}
+			}
+		}
+	}
+}
+
+/// A blocked command's registration on its keys.
+#[derive(Debug)]
+pub struct KeyWaiter {
+	id: u64,
+	keys: Vec<Bytes>,
+	notify: Arc<Notify>,
+	blocking: Arc<Blocking>,
+}
+
+impl KeyWaiter {
+	/// Wait until one of the keys is written or `timeout` passes, returning
+	/// false on timeout. `None` waits forever.
+	pub async fn wait(&self, timeout: Option<Duration>) -> bool {
+		match timeout {
+			Some(timeout) => tokio::time::timeout(timeout, self.notify.notified())
+				.await
+				.is_ok(),
+			None => {
+				self.notify.notified().await;
+				true
+			}
+		}
+	}
+}
+
+impl Drop for KeyWaiter {
+	fn drop(&mut self) {
+		self.blocking.unwatch(self.id, &self.keys);
+	}
+}
+
+/// The waiting side of a read command with a BLOCK option.
+#[derive(Debug)]
+pub struct BlockingRead {
+	waiter: Option<KeyWaiter>,
+	deadline: Option<Instant>,
+}
+
+impl BlockingRead {
+	/// Watch `keys` for a command blocking `block` milliseconds, 0 meaning
+	/// forever. Nothing is watched if the command has no BLOCK option or
+	/// may not block. Call this before the command's first read.
+	pub fn new(ctx: &CmdContext, keys: &[Bytes], block: Option<u64>) -> Self {
+		let block = block.filter(|_| ctx.may_block);
+		Self {
+			waiter: block.map(|_| GCTX!(blocking).watch(keys)),
+			deadline: block
+				.filter(|&ms| ms > 0)
+				.map(|ms| Instant::now() + Duration::from_millis(ms)),
+		}
+	}
+
+	/// Wait until one of the keys is written. Returns false once the command
+	/// should reply that nothing was read: it does not block, or timed out.
+	pub async fn wait(&self) -> bool {
+		let Some(waiter) = &self.waiter else {
+			return false;
+		};
+		let timeout = self
+			.deadline
+			.map(|deadline| deadline.saturating_duration_since(Instant::now()));
+		if timeout.is_some_and(|timeout| timeout.is_zero()) {
+			return false;
+		}
+		waiter.wait(timeout).await
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use rstest::rstest;
+
+	use super::*;
+
+	fn keys(keys: &[&str]) -> Vec<Bytes> {
+		keys.iter()
+			.map(|key| Bytes::from(key.to_string()))
+			.collect()
+	}
+
+	#[tokio::test]
+	async fn test_signal_before_wait_is_kept() {
+		let blocking = Arc::new(Blocking::new());
+		let waiter = blocking.watch(&keys(&["a", "b"]));
+
+		blocking.signal(&Bytes::from("b"));
+		assert!(waiter.wait(Some(Duration::from_millis(10))).await);
+		assert!(!waiter.wait(Some(Duration::from_millis(10))).await);
+	}
+
+	#[tokio::test]
+	async fn test_signal_other_key_does_not_wake() {
+		let blocking = Arc::new(Blocking::new());
+		let waiter = blocking.watch(&keys(&["a"]));
+
+		blocking.signal(&Bytes::from("other"));
+		assert!(!waiter.wait(Some(Duration::from_millis(10))).await);
+	}
+
+	#[test]
+	fn test_drop_unregisters() {
+		let blocking = Arc::new(Blocking::new());
+		let first = blocking.watch(&keys(&["a", "b"]));
+		let second = blocking.watch(&keys(&["a"]));
+		assert_eq!(blocking.blocked_keys(), 2);
+
+		drop(first);
+		assert_eq!(blocking.blocked_keys(), 1);
+		drop(second);
+		assert_eq!(blocking.blocked_keys(), 0);
+	}
+
+	#[rstest]
+	#[case("XREAD", &["BLOCK", "0", "STREAMS", "s", "0"], true)]
+	#[case("XREAD", &["COUNT", "1", "block", "10", "STREAMS", "s", "0"], true)]
+	#[case("XREAD", &["STREAMS", "s", "0"], false)]
+	#[case("XREAD", &["STREAMS", "BLOCK", "0"], false)]
+	#[case("XREADGROUP", &["GROUP", "g", "c", "BLOCK", "0", "STREAMS", "s", ">"], true)]
+	#[case("XREADGROUP", &["GROUP", "g", "c", "STREAMS", "s", ">"], false)]
+	#[case("XRANGE", &["BLOCK", "-", "+"], false)]
+	fn test_may_block(#[case] name: &str, #[case] args: &[&str], #[case] expected: bool) {
+		let parsed_cmd = ParsedCmd {
+			name: name.to_string(),
+			args: keys(args),
+		};
+		assert_eq!(may_block(&parsed_cmd), expected);
+	}
+}
@@ -0,0 +1,50 @@
+use async_trait::async_trait;
+use bytes::Bytes;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+
+use super::filter::BloomFilter;
+use crate::cmd::Cmd;
+use crate::cmd::CmdContext;
+use crate::cmd::CmdMeta;
+use crate::extension;
+
+pub struct BfAddCmd {
+	meta: CmdMeta,
+}
+
+impl Default for BfAddCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "BF.ADD".to_string(),
+				// BF.ADD key item
+				arity: 3,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for BfAddCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let key = args[0].clone();
+		let item = &args[1];
+
+		let added = extension::update(storage, key, |filter: Option<BloomFilter>| {
+			// A missing filter is created with the default parameters.
+			let mut filter = filter.unwrap_or_default();
+			let added = filter.add(item).map_err(RespValue::error)?;
+			Ok((added.then_some(filter), added))
+		})
+		.await;
+		match added {
+			Ok(added) => RespValue::integer(added as i64),
+			Err(e) => e,
+		}
+	}
+}
@@ -0,0 +1,43 @@
+use async_trait::async_trait;
+use bytes::Bytes;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+
+use super::filter::BloomFilter;
+use crate::cmd::Cmd;
+use crate::cmd::CmdContext;
+use crate::cmd::CmdMeta;
+use crate::extension;
+
+pub struct BfExistsCmd {
+	meta: CmdMeta,
+}
+
+impl Default for BfExistsCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "BF.EXISTS".to_string(),
+				// BF.EXISTS key item
+				arity: 3,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for BfExistsCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		match extension::load::<BloomFilter>(storage, args[0].clone()).await {
+			Ok(filter) => {
+				let exists = filter.is_some_and(|filter| filter.contains(&args[1]));
+				RespValue::integer(exists as i64)
+			}
+			Err(e) => e,
+		}
+	}
+}
@@ -0,0 +1,61 @@
+use async_trait::async_trait;
+use bytes::Bytes;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+
+use super::filter::BloomFilter;
+use crate::cmd::Cmd;
+use crate::cmd::CmdContext;
+use crate::cmd::CmdMeta;
+use crate::extension;
+
+pub struct BfMAddCmd {
+	meta: CmdMeta,
+}
+
+impl Default for BfMAddCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "BF.MADD".to_string(),
+				// BF.MADD key item [item ...]
+				arity: -3,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for BfMAddCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let key = args[0].clone();
+		let items = &args[1..];
+
+		let replies = extension::update(storage, key, |filter: Option<BloomFilter>| {
+			let mut changed = filter.is_none();
+			let mut filter = filter.unwrap_or_default();
+			// Like RedisBloom, items that do not fit in a full filter are
+			// reported one by one.
+			let replies: Vec<_> = items
+				.iter()
+				.map(|item| match filter.add(item) {
+					Ok(added) => {
+						changed |= added;
+						RespValue::integer(added as i64)
+					}
+					Err(e) => RespValue::error(e),
+				})
+				.collect();
+			Ok((changed.then_some(filter), replies))
+		})
+		.await;
+		match replies {
+			Ok(replies) => RespValue::array(replies),
+			Err(e) => e,
+		}
+	}
+}
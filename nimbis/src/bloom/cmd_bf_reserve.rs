@@ -0,0 +1,135 @@
+use async_trait::async_trait;
+use bytes::Bytes;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+
+use super::filter::BloomFilter;
+use super::filter::DEFAULT_EXPANSION;
+use crate::cmd::Cmd;
+use crate::cmd::CmdContext;
+use crate::cmd::CmdMeta;
+use crate::cmd::utils;
+use crate::extension;
+
+pub struct BfReserveCmd {
+	meta: CmdMeta,
+}
+
+impl Default for BfReserveCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "BF.RESERVE".to_string(),
+				// BF.RESERVE key error_rate capacity [EXPANSION expansion] [NONSCALING]
+				arity: -4,
+			},
+		}
+	}
+}
+
+/// Parse the arguments of BF.RESERVE after the key, with the errors of
+/// RedisBloom.
+fn parse_args(args: &[Bytes]) -> Result<BloomFilter, String> {
+	let error_rate = utils::parse_float(&args[0]).map_err(|_| "ERR bad error rate".to_string())?;
+	if error_rate <= 0.0 || error_rate >= 1.0 {
+		return Err("ERR (0 < error rate range < 1)".to_string());
+	}
+	let capacity = utils::parse_int::<i64>(&args[1])
+		.ok()
+		.filter(|capacity| *capacity < u32::MAX as i64)
+		.ok_or_else(|| "ERR bad capacity".to_string())?;
+	if capacity <= 0 {
+		return Err("ERR (capacity should be larger than 0)".to_string());
+	}
+
+	let mut expansion = None;
+	let mut nonscaling = false;
+	let mut rest = &args[2..];
+	while let Some((arg, tail)) = rest.split_first() {
+		match arg.to_ascii_uppercase().as_slice() {
+			b"NONSCALING" => nonscaling = true,
+			b"EXPANSION" if !tail.is_empty() => {
+				let value = utils::parse_int::<u32>(&tail[0])
+					.ok()
+					.filter(|value| *value > 0)
+					.ok_or_else(|| "ERR bad expansion".to_string())?;
+				expansion = Some(value);
+				rest = &tail[1..];
+				continue;
+			}
+			_ => return Err("ERR syntax error".to_string()),
+		}
+		rest = tail;
+	}
+	if nonscaling && expansion.is_some() {
+		return Err("ERR Nonscaling filters cannot expand".to_string());
+	}
+
+	let expansion = (!nonscaling).then(|| expansion.unwrap_or(DEFAULT_EXPANSION));
+	Ok(BloomFilter::new(error_rate, capacity as u64, expansion))
+}
+
+#[async_trait]
+impl Cmd for BfReserveCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let key = args[0].clone();
+		let filter = match parse_args(&args[1..]) {
+			Ok(filter) => filter,
+			Err(e) => return RespValue::error(e),
+		};
+
+		let reserved = extension::update(storage, key, |current: Option<BloomFilter>| {
+			if current.is_some() {
+				return Err(RespValue::error("ERR item exists"));
+			}
+			Ok((Some(filter), ()))
+		})
+		.await;
+		match reserved {
+			Ok(()) => RespValue::simple_string("OK"),
+			Err(e) => e,
+		}
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use rstest::rstest;
+
+	use super::*;
+
+	fn args(args: &[&'static str]) -> Vec<Bytes> {
+		args.iter().map(|arg| Bytes::from(*arg)).collect()
+	}
+
+	#[test]
+	fn test_parse_args() {
+		let filter = parse_args(&args(&["0.01", "1000"])).unwrap();
+		assert_eq!(filter, BloomFilter::new(0.01, 1000, Some(2)));
+
+		let filter = parse_args(&args(&["0.001", "10", "expansion", "4"])).unwrap();
+		assert_eq!(filter, BloomFilter::new(0.001, 10, Some(4)));
+
+		let filter = parse_args(&args(&["0.1", "10", "NONSCALING"])).unwrap();
+		assert_eq!(filter, BloomFilter::new(0.1, 10, None));
+	}
+
+	#[rstest]
+	#[case(&["x", "10"], "bad error rate")]
+	#[case(&["1", "10"], "(0 < error rate range < 1)")]
+	#[case(&["0", "10"], "(0 < error rate range < 1)")]
+	#[case(&["0.01", "x"], "bad capacity")]
+	#[case(&["0.01", "4294967295"], "bad capacity")]
+	#[case(&["0.01", "0"], "capacity should be larger than 0")]
+	#[case(&["0.01", "10", "EXPANSION", "0"], "bad expansion")]
+	#[case(&["0.01", "10", "EXPANSION"], "syntax error")]
+	#[case(&["0.01", "10", "NONSCALING", "EXPANSION", "2"], "cannot expand")]
+	fn test_parse_args_errors(#[case] input: &[&'static str], #[case] expected: &str) {
+		let err = parse_args(&args(input)).unwrap_err();
+		assert!(err.contains(expected), "{err}");
+	}
+}
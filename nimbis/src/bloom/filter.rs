@@ -0,0 +1,281 @@
+use bytes::Buf;
+use bytes::BufMut;
+use bytes::Bytes;
+use bytes::BytesMut;
+use nimbis_storage::hll::hash::murmur_hash64a;
+
+use crate::extension::ExtensionType;
+
+/// Error rate of filters created by BF.ADD and BF.MADD.
+pub const DEFAULT_ERROR_RATE: f64 = 0.01;
+/// Capacity of filters created by BF.ADD and BF.MADD.
+pub const DEFAULT_CAPACITY: u64 = 100;
+pub const DEFAULT_EXPANSION: u32 = 2;
+
+/// Each layer has this fraction of the error rate of the one before, so
+/// the error rate of the whole chain stays below twice that of the first.
+const ERROR_TIGHTENING_RATIO: f64 = 0.5;
+/// Seed of the first hash of an item, as in RedisBloom.
+const HASH_SEED: u64 = 0xc6a4a7935bd1e995;
+const ENCODING_VERSION: u8 = 1;
+
+pub const FILTER_FULL: &str = "ERR non scaling filter is full";
+
+/// A scalable bloom filter, like those of RedisBloom: when the newest layer
+/// holds as many items as it was sized for, a layer `expansion` times larger
+/// is added.
+#[derive(Debug, Clone, PartialEq)]
+pub struct BloomFilter {
+	/// `None` for a filter that never grows.
+	expansion: Option<u32>,
+	layers: Vec<Layer>,
+}
+
+#[derive(Debug, Clone, PartialEq)]
+struct Layer {
+	capacity: u64,
+	size: u64,
+	error_rate: f64,
+	hashes: u32,
+	bits: Vec<u8>,
+}
+
+impl Default for BloomFilter {
+	fn default() -> Self {
+		Self::new(
+			DEFAULT_ERROR_RATE,
+			DEFAULT_CAPACITY,
+			Some(DEFAULT_EXPANSION),
+		)
+	}
+}
+
+impl BloomFilter {
+	/// A filter for `capacity` items at `error_rate` before it first grows.
+	pub fn new(error_rate: f64, capacity: u64, expansion: Option<u32>) -> Self {
+		Self {
+			expansion,
+			layers: vec![Layer::new(capacity, error_rate)],
+		}
+	}
+
+	/// Add `item`, returning whether it was new: an item that may already
+	/// be in the filter is not added again.
+	pub fn add(&mut self, item: &[u8]) -> Result<bool, String> {
+		let hash = ItemHash::new(item);
+		if self.contains_hash(&hash) {
+			return Ok(false);
+		}
+
+		let last = self.layers.last().expect("a filter has a layer");
+		if last.size >= last.capacity {
+			let Some(expansion) = self.expansion else {
+				return Err(FILTER_FULL.to_string());
+			};
+			let layer = Layer::new(
+				last.capacity.saturating_mul(expansion as u64),
+				last.error_rate * ERROR_TIGHTENING_RATIO,
+			);
+			self.layers.push(layer);
+		}
+		self.layers
+			.last_mut()
+			.expect("a filter has a layer")
+			.insert(&hash);
+		Ok(true)
+	}
+
+	/// Whether `item` may have been added; `false` is always right.
+	pub fn contains(&self, item: &[u8]) -> bool {
+		self.contains_hash(&ItemHash::new(item))
+	}
+
+	fn contains_hash(&self, hash: &ItemHash) -> bool {
+		// Recent layers are the largest, so check them first.
+		self.layers.iter().rev().any(|layer| layer.contains(hash))
+	}
+}
+
+impl Layer {
+	fn new(capacity: u64, error_rate: f64) -> Self {
+		let bits_per_item = -error_rate.ln() / std::f64::consts::LN_2.powi(2);
+		let bits = (capacity as f64 * bits_per_item).ceil() as u64;
+		let hashes = (std::f64::consts::LN_2 * bits_per_item).ceil() as u32;
+		Self {
+			capacity,
+			size: 0,
+			error_rate,
+			hashes: hashes.max(1),
+			bits: vec![0; bits.div_ceil(8).max(1) as usize],
+		}
+	}
+
+	fn insert(&mut self, hash: &ItemHash) {
+		let bit_count = self.bits.len() as u64 * 8;
+		for i in 0..self.hashes {
+			let bit = hash.bit(i, bit_count);
+			self.bits[(bit / 8) as usize] |= 1 << (bit % 8);
+		}
+		self.size += 1;
+	}
+
+	fn contains(&self, hash: &ItemHash) -> bool {
+		let bit_count = self.bits.len() as u64 * 8;
+		(0..self.hashes).all(|i| {
+			let bit = hash.bit(i, bit_count);
+			self.bits[(bit / 8) as usize] & (1 << (bit % 8)) != 0
+		})
+	}
+}
+
+/// The two hashes an item's bits are derived from, by double hashing.
+struct ItemHash {
+	a: u64,
+	b: u64,
+}
+
+impl ItemHash {
+	fn new(item: &[u8]) -> Self {
+		let a = murmur_hash64a(item, HASH_SEED);
+		let b = murmur_hash64a(item, a);
+		Self { a, b }
+	}
+
+	/// The `i`th bit of the item among `bit_count`.
+	fn bit(&self, i: u32, bit_count: u64) -> u64 {
+		self.a.wrapping_add((i as u64).wrapping_mul(self.b)) % bit_count
+	}
+}
+
+impl ExtensionType for BloomFilter {
+	/// The type name RedisBloom uses.
+	const NAME: &'static str = "MBbloom--";
+
+	fn encode(&self) -> Bytes {
+		// [Version: u8] [Expansion: u32, 0 if none] [LayerCount: u32], then
+		// per layer [Capacity: u64] [Size: u64] [ErrorRate: f64]
+		// [Hashes: u32] [BitsLen: u64] [Bits]
+		let bits_len: usize = self.layers.iter().map(|layer| layer.bits.len()).sum();
+		let mut bytes = BytesMut::with_capacity(9 + self.layers.len() * 36 + bits_len);
+		bytes.put_u8(ENCODING_VERSION);
+		bytes.put_u32(self.expansion.unwrap_or(0));
+		bytes.put_u32(self.layers.len() as u32);
+		for layer in &self.layers {
+			bytes.put_u64(layer.capacity);
+			bytes.put_u64(layer.size);
+			bytes.put_f64(layer.error_rate);
+			bytes.put_u32(layer.hashes);
+			bytes.put_u64(layer.bits.len() as u64);
+			bytes.extend_from_slice(&layer.bits);
+		}
+		bytes.freeze()
+	}
+
+	fn decode(payload: &[u8]) -> Result<Self, String> {
+		let corrupted = || "ERR corrupted bloom filter".to_string();
+		let mut buf = payload;
+		if buf.remaining() < 9 || buf.get_u8() != ENCODING_VERSION {
+			return Err(corrupted());
+		}
+		let expansion = Some(buf.get_u32()).filter(|expansion| *expansion > 0);
+		let layer_count = buf.get_u32();
+		if layer_count == 0 {
+			return Err(corrupted());
+		}
+
+		let mut layers = Vec::with_capacity(layer_count.min(64) as usize);
+		for _ in 0..layer_count {
+			if buf.remaining() < 36 {
+				return Err(corrupted());
+			}
+			let capacity = buf.get_u64();
+			let size = buf.get_u64();
+			let error_rate = buf.get_f64();
+			let hashes = buf.get_u32();
+			let bits_len = buf.get_u64();
+			if hashes == 0 || bits_len == 0 || (buf.remaining() as u64) < bits_len {
+				return Err(corrupted());
+			}
+			let bits = buf[..bits_len as usize].to_vec();
+			buf.advance(bits_len as usize);
+			layers.push(Layer {
+				capacity,
+				size,
+				error_rate,
+				hashes,
+				bits,
+			});
+		}
+		if buf.has_remaining() {
+			return Err(corrupted());
+		}
+		Ok(Self { expansion, layers })
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+
+	fn item(i: usize) -> Vec<u8> {
+		format!("item:{i}").into_bytes()
+	}
+
+	#[test]
+	fn test_add_contains() {
+		let mut filter = BloomFilter::default();
+		assert!(filter.add(b"a").unwrap());
+		assert!(!filter.add(b"a").unwrap());
+		assert!(filter.contains(b"a"));
+		assert!(!filter.contains(b"b"));
+	}
+
+	#[test]
+	fn test_false_positive_rate() {
+		let mut filter = BloomFilter::new(0.01, 1000, None);
+		for i in 0..1000 {
+			filter.add(&item(i)).unwrap();
+		}
+		for i in 0..1000 {
+			assert!(filter.contains(&item(i)));
+		}
+		let false_positives = (1000..11000).filter(|i| filter.contains(&item(*i))).count();
+		assert!(false_positives < 200, "{false_positives} false positives");
+	}
+
+	#[test]
+	fn test_scaling() {
+		let mut filter = BloomFilter::new(0.01, 10, Some(2));
+		let added = (0..100).filter(|i| filter.add(&item(*i)).unwrap()).count();
+		assert!(added > 90);
+		assert!(filter.layers.len() > 1);
+		assert_eq!(filter.layers[1].capacity, 20);
+		assert_eq!(filter.layers[1].error_rate, 0.005);
+		for i in 0..100 {
+			assert!(filter.contains(&item(i)));
+		}
+	}
+
+	#[test]
+	fn test_non_scaling_full() {
+		let mut filter = BloomFilter::new(0.01, 2, None);
+		assert!(filter.add(b"a").unwrap());
+		assert!(filter.add(b"b").unwrap());
+		assert!(!filter.add(b"a").unwrap());
+		assert_eq!(filter.add(b"c").unwrap_err(), FILTER_FULL);
+	}
+
+	#[test]
+	fn test_encode_decode() {
+		let mut filter = BloomFilter::new(0.001, 4, Some(3));
+		for i in 0..10 {
+			filter.add(&item(i)).unwrap();
+		}
+		let encoded = filter.encode();
+		assert_eq!(BloomFilter::decode(&encoded).unwrap(), filter);
+
+		assert!(BloomFilter::decode(&encoded[..encoded.len() - 1]).is_err());
+		assert!(BloomFilter::decode(b"").is_err());
+		assert!(BloomFilter::decode(b"\x02").is_err());
+	}
+}
@@ -0,0 +1,59 @@
+//! Scalable bloom filters with the core commands of RedisBloom, compiled in
+//! with the `bloom` feature.
+
+mod cmd_bf_add;
+mod cmd_bf_exists;
+mod cmd_bf_madd;
+mod cmd_bf_reserve;
+pub mod filter;
+
+use std::sync::Arc;
+
+use cmd_bf_add::BfAddCmd;
+use cmd_bf_exists::BfExistsCmd;
+use cmd_bf_madd::BfMAddCmd;
+use cmd_bf_reserve::BfReserveCmd;
+use filter::BloomFilter;
+
+use crate::extension::Extension;
+use crate::extension::Registrar;
+
+pub struct BloomExtension;
+
+impl Extension for BloomExtension {
+	/// The module name of RedisBloom.
+	fn name(&self) -> &'static str {
+		"bf"
+	}
+
+	fn version(&self) -> u32 {
+		1
+	}
+
+	fn register(&self, registrar: &mut Registrar<'_>) {
+		registrar.data_type::<BloomFilter>();
+		registrar.write_command("BF.RESERVE", Arc::new(BfReserveCmd::default()));
+		registrar.write_command("BF.ADD", Arc::new(BfAddCmd::default()));
+		registrar.write_command("BF.MADD", Arc::new(BfMAddCmd::default()));
+		registrar.command("BF.EXISTS", Arc::new(BfExistsCmd::default()));
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+	use crate::cmd::CmdTable;
+	use crate::extension::ExtensionRegistry;
+
+	#[test]
+	fn test_bloom_commands_are_registered() {
+		let registry = ExtensionRegistry::new(vec![Arc::new(BloomExtension)]);
+		let table = CmdTable::with_extensions(&registry);
+
+		assert!(table.is_write("BF.RESERVE"));
+		assert!(table.is_write("BF.ADD"));
+		assert!(table.is_write("BF.MADD"));
+		assert!(table.get_cmd("BF.EXISTS").is_some());
+		assert!(!table.is_write("BF.EXISTS"));
+	}
+}
@@ -6,7 +6,7 @@ use clap::Parser;
 #[derive(Parser, Debug)]
 #[command(author, version, about, long_about = None)]
 pub struct Cli {
-	/// Configuration file path (TOML, JSON, or YAML).
+	/// Configuration file path (TOML, JSON, YAML, or redis.conf style `.conf`).
 	/// If not provided, nimbis only checks `config/config.toml`, if present.
 	#[arg(short, long, value_hint = clap::ValueHint::FilePath)]
 	pub config: Option<PathBuf>,
@@ -15,7 +15,7 @@ pub struct Cli {
 	#[arg(short, long)]
 	pub port: Option<u16>,
 
-	/// Host to bind to
+	/// Addresses to bind to, separated by spaces
 	#[arg(long, value_hint = clap::ValueHint::Hostname)]
 	pub host: Option<String>,
 
@@ -26,6 +26,16 @@ pub struct Cli {
 	/// Number of Tokio runtime worker threads (default: number of CPU cores)
 	#[arg(long)]
 	pub runtime_threads: Option<usize>,
+
+	/// Set any config field, overriding the config file and environment
+	/// variables. May be repeated.
+	#[arg(long = "set", value_name = "FIELD=VALUE")]
+	pub set: Vec<String>,
+
+	/// Redis RDB file to load before accepting clients. Each key in the file
+	/// replaces the stored one; other keys are kept.
+	#[arg(long, value_hint = clap::ValueHint::FilePath)]
+	pub import_rdb: Option<PathBuf>,
 }
 
 #[cfg(test)]
@@ -40,4 +50,24 @@ mod tests {
 
 		assert_eq!(cli.runtime_threads, Some(4));
 	}
+
+	#[test]
+	fn parses_settings() {
+		let cli = Cli::parse_from([
+			"nimbis",
+			"--set",
+			"maxmemory=1048576",
+			"--set",
+			"slowlog-max-len=64",
+		]);
+
+		assert_eq!(cli.set, vec!["maxmemory=1048576", "slowlog-max-len=64"]);
+	}
+
+	#[test]
+	fn parses_import_rdb() {
+		let cli = Cli::parse_from(["nimbis", "--import-rdb", "dump.rdb"]);
+
+		assert_eq!(cli.import_rdb, Some("dump.rdb".into()));
+	}
 }
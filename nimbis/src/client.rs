@@ -1,6 +1,10 @@
 use std::sync::Arc;
 use std::sync::atomic::AtomicI64;
+use std::sync::atomic::AtomicU64;
+use std::sync::atomic::AtomicUsize;
 use std::sync::atomic::Ordering;
+use std::time::Duration;
+use std::time::Instant;
 
 use bytes::Bytes;
 use bytes::BytesMut;
@@ -10,6 +14,8 @@ use fastrace::prelude::Span;
 use fastrace::prelude::SpanContext;
 use fastrace::trace;
 use log::debug;
+use log::error;
+use nimbis_resp::EncodeError;
 use nimbis_resp::RespEncoder;
 use nimbis_resp::RespParseResult;
 use nimbis_resp::RespParser;
@@ -17,12 +23,62 @@ use nimbis_resp::RespValue;
 use nimbis_storage::Storage;
 use tokio::io::AsyncReadExt;
 use tokio::io::AsyncWriteExt;
-use tokio::net::TcpStream;
 
+use crate::GCTX;
+use crate::access;
+use crate::acl;
+use crate::acllog::Context;
+use crate::blocking;
+use crate::client_eviction::ClientMemory;
+use crate::cluster;
+use crate::cmd::Cmd;
 use crate::cmd::CmdContext;
 use crate::cmd::CmdTable;
 use crate::cmd::ParsedCmd;
+use crate::commandstats;
+use crate::config::SERVER_CONF;
+use crate::disk;
+use crate::latency::LatencyEvent;
+use crate::lazyfree;
+use crate::loading;
+use crate::maxmemory;
+use crate::output_buffer::OutputBuffer;
+use crate::persistence;
+use crate::pubsub;
+use crate::pubsub::Subscriber;
+use crate::ratelimit;
+use crate::ratelimit::Bucket;
+use crate::rename;
+use crate::replication;
+use crate::script;
 use crate::server_config;
+use crate::slowlog;
+use crate::threads;
+use crate::tls::ClientStream;
+use crate::tracking;
+use crate::tracking::Inbox;
+use crate::transaction;
+use crate::transaction::Transaction;
+
+/// How often a client waiting for the exec lock checks whether the running
+/// script has exceeded `lua_time_limit`.
+const BUSY_CHECK_INTERVAL: Duration = Duration::from_millis(10);
+
+/// How often an idle client checks whether it has exceeded `timeout`, so a
+/// changed timeout applies to clients that are already idle.
+const IDLE_CHECK_INTERVAL: Duration = Duration::from_secs(1);
+
+/// How often a client stuck writing its replies checks whether it has been
+/// above the soft limit of its output buffer for too long.
+const OUTPUT_CHECK_INTERVAL: Duration = Duration::from_secs(1);
+
+/// Replies held for a shared sync under `appendfsync always` are released
+/// once this many pile up, so a long pipeline of writes syncs in steps.
+const MAX_HELD_REPLIES: usize = 1024;
+
+/// Queued replies are written once they reach this size, even in the middle
+/// of a pipeline, so a long one does not hold all its replies in memory.
+const REPLY_FLUSH_THRESHOLD: usize = 64 * 1024;
 
 static NEXT_CLIENT_SESSION_ID: AtomicI64 = AtomicI64::new(1);
 
@@ -30,35 +86,176 @@ pub fn next_client_session_id() -> i64 {
 	NEXT_CLIENT_SESSION_ID.fetch_add(1, Ordering::Relaxed)
 }
 
-#[derive(Debug, Clone, Default)]
+#[derive(Debug, Clone)]
 pub struct ClientSession {
 	pub id: i64,
+	pub addr: String,
+	/// The local address the client connected to.
+	pub laddr: String,
+	/// The file descriptor of the socket, -1 where there is none.
+	pub fd: i64,
+	/// When the client connected.
+	pub created: Instant,
+	/// When the client last sent a command.
+	pub last_interaction: Instant,
+	/// The name the last command the client sent is registered under, None
+	/// before the first or after an unknown one.
+	pub last_cmd: Option<&'static str>,
 	pub name: Option<Bytes>,
+	/// Whether the client switched to RESP3 with HELLO 3.
+	pub resp3: bool,
+	/// Whether the client may write on a read-only replica, after READWRITE.
+	pub readwrite: bool,
+	/// Whether the client sent ASKING for its next command or transaction.
+	pub asking: bool,
+	/// Whether the client reads from cluster replicas, after READONLY.
+	pub readonly: bool,
+	/// The ACL user the client is logged in as, None until it authenticates.
+	pub user: Option<String>,
+	/// The client library and its version, set with CLIENT SETINFO.
+	pub lib_name: Option<Bytes>,
+	pub lib_ver: Option<Bytes>,
+}
+
+impl ClientSession {
+	/// Describe the client as a line of CLIENT LIST and CLIENT INFO.
+	pub fn info_line(&self) -> String {
+		let field = |value: &Option<Bytes>| {
+			value
+				.as_ref()
+				.map(|value| String::from_utf8_lossy(value).into_owned())
+				.unwrap_or_default()
+		};
+		// There is only the one database, so db is always 0.
+		format!(
+			"id={} addr={} laddr={} fd={} name={} age={} idle={} db=0 cmd={} lib-name={} lib-ver={}",
+			self.id,
+			self.addr,
+			self.laddr,
+			self.fd,
+			field(&self.name),
+			self.created.elapsed().as_secs(),
+			self.last_interaction.elapsed().as_secs(),
+			self.last_cmd
+				.map(str::to_lowercase)
+				.unwrap_or_else(|| "NULL".to_string()),
+			field(&self.lib_name),
+			field(&self.lib_ver)
+		)
+	}
+}
+
+/// The attributes of CLIENT SETINFO.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum LibAttr {
+	Name,
+	Version,
 }
 
 #[derive(Debug, Clone, Default)]
 pub struct ClientSessions {
 	sessions: Arc<DashMap<i64, ClientSession>>,
+	/// Registered clients, counted apart from `sessions` so admission
+	/// against `maxclients` is atomic.
+	connected: Arc<AtomicUsize>,
+	/// Connections accepted since startup.
+	received: Arc<AtomicU64>,
+	/// Connections refused because `maxclients` were connected.
+	rejected: Arc<AtomicU64>,
 }
 
 impl ClientSessions {
 	pub fn new() -> Self {
-		Self {
-			sessions: Arc::new(DashMap::new()),
-		}
+		Self::default()
 	}
 
-	pub fn register(&self, client_id: i64) {
-		self.sessions
-			.entry(client_id)
-			.or_insert_with(|| ClientSession {
+	/// Register a newly connected client, from `addr` to `laddr` on socket
+	/// `fd`, unless `maxclients` clients are connected already.
+	pub fn register(
+		&self,
+		client_id: i64,
+		addr: String,
+		laddr: String,
+		fd: i64,
+		maxclients: usize,
+	) -> bool {
+		self.received.fetch_add(1, Ordering::Relaxed);
+		let admitted = self
+			.connected
+			.fetch_update(Ordering::AcqRel, Ordering::Acquire, |connected| {
+				(connected < maxclients).then_some(connected + 1)
+			})
+			.is_ok();
+		if !admitted {
+			self.rejected.fetch_add(1, Ordering::Relaxed);
+			return false;
+		}
+		self.sessions.entry(client_id).or_insert_with(|| {
+			let now = Instant::now();
+			ClientSession {
 				id: client_id,
+				addr,
+				laddr,
+				fd,
+				created: now,
+				last_interaction: now,
+				last_cmd: None,
 				name: None,
-			});
+				resp3: false,
+				readwrite: false,
+				asking: false,
+				readonly: false,
+				user: None,
+				lib_name: None,
+				lib_ver: None,
+			}
+		});
+		true
 	}
 
 	pub fn unregister(&self, client_id: i64) {
-		self.sessions.remove(&client_id);
+		if self.sessions.remove(&client_id).is_some() {
+			self.connected.fetch_sub(1, Ordering::AcqRel);
+		}
+	}
+
+	/// The fields of the Clients INFO section.
+	pub fn info(&self) -> Vec<(String, String)> {
+		vec![
+			(
+				"connected_clients".to_string(),
+				self.connected.load(Ordering::Acquire).to_string(),
+			),
+			(
+				"maxclients".to_string(),
+				server_config!(maxclients).to_string(),
+			),
+		]
+	}
+
+	/// The connection counters of the Stats INFO section.
+	pub fn stats(&self) -> Vec<(String, String)> {
+		vec![
+			(
+				"total_connections_received".to_string(),
+				self.received.load(Ordering::Relaxed).to_string(),
+			),
+			(
+				"rejected_connections".to_string(),
+				self.rejected.load(Ordering::Relaxed).to_string(),
+			),
+		]
+	}
+
+	/// Note that the client sent command `name`, for the idle time and last
+	/// command of CLIENT LIST. This runs for every command, so the name is
+	/// kept as the one the command table holds rather than copied.
+	pub fn record_command(&self, client_id: i64, name: &str) {
+		let name = GCTX!(cmd_table).static_name(name);
+		if let Some(mut session) = self.sessions.get_mut(&client_id) {
+			session.last_interaction = Instant::now();
+			session.last_cmd = name;
+		}
 	}
 
 	pub fn set_name(&self, client_id: i64, name: Bytes) -> bool {
@@ -70,45 +267,202 @@ impl ClientSessions {
 		false
 	}
 
+	/// Restore a session to the state of a freshly connected client.
+	pub fn reset(&self, client_id: i64) {
+		if let Some(mut session) = self.sessions.get_mut(&client_id) {
+			session.name = None;
+			session.resp3 = false;
+			session.readwrite = false;
+			session.asking = false;
+			session.readonly = false;
+			session.user = None;
+		}
+	}
+
+	pub fn set_resp3(&self, client_id: i64, resp3: bool) {
+		if let Some(mut session) = self.sessions.get_mut(&client_id) {
+			session.resp3 = resp3;
+		}
+	}
+
+	pub fn is_resp3(&self, client_id: i64) -> bool {
+		self.sessions
+			.get(&client_id)
+			.is_some_and(|session| session.resp3)
+	}
+
+	pub fn set_readwrite(&self, client_id: i64, readwrite: bool) {
+		if let Some(mut session) = self.sessions.get_mut(&client_id) {
+			session.readwrite = readwrite;
+		}
+	}
+
+	pub fn is_readwrite(&self, client_id: i64) -> bool {
+		self.sessions
+			.get(&client_id)
+			.is_some_and(|session| session.readwrite)
+	}
+
+	pub fn set_asking(&self, client_id: i64, asking: bool) {
+		if let Some(mut session) = self.sessions.get_mut(&client_id) {
+			session.asking = asking;
+		}
+	}
+
+	pub fn is_asking(&self, client_id: i64) -> bool {
+		self.sessions
+			.get(&client_id)
+			.is_some_and(|session| session.asking)
+	}
+
+	pub fn set_readonly(&self, client_id: i64, readonly: bool) {
+		if let Some(mut session) = self.sessions.get_mut(&client_id) {
+			session.readonly = readonly;
+		}
+	}
+
+	pub fn is_readonly(&self, client_id: i64) -> bool {
+		self.sessions
+			.get(&client_id)
+			.is_some_and(|session| session.readonly)
+	}
+
+	pub fn set_user(&self, client_id: i64, user: Option<String>) {
+		if let Some(mut session) = self.sessions.get_mut(&client_id) {
+			session.user = user;
+		}
+	}
+
+	pub fn get_user(&self, client_id: i64) -> Option<String> {
+		self.sessions
+			.get(&client_id)
+			.and_then(|session| session.user.clone())
+	}
+
+	/// Describe the client as the ACL log reports it.
+	pub fn describe(&self, client_id: i64) -> String {
+		let Some(session) = self.sessions.get(&client_id) else {
+			return format!("id={}", client_id);
+		};
+		format!(
+			"id={} addr={} name={} user={}",
+			session.id,
+			session.addr,
+			session
+				.name
+				.as_ref()
+				.map(|name| String::from_utf8_lossy(name).into_owned())
+				.unwrap_or_default(),
+			session.user.as_deref().unwrap_or_default()
+		)
+	}
+
+	/// Log out every client logged in as a user that no longer exists.
+	pub fn deauthenticate_removed(&self, exists: impl Fn(&str) -> bool) {
+		for mut session in self.sessions.iter_mut() {
+			if session.user.as_deref().is_some_and(|user| !exists(user)) {
+				session.user = None;
+			}
+		}
+	}
+
 	pub fn get_name(&self, client_id: i64) -> Option<Bytes> {
 		self.sessions
 			.get(&client_id)
 			.and_then(|session| session.name.clone())
 	}
 
-	pub fn list(&self) -> Vec<(i64, Option<Bytes>)> {
+	/// Set the library name or version CLIENT SETINFO reports, or clear it
+	/// with None.
+	pub fn set_lib_info(&self, client_id: i64, attr: LibAttr, value: Option<Bytes>) -> bool {
+		if let Some(mut session) = self.sessions.get_mut(&client_id) {
+			match attr {
+				LibAttr::Name => session.lib_name = value,
+				LibAttr::Version => session.lib_ver = value,
+			}
+			return true;
+		}
+
+		false
+	}
+
+	pub fn get(&self, client_id: i64) -> Option<ClientSession> {
+		self.sessions
+			.get(&client_id)
+			.map(|session| session.value().clone())
+	}
+
+	pub fn list(&self) -> Vec<ClientSession> {
 		let mut entries = self
 			.sessions
 			.iter()
-			.map(|entry| (*entry.key(), entry.value().name.clone()))
+			.map(|entry| entry.value().clone())
 			.collect::<Vec<_>>();
 
-		entries.sort_by_key(|(client_id, _)| *client_id);
+		entries.sort_by_key(|session| session.id);
 		entries
 	}
 }
 
 pub struct ClientConnection {
-	socket: TcpStream,
+	socket: ClientStream,
 	parser: RespParser,
 	storage: Arc<Storage>,
 	cmd_table: Arc<CmdTable>,
 	ctx: CmdContext,
+	addr: String,
+	transaction: Option<Transaction>,
+	subscriber: Subscriber,
+	inbox: Inbox,
+	output: Arc<OutputBuffer>,
+	/// The memory of the connection, accounted for `maxmemory_clients`.
+	memory: Arc<ClientMemory>,
+	/// Encoded replies waiting to be written together.
+	replies: BytesMut,
+	/// Replies that wait, from the first write reply that must be synced
+	/// under `appendfsync always` on, for one flush of the log shared by the
+	/// batch's writes. The flag marks the replies of those writes. Nothing
+	/// is held under any other `appendonly` or `appendfsync` setting, where
+	/// replies are queued as they come.
+	held: Vec<(RespValue, bool)>,
+	/// Set when the command just executed is a write that must be synced.
+	awaiting_sync: bool,
+	/// The connection's `client_commands_per_second` bucket, made on its
+	/// first command with a limit set.
+	rate_bucket: Option<Bucket>,
 }
 
 impl ClientConnection {
 	pub fn new(
-		socket: TcpStream,
+		socket: ClientStream,
 		storage: Arc<Storage>,
 		cmd_table: Arc<CmdTable>,
 		ctx: CmdContext,
 	) -> Self {
+		let addr = socket
+			.peer_addr()
+			.map(|addr| addr.to_string())
+			.unwrap_or_default();
+		let output = Arc::new(OutputBuffer::new());
+		let subscriber = Subscriber::new(ctx.client_id, GCTX!(pubsub).clone(), output.clone());
+		let inbox = Inbox::new(ctx.client_id, GCTX!(tracking).clone(), output.clone());
+		let memory = GCTX!(client_eviction).register(ctx.client_id, output.clone());
 		Self {
 			socket,
 			parser: RespParser::new(),
 			storage,
 			cmd_table,
 			ctx,
+			addr,
+			transaction: None,
+			subscriber,
+			inbox,
+			output,
+			memory,
+			replies: BytesMut::new(),
+			held: Vec::new(),
+			awaiting_sync: false,
+			rate_bucket: None,
 		}
 	}
 
@@ -116,9 +470,39 @@ impl ClientConnection {
 	pub async fn run(&mut self) -> Result<(), Box<dyn std::error::Error + Send + Sync>> {
 		let mut buffer = BytesMut::with_capacity(4096);
 		debug!("Client connection started");
+		let mut last_active = Instant::now();
 
 		loop {
-			let n = match self.socket.read_buf(&mut buffer).await {
+			let subscribed = self.subscriber.is_active();
+			let read = tokio::select! {
+				read = self.socket.read_buf(&mut buffer) => read,
+				_ = self.output.closed() => return Ok(()),
+				_ = idle_timeout(last_active, subscribed) => {
+					debug!("Closing client idle for longer than timeout");
+					return Ok(());
+				}
+				message = self.subscriber.recv() => {
+					let resp3 = GCTX!(client_sessions).is_resp3(self.ctx.client_id);
+					// From here the message counts as a reply.
+					self.output.release(message.size());
+					if !self.write_response(message.to_resp(resp3)).await? {
+						return Ok(());
+					}
+					continue;
+				}
+				invalidation = self.inbox.recv() => {
+					let resp3 = GCTX!(client_sessions).is_resp3(self.ctx.client_id);
+					let subscribed = self.subscriber.is_subscribed(tracking::INVALIDATE_CHANNEL.as_bytes());
+					self.output.release(invalidation.size());
+					if let Some(reply) = invalidation.to_resp(resp3, subscribed)
+						&& !self.write_response(reply).await?
+					{
+						return Ok(());
+					}
+					continue;
+				}
+			};
+			let n = match read {
 				Ok(n) => n,
 				Err(e) if e.kind() == std::io::ErrorKind::ConnectionReset => {
 					debug!("Connection reset by peer");
@@ -127,6 +511,7 @@ impl ClientConnection {
 				Err(e) => return Err(e.into()),
 			};
 			debug!("Read {} bytes from socket", n);
+			self.memory.set_query_buffer(buffer.capacity());
 
 			if n == 0 {
 				if buffer.is_empty() {
@@ -136,54 +521,511 @@ impl ClientConnection {
 				}
 			}
 
+			// Run every complete command in the buffer and answer them all in
+			// one write, so pipelined commands cost one round of syscalls.
 			let mut parsed_cmds = Vec::new();
+			let mut protocol_error: Option<Box<dyn std::error::Error + Send + Sync>> = None;
+			self.parser.set_limits(SERVER_CONF.load().parser_limits());
 
 			loop {
 				match self.parser.parse(&mut buffer) {
-					RespParseResult::Complete(value) => {
-						let parsed_cmd: ParsedCmd = match value.try_into() {
-							Ok(cmd) => cmd,
-							Err(e) => {
-								let error_response =
-									RespValue::error(format!("ERR Protocol error: {}", e));
-								self.socket.write_all(&error_response.encode()?).await?;
-								return Err(e.into());
-							}
-						};
-						parsed_cmds.push(parsed_cmd);
-					}
+					RespParseResult::Complete(value) => match ParsedCmd::try_from(value) {
+						Ok(cmd) => parsed_cmds.push(cmd),
+						Err(e) => {
+							protocol_error = Some(e.into());
+							break;
+						}
+					},
 					RespParseResult::Incomplete => {
 						break;
 					}
 					RespParseResult::Error(e) => {
-						let error_response = RespValue::error(format!("ERR Protocol error: {}", e));
-						match self.socket.write_all(&error_response.encode()?).await {
-							Err(e) if e.kind() != std::io::ErrorKind::ConnectionReset => {
-								return Err(e.into());
-							}
-							_ => {}
-						}
-						return Err(e.into());
+						protocol_error = Some(e.into());
+						break;
 					}
 				}
 			}
 
-			for parsed_cmd in parsed_cmds {
-				let response = self.execute_command(parsed_cmd).await;
-				if let Err(e) = self.socket.write_all(&response.encode()?).await {
-					if e.kind() == std::io::ErrorKind::ConnectionReset {
-						debug!("Connection reset by peer");
+			for mut parsed_cmd in parsed_cmds {
+				match rename::resolve(&parsed_cmd.name) {
+					Some(name) => parsed_cmd.name = name,
+					None => {
+						if let Some(transaction) = self.transaction.as_mut() {
+							transaction.abort();
+						}
+						self.queue_response(unknown_cmd(&parsed_cmd.name))?;
+						continue;
+					}
+				}
+				// A replica asking for the dataset turns the connection into
+				// its replication link.
+				if parsed_cmd.name == "PSYNC"
+					&& self.transaction.is_none()
+					&& lookup_cmd(&self.cmd_table, &parsed_cmd).is_ok()
+				{
+					if let Err(err) = acl::check(
+						self.ctx.client_id,
+						&parsed_cmd.name,
+						&parsed_cmd.args,
+						Context::TopLevel,
+					) {
+						self.queue_response(RespValue::error(err))?;
+						continue;
+					}
+					// The replica reads its handshake replies before the
+					// snapshot.
+					if !self.flush_replies().await? {
 						return Ok(());
 					}
-					return Err(e.into());
+					return replication::serve_replica(
+						&mut self.socket,
+						&self.output,
+						&self.addr,
+						self.ctx.client_id,
+						&self.storage,
+						&parsed_cmd.args,
+						std::mem::take(&mut buffer),
+					)
+					.await;
+				}
+				// The replies before a command that may block must not wait
+				// for it.
+				if blocking::may_block(&parsed_cmd) && !self.flush_replies().await? {
+					return Ok(());
+				}
+				let responses = self.dispatch(parsed_cmd).await;
+				let needs_sync = std::mem::take(&mut self.awaiting_sync);
+				for response in responses {
+					if needs_sync {
+						self.held.push((response, true));
+					} else {
+						self.queue_response(response)?;
+					}
 				}
+				let flush = self.replies.len() >= REPLY_FLUSH_THRESHOLD
+					|| self.held.len() >= MAX_HELD_REPLIES;
+				if flush && !self.flush_replies().await? {
+					return Ok(());
+				}
+			}
+
+			if let Some(e) = protocol_error {
+				self.queue_response(RespValue::error(format!("ERR Protocol error: {}", e)))?;
+				self.flush_replies().await?;
+				return Err(e);
+			}
+			if !self.flush_replies().await? {
+				return Ok(());
 			}
+			// A blocking command may have waited longer than the timeout.
+			last_active = Instant::now();
+		}
+	}
+
+	/// Queue `response` after the replies waiting to be written.
+	fn queue_response(&mut self, response: RespValue) -> Result<(), EncodeError> {
+		if !self.held.is_empty() {
+			self.held.push((response, false));
+			return Ok(());
 		}
+		response.encode_to(&mut self.replies)
 	}
 
-	async fn execute_command(&self, parsed_cmd: ParsedCmd) -> RespValue {
+	/// Write `response` to the socket at once.
+	async fn write_response(
+		&mut self,
+		response: RespValue,
+	) -> Result<bool, Box<dyn std::error::Error + Send + Sync>> {
+		self.queue_response(response)?;
+		self.flush_replies().await
+	}
+
+	/// Write the queued replies to the socket, returning false if the peer
+	/// reset the connection or the client was closed for breaking its output
+	/// buffer limits while the write was stuck.
+	async fn flush_replies(&mut self) -> Result<bool, Box<dyn std::error::Error + Send + Sync>> {
+		if !self.held.is_empty() {
+			let synced = persistence::sync_writes(&self.storage).await;
+			for (response, needs_sync) in std::mem::take(&mut self.held) {
+				match &synced {
+					Err(err) if needs_sync => RespValue::error(err.clone()),
+					_ => response,
+				}
+				.encode_to(&mut self.replies)?;
+			}
+		}
+		if self.replies.is_empty() {
+			return Ok(true);
+		}
+		// The replies count towards the client's output buffer until they
+		// are written, so a client that stops reading a huge reply is closed
+		// by the limits of its class.
+		if !self.output.reserve(self.replies.len()) {
+			return Ok(false);
+		}
+		let mut check = tokio::time::interval_at(
+			(Instant::now() + OUTPUT_CHECK_INTERVAL).into(),
+			OUTPUT_CHECK_INTERVAL,
+		);
+		let written = loop {
+			tokio::select! {
+				written = self.socket.write_buf(&mut self.replies) => match written {
+					Ok(0) => break Err(std::io::ErrorKind::WriteZero.into()),
+					Ok(n) => {
+						self.output.release(n);
+						if self.replies.is_empty() {
+							break Ok(());
+						}
+					}
+					Err(e) => break Err(e),
+				},
+				_ = check.tick() => {
+					if !self.output.check() {
+						return Ok(false);
+					}
+				}
+				_ = self.output.closed() => return Ok(false),
+			}
+		};
+		// Do not keep the memory of an exceptionally large reply around.
+		if self.replies.capacity() > REPLY_FLUSH_THRESHOLD {
+			self.replies = BytesMut::new();
+		}
+		match written {
+			Ok(()) => Ok(true),
+			Err(e) if e.kind() == std::io::ErrorKind::ConnectionReset => {
+				debug!("Connection reset by peer");
+				Ok(false)
+			}
+			Err(e) => Err(e.into()),
+		}
+	}
+
+	/// Run one command and return its replies. Only the subscribe commands
+	/// reply more than once, with one confirmation per channel or pattern.
+	async fn dispatch(&mut self, parsed_cmd: ParsedCmd) -> Vec<RespValue> {
+		GCTX!(client_sessions).record_command(self.ctx.client_id, &parsed_cmd.name);
+		let queued = self.transaction.is_some() && !transaction::runs_immediately(&parsed_cmd.name);
+		// ASKING holds for the next command, or until the transaction it was
+		// sent in ends.
+		let asking = GCTX!(client_sessions).is_asking(self.ctx.client_id);
+		let spent = match parsed_cmd.name.as_str() {
+			"ASKING" | "MULTI" => false,
+			"EXEC" | "DISCARD" => true,
+			_ => self.transaction.is_none(),
+		};
+		if asking && spent {
+			GCTX!(client_sessions).set_asking(self.ctx.client_id, false);
+		}
+		let context = if queued {
+			Context::Multi
+		} else {
+			Context::TopLevel
+		};
+		if let Err(err) = acl::check(
+			self.ctx.client_id,
+			&parsed_cmd.name,
+			&parsed_cmd.args,
+			context,
+		) {
+			if queued && let Some(transaction) = self.transaction.as_mut() {
+				transaction.abort();
+			}
+			commandstats::record_rejected(&parsed_cmd.name);
+			return vec![RespValue::error(err)];
+		}
+		if !ratelimit::allow(self.ctx.client_id, &mut self.rate_bucket) {
+			if queued && let Some(transaction) = self.transaction.as_mut() {
+				transaction.abort();
+			}
+			commandstats::record_rejected(&parsed_cmd.name);
+			return vec![RespValue::error(ratelimit::RATE_LIMITED)];
+		}
+		if let Err(err) = loading::check(&parsed_cmd.name) {
+			if queued && let Some(transaction) = self.transaction.as_mut() {
+				transaction.abort();
+			}
+			commandstats::record_rejected(&parsed_cmd.name);
+			return vec![RespValue::error(err)];
+		}
+		// EXEC is routed by the keys of every command it runs, and discards
+		// the transaction if they are refused.
+		let readonly = GCTX!(client_sessions).is_readonly(self.ctx.client_id);
+		let routed = match self.transaction.as_ref() {
+			Some(transaction) if parsed_cmd.name == "EXEC" => {
+				cluster::check(
+					&self.storage,
+					transaction
+						.queued()
+						.iter()
+						.map(|cmd| (cmd.name.as_str(), cmd.args.as_slice())),
+					asking,
+					readonly,
+				)
+				.await
+			}
+			_ => {
+				cluster::check(
+					&self.storage,
+					[(parsed_cmd.name.as_str(), parsed_cmd.args.as_slice())],
+					asking,
+					readonly,
+				)
+				.await
+			}
+		};
+		if let Err(err) = routed {
+			if parsed_cmd.name == "EXEC" {
+				self.transaction = None;
+			} else if queued && let Some(transaction) = self.transaction.as_mut() {
+				transaction.abort();
+			}
+			commandstats::record_rejected(&parsed_cmd.name);
+			return vec![RespValue::error(err)];
+		}
+		let resp3 = GCTX!(client_sessions).is_resp3(self.ctx.client_id);
+		if self.subscriber.is_active() && !resp3 {
+			if !pubsub::allowed_in_subscribe_mode(&parsed_cmd.name) {
+				commandstats::record_rejected(&parsed_cmd.name);
+				return vec![RespValue::error(format!(
+					"ERR Can't execute '{}': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context",
+					parsed_cmd.name.to_lowercase()
+				))];
+			}
+			if parsed_cmd.name == "PING" && parsed_cmd.args.len() <= 1 {
+				let payload = parsed_cmd.args.first().cloned().unwrap_or_default();
+				commandstats::record_call("PING", Duration::ZERO, false);
+				return vec![pubsub::frame(
+					false,
+					vec![
+						RespValue::bulk_string("pong"),
+						RespValue::bulk_string(payload),
+					],
+				)];
+			}
+		}
+
+		match parsed_cmd.name.as_str() {
+			"SUBSCRIBE" | "UNSUBSCRIBE" | "PSUBSCRIBE" | "PUNSUBSCRIBE"
+				if self.transaction.is_none() =>
+			{
+				if let Err(err) = lookup_cmd(&self.cmd_table, &parsed_cmd) {
+					commandstats::record_rejected(&parsed_cmd.name);
+					return vec![err];
+				}
+				let start = Instant::now();
+				let args = &parsed_cmd.args;
+				let replies = match parsed_cmd.name.as_str() {
+					"SUBSCRIBE" => self.subscriber.subscribe(args, resp3),
+					"UNSUBSCRIBE" => self.subscriber.unsubscribe(args, resp3),
+					"PSUBSCRIBE" => self.subscriber.psubscribe(args, resp3),
+					_ => self.subscriber.punsubscribe(args, resp3),
+				};
+				commandstats::record_call(&parsed_cmd.name, start.elapsed(), false);
+				replies
+			}
+			_ => vec![self.execute_command(parsed_cmd).await],
+		}
+	}
+
+	async fn execute_command(&mut self, parsed_cmd: ParsedCmd) -> RespValue {
+		if !transaction::runs_immediately(&parsed_cmd.name)
+			&& let Some(transaction) = self.transaction.as_mut()
+		{
+			return match lookup_cmd(&self.cmd_table, &parsed_cmd).and_then(|_| {
+				disk::check_write(&parsed_cmd.name)
+					.and_then(|_| maxmemory::check_write(&parsed_cmd.name))
+					.and_then(|_| replication::check_write(&parsed_cmd.name, self.ctx.client_id))
+					.map_err(RespValue::error)
+			}) {
+				Ok(_) => {
+					transaction.queue(parsed_cmd);
+					RespValue::simple_string("QUEUED")
+				}
+				Err(err) => {
+					transaction.abort();
+					commandstats::record_rejected(&parsed_cmd.name);
+					err
+				}
+			};
+		}
+
+		if let Err(err) = disk::check_write(&parsed_cmd.name)
+			.and_then(|_| maxmemory::check_write(&parsed_cmd.name))
+			.and_then(|_| replication::check_write(&parsed_cmd.name, self.ctx.client_id))
+		{
+			commandstats::record_rejected(&parsed_cmd.name);
+			return RespValue::error(err);
+		}
+
+		let start = Instant::now();
+		let response = match parsed_cmd.name.as_str() {
+			"MULTI" | "EXEC" | "DISCARD" => self.execute_transaction_cmd(&parsed_cmd).await,
+			name if transaction::runs_atomically(name) => {
+				match self
+					.execute_atomically(std::slice::from_ref(&parsed_cmd))
+					.await
+				{
+					Ok(mut responses) => responses.pop().unwrap_or(RespValue::Null),
+					Err(err) => err,
+				}
+			}
+			name => {
+				if name == "RESET" {
+					self.transaction = None;
+					self.subscriber.clear();
+				}
+				if script::runs_while_busy(&parsed_cmd) {
+					self.execute_command_traced(&parsed_cmd, &self.ctx).await
+				} else if blocking::may_block(&parsed_cmd) {
+					self.execute_blocking(&parsed_cmd).await
+				} else {
+					let _slot = threads::command_slot().await;
+					match wait_unless_busy(GCTX!(exec_lock).read()).await {
+						Ok(_guard) => {
+							let _order =
+								GCTX!(replication).order_guard(name, &parsed_cmd.args).await;
+							// A failover may have made this server a replica
+							// while the write waited.
+							match replication::check_write(name, self.ctx.client_id) {
+								Ok(()) => self.execute_command_traced(&parsed_cmd, &self.ctx).await,
+								Err(err) => RespValue::error(err),
+							}
+						}
+						Err(busy) => busy,
+					}
+				}
+			}
+		};
+		// The reply waits for the writes of the whole batch to be synced.
+		if !response.is_error() && persistence::needs_sync(&parsed_cmd.name) {
+			self.awaiting_sync = true;
+		}
+		let duration = start.elapsed();
+		GCTX!(tracking).end_command(self.ctx.client_id, &parsed_cmd.name, &parsed_cmd.args);
+		// Time spent blocked is waiting, not work, so it is not reported.
+		if !blocking::may_block(&parsed_cmd) {
+			self.record_slowlog(&parsed_cmd, duration);
+			GCTX!(latency_monitor).add_sample_if_needed(
+				server_config!(latency_monitor_threshold),
+				LatencyEvent::Command,
+				duration,
+			);
+			if server_config!(latency_tracking)
+				&& self.cmd_table.get_cmd(&parsed_cmd.name).is_some()
+			{
+				GCTX!(command_latencies).record(&parsed_cmd.name, duration);
+			}
+		}
+		response
+	}
+
+	/// Run a command that may block. It takes the exec lock itself for each
+	/// read, so it does not hold off EXEC and scripts while it waits, and it
+	/// is abandoned if the peer disconnects meanwhile.
+	async fn execute_blocking(&self, parsed_cmd: &ParsedCmd) -> RespValue {
+		let ctx = CmdContext {
+			may_block: true,
+			..self.ctx
+		};
+		tokio::select! {
+			response = self.execute_command_traced(parsed_cmd, &ctx) => response,
+			_ = peer_closed(&self.socket) => RespValue::Null,
+			_ = self.output.closed() => RespValue::Null,
+		}
+	}
+
+	/// Handle MULTI, EXEC and DISCARD against this connection's transaction.
+	async fn execute_transaction_cmd(&mut self, parsed_cmd: &ParsedCmd) -> RespValue {
+		if let Err(err) = lookup_cmd(&self.cmd_table, parsed_cmd) {
+			if let Some(transaction) = self.transaction.as_mut() {
+				transaction.abort();
+			}
+			commandstats::record_rejected(&parsed_cmd.name);
+			return err;
+		}
+
+		let start = Instant::now();
+		let response = match parsed_cmd.name.as_str() {
+			"MULTI" => {
+				if self.transaction.is_some() {
+					return RespValue::error("ERR MULTI calls can not be nested");
+				}
+				self.transaction = Some(Transaction::new());
+				RespValue::simple_string("OK")
+			}
+			"DISCARD" => match self.transaction.take() {
+				Some(_) => RespValue::simple_string("OK"),
+				None => RespValue::error("ERR DISCARD without MULTI"),
+			},
+			_ => match self.transaction.take() {
+				None => RespValue::error("ERR EXEC without MULTI"),
+				Some(transaction) if transaction.is_aborted() => {
+					RespValue::error("EXECABORT Transaction discarded because of previous errors.")
+				}
+				Some(transaction) => self.exec(transaction).await,
+			},
+		};
+		commandstats::record_call(&parsed_cmd.name, start.elapsed(), response.is_error());
+		response
+	}
+
+	/// Run the queued commands as one atomic group.
+	async fn exec(&self, transaction: Transaction) -> RespValue {
+		let cmds = transaction.into_queued();
+		// The disk or memory may have filled up, this server become a replica, or the
+		// user lost permissions since the commands were queued.
+		if let Some(err) = cmds.iter().find_map(|cmd| {
+			acl::check(self.ctx.client_id, &cmd.name, &cmd.args, Context::Multi)
+				.and_then(|_| disk::check_write(&cmd.name))
+				.and_then(|_| maxmemory::check_write(&cmd.name))
+				.and_then(|_| replication::check_write(&cmd.name, self.ctx.client_id))
+				.err()
+		}) {
+			return RespValue::error(err);
+		}
+		match self.execute_atomically(&cmds).await {
+			Ok(responses) => RespValue::array(responses),
+			Err(err) => err,
+		}
+	}
+
+	/// Run `cmds` while holding the exec lock exclusively, so no other client
+	/// can interleave with them. Their writes form one atomic storage group:
+	/// after a crash they are either all visible or all rolled back.
+	async fn execute_atomically(&self, cmds: &[ParsedCmd]) -> Result<Vec<RespValue>, RespValue> {
+		let _guard = wait_unless_busy(GCTX!(exec_lock).write()).await?;
+		// A failover may have made this server a replica while the group
+		// waited.
+		if let Some(err) = cmds
+			.iter()
+			.find_map(|cmd| replication::check_write(&cmd.name, self.ctx.client_id).err())
+		{
+			return Err(RespValue::error(err));
+		}
+		if let Err(e) = self.storage.begin_atomic().await {
+			return Err(RespValue::error(e.to_string()));
+		}
+
+		let replication = GCTX!(replication);
+		replication.begin_group();
+		let mut responses = Vec::new();
+		for parsed_cmd in cmds {
+			responses.push(self.execute_command_traced(parsed_cmd, &self.ctx).await);
+		}
+
+		let committed = self.storage.commit_atomic().await;
+		replication.end_group(committed.is_ok());
+		if let Err(e) = committed {
+			error!("Failed to commit atomic group: {}", e);
+			return Err(RespValue::error(e.to_string()));
+		}
+		Ok(responses)
+	}
+
+	async fn execute_command_traced(&self, parsed_cmd: &ParsedCmd, ctx: &CmdContext) -> RespValue {
 		if !server_config!(trace_enabled) {
-			return self.execute_command_inner(parsed_cmd).await;
+			return self.execute_command_inner(parsed_cmd, ctx).await;
 		}
 
 		let sampling_ratio = server_config!(trace_sampling_ratio);
@@ -192,29 +1034,136 @@ impl ClientConnection {
 		let root_span = Span::root(fastrace::func_path!(), span_context).with_properties(|| {
 			[
 				("cmd", parsed_cmd.name.clone()),
-				("client_id", self.ctx.client_id.to_string()),
+				("client_id", ctx.client_id.to_string()),
 			]
 		});
 
-		self.execute_command_inner(parsed_cmd)
+		self.execute_command_inner(parsed_cmd, ctx)
 			.in_span(root_span)
 			.await
 	}
 
+	fn record_slowlog(&self, parsed_cmd: &ParsedCmd, duration: Duration) {
+		if !slowlog::is_slow(server_config!(slowlog_log_slower_than), duration)
+			|| self.cmd_table.get_cmd(&parsed_cmd.name).is_none()
+		{
+			return;
+		}
+
+		GCTX!(slowlog).record(
+			server_config!(slowlog_max_len),
+			&parsed_cmd.name,
+			&parsed_cmd.args,
+			duration,
+			&self.addr,
+			GCTX!(client_sessions).get_name(self.ctx.client_id),
+		);
+	}
+
 	#[trace]
-	async fn execute_command_inner(&self, parsed_cmd: ParsedCmd) -> RespValue {
-		let Some(cmd) = self.cmd_table.get_cmd(&parsed_cmd.name) else {
-			return RespValue::error(format!(
-				"ERR unknown command '{}'",
-				parsed_cmd.name.to_lowercase()
-			));
+	async fn execute_command_inner(&self, parsed_cmd: &ParsedCmd, ctx: &CmdContext) -> RespValue {
+		let response = match lookup_cmd(&self.cmd_table, parsed_cmd) {
+			Ok(cmd) => {
+				let start = Instant::now();
+				let response = cmd.do_cmd(&self.storage, &parsed_cmd.args, ctx).await;
+				// Time spent blocked is waiting, not work, so it is not counted.
+				let duration = if ctx.may_block {
+					Duration::ZERO
+				} else {
+					start.elapsed()
+				};
+				commandstats::record_call(&parsed_cmd.name, duration, response.is_error());
+				response
+			}
+			Err(err) => {
+				commandstats::record_rejected(&parsed_cmd.name);
+				err
+			}
 		};
+		run_command_hooks(ctx.client_id, &parsed_cmd.name, &parsed_cmd.args, &response);
+		response
+	}
+}
 
-		if let Err(err) = cmd.meta().validate_arity(parsed_cmd.args.len() + 1) {
-			return RespValue::error(err);
+/// Run the hooks that follow a command a client ran, from the connection or
+/// from a script, if it succeeded with `response`: key tracking, access
+/// times, lazy freeing, waking blocked clients, persistence and replication.
+pub fn run_command_hooks(client_id: i64, name: &str, args: &[Bytes], response: &RespValue) {
+	if response.is_error() {
+		return;
+	}
+	tracking::after_command(client_id, name, args);
+	access::after_command(name, args);
+	lazyfree::after_command(name, args);
+	blocking::after_command(name, args);
+	persistence::after_command(name);
+	replication::after_command(name, args, response);
+}
+
+/// Resolve a command and validate its arity, returning the error reply on
+/// failure.
+fn lookup_cmd<'a>(
+	cmd_table: &'a CmdTable,
+	parsed_cmd: &ParsedCmd,
+) -> Result<&'a Arc<dyn Cmd>, RespValue> {
+	let Some(cmd) = cmd_table.get_cmd(&parsed_cmd.name) else {
+		return Err(unknown_cmd(&parsed_cmd.name));
+	};
+
+	if let Err(err) = cmd.meta().validate_arity(parsed_cmd.args.len() + 1) {
+		return Err(RespValue::error(err));
+	}
+
+	Ok(cmd)
+}
+
+fn unknown_cmd(name: &str) -> RespValue {
+	RespValue::error(format!("ERR unknown command '{}'", name.to_lowercase()))
+}
+
+/// Wait for `acquire` unless a script has been running for longer than
+/// `lua_time_limit`, in which case give up with a BUSY error.
+async fn wait_unless_busy<F: Future>(acquire: F) -> Result<F::Output, RespValue> {
+	let mut acquire = std::pin::pin!(acquire);
+	loop {
+		let time_limit = Duration::from_millis(server_config!(lua_time_limit));
+		if let Some(busy) = GCTX!(running_script).busy_reply(time_limit) {
+			return Err(busy);
+		}
+
+		tokio::select! {
+			biased;
+			output = &mut acquire => return Ok(output),
+			_ = tokio::time::sleep(BUSY_CHECK_INTERVAL) => {}
 		}
+	}
+}
+
+/// Resolve once the client has sent nothing for `timeout` seconds since its
+/// last commands finished at `last_active`. Subscribed clients wait for
+/// messages, not commands, so they are never idle, and blocked clients are
+/// not waiting here at all.
+async fn idle_timeout(last_active: Instant, subscribed: bool) {
+	if subscribed {
+		return std::future::pending().await;
+	}
+	loop {
+		let timeout = server_config!(timeout);
+		if timeout > 0 && last_active.elapsed() >= Duration::from_secs(timeout) {
+			return;
+		}
+		tokio::time::sleep(IDLE_CHECK_INTERVAL).await;
+	}
+}
 
-		cmd.do_cmd(&self.storage, &parsed_cmd.args, &self.ctx).await
+/// Resolve once the peer has closed the connection. If the peer sends more
+/// input instead, it stays queued for after the current command and this
+/// never resolves.
+async fn peer_closed(socket: &ClientStream) {
+	let mut byte = [0u8; 1];
+	match socket.tcp().peek(&mut byte).await {
+		Ok(0) | Err(_) => {}
+		Ok(_) => std::future::pending().await,
 	}
 }
 
@@ -0,0 +1,221 @@
+//! Client eviction under memory pressure.
+//!
+//! Every connection holds memory of its own: the query buffer its commands
+//! are read into, and the output buffer of replies, pub/sub messages and
+//! invalidations queued for it. Output buffer limits bound what one client
+//! may queue, but many clients together can still take more memory than the
+//! dataset. With `maxmemory_clients` set, once the memory of all clients
+//! goes over it, the clients using the most are closed until the rest fit.
+//! Clients that sent `CLIENT NO-EVICT on` and replicas are never evicted.
+
+use std::sync::Arc;
+use std::sync::atomic::AtomicBool;
+use std::sync::atomic::AtomicU64;
+use std::sync::atomic::AtomicUsize;
+use std::sync::atomic::Ordering;
+use std::time::Duration;
+
+use dashmap::DashMap;
+use log::warn;
+
+use crate::GCTX;
+use crate::output_buffer::ClientClass;
+use crate::output_buffer::OutputBuffer;
+use crate::server_config;
+
+/// How often the memory of the clients is checked against the limit.
+const EVICTION_CHECK_INTERVAL: Duration = Duration::from_millis(100);
+
+/// The memory one connection holds.
+#[derive(Debug)]
+pub struct ClientMemory {
+	output: Arc<OutputBuffer>,
+	/// Bytes allocated for the query buffer.
+	query: AtomicUsize,
+	no_evict: AtomicBool,
+}
+
+impl ClientMemory {
+	/// Account for a query buffer of `size` bytes.
+	pub fn set_query_buffer(&self, size: usize) {
+		self.query.store(size, Ordering::Relaxed);
+	}
+
+	/// The query and output buffer bytes of the client.
+	pub fn total(&self) -> usize {
+		self.query.load(Ordering::Relaxed) + self.output.pending()
+	}
+
+	fn evictable(&self) -> bool {
+		!self.no_evict.load(Ordering::Relaxed) && self.output.class() != ClientClass::Replica
+	}
+}
+
+#[derive(Debug, Default)]
+pub struct ClientEviction {
+	clients: DashMap<i64, Arc<ClientMemory>>,
+	/// Clients closed for going over `maxmemory_clients` since startup.
+	evicted: AtomicU64,
+}
+
+impl ClientEviction {
+	pub fn new() -> Self {
+		Self::default()
+	}
+
+	/// Account for the memory of a new connection.
+	pub fn register(&self, client_id: i64, output: Arc<OutputBuffer>) -> Arc<ClientMemory> {
+		let memory = Arc::new(ClientMemory {
+			output,
+			query: AtomicUsize::new(0),
+			no_evict: AtomicBool::new(false),
+		});
+		self.clients.insert(client_id, memory.clone());
+		memory
+	}
+
+	pub fn unregister(&self, client_id: i64) {
+		self.clients.remove(&client_id);
+	}
+
+	/// Set whether the client may be evicted. Returns false if it is gone.
+	pub fn set_no_evict(&self, client_id: i64, no_evict: bool) -> bool {
+		match self.clients.get(&client_id) {
+			Some(memory) => {
+				memory.no_evict.store(no_evict, Ordering::Relaxed);
+				true
+			}
+			None => false,
+		}
+	}
+
+	/// The query and output buffer bytes of all clients.
+	pub fn used(&self) -> usize {
+		self.clients.iter().map(|memory| memory.total()).sum()
+	}
+
+	/// Close the clients using the most memory until the others fit in
+	/// `limit` bytes. A limit of 0 evicts nothing.
+	pub fn enforce(&self, limit: usize) {
+		if limit == 0 {
+			return;
+		}
+		let mut used = 0;
+		let mut candidates = Vec::new();
+		for entry in self.clients.iter() {
+			// A closed client frees its memory as soon as its task ends.
+			if entry.output.is_closed() {
+				continue;
+			}
+			let total = entry.total();
+			used += total;
+			if entry.evictable() {
+				candidates.push((total, *entry.key(), entry.value().clone()));
+			}
+		}
+		if used <= limit {
+			return;
+		}
+		candidates.sort_by_key(|(total, _, _)| std::cmp::Reverse(*total));
+		for (total, client_id, memory) in candidates {
+			if used <= limit {
+				break;
+			}
+			warn!(
+				"Evicting client id={} using {} bytes: clients use {} bytes, over maxmemory_clients {}",
+				client_id, total, used, limit
+			);
+			memory.output.evict();
+			self.evicted.fetch_add(1, Ordering::Relaxed);
+			used -= total;
+		}
+	}
+
+	/// The fields of the Clients INFO section.
+	pub fn info(&self) -> Vec<(String, String)> {
+		vec![
+			("clients_memory".to_string(), self.used().to_string()),
+			(
+				"maxmemory_clients".to_string(),
+				server_config!(maxmemory_clients).to_string(),
+			),
+		]
+	}
+
+	/// The eviction counter of the Stats INFO section.
+	pub fn stats(&self) -> Vec<(String, String)> {
+		vec![(
+			"evicted_clients".to_string(),
+			self.evicted.load(Ordering::Relaxed).to_string(),
+		)]
+	}
+}
+
+/// Check the memory of the clients against `maxmemory_clients` for the
+/// lifetime of the server.
+pub fn start_client_eviction() {
+	tokio::spawn(async move {
+		let mut interval = tokio::time::interval(EVICTION_CHECK_INTERVAL);
+		loop {
+			interval.tick().await;
+			GCTX!(client_eviction).enforce(server_config!(maxmemory_clients));
+		}
+	});
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+
+	fn client(eviction: &ClientEviction, client_id: i64, output: usize) -> Arc<ClientMemory> {
+		let buffer = Arc::new(OutputBuffer::new());
+		assert!(buffer.reserve(output));
+		let memory = eviction.register(client_id, buffer);
+		memory.set_query_buffer(100);
+		memory
+	}
+
+	#[test]
+	fn test_evicts_largest_clients_first() {
+		let eviction = ClientEviction::new();
+		let small = client(&eviction, 1, 100);
+		let large = client(&eviction, 2, 5000);
+		let medium = client(&eviction, 3, 1000);
+		assert_eq!(eviction.used(), 6400);
+
+		eviction.enforce(0);
+		eviction.enforce(6400);
+		assert!(!large.output.is_closed());
+
+		eviction.enforce(2000);
+		assert!(large.output.is_closed());
+		assert!(!medium.output.is_closed());
+		assert!(!small.output.is_closed());
+		assert_eq!(eviction.evicted.load(Ordering::Relaxed), 1);
+
+		eviction.enforce(1000);
+		assert!(medium.output.is_closed());
+		assert!(!small.output.is_closed());
+	}
+
+	#[test]
+	fn test_no_evict_and_replicas_are_kept() {
+		let eviction = ClientEviction::new();
+		let protected = client(&eviction, 1, 5000);
+		let replica = client(&eviction, 2, 5000);
+		replica.output.set_replica();
+		let normal = client(&eviction, 3, 10);
+		assert!(eviction.set_no_evict(1, true));
+		assert!(!eviction.set_no_evict(4, true));
+
+		eviction.enforce(100);
+		assert!(!protected.output.is_closed());
+		assert!(!replica.output.is_closed());
+		assert!(normal.output.is_closed());
+
+		eviction.unregister(1);
+		eviction.unregister(2);
+		eviction.unregister(3);
+		assert_eq!(eviction.used(), 0);
+	}
+}
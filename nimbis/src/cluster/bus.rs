@@ -0,0 +1,951 @@
+//! The cluster bus.
+//!
+//! Every server listens on its bus port for the other servers of the
+//! cluster, and keeps a link to each node it knows, over which it sends a
+//! PING about once a second and reads the PONGs. A node first met with
+//! CLUSTER MEET, or heard of in gossip, is sent MEET instead, which makes it
+//! add this server too. Messages are RESP arrays of bulk strings:
+//!
+//! ```text
+//! <type> <sender id> <port> <bus port> <config epoch> <current epoch> <slot bitmap> <primary id>|- <offset> <flags> [<data> ...]
+//! ```
+//!
+//! where the bitmap has a bit for every slot the sender serves, or for a
+//! replica, its primary serves, whose epoch it tells too. The `manual` flag
+//! marks the messages of a primary that paused writes for a manual failover,
+//! and the votes asked for one. MEET, PING and PONG gossip about the other
+//! nodes the sender knows, with `<id> <ip> <port> <bus port> fail|-` for
+//! each, so a node met by one server is soon met by all, and failure reports
+//! spread. FAIL carries the ID of a node the sender marked failed, while
+//! FAILOVER-AUTH-REQUEST, FAILOVER-AUTH-ACK and MFSTART carry no data (see
+//! `failover`).
+//!
+//! Receiving a message updates what this server knows of its sender: its
+//! role, its slots, its epoch, and with a PONG, that it is reachable. A node
+//! whose PING is not answered within half of `cluster_node_timeout` has its
+//! link reopened.
+
+use std::net::SocketAddr;
+use std::sync::atomic::Ordering;
+use std::time::Duration;
+
+use bytes::Bytes;
+use bytes::BytesMut;
+use log::debug;
+use log::info;
+use log::warn;
+use nimbis_resp::RespParseResult;
+use nimbis_resp::RespParser;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+use tokio::io::AsyncReadExt;
+use tokio::io::AsyncWriteExt;
+use tokio::net::TcpListener;
+use tokio::net::TcpStream;
+use tokio::sync::mpsc;
+
+use super::Cluster;
+use super::ClusterState;
+use super::Link;
+use super::Node;
+use super::failover::MANUAL_FAILOVER_TIMEOUT_MS;
+use super::now_ms;
+use super::slot::bitmap_slots;
+use super::slot::slot_bitmap;
+use crate::GCTX;
+use crate::cmd::ParsedCmd;
+use crate::replication::encode_command;
+use crate::server_config;
+
+const CRON_TICK: Duration = Duration::from_millis(100);
+const CONNECT_TIMEOUT: Duration = Duration::from_secs(5);
+/// How long after the last PONG a node is pinged again.
+const PING_INTERVAL_MS: u64 = 1000;
+
+#[derive(Debug, Clone, Copy, PartialEq)]
+enum MessageKind {
+	Meet,
+	Ping,
+	Pong,
+	Fail,
+	AuthRequest,
+	AuthAck,
+	MfStart,
+}
+
+impl MessageKind {
+	fn name(self) -> &'static str {
+		match self {
+			MessageKind::Meet => "MEET",
+			MessageKind::Ping => "PING",
+			MessageKind::Pong => "PONG",
+			MessageKind::Fail => "FAIL",
+			MessageKind::AuthRequest => "FAILOVER-AUTH-REQUEST",
+			MessageKind::AuthAck => "FAILOVER-AUTH-ACK",
+			MessageKind::MfStart => "MFSTART",
+		}
+	}
+
+	fn from_name(name: &str) -> Option<Self> {
+		Some(match name {
+			"MEET" => MessageKind::Meet,
+			"PING" => MessageKind::Ping,
+			"PONG" => MessageKind::Pong,
+			"FAIL" => MessageKind::Fail,
+			"FAILOVER-AUTH-REQUEST" => MessageKind::AuthRequest,
+			"FAILOVER-AUTH-ACK" => MessageKind::AuthAck,
+			"MFSTART" => MessageKind::MfStart,
+			_ => return None,
+		})
+	}
+
+	/// Whether messages of this kind gossip about other nodes.
+	fn gossips(self) -> bool {
+		matches!(
+			self,
+			MessageKind::Meet | MessageKind::Ping | MessageKind::Pong
+		)
+	}
+}
+
+/// What a message tells of a node other than its sender.
+#[derive(Debug, Clone, PartialEq)]
+struct Gossip {
+	id: String,
+	ip: String,
+	port: u16,
+	cport: u16,
+	/// Whether the sender suspects the node of failing, or marked it failed.
+	failing: bool,
+}
+
+#[derive(Debug, Clone, PartialEq)]
+struct Message {
+	kind: MessageKind,
+	sender: String,
+	port: u16,
+	cport: u16,
+	config_epoch: u64,
+	current_epoch: u64,
+	slots: Bytes,
+	/// The primary the sender replicates, None if it is a primary.
+	primary: Option<String>,
+	/// The replication offset of the sender.
+	offset: u64,
+	manual: bool,
+	gossip: Vec<Gossip>,
+	/// The node a FAIL message marks failed.
+	failed: Option<String>,
+}
+
+impl Message {
+	fn encode(&self) -> Bytes {
+		let mut args = vec![
+			Bytes::from_static(self.kind.name().as_bytes()),
+			Bytes::from(self.sender.clone()),
+			Bytes::from(self.port.to_string()),
+			Bytes::from(self.cport.to_string()),
+			Bytes::from(self.config_epoch.to_string()),
+			Bytes::from(self.current_epoch.to_string()),
+			self.slots.clone(),
+			Bytes::from(self.primary.clone().unwrap_or_else(|| "-".to_string())),
+			Bytes::from(self.offset.to_string()),
+			Bytes::from_static(if self.manual { b"manual" } else { b"-" }),
+		];
+		for gossip in &self.gossip {
+			args.extend([
+				Bytes::from(gossip.id.clone()),
+				Bytes::from(gossip.ip.clone()),
+				Bytes::from(gossip.port.to_string()),
+				Bytes::from(gossip.cport.to_string()),
+				Bytes::from_static(if gossip.failing { b"fail" } else { b"-" }),
+			]);
+		}
+		if let Some(failed) = &self.failed {
+			args.push(Bytes::from(failed.clone()));
+		}
+		encode_command(&args)
+	}
+
+	fn decode(value: RespValue) -> Result<Self, String> {
+		let cmd = ParsedCmd::try_from(value)?;
+		let kind = MessageKind::from_name(&cmd.name)
+			.ok_or_else(|| format!("unknown message {}", cmd.name))?;
+		let malformed = || format!("malformed {} message", cmd.name);
+		let [
+			sender,
+			port,
+			cport,
+			config_epoch,
+			current_epoch,
+			slots,
+			primary,
+			offset,
+			flags,
+			data @ ..,
+		] = cmd.args.as_slice()
+		else {
+			return Err(malformed());
+		};
+		let mut message = Self {
+			kind,
+			sender: text(sender),
+			port: number(port)?,
+			cport: number(cport)?,
+			config_epoch: number(config_epoch)?,
+			current_epoch: number(current_epoch)?,
+			slots: slots.clone(),
+			primary: (primary.as_ref() != b"-").then(|| text(primary)),
+			offset: number(offset)?,
+			manual: flags.split(|b| *b == b',').any(|flag| flag == b"manual"),
+			gossip: Vec::new(),
+			failed: None,
+		};
+		match kind {
+			_ if kind.gossips() => {
+				if data.len() % 5 != 0 {
+					return Err(malformed());
+				}
+				for entry in data.chunks(5) {
+					message.gossip.push(Gossip {
+						id: text(&entry[0]),
+						ip: text(&entry[1]),
+						port: number(&entry[2])?,
+						cport: number(&entry[3])?,
+						failing: entry[4].as_ref() == b"fail",
+					});
+				}
+			}
+			MessageKind::Fail => {
+				let [failed] = data else {
+					return Err(malformed());
+				};
+				message.failed = Some(text(failed));
+			}
+			_ if !data.is_empty() => return Err(malformed()),
+			_ => {}
+		}
+		Ok(message)
+	}
+}
+
+fn text(arg: &[u8]) -> String {
+	String::from_utf8_lossy(arg).into_owned()
+}
+
+fn number<T: std::str::FromStr>(arg: &[u8]) -> Result<T, String> {
+	std::str::from_utf8(arg)
+		.ok()
+		.and_then(|arg| arg.parse().ok())
+		.ok_or_else(|| format!("invalid number '{}'", String::from_utf8_lossy(arg)))
+}
+
+impl ClusterState {
+	/// A message about this server.
+	fn message(&self, kind: MessageKind) -> Message {
+		let myself = self.myself();
+		// A replica tells the claim of its primary.
+		let claimant = myself
+			.primary
+			.as_ref()
+			.and_then(|id| self.nodes.get(id))
+			.unwrap_or(myself);
+		let gossip = if kind.gossips() {
+			self.known_nodes()
+				.into_iter()
+				.skip(1)
+				.map(|node| Gossip {
+					id: node.id.clone(),
+					ip: node.ip.clone(),
+					port: node.port,
+					cport: node.cport,
+					failing: node.pfail || node.fail.is_some(),
+				})
+				.collect()
+		} else {
+			Vec::new()
+		};
+		Message {
+			kind,
+			sender: myself.id.clone(),
+			port: myself.port,
+			cport: myself.cport,
+			config_epoch: claimant.config_epoch,
+			current_epoch: self.current_epoch,
+			slots: Bytes::from(slot_bitmap(self.slots_of(&claimant.id))),
+			primary: myself.primary.clone(),
+			offset: self.offset,
+			manual: match kind {
+				MessageKind::AuthRequest => self
+					.election
+					.as_ref()
+					.is_some_and(|election| election.manual),
+				_ => self.paused_for.is_some() && self.writes_paused,
+			},
+			gossip,
+			failed: None,
+		}
+	}
+
+	/// Give `sender` the slots of `bitmap` that are unassigned or served by
+	/// a node with a lower epoch than `epoch`, except those being imported
+	/// here, which CLUSTER SETSLOT settles. Returns whether a slot moved.
+	fn claim(&mut self, sender: &str, epoch: u64, bitmap: &[u8]) -> bool {
+		let mut moved = false;
+		for slot in bitmap_slots(bitmap) {
+			if self.importing.contains_key(&slot) {
+				continue;
+			}
+			let wins = match &self.slots[slot as usize] {
+				None => true,
+				Some(owner) if owner == sender => false,
+				Some(owner) => self
+					.nodes
+					.get(owner)
+					.is_none_or(|owner| owner.config_epoch < epoch),
+			};
+			if wins {
+				self.slots[slot as usize] = Some(sender.to_string());
+				self.migrating.remove(&slot);
+				moved = true;
+			}
+		}
+		moved
+	}
+
+	/// Give this primary a new epoch when `sender`, another primary, has the
+	/// same one: of two primaries sharing an epoch, the one with the greater
+	/// ID keeps it, so no two claims on a slot ever tie. Returns whether the
+	/// epoch changed.
+	fn resolve_epoch_collision(&mut self, sender: &str) -> bool {
+		let myself = self.myself();
+		let Some(node) = self.nodes.get(sender) else {
+			return false;
+		};
+		if myself.primary.is_some()
+			|| node.primary.is_some()
+			|| node.config_epoch != myself.config_epoch
+			|| sender <= self.myself.as_str()
+		{
+			return false;
+		}
+		self.current_epoch += 1;
+		let epoch = self.current_epoch;
+		self.myself_mut().config_epoch = epoch;
+		true
+	}
+
+	/// The node whose link is `serial`.
+	fn linked(&self, serial: u64) -> Option<&Node> {
+		self.nodes
+			.values()
+			.find(|node| node.link.as_ref().is_some_and(|link| link.serial == serial))
+	}
+}
+
+impl Cluster {
+	/// Take `message`, read from `peer_ip` on a socket whose local address is
+	/// `local_ip`, over the link `link` this server opened or, with `None`,
+	/// over a connection a node opened. Returns the reply to send.
+	fn receive(
+		&self,
+		message: Message,
+		peer_ip: &str,
+		local_ip: &str,
+		link: Option<u64>,
+	) -> Option<Bytes> {
+		self.messages_received.fetch_add(1, Ordering::Relaxed);
+		let mut state = self.state.lock().unwrap();
+		if message.sender == state.myself {
+			return None;
+		}
+		if let Some(serial) = link {
+			let (id, handshake) = state
+				.linked(serial)
+				.map(|node| (node.id.clone(), node.handshake))?;
+			if handshake {
+				// The node met with CLUSTER MEET answered: it is known by its
+				// ID from now on, unless it was known already.
+				if message.kind != MessageKind::Pong {
+					return None;
+				}
+				let mut node = state.nodes.remove(&id)?;
+				if state.nodes.contains_key(&message.sender) {
+					return None;
+				}
+				node.id = message.sender.clone();
+				node.handshake = false;
+				state.nodes.insert(node.id.clone(), node);
+				self.mark_dirty();
+			} else if id != message.sender {
+				return None;
+			}
+		}
+		if message.kind == MessageKind::Meet {
+			if state.myself().ip.is_empty() {
+				state.myself_mut().ip = local_ip.to_string();
+				self.mark_dirty();
+			}
+			if !state.nodes.contains_key(&message.sender) {
+				let node = Node::new(
+					message.sender.clone(),
+					peer_ip.to_string(),
+					message.port,
+					message.cport,
+				);
+				state.nodes.insert(node.id.clone(), node);
+				self.mark_dirty();
+			}
+		}
+		if message.current_epoch > state.current_epoch {
+			state.current_epoch = message.current_epoch;
+			self.mark_dirty();
+		}
+		let now = now_ms();
+		let timeout = server_config!(cluster_node_timeout);
+		let sender = message.sender.as_str();
+		let Some(node) = state.nodes.get_mut(sender) else {
+			return reply(self, &state, message.kind);
+		};
+		if message.kind == MessageKind::Pong {
+			node.pong_received = now;
+			node.ping_sent = 0;
+			node.pfail = false;
+		}
+		node.offset = message.offset;
+		if (node.port, node.cport, node.config_epoch)
+			!= (message.port, message.cport, message.config_epoch)
+		{
+			node.port = message.port;
+			node.cport = message.cport;
+			node.config_epoch = message.config_epoch;
+			self.mark_dirty();
+		}
+		if node.primary != message.primary {
+			node.primary = message.primary.clone();
+			if message.primary.is_some() {
+				// A primary turned replica serves no slots any more.
+				for owner in state.slots.iter_mut() {
+					if owner.as_deref() == Some(sender) {
+						*owner = None;
+					}
+				}
+			}
+			self.mark_dirty();
+		}
+		if message.kind == MessageKind::Pong && state.clear_failure_if_needed(sender, now, timeout)
+		{
+			info!("Node {} is reachable again", sender);
+			self.mark_dirty();
+		}
+		if message.primary.is_none() {
+			if message.kind.gossips() && state.resolve_epoch_collision(sender) {
+				self.mark_dirty();
+			}
+			let followed = state
+				.myself()
+				.primary
+				.clone()
+				.unwrap_or_else(|| state.myself.clone());
+			let served = state.slots_of(&followed).next().is_some();
+			if state.claim(sender, message.config_epoch, &message.slots) {
+				self.mark_dirty();
+				// The sender took the last slots of this server, or of its
+				// primary, so it took their place: follow it.
+				if served && state.slots_of(&followed).next().is_none() {
+					info!("Following {}, which took the slots of {}", sender, followed);
+					state.set_primary(sender);
+				}
+			}
+		}
+		if message.kind.gossips() {
+			self.take_gossip(&mut state, &message, now, timeout);
+			if message.manual
+				&& state.myself().primary.as_deref() == Some(sender)
+				&& let Some(failover) = state.manual_failover.as_mut()
+				&& failover.primary_offset.is_none()
+			{
+				failover.primary_offset = Some(message.offset);
+			}
+		}
+		match message.kind {
+			MessageKind::Fail => {
+				if let Some(failed) = &message.failed
+					&& state.set_failed(failed, now)
+				{
+					info!("Node {} failed, as {} reported", failed, sender);
+					self.mark_dirty();
+				}
+			}
+			MessageKind::AuthRequest => {
+				if state.vote(
+					sender,
+					message.current_epoch,
+					message.config_epoch,
+					&message.slots,
+					message.manual,
+					now,
+					timeout,
+				) {
+					info!(
+						"Voted for replica {} in epoch {}",
+						sender, state.current_epoch
+					);
+					self.mark_dirty();
+					self.messages_sent.fetch_add(1, Ordering::Relaxed);
+					return Some(state.message(MessageKind::AuthAck).encode());
+				}
+			}
+			MessageKind::AuthAck => state.count_vote(sender, message.current_epoch),
+			MessageKind::MfStart => {
+				if state.nodes[sender].primary.as_deref() == Some(state.myself.as_str())
+					&& state.myself().primary.is_none()
+				{
+					info!("Pausing writes for the manual failover of {}", sender);
+					state.paused_for = Some((sender.to_string(), now + MANUAL_FAILOVER_TIMEOUT_MS));
+					GCTX!(replication)
+						.pause_writes(Duration::from_millis(MANUAL_FAILOVER_TIMEOUT_MS * 2));
+				}
+			}
+			MessageKind::Meet | MessageKind::Ping | MessageKind::Pong => {}
+		}
+		reply(self, &state, message.kind)
+	}
+
+	/// Take what `message` tells of other nodes: start a handshake with
+	/// those this server does not know, unless CLUSTER FORGET removed them,
+	/// and count the failure reports of a primary.
+	fn take_gossip(&self, state: &mut ClusterState, message: &Message, now: u64, timeout: u64) {
+		for gossip in &message.gossip {
+			if gossip.id == state.myself {
+				continue;
+			}
+			if !state.knows(&gossip.id) {
+				if !state.forgotten.contains_key(&gossip.id) {
+					state.start_handshake(gossip.ip.clone(), gossip.port, gossip.cport);
+				}
+				continue;
+			}
+			if message.primary.is_some() {
+				continue;
+			}
+			if !gossip.failing {
+				state.forget_failure_report(&gossip.id, &message.sender);
+				continue;
+			}
+			state.report_failure(&gossip.id, &message.sender, now);
+			if state.mark_failed_if_needed(&gossip.id, now, timeout) {
+				info!("Node {} failed", gossip.id);
+				self.broadcast_fail(state, &gossip.id);
+				self.mark_dirty();
+			}
+		}
+	}
+
+	/// Queue `message` on the link of `node`.
+	fn send(&self, node: &Node, message: &Message) {
+		if let Some(link) = &node.link
+			&& link.outbox.send(message.encode()).is_ok()
+		{
+			self.messages_sent.fetch_add(1, Ordering::Relaxed);
+		}
+	}
+
+	/// Queue `message` on the link of every node.
+	fn broadcast(&self, state: &ClusterState, message: &Message) {
+		for node in state.nodes.values() {
+			if node.id != state.myself && !node.handshake {
+				self.send(node, message);
+			}
+		}
+	}
+
+	/// Tell every node that `id` failed.
+	fn broadcast_fail(&self, state: &ClusterState, id: &str) {
+		let mut message = state.message(MessageKind::Fail);
+		message.failed = Some(id.to_string());
+		self.broadcast(state, &message);
+	}
+
+	fn link_connected(&self, serial: u64) {
+		let mut state = self.state.lock().unwrap();
+		if let Some(link) = state
+			.nodes
+			.values_mut()
+			.filter_map(|node| node.link.as_mut())
+			.find(|link| link.serial == serial)
+		{
+			link.connected = true;
+		}
+	}
+
+	fn link_closed(&self, serial: u64) {
+		let mut state = self.state.lock().unwrap();
+		for node in state.nodes.values_mut() {
+			if node.link.as_ref().is_some_and(|link| link.serial == serial) {
+				node.link = None;
+			}
+		}
+	}
+
+	/// Run once every `CRON_TICK`: forget handshakes that were never
+	/// answered, open missing links, ping the nodes due a PING, mark the
+	/// nodes that stopped answering, notice a partition that leaves this
+	/// server in a minority and move failovers along.
+	fn cron(&self) {
+		let replication = GCTX!(replication);
+		let (offset, writes_paused) = (replication.offset(), replication.writes_paused());
+		let mut state = self.state.lock().unwrap();
+		state.offset = offset;
+		state.writes_paused = writes_paused;
+		let now = now_ms();
+		let timeout = server_config!(cluster_node_timeout);
+		state
+			.nodes
+			.retain(|_, node| !node.handshake || now.saturating_sub(node.created) <= timeout);
+		state.forgotten.retain(|_, until| *until > now);
+
+		let myself = state.myself.clone();
+		let ids: Vec<String> = state
+			.nodes
+			.keys()
+			.filter(|id| **id != myself)
+			.cloned()
+			.collect();
+		for id in ids {
+			let kind = if state.nodes[&id].handshake {
+				MessageKind::Meet
+			} else {
+				MessageKind::Ping
+			};
+			let message = state.message(kind);
+			let node = state.nodes.get_mut(&id).expect("the node was just listed");
+			if node.link.is_none() {
+				let serial = self.next_link_serial.fetch_add(1, Ordering::Relaxed);
+				let (outbox, receiver) = mpsc::unbounded_channel();
+				node.link = Some(Link {
+					serial,
+					outbox,
+					connected: false,
+				});
+				tokio::spawn(run_link(serial, node.ip.clone(), node.cport, receiver));
+				self.send(node, &message);
+				if node.ping_sent == 0 {
+					node.ping_sent = now;
+				}
+			} else if node.ping_sent == 0 {
+				if now.saturating_sub(node.pong_received) >= PING_INTERVAL_MS {
+					self.send(node, &message);
+					node.ping_sent = now;
+				}
+			} else if now.saturating_sub(node.ping_sent) > timeout / 2 {
+				// The PING may be stuck behind a dead connection: open a new
+				// one, and keep waiting for the PONG.
+				node.link = None;
+			}
+		}
+
+		for id in state.detect_failures(now, timeout) {
+			info!("Node {} failed", id);
+			self.broadcast_fail(&state, &id);
+			self.mark_dirty();
+		}
+		state.watch_partition(now, timeout);
+		self.run_manual_failover(&mut state, now);
+		if let Some(epoch) = state.run_election(now, timeout) {
+			info!("Asking the primaries for their votes in epoch {}", epoch);
+			self.broadcast(&state, &state.message(MessageKind::AuthRequest));
+			self.mark_dirty();
+		}
+		if state.announce {
+			state.announce = false;
+			self.broadcast(&state, &state.message(MessageKind::Pong));
+			self.mark_dirty();
+		}
+	}
+
+	/// Move a CLUSTER FAILOVER along. On the primary, ping the replica until
+	/// it takes over, and let writes run again once it did or after the
+	/// timeout. On the replica, ask the primary to pause writes, and give up
+	/// after the timeout.
+	fn run_manual_failover(&self, state: &mut ClusterState, now: u64) {
+		if let Some((replica, until)) = state.paused_for.clone() {
+			if now > until || state.myself().primary.is_some() {
+				state.paused_for = None;
+				GCTX!(replication).resume_writes();
+			} else if state.writes_paused
+				&& let Some(node) = state.nodes.get(&replica)
+			{
+				// Tell the replica the offset to catch up with at once.
+				self.send(node, &state.message(MessageKind::Ping));
+			}
+		}
+		let Some(failover) = state.manual_failover.as_mut() else {
+			return;
+		};
+		if now > failover.deadline {
+			warn!("Manual failover timed out");
+			state.manual_failover = None;
+			return;
+		}
+		if !std::mem::replace(&mut failover.requested, true)
+			&& let Some(primary) = state
+				.myself()
+				.primary
+				.as_ref()
+				.and_then(|id| state.nodes.get(id))
+		{
+			self.send(primary, &state.message(MessageKind::MfStart));
+		}
+	}
+}
+
+/// The reply to a message of `kind`: a PONG to a MEET or PING.
+fn reply(cluster: &Cluster, state: &ClusterState, kind: MessageKind) -> Option<Bytes> {
+	match kind {
+		MessageKind::Meet | MessageKind::Ping => {
+			cluster.messages_sent.fetch_add(1, Ordering::Relaxed);
+			Some(state.message(MessageKind::Pong).encode())
+		}
+		_ => None,
+	}
+}
+
+/// Serve the cluster bus on `listeners` and start the cron that keeps the
+/// links to the other nodes.
+pub fn start(storage: Storage, listeners: Vec<TcpListener>) {
+	for listener in listeners {
+		tokio::spawn(accept_loop(listener));
+	}
+	tokio::spawn(async move {
+		let mut interval = tokio::time::interval(CRON_TICK);
+		loop {
+			interval.tick().await;
+			let cluster = GCTX!(cluster);
+			cluster.cron();
+			cluster.sync_replication(&storage);
+			if let Err(e) = cluster.save_if_dirty(&storage).await {
+				warn!("Failed to save the cluster configuration: {}", e);
+			}
+		}
+	});
+}
+
+async fn accept_loop(listener: TcpListener) {
+	loop {
+		match listener.accept().await {
+			Ok((socket, addr)) => {
+				tokio::spawn(async move {
+					if let Err(e) = serve_node(socket, addr).await {
+						debug!("Cluster bus connection from {} closed: {}", addr, e);
+					}
+				});
+			}
+			Err(e) => warn!("Failed to accept a cluster bus connection: {}", e),
+		}
+	}
+}
+
+/// Answer the messages of a connection another node opened.
+async fn serve_node(mut socket: TcpStream, addr: SocketAddr) -> Result<(), String> {
+	let local_ip = local_ip(&socket);
+	let peer_ip = addr.ip().to_string();
+	let mut buffer = BytesMut::new();
+	let mut parser = RespParser::new();
+	loop {
+		read_more(&mut socket, &mut buffer).await?;
+		while let Some(message) = next_message(&mut parser, &mut buffer)? {
+			if let Some(reply) = GCTX!(cluster).receive(message, &peer_ip, &local_ip, None) {
+				socket.write_all(&reply).await.map_err(|e| e.to_string())?;
+			}
+		}
+	}
+}
+
+/// Keep the link `serial` to the node at `ip:cport`, sending what is queued
+/// on `outbox` until the link is dropped.
+async fn run_link(serial: u64, ip: String, cport: u16, mut outbox: mpsc::UnboundedReceiver<Bytes>) {
+	if let Err(e) = link(serial, &ip, cport, &mut outbox).await {
+		debug!("Cluster bus link to {}:{} closed: {}", ip, cport, e);
+	}
+	GCTX!(cluster).link_closed(serial);
+}
+
+async fn link(
+	serial: u64,
+	ip: &str,
+	cport: u16,
+	outbox: &mut mpsc::UnboundedReceiver<Bytes>,
+) -> Result<(), String> {
+	let mut socket = tokio::time::timeout(CONNECT_TIMEOUT, TcpStream::connect((ip, cport)))
+		.await
+		.map_err(|_| "timed out connecting".to_string())?
+		.map_err(|e| e.to_string())?;
+	GCTX!(cluster).link_connected(serial);
+	let local_ip = local_ip(&socket);
+	let mut buffer = BytesMut::new();
+	let mut parser = RespParser::new();
+	loop {
+		tokio::select! {
+			message = outbox.recv() => match message {
+				Some(message) => socket.write_all(&message).await.map_err(|e| e.to_string())?,
+				None => return Ok(()),
+			},
+			read = socket.read_buf(&mut buffer) => {
+				if read.map_err(|e| e.to_string())? == 0 {
+					return Err("the node closed the connection".to_string());
+				}
+				while let Some(message) = next_message(&mut parser, &mut buffer)? {
+					GCTX!(cluster).receive(message, ip, &local_ip, Some(serial));
+				}
+			}
+		}
+	}
+}
+
+fn next_message(parser: &mut RespParser, buffer: &mut BytesMut) -> Result<Option<Message>, String> {
+	match parser.parse(buffer) {
+		RespParseResult::Complete(value) => Message::decode(value).map(Some),
+		RespParseResult::Incomplete => Ok(None),
+		RespParseResult::Error(e) => Err(e.to_string()),
+	}
+}
+
+async fn read_more(socket: &mut TcpStream, buffer: &mut BytesMut) -> Result<(), String> {
+	match socket.read_buf(buffer).await {
+		Ok(0) => Err("the node closed the connection".to_string()),
+		Ok(_) => Ok(()),
+		Err(e) => Err(e.to_string()),
+	}
+}
+
+fn local_ip(socket: &TcpStream) -> String {
+	socket
+		.local_addr()
+		.map(|addr| addr.ip().to_string())
+		.unwrap_or_default()
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+
+	#[test]
+	fn test_message_roundtrip() {
+		let pong = Message {
+			kind: MessageKind::Pong,
+			sender: "a".repeat(40),
+			port: 7000,
+			cport: 17000,
+			config_epoch: 3,
+			current_epoch: 5,
+			slots: Bytes::from(slot_bitmap([0, 16383])),
+			primary: None,
+			offset: 42,
+			manual: true,
+			gossip: vec![Gossip {
+				id: "b".repeat(40),
+				ip: "127.0.0.1".to_string(),
+				port: 7001,
+				cport: 17001,
+				failing: true,
+			}],
+			failed: None,
+		};
+		let fail = Message {
+			kind: MessageKind::Fail,
+			primary: Some("c".repeat(40)),
+			manual: false,
+			gossip: Vec::new(),
+			failed: Some("b".repeat(40)),
+			..pong.clone()
+		};
+		let mut buffer = BytesMut::new();
+		buffer.extend_from_slice(&pong.encode());
+		buffer.extend_from_slice(&fail.encode());
+		let mut parser = RespParser::new();
+		assert_eq!(next_message(&mut parser, &mut buffer).unwrap(), Some(pong));
+		assert_eq!(next_message(&mut parser, &mut buffer).unwrap(), Some(fail));
+		assert!(buffer.is_empty());
+	}
+
+	#[test]
+	fn test_decode_malformed() {
+		let value = RespValue::Array(vec![
+			RespValue::BulkString(Bytes::from("PING")),
+			RespValue::BulkString(Bytes::from("id")),
+		]);
+		assert!(Message::decode(value).is_err());
+		let value = RespValue::Array(vec![RespValue::BulkString(Bytes::from("HELLO"))]);
+		assert!(Message::decode(value).is_err());
+		// A FAIL message names the failed node.
+		let mut args: Vec<RespValue> = ["FAIL", "id", "7000", "17000", "0", "0", "", "-", "0", "-"]
+			.into_iter()
+			.map(|arg| RespValue::BulkString(Bytes::from(arg)))
+			.collect();
+		assert!(Message::decode(RespValue::Array(args.clone())).is_err());
+		args.push(RespValue::BulkString(Bytes::from("other")));
+		assert!(Message::decode(RespValue::Array(args)).is_ok());
+	}
+
+	#[test]
+	fn test_claim() {
+		let mut myself = Node::new("a".repeat(40), String::new(), 7000, 17000);
+		myself.config_epoch = 2;
+		let mut state = ClusterState::new(myself);
+		let other = Node::new("b".repeat(40), String::new(), 7001, 17001);
+		state.nodes.insert(other.id.clone(), other);
+		state.slots[1] = Some("a".repeat(40));
+
+		// A lower epoch takes only the unassigned slots.
+		assert!(state.claim(&"b".repeat(40), 1, &slot_bitmap([0, 1])));
+		assert_eq!(state.slots[0], Some("b".repeat(40)));
+		assert_eq!(state.slots[1], Some("a".repeat(40)));
+		// A greater one takes the slots of this server too.
+		assert!(state.claim(&"b".repeat(40), 3, &slot_bitmap([0, 1])));
+		assert_eq!(state.slots[1], Some("b".repeat(40)));
+		assert!(!state.claim(&"b".repeat(40), 3, &slot_bitmap([0, 1])));
+		// A slot being imported stays where it is.
+		state.importing.insert(2, "b".repeat(40));
+		assert!(!state.claim(&"b".repeat(40), 4, &slot_bitmap([2])));
+		assert_eq!(state.slots[2], None);
+	}
+
+	#[test]
+	fn test_epoch_collision() {
+		let (a, b) = ("a".repeat(40), "b".repeat(40));
+		let mut state = ClusterState::new(Node::new(a.clone(), String::new(), 7000, 17000));
+		state
+			.nodes
+			.insert(b.clone(), Node::new(b.clone(), String::new(), 7001, 17001));
+		// The node with the smaller ID moves on.
+		assert!(state.resolve_epoch_collision(&b));
+		assert_eq!(state.myself().config_epoch, 1);
+		assert!(!state.resolve_epoch_collision(&b));
+
+		state.myself = b.clone();
+		state.nodes.get_mut(&b).unwrap().config_epoch = 1;
+		assert!(!state.resolve_epoch_collision(&a));
+	}
+
+	#[test]
+	fn test_message_from_replica() {
+		let (a, b) = ("a".repeat(40), "b".repeat(40));
+		let mut myself = Node::new(b.clone(), String::new(), 7001, 17001);
+		myself.primary = Some(a.clone());
+		let mut state = ClusterState::new(myself);
+		let mut primary = Node::new(a.clone(), "127.0.0.1".to_string(), 7000, 17000);
+		primary.config_epoch = 7;
+		primary.pfail = true;
+		state.nodes.insert(a.clone(), primary);
+		state.slots[5] = Some(a.clone());
+
+		let message = state.message(MessageKind::Ping);
+		assert_eq!(message.primary, Some(a.clone()));
+		assert_eq!(message.config_epoch, 7);
+		assert_eq!(bitmap_slots(&message.slots).collect::<Vec<_>>(), vec![5]);
+		assert_eq!(message.gossip.len(), 1);
+		assert!(message.gossip[0].failing);
+		assert!(state.message(MessageKind::AuthAck).gossip.is_empty());
+	}
+}
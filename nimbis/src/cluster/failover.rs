@@ -0,0 +1,628 @@
+//! Failure detection and failover.
+//!
+//! A node that does not answer a PING within `cluster_node_timeout` is
+//! suspected of failing (PFAIL) by the server that pinged it, which says so
+//! in its gossip. A server that counts such reports from a majority of the
+//! primaries marks the node failed (FAIL) and tells every node, which marks
+//! it failed too.
+//!
+//! When a primary serving slots fails, its replicas elect one of them to
+//! take its place. After a delay that grows with how far behind it is, a
+//! replica takes a new epoch and asks every primary for its vote; a primary
+//! votes once per epoch. The replica that gets the votes of a majority of
+//! the primaries serving slots claims the slots of its primary with that
+//! epoch, which wins over the claim of the failed primary everywhere. The
+//! failed primary and its other replicas replicate from it once they learn
+//! it took the slots.
+//!
+//! A primary that reaches fewer than a majority of the primaries serving
+//! slots, itself included, for a node timeout is on the minority side of a
+//! partition, whose slots the other side fails over. It refuses commands
+//! with CLUSTERDOWN rather than take writes that would be lost once it
+//! rejoins as a replica, and keeps refusing them for a short delay after it
+//! reaches a majority again, until it heard whether it still serves its
+//! slots.
+//!
+//! CLUSTER FAILOVER promotes a replica whose primary is up: the primary
+//! pauses writes and tells its offset, and once the replica caught up with
+//! it, the replica is elected as if the primary had failed. FORCE does not
+//! wait for the primary, and TAKEOVER does not hold an election either.
+
+use std::collections::HashSet;
+
+use log::info;
+
+use super::ClusterState;
+use super::slot::bitmap_slots;
+
+/// Failure reports older than this many node timeouts no longer count.
+const FAIL_REPORT_VALIDITY_MULT: u64 = 2;
+/// A failed primary that is reachable again and still serves its slots is
+/// no longer failed after this many node timeouts.
+const FAIL_UNDO_TIME_MULT: u64 = 2;
+/// How long a primary back from a minority keeps refusing commands, at
+/// least and at most; in between, a node timeout.
+const REJOIN_DELAY_MIN_MS: u64 = 500;
+const REJOIN_DELAY_MAX_MS: u64 = 5000;
+/// How long CLUSTER FAILOVER may take.
+pub(super) const MANUAL_FAILOVER_TIMEOUT_MS: u64 = 5000;
+
+/// The election a replica holds to take the slots of its primary.
+#[derive(Debug)]
+pub(super) struct Election {
+	/// Unix milliseconds the votes are asked for.
+	pub(super) start: u64,
+	/// The epoch the votes were asked for with, 0 until they are.
+	pub(super) epoch: u64,
+	/// The primaries that voted for this replica.
+	pub(super) votes: HashSet<String>,
+	/// Set for CLUSTER FAILOVER, which primaries vote for although the
+	/// primary of the replica did not fail.
+	pub(super) manual: bool,
+}
+
+/// A CLUSTER FAILOVER this replica runs.
+#[derive(Debug)]
+pub(super) struct ManualFailover {
+	/// Unix milliseconds the failover is given up at.
+	pub(super) deadline: u64,
+	/// Whether the primary was asked to pause writes.
+	pub(super) requested: bool,
+	/// The offset the primary paused writes at.
+	pub(super) primary_offset: Option<u64>,
+	/// Set with FORCE: the election starts without waiting for the primary.
+	pub(super) force: bool,
+}
+
+/// How CLUSTER FAILOVER promotes a replica.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum FailoverMode {
+	Default,
+	Force,
+	Takeover,
+}
+
+impl ClusterState {
+	/// Note that `reporter`, a primary, suspects `id` of failing, or knows
+	/// it failed.
+	pub(super) fn report_failure(&mut self, id: &str, reporter: &str, now: u64) {
+		if let Some(node) = self.nodes.get_mut(id) {
+			node.failure_reports.insert(reporter.to_string(), now);
+		}
+	}
+
+	/// Drop the report of `reporter` on `id`, which it no longer suspects.
+	pub(super) fn forget_failure_report(&mut self, id: &str, reporter: &str) {
+		if let Some(node) = self.nodes.get_mut(id) {
+			node.failure_reports.remove(reporter);
+		}
+	}
+
+	/// The reports on `id` younger than `FAIL_REPORT_VALIDITY_MULT` node
+	/// timeouts.
+	pub(super) fn failure_reports(&mut self, id: &str, now: u64, timeout: u64) -> usize {
+		let Some(node) = self.nodes.get_mut(id) else {
+			return 0;
+		};
+		node.failure_reports
+			.retain(|_, time| now.saturating_sub(*time) <= timeout * FAIL_REPORT_VALIDITY_MULT);
+		node.failure_reports.len()
+	}
+
+	/// Mark `id` failed if this server suspects it and a majority of the
+	/// primaries, counting this server if it is one, report it. Returns
+	/// whether it was marked.
+	pub(super) fn mark_failed_if_needed(&mut self, id: &str, now: u64, timeout: u64) -> bool {
+		if !self
+			.nodes
+			.get(id)
+			.is_some_and(|node| node.pfail && node.fail.is_none())
+		{
+			return false;
+		}
+		let mut failures = self.failure_reports(id, now, timeout);
+		if self.myself().primary.is_none() {
+			failures += 1;
+		}
+		if failures < self.quorum() {
+			return false;
+		}
+		self.set_failed(id, now)
+	}
+
+	/// Mark `id` failed, as the cluster agreed. Returns whether it was not
+	/// already.
+	pub(super) fn set_failed(&mut self, id: &str, now: u64) -> bool {
+		if id == self.myself {
+			return false;
+		}
+		match self.nodes.get_mut(id) {
+			Some(node) if !node.handshake && node.fail.is_none() => {
+				node.pfail = false;
+				node.fail = Some(now);
+				true
+			}
+			_ => false,
+		}
+	}
+
+	/// Mark the nodes whose PING has waited longer than `timeout` as
+	/// suspected, and return the suspected ones that now fail.
+	pub(super) fn detect_failures(&mut self, now: u64, timeout: u64) -> Vec<String> {
+		let myself = self.myself.clone();
+		let mut suspected = Vec::new();
+		for node in self.nodes.values_mut() {
+			if node.id == myself || node.handshake {
+				continue;
+			}
+			if node.ping_sent != 0
+				&& now.saturating_sub(node.ping_sent) > timeout
+				&& node.fail.is_none()
+			{
+				node.pfail = true;
+			}
+			if node.pfail {
+				suspected.push(node.id.clone());
+			}
+		}
+		suspected
+			.into_iter()
+			.filter(|id| self.mark_failed_if_needed(id, now, timeout))
+			.collect()
+	}
+
+	/// Take back the failure of `id`, which answered a PING, when it serves
+	/// no slots, or when it kept its slots for `FAIL_UNDO_TIME_MULT` node
+	/// timeouts since it failed. Returns whether it was taken back.
+	pub(super) fn clear_failure_if_needed(&mut self, id: &str, now: u64, timeout: u64) -> bool {
+		let serves_slots = self.slots_of(id).next().is_some();
+		let Some(node) = self.nodes.get_mut(id) else {
+			return false;
+		};
+		let Some(failed) = node.fail else {
+			return false;
+		};
+		if node.primary.is_some()
+			|| !serves_slots
+			|| now.saturating_sub(failed) > timeout * FAIL_UNDO_TIME_MULT
+		{
+			node.fail = None;
+			return true;
+		}
+		false
+	}
+
+	/// The votes a replica needs: a majority of the primaries serving slots.
+	pub(super) fn quorum(&self) -> usize {
+		self.size() / 2 + 1
+	}
+
+	/// Whether this server is a primary that reaches fewer than a majority
+	/// of the primaries serving slots, counting itself if it serves some:
+	/// the minority side of a partition, whose slots the majority side
+	/// fails over.
+	pub(super) fn in_minority(&self) -> bool {
+		if self.myself().primary.is_some() || self.size() == 0 {
+			return false;
+		}
+		let owners: HashSet<&str> = self.slots.iter().flatten().map(String::as_str).collect();
+		let reachable = owners
+			.into_iter()
+			.filter(|id| {
+				*id == self.myself
+					|| self
+						.nodes
+						.get(*id)
+						.is_some_and(|node| !node.pfail && node.fail.is_none())
+			})
+			.count();
+		reachable < self.quorum()
+	}
+
+	/// Hold off commands while this primary is in a minority, and for a
+	/// rejoin delay after, so once the partition heals it hears whether its
+	/// slots were failed over before it takes writes for them again.
+	pub(super) fn watch_partition(&mut self, now: u64, timeout: u64) {
+		if self.in_minority() {
+			self.rejoin_at = now + timeout.clamp(REJOIN_DELAY_MIN_MS, REJOIN_DELAY_MAX_MS);
+		}
+	}
+
+	/// Make this server a replica of `primary`. It stops serving slots.
+	pub(super) fn set_primary(&mut self, primary: &str) {
+		let myself = self.myself.clone();
+		for owner in self.slots.iter_mut() {
+			if owner.as_deref() == Some(myself.as_str()) {
+				*owner = None;
+			}
+		}
+		self.migrating.clear();
+		self.importing.clear();
+		self.election = None;
+		self.manual_failover = None;
+		self.myself_mut().primary = Some(primary.to_string());
+		self.announce = true;
+	}
+
+	/// Make this replica the primary of the slots of its primary, with
+	/// `epoch` if that is greater than its own.
+	pub(super) fn promote(&mut self, epoch: u64) {
+		let Some(primary) = self.myself_mut().primary.take() else {
+			return;
+		};
+		let myself = self.myself.clone();
+		for owner in self.slots.iter_mut() {
+			if owner.as_deref() == Some(primary.as_str()) {
+				*owner = Some(myself.clone());
+			}
+		}
+		let node = self.myself_mut();
+		node.config_epoch = node.config_epoch.max(epoch);
+		info!(
+			"Promoted to primary in place of {}, in epoch {}",
+			primary, node.config_epoch
+		);
+		self.election = None;
+		self.manual_failover = None;
+		self.announce = true;
+	}
+
+	/// CLUSTER FAILOVER TAKEOVER: take a new epoch without asking the
+	/// other primaries, and the slots of the primary with it.
+	pub(super) fn take_over(&mut self) {
+		self.current_epoch += 1;
+		let epoch = self.current_epoch;
+		self.myself_mut().config_epoch = epoch;
+		self.promote(epoch);
+	}
+
+	/// Whether the CLUSTER FAILOVER of this replica may start its election.
+	fn manual_failover_ready(&self) -> bool {
+		self.manual_failover
+			.as_ref()
+			.is_some_and(|failover| failover.force || failover.primary_offset == Some(self.offset))
+	}
+
+	/// How many replicas of `primary` are ahead of this server.
+	fn rank(&self, primary: &str) -> u64 {
+		self.nodes
+			.values()
+			.filter(|node| {
+				node.id != self.myself
+					&& node.primary.as_deref() == Some(primary)
+					&& node.offset > self.offset
+			})
+			.count() as u64
+	}
+
+	/// Move the election of this replica along: schedule one when its
+	/// primary failed, and promote this server once it has the votes.
+	/// Returns the epoch to ask for votes with, when it is time to ask.
+	pub(super) fn run_election(&mut self, now: u64, timeout: u64) -> Option<u64> {
+		let primary = self.myself().primary.clone()?;
+		let manual = self.manual_failover_ready();
+		let failed = self
+			.nodes
+			.get(&primary)
+			.is_some_and(|node| node.fail.is_some());
+		if (!failed && !manual) || self.slots_of(&primary).next().is_none() {
+			self.election = None;
+			return None;
+		}
+		let auth_timeout = (timeout * 2).max(2000);
+		let retry = auth_timeout * 2;
+		if self
+			.election
+			.as_ref()
+			.is_none_or(|election| now > election.start + retry)
+		{
+			// Replicas further behind ask later, so the one with the most of
+			// the stream usually wins.
+			let start = if manual {
+				now
+			} else {
+				now + 500 + rand::random_range(0..500) + self.rank(&primary) * 1000
+			};
+			self.election = Some(Election {
+				start,
+				epoch: 0,
+				votes: HashSet::new(),
+				manual,
+			});
+		}
+		let quorum = self.quorum();
+		let election = self.election.as_mut()?;
+		if now < election.start || now - election.start > auth_timeout {
+			return None;
+		}
+		if election.epoch == 0 {
+			self.current_epoch += 1;
+			election.epoch = self.current_epoch;
+			return Some(election.epoch);
+		}
+		if election.votes.len() >= quorum {
+			let epoch = election.epoch;
+			self.promote(epoch);
+		}
+		None
+	}
+
+	/// Count the vote of `voter`, given at its current epoch `epoch`.
+	pub(super) fn count_vote(&mut self, voter: &str, epoch: u64) {
+		let serves_slots = self
+			.nodes
+			.get(voter)
+			.is_some_and(|node| node.primary.is_none())
+			&& self.slots_of(voter).next().is_some();
+		if let Some(election) = self.election.as_mut()
+			&& serves_slots
+			&& election.epoch != 0
+			&& epoch >= election.epoch
+		{
+			election.votes.insert(voter.to_string());
+		}
+	}
+
+	/// Decide whether this primary votes for `requester`, which asks at
+	/// current epoch `epoch` to take `slots`, claimed by its primary with
+	/// `config_epoch`. A primary votes once per epoch, only for a replica
+	/// whose primary failed unless the failover is `manual`, and not for two
+	/// replicas of the same primary within two node timeouts.
+	#[allow(clippy::too_many_arguments)]
+	pub(super) fn vote(
+		&mut self,
+		requester: &str,
+		epoch: u64,
+		config_epoch: u64,
+		slots: &[u8],
+		manual: bool,
+		now: u64,
+		timeout: u64,
+	) -> bool {
+		if self.myself().primary.is_some() || self.slots_of(&self.myself).next().is_none() {
+			return false;
+		}
+		if epoch < self.current_epoch || self.last_vote_epoch == self.current_epoch {
+			return false;
+		}
+		let Some(primary) = self
+			.nodes
+			.get(requester)
+			.and_then(|node| node.primary.clone())
+		else {
+			return false;
+		};
+		match self.nodes.get(&primary) {
+			Some(node) if manual || node.fail.is_some() => {
+				if now.saturating_sub(node.voted) < timeout * 2 {
+					return false;
+				}
+			}
+			_ => return false,
+		}
+		// A replica whose primary lost slots since it last heard of them
+		// asks with a stale view.
+		let stale = bitmap_slots(slots).any(|slot| {
+			self.slots[slot as usize]
+				.as_ref()
+				.and_then(|owner| self.nodes.get(owner))
+				.is_some_and(|owner| owner.config_epoch > config_epoch)
+		});
+		if stale {
+			return false;
+		}
+		self.last_vote_epoch = self.current_epoch;
+		if let Some(node) = self.nodes.get_mut(&primary) {
+			node.voted = now;
+		}
+		true
+	}
+
+	/// Forget `id`, and keep gossip from bringing it back for `ttl`
+	/// milliseconds.
+	pub(super) fn forget(&mut self, id: &str, now: u64, ttl: u64) {
+		self.nodes.remove(id);
+		for owner in self.slots.iter_mut() {
+			if owner.as_deref() == Some(id) {
+				*owner = None;
+			}
+		}
+		self.migrating.retain(|_, node| node != id);
+		self.importing.retain(|_, node| node != id);
+		for node in self.nodes.values_mut() {
+			node.failure_reports.remove(id);
+		}
+		self.forgotten.insert(id.to_string(), now + ttl);
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use super::super::Node;
+	use super::super::slot::slot_bitmap;
+	use super::*;
+
+	const TIMEOUT: u64 = 1000;
+
+	/// Primaries a, b and c serving slots 0, 1 and 2, and d replicating a,
+	/// as d sees them.
+	fn replica_state() -> ClusterState {
+		let mut myself = Node::new("d".repeat(40), String::new(), 7003, 17003);
+		myself.primary = Some("a".repeat(40));
+		let mut state = ClusterState::new(myself);
+		for (slot, id) in ["a", "b", "c"].iter().enumerate() {
+			let mut node = Node::new(id.repeat(40), String::new(), 7000, 17000);
+			node.config_epoch = slot as u64 + 1;
+			state.nodes.insert(node.id.clone(), node);
+			state.slots[slot] = Some(id.repeat(40));
+		}
+		state.current_epoch = 3;
+		state
+	}
+
+	/// The same cluster, as primary b sees it.
+	fn primary_state() -> ClusterState {
+		let mut state = replica_state();
+		state.myself = "b".repeat(40);
+		state
+	}
+
+	#[test]
+	fn test_failure_needs_a_majority() {
+		let mut state = primary_state();
+		let a = "a".repeat(40);
+		state.nodes.get_mut(&a).unwrap().ping_sent = 1;
+		assert!(state.detect_failures(1000, TIMEOUT).is_empty());
+		assert!(!state.nodes[&a].pfail);
+
+		// b suspects a, but needs one more primary to agree.
+		assert!(state.detect_failures(1002, TIMEOUT).is_empty());
+		assert!(state.nodes[&a].pfail);
+		state.report_failure(&a, &"c".repeat(40), 1002);
+		assert!(state.mark_failed_if_needed(&a, 1003, TIMEOUT));
+		assert_eq!(state.nodes[&a].fail, Some(1003));
+
+		// A replica answers: it serves no slots, so it is back at once.
+		assert!(!state.clear_failure_if_needed(&a, 1004, TIMEOUT));
+		state.nodes.get_mut(&a).unwrap().primary = Some("b".repeat(40));
+		assert!(state.clear_failure_if_needed(&a, 1004, TIMEOUT));
+	}
+
+	#[test]
+	fn test_stale_failure_reports() {
+		let mut state = primary_state();
+		let a = "a".repeat(40);
+		state.nodes.get_mut(&a).unwrap().pfail = true;
+		state.report_failure(&a, &"c".repeat(40), 0);
+		assert!(!state.mark_failed_if_needed(&a, 3 * TIMEOUT, TIMEOUT));
+		assert_eq!(state.failure_reports(&a, 3 * TIMEOUT, TIMEOUT), 0);
+	}
+
+	#[test]
+	fn test_minority_primary_holds_off_commands() {
+		let mut state = primary_state();
+		let (a, c) = ("a".repeat(40), "c".repeat(40));
+		state.nodes.get_mut(&a).unwrap().pfail = true;
+		state.watch_partition(5_000, TIMEOUT);
+		assert!(!state.in_minority());
+		assert_eq!(state.rejoin_at, 0);
+
+		// b reaches only itself out of three primaries.
+		state.nodes.get_mut(&c).unwrap().pfail = true;
+		assert!(state.in_minority());
+		state.watch_partition(5_000, TIMEOUT);
+		assert_eq!(state.rejoin_at, 6_000);
+
+		// Back in touch, it waits out the rejoin delay.
+		state.nodes.get_mut(&c).unwrap().pfail = false;
+		state.watch_partition(5_100, TIMEOUT);
+		assert!(!state.in_minority());
+		assert_eq!(state.rejoin_at, 6_000);
+
+		// A replica follows its primary instead.
+		let mut state = replica_state();
+		state.nodes.get_mut(&a).unwrap().pfail = true;
+		state.nodes.get_mut(&c).unwrap().pfail = true;
+		assert!(!state.in_minority());
+	}
+
+	#[test]
+	fn test_vote() {
+		let mut state = primary_state();
+		let (a, d) = ("a".repeat(40), "d".repeat(40));
+		let mut replica = Node::new(d.clone(), String::new(), 7003, 17003);
+		replica.primary = Some(a.clone());
+		state.nodes.insert(d.clone(), replica);
+		let slots = slot_bitmap([0]);
+
+		// The primary of d is up.
+		assert!(!state.vote(&d, 4, 1, &slots, false, 10_000, TIMEOUT));
+		state.set_failed(&a, 10_000);
+		state.current_epoch = 4;
+		// A stale claim on the slots.
+		state.nodes.get_mut(&a).unwrap().config_epoch = 2;
+		assert!(!state.vote(&d, 4, 1, &slots, false, 10_000, TIMEOUT));
+		assert!(state.vote(&d, 4, 2, &slots, false, 10_000, TIMEOUT));
+		// One vote per epoch.
+		assert!(!state.vote(&d, 4, 2, &slots, false, 10_000, TIMEOUT));
+		// And not twice for the same primary within two node timeouts.
+		state.current_epoch = 5;
+		assert!(!state.vote(&d, 5, 2, &slots, false, 11_000, TIMEOUT));
+		assert!(state.vote(&d, 5, 2, &slots, false, 12_001, TIMEOUT));
+	}
+
+	#[test]
+	fn test_election() {
+		let mut state = replica_state();
+		let (a, b, c, d) = (
+			"a".repeat(40),
+			"b".repeat(40),
+			"c".repeat(40),
+			"d".repeat(40),
+		);
+		assert_eq!(state.run_election(0, TIMEOUT), None);
+		assert!(state.election.is_none());
+
+		state.set_failed(&a, 0);
+		assert_eq!(state.run_election(0, TIMEOUT), None);
+		let start = state.election.as_ref().unwrap().start;
+		assert!((500..1000).contains(&start));
+		assert_eq!(state.run_election(start, TIMEOUT), Some(4));
+		assert_eq!(state.current_epoch, 4);
+
+		// Votes from a stale epoch, or from a replica, do not count.
+		state.count_vote(&b, 3);
+		state.count_vote(&d, 4);
+		state.count_vote(&b, 4);
+		assert_eq!(state.run_election(start + 1, TIMEOUT), None);
+		assert_eq!(state.myself().primary, Some(a.clone()));
+		state.count_vote(&c, 4);
+		assert_eq!(state.run_election(start + 2, TIMEOUT), None);
+		assert_eq!(state.myself().primary, None);
+		assert_eq!(state.myself().config_epoch, 4);
+		assert_eq!(state.slots[0], Some(d.clone()));
+		assert!(state.announce);
+	}
+
+	#[test]
+	fn test_manual_failover_waits_for_the_offset() {
+		let mut state = replica_state();
+		state.offset = 10;
+		state.manual_failover = Some(ManualFailover {
+			deadline: MANUAL_FAILOVER_TIMEOUT_MS,
+			requested: true,
+			primary_offset: Some(20),
+			force: false,
+		});
+		assert_eq!(state.run_election(0, TIMEOUT), None);
+		assert!(state.election.is_none());
+		state.offset = 20;
+		assert_eq!(state.run_election(0, TIMEOUT), Some(4));
+		assert!(state.election.as_ref().unwrap().manual);
+	}
+
+	#[test]
+	fn test_take_over() {
+		let mut state = replica_state();
+		state.take_over();
+		assert_eq!(state.myself().primary, None);
+		assert_eq!(state.myself().config_epoch, 4);
+		assert_eq!(state.slots[0], Some("d".repeat(40)));
+
+		state.set_primary(&"b".repeat(40));
+		assert_eq!(state.slots[0], None);
+		assert_eq!(state.myself().primary, Some("b".repeat(40)));
+	}
+
+	#[test]
+	fn test_forget() {
+		let mut state = primary_state();
+		let a = "a".repeat(40);
+		state.report_failure(&"c".repeat(40), &a, 0);
+		state.forget(&a, 0, 60_000);
+		assert!(!state.nodes.contains_key(&a));
+		assert_eq!(state.slots[0], None);
+		assert!(state.nodes[&"c".repeat(40)].failure_reports.is_empty());
+		assert_eq!(state.forgotten.get(&a), Some(&60_000));
+	}
+}
@@ -0,0 +1,1423 @@
+//! Cluster mode.
+//!
+//! With `cluster_enabled` set, the keyspace is split into 16384 hash slots
+//! and every slot is served by one primary of the cluster. The slot of a key
+//! is the CRC16 of the key, or of the part between its first `{` and the
+//! next `}` if that is not empty, so keys sharing such a hash tag share a
+//! slot. Before a command runs, its keys are hashed: keys in several slots
+//! are refused with CROSSSLOT, and a slot another primary serves is answered
+//! with `MOVED <slot> <ip>:<port>`, so the client sends the command there.
+//!
+//! Servers join a cluster with CLUSTER MEET and keep in touch over the
+//! cluster bus (see `bus`), where every message carries the slots its sender
+//! serves and the configuration epoch of that claim. A slot goes to the
+//! claimant with the greater epoch, so the slot table of every server
+//! converges on the same owners.
+//!
+//! A slot moves to another primary while it is served: CLUSTER SETSLOT marks
+//! it as migrating on its owner and as importing on the node it goes to, and
+//! MIGRATE moves its keys over. Meanwhile the owner answers a command whose
+//! keys it no longer has with `ASK <slot> <ip>:<port>`, which sends that one
+//! command, preceded by ASKING, to the importing node. Once the keys are
+//! moved, CLUSTER SETSLOT NODE hands the slot over, and the importing node
+//! takes a new epoch so its claim wins everywhere.
+//!
+//! A node made a replica with CLUSTER REPLICATE serves no slots: it
+//! replicates the primary it follows, and serves reads of its slots to the
+//! clients that sent READONLY. The nodes gossip about each other, so one met
+//! by a single node of the cluster soon knows them all, and they watch each
+//! other: a primary that stops answering is failed over to one of its
+//! replicas, and a primary cut off from most of the others stops serving
+//! its slots (see `failover`).
+//!
+//! The node ID, the known nodes and their primaries, the slot table, the
+//! slots being moved and the epochs are kept in the storage metadata entry
+//! `cluster`, in the format of CLUSTER NODES, so a restarted server rejoins the
+//! cluster as the node it was.
+
+mod bus;
+mod failover;
+pub mod slot;
+
+use std::collections::BTreeMap;
+use std::collections::HashMap;
+use std::net::IpAddr;
+use std::sync::Mutex;
+use std::sync::atomic::AtomicBool;
+use std::sync::atomic::AtomicU64;
+use std::sync::atomic::Ordering;
+
+pub use bus::start;
+use bytes::Bytes;
+pub use failover::FailoverMode;
+use log::info;
+use nimbis_storage::Storage;
+use tokio::sync::mpsc;
+
+use self::failover::Election;
+use self::failover::MANUAL_FAILOVER_TIMEOUT_MS;
+use self::failover::ManualFailover;
+use self::slot::CLUSTER_SLOTS;
+use self::slot::key_hash_slot;
+use self::slot::slot_ranges;
+use crate::GCTX;
+use crate::acl;
+use crate::server_config;
+
+/// Storage metadata entry holding the cluster configuration.
+const METADATA_NAME: &str = "cluster";
+
+const CROSSSLOT: &str = "CROSSSLOT Keys in request don't hash to the same slot";
+const SLOT_NOT_SERVED: &str = "CLUSTERDOWN Hash slot not served";
+const CLUSTER_DOWN: &str = "CLUSTERDOWN The cluster is down";
+const TRYAGAIN: &str = "TRYAGAIN Multiple keys request during rehashing of slot";
+/// How long CLUSTER FORGET keeps gossip from bringing a node back.
+const FORGET_TTL_MS: u64 = 60_000;
+
+/// The connection this server opened to a node to ping it.
+#[derive(Debug)]
+struct Link {
+	/// Tells the link apart from the ones opened before it.
+	serial: u64,
+	outbox: mpsc::UnboundedSender<Bytes>,
+	connected: bool,
+}
+
+/// A server of the cluster, as this server knows it.
+#[derive(Debug)]
+struct Node {
+	id: String,
+	ip: String,
+	port: u16,
+	cport: u16,
+	/// The epoch of the node's claim on its slots.
+	config_epoch: u64,
+	/// The primary the node replicates, None if it is a primary.
+	primary: Option<String>,
+	/// The replication offset the node last told.
+	offset: u64,
+	/// Set while this server suspects the node of failing.
+	pfail: bool,
+	/// Unix milliseconds the node was marked failed, None unless it was.
+	fail: Option<u64>,
+	/// The primaries that suspect the node of failing, with the Unix
+	/// milliseconds of their last report.
+	failure_reports: HashMap<String, u64>,
+	/// Unix milliseconds this server last voted for a replica of the node.
+	voted: u64,
+	/// Unix milliseconds of the PING waiting for a PONG, or 0.
+	ping_sent: u64,
+	/// Unix milliseconds of the last PONG.
+	pong_received: u64,
+	/// Set while the node has not answered CLUSTER MEET yet; its ID is a
+	/// placeholder until it does.
+	handshake: bool,
+	/// Unix milliseconds the node was added.
+	created: u64,
+	link: Option<Link>,
+}
+
+impl Node {
+	fn new(id: String, ip: String, port: u16, cport: u16) -> Self {
+		Self {
+			id,
+			ip,
+			port,
+			cport,
+			config_epoch: 0,
+			primary: None,
+			offset: 0,
+			pfail: false,
+			fail: None,
+			failure_reports: HashMap::new(),
+			voted: 0,
+			ping_sent: 0,
+			pong_received: 0,
+			handshake: false,
+			created: now_ms(),
+			link: None,
+		}
+	}
+
+	fn is_connected(&self) -> bool {
+		self.link.as_ref().is_some_and(|link| link.connected)
+	}
+}
+
+/// A node serving a range of slots, for CLUSTER SLOTS.
+#[derive(Debug, Clone, PartialEq)]
+pub struct SlotRange {
+	pub start: u16,
+	pub end: u16,
+	pub nodes: Vec<NodeAddr>,
+}
+
+#[derive(Debug, Clone, PartialEq)]
+pub struct NodeAddr {
+	pub id: String,
+	pub ip: String,
+	pub port: u16,
+}
+
+/// A primary and the slots it serves, for CLUSTER SHARDS.
+#[derive(Debug, Clone, PartialEq)]
+pub struct Shard {
+	pub slots: Vec<(u16, u16)>,
+	pub nodes: Vec<ShardNode>,
+}
+
+#[derive(Debug, Clone, PartialEq)]
+pub struct ShardNode {
+	pub addr: NodeAddr,
+	pub role: &'static str,
+	/// The replication offset of the node.
+	pub offset: u64,
+	pub health: &'static str,
+}
+
+#[derive(Debug)]
+struct ClusterState {
+	/// The ID of this server.
+	myself: String,
+	current_epoch: u64,
+	/// Every known node, this server included.
+	nodes: HashMap<String, Node>,
+	/// The node serving each slot.
+	slots: Vec<Option<String>>,
+	/// The node each slot this server serves is being moved to.
+	migrating: BTreeMap<u16, String>,
+	/// The node each slot being moved to this server comes from.
+	importing: BTreeMap<u16, String>,
+	/// The epoch this server last voted in.
+	last_vote_epoch: u64,
+	election: Option<Election>,
+	manual_failover: Option<ManualFailover>,
+	/// The replica this primary paused writes for, and the Unix milliseconds
+	/// the pause ends at.
+	paused_for: Option<(String, u64)>,
+	/// Nodes CLUSTER FORGET removed, with the Unix milliseconds until which
+	/// gossip does not bring them back.
+	forgotten: HashMap<String, u64>,
+	/// The replication offset of this server, and whether its writes are
+	/// paused, as of the last cron tick.
+	offset: u64,
+	writes_paused: bool,
+	/// Unix milliseconds until which this primary, back from the minority
+	/// side of a partition, keeps refusing commands.
+	rejoin_at: u64,
+	/// Set when the role or the slots of this server changed, so every node
+	/// is told at once.
+	announce: bool,
+}
+
+/// What CLUSTER SETSLOT does to a slot.
+#[derive(Debug, Clone, PartialEq)]
+pub enum SetSlot {
+	Migrating(String),
+	Importing(String),
+	Stable,
+	Node(String),
+}
+
+/// Where a command for a slot this server may run goes.
+#[derive(Debug)]
+enum Route {
+	/// This server serves the slot.
+	Serve,
+	/// This server serves the slot but is moving it; the keys it no longer
+	/// has are asked for with this ASK error.
+	Migrating(String),
+	/// The slot is being moved to this server, which serves it only after
+	/// ASKING; other commands get this MOVED error.
+	Importing(String),
+}
+
+impl ClusterState {
+	fn new(myself: Node) -> Self {
+		let mut nodes = HashMap::new();
+		let id = myself.id.clone();
+		nodes.insert(id.clone(), myself);
+		Self {
+			myself: id,
+			current_epoch: 0,
+			nodes,
+			slots: vec![None; CLUSTER_SLOTS],
+			migrating: BTreeMap::new(),
+			importing: BTreeMap::new(),
+			last_vote_epoch: 0,
+			election: None,
+			manual_failover: None,
+			paused_for: None,
+			forgotten: HashMap::new(),
+			offset: 0,
+			writes_paused: false,
+			rejoin_at: 0,
+			announce: false,
+		}
+	}
+
+	fn myself(&self) -> &Node {
+		&self.nodes[&self.myself]
+	}
+
+	fn myself_mut(&mut self) -> &mut Node {
+		self.nodes
+			.get_mut(&self.myself)
+			.expect("the cluster knows this server")
+	}
+
+	/// The slots `id` serves, ascending.
+	fn slots_of<'a>(&'a self, id: &'a str) -> impl Iterator<Item = u16> + 'a {
+		self.slots
+			.iter()
+			.enumerate()
+			.filter(move |(_, owner)| owner.as_deref() == Some(id))
+			.map(|(slot, _)| slot as u16)
+	}
+
+	fn assigned_slots(&self) -> usize {
+		self.slots.iter().filter(|owner| owner.is_some()).count()
+	}
+
+	/// The IDs of the nodes marked failed, or with `suspected`, of those
+	/// this server suspects of failing too.
+	fn failing(&self, suspected: bool) -> Vec<&str> {
+		self.nodes
+			.values()
+			.filter(|node| node.fail.is_some() || (suspected && node.pfail))
+			.map(|node| node.id.as_str())
+			.collect()
+	}
+
+	/// Whether the cluster serves requests at `now`: this server is not a
+	/// primary cut off in a minority, or just back from one, and every slot
+	/// is served by a node that did not fail, unless
+	/// `cluster_require_full_coverage` is off.
+	fn is_ok(&self, now: u64) -> bool {
+		if self.in_minority() || now < self.rejoin_at {
+			return false;
+		}
+		if !server_config!(cluster_require_full_coverage) {
+			return true;
+		}
+		let failed = self.failing(false);
+		self.slots
+			.iter()
+			.all(|owner| owner.as_deref().is_some_and(|id| !failed.contains(&id)))
+	}
+
+	/// Whether `id` is a node that answered its handshake.
+	fn knows(&self, id: &str) -> bool {
+		self.nodes.get(id).is_some_and(|node| !node.handshake)
+	}
+
+	fn serves(&self, slot: u16) -> bool {
+		self.slots[slot as usize].as_deref() == Some(self.myself.as_str())
+	}
+
+	/// The primaries that serve at least one slot.
+	fn size(&self) -> usize {
+		let mut owners: Vec<&str> = self.slots.iter().flatten().map(String::as_str).collect();
+		owners.sort_unstable();
+		owners.dedup();
+		owners.len()
+	}
+
+	/// The replicas of `id`, by ID.
+	fn replicas_of(&self, id: &str) -> Vec<&Node> {
+		let mut replicas: Vec<&Node> = self
+			.nodes
+			.values()
+			.filter(|node| !node.handshake && node.primary.as_deref() == Some(id))
+			.collect();
+		replicas.sort_by(|a, b| a.id.cmp(&b.id));
+		replicas
+	}
+
+	fn shard_node(&self, node: &Node) -> ShardNode {
+		let myself = node.id == self.myself;
+		ShardNode {
+			addr: addr_of(node),
+			role: if node.primary.is_some() {
+				"replica"
+			} else {
+				"master"
+			},
+			offset: if myself { self.offset } else { node.offset },
+			health: if node.fail.is_some() {
+				"failed"
+			} else if myself || node.is_connected() {
+				"online"
+			} else {
+				"loading"
+			},
+		}
+	}
+
+	/// Start a handshake with the node whose bus listens on `ip:cport`,
+	/// unless one is under way. The node is known by a placeholder ID until
+	/// it answers.
+	fn start_handshake(&mut self, ip: String, port: u16, cport: u16) {
+		if self
+			.nodes
+			.values()
+			.any(|node| node.handshake && node.ip == ip && node.port == port && node.cport == cport)
+		{
+			return;
+		}
+		let mut node = Node::new(new_node_id(), ip, port, cport);
+		node.handshake = true;
+		self.nodes.insert(node.id.clone(), node);
+	}
+
+	/// Nodes that answered their handshake, this server first, then by ID.
+	fn known_nodes(&self) -> Vec<&Node> {
+		let mut nodes: Vec<&Node> = self
+			.nodes
+			.values()
+			.filter(|node| !node.handshake && node.id != self.myself)
+			.collect();
+		nodes.sort_by(|a, b| a.id.cmp(&b.id));
+		nodes.insert(0, self.myself());
+		nodes
+	}
+
+	fn flags(&self, node: &Node) -> String {
+		if node.handshake {
+			return "handshake".to_string();
+		}
+		let mut flags = Vec::new();
+		if node.id == self.myself {
+			flags.push("myself");
+		}
+		flags.push(if node.primary.is_some() {
+			"slave"
+		} else {
+			"master"
+		});
+		if node.pfail {
+			flags.push("fail?");
+		}
+		if node.fail.is_some() {
+			flags.push("fail");
+		}
+		flags.join(",")
+	}
+
+	/// The CLUSTER NODES line of `node`.
+	fn describe(&self, node: &Node) -> String {
+		let myself = node.id == self.myself;
+		let mut line = format!(
+			"{} {}:{}@{} {} {} {} {} {} {}",
+			node.id,
+			node.ip,
+			node.port,
+			node.cport,
+			self.flags(node),
+			node.primary.as_deref().unwrap_or("-"),
+			node.ping_sent,
+			node.pong_received,
+			node.config_epoch,
+			if myself || node.is_connected() {
+				"connected"
+			} else {
+				"disconnected"
+			},
+		);
+		for (start, end) in slot_ranges(self.slots_of(&node.id)) {
+			if start == end {
+				line.push_str(&format!(" {}", start));
+			} else {
+				line.push_str(&format!(" {}-{}", start, end));
+			}
+		}
+		if myself {
+			for (slot, id) in &self.migrating {
+				line.push_str(&format!(" [{}->-{}]", slot, id));
+			}
+			for (slot, id) in &self.importing {
+				line.push_str(&format!(" [{}-<-{}]", slot, id));
+			}
+		}
+		line
+	}
+
+	/// Give this server a new epoch, greater than any the cluster has seen,
+	/// unless its epoch is already the greatest and no other primary shares
+	/// it; replicas tell the epoch of their primary, so they do not count.
+	/// Returns whether the epoch changed and the epoch.
+	fn bump_epoch(&mut self) -> (bool, u64) {
+		let mine = self.myself().config_epoch;
+		let shared = self.nodes.values().any(|node| {
+			node.id != self.myself && node.primary.is_none() && node.config_epoch == mine
+		});
+		if mine != 0 && mine == self.current_epoch && !shared {
+			return (false, mine);
+		}
+		self.current_epoch += 1;
+		let epoch = self.current_epoch;
+		self.myself_mut().config_epoch = epoch;
+		(true, epoch)
+	}
+
+	/// The configuration kept in storage: a CLUSTER NODES line per node that
+	/// answered its handshake, then the epochs.
+	fn encode_config(&self) -> String {
+		let mut config = String::new();
+		for node in self.known_nodes() {
+			config.push_str(&self.describe(node));
+			config.push('\n');
+		}
+		config.push_str(&format!(
+			"vars currentEpoch {} lastVoteEpoch {}\n",
+			self.current_epoch, self.last_vote_epoch
+		));
+		config
+	}
+
+	fn decode_config(config: &str) -> Result<Self, String> {
+		let mut myself = None;
+		let mut current_epoch = 0;
+		let mut last_vote_epoch = 0;
+		let mut nodes = HashMap::new();
+		let mut slots = vec![None; CLUSTER_SLOTS];
+		let mut migrating = BTreeMap::new();
+		let mut importing = BTreeMap::new();
+		for line in config.lines() {
+			let words: Vec<&str> = line.split_whitespace().collect();
+			let invalid = || format!("invalid cluster configuration line '{}'", line);
+			match words.as_slice() {
+				[] => continue,
+				["vars", vars @ ..] => {
+					for pair in vars.chunks(2) {
+						match pair {
+							["currentEpoch", epoch] => {
+								current_epoch = epoch.parse().map_err(|_| invalid())?;
+							}
+							["lastVoteEpoch", epoch] => {
+								last_vote_epoch = epoch.parse().map_err(|_| invalid())?;
+							}
+							_ => {}
+						}
+					}
+				}
+				[
+					id,
+					address,
+					flags,
+					primary,
+					_ping,
+					_pong,
+					epoch,
+					_link,
+					ranges @ ..,
+				] => {
+					let (ip, port, cport) = parse_address(address).ok_or_else(invalid)?;
+					let mut node = Node::new(id.to_string(), ip, port, cport);
+					node.config_epoch = epoch.parse().map_err(|_| invalid())?;
+					if *primary != "-" {
+						node.primary = Some(primary.to_string());
+					}
+					if flags.split(',').any(|flag| flag == "myself") {
+						myself = Some(id.to_string());
+					}
+					for range in ranges {
+						if let Some(moving) =
+							range.strip_prefix('[').and_then(|r| r.strip_suffix(']'))
+						{
+							let (slot, node, moves) = match moving.split_once("->-") {
+								Some((slot, node)) => (slot, node, &mut migrating),
+								None => {
+									let (slot, node) =
+										moving.split_once("-<-").ok_or_else(invalid)?;
+									(slot, node, &mut importing)
+								}
+							};
+							let slot: u16 = slot.parse().map_err(|_| invalid())?;
+							if slot as usize >= CLUSTER_SLOTS {
+								return Err(invalid());
+							}
+							moves.insert(slot, node.to_string());
+							continue;
+						}
+						let (start, end) = match range.split_once('-') {
+							Some((start, end)) => (start, end),
+							None => (*range, *range),
+						};
+						let start: usize = start.parse().map_err(|_| invalid())?;
+						let end: usize = end.parse().map_err(|_| invalid())?;
+						if start > end || end >= CLUSTER_SLOTS {
+							return Err(invalid());
+						}
+						for owner in &mut slots[start..=end] {
+							*owner = Some(id.to_string());
+						}
+					}
+					nodes.insert(id.to_string(), node);
+				}
+				_ => return Err(invalid()),
+			}
+		}
+		migrating.retain(|_, id: &mut String| nodes.contains_key(id.as_str()));
+		importing.retain(|_, id: &mut String| nodes.contains_key(id.as_str()));
+		let myself = myself
+			.and_then(|id| nodes.remove(&id))
+			.ok_or("the cluster configuration names no node as myself")?;
+		let mut state = Self::new(myself);
+		state.current_epoch = current_epoch;
+		state.last_vote_epoch = last_vote_epoch;
+		state.nodes.extend(nodes);
+		state.slots = slots;
+		state.migrating = migrating;
+		state.importing = importing;
+		Ok(state)
+	}
+}
+
+/// Split `ip:port@cport`, which may carry `,hostname` after the bus port.
+fn parse_address(address: &str) -> Option<(String, u16, u16)> {
+	let (addr, cport) = address.split_once('@')?;
+	let cport = cport.split(',').next()?.parse().ok()?;
+	let (ip, port) = addr.rsplit_once(':')?;
+	Some((ip.to_string(), port.parse().ok()?, cport))
+}
+
+#[derive(Debug)]
+pub struct Cluster {
+	state: Mutex<ClusterState>,
+	/// Set when the configuration changed since it was last saved.
+	dirty: AtomicBool,
+	/// Keeps saves from overtaking one another.
+	saving: tokio::sync::Mutex<()>,
+	next_link_serial: AtomicU64,
+	messages_sent: AtomicU64,
+	messages_received: AtomicU64,
+}
+
+impl Default for Cluster {
+	fn default() -> Self {
+		Self::new()
+	}
+}
+
+impl Cluster {
+	pub fn new() -> Self {
+		Self {
+			state: Mutex::new(ClusterState::new(Node::new(
+				new_node_id(),
+				String::new(),
+				0,
+				0,
+			))),
+			dirty: AtomicBool::new(false),
+			saving: tokio::sync::Mutex::new(()),
+			next_link_serial: AtomicU64::new(0),
+			messages_sent: AtomicU64::new(0),
+			messages_received: AtomicU64::new(0),
+		}
+	}
+
+	/// Load the configuration a previous run saved, or save the fresh one of
+	/// a server that never ran in cluster mode.
+	pub async fn load(&self, storage: &Storage) -> Result<(), String> {
+		let saved = storage
+			.get_metadata(METADATA_NAME)
+			.await
+			.map_err(|e| e.to_string())?;
+		{
+			let mut state = self.state.lock().unwrap();
+			if let Some(config) = &saved {
+				*state = ClusterState::decode_config(&String::from_utf8_lossy(config))?;
+			}
+			let myself = state.myself_mut();
+			myself.port = server_config!(port);
+			myself.cport = bus_port();
+			if myself.ip.is_empty() {
+				myself.ip = default_ip();
+			}
+		}
+		self.save(storage).await
+	}
+
+	/// Write the configuration to storage.
+	pub async fn save(&self, storage: &Storage) -> Result<(), String> {
+		let _saving = self.saving.lock().await;
+		self.dirty.store(false, Ordering::Release);
+		let config = self.state.lock().unwrap().encode_config();
+		storage
+			.put_metadata(METADATA_NAME, Bytes::from(config))
+			.await
+			.map_err(|e| e.to_string())
+	}
+
+	fn mark_dirty(&self) {
+		self.dirty.store(true, Ordering::Release);
+	}
+
+	/// Save the configuration if it changed since it was last saved.
+	async fn save_if_dirty(&self, storage: &Storage) -> Result<(), String> {
+		if self.dirty.load(Ordering::Acquire) {
+			self.save(storage).await?;
+		}
+		Ok(())
+	}
+
+	pub fn myid(&self) -> String {
+		self.state.lock().unwrap().myself.clone()
+	}
+
+	/// Accept the command for `slot` here, or tell where to send it.
+	/// `replica_read` tells whether the command only reads, for a client
+	/// that sent READONLY, which a replica serves for its primary.
+	fn route(&self, slot: u16, replica_read: bool) -> Result<Route, String> {
+		let state = self.state.lock().unwrap();
+		let Some(owner) = &state.slots[slot as usize] else {
+			return Err(SLOT_NOT_SERVED.to_string());
+		};
+		if !state.is_ok(now_ms()) {
+			return Err(CLUSTER_DOWN.to_string());
+		}
+		if *owner == state.myself {
+			let target = state
+				.migrating
+				.get(&slot)
+				.and_then(|target| state.nodes.get(target));
+			return Ok(match target {
+				Some(node) => Route::Migrating(format!("ASK {} {}:{}", slot, node.ip, node.port)),
+				None => Route::Serve,
+			});
+		}
+		if replica_read && state.myself().primary.as_ref() == Some(owner) {
+			return Ok(Route::Serve);
+		}
+		let node = &state.nodes[owner];
+		let moved = format!("MOVED {} {}:{}", slot, node.ip, node.port);
+		if state.importing.contains_key(&slot) {
+			Ok(Route::Importing(moved))
+		} else {
+			Err(moved)
+		}
+	}
+
+	/// CLUSTER NODES: a line per known node.
+	pub fn nodes(&self) -> String {
+		let state = self.state.lock().unwrap();
+		let mut nodes: Vec<&Node> = state.nodes.values().collect();
+		nodes.sort_by(|a, b| a.id.cmp(&b.id));
+		nodes
+			.into_iter()
+			.map(|node| state.describe(node) + "\n")
+			.collect()
+	}
+
+	/// The ranges of consecutive slots served by the same node, with its
+	/// replicas that did not fail.
+	pub fn slot_table(&self) -> Vec<SlotRange> {
+		let state = self.state.lock().unwrap();
+		let mut ranges: Vec<SlotRange> = Vec::new();
+		for (slot, owner) in state.slots.iter().enumerate() {
+			let Some(owner) = owner else {
+				continue;
+			};
+			match ranges.last_mut() {
+				Some(range) if range.end as usize + 1 == slot && range.nodes[0].id == *owner => {
+					range.end = slot as u16;
+				}
+				_ => ranges.push(SlotRange {
+					start: slot as u16,
+					end: slot as u16,
+					nodes: vec![addr_of(&state.nodes[owner])],
+				}),
+			}
+		}
+		for range in &mut ranges {
+			let replicas = state.replicas_of(&range.nodes[0].id);
+			range.nodes.extend(
+				replicas
+					.into_iter()
+					.filter(|node| node.fail.is_none())
+					.map(addr_of),
+			);
+		}
+		ranges
+	}
+
+	/// Every primary with the slots it serves and its replicas.
+	pub fn shards(&self) -> Vec<Shard> {
+		let state = self.state.lock().unwrap();
+		state
+			.known_nodes()
+			.into_iter()
+			.filter(|node| node.primary.is_none())
+			.map(|primary| {
+				let mut nodes = vec![state.shard_node(primary)];
+				nodes.extend(
+					state
+						.replicas_of(&primary.id)
+						.into_iter()
+						.map(|node| state.shard_node(node)),
+				);
+				Shard {
+					slots: slot_ranges(state.slots_of(&primary.id)),
+					nodes,
+				}
+			})
+			.collect()
+	}
+
+	/// The fields of CLUSTER INFO.
+	pub fn info(&self) -> Vec<(String, String)> {
+		let state = self.state.lock().unwrap();
+		let assigned = state.assigned_slots();
+		let failed = state.failing(false);
+		let failing = state.failing(true);
+		let (mut pfail, mut fail) = (0, 0);
+		for owner in state.slots.iter().flatten() {
+			if failed.contains(&owner.as_str()) {
+				fail += 1;
+			} else if failing.contains(&owner.as_str()) {
+				pfail += 1;
+			}
+		}
+		vec![
+			(
+				"cluster_state".to_string(),
+				if state.is_ok(now_ms()) { "ok" } else { "fail" }.to_string(),
+			),
+			("cluster_slots_assigned".to_string(), assigned.to_string()),
+			(
+				"cluster_slots_ok".to_string(),
+				(assigned - pfail - fail).to_string(),
+			),
+			("cluster_slots_pfail".to_string(), pfail.to_string()),
+			("cluster_slots_fail".to_string(), fail.to_string()),
+			(
+				"cluster_known_nodes".to_string(),
+				state.known_nodes().len().to_string(),
+			),
+			("cluster_size".to_string(), state.size().to_string()),
+			(
+				"cluster_current_epoch".to_string(),
+				state.current_epoch.to_string(),
+			),
+			(
+				"cluster_my_epoch".to_string(),
+				state.myself().config_epoch.to_string(),
+			),
+			(
+				"cluster_stats_messages_sent".to_string(),
+				self.messages_sent.load(Ordering::Relaxed).to_string(),
+			),
+			(
+				"cluster_stats_messages_received".to_string(),
+				self.messages_received.load(Ordering::Relaxed).to_string(),
+			),
+		]
+	}
+
+	/// Serve `slots` from this server.
+	pub fn add_slots(&self, slots: &[u16]) -> Result<(), String> {
+		let mut state = self.state.lock().unwrap();
+		for (i, &slot) in slots.iter().enumerate() {
+			if state.slots[slot as usize].is_some() {
+				return Err(format!("ERR Slot {} is already busy", slot));
+			}
+			if slots[..i].contains(&slot) {
+				return Err(format!("ERR Slot {} specified multiple times", slot));
+			}
+		}
+		let myself = state.myself.clone();
+		for &slot in slots {
+			state.slots[slot as usize] = Some(myself.clone());
+			// The slot is this server's now, however far its import got.
+			state.importing.remove(&slot);
+		}
+		self.mark_dirty();
+		Ok(())
+	}
+
+	/// Forget who serves `slots`.
+	pub fn del_slots(&self, slots: &[u16]) -> Result<(), String> {
+		let mut state = self.state.lock().unwrap();
+		for (i, &slot) in slots.iter().enumerate() {
+			if state.slots[slot as usize].is_none() {
+				return Err(format!("ERR Slot {} is already unassigned", slot));
+			}
+			if slots[..i].contains(&slot) {
+				return Err(format!("ERR Slot {} specified multiple times", slot));
+			}
+		}
+		for &slot in slots {
+			state.slots[slot as usize] = None;
+			state.migrating.remove(&slot);
+		}
+		self.mark_dirty();
+		Ok(())
+	}
+
+	/// Stop serving every slot this server serves.
+	pub fn flush_slots(&self) {
+		let mut state = self.state.lock().unwrap();
+		let myself = state.myself.clone();
+		for owner in state.slots.iter_mut() {
+			if owner.as_deref() == Some(myself.as_str()) {
+				*owner = None;
+			}
+		}
+		state.migrating.clear();
+		self.mark_dirty();
+	}
+
+	/// CLUSTER SETSLOT: start or stop moving `slot`, or give it to a node.
+	/// `holds_keys` tells whether this server has keys in the slot.
+	pub fn set_slot(&self, slot: u16, action: SetSlot, holds_keys: bool) -> Result<(), String> {
+		let mut state = self.state.lock().unwrap();
+		match action {
+			SetSlot::Migrating(id) => {
+				if !state.serves(slot) {
+					return Err(format!("ERR I'm not the owner of hash slot {}", slot));
+				}
+				if !state.knows(&id) {
+					return Err(format!("ERR I don't know about node {}", id));
+				}
+				state.migrating.insert(slot, id);
+			}
+			SetSlot::Importing(id) => {
+				if state.serves(slot) {
+					return Err(format!("ERR I'm already the owner of hash slot {}", slot));
+				}
+				if !state.knows(&id) {
+					return Err(format!("ERR I don't know about node {}", id));
+				}
+				state.importing.insert(slot, id);
+			}
+			SetSlot::Stable => {
+				state.migrating.remove(&slot);
+				state.importing.remove(&slot);
+			}
+			SetSlot::Node(id) => {
+				if !state.knows(&id) {
+					return Err(format!("ERR Unknown node {}", id));
+				}
+				if state.serves(slot) && id != state.myself && holds_keys {
+					return Err(format!(
+						"ERR Can't assign hashslot {} to a different node while I still hold keys for this hash slot.",
+						slot
+					));
+				}
+				if !holds_keys {
+					state.migrating.remove(&slot);
+				}
+				// The import is over: take a new epoch, so this claim on the
+				// slot wins over the one of the node it came from.
+				if id == state.myself && state.importing.remove(&slot).is_some() {
+					state.bump_epoch();
+				}
+				state.slots[slot as usize] = Some(id);
+			}
+		}
+		self.mark_dirty();
+		Ok(())
+	}
+
+	/// CLUSTER MEET: start a handshake with the node whose bus listens on
+	/// `ip:cport`.
+	pub fn meet(&self, ip: &str, port: u16, cport: u16) -> Result<(), String> {
+		let ip: IpAddr = ip
+			.parse()
+			.map_err(|_| format!("ERR Invalid node address specified: {}:{}", ip, port))?;
+		self.state
+			.lock()
+			.unwrap()
+			.start_handshake(ip.to_string(), port, cport);
+		Ok(())
+	}
+
+	/// Set the epoch of a new node, so nodes created together do not start
+	/// out with the same one.
+	pub fn set_config_epoch(&self, epoch: u64) -> Result<(), String> {
+		let mut state = self.state.lock().unwrap();
+		if state.nodes.len() > 1 {
+			return Err(
+				"ERR The user can assign a config epoch only when the node does not know any other node."
+					.to_string(),
+			);
+		}
+		if state.myself().config_epoch != 0 {
+			return Err("ERR Node config epoch is already non-zero".to_string());
+		}
+		state.myself_mut().config_epoch = epoch;
+		state.current_epoch = state.current_epoch.max(epoch);
+		self.mark_dirty();
+		Ok(())
+	}
+
+	/// CLUSTER BUMPEPOCH.
+	pub fn bump_epoch(&self) -> (bool, u64) {
+		let bumped = self.state.lock().unwrap().bump_epoch();
+		if bumped.0 {
+			self.mark_dirty();
+		}
+		bumped
+	}
+
+	/// CLUSTER REPLICATE: make this server a replica of the primary `id`.
+	/// `holds_keys` tells whether this server has keys.
+	pub fn replicate(&self, id: &str, holds_keys: bool) -> Result<(), String> {
+		let mut state = self.state.lock().unwrap();
+		if !state.knows(id) {
+			return Err(format!("ERR Unknown node {}", id));
+		}
+		if id == state.myself {
+			return Err("ERR Can't replicate myself".to_string());
+		}
+		if state.nodes[id].primary.is_some() {
+			return Err("ERR I can only replicate a master, not a replica.".to_string());
+		}
+		if state.myself().primary.is_none()
+			&& (state.slots_of(&state.myself).next().is_some() || holds_keys)
+		{
+			return Err(
+				"ERR To set a master the node must be empty and without assigned slots."
+					.to_string(),
+			);
+		}
+		state.set_primary(id);
+		self.mark_dirty();
+		Ok(())
+	}
+
+	/// CLUSTER FAILOVER: take the place of the primary of this replica.
+	pub fn failover(&self, mode: FailoverMode) -> Result<(), String> {
+		let mut state = self.state.lock().unwrap();
+		let Some(primary) = state.myself().primary.clone() else {
+			return Err("ERR You should send CLUSTER FAILOVER to a replica".to_string());
+		};
+		let Some(node) = state.nodes.get(&primary) else {
+			return Err("ERR I'm a replica but my master is unknown to me".to_string());
+		};
+		if mode == FailoverMode::Default && (node.fail.is_some() || !node.is_connected()) {
+			return Err(
+				"ERR Master is down or failed, please use CLUSTER FAILOVER FORCE".to_string(),
+			);
+		}
+		if mode == FailoverMode::Takeover {
+			info!("Taking over the slots of primary {}", primary);
+			state.take_over();
+			self.mark_dirty();
+			return Ok(());
+		}
+		info!("Starting a manual failover of primary {}", primary);
+		let force = mode == FailoverMode::Force;
+		state.election = None;
+		state.manual_failover = Some(ManualFailover {
+			deadline: now_ms() + MANUAL_FAILOVER_TIMEOUT_MS,
+			requested: force,
+			primary_offset: None,
+			force,
+		});
+		Ok(())
+	}
+
+	/// CLUSTER FORGET: remove `id` from the nodes this server knows.
+	pub fn forget(&self, id: &str) -> Result<(), String> {
+		let mut state = self.state.lock().unwrap();
+		if id == state.myself {
+			return Err("ERR I tried hard but I can't forget myself...".to_string());
+		}
+		if !state.knows(id) {
+			return Err(format!("ERR Unknown node {}", id));
+		}
+		if state.myself().primary.as_deref() == Some(id) {
+			return Err("ERR Can't forget my master!".to_string());
+		}
+		state.forget(id, now_ms(), FORGET_TTL_MS);
+		self.mark_dirty();
+		Ok(())
+	}
+
+	/// CLUSTER REPLICAS: the CLUSTER NODES lines of the replicas of `id`.
+	pub fn replicas(&self, id: &str) -> Result<Vec<String>, String> {
+		let state = self.state.lock().unwrap();
+		if !state.knows(id) {
+			return Err(format!("ERR Unknown node {}", id));
+		}
+		if state.nodes[id].primary.is_some() {
+			return Err("ERR The specified node is not a master".to_string());
+		}
+		Ok(state
+			.replicas_of(id)
+			.into_iter()
+			.map(|node| state.describe(node))
+			.collect())
+	}
+
+	/// CLUSTER COUNT-FAILURE-REPORTS: how many primaries suspect `id` of
+	/// failing.
+	pub fn count_failure_reports(&self, id: &str) -> Result<usize, String> {
+		let mut state = self.state.lock().unwrap();
+		if !state.knows(id) {
+			return Err(format!("ERR Unknown node {}", id));
+		}
+		Ok(state.failure_reports(id, now_ms(), server_config!(cluster_node_timeout)))
+	}
+
+	/// Replicate from the primary this server follows, or stop replicating
+	/// once it is a primary itself.
+	fn sync_replication(&self, storage: &Storage) {
+		let (is_replica, primary) = {
+			let state = self.state.lock().unwrap();
+			let primary = state.myself().primary.as_ref();
+			(
+				primary.is_some(),
+				primary
+					.and_then(|id| state.nodes.get(id))
+					.map(|node| (node.ip.clone(), node.port)),
+			)
+		};
+		let replication = GCTX!(replication);
+		match primary {
+			Some((ip, port)) => {
+				if !replication.is_replica_of(&ip, port) {
+					replication.replicate_from(ip, port, storage.clone());
+				}
+			}
+			None if !is_replica && replication.is_replica() => {
+				replication.stop_replicating();
+			}
+			None => {}
+		}
+	}
+}
+
+fn addr_of(node: &Node) -> NodeAddr {
+	NodeAddr {
+		id: node.id.clone(),
+		ip: node.ip.clone(),
+		port: node.port,
+	}
+}
+
+/// Refuse a command whose keys do not all hash to one slot, or whose slot
+/// this server does not serve, with the error that tells the client where
+/// to send it. `cmds` are the commands of one request: a command, or the
+/// commands EXEC runs. `asking` tells whether the client sent ASKING, and
+/// `readonly` whether it sent READONLY, which lets a replica serve reads.
+///
+/// While a slot is being moved, its owner runs the commands whose keys it
+/// still has and asks for the others to be sent to the importing node,
+/// which runs them after ASKING. A command with several keys, only some of
+/// which were moved, is refused with TRYAGAIN until they all were.
+pub async fn check<'a>(
+	storage: &Storage,
+	cmds: impl IntoIterator<Item = (&'a str, &'a [Bytes])>,
+	asking: bool,
+	readonly: bool,
+) -> Result<(), String> {
+	if !server_config!(cluster_enabled) {
+		return Ok(());
+	}
+	let table = GCTX!(cmd_table);
+	let mut slot = None;
+	let mut keys = Vec::new();
+	let mut migrate = false;
+	let mut writes = false;
+	let mut asking = asking;
+	for (name, args) in cmds {
+		// Unknown commands fail on their own.
+		if table.get_cmd(name).is_none() {
+			continue;
+		}
+		migrate |= name == "MIGRATE";
+		writes |= table.is_write(name);
+		asking |= name == "RESTORE-ASKING";
+		for key in acl::command_keys(name, args) {
+			let key_slot = key_hash_slot(key);
+			match slot {
+				Some(slot) if slot != key_slot => return Err(CROSSSLOT.to_string()),
+				_ => slot = Some(key_slot),
+			}
+			keys.push(key.clone());
+		}
+	}
+	let Some(slot) = slot else {
+		return Ok(());
+	};
+	match GCTX!(cluster).route(slot, readonly && !writes)? {
+		Route::Serve => Ok(()),
+		// MIGRATE is how the keys of a slot being moved get moved.
+		_ if migrate => Ok(()),
+		Route::Migrating(ask) => {
+			let found = count_existing(storage, &keys).await?;
+			if found == keys.len() {
+				Ok(())
+			} else if keys.len() > 1 && found > 0 {
+				Err(TRYAGAIN.to_string())
+			} else {
+				Err(ask)
+			}
+		}
+		Route::Importing(moved) if !asking => Err(moved),
+		Route::Importing(_) => {
+			if keys.len() > 1 && count_existing(storage, &keys).await? < keys.len() {
+				Err(TRYAGAIN.to_string())
+			} else {
+				Ok(())
+			}
+		}
+	}
+}
+
+async fn count_existing(storage: &Storage, keys: &[Bytes]) -> Result<usize, String> {
+	storage
+		.exists_many(keys.iter().cloned())
+		.await
+		.map(|found| found as usize)
+		.map_err(|e| format!("ERR {}", e))
+}
+
+/// The port of the cluster bus: `cluster_port`, or the client port plus
+/// 10000.
+pub fn bus_port() -> u16 {
+	match server_config!(cluster_port) {
+		0 => server_config!(port).saturating_add(10000),
+		port => port,
+	}
+}
+
+/// The address nodes reach this server at until one tells it otherwise:
+/// the first address it binds to, unless that is a wildcard.
+fn default_ip() -> String {
+	server_config!(host)
+		.with_port(0)
+		.into_iter()
+		.map(|addr| addr.ip())
+		.find(|ip| !ip.is_unspecified())
+		.map(|ip| ip.to_string())
+		.unwrap_or_default()
+}
+
+/// Fields of the Cluster section of INFO.
+pub fn info_fields() -> Vec<(String, String)> {
+	vec![(
+		"cluster_enabled".to_string(),
+		if server_config!(cluster_enabled) {
+			"1"
+		} else {
+			"0"
+		}
+		.to_string(),
+	)]
+}
+
+/// The mode HELLO reports.
+pub fn mode() -> &'static str {
+	if server_config!(cluster_enabled) {
+		"cluster"
+	} else {
+		"standalone"
+	}
+}
+
+/// A new node ID: 40 random hex digits.
+fn new_node_id() -> String {
+	(0..20)
+		.map(|_| format!("{:02x}", rand::random::<u8>()))
+		.collect()
+}
+
+fn now_ms() -> u64 {
+	chrono::Utc::now().timestamp_millis().max(0) as u64
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+
+	fn state_with_nodes() -> ClusterState {
+		let mut myself = Node::new("a".repeat(40), "127.0.0.1".to_string(), 7000, 17000);
+		myself.config_epoch = 1;
+		let mut state = ClusterState::new(myself);
+		let mut other = Node::new("b".repeat(40), "127.0.0.1".to_string(), 7001, 17001);
+		other.config_epoch = 2;
+		state.nodes.insert(other.id.clone(), other);
+		for slot in 0..=100 {
+			state.slots[slot] = Some("a".repeat(40));
+		}
+		state.slots[200] = Some("a".repeat(40));
+		for slot in 101..=199 {
+			state.slots[slot] = Some("b".repeat(40));
+		}
+		state.current_epoch = 2;
+		state
+	}
+
+	#[test]
+	fn test_describe() {
+		let state = state_with_nodes();
+		assert_eq!(
+			state.describe(state.myself()),
+			format!(
+				"{} 127.0.0.1:7000@17000 myself,master - 0 0 1 connected 0-100 200",
+				"a".repeat(40)
+			)
+		);
+		assert_eq!(
+			state.describe(&state.nodes[&"b".repeat(40)]),
+			format!(
+				"{} 127.0.0.1:7001@17001 master - 0 0 2 disconnected 101-199",
+				"b".repeat(40)
+			)
+		);
+	}
+
+	#[test]
+	fn test_describe_replica() {
+		let mut state = state_with_nodes();
+		let mut replica = Node::new("c".repeat(40), "127.0.0.1".to_string(), 7002, 17002);
+		replica.primary = Some("b".repeat(40));
+		replica.config_epoch = 2;
+		replica.fail = Some(1);
+		state.nodes.insert(replica.id.clone(), replica);
+		state.nodes.get_mut(&"b".repeat(40)).unwrap().pfail = true;
+		assert_eq!(
+			state.describe(&state.nodes[&"c".repeat(40)]),
+			format!(
+				"{} 127.0.0.1:7002@17002 slave,fail {} 0 0 2 disconnected",
+				"c".repeat(40),
+				"b".repeat(40)
+			)
+		);
+		assert!(
+			state
+				.describe(&state.nodes[&"b".repeat(40)])
+				.contains(" master,fail? - ")
+		);
+	}
+
+	#[test]
+	fn test_config_roundtrip() {
+		let mut state = state_with_nodes();
+		state.last_vote_epoch = 1;
+		let mut replica = Node::new("c".repeat(40), "127.0.0.1".to_string(), 7002, 17002);
+		replica.primary = Some("a".repeat(40));
+		state.nodes.insert(replica.id.clone(), replica);
+		let config = state.encode_config();
+		assert!(config.ends_with("vars currentEpoch 2 lastVoteEpoch 1\n"));
+
+		let decoded = ClusterState::decode_config(&config).unwrap();
+		assert_eq!(decoded.myself, state.myself);
+		assert_eq!(decoded.current_epoch, 2);
+		assert_eq!(decoded.last_vote_epoch, 1);
+		assert_eq!(decoded.slots, state.slots);
+		assert_eq!(decoded.nodes.len(), 3);
+		assert_eq!(decoded.nodes[&"b".repeat(40)].config_epoch, 2);
+		assert_eq!(decoded.nodes[&"b".repeat(40)].cport, 17001);
+		assert_eq!(decoded.nodes[&"b".repeat(40)].primary, None);
+		assert_eq!(decoded.nodes[&"c".repeat(40)].primary, Some("a".repeat(40)));
+	}
+
+	#[test]
+	fn test_config_keeps_moving_slots() {
+		let mut state = state_with_nodes();
+		state.migrating.insert(0, "b".repeat(40));
+		state.importing.insert(150, "b".repeat(40));
+		assert!(state.describe(state.myself()).ends_with(&format!(
+			" 0-100 200 [0->-{}] [150-<-{}]",
+			"b".repeat(40),
+			"b".repeat(40)
+		)));
+
+		let decoded = ClusterState::decode_config(&state.encode_config()).unwrap();
+		assert_eq!(decoded.slots, state.slots);
+		assert_eq!(decoded.migrating, state.migrating);
+		assert_eq!(decoded.importing, state.importing);
+	}
+
+	#[test]
+	fn test_set_slot() {
+		let cluster = Cluster::new();
+		*cluster.state.lock().unwrap() = state_with_nodes();
+		let (a, b) = ("a".repeat(40), "b".repeat(40));
+		let migrating = |id: &str| SetSlot::Migrating(id.to_string());
+		let importing = |id: &str| SetSlot::Importing(id.to_string());
+		let node = |id: &str| SetSlot::Node(id.to_string());
+
+		assert_eq!(
+			cluster.set_slot(150, migrating(&b), false),
+			Err("ERR I'm not the owner of hash slot 150".to_string())
+		);
+		assert_eq!(
+			cluster.set_slot(0, importing(&b), false),
+			Err("ERR I'm already the owner of hash slot 0".to_string())
+		);
+		assert_eq!(
+			cluster.set_slot(0, migrating(&"c".repeat(40)), false),
+			Err(format!("ERR I don't know about node {}", "c".repeat(40)))
+		);
+
+		// Moving slot 0 out: it is handed over once its keys are gone.
+		assert_eq!(cluster.set_slot(0, migrating(&b), false), Ok(()));
+		assert!(cluster.set_slot(0, node(&b), true).is_err());
+		assert_eq!(cluster.set_slot(0, node(&b), false), Ok(()));
+		{
+			let state = cluster.state.lock().unwrap();
+			assert!(state.migrating.is_empty());
+			assert_eq!(state.slots[0], Some(b.clone()));
+		}
+
+		// Moving slot 150 in: taking it bumps the epoch.
+		assert_eq!(cluster.set_slot(150, importing(&b), false), Ok(()));
+		assert_eq!(cluster.set_slot(150, node(&a), false), Ok(()));
+		{
+			let state = cluster.state.lock().unwrap();
+			assert!(state.importing.is_empty());
+			assert_eq!(state.slots[150], Some(a.clone()));
+			assert_eq!(state.myself().config_epoch, 3);
+		}
+
+		assert_eq!(cluster.set_slot(150, migrating(&b), false), Ok(()));
+		assert_eq!(cluster.set_slot(150, SetSlot::Stable, false), Ok(()));
+		assert!(cluster.state.lock().unwrap().migrating.is_empty());
+	}
+
+	#[test]
+	fn test_config_leaves_out_handshakes() {
+		let mut state = state_with_nodes();
+		let mut node = Node::new("c".repeat(40), "127.0.0.1".to_string(), 7002, 17002);
+		node.handshake = true;
+		state.nodes.insert(node.id.clone(), node);
+		let decoded = ClusterState::decode_config(&state.encode_config()).unwrap();
+		assert_eq!(decoded.nodes.len(), 2);
+	}
+
+	#[test]
+	fn test_decode_config_errors() {
+		assert!(ClusterState::decode_config("vars currentEpoch 0\n").is_err());
+		assert!(ClusterState::decode_config("id addr\n").is_err());
+		assert!(
+			ClusterState::decode_config(&format!(
+				"{} 127.0.0.1:7000@17000 myself,master - 0 0 0 connected 0-16384\n",
+				"a".repeat(40)
+			))
+			.is_err()
+		);
+	}
+
+	#[test]
+	fn test_parse_address() {
+		assert_eq!(
+			parse_address("127.0.0.1:7000@17000"),
+			Some(("127.0.0.1".to_string(), 7000, 17000))
+		);
+		assert_eq!(
+			parse_address("::1:7000@17000,host"),
+			Some(("::1".to_string(), 7000, 17000))
+		);
+		assert_eq!(
+			parse_address(":7000@17000"),
+			Some(("".to_string(), 7000, 17000))
+		);
+		assert_eq!(parse_address("127.0.0.1:7000"), None);
+	}
+}
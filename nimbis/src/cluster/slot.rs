@@ -0,0 +1,148 @@
+//! Hash slots of keys.
+
+/// The number of hash slots the keyspace is split into.
+pub const CLUSTER_SLOTS: usize = 16384;
+
+/// Bytes of a bitmap with one bit per slot.
+pub const SLOT_BITMAP_LEN: usize = CLUSTER_SLOTS / 8;
+
+/// CRC16/XMODEM lookup table, the CRC Redis Cluster hashes keys with.
+const CRC16_TABLE: [u16; 256] = crc16_table();
+
+const fn crc16_table() -> [u16; 256] {
+	let mut table = [0u16; 256];
+	let mut i = 0;
+	while i < 256 {
+		let mut crc = (i as u16) << 8;
+		let mut bit = 0;
+		while bit < 8 {
+			crc = if crc & 0x8000 != 0 {
+				(crc << 1) ^ 0x1021
+			} else {
+				crc << 1
+			};
+			bit += 1;
+		}
+		table[i] = crc;
+		i += 1;
+	}
+	table
+}
+
+fn crc16(data: &[u8]) -> u16 {
+	data.iter().fold(0, |crc, &byte| {
+		(crc << 8) ^ CRC16_TABLE[((crc >> 8) as u8 ^ byte) as usize]
+	})
+}
+
+/// The slot of `key`. Only the part between the first `{` and the next `}`
+/// is hashed if it is not empty, so keys sharing such a hash tag share a
+/// slot.
+pub fn key_hash_slot(key: &[u8]) -> u16 {
+	let hashed = key
+		.iter()
+		.position(|&byte| byte == b'{')
+		.and_then(|open| {
+			let rest = &key[open + 1..];
+			let close = rest.iter().position(|&byte| byte == b'}')?;
+			(close > 0).then(|| &rest[..close])
+		})
+		.unwrap_or(key);
+	crc16(hashed) & (CLUSTER_SLOTS as u16 - 1)
+}
+
+/// Parse a slot number the way CLUSTER subcommands take it.
+pub fn parse_slot(arg: &[u8]) -> Result<u16, String> {
+	std::str::from_utf8(arg)
+		.ok()
+		.and_then(|arg| arg.parse::<u16>().ok())
+		.filter(|&slot| (slot as usize) < CLUSTER_SLOTS)
+		.ok_or_else(|| "ERR Invalid or out of range slot".to_string())
+}
+
+/// Group ascending `slots` into inclusive ranges of consecutive slots.
+pub fn slot_ranges(slots: impl IntoIterator<Item = u16>) -> Vec<(u16, u16)> {
+	let mut ranges: Vec<(u16, u16)> = Vec::new();
+	for slot in slots {
+		match ranges.last_mut() {
+			Some((_, end)) if *end + 1 == slot => *end = slot,
+			_ => ranges.push((slot, slot)),
+		}
+	}
+	ranges
+}
+
+/// A bitmap of `slots`, one bit per slot.
+pub fn slot_bitmap(slots: impl IntoIterator<Item = u16>) -> Vec<u8> {
+	let mut bitmap = vec![0u8; SLOT_BITMAP_LEN];
+	for slot in slots {
+		bitmap[slot as usize / 8] |= 1 << (slot % 8);
+	}
+	bitmap
+}
+
+/// The slots set in `bitmap`.
+pub fn bitmap_slots(bitmap: &[u8]) -> impl Iterator<Item = u16> + '_ {
+	(0..CLUSTER_SLOTS.min(bitmap.len() * 8))
+		.filter(|&slot| bitmap[slot / 8] & (1 << (slot % 8)) != 0)
+		.map(|slot| slot as u16)
+}
+
+#[cfg(test)]
+mod tests {
+	use rstest::rstest;
+
+	use super::*;
+
+	#[test]
+	fn test_crc16() {
+		assert_eq!(crc16(b"123456789"), 0x31c3);
+		assert_eq!(crc16(b""), 0);
+	}
+
+	#[rstest]
+	#[case(b"foo", 12182)]
+	#[case(b"bar", 5061)]
+	#[case(b"{user1000}.following", 3443)]
+	#[case(b"{user1000}.followers", 3443)]
+	fn test_key_hash_slot(#[case] key: &[u8], #[case] slot: u16) {
+		assert_eq!(key_hash_slot(key), slot);
+	}
+
+	#[test]
+	fn test_key_hash_slot_hash_tags() {
+		// An empty tag hashes the whole key.
+		assert_eq!(key_hash_slot(b"foo{}{bar}"), crc16(b"foo{}{bar}") & 16383);
+		// Only the first tag counts, up to the first closing brace.
+		assert_eq!(key_hash_slot(b"foo{{bar}}zap"), key_hash_slot(b"{bar"));
+		assert_eq!(key_hash_slot(b"foo{bar}{zap}"), key_hash_slot(b"bar"));
+		// Without a closing brace there is no tag.
+		assert_eq!(key_hash_slot(b"foo{bar"), crc16(b"foo{bar") & 16383);
+	}
+
+	#[test]
+	fn test_parse_slot() {
+		assert_eq!(parse_slot(b"0"), Ok(0));
+		assert_eq!(parse_slot(b"16383"), Ok(16383));
+		assert!(parse_slot(b"16384").is_err());
+		assert!(parse_slot(b"-1").is_err());
+		assert!(parse_slot(b"x").is_err());
+	}
+
+	#[test]
+	fn test_slot_ranges() {
+		assert_eq!(
+			slot_ranges([0, 1, 2, 5, 7, 8]),
+			vec![(0, 2), (5, 5), (7, 8)]
+		);
+		assert!(slot_ranges([]).is_empty());
+	}
+
+	#[test]
+	fn test_slot_bitmap_roundtrip() {
+		let slots = vec![0, 7, 8, 1000, 16383];
+		let bitmap = slot_bitmap(slots.iter().copied());
+		assert_eq!(bitmap.len(), SLOT_BITMAP_LEN);
+		assert_eq!(bitmap_slots(&bitmap).collect::<Vec<_>>(), slots);
+	}
+}
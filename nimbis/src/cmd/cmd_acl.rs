@@ -0,0 +1,513 @@
+use async_trait::async_trait;
+use bytes::Bytes;
+use log::error;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+
+use super::Cmd;
+use super::CmdContext;
+use super::CmdMeta;
+use super::SubCmds;
+use super::utils;
+use crate::GCTX;
+use crate::acl;
+use crate::acllog;
+use crate::server_config;
+
+const HELP: &[&str] = &[
+	"CAT [<category>]",
+	"    List all commands that belong to <category>, or all command categories",
+	"    when no category is specified.",
+	"DELUSER <username> [<username> ...]",
+	"    Delete a list of users.",
+	"GETUSER <username>",
+	"    Get the user's details.",
+	"LIST",
+	"    Show users details in config file format.",
+	"LOAD",
+	"    Reload users from the ACL file.",
+	"LOG [<count> | RESET]",
+	"    Show the ACL log entries, newest first, or reset the log.",
+	"SAVE",
+	"    Save the current config to the ACL file.",
+	"SETUSER <username> <attribute> [<attribute> ...]",
+	"    Create or modify a user with the specified attributes.",
+	"USERS",
+	"    List all the registered usernames.",
+	"WHOAMI",
+	"    Return the current connection username.",
+];
+
+/// Log out clients of users that no longer exist.
+fn deauthenticate_removed() {
+	let users = GCTX!(acl).usernames();
+	GCTX!(client_sessions).deauthenticate_removed(|user| users.iter().any(|name| name == user));
+}
+
+/// AUTH command implementation.
+pub struct AuthCmd {
+	meta: CmdMeta,
+}
+
+impl Default for AuthCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "AUTH".to_string(),
+				arity: -2, // AUTH [username] password
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for AuthCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, args: &[Bytes], ctx: &CmdContext) -> RespValue {
+		let (user, password) = match args {
+			[password] => {
+				if GCTX!(acl).default_needs_no_auth() {
+					return RespValue::error(
+						"ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?",
+					);
+				}
+				(acl::DEFAULT_USER.to_string(), password)
+			}
+			[user, password] => (String::from_utf8_lossy(user).into_owned(), password),
+			_ => return RespValue::error("ERR syntax error"),
+		};
+		match acl::authenticate(ctx.client_id, user, password) {
+			Ok(()) => RespValue::simple_string("OK"),
+			Err(err) => RespValue::error(err),
+		}
+	}
+}
+
+/// ACL command implementation.
+pub struct AclCmd {
+	meta: CmdMeta,
+	sub_cmds: SubCmds,
+}
+
+impl Default for AclCmd {
+	fn default() -> Self {
+		let mut sub_cmds = SubCmds::new("ACL", HELP);
+
+		sub_cmds.insert("SETUSER", Box::new(AclSetUserCmd::default()));
+		sub_cmds.insert("GETUSER", Box::new(AclGetUserCmd::default()));
+		sub_cmds.insert("DELUSER", Box::new(AclDelUserCmd::default()));
+		sub_cmds.insert("LIST", Box::new(AclListCmd::default()));
+		sub_cmds.insert("USERS", Box::new(AclUsersCmd::default()));
+		sub_cmds.insert("WHOAMI", Box::new(AclWhoAmICmd::default()));
+		sub_cmds.insert("CAT", Box::new(AclCatCmd::default()));
+		sub_cmds.insert("LOG", Box::new(AclLogCmd::default()));
+		sub_cmds.insert("LOAD", Box::new(AclLoadCmd::default()));
+		sub_cmds.insert("SAVE", Box::new(AclSaveCmd::default()));
+
+		Self {
+			meta: CmdMeta {
+				name: "ACL".to_string(),
+				arity: -2,
+			},
+			sub_cmds,
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for AclCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	fn sub_cmds(&self) -> Option<&SubCmds> {
+		Some(&self.sub_cmds)
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], ctx: &CmdContext) -> RespValue {
+		self.sub_cmds.dispatch(storage, args, ctx).await
+	}
+}
+
+pub struct AclSetUserCmd {
+	meta: CmdMeta,
+}
+
+impl Default for AclSetUserCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "SETUSER".to_string(),
+				arity: -2,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for AclSetUserCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let name = String::from_utf8_lossy(&args[0]);
+		match GCTX!(acl).set_user(&name, &args[1..], GCTX!(cmd_table)) {
+			Ok(()) => RespValue::simple_string("OK"),
+			Err(err) => RespValue::error(err),
+		}
+	}
+}
+
+pub struct AclGetUserCmd {
+	meta: CmdMeta,
+}
+
+impl Default for AclGetUserCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "GETUSER".to_string(),
+				arity: 2,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for AclGetUserCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let Some(user) = GCTX!(acl).get_user(&String::from_utf8_lossy(&args[0])) else {
+			return RespValue::Null;
+		};
+		let patterns = |prefix: &str, patterns: &[Bytes]| {
+			patterns
+				.iter()
+				.map(|pattern| format!("{}{}", prefix, String::from_utf8_lossy(pattern)))
+				.collect::<Vec<_>>()
+				.join(" ")
+		};
+		RespValue::array(vec![
+			RespValue::bulk_string("flags"),
+			RespValue::array(user.flags().into_iter().map(RespValue::bulk_string)),
+			RespValue::bulk_string("passwords"),
+			RespValue::array(
+				user.passwords()
+					.map(|hash| RespValue::bulk_string(Bytes::from(hash.clone()))),
+			),
+			RespValue::bulk_string("commands"),
+			RespValue::bulk_string(Bytes::from(user.command_rules())),
+			RespValue::bulk_string("keys"),
+			RespValue::bulk_string(Bytes::from(patterns("~", user.key_patterns()))),
+			RespValue::bulk_string("channels"),
+			RespValue::bulk_string(Bytes::from(patterns("&", user.channel_patterns()))),
+			RespValue::bulk_string("selectors"),
+			RespValue::array(Vec::<RespValue>::new()),
+		])
+	}
+}
+
+pub struct AclDelUserCmd {
+	meta: CmdMeta,
+}
+
+impl Default for AclDelUserCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "DELUSER".to_string(),
+				arity: -2,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for AclDelUserCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let names = args
+			.iter()
+			.map(|name| String::from_utf8_lossy(name).into_owned())
+			.collect::<Vec<_>>();
+		match GCTX!(acl).del_users(&names) {
+			Ok(deleted) => {
+				deauthenticate_removed();
+				RespValue::integer(deleted)
+			}
+			Err(err) => RespValue::error(err),
+		}
+	}
+}
+
+pub struct AclListCmd {
+	meta: CmdMeta,
+}
+
+impl Default for AclListCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "LIST".to_string(),
+				arity: 1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for AclListCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, _args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		RespValue::array(
+			GCTX!(acl)
+				.list()
+				.into_iter()
+				.map(|line| RespValue::bulk_string(Bytes::from(line))),
+		)
+	}
+}
+
+pub struct AclUsersCmd {
+	meta: CmdMeta,
+}
+
+impl Default for AclUsersCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "USERS".to_string(),
+				arity: 1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for AclUsersCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, _args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		RespValue::array(
+			GCTX!(acl)
+				.usernames()
+				.into_iter()
+				.map(|name| RespValue::bulk_string(Bytes::from(name))),
+		)
+	}
+}
+
+pub struct AclWhoAmICmd {
+	meta: CmdMeta,
+}
+
+impl Default for AclWhoAmICmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "WHOAMI".to_string(),
+				arity: 1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for AclWhoAmICmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, _args: &[Bytes], ctx: &CmdContext) -> RespValue {
+		match GCTX!(client_sessions).get_user(ctx.client_id) {
+			Some(user) => RespValue::bulk_string(Bytes::from(user)),
+			None => RespValue::error("NOAUTH Authentication required."),
+		}
+	}
+}
+
+pub struct AclCatCmd {
+	meta: CmdMeta,
+}
+
+impl Default for AclCatCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "CAT".to_string(),
+				arity: -1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for AclCatCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		match args {
+			[] => RespValue::array(acl::categories().into_iter().map(RespValue::bulk_string)),
+			[category] => {
+				let category = String::from_utf8_lossy(category).to_lowercase();
+				match acl::category_commands(GCTX!(cmd_table), &category) {
+					Some(names) => RespValue::array(
+						names
+							.into_iter()
+							.map(|name| RespValue::bulk_string(Bytes::from(name))),
+					),
+					None => RespValue::error(format!("ERR Unknown category '{}'", category)),
+				}
+			}
+			_ => RespValue::error("ERR wrong number of arguments for 'acl|cat' command"),
+		}
+	}
+}
+
+pub struct AclLogCmd {
+	meta: CmdMeta,
+}
+
+impl Default for AclLogCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "LOG".to_string(),
+				arity: -1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for AclLogCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let count = match args {
+			[] => None,
+			[arg] if arg.eq_ignore_ascii_case(b"RESET") => {
+				GCTX!(acl_log).reset();
+				return RespValue::simple_string("OK");
+			}
+			[arg] => match utils::parse_int::<usize>(arg) {
+				Ok(count) => Some(count),
+				Err(err) => return RespValue::error(err),
+			},
+			_ => return RespValue::error("ERR wrong number of arguments for 'acl|log' command"),
+		};
+		let now_ms = acllog::now_ms();
+		RespValue::array(
+			GCTX!(acl_log)
+				.get(count)
+				.iter()
+				.map(|entry| entry.to_resp(now_ms)),
+		)
+	}
+}
+
+pub struct AclLoadCmd {
+	meta: CmdMeta,
+}
+
+impl Default for AclLoadCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "LOAD".to_string(),
+				arity: 1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for AclLoadCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, _args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let path = server_config!(aclfile).clone();
+		if path.is_empty() {
+			return RespValue::error("ERR This instance is not configured to use an ACL file");
+		}
+		let text = match tokio::fs::read_to_string(&path).await {
+			Ok(text) => text,
+			Err(e) => {
+				return RespValue::error(format!(
+					"ERR Error loading ACLs, opening file '{}': {}",
+					path, e
+				));
+			}
+		};
+		match GCTX!(acl).load(&text, GCTX!(cmd_table)) {
+			Ok(()) => {
+				deauthenticate_removed();
+				RespValue::simple_string("OK")
+			}
+			Err(err) => RespValue::error(err),
+		}
+	}
+}
+
+pub struct AclSaveCmd {
+	meta: CmdMeta,
+}
+
+impl Default for AclSaveCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "SAVE".to_string(),
+				arity: 1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for AclSaveCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, _args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let path = server_config!(aclfile).clone();
+		if path.is_empty() {
+			return RespValue::error("ERR This instance is not configured to use an ACL file");
+		}
+		// Write a temporary file first so a failed save keeps the old file.
+		let tmp = format!("{}.tmp", path);
+		let saved = match tokio::fs::write(&tmp, GCTX!(acl).dump()).await {
+			Ok(()) => tokio::fs::rename(&tmp, &path).await,
+			Err(e) => Err(e),
+		};
+		match saved {
+			Ok(()) => RespValue::simple_string("OK"),
+			Err(e) => {
+				error!("Failed to save ACLs to {}: {}", path, e);
+				RespValue::error(format!("ERR Error saving ACLs to '{}': {}", path, e))
+			}
+		}
+	}
+}
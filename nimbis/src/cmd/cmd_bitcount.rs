@@ -0,0 +1,104 @@
+use async_trait::async_trait;
+use bytes::Bytes;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+use nimbis_storage::storage_bitmap::BitRange;
+use nimbis_storage::storage_bitmap::BitUnit;
+
+use super::CmdContext;
+use crate::cmd::Cmd;
+use crate::cmd::CmdMeta;
+use crate::cmd::utils;
+
+pub struct BitCountCmd {
+	meta: CmdMeta,
+}
+
+impl Default for BitCountCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "BITCOUNT".to_string(),
+				// BITCOUNT key [start end [BYTE | BIT]]
+				arity: -2,
+			},
+		}
+	}
+}
+
+/// Parse `start [end [BYTE | BIT]]` of BITCOUNT and BITPOS.
+pub(super) fn parse_bit_range(args: &[Bytes]) -> Result<BitRange, String> {
+	let (start, end, unit) = match args {
+		[start] => (start, None, None),
+		[start, end] => (start, Some(end), None),
+		[start, end, unit] => (start, Some(end), Some(unit)),
+		_ => return Err("ERR syntax error".to_string()),
+	};
+
+	let unit = match unit {
+		None => BitUnit::Byte,
+		Some(unit) if unit.eq_ignore_ascii_case(b"BYTE") => BitUnit::Byte,
+		Some(unit) if unit.eq_ignore_ascii_case(b"BIT") => BitUnit::Bit,
+		Some(_) => return Err("ERR syntax error".to_string()),
+	};
+	Ok(BitRange {
+		start: utils::parse_int(start)?,
+		end: end.map(|end| utils::parse_int(end)).transpose()?,
+		unit,
+	})
+}
+
+#[async_trait]
+impl Cmd for BitCountCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let key = args[0].clone();
+		// The range needs both indexes.
+		let range = match args.len() {
+			1 => None,
+			3 | 4 => match parse_bit_range(&args[1..]) {
+				Ok(range) => Some(range),
+				Err(e) => return RespValue::error(e),
+			},
+			_ => return RespValue::error("ERR syntax error"),
+		};
+
+		match storage.bitcount(key, range).await {
+			Ok(count) => RespValue::Integer(count as i64),
+			Err(e) => RespValue::error(e.to_string()),
+		}
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+
+	#[test]
+	fn test_parse_bit_range() {
+		let args = [Bytes::from("1"), Bytes::from("-1"), Bytes::from("bit")];
+		assert_eq!(
+			parse_bit_range(&args).unwrap(),
+			BitRange {
+				start: 1,
+				end: Some(-1),
+				unit: BitUnit::Bit,
+			}
+		);
+		assert_eq!(
+			parse_bit_range(&args[..1]).unwrap(),
+			BitRange {
+				start: 1,
+				end: None,
+				unit: BitUnit::Byte,
+			}
+		);
+		assert!(
+			parse_bit_range(&[Bytes::from("0"), Bytes::from("1"), Bytes::from("BITS")]).is_err()
+		);
+		assert!(parse_bit_range(&[Bytes::from("x")]).is_err());
+	}
+}
@@ -0,0 +1,229 @@
+use async_trait::async_trait;
+use bytes::Bytes;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+use nimbis_storage::storage_bitfield::BitFieldOp;
+use nimbis_storage::storage_bitfield::BitFieldOverflow;
+use nimbis_storage::storage_bitfield::BitFieldType;
+
+use super::CmdContext;
+use crate::cmd::Cmd;
+use crate::cmd::CmdMeta;
+use crate::cmd::utils;
+
+pub struct BitFieldCmd {
+	meta: CmdMeta,
+}
+
+impl Default for BitFieldCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "BITFIELD".to_string(),
+				// BITFIELD key [GET encoding offset | [OVERFLOW <WRAP | SAT | FAIL>]
+				// <SET encoding offset value | INCRBY encoding offset increment> ...]
+				arity: -2,
+			},
+		}
+	}
+}
+
+/// Parse a field type such as `i16` or `u8`.
+fn parse_type(arg: &[u8]) -> Result<BitFieldType, String> {
+	let signed = match arg.first() {
+		Some(b'i' | b'I') => true,
+		Some(b'u' | b'U') => false,
+		_ => return Err(type_error()),
+	};
+	let bits: u8 = utils::parse_int(&arg[1..]).map_err(|_| type_error())?;
+	let max = if signed { 64 } else { 63 };
+	if bits == 0 || bits > max {
+		return Err(type_error());
+	}
+	Ok(BitFieldType { signed, bits })
+}
+
+fn type_error() -> String {
+	"ERR Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is."
+		.to_string()
+}
+
+/// Parse a field offset in bits, or in multiples of the type width with a
+/// `#` prefix.
+fn parse_offset(arg: &[u8], ty: BitFieldType) -> Result<u64, String> {
+	let offset = match arg.strip_prefix(b"#") {
+		Some(index) => utils::parse_bit_offset(index)?.checked_mul(ty.bits as u64),
+		None => Some(utils::parse_bit_offset(arg)?),
+	};
+	offset
+		.filter(|offset| *offset <= u32::MAX as u64)
+		.ok_or_else(|| "ERR bit offset is not an integer or out of range".to_string())
+}
+
+fn parse_overflow(arg: &[u8]) -> Result<BitFieldOverflow, String> {
+	match arg.to_ascii_uppercase().as_slice() {
+		b"WRAP" => Ok(BitFieldOverflow::Wrap),
+		b"SAT" => Ok(BitFieldOverflow::Sat),
+		b"FAIL" => Ok(BitFieldOverflow::Fail),
+		_ => Err("ERR Invalid OVERFLOW type specified".to_string()),
+	}
+}
+
+/// Parse the subcommands of BITFIELD, or of BITFIELD_RO when `read_only`.
+pub(super) fn parse_ops(args: &[Bytes], read_only: bool) -> Result<Vec<BitFieldOp>, String> {
+	let mut ops = Vec::new();
+	let mut overflow = BitFieldOverflow::default();
+	let mut rest = args;
+	while let Some((sub, tail)) = rest.split_first() {
+		let sub = sub.to_ascii_uppercase();
+		if read_only && sub != b"GET" {
+			return Err("ERR BITFIELD_RO only supports the GET subcommand".to_string());
+		}
+		rest = match (sub.as_slice(), tail) {
+			(b"GET", [ty, offset, tail @ ..]) => {
+				let ty = parse_type(ty)?;
+				let offset = parse_offset(offset, ty)?;
+				ops.push(BitFieldOp::Get { ty, offset });
+				tail
+			}
+			(b"SET", [ty, offset, value, tail @ ..]) => {
+				let ty = parse_type(ty)?;
+				let offset = parse_offset(offset, ty)?;
+				let value = utils::parse_int(value)?;
+				ops.push(BitFieldOp::Set {
+					ty,
+					offset,
+					value,
+					overflow,
+				});
+				tail
+			}
+			(b"INCRBY", [ty, offset, increment, tail @ ..]) => {
+				let ty = parse_type(ty)?;
+				let offset = parse_offset(offset, ty)?;
+				let increment = utils::parse_int(increment)?;
+				ops.push(BitFieldOp::IncrBy {
+					ty,
+					offset,
+					increment,
+					overflow,
+				});
+				tail
+			}
+			(b"OVERFLOW", [kind, tail @ ..]) => {
+				overflow = parse_overflow(kind)?;
+				tail
+			}
+			_ => return Err("ERR syntax error".to_string()),
+		};
+	}
+	Ok(ops)
+}
+
+/// Turn the replies of BITFIELD into an array, with nil for failed
+/// overflows.
+pub(super) fn reply(values: Vec<Option<i64>>) -> RespValue {
+	RespValue::Array(
+		values
+			.into_iter()
+			.map(|value| value.map_or(RespValue::Null, RespValue::Integer))
+			.collect(),
+	)
+}
+
+#[async_trait]
+impl Cmd for BitFieldCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let key = args[0].clone();
+		let ops = match parse_ops(&args[1..], false) {
+			Ok(ops) => ops,
+			Err(e) => return RespValue::error(e),
+		};
+
+		match storage.bitfield(key, ops).await {
+			Ok(values) => reply(values),
+			Err(e) => RespValue::error(e.to_string()),
+		}
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use rstest::rstest;
+
+	use super::*;
+
+	fn args(args: &[&'static str]) -> Vec<Bytes> {
+		args.iter().map(|arg| Bytes::from(*arg)).collect()
+	}
+
+	#[test]
+	fn test_parse_ops() {
+		let ops = parse_ops(
+			&args(&[
+				"get", "i8", "#2", "overflow", "sat", "set", "u4", "3", "20", "INCRBY", "i64", "0",
+				"-1",
+			]),
+			false,
+		)
+		.unwrap();
+		let (i8, u4, i64) = (
+			BitFieldType {
+				signed: true,
+				bits: 8,
+			},
+			BitFieldType {
+				signed: false,
+				bits: 4,
+			},
+			BitFieldType {
+				signed: true,
+				bits: 64,
+			},
+		);
+		assert_eq!(
+			ops,
+			vec![
+				BitFieldOp::Get { ty: i8, offset: 16 },
+				BitFieldOp::Set {
+					ty: u4,
+					offset: 3,
+					value: 20,
+					overflow: BitFieldOverflow::Sat,
+				},
+				BitFieldOp::IncrBy {
+					ty: i64,
+					offset: 0,
+					increment: -1,
+					overflow: BitFieldOverflow::Sat,
+				},
+			]
+		);
+	}
+
+	#[rstest]
+	#[case(&["GET", "u64", "0"], "Invalid bitfield type")]
+	#[case(&["GET", "i0", "0"], "Invalid bitfield type")]
+	#[case(&["GET", "x8", "0"], "Invalid bitfield type")]
+	#[case(&["GET", "u8", "-1"], "bit offset")]
+	#[case(&["GET", "u8", "#4294967295"], "bit offset")]
+	#[case(&["GET", "u8"], "syntax error")]
+	#[case(&["SET", "u8", "0", "x"], "not an integer")]
+	#[case(&["OVERFLOW", "BOUNCE"], "Invalid OVERFLOW type")]
+	#[case(&["DEL", "u8", "0"], "syntax error")]
+	fn test_parse_ops_errors(#[case] input: &[&'static str], #[case] expected: &str) {
+		let err = parse_ops(&args(input), false).unwrap_err();
+		assert!(err.contains(expected), "{err}");
+	}
+
+	#[test]
+	fn test_parse_ops_read_only() {
+		assert!(parse_ops(&args(&["GET", "u8", "0"]), true).is_ok());
+		let err = parse_ops(&args(&["GET", "u8", "0", "SET", "u8", "0", "1"]), true).unwrap_err();
+		assert!(err.contains("BITFIELD_RO only supports the GET subcommand"));
+	}
+}
@@ -0,0 +1,45 @@
+use async_trait::async_trait;
+use bytes::Bytes;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+
+use super::CmdContext;
+use super::cmd_bitfield;
+use crate::cmd::Cmd;
+use crate::cmd::CmdMeta;
+
+pub struct BitFieldRoCmd {
+	meta: CmdMeta,
+}
+
+impl Default for BitFieldRoCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "BITFIELD_RO".to_string(),
+				// BITFIELD_RO key [GET encoding offset [GET encoding offset ...]]
+				arity: -2,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for BitFieldRoCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let key = args[0].clone();
+		let ops = match cmd_bitfield::parse_ops(&args[1..], true) {
+			Ok(ops) => ops,
+			Err(e) => return RespValue::error(e),
+		};
+
+		match storage.bitfield_ro(key, ops).await {
+			Ok(values) => cmd_bitfield::reply(values),
+			Err(e) => RespValue::error(e.to_string()),
+		}
+	}
+}
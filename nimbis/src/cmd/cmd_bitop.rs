@@ -0,0 +1,70 @@
+use async_trait::async_trait;
+use bytes::Bytes;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+use nimbis_storage::storage_bitmap::BitOp;
+
+use super::CmdContext;
+use crate::cmd::Cmd;
+use crate::cmd::CmdMeta;
+
+pub struct BitOpCmd {
+	meta: CmdMeta,
+}
+
+impl Default for BitOpCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "BITOP".to_string(),
+				// BITOP <AND | OR | XOR | NOT> destkey key [key ...]
+				arity: -4,
+			},
+		}
+	}
+}
+
+fn parse_op(arg: &[u8]) -> Option<BitOp> {
+	match arg.to_ascii_uppercase().as_slice() {
+		b"AND" => Some(BitOp::And),
+		b"OR" => Some(BitOp::Or),
+		b"XOR" => Some(BitOp::Xor),
+		b"NOT" => Some(BitOp::Not),
+		_ => None,
+	}
+}
+
+#[async_trait]
+impl Cmd for BitOpCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let Some(op) = parse_op(&args[0]) else {
+			return RespValue::error("ERR syntax error");
+		};
+		let dest = args[1].clone();
+		let keys = args[2..].to_vec();
+		if op == BitOp::Not && keys.len() != 1 {
+			return RespValue::error("ERR BITOP NOT must be called with a single source key.");
+		}
+
+		match storage.bitop(op, dest, keys).await {
+			Ok(len) => RespValue::Integer(len as i64),
+			Err(e) => RespValue::error(e.to_string()),
+		}
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+
+	#[test]
+	fn test_parse_op() {
+		assert_eq!(parse_op(b"and"), Some(BitOp::And));
+		assert_eq!(parse_op(b"XOR"), Some(BitOp::Xor));
+		assert_eq!(parse_op(b"NAND"), None);
+	}
+}
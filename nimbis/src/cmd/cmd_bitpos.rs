@@ -0,0 +1,55 @@
+use async_trait::async_trait;
+use bytes::Bytes;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+use nimbis_storage::storage_bitmap::BitRange;
+
+use super::CmdContext;
+use super::cmd_bitcount::parse_bit_range;
+use crate::cmd::Cmd;
+use crate::cmd::CmdMeta;
+
+pub struct BitPosCmd {
+	meta: CmdMeta,
+}
+
+impl Default for BitPosCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "BITPOS".to_string(),
+				// BITPOS key bit [start [end [BYTE | BIT]]]
+				arity: -3,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for BitPosCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let key = args[0].clone();
+		let bit = match args[1].as_ref() {
+			b"0" => false,
+			b"1" => true,
+			_ => return RespValue::error("ERR The bit argument must be 1 or 0."),
+		};
+		let range = if args.len() > 2 {
+			match parse_bit_range(&args[2..]) {
+				Ok(range) => range,
+				Err(e) => return RespValue::error(e),
+			}
+		} else {
+			BitRange::default()
+		};
+
+		match storage.bitpos(key, bit, range).await {
+			Ok(pos) => RespValue::Integer(pos),
+			Err(e) => RespValue::error(e.to_string()),
+		}
+	}
+}
@@ -1,5 +1,3 @@
-use std::collections::HashMap;
-
 use async_trait::async_trait;
 use bytes::Bytes;
 use nimbis_resp::RespValue;
@@ -8,22 +6,60 @@ use nimbis_storage::Storage;
 use super::Cmd;
 use super::CmdContext;
 use super::CmdMeta;
+use super::SubCmds;
 use crate::GCTX;
+use crate::client::LibAttr;
+use crate::tracking::TrackingOptions;
+
+const HELP: &[&str] = &[
+	"CACHING (YES|NO)",
+	"    Enable/disable tracking of the keys for next command in OPTIN/OPTOUT modes.",
+	"GETREDIRECT",
+	"    Return the client ID we are redirecting to when tracking is enabled.",
+	"GETNAME",
+	"    Return the name of the current connection.",
+	"ID",
+	"    Return the ID of the current connection.",
+	"INFO",
+	"    Return information about the current client connection.",
+	"LIST",
+	"    Return information about client connections.",
+	"NO-EVICT (ON|OFF)",
+	"    Protect current client connection from eviction.",
+	"SETINFO <option> <value>",
+	"    Set client meta attr. Options are:",
+	"    * LIB-NAME: the client lib name.",
+	"    * LIB-VER: the client lib version.",
+	"SETNAME <name>",
+	"    Assign the name <name> to the current connection.",
+	"TRACKING (ON|OFF) [REDIRECT <id>] [BCAST] [PREFIX <prefix> [...]]",
+	"         [OPTIN] [OPTOUT] [NOLOOP]",
+	"    Control server assisted client side caching.",
+	"TRACKINGINFO",
+	"    Report tracking status for the current connection.",
+];
 
 /// Client command implementation.
 pub struct ClientCmd {
 	meta: CmdMeta,
-	sub_cmds: HashMap<&'static str, Box<dyn Cmd>>,
+	sub_cmds: SubCmds,
 }
 
 impl Default for ClientCmd {
 	fn default() -> Self {
-		let mut sub_cmds: HashMap<&'static str, Box<dyn Cmd>> = HashMap::new();
+		let mut sub_cmds = SubCmds::new("CLIENT", HELP);
 
 		sub_cmds.insert("ID", Box::new(ClientIdCmd::default()));
 		sub_cmds.insert("SETNAME", Box::new(ClientSetNameCmd::default()));
 		sub_cmds.insert("GETNAME", Box::new(ClientGetNameCmd::default()));
 		sub_cmds.insert("LIST", Box::new(ClientListCmd::default()));
+		sub_cmds.insert("INFO", Box::new(ClientInfoCmd::default()));
+		sub_cmds.insert("SETINFO", Box::new(ClientSetInfoCmd::default()));
+		sub_cmds.insert("TRACKING", Box::new(ClientTrackingCmd::default()));
+		sub_cmds.insert("CACHING", Box::new(ClientCachingCmd::default()));
+		sub_cmds.insert("NO-EVICT", Box::new(ClientNoEvictCmd::default()));
+		sub_cmds.insert("GETREDIRECT", Box::new(ClientGetRedirectCmd::default()));
+		sub_cmds.insert("TRACKINGINFO", Box::new(ClientTrackingInfoCmd::default()));
 
 		Self {
 			meta: CmdMeta {
@@ -41,12 +77,12 @@ impl Cmd for ClientCmd {
 		&self.meta
 	}
 
+	fn sub_cmds(&self) -> Option<&SubCmds> {
+		Some(&self.sub_cmds)
+	}
+
 	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], ctx: &CmdContext) -> RespValue {
-		let sub_cmd_name = String::from_utf8_lossy(&args[0]).to_uppercase();
-		match self.sub_cmds.get(sub_cmd_name.as_str()) {
-			Some(sub_cmd) => sub_cmd.execute(storage, &args[1..], ctx).await,
-			None => RespValue::error(format!("ERR unknown CLIENT subcommand '{}'", sub_cmd_name)),
-		}
+		self.sub_cmds.dispatch(storage, args, ctx).await
 	}
 }
 
@@ -159,16 +195,439 @@ impl Cmd for ClientListCmd {
 	async fn do_cmd(&self, _storage: &Storage, _args: &[Bytes], _ctx: &CmdContext) -> RespValue {
 		let lines = GCTX!(client_sessions)
 			.list()
-			.into_iter()
-			.map(|(client_id, name)| {
-				let name = name
-					.map(|v| String::from_utf8_lossy(&v).into_owned())
-					.unwrap_or_default();
-				format!("id={} name={}", client_id, name)
-			})
+			.iter()
+			.map(|session| session.info_line())
 			.collect::<Vec<_>>()
 			.join("\n");
 
 		RespValue::bulk_string(Bytes::from(lines))
 	}
 }
+
+pub struct ClientInfoCmd {
+	meta: CmdMeta,
+}
+
+impl Default for ClientInfoCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "INFO".to_string(),
+				arity: 1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for ClientInfoCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, _args: &[Bytes], ctx: &CmdContext) -> RespValue {
+		match GCTX!(client_sessions).get(ctx.client_id) {
+			Some(session) => RespValue::bulk_string(format!("{}\n", session.info_line())),
+			None => RespValue::error("ERR client not found"),
+		}
+	}
+}
+
+pub struct ClientSetInfoCmd {
+	meta: CmdMeta,
+}
+
+impl Default for ClientSetInfoCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "SETINFO".to_string(),
+				arity: 3,
+			},
+		}
+	}
+}
+
+impl ClientSetInfoCmd {
+	/// Parse `LIB-NAME|LIB-VER value`; an empty value clears the attribute.
+	fn parse(args: &[Bytes]) -> Result<(LibAttr, Option<Bytes>), RespValue> {
+		let (attr, field) = match args[0].to_ascii_uppercase().as_slice() {
+			b"LIB-NAME" => (LibAttr::Name, "lib-name"),
+			b"LIB-VER" => (LibAttr::Version, "lib-ver"),
+			_ => {
+				return Err(RespValue::error(format!(
+					"ERR Unrecognized option '{}'",
+					String::from_utf8_lossy(&args[0])
+				)));
+			}
+		};
+		// The values are shown in space-separated CLIENT LIST lines.
+		if !args[1].iter().all(|c| (b'!'..=b'~').contains(c)) {
+			return Err(RespValue::error(format!(
+				"ERR {} cannot contain spaces, newlines or special characters.",
+				field
+			)));
+		}
+		let value = (!args[1].is_empty()).then(|| args[1].clone());
+		Ok((attr, value))
+	}
+}
+
+#[async_trait]
+impl Cmd for ClientSetInfoCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, args: &[Bytes], ctx: &CmdContext) -> RespValue {
+		let (attr, value) = match Self::parse(args) {
+			Ok(parsed) => parsed,
+			Err(err) => return err,
+		};
+		if GCTX!(client_sessions).set_lib_info(ctx.client_id, attr, value) {
+			RespValue::simple_string("OK")
+		} else {
+			RespValue::error("ERR client not found")
+		}
+	}
+}
+
+pub struct ClientTrackingCmd {
+	meta: CmdMeta,
+}
+
+impl Default for ClientTrackingCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "TRACKING".to_string(),
+				arity: -2,
+			},
+		}
+	}
+}
+
+impl ClientTrackingCmd {
+	/// Parse `ON|OFF [REDIRECT id] [PREFIX prefix ...] [BCAST] [OPTIN]
+	/// [OPTOUT] [NOLOOP]`, returning `None` for OFF.
+	fn parse(args: &[Bytes]) -> Result<Option<TrackingOptions>, RespValue> {
+		let on = match args[0].to_ascii_uppercase().as_slice() {
+			b"ON" => true,
+			b"OFF" => false,
+			_ => return Err(RespValue::error("ERR syntax error")),
+		};
+
+		let mut options = TrackingOptions::default();
+		let mut iter = args[1..].iter();
+		while let Some(arg) = iter.next() {
+			match arg.to_ascii_uppercase().as_slice() {
+				b"REDIRECT" => {
+					let id = iter
+						.next()
+						.and_then(|id| std::str::from_utf8(id).ok())
+						.and_then(|id| id.parse::<i64>().ok())
+						.ok_or_else(|| {
+							RespValue::error("ERR value is not an integer or out of range")
+						})?;
+					options.redirect = Some(id);
+				}
+				b"PREFIX" => {
+					let prefix = iter
+						.next()
+						.ok_or_else(|| RespValue::error("ERR syntax error"))?;
+					options.prefixes.push(prefix.clone());
+				}
+				b"BCAST" => options.bcast = true,
+				b"OPTIN" => options.optin = true,
+				b"OPTOUT" => options.optout = true,
+				b"NOLOOP" => options.noloop = true,
+				_ => return Err(RespValue::error("ERR syntax error")),
+			}
+		}
+
+		if !on {
+			return Ok(None);
+		}
+		if !options.bcast && !options.prefixes.is_empty() {
+			return Err(RespValue::error(
+				"ERR PREFIX option requires BCAST mode to be enabled",
+			));
+		}
+		if options.optin && options.optout {
+			return Err(RespValue::error(
+				"ERR You can't use both OPTIN and OPTOUT options",
+			));
+		}
+		if options.bcast && (options.optin || options.optout) {
+			return Err(RespValue::error(
+				"ERR OPTIN and OPTOUT are not compatible with BCAST",
+			));
+		}
+		Ok(Some(options))
+	}
+}
+
+#[async_trait]
+impl Cmd for ClientTrackingCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, args: &[Bytes], ctx: &CmdContext) -> RespValue {
+		match Self::parse(args) {
+			Ok(Some(options)) => match GCTX!(tracking).enable(ctx.client_id, options) {
+				Ok(()) => RespValue::simple_string("OK"),
+				Err(err) => RespValue::error(err),
+			},
+			Ok(None) => {
+				GCTX!(tracking).disable(ctx.client_id);
+				RespValue::simple_string("OK")
+			}
+			Err(err) => err,
+		}
+	}
+}
+
+pub struct ClientCachingCmd {
+	meta: CmdMeta,
+}
+
+impl Default for ClientCachingCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "CACHING".to_string(),
+				arity: 2,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for ClientCachingCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, args: &[Bytes], ctx: &CmdContext) -> RespValue {
+		let caching = match args[0].to_ascii_uppercase().as_slice() {
+			b"YES" => true,
+			b"NO" => false,
+			_ => return RespValue::error("ERR syntax error"),
+		};
+
+		match GCTX!(tracking).set_caching(ctx.client_id, caching) {
+			Ok(()) => RespValue::simple_string("OK"),
+			Err(err) => RespValue::error(err),
+		}
+	}
+}
+
+pub struct ClientNoEvictCmd {
+	meta: CmdMeta,
+}
+
+impl Default for ClientNoEvictCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "NO-EVICT".to_string(),
+				arity: 2,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for ClientNoEvictCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, args: &[Bytes], ctx: &CmdContext) -> RespValue {
+		let no_evict = match args[0].to_ascii_uppercase().as_slice() {
+			b"ON" => true,
+			b"OFF" => false,
+			_ => return RespValue::error("ERR syntax error"),
+		};
+
+		if GCTX!(client_eviction).set_no_evict(ctx.client_id, no_evict) {
+			RespValue::simple_string("OK")
+		} else {
+			RespValue::error("ERR client not found")
+		}
+	}
+}
+
+pub struct ClientGetRedirectCmd {
+	meta: CmdMeta,
+}
+
+impl Default for ClientGetRedirectCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "GETREDIRECT".to_string(),
+				arity: 1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for ClientGetRedirectCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, _args: &[Bytes], ctx: &CmdContext) -> RespValue {
+		RespValue::integer(redirect_id(GCTX!(tracking).options(ctx.client_id).as_ref()))
+	}
+}
+
+/// -1 when tracking is off, 0 when invalidations are not redirected.
+fn redirect_id(options: Option<&TrackingOptions>) -> i64 {
+	options.map_or(-1, |options| options.redirect.unwrap_or(0))
+}
+
+pub struct ClientTrackingInfoCmd {
+	meta: CmdMeta,
+}
+
+impl Default for ClientTrackingInfoCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "TRACKINGINFO".to_string(),
+				arity: 1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for ClientTrackingInfoCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, _args: &[Bytes], ctx: &CmdContext) -> RespValue {
+		let options = GCTX!(tracking).options(ctx.client_id);
+		let flags = match &options {
+			None => vec!["off"],
+			Some(options) => {
+				let mut flags = vec!["on"];
+				for (set, flag) in [
+					(options.bcast, "bcast"),
+					(options.optin, "optin"),
+					(options.optout, "optout"),
+					(options.noloop, "noloop"),
+				] {
+					if set {
+						flags.push(flag);
+					}
+				}
+				flags
+			}
+		};
+		let prefixes = options
+			.as_ref()
+			.map(|options| options.prefixes.clone())
+			.unwrap_or_default();
+
+		RespValue::array([
+			RespValue::bulk_string("flags"),
+			RespValue::array(flags.into_iter().map(RespValue::bulk_string)),
+			RespValue::bulk_string("redirect"),
+			RespValue::integer(redirect_id(options.as_ref())),
+			RespValue::bulk_string("prefixes"),
+			RespValue::array(prefixes.into_iter().map(RespValue::bulk_string)),
+		])
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use bytes::Bytes;
+	use nimbis_resp::RespValue;
+
+	use super::ClientSetInfoCmd;
+	use super::ClientTrackingCmd;
+	use crate::client::LibAttr;
+	use crate::tracking::TrackingOptions;
+
+	fn args(args: &[&'static str]) -> Vec<Bytes> {
+		args.iter().map(|arg| Bytes::from(*arg)).collect()
+	}
+
+	#[test]
+	fn test_parse_tracking() {
+		assert_eq!(ClientTrackingCmd::parse(&args(&["off"])), Ok(None));
+		assert_eq!(
+			ClientTrackingCmd::parse(&args(&[
+				"on", "bcast", "prefix", "a:", "PREFIX", "b:", "noloop", "redirect", "7"
+			])),
+			Ok(Some(TrackingOptions {
+				redirect: Some(7),
+				bcast: true,
+				prefixes: vec![Bytes::from("a:"), Bytes::from("b:")],
+				noloop: true,
+				..Default::default()
+			}))
+		);
+	}
+
+	#[test]
+	fn test_parse_tracking_errors() {
+		let cases: &[(&[&'static str], &str)] = &[
+			(&["maybe"], "ERR syntax error"),
+			(
+				&["on", "prefix", "a:"],
+				"ERR PREFIX option requires BCAST mode to be enabled",
+			),
+			(
+				&["on", "optin", "optout"],
+				"ERR You can't use both OPTIN and OPTOUT options",
+			),
+			(
+				&["on", "bcast", "optin"],
+				"ERR OPTIN and OPTOUT are not compatible with BCAST",
+			),
+			(
+				&["on", "redirect", "x"],
+				"ERR value is not an integer or out of range",
+			),
+			(&["on", "prefix"], "ERR syntax error"),
+		];
+		for (input, err) in cases {
+			assert_eq!(
+				ClientTrackingCmd::parse(&args(input)),
+				Err(RespValue::error(*err)),
+				"{:?}",
+				input
+			);
+		}
+	}
+
+	#[test]
+	fn test_parse_setinfo() {
+		assert_eq!(
+			ClientSetInfoCmd::parse(&args(&["lib-name", "go-redis(,go1.24)"])),
+			Ok((LibAttr::Name, Some(Bytes::from("go-redis(,go1.24)"))))
+		);
+		assert_eq!(
+			ClientSetInfoCmd::parse(&args(&["LIB-VER", ""])),
+			Ok((LibAttr::Version, None))
+		);
+		assert_eq!(
+			ClientSetInfoCmd::parse(&args(&["lib-ver", "9 1"])),
+			Err(RespValue::error(
+				"ERR lib-ver cannot contain spaces, newlines or special characters."
+			))
+		);
+		assert_eq!(
+			ClientSetInfoCmd::parse(&args(&["lib-os", "linux"])),
+			Err(RespValue::error("ERR Unrecognized option 'lib-os'"))
+		);
+	}
+}
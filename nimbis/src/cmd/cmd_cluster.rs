@@ -0,0 +1,1077 @@
+//! CLUSTER command.
+//!
+//! With `cluster_enabled` set, CLUSTER reports and changes the slot table
+//! and the nodes this server knows (see `crate::cluster`). Without it, every
+//! subcommand but HELP fails the way it does on a Redis server with cluster
+//! support disabled, and INFO reports `cluster_enabled:0`, so cluster-aware
+//! clients fall back to a standalone connection.
+//!
+//! ASKING lets the next command run on a node importing its slot.
+
+use async_trait::async_trait;
+use bytes::Bytes;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+use nimbis_storage::error::StorageError;
+
+use super::Cmd;
+use super::CmdContext;
+use super::CmdMeta;
+use super::SubCmds;
+use super::utils;
+use crate::GCTX;
+use crate::cluster::FailoverMode;
+use crate::cluster::SetSlot;
+use crate::cluster::slot::CLUSTER_SLOTS;
+use crate::cluster::slot::key_hash_slot;
+use crate::cluster::slot::parse_slot;
+use crate::server_config;
+
+const HELP: &[&str] = &[
+	"ADDSLOTS <slot> [<slot> ...]",
+	"    Assign slots to current node.",
+	"ADDSLOTSRANGE <start slot> <end slot> [<start slot> <end slot> ...]",
+	"    Assign slots which are between <start-slot> and <end-slot> to current node.",
+	"BUMPEPOCH",
+	"    Advance the cluster config epoch.",
+	"COUNT-FAILURE-REPORTS <node-id>",
+	"    Return number of failure reports for <node-id>.",
+	"COUNTKEYSINSLOT <slot>",
+	"    Return the number of keys in <slot>.",
+	"DELSLOTS <slot> [<slot> ...]",
+	"    Delete slots information from current node.",
+	"DELSLOTSRANGE <start slot> <end slot> [<start slot> <end slot> ...]",
+	"    Delete slots information which are between <start-slot> and <end-slot>.",
+	"FAILOVER [FORCE|TAKEOVER]",
+	"    Promote current replica node to being a master.",
+	"FLUSHSLOTS",
+	"    Delete current node own slots information.",
+	"FORGET <node-id>",
+	"    Remove a node from the cluster.",
+	"GETKEYSINSLOT <slot> <count>",
+	"    Return key names stored by current node in a slot.",
+	"INFO",
+	"    Return information about the cluster.",
+	"KEYSLOT <key>",
+	"    Return the hash slot for <key>.",
+	"MEET <ip> <port> [<bus-port>]",
+	"    Connect nodes into a working cluster.",
+	"MYID",
+	"    Return the node id.",
+	"NODES",
+	"    Return cluster configuration seen by node. Output format:",
+	"    <id> <ip:port@bus-port> <flags> <master> <pings> <pongs> <epoch> <link> <slot> ...",
+	"REPLICAS <node-id>",
+	"    Return <node-id> replicas.",
+	"REPLICATE <node-id>",
+	"    Configure current node as replica to <node-id>.",
+	"SAVECONFIG",
+	"    Force saving cluster configuration on disk.",
+	"SET-CONFIG-EPOCH <epoch>",
+	"    Set config epoch of current node.",
+	"SETSLOT <slot> (IMPORTING <node-id>|MIGRATING <node-id>|STABLE|NODE <node-id>)",
+	"    Set slot state.",
+	"SHARDS",
+	"    Return information about slot range mappings and the nodes associated with them.",
+	"SLOTS",
+	"    Return information about slots range mappings. Each range is made of:",
+	"    start, end, master and replicas IP addresses, ports and ids",
+	"SLAVES <node-id>",
+	"    Return <node-id> replicas.",
+];
+
+const CLUSTER_DISABLED: &str = "ERR This instance has cluster support disabled";
+
+/// Keys read by one batch of the walk for the keys of a slot.
+const SLOT_KEYS_BATCH_SIZE: usize = 1000;
+
+/// CLUSTER command implementation.
+pub struct ClusterCmd {
+	meta: CmdMeta,
+	sub_cmds: SubCmds,
+}
+
+impl Default for ClusterCmd {
+	fn default() -> Self {
+		let mut sub_cmds = SubCmds::new("CLUSTER", HELP);
+
+		sub_cmds.insert("INFO", Box::new(ClusterInfoCmd::default()));
+		sub_cmds.insert("MYID", Box::new(ClusterMyIdCmd::default()));
+		sub_cmds.insert("NODES", Box::new(ClusterNodesCmd::default()));
+		sub_cmds.insert("SLOTS", Box::new(ClusterSlotsCmd::default()));
+		sub_cmds.insert("SHARDS", Box::new(ClusterShardsCmd::default()));
+		sub_cmds.insert("KEYSLOT", Box::new(ClusterKeySlotCmd::default()));
+		sub_cmds.insert("ADDSLOTS", Box::new(ClusterAddSlotsCmd::default()));
+		sub_cmds.insert(
+			"ADDSLOTSRANGE",
+			Box::new(ClusterAddSlotsRangeCmd::default()),
+		);
+		sub_cmds.insert("DELSLOTS", Box::new(ClusterDelSlotsCmd::default()));
+		sub_cmds.insert(
+			"DELSLOTSRANGE",
+			Box::new(ClusterDelSlotsRangeCmd::default()),
+		);
+		sub_cmds.insert("FLUSHSLOTS", Box::new(ClusterFlushSlotsCmd::default()));
+		sub_cmds.insert("SETSLOT", Box::new(ClusterSetSlotCmd::default()));
+		sub_cmds.insert(
+			"COUNTKEYSINSLOT",
+			Box::new(ClusterCountKeysInSlotCmd::default()),
+		);
+		sub_cmds.insert(
+			"GETKEYSINSLOT",
+			Box::new(ClusterGetKeysInSlotCmd::default()),
+		);
+		sub_cmds.insert("MEET", Box::new(ClusterMeetCmd::default()));
+		sub_cmds.insert(
+			"SET-CONFIG-EPOCH",
+			Box::new(ClusterSetConfigEpochCmd::default()),
+		);
+		sub_cmds.insert("BUMPEPOCH", Box::new(ClusterBumpEpochCmd::default()));
+		sub_cmds.insert("SAVECONFIG", Box::new(ClusterSaveConfigCmd::default()));
+		sub_cmds.insert("REPLICATE", Box::new(ClusterReplicateCmd::default()));
+		sub_cmds.insert("REPLICAS", Box::new(ClusterReplicasCmd::default()));
+		sub_cmds.insert("SLAVES", Box::new(ClusterSlavesCmd::default()));
+		sub_cmds.insert("FAILOVER", Box::new(ClusterFailoverCmd::default()));
+		sub_cmds.insert("FORGET", Box::new(ClusterForgetCmd::default()));
+		sub_cmds.insert(
+			"COUNT-FAILURE-REPORTS",
+			Box::new(ClusterCountFailureReportsCmd::default()),
+		);
+
+		Self {
+			meta: CmdMeta {
+				name: "CLUSTER".to_string(),
+				arity: -2,
+			},
+			sub_cmds,
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for ClusterCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	fn sub_cmds(&self) -> Option<&SubCmds> {
+		Some(&self.sub_cmds)
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], ctx: &CmdContext) -> RespValue {
+		if !server_config!(cluster_enabled) && !args[0].eq_ignore_ascii_case(b"HELP") {
+			return RespValue::error(CLUSTER_DISABLED);
+		}
+		self.sub_cmds.dispatch(storage, args, ctx).await
+	}
+}
+
+/// Parse the slots of ADDSLOTS and DELSLOTS.
+fn parse_slots(args: &[Bytes]) -> Result<Vec<u16>, String> {
+	args.iter().map(|arg| parse_slot(arg)).collect()
+}
+
+/// Parse the `<start> <end>` pairs of ADDSLOTSRANGE and DELSLOTSRANGE into
+/// the slots they cover.
+fn parse_slot_ranges(name: &str, args: &[Bytes]) -> Result<Vec<u16>, String> {
+	if args.len() % 2 != 0 {
+		return Err(format!(
+			"ERR wrong number of arguments for 'cluster|{}' command",
+			name
+		));
+	}
+	let mut slots = Vec::new();
+	for pair in args.chunks(2) {
+		let start = parse_slot(&pair[0])?;
+		let end = parse_slot(&pair[1])?;
+		if start > end {
+			return Err(format!(
+				"ERR start slot number {} is greater than end slot number {}",
+				start, end
+			));
+		}
+		slots.extend(start..=end);
+	}
+	Ok(slots)
+}
+
+/// Up to `limit` keys of `slot`, from a walk of every key.
+async fn keys_in_slot(
+	storage: &Storage,
+	slot: u16,
+	limit: usize,
+) -> Result<Vec<Bytes>, StorageError> {
+	let mut keys = Vec::new();
+	let mut start = None;
+	while keys.len() < limit {
+		let batch = storage.key_names(start, SLOT_KEYS_BATCH_SIZE).await?;
+		keys.extend(
+			batch
+				.keys
+				.into_iter()
+				.filter(|key| key_hash_slot(key) == slot),
+		);
+		match batch.next {
+			Some(next) => start = Some(next),
+			None => break,
+		}
+	}
+	keys.truncate(limit);
+	Ok(keys)
+}
+
+fn ok_or_error(result: Result<(), String>) -> RespValue {
+	match result {
+		Ok(()) => RespValue::simple_string("OK"),
+		Err(e) => RespValue::error(e),
+	}
+}
+
+pub struct ClusterInfoCmd {
+	meta: CmdMeta,
+}
+
+impl Default for ClusterInfoCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "INFO".to_string(),
+				arity: 1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for ClusterInfoCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, _args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let info: String = GCTX!(cluster)
+			.info()
+			.into_iter()
+			.map(|(field, value)| format!("{}:{}\r\n", field, value))
+			.collect();
+		RespValue::bulk_string(info)
+	}
+}
+
+pub struct ClusterMyIdCmd {
+	meta: CmdMeta,
+}
+
+impl Default for ClusterMyIdCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "MYID".to_string(),
+				arity: 1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for ClusterMyIdCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, _args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		RespValue::bulk_string(GCTX!(cluster).myid())
+	}
+}
+
+pub struct ClusterNodesCmd {
+	meta: CmdMeta,
+}
+
+impl Default for ClusterNodesCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "NODES".to_string(),
+				arity: 1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for ClusterNodesCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, _args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		RespValue::bulk_string(GCTX!(cluster).nodes())
+	}
+}
+
+pub struct ClusterSlotsCmd {
+	meta: CmdMeta,
+}
+
+impl Default for ClusterSlotsCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "SLOTS".to_string(),
+				arity: 1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for ClusterSlotsCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, _args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		RespValue::array(GCTX!(cluster).slot_table().into_iter().map(|range| {
+			let mut entry = vec![
+				RespValue::integer(range.start as i64),
+				RespValue::integer(range.end as i64),
+			];
+			entry.extend(range.nodes.into_iter().map(|node| {
+				RespValue::array(vec![
+					RespValue::bulk_string(node.ip),
+					RespValue::integer(node.port as i64),
+					RespValue::bulk_string(node.id),
+				])
+			}));
+			RespValue::array(entry)
+		}))
+	}
+}
+
+pub struct ClusterShardsCmd {
+	meta: CmdMeta,
+}
+
+impl Default for ClusterShardsCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "SHARDS".to_string(),
+				arity: 1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for ClusterShardsCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, _args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		RespValue::array(GCTX!(cluster).shards().into_iter().map(|shard| {
+			let slots = shard.slots.into_iter().flat_map(|(start, end)| {
+				[
+					RespValue::integer(start as i64),
+					RespValue::integer(end as i64),
+				]
+			});
+			let nodes = shard.nodes.into_iter().map(|node| {
+				RespValue::array(vec![
+					RespValue::bulk_string("id"),
+					RespValue::bulk_string(node.addr.id),
+					RespValue::bulk_string("port"),
+					RespValue::integer(node.addr.port as i64),
+					RespValue::bulk_string("ip"),
+					RespValue::bulk_string(node.addr.ip.clone()),
+					RespValue::bulk_string("endpoint"),
+					RespValue::bulk_string(node.addr.ip),
+					RespValue::bulk_string("role"),
+					RespValue::bulk_string(node.role),
+					RespValue::bulk_string("replication-offset"),
+					RespValue::integer(node.offset as i64),
+					RespValue::bulk_string("health"),
+					RespValue::bulk_string(node.health),
+				])
+			});
+			RespValue::array(vec![
+				RespValue::bulk_string("slots"),
+				RespValue::array(slots),
+				RespValue::bulk_string("nodes"),
+				RespValue::array(nodes),
+			])
+		}))
+	}
+}
+
+pub struct ClusterKeySlotCmd {
+	meta: CmdMeta,
+}
+
+impl Default for ClusterKeySlotCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "KEYSLOT".to_string(),
+				arity: 2,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for ClusterKeySlotCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		RespValue::integer(key_hash_slot(&args[0]) as i64)
+	}
+}
+
+pub struct ClusterAddSlotsCmd {
+	meta: CmdMeta,
+}
+
+impl Default for ClusterAddSlotsCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "ADDSLOTS".to_string(),
+				arity: -2,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for ClusterAddSlotsCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		ok_or_error(parse_slots(args).and_then(|slots| GCTX!(cluster).add_slots(&slots)))
+	}
+}
+
+pub struct ClusterAddSlotsRangeCmd {
+	meta: CmdMeta,
+}
+
+impl Default for ClusterAddSlotsRangeCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "ADDSLOTSRANGE".to_string(),
+				arity: -3,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for ClusterAddSlotsRangeCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		ok_or_error(
+			parse_slot_ranges("addslotsrange", args)
+				.and_then(|slots| GCTX!(cluster).add_slots(&slots)),
+		)
+	}
+}
+
+pub struct ClusterDelSlotsCmd {
+	meta: CmdMeta,
+}
+
+impl Default for ClusterDelSlotsCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "DELSLOTS".to_string(),
+				arity: -2,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for ClusterDelSlotsCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		ok_or_error(parse_slots(args).and_then(|slots| GCTX!(cluster).del_slots(&slots)))
+	}
+}
+
+pub struct ClusterDelSlotsRangeCmd {
+	meta: CmdMeta,
+}
+
+impl Default for ClusterDelSlotsRangeCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "DELSLOTSRANGE".to_string(),
+				arity: -3,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for ClusterDelSlotsRangeCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		ok_or_error(
+			parse_slot_ranges("delslotsrange", args)
+				.and_then(|slots| GCTX!(cluster).del_slots(&slots)),
+		)
+	}
+}
+
+pub struct ClusterFlushSlotsCmd {
+	meta: CmdMeta,
+}
+
+impl Default for ClusterFlushSlotsCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "FLUSHSLOTS".to_string(),
+				arity: 1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for ClusterFlushSlotsCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, _args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		if storage.keyspace_counts().keys > 0 {
+			return RespValue::error("ERR DB must be empty to perform CLUSTER FLUSHSLOTS.");
+		}
+		GCTX!(cluster).flush_slots();
+		RespValue::simple_string("OK")
+	}
+}
+
+pub struct ClusterSetSlotCmd {
+	meta: CmdMeta,
+}
+
+impl Default for ClusterSetSlotCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "SETSLOT".to_string(),
+				arity: -3,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for ClusterSetSlotCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let slot = match parse_slot(&args[0]) {
+			Ok(slot) => slot,
+			Err(e) => return RespValue::error(e),
+		};
+		let node = || String::from_utf8_lossy(&args[2]).into_owned();
+		let action = match (
+			String::from_utf8_lossy(&args[1]).to_uppercase().as_str(),
+			args.len(),
+		) {
+			("MIGRATING", 3) => SetSlot::Migrating(node()),
+			("IMPORTING", 3) => SetSlot::Importing(node()),
+			("STABLE", 2) => SetSlot::Stable,
+			("NODE", 3) => SetSlot::Node(node()),
+			_ => {
+				return RespValue::error(
+					"ERR Invalid CLUSTER SETSLOT action or number of arguments. Try CLUSTER HELP",
+				);
+			}
+		};
+		let holds_keys = match &action {
+			SetSlot::Node(_) => match keys_in_slot(storage, slot, 1).await {
+				Ok(keys) => !keys.is_empty(),
+				Err(e) => return RespValue::error(format!("ERR {}", e)),
+			},
+			_ => false,
+		};
+		ok_or_error(GCTX!(cluster).set_slot(slot, action, holds_keys))
+	}
+}
+
+pub struct ClusterCountKeysInSlotCmd {
+	meta: CmdMeta,
+}
+
+impl Default for ClusterCountKeysInSlotCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "COUNTKEYSINSLOT".to_string(),
+				arity: 2,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for ClusterCountKeysInSlotCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let Ok(slot) = parse_slot(&args[0]) else {
+			return RespValue::error("ERR Invalid slot");
+		};
+		match keys_in_slot(storage, slot, usize::MAX).await {
+			Ok(keys) => RespValue::integer(keys.len() as i64),
+			Err(e) => RespValue::error(format!("ERR {}", e)),
+		}
+	}
+}
+
+pub struct ClusterGetKeysInSlotCmd {
+	meta: CmdMeta,
+}
+
+impl Default for ClusterGetKeysInSlotCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "GETKEYSINSLOT".to_string(),
+				arity: 3,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for ClusterGetKeysInSlotCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let slot = match utils::parse_int::<i64>(&args[0]) {
+			Ok(slot) => slot,
+			Err(e) => return RespValue::error(e),
+		};
+		let count = match utils::parse_int::<i64>(&args[1]) {
+			Ok(count) => count,
+			Err(e) => return RespValue::error(e),
+		};
+		if !(0..CLUSTER_SLOTS as i64).contains(&slot) || count < 0 {
+			return RespValue::error("ERR Invalid slot or number of keys");
+		}
+		match keys_in_slot(storage, slot as u16, count as usize).await {
+			Ok(keys) => RespValue::array(keys.into_iter().map(RespValue::bulk_string)),
+			Err(e) => RespValue::error(format!("ERR {}", e)),
+		}
+	}
+}
+
+pub struct ClusterMeetCmd {
+	meta: CmdMeta,
+}
+
+impl Default for ClusterMeetCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "MEET".to_string(),
+				arity: -3,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for ClusterMeetCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		if args.len() > 3 {
+			return RespValue::error("ERR wrong number of arguments for 'cluster|meet' command");
+		}
+		let ip = String::from_utf8_lossy(&args[0]);
+		let port = String::from_utf8_lossy(&args[1]);
+		let Ok(port) = port.parse::<u16>() else {
+			return RespValue::error(format!("ERR Invalid base port specified: {}", port));
+		};
+		let cport = match args.get(2) {
+			Some(arg) => {
+				let cport = String::from_utf8_lossy(arg);
+				match cport.parse::<u16>() {
+					Ok(cport) => cport,
+					Err(_) => {
+						return RespValue::error(format!(
+							"ERR Invalid bus port specified: {}",
+							cport
+						));
+					}
+				}
+			}
+			None => match port.checked_add(10000) {
+				Some(cport) => cport,
+				None => {
+					return RespValue::error(format!(
+						"ERR Invalid node address specified: {}:{}",
+						ip, port
+					));
+				}
+			},
+		};
+		ok_or_error(GCTX!(cluster).meet(&ip, port, cport))
+	}
+}
+
+pub struct ClusterSetConfigEpochCmd {
+	meta: CmdMeta,
+}
+
+impl Default for ClusterSetConfigEpochCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "SET-CONFIG-EPOCH".to_string(),
+				arity: 2,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for ClusterSetConfigEpochCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let epoch = String::from_utf8_lossy(&args[0]);
+		let Ok(epoch) = epoch.parse::<u64>() else {
+			return RespValue::error(format!("ERR Invalid config epoch specified: {}", epoch));
+		};
+		ok_or_error(GCTX!(cluster).set_config_epoch(epoch))
+	}
+}
+
+pub struct ClusterBumpEpochCmd {
+	meta: CmdMeta,
+}
+
+impl Default for ClusterBumpEpochCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "BUMPEPOCH".to_string(),
+				arity: 1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for ClusterBumpEpochCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, _args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let (bumped, epoch) = GCTX!(cluster).bump_epoch();
+		RespValue::simple_string(format!(
+			"{} {}",
+			if bumped { "BUMPED" } else { "STILL" },
+			epoch
+		))
+	}
+}
+
+pub struct ClusterSaveConfigCmd {
+	meta: CmdMeta,
+}
+
+impl Default for ClusterSaveConfigCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "SAVECONFIG".to_string(),
+				arity: 1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for ClusterSaveConfigCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, _args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		match GCTX!(cluster).save(storage).await {
+			Ok(()) => RespValue::simple_string("OK"),
+			Err(e) => RespValue::error(format!("ERR error saving the cluster node config: {}", e)),
+		}
+	}
+}
+
+pub struct ClusterReplicateCmd {
+	meta: CmdMeta,
+}
+
+impl Default for ClusterReplicateCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "REPLICATE".to_string(),
+				arity: 2,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for ClusterReplicateCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let holds_keys = storage.keyspace_counts().keys > 0;
+		ok_or_error(GCTX!(cluster).replicate(&String::from_utf8_lossy(&args[0]), holds_keys))
+	}
+}
+
+/// Shared by REPLICAS and its old name SLAVES.
+fn replicas(args: &[Bytes]) -> RespValue {
+	match GCTX!(cluster).replicas(&String::from_utf8_lossy(&args[0])) {
+		Ok(lines) => RespValue::array(lines.into_iter().map(RespValue::bulk_string)),
+		Err(e) => RespValue::error(e),
+	}
+}
+
+pub struct ClusterReplicasCmd {
+	meta: CmdMeta,
+}
+
+impl Default for ClusterReplicasCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "REPLICAS".to_string(),
+				arity: 2,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for ClusterReplicasCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		replicas(args)
+	}
+}
+
+pub struct ClusterSlavesCmd {
+	meta: CmdMeta,
+}
+
+impl Default for ClusterSlavesCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "SLAVES".to_string(),
+				arity: 2,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for ClusterSlavesCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		replicas(args)
+	}
+}
+
+pub struct ClusterFailoverCmd {
+	meta: CmdMeta,
+}
+
+impl Default for ClusterFailoverCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "FAILOVER".to_string(),
+				arity: -1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for ClusterFailoverCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let mode = match args {
+			[] => FailoverMode::Default,
+			[mode] if mode.eq_ignore_ascii_case(b"FORCE") => FailoverMode::Force,
+			[mode] if mode.eq_ignore_ascii_case(b"TAKEOVER") => FailoverMode::Takeover,
+			_ => return RespValue::error("ERR syntax error"),
+		};
+		ok_or_error(GCTX!(cluster).failover(mode))
+	}
+}
+
+pub struct ClusterForgetCmd {
+	meta: CmdMeta,
+}
+
+impl Default for ClusterForgetCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "FORGET".to_string(),
+				arity: 2,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for ClusterForgetCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		ok_or_error(GCTX!(cluster).forget(&String::from_utf8_lossy(&args[0])))
+	}
+}
+
+pub struct ClusterCountFailureReportsCmd {
+	meta: CmdMeta,
+}
+
+impl Default for ClusterCountFailureReportsCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "COUNT-FAILURE-REPORTS".to_string(),
+				arity: 2,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for ClusterCountFailureReportsCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		match GCTX!(cluster).count_failure_reports(&String::from_utf8_lossy(&args[0])) {
+			Ok(count) => RespValue::integer(count as i64),
+			Err(e) => RespValue::error(e),
+		}
+	}
+}
+
+/// ASKING command implementation.
+///
+/// Lets the next command, or the next transaction, run on a node importing
+/// its slot, which otherwise answers with MOVED.
+pub struct AskingCmd {
+	meta: CmdMeta,
+}
+
+impl Default for AskingCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "ASKING".to_string(),
+				arity: 1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for AskingCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, _args: &[Bytes], ctx: &CmdContext) -> RespValue {
+		if !server_config!(cluster_enabled) {
+			return RespValue::error(CLUSTER_DISABLED);
+		}
+		GCTX!(client_sessions).set_asking(ctx.client_id, true);
+		RespValue::simple_string("OK")
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+
+	fn args(args: &[&str]) -> Vec<Bytes> {
+		args.iter()
+			.map(|arg| Bytes::from(arg.to_string()))
+			.collect()
+	}
+
+	#[test]
+	fn test_parse_slot_ranges() {
+		assert_eq!(
+			parse_slot_ranges("addslotsrange", &args(&["0", "2", "10", "10"])),
+			Ok(vec![0, 1, 2, 10])
+		);
+		assert_eq!(
+			parse_slot_ranges("addslotsrange", &args(&["5", "1"])),
+			Err("ERR start slot number 5 is greater than end slot number 1".to_string())
+		);
+		assert!(parse_slot_ranges("addslotsrange", &args(&["0", "2", "3"])).is_err());
+		assert!(parse_slot_ranges("addslotsrange", &args(&["0", "16384"])).is_err());
+	}
+}
@@ -1,5 +1,3 @@
-use std::collections::HashMap;
-
 use async_trait::async_trait;
 use bytes::Bytes;
 use nimbis_resp::RespValue;
@@ -8,26 +6,43 @@ use nimbis_storage::Storage;
 use super::Cmd;
 use super::CmdContext;
 use super::CmdMeta;
+use super::SubCmds;
+use super::utils;
+use crate::GCTX;
 use crate::config::SERVER_CONF;
 use crate::config::ServerConfig;
+use crate::config::rewrite_config;
+
+const HELP: &[&str] = &[
+	"GET <pattern> [<pattern> ...]",
+	"    Return parameters matching the glob-like <pattern> and their values.",
+	"SET <directive> <value>",
+	"    Set the configuration <directive> to <value>.",
+	"RESETSTAT",
+	"    Reset statistics reported by the INFO command.",
+	"REWRITE",
+	"    Rewrite the configuration file.",
+];
 
 /// Config command implementation
 pub struct ConfigCmd {
 	meta: CmdMeta,
-	sub_cmds: HashMap<&'static str, Box<dyn Cmd>>,
+	sub_cmds: SubCmds,
 }
 
 impl Default for ConfigCmd {
 	fn default() -> Self {
-		let mut sub_cmds: HashMap<&'static str, Box<dyn Cmd>> = HashMap::new();
+		let mut sub_cmds = SubCmds::new("CONFIG", HELP);
 
 		sub_cmds.insert("GET", Box::new(ConfigGetCmd::default()));
 		sub_cmds.insert("SET", Box::new(ConfigSetCmd::default()));
+		sub_cmds.insert("REWRITE", Box::new(ConfigRewriteCmd::default()));
+		sub_cmds.insert("RESETSTAT", Box::new(ConfigResetStatCmd::default()));
 
 		Self {
 			meta: CmdMeta {
 				name: "CONFIG".to_string(),
-				arity: -3,
+				arity: -2,
 			},
 			sub_cmds,
 		}
@@ -40,24 +55,12 @@ impl Cmd for ConfigCmd {
 		&self.meta
 	}
 
-	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], ctx: &CmdContext) -> RespValue {
-		// First argument should be the subcommand name (e.g., "GET")
-		if args.is_empty() {
-			return RespValue::error("ERR wrong number of arguments for CONFIG command");
-		}
-
-		// Convert first argument to uppercase for case-insensitive lookup
-		// TODO: find a better way to do this
-		let sub_cmd_name = String::from_utf8_lossy(&args[0]).to_uppercase();
+	fn sub_cmds(&self) -> Option<&SubCmds> {
+		Some(&self.sub_cmds)
+	}
 
-		// Find and execute the subcommand
-		match self.sub_cmds.get(sub_cmd_name.as_str()) {
-			Some(sub_cmd) => {
-				// Pass remaining arguments to the subcommand
-				sub_cmd.execute(storage, &args[1..], ctx).await
-			}
-			None => RespValue::error(format!("ERR unknown CONFIG subcommand '{}'", sub_cmd_name)),
-		}
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], ctx: &CmdContext) -> RespValue {
+		self.sub_cmds.dispatch(storage, args, ctx).await
 	}
 }
 
@@ -70,7 +73,7 @@ impl Default for ConfigGetCmd {
 		Self {
 			meta: CmdMeta {
 				name: "GET".to_string(),
-				arity: 2,
+				arity: -2, // CONFIG GET pattern [pattern ...]
 			},
 		}
 	}
@@ -83,44 +86,25 @@ impl Cmd for ConfigGetCmd {
 	}
 
 	async fn do_cmd(&self, _storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
-		let pattern = String::from_utf8_lossy(&args[0]);
-
-		// Check if pattern contains wildcard
-		if pattern.contains('*') {
-			// Get matching field names
-			let matched_fields = ServerConfig::match_fields(&pattern);
-
-			if matched_fields.is_empty() {
-				// No fields matched
-				return RespValue::array(vec![]);
+		let config = SERVER_CONF.load();
+		let patterns: Vec<Vec<u8>> = args.iter().map(|arg| arg.to_ascii_lowercase()).collect();
+
+		// Like Redis 7, every field matching any pattern is returned once,
+		// and a pattern that matches nothing adds nothing.
+		let mut result = Vec::new();
+		for field_name in ServerConfig::list_fields() {
+			if !patterns
+				.iter()
+				.any(|pattern| utils::glob_match(pattern, field_name.as_bytes()))
+			{
+				continue;
 			}
-
-			// Get current config
-			let config = SERVER_CONF.load();
-
-			// Build result array: [key1, value1, key2, value2, ...]
-			let mut result = Vec::new();
-			for field_name in matched_fields {
-				if let Ok(value) = config.get_field(field_name) {
-					result.push(RespValue::bulk_string(Bytes::from(field_name.to_string())));
-					result.push(RespValue::bulk_string(Bytes::from(value)));
-				}
-			}
-
-			RespValue::array(result)
-		} else {
-			// Exact match - original behavior
-			match SERVER_CONF.load().get_field(&pattern) {
-				Ok(value) => {
-					// CONFIG GET returns an array: [field_name, field_value]
-					RespValue::array(vec![
-						RespValue::bulk_string(Bytes::from(pattern.into_owned())),
-						RespValue::bulk_string(Bytes::from(value)),
-					])
-				}
-				Err(e) => RespValue::error(e),
+			if let Ok(value) = config.get_field(field_name) {
+				result.push(RespValue::bulk_string(Bytes::from(field_name)));
+				result.push(RespValue::bulk_string(Bytes::from(value)));
 			}
 		}
+		RespValue::array(result)
 	}
 }
 
@@ -164,3 +148,60 @@ impl Cmd for ConfigSetCmd {
 		}
 	}
 }
+
+pub struct ConfigRewriteCmd {
+	meta: CmdMeta,
+}
+
+impl Default for ConfigRewriteCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "REWRITE".to_string(),
+				arity: 1, // CONFIG REWRITE
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for ConfigRewriteCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, _args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		match rewrite_config() {
+			Ok(()) => RespValue::simple_string("OK"),
+			Err(e) => RespValue::error(format!("ERR {}", e)),
+		}
+	}
+}
+
+pub struct ConfigResetStatCmd {
+	meta: CmdMeta,
+}
+
+impl Default for ConfigResetStatCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "RESETSTAT".to_string(),
+				arity: 1, // CONFIG RESETSTAT
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for ConfigResetStatCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, _args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		GCTX!(commandstats).reset();
+		GCTX!(command_latencies).reset();
+		RespValue::simple_string("OK")
+	}
+}
@@ -0,0 +1,193 @@
+//! DUMP and RESTORE: single values in the Redis DUMP payload format.
+
+use async_trait::async_trait;
+use bytes::Bytes;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+use nimbis_storage::error::StorageError;
+use nimbis_storage::rdb;
+use nimbis_storage::rdb::RdbEntry;
+
+use super::Cmd;
+use super::CmdContext;
+use super::CmdMeta;
+use super::utils;
+use crate::GCTX;
+
+/// DUMP key
+pub struct DumpCmd {
+	meta: CmdMeta,
+}
+
+impl Default for DumpCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "DUMP".to_string(),
+				arity: 2,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for DumpCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		match storage.dump_entry(args[0].clone()).await {
+			Ok(Some(entry)) => RespValue::bulk_string(rdb::dump(&entry.value)),
+			Ok(None) => RespValue::Null,
+			Err(StorageError::InvalidArgument { message }) => RespValue::error(message),
+			Err(e) => RespValue::error(format!("ERR {}", e)),
+		}
+	}
+}
+
+/// RESTORE key ttl serialized-value [REPLACE] [ABSTTL] [IDLETIME seconds]
+/// [FREQ frequency]
+///
+/// IDLETIME and FREQ set the access statistics OBJECT IDLETIME and
+/// OBJECT FREQ report for the restored key.
+pub struct RestoreCmd {
+	meta: CmdMeta,
+}
+
+impl Default for RestoreCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "RESTORE".to_string(),
+				arity: -4,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for RestoreCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		restore(storage, args).await
+	}
+}
+
+/// RESTORE-ASKING, which MIGRATE sends in cluster mode: RESTORE, also run on
+/// a node importing the key's slot.
+pub struct RestoreAskingCmd {
+	meta: CmdMeta,
+}
+
+impl Default for RestoreAskingCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "RESTORE-ASKING".to_string(),
+				arity: -4,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for RestoreAskingCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		restore(storage, args).await
+	}
+}
+
+/// Create a key from a DUMP payload, for RESTORE and RESTORE-ASKING.
+async fn restore(storage: &Storage, args: &[Bytes]) -> RespValue {
+	let key = args[0].clone();
+	let ttl = match utils::parse_int::<i64>(&args[1]) {
+		Ok(ttl) if ttl >= 0 => ttl,
+		Ok(_) => return RespValue::error("ERR Invalid TTL value, must be >= 0"),
+		Err(e) => return RespValue::error(e),
+	};
+
+	let mut replace = false;
+	let mut absttl = false;
+	let mut idle = None;
+	let mut freq = None;
+	let mut i = 3;
+	while i < args.len() {
+		let option = String::from_utf8_lossy(&args[i]).to_uppercase();
+		match option.as_str() {
+			"REPLACE" => replace = true,
+			"ABSTTL" => absttl = true,
+			"IDLETIME" if i + 1 < args.len() => {
+				i += 1;
+				match utils::parse_int::<i64>(&args[i]) {
+					Ok(value) if value >= 0 => idle = Some(value as u64),
+					Ok(_) => {
+						return RespValue::error("ERR Invalid IDLETIME value, must be >= 0");
+					}
+					Err(e) => return RespValue::error(e),
+				}
+			}
+			"FREQ" if i + 1 < args.len() => {
+				i += 1;
+				match utils::parse_int::<i64>(&args[i]) {
+					Ok(value) if (0..=255).contains(&value) => freq = Some(value as u8),
+					Ok(_) => {
+						return RespValue::error("ERR Invalid FREQ value, must be >= 0 and <= 255");
+					}
+					Err(e) => return RespValue::error(e),
+				}
+			}
+			_ => return RespValue::error("ERR syntax error"),
+		}
+		i += 1;
+	}
+
+	let value = match rdb::undump(&args[2]) {
+		Ok(value) => value,
+		Err(StorageError::InvalidArgument { message }) => return RespValue::error(message),
+		Err(_) => return RespValue::error("ERR Bad data format"),
+	};
+	if !replace {
+		match storage.exists(key.clone()).await {
+			Ok(true) => return RespValue::error("BUSYKEY Target key name already exists."),
+			Ok(false) => {}
+			Err(e) => return RespValue::error(format!("ERR {}", e)),
+		}
+	}
+
+	let expire_ts = match ttl {
+		0 => None,
+		ttl if absttl => Some(ttl),
+		ttl => Some(chrono::Utc::now().timestamp_millis().saturating_add(ttl)),
+	};
+	match storage
+		.restore_entry(RdbEntry {
+			key: key.clone(),
+			value,
+			expire_ts,
+		})
+		.await
+	{
+		Ok(()) => {
+			GCTX!(access).restore(&key, idle, freq);
+			// Replicas get the same expire time, not the same delay.
+			GCTX!(replication).propagate(&[
+				Bytes::from_static(b"RESTORE"),
+				key,
+				Bytes::from(expire_ts.unwrap_or(0).to_string()),
+				args[2].clone(),
+				Bytes::from_static(b"REPLACE"),
+				Bytes::from_static(b"ABSTTL"),
+			]);
+			RespValue::simple_string("OK")
+		}
+		Err(e) => RespValue::error(format!("ERR {}", e)),
+	}
+}
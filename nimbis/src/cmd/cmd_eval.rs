@@ -0,0 +1,154 @@
+use async_trait::async_trait;
+use bytes::Bytes;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+
+use super::Cmd;
+use super::CmdContext;
+use super::CmdMeta;
+use crate::GCTX;
+use crate::script;
+
+/// EVAL command implementation.
+///
+/// EVAL script numkeys [key ...] [arg ...]
+pub struct EvalCmd {
+	meta: CmdMeta,
+}
+
+impl Default for EvalCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "EVAL".to_string(),
+				arity: -3,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for EvalCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], ctx: &CmdContext) -> RespValue {
+		eval(args, false, storage, ctx).await
+	}
+}
+
+/// EVALSHA command implementation.
+///
+/// EVALSHA sha1 numkeys [key ...] [arg ...]
+pub struct EvalShaCmd {
+	meta: CmdMeta,
+}
+
+impl Default for EvalShaCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "EVALSHA".to_string(),
+				arity: -3,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for EvalShaCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], ctx: &CmdContext) -> RespValue {
+		evalsha(args, false, storage, ctx).await
+	}
+}
+
+/// EVAL_RO command implementation.
+///
+/// EVAL_RO script numkeys [key ...] [arg ...]
+pub struct EvalRoCmd {
+	meta: CmdMeta,
+}
+
+impl Default for EvalRoCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "EVAL_RO".to_string(),
+				arity: -3,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for EvalRoCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], ctx: &CmdContext) -> RespValue {
+		eval(args, true, storage, ctx).await
+	}
+}
+
+/// EVALSHA_RO command implementation.
+///
+/// EVALSHA_RO sha1 numkeys [key ...] [arg ...]
+pub struct EvalShaRoCmd {
+	meta: CmdMeta,
+}
+
+impl Default for EvalShaRoCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "EVALSHA_RO".to_string(),
+				arity: -3,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for EvalShaRoCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], ctx: &CmdContext) -> RespValue {
+		evalsha(args, true, storage, ctx).await
+	}
+}
+
+async fn eval(args: &[Bytes], read_only: bool, storage: &Storage, ctx: &CmdContext) -> RespValue {
+	let (keys, argv) = match script::split_keys(&args[1..]) {
+		Ok(split) => split,
+		Err(err) => return err,
+	};
+
+	// Like Redis, EVAL caches the body so EVALSHA can reuse it.
+	GCTX!(scripts).load(args[0].clone());
+	script::run(&args[0], keys, argv, read_only, storage, ctx).await
+}
+
+async fn evalsha(
+	args: &[Bytes],
+	read_only: bool,
+	storage: &Storage,
+	ctx: &CmdContext,
+) -> RespValue {
+	let (keys, argv) = match script::split_keys(&args[1..]) {
+		Ok(split) => split,
+		Err(err) => return err,
+	};
+
+	let Some(body) = GCTX!(scripts).get(&String::from_utf8_lossy(&args[0])) else {
+		return RespValue::error("NOSCRIPT No matching script. Please use EVAL.");
+	};
+	script::run(&body, keys, argv, read_only, storage, ctx).await
+}
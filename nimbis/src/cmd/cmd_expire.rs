@@ -6,6 +6,8 @@ use nimbis_storage::Storage;
 use super::Cmd;
 use super::CmdContext;
 use super::CmdMeta;
+use super::utils;
+use crate::GCTX;
 
 #[derive(Debug, Clone)]
 pub struct ExpireCmd {
@@ -45,7 +47,53 @@ impl Cmd for ExpireCmd {
 
 		let expire_time = now + seconds * 1000;
 
-		match storage.expire(key, expire_time).await {
+		match storage.expire(key.clone(), expire_time).await {
+			Ok(true) => {
+				// Replicas get the same expire time, not the same delay.
+				GCTX!(replication).propagate(&[
+					Bytes::from_static(b"PEXPIREAT"),
+					key,
+					Bytes::from(expire_time.to_string()),
+				]);
+				RespValue::Integer(1)
+			}
+			Ok(false) => RespValue::Integer(0),
+			Err(e) => RespValue::Error(Bytes::from(e.to_string())),
+		}
+	}
+}
+
+#[derive(Debug, Clone)]
+pub struct PExpireAtCmd {
+	meta: CmdMeta,
+}
+
+impl Default for PExpireAtCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "PEXPIREAT".to_string(),
+				arity: 3, // PEXPIREAT key unix-time-milliseconds
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for PExpireAtCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let key = args[0].clone();
+		let timestamp = match utils::parse_int::<i64>(&args[1]) {
+			Ok(timestamp) => timestamp,
+			Err(e) => return RespValue::error(e),
+		};
+
+		// A time in the past deletes the key; 0 would mean no expiry.
+		match storage.expire(key, timestamp.max(1) as u64).await {
 			Ok(true) => RespValue::Integer(1),
 			Ok(false) => RespValue::Integer(0),
 			Err(e) => RespValue::Error(Bytes::from(e.to_string())),
@@ -0,0 +1,515 @@
+use async_trait::async_trait;
+use bytes::Bytes;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+
+use super::Cmd;
+use super::CmdContext;
+use super::CmdMeta;
+use super::SubCmds;
+use super::utils;
+use crate::GCTX;
+use crate::function;
+use crate::function::Library;
+use crate::function::RestorePolicy;
+use crate::script;
+
+const HELP: &[&str] = &[
+	"LOAD [REPLACE] <FUNCTION CODE>",
+	"    Create a new library with the given library name and code.",
+	"DELETE <LIBRARY NAME>",
+	"    Delete the given library.",
+	"LIST [LIBRARYNAME PATTERN] [WITHCODE]",
+	"    Return general information on all the libraries:",
+	"    * Library name",
+	"    * The engine used to run the Library",
+	"    * Library code (if WITHCODE is given)",
+	"    * Functions list with name, description and flags",
+	"    It also possible to get only function that matches a pattern using LIBRARYNAME",
+	"    argument.",
+	"KILL",
+	"    Kill the current running function.",
+	"FLUSH [ASYNC|SYNC]",
+	"    Delete all the libraries.",
+	"DUMP",
+	"    Return a serialized payload representing the current libraries, can be",
+	"    restored using FUNCTION RESTORE command",
+	"RESTORE <PAYLOAD> [FLUSH|APPEND|REPLACE]",
+	"    Restore the libraries represented by the given payload, it is possible to",
+	"    give a restore policy to control how to handle existing libraries",
+	"    (default APPEND):",
+	"    * FLUSH: delete all existing libraries.",
+	"    * APPEND: appends the restored libraries to the existing libraries. On",
+	"      collision, abort.",
+	"    * REPLACE: appends the restored libraries to the existing libraries, On",
+	"      collision, replace the old libraries with the new libraries.",
+];
+
+/// The FUNCTION command `subcommand` ran with `args`, as streamed to
+/// replicas.
+fn function_command(subcommand: &'static [u8], args: &[Bytes]) -> Vec<Bytes> {
+	let mut command = vec![
+		Bytes::from_static(b"FUNCTION"),
+		Bytes::from_static(subcommand),
+	];
+	command.extend(args.iter().cloned());
+	command
+}
+
+/// FCALL command implementation.
+///
+/// FCALL function numkeys [key ...] [arg ...]
+pub struct FcallCmd {
+	meta: CmdMeta,
+}
+
+impl Default for FcallCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "FCALL".to_string(),
+				arity: -3,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for FcallCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], ctx: &CmdContext) -> RespValue {
+		fcall(args, false, storage, ctx).await
+	}
+}
+
+/// FCALL_RO command implementation.
+///
+/// FCALL_RO function numkeys [key ...] [arg ...]
+pub struct FcallRoCmd {
+	meta: CmdMeta,
+}
+
+impl Default for FcallRoCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "FCALL_RO".to_string(),
+				arity: -3,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for FcallRoCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], ctx: &CmdContext) -> RespValue {
+		fcall(args, true, storage, ctx).await
+	}
+}
+
+/// Call a function. FCALL_RO only accepts functions flagged `no-writes`, and
+/// such functions run read-only whichever command calls them.
+async fn fcall(args: &[Bytes], read_only: bool, storage: &Storage, ctx: &CmdContext) -> RespValue {
+	let (keys, argv) = match script::split_keys(&args[1..]) {
+		Ok(split) => split,
+		Err(err) => return err,
+	};
+
+	let name = String::from_utf8_lossy(&args[0]);
+	let Some(library) = GCTX!(functions).find(&name) else {
+		return RespValue::error("ERR Function not found");
+	};
+	let function_read_only = library
+		.function(&name)
+		.is_some_and(|function| function.is_read_only());
+	if read_only && !function_read_only {
+		return RespValue::error(
+			"ERR Can not execute a script with write flag using *_ro command.",
+		);
+	}
+	script::call_function(
+		library.body(),
+		&name,
+		keys,
+		argv,
+		function_read_only,
+		storage,
+		ctx,
+	)
+	.await
+}
+
+/// Function command implementation.
+pub struct FunctionCmd {
+	meta: CmdMeta,
+	sub_cmds: SubCmds,
+}
+
+impl Default for FunctionCmd {
+	fn default() -> Self {
+		let mut sub_cmds = SubCmds::new("FUNCTION", HELP);
+
+		sub_cmds.insert("LOAD", Box::new(FunctionLoadCmd::default()));
+		sub_cmds.insert("LIST", Box::new(FunctionListCmd::default()));
+		sub_cmds.insert("DUMP", Box::new(FunctionDumpCmd::default()));
+		sub_cmds.insert("RESTORE", Box::new(FunctionRestoreCmd::default()));
+		sub_cmds.insert("DELETE", Box::new(FunctionDeleteCmd::default()));
+		sub_cmds.insert("FLUSH", Box::new(FunctionFlushCmd::default()));
+		sub_cmds.insert("KILL", Box::new(FunctionKillCmd::default()));
+
+		Self {
+			meta: CmdMeta {
+				name: "FUNCTION".to_string(),
+				arity: -2,
+			},
+			sub_cmds,
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for FunctionCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	fn sub_cmds(&self) -> Option<&SubCmds> {
+		Some(&self.sub_cmds)
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], ctx: &CmdContext) -> RespValue {
+		self.sub_cmds.dispatch(storage, args, ctx).await
+	}
+}
+
+pub struct FunctionLoadCmd {
+	meta: CmdMeta,
+}
+
+impl Default for FunctionLoadCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "LOAD".to_string(),
+				arity: -2,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for FunctionLoadCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		// FUNCTION LOAD [REPLACE] function-code
+		let (replace, code) = match args {
+			[code] => (false, code),
+			[flag, code] if flag.eq_ignore_ascii_case(b"REPLACE") => (true, code),
+			[flag, _] => {
+				return RespValue::error(format!(
+					"ERR Unknown option given: {}",
+					String::from_utf8_lossy(flag)
+				));
+			}
+			_ => {
+				return RespValue::error(
+					"ERR wrong number of arguments for 'function|load' command",
+				);
+			}
+		};
+
+		let library = match Library::parse(code.clone()) {
+			Ok(library) => library,
+			Err(err) => return RespValue::error(err),
+		};
+		let name = library.name.clone();
+		match GCTX!(functions)
+			.update(storage, &function_command(b"LOAD", args), |libraries| {
+				function::insert(libraries, library, replace)
+			})
+			.await
+		{
+			Ok(()) => RespValue::bulk_string(name),
+			Err(err) => RespValue::error(err),
+		}
+	}
+}
+
+pub struct FunctionListCmd {
+	meta: CmdMeta,
+}
+
+impl Default for FunctionListCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "LIST".to_string(),
+				arity: -1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for FunctionListCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		// FUNCTION LIST [LIBRARYNAME library-name-pattern] [WITHCODE]
+		let mut pattern = None;
+		let mut with_code = false;
+		let mut iter = args.iter();
+		while let Some(arg) = iter.next() {
+			if arg.eq_ignore_ascii_case(b"WITHCODE") && !with_code {
+				with_code = true;
+			} else if arg.eq_ignore_ascii_case(b"LIBRARYNAME") && pattern.is_none() {
+				match iter.next() {
+					Some(value) => pattern = Some(value),
+					None => return RespValue::error("ERR library name argument was not given"),
+				}
+			} else {
+				return RespValue::error(format!(
+					"ERR Unknown argument {}",
+					String::from_utf8_lossy(arg)
+				));
+			}
+		}
+
+		RespValue::array(
+			GCTX!(functions)
+				.libraries()
+				.iter()
+				.filter(|library| {
+					pattern
+						.is_none_or(|pattern| utils::glob_match(pattern, library.name.as_bytes()))
+				})
+				.map(|library| library_to_resp(library, with_code)),
+		)
+	}
+}
+
+fn library_to_resp(library: &Library, with_code: bool) -> RespValue {
+	let functions = library.functions.iter().map(|function| {
+		RespValue::array([
+			RespValue::bulk_string("name"),
+			RespValue::bulk_string(function.name.clone()),
+			RespValue::bulk_string("description"),
+			function
+				.description
+				.clone()
+				.map_or(RespValue::Null, RespValue::bulk_string),
+			RespValue::bulk_string("flags"),
+			RespValue::array(function.flags.iter().cloned().map(RespValue::simple_string)),
+		])
+	});
+
+	let mut fields = vec![
+		RespValue::bulk_string("library_name"),
+		RespValue::bulk_string(library.name.clone()),
+		RespValue::bulk_string("engine"),
+		RespValue::bulk_string("LUA"),
+		RespValue::bulk_string("functions"),
+		RespValue::array(functions),
+	];
+	if with_code {
+		fields.push(RespValue::bulk_string("library_code"));
+		fields.push(RespValue::bulk_string(library.code.clone()));
+	}
+	RespValue::array(fields)
+}
+
+pub struct FunctionDumpCmd {
+	meta: CmdMeta,
+}
+
+impl Default for FunctionDumpCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "DUMP".to_string(),
+				arity: 1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for FunctionDumpCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, _args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		RespValue::bulk_string(GCTX!(functions).dump())
+	}
+}
+
+pub struct FunctionRestoreCmd {
+	meta: CmdMeta,
+}
+
+impl Default for FunctionRestoreCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "RESTORE".to_string(),
+				arity: -2,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for FunctionRestoreCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		// FUNCTION RESTORE serialized-value [FLUSH | APPEND | REPLACE]
+		let policy = match &args[1..] {
+			[] => RestorePolicy::Append,
+			[policy] if policy.eq_ignore_ascii_case(b"APPEND") => RestorePolicy::Append,
+			[policy] if policy.eq_ignore_ascii_case(b"REPLACE") => RestorePolicy::Replace,
+			[policy] if policy.eq_ignore_ascii_case(b"FLUSH") => RestorePolicy::Flush,
+			_ => {
+				return RespValue::error(
+					"ERR Wrong restore policy given, value should be either FLUSH, APPEND or REPLACE.",
+				);
+			}
+		};
+
+		match GCTX!(functions)
+			.update(storage, &function_command(b"RESTORE", args), |libraries| {
+				function::restore(libraries, &args[0], policy)
+			})
+			.await
+		{
+			Ok(()) => RespValue::simple_string("OK"),
+			Err(err) => RespValue::error(err),
+		}
+	}
+}
+
+pub struct FunctionDeleteCmd {
+	meta: CmdMeta,
+}
+
+impl Default for FunctionDeleteCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "DELETE".to_string(),
+				arity: 2,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for FunctionDeleteCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let name = String::from_utf8_lossy(&args[0]).into_owned();
+		match GCTX!(functions)
+			.update(
+				storage,
+				&function_command(b"DELETE", args),
+				|libraries| match libraries.remove(&name) {
+					Some(_) => Ok(()),
+					None => Err("ERR Library not found".to_string()),
+				},
+			)
+			.await
+		{
+			Ok(()) => RespValue::simple_string("OK"),
+			Err(err) => RespValue::error(err),
+		}
+	}
+}
+
+pub struct FunctionFlushCmd {
+	meta: CmdMeta,
+}
+
+impl Default for FunctionFlushCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "FLUSH".to_string(),
+				arity: -1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for FunctionFlushCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let valid = match args {
+			[] => true,
+			[mode] => mode.eq_ignore_ascii_case(b"ASYNC") || mode.eq_ignore_ascii_case(b"SYNC"),
+			_ => false,
+		};
+		if !valid {
+			return RespValue::error("ERR FUNCTION FLUSH only supports SYNC|ASYNC option");
+		}
+
+		match GCTX!(functions)
+			.update(storage, &function_command(b"FLUSH", args), |libraries| {
+				libraries.clear();
+				Ok(())
+			})
+			.await
+		{
+			Ok(()) => RespValue::simple_string("OK"),
+			Err(err) => RespValue::error(err),
+		}
+	}
+}
+
+/// FUNCTION KILL runs without the exec lock, see `script::runs_while_busy`.
+pub struct FunctionKillCmd {
+	meta: CmdMeta,
+}
+
+impl Default for FunctionKillCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "KILL".to_string(),
+				arity: 1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for FunctionKillCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, _args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		GCTX!(running_script).kill()
+	}
+}
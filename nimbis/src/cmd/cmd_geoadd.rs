@@ -0,0 +1,123 @@
+use async_trait::async_trait;
+use bytes::Bytes;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+use nimbis_storage::geo::GeoPoint;
+use nimbis_storage::storage_zset::ZAddOptions;
+
+use super::CmdContext;
+use crate::cmd::Cmd;
+use crate::cmd::CmdMeta;
+use crate::cmd::utils;
+
+pub struct GeoAddCmd {
+	meta: CmdMeta,
+}
+
+impl Default for GeoAddCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "GEOADD".to_string(),
+				// GEOADD key [NX | XX] [CH] longitude latitude member [longitude latitude member
+				// ...]
+				arity: -5,
+			},
+		}
+	}
+}
+
+/// Parse the options and points of GEOADD, after the key.
+fn parse_args(args: &[Bytes]) -> Result<(ZAddOptions, Vec<(GeoPoint, Bytes)>), String> {
+	let mut options = ZAddOptions::default();
+	let mut rest = args;
+	while let Some((arg, tail)) = rest.split_first() {
+		match arg.to_ascii_uppercase().as_slice() {
+			b"NX" => options.nx = true,
+			b"XX" => options.xx = true,
+			b"CH" => options.ch = true,
+			_ => break,
+		}
+		rest = tail;
+	}
+	if options.nx && options.xx {
+		return Err("ERR XX and NX options at the same time are not compatible".to_string());
+	}
+	if rest.is_empty() || !rest.len().is_multiple_of(3) {
+		return Err(
+			"ERR syntax error. Try GEOADD key [x1] [y1] [name1] [x2] [y2] [name2] ... ".to_string(),
+		);
+	}
+
+	let mut points = Vec::with_capacity(rest.len() / 3);
+	for chunk in rest.chunks_exact(3) {
+		let longitude = utils::parse_float(&chunk[0])?;
+		let latitude = utils::parse_float(&chunk[1])?;
+		let point = GeoPoint::new(longitude, latitude).ok_or_else(|| {
+			format!("ERR invalid longitude,latitude pair {longitude:.6},{latitude:.6}")
+		})?;
+		points.push((point, chunk[2].clone()));
+	}
+	Ok((options, points))
+}
+
+#[async_trait]
+impl Cmd for GeoAddCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let key = args[0].clone();
+		let (options, points) = match parse_args(&args[1..]) {
+			Ok(parsed) => parsed,
+			Err(e) => return RespValue::error(e),
+		};
+
+		match storage.geoadd(key, points, options).await {
+			Ok(count) => RespValue::Integer(count as i64),
+			Err(e) => RespValue::error(e.to_string()),
+		}
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use rstest::rstest;
+
+	use super::*;
+
+	fn args(args: &[&'static str]) -> Vec<Bytes> {
+		args.iter().map(|arg| Bytes::from(*arg)).collect()
+	}
+
+	#[test]
+	fn test_parse_args() {
+		let (options, points) =
+			parse_args(&args(&["xx", "CH", "13.5", "38.1", "Palermo"])).unwrap();
+		assert_eq!(
+			options,
+			ZAddOptions {
+				nx: false,
+				xx: true,
+				ch: true,
+			}
+		);
+		assert_eq!(
+			points,
+			vec![(GeoPoint::new(13.5, 38.1).unwrap(), Bytes::from("Palermo"))]
+		);
+	}
+
+	#[rstest]
+	#[case(&["NX", "XX", "1", "2", "m"], "not compatible")]
+	#[case(&["1", "2"], "syntax error")]
+	#[case(&["NX"], "syntax error")]
+	#[case(&["x", "2", "m"], "not a valid float")]
+	#[case(&["200", "2", "m"], "invalid longitude,latitude pair 200.000000,2.000000")]
+	#[case(&["0", "86", "m"], "invalid longitude,latitude pair")]
+	fn test_parse_args_errors(#[case] input: &[&'static str], #[case] expected: &str) {
+		let err = parse_args(&args(input)).unwrap_err();
+		assert!(err.contains(expected), "{err}");
+	}
+}
@@ -0,0 +1,55 @@
+use async_trait::async_trait;
+use bytes::Bytes;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+use nimbis_storage::geo::GeoUnit;
+
+use super::CmdContext;
+use crate::cmd::Cmd;
+use crate::cmd::CmdMeta;
+use crate::cmd::utils;
+
+pub struct GeoDistCmd {
+	meta: CmdMeta,
+}
+
+impl Default for GeoDistCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "GEODIST".to_string(),
+				// GEODIST key member1 member2 [M | KM | FT | MI]
+				arity: -4,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for GeoDistCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let key = args[0].clone();
+		let unit = match &args[3..] {
+			[] => GeoUnit::Meters,
+			[unit] => match GeoUnit::parse(unit) {
+				Some(unit) => unit,
+				None => {
+					return RespValue::error(
+						"ERR unsupported unit provided. please use M, KM, FT, MI",
+					);
+				}
+			},
+			_ => return RespValue::error("ERR syntax error"),
+		};
+
+		match storage.geodist(key, args[1].clone(), args[2].clone()).await {
+			Ok(Some(meters)) => utils::geo_distance_reply(meters, unit),
+			Ok(None) => RespValue::Null,
+			Err(e) => RespValue::error(e.to_string()),
+		}
+	}
+}
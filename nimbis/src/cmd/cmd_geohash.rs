@@ -0,0 +1,45 @@
+use async_trait::async_trait;
+use bytes::Bytes;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+
+use super::CmdContext;
+use crate::cmd::Cmd;
+use crate::cmd::CmdMeta;
+
+pub struct GeoHashCmd {
+	meta: CmdMeta,
+}
+
+impl Default for GeoHashCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "GEOHASH".to_string(),
+				// GEOHASH key [member [member ...]]
+				arity: -2,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for GeoHashCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let key = args[0].clone();
+		let members = args[1..].to_vec();
+
+		match storage.geohash(key, members).await {
+			Ok(hashes) => RespValue::array(
+				hashes
+					.into_iter()
+					.map(|hash| hash.map_or(RespValue::Null, RespValue::bulk_string)),
+			),
+			Err(e) => RespValue::error(e.to_string()),
+		}
+	}
+}
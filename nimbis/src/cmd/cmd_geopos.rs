@@ -0,0 +1,46 @@
+use async_trait::async_trait;
+use bytes::Bytes;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+
+use super::CmdContext;
+use crate::cmd::Cmd;
+use crate::cmd::CmdMeta;
+use crate::cmd::utils;
+
+pub struct GeoPosCmd {
+	meta: CmdMeta,
+}
+
+impl Default for GeoPosCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "GEOPOS".to_string(),
+				// GEOPOS key [member [member ...]]
+				arity: -2,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for GeoPosCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let key = args[0].clone();
+		let members = args[1..].to_vec();
+
+		match storage.geopos(key, members).await {
+			Ok(points) => RespValue::array(
+				points
+					.into_iter()
+					.map(|point| point.map_or(RespValue::Null, utils::geo_point_reply)),
+			),
+			Err(e) => RespValue::error(e.to_string()),
+		}
+	}
+}
@@ -0,0 +1,265 @@
+use async_trait::async_trait;
+use bytes::Bytes;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+use nimbis_storage::geo::GeoPoint;
+use nimbis_storage::geo::GeoUnit;
+use nimbis_storage::geo::search::GeoShape;
+use nimbis_storage::storage_geo::GeoMatch;
+use nimbis_storage::storage_geo::GeoOrder;
+use nimbis_storage::storage_geo::GeoOrigin;
+use nimbis_storage::storage_geo::GeoSearch;
+
+use super::CmdContext;
+use crate::cmd::Cmd;
+use crate::cmd::CmdMeta;
+use crate::cmd::utils;
+
+pub struct GeoSearchCmd {
+	meta: CmdMeta,
+}
+
+impl Default for GeoSearchCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "GEOSEARCH".to_string(),
+				// GEOSEARCH key <FROMMEMBER member | FROMLONLAT longitude latitude>
+				// <BYRADIUS radius <M | KM | FT | MI> | BYBOX width height <M | KM | FT | MI>>
+				// [ASC | DESC] [COUNT count [ANY]] [WITHCOORD] [WITHDIST] [WITHHASH]
+				arity: -7,
+			},
+		}
+	}
+}
+
+/// Options of GEOSEARCH and GEOSEARCHSTORE beyond the query itself.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub(super) struct SearchOptions {
+	pub with_coord: bool,
+	pub with_dist: bool,
+	pub with_hash: bool,
+	/// GEOSEARCHSTORE only: store distances instead of positions.
+	pub store_dist: bool,
+}
+
+/// Parse a GEOSEARCH query after the key, or a GEOSEARCHSTORE one after the
+/// source key with `store`. Also returns the unit of the shape, which
+/// distances are given in.
+pub(super) fn parse_search(
+	args: &[Bytes],
+	store: bool,
+) -> Result<(GeoSearch, GeoUnit, SearchOptions), String> {
+	let name = if store { "GEOSEARCHSTORE" } else { "GEOSEARCH" };
+	let mut origin = None;
+	let mut shape = None;
+	let mut unit = GeoUnit::Meters;
+	let mut order = None;
+	let mut count = None;
+	let mut any = false;
+	let mut options = SearchOptions::default();
+
+	let mut i = 0;
+	while i < args.len() {
+		let remaining = args.len() - i - 1;
+		match args[i].to_ascii_uppercase().as_slice() {
+			b"FROMMEMBER" if remaining >= 1 && origin.is_none() => {
+				origin = Some(GeoOrigin::Member(args[i + 1].clone()));
+				i += 1;
+			}
+			b"FROMLONLAT" if remaining >= 2 && origin.is_none() => {
+				let longitude = utils::parse_float(&args[i + 1])?;
+				let latitude = utils::parse_float(&args[i + 2])?;
+				let point = GeoPoint::new(longitude, latitude).ok_or_else(|| {
+					format!("ERR invalid longitude,latitude pair {longitude:.6},{latitude:.6}")
+				})?;
+				origin = Some(GeoOrigin::Point(point));
+				i += 2;
+			}
+			b"BYRADIUS" if remaining >= 2 && shape.is_none() => {
+				let radius = utils::parse_float(&args[i + 1])?;
+				if radius < 0.0 {
+					return Err("ERR radius cannot be negative".to_string());
+				}
+				unit = parse_unit(&args[i + 2])?;
+				shape = Some(GeoShape::Radius(radius * unit.meters()));
+				i += 2;
+			}
+			b"BYBOX" if remaining >= 3 && shape.is_none() => {
+				let width = utils::parse_float(&args[i + 1])?;
+				let height = utils::parse_float(&args[i + 2])?;
+				if width < 0.0 || height < 0.0 {
+					return Err("ERR height or width cannot be negative".to_string());
+				}
+				unit = parse_unit(&args[i + 3])?;
+				shape = Some(GeoShape::Box {
+					width: width * unit.meters(),
+					height: height * unit.meters(),
+				});
+				i += 3;
+			}
+			b"ASC" => order = Some(GeoOrder::Asc),
+			b"DESC" => order = Some(GeoOrder::Desc),
+			b"COUNT" if remaining >= 1 => {
+				let value = utils::parse_int::<i64>(&args[i + 1])
+					.ok()
+					.filter(|value| *value > 0)
+					.ok_or_else(|| "ERR COUNT must be > 0".to_string())?;
+				count = Some(value as usize);
+				i += 1;
+			}
+			b"ANY" => any = true,
+			b"WITHCOORD" if !store => options.with_coord = true,
+			b"WITHDIST" if !store => options.with_dist = true,
+			b"WITHHASH" if !store => options.with_hash = true,
+			b"STOREDIST" if store => options.store_dist = true,
+			_ => return Err("ERR syntax error".to_string()),
+		}
+		i += 1;
+	}
+
+	let Some(origin) = origin else {
+		return Err(format!(
+			"ERR exactly one of FROMMEMBER or FROMLONLAT can be specified for {name}"
+		));
+	};
+	let Some(shape) = shape else {
+		return Err(format!(
+			"ERR exactly one of BYRADIUS and BYBOX can be specified for {name}"
+		));
+	};
+	if any && count.is_none() {
+		return Err("ERR the ANY argument requires COUNT argument".to_string());
+	}
+
+	let query = GeoSearch {
+		origin,
+		shape,
+		order,
+		count,
+		any,
+	};
+	Ok((query, unit, options))
+}
+
+fn parse_unit(unit: &[u8]) -> Result<GeoUnit, String> {
+	GeoUnit::parse(unit)
+		.ok_or_else(|| "ERR unsupported unit provided. please use M, KM, FT, MI".to_string())
+}
+
+/// Encode matches as member names, or as arrays of the name followed by the
+/// distance, hash and position when asked for.
+fn reply(matches: Vec<GeoMatch>, unit: GeoUnit, options: SearchOptions) -> RespValue {
+	let plain = !(options.with_coord || options.with_dist || options.with_hash);
+	RespValue::array(matches.into_iter().map(|found| {
+		if plain {
+			return RespValue::bulk_string(found.member);
+		}
+		let mut item = vec![RespValue::bulk_string(found.member)];
+		if options.with_dist {
+			item.push(utils::geo_distance_reply(found.distance, unit));
+		}
+		if options.with_hash {
+			item.push(RespValue::Integer(found.score as i64));
+		}
+		if options.with_coord {
+			item.push(utils::geo_point_reply(GeoPoint::from_score(found.score)));
+		}
+		RespValue::array(item)
+	}))
+}
+
+#[async_trait]
+impl Cmd for GeoSearchCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let key = args[0].clone();
+		let (query, unit, options) = match parse_search(&args[1..], false) {
+			Ok(parsed) => parsed,
+			Err(e) => return RespValue::error(e),
+		};
+
+		match storage.geosearch(key, query).await {
+			Ok(matches) => reply(matches, unit, options),
+			Err(e) => RespValue::error(e.to_string()),
+		}
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use rstest::rstest;
+
+	use super::*;
+
+	fn args(args: &[&'static str]) -> Vec<Bytes> {
+		args.iter().map(|arg| Bytes::from(*arg)).collect()
+	}
+
+	#[test]
+	fn test_parse_search() {
+		let input = args(&[
+			"fromlonlat",
+			"15",
+			"37",
+			"BYBOX",
+			"400",
+			"200",
+			"km",
+			"DESC",
+			"COUNT",
+			"3",
+			"ANY",
+			"WITHDIST",
+			"withcoord",
+		]);
+		let (query, unit, options) = parse_search(&input, false).unwrap();
+		assert_eq!(
+			query,
+			GeoSearch {
+				origin: GeoOrigin::Point(GeoPoint::new(15.0, 37.0).unwrap()),
+				shape: GeoShape::Box {
+					width: 400_000.0,
+					height: 200_000.0,
+				},
+				order: Some(GeoOrder::Desc),
+				count: Some(3),
+				any: true,
+			}
+		);
+		assert_eq!(unit, GeoUnit::Kilometers);
+		assert!(options.with_dist && options.with_coord && !options.with_hash);
+
+		let input = args(&["FROMMEMBER", "a", "BYRADIUS", "10", "ft", "STOREDIST"]);
+		let (query, unit, options) = parse_search(&input, true).unwrap();
+		assert_eq!(query.origin, GeoOrigin::Member(Bytes::from("a")));
+		assert_eq!(query.shape, GeoShape::Radius(10.0 * 0.3048));
+		assert_eq!(unit, GeoUnit::Feet);
+		assert!(options.store_dist);
+	}
+
+	#[rstest]
+	#[case(&["BYRADIUS", "1", "m"], false, "exactly one of FROMMEMBER or FROMLONLAT can be specified for GEOSEARCH")]
+	#[case(&["FROMMEMBER", "a"], true, "exactly one of BYRADIUS and BYBOX can be specified for GEOSEARCHSTORE")]
+	#[case(&["FROMMEMBER", "a", "FROMMEMBER", "b", "BYRADIUS", "1", "m"], false, "syntax error")]
+	#[case(&["FROMMEMBER", "a", "BYRADIUS", "1", "m", "BYBOX", "1", "1", "m"], false, "syntax error")]
+	#[case(&["FROMLONLAT", "200", "0", "BYRADIUS", "1", "m"], false, "invalid longitude,latitude pair 200.000000,0.000000")]
+	#[case(&["FROMMEMBER", "a", "BYRADIUS", "-1", "m"], false, "radius cannot be negative")]
+	#[case(&["FROMMEMBER", "a", "BYBOX", "1", "-1", "m"], false, "height or width cannot be negative")]
+	#[case(&["FROMMEMBER", "a", "BYRADIUS", "1", "yd"], false, "unsupported unit")]
+	#[case(&["FROMMEMBER", "a", "BYRADIUS", "1", "m", "COUNT", "0"], false, "COUNT must be > 0")]
+	#[case(&["FROMMEMBER", "a", "BYRADIUS", "1", "m", "ANY"], false, "ANY argument requires COUNT")]
+	#[case(&["FROMMEMBER", "a", "BYRADIUS", "1", "m", "STOREDIST"], false, "syntax error")]
+	#[case(&["FROMMEMBER", "a", "BYRADIUS", "1", "m", "WITHDIST"], true, "syntax error")]
+	fn test_parse_search_errors(
+		#[case] input: &[&'static str],
+		#[case] store: bool,
+		#[case] expected: &str,
+	) {
+		let err = parse_search(&args(input), store).unwrap_err();
+		assert!(err.contains(expected), "{err}");
+	}
+}
@@ -0,0 +1,49 @@
+use async_trait::async_trait;
+use bytes::Bytes;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+
+use super::CmdContext;
+use super::cmd_geosearch;
+use crate::cmd::Cmd;
+use crate::cmd::CmdMeta;
+
+pub struct GeoSearchStoreCmd {
+	meta: CmdMeta,
+}
+
+impl Default for GeoSearchStoreCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "GEOSEARCHSTORE".to_string(),
+				// GEOSEARCHSTORE destination source <FROMMEMBER member | FROMLONLAT longitude
+				// latitude> <BYRADIUS radius <M | KM | FT | MI> | BYBOX width height <M | KM |
+				// FT | MI>> [ASC | DESC] [COUNT count [ANY]] [STOREDIST]
+				arity: -8,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for GeoSearchStoreCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let dest = args[0].clone();
+		let src = args[1].clone();
+		let (query, unit, options) = match cmd_geosearch::parse_search(&args[2..], true) {
+			Ok(parsed) => parsed,
+			Err(e) => return RespValue::error(e),
+		};
+		let store_dist = options.store_dist.then_some(unit);
+
+		match storage.geosearchstore(dest, src, query, store_dist).await {
+			Ok(count) => RespValue::Integer(count as i64),
+			Err(e) => RespValue::error(e.to_string()),
+		}
+	}
+}
@@ -0,0 +1,45 @@
+use async_trait::async_trait;
+use bytes::Bytes;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+
+use super::CmdContext;
+use crate::cmd::Cmd;
+use crate::cmd::CmdMeta;
+use crate::cmd::utils;
+
+pub struct GetBitCmd {
+	meta: CmdMeta,
+}
+
+impl Default for GetBitCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "GETBIT".to_string(),
+				// GETBIT key offset
+				arity: 3,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for GetBitCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let key = args[0].clone();
+		let offset = match utils::parse_bit_offset(&args[1]) {
+			Ok(offset) => offset,
+			Err(e) => return RespValue::error(e),
+		};
+
+		match storage.getbit(key, offset).await {
+			Ok(bit) => RespValue::Integer(bit as i64),
+			Err(e) => RespValue::error(e.to_string()),
+		}
+	}
+}
@@ -8,6 +8,9 @@ use nimbis_storage::Storage;
 use super::Cmd;
 use super::CmdContext;
 use super::CmdMeta;
+use crate::GCTX;
+use crate::acl;
+use crate::cluster;
 
 /// HELLO command implementation
 pub struct HelloCmd {
@@ -19,7 +22,7 @@ impl Default for HelloCmd {
 		Self {
 			meta: CmdMeta {
 				name: "HELLO".to_string(),
-				arity: -1, // HELLO [protover]
+				arity: -1, // HELLO [protover [AUTH username password]]
 			},
 		}
 	}
@@ -57,7 +60,7 @@ impl HelloCmd {
 			RespValue::bulk_string("id"),
 			RespValue::integer(client_id),
 			RespValue::bulk_string("mode"),
-			RespValue::bulk_string("standalone"),
+			RespValue::bulk_string(cluster::mode()),
 			RespValue::bulk_string("role"),
 			RespValue::bulk_string("master"),
 			RespValue::bulk_string("modules"),
@@ -85,7 +88,7 @@ impl HelloCmd {
 		);
 		map.insert(
 			RespValue::bulk_string(Bytes::from_static(b"mode")),
-			RespValue::bulk_string(Bytes::from_static(b"standalone")),
+			RespValue::bulk_string(Bytes::from_static(cluster::mode().as_bytes())),
 		);
 		map.insert(
 			RespValue::bulk_string(Bytes::from_static(b"role")),
@@ -106,11 +109,35 @@ impl Cmd for HelloCmd {
 	}
 
 	async fn do_cmd(&self, _storage: &Storage, args: &[Bytes], ctx: &CmdContext) -> RespValue {
-		let proto = match Self::parse_proto(args) {
+		let (proto, options) = args.split_at(args.len().min(1));
+		let proto = match Self::parse_proto(proto) {
 			Ok(proto) => proto,
 			Err(err) => return err,
 		};
 
+		match options {
+			[] => {
+				if GCTX!(client_sessions).get_user(ctx.client_id).is_none() {
+					return RespValue::error(
+						"NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time",
+					);
+				}
+			}
+			[option, user, password] if option.eq_ignore_ascii_case(b"AUTH") => {
+				let user = String::from_utf8_lossy(user).into_owned();
+				if let Err(err) = acl::authenticate(ctx.client_id, user, password) {
+					return RespValue::error(err);
+				}
+			}
+			[option, ..] => {
+				return RespValue::error(format!(
+					"ERR Syntax error in HELLO option '{}'",
+					String::from_utf8_lossy(option)
+				));
+			}
+		}
+
+		GCTX!(client_sessions).set_resp3(ctx.client_id, proto == 3);
 		if proto == 2 {
 			Self::resp2_hello(proto, ctx.client_id)
 		} else {
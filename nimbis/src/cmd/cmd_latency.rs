@@ -0,0 +1,260 @@
+use async_trait::async_trait;
+use bytes::Bytes;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+
+use super::Cmd;
+use super::CmdContext;
+use super::CmdMeta;
+use super::SubCmds;
+use crate::GCTX;
+use crate::latency::LatencyEvent;
+use crate::server_config;
+
+const HELP: &[&str] = &[
+	"DOCTOR",
+	"    Return a human readable latency analysis report.",
+	"HISTOGRAM [<command> ...]",
+	"    Return a cumulative distribution of latencies in the format of a histogram",
+	"    for the specified command names. If no commands are specified then all",
+	"    histograms are replied.",
+	"HISTORY <event>",
+	"    Return time-latency samples for the <event> class.",
+	"LATEST",
+	"    Return the latest latency samples for all events.",
+	"RESET [<event> ...]",
+	"    Reset latency data of one or more <event> classes.",
+	"    (default: reset all data for all event classes)",
+];
+
+/// Latency command implementation.
+pub struct LatencyCmd {
+	meta: CmdMeta,
+	sub_cmds: SubCmds,
+}
+
+impl Default for LatencyCmd {
+	fn default() -> Self {
+		let mut sub_cmds = SubCmds::new("LATENCY", HELP);
+
+		sub_cmds.insert("LATEST", Box::new(LatencyLatestCmd::default()));
+		sub_cmds.insert("HISTORY", Box::new(LatencyHistoryCmd::default()));
+		sub_cmds.insert("RESET", Box::new(LatencyResetCmd::default()));
+		sub_cmds.insert("DOCTOR", Box::new(LatencyDoctorCmd::default()));
+		sub_cmds.insert("HISTOGRAM", Box::new(LatencyHistogramCmd::default()));
+
+		Self {
+			meta: CmdMeta {
+				name: "LATENCY".to_string(),
+				arity: -2,
+			},
+			sub_cmds,
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for LatencyCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	fn sub_cmds(&self) -> Option<&SubCmds> {
+		Some(&self.sub_cmds)
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], ctx: &CmdContext) -> RespValue {
+		self.sub_cmds.dispatch(storage, args, ctx).await
+	}
+}
+
+pub struct LatencyLatestCmd {
+	meta: CmdMeta,
+}
+
+impl Default for LatencyLatestCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "LATEST".to_string(),
+				arity: 1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for LatencyLatestCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, _args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		RespValue::array(
+			GCTX!(latency_monitor)
+				.latest()
+				.into_iter()
+				.filter_map(|(event, ts)| {
+					let latest = ts.latest()?;
+					Some(RespValue::array(vec![
+						RespValue::bulk_string(event.name()),
+						RespValue::integer(latest.time),
+						RespValue::integer(latest.latency as i64),
+						RespValue::integer(ts.max as i64),
+					]))
+				}),
+		)
+	}
+}
+
+pub struct LatencyHistoryCmd {
+	meta: CmdMeta,
+}
+
+impl Default for LatencyHistoryCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "HISTORY".to_string(),
+				arity: 2,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for LatencyHistoryCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let Some(event) = LatencyEvent::from_name(&String::from_utf8_lossy(&args[0])) else {
+			return RespValue::array(vec![]);
+		};
+
+		RespValue::array(
+			GCTX!(latency_monitor)
+				.history(event)
+				.into_iter()
+				.map(|sample| {
+					RespValue::array(vec![
+						RespValue::integer(sample.time),
+						RespValue::integer(sample.latency as i64),
+					])
+				}),
+		)
+	}
+}
+
+pub struct LatencyResetCmd {
+	meta: CmdMeta,
+}
+
+impl Default for LatencyResetCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "RESET".to_string(),
+				arity: -1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for LatencyResetCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let events = args
+			.iter()
+			.filter_map(|arg| LatencyEvent::from_name(&String::from_utf8_lossy(arg)))
+			.collect::<Vec<_>>();
+		// Only unknown event names were given, so there is nothing to reset.
+		if !args.is_empty() && events.is_empty() {
+			return RespValue::integer(0);
+		}
+
+		RespValue::integer(GCTX!(latency_monitor).reset(&events) as i64)
+	}
+}
+
+pub struct LatencyDoctorCmd {
+	meta: CmdMeta,
+}
+
+impl Default for LatencyDoctorCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "DOCTOR".to_string(),
+				arity: 1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for LatencyDoctorCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, _args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let report = GCTX!(latency_monitor).doctor(server_config!(latency_monitor_threshold));
+		RespValue::bulk_string(report)
+	}
+}
+
+pub struct LatencyHistogramCmd {
+	meta: CmdMeta,
+}
+
+impl Default for LatencyHistogramCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "HISTOGRAM".to_string(),
+				arity: -1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for LatencyHistogramCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let names = args
+			.iter()
+			.map(|arg| String::from_utf8_lossy(arg).into_owned())
+			.collect::<Vec<_>>();
+
+		let mut reply = Vec::new();
+		for (name, histogram) in GCTX!(command_latencies).histograms(&names) {
+			let buckets = histogram
+				.cumulative()
+				.into_iter()
+				.flat_map(|(bucket, calls)| {
+					[
+						RespValue::integer(bucket as i64),
+						RespValue::integer(calls as i64),
+					]
+				});
+			reply.push(RespValue::bulk_string(name));
+			reply.push(RespValue::array(vec![
+				RespValue::bulk_string("calls"),
+				RespValue::integer(histogram.calls() as i64),
+				RespValue::bulk_string("histogram_usec"),
+				RespValue::array(buckets),
+			]));
+		}
+		RespValue::array(reply)
+	}
+}
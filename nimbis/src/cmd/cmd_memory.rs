@@ -0,0 +1,145 @@
+use async_trait::async_trait;
+use bytes::Bytes;
+use log::debug;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+
+use super::Cmd;
+use super::CmdContext;
+use super::CmdMeta;
+use super::SubCmds;
+use super::utils;
+
+const HELP: &[&str] = &[
+	"USAGE <key> [SAMPLES <count>]",
+	"    Return the storage footprint in bytes of <key> and its value.",
+	"    Nested values are sampled up to <count> times (default: 5, 0 means sample all).",
+	"PURGE",
+	"    Drop cached records, flush the memtables and return free allocator memory to the OS.",
+];
+
+/// Number of collection elements sampled by `MEMORY USAGE` by default.
+const DEFAULT_USAGE_SAMPLES: usize = 5;
+
+/// Memory command implementation.
+pub struct MemoryCmd {
+	meta: CmdMeta,
+	sub_cmds: SubCmds,
+}
+
+impl Default for MemoryCmd {
+	fn default() -> Self {
+		let mut sub_cmds = SubCmds::new("MEMORY", HELP);
+
+		sub_cmds.insert("USAGE", Box::new(MemoryUsageCmd::default()));
+		sub_cmds.insert("PURGE", Box::new(MemoryPurgeCmd::default()));
+
+		Self {
+			meta: CmdMeta {
+				name: "MEMORY".to_string(),
+				arity: -2,
+			},
+			sub_cmds,
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for MemoryCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	fn sub_cmds(&self) -> Option<&SubCmds> {
+		Some(&self.sub_cmds)
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], ctx: &CmdContext) -> RespValue {
+		self.sub_cmds.dispatch(storage, args, ctx).await
+	}
+}
+
+pub struct MemoryUsageCmd {
+	meta: CmdMeta,
+}
+
+impl Default for MemoryUsageCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "USAGE".to_string(),
+				arity: -2,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for MemoryUsageCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let key = args[0].clone();
+		let samples = match &args[1..] {
+			[] => DEFAULT_USAGE_SAMPLES,
+			[option, count] if option.eq_ignore_ascii_case(b"SAMPLES") => {
+				match utils::parse_int::<usize>(count) {
+					Ok(n) => n,
+					Err(e) => return RespValue::error(e),
+				}
+			}
+			_ => return RespValue::error("ERR syntax error"),
+		};
+
+		match storage.memory_usage(key, samples).await {
+			Ok(Some(bytes)) => RespValue::integer(bytes as i64),
+			Ok(None) => RespValue::null(),
+			Err(e) => RespValue::error(e.to_string()),
+		}
+	}
+}
+
+pub struct MemoryPurgeCmd {
+	meta: CmdMeta,
+}
+
+impl Default for MemoryPurgeCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "PURGE".to_string(),
+				arity: 1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for MemoryPurgeCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, _args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		if let Err(e) = storage.purge_memory().await {
+			return RespValue::error(e.to_string());
+		}
+		purge_allocator();
+		RespValue::simple_string("OK")
+	}
+}
+
+/// Hand the free pages of the allocator back to the OS. Without it, glibc
+/// keeps the memory of freed values mapped, so RSS stays up after large
+/// deletions.
+#[cfg(all(target_os = "linux", target_env = "gnu"))]
+fn purge_allocator() {
+	// SAFETY: malloc_trim only releases memory that is not in use.
+	let released = unsafe { libc::malloc_trim(0) };
+	debug!("malloc_trim released memory: {}", released == 1);
+}
+
+#[cfg(not(all(target_os = "linux", target_env = "gnu")))]
+fn purge_allocator() {}
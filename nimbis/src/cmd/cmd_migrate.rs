@@ -0,0 +1,281 @@
+//! MIGRATE: move keys to another nimbis or Redis instance.
+//!
+//! The keys are read as DUMP payloads and sent as RESTORE commands over a
+//! new connection, pipelined behind AUTH and SELECT when those are needed.
+//! Each key is deleted here only once the target has acknowledged its
+//! RESTORE, so a failed transfer never loses a key; with COPY nothing is
+//! deleted. The keys stay locked from the DUMP to the delete, so a write to
+//! one of them waits for the transfer rather than landing on a key whose
+//! copy the target already holds. In cluster mode the keys are sent as
+//! RESTORE-ASKING, which a node importing their slot accepts without
+//! ASKING.
+
+use std::time::Duration;
+
+use async_trait::async_trait;
+use bytes::Bytes;
+use bytes::BytesMut;
+use nimbis_resp::RespEncoder;
+use nimbis_resp::RespParseResult;
+use nimbis_resp::RespParser;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+use nimbis_storage::error::StorageError;
+use nimbis_storage::rdb;
+use nimbis_storage::rdb::RdbEntry;
+use tokio::io::AsyncReadExt;
+use tokio::io::AsyncWriteExt;
+use tokio::net::TcpStream;
+
+use super::Cmd;
+use super::CmdContext;
+use super::CmdMeta;
+use super::utils;
+use crate::GCTX;
+use crate::server_config;
+
+/// Timeout used for a `timeout` argument of 0 or less, as in Redis.
+const DEFAULT_TIMEOUT: Duration = Duration::from_millis(1000);
+
+/// MIGRATE host port key|"" destination-db timeout [COPY] [REPLACE]
+/// [AUTH password] [AUTH2 username password] [KEYS key [key ...]]
+pub struct MigrateCmd {
+	meta: CmdMeta,
+}
+
+impl Default for MigrateCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "MIGRATE".to_string(),
+				arity: -6,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for MigrateCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let host = String::from_utf8_lossy(&args[0]).into_owned();
+		let port = match utils::parse_int::<u16>(&args[1]) {
+			Ok(port) => port,
+			Err(e) => return RespValue::error(e),
+		};
+		let db = match utils::parse_int::<i64>(&args[3]) {
+			Ok(db) => db,
+			Err(e) => return RespValue::error(e),
+		};
+		let timeout = match utils::parse_int::<i64>(&args[4]) {
+			Ok(ms) if ms > 0 => Duration::from_millis(ms as u64),
+			Ok(_) => DEFAULT_TIMEOUT,
+			Err(e) => return RespValue::error(e),
+		};
+
+		let mut copy = false;
+		let mut replace = false;
+		let mut auth: Vec<Bytes> = Vec::new();
+		let mut keys = vec![args[2].clone()];
+		let mut i = 5;
+		while i < args.len() {
+			match String::from_utf8_lossy(&args[i]).to_uppercase().as_str() {
+				"COPY" => copy = true,
+				"REPLACE" => replace = true,
+				"AUTH" if i + 1 < args.len() => {
+					auth = vec![args[i + 1].clone()];
+					i += 1;
+				}
+				"AUTH2" if i + 2 < args.len() => {
+					auth = vec![args[i + 1].clone(), args[i + 2].clone()];
+					i += 2;
+				}
+				"KEYS" => {
+					if !args[2].is_empty() {
+						return RespValue::error(
+							"ERR When using MIGRATE KEYS option, the key argument must be set to the empty string",
+						);
+					}
+					keys = args[i + 1..].to_vec();
+					break;
+				}
+				_ => return RespValue::error("ERR syntax error"),
+			}
+			i += 1;
+		}
+
+		let target = Target {
+			host,
+			port,
+			db,
+			timeout,
+			replace,
+			auth,
+		};
+		// Every key is read first, so nothing is sent when one of them
+		// cannot be serialized.
+		let (reply, deleted) = match storage
+			.transfer_entries(keys, !copy, |entries| target.send(entries))
+			.await
+		{
+			Ok(transferred) => transferred,
+			Err(StorageError::InvalidArgument { message }) => return RespValue::error(message),
+			Err(e) => return RespValue::error(format!("ERR {}", e)),
+		};
+		// Replicas delete the keys too, rather than migrating them again.
+		if !deleted.is_empty() {
+			let mut del = vec![Bytes::from_static(b"DEL")];
+			del.extend(deleted);
+			GCTX!(replication).propagate(&del);
+		}
+		reply
+	}
+}
+
+/// Where MIGRATE sends the keys, and how.
+struct Target {
+	host: String,
+	port: u16,
+	db: i64,
+	timeout: Duration,
+	replace: bool,
+	auth: Vec<Bytes>,
+}
+
+impl Target {
+	/// Send `entries` as RESTORE commands, and return the reply of MIGRATE
+	/// with the keys the target acknowledged.
+	async fn send(&self, entries: Vec<RdbEntry>) -> (RespValue, Vec<Bytes>) {
+		if entries.is_empty() {
+			return (RespValue::simple_string("NOKEY"), Vec::new());
+		}
+
+		let mut commands = Vec::new();
+		if !self.auth.is_empty() {
+			commands.push(command("AUTH", self.auth.clone()));
+		}
+		// The target may be a nimbis server, which only has database 0 and
+		// no SELECT.
+		if self.db != 0 {
+			commands.push(command("SELECT", vec![Bytes::from(self.db.to_string())]));
+		}
+		let prelude = commands.len();
+		let restore = if server_config!(cluster_enabled) {
+			"RESTORE-ASKING"
+		} else {
+			"RESTORE"
+		};
+		let now = chrono::Utc::now().timestamp_millis();
+		for entry in &entries {
+			// A TTL of 0 means no expiry, so a key about to expire keeps at
+			// least 1ms.
+			let ttl = entry.expire_ts.map_or(0, |ts| (ts - now).max(1));
+			let mut restore_args = vec![
+				entry.key.clone(),
+				Bytes::from(ttl.to_string()),
+				rdb::dump(&entry.value),
+			];
+			if self.replace {
+				restore_args.push(Bytes::from_static(b"REPLACE"));
+			}
+			commands.push(command(restore, restore_args));
+		}
+
+		let replies = match send_commands(&self.host, self.port, &commands, self.timeout).await {
+			Ok(replies) => replies,
+			Err(e) => return (RespValue::error(e), Vec::new()),
+		};
+		if let Some(message) = replies[..prelude].iter().find_map(error_message) {
+			return (target_error(&message), Vec::new());
+		}
+
+		let mut first_error = None;
+		let mut moved = Vec::new();
+		for (entry, reply) in entries.into_iter().zip(&replies[prelude..]) {
+			match error_message(reply) {
+				Some(message) => {
+					first_error.get_or_insert(message);
+				}
+				None => moved.push(entry.key),
+			}
+		}
+		let reply = match first_error {
+			Some(message) => target_error(&message),
+			None => RespValue::simple_string("OK"),
+		};
+		(reply, moved)
+	}
+}
+
+fn command(name: &'static str, args: Vec<Bytes>) -> RespValue {
+	RespValue::array(
+		std::iter::once(Bytes::from_static(name.as_bytes()))
+			.chain(args)
+			.map(RespValue::bulk_string),
+	)
+}
+
+fn error_message(reply: &RespValue) -> Option<String> {
+	match reply {
+		RespValue::Error(message) | RespValue::BulkError(message) => {
+			Some(String::from_utf8_lossy(message).into_owned())
+		}
+		_ => None,
+	}
+}
+
+fn target_error(message: &str) -> RespValue {
+	RespValue::error(format!(
+		"ERR Target instance replied with error: {}",
+		message
+	))
+}
+
+/// Send `commands` to `host:port` in one pipeline and read a reply to each,
+/// waiting at most `timeout` for the connection and for each read and write.
+async fn send_commands(
+	host: &str,
+	port: u16,
+	commands: &[RespValue],
+	timeout: Duration,
+) -> Result<Vec<RespValue>, String> {
+	let mut stream = match tokio::time::timeout(timeout, TcpStream::connect((host, port))).await {
+		Ok(Ok(stream)) => stream,
+		_ => return Err("IOERR error or timeout connecting to the client".to_string()),
+	};
+
+	let mut buf = BytesMut::new();
+	for command in commands {
+		command
+			.encode_to(&mut buf)
+			.map_err(|e| format!("ERR {}", e))?;
+	}
+	match tokio::time::timeout(timeout, stream.write_all(&buf)).await {
+		Ok(Ok(())) => {}
+		_ => return Err("IOERR error or timeout writing to target instance".to_string()),
+	}
+
+	let mut parser = RespParser::new();
+	let mut buf = BytesMut::new();
+	let mut replies = Vec::with_capacity(commands.len());
+	while replies.len() < commands.len() {
+		match parser.parse(&mut buf) {
+			RespParseResult::Complete(reply) => {
+				replies.push(reply);
+				continue;
+			}
+			RespParseResult::Incomplete => {}
+			RespParseResult::Error(e) => {
+				return Err(format!("IOERR error reading from target instance: {}", e));
+			}
+		}
+		match tokio::time::timeout(timeout, stream.read_buf(&mut buf)).await {
+			Ok(Ok(n)) if n > 0 => {}
+			_ => return Err("IOERR error or timeout reading to target instance".to_string()),
+		}
+	}
+	Ok(replies)
+}
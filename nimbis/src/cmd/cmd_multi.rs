@@ -0,0 +1,100 @@
+//! Transaction commands.
+//!
+//! MULTI, EXEC and DISCARD need the per-connection queue, so
+//! `ClientConnection` handles them itself. They are registered here for
+//! lookup and arity checks; reaching `do_cmd` means they were invoked from a
+//! context without a connection, which is rejected.
+
+use async_trait::async_trait;
+use bytes::Bytes;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+
+use super::Cmd;
+use super::CmdContext;
+use super::CmdMeta;
+
+fn not_allowed(meta: &CmdMeta) -> RespValue {
+	RespValue::error(format!("ERR {} is not allowed in this context", meta.name))
+}
+
+/// MULTI command implementation.
+pub struct MultiCmd {
+	meta: CmdMeta,
+}
+
+impl Default for MultiCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "MULTI".to_string(),
+				arity: 1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for MultiCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, _args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		not_allowed(&self.meta)
+	}
+}
+
+/// EXEC command implementation.
+pub struct ExecCmd {
+	meta: CmdMeta,
+}
+
+impl Default for ExecCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "EXEC".to_string(),
+				arity: 1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for ExecCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, _args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		not_allowed(&self.meta)
+	}
+}
+
+/// DISCARD command implementation.
+pub struct DiscardCmd {
+	meta: CmdMeta,
+}
+
+impl Default for DiscardCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "DISCARD".to_string(),
+				arity: 1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for DiscardCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, _args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		not_allowed(&self.meta)
+	}
+}
@@ -0,0 +1,282 @@
+//! NIMBIS: administration commands specific to nimbis.
+
+use std::path::Path;
+
+use async_trait::async_trait;
+use bytes::Bytes;
+use log::info;
+use log::warn;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+use nimbis_storage::error::StorageError;
+
+use super::Cmd;
+use super::CmdContext;
+use super::CmdMeta;
+use super::SubCmds;
+use crate::GCTX;
+
+const HELP: &[&str] = &[
+	"BIGKEYS [START]",
+	"    With START, start a background scan for the largest keys of each type by",
+	"    element count and estimated bytes. Without, report what the last scan found.",
+	"EXPORT",
+	"    Write the dataset as a Redis RDB file to snapshot/dump.rdb in the object store.",
+	"    Streams and extension types are left out.",
+	"GC",
+	"    Start a background pass deleting the elements of deleted and replaced",
+	"    collections. Progress is reported by INFO storage.",
+	"IMPORT",
+	"    Load the Redis RDB file at snapshot/dump.rdb in the object store. Each key in",
+	"    the file replaces the stored one; other keys are kept.",
+	"RESTORE <path> CONFIRM",
+	"    Replace the whole dataset with the backup written by BACKUP to <path>.",
+];
+
+/// NIMBIS command implementation.
+pub struct NimbisCmd {
+	meta: CmdMeta,
+	sub_cmds: SubCmds,
+}
+
+impl Default for NimbisCmd {
+	fn default() -> Self {
+		let mut sub_cmds = SubCmds::new("NIMBIS", HELP);
+
+		sub_cmds.insert("BIGKEYS", Box::new(NimbisBigKeysCmd::default()));
+		sub_cmds.insert("EXPORT", Box::new(NimbisExportCmd::default()));
+		sub_cmds.insert("GC", Box::new(NimbisGcCmd::default()));
+		sub_cmds.insert("IMPORT", Box::new(NimbisImportCmd::default()));
+		sub_cmds.insert("RESTORE", Box::new(NimbisRestoreCmd::default()));
+
+		Self {
+			meta: CmdMeta {
+				name: "NIMBIS".to_string(),
+				arity: -2,
+			},
+			sub_cmds,
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for NimbisCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	fn sub_cmds(&self) -> Option<&SubCmds> {
+		Some(&self.sub_cmds)
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], ctx: &CmdContext) -> RespValue {
+		self.sub_cmds.dispatch(storage, args, ctx).await
+	}
+}
+
+pub struct NimbisExportCmd {
+	meta: CmdMeta,
+}
+
+impl Default for NimbisExportCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "EXPORT".to_string(),
+				arity: 1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for NimbisExportCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, _args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let export = match storage.export_rdb().await {
+			Ok(export) => export,
+			Err(e) => return RespValue::error(format!("ERR {}", e)),
+		};
+		info!("Exported {} keys to {}", export.keys, export.path);
+		if export.skipped > 0 {
+			warn!(
+				"Left {} extension keys out of the RDB export",
+				export.skipped
+			);
+		}
+
+		RespValue::array(vec![
+			RespValue::bulk_string("path"),
+			RespValue::bulk_string(export.path),
+			RespValue::bulk_string("keys"),
+			RespValue::integer(export.keys as i64),
+			RespValue::bulk_string("skipped"),
+			RespValue::integer(export.skipped as i64),
+		])
+	}
+}
+
+pub struct NimbisImportCmd {
+	meta: CmdMeta,
+}
+
+impl Default for NimbisImportCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "IMPORT".to_string(),
+				arity: 1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for NimbisImportCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, _args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let import = match storage.import_stored_rdb().await {
+			Ok(import) => import,
+			Err(StorageError::InvalidArgument { message }) => return RespValue::error(message),
+			Err(e) => return RespValue::error(format!("ERR {}", e)),
+		};
+		info!("Imported {} keys from the stored RDB file", import.keys);
+		GCTX!(replication).disconnect_replicas();
+		if import.skipped > 0 {
+			warn!(
+				"Left {} non-zero database keys out of the RDB import",
+				import.skipped
+			);
+		}
+
+		RespValue::array(vec![
+			RespValue::bulk_string("keys"),
+			RespValue::integer(import.keys as i64),
+			RespValue::bulk_string("skipped"),
+			RespValue::integer(import.skipped as i64),
+		])
+	}
+}
+
+pub struct NimbisRestoreCmd {
+	meta: CmdMeta,
+}
+
+impl Default for NimbisRestoreCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "RESTORE".to_string(),
+				arity: -2,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for NimbisRestoreCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		match args {
+			[_] => {
+				return RespValue::error(
+					"ERR NIMBIS RESTORE replaces the whole dataset, add CONFIRM to proceed",
+				);
+			}
+			[_, confirm] if confirm.eq_ignore_ascii_case(b"CONFIRM") => {}
+			_ => return RespValue::error("ERR syntax error"),
+		}
+		let dir = String::from_utf8_lossy(&args[0]).into_owned();
+		let backup = match storage.restore_backup(Path::new(&dir)).await {
+			Ok(backup) => backup,
+			Err(StorageError::InvalidArgument { message }) => return RespValue::error(message),
+			Err(e) => return RespValue::error(format!("ERR {}", e)),
+		};
+		warn!(
+			"Replaced the dataset with the backup of {} keys at {}",
+			backup.keys, dir
+		);
+		GCTX!(replication).disconnect_replicas();
+
+		RespValue::array(vec![
+			RespValue::bulk_string("path"),
+			RespValue::bulk_string(backup.path.display().to_string()),
+			RespValue::bulk_string("keys"),
+			RespValue::integer(backup.keys as i64),
+			RespValue::bulk_string("saved_at"),
+			RespValue::integer(backup.saved_at / 1000),
+		])
+	}
+}
+
+pub struct NimbisGcCmd {
+	meta: CmdMeta,
+}
+
+impl Default for NimbisGcCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "GC".to_string(),
+				arity: 1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for NimbisGcCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, _args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		match GCTX!(gc).request() {
+			Ok(()) => RespValue::simple_string("Background GC started"),
+			Err(e) => RespValue::error(e),
+		}
+	}
+}
+
+pub struct NimbisBigKeysCmd {
+	meta: CmdMeta,
+}
+
+impl Default for NimbisBigKeysCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "BIGKEYS".to_string(),
+				arity: -1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for NimbisBigKeysCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let bigkeys = GCTX!(bigkeys);
+		match args {
+			[] => bigkeys.report(),
+			[start] if start.eq_ignore_ascii_case(b"START") => match bigkeys.request() {
+				Ok(()) => RespValue::simple_string("Background big keys scan started"),
+				Err(e) => RespValue::error(e),
+			},
+			_ => RespValue::error("ERR syntax error"),
+		}
+	}
+}
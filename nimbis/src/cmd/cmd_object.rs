@@ -0,0 +1,124 @@
+use async_trait::async_trait;
+use bytes::Bytes;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+
+use super::Cmd;
+use super::CmdContext;
+use super::CmdMeta;
+use super::SubCmds;
+use crate::GCTX;
+
+const HELP: &[&str] = &[
+	"FREQ <key>",
+	"    Return the access frequency index of the key. The returned integer is",
+	"    proportional to the logarithm of the recent access frequency of the key.",
+	"IDLETIME <key>",
+	"    Return the idle time of the key, that is the approximated number of",
+	"    seconds elapsed since the last access to the key.",
+];
+
+/// Object command implementation.
+pub struct ObjectCmd {
+	meta: CmdMeta,
+	sub_cmds: SubCmds,
+}
+
+impl Default for ObjectCmd {
+	fn default() -> Self {
+		let mut sub_cmds = SubCmds::new("OBJECT", HELP);
+
+		sub_cmds.insert("FREQ", Box::new(ObjectFreqCmd::default()));
+		sub_cmds.insert("IDLETIME", Box::new(ObjectIdleTimeCmd::default()));
+
+		Self {
+			meta: CmdMeta {
+				name: "OBJECT".to_string(),
+				arity: -2,
+			},
+			sub_cmds,
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for ObjectCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	fn sub_cmds(&self) -> Option<&SubCmds> {
+		Some(&self.sub_cmds)
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], ctx: &CmdContext) -> RespValue {
+		self.sub_cmds.dispatch(storage, args, ctx).await
+	}
+}
+
+/// Reply with `stat` of `key`, or null if there is no such key.
+async fn key_stat(storage: &Storage, key: &Bytes, stat: impl FnOnce() -> i64) -> RespValue {
+	match storage.exists(key.clone()).await {
+		Ok(true) => RespValue::integer(stat()),
+		Ok(false) => RespValue::null(),
+		Err(e) => RespValue::error(format!("ERR {}", e)),
+	}
+}
+
+pub struct ObjectFreqCmd {
+	meta: CmdMeta,
+}
+
+impl Default for ObjectFreqCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "FREQ".to_string(),
+				arity: 2,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for ObjectFreqCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		key_stat(storage, &args[0], || {
+			GCTX!(access).frequency(&args[0]) as i64
+		})
+		.await
+	}
+}
+
+pub struct ObjectIdleTimeCmd {
+	meta: CmdMeta,
+}
+
+impl Default for ObjectIdleTimeCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "IDLETIME".to_string(),
+				arity: 2,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for ObjectIdleTimeCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		key_stat(storage, &args[0], || {
+			GCTX!(access).idle_time(&args[0]) as i64
+		})
+		.await
+	}
+}
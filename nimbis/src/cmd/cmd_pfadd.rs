@@ -0,0 +1,41 @@
+use async_trait::async_trait;
+use bytes::Bytes;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+
+use super::CmdContext;
+use crate::cmd::Cmd;
+use crate::cmd::CmdMeta;
+
+pub struct PfAddCmd {
+	meta: CmdMeta,
+}
+
+impl Default for PfAddCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "PFADD".to_string(),
+				// PFADD key [element [element ...]]
+				arity: -2,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for PfAddCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let key = args[0].clone();
+		let elements = args[1..].to_vec();
+
+		match storage.pfadd(key, elements).await {
+			Ok(changed) => RespValue::Integer(changed as i64),
+			Err(e) => RespValue::error(e.to_string()),
+		}
+	}
+}
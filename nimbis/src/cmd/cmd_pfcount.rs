@@ -0,0 +1,38 @@
+use async_trait::async_trait;
+use bytes::Bytes;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+
+use super::CmdContext;
+use crate::cmd::Cmd;
+use crate::cmd::CmdMeta;
+
+pub struct PfCountCmd {
+	meta: CmdMeta,
+}
+
+impl Default for PfCountCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "PFCOUNT".to_string(),
+				// PFCOUNT key [key ...]
+				arity: -2,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for PfCountCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		match storage.pfcount(args.iter().cloned()).await {
+			Ok(count) => RespValue::Integer(count as i64),
+			Err(e) => RespValue::error(e.to_string()),
+		}
+	}
+}
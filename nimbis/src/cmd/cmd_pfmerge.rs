@@ -0,0 +1,41 @@
+use async_trait::async_trait;
+use bytes::Bytes;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+
+use super::CmdContext;
+use crate::cmd::Cmd;
+use crate::cmd::CmdMeta;
+
+pub struct PfMergeCmd {
+	meta: CmdMeta,
+}
+
+impl Default for PfMergeCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "PFMERGE".to_string(),
+				// PFMERGE destkey [sourcekey [sourcekey ...]]
+				arity: -2,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for PfMergeCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let dest = args[0].clone();
+		let sources = args[1..].to_vec();
+
+		match storage.pfmerge(dest, sources).await {
+			Ok(()) => RespValue::simple_string("OK"),
+			Err(e) => RespValue::error(e.to_string()),
+		}
+	}
+}
@@ -0,0 +1,301 @@
+//! Pub/sub commands.
+//!
+//! The subscribe commands change the subscriptions of the connection and
+//! reply once per channel or pattern, so `ClientConnection` handles them
+//! itself. They are registered here for lookup and arity checks; reaching
+//! `do_cmd` means they were invoked from a context without a connection,
+//! which is rejected.
+
+use async_trait::async_trait;
+use bytes::Bytes;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+
+use super::Cmd;
+use super::CmdContext;
+use super::CmdMeta;
+use super::SubCmds;
+use crate::GCTX;
+
+const HELP: &[&str] = &[
+	"CHANNELS [<pattern>]",
+	"    Return the currently active channels matching a <pattern> (default: '*').",
+	"NUMPAT",
+	"    Return number of subscriptions to patterns.",
+	"NUMSUB [<channel> ...]",
+	"    Return the number of subscribers for the specified channels, excluding",
+	"    pattern subscriptions(default: no channels).",
+];
+
+fn not_allowed(meta: &CmdMeta) -> RespValue {
+	RespValue::error(format!("ERR {} is not allowed in this context", meta.name))
+}
+
+/// SUBSCRIBE command implementation.
+pub struct SubscribeCmd {
+	meta: CmdMeta,
+}
+
+impl Default for SubscribeCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "SUBSCRIBE".to_string(),
+				arity: -2,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for SubscribeCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, _args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		not_allowed(&self.meta)
+	}
+}
+
+/// UNSUBSCRIBE command implementation.
+pub struct UnsubscribeCmd {
+	meta: CmdMeta,
+}
+
+impl Default for UnsubscribeCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "UNSUBSCRIBE".to_string(),
+				arity: -1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for UnsubscribeCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, _args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		not_allowed(&self.meta)
+	}
+}
+
+/// PSUBSCRIBE command implementation.
+pub struct PSubscribeCmd {
+	meta: CmdMeta,
+}
+
+impl Default for PSubscribeCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "PSUBSCRIBE".to_string(),
+				arity: -2,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for PSubscribeCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, _args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		not_allowed(&self.meta)
+	}
+}
+
+/// PUNSUBSCRIBE command implementation.
+pub struct PUnsubscribeCmd {
+	meta: CmdMeta,
+}
+
+impl Default for PUnsubscribeCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "PUNSUBSCRIBE".to_string(),
+				arity: -1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for PUnsubscribeCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, _args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		not_allowed(&self.meta)
+	}
+}
+
+/// PUBLISH command implementation.
+pub struct PublishCmd {
+	meta: CmdMeta,
+}
+
+impl Default for PublishCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "PUBLISH".to_string(),
+				arity: 3,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for PublishCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let receivers = GCTX!(pubsub).publish(&args[0], &args[1]);
+		RespValue::integer(receivers as i64)
+	}
+}
+
+/// PUBSUB command implementation.
+pub struct PubsubCmd {
+	meta: CmdMeta,
+	sub_cmds: SubCmds,
+}
+
+impl Default for PubsubCmd {
+	fn default() -> Self {
+		let mut sub_cmds = SubCmds::new("PUBSUB", HELP);
+
+		sub_cmds.insert("CHANNELS", Box::new(PubsubChannelsCmd::default()));
+		sub_cmds.insert("NUMSUB", Box::new(PubsubNumsubCmd::default()));
+		sub_cmds.insert("NUMPAT", Box::new(PubsubNumpatCmd::default()));
+
+		Self {
+			meta: CmdMeta {
+				name: "PUBSUB".to_string(),
+				arity: -2,
+			},
+			sub_cmds,
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for PubsubCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	fn sub_cmds(&self) -> Option<&SubCmds> {
+		Some(&self.sub_cmds)
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], ctx: &CmdContext) -> RespValue {
+		self.sub_cmds.dispatch(storage, args, ctx).await
+	}
+}
+
+pub struct PubsubChannelsCmd {
+	meta: CmdMeta,
+}
+
+impl Default for PubsubChannelsCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "CHANNELS".to_string(),
+				arity: -1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for PubsubChannelsCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		if args.len() > 1 {
+			return RespValue::error("ERR wrong number of arguments for 'pubsub|channels' command");
+		}
+
+		let pattern = args.first().map(|pattern| &pattern[..]);
+		RespValue::array(
+			GCTX!(pubsub)
+				.channels(pattern)
+				.into_iter()
+				.map(RespValue::bulk_string),
+		)
+	}
+}
+
+pub struct PubsubNumsubCmd {
+	meta: CmdMeta,
+}
+
+impl Default for PubsubNumsubCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "NUMSUB".to_string(),
+				arity: -1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for PubsubNumsubCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let pubsub = GCTX!(pubsub);
+		RespValue::array(args.iter().flat_map(|channel| {
+			[
+				RespValue::bulk_string(channel.clone()),
+				RespValue::integer(pubsub.numsub(channel) as i64),
+			]
+		}))
+	}
+}
+
+pub struct PubsubNumpatCmd {
+	meta: CmdMeta,
+}
+
+impl Default for PubsubNumpatCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "NUMPAT".to_string(),
+				arity: 1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for PubsubNumpatCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, _args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		RespValue::integer(GCTX!(pubsub).numpat() as i64)
+	}
+}
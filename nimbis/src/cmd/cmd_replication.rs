@@ -0,0 +1,382 @@
+//! Replication commands.
+//!
+//! PSYNC turns the connection into a replication link, so
+//! `ClientConnection` handles it itself. It is registered here for
+//! lookup and arity checks; reaching `do_cmd` means it was invoked from a
+//! context without a connection, which is rejected.
+//!
+//! FAILOVER replies once the handover has started; INFO reports its
+//! progress in `master_failover_state`.
+//!
+//! In cluster mode, replicas are set up with CLUSTER REPLICATE and promoted
+//! with CLUSTER FAILOVER, so REPLICAOF, SLAVEOF and FAILOVER are refused.
+
+use std::time::Duration;
+
+use async_trait::async_trait;
+use bytes::Bytes;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+
+use super::Cmd;
+use super::CmdContext;
+use super::CmdMeta;
+use super::utils;
+use crate::GCTX;
+use crate::replication::Role;
+use crate::server_config;
+
+fn not_allowed(meta: &CmdMeta) -> RespValue {
+	RespValue::error(format!("ERR {} is not allowed in this context", meta.name))
+}
+
+/// Shared by REPLICAOF and its old name SLAVEOF.
+fn replica_of(storage: &Storage, args: &[Bytes]) -> RespValue {
+	if server_config!(cluster_enabled) {
+		return RespValue::error("ERR REPLICAOF not allowed in cluster mode.");
+	}
+	let replication = GCTX!(replication);
+	if args[0].eq_ignore_ascii_case(b"NO") && args[1].eq_ignore_ascii_case(b"ONE") {
+		replication.stop_replicating();
+		return RespValue::simple_string("OK");
+	}
+	let host = String::from_utf8_lossy(&args[0]).to_string();
+	let port = match utils::parse_int::<u16>(&args[1]) {
+		Ok(port) => port,
+		Err(_) => return RespValue::error("ERR Invalid master port"),
+	};
+	if replication.is_replica_of(&host, port) {
+		return RespValue::simple_string("OK Already connected to specified master");
+	}
+	replication.replicate_from(host, port, storage.clone());
+	RespValue::simple_string("OK")
+}
+
+/// REPLICAOF command implementation.
+pub struct ReplicaOfCmd {
+	meta: CmdMeta,
+}
+
+impl Default for ReplicaOfCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "REPLICAOF".to_string(),
+				arity: 3,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for ReplicaOfCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		replica_of(storage, args)
+	}
+}
+
+/// SLAVEOF command implementation.
+pub struct SlaveOfCmd {
+	meta: CmdMeta,
+}
+
+impl Default for SlaveOfCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "SLAVEOF".to_string(),
+				arity: 3,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for SlaveOfCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		replica_of(storage, args)
+	}
+}
+
+/// REPLCONF command implementation.
+///
+/// Only `listening-port` is used, so INFO can report the port a replica
+/// serves clients on; other options are accepted and ignored.
+pub struct ReplConfCmd {
+	meta: CmdMeta,
+}
+
+impl Default for ReplConfCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "REPLCONF".to_string(),
+				arity: -1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for ReplConfCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, args: &[Bytes], ctx: &CmdContext) -> RespValue {
+		if args.len() % 2 != 0 {
+			return RespValue::error("ERR syntax error");
+		}
+		for pair in args.chunks(2) {
+			if pair[0].eq_ignore_ascii_case(b"listening-port") {
+				match utils::parse_int::<u16>(&pair[1]) {
+					Ok(port) => GCTX!(replication).set_listening_port(ctx.client_id, port),
+					Err(e) => return RespValue::error(e),
+				}
+			}
+		}
+		RespValue::simple_string("OK")
+	}
+}
+
+/// PSYNC command implementation.
+pub struct PsyncCmd {
+	meta: CmdMeta,
+}
+
+impl Default for PsyncCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "PSYNC".to_string(),
+				arity: 3,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for PsyncCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, _args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		not_allowed(&self.meta)
+	}
+}
+
+/// READWRITE command implementation.
+///
+/// Lets the connection write on a read-only replica, until READONLY or
+/// RESET. In cluster mode, it also stops the reads from replicas READONLY
+/// allows.
+pub struct ReadWriteCmd {
+	meta: CmdMeta,
+}
+
+impl Default for ReadWriteCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "READWRITE".to_string(),
+				arity: 1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for ReadWriteCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, _args: &[Bytes], ctx: &CmdContext) -> RespValue {
+		GCTX!(client_sessions).set_readwrite(ctx.client_id, true);
+		GCTX!(client_sessions).set_readonly(ctx.client_id, false);
+		RespValue::simple_string("OK")
+	}
+}
+
+/// READONLY command implementation.
+///
+/// Makes the connection follow `replica_read_only` again. In cluster mode,
+/// it also lets a replica serve the connection reads of the slots of its
+/// primary, instead of redirecting them.
+pub struct ReadOnlyCmd {
+	meta: CmdMeta,
+}
+
+impl Default for ReadOnlyCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "READONLY".to_string(),
+				arity: 1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for ReadOnlyCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, _args: &[Bytes], ctx: &CmdContext) -> RespValue {
+		GCTX!(client_sessions).set_readwrite(ctx.client_id, false);
+		GCTX!(client_sessions).set_readonly(ctx.client_id, true);
+		RespValue::simple_string("OK")
+	}
+}
+
+/// FAILOVER command implementation.
+///
+/// `FAILOVER [TO host port [FORCE]] [ABORT] [TIMEOUT milliseconds]`
+pub struct FailoverCmd {
+	meta: CmdMeta,
+}
+
+impl Default for FailoverCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "FAILOVER".to_string(),
+				arity: -1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for FailoverCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		if server_config!(cluster_enabled) {
+			return RespValue::error("ERR FAILOVER not allowed in cluster mode.");
+		}
+		let mut target = None;
+		let mut force = false;
+		let mut abort = false;
+		let mut timeout = None;
+		let mut i = 0;
+		while i < args.len() {
+			let arg = &args[i];
+			if arg.eq_ignore_ascii_case(b"TO") && i + 2 < args.len() && target.is_none() {
+				let host = String::from_utf8_lossy(&args[i + 1]).to_string();
+				let port = match utils::parse_int::<u16>(&args[i + 2]) {
+					Ok(port) => port,
+					Err(e) => return RespValue::error(e),
+				};
+				target = Some((host, port));
+				i += 3;
+			} else if arg.eq_ignore_ascii_case(b"TIMEOUT")
+				&& i + 1 < args.len()
+				&& timeout.is_none()
+			{
+				match utils::parse_int::<u64>(&args[i + 1]) {
+					Ok(0) | Err(_) => {
+						return RespValue::error("ERR FAILOVER timeout must be greater than 0");
+					}
+					Ok(ms) => timeout = Some(Duration::from_millis(ms)),
+				}
+				i += 2;
+			} else if arg.eq_ignore_ascii_case(b"FORCE") && !force {
+				force = true;
+				i += 1;
+			} else if arg.eq_ignore_ascii_case(b"ABORT") && !abort {
+				abort = true;
+				i += 1;
+			} else {
+				return RespValue::error("ERR syntax error");
+			}
+		}
+
+		let replication = GCTX!(replication);
+		if abort {
+			if target.is_some() || force || timeout.is_some() {
+				return RespValue::error("ERR syntax error");
+			}
+			return match replication.abort_failover() {
+				Ok(()) => RespValue::simple_string("OK"),
+				Err(e) => RespValue::error(e),
+			};
+		}
+		if force && (target.is_none() || timeout.is_none()) {
+			return RespValue::error(
+				"ERR FAILOVER with force option requires both a timeout and target HOST and IP.",
+			);
+		}
+		match replication.failover(target, timeout, force, storage.clone()) {
+			Ok(()) => RespValue::simple_string("OK"),
+			Err(e) => RespValue::error(e),
+		}
+	}
+}
+
+/// ROLE command implementation.
+///
+/// Lets clients and monitors find the primary: a primary replies with its
+/// offset and its replicas, a replica with its primary and link state.
+pub struct RoleCmd {
+	meta: CmdMeta,
+}
+
+impl Default for RoleCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "ROLE".to_string(),
+				arity: 1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for RoleCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, _args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		match GCTX!(replication).role() {
+			Role::Primary { offset, replicas } => RespValue::array(vec![
+				RespValue::bulk_string("master"),
+				RespValue::integer(offset as i64),
+				RespValue::array(replicas.into_iter().map(|(ip, port, offset)| {
+					RespValue::array(vec![
+						RespValue::bulk_string(ip),
+						RespValue::bulk_string(port),
+						RespValue::bulk_string(offset.to_string()),
+					])
+				})),
+			]),
+			Role::Replica {
+				host,
+				port,
+				link,
+				offset,
+			} => RespValue::array(vec![
+				RespValue::bulk_string("slave"),
+				RespValue::bulk_string(host),
+				RespValue::integer(port as i64),
+				RespValue::bulk_string(link),
+				RespValue::integer(offset as i64),
+			]),
+		}
+	}
+}
@@ -0,0 +1,294 @@
+//! Persistence commands: SAVE, BGSAVE, LASTSAVE, BGREWRITEAOF, COMPACT,
+//! WAITAOF and BACKUP.
+
+use std::path::Path;
+use std::time::Duration;
+
+use async_trait::async_trait;
+use bytes::Bytes;
+use log::info;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+use nimbis_storage::error::StorageError;
+use nimbis_storage::gc::KeyRange;
+
+use super::Cmd;
+use super::CmdContext;
+use super::CmdMeta;
+use super::utils;
+use crate::GCTX;
+
+/// SAVE command implementation.
+pub struct SaveCmd {
+	meta: CmdMeta,
+}
+
+impl Default for SaveCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "SAVE".to_string(),
+				arity: 1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for SaveCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, _args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		match GCTX!(persistence).save(storage).await {
+			Ok(()) => RespValue::simple_string("OK"),
+			Err(e) => RespValue::error(e),
+		}
+	}
+}
+
+/// BGSAVE command implementation.
+pub struct BgSaveCmd {
+	meta: CmdMeta,
+}
+
+impl Default for BgSaveCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "BGSAVE".to_string(),
+				arity: 1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for BgSaveCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, _args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		match GCTX!(persistence).bgsave(storage.clone()) {
+			Ok(()) => RespValue::simple_string("Background saving started"),
+			Err(e) => RespValue::error(e),
+		}
+	}
+}
+
+/// LASTSAVE command implementation.
+pub struct LastSaveCmd {
+	meta: CmdMeta,
+}
+
+impl Default for LastSaveCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "LASTSAVE".to_string(),
+				arity: 1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for LastSaveCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, _args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		RespValue::integer(GCTX!(persistence).last_save())
+	}
+}
+
+/// BGREWRITEAOF command implementation.
+pub struct BgRewriteAofCmd {
+	meta: CmdMeta,
+}
+
+impl Default for BgRewriteAofCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "BGREWRITEAOF".to_string(),
+				arity: 1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for BgRewriteAofCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, _args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		match GCTX!(persistence).bgrewrite(storage.clone()) {
+			Ok(()) => RespValue::simple_string("Background append only file rewriting started"),
+			Err(e) => RespValue::error(e),
+		}
+	}
+}
+
+/// COMPACT command implementation.
+///
+/// COMPACT [first last]
+///
+/// Starts a background compaction run over every key, or over the keys from
+/// `first` to `last`.
+pub struct CompactCmd {
+	meta: CmdMeta,
+}
+
+impl Default for CompactCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "COMPACT".to_string(),
+				arity: -1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for CompactCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let range = match args {
+			[] => None,
+			[first, last] if first <= last => Some(KeyRange {
+				first: first.clone(),
+				last: last.clone(),
+			}),
+			[_, _] => return RespValue::error("ERR the first key of the range is after the last"),
+			_ => return RespValue::error("ERR syntax error"),
+		};
+		match GCTX!(compaction).request(range) {
+			Ok(()) => RespValue::simple_string("Background compaction started"),
+			Err(e) => RespValue::error(e),
+		}
+	}
+}
+
+/// WAITAOF command implementation.
+///
+/// WAITAOF numlocal numreplicas timeout
+///
+/// Waits for the local log to be flushed and for `numreplicas` replicas to
+/// flush their own up to where the stream went when the command ran, both
+/// within `timeout`, and replies how many of each did.
+pub struct WaitAofCmd {
+	meta: CmdMeta,
+}
+
+impl Default for WaitAofCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "WAITAOF".to_string(),
+				arity: 4,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for WaitAofCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let (numlocal, numreplicas) = match (
+			utils::parse_int::<i64>(&args[0]),
+			utils::parse_int::<i64>(&args[1]),
+		) {
+			(Ok(numlocal), Ok(numreplicas)) => (numlocal, numreplicas),
+			(Err(e), _) | (_, Err(e)) => return RespValue::error(e),
+		};
+		if numlocal < 0 || numreplicas < 0 {
+			return RespValue::error("ERR value is out of range, must be positive");
+		}
+		let timeout = match utils::parse_int::<i64>(&args[2]) {
+			Ok(timeout) if timeout < 0 => return RespValue::error("ERR timeout is negative"),
+			Ok(0) => None,
+			Ok(timeout) => Some(Duration::from_millis(timeout as u64)),
+			Err(_) => {
+				return RespValue::error("ERR timeout is not an integer or out of range");
+			}
+		};
+
+		if GCTX!(replication).is_replica() {
+			return RespValue::error(
+				"ERR WAITAOF cannot be used with replica instances. Please also note that writes to replicas are just local and are not propagated.",
+			);
+		}
+
+		let local = async {
+			if numlocal == 0 {
+				return Ok(0);
+			}
+			GCTX!(persistence)
+				.wait_synced(storage.clone(), timeout)
+				.await
+				.map(|synced| synced as i64)
+		};
+		let replicas = GCTX!(replication).wait_fsynced(numreplicas as usize, timeout);
+		match tokio::join!(local, replicas) {
+			(Ok(local), replicas) => RespValue::array(vec![
+				RespValue::integer(local),
+				RespValue::integer(replicas as i64),
+			]),
+			(Err(e), _) => RespValue::error(e),
+		}
+	}
+}
+
+/// BACKUP command implementation.
+pub struct BackupCmd {
+	meta: CmdMeta,
+}
+
+impl Default for BackupCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "BACKUP".to_string(),
+				arity: 2,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for BackupCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let dir = String::from_utf8_lossy(&args[0]).into_owned();
+		let backup = match storage.backup(Path::new(&dir)).await {
+			Ok(backup) => backup,
+			Err(StorageError::InvalidArgument { message }) => return RespValue::error(message),
+			Err(e) => return RespValue::error(format!("ERR {}", e)),
+		};
+		info!("Backup of {} keys written to {}", backup.keys, dir);
+
+		RespValue::array(vec![
+			RespValue::bulk_string("path"),
+			RespValue::bulk_string(backup.path.display().to_string()),
+			RespValue::bulk_string("keys"),
+			RespValue::integer(backup.keys as i64),
+		])
+	}
+}
@@ -0,0 +1,185 @@
+use async_trait::async_trait;
+use bytes::Bytes;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+
+use super::Cmd;
+use super::CmdContext;
+use super::CmdMeta;
+use super::SubCmds;
+use crate::GCTX;
+use crate::script;
+
+const HELP: &[&str] = &[
+	"EXISTS <sha1> [<sha1> ...]",
+	"    Return information about the existence of the scripts in the script cache.",
+	"FLUSH [ASYNC|SYNC]",
+	"    Flush the Lua scripts cache.",
+	"KILL",
+	"    Kill the currently executing Lua script.",
+	"LOAD <script>",
+	"    Load a script into the scripts cache without executing it.",
+];
+
+/// Script command implementation.
+pub struct ScriptCmd {
+	meta: CmdMeta,
+	sub_cmds: SubCmds,
+}
+
+impl Default for ScriptCmd {
+	fn default() -> Self {
+		let mut sub_cmds = SubCmds::new("SCRIPT", HELP);
+
+		sub_cmds.insert("LOAD", Box::new(ScriptLoadCmd::default()));
+		sub_cmds.insert("EXISTS", Box::new(ScriptExistsCmd::default()));
+		sub_cmds.insert("FLUSH", Box::new(ScriptFlushCmd::default()));
+		sub_cmds.insert("KILL", Box::new(ScriptKillCmd::default()));
+
+		Self {
+			meta: CmdMeta {
+				name: "SCRIPT".to_string(),
+				arity: -2,
+			},
+			sub_cmds,
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for ScriptCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	fn sub_cmds(&self) -> Option<&SubCmds> {
+		Some(&self.sub_cmds)
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], ctx: &CmdContext) -> RespValue {
+		self.sub_cmds.dispatch(storage, args, ctx).await
+	}
+}
+
+pub struct ScriptLoadCmd {
+	meta: CmdMeta,
+}
+
+impl Default for ScriptLoadCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "LOAD".to_string(),
+				arity: 2,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for ScriptLoadCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		if let Err(err) = script::compile(&args[0]) {
+			return err;
+		}
+		RespValue::bulk_string(GCTX!(scripts).load(args[0].clone()))
+	}
+}
+
+pub struct ScriptExistsCmd {
+	meta: CmdMeta,
+}
+
+impl Default for ScriptExistsCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "EXISTS".to_string(),
+				arity: -2,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for ScriptExistsCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		RespValue::array(args.iter().map(|sha| {
+			let exists = GCTX!(scripts).exists(&String::from_utf8_lossy(sha));
+			RespValue::integer(exists as i64)
+		}))
+	}
+}
+
+pub struct ScriptFlushCmd {
+	meta: CmdMeta,
+}
+
+impl Default for ScriptFlushCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "FLUSH".to_string(),
+				arity: -1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for ScriptFlushCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		// ASYNC and SYNC are accepted for compatibility; the cache is
+		// in-memory and always cleared synchronously.
+		let valid = match args {
+			[] => true,
+			[mode] => mode.eq_ignore_ascii_case(b"ASYNC") || mode.eq_ignore_ascii_case(b"SYNC"),
+			_ => false,
+		};
+		if !valid {
+			return RespValue::error("ERR SCRIPT FLUSH only support SYNC|ASYNC option");
+		}
+
+		GCTX!(scripts).flush();
+		RespValue::simple_string("OK")
+	}
+}
+
+/// SCRIPT KILL runs without the exec lock, see `script::runs_while_busy`.
+pub struct ScriptKillCmd {
+	meta: CmdMeta,
+}
+
+impl Default for ScriptKillCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "KILL".to_string(),
+				arity: 1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for ScriptKillCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, _args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		GCTX!(running_script).kill()
+	}
+}
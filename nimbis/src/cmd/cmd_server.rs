@@ -0,0 +1,689 @@
+//! Server commands that act on the server or connection rather than on keys.
+
+use std::collections::BTreeMap;
+use std::time::Duration;
+use std::time::SystemTime;
+use std::time::UNIX_EPOCH;
+
+use async_trait::async_trait;
+use bytes::Bytes;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+use nimbis_storage::stats::DbFiles;
+use nimbis_storage::stats::DbStats;
+
+use super::Cmd;
+use super::CmdContext;
+use super::CmdMeta;
+use super::SubCmds;
+use super::utils;
+use crate::GCTX;
+use crate::acl;
+use crate::cluster;
+use crate::config;
+use crate::keyspace;
+use crate::server_config;
+
+const DEBUG_HELP: &[&str] = &[
+	"SLEEP <seconds>",
+	"    Stop the connection for <seconds>. Decimal values are accepted.",
+];
+
+const MODULE_HELP: &[&str] = &[
+	"LIST",
+	"    Return a list of the extensions compiled into the server.",
+];
+
+/// TIME command implementation.
+pub struct TimeCmd {
+	meta: CmdMeta,
+}
+
+impl Default for TimeCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "TIME".to_string(),
+				arity: 1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for TimeCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, _args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let now = SystemTime::now()
+			.duration_since(UNIX_EPOCH)
+			.unwrap_or_default();
+
+		RespValue::array(vec![
+			RespValue::bulk_string(now.as_secs().to_string()),
+			RespValue::bulk_string(now.subsec_micros().to_string()),
+		])
+	}
+}
+
+/// LOLWUT command implementation.
+pub struct LolwutCmd {
+	meta: CmdMeta,
+}
+
+impl Default for LolwutCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "LOLWUT".to_string(),
+				arity: -1,
+			},
+		}
+	}
+}
+
+impl LolwutCmd {
+	const CLOUD: &'static str = concat!(
+		"        .--.\n",
+		"     .-(    ).\n",
+		"    (___.__)__)\n",
+		"  '  '  '  '  '\n",
+	);
+
+	/// Draw `rows` lines of drifting rain below the cloud. The pattern only
+	/// depends on the requested size so repeated calls are stable.
+	fn rain(rows: usize, columns: usize) -> String {
+		let mut art = String::with_capacity(rows * (columns + 1));
+		for row in 0..rows {
+			for column in 0..columns {
+				art.push(if (column + row * 3) % 5 == 0 {
+					'\''
+				} else {
+					' '
+				});
+			}
+			art.push('\n');
+		}
+		art
+	}
+}
+
+#[async_trait]
+impl Cmd for LolwutCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		// LOLWUT [VERSION <version>] [rows] [columns]
+		let mut args = args;
+		if let [option, _version, rest @ ..] = args
+			&& option.eq_ignore_ascii_case(b"VERSION")
+		{
+			args = rest;
+		}
+
+		let mut sizes = [3usize, 16usize];
+		for (size, arg) in sizes.iter_mut().zip(args) {
+			match utils::parse_int::<usize>(arg) {
+				Ok(n) => *size = n.clamp(1, 80),
+				Err(e) => return RespValue::error(e),
+			}
+		}
+
+		let art = format!(
+			"{}{}\nNimbis ver. {}\n",
+			Self::CLOUD,
+			Self::rain(sizes[0], sizes[1]),
+			env!("CARGO_PKG_VERSION")
+		);
+		RespValue::bulk_string(art)
+	}
+}
+
+/// RESET command implementation.
+///
+/// Restores the connection to its initial state. Per-connection features
+/// must clear their state here as well.
+pub struct ResetCmd {
+	meta: CmdMeta,
+}
+
+impl Default for ResetCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "RESET".to_string(),
+				arity: 1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for ResetCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, _args: &[Bytes], ctx: &CmdContext) -> RespValue {
+		GCTX!(client_sessions).reset(ctx.client_id);
+		acl::auto_authenticate(ctx.client_id);
+		GCTX!(tracking).disable(ctx.client_id);
+		RespValue::simple_string("RESET")
+	}
+}
+
+/// DEBUG command implementation.
+pub struct DebugCmd {
+	meta: CmdMeta,
+	sub_cmds: SubCmds,
+}
+
+impl Default for DebugCmd {
+	fn default() -> Self {
+		let mut sub_cmds = SubCmds::new("DEBUG", DEBUG_HELP);
+
+		sub_cmds.insert("SLEEP", Box::new(DebugSleepCmd::default()));
+
+		Self {
+			meta: CmdMeta {
+				name: "DEBUG".to_string(),
+				arity: -2,
+			},
+			sub_cmds,
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for DebugCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	fn sub_cmds(&self) -> Option<&SubCmds> {
+		Some(&self.sub_cmds)
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], ctx: &CmdContext) -> RespValue {
+		self.sub_cmds.dispatch(storage, args, ctx).await
+	}
+}
+
+pub struct DebugSleepCmd {
+	meta: CmdMeta,
+}
+
+impl Default for DebugSleepCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "SLEEP".to_string(),
+				arity: 2,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for DebugSleepCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let seconds = std::str::from_utf8(&args[0])
+			.ok()
+			.and_then(|s| s.parse::<f64>().ok())
+			.filter(|s| s.is_finite() && *s >= 0.0);
+		let Some(seconds) = seconds else {
+			return RespValue::error("ERR value is not a valid float");
+		};
+
+		tokio::time::sleep(Duration::from_secs_f64(seconds)).await;
+		RespValue::simple_string("OK")
+	}
+}
+
+/// INFO command implementation.
+///
+/// INFO [section ...]
+///
+/// Core sections are followed by the sections of compiled-in extensions,
+/// named `<extension>_<section>`. With no argument, or with `default`, `all`
+/// or `everything`, every section is returned, except `storage`, which lists
+/// the object store and is only returned when named or with `everything`.
+pub struct InfoCmd {
+	meta: CmdMeta,
+}
+
+impl Default for InfoCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "INFO".to_string(),
+				arity: -1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for InfoCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let requested: Vec<String> = args
+			.iter()
+			.map(|arg| String::from_utf8_lossy(arg).to_lowercase())
+			.collect();
+		let everything = requested.is_empty()
+			|| requested
+				.iter()
+				.any(|name| matches!(name.as_str(), "default" | "all" | "everything"));
+		let wanted = |name: &str| everything || requested.iter().any(|r| *r == name.to_lowercase());
+
+		let mut sections = Vec::new();
+		if wanted("server") {
+			sections.push((
+				"Server".to_string(),
+				vec![
+					(
+						"nimbis_version".to_string(),
+						env!("CARGO_PKG_VERSION").to_string(),
+					),
+					("process_id".to_string(), std::process::id().to_string()),
+					("tcp_port".to_string(), server_config!(port).to_string()),
+					(
+						"config_file".to_string(),
+						config::config_file()
+							.map(|path| path.display().to_string())
+							.unwrap_or_default(),
+					),
+				],
+			));
+		}
+		if wanted("clients") {
+			let mut fields = GCTX!(client_sessions).info();
+			fields.extend(GCTX!(client_eviction).info());
+			sections.push(("Clients".to_string(), fields));
+		}
+		if wanted("memory") {
+			let mut fields = GCTX!(maxmemory).info();
+			fields.extend(memory_info(storage));
+			sections.push(("Memory".to_string(), fields));
+		}
+		if wanted("persistence") {
+			let mut fields = GCTX!(loading).info();
+			fields.extend(GCTX!(persistence).info());
+			fields.extend(GCTX!(disk).info());
+			sections.push(("Persistence".to_string(), fields));
+		}
+		if wanted("stats") {
+			let mut fields = GCTX!(client_sessions).stats();
+			fields.extend(GCTX!(rate_limiter).stats());
+			fields.extend(GCTX!(lazyfree).stats());
+			fields.extend(GCTX!(expire).stats());
+			fields.extend(GCTX!(client_eviction).stats());
+			fields.extend(hot_cache_stats(storage));
+			sections.push(("Stats".to_string(), fields));
+		}
+		if wanted("commandstats") {
+			sections.push(("Commandstats".to_string(), GCTX!(commandstats).info()));
+		}
+		if wanted("latencystats") {
+			sections.push(("Latencystats".to_string(), GCTX!(command_latencies).info()));
+		}
+		if wanted("replication") {
+			sections.push(("Replication".to_string(), GCTX!(replication).info()));
+		}
+		if wanted("cluster") {
+			sections.push(("Cluster".to_string(), cluster::info_fields()));
+		}
+		if wanted("keyspace") {
+			sections.push(("Keyspace".to_string(), keyspace::info(storage)));
+		}
+		if requested
+			.iter()
+			.any(|name| matches!(name.as_str(), "storage" | "everything"))
+		{
+			match storage.db_stats().await {
+				Ok(stats) => {
+					let mut fields = storage_info(&stats);
+					fields.extend(GCTX!(gc).info());
+					fields.extend(GCTX!(compaction).info());
+					sections.push(("Storage".to_string(), fields));
+				}
+				Err(e) => return RespValue::error(format!("ERR {}", e)),
+			}
+		}
+		if wanted("modules") {
+			let modules = GCTX!(extensions)
+				.iter()
+				.map(|ext| {
+					(
+						"module".to_string(),
+						format!("name={},ver={}", ext.name(), ext.version()),
+					)
+				})
+				.collect();
+			sections.push(("Modules".to_string(), modules));
+		}
+		for ext in GCTX!(extensions).iter() {
+			for section in ext.info() {
+				let name = format!("{}_{}", ext.name(), section.name);
+				if wanted(&name) {
+					sections.push((name, section.fields));
+				}
+			}
+		}
+
+		RespValue::bulk_string(format_info(&sections))
+	}
+}
+
+/// Render INFO sections as `# Title` headers followed by `field:value`
+/// lines, with a blank line between sections.
+fn format_info(sections: &[(String, Vec<(String, String)>)]) -> String {
+	sections
+		.iter()
+		.map(|(title, fields)| {
+			let mut section = format!("# {}\r\n", title);
+			for (field, value) in fields {
+				section.push_str(&format!("{}:{}\r\n", field, value));
+			}
+			section
+		})
+		.collect::<Vec<_>>()
+		.join("\r\n")
+}
+
+/// Render the Memory INFO section: how string values are compressed, and
+/// what was compressed since the server started.
+fn memory_info(storage: &Storage) -> Vec<(String, String)> {
+	let stats = storage.compression_stats();
+	let ratio = if stats.output_bytes > 0 {
+		stats.input_bytes as f64 / stats.output_bytes as f64
+	} else {
+		1.0
+	};
+	vec![
+		("value_compression".to_string(), stats.codec.to_string()),
+		(
+			"value_compression_threshold".to_string(),
+			stats.threshold.to_string(),
+		),
+		("compressed_values".to_string(), stats.values.to_string()),
+		(
+			"compression_input_bytes".to_string(),
+			stats.input_bytes.to_string(),
+		),
+		(
+			"compression_output_bytes".to_string(),
+			stats.output_bytes.to_string(),
+		),
+		("compression_ratio".to_string(), format!("{:.2}", ratio)),
+	]
+}
+
+/// Hot cache fields of the Stats INFO section: its size, and how many reads
+/// it answered since the server started.
+fn hot_cache_stats(storage: &Storage) -> Vec<(String, String)> {
+	let stats = storage.hot_cache_stats();
+	let reads = stats.hits + stats.misses;
+	let hit_rate = if reads > 0 {
+		stats.hits as f64 / reads as f64
+	} else {
+		0.0
+	};
+	vec![
+		("hot_cache_keys".to_string(), stats.keys.to_string()),
+		("hot_cache_max_keys".to_string(), stats.max_keys.to_string()),
+		("hot_cache_hits".to_string(), stats.hits.to_string()),
+		("hot_cache_misses".to_string(), stats.misses.to_string()),
+		("hot_cache_hit_rate".to_string(), format!("{:.2}", hit_rate)),
+	]
+}
+
+/// Render the Storage INFO section: file totals, one line per DB, then the
+/// engine stats summed over the DBs, keeping the latest of timestamps.
+fn storage_info(stats: &[DbStats]) -> Vec<(String, String)> {
+	let mut total = DbFiles::default();
+	let mut metrics = BTreeMap::new();
+	for db in stats {
+		total.sst_files += db.files.sst_files;
+		total.sst_bytes += db.files.sst_bytes;
+		total.wal_files += db.files.wal_files;
+		total.wal_bytes += db.files.wal_bytes;
+		total.manifest_files += db.files.manifest_files;
+		total.total_bytes += db.files.total_bytes;
+		for &(name, value) in &db.metrics {
+			let metric = metrics.entry(name).or_insert(0);
+			if name.contains("timestamp") {
+				*metric = value.max(*metric);
+			} else {
+				*metric += value;
+			}
+		}
+	}
+
+	let mut fields = vec![
+		("sst_files".to_string(), total.sst_files.to_string()),
+		("sst_bytes".to_string(), total.sst_bytes.to_string()),
+		("wal_files".to_string(), total.wal_files.to_string()),
+		("wal_bytes".to_string(), total.wal_bytes.to_string()),
+		(
+			"manifest_files".to_string(),
+			total.manifest_files.to_string(),
+		),
+		("total_bytes".to_string(), total.total_bytes.to_string()),
+	];
+	for db in stats {
+		fields.push((
+			format!("db_{}", db.name),
+			format!(
+				"sst_files={},sst_bytes={},wal_files={},wal_bytes={},total_bytes={}",
+				db.files.sst_files,
+				db.files.sst_bytes,
+				db.files.wal_files,
+				db.files.wal_bytes,
+				db.files.total_bytes
+			),
+		));
+	}
+
+	// The block cache counts hits and misses per kind of block.
+	let (hits, misses) = metrics
+		.iter()
+		.filter(|(name, _)| name.starts_with("dbcache/"))
+		.fold((0, 0), |(hits, misses), (name, &value)| {
+			if name.ends_with("_hit") {
+				(hits + value, misses)
+			} else if name.ends_with("_miss") {
+				(hits, misses + value)
+			} else {
+				(hits, misses)
+			}
+		});
+	if hits + misses > 0 {
+		fields.push((
+			"cache_hit_rate".to_string(),
+			format!("{:.4}", hits as f64 / (hits + misses) as f64),
+		));
+	}
+	for (name, value) in metrics {
+		fields.push((name.replace('/', "_"), value.to_string()));
+	}
+	fields
+}
+
+/// MODULE command implementation.
+///
+/// Extensions are compiled in, so MODULE only lists them.
+pub struct ModuleCmd {
+	meta: CmdMeta,
+	sub_cmds: SubCmds,
+}
+
+impl Default for ModuleCmd {
+	fn default() -> Self {
+		let mut sub_cmds = SubCmds::new("MODULE", MODULE_HELP);
+
+		sub_cmds.insert("LIST", Box::new(ModuleListCmd::default()));
+
+		Self {
+			meta: CmdMeta {
+				name: "MODULE".to_string(),
+				arity: -2,
+			},
+			sub_cmds,
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for ModuleCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	fn sub_cmds(&self) -> Option<&SubCmds> {
+		Some(&self.sub_cmds)
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], ctx: &CmdContext) -> RespValue {
+		self.sub_cmds.dispatch(storage, args, ctx).await
+	}
+}
+
+pub struct ModuleListCmd {
+	meta: CmdMeta,
+}
+
+impl Default for ModuleListCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "LIST".to_string(),
+				arity: 1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for ModuleListCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, _args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		RespValue::array(GCTX!(extensions).iter().map(|ext| {
+			RespValue::array([
+				RespValue::bulk_string("name"),
+				RespValue::bulk_string(ext.name()),
+				RespValue::bulk_string("ver"),
+				RespValue::integer(ext.version() as i64),
+				RespValue::bulk_string("path"),
+				RespValue::bulk_string("builtin"),
+				RespValue::bulk_string("args"),
+				RespValue::array(Vec::new()),
+			])
+		}))
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use nimbis_storage::stats::DbFiles;
+	use nimbis_storage::stats::DbStats;
+
+	use super::LolwutCmd;
+	use super::format_info;
+	use super::storage_info;
+
+	#[test]
+	fn test_lolwut_rain_size() {
+		let rain = LolwutCmd::rain(4, 10);
+		let lines = rain.lines().collect::<Vec<_>>();
+		assert_eq!(lines.len(), 4);
+		assert!(lines.iter().all(|line| line.len() == 10));
+		assert_eq!(rain, LolwutCmd::rain(4, 10));
+	}
+
+	#[test]
+	fn test_format_info() {
+		let sections = vec![
+			(
+				"Server".to_string(),
+				vec![("tcp_port".to_string(), "6379".to_string())],
+			),
+			("Modules".to_string(), vec![]),
+		];
+		assert_eq!(
+			format_info(&sections),
+			"# Server\r\ntcp_port:6379\r\n\r\n# Modules\r\n"
+		);
+		assert_eq!(format_info(&[]), "");
+	}
+
+	#[test]
+	fn test_storage_info() {
+		let db = |name, sst_files, metrics| DbStats {
+			name,
+			files: DbFiles {
+				sst_files,
+				sst_bytes: 100 * sst_files,
+				wal_files: 1,
+				wal_bytes: 10,
+				manifest_files: 2,
+				total_bytes: 100 * sst_files + 20,
+			},
+			metrics,
+		};
+		let fields = storage_info(&[
+			db(
+				"string",
+				2,
+				vec![
+					("db/get_requests", 5),
+					("dbcache/data_block_hit", 3),
+					("compactor/last_compaction_timestamp_sec", 100),
+				],
+			),
+			db(
+				"hash",
+				1,
+				vec![
+					("db/get_requests", 1),
+					("dbcache/data_block_miss", 1),
+					("compactor/last_compaction_timestamp_sec", 90),
+				],
+			),
+		]);
+		let field = |name: &str| {
+			fields
+				.iter()
+				.find(|(field, _)| field == name)
+				.map(|(_, value)| value.as_str())
+		};
+		assert_eq!(field("sst_files"), Some("3"));
+		assert_eq!(field("wal_bytes"), Some("20"));
+		assert_eq!(field("total_bytes"), Some("340"));
+		assert_eq!(
+			field("db_hash"),
+			Some("sst_files=1,sst_bytes=100,wal_files=1,wal_bytes=10,total_bytes=120")
+		);
+		assert_eq!(field("db_get_requests"), Some("6"));
+		assert_eq!(field("cache_hit_rate"), Some("0.7500"));
+		assert_eq!(
+			field("compactor_last_compaction_timestamp_sec"),
+			Some("100")
+		);
+	}
+}
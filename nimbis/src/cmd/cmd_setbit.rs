@@ -0,0 +1,50 @@
+use async_trait::async_trait;
+use bytes::Bytes;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+
+use super::CmdContext;
+use crate::cmd::Cmd;
+use crate::cmd::CmdMeta;
+use crate::cmd::utils;
+
+pub struct SetBitCmd {
+	meta: CmdMeta,
+}
+
+impl Default for SetBitCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "SETBIT".to_string(),
+				// SETBIT key offset value
+				arity: 4,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for SetBitCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let key = args[0].clone();
+		let offset = match utils::parse_bit_offset(&args[1]) {
+			Ok(offset) => offset,
+			Err(e) => return RespValue::error(e),
+		};
+		let value = match args[2].as_ref() {
+			b"0" => false,
+			b"1" => true,
+			_ => return RespValue::error("ERR bit is not an integer or out of range"),
+		};
+
+		match storage.setbit(key, offset, value).await {
+			Ok(old) => RespValue::Integer(old as i64),
+			Err(e) => RespValue::error(e.to_string()),
+		}
+	}
+}
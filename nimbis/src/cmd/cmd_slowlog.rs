@@ -0,0 +1,165 @@
+use async_trait::async_trait;
+use bytes::Bytes;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+
+use super::Cmd;
+use super::CmdContext;
+use super::CmdMeta;
+use super::SubCmds;
+use super::utils;
+use crate::GCTX;
+
+const HELP: &[&str] = &[
+	"GET [<count>]",
+	"    Return top <count> entries from the slowlog (default: 10, -1 mean all).",
+	"    Entries are made of:",
+	"    id, timestamp, time in microseconds, arguments array, client IP and port,",
+	"    client name",
+	"LEN",
+	"    Return the length of the slowlog.",
+	"RESET",
+	"    Reset the slowlog.",
+];
+
+/// Default number of entries returned by `SLOWLOG GET`.
+const DEFAULT_GET_COUNT: i64 = 10;
+
+/// Slowlog command implementation.
+pub struct SlowlogCmd {
+	meta: CmdMeta,
+	sub_cmds: SubCmds,
+}
+
+impl Default for SlowlogCmd {
+	fn default() -> Self {
+		let mut sub_cmds = SubCmds::new("SLOWLOG", HELP);
+
+		sub_cmds.insert("GET", Box::new(SlowlogGetCmd::default()));
+		sub_cmds.insert("LEN", Box::new(SlowlogLenCmd::default()));
+		sub_cmds.insert("RESET", Box::new(SlowlogResetCmd::default()));
+
+		Self {
+			meta: CmdMeta {
+				name: "SLOWLOG".to_string(),
+				arity: -2,
+			},
+			sub_cmds,
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for SlowlogCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	fn sub_cmds(&self) -> Option<&SubCmds> {
+		Some(&self.sub_cmds)
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], ctx: &CmdContext) -> RespValue {
+		self.sub_cmds.dispatch(storage, args, ctx).await
+	}
+}
+
+pub struct SlowlogGetCmd {
+	meta: CmdMeta,
+}
+
+impl Default for SlowlogGetCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "GET".to_string(),
+				arity: -1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for SlowlogGetCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		if args.len() > 1 {
+			return RespValue::error("ERR wrong number of arguments for 'slowlog|get' command");
+		}
+
+		let count = match args.first() {
+			Some(arg) => match utils::parse_int::<i64>(arg) {
+				Ok(n) => n,
+				Err(e) => return RespValue::error(e),
+			},
+			None => DEFAULT_GET_COUNT,
+		};
+		if count < -1 {
+			return RespValue::error("ERR count should be greater than or equal to -1");
+		}
+
+		let count = (count >= 0).then_some(count as usize);
+		RespValue::array(
+			GCTX!(slowlog)
+				.get(count)
+				.iter()
+				.map(|entry| entry.to_resp()),
+		)
+	}
+}
+
+pub struct SlowlogLenCmd {
+	meta: CmdMeta,
+}
+
+impl Default for SlowlogLenCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "LEN".to_string(),
+				arity: 1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for SlowlogLenCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, _args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		RespValue::integer(GCTX!(slowlog).len() as i64)
+	}
+}
+
+pub struct SlowlogResetCmd {
+	meta: CmdMeta,
+}
+
+impl Default for SlowlogResetCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "RESET".to_string(),
+				arity: 1,
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for SlowlogResetCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, _args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		GCTX!(slowlog).reset();
+		RespValue::simple_string("OK")
+	}
+}
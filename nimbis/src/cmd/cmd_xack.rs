@@ -0,0 +1,49 @@
+use async_trait::async_trait;
+use bytes::Bytes;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+
+use super::Cmd;
+use super::CmdContext;
+use super::CmdMeta;
+use super::utils;
+
+pub struct XAckCmd {
+	meta: CmdMeta,
+}
+
+impl Default for XAckCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "XACK".to_string(),
+				arity: -4, // XACK key group id [id ...]
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for XAckCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let key = args[0].clone();
+		let group = args[1].clone();
+		let ids = match args[2..]
+			.iter()
+			.map(|id| utils::parse_stream_id(id, 0))
+			.collect::<Result<Vec<_>, _>>()
+		{
+			Ok(ids) => ids,
+			Err(e) => return RespValue::error(e),
+		};
+
+		match storage.xack(key, group, ids).await {
+			Ok(acked) => RespValue::integer(acked as i64),
+			Err(e) => RespValue::error(e.to_string()),
+		}
+	}
+}
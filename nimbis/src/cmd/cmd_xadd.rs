@@ -0,0 +1,99 @@
+use async_trait::async_trait;
+use bytes::Bytes;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+use nimbis_storage::stream::id::StreamId;
+use nimbis_storage::stream::id::StreamIdSpec;
+
+use super::CmdContext;
+use super::cmd_xtrim::parse_trim;
+use crate::cmd::Cmd;
+use crate::cmd::CmdMeta;
+use crate::cmd::utils;
+
+pub struct XAddCmd {
+	meta: CmdMeta,
+}
+
+impl Default for XAddCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "XADD".to_string(),
+				// XADD key [NOMKSTREAM] [<MAXLEN | MINID> [= | ~] threshold [LIMIT count]]
+				// <* | id> field value [field value ...]
+				arity: -5,
+			},
+		}
+	}
+}
+
+/// Parse the entry ID argument: `*`, `<ms>-*` or an explicit ID.
+fn parse_id_spec(arg: &[u8]) -> Result<StreamIdSpec, String> {
+	if arg == b"*" {
+		return Ok(StreamIdSpec::Auto);
+	}
+	if let Some(ms) = arg.strip_suffix(b"-*") {
+		let id = utils::parse_stream_id(ms, 0)?;
+		return Ok(StreamIdSpec::AutoSeq(id.ms));
+	}
+	let id = utils::parse_stream_id(arg, 0)?;
+	if id == StreamId::MIN {
+		return Err("ERR The ID specified in XADD must be greater than 0-0".to_string());
+	}
+	Ok(StreamIdSpec::Explicit(id))
+}
+
+#[async_trait]
+impl Cmd for XAddCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let key = args[0].clone();
+
+		let mut idx = 1;
+		let mut nomkstream = false;
+		let mut trim = None;
+		while let Some(arg) = args.get(idx) {
+			if arg.eq_ignore_ascii_case(b"NOMKSTREAM") {
+				nomkstream = true;
+				idx += 1;
+			} else if arg.eq_ignore_ascii_case(b"MAXLEN") || arg.eq_ignore_ascii_case(b"MINID") {
+				match parse_trim(&args[idx..]) {
+					Ok((parsed, taken)) => {
+						trim = Some(parsed);
+						idx += taken;
+					}
+					Err(e) => return RespValue::error(e),
+				}
+			} else {
+				break;
+			}
+		}
+
+		let Some(id_arg) = args.get(idx) else {
+			return RespValue::error("ERR syntax error");
+		};
+		let id = match parse_id_spec(id_arg) {
+			Ok(id) => id,
+			Err(e) => return RespValue::error(e),
+		};
+
+		let pairs = &args[idx + 1..];
+		if pairs.is_empty() || !pairs.len().is_multiple_of(2) {
+			return RespValue::error("ERR wrong number of arguments for 'xadd' command");
+		}
+		let fields = pairs
+			.chunks_exact(2)
+			.map(|chunk| (chunk[0].clone(), chunk[1].clone()))
+			.collect();
+
+		match storage.xadd(key, id, fields, nomkstream, trim).await {
+			Ok(Some(id)) => RespValue::bulk_string(id.to_string()),
+			Ok(None) => RespValue::null(),
+			Err(e) => RespValue::error(e.to_string()),
+		}
+	}
+}
@@ -0,0 +1,144 @@
+use async_trait::async_trait;
+use bytes::Bytes;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+
+use super::CmdContext;
+use crate::cmd::Cmd;
+use crate::cmd::CmdMeta;
+use crate::cmd::utils;
+
+/// Entries claimed per call unless COUNT says otherwise.
+const DEFAULT_COUNT: usize = 100;
+
+pub struct XAutoClaimCmd {
+	meta: CmdMeta,
+}
+
+impl Default for XAutoClaimCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "XAUTOCLAIM".to_string(),
+				// XAUTOCLAIM key group consumer min-idle-time start [COUNT count] [JUSTID]
+				arity: -6,
+			},
+		}
+	}
+}
+
+/// Parse the options after start: COUNT and JUSTID.
+fn parse_options(args: &[Bytes]) -> Result<(usize, bool), String> {
+	let mut count = DEFAULT_COUNT;
+	let mut justid = false;
+	let mut idx = 0;
+	while let Some(arg) = args.get(idx) {
+		if arg.eq_ignore_ascii_case(b"JUSTID") {
+			justid = true;
+			idx += 1;
+		} else if arg.eq_ignore_ascii_case(b"COUNT")
+			&& let Some(value) = args.get(idx + 1)
+		{
+			let n = utils::parse_int::<i64>(value)?;
+			// Every call examines up to ten times COUNT entries.
+			if n <= 0 || n > i64::MAX / 10 {
+				return Err("ERR COUNT must be > 0".to_string());
+			}
+			count = n as usize;
+			idx += 2;
+		} else {
+			return Err("ERR syntax error".to_string());
+		}
+	}
+	Ok((count, justid))
+}
+
+#[async_trait]
+impl Cmd for XAutoClaimCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let key = args[0].clone();
+		let group = args[1].clone();
+		let consumer = args[2].clone();
+		let min_idle = match utils::parse_int::<i64>(&args[3]) {
+			Ok(min_idle) => min_idle.max(0) as u64,
+			Err(e) => return RespValue::error(e),
+		};
+		let start = match utils::parse_stream_range_bound(&args[4], true) {
+			Ok(start) => start,
+			Err(e) => return RespValue::error(e),
+		};
+		let (count, justid) = match parse_options(&args[5..]) {
+			Ok(options) => options,
+			Err(e) => return RespValue::error(e),
+		};
+
+		let auto_claim = match storage
+			.xautoclaim(
+				key.clone(),
+				group.clone(),
+				consumer,
+				min_idle,
+				start,
+				count,
+				justid,
+			)
+			.await
+		{
+			Ok(Some(auto_claim)) => auto_claim,
+			Ok(None) => {
+				return RespValue::error(format!(
+					"NOGROUP No such key '{}' or consumer group '{}'",
+					String::from_utf8_lossy(&key),
+					String::from_utf8_lossy(&group)
+				));
+			}
+			Err(e) => return RespValue::error(e.to_string()),
+		};
+
+		let claimed = if justid {
+			RespValue::array(
+				auto_claim
+					.claimed
+					.into_iter()
+					.map(|(id, _)| RespValue::bulk_string(id.to_string())),
+			)
+		} else {
+			utils::stream_group_entries_reply(auto_claim.claimed)
+		};
+		RespValue::array([
+			RespValue::bulk_string(auto_claim.next.to_string()),
+			claimed,
+			RespValue::array(
+				auto_claim
+					.deleted
+					.into_iter()
+					.map(|id| RespValue::bulk_string(id.to_string())),
+			),
+		])
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use rstest::rstest;
+
+	use super::*;
+
+	#[rstest]
+	#[case(&[], Ok((DEFAULT_COUNT, false)))]
+	#[case(&["COUNT", "5", "JUSTID"], Ok((5, true)))]
+	#[case(&["COUNT", "0"], Err("ERR COUNT must be > 0"))]
+	#[case(&["COUNT"], Err("ERR syntax error"))]
+	#[case(&["BOGUS"], Err("ERR syntax error"))]
+	fn test_parse_options(#[case] args: &[&str], #[case] expected: Result<(usize, bool), &str>) {
+		let args: Vec<Bytes> = args
+			.iter()
+			.map(|arg| Bytes::from(arg.to_string()))
+			.collect();
+		assert_eq!(parse_options(&args), expected.map_err(str::to_string));
+	}
+}
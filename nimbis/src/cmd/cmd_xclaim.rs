@@ -0,0 +1,165 @@
+use async_trait::async_trait;
+use bytes::Bytes;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+use nimbis_storage::storage_stream_group::ClaimOptions;
+use nimbis_storage::stream::id::StreamId;
+
+use super::CmdContext;
+use crate::cmd::Cmd;
+use crate::cmd::CmdMeta;
+use crate::cmd::utils;
+
+pub struct XClaimCmd {
+	meta: CmdMeta,
+}
+
+impl Default for XClaimCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "XCLAIM".to_string(),
+				// XCLAIM key group consumer min-idle-time id [id ...] [IDLE ms]
+				// [TIME unix-time-milliseconds] [RETRYCOUNT count] [FORCE] [JUSTID]
+				// [LASTID lastid]
+				arity: -6,
+			},
+		}
+	}
+}
+
+/// Parse a millisecond argument, clamping negative values to zero.
+fn parse_millis(arg: &[u8]) -> Result<u64, String> {
+	Ok(utils::parse_int::<i64>(arg)?.max(0) as u64)
+}
+
+/// Parse the IDs and options after min-idle-time. IDs come first; the first
+/// argument that is not an ID starts the options.
+fn parse_claim(args: &[Bytes], now: u64) -> Result<(Vec<StreamId>, ClaimOptions), String> {
+	let id_count = args
+		.iter()
+		.take_while(|arg| StreamId::parse(arg, 0).is_some())
+		.count();
+	let ids = args[..id_count]
+		.iter()
+		.map(|id| utils::parse_stream_id(id, 0))
+		.collect::<Result<Vec<_>, _>>()?;
+
+	let mut opts = ClaimOptions::default();
+	let mut idx = id_count;
+	while let Some(arg) = args.get(idx) {
+		let value = args.get(idx + 1);
+		if arg.eq_ignore_ascii_case(b"FORCE") {
+			opts.force = true;
+			idx += 1;
+			continue;
+		}
+		if arg.eq_ignore_ascii_case(b"JUSTID") {
+			opts.justid = true;
+			idx += 1;
+			continue;
+		}
+		let Some(value) = value else {
+			return Err("ERR syntax error".to_string());
+		};
+		if arg.eq_ignore_ascii_case(b"IDLE") {
+			opts.delivery_time = Some(now.saturating_sub(parse_millis(value)?));
+		} else if arg.eq_ignore_ascii_case(b"TIME") {
+			opts.delivery_time = Some(parse_millis(value)?);
+		} else if arg.eq_ignore_ascii_case(b"RETRYCOUNT") {
+			opts.retry_count = Some(parse_millis(value)?);
+		} else if arg.eq_ignore_ascii_case(b"LASTID") {
+			opts.last_id = Some(utils::parse_stream_id(value, 0)?);
+		} else {
+			return Err(format!(
+				"ERR Unrecognized XCLAIM option '{}'",
+				String::from_utf8_lossy(arg)
+			));
+		}
+		idx += 2;
+	}
+	// A delivery time in the future would make the entry look never idle.
+	opts.delivery_time = opts.delivery_time.map(|time| time.min(now));
+	Ok((ids, opts))
+}
+
+#[async_trait]
+impl Cmd for XClaimCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let key = args[0].clone();
+		let group = args[1].clone();
+		let consumer = args[2].clone();
+		let min_idle = match parse_millis(&args[3]) {
+			Ok(min_idle) => min_idle,
+			Err(e) => return RespValue::error(e),
+		};
+		let now = chrono::Utc::now().timestamp_millis().max(0) as u64;
+		let (ids, opts) = match parse_claim(&args[4..], now) {
+			Ok(parsed) => parsed,
+			Err(e) => return RespValue::error(e),
+		};
+		let justid = opts.justid;
+
+		match storage
+			.xclaim(key.clone(), group.clone(), consumer, min_idle, ids, opts)
+			.await
+		{
+			Ok(Some(claimed)) if justid => RespValue::array(
+				claimed
+					.into_iter()
+					.map(|(id, _)| RespValue::bulk_string(id.to_string())),
+			),
+			Ok(Some(claimed)) => utils::stream_group_entries_reply(claimed),
+			Ok(None) => RespValue::error(format!(
+				"NOGROUP No such key '{}' or consumer group '{}'",
+				String::from_utf8_lossy(&key),
+				String::from_utf8_lossy(&group)
+			)),
+			Err(e) => RespValue::error(e.to_string()),
+		}
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+
+	fn to_args(args: &[&str]) -> Vec<Bytes> {
+		args.iter()
+			.map(|arg| Bytes::from(arg.to_string()))
+			.collect()
+	}
+
+	#[test]
+	fn test_parse_claim() {
+		let args = to_args(&[
+			"1-1",
+			"2",
+			"IDLE",
+			"500",
+			"RETRYCOUNT",
+			"3",
+			"force",
+			"JUSTID",
+			"LASTID",
+			"5-0",
+		]);
+		let (ids, opts) = parse_claim(&args, 1000).unwrap();
+		assert_eq!(ids, vec![StreamId::new(1, 1), StreamId::new(2, 0)]);
+		assert_eq!(opts.delivery_time, Some(500));
+		assert_eq!(opts.retry_count, Some(3));
+		assert!(opts.force);
+		assert!(opts.justid);
+		assert_eq!(opts.last_id, Some(StreamId::new(5, 0)));
+
+		let (_, opts) = parse_claim(&to_args(&["1-1", "TIME", "5000"]), 1000).unwrap();
+		assert_eq!(opts.delivery_time, Some(1000));
+
+		let err = parse_claim(&to_args(&["1-1", "BOGUS"]), 1000).unwrap_err();
+		assert!(err.contains("Unrecognized XCLAIM option"), "{err}");
+	}
+}
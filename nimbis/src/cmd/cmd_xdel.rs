@@ -0,0 +1,48 @@
+use async_trait::async_trait;
+use bytes::Bytes;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+
+use super::Cmd;
+use super::CmdContext;
+use super::CmdMeta;
+use super::utils;
+
+pub struct XDelCmd {
+	meta: CmdMeta,
+}
+
+impl Default for XDelCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "XDEL".to_string(),
+				arity: -3, // XDEL key id [id ...]
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for XDelCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let key = args[0].clone();
+		let ids = match args[1..]
+			.iter()
+			.map(|id| utils::parse_stream_id(id, 0))
+			.collect::<Result<Vec<_>, _>>()
+		{
+			Ok(ids) => ids,
+			Err(e) => return RespValue::error(e),
+		};
+
+		match storage.xdel(key, ids).await {
+			Ok(deleted) => RespValue::integer(deleted as i64),
+			Err(e) => RespValue::error(e.to_string()),
+		}
+	}
+}
@@ -0,0 +1,252 @@
+use async_trait::async_trait;
+use bytes::Bytes;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+use nimbis_storage::stream::id::StreamId;
+
+use super::Cmd;
+use super::CmdContext;
+use super::CmdMeta;
+use super::SubCmds;
+use super::utils;
+
+const HELP: &[&str] = &[
+	"CREATE <key> <groupname> <id|$> [MKSTREAM]",
+	"    Create a new consumer group. Options are:",
+	"    * MKSTREAM",
+	"      Create the empty stream if it does not exist.",
+	"CREATECONSUMER <key> <groupname> <consumer>",
+	"    Create a new consumer in the specified group.",
+	"DELCONSUMER <key> <groupname> <consumer>",
+	"    Remove the specified consumer.",
+	"DESTROY <key> <groupname>",
+	"    Remove the specified group.",
+	"SETID <key> <groupname> <id|$>",
+	"    Set the current group ID.",
+];
+
+/// XGROUP command implementation.
+pub struct XGroupCmd {
+	meta: CmdMeta,
+	sub_cmds: SubCmds,
+}
+
+impl Default for XGroupCmd {
+	fn default() -> Self {
+		let mut sub_cmds = SubCmds::new("XGROUP", HELP);
+
+		sub_cmds.insert("CREATE", Box::new(XGroupCreateCmd::default()));
+		sub_cmds.insert("SETID", Box::new(XGroupSetIdCmd::default()));
+		sub_cmds.insert("DESTROY", Box::new(XGroupDestroyCmd::default()));
+		sub_cmds.insert(
+			"CREATECONSUMER",
+			Box::new(XGroupCreateConsumerCmd::default()),
+		);
+		sub_cmds.insert("DELCONSUMER", Box::new(XGroupDelConsumerCmd::default()));
+
+		Self {
+			meta: CmdMeta {
+				name: "XGROUP".to_string(),
+				arity: -2,
+			},
+			sub_cmds,
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for XGroupCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	fn sub_cmds(&self) -> Option<&SubCmds> {
+		Some(&self.sub_cmds)
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], ctx: &CmdContext) -> RespValue {
+		self.sub_cmds.dispatch(storage, args, ctx).await
+	}
+}
+
+/// Parse the group start ID of CREATE and SETID: `$` (`None`) for the newest
+/// entry, or an explicit ID.
+fn parse_group_id(arg: &[u8]) -> Result<Option<StreamId>, String> {
+	match arg {
+		b"$" => Ok(None),
+		id => utils::parse_stream_id(id, 0).map(Some),
+	}
+}
+
+pub struct XGroupCreateCmd {
+	meta: CmdMeta,
+}
+
+impl Default for XGroupCreateCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "CREATE".to_string(),
+				arity: -4, // CREATE key group <id | $> [MKSTREAM]
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for XGroupCreateCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let key = args[0].clone();
+		let group = args[1].clone();
+		let id = match parse_group_id(&args[2]) {
+			Ok(id) => id,
+			Err(e) => return RespValue::error(e),
+		};
+		let mkstream = match &args[3..] {
+			[] => false,
+			[option] if option.eq_ignore_ascii_case(b"MKSTREAM") => true,
+			_ => return RespValue::error("ERR syntax error"),
+		};
+
+		match storage.xgroup_create(key, group, id, mkstream).await {
+			Ok(()) => RespValue::simple_string("OK"),
+			Err(e) => RespValue::error(e.to_string()),
+		}
+	}
+}
+
+pub struct XGroupSetIdCmd {
+	meta: CmdMeta,
+}
+
+impl Default for XGroupSetIdCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "SETID".to_string(),
+				arity: 4, // SETID key group <id | $>
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for XGroupSetIdCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let key = args[0].clone();
+		let group = args[1].clone();
+		let id = match parse_group_id(&args[2]) {
+			Ok(id) => id,
+			Err(e) => return RespValue::error(e),
+		};
+
+		match storage.xgroup_setid(key, group, id).await {
+			Ok(()) => RespValue::simple_string("OK"),
+			Err(e) => RespValue::error(e.to_string()),
+		}
+	}
+}
+
+pub struct XGroupDestroyCmd {
+	meta: CmdMeta,
+}
+
+impl Default for XGroupDestroyCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "DESTROY".to_string(),
+				arity: 3, // DESTROY key group
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for XGroupDestroyCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		match storage
+			.xgroup_destroy(args[0].clone(), args[1].clone())
+			.await
+		{
+			Ok(destroyed) => RespValue::integer(destroyed as i64),
+			Err(e) => RespValue::error(e.to_string()),
+		}
+	}
+}
+
+pub struct XGroupCreateConsumerCmd {
+	meta: CmdMeta,
+}
+
+impl Default for XGroupCreateConsumerCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "CREATECONSUMER".to_string(),
+				arity: 4, // CREATECONSUMER key group consumer
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for XGroupCreateConsumerCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		match storage
+			.xgroup_createconsumer(args[0].clone(), args[1].clone(), args[2].clone())
+			.await
+		{
+			Ok(created) => RespValue::integer(created as i64),
+			Err(e) => RespValue::error(e.to_string()),
+		}
+	}
+}
+
+pub struct XGroupDelConsumerCmd {
+	meta: CmdMeta,
+}
+
+impl Default for XGroupDelConsumerCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "DELCONSUMER".to_string(),
+				arity: 4, // DELCONSUMER key group consumer
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for XGroupDelConsumerCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		match storage
+			.xgroup_delconsumer(args[0].clone(), args[1].clone(), args[2].clone())
+			.await
+		{
+			Ok(pending) => RespValue::integer(pending as i64),
+			Err(e) => RespValue::error(e.to_string()),
+		}
+	}
+}
@@ -0,0 +1,222 @@
+use async_trait::async_trait;
+use bytes::Bytes;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+use nimbis_storage::stream::entry_value::StreamEntryValue;
+use nimbis_storage::stream::id::StreamId;
+
+use super::Cmd;
+use super::CmdContext;
+use super::CmdMeta;
+use super::SubCmds;
+use super::utils;
+
+const HELP: &[&str] = &[
+	"CONSUMERS <key> <groupname>",
+	"    Show consumers of <groupname>.",
+	"GROUPS <key>",
+	"    Show the stream consumer groups.",
+	"STREAM <key>",
+	"    Show information about the stream.",
+];
+
+/// XINFO command implementation.
+pub struct XInfoCmd {
+	meta: CmdMeta,
+	sub_cmds: SubCmds,
+}
+
+impl Default for XInfoCmd {
+	fn default() -> Self {
+		let mut sub_cmds = SubCmds::new("XINFO", HELP);
+
+		sub_cmds.insert("STREAM", Box::new(XInfoStreamCmd::default()));
+		sub_cmds.insert("GROUPS", Box::new(XInfoGroupsCmd::default()));
+		sub_cmds.insert("CONSUMERS", Box::new(XInfoConsumersCmd::default()));
+
+		Self {
+			meta: CmdMeta {
+				name: "XINFO".to_string(),
+				arity: -2,
+			},
+			sub_cmds,
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for XInfoCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	fn sub_cmds(&self) -> Option<&SubCmds> {
+		Some(&self.sub_cmds)
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], ctx: &CmdContext) -> RespValue {
+		self.sub_cmds.dispatch(storage, args, ctx).await
+	}
+}
+
+fn no_such_key() -> RespValue {
+	RespValue::error("ERR no such key")
+}
+
+pub struct XInfoStreamCmd {
+	meta: CmdMeta,
+}
+
+impl Default for XInfoStreamCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "STREAM".to_string(),
+				arity: 2, // STREAM key
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for XInfoStreamCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let info = match storage.xinfo_stream(args[0].clone()).await {
+			Ok(Some(info)) => info,
+			Ok(None) => return no_such_key(),
+			Err(e) => return RespValue::error(e.to_string()),
+		};
+
+		let recorded_first_id = info
+			.first_entry
+			.as_ref()
+			.map_or(StreamId::MIN, |(id, _)| *id);
+		let entry_reply = |entry: Option<(StreamId, StreamEntryValue)>| {
+			entry.map_or(RespValue::Null, |(id, value)| {
+				utils::stream_entry_reply(id, Some(value))
+			})
+		};
+		RespValue::array([
+			RespValue::bulk_string("length"),
+			RespValue::integer(info.len as i64),
+			RespValue::bulk_string("last-generated-id"),
+			RespValue::bulk_string(info.last_generated_id.to_string()),
+			RespValue::bulk_string("max-deleted-entry-id"),
+			RespValue::bulk_string(info.max_deleted_id.to_string()),
+			RespValue::bulk_string("entries-added"),
+			RespValue::integer(info.entries_added as i64),
+			RespValue::bulk_string("recorded-first-entry-id"),
+			RespValue::bulk_string(recorded_first_id.to_string()),
+			RespValue::bulk_string("groups"),
+			RespValue::integer(info.groups as i64),
+			RespValue::bulk_string("first-entry"),
+			entry_reply(info.first_entry),
+			RespValue::bulk_string("last-entry"),
+			entry_reply(info.last_entry),
+		])
+	}
+}
+
+pub struct XInfoGroupsCmd {
+	meta: CmdMeta,
+}
+
+impl Default for XInfoGroupsCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "GROUPS".to_string(),
+				arity: 2, // GROUPS key
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for XInfoGroupsCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let groups = match storage.xinfo_groups(args[0].clone()).await {
+			Ok(Some(groups)) => groups,
+			Ok(None) => return no_such_key(),
+			Err(e) => return RespValue::error(e.to_string()),
+		};
+
+		let optional = |n: Option<u64>| n.map_or(RespValue::Null, |n| RespValue::integer(n as i64));
+		RespValue::array(groups.into_iter().map(|group| {
+			RespValue::array([
+				RespValue::bulk_string("name"),
+				RespValue::bulk_string(group.name),
+				RespValue::bulk_string("consumers"),
+				RespValue::integer(group.consumers as i64),
+				RespValue::bulk_string("pending"),
+				RespValue::integer(group.pending as i64),
+				RespValue::bulk_string("last-delivered-id"),
+				RespValue::bulk_string(group.last_delivered_id.to_string()),
+				RespValue::bulk_string("entries-read"),
+				optional(group.entries_read),
+				RespValue::bulk_string("lag"),
+				optional(group.lag),
+			])
+		}))
+	}
+}
+
+pub struct XInfoConsumersCmd {
+	meta: CmdMeta,
+}
+
+impl Default for XInfoConsumersCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "CONSUMERS".to_string(),
+				arity: 3, // CONSUMERS key group
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for XInfoConsumersCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let consumers = match storage
+			.xinfo_consumers(args[0].clone(), args[1].clone())
+			.await
+		{
+			Ok(Some(consumers)) => consumers,
+			Ok(None) => return no_such_key(),
+			Err(e) => return RespValue::error(e.to_string()),
+		};
+
+		let now = chrono::Utc::now().timestamp_millis().max(0) as u64;
+		RespValue::array(consumers.into_iter().map(|consumer| {
+			// A consumer never delivered an entry reports -1.
+			let inactive = match consumer.active_time {
+				0 => -1,
+				active_time => now.saturating_sub(active_time) as i64,
+			};
+			RespValue::array([
+				RespValue::bulk_string("name"),
+				RespValue::bulk_string(consumer.name),
+				RespValue::bulk_string("pending"),
+				RespValue::integer(consumer.pending as i64),
+				RespValue::bulk_string("idle"),
+				RespValue::integer(now.saturating_sub(consumer.seen_time) as i64),
+				RespValue::bulk_string("inactive"),
+				RespValue::integer(inactive),
+			])
+		}))
+	}
+}
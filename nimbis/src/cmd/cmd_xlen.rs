@@ -0,0 +1,39 @@
+use async_trait::async_trait;
+use bytes::Bytes;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+
+use super::Cmd;
+use super::CmdContext;
+use super::CmdMeta;
+
+pub struct XLenCmd {
+	meta: CmdMeta,
+}
+
+impl Default for XLenCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "XLEN".to_string(),
+				arity: 2, // XLEN key
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for XLenCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let key = args[0].clone();
+
+		match storage.xlen(key).await {
+			Ok(len) => RespValue::integer(len as i64),
+			Err(e) => RespValue::error(e.to_string()),
+		}
+	}
+}
@@ -0,0 +1,156 @@
+use std::collections::BTreeMap;
+
+use async_trait::async_trait;
+use bytes::Bytes;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+use nimbis_storage::storage_stream_group::PendingFilter;
+
+use super::CmdContext;
+use crate::cmd::Cmd;
+use crate::cmd::CmdMeta;
+use crate::cmd::utils;
+
+pub struct XPendingCmd {
+	meta: CmdMeta,
+}
+
+impl Default for XPendingCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "XPENDING".to_string(),
+				// XPENDING key group [[IDLE min-idle-time] start end count [consumer]]
+				arity: -3,
+			},
+		}
+	}
+}
+
+/// Parse the extended form arguments after the group, `None` for the
+/// summary form.
+fn parse_filter(args: &[Bytes]) -> Result<Option<PendingFilter>, String> {
+	if args.is_empty() {
+		return Ok(None);
+	}
+
+	let mut filter = PendingFilter::default();
+	let mut args = args;
+	if args[0].eq_ignore_ascii_case(b"IDLE") {
+		let Some(min_idle) = args.get(1) else {
+			return Err("ERR syntax error".to_string());
+		};
+		filter.min_idle = utils::parse_int::<i64>(min_idle)?.max(0) as u64;
+		args = &args[2..];
+	}
+	let (start, end, count, consumer) = match args {
+		[start, end, count] => (start, end, count, None),
+		[start, end, count, consumer] => (start, end, count, Some(consumer)),
+		_ => return Err("ERR syntax error".to_string()),
+	};
+	filter.start = utils::parse_stream_range_bound(start, true)?;
+	filter.end = utils::parse_stream_range_bound(end, false)?;
+	filter.count = Some(utils::parse_int::<i64>(count)?.max(0) as usize);
+	filter.consumer = consumer.cloned();
+	Ok(Some(filter))
+}
+
+#[async_trait]
+impl Cmd for XPendingCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let key = args[0].clone();
+		let group = args[1].clone();
+		let filter = match parse_filter(&args[2..]) {
+			Ok(filter) => filter,
+			Err(e) => return RespValue::error(e),
+		};
+		let extended = filter.is_some();
+
+		let pending = match storage
+			.xpending(key.clone(), group.clone(), filter.unwrap_or_default())
+			.await
+		{
+			Ok(Some(pending)) => pending,
+			Ok(None) => {
+				return RespValue::error(format!(
+					"NOGROUP No such key '{}' or consumer group '{}'",
+					String::from_utf8_lossy(&key),
+					String::from_utf8_lossy(&group)
+				));
+			}
+			Err(e) => return RespValue::error(e.to_string()),
+		};
+
+		if extended {
+			let now = chrono::Utc::now().timestamp_millis().max(0) as u64;
+			return RespValue::array(pending.into_iter().map(|(id, pending_val)| {
+				RespValue::array([
+					RespValue::bulk_string(id.to_string()),
+					RespValue::bulk_string(pending_val.consumer.clone()),
+					RespValue::integer(pending_val.idle(now) as i64),
+					RespValue::integer(pending_val.delivery_count as i64),
+				])
+			}));
+		}
+
+		// Summary: count, smallest and greatest IDs, and the count per
+		// consumer.
+		let (Some((first, _)), Some((last, _))) = (pending.first(), pending.last()) else {
+			return RespValue::array([
+				RespValue::integer(0),
+				RespValue::Null,
+				RespValue::Null,
+				RespValue::Null,
+			]);
+		};
+		let mut consumers: BTreeMap<Bytes, u64> = BTreeMap::new();
+		for (_, pending_val) in &pending {
+			*consumers.entry(pending_val.consumer.clone()).or_default() += 1;
+		}
+		RespValue::array([
+			RespValue::integer(pending.len() as i64),
+			RespValue::bulk_string(first.to_string()),
+			RespValue::bulk_string(last.to_string()),
+			RespValue::array(consumers.into_iter().map(|(consumer, count)| {
+				RespValue::array([
+					RespValue::bulk_string(consumer),
+					RespValue::bulk_string(count.to_string()),
+				])
+			})),
+		])
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use nimbis_storage::stream::id::StreamId;
+
+	use super::*;
+
+	fn to_args(args: &[&str]) -> Vec<Bytes> {
+		args.iter()
+			.map(|arg| Bytes::from(arg.to_string()))
+			.collect()
+	}
+
+	#[test]
+	fn test_parse_filter() {
+		assert!(parse_filter(&[]).unwrap().is_none());
+
+		let filter = parse_filter(&to_args(&["IDLE", "100", "(1-1", "+", "10", "alice"]))
+			.unwrap()
+			.unwrap();
+		assert_eq!(filter.min_idle, 100);
+		assert_eq!(filter.start, StreamId::new(1, 2));
+		assert_eq!(filter.end, StreamId::MAX);
+		assert_eq!(filter.count, Some(10));
+		assert_eq!(filter.consumer, Some(Bytes::from("alice")));
+
+		assert!(parse_filter(&to_args(&["-", "+"])).is_err());
+		assert!(parse_filter(&to_args(&["IDLE", "100"])).is_err());
+	}
+}
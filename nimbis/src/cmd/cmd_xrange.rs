@@ -0,0 +1,96 @@
+use async_trait::async_trait;
+use bytes::Bytes;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+
+use super::CmdContext;
+use crate::cmd::Cmd;
+use crate::cmd::CmdMeta;
+use crate::cmd::utils;
+
+pub struct XRangeCmd {
+	meta: CmdMeta,
+}
+
+impl Default for XRangeCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "XRANGE".to_string(),
+				arity: -4, // XRANGE key start end [COUNT count]
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for XRangeCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		xrange(storage, &args[0], &args[1], &args[2], &args[3..], false).await
+	}
+}
+
+pub struct XRevRangeCmd {
+	meta: CmdMeta,
+}
+
+impl Default for XRevRangeCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "XREVRANGE".to_string(),
+				arity: -4, // XREVRANGE key end start [COUNT count]
+			},
+		}
+	}
+}
+
+#[async_trait]
+impl Cmd for XRevRangeCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		xrange(storage, &args[0], &args[2], &args[1], &args[3..], true).await
+	}
+}
+
+async fn xrange(
+	storage: &Storage,
+	key: &Bytes,
+	start: &[u8],
+	end: &[u8],
+	options: &[Bytes],
+	rev: bool,
+) -> RespValue {
+	let start = match utils::parse_stream_range_bound(start, true) {
+		Ok(id) => id,
+		Err(e) => return RespValue::error(e),
+	};
+	let end = match utils::parse_stream_range_bound(end, false) {
+		Ok(id) => id,
+		Err(e) => return RespValue::error(e),
+	};
+
+	let count = match options {
+		[] => None,
+		[opt, count] if opt.eq_ignore_ascii_case(b"COUNT") => {
+			// A negative COUNT returns nothing, like COUNT 0.
+			match utils::parse_int::<i64>(count) {
+				Ok(n) => Some(n.max(0) as usize),
+				Err(e) => return RespValue::error(e),
+			}
+		}
+		_ => return RespValue::error("ERR syntax error"),
+	};
+
+	match storage.xrange(key.clone(), start, end, count, rev).await {
+		Ok(entries) => utils::stream_entries_reply(entries),
+		Err(e) => RespValue::error(e.to_string()),
+	}
+}
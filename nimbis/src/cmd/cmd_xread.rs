@@ -0,0 +1,266 @@
+use async_trait::async_trait;
+use bytes::Bytes;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+use nimbis_storage::stream::id::StreamId;
+
+use super::CmdContext;
+use crate::blocking;
+use crate::blocking::BlockingRead;
+use crate::cmd::Cmd;
+use crate::cmd::CmdMeta;
+use crate::cmd::utils;
+
+pub struct XReadCmd {
+	meta: CmdMeta,
+}
+
+impl Default for XReadCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "XREAD".to_string(),
+				// XREAD [COUNT count] [BLOCK milliseconds] STREAMS key [key ...] id [id ...]
+				arity: -4,
+			},
+		}
+	}
+}
+
+/// Parsed XREAD and XREADGROUP arguments.
+pub(super) struct XReadArgs<'a> {
+	/// The GROUP option of XREADGROUP: group and consumer names.
+	pub group: Option<(&'a Bytes, &'a Bytes)>,
+	pub count: Option<usize>,
+	/// BLOCK timeout in milliseconds, 0 blocks forever.
+	pub block: Option<u64>,
+	pub noack: bool,
+	pub keys: &'a [Bytes],
+	pub ids: &'a [Bytes],
+}
+
+/// Parse the arguments of XREAD, or of XREADGROUP when `is_group` is set,
+/// which also takes GROUP and NOACK.
+pub(super) fn parse_args(args: &[Bytes], is_group: bool) -> Result<XReadArgs<'_>, String> {
+	let mut group = None;
+	let mut count = None;
+	let mut block = None;
+	let mut noack = false;
+	let mut idx = 0;
+	loop {
+		let Some(arg) = args.get(idx) else {
+			return Err("ERR syntax error".to_string());
+		};
+		if arg.eq_ignore_ascii_case(b"STREAMS") {
+			idx += 1;
+			break;
+		}
+		if is_group && arg.eq_ignore_ascii_case(b"NOACK") {
+			noack = true;
+			idx += 1;
+			continue;
+		}
+		let Some(value) = args.get(idx + 1) else {
+			return Err("ERR syntax error".to_string());
+		};
+		if is_group && arg.eq_ignore_ascii_case(b"GROUP") {
+			let Some(consumer) = args.get(idx + 2) else {
+				return Err("ERR syntax error".to_string());
+			};
+			group = Some((value, consumer));
+			idx += 3;
+			continue;
+		}
+		if arg.eq_ignore_ascii_case(b"COUNT") {
+			// COUNT 0 or below means no limit.
+			let n = utils::parse_int::<i64>(value)?;
+			count = (n > 0).then_some(n as usize);
+		} else if arg.eq_ignore_ascii_case(b"BLOCK") {
+			let ms = utils::parse_int::<i64>(value)
+				.map_err(|_| "ERR timeout is not an integer or out of range".to_string())?;
+			if ms < 0 {
+				return Err("ERR timeout is negative".to_string());
+			}
+			block = Some(ms as u64);
+		} else {
+			return Err("ERR syntax error".to_string());
+		}
+		idx += 2;
+	}
+
+	if is_group && group.is_none() {
+		return Err("ERR Missing GROUP option for XREADGROUP".to_string());
+	}
+	let streams = &args[idx..];
+	if streams.is_empty() || !streams.len().is_multiple_of(2) {
+		return Err(format!(
+			"ERR Unbalanced '{}' list of streams: for each stream key an ID or '{}' must be specified.",
+			if is_group { "xreadgroup" } else { "xread" },
+			if is_group { ">" } else { "$" }
+		));
+	}
+	let (keys, ids) = streams.split_at(streams.len() / 2);
+	Ok(XReadArgs {
+		group,
+		count,
+		block,
+		noack,
+		keys,
+		ids,
+	})
+}
+
+/// Resolve the ID after which each stream is read. `$` is the newest ID at
+/// the time of the call, so a blocking read only returns later entries.
+async fn resolve_ids(storage: &Storage, args: &XReadArgs<'_>) -> Result<Vec<StreamId>, String> {
+	let mut ids = Vec::with_capacity(args.ids.len());
+	for (key, id) in args.keys.iter().zip(args.ids) {
+		let id = match id.as_ref() {
+			b"$" => storage
+				.xlast_id(key.clone())
+				.await
+				.map_err(|e| e.to_string())?
+				.unwrap_or(StreamId::MIN),
+			b">" => {
+				return Err("ERR The > ID can be specified only when calling XREADGROUP using the GROUP <group> <consumer> option.".to_string());
+			}
+			id => utils::parse_stream_id(id, 0)?,
+		};
+		ids.push(id);
+	}
+	Ok(ids)
+}
+
+/// Read the entries after `ids` from every stream, replying with one
+/// `[key, entries]` pair per stream that has any.
+async fn read_streams(
+	storage: &Storage,
+	keys: &[Bytes],
+	ids: &[StreamId],
+	count: Option<usize>,
+) -> Result<Vec<RespValue>, String> {
+	let mut replies = Vec::new();
+	for (key, id) in keys.iter().zip(ids) {
+		let Some(start) = id.next() else {
+			continue;
+		};
+		let entries = storage
+			.xrange(key.clone(), start, StreamId::MAX, count, false)
+			.await
+			.map_err(|e| e.to_string())?;
+		if !entries.is_empty() {
+			replies.push(RespValue::array([
+				RespValue::bulk_string(key.clone()),
+				utils::stream_entries_reply(entries),
+			]));
+		}
+	}
+	Ok(replies)
+}
+
+#[async_trait]
+impl Cmd for XReadCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], ctx: &CmdContext) -> RespValue {
+		let args = match parse_args(args, false) {
+			Ok(args) => args,
+			Err(e) => return RespValue::error(e),
+		};
+
+		// Watch the keys before the first read so an entry added right after
+		// it still wakes us.
+		let blocking_read = BlockingRead::new(ctx, args.keys, args.block);
+
+		let ids = {
+			let _guard = blocking::exec_guard(ctx).await;
+			match resolve_ids(storage, &args).await {
+				Ok(ids) => ids,
+				Err(e) => return RespValue::error(e),
+			}
+		};
+
+		loop {
+			let replies = {
+				let _guard = blocking::exec_guard(ctx).await;
+				read_streams(storage, args.keys, &ids, args.count).await
+			};
+			match replies {
+				Ok(replies) if !replies.is_empty() => return RespValue::array(replies),
+				Ok(_) => {}
+				Err(e) => return RespValue::error(e),
+			}
+
+			if !blocking_read.wait().await {
+				return RespValue::Null;
+			}
+		}
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use rstest::rstest;
+
+	use super::*;
+
+	fn to_args(args: &[&str]) -> Vec<Bytes> {
+		args.iter()
+			.map(|arg| Bytes::from(arg.to_string()))
+			.collect()
+	}
+
+	#[rstest]
+	#[case(&["STREAMS", "a", "0"], None, None, 1)]
+	#[case(&["COUNT", "2", "BLOCK", "100", "STREAMS", "a", "b", "0", "$"], Some(2), Some(100), 2)]
+	#[case(&["count", "0", "streams", "a", "0"], None, None, 1)]
+	fn test_parse_args(
+		#[case] args: &[&str],
+		#[case] count: Option<usize>,
+		#[case] block: Option<u64>,
+		#[case] streams: usize,
+	) {
+		let args = to_args(args);
+		let parsed = parse_args(&args, false).unwrap();
+		assert_eq!(parsed.count, count);
+		assert_eq!(parsed.block, block);
+		assert_eq!(parsed.keys.len(), streams);
+		assert_eq!(parsed.ids.len(), streams);
+	}
+
+	#[rstest]
+	#[case(&["STREAMS", "a", "b", "0"], "Unbalanced")]
+	#[case(&["BLOCK", "-1", "STREAMS", "a", "0"], "timeout is negative")]
+	#[case(&["BLOCK", "x", "STREAMS", "a", "0"], "timeout is not an integer")]
+	#[case(&["COUNT", "1", "a", "0"], "syntax error")]
+	#[case(&["NOACK", "STREAMS", "a", "0"], "syntax error")]
+	#[case(&["GROUP", "g", "c", "STREAMS", "a", "0"], "syntax error")]
+	fn test_parse_args_errors(#[case] args: &[&str], #[case] expected: &str) {
+		let args = to_args(args);
+		let err = parse_args(&args, false).err().unwrap();
+		assert!(err.contains(expected), "{err}");
+	}
+
+	#[test]
+	fn test_parse_group_args() {
+		let args = to_args(&[
+			"GROUP", "g", "alice", "NOACK", "COUNT", "1", "STREAMS", "a", ">",
+		]);
+		let parsed = parse_args(&args, true).unwrap();
+		assert_eq!(
+			parsed.group,
+			Some((&Bytes::from("g"), &Bytes::from("alice")))
+		);
+		assert!(parsed.noack);
+		assert_eq!(parsed.count, Some(1));
+
+		let args = to_args(&["STREAMS", "a", ">"]);
+		let err = parse_args(&args, true).err().unwrap();
+		assert!(err.contains("Missing GROUP option"), "{err}");
+		let args = to_args(&["GROUP", "g", "alice", "STREAMS", "a"]);
+		let err = parse_args(&args, true).err().unwrap();
+		assert!(err.contains("'xreadgroup'"), "{err}");
+	}
+}
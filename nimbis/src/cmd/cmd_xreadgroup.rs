@@ -0,0 +1,138 @@
+use async_trait::async_trait;
+use bytes::Bytes;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+use nimbis_storage::stream::id::StreamId;
+
+use super::CmdContext;
+use super::cmd_xread::XReadArgs;
+use super::cmd_xread::parse_args;
+use crate::blocking;
+use crate::blocking::BlockingRead;
+use crate::cmd::Cmd;
+use crate::cmd::CmdMeta;
+use crate::cmd::utils;
+
+pub struct XReadGroupCmd {
+	meta: CmdMeta,
+}
+
+impl Default for XReadGroupCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "XREADGROUP".to_string(),
+				// XREADGROUP GROUP group consumer [COUNT count] [BLOCK milliseconds]
+				// [NOACK] STREAMS key [key ...] id [id ...]
+				arity: -7,
+			},
+		}
+	}
+}
+
+/// Parse the ID of each stream: `None` for `>`, new entries never delivered
+/// to the group, or the ID after which the consumer's history is read.
+fn parse_ids(ids: &[Bytes]) -> Result<Vec<Option<StreamId>>, String> {
+	ids.iter()
+		.map(|id| match id.as_ref() {
+			b">" => Ok(None),
+			b"$" => Err("ERR The $ ID is meaningless in the context of XREADGROUP: you want to read the history of this consumer by specifying a proper ID, or use the > ID to get new messages. The $ ID would just return an empty result set.".to_string()),
+			id => utils::parse_stream_id(id, 0).map(Some),
+		})
+		.collect()
+}
+
+/// Read every stream for the group's consumer, replying with one
+/// `[key, entries]` pair per stream. Streams read with `>` are left out
+/// when they have no new entries; history reads are always included.
+async fn read_groups(
+	storage: &Storage,
+	args: &XReadArgs<'_>,
+	ids: &[Option<StreamId>],
+) -> Result<Vec<RespValue>, String> {
+	let Some((group, consumer)) = args.group else {
+		return Err("ERR Missing GROUP option for XREADGROUP".to_string());
+	};
+
+	let mut replies = Vec::new();
+	for (key, id) in args.keys.iter().zip(ids) {
+		let entries = storage
+			.xreadgroup(
+				key.clone(),
+				group.clone(),
+				consumer.clone(),
+				*id,
+				args.count,
+				args.noack,
+			)
+			.await
+			.map_err(|e| e.to_string())?
+			.ok_or_else(|| {
+				format!(
+					"NOGROUP No such key '{}' or consumer group '{}' in XREADGROUP with GROUP option",
+					String::from_utf8_lossy(key),
+					String::from_utf8_lossy(group)
+				)
+			})?;
+		if id.is_none() && entries.is_empty() {
+			continue;
+		}
+		replies.push(RespValue::array([
+			RespValue::bulk_string(key.clone()),
+			utils::stream_group_entries_reply(entries),
+		]));
+	}
+	Ok(replies)
+}
+
+#[async_trait]
+impl Cmd for XReadGroupCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], ctx: &CmdContext) -> RespValue {
+		let args = match parse_args(args, true) {
+			Ok(args) => args,
+			Err(e) => return RespValue::error(e),
+		};
+		let ids = match parse_ids(args.ids) {
+			Ok(ids) => ids,
+			Err(e) => return RespValue::error(e),
+		};
+
+		// History reads always reply, so only `>` reads end up waiting.
+		let blocking_read = BlockingRead::new(ctx, args.keys, args.block);
+		loop {
+			let replies = {
+				let _guard = blocking::exec_guard(ctx).await;
+				read_groups(storage, &args, &ids).await
+			};
+			match replies {
+				Ok(replies) if !replies.is_empty() => return RespValue::array(replies),
+				Ok(_) => {}
+				Err(e) => return RespValue::error(e),
+			}
+
+			if !blocking_read.wait().await {
+				return RespValue::Null;
+			}
+		}
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+
+	#[test]
+	fn test_parse_ids() {
+		let ids = [Bytes::from(">"), Bytes::from("0"), Bytes::from("5-1")];
+		assert_eq!(
+			parse_ids(&ids).unwrap(),
+			vec![None, Some(StreamId::MIN), Some(StreamId::new(5, 1))]
+		);
+		assert!(parse_ids(&[Bytes::from("$")]).is_err());
+		assert!(parse_ids(&[Bytes::from("x")]).is_err());
+	}
+}
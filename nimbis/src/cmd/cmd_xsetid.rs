@@ -0,0 +1,101 @@
+use async_trait::async_trait;
+use bytes::Bytes;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+use nimbis_storage::stream::id::StreamId;
+
+use super::CmdContext;
+use crate::cmd::Cmd;
+use crate::cmd::CmdMeta;
+use crate::cmd::utils;
+
+pub struct XSetIdCmd {
+	meta: CmdMeta,
+}
+
+impl Default for XSetIdCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "XSETID".to_string(),
+				// XSETID key last-id [ENTRIESADDED entries-added]
+				// [MAXDELETEDID max-deleted-id]
+				arity: -3,
+			},
+		}
+	}
+}
+
+/// Parse the options after the ID: ENTRIESADDED and MAXDELETEDID.
+fn parse_options(args: &[Bytes]) -> Result<(Option<u64>, Option<StreamId>), String> {
+	let mut entries_added = None;
+	let mut max_deleted_id = None;
+	let mut idx = 0;
+	while let Some(arg) = args.get(idx) {
+		let Some(value) = args.get(idx + 1) else {
+			return Err("ERR syntax error".to_string());
+		};
+		if arg.eq_ignore_ascii_case(b"ENTRIESADDED") {
+			let n = utils::parse_int::<i64>(value)?;
+			if n < 0 {
+				return Err("ERR entries_added must be positive".to_string());
+			}
+			entries_added = Some(n as u64);
+		} else if arg.eq_ignore_ascii_case(b"MAXDELETEDID") {
+			max_deleted_id = Some(utils::parse_stream_id(value, 0)?);
+		} else {
+			return Err("ERR syntax error".to_string());
+		}
+		idx += 2;
+	}
+	Ok((entries_added, max_deleted_id))
+}
+
+#[async_trait]
+impl Cmd for XSetIdCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let key = args[0].clone();
+		let last_id = match utils::parse_stream_id(&args[1], 0) {
+			Ok(id) => id,
+			Err(e) => return RespValue::error(e),
+		};
+		let (entries_added, max_deleted_id) = match parse_options(&args[2..]) {
+			Ok(options) => options,
+			Err(e) => return RespValue::error(e),
+		};
+
+		match storage
+			.xsetid(key, last_id, entries_added, max_deleted_id)
+			.await
+		{
+			Ok(true) => RespValue::simple_string("OK"),
+			Ok(false) => RespValue::error("ERR no such key"),
+			Err(e) => RespValue::error(e.to_string()),
+		}
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+
+	fn args(args: &[&'static str]) -> Vec<Bytes> {
+		args.iter().map(|arg| Bytes::from(*arg)).collect()
+	}
+
+	#[test]
+	fn test_parse_options() {
+		assert_eq!(parse_options(&[]).unwrap(), (None, None));
+		assert_eq!(
+			parse_options(&args(&["maxdeletedid", "3-1", "ENTRIESADDED", "7"])).unwrap(),
+			(Some(7), Some(StreamId::new(3, 1)))
+		);
+		assert!(parse_options(&args(&["ENTRIESADDED", "-1"])).is_err());
+		assert!(parse_options(&args(&["ENTRIESADDED"])).is_err());
+		assert!(parse_options(&args(&["COUNT", "1"])).is_err());
+	}
+}
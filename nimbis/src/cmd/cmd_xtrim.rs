@@ -0,0 +1,151 @@
+use async_trait::async_trait;
+use bytes::Bytes;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+use nimbis_storage::storage_stream::StreamTrim;
+use nimbis_storage::storage_stream::TrimStrategy;
+
+use super::CmdContext;
+use crate::cmd::Cmd;
+use crate::cmd::CmdMeta;
+use crate::cmd::utils;
+
+/// Entries an approximate trim removes per command unless LIMIT says
+/// otherwise.
+const DEFAULT_TRIM_LIMIT: usize = 10000;
+
+pub struct XTrimCmd {
+	meta: CmdMeta,
+}
+
+impl Default for XTrimCmd {
+	fn default() -> Self {
+		Self {
+			meta: CmdMeta {
+				name: "XTRIM".to_string(),
+				arity: -4, // XTRIM key <MAXLEN | MINID> [= | ~] threshold [LIMIT count]
+			},
+		}
+	}
+}
+
+/// Parse a trim clause, `<MAXLEN | MINID> [= | ~] threshold [LIMIT count]`,
+/// at the start of `args`. Returns the trim and the number of arguments it
+/// took.
+///
+/// Exact trims have no limit. Approximate trims remove at most LIMIT
+/// entries, where LIMIT 0 means no limit.
+pub(super) fn parse_trim(args: &[Bytes]) -> Result<(StreamTrim, usize), String> {
+	let syntax_error = || "ERR syntax error".to_string();
+
+	let maxlen = match args.first() {
+		Some(arg) if arg.eq_ignore_ascii_case(b"MAXLEN") => true,
+		Some(arg) if arg.eq_ignore_ascii_case(b"MINID") => false,
+		_ => return Err(syntax_error()),
+	};
+	let mut idx = 1;
+	let mut approx = false;
+	match args.get(idx).map(|arg| arg.as_ref()) {
+		Some(b"~") => {
+			approx = true;
+			idx += 1;
+		}
+		Some(b"=") => idx += 1,
+		_ => {}
+	}
+
+	let threshold = args.get(idx).ok_or_else(syntax_error)?;
+	let strategy = if maxlen {
+		let n = utils::parse_int::<i64>(threshold)?;
+		if n < 0 {
+			return Err("ERR The MAXLEN argument must be >= 0.".to_string());
+		}
+		TrimStrategy::MaxLen(n as u64)
+	} else {
+		TrimStrategy::MinId(utils::parse_stream_id(threshold, 0)?)
+	};
+	idx += 1;
+
+	let mut limit = approx.then_some(DEFAULT_TRIM_LIMIT);
+	if let Some(arg) = args.get(idx)
+		&& arg.eq_ignore_ascii_case(b"LIMIT")
+	{
+		let value = args.get(idx + 1).ok_or_else(syntax_error)?;
+		let n = utils::parse_int::<i64>(value)?;
+		if n < 0 {
+			return Err("ERR The LIMIT argument must be >= 0.".to_string());
+		}
+		if !approx {
+			return Err(
+				"ERR syntax error, LIMIT cannot be used without the special ~ option".to_string(),
+			);
+		}
+		limit = (n > 0).then_some(n as usize);
+		idx += 2;
+	}
+
+	Ok((StreamTrim { strategy, limit }, idx))
+}
+
+#[async_trait]
+impl Cmd for XTrimCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		let key = args[0].clone();
+		let trim = match parse_trim(&args[1..]) {
+			Ok((trim, taken)) if taken == args.len() - 1 => trim,
+			Ok(_) => return RespValue::error("ERR syntax error"),
+			Err(e) => return RespValue::error(e),
+		};
+
+		match storage.xtrim(key, trim).await {
+			Ok(trimmed) => RespValue::integer(trimmed as i64),
+			Err(e) => RespValue::error(e.to_string()),
+		}
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use nimbis_storage::stream::id::StreamId;
+	use rstest::rstest;
+
+	use super::*;
+
+	fn args(args: &[&'static str]) -> Vec<Bytes> {
+		args.iter().map(|arg| Bytes::from(*arg)).collect()
+	}
+
+	#[rstest]
+	#[case(&["MAXLEN", "5"], TrimStrategy::MaxLen(5), None, 2)]
+	#[case(&["maxlen", "=", "5", "*"], TrimStrategy::MaxLen(5), None, 3)]
+	#[case(&["MAXLEN", "~", "5"], TrimStrategy::MaxLen(5), Some(DEFAULT_TRIM_LIMIT), 3)]
+	#[case(&["MAXLEN", "~", "5", "LIMIT", "7"], TrimStrategy::MaxLen(5), Some(7), 5)]
+	#[case(&["MAXLEN", "~", "5", "LIMIT", "0"], TrimStrategy::MaxLen(5), None, 5)]
+	#[case(&["MINID", "3-1"], TrimStrategy::MinId(StreamId::new(3, 1)), None, 2)]
+	fn test_parse_trim(
+		#[case] input: &[&'static str],
+		#[case] strategy: TrimStrategy,
+		#[case] limit: Option<usize>,
+		#[case] taken: usize,
+	) {
+		assert_eq!(
+			parse_trim(&args(input)).unwrap(),
+			(StreamTrim { strategy, limit }, taken)
+		);
+	}
+
+	#[rstest]
+	#[case(&["MAXLEN"])]
+	#[case(&["MAXLEN", "-1"])]
+	#[case(&["MAXLEN", "5", "LIMIT", "7"])]
+	#[case(&["MAXLEN", "~", "5", "LIMIT", "-1"])]
+	#[case(&["MINID", "x"])]
+	#[case(&["COUNT", "5"])]
+	fn test_parse_trim_errors(#[case] input: &[&'static str]) {
+		assert!(parse_trim(&args(input)).is_err());
+	}
+}
@@ -13,6 +13,10 @@ pub struct CmdMeta {
 #[derive(Debug, Clone, Copy, Default)]
 pub struct CmdContext {
 	pub client_id: i64,
+	/// Whether the command may block waiting for keys. Only set for a
+	/// top-level command run without the exec lock; inside MULTI and scripts
+	/// blocking commands give up at once, like Redis.
+	pub may_block: bool,
 }
 
 impl CmdMeta {
@@ -49,6 +53,11 @@ pub trait Cmd: Send + Sync {
 	/// Get command metadata
 	fn meta(&self) -> &CmdMeta;
 
+	/// The subcommands of a container command, `None` for other commands.
+	fn sub_cmds(&self) -> Option<&SubCmds> {
+		None
+	}
+
 	async fn do_cmd(&self, storage: &Storage, args: &[Bytes], ctx: &CmdContext) -> RespValue;
 
 	/// Execute command with request context.
@@ -99,15 +108,32 @@ impl TryFrom<RespValue> for ParsedCmd {
 
 pub mod utils;
 
+mod cmd_acl;
 mod cmd_append;
+mod cmd_bitcount;
+mod cmd_bitfield;
+mod cmd_bitfield_ro;
+mod cmd_bitop;
+mod cmd_bitpos;
 mod cmd_client;
+mod cmd_cluster;
 mod cmd_config;
 mod cmd_decr;
 mod cmd_del;
+mod cmd_dump;
+mod cmd_eval;
 mod cmd_exists;
 mod cmd_expire;
 mod cmd_flushdb;
+mod cmd_function;
+mod cmd_geoadd;
+mod cmd_geodist;
+mod cmd_geohash;
+mod cmd_geopos;
+mod cmd_geosearch;
+mod cmd_geosearchstore;
 mod cmd_get;
+mod cmd_getbit;
 mod cmd_hdel;
 mod cmd_hello;
 mod cmd_hget;
@@ -116,36 +142,94 @@ mod cmd_hlen;
 mod cmd_hmget;
 mod cmd_hset;
 mod cmd_incr;
+mod cmd_latency;
 mod cmd_llen;
 mod cmd_lpop;
 mod cmd_lpush;
 mod cmd_lrange;
+mod cmd_memory;
+mod cmd_migrate;
+mod cmd_multi;
+mod cmd_nimbis;
+mod cmd_object;
+mod cmd_pfadd;
+mod cmd_pfcount;
+mod cmd_pfmerge;
 mod cmd_ping;
+mod cmd_pubsub;
+mod cmd_replication;
 mod cmd_rpop;
 mod cmd_rpush;
 mod cmd_sadd;
+mod cmd_save;
 mod cmd_scard;
+mod cmd_script;
+mod cmd_server;
 mod cmd_set;
+mod cmd_setbit;
 mod cmd_sismember;
+mod cmd_slowlog;
 mod cmd_smembers;
 mod cmd_srem;
 mod cmd_ttl;
+mod cmd_xack;
+mod cmd_xadd;
+mod cmd_xautoclaim;
+mod cmd_xclaim;
+mod cmd_xdel;
+mod cmd_xgroup;
+mod cmd_xinfo;
+mod cmd_xlen;
+mod cmd_xpending;
+mod cmd_xrange;
+mod cmd_xread;
+mod cmd_xreadgroup;
+mod cmd_xsetid;
+mod cmd_xtrim;
 mod cmd_zadd;
 mod cmd_zcard;
 mod cmd_zrange;
 mod cmd_zrem;
 mod cmd_zscore;
+mod sub_cmds;
 mod table;
 
+pub use cmd_acl::AclCmd;
+pub use cmd_acl::AuthCmd;
 pub use cmd_append::AppendCmd;
+pub use cmd_bitcount::BitCountCmd;
+pub use cmd_bitfield::BitFieldCmd;
+pub use cmd_bitfield_ro::BitFieldRoCmd;
+pub use cmd_bitop::BitOpCmd;
+pub use cmd_bitpos::BitPosCmd;
 pub use cmd_client::ClientCmd;
+pub use cmd_cluster::AskingCmd;
+pub use cmd_cluster::ClusterCmd;
 pub use cmd_config::ConfigCmd;
 pub use cmd_decr::DecrCmd;
 pub use cmd_del::DelCmd;
+pub use cmd_dump::DumpCmd;
+pub use cmd_dump::RestoreAskingCmd;
+pub use cmd_dump::RestoreCmd;
+pub use cmd_eval::EvalCmd;
+pub use cmd_eval::EvalRoCmd;
+pub use cmd_eval::EvalShaCmd;
+pub use cmd_eval::EvalShaRoCmd;
 pub use cmd_exists::ExistsCmd;
 pub use cmd_expire::ExpireCmd;
+pub use cmd_expire::PExpireAtCmd;
 pub use cmd_flushdb::FlushDbCmd;
+pub use cmd_function::FcallCmd;
+pub use cmd_function::FcallRoCmd;
+pub use cmd_function::FunctionCmd;
+pub use cmd_geoadd::GeoAddCmd;
+pub use cmd_geodist::GeoDistCmd;
+pub use cmd_geohash::GeoHashCmd;
+pub use cmd_geopos::GeoPosCmd;
+pub use cmd_geosearch::GeoSearchCmd;
+pub use cmd_geosearchstore::GeoSearchStoreCmd;
 pub use cmd_get::GetCmd;
+pub use cmd_getbit::GetBitCmd;
 pub use cmd_hdel::HDelCmd;
 pub use cmd_hello::HelloCmd;
 pub use cmd_hget::HGetCmd;
@@ -154,23 +238,80 @@ pub use cmd_hlen::HLenCmd;
 pub use cmd_hmget::HMGetCmd;
 pub use cmd_hset::HSetCmd;
 pub use cmd_incr::IncrCmd;
+pub use cmd_latency::LatencyCmd;
 pub use cmd_llen::LLenCmd;
 pub use cmd_lpop::LPopCmd;
 pub use cmd_lpush::LPushCmd;
 pub use cmd_lrange::LRangeCmd;
+pub use cmd_memory::MemoryCmd;
+pub use cmd_migrate::MigrateCmd;
+pub use cmd_multi::DiscardCmd;
+pub use cmd_multi::ExecCmd;
+pub use cmd_multi::MultiCmd;
+pub use cmd_nimbis::NimbisCmd;
+pub use cmd_object::ObjectCmd;
+pub use cmd_pfadd::PfAddCmd;
+pub use cmd_pfcount::PfCountCmd;
+pub use cmd_pfmerge::PfMergeCmd;
 pub use cmd_ping::PingCmd;
+pub use cmd_pubsub::PSubscribeCmd;
+pub use cmd_pubsub::PUnsubscribeCmd;
+pub use cmd_pubsub::PublishCmd;
+pub use cmd_pubsub::PubsubCmd;
+pub use cmd_pubsub::SubscribeCmd;
+pub use cmd_pubsub::UnsubscribeCmd;
+pub use cmd_replication::FailoverCmd;
+pub use cmd_replication::PsyncCmd;
+pub use cmd_replication::ReadOnlyCmd;
+pub use cmd_replication::ReadWriteCmd;
+pub use cmd_replication::ReplConfCmd;
+pub use cmd_replication::ReplicaOfCmd;
+pub use cmd_replication::RoleCmd;
+pub use cmd_replication::SlaveOfCmd;
 pub use cmd_rpop::RPopCmd;
 pub use cmd_rpush::RPushCmd;
 pub use cmd_sadd::SaddCmd;
+pub use cmd_save::BackupCmd;
+pub use cmd_save::BgRewriteAofCmd;
+pub use cmd_save::BgSaveCmd;
+pub use cmd_save::CompactCmd;
+pub use cmd_save::LastSaveCmd;
+pub use cmd_save::SaveCmd;
+pub use cmd_save::WaitAofCmd;
 pub use cmd_scard::ScardCmd;
+pub use cmd_script::ScriptCmd;
+pub use cmd_server::DebugCmd;
+pub use cmd_server::InfoCmd;
+pub use cmd_server::LolwutCmd;
+pub use cmd_server::ModuleCmd;
+pub use cmd_server::ResetCmd;
+pub use cmd_server::TimeCmd;
 pub use cmd_set::SetCmd;
+pub use cmd_setbit::SetBitCmd;
 pub use cmd_sismember::SismemberCmd;
+pub use cmd_slowlog::SlowlogCmd;
 pub use cmd_smembers::SmembersCmd;
 pub use cmd_srem::SremCmd;
 pub use cmd_ttl::TtlCmd;
+pub use cmd_xack::XAckCmd;
+pub use cmd_xadd::XAddCmd;
+pub use cmd_xautoclaim::XAutoClaimCmd;
+pub use cmd_xclaim::XClaimCmd;
+pub use cmd_xdel::XDelCmd;
+pub use cmd_xgroup::XGroupCmd;
+pub use cmd_xinfo::XInfoCmd;
+pub use cmd_xlen::XLenCmd;
+pub use cmd_xpending::XPendingCmd;
+pub use cmd_xrange::XRangeCmd;
+pub use cmd_xrange::XRevRangeCmd;
+pub use cmd_xread::XReadCmd;
+pub use cmd_xreadgroup::XReadGroupCmd;
+pub use cmd_xsetid::XSetIdCmd;
+pub use cmd_xtrim::XTrimCmd;
 pub use cmd_zadd::ZAddCmd;
 pub use cmd_zcard::ZCardCmd;
 pub use cmd_zrange::ZRangeCmd;
 pub use cmd_zrem::ZRemCmd;
 pub use cmd_zscore::ZScoreCmd;
+pub use sub_cmds::SubCmds;
 pub use table::CmdTable;
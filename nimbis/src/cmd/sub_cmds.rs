@@ -0,0 +1,159 @@
+use std::collections::HashMap;
+
+use async_trait::async_trait;
+use bytes::Bytes;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+
+use super::Cmd;
+use super::CmdContext;
+use super::CmdMeta;
+
+/// The subcommands of a container command such as CONFIG or OBJECT.
+///
+/// Every container answers HELP with the usage of its subcommands, framed the
+/// way Redis frames it: a `<CONTAINER> <subcommand> ...` header, the lines
+/// the container describes its subcommands with, then HELP itself.
+pub struct SubCmds {
+	container: &'static str,
+	help: &'static [&'static str],
+	cmds: HashMap<&'static str, Box<dyn Cmd>>,
+}
+
+impl SubCmds {
+	/// The subcommands of `container`, starting with HELP, which replies with
+	/// `help` in the frame above.
+	pub fn new(container: &'static str, help: &'static [&'static str]) -> Self {
+		let mut cmds: HashMap<&'static str, Box<dyn Cmd>> = HashMap::new();
+		cmds.insert(
+			"HELP",
+			Box::new(HelpCmd {
+				meta: CmdMeta {
+					name: "HELP".to_string(),
+					arity: 1,
+				},
+				container,
+				help,
+			}),
+		);
+		Self {
+			container,
+			help,
+			cmds,
+		}
+	}
+
+	pub fn insert(&mut self, name: &'static str, cmd: Box<dyn Cmd>) {
+		self.cmds.insert(name, cmd);
+	}
+
+	/// The names of the subcommands, sorted.
+	pub fn names(&self) -> Vec<&'static str> {
+		let mut names: Vec<_> = self.cmds.keys().copied().collect();
+		names.sort_unstable();
+		names
+	}
+
+	/// The lines HELP replies with.
+	pub fn help(&self) -> Vec<String> {
+		help_lines(self.container, self.help)
+	}
+
+	/// Run the subcommand named by the first of `args` with the rest. A wrong
+	/// number of arguments is reported under the `container|subcommand` name,
+	/// as Redis does.
+	pub async fn dispatch(&self, storage: &Storage, args: &[Bytes], ctx: &CmdContext) -> RespValue {
+		let sub_cmd_name = String::from_utf8_lossy(&args[0]).to_uppercase();
+		match self.cmds.get(sub_cmd_name.as_str()) {
+			Some(sub_cmd) => {
+				if sub_cmd.meta().validate_arity(args.len()).is_err() {
+					return RespValue::error(format!(
+						"ERR wrong number of arguments for '{}|{}' command",
+						self.container.to_lowercase(),
+						sub_cmd_name.to_lowercase()
+					));
+				}
+				sub_cmd.do_cmd(storage, &args[1..], ctx).await
+			}
+			None => RespValue::error(format!(
+				"ERR unknown {} subcommand '{}'. Try {} HELP.",
+				self.container, sub_cmd_name, self.container
+			)),
+		}
+	}
+}
+
+/// Lines of the HELP reply of `container`.
+fn help_lines(container: &str, help: &[&str]) -> Vec<String> {
+	let mut lines = vec![format!(
+		"{} <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+		container
+	)];
+	lines.extend(help.iter().map(|line| line.to_string()));
+	lines.push("HELP".to_string());
+	lines.push("    Print this help.".to_string());
+	lines
+}
+
+struct HelpCmd {
+	meta: CmdMeta,
+	container: &'static str,
+	help: &'static [&'static str],
+}
+
+#[async_trait]
+impl Cmd for HelpCmd {
+	fn meta(&self) -> &CmdMeta {
+		&self.meta
+	}
+
+	async fn do_cmd(&self, _storage: &Storage, _args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+		RespValue::array(
+			help_lines(self.container, self.help)
+				.into_iter()
+				.map(RespValue::simple_string),
+		)
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+	use crate::cmd::CmdTable;
+
+	#[test]
+	fn test_help_lines() {
+		assert_eq!(
+			help_lines("OBJECT", &["FREQ <key>", "    Return the frequency."]),
+			vec![
+				"OBJECT <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+				"FREQ <key>",
+				"    Return the frequency.",
+				"HELP",
+				"    Print this help.",
+			]
+		);
+	}
+
+	#[test]
+	fn test_every_subcommand_has_help() {
+		let table = CmdTable::new();
+		for name in table.names() {
+			let Some(sub_cmds) = table.get_cmd(name).unwrap().sub_cmds() else {
+				continue;
+			};
+			let help = sub_cmds.help();
+			assert!(help[0].starts_with(&format!("{} <subcommand>", name)));
+			for sub in sub_cmds.names() {
+				assert!(
+					help.iter()
+						.any(|line| *line == sub || line.starts_with(&format!("{} ", sub))),
+					"{} {} is missing from {} HELP",
+					name,
+					sub,
+					name
+				);
+			}
+		}
+	}
+}
@@ -1,15 +1,48 @@
 use std::collections::HashMap;
+use std::collections::HashSet;
 use std::sync::Arc;
 
+use super::AclCmd;
 use super::AppendCmd;
+use super::AskingCmd;
+use super::AuthCmd;
+use super::BackupCmd;
+use super::BgRewriteAofCmd;
+use super::BgSaveCmd;
+use super::BitCountCmd;
+use super::BitFieldCmd;
+use super::BitFieldRoCmd;
+use super::BitOpCmd;
+use super::BitPosCmd;
 use super::ClientCmd;
+use super::ClusterCmd;
 use super::Cmd;
+use super::CompactCmd;
 use super::ConfigCmd;
+use super::DebugCmd;
 use super::DecrCmd;
 use super::DelCmd;
+use super::DiscardCmd;
+use super::DumpCmd;
+use super::EvalCmd;
+use super::EvalRoCmd;
+use super::EvalShaCmd;
+use super::EvalShaRoCmd;
+use super::ExecCmd;
 use super::ExistsCmd;
 use super::ExpireCmd;
+use super::FailoverCmd;
+use super::FcallCmd;
+use super::FcallRoCmd;
 use super::FlushDbCmd;
+use super::FunctionCmd;
+use super::GeoAddCmd;
+use super::GeoDistCmd;
+use super::GeoHashCmd;
+use super::GeoPosCmd;
+use super::GeoSearchCmd;
+use super::GeoSearchStoreCmd;
+use super::GetBitCmd;
 use super::GetCmd;
 use super::HDelCmd;
 use super::HGetAllCmd;
@@ -19,28 +52,132 @@ use super::HMGetCmd;
 use super::HSetCmd;
 use super::HelloCmd;
 use super::IncrCmd;
+use super::InfoCmd;
 use super::LLenCmd;
 use super::LPopCmd;
 use super::LPushCmd;
 use super::LRangeCmd;
+use super::LastSaveCmd;
+use super::LatencyCmd;
+use super::LolwutCmd;
+use super::MemoryCmd;
+use super::MigrateCmd;
+use super::ModuleCmd;
+use super::MultiCmd;
+use super::NimbisCmd;
+use super::ObjectCmd;
+use super::PExpireAtCmd;
+use super::PSubscribeCmd;
+use super::PUnsubscribeCmd;
+use super::PfAddCmd;
+use super::PfCountCmd;
+use super::PfMergeCmd;
 use super::PingCmd;
+use super::PsyncCmd;
+use super::PublishCmd;
+use super::PubsubCmd;
 use super::RPopCmd;
 use super::RPushCmd;
+use super::ReadOnlyCmd;
+use super::ReadWriteCmd;
+use super::ReplConfCmd;
+use super::ReplicaOfCmd;
+use super::ResetCmd;
+use super::RestoreAskingCmd;
+use super::RestoreCmd;
+use super::RoleCmd;
 use super::SaddCmd;
+use super::SaveCmd;
 use super::ScardCmd;
+use super::ScriptCmd;
+use super::SetBitCmd;
 use super::SetCmd;
 use super::SismemberCmd;
+use super::SlaveOfCmd;
+use super::SlowlogCmd;
 use super::SmembersCmd;
 use super::SremCmd;
+use super::SubscribeCmd;
+use super::TimeCmd;
 use super::TtlCmd;
+use super::UnsubscribeCmd;
+use super::WaitAofCmd;
+use super::XAckCmd;
+use super::XAddCmd;
+use super::XAutoClaimCmd;
+use super::XClaimCmd;
+use super::XDelCmd;
+use super::XGroupCmd;
+use super::XInfoCmd;
+use super::XLenCmd;
+use super::XPendingCmd;
+use super::XRangeCmd;
+use super::XReadCmd;
+use super::XReadGroupCmd;
+use super::XRevRangeCmd;
+use super::XSetIdCmd;
+use super::XTrimCmd;
 use super::ZAddCmd;
 use super::ZCardCmd;
 use super::ZRangeCmd;
 use super::ZRemCmd;
 use super::ZScoreCmd;
+use crate::extension::ExtensionRegistry;
+use crate::extension::Registrar;
+
+/// Core commands that modify the dataset.
+const WRITE_CMDS: &[&str] = &[
+	"SET",
+	"DEL",
+	"INCR",
+	"DECR",
+	"APPEND",
+	"SETBIT",
+	"BITOP",
+	"BITFIELD",
+	"PFADD",
+	"PFMERGE",
+	"HSET",
+	"HDEL",
+	"LPUSH",
+	"RPUSH",
+	"LPOP",
+	"RPOP",
+	"SADD",
+	"SREM",
+	"ZADD",
+	"ZREM",
+	"GEOADD",
+	"GEOSEARCHSTORE",
+	"XADD",
+	"XGROUP",
+	"XREADGROUP",
+	"XACK",
+	"XCLAIM",
+	"XAUTOCLAIM",
+	"XDEL",
+	"XTRIM",
+	"XSETID",
+	"EXPIRE",
+	"PEXPIREAT",
+	"FLUSHDB",
+	"RESTORE",
+	"RESTORE-ASKING",
+	"MIGRATE",
+];
 
 pub struct CmdTable {
 	inner: HashMap<&'static str, Arc<dyn Cmd>>,
+	/// Extension commands that modify the dataset.
+	extension_writes: HashSet<&'static str>,
+}
+
+impl std::fmt::Debug for CmdTable {
+	fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+		let mut names: Vec<_> = self.inner.keys().collect();
+		names.sort();
+		f.debug_struct("CmdTable").field("cmds", &names).finish()
+	}
 }
 
 impl Default for CmdTable {
@@ -51,10 +188,19 @@ impl Default for CmdTable {
 
 impl CmdTable {
 	pub fn new() -> Self {
+		Self::with_extensions(&ExtensionRegistry::default())
+	}
+
+	/// Build the table with the core commands plus those registered by
+	/// `extensions`.
+	pub fn with_extensions(extensions: &ExtensionRegistry) -> Self {
 		let mut inner: HashMap<&'static str, Arc<dyn Cmd>> = HashMap::new();
 		// ping cmd
 		inner.insert("PING", Arc::new(PingCmd::default()));
 		inner.insert("HELLO", Arc::new(HelloCmd::default()));
+		// acl type cmd
+		inner.insert("AUTH", Arc::new(AuthCmd::default()));
+		inner.insert("ACL", Arc::new(AclCmd::default()));
 		// string type cmd
 		inner.insert("SET", Arc::new(SetCmd::default()));
 		inner.insert("GET", Arc::new(GetCmd::default()));
@@ -63,6 +209,25 @@ impl CmdTable {
 		inner.insert("INCR", Arc::new(IncrCmd::default()));
 		inner.insert("DECR", Arc::new(DecrCmd::default()));
 		inner.insert("APPEND", Arc::new(AppendCmd::default()));
+		// bitmap type cmd
+		inner.insert("SETBIT", Arc::new(SetBitCmd::default()));
+		inner.insert("GETBIT", Arc::new(GetBitCmd::default()));
+		inner.insert("BITCOUNT", Arc::new(BitCountCmd::default()));
+		inner.insert("BITPOS", Arc::new(BitPosCmd::default()));
+		inner.insert("BITOP", Arc::new(BitOpCmd::default()));
+		inner.insert("BITFIELD", Arc::new(BitFieldCmd::default()));
+		inner.insert("BITFIELD_RO", Arc::new(BitFieldRoCmd::default()));
+		// hyperloglog type cmd
+		inner.insert("PFADD", Arc::new(PfAddCmd::default()));
+		inner.insert("PFCOUNT", Arc::new(PfCountCmd::default()));
+		inner.insert("PFMERGE", Arc::new(PfMergeCmd::default()));
+		// geo type cmd
+		inner.insert("GEOADD", Arc::new(GeoAddCmd::default()));
+		inner.insert("GEOPOS", Arc::new(GeoPosCmd::default()));
+		inner.insert("GEODIST", Arc::new(GeoDistCmd::default()));
+		inner.insert("GEOHASH", Arc::new(GeoHashCmd::default()));
+		inner.insert("GEOSEARCH", Arc::new(GeoSearchCmd::default()));
+		inner.insert("GEOSEARCHSTORE", Arc::new(GeoSearchStoreCmd::default()));
 		// hash type cmd
 		inner.insert("HSET", Arc::new(HSetCmd::default()));
 		inner.insert("HDEL", Arc::new(HDelCmd::default()));
@@ -88,18 +253,124 @@ impl CmdTable {
 		inner.insert("SISMEMBER", Arc::new(SismemberCmd::default()));
 		inner.insert("SREM", Arc::new(SremCmd::default()));
 		inner.insert("SCARD", Arc::new(ScardCmd::default()));
+		// stream type cmd
+		inner.insert("XADD", Arc::new(XAddCmd::default()));
+		inner.insert("XLEN", Arc::new(XLenCmd::default()));
+		inner.insert("XRANGE", Arc::new(XRangeCmd::default()));
+		inner.insert("XREVRANGE", Arc::new(XRevRangeCmd::default()));
+		inner.insert("XDEL", Arc::new(XDelCmd::default()));
+		inner.insert("XTRIM", Arc::new(XTrimCmd::default()));
+		inner.insert("XSETID", Arc::new(XSetIdCmd::default()));
+		inner.insert("XREAD", Arc::new(XReadCmd::default()));
+		inner.insert("XGROUP", Arc::new(XGroupCmd::default()));
+		inner.insert("XREADGROUP", Arc::new(XReadGroupCmd::default()));
+		inner.insert("XACK", Arc::new(XAckCmd::default()));
+		inner.insert("XPENDING", Arc::new(XPendingCmd::default()));
+		inner.insert("XCLAIM", Arc::new(XClaimCmd::default()));
+		inner.insert("XAUTOCLAIM", Arc::new(XAutoClaimCmd::default()));
+		inner.insert("XINFO", Arc::new(XInfoCmd::default()));
 		// expire type cmd
 		inner.insert("EXPIRE", Arc::new(ExpireCmd::default()));
+		inner.insert("PEXPIREAT", Arc::new(PExpireAtCmd::default()));
 		inner.insert("TTL", Arc::new(TtlCmd::default()));
+		inner.insert("OBJECT", Arc::new(ObjectCmd::default()));
 		// config type cmd
 		inner.insert("CONFIG", Arc::new(ConfigCmd::default()));
 		inner.insert("CLIENT", Arc::new(ClientCmd::default()));
+		// diagnostics type cmd
+		inner.insert("SLOWLOG", Arc::new(SlowlogCmd::default()));
+		inner.insert("LATENCY", Arc::new(LatencyCmd::default()));
+		inner.insert("MEMORY", Arc::new(MemoryCmd::default()));
+		// server type cmd
+		inner.insert("TIME", Arc::new(TimeCmd::default()));
+		inner.insert("LOLWUT", Arc::new(LolwutCmd::default()));
+		inner.insert("RESET", Arc::new(ResetCmd::default()));
+		inner.insert("DEBUG", Arc::new(DebugCmd::default()));
+		inner.insert("INFO", Arc::new(InfoCmd::default()));
+		inner.insert("MODULE", Arc::new(ModuleCmd::default()));
+		// persistence type cmd
+		inner.insert("SAVE", Arc::new(SaveCmd::default()));
+		inner.insert("BGSAVE", Arc::new(BgSaveCmd::default()));
+		inner.insert("LASTSAVE", Arc::new(LastSaveCmd::default()));
+		inner.insert("BGREWRITEAOF", Arc::new(BgRewriteAofCmd::default()));
+		inner.insert("COMPACT", Arc::new(CompactCmd::default()));
+		inner.insert("WAITAOF", Arc::new(WaitAofCmd::default()));
+		inner.insert("BACKUP", Arc::new(BackupCmd::default()));
+		inner.insert("NIMBIS", Arc::new(NimbisCmd::default()));
+		inner.insert("DUMP", Arc::new(DumpCmd::default()));
+		inner.insert("RESTORE", Arc::new(RestoreCmd::default()));
+		inner.insert("RESTORE-ASKING", Arc::new(RestoreAskingCmd::default()));
+		inner.insert("MIGRATE", Arc::new(MigrateCmd::default()));
+		// replication type cmd
+		inner.insert("REPLICAOF", Arc::new(ReplicaOfCmd::default()));
+		inner.insert("SLAVEOF", Arc::new(SlaveOfCmd::default()));
+		inner.insert("REPLCONF", Arc::new(ReplConfCmd::default()));
+		inner.insert("PSYNC", Arc::new(PsyncCmd::default()));
+		inner.insert("READONLY", Arc::new(ReadOnlyCmd::default()));
+		inner.insert("READWRITE", Arc::new(ReadWriteCmd::default()));
+		inner.insert("FAILOVER", Arc::new(FailoverCmd::default()));
+		inner.insert("ROLE", Arc::new(RoleCmd::default()));
+		// cluster type cmd
+		inner.insert("CLUSTER", Arc::new(ClusterCmd::default()));
+		inner.insert("ASKING", Arc::new(AskingCmd::default()));
+		// transaction type cmd
+		inner.insert("MULTI", Arc::new(MultiCmd::default()));
+		inner.insert("EXEC", Arc::new(ExecCmd::default()));
+		inner.insert("DISCARD", Arc::new(DiscardCmd::default()));
+		// scripting type cmd
+		inner.insert("EVAL", Arc::new(EvalCmd::default()));
+		inner.insert("EVALSHA", Arc::new(EvalShaCmd::default()));
+		inner.insert("EVAL_RO", Arc::new(EvalRoCmd::default()));
+		inner.insert("EVALSHA_RO", Arc::new(EvalShaRoCmd::default()));
+		inner.insert("SCRIPT", Arc::new(ScriptCmd::default()));
+		inner.insert("FUNCTION", Arc::new(FunctionCmd::default()));
+		inner.insert("FCALL", Arc::new(FcallCmd::default()));
+		inner.insert("FCALL_RO", Arc::new(FcallRoCmd::default()));
+		// pubsub type cmd
+		inner.insert("SUBSCRIBE", Arc::new(SubscribeCmd::default()));
+		inner.insert("UNSUBSCRIBE", Arc::new(UnsubscribeCmd::default()));
+		inner.insert("PSUBSCRIBE", Arc::new(PSubscribeCmd::default()));
+		inner.insert("PUNSUBSCRIBE", Arc::new(PUnsubscribeCmd::default()));
+		inner.insert("PUBLISH", Arc::new(PublishCmd::default()));
+		inner.insert("PUBSUB", Arc::new(PubsubCmd::default()));
 		// other type cmd
 		inner.insert("FLUSHDB", Arc::new(FlushDbCmd::default()));
-		Self { inner }
+
+		let mut extension_writes = HashSet::new();
+		let mut types = HashMap::new();
+		for extension in extensions.iter() {
+			let mut registrar = Registrar::new(
+				extension.name(),
+				&mut inner,
+				&mut extension_writes,
+				&mut types,
+			);
+			extension.register(&mut registrar);
+		}
+
+		Self {
+			inner,
+			extension_writes,
+		}
 	}
 
 	pub fn get_cmd(&self, name: &str) -> Option<&Arc<dyn Cmd>> {
 		self.inner.get(name)
 	}
+
+	/// The name the command `name` is registered under, which callers can
+	/// keep without allocating, or None for an unknown command.
+	pub fn static_name(&self, name: &str) -> Option<&'static str> {
+		self.inner.get_key_value(name).map(|(name, _)| *name)
+	}
+
+	/// The names of every command, core and extension.
+	pub fn names(&self) -> impl Iterator<Item = &'static str> + '_ {
+		self.inner.keys().copied()
+	}
+
+	/// Whether the command `name` modifies the dataset.
+	pub fn is_write(&self, name: &str) -> bool {
+		WRITE_CMDS.contains(&name) || self.extension_writes.contains(name)
+	}
 }
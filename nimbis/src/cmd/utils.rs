@@ -1,8 +1,232 @@
 use std::str::FromStr;
 
+use nimbis_resp::RespValue;
+use nimbis_storage::geo::GeoPoint;
+use nimbis_storage::geo::GeoUnit;
+use nimbis_storage::stream::entry_value::StreamEntryValue;
+use nimbis_storage::stream::id::StreamId;
+
 pub fn parse_int<T: FromStr>(bytes: &[u8]) -> Result<T, String> {
 	let s = std::str::from_utf8(bytes)
 		.map_err(|_| "ERR value is not an integer or out of range".to_string())?;
 	s.parse::<T>()
 		.map_err(|_| "ERR value is not an integer or out of range".to_string())
 }
+
+/// Parse the bit offset of SETBIT and GETBIT, which addresses at most 512MB.
+pub fn parse_bit_offset(bytes: &[u8]) -> Result<u64, String> {
+	parse_int::<u64>(bytes)
+		.ok()
+		.filter(|offset| *offset <= u32::MAX as u64)
+		.ok_or_else(|| "ERR bit offset is not an integer or out of range".to_string())
+}
+
+/// Parse a float argument, rejecting NaN.
+pub fn parse_float(bytes: &[u8]) -> Result<f64, String> {
+	std::str::from_utf8(bytes)
+		.ok()
+		.and_then(|s| s.parse::<f64>().ok())
+		.filter(|value| !value.is_nan())
+		.ok_or_else(|| "ERR value is not a valid float".to_string())
+}
+
+/// Encode a GEO position as `[longitude, latitude]`, formatted like Redis
+/// with up to 17 decimals.
+pub fn geo_point_reply(point: GeoPoint) -> RespValue {
+	let format = |value: f64| {
+		let s = format!("{value:.17}");
+		let s = s.trim_end_matches('0').trim_end_matches('.');
+		if s == "-0" {
+			"0".to_string()
+		} else {
+			s.to_string()
+		}
+	};
+	RespValue::array([
+		RespValue::bulk_string(format(point.longitude)),
+		RespValue::bulk_string(format(point.latitude)),
+	])
+}
+
+/// Encode a GEO distance in meters in `unit`, with 4 decimals like Redis.
+pub fn geo_distance_reply(meters: f64, unit: GeoUnit) -> RespValue {
+	RespValue::bulk_string(format!("{:.4}", meters / unit.meters()))
+}
+
+/// Parse a stream ID argument; a bare `<ms>` takes `missing_seq` as sequence.
+pub fn parse_stream_id(bytes: &[u8], missing_seq: u64) -> Result<StreamId, String> {
+	StreamId::parse(bytes, missing_seq)
+		.ok_or_else(|| "ERR Invalid stream ID specified as stream command argument".to_string())
+}
+
+/// Parse a range bound of XRANGE-like commands: `-`, `+`, an ID, or an
+/// exclusive `(<id>`. A bare `<ms>` covers the whole millisecond.
+pub fn parse_stream_range_bound(bytes: &[u8], is_start: bool) -> Result<StreamId, String> {
+	match bytes {
+		b"-" => Ok(StreamId::MIN),
+		b"+" => Ok(StreamId::MAX),
+		[b'(', id @ ..] => {
+			let id = parse_stream_id(id, if is_start { 0 } else { u64::MAX })?;
+			let bound = if is_start { id.next() } else { id.prev() };
+			bound.ok_or_else(|| {
+				format!(
+					"ERR invalid {} ID for the interval",
+					if is_start { "start" } else { "end" }
+				)
+			})
+		}
+		_ => parse_stream_id(bytes, if is_start { 0 } else { u64::MAX }),
+	}
+}
+
+/// Encode stream entries as an array of `[id, [field, value, ...]]`.
+pub fn stream_entries_reply(entries: Vec<(StreamId, StreamEntryValue)>) -> RespValue {
+	RespValue::array(
+		entries
+			.into_iter()
+			.map(|(id, value)| stream_entry_reply(id, Some(value))),
+	)
+}
+
+/// Encode entries read by a consumer group like `stream_entries_reply`. A
+/// pending entry deleted from the stream is encoded as `[id, nil]`.
+pub fn stream_group_entries_reply(entries: Vec<(StreamId, Option<StreamEntryValue>)>) -> RespValue {
+	RespValue::array(
+		entries
+			.into_iter()
+			.map(|(id, value)| stream_entry_reply(id, value)),
+	)
+}
+
+/// Encode one stream entry as `[id, [field, value, ...]]`, or `[id, nil]`
+/// without a value.
+pub fn stream_entry_reply(id: StreamId, value: Option<StreamEntryValue>) -> RespValue {
+	let fields = match value {
+		Some(value) => RespValue::array(value.fields.into_iter().flat_map(|(field, value)| {
+			[RespValue::bulk_string(field), RespValue::bulk_string(value)]
+		})),
+		None => RespValue::Null,
+	};
+	RespValue::array([RespValue::bulk_string(id.to_string()), fields])
+}
+
+/// Match `string` against a Redis glob-style `pattern`. Supports `*`, `?`,
+/// `[...]` classes with `^` negation and `a-z` ranges, and `\` escapes.
+pub fn glob_match(pattern: &[u8], string: &[u8]) -> bool {
+	match pattern {
+		[] => string.is_empty(),
+		[b'*', ..] => {
+			let rest = &pattern[pattern.iter().take_while(|&&b| b == b'*').count()..];
+			(0..=string.len()).any(|i| glob_match(rest, &string[i..]))
+		}
+		[b'?', rest @ ..] => !string.is_empty() && glob_match(rest, &string[1..]),
+		[b'[', rest @ ..] => {
+			let Some((&c, string_rest)) = string.split_first() else {
+				return false;
+			};
+			let (matched, rest) = match_class(rest, c);
+			matched && glob_match(rest, string_rest)
+		}
+		[b'\\', escaped, rest @ ..] | [escaped, rest @ ..] => {
+			string.first() == Some(escaped) && glob_match(rest, &string[1..])
+		}
+	}
+}
+
+/// Match `c` against a `[...]` class whose opening bracket was already
+/// consumed, returning the result and the pattern after the closing bracket.
+fn match_class(mut pattern: &[u8], c: u8) -> (bool, &[u8]) {
+	let negate = pattern.first() == Some(&b'^');
+	if negate {
+		pattern = &pattern[1..];
+	}
+
+	let mut matched = false;
+	loop {
+		match pattern {
+			[] => break,
+			[b']', rest @ ..] => {
+				pattern = rest;
+				break;
+			}
+			[b'\\', escaped, rest @ ..] => {
+				matched |= *escaped == c;
+				pattern = rest;
+			}
+			[lo, b'-', hi, rest @ ..] if *hi != b']' => {
+				matched |= (*lo.min(hi)..=*lo.max(hi)).contains(&c);
+				pattern = rest;
+			}
+			[other, rest @ ..] => {
+				matched |= *other == c;
+				pattern = rest;
+			}
+		}
+	}
+	(matched != negate, pattern)
+}
+
+#[cfg(test)]
+mod tests {
+	use rstest::rstest;
+
+	use super::*;
+
+	#[rstest]
+	#[case("*", "anything", true)]
+	#[case("*", "", true)]
+	#[case("h?llo", "hello", true)]
+	#[case("h?llo", "hllo", false)]
+	#[case("h*llo", "heeeello", true)]
+	#[case("h[ae]llo", "hallo", true)]
+	#[case("h[ae]llo", "hillo", false)]
+	#[case("h[^e]llo", "hallo", true)]
+	#[case("h[^e]llo", "hello", false)]
+	#[case("h[a-b]llo", "hbllo", true)]
+	#[case("h\\*llo", "h*llo", true)]
+	#[case("h\\*llo", "hello", false)]
+	#[case("lib_*", "lib_one", true)]
+	#[case("lib_*", "other", false)]
+	fn test_glob_match(#[case] pattern: &str, #[case] string: &str, #[case] expected: bool) {
+		assert_eq!(glob_match(pattern.as_bytes(), string.as_bytes()), expected);
+	}
+
+	#[test]
+	fn test_geo_point_reply() {
+		let point = GeoPoint {
+			longitude: 13.36138933897018433,
+			latitude: -0.5,
+		};
+		assert_eq!(
+			geo_point_reply(point),
+			RespValue::array([
+				RespValue::bulk_string("13.36138933897018433"),
+				RespValue::bulk_string("-0.5"),
+			])
+		);
+	}
+
+	#[rstest]
+	#[case("-", true, Ok(StreamId::MIN))]
+	#[case("+", false, Ok(StreamId::MAX))]
+	#[case("5", true, Ok(StreamId::new(5, 0)))]
+	#[case("5", false, Ok(StreamId::new(5, u64::MAX)))]
+	#[case("(5-1", true, Ok(StreamId::new(5, 2)))]
+	#[case("(5-1", false, Ok(StreamId::new(5, 0)))]
+	#[case("(0-0", false, Err("ERR invalid end ID for the interval"))]
+	#[case(
+		"x",
+		true,
+		Err("ERR Invalid stream ID specified as stream command argument")
+	)]
+	fn test_parse_stream_range_bound(
+		#[case] input: &str,
+		#[case] is_start: bool,
+		#[case] expected: Result<StreamId, &str>,
+	) {
+		assert_eq!(
+			parse_stream_range_bound(input.as_bytes(), is_start),
+			expected.map_err(str::to_string)
+		);
+	}
+}
@@ -0,0 +1,133 @@
+//! Per-command counters for the Commandstats section of INFO.
+//!
+//! Like Redis, every command that ran counts as a call, with the time it took,
+//! and a call that replied with an error also counts as failed. A command
+//! refused before it ran, for its arity, ACL permissions, the rate limits, a
+//! full disk or memory, or because the server is a replica, counts as
+//! rejected instead. Unknown commands are counted nowhere. CONFIG RESETSTAT
+//! sets every counter back to zero.
+
+use std::collections::HashMap;
+use std::sync::Mutex;
+use std::time::Duration;
+
+use crate::GCTX;
+
+#[derive(Debug, Default, Clone, Copy, PartialEq, Eq)]
+struct CommandStat {
+	calls: u64,
+	usec: u64,
+	rejected_calls: u64,
+	failed_calls: u64,
+}
+
+/// Counters of every command run or refused since the server started, or
+/// since the last CONFIG RESETSTAT.
+#[derive(Debug, Default)]
+pub struct CommandStats {
+	/// Keyed by the name the command is registered under, lowercased only
+	/// for INFO.
+	commands: Mutex<HashMap<&'static str, CommandStat>>,
+}
+
+impl CommandStats {
+	pub fn new() -> Self {
+		Self::default()
+	}
+
+	fn record_call(&self, name: &'static str, duration: Duration, failed: bool) {
+		let mut commands = self.commands.lock().unwrap();
+		let stat = commands.entry(name).or_default();
+		stat.calls += 1;
+		stat.usec += duration.as_micros() as u64;
+		stat.failed_calls += failed as u64;
+	}
+
+	fn record_rejected(&self, name: &'static str) {
+		self.commands
+			.lock()
+			.unwrap()
+			.entry(name)
+			.or_default()
+			.rejected_calls += 1;
+	}
+
+	pub fn reset(&self) {
+		self.commands.lock().unwrap().clear();
+	}
+
+	/// Fields of the Commandstats section of INFO, sorted by command name.
+	pub fn info(&self) -> Vec<(String, String)> {
+		let commands = self.commands.lock().unwrap();
+		let mut fields: Vec<_> = commands
+			.iter()
+			.map(|(name, stat)| {
+				let usec_per_call = if stat.calls == 0 {
+					0.0
+				} else {
+					stat.usec as f64 / stat.calls as f64
+				};
+				(
+					format!("cmdstat_{}", name.to_lowercase()),
+					format!(
+						"calls={},usec={},usec_per_call={:.2},rejected_calls={},failed_calls={}",
+						stat.calls,
+						stat.usec,
+						usec_per_call,
+						stat.rejected_calls,
+						stat.failed_calls
+					),
+				)
+			})
+			.collect();
+		fields.sort();
+		fields
+	}
+}
+
+/// Count a run of command `name` that took `duration`, and whether it
+/// replied with an error.
+pub fn record_call(name: &str, duration: Duration, failed: bool) {
+	if let Some(name) = GCTX!(cmd_table).static_name(name) {
+		GCTX!(commandstats).record_call(name, duration, failed);
+	}
+}
+
+/// Count command `name` as refused before it ran.
+pub fn record_rejected(name: &str) {
+	if let Some(name) = GCTX!(cmd_table).static_name(name) {
+		GCTX!(commandstats).record_rejected(name);
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+
+	#[test]
+	fn test_calls_and_errors() {
+		let stats = CommandStats::new();
+		assert!(stats.info().is_empty());
+
+		stats.record_call("GET", Duration::from_micros(10), false);
+		stats.record_call("GET", Duration::from_micros(20), true);
+		stats.record_rejected("SET");
+		assert_eq!(
+			stats.info(),
+			vec![
+				(
+					"cmdstat_get".to_string(),
+					"calls=2,usec=30,usec_per_call=15.00,rejected_calls=0,failed_calls=1"
+						.to_string()
+				),
+				(
+					"cmdstat_set".to_string(),
+					"calls=0,usec=0,usec_per_call=0.00,rejected_calls=1,failed_calls=0".to_string()
+				),
+			]
+		);
+
+		stats.reset();
+		assert!(stats.info().is_empty());
+	}
+}
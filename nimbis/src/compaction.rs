@@ -0,0 +1,344 @@
+//! Manual and scheduled compactions.
+//!
+//! The storage engine compacts each DB on its own once enough tables pile up,
+//! running up to `compaction_threads` compactions at once. COMPACT, or a
+//! timer every `compaction_interval_seconds`, starts a compaction run on top:
+//! it walks the element DBs, or only the records of the keys in a range,
+//! deleting the elements of deleted and replaced collections like a GC pass,
+//! then flushes the memtable of every DB, so the engine compacts what the run
+//! deleted into the older tables. Runs read at most `compaction_rate_limit`
+//! records a second, so operators can schedule them outside traffic peaks and
+//! keep them from competing with clients.
+
+use std::sync::Mutex;
+use std::time::Duration;
+use std::time::Instant;
+
+use bytes::Bytes;
+use log::error;
+use log::info;
+use nimbis_storage::Storage;
+use nimbis_storage::gc::GC_DBS;
+use nimbis_storage::gc::KeyRange;
+
+use crate::GCTX;
+use crate::server_config;
+
+const COMPACTION_IN_PROGRESS: &str = "ERR Background compaction already in progress";
+/// How often the next batch of a run runs, or a run is checked for.
+const COMPACTION_TICK: Duration = Duration::from_millis(100);
+/// Element records read by one batch, at most.
+const COMPACTION_BATCH_SIZE: usize = 1000;
+
+/// Run compactions for the lifetime of the server.
+pub fn start_compaction(storage: Storage) {
+	tokio::spawn(async move {
+		let mut interval = tokio::time::interval(COMPACTION_TICK);
+		loop {
+			interval.tick().await;
+			let compaction = GCTX!(compaction);
+			let Some(step) = compaction.next_step(server_config!(compaction_interval_seconds))
+			else {
+				continue;
+			};
+			let (db, range, start) = match step {
+				CompactionStep::Walk { db, range, start } => (db, range, start),
+				CompactionStep::Flush => {
+					match storage.rewrite_log().await {
+						Ok(()) => compaction.finish_run(),
+						Err(e) => compaction.fail_run(&e.to_string()),
+					}
+					continue;
+				}
+			};
+
+			let rate = server_config!(compaction_rate_limit);
+			let limit = match rate {
+				0 => COMPACTION_BATCH_SIZE,
+				rate => COMPACTION_BATCH_SIZE.min(rate as usize),
+			};
+			let started = Instant::now();
+			let result = {
+				// Like GC batches, never inside a transaction or script.
+				let _guard = GCTX!(exec_lock).read().await;
+				match &range {
+					Some(range) => storage.gc_range_step(GC_DBS[db], range, start, limit).await,
+					None => storage.gc_step(GC_DBS[db], start, limit).await,
+				}
+			};
+			match result {
+				Ok(step) => {
+					compaction.finish_batch(step.purged, step.reclaimed_bytes, step.next);
+					if rate > 0 {
+						// Keep the run to `rate` records a second.
+						let due = Duration::from_secs_f64(step.scanned as f64 / rate as f64);
+						tokio::time::sleep(due.saturating_sub(started.elapsed())).await;
+					}
+				}
+				Err(e) => compaction.fail_run(&e.to_string()),
+			}
+		}
+	});
+}
+
+/// What the next tick of a run does.
+#[derive(Debug, PartialEq, Eq)]
+enum CompactionStep {
+	/// Run a batch over the DB at `db` in `GC_DBS`, from `start`.
+	Walk {
+		db: usize,
+		range: Option<KeyRange>,
+		start: Option<Bytes>,
+	},
+	/// Flush the memtables, once every DB has been walked.
+	Flush,
+}
+
+/// Where a running run is: the index of its DB in `GC_DBS`, which is
+/// `GC_DBS.len()` once only the flush is left, and the key its next batch
+/// starts at.
+#[derive(Debug)]
+struct CompactionCursor {
+	range: Option<KeyRange>,
+	db: usize,
+	start: Option<Bytes>,
+	started: Instant,
+	purged: u64,
+	reclaimed_bytes: u64,
+}
+
+#[derive(Debug)]
+struct CompactionState {
+	cursor: Option<CompactionCursor>,
+	/// The range COMPACT asked for, `Some(None)` for every key.
+	requested: Option<Option<KeyRange>>,
+	/// When the last run ended, or the server started.
+	last_run_at: Instant,
+	last_run_ok: bool,
+	runs: u64,
+	purged: u64,
+	reclaimed_bytes: u64,
+}
+
+#[derive(Debug)]
+pub struct Compaction {
+	state: Mutex<CompactionState>,
+}
+
+impl Default for Compaction {
+	fn default() -> Self {
+		Self::new()
+	}
+}
+
+impl Compaction {
+	pub fn new() -> Self {
+		Self {
+			state: Mutex::new(CompactionState {
+				cursor: None,
+				requested: None,
+				last_run_at: Instant::now(),
+				last_run_ok: true,
+				runs: 0,
+				purged: 0,
+				reclaimed_bytes: 0,
+			}),
+		}
+	}
+
+	/// Ask for a run over the keys in `range`, or every key, to start on
+	/// the next tick.
+	pub fn request(&self, range: Option<KeyRange>) -> Result<(), String> {
+		let mut state = self.state.lock().unwrap();
+		if state.cursor.is_some() || state.requested.is_some() {
+			return Err(COMPACTION_IN_PROGRESS.to_string());
+		}
+		state.requested = Some(range);
+		Ok(())
+	}
+
+	/// The next step to run, starting a run when one is requested or
+	/// `interval_secs` have passed since the last one. An interval of 0 only
+	/// runs requested runs.
+	fn next_step(&self, interval_secs: u64) -> Option<CompactionStep> {
+		let mut state = self.state.lock().unwrap();
+		if state.cursor.is_none() {
+			let due = interval_secs > 0
+				&& state.last_run_at.elapsed() >= Duration::from_secs(interval_secs);
+			let range = match state.requested.take() {
+				Some(range) => range,
+				None if due => None,
+				None => return None,
+			};
+			state.cursor = Some(CompactionCursor {
+				range,
+				db: 0,
+				start: None,
+				started: Instant::now(),
+				purged: 0,
+				reclaimed_bytes: 0,
+			});
+		}
+		let cursor = state.cursor.as_ref()?;
+		if cursor.db == GC_DBS.len() {
+			return Some(CompactionStep::Flush);
+		}
+		Some(CompactionStep::Walk {
+			db: cursor.db,
+			range: cursor.range.clone(),
+			start: cursor.start.clone(),
+		})
+	}
+
+	fn finish_batch(&self, purged: u64, reclaimed_bytes: u64, next: Option<Bytes>) {
+		let mut state = self.state.lock().unwrap();
+		state.purged += purged;
+		state.reclaimed_bytes += reclaimed_bytes;
+		let Some(cursor) = state.cursor.as_mut() else {
+			return;
+		};
+		cursor.purged += purged;
+		cursor.reclaimed_bytes += reclaimed_bytes;
+		cursor.start = next;
+		if cursor.start.is_none() {
+			cursor.db += 1;
+		}
+	}
+
+	fn finish_run(&self) {
+		let mut state = self.state.lock().unwrap();
+		if let Some(cursor) = state.cursor.take() {
+			info!(
+				"Background compaction terminated with success in {:?}: purged {} records, {} bytes",
+				cursor.started.elapsed(),
+				cursor.purged,
+				cursor.reclaimed_bytes
+			);
+		}
+		state.runs += 1;
+		state.last_run_ok = true;
+		state.last_run_at = Instant::now();
+	}
+
+	fn fail_run(&self, err: &str) {
+		error!("Background compaction error: {}", err);
+		let mut state = self.state.lock().unwrap();
+		state.cursor = None;
+		state.last_run_ok = false;
+		state.last_run_at = Instant::now();
+	}
+
+	/// Compaction fields of the Storage section of INFO.
+	pub fn info(&self) -> Vec<(String, String)> {
+		let state = self.state.lock().unwrap();
+		vec![
+			(
+				"compaction_in_progress".to_string(),
+				(state.cursor.is_some() as u8).to_string(),
+			),
+			("compaction_runs".to_string(), state.runs.to_string()),
+			(
+				"compaction_last_run_status".to_string(),
+				if state.last_run_ok { "ok" } else { "err" }.to_string(),
+			),
+			(
+				"compaction_purged_records".to_string(),
+				state.purged.to_string(),
+			),
+			(
+				"compaction_reclaimed_bytes".to_string(),
+				state.reclaimed_bytes.to_string(),
+			),
+		]
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+
+	fn field<'a>(info: &'a [(String, String)], name: &str) -> &'a str {
+		&info.iter().find(|(k, _)| k == name).unwrap().1
+	}
+
+	#[test]
+	fn test_run_walks_every_db_then_flushes() {
+		let compaction = Compaction::new();
+		assert_eq!(compaction.next_step(0), None);
+
+		let range = KeyRange {
+			first: Bytes::from("a"),
+			last: Bytes::from("m"),
+		};
+		compaction.request(Some(range.clone())).unwrap();
+		assert_eq!(
+			compaction.request(None),
+			Err(COMPACTION_IN_PROGRESS.to_string())
+		);
+		assert_eq!(
+			compaction.next_step(0),
+			Some(CompactionStep::Walk {
+				db: 0,
+				range: Some(range.clone()),
+				start: None,
+			})
+		);
+
+		// A batch that stops early resumes in the same DB.
+		compaction.finish_batch(2, 64, Some(Bytes::from("k")));
+		assert_eq!(
+			compaction.next_step(0),
+			Some(CompactionStep::Walk {
+				db: 0,
+				range: Some(range),
+				start: Some(Bytes::from("k")),
+			})
+		);
+		for _ in 0..GC_DBS.len() {
+			assert!(matches!(
+				compaction.next_step(0),
+				Some(CompactionStep::Walk { .. })
+			));
+			compaction.finish_batch(0, 0, None);
+		}
+		assert_eq!(compaction.next_step(0), Some(CompactionStep::Flush));
+		assert_eq!(field(&compaction.info(), "compaction_in_progress"), "1");
+		compaction.finish_run();
+
+		let info = compaction.info();
+		assert_eq!(field(&info, "compaction_in_progress"), "0");
+		assert_eq!(field(&info, "compaction_runs"), "1");
+		assert_eq!(field(&info, "compaction_purged_records"), "2");
+		assert_eq!(field(&info, "compaction_reclaimed_bytes"), "64");
+		assert_eq!(compaction.next_step(0), None);
+	}
+
+	#[test]
+	fn test_scheduled_run_covers_every_key() {
+		let compaction = Compaction::new();
+		compaction.state.lock().unwrap().last_run_at = Instant::now() - Duration::from_secs(60);
+		assert_eq!(compaction.next_step(120), None);
+		assert_eq!(
+			compaction.next_step(30),
+			Some(CompactionStep::Walk {
+				db: 0,
+				range: None,
+				start: None,
+			})
+		);
+	}
+
+	#[test]
+	fn test_failed_run() {
+		let compaction = Compaction::new();
+		compaction.request(None).unwrap();
+		compaction.next_step(0).unwrap();
+		compaction.fail_run("boom");
+
+		let info = compaction.info();
+		assert_eq!(field(&info, "compaction_in_progress"), "0");
+		assert_eq!(field(&info, "compaction_last_run_status"), "err");
+		assert_eq!(field(&info, "compaction_runs"), "0");
+		compaction.request(None).unwrap();
+	}
+}
@@ -27,10 +27,13 @@ use std::path::Path;
 use std::path::PathBuf;
 use std::str::FromStr;
 use std::sync::Arc;
+use std::sync::Mutex;
 use std::sync::OnceLock;
 
 use arc_swap::ArcSwap;
 pub use nimbis_macros::OnlineConfig;
+use nimbis_resp::ParserLimits;
+use nimbis_storage::compression::Codec;
 use nimbis_telemetry::TelemetryError;
 use nimbis_telemetry::logger::File as LogFile;
 use nimbis_telemetry::logger::LogOutput;
@@ -42,7 +45,14 @@ use serde::Deserialize;
 use serde::Serialize;
 use thiserror::Error;
 
+use crate::bind::BindAddresses;
 use crate::cli::Cli;
+use crate::output_buffer::ClientOutputBufferLimits;
+use crate::persistence::AppendFsync;
+use crate::persistence::AppendOnly;
+use crate::persistence::SaveSchedule;
+use crate::rename::RenameCommands;
+use crate::tls::TlsAuthClients;
 
 /// Configuration-related errors
 #[derive(Error, Debug)]
@@ -91,9 +101,57 @@ pub enum ConfigError {
 	#[error("trace_report_interval_ms must be greater than 0")]
 	InvalidTraceReportInterval,
 
+	#[error("{0}")]
+	InvalidDiskLimit(String),
+
+	#[error("{0}")]
+	InvalidMaxClients(String),
+
+	#[error("{0}")]
+	InvalidProtoLimit(String),
+
+	#[error("tcp_backlog must be greater than 0")]
+	InvalidTcpBacklog,
+
+	#[error("Invalid value_compression: {0}. Valid values: none, zstd")]
+	InvalidValueCompression(String),
+
+	#[error("Invalid host: {0}")]
+	InvalidHost(String),
+
+	#[error("port and tls_port can not both be 0")]
+	NoListener,
+
+	#[error("{0}")]
+	InvalidClusterPort(String),
+
+	#[error("{0} must be set when tls_port is not 0")]
+	TlsFileRequired(&'static str),
+
 	#[error("Invalid environment variable {key}: {value}")]
 	InvalidEnvVar { key: String, value: String },
 
+	#[error("Invalid configuration at line {line}: {reason}")]
+	InvalidConfLine { line: usize, reason: String },
+
+	#[error("Invalid --set {setting}: {reason}")]
+	InvalidCliSetting { setting: String, reason: String },
+
+	#[error("The server is running without a config file")]
+	NoConfigFile,
+
+	#[error("Failed to write configuration file '{path}': {source}")]
+	Write {
+		source: std::io::Error,
+		path: String,
+	},
+
+	#[error("Failed to serialize TOML configuration: {0}")]
+	TomlSerialize(#[from] toml::ser::Error),
+
+	#[error("Failed to edit TOML configuration: {0}")]
+	TomlEdit(#[from] toml_edit::TomlError),
+
 	#[error(transparent)]
 	Telemetry(#[from] TelemetryError),
 }
@@ -113,18 +171,30 @@ impl fmt::Display for ObjectStoreOptions {
 #[serde(default)]
 pub struct ServerConfig {
 	#[online_config(immutable)]
-	pub host: String,
+	pub host: BindAddresses,
 	#[online_config(immutable)]
 	pub port: u16,
+	pub protected_mode: bool,
+	#[online_config(callback = "check_maxclients")]
+	pub maxclients: usize,
+	pub timeout: u64,
+	pub tcp_keepalive: u64,
+	pub tcp_nodelay: bool,
+	#[online_config(immutable)]
+	pub tcp_backlog: u32,
+	#[online_config(callback = "check_proto_limits")]
+	pub proto_max_inline_len: usize,
+	#[online_config(callback = "check_proto_limits")]
+	pub proto_max_multibulk_len: usize,
+	#[online_config(callback = "check_proto_limits")]
+	pub proto_max_bulk_len: usize,
 	#[online_config(immutable)]
 	pub object_store_url: String,
 	#[online_config(immutable)]
 	pub object_store_options: ObjectStoreOptions,
-	// Support redis-benchmark
-	#[online_config(immutable)]
-	pub save: String,
-	#[online_config(immutable)]
-	pub appendonly: String,
+	pub save: SaveSchedule,
+	pub appendonly: AppendOnly,
+	pub appendfsync: AppendFsync,
 	#[online_config(callback = "on_log_level_change")]
 	pub log_level: String,
 	#[online_config(immutable)]
@@ -145,6 +215,65 @@ pub struct ServerConfig {
 	pub trace_report_interval_ms: u64,
 	#[online_config(immutable)]
 	pub runtime_threads: usize,
+	#[online_config(immutable)]
+	pub io_threads: usize,
+	#[online_config(immutable)]
+	pub command_parallelism: usize,
+	pub slowlog_log_slower_than: i64,
+	pub slowlog_max_len: usize,
+	pub latency_monitor_threshold: u64,
+	pub latency_tracking: bool,
+	pub lua_time_limit: u64,
+	pub lfu_log_factor: u32,
+	pub lfu_decay_time: u64,
+	pub gc_interval_seconds: u64,
+	#[online_config(immutable)]
+	pub compaction_threads: usize,
+	pub compaction_interval_seconds: u64,
+	pub compaction_rate_limit: u64,
+	pub lazyfree_lazy_server_del: bool,
+	#[online_config(immutable)]
+	pub value_compression: String,
+	#[online_config(immutable)]
+	pub value_compression_threshold: usize,
+	#[online_config(immutable)]
+	pub hot_cache_max_keys: usize,
+	#[online_config(immutable)]
+	pub hot_cache_max_value_size: usize,
+	#[online_config(callback = "check_disk_limits")]
+	pub disk_soft_limit_percent: u8,
+	#[online_config(callback = "check_disk_limits")]
+	pub disk_hard_limit_percent: u8,
+	pub repl_backlog_size: u64,
+	pub replica_read_only: bool,
+	pub masteruser: String,
+	pub masterauth: String,
+	#[online_config(immutable)]
+	pub cluster_enabled: bool,
+	#[online_config(immutable)]
+	pub cluster_port: u16,
+	pub cluster_node_timeout: u64,
+	pub cluster_require_full_coverage: bool,
+	pub client_output_buffer_limit: ClientOutputBufferLimits,
+	pub maxmemory: usize,
+	pub maxmemory_clients: usize,
+	#[online_config(immutable)]
+	pub aclfile: String,
+	pub acllog_max_len: usize,
+	pub client_commands_per_second: u64,
+	pub user_commands_per_second: u64,
+	#[online_config(immutable)]
+	pub tls_port: u16,
+	#[online_config(immutable)]
+	pub tls_cert_file: String,
+	#[online_config(immutable)]
+	pub tls_key_file: String,
+	#[online_config(immutable)]
+	pub tls_ca_cert_file: String,
+	#[online_config(immutable)]
+	pub tls_auth_clients: TlsAuthClients,
+	#[online_config(immutable)]
+	pub rename_command: RenameCommands,
 }
 
 impl ServerConfig {
@@ -155,6 +284,60 @@ impl ServerConfig {
 			.map_err(|e| e.to_string())
 	}
 
+	fn check_maxclients(&self) -> Result<(), String> {
+		if self.maxclients == 0 {
+			return Err("maxclients must be greater than 0".to_string());
+		}
+		Ok(())
+	}
+
+	fn check_proto_limits(&self) -> Result<(), String> {
+		for (name, limit) in [
+			("proto_max_inline_len", self.proto_max_inline_len),
+			("proto_max_multibulk_len", self.proto_max_multibulk_len),
+			("proto_max_bulk_len", self.proto_max_bulk_len),
+		] {
+			if limit == 0 {
+				return Err(format!("{} must be greater than 0", name));
+			}
+		}
+		Ok(())
+	}
+
+	/// The limits of the `proto_max_*` settings for parsing client input.
+	pub fn parser_limits(&self) -> ParserLimits {
+		ParserLimits {
+			max_inline_len: self.proto_max_inline_len,
+			max_multibulk_len: self.proto_max_multibulk_len,
+			max_bulk_len: self.proto_max_bulk_len,
+		}
+	}
+
+	fn check_disk_limits(&self) -> Result<(), String> {
+		for (name, percent) in [
+			("disk_soft_limit_percent", self.disk_soft_limit_percent),
+			("disk_hard_limit_percent", self.disk_hard_limit_percent),
+		] {
+			if percent > 100 {
+				return Err(format!(
+					"Invalid {}: {}. Expected a value between 0 and 100",
+					name, percent
+				));
+			}
+		}
+		// A limit of 0 is disabled, so only two set limits are compared.
+		if self.disk_soft_limit_percent > 0
+			&& self.disk_hard_limit_percent > 0
+			&& self.disk_soft_limit_percent > self.disk_hard_limit_percent
+		{
+			return Err(format!(
+				"Invalid disk limits: disk_soft_limit_percent {} is above disk_hard_limit_percent {}",
+				self.disk_soft_limit_percent, self.disk_hard_limit_percent
+			));
+		}
+		Ok(())
+	}
+
 	fn validate(&self) -> Result<(), ConfigError> {
 		nimbis_telemetry::logger::validate_log_level(&self.log_level)?;
 
@@ -193,6 +376,69 @@ impl ServerConfig {
 			return Err(ConfigError::InvalidTraceReportInterval);
 		}
 
+		self.check_disk_limits()
+			.map_err(ConfigError::InvalidDiskLimit)?;
+
+		self.check_maxclients()
+			.map_err(ConfigError::InvalidMaxClients)?;
+
+		self.check_proto_limits()
+			.map_err(ConfigError::InvalidProtoLimit)?;
+
+		if self.tcp_backlog == 0 {
+			return Err(ConfigError::InvalidTcpBacklog);
+		}
+
+		if self.value_compression.parse::<Codec>().is_err() {
+			return Err(ConfigError::InvalidValueCompression(
+				self.value_compression.clone(),
+			));
+		}
+
+		self.validate_tls()?;
+
+		self.check_cluster_port()
+			.map_err(ConfigError::InvalidClusterPort)?;
+
+		Ok(())
+	}
+
+	/// Cluster mode needs a client port, and a bus port that fits in a u16.
+	fn check_cluster_port(&self) -> Result<(), String> {
+		if !self.cluster_enabled {
+			return Ok(());
+		}
+		if self.port == 0 {
+			return Err("cluster_enabled needs a port that is not 0".to_string());
+		}
+		if self.cluster_port == 0 && self.port > u16::MAX - 10000 {
+			return Err(format!(
+				"cluster_port must be set when port {} is above {}",
+				self.port,
+				u16::MAX - 10000
+			));
+		}
+		Ok(())
+	}
+
+	fn validate_tls(&self) -> Result<(), ConfigError> {
+		if self.port == 0 && self.tls_port == 0 {
+			return Err(ConfigError::NoListener);
+		}
+		if self.tls_port == 0 {
+			return Ok(());
+		}
+
+		if self.tls_cert_file.is_empty() {
+			return Err(ConfigError::TlsFileRequired("tls_cert_file"));
+		}
+		if self.tls_key_file.is_empty() {
+			return Err(ConfigError::TlsFileRequired("tls_key_file"));
+		}
+		if self.tls_auth_clients != TlsAuthClients::No && self.tls_ca_cert_file.is_empty() {
+			return Err(ConfigError::TlsFileRequired("tls_ca_cert_file"));
+		}
+
 		Ok(())
 	}
 }
@@ -200,12 +446,22 @@ impl ServerConfig {
 impl Default for ServerConfig {
 	fn default() -> Self {
 		Self {
-			host: "127.0.0.1".into(),
+			host: BindAddresses::default(),
 			port: 6379,
+			protected_mode: true,
+			maxclients: 10000,
+			timeout: 0,
+			tcp_keepalive: 300,
+			tcp_nodelay: true,
+			tcp_backlog: 511,
+			proto_max_inline_len: 64 * 1024,
+			proto_max_multibulk_len: 1024 * 1024,
+			proto_max_bulk_len: 512 * 1024 * 1024,
 			object_store_url: "file:nimbis_store".into(),
 			object_store_options: ObjectStoreOptions::default(),
-			save: "".into(),
-			appendonly: "no".into(),
+			save: SaveSchedule::default(),
+			appendonly: AppendOnly::default(),
+			appendfsync: AppendFsync::default(),
 			log_level: "info".into(),
 			log_output: "terminal".into(),
 			log_rotation: "daily".into(),
@@ -216,6 +472,47 @@ impl Default for ServerConfig {
 			trace_export_timeout_seconds: 10,
 			trace_report_interval_ms: 1000,
 			runtime_threads: num_cpus::get(),
+			io_threads: 0,
+			command_parallelism: 0,
+			slowlog_log_slower_than: 10000,
+			slowlog_max_len: 128,
+			latency_monitor_threshold: 0,
+			latency_tracking: true,
+			lua_time_limit: 5000,
+			lfu_log_factor: 10,
+			lfu_decay_time: 1,
+			gc_interval_seconds: 600,
+			compaction_threads: 0,
+			compaction_interval_seconds: 0,
+			compaction_rate_limit: 0,
+			lazyfree_lazy_server_del: true,
+			value_compression: "none".to_string(),
+			value_compression_threshold: 1024,
+			hot_cache_max_keys: 0,
+			hot_cache_max_value_size: 1024,
+			disk_soft_limit_percent: 90,
+			disk_hard_limit_percent: 95,
+			repl_backlog_size: 1024 * 1024,
+			replica_read_only: true,
+			masteruser: "".into(),
+			masterauth: "".into(),
+			cluster_enabled: false,
+			cluster_port: 0,
+			cluster_node_timeout: 15000,
+			cluster_require_full_coverage: true,
+			client_output_buffer_limit: ClientOutputBufferLimits::default(),
+			maxmemory: 0,
+			maxmemory_clients: 0,
+			aclfile: "".into(),
+			acllog_max_len: 128,
+			client_commands_per_second: 0,
+			user_commands_per_second: 0,
+			tls_port: 0,
+			tls_cert_file: "".into(),
+			tls_key_file: "".into(),
+			tls_ca_cert_file: "".into(),
+			tls_auth_clients: TlsAuthClients::default(),
+			rename_command: RenameCommands::default(),
 		}
 	}
 }
@@ -256,11 +553,16 @@ impl Default for GlobalConfig {
 
 pub static SERVER_CONF: GlobalConfig = GlobalConfig::new();
 
+/// The file the configuration was loaded from, which CONFIG REWRITE writes.
+static CONFIG_PATH: OnceLock<PathBuf> = OnceLock::new();
+/// Keeps concurrent rewrites from writing the same temporary file.
+static REWRITE_LOCK: Mutex<()> = Mutex::new(());
+
 /// Helper macro to access server configuration fields
 ///
 /// Usage:
 /// - For Copy types (numbers): `let n = server_config!(runtime_threads);`
-/// - For Borrowed types (Strings): `let s = &server_config!(host);`
+/// - For Borrowed types (Strings): `let s = &server_config!(log_level);`
 #[macro_export]
 macro_rules! server_config {
 	($field:ident) => {
@@ -269,14 +571,25 @@ macro_rules! server_config {
 }
 
 pub fn setup(args: Cli) -> Result<(), ConfigError> {
-	let mut config = resolve_config_path(args.config.as_deref(), Path::new("."))
+	// Each layer overrides the one before: the config file, environment
+	// variables, then command-line flags.
+	let path = resolve_config_path(args.config.as_deref(), Path::new("."));
+	let mut config = path
+		.as_ref()
 		.map(load_from_file)
 		.transpose()?
 		.unwrap_or_default();
+	if let Some(path) = path {
+		let _ = CONFIG_PATH.set(std::fs::canonicalize(&path).unwrap_or(path));
+	}
+
+	apply_env_overrides(&mut config, std::env::vars())?;
 
-	// Override with CLI arguments if explicitly provided
+	for setting in &args.set {
+		apply_cli_setting(&mut config, setting)?;
+	}
 	if let Some(host) = args.host {
-		config.host = host;
+		config.host = host.parse().map_err(ConfigError::InvalidHost)?;
 	}
 	if let Some(port) = args.port {
 		config.port = port;
@@ -287,9 +600,6 @@ pub fn setup(args: Cli) -> Result<(), ConfigError> {
 	if let Some(t) = args.runtime_threads {
 		config.runtime_threads = t;
 	}
-	apply_env_overrides(&mut config, std::env::vars());
-
-	apply_trace_env_overrides(&mut config)?;
 
 	config.validate()?;
 
@@ -312,55 +622,6 @@ pub fn setup(args: Cli) -> Result<(), ConfigError> {
 	Ok(())
 }
 
-fn apply_trace_env_overrides(config: &mut ServerConfig) -> Result<(), ConfigError> {
-	if let Some(raw) = read_non_empty_env("NIMBIS_TRACE_ENABLED") {
-		config.trace_enabled = raw
-			.parse::<bool>()
-			.map_err(|_| ConfigError::InvalidEnvVar {
-				key: "NIMBIS_TRACE_ENABLED".into(),
-				value: raw.clone(),
-			})?;
-	}
-
-	if let Some(endpoint) = read_non_empty_env("NIMBIS_TRACE_ENDPOINT") {
-		config.trace_endpoint = endpoint;
-	}
-
-	if let Some(raw) = read_non_empty_env("NIMBIS_TRACE_SAMPLING_RATIO") {
-		config.trace_sampling_ratio =
-			raw.parse::<f64>().map_err(|_| ConfigError::InvalidEnvVar {
-				key: "NIMBIS_TRACE_SAMPLING_RATIO".into(),
-				value: raw.clone(),
-			})?;
-	}
-
-	if let Some(protocol) = read_non_empty_env("NIMBIS_TRACE_PROTOCOL") {
-		config.trace_protocol = protocol;
-	}
-
-	if let Some(raw) = read_non_empty_env("NIMBIS_TRACE_EXPORT_TIMEOUT_SECONDS") {
-		config.trace_export_timeout_seconds =
-			raw.parse::<u64>().map_err(|_| ConfigError::InvalidEnvVar {
-				key: "NIMBIS_TRACE_EXPORT_TIMEOUT_SECONDS".into(),
-				value: raw.clone(),
-			})?;
-	}
-
-	if let Some(raw) = read_non_empty_env("NIMBIS_TRACE_REPORT_INTERVAL_MS") {
-		config.trace_report_interval_ms =
-			raw.parse::<u64>().map_err(|_| ConfigError::InvalidEnvVar {
-				key: "NIMBIS_TRACE_REPORT_INTERVAL_MS".into(),
-				value: raw.clone(),
-			})?;
-	}
-
-	Ok(())
-}
-
-fn read_non_empty_env(key: &str) -> Option<String> {
-	std::env::var(key).ok().filter(|v| !v.trim().is_empty())
-}
-
 fn resolve_default_config_path_from_base(base: &Path) -> Option<PathBuf> {
 	let path = base.join("config").join("config.toml");
 	path.is_file().then_some(path)
@@ -391,25 +652,184 @@ fn resolve_log_output(config: &ServerConfig) -> Result<LogOutput, ConfigError> {
 	}
 }
 
-fn apply_env_overrides<I, K, V>(config: &mut ServerConfig, vars: I)
+/// Apply the `NIMBIS_<FIELD>` environment variables, such as
+/// `NIMBIS_SLOWLOG_MAX_LEN`, and the `NIMBIS_OBJECT_STORE_OPTION_<KEY>`
+/// options. Empty values are ignored.
+fn apply_env_overrides<I, K, V>(config: &mut ServerConfig, vars: I) -> Result<(), ConfigError>
 where
 	I: IntoIterator<Item = (K, V)>,
 	K: AsRef<str>,
 	V: Into<String>,
 {
+	const FIELD_PREFIX: &str = "NIMBIS_";
 	const OPTION_PREFIX: &str = "NIMBIS_OBJECT_STORE_OPTION_";
 
 	for (key, value) in vars {
 		let key = key.as_ref();
-		if key == "NIMBIS_OBJECT_STORE_URL" {
-			config.object_store_url = value.into();
-		} else if let Some(option_key) = key.strip_prefix(OPTION_PREFIX) {
+		let value = value.into();
+		if let Some(option_key) = key.strip_prefix(OPTION_PREFIX) {
 			config
 				.object_store_options
 				.0
-				.insert(option_key.to_ascii_lowercase(), value.into());
+				.insert(option_key.to_ascii_lowercase(), value);
+			continue;
+		}
+		let Some(field) = key.strip_prefix(FIELD_PREFIX) else {
+			continue;
+		};
+		let field = field.to_ascii_lowercase();
+		if value.trim().is_empty() || !ServerConfig::list_fields().contains(&field.as_str()) {
+			continue;
+		}
+		apply_setting(config, &field, std::slice::from_ref(&value)).map_err(|_| {
+			ConfigError::InvalidEnvVar {
+				key: key.to_string(),
+				value,
+			}
+		})?;
+	}
+	Ok(())
+}
+
+/// Apply a `--set <field>=<value>` flag.
+fn apply_cli_setting(config: &mut ServerConfig, setting: &str) -> Result<(), ConfigError> {
+	let invalid = |reason: String| ConfigError::InvalidCliSetting {
+		setting: setting.to_string(),
+		reason,
+	};
+	let (field, value) = setting
+		.split_once('=')
+		.ok_or_else(|| invalid("expected <field>=<value>".to_string()))?;
+	apply_setting(config, &field_name(field), &[value.to_string()]).map_err(invalid)
+}
+
+/// The field a setting names, accepting the dashed names of redis.conf.
+fn field_name(name: &str) -> String {
+	name.trim().to_ascii_lowercase().replace('-', "_")
+}
+
+/// Set `field` from `args`, the words a config file line, environment
+/// variable or command-line flag gives for it. The words are converted to the
+/// type the field has in the config, so immutable fields can be set too. Map
+/// fields take one entry, a name and a value, per setting.
+fn apply_setting(config: &mut ServerConfig, field: &str, args: &[String]) -> Result<(), String> {
+	use serde_json::Value;
+
+	let mut fields = serde_json::to_value(&*config).map_err(|e| e.to_string())?;
+	let Some(slot) = fields.get_mut(field) else {
+		return Err(format!("unknown field '{}'", field));
+	};
+	let raw = args.join(" ");
+	let invalid = || format!("invalid value '{}' for '{}'", raw, field);
+	match slot {
+		Value::Bool(_) => {
+			*slot = Value::Bool(match raw.to_ascii_lowercase().as_str() {
+				"yes" | "true" => true,
+				"no" | "false" => false,
+				_ => return Err(invalid()),
+			});
+		}
+		Value::Number(n) if n.is_f64() => {
+			*slot = raw.parse::<f64>().map_err(|_| invalid())?.into();
+		}
+		Value::Number(_) => {
+			*slot = match raw.parse::<u64>() {
+				Ok(n) => n.into(),
+				Err(_) => raw.parse::<i64>().map_err(|_| invalid())?.into(),
+			};
 		}
+		Value::Object(map) => {
+			let words = match args {
+				[arg] => split_args(arg)?,
+				_ => args.to_vec(),
+			};
+			let [name, value] = words.as_slice() else {
+				return Err(format!("'{}' takes a name and a value", field));
+			};
+			map.insert(name.clone(), Value::String(value.clone()));
+		}
+		_ => *slot = Value::String(raw.clone()),
 	}
+	*config = serde_json::from_value(fields).map_err(|e| e.to_string())?;
+	Ok(())
+}
+
+/// Split a redis.conf line into words. Double quoted words take backslash
+/// escapes, single quoted words are kept as written.
+fn split_args(line: &str) -> Result<Vec<String>, String> {
+	let mut args = Vec::new();
+	let mut chars = line.chars().peekable();
+	loop {
+		while chars.next_if(|c| c.is_whitespace()).is_some() {}
+		let Some(first) = chars.next() else {
+			return Ok(args);
+		};
+		let mut arg = String::new();
+		match first {
+			'"' => loop {
+				match chars.next() {
+					Some('"') => break,
+					Some('\\') => match chars.next() {
+						Some('n') => arg.push('\n'),
+						Some('t') => arg.push('\t'),
+						Some('r') => arg.push('\r'),
+						Some(c) => arg.push(c),
+						None => return Err("unbalanced quotes".to_string()),
+					},
+					Some(c) => arg.push(c),
+					None => return Err("unbalanced quotes".to_string()),
+				}
+			},
+			'\'' => loop {
+				match chars.next() {
+					Some('\'') => break,
+					Some(c) => arg.push(c),
+					None => return Err("unbalanced quotes".to_string()),
+				}
+			},
+			c => {
+				arg.push(c);
+				while let Some(c) = chars.next_if(|c| !c.is_whitespace()) {
+					arg.push(c);
+				}
+				args.push(arg);
+				continue;
+			}
+		}
+		if chars.peek().is_some_and(|c| !c.is_whitespace()) {
+			return Err("closing quote must be followed by a space".to_string());
+		}
+		args.push(arg);
+	}
+}
+
+/// Parse a redis.conf style file: one `<field> <value>` directive a line,
+/// with `#` comments. A map field takes one directive per entry, such as
+/// `rename-command FLUSHALL ""`.
+fn parse_conf(content: &str) -> Result<ServerConfig, ConfigError> {
+	let mut config = ServerConfig::default();
+	for (i, line) in content.lines().enumerate() {
+		let line = line.trim();
+		if line.is_empty() || line.starts_with('#') {
+			continue;
+		}
+		let invalid = |reason| ConfigError::InvalidConfLine {
+			line: i + 1,
+			reason,
+		};
+		let args = split_args(line).map_err(invalid)?;
+		apply_setting(&mut config, &field_name(&args[0]), &args[1..]).map_err(invalid)?;
+	}
+	Ok(config)
+}
+
+/// Render `value` as one redis.conf word.
+fn quote_conf(value: &str) -> String {
+	if !value.is_empty() && !value.contains(|c: char| c.is_whitespace() || "\"'\\".contains(c)) {
+		return value.to_string();
+	}
+	let escaped = value.replace('\\', "\\\\").replace('"', "\\\"");
+	format!("\"{}\"", escaped)
 }
 
 fn validate_trace_endpoint(endpoint: &str) -> Result<(), ConfigError> {
@@ -431,26 +851,151 @@ fn validate_trace_endpoint(endpoint: &str) -> Result<(), ConfigError> {
 
 fn load_from_file<P: AsRef<Path>>(path: P) -> Result<ServerConfig, ConfigError> {
 	let path_ref = path.as_ref();
-	let content = std::fs::read_to_string(path_ref).map_err(|source| ConfigError::Io {
-		path: path_ref.display().to_string(),
+	let (content, format) = read_config_file(path_ref)?;
+	let config = parse_config(&content, &format)?;
+
+	config.validate()?;
+
+	Ok(config)
+}
+
+/// Read a config file and the lowercase extension that names its format.
+fn read_config_file(path: &Path) -> Result<(String, String), ConfigError> {
+	let content = std::fs::read_to_string(path).map_err(|source| ConfigError::Io {
+		path: path.display().to_string(),
 		source,
 	})?;
 
-	let extension = path_ref
+	let extension = path
 		.extension()
 		.and_then(|ext| ext.to_str())
 		.ok_or(ConfigError::NoExtension)?;
 
-	let config: ServerConfig = match extension.to_lowercase().as_str() {
-		"toml" => toml::from_str(&content)?,
-		"json" => serde_json::from_str(&content)?,
-		"yaml" | "yml" => serde_yaml::from_str(&content)?,
-		_ => return Err(ConfigError::UnsupportedFormat(extension.to_string())),
+	Ok((content, extension.to_lowercase()))
+}
+
+fn parse_config(content: &str, format: &str) -> Result<ServerConfig, ConfigError> {
+	Ok(match format {
+		"toml" => toml::from_str(content)?,
+		"json" => serde_json::from_str(content)?,
+		"yaml" | "yml" => serde_yaml::from_str(content)?,
+		"conf" => parse_conf(content)?,
+		_ => return Err(ConfigError::UnsupportedFormat(format.to_string())),
+	})
+}
+
+/// The config file the server was started with, if any.
+pub fn config_file() -> Option<&'static Path> {
+	CONFIG_PATH.get().map(PathBuf::as_path)
+}
+
+/// Write the effective configuration back to the file it was loaded from.
+pub fn rewrite_config() -> Result<(), ConfigError> {
+	let path = CONFIG_PATH.get().ok_or(ConfigError::NoConfigFile)?;
+	let _guard = REWRITE_LOCK.lock().unwrap();
+	rewrite_file(path, &SERVER_CONF.load())
+}
+
+/// Rewrite the fields of `path` that can be changed at runtime and differ
+/// from `effective`. Immutable fields are left as the file has them, so
+/// addresses and secrets given on the command line or in the environment are
+/// never written. TOML and redis.conf files keep their comments and layout;
+/// JSON and YAML files are written out again.
+fn rewrite_file(path: &Path, effective: &ServerConfig) -> Result<(), ConfigError> {
+	let (content, format) = read_config_file(path)?;
+	let current = parse_config(&content, &format)?;
+	let changed: Vec<&str> = ServerConfig::mutable_fields()
+		.into_iter()
+		.filter(|field| current.get_field(field) != effective.get_field(field))
+		.collect();
+	if changed.is_empty() {
+		return Ok(());
+	}
+
+	let content = match format.as_str() {
+		"toml" => {
+			let mut doc: toml_edit::DocumentMut = content.parse()?;
+			let values: toml_edit::DocumentMut = toml::to_string(effective)?.parse()?;
+			for field in changed {
+				let Some(mut value) = values.get(field).and_then(|item| item.as_value()).cloned()
+				else {
+					continue;
+				};
+				match doc.get_mut(field).and_then(|item| item.as_value_mut()) {
+					Some(old) => {
+						// Keep the comments around the old value.
+						let decor = old.decor().clone();
+						*old = value;
+						*old.decor_mut() = decor;
+					}
+					None => {
+						value.decor_mut().clear();
+						doc.insert(field, toml_edit::Item::Value(value));
+					}
+				}
+			}
+			doc.to_string()
+		}
+		"conf" => rewrite_conf(&content, effective, &changed),
+		"json" => {
+			let mut doc: serde_json::Value = serde_json::from_str(&content)?;
+			let values = serde_json::to_value(effective)?;
+			if let Some(doc) = doc.as_object_mut() {
+				for field in changed {
+					doc.insert(field.to_string(), values[field].clone());
+				}
+			}
+			serde_json::to_string_pretty(&doc)? + "\n"
+		}
+		_ => {
+			let mut doc: serde_yaml::Value = serde_yaml::from_str(&content)?;
+			let values = serde_yaml::to_value(effective)?;
+			if let Some(doc) = doc.as_mapping_mut() {
+				for field in changed {
+					doc.insert(field.into(), values[field].clone());
+				}
+			}
+			serde_yaml::to_string(&doc)?
+		}
 	};
 
-	config.validate()?;
+	// Write a temporary file next to the config and rename it over, so a
+	// crash never leaves a truncated config behind.
+	let write_error = |source: std::io::Error| ConfigError::Write {
+		path: path.display().to_string(),
+		source,
+	};
+	let mut tmp = path.as_os_str().to_owned();
+	tmp.push(".tmp");
+	std::fs::write(&tmp, content).map_err(write_error)?;
+	std::fs::rename(&tmp, path).map_err(write_error)
+}
 
-	Ok(config)
+/// Replace the directives of the `changed` fields in a redis.conf file,
+/// keeping every other line, and append the ones the file does not have.
+fn rewrite_conf(content: &str, effective: &ServerConfig, changed: &[&str]) -> String {
+	let value = |field: &str| quote_conf(&effective.get_field(field).unwrap_or_default());
+	let mut written = Vec::new();
+	let mut lines = Vec::new();
+	for line in content.lines() {
+		let directive = line
+			.split_whitespace()
+			.next()
+			.filter(|word| !word.starts_with('#'));
+		match directive.map(|word| (word, field_name(word))) {
+			Some((word, field)) if changed.contains(&field.as_str()) => {
+				lines.push(format!("{} {}", word, value(&field)));
+				written.push(field);
+			}
+			_ => lines.push(line.to_string()),
+		}
+	}
+	for field in changed {
+		if !written.iter().any(|written| written == field) {
+			lines.push(format!("{} {}", field.replace('_', "-"), value(field)));
+		}
+	}
+	lines.join("\n") + "\n"
 }
 
 #[cfg(test)]
@@ -469,7 +1014,7 @@ mod tests {
 		SERVER_CONF.init(config);
 
 		// Now verify access via load()
-		let host = &server_config!(host);
+		let host = server_config!(host).to_string();
 		assert_eq!(host, "127.0.0.1");
 
 		let port = server_config!(port);
@@ -490,18 +1035,29 @@ object_store_url = "file:./data"
 object_store_options = { aws_region = "us-east-1" }
 save = "900 1"
 appendonly = "yes"
+appendfsync = "always"
 log_level = "debug"
 log_output = "file"
 log_rotation = "hourly"
 trace_enabled = true
 trace_endpoint = "http://localhost:4317"
 runtime_threads = 4
+client_output_buffer_limit = "pubsub 1mb 512kb 30"
+
+[rename_command]
+FLUSHALL = ""
+CONFIG = "admin-config"
 "#;
 		std::fs::write(&file_path, content).unwrap();
 
 		let config = load_from_file(&file_path).unwrap();
-		assert_eq!(config.host, "127.0.0.1");
+		assert_eq!(config.host.to_string(), "127.0.0.1");
 		assert_eq!(config.port, 1234);
+		assert_eq!(config.client_output_buffer_limit.pubsub.hard, 1 << 20);
+		assert_eq!(
+			config.rename_command.to_string(),
+			r#"{"CONFIG":"admin-config","FLUSHALL":""}"#
+		);
 		assert_eq!(config.object_store_url, "file:./data");
 		assert_eq!(
 			config
@@ -514,6 +1070,9 @@ runtime_threads = 4
 		assert_eq!(config.log_level, "debug");
 		assert_eq!(config.log_output, "file");
 		assert_eq!(config.log_rotation, "hourly");
+		assert_eq!(config.save.to_string(), "900 1");
+		assert!(config.appendonly.0);
+		assert_eq!(config.appendfsync, AppendFsync::Always);
 		assert!(config.trace_enabled);
 		assert_eq!(config.runtime_threads, 4);
 	}
@@ -532,6 +1091,7 @@ runtime_threads = 4
   },
   "save": "900 1",
   "appendonly": "yes",
+  "appendfsync": "always",
   "log_level": "debug",
   "log_output": "file",
   "log_rotation": "hourly",
@@ -543,7 +1103,7 @@ runtime_threads = 4
 		std::fs::write(&file_path, content).unwrap();
 
 		let config = load_from_file(&file_path).unwrap();
-		assert_eq!(config.host, "127.0.0.1");
+		assert_eq!(config.host.to_string(), "127.0.0.1");
 		assert_eq!(config.port, 1234);
 		assert_eq!(config.object_store_url, "file:./data");
 		assert_eq!(
@@ -557,6 +1117,9 @@ runtime_threads = 4
 		assert_eq!(config.log_level, "debug");
 		assert_eq!(config.log_output, "file");
 		assert_eq!(config.log_rotation, "hourly");
+		assert_eq!(config.save.to_string(), "900 1");
+		assert!(config.appendonly.0);
+		assert_eq!(config.appendfsync, AppendFsync::Always);
 		assert!(config.trace_enabled);
 	}
 
@@ -572,6 +1135,7 @@ object_store_options:
   aws_region: "us-east-1"
 save: "900 1"
 appendonly: "yes"
+appendfsync: "always"
 log_level: "debug"
 log_output: "file"
 log_rotation: "hourly"
@@ -582,7 +1146,7 @@ runtime_threads: 4
 		std::fs::write(&file_path, content).unwrap();
 
 		let config = load_from_file(&file_path).unwrap();
-		assert_eq!(config.host, "127.0.0.1");
+		assert_eq!(config.host.to_string(), "127.0.0.1");
 		assert_eq!(config.port, 1234);
 		assert_eq!(config.object_store_url, "file:./data");
 		assert_eq!(
@@ -596,6 +1160,9 @@ runtime_threads: 4
 		assert_eq!(config.log_level, "debug");
 		assert_eq!(config.log_output, "file");
 		assert_eq!(config.log_rotation, "hourly");
+		assert_eq!(config.save.to_string(), "900 1");
+		assert!(config.appendonly.0);
+		assert_eq!(config.appendfsync, AppendFsync::Always);
 		assert!(config.trace_enabled);
 	}
 
@@ -623,6 +1190,298 @@ runtime_threads: 4
 		assert!(ServerConfig::default().object_store_options.0.is_empty());
 	}
 
+	#[test]
+	fn test_set_client_output_buffer_limit() {
+		let mut config = ServerConfig::default();
+		config
+			.set_field("client_output_buffer_limit", "pubsub 1k 0 0")
+			.unwrap();
+		assert_eq!(
+			config.get_field("client_output_buffer_limit").unwrap(),
+			"normal 0 0 0 replica 268435456 67108864 60 pubsub 1000 0 0"
+		);
+		assert!(
+			config
+				.set_field("client_output_buffer_limit", "pubsub 1k")
+				.is_err()
+		);
+	}
+
+	#[test]
+	fn test_set_save() {
+		let mut config = ServerConfig::default();
+		assert_eq!(config.get_field("save").unwrap(), "");
+		config.set_field("save", "900 1 300 10").unwrap();
+		assert_eq!(config.get_field("save").unwrap(), "900 1 300 10");
+		assert!(config.set_field("save", "900").is_err());
+	}
+
+	#[test]
+	fn test_set_appendonly() {
+		let mut config = ServerConfig::default();
+		assert_eq!(config.get_field("appendonly").unwrap(), "no");
+		assert_eq!(config.get_field("appendfsync").unwrap(), "everysec");
+		config.set_field("appendonly", "YES").unwrap();
+		config.set_field("appendfsync", "always").unwrap();
+		assert_eq!(config.get_field("appendonly").unwrap(), "yes");
+		assert_eq!(config.get_field("appendfsync").unwrap(), "always");
+		assert!(config.set_field("appendonly", "true").is_err());
+		assert!(config.set_field("appendfsync", "sometimes").is_err());
+	}
+
+	#[test]
+	fn test_set_maxmemory() {
+		let mut config = ServerConfig::default();
+		assert_eq!(config.get_field("maxmemory").unwrap(), "0");
+		config.set_field("maxmemory", "1073741824").unwrap();
+		assert_eq!(config.maxmemory, 1 << 30);
+		assert!(config.set_field("maxmemory", "1gb").is_err());
+		assert!(config.set_field("maxmemory", "-1").is_err());
+		assert_eq!(config.maxmemory, 1 << 30);
+	}
+
+	#[test]
+	fn test_rewrite_toml_keeps_comments() {
+		let dir = tempfile::tempdir().unwrap();
+		let file_path = dir.path().join("config.toml");
+		let content = r#"# Nimbis config
+port = 1234
+
+# Slow log
+slowlog_max_len = 128 # entries
+
+[rename_command]
+FLUSHALL = ""
+"#;
+		std::fs::write(&file_path, content).unwrap();
+
+		let mut effective = load_from_file(&file_path).unwrap();
+		effective.port = 6380;
+		effective.set_field("slowlog_max_len", "64").unwrap();
+		effective.set_field("maxmemory", "1048576").unwrap();
+		rewrite_file(&file_path, &effective).unwrap();
+
+		let rewritten = std::fs::read_to_string(&file_path).unwrap();
+		assert!(rewritten.starts_with("# Nimbis config\nport = 1234\n"));
+		assert!(rewritten.contains("# Slow log\nslowlog_max_len = 64 # entries\n"));
+		assert!(rewritten.contains("FLUSHALL = \"\""));
+		let config = load_from_file(&file_path).unwrap();
+		assert_eq!(config.port, 1234);
+		assert_eq!(config.slowlog_max_len, 64);
+		assert_eq!(config.maxmemory, 1 << 20);
+
+		// Nothing changed, nothing is written.
+		rewrite_file(&file_path, &config).unwrap();
+		assert_eq!(std::fs::read_to_string(&file_path).unwrap(), rewritten);
+	}
+
+	#[rstest]
+	#[case("config.json", r#"{"port": 1234, "slowlog_max_len": 128}"#)]
+	#[case("config.yaml", "port: 1234\nslowlog_max_len: 128\n")]
+	fn test_rewrite_json_and_yaml(#[case] name: &str, #[case] content: &str) {
+		let dir = tempfile::tempdir().unwrap();
+		let file_path = dir.path().join(name);
+		std::fs::write(&file_path, content).unwrap();
+
+		let mut effective = load_from_file(&file_path).unwrap();
+		effective.port = 6380;
+		effective.set_field("slowlog_max_len", "64").unwrap();
+		effective.set_field("save", "900 1").unwrap();
+		rewrite_file(&file_path, &effective).unwrap();
+
+		let config = load_from_file(&file_path).unwrap();
+		assert_eq!(config.port, 1234);
+		assert_eq!(config.slowlog_max_len, 64);
+		assert_eq!(config.save.to_string(), "900 1");
+	}
+
+	#[test]
+	fn test_disk_limits_must_be_percentages() {
+		let mut config = ServerConfig::default();
+		assert_eq!(config.get_field("disk_soft_limit_percent").unwrap(), "90");
+		assert_eq!(config.get_field("disk_hard_limit_percent").unwrap(), "95");
+		config.set_field("disk_hard_limit_percent", "0").unwrap();
+		assert!(config.set_field("disk_soft_limit_percent", "101").is_err());
+		assert!(config.set_field("disk_hard_limit_percent", "-1").is_err());
+
+		let config = ServerConfig {
+			disk_hard_limit_percent: 120,
+			..ServerConfig::default()
+		};
+		let err = config.validate().unwrap_err();
+		assert!(matches!(err, ConfigError::InvalidDiskLimit(_)));
+	}
+
+	#[test]
+	fn test_disk_soft_limit_must_not_exceed_hard_limit() {
+		let mut config = ServerConfig::default();
+		assert!(config.set_field("disk_soft_limit_percent", "96").is_err());
+		assert!(config.set_field("disk_hard_limit_percent", "80").is_err());
+		config.set_field("disk_hard_limit_percent", "90").unwrap();
+		config.set_field("disk_soft_limit_percent", "90").unwrap();
+
+		// Either limit may be disabled whatever the other is.
+		let mut config = ServerConfig::default();
+		config.set_field("disk_hard_limit_percent", "0").unwrap();
+		config.set_field("disk_soft_limit_percent", "99").unwrap();
+		config.set_field("disk_soft_limit_percent", "0").unwrap();
+		config.set_field("disk_hard_limit_percent", "50").unwrap();
+
+		let config = ServerConfig {
+			disk_soft_limit_percent: 95,
+			disk_hard_limit_percent: 90,
+			..ServerConfig::default()
+		};
+		let err = config.validate().unwrap_err();
+		assert!(matches!(err, ConfigError::InvalidDiskLimit(_)));
+	}
+
+	#[test]
+	fn test_maxclients_must_be_positive() {
+		let mut config = ServerConfig::default();
+		assert_eq!(config.get_field("maxclients").unwrap(), "10000");
+		config.set_field("maxclients", "1").unwrap();
+		assert!(config.set_field("maxclients", "0").is_err());
+
+		let config = ServerConfig {
+			maxclients: 0,
+			..ServerConfig::default()
+		};
+		let err = config.validate().unwrap_err();
+		assert!(matches!(err, ConfigError::InvalidMaxClients(_)));
+	}
+
+	#[test]
+	fn test_tcp_settings() {
+		let mut config = ServerConfig::default();
+		assert_eq!(config.get_field("tcp_keepalive").unwrap(), "300");
+		assert_eq!(config.get_field("tcp_nodelay").unwrap(), "true");
+		config.set_field("tcp_keepalive", "0").unwrap();
+		config.set_field("tcp_nodelay", "false").unwrap();
+		assert!(config.set_field("tcp_backlog", "128").is_err());
+
+		let config = ServerConfig {
+			tcp_backlog: 0,
+			..ServerConfig::default()
+		};
+		let err = config.validate().unwrap_err();
+		assert!(matches!(err, ConfigError::InvalidTcpBacklog));
+	}
+
+	#[test]
+	fn test_value_compression() {
+		let mut config = ServerConfig::default();
+		assert_eq!(config.get_field("value_compression").unwrap(), "none");
+		assert!(config.set_field("value_compression", "zstd").is_err());
+		assert!(
+			config
+				.set_field("value_compression_threshold", "64")
+				.is_err()
+		);
+
+		config.value_compression = "ZSTD".to_string();
+		config.validate().unwrap();
+		config.value_compression = "lz4".to_string();
+		let err = config.validate().unwrap_err();
+		assert!(matches!(err, ConfigError::InvalidValueCompression(value) if value == "lz4"));
+	}
+
+	#[test]
+	fn test_compaction_settings() {
+		let mut config = ServerConfig::default();
+		assert!(config.set_field("compaction_threads", "2").is_err());
+		config
+			.set_field("compaction_interval_seconds", "3600")
+			.unwrap();
+		config.set_field("compaction_rate_limit", "5000").unwrap();
+		assert_eq!(config.compaction_interval_seconds, 3600);
+		assert_eq!(config.compaction_rate_limit, 5000);
+	}
+
+	#[test]
+	fn test_hot_cache_is_off_by_default() {
+		let mut config = ServerConfig::default();
+		assert_eq!(config.get_field("hot_cache_max_keys").unwrap(), "0");
+		assert_eq!(
+			config.get_field("hot_cache_max_value_size").unwrap(),
+			"1024"
+		);
+		assert!(config.set_field("hot_cache_max_keys", "100000").is_err());
+	}
+
+	#[rstest]
+	#[case("proto_max_inline_len")]
+	#[case("proto_max_multibulk_len")]
+	#[case("proto_max_bulk_len")]
+	fn test_proto_limits_must_be_positive(#[case] field: &str) {
+		let mut config = ServerConfig::default();
+		config.set_field(field, "1").unwrap();
+		assert!(config.set_field(field, "0").is_err());
+
+		let config = ServerConfig {
+			proto_max_bulk_len: 0,
+			..ServerConfig::default()
+		};
+		let err = config.validate().unwrap_err();
+		assert!(matches!(err, ConfigError::InvalidProtoLimit(_)));
+	}
+
+	#[test]
+	fn test_tls_port_requires_certificate_files() {
+		let config = ServerConfig {
+			tls_port: 6380,
+			..ServerConfig::default()
+		};
+		let err = config.validate().unwrap_err();
+		assert!(matches!(err, ConfigError::TlsFileRequired("tls_cert_file")));
+
+		let config = ServerConfig {
+			tls_port: 6380,
+			tls_cert_file: "nimbis.crt".into(),
+			tls_key_file: "nimbis.key".into(),
+			..ServerConfig::default()
+		};
+		let err = config.validate().unwrap_err();
+		assert!(matches!(
+			err,
+			ConfigError::TlsFileRequired("tls_ca_cert_file")
+		));
+
+		let config = ServerConfig {
+			tls_auth_clients: TlsAuthClients::No,
+			..config
+		};
+		assert!(config.validate().is_ok());
+	}
+
+	#[test]
+	fn test_port_and_tls_port_can_not_both_be_disabled() {
+		let config = ServerConfig {
+			port: 0,
+			..ServerConfig::default()
+		};
+
+		let err = config.validate().unwrap_err();
+		assert!(matches!(err, ConfigError::NoListener));
+	}
+
+	#[test]
+	fn test_cluster_port_must_fit() {
+		let config = ServerConfig {
+			cluster_enabled: true,
+			port: 60000,
+			..ServerConfig::default()
+		};
+		let err = config.validate().unwrap_err();
+		assert!(matches!(err, ConfigError::InvalidClusterPort(_)));
+
+		let config = ServerConfig {
+			cluster_port: 16379,
+			..config
+		};
+		assert!(config.validate().is_ok());
+	}
+
 	#[test]
 	fn test_apply_object_store_env_overrides() {
 		let env = [
@@ -635,7 +1494,7 @@ runtime_threads: 4
 		];
 		let mut config = ServerConfig::default();
 
-		apply_env_overrides(&mut config, env);
+		apply_env_overrides(&mut config, env).unwrap();
 
 		assert_eq!(config.object_store_url, "s3://nimbis/dev");
 		assert_eq!(
@@ -656,6 +1515,113 @@ runtime_threads: 4
 		);
 	}
 
+	#[test]
+	fn test_apply_field_env_overrides() {
+		let env = [
+			("NIMBIS_SLOWLOG_MAX_LEN", "64"),
+			("NIMBIS_PROTECTED_MODE", "no"),
+			("NIMBIS_TRACE_SAMPLING_RATIO", "0.5"),
+			("NIMBIS_PORT", ""),
+			("NIMBIS_PID", "1234"),
+		];
+		let mut config = ServerConfig::default();
+
+		apply_env_overrides(&mut config, env).unwrap();
+
+		assert_eq!(config.slowlog_max_len, 64);
+		assert!(!config.protected_mode);
+		assert_eq!(config.trace_sampling_ratio, 0.5);
+		assert_eq!(config.port, 6379);
+		assert!(matches!(
+			apply_env_overrides(&mut config, [("NIMBIS_PORT", "high")]),
+			Err(ConfigError::InvalidEnvVar { .. })
+		));
+	}
+
+	#[test]
+	fn test_apply_cli_setting() {
+		let mut config = ServerConfig::default();
+		apply_cli_setting(&mut config, "slowlog-max-len=64").unwrap();
+		apply_cli_setting(&mut config, "save=900 1").unwrap();
+		apply_cli_setting(&mut config, "rename_command=FLUSHALL \"\"").unwrap();
+		assert_eq!(config.slowlog_max_len, 64);
+		assert_eq!(config.save.to_string(), "900 1");
+		assert_eq!(config.rename_command.0.get("FLUSHALL").unwrap(), "");
+
+		assert!(apply_cli_setting(&mut config, "slowlog_max_len").is_err());
+		assert!(apply_cli_setting(&mut config, "slowlog_max_len=-1").is_err());
+		assert!(apply_cli_setting(&mut config, "unknown=1").is_err());
+	}
+
+	#[test]
+	fn test_parse_conf() {
+		let dir = tempfile::tempdir().unwrap();
+		let file_path = dir.path().join("nimbis.conf");
+		let content = r#"
+# Nimbis, redis.conf style
+host 127.0.0.1 ::1
+port 1234
+protected-mode no
+slowlog-log-slower-than -1
+save "900 1"
+appendonly yes
+client-output-buffer-limit pubsub 1mb 512kb 30
+rename-command FLUSHALL ""
+rename-command CONFIG 'admin-config'
+object_store_options aws_region us-east-1
+"#;
+		std::fs::write(&file_path, content).unwrap();
+
+		let config = load_from_file(&file_path).unwrap();
+		assert_eq!(config.host.to_string(), "127.0.0.1 ::1");
+		assert_eq!(config.port, 1234);
+		assert!(!config.protected_mode);
+		assert_eq!(config.slowlog_log_slower_than, -1);
+		assert_eq!(config.save.to_string(), "900 1");
+		assert!(config.appendonly.0);
+		assert_eq!(config.client_output_buffer_limit.pubsub.hard, 1 << 20);
+		assert_eq!(
+			config.rename_command.to_string(),
+			r#"{"CONFIG":"admin-config","FLUSHALL":""}"#
+		);
+		assert_eq!(
+			config
+				.object_store_options
+				.0
+				.get("aws_region")
+				.map(String::as_str),
+			Some("us-east-1")
+		);
+	}
+
+	#[rstest]
+	#[case("port high", "line 1")]
+	#[case("\nmaxclients -1", "line 2")]
+	#[case("unknown 1", "unknown field")]
+	#[case("save \"900 1", "unbalanced quotes")]
+	fn test_parse_conf_errors(#[case] content: &str, #[case] reason: &str) {
+		let err = parse_conf(content).unwrap_err().to_string();
+		assert!(err.contains(reason), "{}", err);
+	}
+
+	#[test]
+	fn test_rewrite_conf_keeps_comments() {
+		let dir = tempfile::tempdir().unwrap();
+		let file_path = dir.path().join("nimbis.conf");
+		std::fs::write(&file_path, "# Slow log\nslowlog-max-len 128\nport 1234\n").unwrap();
+
+		let mut effective = load_from_file(&file_path).unwrap();
+		effective.port = 6380;
+		effective.set_field("slowlog_max_len", "64").unwrap();
+		effective.set_field("save", "900 1").unwrap();
+		rewrite_file(&file_path, &effective).unwrap();
+
+		assert_eq!(
+			std::fs::read_to_string(&file_path).unwrap(),
+			"# Slow log\nslowlog-max-len 64\nport 1234\nsave \"900 1\"\n"
+		);
+	}
+
 	#[rstest]
 	#[case("not a url")]
 	#[case("unknown://bucket/path")]
@@ -1,16 +1,110 @@
 use std::sync::Arc;
 use std::sync::OnceLock;
 
+use tokio::sync::RwLock;
+
+use crate::access::AccessTracker;
+use crate::acl::Acl;
+use crate::acllog::AclLog;
+use crate::bigkeys::BigKeys;
+use crate::blocking::Blocking;
 use crate::client::ClientSessions;
+use crate::client_eviction::ClientEviction;
+use crate::cluster::Cluster;
+use crate::cmd::CmdTable;
+use crate::commandstats::CommandStats;
+use crate::compaction::Compaction;
+use crate::disk::Disk;
+use crate::expire::Expire;
+use crate::extension::ExtensionRegistry;
+use crate::function::FunctionRegistry;
+use crate::gc::Gc;
+use crate::latency::CommandLatencies;
+use crate::latency::LatencyMonitor;
+use crate::lazyfree::LazyFree;
+use crate::loading::Loading;
+use crate::maxmemory::MaxMemory;
+use crate::persistence::Persistence;
+use crate::pubsub::PubSub;
+use crate::ratelimit::RateLimiter;
+use crate::replication::Replication;
+use crate::script::RunningScript;
+use crate::script::ScriptCache;
+use crate::slowlog::SlowLog;
+use crate::tracking::Tracking;
 
 #[derive(Debug)]
 pub struct GlobalContext {
 	pub client_sessions: Arc<ClientSessions>,
+	pub client_eviction: Arc<ClientEviction>,
+	pub extensions: Arc<ExtensionRegistry>,
+	pub cmd_table: Arc<CmdTable>,
+	pub slowlog: Arc<SlowLog>,
+	pub latency_monitor: Arc<LatencyMonitor>,
+	pub command_latencies: Arc<CommandLatencies>,
+	pub commandstats: Arc<CommandStats>,
+	/// Commands hold this shared while they run; EXEC and scripts hold it
+	/// exclusively so no other client observes a half-applied transaction.
+	pub exec_lock: Arc<RwLock<()>>,
+	pub scripts: Arc<ScriptCache>,
+	pub running_script: Arc<RunningScript>,
+	pub functions: Arc<FunctionRegistry>,
+	pub pubsub: Arc<PubSub>,
+	pub tracking: Arc<Tracking>,
+	pub blocking: Arc<Blocking>,
+	pub persistence: Arc<Persistence>,
+	pub gc: Arc<Gc>,
+	pub compaction: Arc<Compaction>,
+	pub lazyfree: Arc<LazyFree>,
+	pub expire: Arc<Expire>,
+	pub bigkeys: Arc<BigKeys>,
+	pub loading: Arc<Loading>,
+	pub disk: Arc<Disk>,
+	pub maxmemory: Arc<MaxMemory>,
+	pub replication: Arc<Replication>,
+	pub cluster: Arc<Cluster>,
+	pub acl: Arc<Acl>,
+	pub acl_log: Arc<AclLog>,
+	pub rate_limiter: Arc<RateLimiter>,
+	pub access: Arc<AccessTracker>,
 }
 
 impl GlobalContext {
 	pub fn new(client_sessions: Arc<ClientSessions>) -> Self {
-		Self { client_sessions }
+		let extensions = ExtensionRegistry::builtin();
+		let cmd_table = CmdTable::with_extensions(&extensions);
+		Self {
+			client_sessions,
+			client_eviction: Arc::new(ClientEviction::new()),
+			extensions: Arc::new(extensions),
+			cmd_table: Arc::new(cmd_table),
+			slowlog: Arc::new(SlowLog::new()),
+			latency_monitor: Arc::new(LatencyMonitor::new()),
+			command_latencies: Arc::new(CommandLatencies::new()),
+			commandstats: Arc::new(CommandStats::new()),
+			exec_lock: Arc::new(RwLock::new(())),
+			scripts: Arc::new(ScriptCache::new()),
+			running_script: Arc::new(RunningScript::new()),
+			functions: Arc::new(FunctionRegistry::new()),
+			pubsub: Arc::new(PubSub::new()),
+			tracking: Arc::new(Tracking::new()),
+			blocking: Arc::new(Blocking::new()),
+			persistence: Arc::new(Persistence::new()),
+			gc: Arc::new(Gc::new()),
+			compaction: Arc::new(Compaction::new()),
+			lazyfree: Arc::new(LazyFree::new()),
+			expire: Arc::new(Expire::new()),
+			bigkeys: Arc::new(BigKeys::new()),
+			loading: Arc::new(Loading::new()),
+			disk: Arc::new(Disk::new()),
+			maxmemory: Arc::new(MaxMemory::new()),
+			replication: Arc::new(Replication::new()),
+			cluster: Arc::new(Cluster::new()),
+			acl: Arc::new(Acl::new()),
+			acl_log: Arc::new(AclLog::new()),
+			rate_limiter: Arc::new(RateLimiter::new()),
+			access: Arc::new(AccessTracker::new()),
+		}
 	}
 }
 
@@ -0,0 +1,211 @@
+//! Disk-space watermarks for a store on the local filesystem.
+//!
+//! The volume holding the object store is checked every second. Once its
+//! usage reaches `disk_soft_limit_percent`, a warning is logged and INFO
+//! reports it. Once it reaches `disk_hard_limit_percent`, write commands are
+//! refused with a MISCONF error while reads are still served, so the storage
+//! engine never runs out of space in the middle of a write. Stores in a
+//! remote object store have no local volume and are never limited.
+
+use std::path::PathBuf;
+use std::sync::Mutex;
+use std::time::Duration;
+
+use log::error;
+use log::info;
+use log::warn;
+
+use crate::GCTX;
+use crate::server_config;
+
+const DISK_CHECK_INTERVAL: Duration = Duration::from_secs(1);
+const HARD_LIMIT_REACHED: &str = "MISCONF Disk usage reached disk_hard_limit_percent, so write commands are disabled. Free some space or raise the limit.";
+/// Write commands still allowed above the hard limit, because deleting keys
+/// is how space is freed.
+const FREEING_CMDS: &[&str] = &["DEL", "FLUSHDB"];
+
+/// Check the volume at `path` for the lifetime of the server. Without a
+/// path nothing is checked.
+pub fn start_disk_monitor(path: Option<PathBuf>) {
+	let Some(path) = path else {
+		return;
+	};
+	tokio::spawn(async move {
+		let mut interval = tokio::time::interval(DISK_CHECK_INTERVAL);
+		loop {
+			interval.tick().await;
+			let disk = GCTX!(disk);
+			match fs4::statvfs(&path) {
+				Ok(stats) => disk.update(stats.total_space(), stats.available_space()),
+				Err(e) => disk.fail(&path, &e.to_string()),
+			}
+		}
+	});
+}
+
+/// Refuse write command `name` while disk usage is above the hard limit.
+pub fn check_write(name: &str) -> Result<(), String> {
+	if !GCTX!(cmd_table).is_write(name) || FREEING_CMDS.contains(&name) {
+		return Ok(());
+	}
+	match GCTX!(disk).level() {
+		DiskLevel::HardLimit => Err(HARD_LIMIT_REACHED.to_string()),
+		_ => Ok(()),
+	}
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum DiskLevel {
+	Ok,
+	SoftLimit,
+	HardLimit,
+}
+
+impl DiskLevel {
+	fn name(self) -> &'static str {
+		match self {
+			DiskLevel::Ok => "ok",
+			DiskLevel::SoftLimit => "soft_limit",
+			DiskLevel::HardLimit => "hard_limit",
+		}
+	}
+}
+
+#[derive(Debug, Default)]
+struct DiskState {
+	total_bytes: u64,
+	available_bytes: u64,
+	/// The level last logged, so each change is logged once.
+	logged: Option<DiskLevel>,
+	/// Whether the last check failed, so a failure is logged once.
+	failing: bool,
+}
+
+impl DiskState {
+	fn used_percent(&self) -> f64 {
+		if self.total_bytes == 0 {
+			return 0.0;
+		}
+		(self.total_bytes - self.available_bytes.min(self.total_bytes)) as f64 * 100.0
+			/ self.total_bytes as f64
+	}
+
+	/// The level of the current usage, where a limit of 0 is disabled.
+	fn level(&self, soft_limit: u8, hard_limit: u8) -> DiskLevel {
+		let used = self.used_percent();
+		if hard_limit > 0 && used >= hard_limit as f64 {
+			DiskLevel::HardLimit
+		} else if soft_limit > 0 && used >= soft_limit as f64 {
+			DiskLevel::SoftLimit
+		} else {
+			DiskLevel::Ok
+		}
+	}
+}
+
+#[derive(Debug, Default)]
+pub struct Disk {
+	state: Mutex<DiskState>,
+}
+
+impl Disk {
+	pub fn new() -> Self {
+		Self::default()
+	}
+
+	/// The level of the last check against the configured limits, so a
+	/// CONFIG SET of a limit takes effect right away.
+	pub fn level(&self) -> DiskLevel {
+		self.state.lock().unwrap().level(
+			server_config!(disk_soft_limit_percent),
+			server_config!(disk_hard_limit_percent),
+		)
+	}
+
+	fn update(&self, total_bytes: u64, available_bytes: u64) {
+		self.record(
+			total_bytes,
+			available_bytes,
+			server_config!(disk_soft_limit_percent),
+			server_config!(disk_hard_limit_percent),
+		);
+	}
+
+	fn record(&self, total_bytes: u64, available_bytes: u64, soft_limit: u8, hard_limit: u8) {
+		let mut state = self.state.lock().unwrap();
+		state.total_bytes = total_bytes;
+		state.available_bytes = available_bytes;
+		state.failing = false;
+		let level = state.level(soft_limit, hard_limit);
+		if state.logged.replace(level).unwrap_or(DiskLevel::Ok) == level {
+			return;
+		}
+		let used = state.used_percent();
+		match level {
+			DiskLevel::HardLimit => error!(
+				"Disk usage is {:.1}%, at or above disk_hard_limit_percent {}: write commands are disabled",
+				used, hard_limit
+			),
+			DiskLevel::SoftLimit => warn!(
+				"Disk usage is {:.1}%, at or above disk_soft_limit_percent {}",
+				used, soft_limit
+			),
+			DiskLevel::Ok => info!("Disk usage is back to {:.1}%", used),
+		}
+	}
+
+	fn fail(&self, path: &std::path::Path, err: &str) {
+		let mut state = self.state.lock().unwrap();
+		if !state.failing {
+			error!("Failed to check disk usage of {}: {}", path.display(), err);
+		}
+		state.failing = true;
+	}
+
+	/// Disk fields of the Persistence section of INFO.
+	pub fn info(&self) -> Vec<(String, String)> {
+		let level = self.level();
+		let state = self.state.lock().unwrap();
+		vec![
+			(
+				"disk_total_bytes".to_string(),
+				state.total_bytes.to_string(),
+			),
+			(
+				"disk_available_bytes".to_string(),
+				state.available_bytes.to_string(),
+			),
+			(
+				"disk_used_percent".to_string(),
+				format!("{:.2}", state.used_percent()),
+			),
+			("disk_status".to_string(), level.name().to_string()),
+		]
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+
+	#[test]
+	fn test_disk_levels() {
+		let disk = Disk::new();
+		let level = |soft, hard| disk.state.lock().unwrap().level(soft, hard);
+		assert_eq!(level(90, 95), DiskLevel::Ok);
+
+		disk.record(1000, 50, 90, 95);
+		assert_eq!(disk.state.lock().unwrap().used_percent(), 95.0);
+		assert_eq!(level(90, 95), DiskLevel::HardLimit);
+		assert_eq!(level(90, 96), DiskLevel::SoftLimit);
+		assert_eq!(level(0, 0), DiskLevel::Ok);
+		assert_eq!(
+			disk.state.lock().unwrap().logged,
+			Some(DiskLevel::HardLimit)
+		);
+
+		disk.record(1000, 500, 90, 95);
+		assert_eq!(level(90, 95), DiskLevel::Ok);
+		assert_eq!(disk.state.lock().unwrap().logged, Some(DiskLevel::Ok));
+	}
+}
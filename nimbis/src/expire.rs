@@ -0,0 +1,152 @@
+//! The active expire cycle.
+//!
+//! Storage finds a key past its expire time when a command reads it, but
+//! keys nobody reads would sit in the store until compaction. Like the
+//! active expire cycle of Redis, a cycle runs every tick and deletes the keys
+//! whose time has passed, [`EXPIRE_KEYS_PER_LOOP`] at a time, until a loop
+//! finds fewer than that or the cycle has run for
+//! [`EXPIRE_CYCLE_TIME_LIMIT`]. Storage indexes the keys by expire time, so
+//! a loop takes the keys due instead of sampling. Every key deleted is
+//! streamed to replicas as a DEL, and replicas leave expiry to their
+//! primary. Cycles that take `latency_monitor_threshold` or longer are
+//! recorded as the `expire-cycle` latency event.
+
+use std::sync::Mutex;
+use std::time::Duration;
+use std::time::Instant;
+
+use bytes::Bytes;
+use log::error;
+use nimbis_storage::Storage;
+
+use crate::GCTX;
+use crate::latency::LatencyEvent;
+use crate::server_config;
+
+/// How often a cycle runs, every 100ms like the default `hz` of Redis.
+const EXPIRE_TICK: Duration = Duration::from_millis(100);
+/// Keys deleted by one loop of a cycle, at most.
+const EXPIRE_KEYS_PER_LOOP: usize = 20;
+/// How long a cycle runs at most, a quarter of the tick like Redis.
+const EXPIRE_CYCLE_TIME_LIMIT: Duration = Duration::from_millis(25);
+
+/// Run the active expire cycle for the lifetime of the server.
+pub fn start_active_expire(storage: Storage) {
+	tokio::spawn(async move {
+		let mut interval = tokio::time::interval(EXPIRE_TICK);
+		loop {
+			interval.tick().await;
+			if GCTX!(replication).is_replica() {
+				continue;
+			}
+			run_cycle(&storage).await;
+		}
+	});
+}
+
+async fn run_cycle(storage: &Storage) {
+	let started = Instant::now();
+	let mut time_limit_reached = false;
+	loop {
+		let result = {
+			// Like GC batches, never inside a transaction or script.
+			let _guard = GCTX!(exec_lock).read().await;
+			storage.expire_step(EXPIRE_KEYS_PER_LOOP).await
+		};
+		match result {
+			Ok(step) if step.due < EXPIRE_KEYS_PER_LOOP as u64 => break,
+			Ok(_) => {}
+			Err(e) => {
+				error!("Active expire cycle error: {}", e);
+				break;
+			}
+		}
+		if started.elapsed() >= EXPIRE_CYCLE_TIME_LIMIT {
+			time_limit_reached = true;
+			break;
+		}
+		tokio::task::yield_now().await;
+	}
+	let elapsed = started.elapsed();
+	GCTX!(expire).finish_cycle(elapsed, time_limit_reached);
+	GCTX!(latency_monitor).add_sample_if_needed(
+		server_config!(latency_monitor_threshold),
+		LatencyEvent::ExpireCycle,
+		elapsed,
+	);
+}
+
+/// Count `key`, which storage found expired.
+pub fn expired(_key: &Bytes) {
+	GCTX!(expire).expired();
+}
+
+#[derive(Debug, Default)]
+struct ExpireState {
+	/// Keys storage found expired, by a read or a cycle.
+	expired: u64,
+	/// Time spent in cycles.
+	cycle_time: Duration,
+	/// Cycles that stopped at the time limit with keys left to delete.
+	time_limit_reached: u64,
+}
+
+#[derive(Debug, Default)]
+pub struct Expire {
+	state: Mutex<ExpireState>,
+}
+
+impl Expire {
+	pub fn new() -> Self {
+		Self::default()
+	}
+
+	fn expired(&self) {
+		self.state.lock().unwrap().expired += 1;
+	}
+
+	fn finish_cycle(&self, elapsed: Duration, time_limit_reached: bool) {
+		let mut state = self.state.lock().unwrap();
+		state.cycle_time += elapsed;
+		state.time_limit_reached += time_limit_reached as u64;
+	}
+
+	/// Expiry fields of the Stats section of INFO.
+	pub fn stats(&self) -> Vec<(String, String)> {
+		let state = self.state.lock().unwrap();
+		vec![
+			("expired_keys".to_string(), state.expired.to_string()),
+			(
+				"expired_time_cap_reached_count".to_string(),
+				state.time_limit_reached.to_string(),
+			),
+			(
+				"expire_cycle_cpu_milliseconds".to_string(),
+				state.cycle_time.as_millis().to_string(),
+			),
+		]
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+
+	fn field<'a>(stats: &'a [(String, String)], name: &str) -> &'a str {
+		&stats.iter().find(|(k, _)| k == name).unwrap().1
+	}
+
+	#[test]
+	fn test_stats_add_up_keys_and_cycles() {
+		let expire = Expire::new();
+		expire.expired();
+		expire.expired();
+		expire.finish_cycle(Duration::from_millis(3), false);
+		expire.finish_cycle(Duration::from_millis(25), true);
+
+		let stats = expire.stats();
+		assert_eq!(field(&stats, "expired_keys"), "2");
+		assert_eq!(field(&stats, "expired_time_cap_reached_count"), "1");
+		assert_eq!(field(&stats, "expire_cycle_cpu_milliseconds"), "28");
+	}
+}
@@ -0,0 +1,312 @@
+//! Compiled-in command extensions, in the spirit of Redis modules.
+//!
+//! An extension adds a family of commands, optionally with its own key types
+//! and INFO sections. Extensions are listed in [`ExtensionRegistry::builtin`],
+//! each behind its own cargo feature, and register their commands into the
+//! command table at startup, so the dispatcher never needs to know about them.
+//!
+//! Values of an extension key type are stored in the keyspace like any other
+//! key, so DEL, EXISTS, EXPIRE and TTL work on them, while their payload is
+//! encoded and decoded by the extension through [`ExtensionType`].
+
+use std::collections::HashMap;
+use std::collections::HashSet;
+use std::sync::Arc;
+
+use bytes::Bytes;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+
+use crate::cmd::Cmd;
+
+/// A family of commands compiled into the server.
+pub trait Extension: Send + Sync {
+	/// Name shown by MODULE LIST and used to prefix the extension's INFO
+	/// sections.
+	fn name(&self) -> &'static str;
+
+	fn version(&self) -> u32;
+
+	/// Register the extension's commands and key types.
+	fn register(&self, registrar: &mut Registrar<'_>);
+
+	/// Sections appended to INFO output, each named
+	/// `<extension>_<section>`.
+	fn info(&self) -> Vec<InfoSection> {
+		Vec::new()
+	}
+}
+
+/// One INFO section of an extension.
+#[derive(Debug, Clone, PartialEq)]
+pub struct InfoSection {
+	pub name: &'static str,
+	pub fields: Vec<(String, String)>,
+}
+
+/// A key type owned by an extension.
+pub trait ExtensionType: Sized {
+	/// Name stored with every value of this type. It must be unique across
+	/// extensions and at most 255 bytes long.
+	const NAME: &'static str;
+
+	fn encode(&self) -> Bytes;
+
+	/// Decode a payload written by `encode`, returning the error reply on
+	/// failure.
+	fn decode(payload: &[u8]) -> Result<Self, String>;
+}
+
+/// Load the value of type `T` stored at `key`.
+pub async fn load<T: ExtensionType>(storage: &Storage, key: Bytes) -> Result<Option<T>, RespValue> {
+	match storage.get_extension(key, T::NAME).await {
+		Ok(Some(payload)) => T::decode(&payload).map(Some).map_err(RespValue::error),
+		Ok(None) => Ok(None),
+		Err(e) => Err(RespValue::error(format!("ERR {}", e))),
+	}
+}
+
+/// Store `value` at `key`, keeping the TTL of a value of the same type.
+pub async fn store<T: ExtensionType>(
+	storage: &Storage,
+	key: Bytes,
+	value: &T,
+) -> Result<(), RespValue> {
+	storage
+		.set_extension(key, T::NAME, value.encode())
+		.await
+		.map_err(|e| RespValue::error(format!("ERR {}", e)))
+}
+
+/// Update the value of type `T` at `key` with `f`, holding the key lock
+/// throughout so concurrent updates are not lost. `f` returns the value to
+/// store, or `None` to leave the key unchanged, along with its result.
+pub async fn update<T, R, F>(storage: &Storage, key: Bytes, f: F) -> Result<R, RespValue>
+where
+	T: ExtensionType,
+	R: Send,
+	F: FnOnce(Option<T>) -> Result<(Option<T>, R), RespValue> + Send,
+{
+	let mut outcome = None;
+	let updated = storage
+		.update_extension(key, T::NAME, |payload| {
+			let current = match payload.map(|payload| T::decode(payload)).transpose() {
+				Ok(current) => current,
+				Err(e) => {
+					outcome = Some(Err(RespValue::error(e)));
+					return None;
+				}
+			};
+			match f(current) {
+				Ok((value, result)) => {
+					outcome = Some(Ok(result));
+					value.map(|value| value.encode())
+				}
+				Err(e) => {
+					outcome = Some(Err(e));
+					None
+				}
+			}
+		})
+		.await;
+	if let Err(e) = updated {
+		return Err(RespValue::error(format!("ERR {}", e)));
+	}
+	outcome.expect("update_extension runs the update once it succeeds")
+}
+
+/// Handed to [`Extension::register`] to add commands and key types to the
+/// command table. Name clashes are programming errors and panic at startup.
+pub struct Registrar<'a> {
+	extension: &'static str,
+	cmds: &'a mut HashMap<&'static str, Arc<dyn Cmd>>,
+	write_cmds: &'a mut HashSet<&'static str>,
+	types: &'a mut HashMap<&'static str, &'static str>,
+}
+
+impl<'a> Registrar<'a> {
+	pub(crate) fn new(
+		extension: &'static str,
+		cmds: &'a mut HashMap<&'static str, Arc<dyn Cmd>>,
+		write_cmds: &'a mut HashSet<&'static str>,
+		types: &'a mut HashMap<&'static str, &'static str>,
+	) -> Self {
+		Self {
+			extension,
+			cmds,
+			write_cmds,
+			types,
+		}
+	}
+
+	/// Register a command that only reads the dataset.
+	pub fn command(&mut self, name: &'static str, cmd: Arc<dyn Cmd>) {
+		if self.cmds.insert(name, cmd).is_some() {
+			panic!(
+				"extension {} registers command {} which already exists",
+				self.extension, name
+			);
+		}
+	}
+
+	/// Register a command that modifies the dataset. Read-only scripts may
+	/// not call it and scripts that did can no longer be killed.
+	pub fn write_command(&mut self, name: &'static str, cmd: Arc<dyn Cmd>) {
+		self.command(name, cmd);
+		self.write_cmds.insert(name);
+	}
+
+	/// Claim the key type `T` for this extension.
+	pub fn data_type<T: ExtensionType>(&mut self) {
+		assert!(
+			T::NAME.len() <= u8::MAX as usize,
+			"extension type name {} is too long",
+			T::NAME
+		);
+		if let Some(owner) = self.types.insert(T::NAME, self.extension) {
+			panic!(
+				"extension {} registers type {} already owned by {}",
+				self.extension,
+				T::NAME,
+				owner
+			);
+		}
+	}
+}
+
+/// The extensions compiled into this server.
+#[derive(Default)]
+pub struct ExtensionRegistry {
+	extensions: Vec<Arc<dyn Extension>>,
+}
+
+impl std::fmt::Debug for ExtensionRegistry {
+	fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+		let names: Vec<_> = self.extensions.iter().map(|ext| ext.name()).collect();
+		f.debug_struct("ExtensionRegistry")
+			.field("extensions", &names)
+			.finish()
+	}
+}
+
+impl ExtensionRegistry {
+	pub fn new(extensions: Vec<Arc<dyn Extension>>) -> Self {
+		Self { extensions }
+	}
+
+	/// Extensions enabled by cargo features. Add new ones here as
+	/// `#[cfg(feature = "<name>")] extensions.push(Arc::new(...));`.
+	#[allow(unused_mut)]
+	pub fn builtin() -> Self {
+		let mut extensions: Vec<Arc<dyn Extension>> = Vec::new();
+		#[cfg(feature = "bloom")]
+		extensions.push(Arc::new(crate::bloom::BloomExtension));
+		Self::new(extensions)
+	}
+
+	pub fn iter(&self) -> impl Iterator<Item = &Arc<dyn Extension>> {
+		self.extensions.iter()
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use async_trait::async_trait;
+
+	use super::*;
+	use crate::cmd::CmdContext;
+	use crate::cmd::CmdMeta;
+	use crate::cmd::CmdTable;
+
+	struct EchoCmd {
+		meta: CmdMeta,
+	}
+
+	impl Default for EchoCmd {
+		fn default() -> Self {
+			Self {
+				meta: CmdMeta {
+					name: "EXT.ECHO".to_string(),
+					arity: 2,
+				},
+			}
+		}
+	}
+
+	#[async_trait]
+	impl Cmd for EchoCmd {
+		fn meta(&self) -> &CmdMeta {
+			&self.meta
+		}
+
+		async fn do_cmd(&self, _storage: &Storage, args: &[Bytes], _ctx: &CmdContext) -> RespValue {
+			RespValue::bulk_string(args[0].clone())
+		}
+	}
+
+	struct Counter;
+
+	impl ExtensionType for Counter {
+		const NAME: &'static str = "counter";
+
+		fn encode(&self) -> Bytes {
+			Bytes::new()
+		}
+
+		fn decode(_payload: &[u8]) -> Result<Self, String> {
+			Ok(Self)
+		}
+	}
+
+	struct TestExtension {
+		command: &'static str,
+	}
+
+	impl Extension for TestExtension {
+		fn name(&self) -> &'static str {
+			"test"
+		}
+
+		fn version(&self) -> u32 {
+			1
+		}
+
+		fn register(&self, registrar: &mut Registrar<'_>) {
+			registrar.data_type::<Counter>();
+			registrar.command("EXT.ECHO", Arc::new(EchoCmd::default()));
+			registrar.write_command(self.command, Arc::new(EchoCmd::default()));
+		}
+	}
+
+	#[test]
+	fn test_extension_commands_are_registered() {
+		let registry = ExtensionRegistry::new(vec![Arc::new(TestExtension { command: "EXT.SET" })]);
+		let table = CmdTable::with_extensions(&registry);
+
+		assert!(table.get_cmd("EXT.ECHO").is_some());
+		assert!(table.get_cmd("GET").is_some());
+		assert!(!table.is_write("EXT.ECHO"));
+		assert!(table.is_write("EXT.SET"));
+		assert!(table.is_write("SET"));
+		assert!(!table.is_write("GET"));
+	}
+
+	#[test]
+	#[should_panic(expected = "registers command SET which already exists")]
+	fn test_extension_cannot_replace_core_commands() {
+		let registry = ExtensionRegistry::new(vec![Arc::new(TestExtension { command: "SET" })]);
+		CmdTable::with_extensions(&registry);
+	}
+
+	#[test]
+	#[should_panic(expected = "registers type counter already owned by test")]
+	fn test_extension_types_are_unique() {
+		let registry = ExtensionRegistry::new(vec![
+			Arc::new(TestExtension { command: "EXT.SET" }),
+			Arc::new(TestExtension {
+				command: "EXT.SET2",
+			}),
+		]);
+		CmdTable::with_extensions(&registry);
+	}
+}
@@ -0,0 +1,432 @@
+//! Function libraries for FUNCTION and FCALL.
+//!
+//! A library is Lua code whose first line is `#!lua name=<library>` and which
+//! registers functions with `redis.register_function`. Loading a library runs
+//! its code once in a sandbox without `redis.call` to learn which functions it
+//! registers; FCALL runs the code again in a fresh state before calling the
+//! function. All libraries are persisted together as one storage metadata
+//! entry in the FUNCTION DUMP format, so they survive restarts, and every
+//! change is streamed to replicas as the FUNCTION command that made it.
+
+use std::collections::BTreeMap;
+use std::sync::Arc;
+use std::sync::RwLock;
+
+use bytes::Buf;
+use bytes::BufMut;
+use bytes::Bytes;
+use bytes::BytesMut;
+use mlua::Table;
+use nimbis_storage::Storage;
+use tokio::sync::Mutex;
+
+use crate::GCTX;
+use crate::script;
+
+/// Storage metadata entry holding every loaded library.
+const METADATA_NAME: &str = "functions";
+
+const DUMP_MAGIC: &[u8] = b"NIMBISFN1";
+
+const KNOWN_FLAGS: &[&str] = &[
+	"no-writes",
+	"allow-oom",
+	"allow-stale",
+	"no-cluster",
+	"allow-cross-slot-keys",
+];
+
+pub type Libraries = BTreeMap<String, Arc<Library>>;
+
+#[derive(Debug, Clone, PartialEq)]
+pub struct FunctionInfo {
+	pub name: String,
+	pub description: Option<String>,
+	pub flags: Vec<String>,
+}
+
+impl FunctionInfo {
+	/// Functions flagged `no-writes` run as read-only scripts.
+	pub fn is_read_only(&self) -> bool {
+		self.flags.iter().any(|flag| flag == "no-writes")
+	}
+}
+
+#[derive(Debug, Clone)]
+pub struct Library {
+	pub name: String,
+	pub code: Bytes,
+	pub functions: Vec<FunctionInfo>,
+}
+
+impl Library {
+	/// Parse the metadata line of `code` and run it to collect the functions
+	/// it registers.
+	pub fn parse(code: Bytes) -> Result<Self, String> {
+		let name = parse_metadata(&code)?;
+		let lua = script::sandbox().map_err(script::error_message)?;
+		let registry = script::install_register_function(&lua).map_err(script::error_message)?;
+		lua.load(library_body(&code))
+			.set_name("@user_function")
+			.exec()
+			.map_err(script::error_message)?;
+
+		let mut functions = collect_functions(&registry).map_err(script::error_message)?;
+		if functions.is_empty() {
+			return Err("ERR No functions registered".to_string());
+		}
+		for function in &functions {
+			if !is_valid_name(&function.name) {
+				return Err("ERR Function names can only contain letters, numbers, or \
+				            underscores(_) and must be at least one character long"
+					.to_string());
+			}
+			if let Some(flag) = function
+				.flags
+				.iter()
+				.find(|flag| !KNOWN_FLAGS.contains(&flag.as_str()))
+			{
+				return Err(format!("ERR Unknown flag given: {}", flag));
+			}
+		}
+		functions.sort_by(|a, b| a.name.cmp(&b.name));
+
+		Ok(Self {
+			name,
+			code,
+			functions,
+		})
+	}
+
+	pub fn function(&self, name: &str) -> Option<&FunctionInfo> {
+		self.functions.iter().find(|function| function.name == name)
+	}
+
+	/// The code with its metadata line blanked out, so line numbers in error
+	/// messages still match the loaded code.
+	pub fn body(&self) -> &[u8] {
+		library_body(&self.code)
+	}
+}
+
+fn library_body(code: &[u8]) -> &[u8] {
+	match code.iter().position(|&b| b == b'\n') {
+		Some(pos) => &code[pos..],
+		None => &[],
+	}
+}
+
+/// Parse `#!<engine> name=<library>` and return the library name.
+fn parse_metadata(code: &[u8]) -> Result<String, String> {
+	let first_line = code.split(|&b| b == b'\n').next().unwrap_or_default();
+	let Some(shebang) = first_line.strip_prefix(b"#!") else {
+		return Err("ERR Missing library metadata".to_string());
+	};
+	let shebang = String::from_utf8_lossy(shebang);
+
+	let mut parts = shebang.split_whitespace();
+	let engine = parts.next().unwrap_or_default();
+	if !engine.eq_ignore_ascii_case("lua") {
+		return Err(format!("ERR Engine '{}' not found", engine));
+	}
+
+	let mut name = None;
+	for part in parts {
+		match part.split_once('=') {
+			Some(("name", value)) => name = Some(value.to_string()),
+			_ => return Err(format!("ERR Invalid metadata value given: {}", part)),
+		}
+	}
+
+	let name = name.ok_or_else(|| "ERR Library name was not given".to_string())?;
+	if !is_valid_name(&name) {
+		return Err(
+			"ERR Library names can only contain letters, numbers, or underscores(_) \
+		            and must be at least one character long"
+				.to_string(),
+		);
+	}
+	Ok(name)
+}
+
+fn collect_functions(registry: &Table) -> mlua::Result<Vec<FunctionInfo>> {
+	let mut functions = Vec::new();
+	for pair in registry.pairs::<String, Table>() {
+		let (name, entry) = pair?;
+		functions.push(FunctionInfo {
+			name,
+			description: entry.get("description")?,
+			flags: entry.get("flags")?,
+		});
+	}
+	Ok(functions)
+}
+
+fn is_valid_name(name: &str) -> bool {
+	!name.is_empty() && name.bytes().all(|b| b.is_ascii_alphanumeric() || b == b'_')
+}
+
+/// Add `library`, replacing a library with the same name only if `replace`
+/// is set. Function names must be unique across libraries.
+pub fn insert(libraries: &mut Libraries, library: Library, replace: bool) -> Result<(), String> {
+	if !replace && libraries.contains_key(&library.name) {
+		return Err(format!("ERR Library '{}' already exists", library.name));
+	}
+	for function in &library.functions {
+		if let Some(owner) = find_owner(libraries, &function.name)
+			&& owner.name != library.name
+		{
+			return Err(format!("ERR Function {} already exists", function.name));
+		}
+	}
+
+	libraries.insert(library.name.clone(), Arc::new(library));
+	Ok(())
+}
+
+fn find_owner<'a>(libraries: &'a Libraries, function: &str) -> Option<&'a Arc<Library>> {
+	libraries
+		.values()
+		.find(|library| library.function(function).is_some())
+}
+
+/// How FUNCTION RESTORE treats libraries that already exist.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum RestorePolicy {
+	/// Fail if any restored library already exists.
+	Append,
+	/// Replace existing libraries with the restored ones.
+	Replace,
+	/// Delete every library before restoring.
+	Flush,
+}
+
+/// Restore libraries from a FUNCTION DUMP payload.
+pub fn restore(
+	libraries: &mut Libraries,
+	payload: &[u8],
+	policy: RestorePolicy,
+) -> Result<(), String> {
+	let restored = decode_dump(payload)?;
+	if policy == RestorePolicy::Flush {
+		libraries.clear();
+	}
+	for library in restored {
+		insert(libraries, library, policy == RestorePolicy::Replace)?;
+	}
+	Ok(())
+}
+
+/// Serialize `libraries` for FUNCTION DUMP: a magic header followed by each
+/// library's code, length prefixed.
+pub fn dump(libraries: &Libraries) -> Bytes {
+	let mut buf = BytesMut::new();
+	buf.extend_from_slice(DUMP_MAGIC);
+	for library in libraries.values() {
+		buf.put_u32(library.code.len() as u32);
+		buf.extend_from_slice(&library.code);
+	}
+	buf.freeze()
+}
+
+fn decode_dump(payload: &[u8]) -> Result<Vec<Library>, String> {
+	let invalid = || "ERR payload version or checksum are wrong".to_string();
+	let mut buf = payload.strip_prefix(DUMP_MAGIC).ok_or_else(invalid)?;
+
+	let mut libraries = Vec::new();
+	while buf.has_remaining() {
+		if buf.remaining() < 4 {
+			return Err(invalid());
+		}
+		let len = buf.get_u32() as usize;
+		if buf.remaining() < len {
+			return Err(invalid());
+		}
+		libraries.push(Library::parse(Bytes::copy_from_slice(&buf[..len]))?);
+		buf.advance(len);
+	}
+	Ok(libraries)
+}
+
+/// Loaded libraries, shared by all clients.
+#[derive(Debug, Default)]
+pub struct FunctionRegistry {
+	libraries: RwLock<Libraries>,
+	/// Serializes changes so the persisted copy always matches the last one.
+	update_lock: Mutex<()>,
+}
+
+impl FunctionRegistry {
+	pub fn new() -> Self {
+		Self::default()
+	}
+
+	/// Loaded libraries, ordered by name.
+	pub fn libraries(&self) -> Vec<Arc<Library>> {
+		self.libraries.read().unwrap().values().cloned().collect()
+	}
+
+	/// The library that registered `function`.
+	pub fn find(&self, function: &str) -> Option<Arc<Library>> {
+		find_owner(&self.libraries.read().unwrap(), function).cloned()
+	}
+
+	pub fn dump(&self) -> Bytes {
+		dump(&self.libraries.read().unwrap())
+	}
+
+	/// Apply `change` to a copy of the libraries, persist the result and only
+	/// then make it visible, streaming `command` to replicas before another
+	/// change can come in between. Nothing changes if `change` or persisting
+	/// fails.
+	pub async fn update<T>(
+		&self,
+		storage: &Storage,
+		command: &[Bytes],
+		change: impl FnOnce(&mut Libraries) -> Result<T, String>,
+	) -> Result<T, String> {
+		let _guard = self.update_lock.lock().await;
+		let mut libraries = self.libraries.read().unwrap().clone();
+		let result = change(&mut libraries)?;
+
+		storage
+			.put_metadata(METADATA_NAME, dump(&libraries))
+			.await
+			.map_err(|e| e.to_string())?;
+		*self.libraries.write().unwrap() = libraries;
+		GCTX!(replication).propagate(command);
+		Ok(result)
+	}
+
+	/// Reload the libraries persisted by a previous run.
+	pub async fn load_persisted(&self, storage: &Storage) -> Result<(), String> {
+		let Some(payload) = storage
+			.get_metadata(METADATA_NAME)
+			.await
+			.map_err(|e| e.to_string())?
+		else {
+			return Ok(());
+		};
+
+		let mut libraries = Libraries::new();
+		restore(&mut libraries, &payload, RestorePolicy::Append)?;
+		*self.libraries.write().unwrap() = libraries;
+		Ok(())
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use rstest::rstest;
+
+	use super::*;
+
+	const LIBRARY: &str = "#!lua name=mylib\n\
+		redis.register_function('echo', function(keys, args) return args[1] end)\n\
+		redis.register_function{function_name='ro', callback=function() return 1 end, \
+		flags={'no-writes'}, description='read only'}\n";
+
+	#[test]
+	fn test_parse_library() {
+		let library = Library::parse(Bytes::from(LIBRARY)).unwrap();
+		assert_eq!(library.name, "mylib");
+		assert_eq!(
+			library.functions,
+			vec![
+				FunctionInfo {
+					name: "echo".to_string(),
+					description: None,
+					flags: vec![],
+				},
+				FunctionInfo {
+					name: "ro".to_string(),
+					description: Some("read only".to_string()),
+					flags: vec!["no-writes".to_string()],
+				},
+			]
+		);
+		assert!(library.body().starts_with(b"\nredis.register_function"));
+		assert!(!library.function("echo").unwrap().is_read_only());
+		assert!(library.function("ro").unwrap().is_read_only());
+		assert!(library.function("missing").is_none());
+	}
+
+	#[rstest]
+	#[case("return 1", "Missing library metadata")]
+	#[case("#!js name=lib\n", "Engine 'js' not found")]
+	#[case("#!lua\n", "Library name was not given")]
+	#[case("#!lua name=bad-name\n", "Library names can only contain")]
+	#[case("#!lua name=lib foo=bar\n", "Invalid metadata value")]
+	#[case("#!lua name=lib\nlocal x = 1", "No functions registered")]
+	#[case("#!lua name=lib\nredis.call('SET', 'a', 'b')", "Error running script")]
+	#[case(
+		"#!lua name=lib\nredis.register_function{function_name='f', callback=function() end, flags={'bogus'}}",
+		"Unknown flag given"
+	)]
+	#[case(
+		"#!lua name=lib\nredis.register_function('f', function() end)\nredis.register_function('f', function() end)",
+		"Function already exists in the library"
+	)]
+	fn test_parse_library_errors(#[case] code: &str, #[case] expected: &str) {
+		let err = Library::parse(Bytes::from(code.to_string())).unwrap_err();
+		assert!(err.contains(expected), "{err}");
+	}
+
+	#[test]
+	fn test_insert_conflicts() {
+		let mut libraries = Libraries::new();
+		insert(
+			&mut libraries,
+			Library::parse(Bytes::from(LIBRARY)).unwrap(),
+			false,
+		)
+		.unwrap();
+
+		let err = insert(
+			&mut libraries,
+			Library::parse(Bytes::from(LIBRARY)).unwrap(),
+			false,
+		)
+		.unwrap_err();
+		assert!(err.contains("Library 'mylib' already exists"));
+		insert(
+			&mut libraries,
+			Library::parse(Bytes::from(LIBRARY)).unwrap(),
+			true,
+		)
+		.unwrap();
+
+		let other = "#!lua name=other\nredis.register_function('echo', function() end)";
+		let err = insert(
+			&mut libraries,
+			Library::parse(Bytes::from(other)).unwrap(),
+			false,
+		)
+		.unwrap_err();
+		assert!(err.contains("Function echo already exists"));
+	}
+
+	#[test]
+	fn test_dump_and_restore() {
+		let mut libraries = Libraries::new();
+		insert(
+			&mut libraries,
+			Library::parse(Bytes::from(LIBRARY)).unwrap(),
+			false,
+		)
+		.unwrap();
+		let payload = dump(&libraries);
+
+		let mut restored = Libraries::new();
+		restore(&mut restored, &payload, RestorePolicy::Append).unwrap();
+		assert_eq!(restored.keys().collect::<Vec<_>>(), vec!["mylib"]);
+
+		assert!(restore(&mut restored, &payload, RestorePolicy::Append).is_err());
+		restore(&mut restored, &payload, RestorePolicy::Replace).unwrap();
+		restore(&mut restored, &payload, RestorePolicy::Flush).unwrap();
+		assert_eq!(restored.len(), 1);
+
+		let err = restore(&mut restored, b"garbage", RestorePolicy::Append).unwrap_err();
+		assert!(err.contains("payload version or checksum are wrong"));
+	}
+}
@@ -0,0 +1,262 @@
+//! Background garbage collection of element data left behind by deleted or
+//! replaced collections.
+//!
+//! A GC pass walks every element DB in small batches, one batch per tick, so
+//! it never holds up clients for long. Passes start every
+//! `gc_interval_seconds` after the last one ended, or on request with
+//! NIMBIS GC. Their progress and what they reclaimed are reported by the
+//! Storage section of INFO.
+
+use std::sync::Mutex;
+use std::time::Duration;
+use std::time::Instant;
+
+use bytes::Bytes;
+use log::error;
+use log::info;
+use nimbis_storage::Storage;
+use nimbis_storage::data_type::DataType;
+use nimbis_storage::gc::GC_DBS;
+
+use crate::GCTX;
+use crate::server_config;
+
+const GC_IN_PROGRESS: &str = "ERR Background GC already in progress";
+/// How often the next batch of a pass runs, or a pass is checked for.
+const GC_TICK: Duration = Duration::from_millis(100);
+/// Element records read by one batch.
+const GC_BATCH_SIZE: usize = 1000;
+
+/// Run GC passes for the lifetime of the server.
+pub fn start_gc(storage: Storage) {
+	tokio::spawn(async move {
+		let mut interval = tokio::time::interval(GC_TICK);
+		loop {
+			interval.tick().await;
+			let gc = GCTX!(gc);
+			let Some((db, start)) = gc.next_batch(server_config!(gc_interval_seconds)) else {
+				continue;
+			};
+			let result = {
+				// Batches never run inside a transaction or script, whose
+				// rollback could need the data GC deletes.
+				let _guard = GCTX!(exec_lock).read().await;
+				storage.gc_step(GC_DBS[db], start, GC_BATCH_SIZE).await
+			};
+			match result {
+				Ok(step) => {
+					gc.finish_batch(step.scanned, step.purged, step.reclaimed_bytes, step.next)
+				}
+				Err(e) => gc.fail_pass(&e.to_string()),
+			}
+		}
+	});
+}
+
+/// Where a running pass is: the index of its DB in `GC_DBS` and the key
+/// its next batch starts at.
+#[derive(Debug)]
+struct GcCursor {
+	db: usize,
+	start: Option<Bytes>,
+	started: Instant,
+	purged: u64,
+	reclaimed_bytes: u64,
+}
+
+#[derive(Debug)]
+struct GcState {
+	cursor: Option<GcCursor>,
+	/// Whether NIMBIS GC asked for a pass.
+	requested: bool,
+	/// When the last pass ended, or the server started.
+	last_pass_at: Instant,
+	last_pass_ok: bool,
+	passes: u64,
+	scanned: u64,
+	purged: u64,
+	reclaimed_bytes: u64,
+}
+
+#[derive(Debug)]
+pub struct Gc {
+	state: Mutex<GcState>,
+}
+
+impl Default for Gc {
+	fn default() -> Self {
+		Self::new()
+	}
+}
+
+impl Gc {
+	pub fn new() -> Self {
+		Self {
+			state: Mutex::new(GcState {
+				cursor: None,
+				requested: false,
+				last_pass_at: Instant::now(),
+				last_pass_ok: true,
+				passes: 0,
+				scanned: 0,
+				purged: 0,
+				reclaimed_bytes: 0,
+			}),
+		}
+	}
+
+	/// Ask for a pass to start on the next tick.
+	pub fn request(&self) -> Result<(), String> {
+		let mut state = self.state.lock().unwrap();
+		if state.cursor.is_some() || state.requested {
+			return Err(GC_IN_PROGRESS.to_string());
+		}
+		state.requested = true;
+		Ok(())
+	}
+
+	/// The next batch to run, starting a pass when one is requested or
+	/// `interval_secs` have passed since the last one. An interval of 0 only
+	/// runs requested passes.
+	fn next_batch(&self, interval_secs: u64) -> Option<(usize, Option<Bytes>)> {
+		let mut state = self.state.lock().unwrap();
+		if state.cursor.is_none() {
+			let due = interval_secs > 0
+				&& state.last_pass_at.elapsed() >= Duration::from_secs(interval_secs);
+			if !state.requested && !due {
+				return None;
+			}
+			state.requested = false;
+			state.cursor = Some(GcCursor {
+				db: 0,
+				start: None,
+				started: Instant::now(),
+				purged: 0,
+				reclaimed_bytes: 0,
+			});
+		}
+		state
+			.cursor
+			.as_ref()
+			.map(|cursor| (cursor.db, cursor.start.clone()))
+	}
+
+	fn finish_batch(&self, scanned: u64, purged: u64, reclaimed_bytes: u64, next: Option<Bytes>) {
+		let mut state = self.state.lock().unwrap();
+		state.scanned += scanned;
+		state.purged += purged;
+		state.reclaimed_bytes += reclaimed_bytes;
+		let Some(cursor) = state.cursor.as_mut() else {
+			return;
+		};
+		cursor.purged += purged;
+		cursor.reclaimed_bytes += reclaimed_bytes;
+		cursor.start = next;
+		if cursor.start.is_some() {
+			return;
+		}
+		cursor.db += 1;
+		if cursor.db < GC_DBS.len() {
+			return;
+		}
+		if let Some(cursor) = state.cursor.take() {
+			info!(
+				"Background GC pass terminated with success in {:?}: purged {} records, {} bytes",
+				cursor.started.elapsed(),
+				cursor.purged,
+				cursor.reclaimed_bytes
+			);
+		}
+		state.passes += 1;
+		state.last_pass_ok = true;
+		state.last_pass_at = Instant::now();
+	}
+
+	fn fail_pass(&self, err: &str) {
+		error!("Background GC error: {}", err);
+		let mut state = self.state.lock().unwrap();
+		state.cursor = None;
+		state.last_pass_ok = false;
+		state.last_pass_at = Instant::now();
+	}
+
+	/// GC fields of the Storage section of INFO.
+	pub fn info(&self) -> Vec<(String, String)> {
+		let state = self.state.lock().unwrap();
+		let current_db = state
+			.cursor
+			.as_ref()
+			.map_or(String::new(), |cursor| db_name(GC_DBS[cursor.db]));
+		vec![
+			(
+				"gc_in_progress".to_string(),
+				(state.cursor.is_some() as u8).to_string(),
+			),
+			("gc_current_db".to_string(), current_db),
+			("gc_passes".to_string(), state.passes.to_string()),
+			(
+				"gc_last_pass_status".to_string(),
+				if state.last_pass_ok { "ok" } else { "err" }.to_string(),
+			),
+			("gc_scanned_records".to_string(), state.scanned.to_string()),
+			("gc_purged_records".to_string(), state.purged.to_string()),
+			(
+				"gc_reclaimed_bytes".to_string(),
+				state.reclaimed_bytes.to_string(),
+			),
+		]
+	}
+}
+
+fn db_name(data_type: DataType) -> String {
+	format!("{:?}", data_type).to_lowercase()
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+
+	fn field<'a>(info: &'a [(String, String)], name: &str) -> &'a str {
+		&info.iter().find(|(k, _)| k == name).unwrap().1
+	}
+
+	#[test]
+	fn test_gc_pass_walks_every_db() {
+		let gc = Gc::new();
+		assert_eq!(gc.next_batch(0), None);
+
+		gc.request().unwrap();
+		assert_eq!(gc.request(), Err(GC_IN_PROGRESS.to_string()));
+		assert_eq!(gc.next_batch(0), Some((0, None)));
+		assert_eq!(field(&gc.info(), "gc_current_db"), "hash");
+
+		// A batch that stops early resumes in the same DB.
+		gc.finish_batch(10, 2, 64, Some(Bytes::from("k")));
+		assert_eq!(gc.next_batch(0), Some((0, Some(Bytes::from("k")))));
+		for db in 0..GC_DBS.len() {
+			assert_eq!(gc.next_batch(0).unwrap().0, db);
+			gc.finish_batch(1, 0, 0, None);
+		}
+
+		let info = gc.info();
+		assert_eq!(field(&info, "gc_in_progress"), "0");
+		assert_eq!(field(&info, "gc_passes"), "1");
+		assert_eq!(field(&info, "gc_scanned_records"), "16");
+		assert_eq!(field(&info, "gc_purged_records"), "2");
+		assert_eq!(field(&info, "gc_reclaimed_bytes"), "64");
+		assert_eq!(gc.next_batch(0), None);
+	}
+
+	#[test]
+	fn test_gc_failed_pass() {
+		let gc = Gc::new();
+		gc.request().unwrap();
+		gc.next_batch(0).unwrap();
+		gc.fail_pass("boom");
+
+		let info = gc.info();
+		assert_eq!(field(&info, "gc_in_progress"), "0");
+		assert_eq!(field(&info, "gc_last_pass_status"), "err");
+		assert_eq!(field(&info, "gc_passes"), "0");
+	}
+}
@@ -0,0 +1,52 @@
+//! The Keyspace section of INFO.
+//!
+//! Storage counts the keys as they are written, deleted and expired, so the
+//! section reads those counts without walking the keys.
+
+use nimbis_storage::Storage;
+use nimbis_storage::keyspace::KeyspaceCounts;
+
+/// The fields of the Keyspace section of INFO: a `db0` line, left out while
+/// there are no keys, like Redis does for empty databases.
+pub fn info(storage: &Storage) -> Vec<(String, String)> {
+	fields(&storage.keyspace_counts())
+}
+
+fn fields(counts: &KeyspaceCounts) -> Vec<(String, String)> {
+	if counts.keys == 0 {
+		return Vec::new();
+	}
+	vec![(
+		"db0".to_string(),
+		format!(
+			"keys={},expires={},avg_ttl={}",
+			counts.keys, counts.expires, counts.avg_ttl_ms
+		),
+	)]
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+
+	fn counts(keys: u64, expires: u64, avg_ttl_ms: u64) -> KeyspaceCounts {
+		KeyspaceCounts {
+			keys,
+			expires,
+			avg_ttl_ms,
+		}
+	}
+
+	#[test]
+	fn test_fields_leave_out_an_empty_db() {
+		assert!(fields(&counts(0, 0, 0)).is_empty());
+		assert_eq!(
+			fields(&counts(1500, 20, 2000)),
+			vec![(
+				"db0".to_string(),
+				"keys=1500,expires=20,avg_ttl=2000".to_string()
+			)]
+		);
+		assert_eq!(fields(&counts(3, 0, 0))[0].1, "keys=3,expires=0,avg_ttl=0");
+	}
+}
@@ -0,0 +1,495 @@
+use std::collections::BTreeMap;
+use std::collections::HashMap;
+use std::collections::VecDeque;
+use std::fmt::Write;
+use std::sync::Mutex;
+use std::time::Duration;
+use std::time::SystemTime;
+use std::time::UNIX_EPOCH;
+
+/// Number of samples kept per event, matching Redis.
+const LATENCY_TS_LEN: usize = 160;
+
+/// Sources of latency spikes tracked by the latency monitor.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord, Hash)]
+pub enum LatencyEvent {
+	/// Execution of a single client command.
+	Command,
+	/// Deleting the keys past their expire time in an active expire cycle.
+	ExpireCycle,
+	/// Creating a point-in-time snapshot of the storage engine.
+	Snapshot,
+	/// Waiting on the storage engine for a flush or checkpoint.
+	StorageStall,
+}
+
+impl LatencyEvent {
+	pub const ALL: [LatencyEvent; 4] = [
+		LatencyEvent::Command,
+		LatencyEvent::ExpireCycle,
+		LatencyEvent::Snapshot,
+		LatencyEvent::StorageStall,
+	];
+
+	pub fn name(&self) -> &'static str {
+		match self {
+			LatencyEvent::Command => "command",
+			LatencyEvent::ExpireCycle => "expire-cycle",
+			LatencyEvent::Snapshot => "snapshot",
+			LatencyEvent::StorageStall => "storage-stall",
+		}
+	}
+
+	pub fn from_name(name: &str) -> Option<Self> {
+		Self::ALL
+			.into_iter()
+			.find(|event| event.name().eq_ignore_ascii_case(name))
+	}
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct LatencySample {
+	/// Unix time in seconds.
+	pub time: i64,
+	/// Latency in milliseconds.
+	pub latency: u64,
+}
+
+/// Latest samples of a single event together with its all time maximum.
+#[derive(Debug, Clone, Default)]
+pub struct LatencyTimeSeries {
+	pub samples: VecDeque<LatencySample>,
+	pub max: u64,
+}
+
+impl LatencyTimeSeries {
+	pub fn latest(&self) -> Option<LatencySample> {
+		self.samples.back().copied()
+	}
+
+	fn add(&mut self, sample: LatencySample) {
+		self.max = self.max.max(sample.latency);
+
+		// Keep a single sample per second, retaining the worst one.
+		if let Some(last) = self.samples.back_mut()
+			&& last.time == sample.time
+		{
+			last.latency = last.latency.max(sample.latency);
+			return;
+		}
+
+		self.samples.push_back(sample);
+		if self.samples.len() > LATENCY_TS_LEN {
+			self.samples.pop_front();
+		}
+	}
+}
+
+/// Tracks latency spikes reaching `latency_monitor_threshold` per event.
+#[derive(Debug, Default)]
+pub struct LatencyMonitor {
+	events: Mutex<BTreeMap<LatencyEvent, LatencyTimeSeries>>,
+}
+
+impl LatencyMonitor {
+	pub fn new() -> Self {
+		Self::default()
+	}
+
+	/// Record `duration` for `event` when it reaches `threshold_ms`. A zero
+	/// threshold disables the monitor.
+	pub fn add_sample_if_needed(&self, threshold_ms: u64, event: LatencyEvent, duration: Duration) {
+		let latency = duration.as_millis() as u64;
+		if threshold_ms == 0 || latency < threshold_ms {
+			return;
+		}
+
+		let time = SystemTime::now()
+			.duration_since(UNIX_EPOCH)
+			.map(|d| d.as_secs() as i64)
+			.unwrap_or_default();
+		self.events
+			.lock()
+			.unwrap()
+			.entry(event)
+			.or_default()
+			.add(LatencySample { time, latency });
+	}
+
+	/// Snapshot of every event that has at least one sample.
+	pub fn latest(&self) -> Vec<(LatencyEvent, LatencyTimeSeries)> {
+		self.events
+			.lock()
+			.unwrap()
+			.iter()
+			.map(|(event, ts)| (*event, ts.clone()))
+			.collect()
+	}
+
+	pub fn history(&self, event: LatencyEvent) -> Vec<LatencySample> {
+		self.events
+			.lock()
+			.unwrap()
+			.get(&event)
+			.map(|ts| ts.samples.iter().copied().collect())
+			.unwrap_or_default()
+	}
+
+	/// Reset the given events, or all of them when `events` is empty.
+	/// Returns the number of event time series that were removed.
+	pub fn reset(&self, events: &[LatencyEvent]) -> usize {
+		let mut guard = self.events.lock().unwrap();
+		if events.is_empty() {
+			let count = guard.len();
+			guard.clear();
+			return count;
+		}
+
+		events
+			.iter()
+			.filter(|event| guard.remove(event).is_some())
+			.count()
+	}
+
+	/// Human readable analysis of the recorded events.
+	pub fn doctor(&self, threshold_ms: u64) -> String {
+		let events = self.latest();
+		if threshold_ms == 0 && events.is_empty() {
+			return "Latency monitoring is disabled in this Nimbis instance. You may use \
+			        \"CONFIG SET latency_monitor_threshold <milliseconds>\" in order to \
+			        enable it.\n"
+				.to_string();
+		}
+		if events.is_empty() {
+			return "No latency spike was observed during the lifetime of this Nimbis \
+			        instance.\n"
+				.to_string();
+		}
+
+		let mut report = String::from("Latency spikes are observed in this Nimbis instance.\n\n");
+		for (i, (event, ts)) in events.iter().enumerate() {
+			let samples = ts.samples.len() as u64;
+			let sum = ts.samples.iter().map(|s| s.latency).sum::<u64>();
+			let avg = sum / samples.max(1);
+			let mad =
+				ts.samples
+					.iter()
+					.map(|s| s.latency.abs_diff(avg))
+					.sum::<u64>() / samples.max(1);
+			let period = match (ts.samples.front(), ts.samples.back()) {
+				(Some(first), Some(last)) if samples > 1 => {
+					(last.time - first.time) / (samples as i64 - 1)
+				}
+				_ => 0,
+			};
+			let _ = writeln!(
+				report,
+				"{}. {}: {} latency spikes (average {}ms, mean deviation {}ms, period {} sec). \
+				 Worst all time event {}ms.",
+				i + 1,
+				event.name(),
+				samples,
+				avg,
+				mad,
+				period,
+				ts.max
+			);
+		}
+
+		report
+	}
+}
+
+/// Latencies below this many microseconds have a bucket of their own; from
+/// there on every power of two is split into this many buckets, so a
+/// percentile is off by at most 1/16 of its value.
+const HISTOGRAM_SUB_BUCKETS: u64 = 16;
+const HISTOGRAM_SUB_BITS: u32 = HISTOGRAM_SUB_BUCKETS.trailing_zeros();
+const HISTOGRAM_BUCKETS: usize =
+	((64 - HISTOGRAM_SUB_BITS + 1) as u64 * HISTOGRAM_SUB_BUCKETS) as usize;
+
+/// The percentiles INFO latencystats reports, with their field names.
+pub const LATENCY_PERCENTILES: [(f64, &str); 3] = [(50.0, "p50"), (99.0, "p99"), (99.9, "p99.9")];
+
+/// Log-linear histogram of latencies in microseconds.
+#[derive(Debug, Clone)]
+pub struct LatencyHistogram {
+	counts: Vec<u64>,
+	calls: u64,
+	max: u64,
+}
+
+impl Default for LatencyHistogram {
+	fn default() -> Self {
+		Self {
+			counts: vec![0; HISTOGRAM_BUCKETS],
+			calls: 0,
+			max: 0,
+		}
+	}
+}
+
+impl LatencyHistogram {
+	fn bucket(usec: u64) -> usize {
+		if usec < HISTOGRAM_SUB_BUCKETS {
+			return usec as usize;
+		}
+		let major = 63 - usec.leading_zeros();
+		let sub = (usec >> (major - HISTOGRAM_SUB_BITS)) & (HISTOGRAM_SUB_BUCKETS - 1);
+		((major - HISTOGRAM_SUB_BITS + 1) as u64 * HISTOGRAM_SUB_BUCKETS + sub) as usize
+	}
+
+	/// The lowest latency counted in `bucket`.
+	fn bucket_start(bucket: usize) -> u64 {
+		let bucket = bucket as u64;
+		if bucket < HISTOGRAM_SUB_BUCKETS {
+			return bucket;
+		}
+		let major = (bucket / HISTOGRAM_SUB_BUCKETS) as u32 + HISTOGRAM_SUB_BITS - 1;
+		(HISTOGRAM_SUB_BUCKETS + bucket % HISTOGRAM_SUB_BUCKETS) << (major - HISTOGRAM_SUB_BITS)
+	}
+
+	pub fn record(&mut self, duration: Duration) {
+		let usec = duration.as_micros().min(u64::MAX as u128) as u64;
+		self.counts[Self::bucket(usec)] += 1;
+		self.calls += 1;
+		self.max = self.max.max(usec);
+	}
+
+	pub fn calls(&self) -> u64 {
+		self.calls
+	}
+
+	/// The latency in microseconds that `percentile` percent of the calls
+	/// took at most, rounded up to the end of its bucket.
+	pub fn percentile(&self, percentile: f64) -> u64 {
+		let rank =
+			((percentile / 100.0 * self.calls as f64).ceil() as u64).clamp(1, self.calls.max(1));
+		let mut seen = 0;
+		for (bucket, count) in self.counts.iter().enumerate() {
+			seen += count;
+			if seen >= rank {
+				if bucket + 1 == HISTOGRAM_BUCKETS {
+					return self.max;
+				}
+				return (Self::bucket_start(bucket + 1) - 1).min(self.max);
+			}
+		}
+		self.max
+	}
+
+	/// Calls below each power of two microseconds, from 1 to the first power
+	/// of two above the slowest call, as `(bucket, calls)` pairs.
+	pub fn cumulative(&self) -> Vec<(u64, u64)> {
+		let mut buckets = Vec::new();
+		let mut seen = 0;
+		let mut counts = self.counts.iter().enumerate().peekable();
+		for power in 0..64 {
+			let limit = 1u64 << power;
+			while let Some((_, count)) =
+				counts.next_if(|(bucket, _)| Self::bucket_start(*bucket) < limit)
+			{
+				seen += count;
+			}
+			buckets.push((limit, seen));
+			if limit > self.max {
+				break;
+			}
+		}
+		buckets
+	}
+}
+
+/// Latency histograms of every command run since the server started, kept
+/// while `latency_tracking` is on.
+#[derive(Debug, Default)]
+pub struct CommandLatencies {
+	commands: Mutex<HashMap<String, LatencyHistogram>>,
+}
+
+impl CommandLatencies {
+	pub fn new() -> Self {
+		Self::default()
+	}
+
+	pub fn record(&self, name: &str, duration: Duration) {
+		self.commands
+			.lock()
+			.unwrap()
+			.entry(name.to_lowercase())
+			.or_default()
+			.record(duration);
+	}
+
+	pub fn reset(&self) {
+		self.commands.lock().unwrap().clear();
+	}
+
+	/// Histograms of the given commands, or of every command that ran when
+	/// `names` is empty, sorted by name.
+	pub fn histograms(&self, names: &[String]) -> Vec<(String, LatencyHistogram)> {
+		let commands = self.commands.lock().unwrap();
+		let mut histograms: Vec<_> = commands
+			.iter()
+			.filter(|(name, _)| {
+				names.is_empty() || names.iter().any(|n| n.eq_ignore_ascii_case(name))
+			})
+			.map(|(name, histogram)| (name.clone(), histogram.clone()))
+			.collect();
+		histograms.sort_by(|a, b| a.0.cmp(&b.0));
+		histograms
+	}
+
+	/// Fields of the Latencystats section of INFO.
+	pub fn info(&self) -> Vec<(String, String)> {
+		self.histograms(&[])
+			.into_iter()
+			.map(|(name, histogram)| {
+				let percentiles = LATENCY_PERCENTILES
+					.iter()
+					.map(|(percentile, field)| {
+						format!("{}={}", field, histogram.percentile(*percentile))
+					})
+					.collect::<Vec<_>>()
+					.join(",");
+				(format!("latency_percentiles_usec_{}", name), percentiles)
+			})
+			.collect()
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+
+	#[test]
+	fn test_event_names_round_trip() {
+		for event in LatencyEvent::ALL {
+			assert_eq!(LatencyEvent::from_name(event.name()), Some(event));
+		}
+		assert_eq!(
+			LatencyEvent::from_name("COMMAND"),
+			Some(LatencyEvent::Command)
+		);
+		assert_eq!(LatencyEvent::from_name("fork"), None);
+	}
+
+	#[test]
+	fn test_add_sample_respects_threshold() {
+		let monitor = LatencyMonitor::new();
+
+		monitor.add_sample_if_needed(0, LatencyEvent::Command, Duration::from_secs(1));
+		monitor.add_sample_if_needed(100, LatencyEvent::Command, Duration::from_millis(99));
+		assert!(monitor.latest().is_empty());
+
+		monitor.add_sample_if_needed(100, LatencyEvent::Command, Duration::from_millis(150));
+		monitor.add_sample_if_needed(100, LatencyEvent::Command, Duration::from_millis(120));
+		let latest = monitor.latest();
+		assert_eq!(latest.len(), 1);
+		assert_eq!(latest[0].0, LatencyEvent::Command);
+		assert_eq!(latest[0].1.max, 150);
+	}
+
+	#[test]
+	fn test_time_series_keeps_worst_sample_per_second() {
+		let mut ts = LatencyTimeSeries::default();
+		ts.add(LatencySample {
+			time: 1,
+			latency: 10,
+		});
+		ts.add(LatencySample {
+			time: 1,
+			latency: 30,
+		});
+		ts.add(LatencySample {
+			time: 1,
+			latency: 20,
+		});
+		assert_eq!(ts.samples.len(), 1);
+		assert_eq!(ts.latest().unwrap().latency, 30);
+
+		for time in 2..(LATENCY_TS_LEN as i64 + 10) {
+			ts.add(LatencySample { time, latency: 1 });
+		}
+		assert_eq!(ts.samples.len(), LATENCY_TS_LEN);
+		assert_eq!(ts.max, 30);
+	}
+
+	#[test]
+	fn test_reset() {
+		let monitor = LatencyMonitor::new();
+		monitor.add_sample_if_needed(1, LatencyEvent::Command, Duration::from_millis(5));
+		monitor.add_sample_if_needed(1, LatencyEvent::Snapshot, Duration::from_millis(5));
+
+		assert_eq!(monitor.reset(&[LatencyEvent::Snapshot]), 1);
+		assert!(monitor.history(LatencyEvent::Snapshot).is_empty());
+		assert_eq!(monitor.history(LatencyEvent::Command).len(), 1);
+		assert_eq!(monitor.reset(&[]), 1);
+		assert!(monitor.latest().is_empty());
+	}
+
+	#[test]
+	fn test_histogram_buckets() {
+		for usec in [0, 1, 15, 16, 17, 31, 32, 33, 1000, 123_456, u64::MAX] {
+			let bucket = LatencyHistogram::bucket(usec);
+			assert!(LatencyHistogram::bucket_start(bucket) <= usec);
+			if bucket + 1 < HISTOGRAM_BUCKETS {
+				assert!(LatencyHistogram::bucket_start(bucket + 1) > usec);
+			}
+		}
+		assert_eq!(LatencyHistogram::bucket(u64::MAX), HISTOGRAM_BUCKETS - 1);
+	}
+
+	#[test]
+	fn test_histogram_percentiles() {
+		let mut histogram = LatencyHistogram::default();
+		assert_eq!(histogram.percentile(50.0), 0);
+		for usec in 1..=1000 {
+			histogram.record(Duration::from_micros(usec));
+		}
+		assert_eq!(histogram.calls(), 1000);
+		let p50 = histogram.percentile(50.0);
+		assert!((500..=500 + 500 / 16).contains(&p50), "p50 {}", p50);
+		let p99 = histogram.percentile(99.0);
+		assert!((990..=990 + 990 / 16).contains(&p99), "p99 {}", p99);
+		assert_eq!(histogram.percentile(99.9), 1000);
+		assert_eq!(histogram.percentile(100.0), 1000);
+	}
+
+	#[test]
+	fn test_histogram_cumulative() {
+		let mut histogram = LatencyHistogram::default();
+		for usec in [0, 1, 3, 100] {
+			histogram.record(Duration::from_micros(usec));
+		}
+		let cumulative = histogram.cumulative();
+		assert_eq!(cumulative[0], (1, 1));
+		assert_eq!(cumulative[1], (2, 2));
+		assert_eq!(cumulative[2], (4, 3));
+		assert_eq!(cumulative.last(), Some(&(128, 4)));
+	}
+
+	#[test]
+	fn test_command_latencies() {
+		let latencies = CommandLatencies::new();
+		latencies.record("GET", Duration::from_micros(10));
+		latencies.record("get", Duration::from_micros(20));
+		latencies.record("SET", Duration::from_micros(30));
+
+		let all = latencies.histograms(&[]);
+		assert_eq!(all.len(), 2);
+		assert_eq!(all[0].0, "get");
+		assert_eq!(all[0].1.calls(), 2);
+		assert_eq!(latencies.histograms(&["SET".to_string()]).len(), 1);
+		assert!(latencies.histograms(&["del".to_string()]).is_empty());
+
+		let info = latencies.info();
+		assert_eq!(
+			info[1],
+			(
+				"latency_percentiles_usec_set".to_string(),
+				"p50=30,p99=30,p99.9=30".to_string()
+			)
+		);
+	}
+}
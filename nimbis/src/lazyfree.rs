@@ -0,0 +1,278 @@
+//! Lazy freeing of the elements of deleted and overwritten collections.
+//!
+//! Deleting or overwriting a collection only replaces its metadata, so the
+//! command stays fast whatever the size of the collection, but its elements
+//! are left for the next GC pass or compaction. With
+//! `lazyfree_lazy_server_del`, every key a command may have dropped a
+//! collection at, and every key storage found expired, is queued for a
+//! background worker that deletes the stale elements of that key right away,
+//! a batch at a time, like Redis frees large values in a background thread.
+//! Other ways of dropping keys, such as eviction, queue them through [`free`].
+//!
+//! Keys queued while [`LAZYFREE_QUEUE_LIMIT`] keys are pending are left to GC
+//! passes.
+
+use std::collections::HashSet;
+use std::collections::VecDeque;
+use std::sync::Mutex;
+
+use bytes::Bytes;
+use log::error;
+use nimbis_storage::Storage;
+use nimbis_storage::gc::GC_DBS;
+use tokio::sync::Notify;
+
+use crate::GCTX;
+use crate::acl;
+use crate::server_config;
+
+/// Keys that can wait to be freed at once.
+pub const LAZYFREE_QUEUE_LIMIT: usize = 10_000;
+/// Element records read by one batch.
+const LAZYFREE_BATCH_SIZE: usize = 1000;
+
+/// Commands that can delete or overwrite a collection at the keys they are
+/// given.
+const LAZYFREE_CMDS: &[&str] = &[
+	"SET",
+	"DEL",
+	"RESTORE",
+	"RESTORE-ASKING",
+	"MIGRATE",
+	"BITOP",
+	"GEOSEARCHSTORE",
+];
+
+/// Run the lazy free worker for the lifetime of the server.
+pub fn start_lazyfree(storage: Storage) {
+	tokio::spawn(async move {
+		let lazyfree = GCTX!(lazyfree);
+		loop {
+			let Some((key, db, start)) = lazyfree.next_batch() else {
+				lazyfree.pending.notified().await;
+				continue;
+			};
+			let result = {
+				// Like GC batches, never inside a transaction or script.
+				let _guard = GCTX!(exec_lock).read().await;
+				storage
+					.gc_key_step(GC_DBS[db], &key, start, LAZYFREE_BATCH_SIZE)
+					.await
+			};
+			match result {
+				Ok(step) => lazyfree.finish_batch(step.purged, step.next),
+				Err(e) => lazyfree.fail_batch(&key, &e.to_string()),
+			}
+			tokio::task::yield_now().await;
+		}
+	});
+}
+
+/// The key being freed: the index of its DB in `GC_DBS` and the record its
+/// next batch starts at.
+#[derive(Debug)]
+struct FreeCursor {
+	key: Bytes,
+	db: usize,
+	start: Option<Bytes>,
+	purged: u64,
+}
+
+#[derive(Debug, Default)]
+struct LazyFreeState {
+	queue: VecDeque<Bytes>,
+	/// The keys in `queue`, so a key is queued once.
+	queued: HashSet<Bytes>,
+	cursor: Option<FreeCursor>,
+	/// Keys that had stale elements to delete.
+	freed: u64,
+	/// Stale element records deleted.
+	purged: u64,
+}
+
+#[derive(Debug, Default)]
+pub struct LazyFree {
+	state: Mutex<LazyFreeState>,
+	/// Woken when a key is queued.
+	pending: Notify,
+}
+
+impl LazyFree {
+	pub fn new() -> Self {
+		Self::default()
+	}
+
+	/// Queue `key` to have its stale elements freed. Returns false when the
+	/// queue is full.
+	pub fn queue(&self, key: &Bytes) -> bool {
+		let mut state = self.state.lock().unwrap();
+		if state.queued.contains(key) {
+			return true;
+		}
+		if state.queue.len() >= LAZYFREE_QUEUE_LIMIT {
+			return false;
+		}
+		state.queue.push_back(key.clone());
+		state.queued.insert(key.clone());
+		drop(state);
+		self.pending.notify_one();
+		true
+	}
+
+	/// The next batch to run, taking the next queued key when the last one
+	/// is done.
+	fn next_batch(&self) -> Option<(Bytes, usize, Option<Bytes>)> {
+		let mut state = self.state.lock().unwrap();
+		if state.cursor.is_none() {
+			let key = state.queue.pop_front()?;
+			state.queued.remove(&key);
+			state.cursor = Some(FreeCursor {
+				key,
+				db: 0,
+				start: None,
+				purged: 0,
+			});
+		}
+		state
+			.cursor
+			.as_ref()
+			.map(|cursor| (cursor.key.clone(), cursor.db, cursor.start.clone()))
+	}
+
+	fn finish_batch(&self, purged: u64, next: Option<Bytes>) {
+		let mut state = self.state.lock().unwrap();
+		state.purged += purged;
+		let Some(cursor) = state.cursor.as_mut() else {
+			return;
+		};
+		cursor.purged += purged;
+		cursor.start = next;
+		if cursor.start.is_some() {
+			return;
+		}
+		cursor.db += 1;
+		if cursor.db < GC_DBS.len() {
+			return;
+		}
+		if state.cursor.take().is_some_and(|cursor| cursor.purged > 0) {
+			state.freed += 1;
+		}
+	}
+
+	fn fail_batch(&self, key: &Bytes, err: &str) {
+		error!(
+			"Lazy free of key '{}' error: {}",
+			String::from_utf8_lossy(key),
+			err
+		);
+		self.state.lock().unwrap().cursor = None;
+	}
+
+	/// Lazy free fields of the Stats section of INFO.
+	pub fn stats(&self) -> Vec<(String, String)> {
+		let state = self.state.lock().unwrap();
+		let pending = state.queue.len() + state.cursor.is_some() as usize;
+		vec![
+			("lazyfree_pending_objects".to_string(), pending.to_string()),
+			("lazyfreed_objects".to_string(), state.freed.to_string()),
+			(
+				"lazyfree_purged_records".to_string(),
+				state.purged.to_string(),
+			),
+		]
+	}
+}
+
+/// Queue `key`, which was deleted, overwritten or evicted, to have its
+/// elements freed, unless `lazyfree_lazy_server_del` is off.
+pub fn free(key: &Bytes) {
+	if server_config!(lazyfree_lazy_server_del) {
+		GCTX!(lazyfree).queue(key);
+	}
+}
+
+/// Queue the keys command `name` may have dropped a collection at.
+pub fn after_command(name: &str, args: &[Bytes]) {
+	if !LAZYFREE_CMDS.contains(&name) {
+		return;
+	}
+	for key in acl::command_keys(name, args) {
+		free(key);
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+
+	fn field<'a>(stats: &'a [(String, String)], name: &str) -> &'a str {
+		&stats.iter().find(|(k, _)| k == name).unwrap().1
+	}
+
+	#[test]
+	fn test_key_walks_every_db() {
+		let lazyfree = LazyFree::new();
+		assert_eq!(lazyfree.next_batch(), None);
+
+		let key = Bytes::from("big");
+		assert!(lazyfree.queue(&key));
+		assert!(lazyfree.queue(&key));
+		assert_eq!(field(&lazyfree.stats(), "lazyfree_pending_objects"), "1");
+		assert_eq!(lazyfree.next_batch(), Some((key.clone(), 0, None)));
+
+		// A batch that stops early resumes in the same DB.
+		lazyfree.finish_batch(1000, Some(Bytes::from("k")));
+		assert_eq!(
+			lazyfree.next_batch(),
+			Some((key.clone(), 0, Some(Bytes::from("k"))))
+		);
+		for db in 0..GC_DBS.len() {
+			assert_eq!(lazyfree.next_batch().unwrap().1, db);
+			lazyfree.finish_batch(1, None);
+		}
+
+		let stats = lazyfree.stats();
+		assert_eq!(field(&stats, "lazyfree_pending_objects"), "0");
+		assert_eq!(field(&stats, "lazyfreed_objects"), "1");
+		assert_eq!(field(&stats, "lazyfree_purged_records"), "1006");
+		assert_eq!(lazyfree.next_batch(), None);
+	}
+
+	#[test]
+	fn test_key_without_stale_elements() {
+		let lazyfree = LazyFree::new();
+		lazyfree.queue(&Bytes::from("small"));
+		for _ in 0..GC_DBS.len() {
+			lazyfree.next_batch().unwrap();
+			lazyfree.finish_batch(0, None);
+		}
+		assert_eq!(field(&lazyfree.stats(), "lazyfreed_objects"), "0");
+	}
+
+	#[test]
+	fn test_queue_limit() {
+		let lazyfree = LazyFree::new();
+		for i in 0..LAZYFREE_QUEUE_LIMIT {
+			assert!(lazyfree.queue(&Bytes::from(i.to_string())));
+		}
+		assert!(!lazyfree.queue(&Bytes::from("one more")));
+
+		// A key being freed no longer counts against the limit.
+		lazyfree.next_batch().unwrap();
+		assert!(lazyfree.queue(&Bytes::from("one more")));
+		assert_eq!(
+			field(&lazyfree.stats(), "lazyfree_pending_objects"),
+			(LAZYFREE_QUEUE_LIMIT + 1).to_string()
+		);
+	}
+
+	#[test]
+	fn test_failed_batch_moves_on() {
+		let lazyfree = LazyFree::new();
+		lazyfree.queue(&Bytes::from("a"));
+		lazyfree.queue(&Bytes::from("b"));
+		let (key, _, _) = lazyfree.next_batch().unwrap();
+		lazyfree.fail_batch(&key, "boom");
+		assert_eq!(lazyfree.next_batch().unwrap().0, Bytes::from("b"));
+	}
+}
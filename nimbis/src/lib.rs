@@ -1,7 +1,41 @@
+pub mod access;
+pub mod acl;
+pub mod acllog;
+pub mod bigkeys;
+pub mod bind;
+pub mod blocking;
+#[cfg(feature = "bloom")]
+pub mod bloom;
 pub mod cli;
 pub mod client;
+pub mod client_eviction;
+pub mod cluster;
 pub mod cmd;
+pub mod commandstats;
+pub mod compaction;
 pub mod config;
 pub mod context;
+pub mod disk;
+pub mod expire;
+pub mod extension;
+pub mod function;
+pub mod gc;
+pub mod keyspace;
+pub mod latency;
+pub mod lazyfree;
+pub mod loading;
 pub mod logo;
+pub mod maxmemory;
+pub mod output_buffer;
+pub mod persistence;
+pub mod pubsub;
+pub mod ratelimit;
+pub mod rename;
+pub mod replication;
+pub mod script;
 pub mod server;
+pub mod slowlog;
+pub mod threads;
+pub mod tls;
+pub mod tracking;
+pub mod transaction;
@@ -0,0 +1,233 @@
+//! The loading state, for readiness probes.
+//!
+//! While the server loads a dataset, the RDB file of `--import-rdb` at startup
+//! or the snapshot of its primary on a full resync, commands are refused with
+//! the LOADING error Redis clients retry on, except the few that inspect or
+//! configure the server. PING is refused like the rest, so a PING answered
+//! with PONG tells a probe the server is ready, and one answered with LOADING
+//! that it is alive but still loading.
+//!
+//! A load reports how far it has come through its guard. The progress, with
+//! an estimate of the time left, is logged at most once per
+//! [`PROGRESS_LOG_INTERVAL`] and shown in the Persistence section of INFO,
+//! so a slow load can be told apart from a hung one.
+
+use std::sync::Mutex;
+use std::time::Duration;
+use std::time::Instant;
+use std::time::SystemTime;
+use std::time::UNIX_EPOCH;
+
+use log::info;
+use nimbis_storage::storage_snapshot::LoadProgress;
+
+use crate::GCTX;
+
+pub const LOADING: &str = "LOADING Nimbis is loading the dataset in memory";
+/// Commands served while loading, like the `loading` flag of Redis commands.
+const LOADING_CMDS: &[&str] = &[
+	"ACL", "AUTH", "CLIENT", "CONFIG", "HELLO", "INFO", "LATENCY", "RESET", "ROLE", "SLOWLOG",
+];
+/// How often the progress of a load is logged.
+const PROGRESS_LOG_INTERVAL: Duration = Duration::from_secs(1);
+
+/// Refuse command `name` while a dataset is loading.
+pub fn check(name: &str) -> Result<(), String> {
+	if GCTX!(loading).is_loading() && !LOADING_CMDS.contains(&name) {
+		return Err(LOADING.to_string());
+	}
+	Ok(())
+}
+
+/// Mark the server as loading until the returned guard is dropped.
+pub fn begin() -> LoadingGuard {
+	GCTX!(loading).begin();
+	LoadingGuard(())
+}
+
+/// Ends the load started by [`begin`] when dropped, whether the load
+/// succeeded or not.
+#[must_use]
+pub struct LoadingGuard(());
+
+impl LoadingGuard {
+	/// Record how far the load has come.
+	pub fn progress(&self, progress: LoadProgress) {
+		GCTX!(loading).progress(progress);
+	}
+}
+
+impl Drop for LoadingGuard {
+	fn drop(&mut self) {
+		GCTX!(loading).end();
+	}
+}
+
+#[derive(Debug, Default)]
+struct LoadingState {
+	/// Loads in progress.
+	loads: usize,
+	/// When the first of them started, in unix seconds.
+	started: i64,
+	/// When the first of them started, for the time left.
+	clock: Option<Instant>,
+	/// The last progress reported.
+	progress: Option<LoadProgress>,
+	/// When the progress was last logged.
+	logged: Option<Instant>,
+}
+
+impl LoadingState {
+	/// Loaded percentage and estimated time left, once anything is loaded.
+	fn estimate(&self) -> Option<(f64, Duration)> {
+		let progress = self.progress.filter(|p| p.loaded > 0 && p.total > 0)?;
+		let elapsed = self.clock?.elapsed();
+		let left = progress.total.saturating_sub(progress.loaded);
+		Some((
+			progress.loaded as f64 * 100.0 / progress.total as f64,
+			elapsed.mul_f64(left as f64 / progress.loaded as f64),
+		))
+	}
+}
+
+#[derive(Debug, Default)]
+pub struct Loading {
+	state: Mutex<LoadingState>,
+}
+
+impl Loading {
+	pub fn new() -> Self {
+		Self::default()
+	}
+
+	fn begin(&self) {
+		let mut state = self.state.lock().unwrap();
+		if state.loads == 0 {
+			state.started = SystemTime::now()
+				.duration_since(UNIX_EPOCH)
+				.map_or(0, |d| d.as_secs() as i64);
+			state.clock = Some(Instant::now());
+			state.progress = None;
+			state.logged = None;
+		}
+		state.loads += 1;
+	}
+
+	fn progress(&self, progress: LoadProgress) {
+		let mut state = self.state.lock().unwrap();
+		state.progress = Some(progress);
+		if state
+			.logged
+			.is_some_and(|logged| logged.elapsed() < PROGRESS_LOG_INTERVAL)
+		{
+			return;
+		}
+		state.logged = Some(Instant::now());
+		if let Some((perc, eta)) = state.estimate() {
+			info!(
+				"Loading the dataset: {:.2}% ({}/{} entries), ETA {}s",
+				perc,
+				progress.loaded,
+				progress.total,
+				eta.as_secs()
+			);
+		}
+	}
+
+	fn end(&self) {
+		let mut state = self.state.lock().unwrap();
+		state.loads = state.loads.saturating_sub(1);
+	}
+
+	pub fn is_loading(&self) -> bool {
+		self.state.lock().unwrap().loads > 0
+	}
+
+	/// The loading fields of the Persistence section of INFO.
+	pub fn info(&self) -> Vec<(String, String)> {
+		let state = self.state.lock().unwrap();
+		let mut fields = vec![("loading".to_string(), ((state.loads > 0) as u8).to_string())];
+		if state.loads == 0 {
+			return fields;
+		}
+		fields.push(("loading_start_time".to_string(), state.started.to_string()));
+		let progress = state.progress.unwrap_or(LoadProgress {
+			loaded: 0,
+			total: 0,
+		});
+		fields.push((
+			"loading_loaded_entries".to_string(),
+			progress.loaded.to_string(),
+		));
+		fields.push((
+			"loading_total_entries".to_string(),
+			progress.total.to_string(),
+		));
+		let (perc, eta) = state.estimate().unwrap_or((0.0, Duration::ZERO));
+		fields.push(("loading_loaded_perc".to_string(), format!("{:.2}", perc)));
+		fields.push(("loading_eta_seconds".to_string(), eta.as_secs().to_string()));
+		fields
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+
+	#[test]
+	fn test_nested_loads() {
+		let loading = Loading::new();
+		assert!(!loading.is_loading());
+		assert_eq!(
+			loading.info(),
+			vec![("loading".to_string(), "0".to_string())]
+		);
+
+		loading.begin();
+		loading.begin();
+		loading.end();
+		assert!(loading.is_loading());
+		let info = loading.info();
+		assert_eq!(info[0], ("loading".to_string(), "1".to_string()));
+		assert_eq!(info[1].0, "loading_start_time");
+		assert_eq!(
+			info[2..],
+			[
+				("loading_loaded_entries".to_string(), "0".to_string()),
+				("loading_total_entries".to_string(), "0".to_string()),
+				("loading_loaded_perc".to_string(), "0.00".to_string()),
+				("loading_eta_seconds".to_string(), "0".to_string()),
+			]
+		);
+
+		loading.end();
+		assert!(!loading.is_loading());
+	}
+
+	#[test]
+	fn test_progress() {
+		let loading = Loading::new();
+		loading.begin();
+		loading.progress(LoadProgress {
+			loaded: 250,
+			total: 1000,
+		});
+		let info = loading.info();
+		assert_eq!(
+			info[2..4],
+			[
+				("loading_loaded_entries".to_string(), "250".to_string()),
+				("loading_total_entries".to_string(), "1000".to_string()),
+			]
+		);
+		assert_eq!(
+			info[4],
+			("loading_loaded_perc".to_string(), "25.00".to_string())
+		);
+
+		let mut state = loading.state.lock().unwrap();
+		state.clock = Instant::now().checked_sub(Duration::from_secs(10));
+		let (_, eta) = state.estimate().unwrap();
+		assert!((29..=31).contains(&eta.as_secs()));
+	}
+}
@@ -7,6 +7,7 @@ use nimbis_telemetry::manager::TELEMETRY_MANAGER;
 
 fn main() -> Result<(), Box<dyn std::error::Error + Send + Sync>> {
 	let args = Cli::parse();
+	let import_rdb = args.import_rdb.clone();
 
 	if let Err(e) = nimbis::config::setup(args) {
 		log::error!("Failed to load configuration: {}", e);
@@ -22,7 +23,10 @@ fn main() -> Result<(), Box<dyn std::error::Error + Send + Sync>> {
 		.build()?;
 
 	let result = runtime.block_on(async {
-		let server = Server::new().await?;
+		let mut server = Server::new().await?;
+		if let Some(path) = import_rdb {
+			server.import_rdb(path);
+		}
 		tokio::select! {
 			result = server.run() => result,
 			signal = tokio::signal::ctrl_c() => {
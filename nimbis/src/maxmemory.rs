@@ -0,0 +1,137 @@
+//! The `maxmemory` limit.
+//!
+//! Keys live in the storage engine, so the memory of the server is its
+//! memtables, caches and client buffers rather than the dataset. The resident
+//! set size of the process is sampled every 100 milliseconds. Once it reaches
+//! `maxmemory`, write commands are refused with an OOM error, like the
+//! `noeviction` policy of Redis, while reads, and the deletes that let memory
+//! be freed, are still served. A limit of 0, or a platform whose resident set
+//! size cannot be read, never refuses anything.
+
+use std::sync::atomic::AtomicBool;
+use std::sync::atomic::AtomicU64;
+use std::sync::atomic::Ordering;
+use std::time::Duration;
+
+use log::info;
+use log::warn;
+
+use crate::GCTX;
+use crate::server_config;
+
+const MEMORY_CHECK_INTERVAL: Duration = Duration::from_millis(100);
+const MAXMEMORY_REACHED: &str = "OOM command not allowed when used memory > 'maxmemory'.";
+/// Write commands still allowed over the limit, because deleting keys
+/// is how memory is freed.
+const FREEING_CMDS: &[&str] = &["DEL", "FLUSHDB"];
+
+/// Sample the resident set size of the process for the lifetime of the
+/// server.
+pub fn start_memory_monitor() {
+	tokio::spawn(async move {
+		let mut interval = tokio::time::interval(MEMORY_CHECK_INTERVAL);
+		loop {
+			interval.tick().await;
+			if let Some(rss) = resident_set_size() {
+				GCTX!(maxmemory).update(rss, server_config!(maxmemory));
+			}
+		}
+	});
+}
+
+/// Refuse write command `name` while the server uses more than `maxmemory`.
+pub fn check_write(name: &str) -> Result<(), String> {
+	if !GCTX!(cmd_table).is_write(name) || FREEING_CMDS.contains(&name) {
+		return Ok(());
+	}
+	if GCTX!(maxmemory).reached(server_config!(maxmemory)) {
+		return Err(MAXMEMORY_REACHED.to_string());
+	}
+	Ok(())
+}
+
+/// The resident set size of the process in bytes, from `/proc`.
+fn resident_set_size() -> Option<u64> {
+	let status = std::fs::read_to_string("/proc/self/status").ok()?;
+	let line = status.lines().find(|line| line.starts_with("VmRSS:"))?;
+	let kb = line.split_whitespace().nth(1)?.parse::<u64>().ok()?;
+	Some(kb * 1024)
+}
+
+#[derive(Debug, Default)]
+pub struct MaxMemory {
+	rss: AtomicU64,
+	/// Whether the last sample was over the limit, so each change is logged
+	/// once.
+	over: AtomicBool,
+}
+
+impl MaxMemory {
+	pub fn new() -> Self {
+		Self::default()
+	}
+
+	/// Whether the last sample reached `limit`, checked against the limit in
+	/// effect now so a CONFIG SET takes effect right away.
+	fn reached(&self, limit: usize) -> bool {
+		limit > 0 && self.rss.load(Ordering::Relaxed) >= limit as u64
+	}
+
+	fn update(&self, rss: u64, limit: usize) {
+		self.rss.store(rss, Ordering::Relaxed);
+		let over = self.reached(limit);
+		if self.over.swap(over, Ordering::Relaxed) == over {
+			return;
+		}
+		if over {
+			warn!(
+				"Used memory {} bytes reached maxmemory {}: write commands are disabled",
+				rss, limit
+			);
+		} else {
+			info!("Used memory is back to {} bytes", rss);
+		}
+	}
+
+	/// The limit fields of the Memory section of INFO.
+	pub fn info(&self) -> Vec<(String, String)> {
+		vec![
+			(
+				"used_memory_rss".to_string(),
+				self.rss.load(Ordering::Relaxed).to_string(),
+			),
+			(
+				"maxmemory".to_string(),
+				server_config!(maxmemory).to_string(),
+			),
+			("maxmemory_policy".to_string(), "noeviction".to_string()),
+		]
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+
+	#[test]
+	fn test_limit() {
+		let memory = MaxMemory::new();
+		assert!(!memory.reached(1));
+
+		memory.update(1000, 1000);
+		assert!(memory.reached(1000));
+		assert!(memory.over.load(Ordering::Relaxed));
+		assert!(!memory.reached(1001));
+		assert!(!memory.reached(0));
+
+		memory.update(999, 1000);
+		assert!(!memory.reached(1000));
+		assert!(!memory.over.load(Ordering::Relaxed));
+	}
+
+	#[cfg(target_os = "linux")]
+	#[test]
+	fn test_resident_set_size() {
+		assert!(resident_set_size().unwrap() > 0);
+	}
+}
@@ -0,0 +1,482 @@
+//! Client output buffer limits.
+//!
+//! Each connection owns an [`OutputBuffer`] that accounts for what is
+//! queued for it and not yet written to its socket: the replies to its own
+//! commands, pub/sub messages and tracking invalidations queued by other
+//! clients, and for a replica the replication stream. A client that stops
+//! reading lets these pile up, so once its queue passes the hard limit of
+//! the client's class, or stays above the soft limit for longer than the
+//! configured number of seconds, the client is closed instead of letting
+//! its queue grow without bound.
+
+use std::fmt;
+use std::str::FromStr;
+use std::sync::Arc;
+use std::sync::Mutex;
+use std::sync::atomic::AtomicBool;
+use std::sync::atomic::AtomicUsize;
+use std::sync::atomic::Ordering;
+use std::time::Duration;
+use std::time::Instant;
+
+use log::warn;
+use serde::Deserialize;
+use serde::Serialize;
+use tokio::sync::Notify;
+use tokio::sync::mpsc;
+
+use crate::server_config;
+
+/// The classes clients are grouped into for output buffer limits.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum ClientClass {
+	Normal,
+	Pubsub,
+	Replica,
+}
+
+impl ClientClass {
+	fn name(self) -> &'static str {
+		match self {
+			ClientClass::Normal => "normal",
+			ClientClass::Pubsub => "pubsub",
+			ClientClass::Replica => "replica",
+		}
+	}
+}
+
+impl FromStr for ClientClass {
+	type Err = String;
+
+	fn from_str(s: &str) -> Result<Self, Self::Err> {
+		match s.to_ascii_lowercase().as_str() {
+			"normal" => Ok(ClientClass::Normal),
+			"pubsub" => Ok(ClientClass::Pubsub),
+			// "slave" is the historical name Redis still accepts.
+			"replica" | "slave" => Ok(ClientClass::Replica),
+			_ => Err(format!("Invalid client class: {}", s)),
+		}
+	}
+}
+
+/// Limits of one client class, in bytes. Zero disables a limit.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Default)]
+pub struct OutputBufferLimit {
+	pub hard: usize,
+	pub soft: usize,
+	pub soft_seconds: u64,
+}
+
+impl OutputBufferLimit {
+	const fn new(hard: usize, soft: usize, soft_seconds: u64) -> Self {
+		Self {
+			hard,
+			soft,
+			soft_seconds,
+		}
+	}
+}
+
+/// The `client_output_buffer_limit` setting, written like the Redis
+/// directive: `<class> <hard> <soft> <soft seconds>` repeated per class,
+/// with sizes in bytes or with a k, kb, m, mb, g or gb suffix. Classes
+/// left out keep their defaults.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Deserialize, Serialize)]
+#[serde(try_from = "String", into = "String")]
+pub struct ClientOutputBufferLimits {
+	pub normal: OutputBufferLimit,
+	pub pubsub: OutputBufferLimit,
+	pub replica: OutputBufferLimit,
+}
+
+impl ClientOutputBufferLimits {
+	pub fn get(&self, class: ClientClass) -> OutputBufferLimit {
+		match class {
+			ClientClass::Normal => self.normal,
+			ClientClass::Pubsub => self.pubsub,
+			ClientClass::Replica => self.replica,
+		}
+	}
+
+	fn get_mut(&mut self, class: ClientClass) -> &mut OutputBufferLimit {
+		match class {
+			ClientClass::Normal => &mut self.normal,
+			ClientClass::Pubsub => &mut self.pubsub,
+			ClientClass::Replica => &mut self.replica,
+		}
+	}
+}
+
+impl Default for ClientOutputBufferLimits {
+	fn default() -> Self {
+		Self {
+			normal: OutputBufferLimit::new(0, 0, 0),
+			pubsub: OutputBufferLimit::new(32 << 20, 8 << 20, 60),
+			replica: OutputBufferLimit::new(256 << 20, 64 << 20, 60),
+		}
+	}
+}
+
+/// Parse a size such as `1024`, `8mb` or `1g`.
+fn parse_memory(s: &str) -> Result<usize, String> {
+	let lower = s.to_ascii_lowercase();
+	let (digits, unit) = match lower.find(|c: char| !c.is_ascii_digit()) {
+		Some(index) => lower.split_at(index),
+		None => (lower.as_str(), ""),
+	};
+	let multiplier: usize = match unit {
+		"" | "b" => 1,
+		"k" => 1000,
+		"kb" => 1 << 10,
+		"m" => 1000 * 1000,
+		"mb" => 1 << 20,
+		"g" => 1000 * 1000 * 1000,
+		"gb" => 1 << 30,
+		_ => return Err(format!("Invalid memory size: {}", s)),
+	};
+	digits
+		.parse::<usize>()
+		.ok()
+		.and_then(|n| n.checked_mul(multiplier))
+		.ok_or_else(|| format!("Invalid memory size: {}", s))
+}
+
+impl FromStr for ClientOutputBufferLimits {
+	type Err = String;
+
+	fn from_str(s: &str) -> Result<Self, Self::Err> {
+		let tokens = s.split_whitespace().collect::<Vec<_>>();
+		if tokens.len() % 4 != 0 {
+			return Err("Wrong number of arguments in buffer limit configuration.".to_string());
+		}
+
+		let mut limits = Self::default();
+		for chunk in tokens.chunks(4) {
+			let class = chunk[0].parse::<ClientClass>()?;
+			let hard = parse_memory(chunk[1])?;
+			let soft = parse_memory(chunk[2])?;
+			let soft_seconds = chunk[3]
+				.parse::<u64>()
+				.map_err(|_| format!("Invalid soft limit seconds: {}", chunk[3]))?;
+			*limits.get_mut(class) = OutputBufferLimit::new(hard, soft, soft_seconds);
+		}
+		Ok(limits)
+	}
+}
+
+impl TryFrom<String> for ClientOutputBufferLimits {
+	type Error = String;
+
+	fn try_from(value: String) -> Result<Self, Self::Error> {
+		value.parse()
+	}
+}
+
+impl From<ClientOutputBufferLimits> for String {
+	fn from(limits: ClientOutputBufferLimits) -> Self {
+		limits.to_string()
+	}
+}
+
+impl fmt::Display for ClientOutputBufferLimits {
+	fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+		let classes = [
+			ClientClass::Normal,
+			ClientClass::Replica,
+			ClientClass::Pubsub,
+		];
+		for (i, class) in classes.into_iter().enumerate() {
+			let limit = self.get(class);
+			if i > 0 {
+				f.write_str(" ")?;
+			}
+			write!(
+				f,
+				"{} {} {} {}",
+				class.name(),
+				limit.hard,
+				limit.soft,
+				limit.soft_seconds
+			)?;
+		}
+		Ok(())
+	}
+}
+
+/// Accounts for the bytes queued for one connection and closes it once the
+/// queue breaks the limits of the client's class.
+#[derive(Debug, Default)]
+pub struct OutputBuffer {
+	pending: AtomicUsize,
+	pubsub: AtomicBool,
+	replica: AtomicBool,
+	soft_exceeded_since: Mutex<Option<Instant>>,
+	closed: AtomicBool,
+	notify: Notify,
+}
+
+impl OutputBuffer {
+	pub fn new() -> Self {
+		Self::default()
+	}
+
+	/// Mark whether the client has subscriptions, which puts it in the
+	/// pubsub class.
+	pub fn set_pubsub(&self, pubsub: bool) {
+		self.pubsub.store(pubsub, Ordering::Relaxed);
+	}
+
+	/// Mark the client as a replica, which it stays until it disconnects.
+	pub fn set_replica(&self) {
+		self.replica.store(true, Ordering::Relaxed);
+	}
+
+	pub fn class(&self) -> ClientClass {
+		if self.replica.load(Ordering::Relaxed) {
+			ClientClass::Replica
+		} else if self.pubsub.load(Ordering::Relaxed) {
+			ClientClass::Pubsub
+		} else {
+			ClientClass::Normal
+		}
+	}
+
+	/// Bytes queued and not yet written to the socket.
+	pub fn pending(&self) -> usize {
+		self.pending.load(Ordering::Relaxed)
+	}
+
+	/// Account for `size` more bytes queued for the client, checking the
+	/// limits of its class. Returns false, and closes the client, if the
+	/// message must be dropped.
+	pub fn reserve(&self, size: usize) -> bool {
+		let limits = server_config!(client_output_buffer_limit);
+		self.reserve_with(size, limits.get(self.class()), Instant::now())
+	}
+
+	/// Check the limits against what is queued now, so a client whose queue
+	/// stays above the soft limit is closed even if nothing more is queued.
+	/// Returns false if the client is closed.
+	pub fn check(&self) -> bool {
+		self.reserve(0)
+	}
+
+	/// Account for `size` bytes written out to the socket.
+	pub fn release(&self, size: usize) {
+		let _ = self
+			.pending
+			.fetch_update(Ordering::Relaxed, Ordering::Relaxed, |pending| {
+				Some(pending.saturating_sub(size))
+			});
+	}
+
+	pub fn is_closed(&self) -> bool {
+		self.closed.load(Ordering::Relaxed)
+	}
+
+	/// Wait until the client is closed for breaking its limits.
+	pub async fn closed(&self) {
+		loop {
+			let notified = self.notify.notified();
+			if self.is_closed() {
+				return;
+			}
+			notified.await;
+		}
+	}
+
+	/// Close the client to free its memory, as `maxmemory_clients` asks.
+	pub fn evict(&self) {
+		self.close();
+	}
+
+	fn reserve_with(&self, size: usize, limit: OutputBufferLimit, now: Instant) -> bool {
+		if self.is_closed() {
+			return false;
+		}
+
+		let pending = self.pending.fetch_add(size, Ordering::Relaxed) + size;
+		let hard_reached = limit.hard > 0 && pending >= limit.hard;
+		let soft_reached = limit.soft > 0 && pending >= limit.soft && {
+			let mut since = self.soft_exceeded_since.lock().unwrap();
+			let since = *since.get_or_insert(now);
+			now.duration_since(since) > Duration::from_secs(limit.soft_seconds)
+		};
+		if limit.soft == 0 || pending < limit.soft {
+			*self.soft_exceeded_since.lock().unwrap() = None;
+		}
+
+		if hard_reached || soft_reached {
+			self.release(size);
+			self.close();
+			warn!(
+				"Client scheduled to be closed for overcoming of output buffer limits (class {}, {} bytes pending)",
+				self.class().name(),
+				pending
+			);
+			return false;
+		}
+		true
+	}
+
+	fn close(&self) {
+		self.closed.store(true, Ordering::Relaxed);
+		self.notify.notify_waiters();
+	}
+}
+
+/// A sending half of a connection's queue that accounts every message in
+/// the connection's [`OutputBuffer`].
+#[derive(Debug)]
+pub struct Outbox<T> {
+	sender: mpsc::UnboundedSender<T>,
+	buffer: Arc<OutputBuffer>,
+}
+
+impl<T> Outbox<T> {
+	pub fn new(sender: mpsc::UnboundedSender<T>, buffer: Arc<OutputBuffer>) -> Self {
+		Self { sender, buffer }
+	}
+
+	/// Queue `message`, accounted as `size` bytes. Returns false if the
+	/// connection is gone or the message broke its limits.
+	pub fn send(&self, message: T, size: usize) -> bool {
+		self.buffer.reserve(size) && self.sender.send(message).is_ok()
+	}
+}
+
+impl<T> Clone for Outbox<T> {
+	fn clone(&self) -> Self {
+		Self {
+			sender: self.sender.clone(),
+			buffer: self.buffer.clone(),
+		}
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+
+	#[test]
+	fn test_parse_limits() {
+		let limits = "pubsub 1mb 512kb 10 normal 0 0 0"
+			.parse::<ClientOutputBufferLimits>()
+			.unwrap();
+		assert_eq!(
+			limits.pubsub,
+			OutputBufferLimit::new(1 << 20, 512 << 10, 10)
+		);
+		assert_eq!(limits.normal, OutputBufferLimit::new(0, 0, 0));
+		assert_eq!(limits.replica, ClientOutputBufferLimits::default().replica);
+
+		let limits = "slave 1k 1 0".parse::<ClientOutputBufferLimits>().unwrap();
+		assert_eq!(limits.replica, OutputBufferLimit::new(1000, 1, 0));
+
+		assert!(
+			"pubsub 1mb 512kb"
+				.parse::<ClientOutputBufferLimits>()
+				.is_err()
+		);
+		assert!("master 1 1 1".parse::<ClientOutputBufferLimits>().is_err());
+		assert!(
+			"pubsub 1tb 1 1"
+				.parse::<ClientOutputBufferLimits>()
+				.is_err()
+		);
+		assert!("pubsub 1 1 -1".parse::<ClientOutputBufferLimits>().is_err());
+	}
+
+	#[test]
+	fn test_limits_round_trip() {
+		let limits = ClientOutputBufferLimits::default();
+		assert_eq!(
+			limits.to_string(),
+			"normal 0 0 0 replica 268435456 67108864 60 pubsub 33554432 8388608 60"
+		);
+		assert_eq!(
+			limits
+				.to_string()
+				.parse::<ClientOutputBufferLimits>()
+				.unwrap(),
+			limits
+		);
+	}
+
+	#[test]
+	fn test_hard_limit_closes_client() {
+		let buffer = OutputBuffer::new();
+		let limit = OutputBufferLimit::new(100, 0, 0);
+		let now = Instant::now();
+
+		assert!(buffer.reserve_with(60, limit, now));
+		buffer.release(60);
+		assert!(buffer.reserve_with(60, limit, now));
+		assert!(!buffer.is_closed());
+		assert!(!buffer.reserve_with(60, limit, now));
+		assert!(buffer.is_closed());
+		assert_eq!(buffer.pending(), 60);
+		assert!(!buffer.reserve_with(1, limit, now));
+	}
+
+	#[test]
+	fn test_soft_limit_needs_to_persist() {
+		let buffer = OutputBuffer::new();
+		let limit = OutputBufferLimit::new(0, 100, 10);
+		let start = Instant::now();
+
+		assert!(buffer.reserve_with(150, limit, start));
+		assert!(buffer.reserve_with(1, limit, start + Duration::from_secs(5)));
+
+		// Draining below the soft limit restarts the clock.
+		buffer.release(151);
+		assert!(buffer.reserve_with(1, limit, start + Duration::from_secs(6)));
+		assert!(buffer.reserve_with(150, limit, start + Duration::from_secs(12)));
+		assert!(buffer.reserve_with(1, limit, start + Duration::from_secs(20)));
+		assert!(!buffer.reserve_with(1, limit, start + Duration::from_secs(23)));
+	}
+
+	#[test]
+	fn test_check_without_new_output() {
+		let buffer = OutputBuffer::new();
+		let limit = OutputBufferLimit::new(0, 100, 10);
+		let start = Instant::now();
+
+		assert!(buffer.reserve_with(150, limit, start));
+		assert!(buffer.reserve_with(0, limit, start + Duration::from_secs(10)));
+		assert!(!buffer.reserve_with(0, limit, start + Duration::from_secs(11)));
+		assert!(buffer.is_closed());
+	}
+
+	#[test]
+	fn test_replica_class() {
+		let buffer = OutputBuffer::new();
+		assert_eq!(buffer.class(), ClientClass::Normal);
+		buffer.set_pubsub(true);
+		assert_eq!(buffer.class(), ClientClass::Pubsub);
+		buffer.set_replica();
+		assert_eq!(buffer.class(), ClientClass::Replica);
+	}
+
+	#[test]
+	fn test_zero_disables_limits() {
+		let buffer = OutputBuffer::new();
+		let limit = OutputBufferLimit::default();
+		let now = Instant::now();
+
+		assert!(buffer.reserve_with(usize::MAX / 2, limit, now));
+		assert!(!buffer.is_closed());
+	}
+
+	#[tokio::test]
+	async fn test_closed_wakes_waiters() {
+		let buffer = Arc::new(OutputBuffer::new());
+		let waiter = tokio::spawn({
+			let buffer = buffer.clone();
+			async move { buffer.closed().await }
+		});
+		tokio::task::yield_now().await;
+		assert!(!buffer.reserve_with(2, OutputBufferLimit::new(1, 0, 0), Instant::now()));
+		waiter.await.unwrap();
+	}
+}
@@ -0,0 +1,701 @@
+//! Snapshots of the dataset taken by SAVE and BGSAVE, and the durability of
+//! individual writes.
+//!
+//! Both copy a point-in-time view of the dataset, then write the copy as
+//! the store's snapshot; BGSAVE does so in a background task. The time of
+//! the last successful save and the state of background saves are reported
+//! by LASTSAVE and the Persistence section of INFO.
+//!
+//! Every successful write command counts as one change. When the `save`
+//! schedule is set, a background save starts once any of its points has
+//! both its number of seconds since the last save and its number of changes.
+//!
+//! Every write reaches the storage write-ahead log, which the engine uploads
+//! to the object store on its own flush interval. With `appendonly yes`,
+//! `appendfsync` adds to that: `always` flushes the log before each write
+//! command is answered, and `everysec` flushes it once a second while there
+//! are writes. `appendfsync no`, like `appendonly no`, leaves the log to the
+//! engine. Whatever the policy, WAITAOF flushes the log for a client that
+//! needs its latest writes to be durable. BGREWRITEAOF moves what the log holds
+//! into sorted tables in a background task, so the log can be reclaimed without
+//! waiting for the engine to fill its memtables.
+
+use std::fmt;
+use std::str::FromStr;
+use std::sync::Arc;
+use std::sync::Mutex;
+use std::sync::atomic::AtomicBool;
+use std::sync::atomic::AtomicU64;
+use std::sync::atomic::Ordering;
+use std::time::Duration;
+use std::time::Instant;
+
+use log::error;
+use log::info;
+use nimbis_storage::Storage;
+use nimbis_storage::error::StorageError;
+use serde::Deserialize;
+use serde::Serialize;
+
+use crate::GCTX;
+use crate::latency::LatencyEvent;
+use crate::server_config;
+
+const BGSAVE_IN_PROGRESS: &str = "ERR Background save already in progress";
+const REWRITE_IN_PROGRESS: &str = "ERR Background append only file rewriting already in progress";
+/// How often the `save` schedule is checked.
+const SCHEDULE_INTERVAL: Duration = Duration::from_millis(100);
+/// Wait before a scheduled save retries after a failed one, as in Redis.
+const BGSAVE_RETRY_DELAY: Duration = Duration::from_secs(5);
+/// How often `appendfsync everysec` flushes the write-ahead log.
+const EVERYSEC_INTERVAL: Duration = Duration::from_secs(1);
+
+/// The `appendonly` setting, `yes` or `no` as in Redis.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Deserialize, Serialize)]
+#[serde(try_from = "String", into = "String")]
+pub struct AppendOnly(pub bool);
+
+impl FromStr for AppendOnly {
+	type Err = String;
+
+	fn from_str(s: &str) -> Result<Self, Self::Err> {
+		match s.to_ascii_lowercase().as_str() {
+			"yes" => Ok(AppendOnly(true)),
+			"no" => Ok(AppendOnly(false)),
+			_ => Err(format!("Invalid appendonly value: {}", s)),
+		}
+	}
+}
+
+impl TryFrom<String> for AppendOnly {
+	type Error = String;
+
+	fn try_from(value: String) -> Result<Self, Self::Error> {
+		value.parse()
+	}
+}
+
+impl From<AppendOnly> for String {
+	fn from(value: AppendOnly) -> Self {
+		value.to_string()
+	}
+}
+
+impl fmt::Display for AppendOnly {
+	fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+		f.write_str(if self.0 { "yes" } else { "no" })
+	}
+}
+
+/// The `appendfsync` setting: when writes are made durable with
+/// `appendonly yes`.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Deserialize, Serialize)]
+#[serde(try_from = "String", into = "String")]
+pub enum AppendFsync {
+	/// Before each write command is answered.
+	Always,
+	/// Once a second.
+	#[default]
+	EverySec,
+	/// When the storage engine flushes its write-ahead log.
+	No,
+}
+
+impl FromStr for AppendFsync {
+	type Err = String;
+
+	fn from_str(s: &str) -> Result<Self, Self::Err> {
+		match s.to_ascii_lowercase().as_str() {
+			"always" => Ok(AppendFsync::Always),
+			"everysec" => Ok(AppendFsync::EverySec),
+			"no" => Ok(AppendFsync::No),
+			_ => Err(format!("Invalid appendfsync value: {}", s)),
+		}
+	}
+}
+
+impl TryFrom<String> for AppendFsync {
+	type Error = String;
+
+	fn try_from(value: String) -> Result<Self, Self::Error> {
+		value.parse()
+	}
+}
+
+impl From<AppendFsync> for String {
+	fn from(value: AppendFsync) -> Self {
+		value.to_string()
+	}
+}
+
+impl fmt::Display for AppendFsync {
+	fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+		f.write_str(match self {
+			AppendFsync::Always => "always",
+			AppendFsync::EverySec => "everysec",
+			AppendFsync::No => "no",
+		})
+	}
+}
+
+/// The `appendfsync` policy in effect, or `None` with `appendonly no`.
+fn fsync_policy() -> Option<AppendFsync> {
+	server_config!(appendonly)
+		.0
+		.then(|| server_config!(appendfsync))
+}
+
+/// Save after `seconds` have passed since the last save if there were at
+/// least `changes` changes.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct SavePoint {
+	pub seconds: u64,
+	pub changes: u64,
+}
+
+/// The `save` setting, written like the Redis directive: `<seconds>
+/// <changes>` pairs, or an empty string to only save on request.
+#[derive(Debug, Clone, Default, PartialEq, Eq, Deserialize, Serialize)]
+#[serde(try_from = "String", into = "String")]
+pub struct SaveSchedule(pub Vec<SavePoint>);
+
+impl SaveSchedule {
+	/// Whether `changes` changes in `elapsed` since the last save call for
+	/// a save.
+	pub fn is_due(&self, changes: u64, elapsed: Duration) -> bool {
+		self.0
+			.iter()
+			.any(|point| changes >= point.changes && elapsed.as_secs() >= point.seconds)
+	}
+}
+
+impl FromStr for SaveSchedule {
+	type Err = String;
+
+	fn from_str(s: &str) -> Result<Self, Self::Err> {
+		let tokens = s.split_whitespace().collect::<Vec<_>>();
+		if tokens.len() % 2 != 0 {
+			return Err("Invalid save parameters".to_string());
+		}
+		tokens
+			.chunks(2)
+			.map(|pair| {
+				let parse = |token: &str| {
+					token
+						.parse::<u64>()
+						.map_err(|_| "Invalid save parameters".to_string())
+				};
+				Ok(SavePoint {
+					seconds: parse(pair[0])?,
+					changes: parse(pair[1])?,
+				})
+			})
+			.collect::<Result<Vec<_>, _>>()
+			.map(Self)
+	}
+}
+
+impl TryFrom<String> for SaveSchedule {
+	type Error = String;
+
+	fn try_from(value: String) -> Result<Self, Self::Error> {
+		value.parse()
+	}
+}
+
+impl From<SaveSchedule> for String {
+	fn from(schedule: SaveSchedule) -> Self {
+		schedule.to_string()
+	}
+}
+
+impl fmt::Display for SaveSchedule {
+	fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+		for (i, point) in self.0.iter().enumerate() {
+			if i > 0 {
+				f.write_str(" ")?;
+			}
+			write!(f, "{} {}", point.seconds, point.changes)?;
+		}
+		Ok(())
+	}
+}
+
+/// Count a successful command towards the changes since the last save.
+pub fn after_command(name: &str) {
+	if GCTX!(cmd_table).is_write(name) {
+		let persistence = GCTX!(persistence);
+		persistence.changes.fetch_add(1, Ordering::Relaxed);
+		persistence.unsynced.store(true, Ordering::Relaxed);
+	}
+}
+
+/// Whether, with `appendfsync always`, the writes of a successful `name`
+/// must be made durable before it is answered.
+pub fn needs_sync(name: &str) -> bool {
+	fsync_policy() == Some(AppendFsync::Always) && GCTX!(cmd_table).is_write(name)
+}
+
+/// Make the writes of every command that needed it durable at once, so a
+/// pipeline of writes under `appendfsync always` costs a single flush of
+/// the write-ahead log. Only the flush is coalesced: each command has
+/// committed its writes to the storage engine on its own.
+pub async fn sync_writes(storage: &Storage) -> Result<(), String> {
+	GCTX!(persistence).sync(storage).await
+}
+
+/// Flush the write-ahead log once a second for the lifetime of the server
+/// while `appendfsync everysec` is in effect and there were writes.
+pub fn start_everysec(storage: Storage) {
+	tokio::spawn(async move {
+		let mut interval = tokio::time::interval(EVERYSEC_INTERVAL);
+		loop {
+			interval.tick().await;
+			let persistence = GCTX!(persistence);
+			if fsync_policy() == Some(AppendFsync::EverySec)
+				&& persistence.unsynced.load(Ordering::Relaxed)
+			{
+				// The error is logged and reported by INFO persistence.
+				let _ = persistence.sync(&storage).await;
+			}
+		}
+	});
+}
+
+/// Check the `save` schedule for the lifetime of the server, starting
+/// background saves of `storage` when it calls for one.
+pub fn start_schedule(storage: Storage) {
+	tokio::spawn(async move {
+		let mut interval = tokio::time::interval(SCHEDULE_INTERVAL);
+		loop {
+			interval.tick().await;
+			let persistence = GCTX!(persistence);
+			if persistence.is_save_due(&server_config!(save))
+				&& persistence.bgsave(storage.clone()).is_ok()
+			{
+				info!("Background saving started by the save schedule");
+			}
+		}
+	});
+}
+
+#[derive(Debug)]
+struct PersistenceState {
+	/// Unix time in seconds of the last successful save. The dataset is
+	/// considered saved when the server starts, as in Redis.
+	last_save: i64,
+	/// When the last save succeeded, to measure the schedule against.
+	last_save_at: Instant,
+	bgsave_started: Option<Instant>,
+	/// Changes counted when the running background save started; they are
+	/// in its snapshot.
+	bgsave_changes: u64,
+	last_bgsave_ok: bool,
+	last_bgsave_secs: Option<u64>,
+	last_bgsave_at: Option<Instant>,
+	rewrite_started: Option<Instant>,
+	last_rewrite_ok: bool,
+	last_rewrite_secs: Option<u64>,
+}
+
+#[derive(Debug)]
+pub struct Persistence {
+	state: Mutex<PersistenceState>,
+	/// Changes since the last successful save.
+	changes: AtomicU64,
+	/// Whether there were writes since the write-ahead log was last
+	/// flushed by `appendfsync`.
+	unsynced: AtomicBool,
+	last_sync_ok: AtomicBool,
+}
+
+impl Default for Persistence {
+	fn default() -> Self {
+		Self::new()
+	}
+}
+
+impl Persistence {
+	pub fn new() -> Self {
+		Self {
+			state: Mutex::new(PersistenceState {
+				last_save: chrono::Utc::now().timestamp(),
+				last_save_at: Instant::now(),
+				bgsave_started: None,
+				bgsave_changes: 0,
+				last_bgsave_ok: true,
+				last_bgsave_secs: None,
+				last_bgsave_at: None,
+				rewrite_started: None,
+				last_rewrite_ok: true,
+				last_rewrite_secs: None,
+			}),
+			changes: AtomicU64::new(0),
+			unsynced: AtomicBool::new(false),
+			last_sync_ok: AtomicBool::new(true),
+		}
+	}
+
+	/// Flush the write-ahead log, so every write made so far is durable.
+	async fn sync(&self, storage: &Storage) -> Result<(), String> {
+		self.unsynced.store(false, Ordering::Relaxed);
+		let position = GCTX!(replication).position();
+		let started = Instant::now();
+		let result = storage.sync().await;
+		record_latency(LatencyEvent::StorageStall, started);
+		self.last_sync_ok.store(result.is_ok(), Ordering::Relaxed);
+		if result.is_ok() {
+			GCTX!(replication).flushed(position);
+		}
+		result.map_err(|e| {
+			error!("Failed to sync the write-ahead log: {}", e);
+			self.unsynced.store(true, Ordering::Relaxed);
+			format!("ERR Failed to sync the write-ahead log: {}", e)
+		})
+	}
+
+	/// Flush the write-ahead log for WAITAOF, returning whether every write
+	/// made so far became durable within `timeout`, or however long it takes
+	/// without one. A flush that times out still completes in the background.
+	pub async fn wait_synced(
+		self: &Arc<Self>,
+		storage: Storage,
+		timeout: Option<Duration>,
+	) -> Result<bool, String> {
+		let persistence = self.clone();
+		let sync = tokio::spawn(async move { persistence.sync(&storage).await });
+		let joined = match timeout {
+			Some(timeout) => match tokio::time::timeout(timeout, sync).await {
+				Ok(joined) => joined,
+				Err(_) => return Ok(false),
+			},
+			None => sync.await,
+		};
+		joined.map_err(|e| format!("ERR {}", e))?.map(|_| true)
+	}
+
+	pub fn last_save(&self) -> i64 {
+		self.state.lock().unwrap().last_save
+	}
+
+	/// Save a snapshot before returning. The caller must keep transactions
+	/// and scripts from running, as commands do by holding the exec lock.
+	pub async fn save(&self, storage: &Storage) -> Result<(), String> {
+		if self.state.lock().unwrap().bgsave_started.is_some() {
+			return Err(BGSAVE_IN_PROGRESS.to_string());
+		}
+		// The snapshot is taken after this load, so it holds every change
+		// counted so far.
+		let changes = self.changes.load(Ordering::Relaxed);
+		let saved_at = write_snapshot(storage)
+			.await
+			.map_err(|e| format!("ERR {}", e))?;
+		self.changes.fetch_sub(changes, Ordering::Relaxed);
+		let mut state = self.state.lock().unwrap();
+		state.last_save = saved_at;
+		state.last_save_at = Instant::now();
+		Ok(())
+	}
+
+	/// Start saving a snapshot in a background task.
+	pub fn bgsave(self: &Arc<Self>, storage: Storage) -> Result<(), String> {
+		{
+			let mut state = self.state.lock().unwrap();
+			if state.bgsave_started.is_some() {
+				return Err(BGSAVE_IN_PROGRESS.to_string());
+			}
+			state.bgsave_started = Some(Instant::now());
+			state.bgsave_changes = self.changes.load(Ordering::Relaxed);
+		}
+
+		let persistence = self.clone();
+		tokio::spawn(async move {
+			let result = {
+				// Wait for running transactions and scripts, so the copy
+				// never holds half of one.
+				let _guard = GCTX!(exec_lock).read().await;
+				let started = Instant::now();
+				let snapshot = storage.snapshot().await;
+				record_latency(LatencyEvent::Snapshot, started);
+				snapshot
+			};
+			let result = match result {
+				Ok(snapshot) => storage
+					.save_snapshot(&snapshot)
+					.await
+					.map(|_| (snapshot.saved_at / 1000, snapshot.key_count())),
+				Err(e) => Err(e),
+			};
+			persistence.finish_bgsave(result);
+		});
+		Ok(())
+	}
+
+	fn finish_bgsave(&self, result: Result<(i64, usize), StorageError>) {
+		let mut state = self.state.lock().unwrap();
+		let started = state.bgsave_started.take();
+		state.last_bgsave_secs = started.map(|started| started.elapsed().as_secs());
+		state.last_bgsave_ok = result.is_ok();
+		state.last_bgsave_at = Some(Instant::now());
+		match result {
+			Ok((saved_at, keys)) => {
+				info!("Background saving terminated with success: {} keys", keys);
+				// Commands may have written while the snapshot was taken, but
+				// only changes made before the save started are certainly in it.
+				self.changes
+					.fetch_sub(state.bgsave_changes, Ordering::Relaxed);
+				state.last_save = saved_at;
+				state.last_save_at = Instant::now();
+			}
+			Err(e) => error!("Background saving error: {}", e),
+		}
+	}
+
+	/// Start rewriting the write-ahead log in a background task.
+	pub fn bgrewrite(self: &Arc<Self>, storage: Storage) -> Result<(), String> {
+		{
+			let mut state = self.state.lock().unwrap();
+			if state.rewrite_started.is_some() {
+				return Err(REWRITE_IN_PROGRESS.to_string());
+			}
+			state.rewrite_started = Some(Instant::now());
+		}
+
+		let persistence = self.clone();
+		tokio::spawn(async move {
+			let started = Instant::now();
+			let result = storage.rewrite_log().await;
+			record_latency(LatencyEvent::StorageStall, started);
+			persistence.finish_rewrite(result);
+		});
+		Ok(())
+	}
+
+	fn finish_rewrite(&self, result: Result<(), StorageError>) {
+		let mut state = self.state.lock().unwrap();
+		let started = state.rewrite_started.take();
+		state.last_rewrite_secs = started.map(|started| started.elapsed().as_secs());
+		state.last_rewrite_ok = result.is_ok();
+		match result {
+			Ok(()) => info!("Background append only file rewriting terminated with success"),
+			Err(e) => error!("Background append only file rewriting error: {}", e),
+		}
+	}
+
+	/// Whether `schedule` calls for a background save now. After a failed
+	/// background save, the next one waits for `BGSAVE_RETRY_DELAY`.
+	fn is_save_due(&self, schedule: &SaveSchedule) -> bool {
+		let state = self.state.lock().unwrap();
+		if state.bgsave_started.is_some() {
+			return false;
+		}
+		if !state.last_bgsave_ok
+			&& state
+				.last_bgsave_at
+				.is_some_and(|at| at.elapsed() < BGSAVE_RETRY_DELAY)
+		{
+			return false;
+		}
+		schedule.is_due(
+			self.changes.load(Ordering::Relaxed),
+			state.last_save_at.elapsed(),
+		)
+	}
+
+	/// Fields of the Persistence section of INFO.
+	pub fn info(&self) -> Vec<(String, String)> {
+		let state = self.state.lock().unwrap();
+		let secs = |secs: Option<u64>| secs.map_or("-1".to_string(), |secs| secs.to_string());
+		vec![
+			(
+				"rdb_changes_since_last_save".to_string(),
+				self.changes.load(Ordering::Relaxed).to_string(),
+			),
+			(
+				"rdb_bgsave_in_progress".to_string(),
+				(state.bgsave_started.is_some() as u8).to_string(),
+			),
+			(
+				"rdb_last_save_time".to_string(),
+				state.last_save.to_string(),
+			),
+			(
+				"rdb_last_bgsave_status".to_string(),
+				if state.last_bgsave_ok { "ok" } else { "err" }.to_string(),
+			),
+			(
+				"rdb_last_bgsave_time_sec".to_string(),
+				secs(state.last_bgsave_secs),
+			),
+			(
+				"rdb_current_bgsave_time_sec".to_string(),
+				secs(
+					state
+						.bgsave_started
+						.map(|started| started.elapsed().as_secs()),
+				),
+			),
+			(
+				"aof_enabled".to_string(),
+				(server_config!(appendonly).0 as u8).to_string(),
+			),
+			(
+				"aof_last_write_status".to_string(),
+				if self.last_sync_ok.load(Ordering::Relaxed) {
+					"ok"
+				} else {
+					"err"
+				}
+				.to_string(),
+			),
+			(
+				"aof_rewrite_in_progress".to_string(),
+				(state.rewrite_started.is_some() as u8).to_string(),
+			),
+			(
+				"aof_last_bgrewrite_status".to_string(),
+				if state.last_rewrite_ok { "ok" } else { "err" }.to_string(),
+			),
+			(
+				"aof_last_rewrite_time_sec".to_string(),
+				secs(state.last_rewrite_secs),
+			),
+			(
+				"aof_current_rewrite_time_sec".to_string(),
+				secs(
+					state
+						.rewrite_started
+						.map(|started| started.elapsed().as_secs()),
+				),
+			),
+		]
+	}
+}
+
+/// Take and save a snapshot, returning when it was taken in unix seconds.
+async fn write_snapshot(storage: &Storage) -> Result<i64, StorageError> {
+	let started = Instant::now();
+	let snapshot = storage.snapshot().await;
+	record_latency(LatencyEvent::Snapshot, started);
+	let snapshot = snapshot?;
+	storage.save_snapshot(&snapshot).await?;
+	info!("DB saved: {} keys", snapshot.key_count());
+	Ok(snapshot.saved_at / 1000)
+}
+
+/// Report to the latency monitor how long `event` took since `started`.
+fn record_latency(event: LatencyEvent, started: Instant) {
+	GCTX!(latency_monitor).add_sample_if_needed(
+		server_config!(latency_monitor_threshold),
+		event,
+		started.elapsed(),
+	);
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+	use crate::config::SERVER_CONF;
+	use crate::config::ServerConfig;
+
+	fn field<'a>(fields: &'a [(String, String)], name: &str) -> &'a str {
+		&fields.iter().find(|(field, _)| field == name).unwrap().1
+	}
+
+	#[test]
+	fn test_info() {
+		SERVER_CONF.init(ServerConfig::default());
+		let persistence = Persistence::new();
+		let fields = persistence.info();
+		assert_eq!(field(&fields, "rdb_bgsave_in_progress"), "0");
+		assert_eq!(field(&fields, "rdb_last_bgsave_status"), "ok");
+		assert_eq!(field(&fields, "rdb_last_bgsave_time_sec"), "-1");
+		assert_eq!(
+			field(&fields, "rdb_last_save_time"),
+			persistence.last_save().to_string()
+		);
+
+		persistence.state.lock().unwrap().bgsave_started = Some(Instant::now());
+		persistence.finish_bgsave(Err(StorageError::DataInconsistency {
+			message: "test".to_string(),
+		}));
+		let fields = persistence.info();
+		assert_eq!(field(&fields, "rdb_bgsave_in_progress"), "0");
+		assert_eq!(field(&fields, "rdb_last_bgsave_status"), "err");
+		assert_eq!(field(&fields, "rdb_last_bgsave_time_sec"), "0");
+
+		persistence.state.lock().unwrap().rewrite_started = Some(Instant::now());
+		let fields = persistence.info();
+		assert_eq!(field(&fields, "aof_rewrite_in_progress"), "1");
+		assert_eq!(field(&fields, "aof_current_rewrite_time_sec"), "0");
+		persistence.finish_rewrite(Ok(()));
+		let fields = persistence.info();
+		assert_eq!(field(&fields, "aof_rewrite_in_progress"), "0");
+		assert_eq!(field(&fields, "aof_last_bgrewrite_status"), "ok");
+		assert_eq!(field(&fields, "aof_last_rewrite_time_sec"), "0");
+		assert_eq!(field(&fields, "aof_current_rewrite_time_sec"), "-1");
+	}
+
+	#[test]
+	fn test_parse_save_schedule() {
+		let schedule = "900 1  300 10".parse::<SaveSchedule>().unwrap();
+		assert_eq!(
+			schedule.0,
+			vec![
+				SavePoint {
+					seconds: 900,
+					changes: 1
+				},
+				SavePoint {
+					seconds: 300,
+					changes: 10
+				},
+			]
+		);
+		assert_eq!(schedule.to_string(), "900 1 300 10");
+		assert!("".parse::<SaveSchedule>().unwrap().0.is_empty());
+		assert!("900".parse::<SaveSchedule>().is_err());
+		assert!("900 -1".parse::<SaveSchedule>().is_err());
+		assert!("soon 1".parse::<SaveSchedule>().is_err());
+	}
+
+	#[test]
+	fn test_save_schedule_due() {
+		let schedule = "900 1 60 100".parse::<SaveSchedule>().unwrap();
+		assert!(!schedule.is_due(0, Duration::from_secs(1000)));
+		assert!(!schedule.is_due(50, Duration::from_secs(899)));
+		assert!(schedule.is_due(1, Duration::from_secs(900)));
+		assert!(schedule.is_due(100, Duration::from_secs(60)));
+		assert!(!SaveSchedule::default().is_due(100, Duration::from_secs(1000)));
+	}
+
+	#[test]
+	fn test_save_retry_after_failure() {
+		let persistence = Persistence::new();
+		let schedule = "0 1".parse::<SaveSchedule>().unwrap();
+		assert!(!persistence.is_save_due(&schedule));
+		persistence.changes.store(1, Ordering::Relaxed);
+		assert!(persistence.is_save_due(&schedule));
+
+		persistence.state.lock().unwrap().bgsave_started = Some(Instant::now());
+		assert!(!persistence.is_save_due(&schedule));
+		persistence.finish_bgsave(Err(StorageError::DataInconsistency {
+			message: "test".to_string(),
+		}));
+		assert!(!persistence.is_save_due(&schedule));
+		persistence.state.lock().unwrap().last_bgsave_at =
+			Some(Instant::now() - BGSAVE_RETRY_DELAY);
+		assert!(persistence.is_save_due(&schedule));
+
+		// A change made while a background save runs stays counted.
+		{
+			let mut state = persistence.state.lock().unwrap();
+			state.bgsave_started = Some(Instant::now());
+			state.bgsave_changes = 1;
+		}
+		persistence.changes.fetch_add(1, Ordering::Relaxed);
+		persistence.finish_bgsave(Ok((0, 0)));
+		let fields = persistence.info();
+		assert_eq!(field(&fields, "rdb_changes_since_last_save"), "1");
+	}
+}
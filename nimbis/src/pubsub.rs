@@ -0,0 +1,521 @@
+//! Channel based publish/subscribe.
+//!
+//! [`PubSub`] maps every channel and glob pattern to the clients subscribed
+//! to it. Each
+//! subscribed connection owns a [`Subscriber`] whose queue receives the
+//! published messages, so PUBLISH never waits for a subscriber's socket: it
+//! only enqueues, and the subscriber's own connection task writes the
+//! message out. Queued messages count against the connection's output
+//! buffer limits, so a subscriber that stops reading is disconnected rather
+//! than queueing without bound.
+
+use std::collections::HashMap;
+use std::collections::HashSet;
+use std::sync::Arc;
+
+use bytes::Bytes;
+use dashmap::DashMap;
+use dashmap::mapref::entry::Entry;
+use nimbis_resp::RespValue;
+use tokio::sync::mpsc;
+
+use crate::cmd::utils::glob_match;
+use crate::output_buffer::Outbox;
+use crate::output_buffer::OutputBuffer;
+
+/// Commands a RESP2 client may send while it has subscriptions, since any
+/// other reply could not be told apart from a published message.
+const SUBSCRIBE_MODE_CMDS: &[&str] = &[
+	"SUBSCRIBE",
+	"UNSUBSCRIBE",
+	"PSUBSCRIBE",
+	"PUNSUBSCRIBE",
+	"PING",
+	"RESET",
+];
+
+/// Returns true if `name` may run on a RESP2 connection in subscribe mode.
+pub fn allowed_in_subscribe_mode(name: &str) -> bool {
+	SUBSCRIBE_MODE_CMDS.contains(&name)
+}
+
+/// Frame a pub/sub reply: a push in RESP3, a plain array in RESP2.
+pub fn frame(resp3: bool, items: Vec<RespValue>) -> RespValue {
+	if resp3 {
+		RespValue::Push(items)
+	} else {
+		RespValue::array(items)
+	}
+}
+
+/// A message published to a channel.
+#[derive(Debug, Clone, PartialEq)]
+pub struct Message {
+	/// The pattern the message matched, for pattern subscriptions.
+	pub pattern: Option<Bytes>,
+	pub channel: Bytes,
+	pub payload: Bytes,
+}
+
+impl Message {
+	pub fn to_resp(&self, resp3: bool) -> RespValue {
+		let mut items = Vec::with_capacity(4);
+		match &self.pattern {
+			Some(pattern) => {
+				items.push(RespValue::bulk_string("pmessage"));
+				items.push(RespValue::bulk_string(pattern.clone()));
+			}
+			None => items.push(RespValue::bulk_string("message")),
+		}
+		items.push(RespValue::bulk_string(self.channel.clone()));
+		items.push(RespValue::bulk_string(self.payload.clone()));
+		frame(resp3, items)
+	}
+
+	/// Bytes the message is accounted as in the output buffer.
+	pub fn size(&self) -> usize {
+		self.pattern.as_ref().map_or(0, Bytes::len) + self.channel.len() + self.payload.len()
+	}
+}
+
+/// Clients subscribed to each channel or pattern.
+type Subscribers = DashMap<Bytes, HashMap<i64, Outbox<Message>>>;
+
+fn add_subscriber(subscribers: &Subscribers, name: Bytes, client_id: i64, outbox: Outbox<Message>) {
+	subscribers
+		.entry(name)
+		.or_default()
+		.insert(client_id, outbox);
+}
+
+fn remove_subscriber(subscribers: &Subscribers, name: Bytes, client_id: i64) {
+	if let Entry::Occupied(mut entry) = subscribers.entry(name) {
+		entry.get_mut().remove(&client_id);
+		if entry.get().is_empty() {
+			entry.remove();
+		}
+	}
+}
+
+/// Server-wide channel and pattern registry.
+#[derive(Debug, Default)]
+pub struct PubSub {
+	channels: Subscribers,
+	patterns: Subscribers,
+}
+
+impl PubSub {
+	pub fn new() -> Self {
+		Self::default()
+	}
+
+	/// Queue `payload` for every subscriber of `channel` and of every
+	/// pattern matching it, returning how many messages were queued. A
+	/// client matching through several subscriptions receives one message
+	/// per subscription; a client over its output buffer limits receives
+	/// none and is disconnected.
+	pub fn publish(&self, channel: &Bytes, payload: &Bytes) -> usize {
+		let deliver = |outboxes: &HashMap<i64, Outbox<Message>>, pattern: Option<&Bytes>| {
+			let message = Message {
+				pattern: pattern.cloned(),
+				channel: channel.clone(),
+				payload: payload.clone(),
+			};
+			let size = message.size();
+			outboxes
+				.values()
+				.filter(|outbox| outbox.send(message.clone(), size))
+				.count()
+		};
+
+		let mut receivers = self
+			.channels
+			.get(channel)
+			.map_or(0, |senders| deliver(senders.value(), None));
+		for entry in self.patterns.iter() {
+			if glob_match(entry.key(), channel) {
+				receivers += deliver(entry.value(), Some(entry.key()));
+			}
+		}
+		receivers
+	}
+
+	/// Channels with at least one subscriber, optionally filtered by a glob
+	/// pattern. Pattern subscriptions are not counted.
+	pub fn channels(&self, pattern: Option<&[u8]>) -> Vec<Bytes> {
+		self.channels
+			.iter()
+			.map(|entry| entry.key().clone())
+			.filter(|channel| pattern.is_none_or(|pattern| glob_match(pattern, channel)))
+			.collect()
+	}
+
+	/// Number of clients subscribed to `channel`, excluding pattern
+	/// subscriptions.
+	pub fn numsub(&self, channel: &Bytes) -> usize {
+		self.channels
+			.get(channel)
+			.map_or(0, |subscribers| subscribers.len())
+	}
+
+	/// Number of distinct patterns subscribed to by any client.
+	pub fn numpat(&self) -> usize {
+		self.patterns.len()
+	}
+}
+
+/// What a subscription name refers to.
+#[derive(Debug, Clone, Copy)]
+enum Kind {
+	Channel,
+	Pattern,
+}
+
+impl Kind {
+	fn subscribe_reply(self) -> &'static str {
+		match self {
+			Kind::Channel => "subscribe",
+			Kind::Pattern => "psubscribe",
+		}
+	}
+
+	fn unsubscribe_reply(self) -> &'static str {
+		match self {
+			Kind::Channel => "unsubscribe",
+			Kind::Pattern => "punsubscribe",
+		}
+	}
+}
+
+/// The subscriptions of one connection and the queue its messages arrive
+/// on. Dropping it unsubscribes from everything.
+#[derive(Debug)]
+pub struct Subscriber {
+	client_id: i64,
+	pubsub: Arc<PubSub>,
+	buffer: Arc<OutputBuffer>,
+	outbox: Outbox<Message>,
+	receiver: mpsc::UnboundedReceiver<Message>,
+	channels: HashSet<Bytes>,
+	patterns: HashSet<Bytes>,
+}
+
+impl Subscriber {
+	pub fn new(client_id: i64, pubsub: Arc<PubSub>, buffer: Arc<OutputBuffer>) -> Self {
+		let (sender, receiver) = mpsc::unbounded_channel();
+		Self {
+			client_id,
+			pubsub,
+			outbox: Outbox::new(sender, buffer.clone()),
+			buffer,
+			receiver,
+			channels: HashSet::new(),
+			patterns: HashSet::new(),
+		}
+	}
+
+	/// Whether the connection is in subscribe mode.
+	pub fn is_active(&self) -> bool {
+		self.count() > 0
+	}
+
+	/// Whether the connection is subscribed to `channel` itself, not
+	/// through a pattern.
+	pub fn is_subscribed(&self, channel: &[u8]) -> bool {
+		self.channels.contains(channel)
+	}
+
+	/// Number of channels and patterns subscribed to.
+	pub fn count(&self) -> usize {
+		self.channels.len() + self.patterns.len()
+	}
+
+	/// Subscribe to `channels`, returning one confirmation per channel.
+	pub fn subscribe(&mut self, channels: &[Bytes], resp3: bool) -> Vec<RespValue> {
+		self.add(Kind::Channel, channels, resp3)
+	}
+
+	/// Unsubscribe from `channels`, or from every channel when empty,
+	/// returning one confirmation per channel.
+	pub fn unsubscribe(&mut self, channels: &[Bytes], resp3: bool) -> Vec<RespValue> {
+		self.remove(Kind::Channel, channels, resp3)
+	}
+
+	/// Subscribe to the glob `patterns`, returning one confirmation per
+	/// pattern.
+	pub fn psubscribe(&mut self, patterns: &[Bytes], resp3: bool) -> Vec<RespValue> {
+		self.add(Kind::Pattern, patterns, resp3)
+	}
+
+	/// Unsubscribe from `patterns`, or from every pattern when empty,
+	/// returning one confirmation per pattern.
+	pub fn punsubscribe(&mut self, patterns: &[Bytes], resp3: bool) -> Vec<RespValue> {
+		self.remove(Kind::Pattern, patterns, resp3)
+	}
+
+	/// Drop every subscription, leaving subscribe mode.
+	pub fn clear(&mut self) {
+		for channel in self.channels.drain() {
+			remove_subscriber(&self.pubsub.channels, channel, self.client_id);
+		}
+		for pattern in self.patterns.drain() {
+			remove_subscriber(&self.pubsub.patterns, pattern, self.client_id);
+		}
+		self.buffer.set_pubsub(false);
+	}
+
+	/// Wait for the next message published to a subscribed channel. The
+	/// caller releases its size from the output buffer once written.
+	pub async fn recv(&mut self) -> Message {
+		self.receiver
+			.recv()
+			.await
+			.expect("subscriber holds its own sender")
+	}
+
+	fn subscriptions(&mut self, kind: Kind) -> (&mut HashSet<Bytes>, &Subscribers) {
+		match kind {
+			Kind::Channel => (&mut self.channels, &self.pubsub.channels),
+			Kind::Pattern => (&mut self.patterns, &self.pubsub.patterns),
+		}
+	}
+
+	fn add(&mut self, kind: Kind, names: &[Bytes], resp3: bool) -> Vec<RespValue> {
+		let mut replies = Vec::with_capacity(names.len());
+		for name in names {
+			let client_id = self.client_id;
+			let outbox = self.outbox.clone();
+			let (subscribed, subscribers) = self.subscriptions(kind);
+			if subscribed.insert(name.clone()) {
+				add_subscriber(subscribers, name.clone(), client_id, outbox);
+			}
+			self.buffer.set_pubsub(true);
+			replies.push(self.confirmation(kind.subscribe_reply(), Some(name.clone()), resp3));
+		}
+		replies
+	}
+
+	fn remove(&mut self, kind: Kind, names: &[Bytes], resp3: bool) -> Vec<RespValue> {
+		let client_id = self.client_id;
+		let (subscribed, _) = self.subscriptions(kind);
+		let names = if names.is_empty() {
+			subscribed.iter().cloned().collect()
+		} else {
+			names.to_vec()
+		};
+		if names.is_empty() {
+			return vec![self.confirmation(kind.unsubscribe_reply(), None, resp3)];
+		}
+
+		let mut replies = Vec::with_capacity(names.len());
+		for name in names {
+			let (subscribed, subscribers) = self.subscriptions(kind);
+			if subscribed.remove(&name) {
+				remove_subscriber(subscribers, name.clone(), client_id);
+			}
+			replies.push(self.confirmation(kind.unsubscribe_reply(), Some(name), resp3));
+		}
+		self.buffer.set_pubsub(self.is_active());
+		replies
+	}
+
+	fn confirmation(&self, kind: &'static str, name: Option<Bytes>, resp3: bool) -> RespValue {
+		frame(
+			resp3,
+			vec![
+				RespValue::bulk_string(kind),
+				name.map_or(RespValue::Null, RespValue::bulk_string),
+				RespValue::integer(self.count() as i64),
+			],
+		)
+	}
+}
+
+impl Drop for Subscriber {
+	fn drop(&mut self) {
+		self.clear();
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+	use crate::config::SERVER_CONF;
+	use crate::config::ServerConfig;
+	use crate::server_config;
+
+	fn subscriber(client_id: i64, pubsub: &Arc<PubSub>) -> Subscriber {
+		SERVER_CONF.init(ServerConfig::default());
+		Subscriber::new(client_id, pubsub.clone(), Arc::new(OutputBuffer::new()))
+	}
+
+	fn confirmation(kind: &'static str, channel: Option<&'static str>, count: i64) -> RespValue {
+		RespValue::array(vec![
+			RespValue::bulk_string(kind),
+			channel.map_or(RespValue::Null, RespValue::bulk_string),
+			RespValue::integer(count),
+		])
+	}
+
+	#[tokio::test]
+	async fn test_publish_reaches_subscribers() {
+		let pubsub = Arc::new(PubSub::new());
+		let mut first = subscriber(1, &pubsub);
+		let mut second = subscriber(2, &pubsub);
+		let news = Bytes::from("news");
+
+		first.subscribe(&[news.clone()], false);
+		second.subscribe(&[news.clone(), Bytes::from("other")], false);
+		assert_eq!(pubsub.publish(&news, &Bytes::from("hello")), 2);
+		assert_eq!(
+			pubsub.publish(&Bytes::from("missing"), &Bytes::from("x")),
+			0
+		);
+
+		let expected = Message {
+			pattern: None,
+			channel: news,
+			payload: Bytes::from("hello"),
+		};
+		assert_eq!(first.recv().await, expected);
+		assert_eq!(second.recv().await, expected);
+	}
+
+	#[test]
+	fn test_subscribe_confirmations() {
+		let pubsub = Arc::new(PubSub::new());
+		let mut subscriber = subscriber(1, &pubsub);
+		let channels = [Bytes::from("a"), Bytes::from("b"), Bytes::from("a")];
+
+		assert_eq!(
+			subscriber.subscribe(&channels, false),
+			vec![
+				confirmation("subscribe", Some("a"), 1),
+				confirmation("subscribe", Some("b"), 2),
+				confirmation("subscribe", Some("a"), 2),
+			]
+		);
+		assert_eq!(
+			subscriber.unsubscribe(&[Bytes::from("b")], false),
+			vec![confirmation("unsubscribe", Some("b"), 1)]
+		);
+		assert_eq!(
+			subscriber.unsubscribe(&[], false),
+			vec![confirmation("unsubscribe", Some("a"), 0)]
+		);
+		assert_eq!(
+			subscriber.unsubscribe(&[], false),
+			vec![confirmation("unsubscribe", None, 0)]
+		);
+		assert!(!subscriber.is_active());
+	}
+
+	#[test]
+	fn test_dropped_subscriber_leaves_channels() {
+		let pubsub = Arc::new(PubSub::new());
+		let channel = Bytes::from("news");
+		{
+			let mut subscriber = subscriber(1, &pubsub);
+			subscriber.subscribe(&[channel.clone()], true);
+			assert_eq!(pubsub.publish(&channel, &Bytes::from("x")), 1);
+		}
+		assert_eq!(pubsub.publish(&channel, &Bytes::from("x")), 0);
+		assert!(pubsub.channels.is_empty());
+	}
+
+	#[tokio::test]
+	async fn test_pattern_subscriptions() {
+		let pubsub = Arc::new(PubSub::new());
+		let mut subscriber = subscriber(1, &pubsub);
+		let channel = Bytes::from("news.tech");
+
+		assert_eq!(
+			subscriber.psubscribe(&[Bytes::from("news.*")], false),
+			vec![confirmation("psubscribe", Some("news.*"), 1)]
+		);
+		subscriber.subscribe(&[channel.clone()], false);
+		assert_eq!(pubsub.publish(&channel, &Bytes::from("hi")), 2);
+		assert_eq!(pubsub.publish(&Bytes::from("sports"), &Bytes::from("x")), 0);
+
+		assert_eq!(subscriber.recv().await.pattern, None);
+		assert_eq!(
+			subscriber.recv().await,
+			Message {
+				pattern: Some(Bytes::from("news.*")),
+				channel,
+				payload: Bytes::from("hi"),
+			}
+		);
+
+		assert_eq!(
+			subscriber.punsubscribe(&[], false),
+			vec![confirmation("punsubscribe", Some("news.*"), 1)]
+		);
+		assert_eq!(pubsub.numpat(), 0);
+	}
+
+	#[test]
+	fn test_slow_subscriber_is_closed() {
+		let pubsub = Arc::new(PubSub::new());
+		let buffer = Arc::new(OutputBuffer::new());
+		SERVER_CONF.init(ServerConfig::default());
+		let mut slow = Subscriber::new(1, pubsub.clone(), buffer.clone());
+		let channel = Bytes::from("news");
+
+		slow.subscribe(&[channel.clone()], false);
+		let hard = server_config!(client_output_buffer_limit).pubsub.hard;
+		let payload = Bytes::from(vec![b'x'; hard]);
+		assert_eq!(pubsub.publish(&channel, &payload), 0);
+		assert!(buffer.is_closed());
+		assert_eq!(buffer.pending(), 0);
+	}
+
+	#[test]
+	fn test_introspection() {
+		let pubsub = Arc::new(PubSub::new());
+		let mut first = subscriber(1, &pubsub);
+		let mut second = subscriber(2, &pubsub);
+
+		first.subscribe(&[Bytes::from("news"), Bytes::from("sports")], false);
+		second.subscribe(&[Bytes::from("news")], false);
+		first.psubscribe(&[Bytes::from("n*")], false);
+		second.psubscribe(&[Bytes::from("n*"), Bytes::from("s*")], false);
+
+		let mut channels = pubsub.channels(None);
+		channels.sort();
+		assert_eq!(channels, vec![Bytes::from("news"), Bytes::from("sports")]);
+		assert_eq!(pubsub.channels(Some(&b"n*"[..])), vec![Bytes::from("news")]);
+		assert_eq!(pubsub.numsub(&Bytes::from("news")), 2);
+		assert_eq!(pubsub.numsub(&Bytes::from("missing")), 0);
+		assert_eq!(pubsub.numpat(), 2);
+
+		drop(second);
+		assert_eq!(pubsub.numsub(&Bytes::from("news")), 1);
+		assert_eq!(pubsub.numpat(), 1);
+	}
+
+	#[test]
+	fn test_frame_uses_push_for_resp3() {
+		let message = Message {
+			pattern: None,
+			channel: Bytes::from("c"),
+			payload: Bytes::from("p"),
+		};
+		assert!(matches!(message.to_resp(true), RespValue::Push(_)));
+		assert!(matches!(message.to_resp(false), RespValue::Array(_)));
+
+		let message = Message {
+			pattern: Some(Bytes::from("c*")),
+			..message
+		};
+		assert_eq!(
+			message.to_resp(false),
+			RespValue::array(vec![
+				RespValue::bulk_string("pmessage"),
+				RespValue::bulk_string("c*"),
+				RespValue::bulk_string("c"),
+				RespValue::bulk_string("p"),
+			])
+		);
+	}
+}
@@ -0,0 +1,126 @@
+//! Command rate limits per connection and per ACL user, so one tenant cannot
+//! starve the others.
+
+use std::sync::atomic::AtomicU64;
+use std::sync::atomic::Ordering;
+use std::time::Instant;
+
+use dashmap::DashMap;
+
+use crate::GCTX;
+use crate::server_config;
+
+/// The error a client gets for a command above its rate limit.
+pub const RATE_LIMITED: &str = "RATELIMIT command rate limit exceeded, try again later";
+
+/// A token bucket holding up to one second of commands, refilled
+/// continuously at the rate limit.
+#[derive(Debug, Clone, Copy)]
+pub struct Bucket {
+	tokens: f64,
+	updated: Instant,
+}
+
+impl Bucket {
+	fn full(rate: u64, now: Instant) -> Self {
+		Self {
+			tokens: rate as f64,
+			updated: now,
+		}
+	}
+
+	/// Take a token for one command at `rate` commands a second, returning
+	/// false if none is left.
+	fn take(&mut self, rate: u64, now: Instant) -> bool {
+		let rate = rate as f64;
+		let refill = now.saturating_duration_since(self.updated).as_secs_f64() * rate;
+		self.tokens = (self.tokens + refill).min(rate);
+		self.updated = now;
+		if self.tokens < 1.0 {
+			return false;
+		}
+		self.tokens -= 1.0;
+		true
+	}
+}
+
+/// The buckets of the ACL users, shared by all their connections.
+#[derive(Debug, Default)]
+pub struct RateLimiter {
+	users: DashMap<String, Bucket>,
+	/// Commands refused since startup.
+	limited: AtomicU64,
+}
+
+impl RateLimiter {
+	pub fn new() -> Self {
+		Self::default()
+	}
+
+	fn take_user(&self, user: &str, rate: u64, now: Instant) -> bool {
+		self.users
+			.entry(user.to_string())
+			.or_insert_with(|| Bucket::full(rate, now))
+			.take(rate, now)
+	}
+
+	/// The counters of the Stats INFO section.
+	pub fn stats(&self) -> Vec<(String, String)> {
+		vec![(
+			"rate_limited_commands".to_string(),
+			self.limited.load(Ordering::Relaxed).to_string(),
+		)]
+	}
+}
+
+/// Take a token for one command of `client_id` from the bucket of its
+/// connection, `bucket`, and of its user, returning false if either limit
+/// is reached.
+pub fn allow(client_id: i64, bucket: &mut Option<Bucket>) -> bool {
+	let now = Instant::now();
+	let limiter = GCTX!(rate_limiter);
+	let client_rate = server_config!(client_commands_per_second);
+	if client_rate > 0
+		&& !bucket
+			.get_or_insert_with(|| Bucket::full(client_rate, now))
+			.take(client_rate, now)
+	{
+		limiter.limited.fetch_add(1, Ordering::Relaxed);
+		return false;
+	}
+	let user_rate = server_config!(user_commands_per_second);
+	if user_rate > 0
+		&& let Some(user) = GCTX!(client_sessions).get_user(client_id)
+		&& !limiter.take_user(&user, user_rate, now)
+	{
+		limiter.limited.fetch_add(1, Ordering::Relaxed);
+		return false;
+	}
+	true
+}
+
+#[cfg(test)]
+mod tests {
+	use std::time::Duration;
+	use std::time::Instant;
+
+	use super::Bucket;
+
+	#[test]
+	fn test_bucket_refills_at_the_rate() {
+		let start = Instant::now();
+		let mut bucket = Bucket::full(2, start);
+		assert!(bucket.take(2, start));
+		assert!(bucket.take(2, start));
+		assert!(!bucket.take(2, start));
+
+		let later = start + Duration::from_millis(500);
+		assert!(bucket.take(2, later));
+		assert!(!bucket.take(2, later));
+
+		let much_later = start + Duration::from_secs(60);
+		assert!(bucket.take(2, much_later));
+		assert!(bucket.take(2, much_later));
+		assert!(!bucket.take(2, much_later));
+	}
+}
@@ -0,0 +1,98 @@
+//! Renamed and disabled commands, set with `rename_command`, so operators
+//! can hide the admin surface from clients.
+
+use std::collections::BTreeMap;
+use std::fmt;
+
+use serde::Deserialize;
+use serde::Serialize;
+
+use crate::cmd::CmdTable;
+use crate::config::SERVER_CONF;
+use crate::server_config;
+
+/// The `rename_command` setting: the name clients must use for each listed
+/// command, or an empty name to disable it.
+#[derive(Debug, Clone, Default, PartialEq, Eq, Deserialize, Serialize)]
+#[serde(transparent)]
+pub struct RenameCommands(pub BTreeMap<String, String>);
+
+impl RenameCommands {
+	/// The command a client runs by sending `name`, or None if `name` was
+	/// renamed or disabled.
+	fn resolve(&self, name: &str) -> Option<String> {
+		if self.0.keys().any(|cmd| cmd.eq_ignore_ascii_case(name)) {
+			return None;
+		}
+		let renamed = self
+			.0
+			.iter()
+			.find(|(_, new)| !new.is_empty() && new.eq_ignore_ascii_case(name));
+		Some(match renamed {
+			Some((cmd, _)) => cmd.to_ascii_uppercase(),
+			None => name.to_string(),
+		})
+	}
+}
+
+impl fmt::Display for RenameCommands {
+	fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+		let value = serde_json::to_string(&self.0).map_err(|_| fmt::Error)?;
+		f.write_str(&value)
+	}
+}
+
+/// Translate the command name a client sent, uppercased, into the command it
+/// runs, or None if that name is not available to clients.
+pub fn resolve(name: &str) -> Option<String> {
+	server_config!(rename_command).resolve(name)
+}
+
+/// Check that every renamed command exists and that no new name is already
+/// taken by another command.
+pub fn validate(table: &CmdTable) -> Result<(), String> {
+	let config = SERVER_CONF.load();
+	let renames = &config.rename_command.0;
+	let mut taken = Vec::new();
+	for (cmd, new) in renames {
+		if table.get_cmd(&cmd.to_ascii_uppercase()).is_none() {
+			return Err(format!("rename_command: unknown command '{}'", cmd));
+		}
+		if new.is_empty() {
+			continue;
+		}
+		let new = new.to_ascii_uppercase();
+		let clashes = taken.contains(&new)
+			|| (table.get_cmd(&new).is_some()
+				&& !renames.keys().any(|cmd| cmd.eq_ignore_ascii_case(&new)));
+		if clashes {
+			return Err(format!(
+				"rename_command: '{}' can not be renamed to '{}', which is already taken",
+				cmd, new
+			));
+		}
+		taken.push(new);
+	}
+	Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+	use super::RenameCommands;
+
+	#[test]
+	fn test_resolve_renamed_and_disabled_commands() {
+		let renames = RenameCommands(
+			[
+				("flushall".to_string(), "".to_string()),
+				("CONFIG".to_string(), "admin-config".to_string()),
+			]
+			.into(),
+		);
+
+		assert_eq!(renames.resolve("FLUSHALL"), None);
+		assert_eq!(renames.resolve("CONFIG"), None);
+		assert_eq!(renames.resolve("ADMIN-CONFIG"), Some("CONFIG".to_string()));
+		assert_eq!(renames.resolve("GET"), Some("GET".to_string()));
+	}
+}
@@ -0,0 +1,1659 @@
+//! Primary/replica replication.
+//!
+//! A replica connects to its primary after REPLICAOF and sends PSYNC. The
+//! primary answers with FULLRESYNC and a snapshot of its dataset, then streams
+//! every write command it runs from that point on, as RESP arrays in the order
+//! they were applied. The replica loads the snapshot in place of its dataset,
+//! applies the stream and acknowledges its offset every second. Writes that
+//! succeed inside a transaction or script are streamed wrapped in MULTI/EXEC,
+//! so the replica applies them atomically too. A replica streams what it
+//! applies on to its own replicas, and does not stream writes of its own
+//! clients. Its replicas share its stream ID and offsets, so they can resume
+//! from either it or its primary; it only serves them while its own link is
+//! up.
+//!
+//! The stream is identified by a replication ID and counted in bytes. The
+//! tail of it is kept in a backlog of `repl_backlog_size` bytes, so a replica
+//! that reconnects with PSYNC naming the ID and its offset gets CONTINUE and
+//! the commands it missed instead of a new snapshot. A replica that is
+//! promoted with REPLICAOF NO ONE starts a new ID and keeps the old one as its
+//! second ID up to its offset, so the other replicas of its old primary can
+//! resume from it.
+//!
+//! FAILOVER hands the primary role to a replica: it pauses writes, asks the
+//! replica to acknowledge the offset at that point, promotes it with
+//! REPLICAOF NO ONE once it has caught up and then replicates from it,
+//! resuming the stream the replica took over.
+//!
+//! Both sides are nimbis servers: the snapshot is the encoding SAVE writes,
+//! followed by the function libraries in the FUNCTION DUMP format.
+
+use std::collections::HashMap;
+use std::collections::VecDeque;
+use std::sync::Arc;
+use std::sync::Mutex;
+use std::sync::atomic::AtomicBool;
+use std::sync::atomic::Ordering;
+use std::time::Duration;
+use std::time::Instant;
+
+use bytes::Buf;
+use bytes::BufMut;
+use bytes::Bytes;
+use bytes::BytesMut;
+use log::info;
+use log::warn;
+use nimbis_resp::RespParseResult;
+use nimbis_resp::RespParser;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+use nimbis_storage::lock::StorageLock;
+use nimbis_storage::lock::StorageLockGuard;
+use nimbis_storage::lock::StorageLocks;
+use nimbis_storage::snapshot::Snapshot;
+use tokio::io::AsyncReadExt;
+use tokio::io::AsyncWriteExt;
+use tokio::net::TcpStream;
+use tokio::sync::mpsc;
+use tokio::task::JoinHandle;
+
+use crate::GCTX;
+use crate::access;
+use crate::acl;
+use crate::blocking;
+use crate::cmd::CmdContext;
+use crate::cmd::ParsedCmd;
+use crate::config::SERVER_CONF;
+use crate::function;
+use crate::function::RestorePolicy;
+use crate::lazyfree;
+use crate::loading;
+use crate::output_buffer::Outbox;
+use crate::output_buffer::OutputBuffer;
+use crate::persistence;
+use crate::server_config;
+use crate::tls::ClientStream;
+use crate::tracking;
+
+/// How often a replica acknowledges the offset it applied.
+const ACK_INTERVAL: Duration = Duration::from_secs(1);
+/// How long a replica waits before connecting to its primary again.
+const RECONNECT_DELAY: Duration = Duration::from_secs(1);
+const CONNECT_TIMEOUT: Duration = Duration::from_secs(5);
+/// How often a failover checks whether its target has caught up.
+const FAILOVER_POLL_INTERVAL: Duration = Duration::from_millis(10);
+/// How often WAITAOF checks whether enough replicas have acknowledged.
+const ACK_POLL_INTERVAL: Duration = Duration::from_millis(10);
+/// Client id of the commands a replica applies from its primary.
+const REPLICATION_CLIENT_ID: i64 = 0;
+/// Write commands that stream other commands themselves: MIGRATE streams DEL
+/// for the keys it moved, and EXPIRE and RESTORE stream the absolute expire
+/// time they set, so it is the same on replicas.
+const NOT_STREAMED_CMDS: &[&str] = &["MIGRATE", "EXPIRE", "RESTORE", "RESTORE-ASKING"];
+const READONLY_REPLICA: &str = "READONLY You can't write against a read only replica.";
+
+/// A replica attached to this server.
+#[derive(Debug)]
+struct ReplicaLink {
+	client_id: i64,
+	addr: String,
+	listening_port: Option<u16>,
+	outbox: Outbox<Bytes>,
+	/// The offset the replica last acknowledged.
+	ack_offset: u64,
+	/// The offset the replica last acknowledged its write-ahead log flushed
+	/// up to, with FACK.
+	fack_offset: u64,
+	last_ack: Instant,
+}
+
+impl ReplicaLink {
+	/// Whether this replica serves clients on `host:port`.
+	fn is_at(&self, host: &str, port: u16) -> bool {
+		split_addr(&self.addr).0 == host && self.listening_port == Some(port)
+	}
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum LinkStatus {
+	Connecting,
+	Sync,
+	Connected,
+}
+
+/// The primary this server replicates from.
+#[derive(Debug)]
+struct PrimaryLink {
+	host: String,
+	port: u16,
+	status: LinkStatus,
+	last_io: Instant,
+	task: JoinHandle<()>,
+}
+
+/// What ROLE reports about this server.
+#[derive(Debug, Clone, PartialEq)]
+pub enum Role {
+	Primary {
+		offset: u64,
+		/// The IP, port and acknowledged offset of each attached replica.
+		replicas: Vec<(String, String, u64)>,
+	},
+	Replica {
+		host: String,
+		port: u16,
+		/// `connecting`, `sync` or `connected`.
+		link: &'static str,
+		offset: u64,
+	},
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum FailoverStatus {
+	/// Writes are paused until the target acknowledges the last of them.
+	WaitingForSync,
+	/// The target is being promoted.
+	InProgress,
+}
+
+/// A FAILOVER that has not finished.
+#[derive(Debug)]
+struct Failover {
+	status: FailoverStatus,
+	task: JoinHandle<()>,
+}
+
+/// The tail of the command stream, kept so a replica that reconnects can
+/// resume from its offset.
+#[derive(Debug)]
+struct Backlog {
+	frames: VecDeque<Bytes>,
+	/// The stream offset the first frame starts at.
+	start: u64,
+	/// Bytes held in `frames`.
+	len: u64,
+}
+
+impl Backlog {
+	fn new(start: u64) -> Self {
+		Self {
+			frames: VecDeque::new(),
+			start,
+			len: 0,
+		}
+	}
+
+	/// Append `frame`, dropping the oldest frames beyond `size` bytes.
+	fn push(&mut self, frame: Bytes, size: u64) {
+		self.len += frame.len() as u64;
+		self.frames.push_back(frame);
+		while self.len > size
+			&& let Some(oldest) = self.frames.pop_front()
+		{
+			self.start += oldest.len() as u64;
+			self.len -= oldest.len() as u64;
+		}
+	}
+
+	/// The frames after stream offset `offset`, or None if the backlog no
+	/// longer holds them or `offset` falls inside a frame.
+	fn since(&self, offset: u64) -> Option<Vec<Bytes>> {
+		let mut pos = self.start;
+		for (i, frame) in self.frames.iter().enumerate() {
+			if pos == offset {
+				return Some(self.frames.range(i..).cloned().collect());
+			}
+			pos += frame.len() as u64;
+		}
+		(pos == offset).then(Vec::new)
+	}
+}
+
+#[derive(Debug)]
+struct ReplicationState {
+	replid: String,
+	/// Bytes of the command stream produced or applied so far.
+	offset: u64,
+	/// The offset of the stream `replid` the write-ahead log was last flushed
+	/// up to, which a replica reports to its primary with FACK.
+	fsynced: u64,
+	/// The ID of the stream this server took over when it was promoted, and
+	/// the offset it stops at.
+	replid2: Option<(String, u64)>,
+	/// Kept from the first time a replica attaches or this server syncs with
+	/// a primary.
+	backlog: Option<Backlog>,
+	replicas: Vec<ReplicaLink>,
+	primary: Option<PrimaryLink>,
+	/// Ports replicas announced with REPLCONF before sending PSYNC.
+	listening_ports: HashMap<i64, u16>,
+	/// The commands of the open atomic group.
+	group: Option<Vec<Bytes>>,
+	failover: Option<Failover>,
+	/// Holds writes back for a cluster manual failover.
+	pause: Option<JoinHandle<()>>,
+}
+
+#[derive(Debug)]
+pub struct Replication {
+	state: Mutex<ReplicationState>,
+	/// Whether write commands are streamed into the backlog, so the order
+	/// they apply in must be the order they are streamed in.
+	active: AtomicBool,
+	/// Held by write commands while `active`, on the lock stripes of their
+	/// keys: writes to the same key apply in the order they are streamed in,
+	/// while writes to unrelated keys, which commute, run side by side.
+	/// Commands without keys, and FAILOVER, hold it whole.
+	order: StorageLocks,
+	/// Set while `pause` holds writes back.
+	paused: AtomicBool,
+}
+
+impl Default for Replication {
+	fn default() -> Self {
+		Self::new()
+	}
+}
+
+impl Replication {
+	pub fn new() -> Self {
+		Self {
+			state: Mutex::new(ReplicationState {
+				replid: new_replid(),
+				offset: 0,
+				fsynced: 0,
+				replid2: None,
+				backlog: None,
+				replicas: Vec::new(),
+				primary: None,
+				listening_ports: HashMap::new(),
+				group: None,
+				failover: None,
+				pause: None,
+			}),
+			active: AtomicBool::new(false),
+			order: StorageLocks::new(),
+			paused: AtomicBool::new(false),
+		}
+	}
+
+	/// Keep other write commands to the keys of `args` out until the
+	/// returned guard is dropped, when `name` is a write command that will be
+	/// streamed. A write without keys keeps every other write out. The caller
+	/// holds the exec lock for reading.
+	pub async fn order_guard(&self, name: &str, args: &[Bytes]) -> Option<StorageLockGuard> {
+		if !self.active.load(Ordering::Acquire) || !GCTX!(cmd_table).is_write(name) {
+			return None;
+		}
+		let keys = acl::command_keys(name, args);
+		let lock = if keys.is_empty() {
+			StorageLock::global_write()
+		} else {
+			StorageLock::write_keys(keys.into_iter().cloned())
+		};
+		Some(self.order.acquire(&lock).await)
+	}
+
+	/// Stream the command `args`, or hold it back for the open atomic group.
+	pub fn propagate(&self, args: &[Bytes]) {
+		if !self.active.load(Ordering::Acquire) {
+			return;
+		}
+		let frame = encode_command(args);
+		let mut state = self.state.lock().unwrap();
+		if state.primary.is_some() {
+			return;
+		}
+		match state.group.as_mut() {
+			Some(group) => group.push(frame),
+			None => state.feed(frame),
+		}
+	}
+
+	/// Start holding back the commands of an atomic group. The caller holds
+	/// the exec lock exclusively until `end_group`.
+	pub fn begin_group(&self) {
+		if self.active.load(Ordering::Acquire) {
+			self.state.lock().unwrap().group = Some(Vec::new());
+		}
+	}
+
+	/// Stream the commands of the atomic group, if it was committed.
+	pub fn end_group(&self, committed: bool) {
+		let mut state = self.state.lock().unwrap();
+		let Some(group) = state.group.take() else {
+			return;
+		};
+		if !committed || group.is_empty() {
+			return;
+		}
+		if group.len() == 1 {
+			state.feed(group.into_iter().next().unwrap());
+			return;
+		}
+		state.feed(encode_command(&[Bytes::from_static(b"MULTI")]));
+		for frame in group {
+			state.feed(frame);
+		}
+		state.feed(encode_command(&[Bytes::from_static(b"EXEC")]));
+	}
+
+	/// Remember the port the replica on connection `client_id` listens on.
+	pub fn set_listening_port(&self, client_id: i64, port: u16) {
+		self.state
+			.lock()
+			.unwrap()
+			.listening_ports
+			.insert(client_id, port);
+	}
+
+	/// Forget what connection `client_id` announced, once it closes.
+	pub fn forget_client(&self, client_id: i64) {
+		self.state
+			.lock()
+			.unwrap()
+			.listening_ports
+			.remove(&client_id);
+	}
+
+	/// Attach the replica on connection `client_id`, returning the stream it
+	/// starts at. The caller holds the exec lock exclusively, so no write runs
+	/// until the snapshot the replica gets has been taken.
+	fn attach(&self, client_id: i64, addr: &str, outbox: Outbox<Bytes>) -> (String, u64) {
+		let mut state = self.state.lock().unwrap();
+		let offset = state.offset;
+		state.add_replica(client_id, addr, outbox, offset);
+		if state.backlog.is_none() {
+			state.backlog = Some(Backlog::new(offset));
+			self.active.store(true, Ordering::Release);
+		}
+		(state.replid.clone(), offset)
+	}
+
+	/// Attach the replica on connection `client_id` that asked to resume
+	/// stream `replid` from `psync_offset`, the offset of the first byte it
+	/// lacks, and queue the commands it missed. Returns the ID of the stream
+	/// it continues, or None if it needs a full resync.
+	fn resume(
+		&self,
+		client_id: i64,
+		addr: &str,
+		outbox: Outbox<Bytes>,
+		replid: &str,
+		psync_offset: u64,
+	) -> Option<String> {
+		let mut state = self.state.lock().unwrap();
+		let offset = psync_offset.checked_sub(1)?;
+		let known = replid == state.replid
+			|| state
+				.replid2
+				.as_ref()
+				.is_some_and(|(replid2, end)| replid == replid2 && offset <= *end);
+		if !known {
+			return None;
+		}
+		let missed = state.backlog.as_ref()?.since(offset)?;
+		for frame in missed {
+			let size = frame.len();
+			outbox.send(frame, size);
+		}
+		state.add_replica(client_id, addr, outbox, offset);
+		Some(state.replid.clone())
+	}
+
+	fn detach(&self, client_id: i64) {
+		let mut state = self.state.lock().unwrap();
+		state.replicas.retain(|link| link.client_id != client_id);
+	}
+
+	fn ack(&self, client_id: i64, offset: u64, fack: Option<u64>) {
+		let mut state = self.state.lock().unwrap();
+		if let Some(link) = state
+			.replicas
+			.iter_mut()
+			.find(|link| link.client_id == client_id)
+		{
+			link.ack_offset = offset;
+			if let Some(fack) = fack {
+				link.fack_offset = fack;
+			}
+			link.last_ack = Instant::now();
+		}
+	}
+
+	/// Drop every attached replica and start a new stream, so each replica
+	/// connects again and gets a full copy of a dataset that was replaced as
+	/// a whole.
+	pub fn disconnect_replicas(&self) {
+		let mut state = self.state.lock().unwrap();
+		if !state.replicas.is_empty() {
+			info!(
+				"Disconnecting {} replicas after the dataset was replaced",
+				state.replicas.len()
+			);
+		}
+		state.replicas.clear();
+		state.replid = new_replid();
+		state.replid2 = None;
+		let offset = state.offset;
+		if let Some(backlog) = state.backlog.as_mut() {
+			*backlog = Backlog::new(offset);
+		}
+	}
+
+	/// Replicate from `host:port`, replacing the primary this server
+	/// replicated from, if any.
+	pub fn replicate_from(&self, host: String, port: u16, storage: Storage) {
+		let mut state = self.state.lock().unwrap();
+		if let Some(primary) = state.primary.take() {
+			primary.task.abort();
+		}
+		info!("Replicating from primary {}:{}", host, port);
+		let task = tokio::spawn(run_primary_link(host.clone(), port, storage));
+		state.primary = Some(PrimaryLink {
+			host,
+			port,
+			status: LinkStatus::Connecting,
+			last_io: Instant::now(),
+			task,
+		});
+	}
+
+	/// Stop replicating and keep the dataset as it is. The stream continues
+	/// under a new ID, so replicas of the old primary can resume from this
+	/// server. Returns false if this server was not a replica.
+	pub fn stop_replicating(&self) -> bool {
+		let mut state = self.state.lock().unwrap();
+		let Some(primary) = state.primary.take() else {
+			return false;
+		};
+		primary.task.abort();
+		let old = std::mem::replace(&mut state.replid, new_replid());
+		state.replid2 = Some((old, state.offset));
+		info!(
+			"Stopped replicating from primary {}:{}",
+			primary.host, primary.port
+		);
+		true
+	}
+
+	/// Whether this server replicates from a primary.
+	pub fn is_replica(&self) -> bool {
+		self.state.lock().unwrap().primary.is_some()
+	}
+
+	/// Whether this server replicates from `host:port`.
+	pub fn is_replica_of(&self, host: &str, port: u16) -> bool {
+		self.state
+			.lock()
+			.unwrap()
+			.primary
+			.as_ref()
+			.is_some_and(|primary| primary.host == host && primary.port == port)
+	}
+
+	/// Whether this server is a primary, or a replica whose link to its
+	/// primary is up.
+	fn can_serve_replicas(&self) -> bool {
+		self.state
+			.lock()
+			.unwrap()
+			.primary
+			.as_ref()
+			.is_none_or(|primary| primary.status == LinkStatus::Connected)
+	}
+
+	fn set_link_status(&self, status: LinkStatus) {
+		let mut state = self.state.lock().unwrap();
+		if let Some(primary) = state.primary.as_mut() {
+			primary.status = status;
+			primary.last_io = Instant::now();
+		}
+	}
+
+	/// The ID and offset to ask the primary to resume from: those of the
+	/// stream this server last applied or produced.
+	fn psync_position(&self) -> (String, u64) {
+		let state = self.state.lock().unwrap();
+		(state.replid.clone(), state.offset)
+	}
+
+	/// Start the stream `replid` at `offset`, after loading the snapshot of
+	/// the primary.
+	fn synced(&self, replid: String, offset: u64) {
+		let mut state = self.state.lock().unwrap();
+		state.replid = replid;
+		state.replid2 = None;
+		state.offset = offset;
+		state.fsynced = 0;
+		state.backlog = Some(Backlog::new(offset));
+		self.active.store(true, Ordering::Release);
+		state.connected();
+	}
+
+	/// Continue the stream from the primary where it broke off. A primary
+	/// that was promoted since continues it under `replid`.
+	fn resumed(&self, replid: Option<String>) {
+		let mut state = self.state.lock().unwrap();
+		if let Some(replid) = replid
+			&& replid != state.replid
+		{
+			let old = std::mem::replace(&mut state.replid, replid);
+			state.replid2 = Some((old, state.offset));
+		}
+		if state.backlog.is_none() {
+			state.backlog = Some(Backlog::new(state.offset));
+			self.active.store(true, Ordering::Release);
+		}
+		state.connected();
+	}
+
+	/// Count `frame` of the stream from the primary as applied and stream it
+	/// on. The caller holds the exec lock, like a primary streaming a write.
+	fn applied(&self, frame: Bytes) {
+		let mut state = self.state.lock().unwrap();
+		if let Some(primary) = state.primary.as_mut() {
+			primary.last_io = Instant::now();
+		}
+		state.feed(frame);
+	}
+
+	/// Bytes of the command stream produced or applied so far.
+	pub fn offset(&self) -> u64 {
+		self.state.lock().unwrap().offset
+	}
+
+	/// The stream and the offset in it that the writes applied so far reach,
+	/// to pass to `flushed` once they are durable.
+	pub fn position(&self) -> (String, u64) {
+		let state = self.state.lock().unwrap();
+		(state.replid.clone(), state.offset)
+	}
+
+	/// Count the stream up to `position` as flushed to the write-ahead log,
+	/// unless the dataset was replaced by a full resync since.
+	pub fn flushed(&self, position: (String, u64)) {
+		let mut state = self.state.lock().unwrap();
+		let (replid, offset) = position;
+		if replid == state.replid
+			|| state
+				.replid2
+				.as_ref()
+				.is_some_and(|(old, _)| *old == replid)
+		{
+			state.fsynced = state.fsynced.max(offset);
+		}
+	}
+
+	fn fsynced(&self) -> u64 {
+		self.state.lock().unwrap().fsynced
+	}
+
+	/// Hold writes back for up to `timeout`, or until `resume_writes`, so a
+	/// replica can catch up before a cluster manual failover promotes it.
+	pub fn pause_writes(&self, timeout: Duration) {
+		let mut state = self.state.lock().unwrap();
+		if let Some(pause) = state.pause.take() {
+			pause.abort();
+		}
+		self.paused.store(false, Ordering::Release);
+		state.pause = Some(tokio::spawn(async move {
+			let replication = GCTX!(replication);
+			// As for FAILOVER: plain write commands wait for `order`, and
+			// transactions and scripts for the exec lock.
+			let _paused = GCTX!(exec_lock).read().await;
+			let _order = replication
+				.order
+				.acquire(&StorageLock::global_write())
+				.await;
+			replication.paused.store(true, Ordering::Release);
+			tokio::time::sleep(timeout).await;
+			replication.paused.store(false, Ordering::Release);
+		}));
+	}
+
+	/// Let the writes `pause_writes` held back run again.
+	pub fn resume_writes(&self) {
+		if let Some(pause) = self.state.lock().unwrap().pause.take() {
+			pause.abort();
+		}
+		self.paused.store(false, Ordering::Release);
+	}
+
+	/// Whether `pause_writes` holds writes back: the offset stays put until
+	/// it stops.
+	pub fn writes_paused(&self) -> bool {
+		self.paused.load(Ordering::Acquire)
+	}
+
+	/// Start handing the primary role to the replica at `target`, or to the
+	/// replica that acknowledged the most of the stream. The replica is
+	/// promoted once it has caught up, or after `timeout` if `force` is set.
+	pub fn failover(
+		&self,
+		target: Option<(String, u16)>,
+		timeout: Option<Duration>,
+		force: bool,
+		storage: Storage,
+	) -> Result<(), String> {
+		let mut state = self.state.lock().unwrap();
+		if state.primary.is_some() {
+			return Err("ERR FAILOVER is not valid when server is a replica.".to_string());
+		}
+		if state.failover.is_some() {
+			return Err("ERR FAILOVER already in progress.".to_string());
+		}
+		let (host, port) = match target {
+			Some((host, port)) => {
+				if !state.replicas.iter().any(|link| link.is_at(&host, port)) {
+					return Err("ERR FAILOVER target HOST and PORT is not a replica.".to_string());
+				}
+				(host, port)
+			}
+			None => state
+				.replicas
+				.iter()
+				.filter_map(|link| link.listening_port.map(|port| (link, port)))
+				.max_by_key(|(link, _)| link.ack_offset)
+				.map(|(link, port)| (split_addr(&link.addr).0.to_string(), port))
+				.ok_or("ERR FAILOVER requires connected replicas.")?,
+		};
+		info!("Starting a failover to replica {}:{}", host, port);
+		let task = tokio::spawn(run_failover(host, port, timeout, force, storage));
+		state.failover = Some(Failover {
+			status: FailoverStatus::WaitingForSync,
+			task,
+		});
+		Ok(())
+	}
+
+	/// Abort the failover that is waiting for its target to catch up, and
+	/// let writes run again.
+	pub fn abort_failover(&self) -> Result<(), String> {
+		let mut state = self.state.lock().unwrap();
+		match state.failover.as_ref().map(|failover| failover.status) {
+			None => Err("ERR No failover in progress.".to_string()),
+			Some(FailoverStatus::InProgress) => {
+				Err("ERR FAILOVER is promoting its target and can't be aborted.".to_string())
+			}
+			Some(FailoverStatus::WaitingForSync) => {
+				if let Some(failover) = state.failover.take() {
+					failover.task.abort();
+				}
+				info!("Aborted the failover");
+				Ok(())
+			}
+		}
+	}
+
+	fn set_failover_status(&self, status: FailoverStatus) {
+		if let Some(failover) = self.state.lock().unwrap().failover.as_mut() {
+			failover.status = status;
+		}
+	}
+
+	fn end_failover(&self) {
+		self.state.lock().unwrap().failover = None;
+	}
+
+	/// Ask every replica to acknowledge its offset, returning the offset
+	/// that covers the request.
+	fn request_ack(&self) -> u64 {
+		let mut state = self.state.lock().unwrap();
+		state.feed(encode_command(&[
+			Bytes::from_static(b"REPLCONF"),
+			Bytes::from_static(b"GETACK"),
+			Bytes::from_static(b"*"),
+		]));
+		state.offset
+	}
+
+	/// The offset the replica at `host:port` last acknowledged, or None if it
+	/// is no longer attached.
+	fn acked_by(&self, host: &str, port: u16) -> Option<u64> {
+		self.state
+			.lock()
+			.unwrap()
+			.replicas
+			.iter()
+			.find(|link| link.is_at(host, port))
+			.map(|link| link.ack_offset)
+	}
+
+	/// How many attached replicas have flushed the stream up to `offset` to
+	/// their write-ahead log, and how many are attached.
+	fn fsynced_at(&self, offset: u64) -> (usize, usize) {
+		let state = self.state.lock().unwrap();
+		let fsynced = state
+			.replicas
+			.iter()
+			.filter(|link| link.fack_offset >= offset)
+			.count();
+		(fsynced, state.replicas.len())
+	}
+
+	/// Wait until `numreplicas` replicas have flushed the stream as far as it
+	/// goes now, which covers every write a client was answered for, to
+	/// their write-ahead log, or until `timeout` runs out. Returns how many
+	/// replicas did.
+	pub async fn wait_fsynced(&self, numreplicas: usize, timeout: Option<Duration>) -> usize {
+		let offset = self.offset();
+		let deadline = timeout.map(|timeout| Instant::now() + timeout);
+		let mut asked = false;
+		loop {
+			let (acked, attached) = self.fsynced_at(offset);
+			if acked >= numreplicas || deadline.is_some_and(|deadline| Instant::now() >= deadline) {
+				return acked;
+			}
+			// Replicas acknowledge once a second on their own; ask them to
+			// do so now, which also makes them flush their log.
+			if !asked && attached > 0 {
+				self.request_ack();
+				asked = true;
+			}
+			tokio::time::sleep(ACK_POLL_INTERVAL).await;
+		}
+	}
+
+	/// The role of this server and the servers it replicates with.
+	pub fn role(&self) -> Role {
+		let state = self.state.lock().unwrap();
+		match state.primary.as_ref() {
+			Some(primary) => Role::Replica {
+				host: primary.host.clone(),
+				port: primary.port,
+				link: match primary.status {
+					LinkStatus::Connecting => "connecting",
+					LinkStatus::Sync => "sync",
+					LinkStatus::Connected => "connected",
+				},
+				offset: state.offset,
+			},
+			None => Role::Primary {
+				offset: state.offset,
+				replicas: state
+					.replicas
+					.iter()
+					.map(|link| {
+						let (ip, port) = split_addr(&link.addr);
+						(
+							ip.to_string(),
+							link.listening_port.map_or(port, |port| port.to_string()),
+							link.ack_offset,
+						)
+					})
+					.collect(),
+			},
+		}
+	}
+
+	/// Fields of the Replication section of INFO.
+	pub fn info(&self) -> Vec<(String, String)> {
+		let state = self.state.lock().unwrap();
+		let mut fields = Vec::new();
+		match state.primary.as_ref() {
+			Some(primary) => {
+				fields.push(("role".to_string(), "slave".to_string()));
+				fields.push(("master_host".to_string(), primary.host.clone()));
+				fields.push(("master_port".to_string(), primary.port.to_string()));
+				fields.push((
+					"master_link_status".to_string(),
+					if primary.status == LinkStatus::Connected {
+						"up"
+					} else {
+						"down"
+					}
+					.to_string(),
+				));
+				fields.push((
+					"master_last_io_seconds_ago".to_string(),
+					primary.last_io.elapsed().as_secs().to_string(),
+				));
+				fields.push((
+					"master_sync_in_progress".to_string(),
+					((primary.status == LinkStatus::Sync) as u8).to_string(),
+				));
+				fields.push(("slave_repl_offset".to_string(), state.offset.to_string()));
+			}
+			None => fields.push(("role".to_string(), "master".to_string())),
+		}
+		fields.push((
+			"connected_slaves".to_string(),
+			state.replicas.len().to_string(),
+		));
+		for (i, link) in state.replicas.iter().enumerate() {
+			let (ip, port) = split_addr(&link.addr);
+			fields.push((
+				format!("slave{}", i),
+				format!(
+					"ip={},port={},state=online,offset={},lag={}",
+					ip,
+					link.listening_port.map_or(port, |port| port.to_string()),
+					link.ack_offset,
+					link.last_ack.elapsed().as_secs()
+				),
+			));
+		}
+		fields.push((
+			"master_failover_state".to_string(),
+			match state.failover.as_ref().map(|failover| failover.status) {
+				None => "no-failover",
+				Some(FailoverStatus::WaitingForSync) => "waiting-for-sync",
+				Some(FailoverStatus::InProgress) => "failover-in-progress",
+			}
+			.to_string(),
+		));
+		let (replid2, second_offset) = match state.replid2.as_ref() {
+			Some((replid2, end)) => (replid2.clone(), (end + 1).to_string()),
+			None => ("0".repeat(40), "-1".to_string()),
+		};
+		fields.push(("master_replid".to_string(), state.replid.clone()));
+		fields.push(("master_replid2".to_string(), replid2));
+		fields.push(("master_repl_offset".to_string(), state.offset.to_string()));
+		fields.push(("second_repl_offset".to_string(), second_offset));
+		let (first_byte, histlen) = state
+			.backlog
+			.as_ref()
+			.map_or((0, 0), |backlog| (backlog.start + 1, backlog.len));
+		fields.push((
+			"repl_backlog_active".to_string(),
+			(state.backlog.is_some() as u8).to_string(),
+		));
+		fields.push((
+			"repl_backlog_size".to_string(),
+			server_config!(repl_backlog_size).to_string(),
+		));
+		fields.push((
+			"repl_backlog_first_byte_offset".to_string(),
+			first_byte.to_string(),
+		));
+		fields.push(("repl_backlog_histlen".to_string(), histlen.to_string()));
+		fields
+	}
+}
+
+impl ReplicationState {
+	fn feed(&mut self, frame: Bytes) {
+		self.offset += frame.len() as u64;
+		// A replica whose connection closed, or that broke its output
+		// buffer limits, is detached by its own task.
+		for link in &self.replicas {
+			link.outbox.send(frame.clone(), frame.len());
+		}
+		if let Some(backlog) = self.backlog.as_mut() {
+			backlog.push(frame, server_config!(repl_backlog_size));
+		}
+	}
+
+	fn add_replica(&mut self, client_id: i64, addr: &str, outbox: Outbox<Bytes>, offset: u64) {
+		let listening_port = self.listening_ports.get(&client_id).copied();
+		self.replicas.push(ReplicaLink {
+			client_id,
+			addr: addr.to_string(),
+			listening_port,
+			outbox,
+			ack_offset: offset,
+			fack_offset: 0,
+			last_ack: Instant::now(),
+		});
+	}
+
+	fn connected(&mut self) {
+		if let Some(primary) = self.primary.as_mut() {
+			primary.status = LinkStatus::Connected;
+			primary.last_io = Instant::now();
+		}
+	}
+}
+
+/// Refuse write command `name` from connection `client_id` on a read-only
+/// replica, unless the connection sent READWRITE.
+pub fn check_write(name: &str, client_id: i64) -> Result<(), String> {
+	if server_config!(replica_read_only)
+		&& GCTX!(cmd_table).is_write(name)
+		&& GCTX!(replication).is_replica()
+		&& !GCTX!(client_sessions).is_readwrite(client_id)
+	{
+		return Err(READONLY_REPLICA.to_string());
+	}
+	Ok(())
+}
+
+/// Stream the deletion of `key`, which storage found expired, so replicas
+/// delete it too.
+pub fn expired(key: &Bytes) {
+	GCTX!(replication).propagate(&[Bytes::from_static(b"DEL"), key.clone()]);
+}
+
+/// Stream the write command `name` that ran with `args` and replied
+/// `response` to the replicas, with arguments that make the replicas
+/// produce the same result.
+pub fn after_command(name: &str, args: &[Bytes], response: &RespValue) {
+	let replication = GCTX!(replication);
+	if !replication.active.load(Ordering::Acquire)
+		|| !GCTX!(cmd_table).is_write(name)
+		|| NOT_STREAMED_CMDS.contains(&name)
+	{
+		return;
+	}
+	let mut command = Vec::with_capacity(args.len() + 1);
+	command.push(Bytes::copy_from_slice(name.as_bytes()));
+	command.extend(args.iter().cloned());
+	match name {
+		// A replica must add the entry under the ID the primary gave it.
+		"XADD" => {
+			if let RespValue::BulkString(id) = response {
+				command[xadd_id_index(args) + 1] = id.clone();
+			}
+		}
+		// A replica applies the read the primary did; it never waits.
+		"XREADGROUP" => {
+			if let Some(i) = args
+				.iter()
+				.take_while(|arg| !arg.eq_ignore_ascii_case(b"STREAMS"))
+				.position(|arg| arg.eq_ignore_ascii_case(b"BLOCK"))
+			{
+				command.drain(i + 1..(i + 3).min(command.len()));
+			}
+		}
+		_ => {}
+	}
+	replication.propagate(&command);
+}
+
+/// The index of the entry ID among the arguments of XADD.
+fn xadd_id_index(args: &[Bytes]) -> usize {
+	let mut i = 1;
+	while i < args.len() {
+		let arg = args[i].to_ascii_uppercase();
+		match arg.as_slice() {
+			b"NOMKSTREAM" => i += 1,
+			b"MAXLEN" | b"MINID" => {
+				i += 1;
+				if args
+					.get(i)
+					.is_some_and(|arg| arg.as_ref() == b"=" || arg.as_ref() == b"~")
+				{
+					i += 1;
+				}
+				i += 1;
+				if args
+					.get(i)
+					.is_some_and(|arg| arg.eq_ignore_ascii_case(b"LIMIT"))
+				{
+					i += 2;
+				}
+			}
+			_ => break,
+		}
+	}
+	i.min(args.len().saturating_sub(1))
+}
+
+/// Serve the replica that sent PSYNC with `args` on `socket`: attach it,
+/// send it the commands it missed or a snapshot of the dataset, then stream
+/// every write command to it until the connection closes. `buffer` holds
+/// what the replica sent after PSYNC.
+pub async fn serve_replica(
+	socket: &mut ClientStream,
+	output: &Arc<OutputBuffer>,
+	addr: &str,
+	client_id: i64,
+	storage: &Storage,
+	args: &[Bytes],
+	mut buffer: BytesMut,
+) -> Result<(), Box<dyn std::error::Error + Send + Sync>> {
+	let replication = GCTX!(replication);
+	// A replica passes on the stream of its primary, so it has nothing
+	// consistent to offer until it has synced.
+	if !replication.can_serve_replicas() {
+		socket
+			.write_all(b"-NOMASTERLINK Can't SYNC while not connected with my master\r\n")
+			.await?;
+		return Ok(());
+	}
+	let (sender, mut receiver) = mpsc::unbounded_channel();
+	output.set_replica();
+	let outbox = Outbox::new(sender, output.clone());
+	let _attached = Attached(client_id);
+
+	let requested = String::from_utf8_lossy(&args[0]);
+	let psync_offset = std::str::from_utf8(&args[1])
+		.ok()
+		.and_then(|offset| offset.parse::<u64>().ok());
+	let resumed = psync_offset
+		.and_then(|offset| replication.resume(client_id, addr, outbox.clone(), &requested, offset));
+	if let Some(replid) = resumed {
+		info!(
+			"Replica {} resumed from offset {}",
+			addr,
+			psync_offset.unwrap_or_default()
+		);
+		socket
+			.write_all(format!("+CONTINUE {}\r\n", replid).as_bytes())
+			.await?;
+	} else {
+		let (replid, offset, view, functions) = {
+			// No command runs while the view is taken, so the snapshot holds
+			// exactly the writes streamed before `offset`.
+			let _exclusive = GCTX!(exec_lock).write().await;
+			let view = storage.snapshot_view().await?;
+			let functions = GCTX!(functions).dump();
+			let (replid, offset) = replication.attach(client_id, addr, outbox);
+			(replid, offset, view, functions)
+		};
+		info!(
+			"Replica {} asked for a full resync at offset {}",
+			addr, offset
+		);
+
+		socket
+			.write_all(format!("+FULLRESYNC {} {}\r\n", replid, offset).as_bytes())
+			.await?;
+		// The snapshot goes straight from the view to the socket, so it is
+		// never held whole; it is walked once first for its length.
+		let size = view.size().await?;
+		socket
+			.write_all(format!("${}\r\n", size.len).as_bytes())
+			.await?;
+		// The stream queued meanwhile counts towards the replica's output
+		// buffer limits, which close a replica too slow to take the snapshot.
+		tokio::select! {
+			written = view.write_to(&size, socket) => written?,
+			_ = output.closed() => return Ok(()),
+		}
+		socket
+			.write_all(format!("${}\r\n", functions.len()).as_bytes())
+			.await?;
+		socket.write_all(&functions).await?;
+		info!(
+			"Sent a snapshot of {} keys in {} bytes to replica {}",
+			size.keys, size.len, addr
+		);
+	}
+
+	let mut parser = RespParser::new();
+	loop {
+		tokio::select! {
+			frame = receiver.recv() => match frame {
+				Some(frame) => {
+					socket.write_all(&frame).await?;
+					output.release(frame.len());
+				}
+				None => return Ok(()),
+			},
+			_ = output.closed() => {
+				warn!("Replica {} closed for overcoming its output buffer limits", addr);
+				return Ok(());
+			}
+			read = socket.read_buf(&mut buffer) => {
+				if read? == 0 {
+					info!("Replica {} disconnected", addr);
+					return Ok(());
+				}
+				while let RespParseResult::Complete(value) = parser.parse(&mut buffer) {
+					let Ok(cmd) = ParsedCmd::try_from(value) else {
+						continue;
+					};
+					if cmd.name == "REPLCONF"
+						&& (cmd.args.len() == 2 || cmd.args.len() == 4)
+						&& cmd.args[0].eq_ignore_ascii_case(b"ACK")
+						&& let Ok(offset) = std::str::from_utf8(&cmd.args[1]).unwrap_or("").parse()
+					{
+						// REPLCONF ACK <offset> [FACK <offset>]
+						let fack = match cmd.args.get(2..4) {
+							Some([name, fack]) if name.eq_ignore_ascii_case(b"FACK") => {
+								std::str::from_utf8(fack).unwrap_or("").parse().ok()
+							}
+							_ => None,
+						};
+						replication.ack(client_id, offset, fack);
+					}
+				}
+			}
+		}
+	}
+}
+
+/// Detaches a replica when its connection ends, however it ends.
+struct Attached(i64);
+
+impl Drop for Attached {
+	fn drop(&mut self) {
+		GCTX!(replication).detach(self.0);
+	}
+}
+
+/// Replicate from `host:port` until aborted, connecting again whenever the
+/// link breaks.
+async fn run_primary_link(host: String, port: u16, storage: Storage) {
+	let replication = GCTX!(replication);
+	loop {
+		replication.set_link_status(LinkStatus::Connecting);
+		if let Err(e) = sync_with_primary(&host, port, &storage).await {
+			warn!("Replication link to {}:{} broke: {}", host, port, e);
+		}
+		replication.set_link_status(LinkStatus::Connecting);
+		tokio::time::sleep(RECONNECT_DELAY).await;
+	}
+}
+
+/// Resume the stream of the primary, or load a full copy of its dataset if
+/// it cannot be resumed, then apply the stream until the connection breaks.
+async fn sync_with_primary(host: &str, port: u16, storage: &Storage) -> Result<(), String> {
+	let replication = GCTX!(replication);
+	let mut socket = tokio::time::timeout(CONNECT_TIMEOUT, TcpStream::connect((host, port)))
+		.await
+		.map_err(|_| "timed out connecting".to_string())?
+		.map_err(|e| e.to_string())?;
+
+	let mut handshake = BytesMut::new();
+	let auth = auth_command();
+	if let Some(auth) = &auth {
+		handshake.extend_from_slice(&encode_command(auth));
+	}
+	handshake.extend_from_slice(&encode_command(&[Bytes::from_static(b"PING")]));
+	handshake.extend_from_slice(&encode_command(&[
+		Bytes::from_static(b"REPLCONF"),
+		Bytes::from_static(b"listening-port"),
+		Bytes::from(server_config!(port).to_string()),
+	]));
+	let (replid, offset) = replication.psync_position();
+	handshake.extend_from_slice(&encode_command(&[
+		Bytes::from_static(b"PSYNC"),
+		Bytes::from(replid),
+		Bytes::from((offset + 1).to_string()),
+	]));
+	socket
+		.write_all(&handshake)
+		.await
+		.map_err(|e| e.to_string())?;
+
+	let mut buffer = BytesMut::new();
+	// The stream carries the commands of the primary's clients, which its own
+	// limits admitted.
+	let mut parser = RespParser::with_limits(SERVER_CONF.load().parser_limits());
+	let mut replies = Vec::new();
+	while replies.len() < 3 + auth.is_some() as usize {
+		match parser.parse(&mut buffer) {
+			RespParseResult::Complete(reply) => replies.push(reply),
+			RespParseResult::Incomplete => read_more(&mut socket, &mut buffer).await?,
+			RespParseResult::Error(e) => return Err(e.to_string()),
+		}
+	}
+	if auth.is_some()
+		&& let RespValue::Error(e) = replies.remove(0)
+	{
+		return Err(format!(
+			"primary refused AUTH: {}",
+			String::from_utf8_lossy(&e)
+		));
+	}
+	let reply = match &replies[2] {
+		RespValue::SimpleString(reply) => {
+			parse_psync_reply(reply).ok_or_else(|| format!("unexpected PSYNC reply {:?}", reply))?
+		}
+		RespValue::Error(e) => {
+			return Err(format!(
+				"primary refused PSYNC: {}",
+				String::from_utf8_lossy(e)
+			));
+		}
+		reply => return Err(format!("unexpected PSYNC reply {:?}", reply)),
+	};
+	match reply {
+		PsyncReply::Continue(replid) => {
+			replication.resumed(replid);
+			info!(
+				"Resumed the stream of primary {}:{} at offset {}",
+				host, port, offset
+			);
+		}
+		PsyncReply::FullResync(replid, offset) => {
+			full_resync(&mut socket, &mut buffer, storage, replid, offset).await?;
+			info!(
+				"Loaded the dataset of primary {}:{}, streaming from offset {}",
+				host, port, offset
+			);
+		}
+	}
+
+	let mut ack = tokio::time::interval(ACK_INTERVAL);
+	let mut group: Option<Vec<ParsedCmd>> = None;
+	loop {
+		loop {
+			let value = match parser.parse(&mut buffer) {
+				RespParseResult::Complete(value) => value,
+				RespParseResult::Incomplete => break,
+				RespParseResult::Error(e) => return Err(e.to_string()),
+			};
+			let cmd = ParsedCmd::try_from(value)?;
+			let getack = is_getack(&cmd);
+			apply(storage, cmd, &mut group).await;
+			if getack {
+				// The primary asks on behalf of WAITAOF, so flush what was
+				// applied before answering.
+				if replication.fsynced() < replication.offset()
+					&& let Err(e) = persistence::sync_writes(storage).await
+				{
+					warn!("Failed to flush the stream from the primary: {}", e);
+				}
+				socket
+					.write_all(&ack_frame(replication.offset(), replication.fsynced()))
+					.await
+					.map_err(|e| e.to_string())?;
+			}
+		}
+		tokio::select! {
+			read = socket.read_buf(&mut buffer) => match read {
+				Ok(0) => return Err("primary closed the connection".to_string()),
+				Ok(_) => {}
+				Err(e) => return Err(e.to_string()),
+			},
+			_ = ack.tick() => {
+				socket
+					.write_all(&ack_frame(replication.offset(), replication.fsynced()))
+					.await
+					.map_err(|e| e.to_string())?;
+			}
+		}
+	}
+}
+
+/// The AUTH command to send the primary before anything else, as
+/// `masteruser` with `masterauth`, or None if `masterauth` is not set.
+fn auth_command() -> Option<Vec<Bytes>> {
+	let password = server_config!(masterauth).clone();
+	if password.is_empty() {
+		return None;
+	}
+	let mut auth = vec![Bytes::from_static(b"AUTH")];
+	let user = server_config!(masteruser).clone();
+	if !user.is_empty() {
+		auth.push(Bytes::from(user));
+	}
+	auth.push(Bytes::from(password));
+	Some(auth)
+}
+
+/// Whether `cmd` is the primary asking for the offset this server applied.
+fn is_getack(cmd: &ParsedCmd) -> bool {
+	cmd.name == "REPLCONF"
+		&& cmd
+			.args
+			.first()
+			.is_some_and(|arg| arg.eq_ignore_ascii_case(b"GETACK"))
+}
+
+fn ack_frame(offset: u64, fsynced: u64) -> Bytes {
+	encode_command(&[
+		Bytes::from_static(b"REPLCONF"),
+		Bytes::from_static(b"ACK"),
+		Bytes::from(offset.to_string()),
+		Bytes::from_static(b"FACK"),
+		Bytes::from(fsynced.to_string()),
+	])
+}
+
+/// Read the snapshot and the function libraries that follow FULLRESYNC and
+/// load them in place of the dataset and libraries, then start the stream
+/// `replid` at `offset`.
+async fn full_resync(
+	socket: &mut TcpStream,
+	buffer: &mut BytesMut,
+	storage: &Storage,
+	replid: String,
+	offset: u64,
+) -> Result<(), String> {
+	let replication = GCTX!(replication);
+	replication.set_link_status(LinkStatus::Sync);
+
+	let payload = read_payload(socket, buffer).await?;
+	let loading = loading::begin();
+	let snapshot = Snapshot::decode(&payload).map_err(|e| e.to_string())?;
+	let keys = snapshot.key_count();
+	let functions = read_payload(socket, buffer).await?.freeze();
+	{
+		let _exclusive = GCTX!(exec_lock).write().await;
+		storage
+			.replace_dataset(snapshot, &|progress| loading.progress(progress))
+			.await
+			.map_err(|e| e.to_string())?;
+		GCTX!(tracking).invalidate_all();
+		let restore = [
+			Bytes::from_static(b"FUNCTION"),
+			Bytes::from_static(b"RESTORE"),
+			functions.clone(),
+			Bytes::from_static(b"FLUSH"),
+		];
+		GCTX!(functions)
+			.update(storage, &restore, |libraries| {
+				function::restore(libraries, &functions, RestorePolicy::Flush)
+			})
+			.await?;
+	}
+	// Chained replicas hold a copy of the old dataset.
+	replication.disconnect_replicas();
+	replication.synced(replid, offset);
+	info!("Loaded {} keys from the snapshot of the primary", keys);
+	Ok(())
+}
+
+/// Read a part of the full resync payload, sent as a bulk string without the
+/// trailing CRLF.
+async fn read_payload(socket: &mut TcpStream, buffer: &mut BytesMut) -> Result<BytesMut, String> {
+	let header_end = loop {
+		if let Some(end) = buffer.windows(2).position(|w| w == b"\r\n") {
+			break end;
+		}
+		read_more(socket, buffer).await?;
+	};
+	let len: usize = std::str::from_utf8(&buffer[..header_end])
+		.ok()
+		.and_then(|header| header.strip_prefix('$'))
+		.and_then(|len| len.parse().ok())
+		.ok_or("invalid full resync payload header")?;
+	buffer.advance(header_end + 2);
+	while buffer.len() < len {
+		read_more(socket, buffer).await?;
+	}
+	Ok(buffer.split_to(len))
+}
+
+async fn read_more(socket: &mut TcpStream, buffer: &mut BytesMut) -> Result<(), String> {
+	match socket.read_buf(buffer).await {
+		Ok(0) => Err("primary closed the connection".to_string()),
+		Ok(_) => Ok(()),
+		Err(e) => Err(e.to_string()),
+	}
+}
+
+#[derive(Debug, PartialEq)]
+enum PsyncReply {
+	/// The stream continues, under a new ID if the primary names one.
+	Continue(Option<String>),
+	FullResync(String, u64),
+}
+
+fn parse_psync_reply(reply: &[u8]) -> Option<PsyncReply> {
+	let reply = std::str::from_utf8(reply).ok()?;
+	let mut parts = reply.split(' ');
+	match parts.next()? {
+		"CONTINUE" => Some(PsyncReply::Continue(parts.next().map(str::to_string))),
+		"FULLRESYNC" => {
+			let replid = parts.next()?.to_string();
+			let offset = parts.next()?.parse().ok()?;
+			Some(PsyncReply::FullResync(replid, offset))
+		}
+		_ => None,
+	}
+}
+
+/// Hand the primary role to the replica at `host:port`. Writes stay paused
+/// until it is promoted, so it holds every write this server applied; then
+/// this server replicates from it.
+async fn run_failover(
+	host: String,
+	port: u16,
+	timeout: Option<Duration>,
+	force: bool,
+	storage: Storage,
+) {
+	let replication = GCTX!(replication);
+	// Plain write commands wait for `order`, and transactions and scripts for
+	// the exec lock.
+	let _paused = GCTX!(exec_lock).read().await;
+	let _order = replication
+		.order
+		.acquire(&StorageLock::global_write())
+		.await;
+	let offset = replication.request_ack();
+	let deadline = timeout.map(|timeout| Instant::now() + timeout);
+	loop {
+		let Some(acked) = replication.acked_by(&host, port) else {
+			warn!("Failover target {}:{} disconnected", host, port);
+			replication.end_failover();
+			return;
+		};
+		if acked >= offset {
+			break;
+		}
+		if deadline.is_some_and(|deadline| Instant::now() >= deadline) {
+			if force {
+				warn!(
+					"Failover target {}:{} is at offset {} of {}, promoting it anyway",
+					host, port, acked, offset
+				);
+				break;
+			}
+			warn!(
+				"Failover target {}:{} did not catch up in time, aborting the failover",
+				host, port
+			);
+			replication.end_failover();
+			return;
+		}
+		tokio::time::sleep(FAILOVER_POLL_INTERVAL).await;
+	}
+
+	replication.set_failover_status(FailoverStatus::InProgress);
+	if let Err(e) = promote(&host, port).await {
+		warn!("Failed to promote failover target {}:{}: {}", host, port, e);
+		replication.end_failover();
+		return;
+	}
+	replication.replicate_from(host.clone(), port, storage);
+	replication.end_failover();
+	info!("Failed over to {}:{} at offset {}", host, port, offset);
+}
+
+/// Send REPLICAOF NO ONE to the server at `host:port`.
+async fn promote(host: &str, port: u16) -> Result<(), String> {
+	let mut socket = tokio::time::timeout(CONNECT_TIMEOUT, TcpStream::connect((host, port)))
+		.await
+		.map_err(|_| "timed out connecting".to_string())?
+		.map_err(|e| e.to_string())?;
+	socket
+		.write_all(&encode_command(&[
+			Bytes::from_static(b"REPLICAOF"),
+			Bytes::from_static(b"NO"),
+			Bytes::from_static(b"ONE"),
+		]))
+		.await
+		.map_err(|e| e.to_string())?;
+	let mut buffer = BytesMut::new();
+	let mut parser = RespParser::new();
+	loop {
+		match parser.parse(&mut buffer) {
+			RespParseResult::Complete(RespValue::SimpleString(_)) => return Ok(()),
+			RespParseResult::Complete(RespValue::Error(e)) => {
+				return Err(String::from_utf8_lossy(&e).to_string());
+			}
+			RespParseResult::Complete(reply) => {
+				return Err(format!("unexpected reply {:?}", reply));
+			}
+			RespParseResult::Incomplete => read_more(&mut socket, &mut buffer).await?,
+			RespParseResult::Error(e) => return Err(e.to_string()),
+		}
+	}
+}
+
+/// Apply one command of the stream from the primary. MULTI/EXEC groups are
+/// collected and applied as one atomic group, and only count as applied once
+/// EXEC arrives, so a link that breaks inside a group resumes before it.
+async fn apply(storage: &Storage, cmd: ParsedCmd, group: &mut Option<Vec<ParsedCmd>>) {
+	let replication = GCTX!(replication);
+	match (cmd.name.as_str(), group.as_mut()) {
+		("MULTI", _) => *group = Some(Vec::new()),
+		("EXEC", Some(_)) => {
+			let cmds = group.take().unwrap_or_default();
+			let _exclusive = GCTX!(exec_lock).write().await;
+			match storage.begin_atomic().await {
+				Ok(()) => {
+					for cmd in &cmds {
+						apply_one(storage, cmd).await;
+					}
+					if let Err(e) = storage.commit_atomic().await {
+						warn!("Failed to apply a transaction from the primary: {}", e);
+					}
+				}
+				Err(e) => warn!("Failed to apply a transaction from the primary: {}", e),
+			}
+			replication.applied(encode_command(&[Bytes::from_static(b"MULTI")]));
+			for cmd in &cmds {
+				replication.applied(encode_parsed(cmd));
+			}
+			replication.applied(encode_parsed(&cmd));
+		}
+		(_, Some(cmds)) => cmds.push(cmd),
+		_ => {
+			let _guard = GCTX!(exec_lock).read().await;
+			if cmd.name != "PING" && cmd.name != "REPLCONF" {
+				apply_one(storage, &cmd).await;
+			}
+			replication.applied(encode_parsed(&cmd));
+		}
+	}
+}
+
+/// Encode `cmd` the way the primary streamed it.
+fn encode_parsed(cmd: &ParsedCmd) -> Bytes {
+	let mut args = Vec::with_capacity(cmd.args.len() + 1);
+	args.push(Bytes::copy_from_slice(cmd.name.as_bytes()));
+	args.extend(cmd.args.iter().cloned());
+	encode_command(&args)
+}
+
+async fn apply_one(storage: &Storage, cmd: &ParsedCmd) {
+	let ctx = CmdContext {
+		client_id: REPLICATION_CLIENT_ID,
+		may_block: false,
+	};
+	let response = match GCTX!(cmd_table).get_cmd(&cmd.name) {
+		Some(handler) => handler.execute(storage, &cmd.args, &ctx).await,
+		None => RespValue::error(format!("ERR unknown command '{}'", cmd.name)),
+	};
+	if let RespValue::Error(e) = &response {
+		warn!(
+			"Command {} from the primary failed: {}",
+			cmd.name,
+			String::from_utf8_lossy(e)
+		);
+		return;
+	}
+	tracking::after_command(ctx.client_id, &cmd.name, &cmd.args);
+	access::after_command(&cmd.name, &cmd.args);
+	lazyfree::after_command(&cmd.name, &cmd.args);
+	blocking::after_command(&cmd.name, &cmd.args);
+	persistence::after_command(&cmd.name);
+}
+
+/// Encode `args` as a RESP array of bulk strings, the form commands take on
+/// the wire.
+pub(crate) fn encode_command(args: &[Bytes]) -> Bytes {
+	let mut buf = BytesMut::new();
+	buf.put_slice(format!("*{}\r\n", args.len()).as_bytes());
+	for arg in args {
+		buf.put_slice(format!("${}\r\n", arg.len()).as_bytes());
+		buf.put_slice(arg);
+		buf.put_slice(b"\r\n");
+	}
+	buf.freeze()
+}
+
+/// A new replication ID: 40 random hex digits.
+fn new_replid() -> String {
+	(0..20)
+		.map(|_| format!("{:02x}", rand::random::<u8>()))
+		.collect()
+}
+
+/// Split `ip:port` at the last colon.
+fn split_addr(addr: &str) -> (&str, String) {
+	match addr.rsplit_once(':') {
+		Some((ip, port)) => (ip, port.to_string()),
+		None => (addr, String::new()),
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+
+	#[test]
+	fn test_encode_command() {
+		assert_eq!(
+			encode_command(&[Bytes::from("SET"), Bytes::from("k"), Bytes::from("")]),
+			Bytes::from("*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$0\r\n\r\n")
+		);
+	}
+
+	#[test]
+	fn test_xadd_id_index() {
+		let args = |args: &[&str]| {
+			args.iter()
+				.map(|arg| Bytes::copy_from_slice(arg.as_bytes()))
+				.collect::<Vec<_>>()
+		};
+		assert_eq!(xadd_id_index(&args(&["s", "*", "f", "v"])), 1);
+		assert_eq!(
+			xadd_id_index(&args(&[
+				"s",
+				"NOMKSTREAM",
+				"maxlen",
+				"~",
+				"10",
+				"*",
+				"f",
+				"v"
+			])),
+			5
+		);
+		assert_eq!(
+			xadd_id_index(&args(&["s", "MINID", "0-1", "LIMIT", "5", "*", "f", "v"])),
+			5
+		);
+	}
+
+	#[test]
+	fn test_parse_psync_reply() {
+		assert_eq!(
+			parse_psync_reply(b"FULLRESYNC abc 42"),
+			Some(PsyncReply::FullResync("abc".to_string(), 42))
+		);
+		assert_eq!(
+			parse_psync_reply(b"CONTINUE"),
+			Some(PsyncReply::Continue(None))
+		);
+		assert_eq!(
+			parse_psync_reply(b"CONTINUE abc"),
+			Some(PsyncReply::Continue(Some("abc".to_string())))
+		);
+		assert_eq!(parse_psync_reply(b"FULLRESYNC abc"), None);
+	}
+
+	#[test]
+	fn test_backlog() {
+		let frame = |s: &'static str| Bytes::from_static(s.as_bytes());
+		let mut backlog = Backlog::new(10);
+		backlog.push(frame("aaaa"), 10);
+		backlog.push(frame("bbb"), 10);
+		assert_eq!(backlog.since(10), Some(vec![frame("aaaa"), frame("bbb")]));
+		assert_eq!(backlog.since(14), Some(vec![frame("bbb")]));
+		assert_eq!(backlog.since(17), Some(vec![]));
+		assert_eq!(backlog.since(12), None);
+		assert_eq!(backlog.since(18), None);
+
+		backlog.push(frame("cccccc"), 10);
+		assert_eq!((backlog.start, backlog.len), (14, 9));
+		assert_eq!(backlog.since(10), None);
+		assert_eq!(backlog.since(14), Some(vec![frame("bbb"), frame("cccccc")]));
+	}
+
+	#[test]
+	fn test_new_replid() {
+		let replid = new_replid();
+		assert_eq!(replid.len(), 40);
+		assert!(replid.chars().all(|c| c.is_ascii_hexdigit()));
+	}
+}
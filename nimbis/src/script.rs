@@ -0,0 +1,768 @@
+//! Lua scripting for EVAL, EVALSHA and FCALL.
+//!
+//! Every script runs in a fresh Lua state with only the base, table, string
+//! and math libraries, and `math.random` seeded with a constant, so a script
+//! produces the same writes for the same KEYS and ARGV. `redis.call` and
+//! `redis.pcall` dispatch through the command table; the caller is
+//! responsible for holding the exec lock and the atomic storage group.
+//!
+//! The running script is tracked in [`RunningScript`] so other clients can
+//! get a BUSY reply after `lua_time_limit` and stop it with SCRIPT KILL.
+
+use std::sync::Arc;
+use std::sync::Mutex;
+use std::sync::atomic::AtomicBool;
+use std::sync::atomic::Ordering;
+use std::time::Duration;
+use std::time::Instant;
+
+use bytes::Bytes;
+use dashmap::DashMap;
+use mlua::Function;
+use mlua::HookTriggers;
+use mlua::Lua;
+use mlua::LuaOptions;
+use mlua::MultiValue;
+use mlua::StdLib;
+use mlua::Table;
+use mlua::Value;
+use mlua::VmState;
+use nimbis_resp::RespValue;
+use nimbis_storage::Storage;
+use sha1::Digest;
+use sha1::Sha1;
+
+use crate::GCTX;
+use crate::acl;
+use crate::acllog::Context;
+use crate::client::run_command_hooks;
+use crate::cmd::CmdContext;
+use crate::cmd::ParsedCmd;
+use crate::commandstats;
+use crate::disk;
+use crate::maxmemory;
+use crate::rename;
+use crate::replication;
+
+/// Commands that cannot be called from a script, either because they drive
+/// connection state or because they would re-enter the script engine.
+const NOSCRIPT_CMDS: &[&str] = &[
+	"MULTI",
+	"EXEC",
+	"DISCARD",
+	"RESET",
+	"HELLO",
+	"SUBSCRIBE",
+	"UNSUBSCRIBE",
+	"PSUBSCRIBE",
+	"PUNSUBSCRIBE",
+	"EVAL",
+	"EVALSHA",
+	"EVAL_RO",
+	"EVALSHA_RO",
+	"FCALL",
+	"FCALL_RO",
+	"FUNCTION",
+];
+
+/// Base library functions that can reach the filesystem.
+const REMOVED_GLOBALS: &[&str] = &["dofile", "loadfile"];
+
+/// Number of VM instructions between two checks for SCRIPT KILL.
+const KILL_CHECK_INSTRUCTIONS: u32 = 10_000;
+
+const BUSY_ERROR: &str =
+	"BUSY Redis is busy running a script. You can only call SCRIPT KILL or SHUTDOWN NOSAVE.";
+
+const KILLED_ERROR: &str = "ERR Script killed by user with SCRIPT KILL...";
+
+const READ_ONLY_ERROR: &str = "ERR Write commands are not allowed from read-only scripts.";
+
+/// `redis.call` raises the error reply of `redis.pcall` instead of returning
+/// it. `unpack` keeps scripts written for Lua 5.1 working.
+const PRELUDE: &str = r#"
+unpack = table.unpack
+redis.call = function(...)
+	local reply = redis.pcall(...)
+	if type(reply) == "table" and reply.err ~= nil then
+		error(reply.err, 0)
+	end
+	return reply
+end
+math.randomseed(0)
+"#;
+
+/// Implements both `redis.register_function(name, callback)` and the
+/// `redis.register_function{function_name=..., callback=..., flags=...}`
+/// form. The chunk receives the table to register into.
+const REGISTER_FUNCTION: &str = r#"
+local registry = ...
+redis.register_function = function(name, callback)
+	local flags, description = {}, nil
+	if type(name) == "table" then
+		callback = name.callback
+		flags = name.flags or {}
+		description = name.description
+		name = name.function_name
+	end
+	if type(name) ~= "string" then
+		error("ERR function name argument given to redis.register_function must be a string", 0)
+	end
+	if type(callback) ~= "function" then
+		error("ERR callback argument given to redis.register_function must be a function", 0)
+	end
+	if registry[name] ~= nil then
+		error("ERR Function already exists in the library", 0)
+	end
+	registry[name] = {callback = callback, flags = flags, description = description}
+end
+"#;
+
+/// Lowercase hex SHA1 of a script body, the key used by EVALSHA.
+pub fn sha1_hex(body: &[u8]) -> String {
+	format!("{:x}", Sha1::digest(body))
+}
+
+/// Script bodies known to the server, keyed by their SHA1.
+#[derive(Debug, Default)]
+pub struct ScriptCache {
+	scripts: DashMap<String, Bytes>,
+}
+
+impl ScriptCache {
+	pub fn new() -> Self {
+		Self::default()
+	}
+
+	/// Store `body` and return its SHA1.
+	pub fn load(&self, body: Bytes) -> String {
+		let sha = sha1_hex(&body);
+		self.scripts.entry(sha.clone()).or_insert(body);
+		sha
+	}
+
+	pub fn get(&self, sha: &str) -> Option<Bytes> {
+		self.scripts
+			.get(&sha.to_ascii_lowercase())
+			.map(|body| body.clone())
+	}
+
+	pub fn exists(&self, sha: &str) -> bool {
+		self.scripts.contains_key(&sha.to_ascii_lowercase())
+	}
+
+	pub fn flush(&self) {
+		self.scripts.clear();
+	}
+}
+
+/// Compile `body` without running it, as SCRIPT LOAD does before caching.
+pub fn compile(body: &[u8]) -> Result<(), RespValue> {
+	let lua = Lua::new_with(StdLib::NONE, LuaOptions::default()).map_err(script_error)?;
+	lua.load(body)
+		.set_name("@user_script")
+		.into_function()
+		.map(|_| ())
+		.map_err(script_error)
+}
+
+#[derive(Debug)]
+struct ScriptRun {
+	started: Instant,
+	killed: AtomicBool,
+	wrote: AtomicBool,
+	read_only: bool,
+}
+
+impl ScriptRun {
+	/// Record that the script is about to run a write command, or refuse it
+	/// if the script is read-only.
+	fn begin_write(&self) -> Result<(), RespValue> {
+		if self.read_only {
+			return Err(RespValue::error(READ_ONLY_ERROR));
+		}
+		self.wrote.store(true, Ordering::Relaxed);
+		Ok(())
+	}
+}
+
+/// The script currently running, if any. Scripts hold the exec lock
+/// exclusively, so at most one runs at a time.
+#[derive(Debug, Default)]
+pub struct RunningScript {
+	current: Mutex<Option<Arc<ScriptRun>>>,
+}
+
+impl RunningScript {
+	pub fn new() -> Self {
+		Self::default()
+	}
+
+	fn start(&self, read_only: bool) -> RunGuard<'_> {
+		let run = Arc::new(ScriptRun {
+			started: Instant::now(),
+			killed: AtomicBool::new(false),
+			wrote: AtomicBool::new(false),
+			read_only,
+		});
+		*self.current.lock().unwrap() = Some(run.clone());
+		RunGuard { owner: self, run }
+	}
+
+	/// The BUSY reply other clients get once the running script has exceeded
+	/// `time_limit`. A zero limit disables BUSY replies.
+	pub fn busy_reply(&self, time_limit: Duration) -> Option<RespValue> {
+		if time_limit.is_zero() {
+			return None;
+		}
+		let current = self.current.lock().unwrap();
+		current
+			.as_ref()
+			.filter(|run| run.started.elapsed() >= time_limit)
+			.map(|_| RespValue::error(BUSY_ERROR))
+	}
+
+	/// Ask the running script to stop. Scripts that already wrote to the
+	/// dataset keep running.
+	pub fn kill(&self) -> RespValue {
+		let current = self.current.lock().unwrap();
+		match current.as_ref() {
+			None => RespValue::error("NOTBUSY No scripts in execution right now."),
+			Some(run) if run.wrote.load(Ordering::Relaxed) => RespValue::error(
+				"UNKILLABLE Sorry the script already executed write commands against the dataset. \
+				 You can either wait the script termination or kill the server in a hard way \
+				 using the SHUTDOWN NOSAVE command.",
+			),
+			Some(run) => {
+				run.killed.store(true, Ordering::Relaxed);
+				RespValue::simple_string("OK")
+			}
+		}
+	}
+}
+
+/// Clears [`RunningScript`] when the script finishes, even if the connection
+/// running it goes away.
+struct RunGuard<'a> {
+	owner: &'a RunningScript,
+	run: Arc<ScriptRun>,
+}
+
+impl Drop for RunGuard<'_> {
+	fn drop(&mut self) {
+		*self.owner.current.lock().unwrap() = None;
+	}
+}
+
+/// Returns true if `parsed_cmd` must be served while a script holds the exec
+/// lock, so it runs without taking the lock.
+pub fn runs_while_busy(parsed_cmd: &ParsedCmd) -> bool {
+	matches!(parsed_cmd.name.as_str(), "SCRIPT" | "FUNCTION")
+		&& parsed_cmd
+			.args
+			.first()
+			.is_some_and(|sub| sub.eq_ignore_ascii_case(b"KILL"))
+}
+
+/// Split `numkeys key ... arg ...` into KEYS and ARGV.
+pub fn split_keys(args: &[Bytes]) -> Result<(&[Bytes], &[Bytes]), RespValue> {
+	let numkeys = std::str::from_utf8(&args[0])
+		.ok()
+		.and_then(|s| s.parse::<i64>().ok())
+		.ok_or_else(|| RespValue::error("ERR value is not an integer or out of range"))?;
+	if numkeys < 0 {
+		return Err(RespValue::error("ERR Number of keys can't be negative"));
+	}
+
+	let rest = &args[1..];
+	let numkeys = numkeys as usize;
+	if numkeys > rest.len() {
+		return Err(RespValue::error(
+			"ERR Number of keys can't be greater than number of args",
+		));
+	}
+	Ok(rest.split_at(numkeys))
+}
+
+/// Run `body` with the given KEYS and ARGV and convert its result to a reply.
+/// A `read_only` script gets an error from any write command it calls.
+pub async fn run(
+	body: &[u8],
+	keys: &[Bytes],
+	argv: &[Bytes],
+	read_only: bool,
+	storage: &Storage,
+	ctx: &CmdContext,
+) -> RespValue {
+	let guard = GCTX!(running_script).start(read_only);
+	match run_inner(body, keys, argv, storage, ctx, guard.run.clone()).await {
+		Ok(value) => value,
+		Err(err) => script_error(err),
+	}
+}
+
+/// Run the library `body`, then call the function `name` it registered with
+/// KEYS and ARGV as the callback's two arguments.
+pub async fn call_function(
+	body: &[u8],
+	name: &str,
+	keys: &[Bytes],
+	argv: &[Bytes],
+	read_only: bool,
+	storage: &Storage,
+	ctx: &CmdContext,
+) -> RespValue {
+	let guard = GCTX!(running_script).start(read_only);
+	match call_function_inner(body, name, keys, argv, storage, ctx, guard.run.clone()).await {
+		Ok(value) => value,
+		Err(err) => script_error(err),
+	}
+}
+
+async fn run_inner(
+	body: &[u8],
+	keys: &[Bytes],
+	argv: &[Bytes],
+	storage: &Storage,
+	ctx: &CmdContext,
+	run: Arc<ScriptRun>,
+) -> mlua::Result<RespValue> {
+	let lua = new_lua(storage.clone(), *ctx, run)?;
+	lua.globals().set("KEYS", bytes_table(&lua, keys)?)?;
+	lua.globals().set("ARGV", bytes_table(&lua, argv)?)?;
+
+	let value: Value = lua.load(body).set_name("@user_script").eval_async().await?;
+	Ok(lua_to_resp(&value))
+}
+
+async fn call_function_inner(
+	body: &[u8],
+	name: &str,
+	keys: &[Bytes],
+	argv: &[Bytes],
+	storage: &Storage,
+	ctx: &CmdContext,
+	run: Arc<ScriptRun>,
+) -> mlua::Result<RespValue> {
+	let lua = new_lua(storage.clone(), *ctx, run)?;
+	let registry = install_register_function(&lua)?;
+	lua.load(body).set_name("@user_function").exec()?;
+
+	let entry: Table = registry.get(name)?;
+	let callback: Function = entry.get("callback")?;
+	let value: Value = callback
+		.call_async((bytes_table(&lua, keys)?, bytes_table(&lua, argv)?))
+		.await?;
+	Ok(lua_to_resp(&value))
+}
+
+/// A Lua state with only the libraries scripts may use.
+pub(crate) fn sandbox() -> mlua::Result<Lua> {
+	let lua = Lua::new_with(
+		StdLib::TABLE | StdLib::STRING | StdLib::MATH,
+		LuaOptions::default(),
+	)?;
+	for name in REMOVED_GLOBALS {
+		lua.globals().set(*name, Value::Nil)?;
+	}
+	lua.globals().set("redis", lua.create_table()?)?;
+	Ok(lua)
+}
+
+/// Define `redis.register_function` and return the table it fills, keyed by
+/// function name with `callback`, `flags` and `description` fields.
+pub(crate) fn install_register_function(lua: &Lua) -> mlua::Result<Table> {
+	let registry = lua.create_table()?;
+	lua.load(REGISTER_FUNCTION)
+		.set_name("@register_function")
+		.call::<()>(registry.clone())?;
+	Ok(registry)
+}
+
+fn new_lua(storage: Storage, ctx: CmdContext, run: Arc<ScriptRun>) -> mlua::Result<Lua> {
+	let lua = sandbox()?;
+
+	let hook_run = run.clone();
+	lua.set_hook(
+		HookTriggers::new().every_nth_instruction(KILL_CHECK_INSTRUCTIONS),
+		move |_, _| {
+			if hook_run.killed.load(Ordering::Relaxed) {
+				return Err(mlua::Error::RuntimeError(KILLED_ERROR.to_string()));
+			}
+			Ok(VmState::Continue)
+		},
+	);
+
+	let redis: Table = lua.globals().get("redis")?;
+	let pcall = lua.create_async_function(move |lua, args: MultiValue| {
+		let storage = storage.clone();
+		let run = run.clone();
+		async move {
+			let reply = call_cmd(&storage, &ctx, &run, args).await;
+			resp_to_lua(&lua, reply)
+		}
+	})?;
+	redis.set("pcall", pcall)?;
+	redis.set(
+		"error_reply",
+		lua.create_function(|lua, msg: mlua::String| reply_table(lua, "err", &msg.as_bytes()))?,
+	)?;
+	redis.set(
+		"status_reply",
+		lua.create_function(|lua, msg: mlua::String| reply_table(lua, "ok", &msg.as_bytes()))?,
+	)?;
+
+	lua.load(PRELUDE).set_name("@prelude").exec()?;
+	Ok(lua)
+}
+
+async fn call_cmd(
+	storage: &Storage,
+	ctx: &CmdContext,
+	run: &ScriptRun,
+	args: MultiValue,
+) -> RespValue {
+	let mut argv = Vec::with_capacity(args.len());
+	for arg in args {
+		match arg {
+			Value::String(s) => argv.push(Bytes::copy_from_slice(&s.as_bytes())),
+			Value::Integer(i) => argv.push(Bytes::from(i.to_string())),
+			Value::Number(n) => argv.push(Bytes::from(n.to_string())),
+			_ => {
+				return RespValue::error(
+					"ERR Lua redis lib command arguments must be strings or integers",
+				);
+			}
+		}
+	}
+
+	let Some(name) = argv.first() else {
+		return RespValue::error(
+			"ERR Please specify at least one argument for this redis lib call",
+		);
+	};
+	// Scripts see commands under the names clients use.
+	let Some(name) = rename::resolve(&String::from_utf8_lossy(name).to_uppercase()) else {
+		return RespValue::error("ERR Unknown Redis command called from script");
+	};
+	if NOSCRIPT_CMDS.contains(&name.as_str()) {
+		commandstats::record_rejected(&name);
+		return RespValue::error("ERR This Redis command is not allowed from script");
+	}
+	if let Err(err) = acl::check(ctx.client_id, &name, &argv[1..], Context::Lua)
+		.and_then(|_| disk::check_write(&name))
+		.and_then(|_| maxmemory::check_write(&name))
+		.and_then(|_| replication::check_write(&name, ctx.client_id))
+	{
+		commandstats::record_rejected(&name);
+		return RespValue::error(err);
+	}
+	// A script that wrote can no longer be killed, because its writes cannot
+	// be taken back, and read-only scripts may not write at all.
+	if GCTX!(cmd_table).is_write(&name)
+		&& let Err(err) = run.begin_write()
+	{
+		return err;
+	}
+
+	let start = Instant::now();
+	let response = match GCTX!(cmd_table).get_cmd(&name) {
+		Some(cmd) => cmd.execute(storage, &argv[1..], ctx).await,
+		None => RespValue::error("ERR Unknown Redis command called from script"),
+	};
+	commandstats::record_call(&name, start.elapsed(), response.is_error());
+	run_command_hooks(ctx.client_id, &name, &argv[1..], &response);
+	response
+}
+
+fn bytes_table(lua: &Lua, items: &[Bytes]) -> mlua::Result<Table> {
+	lua.create_sequence_from(
+		items
+			.iter()
+			.map(|item| lua.create_string(item))
+			.collect::<mlua::Result<Vec<_>>>()?,
+	)
+}
+
+fn reply_table(lua: &Lua, field: &str, msg: &[u8]) -> mlua::Result<Table> {
+	let table = lua.create_table()?;
+	table.raw_set(field, lua.create_string(msg)?)?;
+	Ok(table)
+}
+
+/// Convert a command reply to the Lua value a script sees, following the
+/// Redis conversion rules: nil becomes false, status and error replies become
+/// `{ok=...}` and `{err=...}` tables.
+fn resp_to_lua(lua: &Lua, reply: RespValue) -> mlua::Result<Value> {
+	Ok(match reply {
+		RespValue::SimpleString(s) => Value::Table(reply_table(lua, "ok", &s)?),
+		RespValue::Error(e) | RespValue::BulkError(e) => Value::Table(reply_table(lua, "err", &e)?),
+		RespValue::Integer(i) => Value::Integer(i as mlua::Integer),
+		RespValue::BulkString(b)
+		| RespValue::BigNumber(b)
+		| RespValue::VerbatimString { data: b, .. } => Value::String(lua.create_string(&b)?),
+		RespValue::Null => Value::Boolean(false),
+		RespValue::Boolean(b) => Value::Boolean(b),
+		RespValue::Double(d) => Value::String(lua.create_string(d.to_string())?),
+		RespValue::Array(items) | RespValue::Push(items) => sequence_table(lua, items)?,
+		RespValue::Set(items) => sequence_table(lua, items)?,
+		RespValue::Map(entries) => {
+			sequence_table(lua, entries.into_iter().flat_map(|(k, v)| [k, v]))?
+		}
+	})
+}
+
+fn sequence_table(lua: &Lua, items: impl IntoIterator<Item = RespValue>) -> mlua::Result<Value> {
+	let table = lua.create_table()?;
+	for (i, item) in items.into_iter().enumerate() {
+		table.raw_set(i + 1, resp_to_lua(lua, item)?)?;
+	}
+	Ok(Value::Table(table))
+}
+
+/// Convert a script's return value to a reply. Numbers are truncated to
+/// integers and arrays stop at the first nil, as in Redis.
+fn lua_to_resp(value: &Value) -> RespValue {
+	match value {
+		Value::Boolean(true) => RespValue::Integer(1),
+		Value::Integer(i) => RespValue::Integer(*i),
+		Value::Number(n) => RespValue::Integer(*n as i64),
+		Value::String(s) => RespValue::BulkString(Bytes::copy_from_slice(&s.as_bytes())),
+		Value::Table(table) => table_to_resp(table),
+		_ => RespValue::Null,
+	}
+}
+
+fn table_to_resp(table: &Table) -> RespValue {
+	if let Ok(Value::String(err)) = table.raw_get::<Value>("err") {
+		return RespValue::Error(Bytes::copy_from_slice(&err.as_bytes()));
+	}
+	if let Ok(Value::String(ok)) = table.raw_get::<Value>("ok") {
+		return RespValue::SimpleString(Bytes::copy_from_slice(&ok.as_bytes()));
+	}
+
+	let mut items = Vec::new();
+	for i in 1.. {
+		match table.raw_get::<Value>(i) {
+			Ok(Value::Nil) | Err(_) => break,
+			Ok(value) => items.push(lua_to_resp(&value)),
+		}
+	}
+	RespValue::Array(items)
+}
+
+fn script_error(err: mlua::Error) -> RespValue {
+	RespValue::error(error_message(err))
+}
+
+/// The Redis error reply text for a Lua error.
+pub(crate) fn error_message(err: mlua::Error) -> String {
+	match err {
+		mlua::Error::SyntaxError { message, .. } => {
+			format!("ERR Error compiling script: {}", message)
+		}
+		// Errors raised by redis.call already start with a Redis error code.
+		mlua::Error::RuntimeError(message) if has_error_code(&message) => message,
+		mlua::Error::RuntimeError(message) => format!("ERR Error running script: {}", message),
+		mlua::Error::CallbackError { cause, .. } => error_message((*cause).clone()),
+		other => format!("ERR Error running script: {}", other),
+	}
+}
+
+fn has_error_code(message: &str) -> bool {
+	message
+		.split(' ')
+		.next()
+		.is_some_and(|code| !code.is_empty() && code.bytes().all(|b| b.is_ascii_uppercase()))
+}
+
+#[cfg(test)]
+mod tests {
+	use rstest::rstest;
+
+	use super::*;
+
+	#[test]
+	fn test_sha1_hex() {
+		assert_eq!(
+			sha1_hex(b"return 1"),
+			"e0e1f9fabfc9d4800c877a703b823ac0578ff8db"
+		);
+	}
+
+	#[test]
+	fn test_script_cache() {
+		let cache = ScriptCache::new();
+		let sha = cache.load(Bytes::from("return 1"));
+		assert_eq!(cache.get(&sha), Some(Bytes::from("return 1")));
+		assert_eq!(
+			cache.get(&sha.to_uppercase()),
+			Some(Bytes::from("return 1"))
+		);
+		assert_eq!(cache.get("missing"), None);
+		assert!(cache.exists(&sha));
+
+		cache.flush();
+		assert!(!cache.exists(&sha));
+	}
+
+	#[test]
+	fn test_compile() {
+		assert!(compile(b"return redis.call('GET', KEYS[1])").is_ok());
+		let Err(RespValue::Error(err)) = compile(b"return +") else {
+			panic!("expected compile error");
+		};
+		assert!(err.starts_with(b"ERR Error compiling script"));
+	}
+
+	#[test]
+	fn test_running_script_kill() {
+		let running = RunningScript::new();
+		assert!(running.kill().is_error());
+
+		let guard = running.start(false);
+		assert_eq!(running.kill(), RespValue::simple_string("OK"));
+		assert!(guard.run.killed.load(Ordering::Relaxed));
+
+		guard.run.wrote.store(true, Ordering::Relaxed);
+		let RespValue::Error(err) = running.kill() else {
+			panic!("expected UNKILLABLE");
+		};
+		assert!(err.starts_with(b"UNKILLABLE"));
+
+		drop(guard);
+		let RespValue::Error(err) = running.kill() else {
+			panic!("expected NOTBUSY");
+		};
+		assert!(err.starts_with(b"NOTBUSY"));
+	}
+
+	#[test]
+	fn test_read_only_script_rejects_writes() {
+		let running = RunningScript::new();
+		let guard = running.start(true);
+		assert_eq!(
+			guard.run.begin_write(),
+			Err(RespValue::error(READ_ONLY_ERROR))
+		);
+		assert!(!guard.run.wrote.load(Ordering::Relaxed));
+		drop(guard);
+
+		let guard = running.start(false);
+		assert_eq!(guard.run.begin_write(), Ok(()));
+		assert!(guard.run.wrote.load(Ordering::Relaxed));
+	}
+
+	#[test]
+	fn test_running_script_busy_reply() {
+		let running = RunningScript::new();
+		assert!(running.busy_reply(Duration::from_millis(1)).is_none());
+
+		let _guard = running.start(false);
+		std::thread::sleep(Duration::from_millis(5));
+		assert!(running.busy_reply(Duration::from_millis(1)).is_some());
+		assert!(running.busy_reply(Duration::from_secs(60)).is_none());
+		assert!(running.busy_reply(Duration::ZERO).is_none());
+	}
+
+	#[rstest]
+	#[case("SCRIPT", &["KILL"], true)]
+	#[case("SCRIPT", &["kill"], true)]
+	#[case("SCRIPT", &["FLUSH"], false)]
+	#[case("FUNCTION", &["KILL"], true)]
+	#[case("GET", &["KILL"], false)]
+	fn test_runs_while_busy(#[case] name: &str, #[case] args: &[&str], #[case] expected: bool) {
+		let parsed_cmd = ParsedCmd {
+			name: name.to_string(),
+			args: args.iter().map(|a| Bytes::from(a.to_string())).collect(),
+		};
+		assert_eq!(runs_while_busy(&parsed_cmd), expected);
+	}
+
+	#[rstest]
+	#[case(&["0", "a"], Some((0, 1)))]
+	#[case(&["2", "k1", "k2", "a"], Some((2, 1)))]
+	#[case(&["3", "k1", "k2"], None)]
+	#[case(&["-1"], None)]
+	#[case(&["x"], None)]
+	fn test_split_keys(#[case] args: &[&str], #[case] expected: Option<(usize, usize)>) {
+		let args: Vec<Bytes> = args.iter().map(|a| Bytes::from(a.to_string())).collect();
+		let result = split_keys(&args).ok().map(|(k, a)| (k.len(), a.len()));
+		assert_eq!(result, expected);
+	}
+
+	#[rstest]
+	#[case("return 42", RespValue::Integer(42))]
+	#[case("return 3.9", RespValue::Integer(3))]
+	#[case("return 'hi'", RespValue::BulkString(Bytes::from("hi")))]
+	#[case("return true", RespValue::Integer(1))]
+	#[case("return false", RespValue::Null)]
+	#[case("return nil", RespValue::Null)]
+	#[case("return {1, 'a', nil, 2}", RespValue::Array(vec![RespValue::Integer(1), RespValue::BulkString(Bytes::from("a"))]))]
+	#[case(
+		"return redis.status_reply('PONG')",
+		RespValue::SimpleString(Bytes::from("PONG"))
+	)]
+	#[case(
+		"return redis.error_reply('ERR boom')",
+		RespValue::Error(Bytes::from("ERR boom"))
+	)]
+	fn test_lua_to_resp(#[case] script: &str, #[case] expected: RespValue) {
+		let lua = new_lua_for_test();
+		let value: Value = lua.load(script).eval().unwrap();
+		assert_eq!(lua_to_resp(&value), expected);
+	}
+
+	#[test]
+	fn test_resp_to_lua() {
+		let lua = Lua::new();
+		let reply = RespValue::Array(vec![
+			RespValue::Integer(7),
+			RespValue::Null,
+			RespValue::simple_string("OK"),
+		]);
+		let Value::Table(table) = resp_to_lua(&lua, reply).unwrap() else {
+			panic!("expected table");
+		};
+		assert_eq!(table.raw_get::<i64>(1).unwrap(), 7);
+		assert_eq!(table.raw_get::<Value>(2).unwrap(), Value::Boolean(false));
+		let Value::Table(status) = table.raw_get::<Value>(3).unwrap() else {
+			panic!("expected status table");
+		};
+		assert_eq!(status.raw_get::<String>("ok").unwrap(), "OK");
+	}
+
+	#[rstest]
+	#[case("WRONGTYPE Operation against a key", true)]
+	#[case("ERR boom", true)]
+	#[case("user_script:1: attempt to call a nil value", false)]
+	#[case("", false)]
+	fn test_has_error_code(#[case] message: &str, #[case] expected: bool) {
+		assert_eq!(has_error_code(message), expected);
+	}
+
+	fn new_lua_for_test() -> Lua {
+		let lua = Lua::new();
+		let redis = lua.create_table().unwrap();
+		redis
+			.set(
+				"error_reply",
+				lua.create_function(|lua, msg: mlua::String| {
+					reply_table(lua, "err", &msg.as_bytes())
+				})
+				.unwrap(),
+			)
+			.unwrap();
+		redis
+			.set(
+				"status_reply",
+				lua.create_function(|lua, msg: mlua::String| {
+					reply_table(lua, "ok", &msg.as_bytes())
+				})
+				.unwrap(),
+			)
+			.unwrap();
+		lua.globals().set("redis", redis).unwrap();
+		lua
+	}
+}
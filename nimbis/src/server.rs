@@ -1,25 +1,66 @@
+use std::net::SocketAddr;
+use std::path::Path;
+use std::path::PathBuf;
 use std::sync::Arc;
+use std::time::Duration;
 
+use bytes::Bytes;
 use fastrace::trace;
 use log::debug;
 use log::error;
 use log::info;
+use log::warn;
+use nimbis_storage::CompactorSettings;
 use nimbis_storage::Storage;
+use socket2::SockRef;
+use socket2::TcpKeepalive;
+use tokio::io::AsyncWriteExt;
 use tokio::net::TcpListener;
+use tokio::net::TcpSocket;
+use tokio::net::TcpStream;
+use tokio::sync::mpsc;
+use tokio_rustls::TlsAcceptor;
 
 use crate::GCTX;
+use crate::access;
+use crate::acl;
+use crate::bigkeys;
+use crate::bind;
 use crate::client::ClientConnection;
 use crate::client::ClientSessions;
 use crate::client::next_client_session_id;
+use crate::client_eviction;
+use crate::cluster;
 use crate::cmd::CmdContext;
 use crate::cmd::CmdTable;
+use crate::compaction;
 use crate::context::init_global_context;
+use crate::disk;
+use crate::expire;
+use crate::gc;
+use crate::lazyfree;
+use crate::loading;
+use crate::maxmemory;
+use crate::persistence;
+use crate::rename;
+use crate::replication;
 use crate::server_config;
+use crate::threads;
+use crate::tls;
+use crate::tls::ClientStream;
+
+/// How many accepted connections may wait for the server to start their
+/// sessions.
+const ACCEPT_QUEUE: usize = 128;
+
+const MAXCLIENTS_REACHED: &[u8] = b"-ERR max number of clients reached\r\n";
 
 pub struct Server {
 	storage: Arc<Storage>,
 	cmd_table: Arc<CmdTable>,
 	_client_sessions: Arc<ClientSessions>,
+	/// The Redis RDB file to load once the server listens.
+	import_rdb: Option<PathBuf>,
 }
 
 impl Server {
@@ -28,61 +69,309 @@ impl Server {
 	pub async fn new() -> Result<Self, Box<dyn std::error::Error + Send + Sync>> {
 		let client_sessions = Arc::new(ClientSessions::new());
 		init_global_context(client_sessions.clone());
-		let cmd_table = Arc::new(CmdTable::new());
+		let cmd_table = GCTX!(cmd_table).clone();
+		rename::validate(&cmd_table)?;
 
 		let config = crate::config::SERVER_CONF.load();
 		let object_store_url = config.object_store_url.clone();
 		let object_store_options = config.object_store_options.0.clone();
+		// Checked when the config was loaded.
+		let codec = config.value_compression.parse().unwrap_or_default();
+		let compression_threshold = config.value_compression_threshold;
+		let hot_cache_max_keys = config.hot_cache_max_keys;
+		let hot_cache_max_value_size = config.hot_cache_max_value_size;
+		let compactor = CompactorSettings {
+			max_concurrent_compactions: (config.compaction_threads > 0)
+				.then_some(config.compaction_threads),
+		};
 		drop(config);
 
 		let storage = Arc::new(
-			Storage::open_object_store(
+			Storage::open_object_store_with_compactor(
 				&object_store_url,
 				object_store_options
 					.iter()
 					.map(|(key, value)| (key.as_str(), value.as_str())),
 				None,
+				compactor,
 			)
 			.await?,
 		);
+		storage.set_compression(codec, compression_threshold);
+		storage.set_hot_cache(hot_cache_max_keys, hot_cache_max_value_size);
+		GCTX!(functions).load_persisted(&storage).await?;
+		if server_config!(cluster_enabled) {
+			GCTX!(cluster).load(&storage).await?;
+			info!("Cluster node {}", GCTX!(cluster).myid());
+		}
+		let aclfile = server_config!(aclfile).clone();
+		if !aclfile.is_empty() {
+			let text = tokio::fs::read_to_string(&aclfile).await?;
+			GCTX!(acl).load(&text, &cmd_table)?;
+			info!("Loaded ACL users from {}", aclfile);
+		}
+		storage.set_expire_listener(Box::new(|key: &Bytes| {
+			replication::expired(key);
+			access::expired(key);
+			lazyfree::free(key);
+			expire::expired(key);
+		}));
 
 		Ok(Self {
 			storage,
 			cmd_table,
 			_client_sessions: client_sessions,
+			import_rdb: None,
 		})
 	}
 
+	/// Load the Redis RDB file at `path` into storage when `run` starts.
+	/// Clients that connect meanwhile are refused with LOADING.
+	pub fn import_rdb(&mut self, path: PathBuf) {
+		self.import_rdb = Some(path);
+	}
+
+	#[trace]
+	async fn load_rdb(&self, path: &Path) -> Result<(), Box<dyn std::error::Error + Send + Sync>> {
+		let loading = loading::begin();
+		let data = tokio::fs::read(path).await?;
+		info!("Loading {} ({} bytes)", path.display(), data.len());
+		let import = self
+			.storage
+			.import_rdb(&data, &|progress| loading.progress(progress))
+			.await?;
+		info!("Imported {} keys from {}", import.keys, path.display());
+		if import.skipped > 0 {
+			warn!(
+				"Left {} non-zero database keys out of the RDB import",
+				import.skipped
+			);
+		}
+		Ok(())
+	}
+
 	#[trace]
 	pub async fn run(self) -> Result<(), Box<dyn std::error::Error + Send + Sync>> {
-		let addr = format!("{}:{}", server_config!(host), server_config!(port));
-		let listener = TcpListener::bind(&addr).await?;
-		info!("Nimbis server listening on {}", addr);
-
-		loop {
-			debug!("Waiting for accept...");
-			match listener.accept().await {
-				Ok((socket, addr)) => {
-					debug!("New client connected from {}", addr);
-
-					let storage = self.storage.clone();
-					let cmd_table = self.cmd_table.clone();
-					tokio::spawn(async move {
-						let client_id = next_client_session_id();
-						let ctx = CmdContext { client_id };
-						let mut session = ClientConnection::new(socket, storage, cmd_table, ctx);
-						GCTX!(client_sessions).register(client_id);
-						if let Err(e) = session.run().await {
-							debug!("Client session error: {}", e);
-						}
-						GCTX!(client_sessions).unregister(client_id);
-					});
-				}
-				Err(e) => {
-					error!("Error accepting connection: {}", e);
-					tokio::time::sleep(std::time::Duration::from_millis(500)).await;
+		let host = server_config!(host).clone();
+		let backlog = server_config!(tcp_backlog);
+		let (accepted_tx, mut accepted_rx) = mpsc::channel(ACCEPT_QUEUE);
+		threads::start_io_runtime()?;
+		let port = server_config!(port);
+		if port != 0 {
+			for addr in host.with_port(port) {
+				let listener = listen(addr, backlog)?;
+				info!("Nimbis server listening on {}", addr);
+				tokio::spawn(accept_loop(listener, None, accepted_tx.clone()));
+			}
+		}
+		let tls_port = server_config!(tls_port);
+		if tls_port != 0 {
+			let acceptor = tls::load_acceptor()?;
+			for addr in host.with_port(tls_port) {
+				let listener = listen(addr, backlog)?;
+				info!("Nimbis server listening for TLS on {}", addr);
+				tokio::spawn(accept_loop(
+					listener,
+					Some(acceptor.clone()),
+					accepted_tx.clone(),
+				));
+			}
+		}
+		drop(accepted_tx);
+		if server_config!(cluster_enabled) {
+			let cport = cluster::bus_port();
+			let mut listeners = Vec::new();
+			for addr in host.with_port(cport) {
+				listeners.push(listen(addr, backlog)?);
+				info!("Cluster bus listening on {}", addr);
+			}
+			cluster::start((*self.storage).clone(), listeners);
+		}
+		let serving = tokio::spawn(serve_accepted(
+			accepted_rx,
+			self.storage.clone(),
+			self.cmd_table.clone(),
+		));
+		if let Some(path) = &self.import_rdb {
+			self.load_rdb(path).await?;
+		}
+		persistence::start_schedule((*self.storage).clone());
+		persistence::start_everysec((*self.storage).clone());
+		gc::start_gc((*self.storage).clone());
+		compaction::start_compaction((*self.storage).clone());
+		lazyfree::start_lazyfree((*self.storage).clone());
+		expire::start_active_expire((*self.storage).clone());
+		bigkeys::start_bigkeys((*self.storage).clone());
+		client_eviction::start_client_eviction();
+		maxmemory::start_memory_monitor();
+		disk::start_disk_monitor(nimbis_storage::local_store_path(&server_config!(
+			object_store_url
+		)));
+
+		serving.await?;
+		Ok(())
+	}
+}
+
+/// Start a session for every connection the accept loops take.
+async fn serve_accepted(
+	mut accepted: mpsc::Receiver<Accepted>,
+	storage: Arc<Storage>,
+	cmd_table: Arc<CmdTable>,
+) {
+	while let Some((socket, addr, acceptor)) = accepted.recv().await {
+		debug!("New client connected from {}", addr);
+
+		let storage = storage.clone();
+		let cmd_table = cmd_table.clone();
+		let Some(io) = threads::io_runtime() else {
+			tokio::spawn(serve_client(socket, addr, acceptor, storage, cmd_table));
+			continue;
+		};
+		// Move the socket to the reactor of the IO runtime, so its reads
+		// and writes are polled by the IO threads too.
+		let socket = match socket.into_std() {
+			Ok(socket) => socket,
+			Err(e) => {
+				debug!("Failed to hand client {} to the IO threads: {}", addr, e);
+				continue;
+			}
+		};
+		io.spawn(async move {
+			match TcpStream::from_std(socket) {
+				Ok(socket) => serve_client(socket, addr, acceptor, storage, cmd_table).await,
+				Err(e) => debug!("Failed to hand client {} to the IO threads: {}", addr, e),
+			}
+		});
+	}
+}
+
+/// Run the session of an accepted client until it disconnects.
+async fn serve_client(
+	socket: TcpStream,
+	addr: SocketAddr,
+	acceptor: Option<TlsAcceptor>,
+	storage: Arc<Storage>,
+	cmd_table: Arc<CmdTable>,
+) {
+	if let Err(e) = tune_socket(&socket) {
+		debug!("Failed to set socket options for {}: {}", addr, e);
+	}
+	let laddr = socket
+		.local_addr()
+		.map(|laddr| laddr.to_string())
+		.unwrap_or_default();
+	let fd = socket_fd(&socket);
+	// The handshake runs in the client's task so a slow peer does not hold
+	// up accepting others.
+	let mut stream = match acceptor {
+		Some(acceptor) => match acceptor.accept(socket).await {
+			Ok(stream) => ClientStream::Tls(Box::new(stream)),
+			Err(e) => {
+				debug!("TLS handshake with {} failed: {}", addr, e);
+				return;
+			}
+		},
+		None => ClientStream::Plain(socket),
+	};
+	if bind::denies(addr.ip()) {
+		debug!("Protected mode refused client {}", addr);
+		let _ = stream.write_all(bind::DENIED.as_bytes()).await;
+		return;
+	}
+	let client_id = next_client_session_id();
+	if !GCTX!(client_sessions).register(
+		client_id,
+		addr.to_string(),
+		laddr,
+		fd,
+		server_config!(maxclients),
+	) {
+		debug!("Refused client {}: maxclients reached", addr);
+		let _ = stream.write_all(MAXCLIENTS_REACHED).await;
+		return;
+	}
+	let ctx = CmdContext {
+		client_id,
+		may_block: false,
+	};
+	let mut session = ClientConnection::new(stream, storage, cmd_table, ctx);
+	acl::auto_authenticate(client_id);
+	if let Err(e) = session.run().await {
+		debug!("Client session error: {}", e);
+	}
+	GCTX!(client_sessions).unregister(client_id);
+	GCTX!(client_eviction).unregister(client_id);
+	GCTX!(replication).forget_client(client_id);
+}
+
+/// The file descriptor of `socket`, as CLIENT LIST reports it.
+#[cfg(unix)]
+fn socket_fd(socket: &TcpStream) -> i64 {
+	use std::os::fd::AsRawFd;
+	socket.as_raw_fd() as i64
+}
+
+#[cfg(not(unix))]
+fn socket_fd(_socket: &TcpStream) -> i64 {
+	-1
+}
+
+/// Bind a listener on `addr` with a queue of `backlog` pending connections.
+fn listen(addr: SocketAddr, backlog: u32) -> std::io::Result<TcpListener> {
+	let socket = match addr {
+		SocketAddr::V4(_) => TcpSocket::new_v4()?,
+		SocketAddr::V6(_) => TcpSocket::new_v6()?,
+	};
+	#[cfg(unix)]
+	socket.set_reuseaddr(true)?;
+	socket.bind(addr)?;
+	socket.listen(backlog)
+}
+
+/// Apply the `tcp_nodelay` and `tcp_keepalive` settings to an accepted
+/// connection.
+fn tune_socket(socket: &TcpStream) -> std::io::Result<()> {
+	socket.set_nodelay(server_config!(tcp_nodelay))?;
+	let keepalive = server_config!(tcp_keepalive);
+	if keepalive > 0 {
+		// Like Redis, probe after `keepalive` idle seconds and then every
+		// third of it, so a dead peer is found in about twice the time.
+		let idle = Duration::from_secs(keepalive);
+		let interval = Duration::from_secs((keepalive / 3).max(1));
+		SockRef::from(socket)
+			.set_tcp_keepalive(&TcpKeepalive::new().with_time(idle).with_interval(interval))?;
+	}
+	Ok(())
+}
+
+/// A connection taken by an accept loop, with the acceptor of its TLS
+/// listener, if it came through one.
+type Accepted = (TcpStream, SocketAddr, Option<TlsAcceptor>);
+
+/// Accept connections on `listener` and pass them on to `accepted` until
+/// the server stops taking them.
+async fn accept_loop(
+	listener: TcpListener,
+	acceptor: Option<TlsAcceptor>,
+	accepted: mpsc::Sender<Accepted>,
+) {
+	loop {
+		debug!("Waiting for accept...");
+		match listener.accept().await {
+			Ok((socket, addr)) => {
+				if accepted
+					.send((socket, addr, acceptor.clone()))
+					.await
+					.is_err()
+				{
+					return;
 				}
 			}
+			Err(e) => {
+				error!("Error accepting connection: {}", e);
+				tokio::time::sleep(std::time::Duration::from_millis(500)).await;
+			}
 		}
 	}
 }
@@ -0,0 +1,205 @@
+use std::collections::VecDeque;
+use std::sync::Mutex;
+use std::time::Duration;
+use std::time::SystemTime;
+use std::time::UNIX_EPOCH;
+
+use bytes::Bytes;
+use bytes::BytesMut;
+use nimbis_resp::RespValue;
+
+/// Maximum number of arguments kept per entry, matching Redis.
+const SLOWLOG_ENTRY_MAX_ARGC: usize = 32;
+/// Maximum length of each kept argument, matching Redis.
+const SLOWLOG_ENTRY_MAX_STRING: usize = 128;
+
+#[derive(Debug, Clone)]
+pub struct SlowLogEntry {
+	pub id: u64,
+	pub timestamp: i64,
+	pub duration_us: u64,
+	pub args: Vec<Bytes>,
+	pub client_addr: String,
+	pub client_name: Bytes,
+}
+
+impl SlowLogEntry {
+	pub fn to_resp(&self) -> RespValue {
+		RespValue::array(vec![
+			RespValue::integer(self.id as i64),
+			RespValue::integer(self.timestamp),
+			RespValue::integer(self.duration_us as i64),
+			RespValue::array(self.args.iter().cloned().map(RespValue::bulk_string)),
+			RespValue::bulk_string(Bytes::from(self.client_addr.clone())),
+			RespValue::bulk_string(self.client_name.clone()),
+		])
+	}
+}
+
+#[derive(Debug, Default)]
+struct SlowLogInner {
+	next_id: u64,
+	entries: VecDeque<SlowLogEntry>,
+}
+
+/// Bounded in-memory log of commands that exceeded
+/// `slowlog_log_slower_than`. The newest entry is kept at the front.
+#[derive(Debug, Default)]
+pub struct SlowLog {
+	inner: Mutex<SlowLogInner>,
+}
+
+impl SlowLog {
+	pub fn new() -> Self {
+		Self::default()
+	}
+
+	/// Record a command, dropping the oldest entries beyond `max_len`.
+	pub fn record(
+		&self,
+		max_len: usize,
+		name: &str,
+		args: &[Bytes],
+		duration: Duration,
+		client_addr: &str,
+		client_name: Option<Bytes>,
+	) {
+		let timestamp = SystemTime::now()
+			.duration_since(UNIX_EPOCH)
+			.map(|d| d.as_secs() as i64)
+			.unwrap_or_default();
+
+		let mut inner = self.inner.lock().unwrap();
+		let entry = SlowLogEntry {
+			id: inner.next_id,
+			timestamp,
+			duration_us: duration.as_micros() as u64,
+			args: truncate_args(name, args),
+			client_addr: client_addr.to_string(),
+			client_name: client_name.unwrap_or_default(),
+		};
+		inner.next_id += 1;
+		inner.entries.push_front(entry);
+		inner.entries.truncate(max_len);
+	}
+
+	/// Return up to `count` of the newest entries, or all of them when
+	/// `count` is `None`.
+	pub fn get(&self, count: Option<usize>) -> Vec<SlowLogEntry> {
+		let inner = self.inner.lock().unwrap();
+		let count = count.unwrap_or(inner.entries.len());
+		inner.entries.iter().take(count).cloned().collect()
+	}
+
+	pub fn len(&self) -> usize {
+		self.inner.lock().unwrap().entries.len()
+	}
+
+	pub fn is_empty(&self) -> bool {
+		self.len() == 0
+	}
+
+	pub fn reset(&self) {
+		self.inner.lock().unwrap().entries.clear();
+	}
+}
+
+/// Whether a command that took `duration` belongs in the slowlog. A negative
+/// threshold disables the slowlog, zero records every command.
+pub fn is_slow(threshold_us: i64, duration: Duration) -> bool {
+	threshold_us >= 0 && duration.as_micros() >= threshold_us as u128
+}
+
+/// Apply the Redis argument truncation rules: keep at most 32 arguments
+/// (the last one summarising the rest) and at most 128 bytes per argument.
+fn truncate_args(name: &str, args: &[Bytes]) -> Vec<Bytes> {
+	let argv = std::iter::once(Bytes::from(name.to_string()))
+		.chain(args.iter().cloned())
+		.collect::<Vec<_>>();
+	let argc = argv.len().min(SLOWLOG_ENTRY_MAX_ARGC);
+
+	let mut truncated = Vec::with_capacity(argc);
+	for (i, arg) in argv.iter().take(argc).enumerate() {
+		if argc != argv.len() && i == argc - 1 {
+			truncated.push(Bytes::from(format!(
+				"... ({} more arguments)",
+				argv.len() - argc + 1
+			)));
+		} else if arg.len() > SLOWLOG_ENTRY_MAX_STRING {
+			let mut buf = BytesMut::from(&arg[..SLOWLOG_ENTRY_MAX_STRING]);
+			buf.extend_from_slice(
+				format!("... ({} more bytes)", arg.len() - SLOWLOG_ENTRY_MAX_STRING).as_bytes(),
+			);
+			truncated.push(buf.freeze());
+		} else {
+			truncated.push(arg.clone());
+		}
+	}
+
+	truncated
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+
+	fn record(log: &SlowLog, max_len: usize, duration_us: u64) {
+		log.record(
+			max_len,
+			"GET",
+			&[Bytes::from_static(b"key")],
+			Duration::from_micros(duration_us),
+			"127.0.0.1:6000",
+			None,
+		);
+	}
+
+	#[test]
+	fn test_is_slow() {
+		assert!(!is_slow(100, Duration::from_micros(99)));
+		assert!(is_slow(100, Duration::from_micros(100)));
+		assert!(is_slow(0, Duration::ZERO));
+		assert!(!is_slow(-1, Duration::from_secs(1)));
+	}
+
+	#[test]
+	fn test_record_keeps_newest_entries() {
+		let log = SlowLog::new();
+		for _ in 0..5 {
+			record(&log, 3, 1);
+		}
+
+		let ids = log
+			.get(None)
+			.into_iter()
+			.map(|entry| entry.id)
+			.collect::<Vec<_>>();
+		assert_eq!(ids, vec![4, 3, 2]);
+		assert_eq!(log.get(Some(1)).len(), 1);
+
+		log.reset();
+		assert!(log.is_empty());
+		record(&log, 3, 1);
+		assert_eq!(log.get(None)[0].id, 5);
+	}
+
+	#[test]
+	fn test_truncate_args() {
+		let args = (0..40)
+			.map(|i| Bytes::from(i.to_string()))
+			.collect::<Vec<_>>();
+		let truncated = truncate_args("RPUSH", &args);
+		assert_eq!(truncated.len(), SLOWLOG_ENTRY_MAX_ARGC);
+		assert_eq!(truncated[0], Bytes::from_static(b"RPUSH"));
+		assert_eq!(
+			truncated[SLOWLOG_ENTRY_MAX_ARGC - 1],
+			Bytes::from_static(b"... (10 more arguments)")
+		);
+
+		let long = Bytes::from(vec![b'a'; 200]);
+		let truncated = truncate_args("SET", &[Bytes::from_static(b"k"), long]);
+		assert_eq!(truncated.len(), 3);
+		assert!(truncated[2].ends_with(b"... (72 more bytes)"));
+		assert_eq!(truncated[2].len(), SLOWLOG_ENTRY_MAX_STRING + 19);
+	}
+}
@@ -0,0 +1,64 @@
+//! Threads that serve clients and limits on how many commands run at once.
+//!
+//! By default every client connection runs on the runtime threads, next to
+//! the storage engine and background tasks. With `io_threads`, connections
+//! run on a pool of their own: socket reads and writes, RESP parsing and
+//! command execution happen there, while the runtime threads are left to
+//! storage engine flushes and compactions, GC, persistence and replication,
+//! so a burst of clients does not starve them.
+//!
+//! With `command_parallelism`, at most that many commands execute at once
+//! across all clients; the others wait for a slot before they start. `1`
+//! runs one command at a time, like a single-threaded Redis. Either way the
+//! commands of one connection run and reply in the order they were sent.
+
+use std::sync::OnceLock;
+
+use log::info;
+use tokio::runtime::Handle;
+use tokio::runtime::Runtime;
+use tokio::sync::Semaphore;
+use tokio::sync::SemaphorePermit;
+
+use crate::server_config;
+
+static IO_RUNTIME: OnceLock<Runtime> = OnceLock::new();
+static COMMAND_SLOTS: OnceLock<Option<Semaphore>> = OnceLock::new();
+
+/// Build the IO runtime when `io_threads` asks for one. It lives as long as
+/// the process, so a server started again in the same process reuses it.
+pub fn start_io_runtime() -> std::io::Result<()> {
+	let threads = server_config!(io_threads);
+	if threads == 0 || IO_RUNTIME.get().is_some() {
+		return Ok(());
+	}
+	let runtime = tokio::runtime::Builder::new_multi_thread()
+		.worker_threads(threads)
+		.thread_name("nimbis-io")
+		.enable_all()
+		.build()?;
+	info!("Serving clients on {} IO threads", threads);
+	// Dropping a runtime from async code panics, so one that lost a race
+	// is leaked instead.
+	if let Err(runtime) = IO_RUNTIME.set(runtime) {
+		std::mem::forget(runtime);
+	}
+	Ok(())
+}
+
+/// The runtime client connections run on, or `None` when they run on the
+/// runtime threads.
+pub fn io_runtime() -> Option<&'static Handle> {
+	IO_RUNTIME.get().map(Runtime::handle)
+}
+
+/// Wait for a slot to run a command in, when `command_parallelism` limits
+/// them. The slot is released when the permit is dropped.
+pub async fn command_slot() -> Option<SemaphorePermit<'static>> {
+	let slots = COMMAND_SLOTS.get_or_init(|| match server_config!(command_parallelism) {
+		0 => None,
+		slots => Some(Semaphore::new(slots)),
+	});
+	// The semaphore is never closed.
+	slots.as_ref()?.acquire().await.ok()
+}
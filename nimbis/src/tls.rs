@@ -0,0 +1,207 @@
+//! TLS for client connections: the `tls_port` listener's acceptor and the
+//! stream type that lets a session run over plain TCP or TLS alike.
+
+use std::fmt;
+use std::io;
+use std::net::SocketAddr;
+use std::pin::Pin;
+use std::str::FromStr;
+use std::sync::Arc;
+use std::task::Context;
+use std::task::Poll;
+
+use serde::Deserialize;
+use serde::Serialize;
+use tokio::io::AsyncRead;
+use tokio::io::AsyncWrite;
+use tokio::io::ReadBuf;
+use tokio::net::TcpStream;
+use tokio_rustls::TlsAcceptor;
+use tokio_rustls::rustls::RootCertStore;
+use tokio_rustls::rustls::ServerConfig;
+use tokio_rustls::rustls::pki_types::CertificateDer;
+use tokio_rustls::rustls::pki_types::PrivateKeyDer;
+use tokio_rustls::rustls::pki_types::pem::PemObject;
+use tokio_rustls::rustls::server::WebPkiClientVerifier;
+use tokio_rustls::server::TlsStream;
+
+use crate::server_config;
+
+/// Whether clients connecting to `tls_port` must present a certificate
+/// signed by `tls_ca_cert_file`, written like the Redis directive.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Deserialize, Serialize)]
+#[serde(try_from = "String", into = "String")]
+pub enum TlsAuthClients {
+	/// Refuse clients without a valid certificate (mutual TLS).
+	#[default]
+	Yes,
+	/// Never ask clients for a certificate.
+	No,
+	/// Accept clients without a certificate, but verify one if presented.
+	Optional,
+}
+
+impl FromStr for TlsAuthClients {
+	type Err = String;
+
+	fn from_str(s: &str) -> Result<Self, Self::Err> {
+		match s.to_ascii_lowercase().as_str() {
+			"yes" => Ok(TlsAuthClients::Yes),
+			"no" => Ok(TlsAuthClients::No),
+			"optional" => Ok(TlsAuthClients::Optional),
+			_ => Err(format!("Invalid tls_auth_clients value: {}", s)),
+		}
+	}
+}
+
+impl TryFrom<String> for TlsAuthClients {
+	type Error = String;
+
+	fn try_from(value: String) -> Result<Self, Self::Error> {
+		value.parse()
+	}
+}
+
+impl From<TlsAuthClients> for String {
+	fn from(value: TlsAuthClients) -> Self {
+		value.to_string()
+	}
+}
+
+impl fmt::Display for TlsAuthClients {
+	fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+		f.write_str(match self {
+			TlsAuthClients::Yes => "yes",
+			TlsAuthClients::No => "no",
+			TlsAuthClients::Optional => "optional",
+		})
+	}
+}
+
+/// Build the acceptor for `tls_port` from the configured certificate, key
+/// and CA files.
+pub fn load_acceptor() -> Result<TlsAcceptor, String> {
+	let cert_file = server_config!(tls_cert_file).clone();
+	let key_file = server_config!(tls_key_file).clone();
+	let ca_cert_file = server_config!(tls_ca_cert_file).clone();
+	let auth_clients = server_config!(tls_auth_clients);
+
+	let certs = read_certs("tls_cert_file", &cert_file)?;
+	let key = PrivateKeyDer::from_pem_file(&key_file)
+		.map_err(|e| format!("Failed to read tls_key_file '{}': {}", key_file, e))?;
+
+	let builder = ServerConfig::builder();
+	let builder = match auth_clients {
+		TlsAuthClients::No => builder.with_no_client_auth(),
+		TlsAuthClients::Yes | TlsAuthClients::Optional => {
+			let mut roots = RootCertStore::empty();
+			for cert in read_certs("tls_ca_cert_file", &ca_cert_file)? {
+				roots
+					.add(cert)
+					.map_err(|e| format!("Invalid CA certificate in '{}': {}", ca_cert_file, e))?;
+			}
+			let verifier = WebPkiClientVerifier::builder(Arc::new(roots));
+			let verifier = if auth_clients == TlsAuthClients::Optional {
+				verifier.allow_unauthenticated()
+			} else {
+				verifier
+			};
+			builder.with_client_cert_verifier(verifier.build().map_err(|e| e.to_string())?)
+		}
+	};
+	let config = builder
+		.with_single_cert(certs, key)
+		.map_err(|e| format!("Invalid TLS certificate or key: {}", e))?;
+	Ok(TlsAcceptor::from(Arc::new(config)))
+}
+
+/// Read every PEM certificate in `path`, the file set as `field`.
+fn read_certs(field: &str, path: &str) -> Result<Vec<CertificateDer<'static>>, String> {
+	CertificateDer::pem_file_iter(path)
+		.and_then(|certs| certs.collect())
+		.map_err(|e| format!("Failed to read {} '{}': {}", field, path, e))
+}
+
+/// A client connection, over plain TCP or TLS.
+pub enum ClientStream {
+	Plain(TcpStream),
+	Tls(Box<TlsStream<TcpStream>>),
+}
+
+impl ClientStream {
+	pub fn peer_addr(&self) -> io::Result<SocketAddr> {
+		self.tcp().peer_addr()
+	}
+
+	/// The TCP socket under the connection.
+	pub fn tcp(&self) -> &TcpStream {
+		match self {
+			ClientStream::Plain(socket) => socket,
+			ClientStream::Tls(stream) => stream.get_ref().0,
+		}
+	}
+}
+
+impl AsyncRead for ClientStream {
+	fn poll_read(
+		self: Pin<&mut Self>,
+		cx: &mut Context<'_>,
+		buf: &mut ReadBuf<'_>,
+	) -> Poll<io::Result<()>> {
+		match self.get_mut() {
+			ClientStream::Plain(socket) => Pin::new(socket).poll_read(cx, buf),
+			ClientStream::Tls(stream) => Pin::new(stream).poll_read(cx, buf),
+		}
+	}
+}
+
+impl AsyncWrite for ClientStream {
+	fn poll_write(
+		self: Pin<&mut Self>,
+		cx: &mut Context<'_>,
+		buf: &[u8],
+	) -> Poll<io::Result<usize>> {
+		match self.get_mut() {
+			ClientStream::Plain(socket) => Pin::new(socket).poll_write(cx, buf),
+			ClientStream::Tls(stream) => Pin::new(stream).poll_write(cx, buf),
+		}
+	}
+
+	fn poll_flush(self: Pin<&mut Self>, cx: &mut Context<'_>) -> Poll<io::Result<()>> {
+		match self.get_mut() {
+			ClientStream::Plain(socket) => Pin::new(socket).poll_flush(cx),
+			ClientStream::Tls(stream) => Pin::new(stream).poll_flush(cx),
+		}
+	}
+
+	fn poll_shutdown(self: Pin<&mut Self>, cx: &mut Context<'_>) -> Poll<io::Result<()>> {
+		match self.get_mut() {
+			ClientStream::Plain(socket) => Pin::new(socket).poll_shutdown(cx),
+			ClientStream::Tls(stream) => Pin::new(stream).poll_shutdown(cx),
+		}
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use rstest::rstest;
+
+	use super::TlsAuthClients;
+
+	#[rstest]
+	#[case("yes", TlsAuthClients::Yes)]
+	#[case("NO", TlsAuthClients::No)]
+	#[case("optional", TlsAuthClients::Optional)]
+	fn test_parse_tls_auth_clients(#[case] value: &str, #[case] expected: TlsAuthClients) {
+		assert_eq!(value.parse::<TlsAuthClients>().unwrap(), expected);
+		assert_eq!(
+			expected.to_string().parse::<TlsAuthClients>().unwrap(),
+			expected
+		);
+	}
+
+	#[test]
+	fn test_parse_tls_auth_clients_rejects_unknown_values() {
+		assert!("maybe".parse::<TlsAuthClients>().is_err());
+	}
+}
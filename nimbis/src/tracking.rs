@@ -0,0 +1,521 @@
+//! Server-assisted client-side caching (CLIENT TRACKING).
+//!
+//! In the default mode [`Tracking`] remembers which keys each tracking
+//! client has read, and when one of them is written it sends that client an
+//! invalidation and forgets the key until the client reads it again. In
+//! broadcast mode nothing is remembered: every write to a key matching one
+//! of the client's prefixes is announced.
+//!
+//! Invalidations are queued on the target connection's [`Inbox`], as a RESP3
+//! `invalidate` push, or as a `__redis__:invalidate` pub/sub message when
+//! the client redirects them to another connection. Like pub/sub messages
+//! they count against the target connection's output buffer limits.
+
+use std::collections::HashMap;
+use std::collections::HashSet;
+use std::sync::Arc;
+
+use bytes::Bytes;
+use dashmap::DashMap;
+use nimbis_resp::RespValue;
+use tokio::sync::mpsc;
+
+use crate::GCTX;
+use crate::output_buffer::Outbox;
+use crate::output_buffer::OutputBuffer;
+use crate::pubsub;
+
+/// Channel that redirected invalidations are published on.
+pub const INVALIDATE_CHANNEL: &str = "__redis__:invalidate";
+
+/// Core read commands whose every argument is a key.
+const MULTI_KEY_READ_CMDS: &[&str] = &["EXISTS", "PFCOUNT"];
+
+/// Core read commands whose first argument is the only key.
+const READ_CMDS: &[&str] = &[
+	"GET",
+	"TTL",
+	"HGET",
+	"HLEN",
+	"HMGET",
+	"HGETALL",
+	"LLEN",
+	"LRANGE",
+	"SMEMBERS",
+	"SISMEMBER",
+	"SCARD",
+	"ZRANGE",
+	"ZSCORE",
+	"ZCARD",
+	"XLEN",
+	"XRANGE",
+	"XREVRANGE",
+	"GETBIT",
+	"BITCOUNT",
+	"BITPOS",
+	"BITFIELD_RO",
+	"GEOPOS",
+	"GEODIST",
+	"GEOHASH",
+	"GEOSEARCH",
+];
+
+/// Core write commands whose every argument is a key.
+const MULTI_KEY_WRITE_CMDS: &[&str] = &["DEL"];
+
+/// Core write commands whose second argument is the only key written.
+const DEST_KEY_WRITE_CMDS: &[&str] = &["BITOP"];
+
+/// Core write commands that only change stream consumer groups, which no
+/// tracked read returns.
+const GROUP_WRITE_CMDS: &[&str] = &["XGROUP", "XREADGROUP", "XACK", "XCLAIM", "XAUTOCLAIM"];
+
+/// Options given to `CLIENT TRACKING ON`.
+#[derive(Debug, Clone, Default, PartialEq)]
+pub struct TrackingOptions {
+	/// Client that receives the invalidations instead of this one.
+	pub redirect: Option<i64>,
+	pub bcast: bool,
+	/// Key prefixes announced in broadcast mode; empty means every key.
+	pub prefixes: Vec<Bytes>,
+	/// Only track reads right after `CLIENT CACHING YES`.
+	pub optin: bool,
+	/// Track reads unless right after `CLIENT CACHING NO`.
+	pub optout: bool,
+	/// Do not invalidate keys the client modified itself.
+	pub noloop: bool,
+}
+
+impl TrackingOptions {
+	fn matches_prefix(&self, key: &[u8]) -> bool {
+		self.prefixes.is_empty() || self.prefixes.iter().any(|prefix| key.starts_with(prefix))
+	}
+}
+
+/// Keys a client may have cached that are no longer valid.
+#[derive(Debug, Clone, PartialEq)]
+pub struct Invalidation {
+	/// `None` when the whole dataset was flushed.
+	pub keys: Option<Vec<Bytes>>,
+	/// Whether the client asked for these to be sent to another connection.
+	pub redirected: bool,
+}
+
+impl Invalidation {
+	/// The reply to write, or `None` if the connection cannot receive it:
+	/// a RESP2 connection only gets redirected invalidations, and only while
+	/// it is subscribed to [`INVALIDATE_CHANNEL`].
+	pub fn to_resp(&self, resp3: bool, subscribed: bool) -> Option<RespValue> {
+		let keys = match &self.keys {
+			Some(keys) => RespValue::array(keys.iter().cloned().map(RespValue::bulk_string)),
+			None => RespValue::Null,
+		};
+		if !self.redirected {
+			return resp3
+				.then(|| RespValue::Push(vec![RespValue::bulk_string("invalidate"), keys]));
+		}
+		subscribed.then(|| {
+			pubsub::frame(
+				resp3,
+				vec![
+					RespValue::bulk_string("message"),
+					RespValue::bulk_string(INVALIDATE_CHANNEL),
+					keys,
+				],
+			)
+		})
+	}
+
+	/// Bytes the invalidation is accounted as in the output buffer.
+	pub fn size(&self) -> usize {
+		self.keys
+			.as_ref()
+			.map_or(0, |keys| keys.iter().map(Bytes::len).sum())
+	}
+}
+
+#[derive(Debug)]
+struct TrackedClient {
+	options: TrackingOptions,
+	/// Set by `CLIENT CACHING` for the next command only.
+	caching: Option<bool>,
+}
+
+/// Server-wide tracking state.
+#[derive(Debug, Default)]
+pub struct Tracking {
+	inboxes: DashMap<i64, Outbox<Invalidation>>,
+	clients: DashMap<i64, TrackedClient>,
+	/// Keys read by default-mode clients, and who read them.
+	keys: DashMap<Bytes, HashSet<i64>>,
+}
+
+impl Tracking {
+	pub fn new() -> Self {
+		Self::default()
+	}
+
+	/// Turn tracking on for `client_id`. Turning it on again keeps the mode
+	/// and adds the new prefixes.
+	pub fn enable(&self, client_id: i64, mut options: TrackingOptions) -> Result<(), &'static str> {
+		if let Some(redirect) = options.redirect
+			&& !self.inboxes.contains_key(&redirect)
+		{
+			return Err("ERR The client ID you want redirect to does not exist");
+		}
+
+		if let Some(mut client) = self.clients.get_mut(&client_id) {
+			if client.options.bcast != options.bcast {
+				return Err(
+					"ERR You can't switch BCAST mode on/off before disabling tracking for this client, and then re-enabling it with a different mode.",
+				);
+			}
+			let mut prefixes = std::mem::take(&mut client.options.prefixes);
+			for prefix in options.prefixes.drain(..) {
+				if !prefixes.contains(&prefix) {
+					prefixes.push(prefix);
+				}
+			}
+			options.prefixes = prefixes;
+			client.options = options;
+			return Ok(());
+		}
+
+		self.clients.insert(
+			client_id,
+			TrackedClient {
+				options,
+				caching: None,
+			},
+		);
+		Ok(())
+	}
+
+	pub fn disable(&self, client_id: i64) {
+		self.clients.remove(&client_id);
+	}
+
+	/// The options of `client_id`, or `None` if it is not tracking.
+	pub fn options(&self, client_id: i64) -> Option<TrackingOptions> {
+		self.clients
+			.get(&client_id)
+			.map(|client| client.options.clone())
+	}
+
+	/// Handle `CLIENT CACHING YES|NO` for the next command of `client_id`.
+	pub fn set_caching(&self, client_id: i64, caching: bool) -> Result<(), &'static str> {
+		let Some(mut client) = self.clients.get_mut(&client_id) else {
+			return Err(
+				"ERR CLIENT CACHING can be called only when the client is in tracking mode with OPTIN or OPTOUT mode enabled",
+			);
+		};
+		match (caching, client.options.optin, client.options.optout) {
+			(true, true, _) | (false, _, true) => {
+				client.caching = Some(caching);
+				Ok(())
+			}
+			(_, false, false) => Err(
+				"ERR CLIENT CACHING can be called only when the client is in tracking mode with OPTIN or OPTOUT mode enabled",
+			),
+			(true, _, _) => {
+				Err("ERR CLIENT CACHING YES is only valid when tracking is enabled in OPTIN mode.")
+			}
+			(false, _, _) => {
+				Err("ERR CLIENT CACHING NO is only valid when tracking is enabled in OPTOUT mode.")
+			}
+		}
+	}
+
+	/// Forget a `CLIENT CACHING` choice once the command it applied to,
+	/// the one following it, ran.
+	pub fn end_command(&self, client_id: i64, name: &str, args: &[Bytes]) {
+		if name == "CLIENT"
+			&& args
+				.first()
+				.is_some_and(|sub| sub.eq_ignore_ascii_case(b"CACHING"))
+		{
+			return;
+		}
+		if let Some(mut client) = self.clients.get_mut(&client_id) {
+			client.caching = None;
+		}
+	}
+
+	/// Remember that `client_id` read `keys`, if it tracks them.
+	pub fn track_reads(&self, client_id: i64, keys: &[Bytes]) {
+		let tracked = self.clients.get(&client_id).is_some_and(|client| {
+			let options = &client.options;
+			!options.bcast
+				&& (!options.optin || client.caching == Some(true))
+				&& (!options.optout || client.caching != Some(false))
+		});
+		if !tracked {
+			return;
+		}
+
+		for key in keys {
+			self.keys.entry(key.clone()).or_default().insert(client_id);
+		}
+	}
+
+	/// Announce that `origin` modified `keys`.
+	pub fn invalidate(&self, origin: i64, keys: &[Bytes]) {
+		let mut pending: HashMap<i64, Vec<Bytes>> = HashMap::new();
+		for key in keys {
+			let readers = self
+				.keys
+				.remove(key)
+				.map(|(_, readers)| readers)
+				.unwrap_or_default();
+			for client_id in readers {
+				pending.entry(client_id).or_default().push(key.clone());
+			}
+		}
+		for client in self.clients.iter() {
+			if client.options.bcast {
+				let keys = keys
+					.iter()
+					.filter(|key| client.options.matches_prefix(key))
+					.cloned()
+					.collect::<Vec<_>>();
+				if !keys.is_empty() {
+					pending.insert(*client.key(), keys);
+				}
+			}
+		}
+
+		for (client_id, keys) in pending {
+			self.send(client_id, origin, Some(keys));
+		}
+	}
+
+	/// Announce that the whole dataset was flushed.
+	pub fn invalidate_all(&self) {
+		self.keys.clear();
+		let client_ids = self
+			.clients
+			.iter()
+			.map(|client| *client.key())
+			.collect::<Vec<_>>();
+		for client_id in client_ids {
+			self.send(client_id, 0, None);
+		}
+	}
+
+	fn send(&self, client_id: i64, origin: i64, keys: Option<Vec<Bytes>>) {
+		let Some(options) = self.options(client_id) else {
+			return;
+		};
+		if options.noloop && client_id == origin {
+			return;
+		}
+
+		let target = options.redirect.unwrap_or(client_id);
+		if let Some(inbox) = self.inboxes.get(&target) {
+			let invalidation = Invalidation {
+				keys,
+				redirected: options.redirect.is_some(),
+			};
+			let size = invalidation.size();
+			inbox.send(invalidation, size);
+		}
+	}
+}
+
+/// Update tracking after `client_id` ran `name` with `args` successfully:
+/// record the keys it read, or invalidate the keys it wrote.
+pub fn after_command(client_id: i64, name: &str, args: &[Bytes]) {
+	let tracking = GCTX!(tracking);
+	if name == "FLUSHDB" {
+		tracking.invalidate_all();
+	} else if GCTX!(cmd_table).is_write(name) && !GROUP_WRITE_CMDS.contains(&name) {
+		let keys = if MULTI_KEY_WRITE_CMDS.contains(&name) {
+			args
+		} else if DEST_KEY_WRITE_CMDS.contains(&name) {
+			args.get(1..2).unwrap_or_default()
+		} else {
+			&args[..args.len().min(1)]
+		};
+		tracking.invalidate(client_id, keys);
+	} else if MULTI_KEY_READ_CMDS.contains(&name) {
+		tracking.track_reads(client_id, args);
+	} else if READ_CMDS.contains(&name) {
+		tracking.track_reads(client_id, &args[..args.len().min(1)]);
+	}
+}
+
+/// The queue a connection receives its invalidations on. Dropping it turns
+/// tracking off for the connection.
+#[derive(Debug)]
+pub struct Inbox {
+	client_id: i64,
+	tracking: Arc<Tracking>,
+	// Kept so `recv` never sees a closed queue.
+	_sender: mpsc::UnboundedSender<Invalidation>,
+	receiver: mpsc::UnboundedReceiver<Invalidation>,
+}
+
+impl Inbox {
+	pub fn new(client_id: i64, tracking: Arc<Tracking>, buffer: Arc<OutputBuffer>) -> Self {
+		let (sender, receiver) = mpsc::unbounded_channel();
+		tracking
+			.inboxes
+			.insert(client_id, Outbox::new(sender.clone(), buffer));
+		Self {
+			client_id,
+			tracking,
+			_sender: sender,
+			receiver,
+		}
+	}
+
+	/// Wait for the next invalidation addressed to this connection. The
+	/// caller releases its size from the output buffer once written.
+	pub async fn recv(&mut self) -> Invalidation {
+		self.receiver
+			.recv()
+			.await
+			.expect("inbox holds its own sender")
+	}
+}
+
+impl Drop for Inbox {
+	fn drop(&mut self) {
+		self.tracking.inboxes.remove(&self.client_id);
+		self.tracking.disable(self.client_id);
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use super::*;
+	use crate::config::SERVER_CONF;
+	use crate::config::ServerConfig;
+
+	fn inbox(client_id: i64, tracking: &Arc<Tracking>) -> Inbox {
+		SERVER_CONF.init(ServerConfig::default());
+		Inbox::new(client_id, tracking.clone(), Arc::new(OutputBuffer::new()))
+	}
+
+	fn keys(keys: &[&'static str]) -> Option<Vec<Bytes>> {
+		Some(keys.iter().map(|key| Bytes::from(*key)).collect())
+	}
+
+	#[tokio::test]
+	async fn test_default_mode_invalidates_read_keys_once() {
+		let tracking = Arc::new(Tracking::new());
+		let mut inbox = inbox(1, &tracking);
+		tracking.enable(1, TrackingOptions::default()).unwrap();
+
+		tracking.track_reads(1, &[Bytes::from("a"), Bytes::from("b")]);
+		tracking.invalidate(2, &[Bytes::from("a"), Bytes::from("c")]);
+		assert_eq!(inbox.recv().await.keys, keys(&["a"]));
+
+		// The key is forgotten until it is read again.
+		tracking.invalidate(2, &[Bytes::from("a")]);
+		tracking.invalidate(2, &[Bytes::from("b")]);
+		assert_eq!(inbox.recv().await.keys, keys(&["b"]));
+	}
+
+	#[tokio::test]
+	async fn test_bcast_mode_matches_prefixes() {
+		let tracking = Arc::new(Tracking::new());
+		let mut inbox = inbox(1, &tracking);
+		let options = TrackingOptions {
+			bcast: true,
+			prefixes: vec![Bytes::from("user:")],
+			..Default::default()
+		};
+		tracking.enable(1, options).unwrap();
+
+		tracking.invalidate(2, &[Bytes::from("order:1")]);
+		tracking.invalidate(2, &[Bytes::from("user:1"), Bytes::from("user:2")]);
+		assert_eq!(inbox.recv().await.keys, keys(&["user:1", "user:2"]));
+	}
+
+	#[tokio::test]
+	async fn test_noloop_and_redirect() {
+		let tracking = Arc::new(Tracking::new());
+		let mut own = inbox(1, &tracking);
+		let mut target = inbox(2, &tracking);
+		let options = TrackingOptions {
+			redirect: Some(2),
+			bcast: true,
+			noloop: true,
+			..Default::default()
+		};
+		tracking.enable(1, options).unwrap();
+
+		tracking.invalidate(1, &[Bytes::from("mine")]);
+		tracking.invalidate(3, &[Bytes::from("theirs")]);
+		let invalidation = target.recv().await;
+		assert_eq!(invalidation.keys, keys(&["theirs"]));
+		assert!(invalidation.redirected);
+		assert!(own.receiver.try_recv().is_err());
+
+		let options = TrackingOptions {
+			redirect: Some(9),
+			..Default::default()
+		};
+		assert!(tracking.enable(3, options).is_err());
+	}
+
+	#[test]
+	fn test_optin_needs_caching_yes() {
+		let tracking = Arc::new(Tracking::new());
+		let _inbox = inbox(1, &tracking);
+		let options = TrackingOptions {
+			optin: true,
+			..Default::default()
+		};
+		tracking.enable(1, options).unwrap();
+
+		tracking.track_reads(1, &[Bytes::from("skipped")]);
+		tracking.set_caching(1, true).unwrap();
+		tracking.end_command(1, "CLIENT", &[Bytes::from("caching"), Bytes::from("yes")]);
+		tracking.track_reads(1, &[Bytes::from("cached")]);
+		tracking.end_command(1, "GET", &[Bytes::from("cached")]);
+		assert!(!tracking.keys.contains_key(&Bytes::from("skipped")));
+		assert!(tracking.keys.contains_key(&Bytes::from("cached")));
+
+		assert!(tracking.set_caching(1, false).is_err());
+		assert!(tracking.set_caching(2, true).is_err());
+	}
+
+	#[test]
+	fn test_switching_bcast_requires_disable() {
+		let tracking = Tracking::new();
+		tracking.enable(1, TrackingOptions::default()).unwrap();
+		let bcast = TrackingOptions {
+			bcast: true,
+			..Default::default()
+		};
+		assert!(tracking.enable(1, bcast.clone()).is_err());
+		tracking.disable(1);
+		assert!(tracking.enable(1, bcast).is_ok());
+	}
+
+	#[test]
+	fn test_invalidation_framing() {
+		let own = Invalidation {
+			keys: keys(&["k"]),
+			redirected: false,
+		};
+		assert!(matches!(own.to_resp(true, false), Some(RespValue::Push(_))));
+		assert_eq!(own.to_resp(false, true), None);
+
+		let redirected = Invalidation {
+			keys: None,
+			redirected: true,
+		};
+		assert_eq!(redirected.to_resp(false, false), None);
+		assert_eq!(
+			redirected.to_resp(false, true),
+			Some(RespValue::array(vec![
+				RespValue::bulk_string("message"),
+				RespValue::bulk_string(INVALIDATE_CHANNEL),
+				RespValue::Null,
+			]))
+		);
+	}
+}
@@ -0,0 +1,110 @@
+use crate::cmd::ParsedCmd;
+
+/// Commands that drive a transaction instead of being queued by it.
+const CONTROL_CMDS: &[&str] = &["MULTI", "EXEC", "DISCARD"];
+
+/// Returns true if `name` must run immediately even inside MULTI.
+/// RESET is included because it discards the open transaction.
+pub fn runs_immediately(name: &str) -> bool {
+	CONTROL_CMDS.contains(&name) || name == "RESET"
+}
+
+/// Commands that issue several writes of their own. Outside MULTI they run
+/// like a one-command transaction: under the exclusive exec lock and as one
+/// atomic storage group.
+const ATOMIC_CMDS: &[&str] = &[
+	"EVAL",
+	"EVALSHA",
+	"EVAL_RO",
+	"EVALSHA_RO",
+	"FCALL",
+	"FCALL_RO",
+];
+
+/// Returns true if `name` must run as its own atomic group.
+pub fn runs_atomically(name: &str) -> bool {
+	ATOMIC_CMDS.contains(&name)
+}
+
+/// Per-connection MULTI state: the queued commands and whether a queue-time
+/// error has already doomed the transaction.
+#[derive(Default)]
+pub struct Transaction {
+	queued: Vec<ParsedCmd>,
+	aborted: bool,
+}
+
+impl Transaction {
+	pub fn new() -> Self {
+		Self::default()
+	}
+
+	pub fn queue(&mut self, cmd: ParsedCmd) {
+		self.queued.push(cmd);
+	}
+
+	/// Mark the transaction so that EXEC fails with EXECABORT, like Redis does
+	/// after an unknown command or an arity error while queueing.
+	pub fn abort(&mut self) {
+		self.aborted = true;
+	}
+
+	pub fn is_aborted(&self) -> bool {
+		self.aborted
+	}
+
+	pub fn queued(&self) -> &[ParsedCmd] {
+		&self.queued
+	}
+
+	pub fn into_queued(self) -> Vec<ParsedCmd> {
+		self.queued
+	}
+}
+
+#[cfg(test)]
+mod tests {
+	use bytes::Bytes;
+	use rstest::rstest;
+
+	use super::*;
+
+	#[rstest]
+	#[case("MULTI", true)]
+	#[case("EXEC", true)]
+	#[case("DISCARD", true)]
+	#[case("RESET", true)]
+	#[case("SET", false)]
+	fn test_runs_immediately(#[case] name: &str, #[case] expected: bool) {
+		assert_eq!(runs_immediately(name), expected);
+	}
+
+	#[rstest]
+	#[case("EVAL", true)]
+	#[case("EVALSHA", true)]
+	#[case("FCALL", true)]
+	#[case("EVAL_RO", true)]
+	#[case("FCALL_RO", true)]
+	#[case("EXEC", false)]
+	#[case("SET", false)]
+	fn test_runs_atomically(#[case] name: &str, #[case] expected: bool) {
+		assert_eq!(runs_atomically(name), expected);
+	}
+
+	#[test]
+	fn test_transaction_queue_and_abort() {
+		let mut transaction = Transaction::new();
+		transaction.queue(ParsedCmd {
+			name: "SET".to_string(),
+			args: vec![Bytes::from("key"), Bytes::from("value")],
+		});
+		assert!(!transaction.is_aborted());
+
+		transaction.abort();
+		assert!(transaction.is_aborted());
+
+		let queued = transaction.into_queued();
+		assert_eq!(queued.len(), 1);
+		assert_eq!(queued[0].name, "SET");
+	}
+}
@@ -34,8 +34,6 @@ impl MockNimbisServer {
 			port,
 			object_store_url: object_store_url.clone(),
 			object_store_options: Default::default(),
-			save: "".to_string(),
-			appendonly: "no".to_string(),
 			log_level: "error".to_string(),
 			log_output: "terminal".to_string(),
 			log_rotation: "daily".to_string(),
@@ -46,6 +44,7 @@ impl MockNimbisServer {
 			trace_export_timeout_seconds: 10,
 			trace_report_interval_ms: 1000,
 			runtime_threads: 2,
+			..ServerConfig::default()
 		};
 
 		SERVER_CONF.init(config.clone());
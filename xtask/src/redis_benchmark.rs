@@ -13,7 +13,7 @@ use clap::ValueEnum;
 
 use crate::write_stdout_line;
 
-const BUILTIN_SUPPORTED: &str = "ping,set,get,incr,lpush,rpush,lpop,rpop,sadd,hset,zadd";
+const BUILTIN_SUPPORTED: &str = "ping,set,get,incr,lpush,rpush,lpop,rpop,sadd,hset,zadd,xadd";
 
 #[derive(ClapArgs, Debug, Default)]
 pub struct Args {
@@ -289,6 +289,14 @@ fn seed_fixed_data<R: Runner>(config: &Config, runner: &R) -> Result<(), String>
 			"four",
 		],
 	)?;
+	redis_cli(config, runner, &["DEL", "bench:stream"])?;
+	for id in ["1-1", "1-2", "2-1", "3-1"] {
+		redis_cli(
+			config,
+			runner,
+			&["XADD", "bench:stream", id, "field", "value"],
+		)?;
+	}
 	Ok(())
 }
 
@@ -416,6 +424,16 @@ fn run_custom_suite<R: Runner>(config: &Config, runner: &R) -> Result<(), String
 		("zscore", &["ZSCORE", "bench:zset", "one"]),
 		("zrem", &["ZREM", "bench:zset:zrem", "member:__rand_int__"]),
 		("zcard", &["ZCARD", "bench:zset"]),
+		("xlen", &["XLEN", "bench:stream"]),
+		("xrange", &["XRANGE", "bench:stream", "-", "+"]),
+		(
+			"xrevrange",
+			&["XREVRANGE", "bench:stream", "+", "-", "COUNT", "2"],
+		),
+		(
+			"xread",
+			&["XREAD", "COUNT", "2", "STREAMS", "bench:stream", "0"],
+		),
 		(
 			"expire",
 			&["EXPIRE", "bench:string:expire:__rand_int__", "300"],
@@ -709,6 +727,11 @@ mod tests {
 		"SMEMBERS",
 		"SREM",
 		"TTL",
+		"XADD",
+		"XLEN",
+		"XRANGE",
+		"XREAD",
+		"XREVRANGE",
 		"ZADD",
 		"ZCARD",
 		"ZRANGE",
@@ -925,7 +948,7 @@ mod tests {
 		assert!(labels.contains(&"lrange".to_string()));
 		assert!(labels.contains(&"hello_2".to_string()));
 		assert!(labels.contains(&"client_id".to_string()));
-		assert_eq!(labels.len(), 25);
+		assert_eq!(labels.len(), 29);
 		assert_eq!(
 			runner.streamed_commands(),
 			benchmarked_command_set(BENCHMARKED_FULL_PROFILE_COMMANDS)